@@ -142,6 +142,7 @@ func loadProviderConf(c Configuration) (Configuration, error) {
 // Initialize validates and set the configuration
 func Initialize(c Configuration, configDir string, checkRenew bool) error {
 	config = nil
+	common.SetOnDemandCertificateFn(nil)
 	initialConfig = c
 	c, err := loadProviderConf(c)
 	if err != nil {
@@ -153,13 +154,17 @@ func Initialize(c Configuration, configDir string, checkRenew bool) error {
 	if err := c.Initialize(configDir); err != nil {
 		return err
 	}
-	if len(c.Domains) == 0 {
+	if len(c.Domains) == 0 && !c.OnDemand.isEnabled() {
 		return nil
 	}
 	util.CertsBasePath = c.CertsPath
-	acmeLog(logger.LevelInfo, "configured domains: %+v, certs base path %q", c.Domains, c.CertsPath)
+	acmeLog(logger.LevelInfo, "configured domains: %+v, on demand allowed hosts: %+v, certs base path %q",
+		c.Domains, c.OnDemand.AllowedHosts, c.CertsPath)
 	config = &c
 	if checkRenew {
+		if c.OnDemand.isEnabled() {
+			common.SetOnDemandCertificateFn(getOnDemandCertificate)
+		}
 		return startScheduler()
 	}
 	return nil
@@ -227,6 +232,7 @@ type Configuration struct {
 	RenewDays          int                `json:"renew_days" mapstructure:"renew_days"`
 	HTTP01Challenge    HTTP01Challenge    `json:"http01_challenge" mapstructure:"http01_challenge"`
 	TLSALPN01Challenge TLSALPN01Challenge `json:"tls_alpn01_challenge" mapstructure:"tls_alpn01_challenge"`
+	OnDemand           OnDemand           `json:"on_demand" mapstructure:"on_demand"`
 	accountConfigPath  string
 	accountKeyPath     string
 	lockPath           string
@@ -236,7 +242,8 @@ type Configuration struct {
 // Initialize validates and initialize the configuration
 func (c *Configuration) Initialize(configDir string) error {
 	c.checkDomains()
-	if len(c.Domains) == 0 {
+	c.OnDemand.checkAllowedHosts()
+	if len(c.Domains) == 0 && !c.OnDemand.isEnabled() {
 		acmeLog(logger.LevelInfo, "no domains configured, acme disabled")
 		return nil
 	}
@@ -723,6 +730,9 @@ func (c *Configuration) renewCertificates() error {
 			needReload = true
 		}
 	}
+	if err := c.renewOnDemandCertificates(); err != nil {
+		errRenew = err
+	}
 	if needReload {
 		// at least one certificate has been renewed, sends a reload to all services that may be using certificates
 		err = ftpd.ReloadCertificateMgr()
@@ -0,0 +1,260 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package acme
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	// delay before trying again to obtain a certificate for a server name
+	// after a failure
+	onDemandRetryDelay = 10 * time.Minute
+)
+
+var (
+	errOnDemandNotAllowed = errors.New("on demand certificates are not allowed for the requested server name")
+	onDemandCerts         = newOnDemandManager()
+)
+
+// OnDemand defines the configuration to obtain certificates on demand, the
+// first time a TLS client requests an allowed server name using SNI. On demand
+// certificates must be enabled for each binding
+type OnDemand struct {
+	// Server names allowed for on demand certificates. A name starting with
+	// "*." matches any subdomain, for example "*.example.com" matches
+	// "a.example.com" and "b.a.example.com" but not "example.com"
+	AllowedHosts []string `json:"allowed_hosts" mapstructure:"allowed_hosts"`
+}
+
+func (o *OnDemand) isEnabled() bool {
+	return len(o.AllowedHosts) > 0
+}
+
+func (o *OnDemand) checkAllowedHosts() {
+	var hosts []string
+	for _, host := range o.AllowedHosts {
+		host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+		if host == "" || host == "*." {
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	o.AllowedHosts = util.RemoveDuplicates(hosts, false)
+}
+
+func (o *OnDemand) isAllowed(serverName string) bool {
+	for _, host := range o.AllowedHosts {
+		if suffix, ok := strings.CutPrefix(host, "*"); ok {
+			if strings.HasSuffix(serverName, suffix) && len(serverName) > len(suffix) {
+				return true
+			}
+			continue
+		}
+		if serverName == host {
+			return true
+		}
+	}
+	return false
+}
+
+type onDemandRequest struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+type onDemandManager struct {
+	sync.Mutex
+	certs    map[string]*tls.Certificate
+	pending  map[string]*onDemandRequest
+	failures map[string]time.Time
+}
+
+func newOnDemandManager() *onDemandManager {
+	return &onDemandManager{
+		certs:    make(map[string]*tls.Certificate),
+		pending:  make(map[string]*onDemandRequest),
+		failures: make(map[string]time.Time),
+	}
+}
+
+func (m *onDemandManager) get(serverName string) (*tls.Certificate, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	cert, ok := m.certs[serverName]
+	return cert, ok
+}
+
+func (m *onDemandManager) set(serverName string, cert *tls.Certificate) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.certs[serverName] = cert
+	delete(m.failures, serverName)
+}
+
+func (m *onDemandManager) getServerNames() []string {
+	m.Lock()
+	defer m.Unlock()
+
+	serverNames := make([]string, 0, len(m.certs))
+	for serverName := range m.certs {
+		serverNames = append(serverNames, serverName)
+	}
+	return serverNames
+}
+
+// getCertificate returns the cached certificate for the specified server name
+// or obtains a new one. Concurrent requests for the same server name wait for
+// the same result
+func (m *onDemandManager) getCertificate(c *Configuration, serverName string) (*tls.Certificate, error) {
+	m.Lock()
+	if cert, ok := m.certs[serverName]; ok {
+		m.Unlock()
+		return cert, nil
+	}
+	if req, ok := m.pending[serverName]; ok {
+		m.Unlock()
+		<-req.done
+		return req.cert, req.err
+	}
+	if lastFailure, ok := m.failures[serverName]; ok && time.Since(lastFailure) < onDemandRetryDelay {
+		m.Unlock()
+		return nil, fmt.Errorf("unable to obtain a certificate for %q, retry after %s", serverName,
+			lastFailure.Add(onDemandRetryDelay).Format(time.RFC3339))
+	}
+	req := &onDemandRequest{
+		done: make(chan struct{}),
+	}
+	m.pending[serverName] = req
+	m.Unlock()
+
+	req.cert, req.err = c.loadOrObtainOnDemandCertificate(serverName)
+
+	m.Lock()
+	delete(m.pending, serverName)
+	if req.err != nil {
+		m.failures[serverName] = time.Now()
+	} else {
+		m.certs[serverName] = req.cert
+	}
+	m.Unlock()
+	close(req.done)
+
+	return req.cert, req.err
+}
+
+// getOnDemandCertificate returns the certificate for the specified server
+// name, the certificate is obtained the first time an allowed server name is
+// requested
+func getOnDemandCertificate(serverName string) (*tls.Certificate, error) {
+	c := config
+	if c == nil || !c.OnDemand.isEnabled() {
+		return nil, errors.New("on demand certificates are disabled")
+	}
+	serverName = strings.TrimSuffix(strings.ToLower(serverName), ".")
+	if serverName == "" || net.ParseIP(serverName) != nil || !c.OnDemand.isAllowed(serverName) {
+		return nil, errOnDemandNotAllowed
+	}
+	return onDemandCerts.getCertificate(c, serverName)
+}
+
+func (c *Configuration) loadOnDemandCertificate(serverName string) (*tls.Certificate, error) {
+	domain := util.SanitizeDomain(serverName)
+	cert, err := tls.LoadX509KeyPair(c.getCrtPath(domain), c.getKeyPath(domain))
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
+
+func (c *Configuration) loadOrObtainOnDemandCertificate(serverName string) (*tls.Certificate, error) {
+	hasCerts, err := c.hasCertificates(serverName)
+	if err != nil {
+		return nil, err
+	}
+	if hasCerts {
+		cert, err := c.loadOnDemandCertificate(serverName)
+		if err == nil && time.Until(cert.Leaf.NotAfter) > 0 {
+			acmeLog(logger.LevelDebug, "on demand certificate for %q loaded from disk", serverName)
+			return cert, nil
+		}
+		acmeLog(logger.LevelInfo, "unable to use the existing certificate for %q, obtaining a new one, error: %v",
+			serverName, err)
+	}
+	return c.obtainOnDemandCertificate(serverName)
+}
+
+func (c *Configuration) obtainOnDemandCertificate(serverName string) (*tls.Certificate, error) {
+	acmeLog(logger.LevelInfo, "obtaining on demand certificate for %q", serverName)
+	account, client, err := c.setup()
+	if err != nil {
+		return nil, err
+	}
+	if account.Registration == nil {
+		reg, err := c.register(client)
+		if err != nil {
+			acmeLog(logger.LevelError, "unable to register account: %v", err)
+			return nil, fmt.Errorf("unable to register account: %w", err)
+		}
+		account.Registration = reg
+		if err := c.saveAccount(account); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.obtainAndSaveCertificate(client, serverName); err != nil {
+		c.notifyCertificateRenewal(serverName, err)
+		return nil, err
+	}
+	c.notifyCertificateRenewal(serverName, nil)
+	return c.loadOnDemandCertificate(serverName)
+}
+
+// renewOnDemandCertificates renews the on demand certificates loaded or
+// obtained since the service started
+func (c *Configuration) renewOnDemandCertificates() error {
+	var errRenew error
+	for _, serverName := range onDemandCerts.getServerNames() {
+		cert, ok := onDemandCerts.get(serverName)
+		if !ok || !c.needRenewal(cert.Leaf, serverName) {
+			continue
+		}
+		newCert, err := c.obtainOnDemandCertificate(serverName)
+		if err != nil {
+			errRenew = err
+			continue
+		}
+		onDemandCerts.set(serverName, newCert)
+	}
+	return errRenew
+}
@@ -0,0 +1,210 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/drakkan/sftpgo/v2/pkg/config"
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/plugin"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+var (
+	importUsersFormat         string
+	importUsersFile           string
+	importUsersMapping        string
+	importUsersTemplate       string
+	importUsersDryRun         bool
+	importUsersUpdateExisting bool
+	importUsersErrors         string
+	importUsersCmd            = &cobra.Command{
+		Use:   "importusers",
+		Short: "Import users from CSV and other servers",
+		Long: `This command reads the data provider connection details from the specified
+configuration file and imports the users from a CSV file or from the users
+file of another server.
+
+Supported formats:
+
+- "csv", CSV file with a header row. The columns are mapped to the user
+  fields using the "--mapping" JSON file, for example {"username": "login"}.
+  Unmapped fields are read from the column with the same name, if any
+- "passwd", passwd style files, for example ProFTPD AuthUserFile or vsftpd
+  virtual users password files
+- "pureftpd", Pure-FTPd virtual users file, as managed by pure-pw
+
+The "--template" JSON file defines the settings for the imported users, for
+example the permissions, the groups and the filesystem, using the same format
+as the REST API.
+
+Use the "--dry-run" flag to validate the users without saving them:
+
+$ sftpgo importusers --format pureftpd --file /etc/pureftpd.passwd --dry-run
+
+Use the "--errors" flag to save the rows that cannot be imported to a CSV file.
+This command is not supported for the memory provider.
+For embedded providers like bolt and SQLite you should stop the running SFTPGo
+instance to avoid database corruption.
+
+Please take a look at the usage below to customize the options.`,
+		Run: func(_ *cobra.Command, _ []string) {
+			logger.DisableLogger()
+			logger.EnableConsoleLogger(zerolog.DebugLevel)
+			configDir = util.CleanDirInput(configDir)
+			req, err := getUserImportRequest()
+			if err != nil {
+				logger.ErrorToConsole("%v", err)
+				os.Exit(1)
+			}
+			err = config.LoadConfig(configDir, configFile)
+			if err != nil {
+				logger.WarnToConsole("Unable to load configuration: %v", err)
+				os.Exit(1)
+			}
+			kmsConfig := config.GetKMSConfig()
+			err = kmsConfig.Initialize()
+			if err != nil {
+				logger.ErrorToConsole("unable to initialize KMS: %v", err)
+				os.Exit(1)
+			}
+			providerConf := config.GetProviderConf()
+			if providerConf.Driver == dataprovider.MemoryDataProviderName {
+				logger.ErrorToConsole("memory provider is not supported")
+				os.Exit(1)
+			}
+			// ignore actions
+			providerConf.Actions.Hook = ""
+			providerConf.Actions.ExecuteFor = nil
+			providerConf.Actions.ExecuteOn = nil
+			logger.InfoToConsole("Initializing provider: %q config file: %q", providerConf.Driver, viper.ConfigFileUsed())
+			err = dataprovider.Initialize(providerConf, configDir, false)
+			if err != nil {
+				logger.ErrorToConsole("Unable to initialize data provider: %v", err)
+				os.Exit(1)
+			}
+			if err := plugin.Initialize(config.GetPluginsConfig(), defaultLogLevel); err != nil {
+				logger.ErrorToConsole("Unable to initialize plugin system: %v", err)
+				os.Exit(1)
+			}
+			defer plugin.Handler.Cleanup()
+
+			report, err := dataprovider.ImportUsers(&req, dataprovider.ActionExecutorSystem, "", "", nil)
+			if err != nil {
+				logger.ErrorToConsole("Unable to import users: %v", err)
+				plugin.Handler.Cleanup()
+				os.Exit(1)
+			}
+			for _, result := range report.Results {
+				if result.Action == dataprovider.UserImportActionError {
+					logger.WarnToConsole("line %d, user %q: %s", result.Line, result.Username, result.Error)
+				}
+			}
+			logger.InfoToConsole("Import completed, dry run: %t, added: %d, updated: %d, skipped: %d, errors: %d",
+				report.DryRun, report.Added, report.Updated, report.Skipped, report.Errors)
+			if importUsersErrors != "" && report.Errors > 0 {
+				if err := saveUserImportErrors(&report); err != nil {
+					logger.ErrorToConsole("Unable to save the import errors: %v", err)
+					plugin.Handler.Cleanup()
+					os.Exit(1)
+				}
+			}
+		},
+	}
+)
+
+func getUserImportRequest() (dataprovider.UserImportRequest, error) {
+	req := dataprovider.UserImportRequest{
+		Format:         importUsersFormat,
+		DryRun:         importUsersDryRun,
+		UpdateExisting: importUsersUpdateExisting,
+	}
+	data, err := os.ReadFile(filepath.Clean(importUsersFile))
+	if err != nil {
+		return req, err
+	}
+	req.Data = string(data)
+	if importUsersMapping != "" {
+		data, err := os.ReadFile(filepath.Clean(importUsersMapping))
+		if err != nil {
+			return req, err
+		}
+		if err := json.Unmarshal(data, &req.Mapping); err != nil {
+			return req, err
+		}
+	}
+	if importUsersTemplate != "" {
+		data, err := os.ReadFile(filepath.Clean(importUsersTemplate))
+		if err != nil {
+			return req, err
+		}
+		if err := json.Unmarshal(data, &req.Template); err != nil {
+			return req, err
+		}
+	}
+	return req, nil
+}
+
+func saveUserImportErrors(report *dataprovider.UserImportReport) error {
+	f, err := os.Create(filepath.Clean(importUsersErrors))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if err := w.Write([]string{"line", "username", "error"}); err != nil {
+		return err
+	}
+	for _, result := range report.Results {
+		if result.Action != dataprovider.UserImportActionError {
+			continue
+		}
+		if err := w.Write([]string{strconv.Itoa(result.Line), result.Username, result.Error}); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func init() {
+	addConfigFlags(importUsersCmd)
+	importUsersCmd.Flags().StringVar(&importUsersFormat, "format", dataprovider.UserImportFormatCSV, `Format of the file to import:
+"csv", "passwd", "pureftpd"`)
+	importUsersCmd.Flags().StringVar(&importUsersFile, "file", "", `Path to the file to import`)
+	importUsersCmd.Flags().StringVar(&importUsersMapping, "mapping", "", `Path to a JSON file with the mapping between
+the user fields and the CSV columns`)
+	importUsersCmd.Flags().StringVar(&importUsersTemplate, "template", "", `Path to a JSON file with the settings for
+the imported users`)
+	importUsersCmd.Flags().BoolVar(&importUsersDryRun, "dry-run", false, `Validate the users without saving them`)
+	importUsersCmd.Flags().BoolVar(&importUsersUpdateExisting, "update-existing", false, `Update the existing users, by default
+they are skipped`)
+	importUsersCmd.Flags().StringVar(&importUsersErrors, "errors", "", `Save the rows that cannot be imported to this
+CSV file`)
+	importUsersCmd.MarkFlagRequired("file") //nolint:errcheck
+
+	rootCmd.AddCommand(importUsersCmd)
+}
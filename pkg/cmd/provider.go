@@ -0,0 +1,170 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+
+	"github.com/drakkan/sftpgo/v2/pkg/config"
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/service"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+var (
+	migrateTargetConfigFile string
+	migrateAllowNonEmpty    bool
+	providerCmd             = &cobra.Command{
+		Use:   "provider",
+		Short: "Manage the data provider",
+	}
+	providerMigrateCmd = &cobra.Command{
+		Use:   "migrate",
+		Short: "Copy all the data from the configured provider to another one",
+		Long: `This command copies users, groups, folders, admins, roles, API keys,
+shares, event actions, event rules, IP list entries and configurations from
+the data provider defined in the SFTPGo configuration file (source) to the one
+defined in the "data_provider" section of the target configuration file.
+Any setting not defined in the target file is inherited from the source
+configuration. Environment variables are applied to the source provider only.
+
+The source provider is only read, so the migration can be done while SFTPGo is
+running. The target provider is initialized, if required, and must be empty
+unless "--allow-non-empty" is set: in this case existing objects are updated,
+this way you can run the migration again, for example after stopping SFTPGo,
+to copy the latest changes.
+
+After copying the data, the target provider is verified and a cutover
+checklist is printed.
+
+Example:
+
+$ sftpgo provider migrate --target-config-file /etc/sftpgo/sftpgo-pgsql.json
+
+Any defined action and hook is ignored.
+Please take a look at the usage below to customize the options.`,
+		Run: func(_ *cobra.Command, _ []string) {
+			logger.DisableLogger()
+			logger.EnableConsoleLogger(zerolog.InfoLevel)
+			configDir = util.CleanDirInput(configDir)
+			err := config.LoadConfig(configDir, configFile)
+			if err != nil {
+				logger.ErrorToConsole("Unable to migrate the data provider, config load error: %v", err)
+				os.Exit(1)
+			}
+			kmsConfig := config.GetKMSConfig()
+			err = kmsConfig.Initialize()
+			if err != nil {
+				logger.ErrorToConsole("Unable to initialize KMS: %v", err)
+				os.Exit(1)
+			}
+			mfaConfig := config.GetMFAConfig()
+			err = mfaConfig.Initialize()
+			if err != nil {
+				logger.ErrorToConsole("Unable to initialize MFA: %v", err)
+				os.Exit(1)
+			}
+			targetConfigFile := migrateTargetConfigFile
+			if targetConfigFile != "" && !filepath.IsAbs(targetConfigFile) {
+				targetConfigFile = filepath.Join(configDir, targetConfigFile)
+			}
+			targetConf, err := config.GetProviderConfFromFile(targetConfigFile)
+			if err != nil {
+				logger.ErrorToConsole("Unable to load the target provider configuration: %v", err)
+				os.Exit(1)
+			}
+			migration := service.ProviderMigration{
+				Source:              config.GetProviderConf(),
+				Target:              targetConf,
+				ConfigDir:           configDir,
+				AllowNonEmptyTarget: migrateAllowNonEmpty,
+			}
+			summary, err := migration.Migrate()
+			printMigrationSummary(summary)
+			if err != nil {
+				logger.ErrorToConsole("Unable to migrate the data provider: %v", err)
+				os.Exit(1)
+			}
+			logger.InfoToConsole("Data successfully copied from provider %q to provider %q", migration.Source.Driver,
+				migration.Target.Driver)
+			printMigrationChecklist(targetConfigFile)
+		},
+	}
+)
+
+func printMigrationSummary(summary []dataprovider.MigrationSummary) {
+	if len(summary) == 0 {
+		return
+	}
+	fmt.Printf("\n%-20s %10s %10s  %s\n", "OBJECT", "SOURCE", "TARGET", "STATUS")
+	for _, s := range summary {
+		status := "ok"
+		if !s.IsValid() {
+			var details []string
+			if len(s.Missing) > 0 {
+				details = append(details, fmt.Sprintf("missing: %s", strings.Join(s.Missing, ", ")))
+			}
+			if len(s.Unexpected) > 0 {
+				details = append(details, fmt.Sprintf("unexpected: %s", strings.Join(s.Unexpected, ", ")))
+			}
+			status = strings.Join(details, "; ")
+		}
+		fmt.Printf("%-20s %10d %10d  %s\n", s.Object, s.Source, s.Target, status)
+	}
+	fmt.Println()
+}
+
+func printMigrationChecklist(targetConfigFile string) {
+	fmt.Printf(`Cutover checklist:
+
+1. If SFTPGo was running during the migration, stop all the instances and run
+   this command again with "--allow-non-empty" to copy the latest changes.
+   Objects deleted from the source provider after the first run are reported
+   as unexpected and must be removed manually.
+2. Copy the "data_provider" section from %q to the configuration
+   file used by SFTPGo, or set the equivalent environment variables.
+3. Make sure that all the SFTPGo instances use the same KMS configuration,
+   the secrets are copied encrypted.
+4. Start SFTPGo and verify that users and admins can login.
+5. Quota usage is copied, you can run a quota scan to refresh it if required.
+   Last login times, active transfers, defender data and shared sessions are
+   not copied.
+6. Keep the source provider as backup until the new setup is verified.
+`, targetConfigFile)
+}
+
+func init() {
+	addConfigFlags(providerMigrateCmd)
+	providerMigrateCmd.Flags().StringVar(&migrateTargetConfigFile, "target-config-file", "",
+		`Path to the configuration file defining the
+target data provider. It must be an absolute
+path or a path relative to the configuration
+directory. Only the "data_provider" section is
+used. Required`)
+	providerMigrateCmd.MarkFlagRequired("target-config-file") //nolint:errcheck
+	providerMigrateCmd.Flags().BoolVar(&migrateAllowNonEmpty, "allow-non-empty", false,
+		`Copy the data even if the target provider is
+not empty, existing objects are updated`)
+
+	providerCmd.AddCommand(providerMigrateCmd)
+	rootCmd.AddCommand(providerCmd)
+}
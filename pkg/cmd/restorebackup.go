@@ -0,0 +1,186 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/drakkan/sftpgo/v2/pkg/common"
+	"github.com/drakkan/sftpgo/v2/pkg/config"
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/plugin"
+	"github.com/drakkan/sftpgo/v2/pkg/service"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+var (
+	restoreBackupName   string
+	restoreBackupRemote bool
+	restoreBackupList   bool
+	restoreBackupOutput string
+	restoreBackupMode   int
+	restoreBackupCmd    = &cobra.Command{
+		Use:   "restorebackup",
+		Short: "List and restore the scheduled data provider backups",
+		Long: `This command reads the data provider connection details, the KMS and the
+provider backups configuration from the specified configuration file and
+restores a backup saved by the scheduled provider backups. The backup is
+read from the configured backups path or, using the "--remote" flag, from
+the configured remote folder. Encrypted backups are decrypted using the
+configured KMS.
+
+To list the available backups:
+
+$ sftpgo restorebackup --list
+
+To restore a backup from the remote folder:
+
+$ sftpgo restorebackup --remote --name sftpgo_backup_20230510T020000Z.json.enc
+
+Use the "--output" flag to save the decrypted backup to a local file instead
+of restoring it, the saved file can be restored using the "loaddata" REST API
+or the "--loaddata-from" flag.
+This command is not supported for the memory provider.
+For embedded providers like bolt and SQLite you should stop the running SFTPGo
+instance to avoid database corruption.
+
+Please take a look at the usage below to customize the options.`,
+		Run: func(_ *cobra.Command, _ []string) {
+			logger.DisableLogger()
+			logger.EnableConsoleLogger(zerolog.DebugLevel)
+			configDir = util.CleanDirInput(configDir)
+			err := config.LoadConfig(configDir, configFile)
+			if err != nil {
+				logger.WarnToConsole("Unable to load configuration: %v", err)
+				os.Exit(1)
+			}
+			kmsConfig := config.GetKMSConfig()
+			err = kmsConfig.Initialize()
+			if err != nil {
+				logger.ErrorToConsole("unable to initialize KMS: %v", err)
+				os.Exit(1)
+			}
+			mfaConfig := config.GetMFAConfig()
+			err = mfaConfig.Initialize()
+			if err != nil {
+				logger.ErrorToConsole("Unable to initialize MFA: %v", err)
+				os.Exit(1)
+			}
+			providerConf := config.GetProviderConf()
+			if providerConf.Driver == dataprovider.MemoryDataProviderName {
+				logger.ErrorToConsole("memory provider is not supported")
+				os.Exit(1)
+			}
+			// ignore actions
+			providerConf.Actions.Hook = ""
+			providerConf.Actions.ExecuteFor = nil
+			providerConf.Actions.ExecuteOn = nil
+			logger.InfoToConsole("Initializing provider: %q config file: %q", providerConf.Driver, viper.ConfigFileUsed())
+			err = dataprovider.Initialize(providerConf, configDir, false)
+			if err != nil {
+				logger.ErrorToConsole("Unable to initialize data provider: %v", err)
+				os.Exit(1)
+			}
+			if err := plugin.Initialize(config.GetPluginsConfig(), defaultLogLevel); err != nil {
+				logger.ErrorToConsole("Unable to initialize plugin system: %v", err)
+				os.Exit(1)
+			}
+			defer plugin.Handler.Cleanup()
+
+			backupsConfig := config.GetCommonConfig().ProviderBackups
+			if restoreBackupList {
+				listProviderBackups(&backupsConfig)
+				return
+			}
+			if restoreBackupName == "" {
+				logger.ErrorToConsole("the backup name is required")
+				plugin.Handler.Cleanup()
+				os.Exit(1)
+			}
+			content, err := backupsConfig.ReadBackup(restoreBackupName, restoreBackupRemote)
+			if err != nil {
+				logger.ErrorToConsole("Unable to read backup %q: %v", restoreBackupName, err)
+				plugin.Handler.Cleanup()
+				os.Exit(1)
+			}
+			if restoreBackupOutput != "" {
+				outputFile := filepath.Clean(restoreBackupOutput)
+				if err := os.WriteFile(outputFile, content, 0600); err != nil {
+					logger.ErrorToConsole("Unable to save backup %q to %q: %v", restoreBackupName, outputFile, err)
+					plugin.Handler.Cleanup()
+					os.Exit(1)
+				}
+				logger.InfoToConsole("Backup %q saved to %q", restoreBackupName, outputFile)
+				return
+			}
+			s := service.Service{
+				LoadDataFrom: restoreBackupName,
+				LoadDataMode: restoreBackupMode,
+			}
+			if err := s.LoadData(content); err != nil {
+				logger.ErrorToConsole("Unable to restore backup %q: %v", restoreBackupName, err)
+				plugin.Handler.Cleanup()
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+func listProviderBackups(backupsConfig *common.ProviderBackupsConfig) {
+	backups, err := backupsConfig.ListLocalBackups()
+	if err != nil {
+		logger.ErrorToConsole("Unable to list local backups: %v", err)
+	}
+	logger.InfoToConsole("Local backups in %q: %d", dataprovider.GetBackupsPath(), len(backups))
+	for _, backup := range backups {
+		logger.InfoToConsole("%s, size: %d, encrypted: %t", backup.Name, backup.Size, backup.Encrypted)
+	}
+	if backupsConfig.RemoteFolder == "" {
+		return
+	}
+	backups, err = backupsConfig.ListRemoteBackups()
+	if err != nil {
+		logger.ErrorToConsole("Unable to list remote backups: %v", err)
+		return
+	}
+	logger.InfoToConsole("Remote backups in folder %q: %d", backupsConfig.RemoteFolder, len(backups))
+	for _, backup := range backups {
+		logger.InfoToConsole("%s, size: %d, encrypted: %t", backup.Name, backup.Size, backup.Encrypted)
+	}
+}
+
+func init() {
+	addConfigFlags(restoreBackupCmd)
+	restoreBackupCmd.Flags().StringVar(&restoreBackupName, "name", "", `Name of the backup to restore`)
+	restoreBackupCmd.Flags().BoolVar(&restoreBackupRemote, "remote", false, `Read the backup from the configured
+remote folder`)
+	restoreBackupCmd.Flags().BoolVar(&restoreBackupList, "list", false, `List the available backups`)
+	restoreBackupCmd.Flags().StringVar(&restoreBackupOutput, "output", "", `Save the decrypted backup to this file
+instead of restoring it`)
+	restoreBackupCmd.Flags().IntVar(&restoreBackupMode, "mode", 1, `Restore mode:
+  0 - new users are added, existing users are
+      updated
+  1 - New users are added, existing users are
+      not modified
+`)
+
+	rootCmd.AddCommand(restoreBackupCmd)
+}
@@ -0,0 +1,107 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"os"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/drakkan/sftpgo/v2/pkg/config"
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/plugin"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+var (
+	rotateSecretsAll bool
+	rotateSecretsCmd = &cobra.Command{
+		Use:   "rotatesecrets",
+		Short: "Re-encrypt the stored secrets using the configured KMS",
+		Long: `This command reads the data provider connection details and the KMS
+configuration from the specified configuration file and re-encrypts the
+secrets stored in the data provider using the configured KMS secret provider.
+It can be used to migrate the secrets to a new KMS, for example a PKCS#11
+token, or to re-encrypt them after rotating the KMS key.
+The secret providers used to encrypt the existing secrets, for example the
+previously used KMS plugins, must be configured to allow decryption.
+This command is not supported for the memory provider.
+For embedded providers like bolt and SQLite you should stop the running SFTPGo
+instance to avoid database corruption.
+
+Please take a look at the usage below to customize the options.`,
+		Run: func(_ *cobra.Command, _ []string) {
+			logger.DisableLogger()
+			logger.EnableConsoleLogger(zerolog.DebugLevel)
+			configDir = util.CleanDirInput(configDir)
+			err := config.LoadConfig(configDir, configFile)
+			if err != nil {
+				logger.WarnToConsole("Unable to load configuration: %v", err)
+				os.Exit(1)
+			}
+			kmsConfig := config.GetKMSConfig()
+			err = kmsConfig.Initialize()
+			if err != nil {
+				logger.ErrorToConsole("unable to initialize KMS: %v", err)
+				os.Exit(1)
+			}
+			mfaConfig := config.GetMFAConfig()
+			err = mfaConfig.Initialize()
+			if err != nil {
+				logger.ErrorToConsole("Unable to initialize MFA: %v", err)
+				os.Exit(1)
+			}
+			providerConf := config.GetProviderConf()
+			if providerConf.Driver == dataprovider.MemoryDataProviderName {
+				logger.ErrorToConsole("memory provider is not supported")
+				os.Exit(1)
+			}
+			logger.InfoToConsole("Initializing provider: %q config file: %q", providerConf.Driver, viper.ConfigFileUsed())
+			err = dataprovider.Initialize(providerConf, configDir, false)
+			if err != nil {
+				logger.ErrorToConsole("Unable to initialize data provider: %v", err)
+				os.Exit(1)
+			}
+			if err := plugin.Initialize(config.GetPluginsConfig(), defaultLogLevel); err != nil {
+				logger.ErrorToConsole("Unable to initialize plugin system: %v", err)
+				os.Exit(1)
+			}
+			defer plugin.Handler.Cleanup()
+
+			result, err := dataprovider.RotateSecrets(rotateSecretsAll, dataprovider.ActionExecutorSystem, "")
+			if err != nil {
+				logger.ErrorToConsole("Unable to rotate secrets: %v, re-encrypted secrets so far: %+v", err, result)
+				plugin.Handler.Cleanup()
+				os.Exit(1)
+			}
+			logger.InfoToConsole("Secrets rotation completed, re-encrypted secrets: %d, details: %+v",
+				result.GetTotal(), result)
+		},
+	}
+)
+
+func init() {
+	addConfigFlags(rotateSecretsCmd)
+	rotateSecretsCmd.Flags().BoolVar(&rotateSecretsAll, "all", false, `Re-encrypt all the secrets. By default only
+the secrets encrypted using a secret provider
+different from the configured one are
+re-encrypted. Set this flag after rotating
+the key used by the configured provider`)
+
+	rootCmd.AddCommand(rotateSecretsCmd)
+}
@@ -42,12 +42,15 @@ const (
 	HookPostLogin           = "post_login"
 	HookExternalAuth        = "external_auth"
 	HookKeyboardInteractive = "keyboard_interactive"
+	HookStaging             = "staging"
+	HookTranscoding         = "transcoding"
 )
 
 var (
 	config         Config
 	supportedHooks = []string{HookFsActions, HookProviderActions, HookStartup, HookPostConnect, HookPostDisconnect,
-		HookDataRetention, HookCheckPassword, HookPreLogin, HookPostLogin, HookExternalAuth, HookKeyboardInteractive}
+		HookDataRetention, HookCheckPassword, HookPreLogin, HookPostLogin, HookExternalAuth, HookKeyboardInteractive,
+		HookStaging, HookTranscoding}
 )
 
 // Command define the configuration for a specific commands
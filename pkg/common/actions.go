@@ -31,13 +31,16 @@ import (
 
 	"github.com/sftpgo/sdk"
 	"github.com/sftpgo/sdk/plugin/notifier"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/drakkan/sftpgo/v2/pkg/command"
 	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
 	"github.com/drakkan/sftpgo/v2/pkg/httpclient"
 	"github.com/drakkan/sftpgo/v2/pkg/logger"
 	"github.com/drakkan/sftpgo/v2/pkg/plugin"
+	"github.com/drakkan/sftpgo/v2/pkg/tracing"
 	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
 )
 
 var (
@@ -83,7 +86,14 @@ func InitializeActionHandler(handler ActionHandler) {
 // - 0 not executed
 // - 1 executed using an external hook
 // - 2 executed using the event manager
+// Uploads are denied, before executing any action, if the concurrent transfers
+// limit for the target virtual folder is reached
 func ExecutePreAction(conn *BaseConnection, operation, filePath, virtualPath string, fileSize int64, openFlags int) (int, error) {
+	if operation == OperationPreUpload {
+		if err := conn.checkFolderTransfersLimit(virtualPath); err != nil {
+			return 0, err
+		}
+	}
 	var event *notifier.FsEvent
 	hasNotifiersPlugin := plugin.Handler.HasNotifiers()
 	hasHook := util.Contains(Config.Actions.ExecuteOn, operation)
@@ -113,6 +123,8 @@ func ExecutePreAction(conn *BaseConnection, operation, filePath, virtualPath str
 			Role:              event.Role,
 			Timestamp:         event.Timestamp,
 			Email:             conn.User.Email,
+			UploadFields:      conn.getUploadFields(),
+			CorrelationID:     conn.ID,
 			Object:            nil,
 		}
 		executedSync, err := eventManager.handleFsEvent(params)
@@ -130,10 +142,18 @@ func ExecutePreAction(conn *BaseConnection, operation, filePath, virtualPath str
 func ExecuteActionNotification(conn *BaseConnection, operation, filePath, virtualPath, target, virtualTarget, sshCmd string,
 	fileSize int64, err error, elapsed int64,
 ) error {
+	updateSearchIndex(conn, operation, virtualPath, virtualTarget, err)
+	updateFilesMetadata(conn, operation, virtualPath, virtualTarget, err)
+	updateAccessAnalytics(conn, operation, virtualPath, virtualTarget, fileSize, err)
+	publishUserFsEvent(conn, operation, virtualPath, virtualTarget, fileSize, err)
 	hasNotifiersPlugin := plugin.Handler.HasNotifiers()
 	hasHook := util.Contains(Config.Actions.ExecuteOn, operation)
 	hasRules := eventManager.hasFsRules()
-	if !hasHook && !hasNotifiersPlugin && !hasRules {
+	var webhooks []dataprovider.UserWebhook
+	if conn.protocol != protocolEventAction {
+		webhooks = getMatchingUserWebhooks(&conn.User, operation, virtualPath, virtualTarget)
+	}
+	if !hasHook && !hasNotifiersPlugin && !hasRules && len(webhooks) == 0 {
 		return nil
 	}
 	notification := newActionNotification(&conn.User, operation, filePath, virtualPath, target, virtualTarget, sshCmd,
@@ -141,7 +161,7 @@ func ExecuteActionNotification(conn *BaseConnection, operation, filePath, virtua
 	if hasNotifiersPlugin {
 		plugin.Handler.NotifyFsEvent(notification)
 	}
-	if hasRules {
+	if hasRules || len(webhooks) > 0 {
 		params := EventParams{
 			Name:              notification.Username,
 			Groups:            conn.User.Groups,
@@ -159,14 +179,21 @@ func ExecuteActionNotification(conn *BaseConnection, operation, filePath, virtua
 			Role:              notification.Role,
 			Timestamp:         notification.Timestamp,
 			Email:             conn.User.Email,
+			UploadFields:      conn.getUploadFields(),
+			CorrelationID:     conn.ID,
 			Object:            nil,
 		}
 		if err != nil {
 			params.AddError(fmt.Errorf("%q failed: %w", params.Event, err))
 		}
-		executedSync, err := eventManager.handleFsEvent(params)
-		if executedSync {
-			return err
+		if len(webhooks) > 0 {
+			go executeUserWebhooks(webhooks, *params.getACopy())
+		}
+		if hasRules {
+			executedSync, err := eventManager.handleFsEvent(params)
+			if executedSync {
+				return err
+			}
 		}
 	}
 	if hasHook {
@@ -214,6 +241,8 @@ func newActionNotification(
 		endpoint = fsConfig.SFTPConfig.Endpoint
 	case sdk.HTTPFilesystemProvider:
 		endpoint = fsConfig.HTTPConfig.Endpoint
+	case vfs.WebDAVFilesystemProvider:
+		endpoint = fsConfig.WebDAVConfig.Endpoint
 	}
 
 	return &notifier.FsEvent{
@@ -252,12 +281,17 @@ func (h *defaultActionHandler) Handle(event *notifier.FsEvent) (int, error) {
 		return 0, nil
 	}
 
+	span := tracing.StartSpan(event.SessionID, "action hook",
+		attribute.String("sftpgo.action", event.Action),
+		attribute.String("sftpgo.username", event.Username))
+
+	var err error
 	if strings.HasPrefix(Config.Actions.Hook, "http") {
-		err := h.handleHTTP(event)
-		return 1, err
+		err = h.handleHTTP(event)
+	} else {
+		err = h.handleCommand(event)
 	}
-
-	err := h.handleCommand(event)
+	tracing.EndSpan(span, err)
 	return 1, err
 }
 
@@ -275,7 +309,7 @@ func (h *defaultActionHandler) handleHTTP(event *notifier.FsEvent) error {
 	var b bytes.Buffer
 	_ = json.NewEncoder(&b).Encode(event)
 
-	resp, err := httpclient.RetryablePost(Config.Actions.Hook, "application/json", &b)
+	resp, err := httpclient.RetryablePostWithCorrelationID(Config.Actions.Hook, "application/json", &b, event.SessionID)
 	if err == nil {
 		respCode = resp.StatusCode
 		resp.Body.Close()
@@ -285,7 +319,7 @@ func (h *defaultActionHandler) handleHTTP(event *notifier.FsEvent) error {
 		}
 	}
 
-	logger.Debug(event.Protocol, "", "notified operation %q to URL: %s status code: %d, elapsed: %s err: %v",
+	logger.Debug(event.Protocol, event.SessionID, "notified operation %q to URL: %s status code: %d, elapsed: %s err: %v",
 		event.Action, u.Redacted(), respCode, time.Since(startTime), err)
 
 	return err
@@ -309,7 +343,7 @@ func (h *defaultActionHandler) handleCommand(event *notifier.FsEvent) error {
 	startTime := time.Now()
 	err := cmd.Run()
 
-	logger.Debug(event.Protocol, "", "executed command %q, elapsed: %s, error: %v",
+	logger.Debug(event.Protocol, event.SessionID, "executed command %q, elapsed: %s, error: %v",
 		Config.Actions.Hook, time.Since(startTime), err)
 
 	return err
@@ -333,6 +367,7 @@ func notificationAsEnvVars(event *notifier.FsEvent) []string {
 		fmt.Sprintf("SFTPGO_ACTION_PROTOCOL=%s", event.Protocol),
 		fmt.Sprintf("SFTPGO_ACTION_IP=%s", event.IP),
 		fmt.Sprintf("SFTPGO_ACTION_SESSION_ID=%s", event.SessionID),
+		fmt.Sprintf("%s=%s", logger.CorrelationIDEnvVar, event.SessionID),
 		fmt.Sprintf("SFTPGO_ACTION_OPEN_FLAGS=%d", event.OpenFlags),
 		fmt.Sprintf("SFTPGO_ACTION_TIMESTAMP=%d", event.Timestamp),
 		fmt.Sprintf("SFTPGO_ACTION_ROLE=%s", event.Role),
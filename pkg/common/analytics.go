@@ -0,0 +1,539 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// Supported heatmap orderings
+const (
+	HeatmapOrderReads        = "reads"
+	HeatmapOrderWrites       = "writes"
+	HeatmapOrderReadBytes    = "read_bytes"
+	HeatmapOrderWrittenBytes = "written_bytes"
+	HeatmapOrderLastAccess   = "last_access"
+)
+
+const (
+	protocolAnalytics         = "Analytics"
+	defaultColdFilesLimit     = 50
+	maxColdFilesLimit         = 1000
+	analyticsEvictionFraction = 10
+)
+
+var (
+	// ErrStorageReportInProgress is returned if a storage report for the same
+	// user is already being generated
+	ErrStorageReportInProgress = errors.New("a storage report for this user is already in progress")
+	accessTracker              *fileAccessTracker
+	supportedHeatmapOrders     = []string{HeatmapOrderReads, HeatmapOrderWrites, HeatmapOrderReadBytes,
+		HeatmapOrderWrittenBytes, HeatmapOrderLastAccess}
+	storageReports = &activeStorageReports{
+		users: make(map[string]bool),
+	}
+)
+
+// AnalyticsConfig defines the configuration for file access analytics
+type AnalyticsConfig struct {
+	// Set to true to track read and write accesses to files.
+	// The statistics are kept in memory and are reset after a restart
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// Maximum number of tracked files, if exceeded the least recently
+	// accessed files are evicted
+	MaxTrackedFiles int `json:"max_tracked_files" mapstructure:"max_tracked_files"`
+}
+
+func (c *AnalyticsConfig) validate() error {
+	if c.Enabled && c.MaxTrackedFiles <= 0 {
+		return fmt.Errorf("analytics: invalid max tracked files %d", c.MaxTrackedFiles)
+	}
+	return nil
+}
+
+// IsAnalyticsEnabled returns true if file access analytics are enabled
+func IsAnalyticsEnabled() bool {
+	return accessTracker != nil
+}
+
+// FileAccessStats defines the access statistics for a file or directory
+type FileAccessStats struct {
+	Username     string `json:"username"`
+	Path         string `json:"path"`
+	Reads        int64  `json:"reads"`
+	Writes       int64  `json:"writes"`
+	ReadBytes    int64  `json:"read_bytes"`
+	WrittenBytes int64  `json:"written_bytes"`
+	// Last access as unix timestamp in milliseconds
+	LastAccess int64 `json:"last_access"`
+	role       string
+}
+
+func (s *FileAccessStats) add(other *FileAccessStats) {
+	s.Reads += other.Reads
+	s.Writes += other.Writes
+	s.ReadBytes += other.ReadBytes
+	s.WrittenBytes += other.WrittenBytes
+	if other.LastAccess > s.LastAccess {
+		s.LastAccess = other.LastAccess
+	}
+}
+
+func (s *FileAccessStats) getOrderValue(order string) int64 {
+	switch order {
+	case HeatmapOrderWrites:
+		return s.Writes
+	case HeatmapOrderReadBytes:
+		return s.ReadBytes
+	case HeatmapOrderWrittenBytes:
+		return s.WrittenBytes
+	case HeatmapOrderLastAccess:
+		return s.LastAccess
+	default:
+		return s.Reads
+	}
+}
+
+// HeatmapQuery defines the filters for the access heatmap
+type HeatmapQuery struct {
+	// Limit the results to this user, empty means all users
+	Username string
+	// Limit the results to users with this role, empty means all roles
+	Role string
+	// If true the statistics are aggregated for each directory
+	GroupByDir bool
+	// Ordering field, descending
+	Order string
+	Limit int
+}
+
+func (q *HeatmapQuery) validate() error {
+	if q.Order == "" {
+		q.Order = HeatmapOrderReads
+	}
+	if !util.Contains(supportedHeatmapOrders, q.Order) {
+		return util.NewValidationError(fmt.Sprintf("invalid order %q", q.Order))
+	}
+	if q.Limit <= 0 {
+		return util.NewValidationError(fmt.Sprintf("invalid limit %d", q.Limit))
+	}
+	return nil
+}
+
+type fileAccessTracker struct {
+	sync.RWMutex
+	maxFiles int
+	numFiles int
+	// username -> virtual path -> stats
+	files map[string]map[string]*FileAccessStats
+}
+
+func newFileAccessTracker(maxFiles int) *fileAccessTracker {
+	return &fileAccessTracker{
+		maxFiles: maxFiles,
+		files:    make(map[string]map[string]*FileAccessStats),
+	}
+}
+
+func (t *fileAccessTracker) onFsEvent(conn *BaseConnection, operation, virtualPath, virtualTarget string, fileSize int64) {
+	switch operation {
+	case operationDownload:
+		t.addAccess(&conn.User, virtualPath, fileSize, false)
+	case operationUpload:
+		t.addAccess(&conn.User, virtualPath, fileSize, true)
+	case operationCopy:
+		t.addAccess(&conn.User, virtualTarget, fileSize, true)
+	case operationDelete, operationRmdir:
+		t.remove(conn.User.Username, virtualPath)
+	case operationRename:
+		t.rename(conn.User.Username, virtualPath, virtualTarget)
+	}
+}
+
+func (t *fileAccessTracker) addAccess(user *dataprovider.User, virtualPath string, size int64, isWrite bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	userFiles, ok := t.files[user.Username]
+	if !ok {
+		userFiles = make(map[string]*FileAccessStats)
+		t.files[user.Username] = userFiles
+	}
+	stats, ok := userFiles[virtualPath]
+	if !ok {
+		if t.numFiles >= t.maxFiles {
+			t.evict()
+		}
+		stats = &FileAccessStats{
+			Username: user.Username,
+			Path:     virtualPath,
+		}
+		userFiles[virtualPath] = stats
+		t.numFiles++
+	}
+	stats.role = user.Role
+	stats.LastAccess = util.GetTimeAsMsSinceEpoch(time.Now())
+	if isWrite {
+		stats.Writes++
+		stats.WrittenBytes += size
+	} else {
+		stats.Reads++
+		stats.ReadBytes += size
+	}
+}
+
+// evict removes the least recently accessed files, it must be called with the lock held
+func (t *fileAccessTracker) evict() {
+	all := make([]*FileAccessStats, 0, t.numFiles)
+	for _, userFiles := range t.files {
+		for _, stats := range userFiles {
+			all = append(all, stats)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].LastAccess < all[j].LastAccess
+	})
+	toRemove := t.maxFiles / analyticsEvictionFraction
+	if toRemove < 1 {
+		toRemove = 1
+	}
+	for idx := 0; idx < toRemove && idx < len(all); idx++ {
+		t.removeStats(all[idx].Username, all[idx].Path)
+	}
+}
+
+// removeStats must be called with the lock held
+func (t *fileAccessTracker) removeStats(username, virtualPath string) {
+	userFiles := t.files[username]
+	if _, ok := userFiles[virtualPath]; !ok {
+		return
+	}
+	delete(userFiles, virtualPath)
+	t.numFiles--
+	if len(userFiles) == 0 {
+		delete(t.files, username)
+	}
+}
+
+func (t *fileAccessTracker) remove(username, virtualPath string) {
+	t.Lock()
+	defer t.Unlock()
+
+	for p := range t.files[username] {
+		if p == virtualPath || strings.HasPrefix(p, virtualPath+"/") {
+			t.removeStats(username, p)
+		}
+	}
+}
+
+func (t *fileAccessTracker) rename(username, source, target string) {
+	t.Lock()
+	defer t.Unlock()
+
+	userFiles := t.files[username]
+	var renamed []*FileAccessStats
+	for p, stats := range userFiles {
+		if p == source || strings.HasPrefix(p, source+"/") {
+			renamed = append(renamed, stats)
+			t.removeStats(username, p)
+		}
+	}
+	if len(renamed) == 0 {
+		return
+	}
+	for p := range t.files[username] {
+		if p == target || strings.HasPrefix(p, target+"/") {
+			t.removeStats(username, p)
+		}
+	}
+	if _, ok := t.files[username]; !ok {
+		t.files[username] = make(map[string]*FileAccessStats)
+	}
+	for _, stats := range renamed {
+		stats.Path = path.Join(target, strings.TrimPrefix(stats.Path, source))
+		t.files[username][stats.Path] = stats
+		t.numFiles++
+	}
+}
+
+func (t *fileAccessTracker) getLastAccess(username string) map[string]int64 {
+	t.RLock()
+	defer t.RUnlock()
+
+	result := make(map[string]int64, len(t.files[username]))
+	for p, stats := range t.files[username] {
+		result[p] = stats.LastAccess
+	}
+	return result
+}
+
+func (t *fileAccessTracker) getHeatmap(query *HeatmapQuery) []FileAccessStats {
+	t.RLock()
+
+	results := make(map[string]*FileAccessStats)
+	for username, userFiles := range t.files {
+		if query.Username != "" && username != query.Username {
+			continue
+		}
+		for _, stats := range userFiles {
+			if query.Role != "" && stats.role != query.Role {
+				continue
+			}
+			p := stats.Path
+			if query.GroupByDir {
+				p = path.Dir(p)
+			}
+			key := username + p
+			val, ok := results[key]
+			if !ok {
+				val = &FileAccessStats{
+					Username: username,
+					Path:     p,
+				}
+				results[key] = val
+			}
+			val.add(stats)
+		}
+	}
+
+	t.RUnlock()
+
+	heatmap := make([]FileAccessStats, 0, len(results))
+	for _, stats := range results {
+		heatmap = append(heatmap, *stats)
+	}
+	sort.Slice(heatmap, func(i, j int) bool {
+		vi := heatmap[i].getOrderValue(query.Order)
+		vj := heatmap[j].getOrderValue(query.Order)
+		if vi == vj {
+			if heatmap[i].Username == heatmap[j].Username {
+				return heatmap[i].Path < heatmap[j].Path
+			}
+			return heatmap[i].Username < heatmap[j].Username
+		}
+		return vi > vj
+	})
+	if len(heatmap) > query.Limit {
+		heatmap = heatmap[:query.Limit]
+	}
+	return heatmap
+}
+
+func updateAccessAnalytics(conn *BaseConnection, operation, virtualPath, virtualTarget string, fileSize int64, err error) {
+	if accessTracker == nil || err != nil {
+		return
+	}
+	accessTracker.onFsEvent(conn, operation, virtualPath, virtualTarget, fileSize)
+}
+
+// GetAccessHeatmap returns the most accessed files or directories
+func GetAccessHeatmap(query HeatmapQuery) ([]FileAccessStats, error) {
+	if accessTracker == nil {
+		return nil, util.NewMethodDisabledError("file access analytics are disabled")
+	}
+	if err := query.validate(); err != nil {
+		return nil, err
+	}
+	return accessTracker.getHeatmap(&query), nil
+}
+
+// ExtensionStats defines the storage used by files with the same extension
+type ExtensionStats struct {
+	// Lowercase extension including the dot, empty for files without extension
+	Extension string `json:"extension"`
+	Files     int64  `json:"files"`
+	Size      int64  `json:"size"`
+}
+
+// ColdFile defines a file not accessed for a long time
+type ColdFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Last modification as unix timestamp in milliseconds
+	ModTime int64 `json:"mod_time"`
+	// Last tracked access as unix timestamp in milliseconds, if no access was
+	// tracked since the service started this is the last modification time
+	LastAccess int64 `json:"last_access"`
+}
+
+// StorageReport defines the storage analytics for a user
+type StorageReport struct {
+	Username string `json:"username"`
+	Files    int64  `json:"files"`
+	Size     int64  `json:"size"`
+	// Storage breakdown by file extension, sorted by size
+	Extensions []ExtensionStats `json:"extensions"`
+	// The files with the oldest access, the coldest first
+	ColdFiles []ColdFile `json:"cold_files"`
+	// Report generation time as unix timestamp in milliseconds
+	CreatedAt int64 `json:"created_at"`
+	// Time required to generate the report, in milliseconds
+	Elapsed int64 `json:"elapsed"`
+}
+
+// coldFilesHeap is a max heap based on the last access, it keeps the N coldest files
+type coldFilesHeap []ColdFile
+
+func (h coldFilesHeap) Len() int           { return len(h) }
+func (h coldFilesHeap) Less(i, j int) bool { return h[i].LastAccess > h[j].LastAccess }
+func (h coldFilesHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *coldFilesHeap) Push(x any) {
+	*h = append(*h, x.(ColdFile))
+}
+
+func (h *coldFilesHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+type activeStorageReports struct {
+	sync.Mutex
+	users map[string]bool
+}
+
+func (r *activeStorageReports) add(username string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.users[username] {
+		return false
+	}
+	r.users[username] = true
+	return true
+}
+
+func (r *activeStorageReports) remove(username string) {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.users, username)
+}
+
+// GetStorageReport walks the filesystems of the specified user and returns
+// the storage breakdown by extension and the coldest files.
+// The last access is known only for files tracked by the access analytics,
+// for the other files the modification time is used
+func GetStorageReport(user dataprovider.User, coldFilesLimit int) (StorageReport, error) {
+	if coldFilesLimit <= 0 {
+		coldFilesLimit = defaultColdFilesLimit
+	}
+	if coldFilesLimit > maxColdFilesLimit {
+		coldFilesLimit = maxColdFilesLimit
+	}
+	if !storageReports.add(user.Username) {
+		return StorageReport{}, ErrStorageReportInProgress
+	}
+	defer storageReports.remove(user.Username)
+
+	startTime := time.Now()
+	var lastAccess map[string]int64
+	if accessTracker != nil {
+		lastAccess = accessTracker.getLastAccess(user.Username)
+	}
+	conn := NewBaseConnection(fmt.Sprintf("%s_%s", protocolAnalytics, xid.New().String()), protocolAnalytics,
+		"", "", user)
+	defer conn.CloseFS() //nolint:errcheck
+
+	report := StorageReport{
+		Username: user.Username,
+	}
+	extensions := make(map[string]*ExtensionStats)
+	coldFiles := &coldFilesHeap{}
+
+	var walkDir func(string) error
+	walkDir = func(dirPath string) error {
+		contents, err := conn.ListDir(dirPath)
+		if err != nil {
+			return fmt.Errorf("unable to list directory %q: %w", dirPath, err)
+		}
+		for _, info := range contents {
+			p := path.Join(dirPath, info.Name())
+			if info.IsDir() {
+				if err := walkDir(p); err != nil {
+					return err
+				}
+				continue
+			}
+			if !info.Mode().IsRegular() {
+				continue
+			}
+			report.Files++
+			report.Size += info.Size()
+			ext := strings.ToLower(path.Ext(info.Name()))
+			stats, ok := extensions[ext]
+			if !ok {
+				stats = &ExtensionStats{Extension: ext}
+				extensions[ext] = stats
+			}
+			stats.Files++
+			stats.Size += info.Size()
+
+			file := ColdFile{
+				Path:       p,
+				Size:       info.Size(),
+				ModTime:    util.GetTimeAsMsSinceEpoch(info.ModTime()),
+				LastAccess: lastAccess[p],
+			}
+			if file.LastAccess == 0 {
+				file.LastAccess = file.ModTime
+			}
+			if coldFiles.Len() < coldFilesLimit {
+				heap.Push(coldFiles, file)
+			} else if file.LastAccess < (*coldFiles)[0].LastAccess {
+				(*coldFiles)[0] = file
+				heap.Fix(coldFiles, 0)
+			}
+		}
+		return nil
+	}
+
+	if err := walkDir("/"); err != nil {
+		return report, err
+	}
+
+	report.Extensions = make([]ExtensionStats, 0, len(extensions))
+	for _, stats := range extensions {
+		report.Extensions = append(report.Extensions, *stats)
+	}
+	sort.Slice(report.Extensions, func(i, j int) bool {
+		if report.Extensions[i].Size == report.Extensions[j].Size {
+			return report.Extensions[i].Extension < report.Extensions[j].Extension
+		}
+		return report.Extensions[i].Size > report.Extensions[j].Size
+	})
+	report.ColdFiles = make([]ColdFile, coldFiles.Len())
+	for idx := len(report.ColdFiles) - 1; idx >= 0; idx-- {
+		report.ColdFiles[idx] = heap.Pop(coldFiles).(ColdFile)
+	}
+	report.CreatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+	report.Elapsed = time.Since(startTime).Milliseconds()
+	return report, nil
+}
@@ -0,0 +1,179 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+func TestAccessAnalytics(t *testing.T) {
+	c := AnalyticsConfig{
+		Enabled: true,
+	}
+	assert.Error(t, c.validate())
+	c.MaxTrackedFiles = 10
+	assert.NoError(t, c.validate())
+
+	_, err := GetAccessHeatmap(HeatmapQuery{Limit: 10})
+	assert.ErrorIs(t, err, util.ErrMethodDisabled)
+	assert.False(t, IsAnalyticsEnabled())
+
+	accessTracker = newFileAccessTracker(c.MaxTrackedFiles)
+	defer func() {
+		accessTracker = nil
+	}()
+	assert.True(t, IsAnalyticsEnabled())
+
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "analytics_user",
+			Role:     "role1",
+		},
+	}
+	conn := NewBaseConnection("", ProtocolSFTP, "", "", user)
+	updateAccessAnalytics(conn, operationDownload, "/dir/file1", "", 100, nil)
+	updateAccessAnalytics(conn, operationDownload, "/dir/file1", "", 100, nil)
+	updateAccessAnalytics(conn, operationUpload, "/dir/file2", "", 50, nil)
+	updateAccessAnalytics(conn, operationDownload, "/dir/sub/file3", "", 10, nil)
+	updateAccessAnalytics(conn, operationCopy, "/dir/file2", "/file4", 50, nil)
+	updateAccessAnalytics(conn, operationUpload, "/failed", "", 50, os.ErrPermission)
+
+	_, err = GetAccessHeatmap(HeatmapQuery{Order: "invalid", Limit: 10})
+	assert.ErrorIs(t, err, util.ErrValidation)
+	_, err = GetAccessHeatmap(HeatmapQuery{})
+	assert.ErrorIs(t, err, util.ErrValidation)
+
+	heatmap, err := GetAccessHeatmap(HeatmapQuery{Limit: 10})
+	require.NoError(t, err)
+	if assert.Len(t, heatmap, 4) {
+		assert.Equal(t, "/dir/file1", heatmap[0].Path)
+		assert.Equal(t, int64(2), heatmap[0].Reads)
+		assert.Equal(t, int64(200), heatmap[0].ReadBytes)
+		assert.Greater(t, heatmap[0].LastAccess, int64(0))
+	}
+	heatmap, err = GetAccessHeatmap(HeatmapQuery{Order: HeatmapOrderWrittenBytes, Limit: 1})
+	require.NoError(t, err)
+	if assert.Len(t, heatmap, 1) {
+		assert.Equal(t, "/dir/file2", heatmap[0].Path)
+	}
+	heatmap, err = GetAccessHeatmap(HeatmapQuery{GroupByDir: true, Limit: 10})
+	require.NoError(t, err)
+	if assert.Len(t, heatmap, 3) {
+		assert.Equal(t, "/dir", heatmap[0].Path)
+		assert.Equal(t, int64(2), heatmap[0].Reads)
+		assert.Equal(t, int64(1), heatmap[0].Writes)
+	}
+	heatmap, err = GetAccessHeatmap(HeatmapQuery{Role: "role2", Limit: 10})
+	require.NoError(t, err)
+	assert.Len(t, heatmap, 0)
+	heatmap, err = GetAccessHeatmap(HeatmapQuery{Username: "missing", Limit: 10})
+	require.NoError(t, err)
+	assert.Len(t, heatmap, 0)
+
+	updateAccessAnalytics(conn, operationRename, "/dir", "/renamed", 0, nil)
+	heatmap, err = GetAccessHeatmap(HeatmapQuery{Order: HeatmapOrderLastAccess, Limit: 10})
+	require.NoError(t, err)
+	if assert.Len(t, heatmap, 4) {
+		paths := []string{heatmap[0].Path, heatmap[1].Path, heatmap[2].Path, heatmap[3].Path}
+		assert.Contains(t, paths, "/renamed/file1")
+		assert.Contains(t, paths, "/renamed/sub/file3")
+		assert.NotContains(t, paths, "/dir/file1")
+	}
+	updateAccessAnalytics(conn, operationRmdir, "/renamed/sub", "", 0, nil)
+	updateAccessAnalytics(conn, operationDelete, "/file4", "", 0, nil)
+	heatmap, err = GetAccessHeatmap(HeatmapQuery{Limit: 10})
+	require.NoError(t, err)
+	assert.Len(t, heatmap, 2)
+	assert.Equal(t, 2, accessTracker.numFiles)
+	// exceeding the limit evicts the least recently accessed files
+	for i := 0; i < 12; i++ {
+		updateAccessAnalytics(conn, operationUpload, filepath.ToSlash(filepath.Join("/files", util.GenerateUniqueID())),
+			"", 1, nil)
+	}
+	assert.LessOrEqual(t, accessTracker.numFiles, c.MaxTrackedFiles)
+	heatmap, err = GetAccessHeatmap(HeatmapQuery{Limit: 100})
+	require.NoError(t, err)
+	assert.Len(t, heatmap, accessTracker.numFiles)
+}
+
+func TestStorageReport(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "analytics_home")
+	err := os.MkdirAll(filepath.Join(homeDir, "dir"), os.ModePerm)
+	require.NoError(t, err)
+	files := map[string]int{
+		"file1.txt":     10,
+		"dir/file2.TXT": 20,
+		"dir/file3.zip": 100,
+		"noext":         5,
+	}
+	for name, size := range files {
+		err = os.WriteFile(filepath.Join(homeDir, name), make([]byte, size), 0666)
+		require.NoError(t, err)
+	}
+	oldTime := time.Now().Add(-48 * time.Hour)
+	err = os.Chtimes(filepath.Join(homeDir, "noext"), oldTime, oldTime)
+	require.NoError(t, err)
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "analytics_report_user",
+			HomeDir:  homeDir,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+	}
+	accessTracker = newFileAccessTracker(100)
+	defer func() {
+		accessTracker = nil
+	}()
+	conn := NewBaseConnection("", ProtocolSFTP, "", "", user)
+	updateAccessAnalytics(conn, operationDownload, "/dir/file3.zip", "", 100, nil)
+
+	report, err := GetStorageReport(user, 2)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), report.Files)
+	assert.Equal(t, int64(135), report.Size)
+	if assert.Len(t, report.Extensions, 3) {
+		assert.Equal(t, ".zip", report.Extensions[0].Extension)
+		assert.Equal(t, ".txt", report.Extensions[1].Extension)
+		assert.Equal(t, int64(2), report.Extensions[1].Files)
+		assert.Equal(t, int64(30), report.Extensions[1].Size)
+		assert.Equal(t, "", report.Extensions[2].Extension)
+	}
+	if assert.Len(t, report.ColdFiles, 2) {
+		assert.Equal(t, "/noext", report.ColdFiles[0].Path)
+		assert.NotEqual(t, "/dir/file3.zip", report.ColdFiles[1].Path)
+	}
+	// only one report for each user can run at the same time
+	assert.True(t, storageReports.add(user.Username))
+	_, err = GetStorageReport(user, 0)
+	assert.ErrorIs(t, err, ErrStorageReportInProgress)
+	storageReports.remove(user.Username)
+
+	err = os.RemoveAll(homeDir)
+	assert.NoError(t, err)
+	_, err = GetStorageReport(user, 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,258 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+// the SHA-256 checksums are stored as custom metadata for the uploaded files
+// together with the file size they refer to
+const (
+	checksumKeySHA256 = "sftpgo_sha256"
+	checksumKeySize   = "sftpgo_sha256_size"
+)
+
+var (
+	// ErrChecksumMismatch defines the error returned if a file does not match its stored checksum
+	ErrChecksumMismatch = errors.New("the file does not match its stored SHA-256 checksum")
+)
+
+// transferChecksum computes the SHA-256 checksum while uploading.
+// If the data is not written sequentially, starting from the beginning of
+// the file, the checksum is computed reading the uploaded file
+type transferChecksum struct {
+	sync.Mutex
+	hash    hash.Hash
+	written int64
+	valid   bool
+}
+
+func newTransferChecksum() *transferChecksum {
+	return &transferChecksum{
+		hash:  sha256.New(),
+		valid: true,
+	}
+}
+
+func (c *transferChecksum) update(p []byte, off int64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.valid {
+		return
+	}
+	if off >= 0 && off != c.written {
+		c.valid = false
+		return
+	}
+	c.hash.Write(p) //nolint:errcheck
+	c.written += int64(len(p))
+}
+
+// getSum returns the computed checksum if it covers the whole file
+func (c *transferChecksum) getSum(fileSize int64) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.valid || c.written != fileSize {
+		return "", false
+	}
+	return hex.EncodeToString(c.hash.Sum(nil)), true
+}
+
+// IsChecksumEnabled returns true if the SHA-256 checksums must be computed
+// and stored for the uploads
+func (c *BaseConnection) IsChecksumEnabled() bool {
+	return Config.StoreChecksums || c.User.Filters.StoreChecksums
+}
+
+// UpdateChecksum adds the data written at the specified offset to the
+// upload checksum. A negative offset means that the data is appended
+func (t *BaseTransfer) UpdateChecksum(p []byte, off int64) {
+	if t.checksum != nil && len(p) > 0 {
+		t.checksum.update(p, off)
+	}
+}
+
+// getChecksum returns the SHA-256 checksum for the uploaded file or an
+// empty string if checksums are disabled or the checksum cannot be computed
+func (t *BaseTransfer) getChecksum(fileSize int64) string {
+	if t.checksum == nil || t.ErrTransfer != nil {
+		return ""
+	}
+	if sum, ok := t.checksum.getSum(fileSize); ok {
+		return sum
+	}
+	fsPath := t.getUploadedFsPath()
+	sum, err := computeFileChecksum(t.Fs, fsPath)
+	if err != nil {
+		t.Connection.Log(logger.LevelWarn, "unable to compute the checksum for file %q: %v", fsPath, err)
+		return ""
+	}
+	return sum
+}
+
+// storeChecksum saves the checksum for the uploaded file. If no checksum is
+// available any stored checksum for an overwritten file is removed, it
+// refers to the previous contents
+func (t *BaseTransfer) storeChecksum(checksum string, fileSize int64) {
+	if t.ErrTransfer != nil {
+		return
+	}
+	var err error
+	if checksum != "" {
+		err = setFileChecksum(t.Connection.User.Username, t.requestPath, checksum, fileSize)
+	} else if !t.isNewFile {
+		err = removeFileChecksum(t.Connection.User.Username, t.requestPath)
+	}
+	if err != nil {
+		t.Connection.Log(logger.LevelWarn, "unable to update the checksum for file %q: %v", t.requestPath, err)
+	}
+}
+
+func setFileChecksum(username, virtualPath, checksum string, fileSize int64) error {
+	metadata, err := dataprovider.GetFileMetadata(username, virtualPath)
+	if err != nil {
+		if !errors.Is(err, util.ErrNotFound) {
+			return err
+		}
+		metadata = dataprovider.FileMetadata{
+			Path: virtualPath,
+		}
+	}
+	if metadata.Metadata == nil {
+		metadata.Metadata = make(map[string]string)
+	}
+	metadata.Metadata[checksumKeySHA256] = checksum
+	metadata.Metadata[checksumKeySize] = strconv.FormatInt(fileSize, 10)
+	return dataprovider.SetFileMetadata(username, &metadata)
+}
+
+func removeFileChecksum(username, virtualPath string) error {
+	metadata, err := dataprovider.GetFileMetadata(username, virtualPath)
+	if err != nil {
+		if errors.Is(err, util.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	if _, ok := metadata.Metadata[checksumKeySHA256]; !ok {
+		return nil
+	}
+	delete(metadata.Metadata, checksumKeySHA256)
+	delete(metadata.Metadata, checksumKeySize)
+	return dataprovider.SetFileMetadata(username, &metadata)
+}
+
+func computeFileChecksum(fs vfs.Fs, fsPath string) (string, error) {
+	f, r, cancelFn, err := fs.Open(fsPath, 0)
+	if err != nil {
+		return "", err
+	}
+	if cancelFn != nil {
+		defer cancelFn()
+	}
+	var reader io.ReadCloser = r
+	if f != nil {
+		reader = f
+	}
+	defer reader.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, reader); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// getStoredChecksum returns the stored SHA-256 checksum for the specified
+// file. Checksums stored for a different file size are ignored
+func (c *BaseConnection) getStoredChecksum(virtualPath string, fileSize int64) (string, error) {
+	metadata, err := dataprovider.GetFileMetadata(c.User.Username, virtualPath)
+	if err != nil {
+		return "", err
+	}
+	checksum := metadata.Metadata[checksumKeySHA256]
+	if checksum == "" || metadata.Metadata[checksumKeySize] != strconv.FormatInt(fileSize, 10) {
+		return "", util.NewRecordNotFoundError("no checksum stored for " + virtualPath)
+	}
+	return checksum, nil
+}
+
+// GetFileChecksum returns the SHA-256 checksum stored for the specified file.
+// The file must exist and be visible to the connection's user
+func (c *BaseConnection) GetFileChecksum(virtualPath string) (string, error) {
+	if !c.User.HasPerm(dataprovider.PermListItems, path.Dir(virtualPath)) {
+		return "", c.GetPermissionDeniedError()
+	}
+	info, err := c.DoStat(virtualPath, 0, true)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", util.NewValidationError("checksums are only available for files")
+	}
+	return c.getStoredChecksum(virtualPath, info.Size())
+}
+
+// GetStoredChecksum returns the SHA-256 checksum stored for the specified
+// file without any permission check, an empty string means that no checksum
+// is available
+func (c *BaseConnection) GetStoredChecksum(fs vfs.Fs, fsPath, virtualPath string) string {
+	info, err := fs.Stat(fsPath)
+	if err != nil || info.IsDir() {
+		return ""
+	}
+	checksum, err := c.getStoredChecksum(virtualPath, info.Size())
+	if err != nil {
+		return ""
+	}
+	return checksum
+}
+
+// VerifyFileChecksum computes the SHA-256 checksum for the specified file and
+// compares it with the stored one. The stored checksum is returned
+func (c *BaseConnection) VerifyFileChecksum(virtualPath string) (string, error) {
+	checksum, err := c.GetFileChecksum(virtualPath)
+	if err != nil {
+		return "", err
+	}
+	fs, fsPath, err := c.GetFsAndResolvedPath(virtualPath)
+	if err != nil {
+		return "", err
+	}
+	actual, err := computeFileChecksum(fs, fsPath)
+	if err != nil {
+		return "", c.GetFsError(fs, err)
+	}
+	if actual != checksum {
+		c.Log(logger.LevelWarn, "checksum mismatch for file %q, stored: %q, actual: %q", virtualPath, checksum, actual)
+		return "", ErrChecksumMismatch
+	}
+	return checksum, nil
+}
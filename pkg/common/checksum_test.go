@@ -0,0 +1,174 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+func TestTransferChecksum(t *testing.T) {
+	data := []byte("checksum content")
+	h := sha256.Sum256(data)
+	expected := hex.EncodeToString(h[:])
+
+	c := newTransferChecksum()
+	c.update(data[:5], 0)
+	c.update(data[5:], 5)
+	sum, ok := c.getSum(int64(len(data)))
+	assert.True(t, ok)
+	assert.Equal(t, expected, sum)
+	_, ok = c.getSum(int64(len(data) + 1))
+	assert.False(t, ok)
+
+	c = newTransferChecksum()
+	c.update(data[:5], -1)
+	c.update(data[5:], -1)
+	sum, ok = c.getSum(int64(len(data)))
+	assert.True(t, ok)
+	assert.Equal(t, expected, sum)
+	// out of order writes invalidate the checksum
+	c = newTransferChecksum()
+	c.update(data[5:], 5)
+	c.update(data[:5], 0)
+	_, ok = c.getSum(int64(len(data)))
+	assert.False(t, ok)
+}
+
+func TestUploadChecksum(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "checksum_home")
+	err := os.MkdirAll(filepath.Join(homeDir, "incoming"), os.ModePerm)
+	require.NoError(t, err)
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "checksum_user",
+			HomeDir:  homeDir,
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+	}
+	user.Filters.StoreChecksums = true
+	user.Filters.StagingFolders = []string{"/incoming"}
+	err = dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+	assert.True(t, user.Filters.StoreChecksums)
+	conn := NewBaseConnection("", ProtocolSFTP, "", "", user)
+	assert.True(t, conn.IsChecksumEnabled())
+
+	upload := func(conn *BaseConnection, virtualPath string, data []byte, sequential, isNewFile bool) string {
+		fs, fsPath, err := conn.GetFsAndResolvedPath(virtualPath)
+		require.NoError(t, err)
+		filePath, err := conn.GetUploadFsPath(fs, fsPath, virtualPath)
+		require.NoError(t, err)
+		err = os.WriteFile(filePath, data, 0666)
+		require.NoError(t, err)
+		transfer := NewBaseTransfer(nil, conn, nil, fsPath, filePath, virtualPath, TransferUpload, 0, 0, 0, 0, isNewFile,
+			fs, dataprovider.TransferQuota{})
+		if sequential {
+			transfer.UpdateChecksum(data[:5], 0)
+			transfer.UpdateChecksum(data[5:], 5)
+		} else {
+			transfer.UpdateChecksum(data[5:], 5)
+			transfer.UpdateChecksum(data[:5], 0)
+		}
+		transfer.BytesReceived.Store(int64(len(data)))
+		err = transfer.Close()
+		require.NoError(t, err)
+		return filepath.Base(filePath)
+	}
+	checksum := func(data []byte) string {
+		h := sha256.Sum256(data)
+		return hex.EncodeToString(h[:])
+	}
+
+	data := []byte("uploaded content")
+	upload(conn, "/file.txt", data, true, true)
+	sum, err := conn.GetFileChecksum("/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, checksum(data), sum)
+	fs, fsPath, err := conn.GetFsAndResolvedPath("/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, checksum(data), conn.GetStoredChecksum(fs, fsPath, "/file.txt"))
+	sum, err = conn.VerifyFileChecksum("/file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, checksum(data), sum)
+	// the stored checksum does not match the modified contents
+	err = os.WriteFile(fsPath, []byte("modified content"), 0666)
+	require.NoError(t, err)
+	_, err = conn.VerifyFileChecksum("/file.txt")
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	// a checksum stored for a different size is ignored
+	err = os.WriteFile(fsPath, []byte("modified"), 0666)
+	require.NoError(t, err)
+	_, err = conn.GetFileChecksum("/file.txt")
+	assert.ErrorIs(t, err, util.ErrNotFound)
+	assert.Empty(t, conn.GetStoredChecksum(fs, fsPath, "/file.txt"))
+	_, err = conn.GetFileChecksum("/missing")
+	assert.True(t, conn.IsNotExistError(err))
+	_, err = conn.GetFileChecksum("/incoming")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	// the checksum is computed reading the file if the writes are not sequential
+	upload(conn, "/file.txt", data, false, false)
+	sum, err = conn.GetFileChecksum("/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, checksum(data), sum)
+	// custom metadata are preserved
+	metadata, err := dataprovider.GetFileMetadata(user.Username, "/file.txt")
+	require.NoError(t, err)
+	metadata.Metadata["key"] = "value"
+	err = dataprovider.SetFileMetadata(user.Username, &metadata)
+	require.NoError(t, err)
+	// overwriting the file with checksums disabled removes the stored checksum
+	user.Filters.StoreChecksums = false
+	connNoChecksum := NewBaseConnection("", ProtocolSFTP, "", "", user)
+	assert.False(t, connNoChecksum.IsChecksumEnabled())
+	upload(connNoChecksum, "/file.txt", data, true, false)
+	_, err = conn.GetFileChecksum("/file.txt")
+	assert.ErrorIs(t, err, util.ErrNotFound)
+	metadata, err = dataprovider.GetFileMetadata(user.Username, "/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"key": "value"}, metadata.Metadata)
+	// staged uploads
+	id := upload(conn, "/incoming/file.txt", data, true, true)
+	item, err := getStagedItem(user.Username, id)
+	require.NoError(t, err)
+	assert.Equal(t, checksum(data), item.SHA256)
+	err = PublishStagedItem(user.Username, id, "invalid")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	err = PublishStagedItem(user.Username, id, checksum(data))
+	require.NoError(t, err)
+	sum, err = conn.GetFileChecksum("/incoming/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, checksum(data), sum)
+
+	err = dataprovider.DeleteUser(user.Username, "", "", "")
+	assert.NoError(t, err)
+	err = os.RemoveAll(homeDir)
+	assert.NoError(t, err)
+}
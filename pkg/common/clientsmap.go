@@ -63,3 +63,14 @@ func (c *clientsMap) getTotalFrom(source string) int {
 
 	return c.clients[source]
 }
+
+func (c *clientsMap) getAll() map[string]int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	result := make(map[string]int)
+	for source, val := range c.clients {
+		result[source] = val
+	}
+	return result
+}
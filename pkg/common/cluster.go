@@ -0,0 +1,157 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	defaultClusterSyncInterval = 10
+)
+
+var (
+	// connections published by the other cluster nodes, nil if clustering is disabled
+	clusterConns atomic.Pointer[clusterConnections]
+)
+
+// ClusterConfig defines the configuration to share the active connections
+// between the nodes of an active-active cluster. Clustering requires a shared
+// data provider and the data provider node configuration. The shared data
+// provider also shares the active transfers, used for the transfer quota
+// checks, and the defender, if enabled, must use a shared driver.
+// The connection limits are eventually consistent: each node checks the new
+// connections against the counters loaded at the last sync, so nodes racing
+// for the last slot can both accept a connection until the next sync
+type ClusterConfig struct {
+	// Set to true to enforce max_sessions, max_total_connections and
+	// max_per_host_connections cluster-wide
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// Interval, in seconds, to publish the local connections and to load
+	// the ones from the other nodes. 0 means the default (10 seconds)
+	SyncInterval int `json:"sync_interval" mapstructure:"sync_interval"`
+}
+
+func (c *ClusterConfig) getSyncInterval() time.Duration {
+	if c.SyncInterval <= 0 {
+		return defaultClusterSyncInterval * time.Second
+	}
+	return time.Duration(c.SyncInterval) * time.Second
+}
+
+func (c *ClusterConfig) validate(isShared int) error {
+	clusterConns.Store(nil)
+	if !c.Enabled {
+		return nil
+	}
+	if c.SyncInterval < 0 {
+		return fmt.Errorf("cluster: invalid sync interval %d", c.SyncInterval)
+	}
+	if Config.DefenderConfig.Enabled && Config.DefenderConfig.Driver == DefenderDriverMemory {
+		return fmt.Errorf("cluster: the defender %q driver does not share scores and bans between nodes, use %q or %q",
+			DefenderDriverMemory, DefenderDriverProvider, DefenderDriverRedis)
+	}
+	if isShared != 1 || dataprovider.GetNodeName() == "" {
+		return errors.New("cluster: a shared data provider and the data provider node configuration are required")
+	}
+	clusterConns.Store(&clusterConnections{
+		hosts: make(map[string]int),
+		users: make(map[string]int),
+	})
+	return nil
+}
+
+// clusterConnections holds the aggregated connections of the other cluster nodes
+type clusterConnections struct {
+	clients  int
+	sessions int
+	hosts    map[string]int
+	users    map[string]int
+}
+
+func getClusterConnections() *clusterConnections {
+	if c := clusterConns.Load(); c != nil {
+		return c
+	}
+	return &clusterConnections{}
+}
+
+// syncClusterConnections publishes the connections for this node and
+// loads the ones published by the other nodes
+func syncClusterConnections() {
+	if clusterConns.Load() == nil {
+		return
+	}
+	if err := dataprovider.UpdateNodeConnections(Connections.getNodeConnections()); err != nil {
+		logger.Warn(logSender, "", "unable to publish cluster connections: %v", err)
+	}
+	nodes, err := dataprovider.GetNodes()
+	if err != nil {
+		logger.Warn(logSender, "", "unable to load cluster connections: %v", err)
+		return
+	}
+	conns := newClusterConnections(nodes)
+	clusterConns.Store(conns)
+	logger.Debug(logSender, "", "cluster connections synced, nodes: %d, clients: %d, sessions: %d",
+		len(nodes), conns.clients, conns.sessions)
+}
+
+// newClusterConnections aggregates the connections published by the specified nodes
+func newClusterConnections(nodes []dataprovider.Node) *clusterConnections {
+	// ignore the counters not updated recently, the node could be down
+	limit := util.GetTimeAsMsSinceEpoch(time.Now().Add(-3 * Config.Cluster.getSyncInterval()))
+	conns := &clusterConnections{
+		hosts: make(map[string]int),
+		users: make(map[string]int),
+	}
+	for _, node := range nodes {
+		nodeConns := node.Data.Connections
+		if nodeConns == nil || nodeConns.UpdatedAt < limit {
+			continue
+		}
+		conns.clients += nodeConns.Clients
+		conns.sessions += nodeConns.Sessions
+		for host, val := range nodeConns.Hosts {
+			conns.hosts[host] += val
+		}
+		for username, val := range nodeConns.Users {
+			conns.users[username] += val
+		}
+	}
+	return conns
+}
+
+func (conns *ActiveConnections) getNodeConnections() *dataprovider.NodeConnections {
+	result := &dataprovider.NodeConnections{
+		Clients: int(conns.clients.getTotal()),
+		Hosts:   conns.clients.getAll(),
+	}
+	conns.RLock()
+	defer conns.RUnlock()
+
+	result.Sessions = len(conns.connections)
+	result.Users = make(map[string]int)
+	for username, val := range conns.perUserConns {
+		result.Users[username] = val
+	}
+	return result
+}
@@ -0,0 +1,202 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+func TestClusterConfigValidate(t *testing.T) {
+	c := ClusterConfig{}
+	assert.NoError(t, c.validate(1))
+	assert.Nil(t, clusterConns.Load())
+	assert.Equal(t, defaultClusterSyncInterval*time.Second, c.getSyncInterval())
+	c.Enabled = true
+	c.SyncInterval = -1
+	assert.Error(t, c.validate(1))
+	c.SyncInterval = 5
+	assert.Equal(t, 5*time.Second, c.getSyncInterval())
+	// the memory defender is per node
+	oldDefenderConfig := Config.DefenderConfig
+	Config.DefenderConfig.Enabled = true
+	Config.DefenderConfig.Driver = DefenderDriverMemory
+	err := c.validate(1)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "does not share scores and bans")
+	}
+	Config.DefenderConfig.Driver = DefenderDriverProvider
+	err = c.validate(0)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "shared data provider")
+	}
+	Config.DefenderConfig = oldDefenderConfig
+	// the test data provider is not shared and no node is configured
+	err = c.validate(0)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "shared data provider")
+	}
+	assert.Error(t, c.validate(1))
+	assert.Nil(t, clusterConns.Load())
+	// sync is a no-op if clustering is disabled
+	syncClusterConnections()
+	assert.Nil(t, clusterConns.Load())
+}
+
+func TestClusterConnectionLimits(t *testing.T) {
+	oldMaxTotal := Config.MaxTotalConnections
+	oldPerHost := Config.MaxPerHostConnections
+	defer func() {
+		Config.MaxTotalConnections = oldMaxTotal
+		Config.MaxPerHostConnections = oldPerHost
+		clusterConns.Store(nil)
+	}()
+
+	ipAddr := "192.168.10.11"
+	username := "cluster_user"
+	clusterConns.Store(&clusterConnections{
+		clients:  2,
+		sessions: 2,
+		hosts:    map[string]int{ipAddr: 2},
+		users:    map[string]int{username: 1},
+	})
+
+	Config.MaxTotalConnections = 0
+	Config.MaxPerHostConnections = 2
+	Connections.AddClientConnection(ipAddr)
+	assert.Error(t, Connections.IsNewConnectionAllowed(ipAddr, ProtocolSFTP))
+	assert.NoError(t, Connections.IsNewConnectionAllowed("192.168.10.12", ProtocolSFTP))
+	Connections.RemoveClientConnection(ipAddr)
+
+	Config.MaxPerHostConnections = 0
+	Config.MaxTotalConnections = 3
+	assert.NoError(t, Connections.IsNewConnectionAllowed(ipAddr, ProtocolSFTP))
+	Connections.AddClientConnection(ipAddr)
+	Connections.AddClientConnection(ipAddr)
+	assert.Error(t, Connections.IsNewConnectionAllowed(ipAddr, ProtocolSFTP))
+	Connections.RemoveClientConnection(ipAddr)
+	Connections.RemoveClientConnection(ipAddr)
+
+	Config.MaxTotalConnections = 0
+	assert.Equal(t, 1, Connections.GetActiveSessions(username))
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username:    username,
+			MaxSessions: 2,
+		},
+	}
+	conn1 := &fakeConnection{
+		BaseConnection: NewBaseConnection("cluster1", ProtocolSFTP, "", "", user),
+	}
+	err := Connections.Add(conn1)
+	require.NoError(t, err)
+	assert.Equal(t, 2, Connections.GetActiveSessions(username))
+	conn2 := &fakeConnection{
+		BaseConnection: NewBaseConnection("cluster2", ProtocolSFTP, "", "", user),
+	}
+	err = Connections.Add(conn2)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "too many open sessions: 2/2")
+	}
+	nodeConns := Connections.getNodeConnections()
+	assert.Equal(t, 1, nodeConns.Sessions)
+	assert.Equal(t, 1, nodeConns.Users[username])
+	Connections.Remove(conn1.GetID())
+	assert.Equal(t, 1, Connections.GetActiveSessions(username))
+}
+
+func TestClusterLastSessionRace(t *testing.T) {
+	defer clusterConns.Store(nil)
+
+	nodeA := &Connections
+	nodeB := &ActiveConnections{
+		clients: clientsMap{
+			clients: make(map[string]int),
+		},
+		perUserConns: make(map[string]int),
+		mapping:      make(map[string]int),
+		sshMapping:   make(map[string]int),
+	}
+	// each node checks the new connections against the counters published
+	// by the other node at the last sync
+	publish := func(conns *ActiveConnections) []dataprovider.Node {
+		nodeConns := conns.getNodeConnections()
+		nodeConns.UpdatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+		return []dataprovider.Node{
+			{
+				Data: dataprovider.NodeData{
+					Connections: nodeConns,
+				},
+			},
+		}
+	}
+	addToNode := func(node *ActiveConnections, view *clusterConnections, conn ActiveConnection) error {
+		clusterConns.Store(view)
+		return node.Add(conn)
+	}
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username:    "cluster_race_user",
+			MaxSessions: 2,
+		},
+	}
+	newConn := func(id string) *fakeConnection {
+		return &fakeConnection{
+			BaseConnection: NewBaseConnection(id, ProtocolSFTP, "", "", user),
+		}
+	}
+	connB1 := newConn("race_b1")
+	err := addToNode(nodeB, newClusterConnections(publish(nodeA)), connB1)
+	require.NoError(t, err)
+	defer nodeB.Remove(connB1.GetID())
+	// sync, one slot is left
+	viewA := newClusterConnections(publish(nodeB))
+	viewB := newClusterConnections(publish(nodeA))
+	assert.Equal(t, 1, viewA.users[user.Username])
+	assert.Equal(t, 0, viewB.users[user.Username])
+	// both nodes accept a connection for the last slot before the next sync
+	connA1 := newConn("race_a1")
+	err = addToNode(nodeA, viewA, connA1)
+	require.NoError(t, err)
+	defer nodeA.Remove(connA1.GetID())
+	connB2 := newConn("race_b2")
+	err = addToNode(nodeB, viewB, connB2)
+	require.NoError(t, err)
+	defer nodeB.Remove(connB2.GetID())
+	assert.Equal(t, 1, nodeA.getNodeConnections().Users[user.Username])
+	assert.Equal(t, 2, nodeB.getNodeConnections().Users[user.Username])
+	// after the next sync the limit is exceeded and both nodes deny new connections
+	viewA = newClusterConnections(publish(nodeB))
+	viewB = newClusterConnections(publish(nodeA))
+	err = addToNode(nodeA, viewA, newConn("race_a2"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "too many open sessions: 3/2")
+	}
+	err = addToNode(nodeB, viewB, newConn("race_b3"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "too many open sessions: 3/2")
+	}
+	// stale counters are ignored, the node could be down
+	nodes := publish(nodeB)
+	nodes[0].Data.Connections.UpdatedAt = util.GetTimeAsMsSinceEpoch(time.Now().Add(-time.Hour))
+	assert.Equal(t, 0, newClusterConnections(nodes).users[user.Username])
+}
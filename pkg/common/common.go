@@ -33,14 +33,17 @@ import (
 
 	"github.com/pires/go-proxyproto"
 	"github.com/sftpgo/sdk/plugin/notifier"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/drakkan/sftpgo/v2/pkg/command"
 	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/geoip"
 	"github.com/drakkan/sftpgo/v2/pkg/httpclient"
 	"github.com/drakkan/sftpgo/v2/pkg/logger"
 	"github.com/drakkan/sftpgo/v2/pkg/metric"
 	"github.com/drakkan/sftpgo/v2/pkg/plugin"
 	"github.com/drakkan/sftpgo/v2/pkg/smtp"
+	"github.com/drakkan/sftpgo/v2/pkg/tracing"
 	"github.com/drakkan/sftpgo/v2/pkg/util"
 	"github.com/drakkan/sftpgo/v2/pkg/vfs"
 )
@@ -67,6 +70,12 @@ const (
 	operationFirstUpload   = "first-upload"
 	operationDelete        = "delete"
 	operationCopy          = "copy"
+	// operationSessionTerminated is notified when a session is closed because it
+	// exceeded the configured idle timeout or max duration
+	operationSessionTerminated = "session-terminated"
+	// operationUploadRejected is notified when an upload, a rename or a copy
+	// is rejected by the MIME policy
+	operationUploadRejected = "upload-rejected"
 	// Pre-download action name
 	OperationPreDownload = "pre-download"
 	// Pre-upload action name
@@ -107,7 +116,9 @@ const (
 	ProtocolHTTP          = "HTTP"
 	ProtocolHTTPShare     = "HTTPShare"
 	ProtocolDataRetention = "DataRetention"
+	ProtocolBackgroundJob = "BackgroundJob"
 	ProtocolOIDC          = "OIDC"
+	ProtocolSAML          = "SAML"
 	protocolEventAction   = "EventAction"
 )
 
@@ -142,8 +153,13 @@ var (
 	ErrInternalFailure   = errors.New("internal failure")
 	ErrTransferAborted   = errors.New("transfer aborted")
 	ErrShuttingDown      = errors.New("the service is shutting down")
-	errNoTransfer        = errors.New("requested transfer not found")
-	errTransferMismatch  = errors.New("transfer mismatch")
+	ErrFolderTransfers   = errors.New("too many concurrent transfers for this folder")
+	ErrWORMProtected     = errors.New("the file is write protected until its retention expires")
+	ErrContentTypeDenied = errors.New("the file content type is not allowed")
+	// ErrMemoryBudgetExhausted is returned if no transfer buffer is released within the wait timeout
+	ErrMemoryBudgetExhausted = errors.New("no transfer buffer available, the memory budget is exhausted")
+	errNoTransfer            = errors.New("requested transfer not found")
+	errTransferMismatch      = errors.New("transfer mismatch")
 )
 
 var (
@@ -157,7 +173,7 @@ var (
 	ActiveMetadataChecks MetadataChecks
 	transfersChecker     TransfersChecker
 	supportedProtocols   = []string{ProtocolSFTP, ProtocolSCP, ProtocolSSH, ProtocolFTP, ProtocolWebDAV,
-		ProtocolHTTP, ProtocolHTTPShare, ProtocolOIDC}
+		ProtocolHTTP, ProtocolHTTPShare, ProtocolOIDC, ProtocolSAML}
 	disconnHookProtocols = []string{ProtocolSFTP, ProtocolSCP, ProtocolSSH, ProtocolFTP}
 	// the map key is the protocol, for each protocol we can have multiple rate limiters
 	rateLimiters     map[string][]*rateLimiter
@@ -197,6 +213,12 @@ func Initialize(c Configuration, isShared int) error {
 		}
 		Config.rateLimitersList = rateLimitersList
 	}
+	if err := logger.InitAuditLog(c.AuditLog); err != nil {
+		return fmt.Errorf("audit log initialization error: %w", err)
+	}
+	if err := Config.GeoIP.initialize(); err != nil {
+		return err
+	}
 	if c.DefenderConfig.Enabled {
 		if !util.Contains(supportedDefenderDrivers, c.DefenderConfig.Driver) {
 			return fmt.Errorf("unsupported defender driver %q", c.DefenderConfig.Driver)
@@ -206,15 +228,134 @@ func Initialize(c Configuration, isShared int) error {
 		switch c.DefenderConfig.Driver {
 		case DefenderDriverProvider:
 			defender, err = newDBDefender(&c.DefenderConfig)
+		case DefenderDriverRedis:
+			defender, err = newRedisDefender(&c.DefenderConfig)
 		default:
 			defender, err = newInMemoryDefender(&c.DefenderConfig)
 		}
 		if err != nil {
 			return fmt.Errorf("defender initialization error: %v", err)
 		}
-		logger.Info(logSender, "", "defender initialized with config %+v", c.DefenderConfig)
+		logger.Info(logSender, "", "defender initialized with config %+v", c.DefenderConfig.getRedactedConfig())
 		Config.defender = defender
 	}
+	if err := initializeDefenderIntegrations(&Config.DefenderConfig); err != nil {
+		return fmt.Errorf("defender integrations initialization error: %w", err)
+	}
+	if err := Config.Fairness.validate(); err != nil {
+		return err
+	}
+	if err := Config.MemoryBudget.validate(); err != nil {
+		return err
+	}
+	transferBuffers = newTransferBufferPool(Config.MemoryBudget)
+	if Config.MemoryBudget.MaxMemory > 0 || Config.MemoryBudget.MaxConnectionMemory > 0 {
+		logger.Info(logSender, "", "transfer buffers memory budget enabled, buffer size: %d KB, max memory: %d MB, max connection memory: %d KB",
+			Config.MemoryBudget.getBufferSize()/1024, Config.MemoryBudget.MaxMemory, Config.MemoryBudget.MaxConnectionMemory)
+	}
+	if err := Config.Cluster.validate(isShared); err != nil {
+		return err
+	}
+	if Config.Cluster.Enabled {
+		spec := fmt.Sprintf("@every %s", Config.Cluster.getSyncInterval())
+		if _, err := eventScheduler.AddFunc(spec, syncClusterConnections); err != nil {
+			return fmt.Errorf("unable to schedule cluster connections sync: %w", err)
+		}
+		logger.Info(logSender, "", "cluster enabled, node %q, connections sync schedule %q",
+			dataprovider.GetNodeName(), spec)
+	}
+	searchIndexer = nil
+	if c.Search.Enabled {
+		indexer, err := newSearchManager(c.Search)
+		if err != nil {
+			return fmt.Errorf("search index initialization error: %w", err)
+		}
+		logger.Info(logSender, "", "search index initialized, driver: %q", c.Search.Driver)
+		searchIndexer = indexer
+	}
+	if err := c.Analytics.validate(); err != nil {
+		return err
+	}
+	accessTracker = nil
+	if c.Analytics.Enabled {
+		accessTracker = newFileAccessTracker(c.Analytics.MaxTrackedFiles)
+		logger.Info(logSender, "", "file access analytics enabled, max tracked files: %d", c.Analytics.MaxTrackedFiles)
+	}
+	if err := c.UserWebhooks.validate(); err != nil {
+		return err
+	}
+	userWebhooksLimiter = nil
+	if c.UserWebhooks.Enabled {
+		userWebhooksLimiter = c.UserWebhooks.getLimiter()
+		logger.Info(logSender, "", "user webhooks enabled, rate limit: %d", c.UserWebhooks.RateLimit)
+	}
+	if err := Config.Consents.validate(); err != nil {
+		return err
+	}
+	if err := Config.SFTPFsPool.Validate(); err != nil {
+		return err
+	}
+	if err := Config.QoS.validate(); err != nil {
+		return err
+	}
+	if err := Config.PullJobs.validate(); err != nil {
+		return err
+	}
+	if err := Config.ObjectCache.Validate(); err != nil {
+		return err
+	}
+	if err := Config.DirListCache.Validate(); err != nil {
+		return err
+	}
+	if err := Config.Dedup.Validate(); err != nil {
+		return err
+	}
+	if Config.Dedup.IsEnabled() {
+		spec := fmt.Sprintf("@every %dm", Config.Dedup.GCInterval)
+		if _, err := eventScheduler.AddFunc(spec, runDedupGC); err != nil {
+			return fmt.Errorf("unable to schedule dedup GC: %w", err)
+		}
+		logger.Info(logSender, "", "deduplication enabled, store %q, GC schedule %q", Config.Dedup.StorePath, spec)
+	}
+	if err := Config.ScheduledQuotaScans.validate(); err != nil {
+		return err
+	}
+	ScheduledQuotaScans.init(Config.ScheduledQuotaScans)
+	if Config.ScheduledQuotaScans.isEnabled() {
+		spec := fmt.Sprintf("@every %dm", Config.ScheduledQuotaScans.Interval)
+		if _, err := eventScheduler.AddFunc(spec, ScheduledQuotaScans.runScheduled); err != nil {
+			return fmt.Errorf("unable to schedule quota scans: %w", err)
+		}
+		logger.Info(logSender, "", "scheduled quota scans enabled, schedule %q, incremental: %t",
+			spec, Config.ScheduledQuotaScans.Incremental)
+	}
+	if err := Config.Jobs.validate(); err != nil {
+		return err
+	}
+	Jobs.init(Config.Jobs)
+	if Config.Jobs.isEnabled() {
+		if _, err := eventScheduler.AddFunc("@every 30m", Jobs.cleanup); err != nil {
+			return fmt.Errorf("unable to schedule background jobs cleanup: %w", err)
+		}
+		logger.Info(logSender, "", "background jobs enabled, max concurrent jobs: %d, retention: %d hours",
+			Config.Jobs.MaxConcurrentJobs, Config.Jobs.Retention)
+	}
+	if err := Config.ProviderBackups.validate(); err != nil {
+		return err
+	}
+	if Config.ProviderBackups.isEnabled() {
+		if _, err := eventScheduler.AddFunc(Config.ProviderBackups.Schedule, Config.ProviderBackups.runScheduled); err != nil {
+			return fmt.Errorf("unable to schedule provider backups: %w", err)
+		}
+		logger.Info(logSender, "", "provider backups enabled, schedule %q, encrypt: %t, remote folder: %q",
+			Config.ProviderBackups.Schedule, Config.ProviderBackups.Encrypt, Config.ProviderBackups.RemoteFolder)
+	}
+	qos = nil
+	if Config.QoS.isEnabled() {
+		qos = newQoSScheduler(Config.QoS)
+		logger.Info(logSender, "", "global bandwidth limits enabled, upload: %d KB/s, download: %d KB/s, classes: %d",
+			Config.QoS.UploadBandwidth, Config.QoS.DownloadBandwidth, len(Config.QoS.Classes))
+	}
 	if c.AllowListStatus > 0 {
 		allowList, err := dataprovider.NewIPList(dataprovider.IPListTypeAllowList)
 		if err != nil {
@@ -230,6 +371,10 @@ func Initialize(c Configuration, isShared int) error {
 	dataprovider.SetTempPath(c.TempPath)
 	vfs.SetAllowSelfConnections(c.AllowSelfConnections)
 	vfs.SetRenameMode(c.RenameMode)
+	vfs.SetSFTPPoolConfig(Config.SFTPFsPool)
+	vfs.SetObjectCacheConfig(Config.ObjectCache)
+	vfs.SetDirListCacheConfig(Config.DirListCache)
+	vfs.SetDedupConfig(Config.Dedup)
 	dataprovider.SetAllowSelfConnections(c.AllowSelfConnections)
 	transfersChecker = getTransfersChecker(isShared)
 	return nil
@@ -301,6 +446,25 @@ func getActiveConnections() int {
 // It returns an error if the time to wait exceeds the max
 // allowed delay
 func LimitRate(protocol, ip string) (time.Duration, error) {
+	return limitRate(protocol, ip, "", "")
+}
+
+// LimitHTTPRate is like LimitRate but it only applies the HTTP rate limiters
+// that are not per-user and match the specified URL path
+func LimitHTTPRate(ip, urlPath string) (time.Duration, error) {
+	return limitRate(ProtocolHTTP, ip, "", urlPath)
+}
+
+// LimitHTTPUserRate applies the per-user HTTP rate limiters matching the
+// specified URL path. The key identifies the authenticated user or API key
+func LimitHTTPUserRate(ip, key, urlPath string) (time.Duration, error) {
+	if key == "" {
+		return 0, nil
+	}
+	return limitRate(ProtocolHTTP, ip, key, urlPath)
+}
+
+func limitRate(protocol, ip, userKey, urlPath string) (time.Duration, error) {
 	if Config.rateLimitersList != nil {
 		isListed, _, err := Config.rateLimitersList.IsListed(ip, protocol)
 		if err == nil && isListed {
@@ -308,18 +472,27 @@ func LimitRate(protocol, ip string) (time.Duration, error) {
 		}
 	}
 	for _, limiter := range rateLimiters[protocol] {
-		if delay, err := limiter.Wait(ip, protocol); err != nil {
-			logger.Debug(logSender, "", "protocol %s ip %s: %v", protocol, ip, err)
+		if limiter.isUserLimiter() != (userKey != "") || !limiter.matchesHTTPRoute(urlPath) {
+			continue
+		}
+		source := ip
+		if limiter.isUserLimiter() {
+			source = userKey
+		}
+		if delay, err := limiter.Wait(source, protocol); err != nil {
+			logger.Debug(logSender, "", "protocol %s ip %s user key %q: %v", protocol, ip, userKey, err)
+			metric.AddRateLimitedRequest(protocol, limiter.getTypeAsString())
 			return delay, err
 		}
 	}
 	return 0, nil
 }
 
-// Reload reloads the whitelist, the IP filter plugin and the defender's block and safe lists
+// Reload reloads the whitelist, the IP filter plugin, the defender's block and safe lists
+// and the geoip database
 func Reload() error {
 	plugin.Handler.ReloadFilter()
-	return nil
+	return geoip.Reload()
 }
 
 // IsBanned returns true if the specified IP address is banned
@@ -380,13 +553,33 @@ func GetDefenderScore(ip string) (int, error) {
 	return Config.defender.GetScore(ip)
 }
 
-// AddDefenderEvent adds the specified defender event for the given IP
+// GetDefenderHostStatus returns the escalation stage and history for the given IP
+func GetDefenderHostStatus(ip string) (DefenderHostStatus, error) {
+	if Config.defender == nil {
+		return DefenderHostStatus{}, errors.New("defender is disabled")
+	}
+
+	return Config.defender.GetHostStatus(ip)
+}
+
+// AddDefenderEvent adds the specified defender event for the given IP.
+// Failed authentication attempts from throttled hosts are delayed
 func AddDefenderEvent(ip, protocol string, event HostEvent) {
 	if Config.defender == nil {
 		return
 	}
 
 	Config.defender.AddEvent(ip, protocol, event)
+	if event == HostEventLoginFailed || event == HostEventUserNotFound {
+		if delay := Config.defender.GetThrottleDelay(ip); delay > 0 {
+			logger.Debug(logSender, "", "throttling failed authentication from %q, delay: %s", ip, delay)
+			time.Sleep(delay)
+		}
+	}
+}
+
+func runDedupGC() {
+	vfs.RunDedupGC() //nolint:errcheck // the result is logged
 }
 
 func startPeriodicChecks(duration time.Duration, isShared int) {
@@ -400,13 +593,16 @@ func startPeriodicChecks(duration time.Duration, isShared int) {
 		_, err := eventScheduler.AddFunc("@every 10m", smtp.ReloadProviderConf)
 		util.PanicOnError(err)
 	}
-	if Config.IdleTimeout > 0 {
-		ratio := idleTimeoutCheckInterval / periodicTimeoutCheckInterval
-		spec = fmt.Sprintf("@every %s", duration*ratio)
-		_, err = eventScheduler.AddFunc(spec, Connections.checkIdles)
-		util.PanicOnError(err)
-		logger.Info(logSender, "", "scheduled idle connections check, schedule %q", spec)
-	}
+	// idle timeouts and max session durations can also be defined per user/group
+	// so we always check idle connections
+	ratio := idleTimeoutCheckInterval / periodicTimeoutCheckInterval
+	spec = fmt.Sprintf("@every %s", duration*ratio)
+	_, err = eventScheduler.AddFunc(spec, Connections.checkIdles)
+	util.PanicOnError(err)
+	logger.Info(logSender, "", "scheduled idle connections check, schedule %q", spec)
+	_, err = eventScheduler.AddFunc(sharesCheckInterval, checkShares)
+	util.PanicOnError(err)
+	logger.Info(logSender, "", "scheduled shares check, schedule %q", sharesCheckInterval)
 }
 
 // ActiveTransfer defines the interface for the current active transfers
@@ -424,6 +620,8 @@ type ActiveTransfer interface {
 	SetTimes(fsPath string, atime time.Time, mtime time.Time) bool
 	GetTruncatedSize() int64
 	HasSizeLimit() bool
+	SetBandwidthLimit(bandwidth int64)
+	GetBandwidthLimit() int64
 }
 
 // ActiveConnection defines the interface for the current active connections
@@ -432,6 +630,7 @@ type ActiveConnection interface {
 	GetUsername() string
 	GetRole() string
 	GetMaxSessions() int
+	GetSessionPolicy() dataprovider.SessionPolicy
 	GetLocalAddress() string
 	GetRemoteAddress() string
 	GetClientVersion() string
@@ -444,6 +643,7 @@ type ActiveConnection interface {
 	RemoveTransfer(t ActiveTransfer)
 	GetTransfers() []ConnectionTransfer
 	SignalTransferClose(transferID int64, err error)
+	SetTransferBandwidthLimit(transferID int64, bandwidth int64) bool
 	CloseFS() error
 }
 
@@ -460,14 +660,15 @@ type StatAttributes struct {
 
 // ConnectionTransfer defines the trasfer details
 type ConnectionTransfer struct {
-	ID            int64  `json:"-"`
-	OperationType string `json:"operation_type"`
-	StartTime     int64  `json:"start_time"`
-	Size          int64  `json:"size"`
-	VirtualPath   string `json:"path"`
-	HasSizeLimit  bool   `json:"-"`
-	ULSize        int64  `json:"-"`
-	DLSize        int64  `json:"-"`
+	ID             int64  `json:"id"`
+	OperationType  string `json:"operation_type"`
+	StartTime      int64  `json:"start_time"`
+	Size           int64  `json:"size"`
+	VirtualPath    string `json:"path"`
+	BandwidthLimit int64  `json:"bandwidth_limit,omitempty"`
+	HasSizeLimit   bool   `json:"-"`
+	ULSize         int64  `json:"-"`
+	DLSize         int64  `json:"-"`
 }
 
 func (t *ConnectionTransfer) getConnectionTransferAsString() string {
@@ -556,10 +757,18 @@ type Configuration struct {
 	// Absolute path to an external program or an HTTP URL to invoke after a data retention check completes.
 	// Leave empty do disable.
 	DataRetentionHook string `json:"data_retention_hook" mapstructure:"data_retention_hook"`
+	// Absolute path to an external program or an HTTP URL to invoke to validate the uploads
+	// to staging folders. Uploads are published if the hook succeeds. Leave empty do disable.
+	StagingHook string `json:"staging_hook" mapstructure:"staging_hook"`
+	// If enabled, the SHA-256 checksum is computed while uploading and stored as file metadata.
+	// Checksums can also be enabled for specific users
+	StoreChecksums bool `json:"store_checksums" mapstructure:"store_checksums"`
 	// Maximum number of concurrent client connections. 0 means unlimited
 	MaxTotalConnections int `json:"max_total_connections" mapstructure:"max_total_connections"`
 	// Maximum number of concurrent client connections from the same host (IP). 0 means unlimited
 	MaxPerHostConnections int `json:"max_per_host_connections" mapstructure:"max_per_host_connections"`
+	// Admission policy to share max_total_connections between hosts, users and roles
+	Fairness FairnessConfig `json:"fairness" mapstructure:"fairness"`
 	// Defines the status of the global allow list. 0 means disabled, 1 enabled.
 	// If enabled, only the listed IPs/networks can access the configured services, all other
 	// client connections will be dropped before they even try to authenticate.
@@ -568,10 +777,47 @@ type Configuration struct {
 	// Allow users on this instance to use other users/virtual folders on this instance as storage backend.
 	// Enable this setting if you know what you are doing.
 	AllowSelfConnections int `json:"allow_self_connections" mapstructure:"allow_self_connections"`
+	// If enabled the downloads from the local filesystem are sent using sendfile, if supported
+	// by the connection, avoiding to copy the file contents in user space
+	ZeroCopyDownloads bool `json:"zero_copy_downloads" mapstructure:"zero_copy_downloads"`
+	// Memory budget and buffers reuse for the SFTP/SCP, FTP and WebDAV transfers
+	MemoryBudget MemoryBudgetConfig `json:"memory_budget" mapstructure:"memory_budget"`
 	// Defender configuration
 	DefenderConfig DefenderConfig `json:"defender" mapstructure:"defender"`
+	// IP geolocation configuration
+	GeoIP GeoIPConfig `json:"geoip" mapstructure:"geoip"`
 	// Rate limiter configurations
-	RateLimitersConfig    []RateLimiterConfig `json:"rate_limiters" mapstructure:"rate_limiters"`
+	RateLimitersConfig []RateLimiterConfig `json:"rate_limiters" mapstructure:"rate_limiters"`
+	// Search index configuration
+	Search SearchConfig `json:"search" mapstructure:"search"`
+	// File access analytics configuration
+	Analytics AnalyticsConfig `json:"analytics" mapstructure:"analytics"`
+	// Webhooks registered by the users for their folders
+	UserWebhooks UserWebhooksConfig `json:"user_webhooks" mapstructure:"user_webhooks"`
+	// Active-active cluster configuration
+	Cluster ClusterConfig `json:"cluster" mapstructure:"cluster"`
+	// Consent documents, such as the terms of service, that users must accept
+	Consents ConsentsConfig `json:"consents" mapstructure:"consents"`
+	// Pool of connections to the upstream servers used by the SFTP storage backend
+	SFTPFsPool vfs.SFTPPoolConfig `json:"sftpfs_pool" mapstructure:"sftpfs_pool"`
+	// Global bandwidth limits and transfer priority classes
+	QoS QoSConfig `json:"qos" mapstructure:"qos"`
+	// Server side downloads from external URLs to the users' storage
+	PullJobs PullJobsConfig `json:"pull_jobs" mapstructure:"pull_jobs"`
+	// Local disk cache for the objects stored on S3, Google Cloud Storage and Azure Blob storage
+	ObjectCache vfs.ObjectCacheConfig `json:"object_cache" mapstructure:"object_cache"`
+	// In memory cache for the directory listings of S3, Google Cloud Storage and Azure Blob storage
+	DirListCache vfs.DirListCacheConfig `json:"dir_list_cache" mapstructure:"dir_list_cache"`
+	// Content-addressable deduplication store for the local filesystems
+	Dedup vfs.DedupConfig `json:"dedup" mapstructure:"dedup"`
+	// Periodic quota scans for users and virtual folders
+	ScheduledQuotaScans ScheduledQuotaScansConfig `json:"scheduled_quota_scans" mapstructure:"scheduled_quota_scans"`
+	// Background jobs started using the REST API
+	Jobs JobsConfig `json:"jobs" mapstructure:"jobs"`
+	// Scheduled data provider backups
+	ProviderBackups ProviderBackupsConfig `json:"provider_backups" mapstructure:"provider_backups"`
+	// Audit records sent to a remote syslog collector
+	AuditLog              logger.AuditLogConfig `json:"audit_log" mapstructure:"audit_log"`
 	idleTimeoutAsDuration time.Duration
 	idleLoginTimeout      time.Duration
 	defender              Defender
@@ -683,6 +929,12 @@ func (c *Configuration) executePostDisconnectHook(remoteAddr, protocol, username
 
 	ipAddr := util.GetIPFromRemoteAddress(remoteAddr)
 	connDuration := int64(time.Since(connectionTime) / time.Millisecond)
+	// the connection span is already ended, the hook has its own trace
+	span := tracing.StartSpan("", "post-disconnect hook",
+		attribute.String("sftpgo.protocol", protocol),
+		attribute.String("sftpgo.connection_id", connID),
+		attribute.String("sftpgo.username", username))
+	defer span.End()
 
 	if strings.HasPrefix(c.PostDisconnectHook, "http") {
 		var url *url.URL
@@ -698,7 +950,7 @@ func (c *Configuration) executePostDisconnectHook(remoteAddr, protocol, username
 		q.Add("connection_duration", strconv.FormatInt(connDuration, 10))
 		url.RawQuery = q.Encode()
 		startTime := time.Now()
-		resp, err := httpclient.RetryableGet(url.String())
+		resp, err := httpclient.RetryableGetWithCorrelationID(url.String(), connID)
 		respCode := 0
 		if err == nil {
 			respCode = resp.StatusCode
@@ -722,7 +974,8 @@ func (c *Configuration) executePostDisconnectHook(remoteAddr, protocol, username
 		fmt.Sprintf("SFTPGO_CONNECTION_IP=%s", ipAddr),
 		fmt.Sprintf("SFTPGO_CONNECTION_USERNAME=%s", username),
 		fmt.Sprintf("SFTPGO_CONNECTION_DURATION=%d", connDuration),
-		fmt.Sprintf("SFTPGO_CONNECTION_PROTOCOL=%s", protocol))
+		fmt.Sprintf("SFTPGO_CONNECTION_PROTOCOL=%s", protocol),
+		fmt.Sprintf("%s=%s", logger.CorrelationIDEnvVar, connID))
 	err := cmd.Run()
 	logger.Debug(protocol, connID, "Post disconnect hook executed, elapsed: %s error: %v", time.Since(startTime), err)
 }
@@ -738,10 +991,16 @@ func (c *Configuration) checkPostDisconnectHook(remoteAddr, protocol, username,
 }
 
 // ExecutePostConnectHook executes the post connect hook if defined
-func (c *Configuration) ExecutePostConnectHook(ipAddr, protocol string) error {
+func (c *Configuration) ExecutePostConnectHook(ipAddr, protocol string) (err error) {
 	if c.PostConnectHook == "" {
 		return nil
 	}
+	span := tracing.StartSpan("", "post-connect hook", attribute.String("sftpgo.protocol", protocol),
+		attribute.String("net.sock.peer.addr", ipAddr))
+	defer func() {
+		tracing.EndSpan(span, err)
+	}()
+
 	if strings.HasPrefix(c.PostConnectHook, "http") {
 		var url *url.URL
 		url, err := url.Parse(c.PostConnectHook)
@@ -780,7 +1039,7 @@ func (c *Configuration) ExecutePostConnectHook(ipAddr, protocol string) error {
 	cmd.Env = append(env,
 		fmt.Sprintf("SFTPGO_CONNECTION_IP=%s", ipAddr),
 		fmt.Sprintf("SFTPGO_CONNECTION_PROTOCOL=%s", protocol))
-	err := cmd.Run()
+	err = cmd.Run()
 	if err != nil {
 		logger.Warn(protocol, "", "Login from ip %q denied, connect hook error: %v", ipAddr, err)
 		return getPermissionDeniedError(protocol)
@@ -895,7 +1154,7 @@ func (conns *ActiveConnections) GetActiveSessions(username string) int {
 	conns.RLock()
 	defer conns.RUnlock()
 
-	return conns.perUserConns[username]
+	return conns.perUserConns[username] + getClusterConnections().users[username]
 }
 
 // Add adds a new connection to the active ones
@@ -905,15 +1164,25 @@ func (conns *ActiveConnections) Add(c ActiveConnection) error {
 
 	if username := c.GetUsername(); username != "" {
 		if maxSessions := c.GetMaxSessions(); maxSessions > 0 {
-			if val := conns.perUserConns[username]; val >= maxSessions {
+			if val := conns.perUserConns[username] + getClusterConnections().users[username]; val >= maxSessions {
 				return fmt.Errorf("too many open sessions: %d/%d", val, maxSessions)
 			}
 		}
+		if err := Config.Fairness.checkAdmission(conns, username, c.GetRole(),
+			util.GetIPFromRemoteAddress(c.GetRemoteAddress())); err != nil {
+			return err
+		}
 		conns.addUserConnection(username)
 	}
 	conns.mapping[c.GetID()] = len(conns.connections)
 	conns.connections = append(conns.connections, c)
 	metric.UpdateActiveConnectionsSize(len(conns.connections))
+	tracing.StartConnection(c.GetID(), c.GetProtocol()+" connection",
+		attribute.String("sftpgo.protocol", c.GetProtocol()),
+		attribute.String("sftpgo.connection_id", c.GetID()),
+		attribute.String("sftpgo.username", c.GetUsername()),
+		attribute.String("net.sock.peer.addr", util.GetIPFromRemoteAddress(c.GetRemoteAddress())),
+	)
 	logger.Debug(c.GetProtocol(), c.GetID(), "connection added, local address %q, remote address %q, num open connections: %d",
 		c.GetLocalAddress(), c.GetRemoteAddress(), len(conns.connections))
 	return nil
@@ -932,15 +1201,25 @@ func (conns *ActiveConnections) Swap(c ActiveConnection) error {
 		conns.removeUserConnection(conn.GetUsername())
 		if username := c.GetUsername(); username != "" {
 			if maxSessions := c.GetMaxSessions(); maxSessions > 0 {
-				if val, ok := conns.perUserConns[username]; ok && val >= maxSessions {
+				if val := conns.perUserConns[username] + getClusterConnections().users[username]; val >= maxSessions {
 					conns.addUserConnection(conn.GetUsername())
 					return fmt.Errorf("too many open sessions: %d/%d", val, maxSessions)
 				}
 			}
+			if conn.GetUsername() == "" {
+				// the connection is swapped after the login, the fairness shares
+				// are checked only for not logged in connections
+				if err := Config.Fairness.checkAdmission(conns, username, c.GetRole(),
+					util.GetIPFromRemoteAddress(c.GetRemoteAddress())); err != nil {
+					conns.addUserConnection(conn.GetUsername())
+					return err
+				}
+			}
 			conns.addUserConnection(username)
 		}
 		err := conn.CloseFS()
 		conns.connections[idx] = c
+		tracing.SetConnectionAttributes(c.GetID(), attribute.String("sftpgo.username", c.GetUsername()))
 		logger.Debug(logSender, c.GetID(), "connection swapped, close fs error: %v", err)
 		conn = nil
 		return nil
@@ -967,6 +1246,7 @@ func (conns *ActiveConnections) Remove(connectionID string) {
 		}
 		conns.removeUserConnection(conn.GetUsername())
 		metric.UpdateActiveConnectionsSize(lastIdx)
+		tracing.EndConnection(connectionID, nil)
 		logger.Debug(conn.GetProtocol(), conn.GetID(), "connection removed, local address %q, remote address %q close fs error: %v, num open connections: %d",
 			conn.GetLocalAddress(), conn.GetRemoteAddress(), err, lastIdx)
 		if conn.GetProtocol() == ProtocolFTP && conn.GetUsername() == "" && !util.Contains(ftpLoginCommands, conn.GetCommand()) {
@@ -975,8 +1255,8 @@ func (conns *ActiveConnections) Remove(connectionID string) {
 				dataprovider.ErrNoAuthTried.Error())
 			metric.AddNoAuthTried()
 			AddDefenderEvent(ip, ProtocolFTP, HostEventNoLoginTried)
-			dataprovider.ExecutePostLoginHook(&dataprovider.User{}, dataprovider.LoginMethodNoAuthTried, ip,
-				ProtocolFTP, dataprovider.ErrNoAuthTried)
+			dataprovider.ExecutePostLoginHook(logger.WithCorrelationID(context.Background(), conn.GetID()),
+				&dataprovider.User{}, dataprovider.LoginMethodNoAuthTried, ip, ProtocolFTP, dataprovider.ErrNoAuthTried)
 			plugin.Handler.NotifyLogEvent(notifier.LogEventTypeNoLoginTried, ProtocolFTP, "", ip, "",
 				dataprovider.ErrNoAuthTried)
 		}
@@ -1041,29 +1321,53 @@ func (conns *ActiveConnections) RemoveSSHConnection(connectionID string) {
 	logger.Warn(logSender, "", "ssh connection to remove with id %q not found!", connectionID)
 }
 
+type sessionTerminationNotifier interface {
+	notifySessionTerminated(reason error)
+}
+
+// getSessionTerminationReason returns a non nil error if the connection must be closed
+// because it exceeded the idle timeout or the max session duration
+func getSessionTerminationReason(c ActiveConnection, policy *dataprovider.SessionPolicy) error {
+	idleTimeout := Config.idleTimeoutAsDuration
+	if policy.IdleTimeout > 0 {
+		idleTimeout = policy.GetIdleTimeout()
+	}
+	if idleTime := time.Since(c.GetLastActivity()); idleTimeout > 0 && idleTime > idleTimeout {
+		return fmt.Errorf("idle timeout exceeded, idle time: %s", idleTime.Round(time.Second))
+	}
+	if policy.MaxSessionDuration > 0 {
+		if duration := time.Since(c.GetConnectionTime()); duration > policy.GetMaxSessionDuration() {
+			return fmt.Errorf("max session duration exceeded, session duration: %s", duration.Round(time.Second))
+		}
+	}
+	return nil
+}
+
 func (conns *ActiveConnections) checkIdles() {
 	conns.RLock()
 
-	for _, sshConn := range conns.sshConnections {
-		idleTime := time.Since(sshConn.GetLastActivity())
-		if idleTime > Config.idleTimeoutAsDuration {
-			// we close an SSH connection if it has no active connections associated
-			idToMatch := fmt.Sprintf("_%s_", sshConn.GetID())
-			toClose := true
-			for _, conn := range conns.connections {
-				if strings.Contains(conn.GetID(), idToMatch) {
-					if time.Since(conn.GetLastActivity()) <= Config.idleTimeoutAsDuration {
-						toClose = false
-						break
+	if Config.IdleTimeout > 0 {
+		for _, sshConn := range conns.sshConnections {
+			idleTime := time.Since(sshConn.GetLastActivity())
+			if idleTime > Config.idleTimeoutAsDuration {
+				// we close an SSH connection if it has no active connections associated
+				idToMatch := fmt.Sprintf("_%s_", sshConn.GetID())
+				toClose := true
+				for _, conn := range conns.connections {
+					if strings.Contains(conn.GetID(), idToMatch) {
+						if time.Since(conn.GetLastActivity()) <= Config.idleTimeoutAsDuration {
+							toClose = false
+							break
+						}
 					}
 				}
-			}
-			if toClose {
-				defer func(c *SSHConnection) {
-					err := c.Close()
-					logger.Debug(logSender, c.GetID(), "close idle SSH connection, idle time: %v, close err: %v",
-						time.Since(c.GetLastActivity()), err)
-				}(sshConn)
+				if toClose {
+					defer func(c *SSHConnection) {
+						err := c.Close()
+						logger.Debug(logSender, c.GetID(), "close idle SSH connection, idle time: %v, close err: %v",
+							time.Since(c.GetLastActivity()), err)
+					}(sshConn)
+				}
 			}
 		}
 	}
@@ -1072,12 +1376,26 @@ func (conns *ActiveConnections) checkIdles() {
 		idleTime := time.Since(c.GetLastActivity())
 		isUnauthenticatedFTPUser := (c.GetProtocol() == ProtocolFTP && c.GetUsername() == "")
 
-		if idleTime > Config.idleTimeoutAsDuration || (isUnauthenticatedFTPUser && idleTime > Config.idleLoginTimeout) {
-			defer func(conn ActiveConnection) {
+		if isUnauthenticatedFTPUser {
+			if Config.IdleTimeout > 0 && (idleTime > Config.idleLoginTimeout || idleTime > Config.idleTimeoutAsDuration) {
+				defer func(conn ActiveConnection) {
+					err := conn.Disconnect()
+					logger.Debug(conn.GetProtocol(), conn.GetID(), "close idle connection, idle time: %v, username: %q close err: %v",
+						time.Since(conn.GetLastActivity()), conn.GetUsername(), err)
+				}(c)
+			}
+			continue
+		}
+		policy := c.GetSessionPolicy()
+		if reason := getSessionTerminationReason(c, &policy); reason != nil {
+			defer func(conn ActiveConnection, reason error) {
+				if n, ok := conn.(sessionTerminationNotifier); ok {
+					n.notifySessionTerminated(reason)
+				}
 				err := conn.Disconnect()
-				logger.Debug(conn.GetProtocol(), conn.GetID(), "close idle connection, idle time: %v, username: %q close err: %v",
-					time.Since(conn.GetLastActivity()), conn.GetUsername(), err)
-			}(c)
+				logger.Debug(conn.GetProtocol(), conn.GetID(), "close connection, %v, username: %q close err: %v",
+					reason, conn.GetUsername(), err)
+			}(c, reason)
 		}
 	}
 
@@ -1180,21 +1498,30 @@ func (conns *ActiveConnections) IsNewConnectionAllowed(ipAddr, protocol string)
 			return ErrConnectionDenied
 		}
 	}
+	if !Config.GeoIP.isAllowed(ipAddr) {
+		logger.Debug(logSender, "", "connection from ip %q, country %q denied by the geoip rules, protocol %s",
+			ipAddr, geoip.GetCountry(ipAddr), protocol)
+		return ErrConnectionDenied
+	}
 	if Config.MaxTotalConnections == 0 && Config.MaxPerHostConnections == 0 {
 		return nil
 	}
 
 	if Config.MaxPerHostConnections > 0 {
-		if total := conns.clients.getTotalFrom(ipAddr); total > Config.MaxPerHostConnections {
+		total := conns.clients.getTotalFrom(ipAddr) + getClusterConnections().hosts[ipAddr]
+		if total > Config.MaxPerHostConnections {
 			logger.Info(logSender, "", "active connections from %s %d/%d", ipAddr, total, Config.MaxPerHostConnections)
+			metric.AddRejectedConnection(rejectReasonMaxPerHost)
 			AddDefenderEvent(ipAddr, protocol, HostEventLimitExceeded)
 			return ErrConnectionDenied
 		}
 	}
 
 	if Config.MaxTotalConnections > 0 {
-		if total := conns.clients.getTotal(); total > int32(Config.MaxTotalConnections) {
+		total := int(conns.clients.getTotal()) + getClusterConnections().clients
+		if total > Config.MaxTotalConnections {
 			logger.Info(logSender, "", "active client connections %d/%d", total, Config.MaxTotalConnections)
+			metric.AddRejectedConnection(rejectReasonMaxTotal)
 			return ErrConnectionDenied
 		}
 
@@ -1204,8 +1531,9 @@ func (conns *ActiveConnections) IsNewConnectionAllowed(ipAddr, protocol string)
 		conns.RLock()
 		defer conns.RUnlock()
 
-		if sess := len(conns.connections); sess >= Config.MaxTotalConnections {
+		if sess := len(conns.connections) + getClusterConnections().sessions; sess >= Config.MaxTotalConnections {
 			logger.Info(logSender, "", "active client sessions %d/%d", sess, Config.MaxTotalConnections)
+			metric.AddRejectedConnection(rejectReasonMaxTotal)
 			return ErrConnectionDenied
 		}
 	}
@@ -1308,8 +1636,11 @@ type ActiveQuotaScan struct {
 	// Username to which the quota scan refers
 	Username string `json:"username"`
 	// quota scan start time as unix timestamp in milliseconds
-	StartTime int64  `json:"start_time"`
-	Role      string `json:"-"`
+	StartTime int64 `json:"start_time"`
+	// Files and size found so far
+	ScannedFiles int    `json:"scanned_files"`
+	ScannedSize  int64  `json:"scanned_size"`
+	Role         string `json:"-"`
 }
 
 // ActiveVirtualFolderQuotaScan defines an active quota scan for a virtual folder
@@ -1318,6 +1649,9 @@ type ActiveVirtualFolderQuotaScan struct {
 	Name string `json:"name"`
 	// quota scan start time as unix timestamp in milliseconds
 	StartTime int64 `json:"start_time"`
+	// Files and size found so far
+	ScannedFiles int   `json:"scanned_files"`
+	ScannedSize  int64 `json:"scanned_size"`
 }
 
 // ActiveScans holds the active quota scans
@@ -1336,8 +1670,10 @@ func (s *ActiveScans) GetUsersQuotaScans(role string) []ActiveQuotaScan {
 	for _, scan := range s.UserScans {
 		if role == "" || role == scan.Role {
 			scans = append(scans, ActiveQuotaScan{
-				Username:  scan.Username,
-				StartTime: scan.StartTime,
+				Username:     scan.Username,
+				StartTime:    scan.StartTime,
+				ScannedFiles: scan.ScannedFiles,
+				ScannedSize:  scan.ScannedSize,
 			})
 		}
 	}
@@ -1382,6 +1718,21 @@ func (s *ActiveScans) RemoveUserQuotaScan(username string) bool {
 	return false
 }
 
+// UpdateUserQuotaScanProgress updates the files and the size found so far by
+// the active quota scan for the specified user
+func (s *ActiveScans) UpdateUserQuotaScanProgress(username string, numFiles int, size int64) {
+	s.Lock()
+	defer s.Unlock()
+
+	for idx := range s.UserScans {
+		if s.UserScans[idx].Username == username {
+			s.UserScans[idx].ScannedFiles = numFiles
+			s.UserScans[idx].ScannedSize = size
+			return
+		}
+	}
+}
+
 // GetVFoldersQuotaScans returns the active quota scans for virtual folders
 func (s *ActiveScans) GetVFoldersQuotaScans() []ActiveVirtualFolderQuotaScan {
 	s.RLock()
@@ -1427,6 +1778,21 @@ func (s *ActiveScans) RemoveVFolderQuotaScan(folderName string) bool {
 	return false
 }
 
+// UpdateVFolderQuotaScanProgress updates the files and the size found so far
+// by the active quota scan for the specified folder
+func (s *ActiveScans) UpdateVFolderQuotaScanProgress(folderName string, numFiles int, size int64) {
+	s.Lock()
+	defer s.Unlock()
+
+	for idx := range s.FolderScans {
+		if s.FolderScans[idx].Name == folderName {
+			s.FolderScans[idx].ScannedFiles = numFiles
+			s.FolderScans[idx].ScannedSize = size
+			return
+		}
+	}
+}
+
 // MetadataCheck defines an active metadata check
 type MetadataCheck struct {
 	// Username to which the metadata check refers
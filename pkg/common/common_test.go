@@ -16,9 +16,14 @@ package common
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"fmt"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -31,14 +36,17 @@ import (
 	"github.com/alexedwards/argon2id"
 	"github.com/pires/go-proxyproto"
 	"github.com/sftpgo/sdk"
+	sdkkms "github.com/sftpgo/sdk/kms"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
 	"github.com/drakkan/sftpgo/v2/pkg/kms"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
 	"github.com/drakkan/sftpgo/v2/pkg/plugin"
 	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vault"
 	"github.com/drakkan/sftpgo/v2/pkg/vfs"
 )
 
@@ -246,6 +254,70 @@ func TestInitializationProxyErrors(t *testing.T) {
 	assert.Len(t, Config.proxySkipped, 0)
 }
 
+func TestInitializationAuditLogErrors(t *testing.T) {
+	configCopy := Config
+
+	c := Configuration{
+		AuditLog: logger.AuditLogConfig{
+			Address: "127.0.0.1:5514",
+			Format:  "json",
+		},
+	}
+	err := Initialize(c, 0)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "audit log initialization error")
+	}
+	c.AuditLog.Format = logger.AuditFormatCEF
+	err = Initialize(c, 0)
+	assert.NoError(t, err)
+	err = logger.InitAuditLog(logger.AuditLogConfig{})
+	assert.NoError(t, err)
+
+	Config = configCopy
+}
+
+func TestSFTPFsPoolConfig(t *testing.T) {
+	configCopy := Config
+
+	c := vfs.SFTPPoolConfig{}
+	err := c.Validate()
+	assert.NoError(t, err)
+	assert.Equal(t, 5, c.MaxSessionsPerConnection)
+	assert.Equal(t, 0, c.MaxConnections)
+	assert.Equal(t, 30, c.HealthCheckInterval)
+	assert.Equal(t, 30, c.IdleTimeout)
+	assert.Equal(t, 60, c.MaxBackoff)
+	c.HealthCheckInterval = 2
+	assert.ErrorContains(t, c.Validate(), "health check interval")
+	c.HealthCheckInterval = 10
+	c.MaxConnections = -1
+	assert.ErrorContains(t, c.Validate(), "max connections")
+	c.MaxConnections = 2
+	c.MaxSessionsPerConnection = -1
+	assert.ErrorContains(t, c.Validate(), "max sessions per connection")
+	c.MaxSessionsPerConnection = 1
+	c.IdleTimeout = -1
+	assert.ErrorContains(t, c.Validate(), "idle timeout")
+	c.IdleTimeout = 10
+	c.MaxBackoff = -1
+	assert.ErrorContains(t, c.Validate(), "max backoff")
+	c.MaxBackoff = 10
+	c.ProxyProtocol = 3
+	assert.ErrorContains(t, c.Validate(), "proxy protocol")
+	c.ProxyProtocol = 2
+	assert.NoError(t, c.Validate())
+
+	config := Configuration{
+		SFTPFsPool: vfs.SFTPPoolConfig{
+			MaxConnections: -1,
+		},
+	}
+	err = Initialize(config, 0)
+	assert.ErrorContains(t, err, "invalid SFTP pool max connections")
+
+	Config = configCopy
+}
+
 func TestInitializationClosedProvider(t *testing.T) {
 	configCopy := Config
 
@@ -572,6 +644,8 @@ func TestRateLimitersIntegration(t *testing.T) {
 		_, err = LimitRate(ProtocolWebDAV, source3)
 		assert.NoError(t, err)
 	}
+	_, err = LimitHTTPUserRate(source1, "", "/api/v2/user/files")
+	assert.NoError(t, err)
 	for _, e := range entries {
 		err := dataprovider.DeleteIPListEntry(e.IPOrNet, e.Type, "", "", "")
 		assert.NoError(t, err)
@@ -581,6 +655,60 @@ func TestRateLimitersIntegration(t *testing.T) {
 	Config = configCopy
 }
 
+func TestLimitHTTPRate(t *testing.T) {
+	configCopy := Config
+
+	Config.RateLimitersConfig = []RateLimiterConfig{
+		{
+			Average:          1,
+			Period:           1000,
+			Burst:            1,
+			Type:             int(rateLimiterTypeSource),
+			Protocols:        []string{ProtocolHTTP},
+			HTTPRoutes:       []string{"/api/v2/token"},
+			EntriesSoftLimit: 100,
+			EntriesHardLimit: 150,
+		},
+		{
+			Average:          1,
+			Period:           1000,
+			Burst:            1,
+			Type:             int(rateLimiterTypeUser),
+			Protocols:        []string{ProtocolHTTP},
+			EntriesSoftLimit: 100,
+			EntriesHardLimit: 150,
+		},
+	}
+	err := Initialize(Config, 0)
+	assert.NoError(t, err)
+	assert.Len(t, rateLimiters[ProtocolHTTP], 2)
+
+	source := "127.1.1.3"
+	_, err = LimitHTTPRate(source, "/api/v2/token")
+	assert.NoError(t, err)
+	_, err = LimitHTTPRate(source, "/api/v2/token")
+	assert.Error(t, err)
+	// the route does not match and the user rate limiter is not used without a key
+	_, err = LimitHTTPRate(source, "/api/v2/users")
+	assert.NoError(t, err)
+	_, err = LimitHTTPRate(source, "/api/v2/users")
+	assert.NoError(t, err)
+
+	_, err = LimitHTTPUserRate(source, "user_a", "/api/v2/user/files")
+	assert.NoError(t, err)
+	_, err = LimitHTTPUserRate(source, "user_a", "/api/v2/user/files")
+	assert.Error(t, err)
+	_, err = LimitHTTPUserRate(source, "apikey_1", "/api/v2/user/files")
+	assert.NoError(t, err)
+	// the per-user limiters are ignored for the other protocols
+	_, err = LimitRate(ProtocolFTP, source)
+	assert.NoError(t, err)
+
+	Config = configCopy
+	err = Initialize(Config, 0)
+	assert.NoError(t, err)
+}
+
 func TestUserMaxSessions(t *testing.T) {
 	c := NewBaseConnection("id", ProtocolSFTP, "", "", dataprovider.User{
 		BaseUser: sdk.BaseUser{
@@ -780,6 +908,289 @@ func TestIdleConnections(t *testing.T) {
 	Config = configCopy
 }
 
+func TestSessionPolicies(t *testing.T) {
+	configCopy := Config
+
+	Config.IdleTimeout = 0
+	err := Initialize(Config, 0)
+	assert.NoError(t, err)
+
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: userTestUsername,
+		},
+		Filters: dataprovider.UserFilters{
+			SessionPolicies: []dataprovider.SessionPolicy{
+				{
+					IdleTimeout: 10,
+				},
+				{
+					Protocols:          []string{ProtocolFTP},
+					MaxSessionDuration: 60,
+				},
+			},
+		},
+	}
+	policy := user.GetSessionPolicy(ProtocolSCP)
+	assert.Equal(t, 10, policy.IdleTimeout)
+	assert.Equal(t, 0, policy.MaxSessionDuration)
+	policy = user.GetSessionPolicy(ProtocolFTP)
+	assert.Equal(t, 0, policy.IdleTimeout)
+	assert.Equal(t, 60, policy.MaxSessionDuration)
+
+	c1 := NewBaseConnection("id1", ProtocolSFTP, "", "", user)
+	c1.lastActivity.Store(time.Now().Add(-5 * time.Minute).UnixNano())
+	c2 := NewBaseConnection("id2", ProtocolSFTP, "", "", user)
+	c2.lastActivity.Store(time.Now().Add(-15 * time.Minute).UnixNano())
+	c3 := NewBaseConnection("id3", ProtocolFTP, "", "", user)
+	c3.lastActivity.Store(time.Now().Add(-15 * time.Minute).UnixNano())
+	c4 := NewBaseConnection("id4", ProtocolFTP, "", "", user)
+	c4.startTime = time.Now().Add(-2 * time.Hour)
+	for _, c := range []*BaseConnection{c1, c2, c3, c4} {
+		fakeConn := &fakeConnection{
+			BaseConnection: c,
+		}
+		policy := fakeConn.GetSessionPolicy()
+		reason := getSessionTerminationReason(fakeConn, &policy)
+		switch c {
+		case c2:
+			assert.ErrorContains(t, reason, "idle timeout exceeded")
+		case c4:
+			assert.ErrorContains(t, reason, "max session duration exceeded")
+		default:
+			assert.NoError(t, reason)
+		}
+		err = Connections.Add(fakeConn)
+		assert.NoError(t, err)
+	}
+	assert.Len(t, Connections.GetStats(""), 4)
+	Connections.checkIdles()
+	assert.Eventually(t, func() bool { return len(Connections.GetStats("")) == 2 }, 1*time.Second, 100*time.Millisecond)
+	for _, stat := range Connections.GetStats("") {
+		assert.Contains(t, []string{c1.GetID(), c3.GetID()}, stat.ConnectionID)
+	}
+	Connections.Remove(c1.GetID())
+	Connections.Remove(c3.GetID())
+	assert.Len(t, Connections.GetStats(""), 0)
+
+	Config = configCopy
+}
+
+func TestGroupOverrides(t *testing.T) {
+	group := dataprovider.Group{
+		BaseGroup: sdk.BaseGroup{
+			Name: "group_overrides",
+		},
+		UserSettings: dataprovider.GroupUserSettings{
+			BaseGroupUserSettings: sdk.BaseGroupUserSettings{
+				UploadBandwidth: 100,
+			},
+			Overrides: []dataprovider.GroupOverride{
+				{
+					SourceNetworks: []string{"10.8.0.0/16"},
+				},
+			},
+		},
+	}
+	err := dataprovider.AddGroup(&group, "", "", "")
+	assert.ErrorContains(t, err, "must override at least a setting")
+	group.UserSettings.Overrides[0].Protocols = []string{"SCP"}
+	group.UserSettings.Overrides[0].DownloadBandwidth = 50
+	err = dataprovider.AddGroup(&group, "", "", "")
+	assert.ErrorContains(t, err, "invalid group override protocol")
+	group.UserSettings.Overrides[0].Protocols = nil
+	group.UserSettings.Overrides[0].SourceNetworks = []string{"invalid"}
+	err = dataprovider.AddGroup(&group, "", "", "")
+	assert.ErrorContains(t, err, "could not parse group override source network")
+	group.UserSettings.Overrides = []dataprovider.GroupOverride{
+		{
+			Protocols:         []string{ProtocolFTP},
+			SourceNetworks:    []string{"10.8.0.0/16"},
+			UploadBandwidth:   10,
+			DownloadBandwidth: 20,
+		},
+		{
+			Protocols: []string{ProtocolFTP, ProtocolWebDAV},
+			Permissions: map[string][]string{
+				"/":     {dataprovider.PermListItems, dataprovider.PermDownload},
+				"/sub1": {dataprovider.PermListItems},
+			},
+		},
+	}
+	err = dataprovider.AddGroup(&group, "", "", "")
+	require.NoError(t, err)
+	defer dataprovider.DeleteGroup(group.Name, "", "", "") //nolint:errcheck
+
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username:          "group_overrides_user",
+			HomeDir:           filepath.Join(os.TempDir(), "group_overrides_user"),
+			Status:            1,
+			DownloadBandwidth: 30,
+			Permissions: map[string][]string{
+				"/":     {dataprovider.PermAny},
+				"/sub1": {dataprovider.PermAny},
+			},
+		},
+		Groups: []sdk.GroupMapping{
+			{
+				Name: group.Name,
+				Type: sdk.GroupTypePrimary,
+			},
+		},
+	}
+	err = dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+	defer dataprovider.DeleteUser(user.Username, "", "", "") //nolint:errcheck
+
+	user, err = dataprovider.GetUserWithGroupSettings(user.Username, "")
+	require.NoError(t, err)
+	// no override matches
+	c := NewBaseConnection("id", ProtocolSFTP, "", "10.8.1.1:1234", user)
+	assert.Equal(t, int64(100), c.User.UploadBandwidth)
+	assert.Equal(t, int64(30), c.User.DownloadBandwidth)
+	assert.Equal(t, []string{dataprovider.PermAny}, c.User.Permissions["/"])
+	// the first override wins, the download bandwidth defined for the user is preserved
+	c = NewBaseConnection("id", ProtocolFTP, "", "10.8.1.1:1234", user)
+	assert.Equal(t, int64(10), c.User.UploadBandwidth)
+	assert.Equal(t, int64(30), c.User.DownloadBandwidth)
+	assert.Equal(t, []string{dataprovider.PermAny}, c.User.Permissions["/"])
+	// the permissions defined for the user sub directories are preserved
+	c = NewBaseConnection("id", ProtocolFTP, "", "192.168.1.1:1234", user)
+	assert.Equal(t, int64(100), c.User.UploadBandwidth)
+	assert.Equal(t, []string{dataprovider.PermListItems, dataprovider.PermDownload}, c.User.Permissions["/"])
+	assert.Equal(t, []string{dataprovider.PermAny}, c.User.Permissions["/sub1"])
+	c = NewBaseConnection("id", ProtocolWebDAV, "", "", user)
+	assert.Equal(t, []string{dataprovider.PermListItems, dataprovider.PermDownload}, c.User.Permissions["/"])
+	// the original user is not modified
+	assert.Equal(t, []string{dataprovider.PermAny}, user.Permissions["/"])
+}
+
+func TestAccessWindows(t *testing.T) {
+	group := dataprovider.Group{
+		BaseGroup: sdk.BaseGroup{
+			Name: "access_windows_group",
+		},
+		UserSettings: dataprovider.GroupUserSettings{
+			AccessWindows: []dataprovider.AccessWindow{
+				{
+					From: "8:00",
+					To:   "8:00",
+				},
+			},
+		},
+	}
+	err := dataprovider.AddGroup(&group, "", "", "")
+	assert.ErrorContains(t, err, "cannot be equal")
+	group.UserSettings.AccessWindows[0].To = "25:00"
+	err = dataprovider.AddGroup(&group, "", "", "")
+	assert.ErrorContains(t, err, "invalid access window end time")
+	group.UserSettings.AccessWindows[0].To = "18:00"
+	group.UserSettings.AccessWindows[0].DaysOfWeek = []int{7}
+	err = dataprovider.AddGroup(&group, "", "", "")
+	assert.ErrorContains(t, err, "invalid access window day of week")
+	group.UserSettings.AccessWindows[0].DaysOfWeek = []int{5, 1, 1}
+	group.UserSettings.AccessTimezone = "Invalid/Timezone"
+	err = dataprovider.AddGroup(&group, "", "", "")
+	assert.ErrorContains(t, err, "invalid access windows timezone")
+	group.UserSettings.AccessTimezone = "Europe/Rome"
+	err = dataprovider.AddGroup(&group, "", "", "")
+	require.NoError(t, err)
+	defer dataprovider.DeleteGroup(group.Name, "", "", "") //nolint:errcheck
+
+	group, err = dataprovider.GroupExists(group.Name)
+	require.NoError(t, err)
+	if assert.Len(t, group.UserSettings.AccessWindows, 1) {
+		assert.Equal(t, []int{1, 5}, group.UserSettings.AccessWindows[0].DaysOfWeek)
+		assert.Equal(t, "08:00", group.UserSettings.AccessWindows[0].From)
+	}
+
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username:       "access_windows_user",
+			Password:       "pwd",
+			HomeDir:        filepath.Join(os.TempDir(), "access_windows_user"),
+			Status:         1,
+			ExpirationDate: util.GetTimeAsMsSinceEpoch(time.Now().Add(24 * time.Hour)),
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+		Filters: dataprovider.UserFilters{
+			ActivationDate: util.GetTimeAsMsSinceEpoch(time.Now().Add(48 * time.Hour)),
+		},
+		Groups: []sdk.GroupMapping{
+			{
+				Name: group.Name,
+				Type: sdk.GroupTypePrimary,
+			},
+		},
+	}
+	err = dataprovider.AddUser(&user, "", "", "")
+	assert.ErrorContains(t, err, "the activation date must be before the expiration date")
+	user.Filters.ActivationDate = util.GetTimeAsMsSinceEpoch(time.Now().Add(12 * time.Hour))
+	err = dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+	defer dataprovider.DeleteUser(user.Username, "", "", "") //nolint:errcheck
+
+	user, err = dataprovider.GetUserWithGroupSettings(user.Username, "")
+	require.NoError(t, err)
+	err = user.CheckLoginConditions()
+	assert.ErrorContains(t, err, "is not yet active")
+	// the access windows are inherited from the group
+	assert.Equal(t, "Europe/Rome", user.Filters.AccessTimezone)
+	rome, err := time.LoadLocation("Europe/Rome")
+	require.NoError(t, err)
+	// 2023-05-01 is a Monday
+	assert.True(t, user.IsWithinAccessWindows(time.Date(2023, 5, 1, 8, 0, 0, 0, rome)))
+	assert.True(t, user.IsWithinAccessWindows(time.Date(2023, 5, 5, 17, 59, 0, 0, rome)))
+	assert.False(t, user.IsWithinAccessWindows(time.Date(2023, 5, 1, 18, 0, 0, 0, rome)))
+	assert.False(t, user.IsWithinAccessWindows(time.Date(2023, 5, 2, 10, 0, 0, 0, rome)))
+	// 06:30 UTC is 08:30 in Rome
+	assert.True(t, user.IsWithinAccessWindows(time.Date(2023, 5, 1, 6, 30, 0, 0, time.UTC)))
+	assert.False(t, user.IsWithinAccessWindows(time.Date(2023, 5, 1, 16, 30, 0, 0, time.UTC)))
+	// a window ending the next day
+	user.Filters.AccessTimezone = ""
+	user.Filters.AccessWindows = []dataprovider.AccessWindow{
+		{
+			DaysOfWeek: []int{int(time.Saturday)},
+			From:       "22:00",
+			To:         "02:00",
+		},
+	}
+	assert.True(t, user.IsWithinAccessWindows(time.Date(2023, 5, 6, 23, 0, 0, 0, time.UTC)))
+	assert.True(t, user.IsWithinAccessWindows(time.Date(2023, 5, 7, 1, 59, 0, 0, time.UTC)))
+	assert.False(t, user.IsWithinAccessWindows(time.Date(2023, 5, 7, 2, 0, 0, 0, time.UTC)))
+	assert.False(t, user.IsWithinAccessWindows(time.Date(2023, 5, 7, 23, 0, 0, 0, time.UTC)))
+	assert.False(t, user.IsWithinAccessWindows(time.Date(2023, 5, 6, 1, 0, 0, 0, time.UTC)))
+	user.Filters.AccessWindows = nil
+	assert.True(t, user.IsWithinAccessWindows(time.Now()))
+	// the user access windows have precedence
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+	user.Filters.ActivationDate = 0
+	user.Filters.AccessWindows = []dataprovider.AccessWindow{
+		{
+			DaysOfWeek: []int{int(time.Now().UTC().Add(48 * time.Hour).Weekday())},
+			From:       "00:00",
+			To:         "23:59",
+		},
+	}
+	err = dataprovider.UpdateUser(&user, "", "", "")
+	require.NoError(t, err)
+	_, err = dataprovider.CheckUserAndPass(user.Username, "pwd", "127.0.0.1", ProtocolSSH)
+	assert.ErrorContains(t, err, "is not allowed to log in at this time")
+	user.Filters.AccessWindows[0].DaysOfWeek = nil
+	err = dataprovider.UpdateUser(&user, "", "", "")
+	require.NoError(t, err)
+	user, err = dataprovider.GetUserWithGroupSettings(user.Username, "")
+	require.NoError(t, err)
+	assert.Empty(t, user.Filters.AccessTimezone)
+	if assert.Len(t, user.Filters.AccessWindows, 1) {
+		assert.Len(t, user.Filters.AccessWindows[0].DaysOfWeek, 0)
+	}
+}
+
 func TestCloseConnection(t *testing.T) {
 	c := NewBaseConnection("id", ProtocolSFTP, "", "", dataprovider.User{})
 	fakeConn := &fakeConnection{
@@ -1500,6 +1911,203 @@ func TestUpdateTransferTimestamps(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestRotateSecrets(t *testing.T) {
+	folder := vfs.BaseVirtualFolder{
+		Name:       "folder_rotate_secrets",
+		MappedPath: filepath.Join(os.TempDir(), "folder_rotate_secrets"),
+		FsConfig: vfs.Filesystem{
+			Provider: sdk.CryptedFilesystemProvider,
+			CryptConfig: vfs.CryptFsConfig{
+				Passphrase: kms.NewPlainSecret("folder passphrase"),
+			},
+		},
+	}
+	err := dataprovider.AddFolder(&folder, "", "", "")
+	require.NoError(t, err)
+	username := "user_rotate_secrets"
+	user := &dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: username,
+			HomeDir:  filepath.Join(os.TempDir(), username),
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+		FsConfig: vfs.Filesystem{
+			Provider: sdk.CryptedFilesystemProvider,
+			CryptConfig: vfs.CryptFsConfig{
+				Passphrase: kms.NewPlainSecret("user passphrase"),
+			},
+		},
+	}
+	err = dataprovider.AddUser(user, "", "", "")
+	require.NoError(t, err)
+	payload := user.FsConfig.CryptConfig.Passphrase.GetPayload()
+	assert.Equal(t, kms.GetEncryptedStatus(), user.FsConfig.CryptConfig.Passphrase.GetStatus())
+	// all the secrets are encrypted using the configured provider
+	result, err := dataprovider.RotateSecrets(false, dataprovider.ActionExecutorSystem, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.GetTotal())
+
+	result, err = dataprovider.RotateSecrets(true, dataprovider.ActionExecutorSystem, "")
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, result.Users, 1)
+	assert.GreaterOrEqual(t, result.Folders, 1)
+	userGet, err := dataprovider.UserExists(username, "")
+	require.NoError(t, err)
+	secret := userGet.FsConfig.CryptConfig.Passphrase
+	assert.Equal(t, kms.GetEncryptedStatus(), secret.GetStatus())
+	assert.NotEqual(t, payload, secret.GetPayload())
+	assert.Equal(t, username, secret.GetAdditionalData())
+	err = secret.Decrypt()
+	assert.NoError(t, err)
+	assert.Equal(t, "user passphrase", secret.GetPayload())
+	folder, err = dataprovider.GetFolderByName(folder.Name)
+	require.NoError(t, err)
+	err = folder.FsConfig.CryptConfig.Passphrase.Decrypt()
+	assert.NoError(t, err)
+	assert.Equal(t, "folder passphrase", folder.FsConfig.CryptConfig.Passphrase.GetPayload())
+
+	err = dataprovider.DeleteUser(username, "", "", "")
+	assert.NoError(t, err)
+	err = dataprovider.DeleteFolder(folder.Name, "", "", "")
+	assert.NoError(t, err)
+}
+
+func TestPKCS11KMSConfig(t *testing.T) {
+	for _, u := range []string{
+		"pkcs11:token=sftpgo?module-path=/usr/lib/libsofthsm2.so",
+		"pkcs11:token=sftpgo;object=kms-key",
+		"pkcs11:token=sftpgo;object=kms-key?module-path=relative/libsofthsm2.so",
+		"pkcs11:token=sftpgo;object=kms-key?module-path=" + filepath.Join(os.TempDir(), "missing.so"),
+		"pkcs11:token=sftpgo;object=kms-key?module-name=softhsm2&pin-value=1234",
+		"pkcs11:token=sftpgo;object=kms-key?module-name=softhsm2&pin-source=env:PIN",
+		"pkcs11:token=sftpgo;object=kms-key;object=other?module-name=softhsm2",
+		"pkcs11:token=sftpgo;object?module-name=softhsm2",
+		"pkcs11:token=sftpgo;object=%zz?module-name=softhsm2",
+	} {
+		kmsConfig := kms.Configuration{
+			Secrets: kms.Secrets{
+				URL: u,
+			},
+		}
+		assert.Error(t, kmsConfig.Initialize(), u)
+	}
+}
+
+func TestVaultTransitKMS(t *testing.T) {
+	vaultToken := "vault token"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != vaultToken {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`)) //nolint:errcheck
+			return
+		}
+		var req map[string]string
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/testkey":
+			w.Write([]byte(fmt.Sprintf(`{"data":{"ciphertext":"vault:v1:%s"}}`, req["plaintext"]))) //nolint:errcheck
+		case "/v1/transit/decrypt/testkey":
+			w.Write([]byte(fmt.Sprintf(`{"data":{"plaintext":"%s"}}`, //nolint:errcheck
+				strings.TrimPrefix(req["ciphertext"], "vault:v1:"))))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv(vault.EnvAddress, server.URL)
+	t.Setenv(vault.EnvToken, vaultToken)
+
+	kmsConfig := kms.Configuration{
+		Secrets: kms.Secrets{
+			URL: sdkkms.SchemeVaultTransit + "://",
+		},
+	}
+	assert.Error(t, kmsConfig.Initialize())
+	kmsConfig.Secrets.URL = sdkkms.SchemeVaultTransit + "://testkey"
+	require.NoError(t, kmsConfig.Initialize())
+	defer func() {
+		kmsConfig := kms.Configuration{}
+		err := kmsConfig.Initialize()
+		assert.NoError(t, err)
+	}()
+	assert.Equal(t, sdkkms.SecretStatusVaultTransit, kms.GetEncryptedStatus())
+
+	secret := kms.NewPlainSecret("vault payload")
+	secret.SetAdditionalData("data")
+	err := secret.Encrypt()
+	require.NoError(t, err)
+	assert.Equal(t, sdkkms.SecretStatusVaultTransit, secret.GetStatus())
+	assert.True(t, strings.HasPrefix(secret.GetKey(), "transit/testkey/vault:v1:"))
+	assert.NotContains(t, secret.GetPayload(), "vault payload")
+	secretCopy := secret.Clone()
+	err = secret.Decrypt()
+	assert.NoError(t, err)
+	assert.Equal(t, "vault payload", secret.GetPayload())
+	// the additional data is bound to the ciphertext
+	secretCopy.SetAdditionalData("other data")
+	err = secretCopy.Decrypt()
+	assert.Error(t, err)
+
+	t.Setenv(vault.EnvToken, "invalid token")
+	secret = kms.NewPlainSecret("vault payload")
+	err = secret.Encrypt()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "permission denied")
+	}
+}
+
+func TestS3VaultCredentialsPath(t *testing.T) {
+	username := "user_s3_vault"
+	user := &dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: username,
+			HomeDir:  filepath.Join(os.TempDir(), username),
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+		FsConfig: vfs.Filesystem{
+			Provider: sdk.S3FilesystemProvider,
+			S3Config: vfs.S3FsConfig{
+				BaseS3FsConfig: sdk.BaseS3FsConfig{
+					Bucket:    "bucket",
+					Region:    "us-east-1",
+					AccessKey: "access key",
+				},
+				AccessSecret:         kms.NewPlainSecret("access secret"),
+				VaultCredentialsPath: "aws/creds/sftpgo",
+			},
+		},
+	}
+	err := dataprovider.AddUser(user, "", "", "")
+	assert.Error(t, err)
+	user.FsConfig.S3Config.AccessKey = ""
+	user.FsConfig.S3Config.AccessSecret = kms.NewEmptySecret()
+	user.FsConfig.S3Config.VaultCredentialsPath = "/aws/../creds"
+	err = dataprovider.AddUser(user, "", "", "")
+	assert.Error(t, err)
+	user.FsConfig.S3Config.VaultCredentialsPath = "/aws/creds/sftpgo/"
+	err = dataprovider.AddUser(user, "", "", "")
+	assert.NoError(t, err)
+	userGet, err := dataprovider.UserExists(username, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "aws/creds/sftpgo", userGet.FsConfig.S3Config.VaultCredentialsPath)
+	fsCopy := userGet.FsConfig.GetACopy()
+	assert.Equal(t, "aws/creds/sftpgo", fsCopy.S3Config.VaultCredentialsPath)
+
+	err = dataprovider.DeleteUser(username, "", "", "")
+	assert.NoError(t, err)
+}
+
 func TestMetadataAPI(t *testing.T) {
 	username := "metadatauser"
 	require.False(t, ActiveMetadataChecks.Remove(username))
@@ -1838,3 +2446,52 @@ func BenchmarkAddRemoveSSHConnections(b *testing.B) {
 	conn1.Close()
 	conn2.Close()
 }
+
+func TestTLSCertificateUsername(t *testing.T) {
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username:    "tls_user@example.com",
+			HomeDir:     filepath.Join(os.TempDir(), "tls_user"),
+			Status:      1,
+			Permissions: map[string][]string{"/": {dataprovider.PermAny}},
+		},
+		Filters: dataprovider.UserFilters{
+			BaseUserFilters: sdk.BaseUserFilters{
+				TLSUsername: dataprovider.TLSUsernameSAN,
+			},
+		},
+	}
+	err := dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+	defer dataprovider.DeleteUser(user.Username, "", "", "") //nolint:errcheck
+
+	tlsCert := &x509.Certificate{
+		SerialNumber:   big.NewInt(4660),
+		Subject:        pkix.Name{CommonName: "client"},
+		EmailAddresses: []string{"TLS_user@example.com"},
+	}
+	_, err = dataprovider.CheckUserAndTLSCert(user.Username, "127.0.0.1", ProtocolHTTP, tlsCert)
+	assert.NoError(t, err)
+	_, loginMethod, err := dataprovider.CheckCompositeCredentials(user.Username, "", "127.0.0.1",
+		dataprovider.LoginMethodTLSCertificate, ProtocolHTTP, tlsCert)
+	assert.NoError(t, err)
+	assert.Equal(t, dataprovider.LoginMethodTLSCertificate, loginMethod)
+	_, err = dataprovider.CheckUserAndTLSCert(user.Username, "127.0.0.1", ProtocolSSH, tlsCert)
+	assert.Error(t, err)
+
+	tlsCert.EmailAddresses = nil
+	tlsCert.DNSNames = []string{"example.com"}
+	_, err = dataprovider.CheckUserAndTLSCert(user.Username, "127.0.0.1", ProtocolHTTP, tlsCert)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no subject alternative name matches")
+	}
+
+	user.Filters.TLSUsername = sdk.TLSUsernameCN
+	err = dataprovider.UpdateUser(&user, "", "", "")
+	require.NoError(t, err)
+	_, err = dataprovider.CheckUserAndTLSCert(user.Username, "127.0.0.1", ProtocolHTTP, tlsCert)
+	assert.Error(t, err)
+	tlsCert.Subject.CommonName = user.Username
+	_, err = dataprovider.CheckUserAndTLSCert(user.Username, "127.0.0.1", ProtocolHTTP, tlsCert)
+	assert.NoError(t, err)
+}
@@ -56,6 +56,35 @@ type BaseConnection struct {
 	localAddr  string
 	sync.RWMutex
 	activeTransfers []ActiveTransfer
+	// progress is not nil for connections running a background file operation
+	progress *fileOperationProgress
+	// custom fields submitted with the uploads, for example from share upload portals
+	uploadFields map[string]string
+	// staging transaction for the uploads, if any
+	stagingTx string
+}
+
+// SetUploadFields sets the custom fields submitted with the uploads, they are
+// forwarded to the event manager
+func (c *BaseConnection) SetUploadFields(fields map[string]string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.uploadFields = fields
+}
+
+func (c *BaseConnection) getUploadFields() *map[string]string {
+	c.RLock()
+	defer c.RUnlock()
+
+	if len(c.uploadFields) == 0 {
+		return nil
+	}
+	fields := make(map[string]string, len(c.uploadFields))
+	for k, v := range c.uploadFields {
+		fields[k] = v
+	}
+	return &fields
 }
 
 // NewBaseConnection returns a new BaseConnection
@@ -64,7 +93,10 @@ func NewBaseConnection(id, protocol, localAddr, remoteAddr string, user dataprov
 	if util.Contains(supportedProtocols, protocol) {
 		connID = fmt.Sprintf("%s_%s", protocol, id)
 	}
-	user.UploadBandwidth, user.DownloadBandwidth = user.GetBandwidthForIP(util.GetIPFromRemoteAddress(remoteAddr), connID)
+	clientIP := util.GetIPFromRemoteAddress(remoteAddr)
+	user.ApplyGroupOverrides(protocol, clientIP, connID)
+	user.UploadBandwidth, user.DownloadBandwidth = user.GetBandwidthForIP(clientIP, connID)
+	user.SetClientIP(clientIP)
 	c := &BaseConnection{
 		ID:         connID,
 		User:       user,
@@ -109,6 +141,16 @@ func (c *BaseConnection) GetMaxSessions() int {
 	return c.User.MaxSessions
 }
 
+// GetSessionPolicy returns the session policy for the user and protocol
+// associated with this connection
+func (c *BaseConnection) GetSessionPolicy() dataprovider.SessionPolicy {
+	return c.User.GetSessionPolicy(c.protocol)
+}
+
+func (c *BaseConnection) notifySessionTerminated(reason error) {
+	ExecuteActionNotification(c, operationSessionTerminated, "", "", "", "", "", 0, reason, 0) //nolint:errcheck
+}
+
 // GetProtocol returns the protocol for the connection
 func (c *BaseConnection) GetProtocol() string {
 	return c.protocol
@@ -200,6 +242,21 @@ func (c *BaseConnection) RemoveTransfer(t ActiveTransfer) {
 	c.Log(logger.LevelWarn, "transfer to remove with id %v not found!", t.GetID())
 }
 
+// checkFolderTransfersLimit returns an error if no more transfers are allowed
+// for the virtual folder that includes the specified virtual path
+func (c *BaseConnection) checkFolderTransfersLimit(virtualPath string) error {
+	vfolder, err := c.User.GetVirtualFolderForPath(path.Dir(virtualPath))
+	if err != nil {
+		return nil
+	}
+	if folderLimits.isLimitReached(vfolder.Name, vfolder.Limits) {
+		c.Log(logger.LevelInfo, "transfer for %q denied, too many concurrent transfers for folder %q",
+			virtualPath, vfolder.Name)
+		return ErrFolderTransfers
+	}
+	return nil
+}
+
 // SignalTransferClose makes the transfer fail on the next read/write with the
 // specified error
 func (c *BaseConnection) SignalTransferClose(transferID int64, err error) {
@@ -214,6 +271,22 @@ func (c *BaseConnection) SignalTransferClose(transferID int64, err error) {
 	}
 }
 
+// SetTransferBandwidthLimit sets the bandwidth limit, as KB/s, for the transfer
+// with the specified id. It returns false if the transfer does not exist
+func (c *BaseConnection) SetTransferBandwidthLimit(transferID int64, bandwidth int64) bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	for _, t := range c.activeTransfers {
+		if t.GetID() == transferID {
+			c.Log(logger.LevelInfo, "set bandwidth limit %d KB/s for transfer id %v", bandwidth, transferID)
+			t.SetBandwidthLimit(bandwidth)
+			return true
+		}
+	}
+	return false
+}
+
 // GetTransfers returns the active transfers
 func (c *BaseConnection) GetTransfers() []ConnectionTransfer {
 	c.RLock()
@@ -229,14 +302,15 @@ func (c *BaseConnection) GetTransfers() []ConnectionTransfer {
 			operationType = operationUpload
 		}
 		transfers = append(transfers, ConnectionTransfer{
-			ID:            t.GetID(),
-			OperationType: operationType,
-			StartTime:     util.GetTimeAsMsSinceEpoch(t.GetStartTime()),
-			Size:          t.GetSize(),
-			VirtualPath:   t.GetVirtualPath(),
-			HasSizeLimit:  t.HasSizeLimit(),
-			ULSize:        t.GetUploadedSize(),
-			DLSize:        t.GetDownloadedSize(),
+			ID:             t.GetID(),
+			OperationType:  operationType,
+			StartTime:      util.GetTimeAsMsSinceEpoch(t.GetStartTime()),
+			Size:           t.GetSize(),
+			VirtualPath:    t.GetVirtualPath(),
+			BandwidthLimit: t.GetBandwidthLimit(),
+			HasSizeLimit:   t.HasSizeLimit(),
+			ULSize:         t.GetUploadedSize(),
+			DLSize:         t.GetDownloadedSize(),
 		})
 	}
 
@@ -298,6 +372,17 @@ func (c *BaseConnection) truncateOpenHandle(fsPath string, size int64) (int64, e
 
 // ListDir reads the directory matching virtualPath and returns a list of directory entries
 func (c *BaseConnection) ListDir(virtualPath string) ([]os.FileInfo, error) {
+	lister, err := c.GetDirLister(virtualPath)
+	if err != nil {
+		return nil, err
+	}
+	return vfs.ReadAllFromDirLister(lister)
+}
+
+// GetDirLister returns a lister for the directory matching virtualPath.
+// The directory entries are read in chunks, if supported by the storage backend,
+// so the whole listing is never loaded in memory. The lister must be closed
+func (c *BaseConnection) GetDirLister(virtualPath string) (*DirListerAt, error) {
 	if !c.User.HasPerm(dataprovider.PermListItems, virtualPath) {
 		return nil, c.GetPermissionDeniedError()
 	}
@@ -311,7 +396,7 @@ func (c *BaseConnection) ListDir(virtualPath string) ([]os.FileInfo, error) {
 		return nil, c.GetPermissionDeniedError()
 	}
 	startTime := time.Now()
-	files, err := fs.ReadDir(fsPath)
+	lister, err := vfs.ListDir(fs, fsPath)
 	if err != nil {
 		c.Log(logger.LevelDebug, "error listing directory: %+v", err)
 		return nil, c.GetFsError(fs, err)
@@ -321,7 +406,12 @@ func (c *BaseConnection) ListDir(virtualPath string) ([]os.FileInfo, error) {
 	logger.CommandLog(lsdirLogSender, fsPath, "", c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "", -1,
 		c.localAddr, c.remoteAddr, elapsed)
 
-	return c.User.FilterListDir(files, virtualPath), nil
+	return &DirListerAt{
+		conn:   c,
+		fs:     fs,
+		filter: c.User.NewDirListFilter(virtualPath),
+		lister: lister,
+	}, nil
 }
 
 // CheckParentDirs tries to create the specified directory and any missing parent dirs
@@ -413,6 +503,9 @@ func (c *BaseConnection) RemoveFile(fs vfs.Fs, fsPath, virtualPath string, info
 	if err := c.IsRemoveFileAllowed(virtualPath); err != nil {
 		return err
 	}
+	if err := c.CheckWORMProtection(virtualPath, info); err != nil {
+		return err
+	}
 
 	size := info.Size()
 	status, err := ExecutePreAction(c, operationPreDelete, fsPath, virtualPath, size, 0)
@@ -437,17 +530,65 @@ func (c *BaseConnection) RemoveFile(fs vfs.Fs, fsPath, virtualPath string, info
 	logger.CommandLog(removeLogSender, fsPath, "", c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "", -1,
 		c.localAddr, c.remoteAddr, elapsed)
 	if updateQuota && info.Mode()&os.ModeSymlink == 0 {
-		vfolder, err := c.User.GetVirtualFolderForPath(path.Dir(virtualPath))
-		if err == nil {
-			dataprovider.UpdateVirtualFolderQuota(&vfolder.BaseVirtualFolder, -1, -size, false) //nolint:errcheck
-			if vfolder.IsIncludedInUserQuota() {
-				dataprovider.UpdateUserQuota(&c.User, -1, -size, false) //nolint:errcheck
-			}
-		} else {
+		c.updateQuotaAfterRemove(virtualPath, size)
+	}
+	c.progress.add(1, size)
+	ExecuteActionNotification(c, operationDelete, fsPath, virtualPath, "", "", "", size, nil, elapsed) //nolint:errcheck
+	return nil
+}
+
+func (c *BaseConnection) updateQuotaAfterRemove(virtualPath string, size int64) {
+	vfolder, err := c.User.GetVirtualFolderForPath(path.Dir(virtualPath))
+	if err == nil {
+		dataprovider.UpdateVirtualFolderQuota(&vfolder.BaseVirtualFolder, -1, -size, false) //nolint:errcheck
+		if vfolder.IsIncludedInUserQuota() {
 			dataprovider.UpdateUserQuota(&c.User, -1, -size, false) //nolint:errcheck
 		}
+	} else {
+		dataprovider.UpdateUserQuota(&c.User, -1, -size, false) //nolint:errcheck
+	}
+}
+
+// removeFiles removes the specified files, contained in virtualDirPath, using
+// a single request for filesystems supporting batch removals
+func (c *BaseConnection) removeFiles(fs vfs.FsBatchRemover, virtualDirPath string, files []os.FileInfo) error {
+	fsPaths := make([]string, 0, len(files))
+	for _, info := range files {
+		virtualPath := path.Join(virtualDirPath, info.Name())
+		if err := c.IsRemoveFileAllowed(virtualPath); err != nil {
+			return err
+		}
+		if err := c.CheckWORMProtection(virtualPath, info); err != nil {
+			return err
+		}
+		fsPath, err := fs.ResolvePath(virtualPath)
+		if err != nil {
+			return c.GetFsError(fs, err)
+		}
+		if _, err := ExecutePreAction(c, operationPreDelete, fsPath, virtualPath, info.Size(), 0); err != nil {
+			c.Log(logger.LevelDebug, "delete for file %q denied by pre action: %v", virtualPath, err)
+			return c.GetPermissionDeniedError()
+		}
+		fsPaths = append(fsPaths, fsPath)
+	}
+	startTime := time.Now()
+	if err := fs.RemoveFiles(fsPaths); err != nil {
+		c.Log(logger.LevelError, "failed to remove %d files inside %q: %+v", len(fsPaths), virtualDirPath, err)
+		return c.GetFsError(fs, err)
+	}
+	elapsed := time.Since(startTime).Nanoseconds() / 1000000
+
+	for idx, info := range files {
+		virtualPath := path.Join(virtualDirPath, info.Name())
+		size := info.Size()
+		logger.CommandLog(removeLogSender, fsPaths[idx], "", c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "",
+			-1, c.localAddr, c.remoteAddr, elapsed)
+		if info.Mode()&os.ModeSymlink == 0 {
+			c.updateQuotaAfterRemove(virtualPath, size)
+		}
+		c.progress.add(1, size)
+		ExecuteActionNotification(c, operationDelete, fsPaths[idx], virtualPath, "", "", "", size, nil, elapsed) //nolint:errcheck
 	}
-	ExecuteActionNotification(c, operationDelete, fsPath, virtualPath, "", "", "", size, nil, elapsed) //nolint:errcheck
 	return nil
 }
 
@@ -531,12 +672,23 @@ func (c *BaseConnection) doRecursiveRemove(fs vfs.Fs, fsPath, virtualPath string
 		if err != nil {
 			return fmt.Errorf("unable to get contents for dir %q: %w", virtualPath, err)
 		}
+		remover, canBatchRemove := fs.(vfs.FsBatchRemover)
+		var files []os.FileInfo
 		for _, fi := range entries {
+			if canBatchRemove && !fi.IsDir() {
+				files = append(files, fi)
+				continue
+			}
 			targetPath := path.Join(virtualPath, fi.Name())
 			if err := c.doRecursiveRemoveDirEntry(targetPath, fi); err != nil {
 				return err
 			}
 		}
+		if len(files) > 0 {
+			if err := c.removeFiles(remover, virtualPath, files); err != nil {
+				return err
+			}
+		}
 		return c.RemoveDir(virtualPath)
 	}
 	return c.RemoveFile(fs, fsPath, virtualPath, info)
@@ -598,17 +750,35 @@ func (c *BaseConnection) copyFile(virtualSourcePath, virtualTargetPath string, s
 	if ok, _ := c.User.IsFileAllowed(virtualTargetPath); !ok {
 		return fmt.Errorf("file %q is not allowed: %w", virtualTargetPath, c.GetPermissionDeniedError())
 	}
+	if c.IsMIMEPolicyEnabled(virtualTargetPath) {
+		fs, fsSourcePath, err := c.GetFsAndResolvedPath(virtualSourcePath)
+		if err != nil {
+			return err
+		}
+		if err := c.checkContentTypeForPath(fs, fsSourcePath, virtualTargetPath); err != nil {
+			return err
+		}
+	}
 	if c.IsSameResource(virtualSourcePath, virtualTargetPath) {
 		fs, fsTargetPath, err := c.GetFsAndResolvedPath(virtualTargetPath)
 		if err != nil {
 			return err
 		}
 		if copier, ok := fs.(vfs.FsFileCopier); ok {
+			if info, err := fs.Lstat(fsTargetPath); err == nil {
+				if err := c.CheckWORMProtection(virtualTargetPath, info); err != nil {
+					return err
+				}
+			}
 			_, fsSourcePath, err := c.GetFsAndResolvedPath(virtualSourcePath)
 			if err != nil {
 				return err
 			}
-			return copier.CopyFile(fsSourcePath, fsTargetPath, srcSize)
+			if err := copier.CopyFile(fsSourcePath, fsTargetPath, srcSize); err != nil {
+				return err
+			}
+			c.progress.add(1, srcSize)
+			return nil
 		}
 	}
 
@@ -627,8 +797,12 @@ func (c *BaseConnection) copyFile(virtualSourcePath, virtualTargetPath string, s
 
 	startTime := time.Now()
 	_, err = io.Copy(writer, reader)
-	return closeWriterAndUpdateQuota(writer, c, virtualSourcePath, virtualTargetPath, numFiles, truncatedSize,
+	err = closeWriterAndUpdateQuota(writer, c, virtualSourcePath, virtualTargetPath, numFiles, truncatedSize,
 		err, operationCopy, startTime)
+	if err == nil {
+		c.progress.add(1, srcSize)
+	}
+	return err
 }
 
 func (c *BaseConnection) doRecursiveCopy(virtualSourcePath, virtualTargetPath string, srcInfo os.FileInfo,
@@ -674,6 +848,9 @@ func (c *BaseConnection) doRecursiveCopy(virtualSourcePath, virtualTargetPath st
 		c.Log(logger.LevelInfo, "skipping copy for non regular file %q", virtualSourcePath)
 		return nil
 	}
+	if err := c.progress.checkCanceled(); err != nil {
+		return err
+	}
 
 	return c.copyFile(virtualSourcePath, virtualTargetPath, srcInfo.Size())
 }
@@ -723,7 +900,13 @@ func (c *BaseConnection) Copy(virtualSourcePath, virtualTargetPath string) error
 	defer close(done)
 	go keepConnectionAlive(c, done, 2*time.Minute)
 
-	return c.doRecursiveCopy(virtualSourcePath, destPath, srcInfo, createTargetDir)
+	if err := c.doRecursiveCopy(virtualSourcePath, destPath, srcInfo, createTargetDir); err != nil {
+		return err
+	}
+	if err := dataprovider.CopyFileMetadata(c.User.Username, virtualSourcePath, destPath); err != nil {
+		c.Log(logger.LevelWarn, "unable to copy custom metadata from %q to %q: %v", virtualSourcePath, destPath, err)
+	}
+	return nil
 }
 
 // Rename renames (moves) virtualSourcePath to virtualTargetPath
@@ -751,6 +934,17 @@ func (c *BaseConnection) renameInternal(virtualSourcePath, virtualTargetPath str
 	if !c.isRenamePermitted(fsSrc, fsDst, fsSourcePath, fsTargetPath, virtualSourcePath, virtualTargetPath, srcInfo) {
 		return c.GetPermissionDeniedError()
 	}
+	if srcInfo.IsDir() {
+		err = c.checkWORMDirRename(virtualSourcePath)
+	} else {
+		err = c.CheckWORMProtection(virtualSourcePath, srcInfo)
+	}
+	if err != nil {
+		return err
+	}
+	if err := c.checkRenameContentType(fsSrc, fsSourcePath, virtualSourcePath, virtualTargetPath, srcInfo); err != nil {
+		return err
+	}
 	initialSize := int64(-1)
 	if dstInfo, err := fsDst.Lstat(fsTargetPath); err == nil {
 		checkParentDestination = false
@@ -768,6 +962,9 @@ func (c *BaseConnection) renameInternal(virtualSourcePath, virtualTargetPath str
 				"has no overwrite permission", virtualSourcePath, virtualTargetPath, c.User.Username)
 			return c.GetPermissionDeniedError()
 		}
+		if err := c.CheckWORMProtection(virtualTargetPath, dstInfo); err != nil {
+			return err
+		}
 	}
 	if srcInfo.IsDir() {
 		if err := c.checkFolderRename(fsSrc, fsDst, fsSourcePath, fsTargetPath, virtualSourcePath, virtualTargetPath, srcInfo); err != nil {
@@ -792,6 +989,9 @@ func (c *BaseConnection) renameInternal(virtualSourcePath, virtualTargetPath str
 	}
 	vfs.SetPathPermissions(fsDst, fsTargetPath, c.User.GetUID(), c.User.GetGID())
 	elapsed := time.Since(startTime).Nanoseconds() / 1000000
+	if files > 0 {
+		c.progress.add(files, size)
+	}
 	c.updateQuotaAfterRename(fsDst, virtualSourcePath, virtualTargetPath, fsTargetPath, initialSize, files, size) //nolint:errcheck
 	logger.CommandLog(renameLogSender, fsSourcePath, fsTargetPath, c.User.Username, "", c.ID, c.protocol, -1, -1,
 		"", "", "", -1, c.localAddr, c.remoteAddr, elapsed)
@@ -814,6 +1014,12 @@ func (c *BaseConnection) CreateSymlink(virtualSourcePath, virtualTargetPath stri
 		c.Log(logger.LevelWarn, "cross folder symlink is not supported, src: %v dst: %v", virtualSourcePath, virtualTargetPath)
 		return c.GetOpUnsupportedError()
 	}
+	// writing to a symlink overwrites the linked file, so symlinks are not
+	// allowed inside WORM folders
+	if c.IsWORMEnabled(virtualTargetPath) {
+		c.Log(logger.LevelInfo, "creating symlink %q inside a WORM folder is not allowed", virtualTargetPath)
+		return c.GetWORMProtectedError()
+	}
 	// we cannot have a cross folder request here so only one fs is enough
 	fs, fsSourcePath, err := c.GetFsAndResolvedPath(virtualSourcePath)
 	if err != nil {
@@ -1003,6 +1209,22 @@ func (c *BaseConnection) SetStat(virtualPath string, attributes *StatAttributes)
 		return err
 	}
 	pathForPerms := c.getPathForSetStatPerms(fs, fsPath, virtualPath)
+	if c.IsWORMEnabled(virtualPath) {
+		// the retention starts from the modification time, so it cannot be
+		// changed by the clients, not even while the file is being uploaded
+		if attributes.Flags&StatAttrTimes != 0 && Config.SetstatMode != 1 {
+			c.Log(logger.LevelInfo, "denying modification time change for %q inside a WORM folder", virtualPath)
+			return c.GetWORMProtectedError()
+		}
+		// the files uploaded within this connection can be changed until the upload ends
+		if !c.isUploading(virtualPath) {
+			if info, err := fs.Lstat(fsPath); err == nil {
+				if err := c.CheckWORMProtection(virtualPath, info); err != nil {
+					return err
+				}
+			}
+		}
+	}
 
 	if attributes.Flags&StatAttrTimes != 0 {
 		if err = c.handleChtimes(fs, fsPath, pathForPerms, attributes); err != nil {
@@ -1573,7 +1795,7 @@ func (c *BaseConnection) IsNotExistError(err error) bool {
 	switch c.protocol {
 	case ProtocolSFTP:
 		return errors.Is(err, sftp.ErrSSHFxNoSuchFile)
-	case ProtocolWebDAV, ProtocolFTP, ProtocolHTTP, ProtocolOIDC, ProtocolHTTPShare, ProtocolDataRetention:
+	case ProtocolWebDAV, ProtocolFTP, ProtocolHTTP, ProtocolOIDC, ProtocolSAML, ProtocolHTTPShare, ProtocolDataRetention:
 		return errors.Is(err, os.ErrNotExist)
 	default:
 		return errors.Is(err, ErrNotExist)
@@ -1600,7 +1822,7 @@ func (c *BaseConnection) GetNotExistError() error {
 	switch c.protocol {
 	case ProtocolSFTP:
 		return sftp.ErrSSHFxNoSuchFile
-	case ProtocolWebDAV, ProtocolFTP, ProtocolHTTP, ProtocolOIDC, ProtocolHTTPShare, ProtocolDataRetention:
+	case ProtocolWebDAV, ProtocolFTP, ProtocolHTTP, ProtocolOIDC, ProtocolSAML, ProtocolHTTPShare, ProtocolDataRetention:
 		return os.ErrNotExist
 	default:
 		return ErrNotExist
@@ -1672,9 +1894,13 @@ func (c *BaseConnection) GetGenericError(err error) error {
 		if err == vfs.ErrStorageSizeUnavailable {
 			return fmt.Errorf("%w: %v", sftp.ErrSSHFxOpUnsupported, err.Error())
 		}
-		if err == ErrShuttingDown {
+		if err == ErrShuttingDown || err == ErrMemoryBudgetExhausted {
 			return fmt.Errorf("%w: %v", sftp.ErrSSHFxFailure, err.Error())
 		}
+		if errors.Is(err, sftp.ErrSSHFxPermissionDenied) {
+			// for example the content type denied error returned on close
+			return err
+		}
 		if err != nil {
 			if e, ok := err.(*os.PathError); ok {
 				c.Log(logger.LevelError, "generic path error: %+v", e)
@@ -1687,7 +1913,7 @@ func (c *BaseConnection) GetGenericError(err error) error {
 	default:
 		if err == ErrPermissionDenied || err == ErrNotExist || err == ErrOpUnsupported ||
 			err == ErrQuotaExceeded || err == ErrReadQuotaExceeded || err == vfs.ErrStorageSizeUnavailable ||
-			err == ErrShuttingDown {
+			err == ErrShuttingDown || err == ErrContentTypeDenied || err == ErrMemoryBudgetExhausted {
 			return err
 		}
 		c.Log(logger.LevelError, "generic error: %+v", err)
@@ -1747,7 +1973,7 @@ func getPermissionDeniedError(protocol string) error {
 	switch protocol {
 	case ProtocolSFTP:
 		return sftp.ErrSSHFxPermissionDenied
-	case ProtocolWebDAV, ProtocolFTP, ProtocolHTTP, ProtocolOIDC, ProtocolHTTPShare, ProtocolDataRetention:
+	case ProtocolWebDAV, ProtocolFTP, ProtocolHTTP, ProtocolOIDC, ProtocolSAML, ProtocolHTTPShare, ProtocolDataRetention:
 		return os.ErrPermission
 	default:
 		return ErrPermissionDenied
@@ -1769,3 +1995,92 @@ func keepConnectionAlive(c *BaseConnection, done chan bool, interval time.Durati
 		}
 	}
 }
+
+// DirListerAt streams a directory listing adding the virtual folders and
+// removing the hidden items. It implements the vfs.DirLister interface and
+// the sftp.ListerAt interface
+type DirListerAt struct {
+	conn   *BaseConnection
+	fs     vfs.Fs
+	filter *dataprovider.DirListFilter
+	lister vfs.DirLister
+	mu     sync.Mutex
+	cache  []os.FileInfo
+	offset int64
+	eof    bool
+}
+
+// Prepend adds the specified entry before the ones already returned
+// by this lister, for example "." and ".."
+func (l *DirListerAt) Prepend(fi os.FileInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.cache = util.PrependFileInfo(l.cache, fi)
+}
+
+// Next implements the vfs.DirLister interface
+func (l *DirListerAt) Next(limit int) ([]os.FileInfo, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	files, err := l.next(limit)
+	l.offset += int64(len(files))
+	return files, err
+}
+
+// ListAt implements the sftp.ListerAt interface.
+// The entries must be requested sequentially
+func (l *DirListerAt) ListAt(f []os.FileInfo, offset int64) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if offset != l.offset {
+		return 0, sftp.ErrSSHFxFailure
+	}
+	if len(f) == 0 {
+		return 0, nil
+	}
+	files, err := l.next(len(f))
+	n := copy(f, files)
+	l.offset += int64(n)
+	return n, err
+}
+
+func (l *DirListerAt) next(limit int) ([]os.FileInfo, error) {
+	if limit <= 0 {
+		limit = vfs.ListerBatchSize
+	}
+	for !l.eof && len(l.cache) < limit {
+		files, err := l.lister.Next(limit - len(l.cache))
+		if err != nil && !errors.Is(err, io.EOF) {
+			l.conn.Log(logger.LevelDebug, "error listing directory: %+v", err)
+			return nil, l.conn.GetFsError(l.fs, err)
+		}
+		l.cache = append(l.cache, l.filter.Filter(files)...)
+		if err != nil {
+			l.eof = true
+			l.cache = append(l.cache, l.filter.RemainingVirtualFolders()...)
+		}
+	}
+	if len(l.cache) == 0 {
+		return nil, io.EOF
+	}
+	if limit >= len(l.cache) {
+		result := l.cache
+		l.cache = nil
+		return result, nil
+	}
+	result := l.cache[:limit:limit]
+	l.cache = l.cache[limit:]
+	return result, nil
+}
+
+// Close implements the vfs.DirLister interface
+func (l *DirListerAt) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.cache = nil
+	return l.lister.Close()
+}
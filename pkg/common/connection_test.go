@@ -17,6 +17,7 @@ package common
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
@@ -127,6 +128,105 @@ func TestRemoveErrors(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestFailoverFs(t *testing.T) {
+	folderName := "failover_fs_test"
+	primaryDir := filepath.Join(os.TempDir(), "failover_primary")
+	secondaryDir := filepath.Join(os.TempDir(), "failover_secondary")
+	err := os.MkdirAll(primaryDir, os.ModePerm)
+	assert.NoError(t, err)
+	err = os.MkdirAll(secondaryDir, os.ModePerm)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(secondaryDir, "file.txt"), []byte("content"), 0666)
+	assert.NoError(t, err)
+
+	primary := newMockOsFs(false, "", primaryDir, "", errors.New("connection lost"))
+	secondary := vfs.NewOsFs("", secondaryDir, "", nil)
+	fs := vfs.NewFailoverFs("", "", folderName, primary, secondary, vfs.FolderFailover{
+		Timeout: 1,
+	})
+	assert.Equal(t, "failoverfs", fs.Name())
+	assert.False(t, fs.IsAtomicUploadSupported())
+	assert.False(t, fs.HasVirtualFolders())
+	assert.Equal(t, "/file.txt", fs.GetRelativePath("file.txt"))
+	fsPath, err := fs.ResolvePath("/dir/../file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "/file.txt", fsPath)
+
+	// the primary backend fails after returning some entries, the secondary one is not used
+	var walked []string
+	err = fs.Walk("/", func(walkedPath string, _ os.FileInfo, _ error) error {
+		walked = append(walked, walkedPath)
+		return nil
+	})
+	assert.Error(t, err)
+	assert.Len(t, walked, 1)
+	status := vfs.GetFolderFailoverStatus(folderName)
+	assert.False(t, status.Active)
+	// the primary backend returns an error, the secondary one is used
+	info, err := fs.Lstat(fsPath)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), info.Size())
+	status = vfs.GetFolderFailoverStatus(folderName)
+	assert.True(t, status.Active)
+	assert.Equal(t, int64(1), status.Failovers)
+	assert.Equal(t, "connection lost", status.LastError)
+	// writes are journaled while the failover is active
+	err = fs.Mkdir("/sub")
+	assert.NoError(t, err)
+	assert.DirExists(t, filepath.Join(secondaryDir, "sub"))
+	assert.NoDirExists(t, filepath.Join(primaryDir, "sub"))
+	_, _, err = fs.Rename("/file.txt", "/sub/file.txt")
+	assert.NoError(t, err)
+	status = vfs.GetFolderFailoverStatus(folderName)
+	if assert.Len(t, status.Journal, 2) {
+		assert.Equal(t, vfs.FailoverOpMkdir, status.Journal[0].Operation)
+		assert.Equal(t, "/sub", status.Journal[0].Path)
+		assert.True(t, status.Journal[0].IsDir)
+		assert.Equal(t, vfs.FailoverOpRename, status.Journal[1].Operation)
+		assert.Equal(t, "/file.txt", status.Journal[1].Path)
+		assert.Equal(t, "/sub/file.txt", status.Journal[1].Target)
+	}
+	// failed operations are not journaled
+	err = fs.Remove("/missing", false)
+	assert.True(t, fs.IsNotExist(err))
+	status = vfs.GetFolderFailoverStatus(folderName)
+	assert.Len(t, status.Journal, 2)
+	found := false
+	for _, s := range vfs.GetFoldersFailoverStatus() {
+		if s.Folder == folderName {
+			found = true
+		}
+	}
+	assert.True(t, found)
+	err = fs.Close()
+	assert.NoError(t, err)
+	// a missing primary backend
+	secondary = vfs.NewOsFs("", secondaryDir, "/vdir", nil)
+	fs = vfs.NewFailoverFs("", "/vdir", folderName, nil, secondary, vfs.FolderFailover{})
+	_, err = fs.Stat("/vdir/sub/file.txt")
+	assert.NoError(t, err)
+	assert.True(t, fs.CheckRootPath("", -1, -1))
+	assert.True(t, fs.IsUploadResumeSupported())
+	err = fs.Chmod("/vdir/sub/file.txt", 0600)
+	assert.NoError(t, err)
+	status = vfs.GetFolderFailoverStatus(folderName)
+	if assert.Len(t, status.Journal, 3) {
+		assert.Equal(t, vfs.FailoverOpChmod, status.Journal[2].Operation)
+		assert.Equal(t, "/sub/file.txt", status.Journal[2].Path)
+	}
+
+	vfs.RemoveFolderFailoverStatus(folderName)
+	status = vfs.GetFolderFailoverStatus(folderName)
+	assert.False(t, status.Active)
+	assert.Len(t, status.Journal, 0)
+	vfs.RemoveFolderFailoverStatus(folderName)
+
+	err = os.RemoveAll(primaryDir)
+	assert.NoError(t, err)
+	err = os.RemoveAll(secondaryDir)
+	assert.NoError(t, err)
+}
+
 func TestSetStatMode(t *testing.T) {
 	oldSetStatMode := Config.SetstatMode
 	Config.SetstatMode = 1
@@ -381,7 +481,7 @@ func TestErrorsMapping(t *testing.T) {
 	fs := vfs.NewOsFs("", os.TempDir(), "", nil)
 	conn := NewBaseConnection("", ProtocolSFTP, "", "", dataprovider.User{BaseUser: sdk.BaseUser{HomeDir: os.TempDir()}})
 	osErrorsProtocols := []string{ProtocolWebDAV, ProtocolFTP, ProtocolHTTP, ProtocolHTTPShare,
-		ProtocolDataRetention, ProtocolOIDC, protocolEventAction}
+		ProtocolDataRetention, ProtocolOIDC, ProtocolSAML, protocolEventAction}
 	for _, protocol := range supportedProtocols {
 		conn.SetProtocol(protocol)
 		err := conn.GetFsError(fs, os.ErrNotExist)
@@ -1034,3 +1134,97 @@ func TestFilePatterns(t *testing.T) {
 	filtered = user.FilterListDir(dirContents, "/dir3/ic35/abc")
 	require.Len(t, filtered, 1)
 }
+
+func TestDirListerAt(t *testing.T) {
+	homePath := filepath.Join(os.TempDir(), "dir_lister_home")
+	require.NoError(t, os.MkdirAll(homePath, os.ModePerm))
+	defer os.RemoveAll(homePath)
+
+	numFiles := 10
+	for i := 0; i < numFiles; i++ {
+		require.NoError(t, os.WriteFile(filepath.Join(homePath, fmt.Sprintf("file%d.txt", i)), []byte("data"), 0666))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(homePath, "file.jpg"), []byte("data"), 0666))
+	require.NoError(t, os.WriteFile(filepath.Join(homePath, "vdir1"), []byte("data"), 0666))
+
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "dir_lister_user",
+			HomeDir:  homePath,
+		},
+		Filters: dataprovider.UserFilters{
+			BaseUserFilters: sdk.BaseUserFilters{
+				FilePatterns: []sdk.PatternsFilter{
+					{
+						Path:           "/",
+						DenyPolicy:     sdk.DenyPolicyHide,
+						DeniedPatterns: []string{"*.jpg"},
+					},
+				},
+			},
+		},
+		VirtualFolders: []vfs.VirtualFolder{
+			{
+				BaseVirtualFolder: vfs.BaseVirtualFolder{
+					Name:       "vdir1",
+					MappedPath: filepath.Join(os.TempDir(), "vdir1"),
+				},
+				VirtualPath: "/vdir1",
+			},
+			{
+				BaseVirtualFolder: vfs.BaseVirtualFolder{
+					Name:       "vdir2",
+					MappedPath: filepath.Join(os.TempDir(), "vdir2"),
+				},
+				VirtualPath: "/vdir2",
+			},
+		},
+	}
+	user.Permissions = make(map[string][]string)
+	user.Permissions["/"] = []string{dataprovider.PermAny}
+	conn := NewBaseConnection("", ProtocolSFTP, "", "", user)
+
+	files, err := conn.ListDir("/")
+	assert.NoError(t, err)
+	assert.Len(t, files, numFiles+2)
+
+	lister, err := conn.GetDirLister("/")
+	require.NoError(t, err)
+	lister.Prepend(vfs.NewFileInfo(".", true, 0, time.Unix(0, 0), false))
+	buf := make([]os.FileInfo, 3)
+	var names []string
+	var offset int64
+	for {
+		n, err := lister.ListAt(buf, offset)
+		for _, fi := range buf[:n] {
+			names = append(names, fi.Name())
+			if fi.Name() == "vdir1" {
+				assert.True(t, fi.IsDir())
+			}
+		}
+		offset += int64(n)
+		if err != nil {
+			assert.ErrorIs(t, err, io.EOF)
+			break
+		}
+		assert.Greater(t, n, 0)
+	}
+	assert.Len(t, names, numFiles+3)
+	assert.Equal(t, ".", names[0])
+	// virtual folders not found in the listing are added at the end
+	assert.Equal(t, "vdir2", names[len(names)-1])
+	assert.NotContains(t, names, "file.jpg")
+	assert.NoError(t, lister.Close())
+	// the entries must be requested sequentially
+	lister, err = conn.GetDirLister("/")
+	require.NoError(t, err)
+	_, err = lister.ListAt(buf, 1)
+	assert.Error(t, err)
+	assert.NoError(t, lister.Close())
+
+	_, err = conn.GetDirLister("/missing")
+	assert.Error(t, err)
+	conn.User.Permissions["/"] = []string{dataprovider.PermDownload}
+	_, err = conn.GetDirLister("/")
+	assert.ErrorIs(t, err, sftp.ErrSSHFxPermissionDenied)
+}
@@ -0,0 +1,207 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	maxConsentDocumentSize = 1048576
+)
+
+// ErrConsentsRequired defines the error returned if a user must accept the
+// configured consent documents before logging in
+var ErrConsentsRequired = errors.New("consent documents acceptance required")
+
+// ConsentDocument defines a document, for example the terms of service or an
+// acceptable use policy, that users must accept before using their account
+type ConsentDocument struct {
+	// Unique name for the document, it is recorded with the acceptances
+	Name string `json:"name" mapstructure:"name"`
+	// Title displayed to the users
+	Title string `json:"title" mapstructure:"title"`
+	// Version of the document, it is recorded with the acceptances.
+	// Change it each time the document is updated
+	Version string `json:"version" mapstructure:"version"`
+	// Absolute path to a plain text file with the document contents
+	Path string `json:"path" mapstructure:"path"`
+	// If true, users who accepted a previous version must accept the current one
+	ReacceptOnUpdate bool `json:"reaccept_on_update" mapstructure:"reaccept_on_update"`
+	content          string
+}
+
+// GetContent returns the document contents
+func (d *ConsentDocument) GetContent() string {
+	return d.content
+}
+
+// IsAcceptedBy returns true if the specified user accepted the document
+func (d *ConsentDocument) IsAcceptedBy(user *dataprovider.User) bool {
+	if d.ReacceptOnUpdate {
+		return user.HasAcceptedConsent(d.Name, d.Version)
+	}
+	return user.HasAcceptedConsent(d.Name, "")
+}
+
+func (d *ConsentDocument) load() error {
+	d.Name = strings.TrimSpace(d.Name)
+	d.Version = strings.TrimSpace(d.Version)
+	if d.Name == "" {
+		return errors.New("consents: document name is mandatory")
+	}
+	if d.Version == "" {
+		return fmt.Errorf("consents: version is mandatory for document %q", d.Name)
+	}
+	if d.Title == "" {
+		d.Title = d.Name
+	}
+	if !filepath.IsAbs(d.Path) {
+		return fmt.Errorf("consents: invalid path %q for document %q, it must be an absolute path", d.Path, d.Name)
+	}
+	info, err := os.Stat(d.Path)
+	if err != nil {
+		return fmt.Errorf("consents: unable to stat document %q: %w", d.Name, err)
+	}
+	if !info.Mode().IsRegular() || info.Size() > maxConsentDocumentSize {
+		return fmt.Errorf("consents: document %q must be a regular file, max size %d bytes", d.Name, maxConsentDocumentSize)
+	}
+	content, err := os.ReadFile(d.Path)
+	if err != nil {
+		return fmt.Errorf("consents: unable to read document %q: %w", d.Name, err)
+	}
+	d.content = string(content)
+	return nil
+}
+
+// ConsentsConfig defines the documents, for example the terms of service, that
+// users must accept on their first WebClient login
+type ConsentsConfig struct {
+	// Documents to accept
+	Documents []ConsentDocument `json:"documents" mapstructure:"documents"`
+	// If true, users cannot login using SFTP, FTP, WebDAV and the REST API until
+	// they accept the documents from the WebClient or using a consent link
+	EnforceForProtocols bool `json:"enforce_for_protocols" mapstructure:"enforce_for_protocols"`
+	// Validity, as hours, for the consent links that admins can generate for
+	// users who cannot login to the WebClient
+	LinkValidity int `json:"link_validity" mapstructure:"link_validity"`
+}
+
+func (c *ConsentsConfig) validate() error {
+	if len(c.Documents) == 0 {
+		return nil
+	}
+	if c.LinkValidity < 1 || c.LinkValidity > 720 {
+		return fmt.Errorf("consents: invalid link validity %d, valid range: 1-720", c.LinkValidity)
+	}
+	names := make(map[string]bool)
+	for idx := range c.Documents {
+		doc := &c.Documents[idx]
+		if err := doc.load(); err != nil {
+			return err
+		}
+		if names[doc.Name] {
+			return fmt.Errorf("consents: duplicate document %q", doc.Name)
+		}
+		names[doc.Name] = true
+	}
+	return nil
+}
+
+// IsConsentsEnabled returns true if there are consent documents to accept
+func IsConsentsEnabled() bool {
+	return len(Config.Consents.Documents) > 0
+}
+
+// GetConsentLinkValidity returns the validity for the consent links
+func GetConsentLinkValidity() time.Duration {
+	return time.Duration(Config.Consents.LinkValidity) * time.Hour
+}
+
+// GetConsentDocuments returns the configured consent documents
+func GetConsentDocuments() []ConsentDocument {
+	return Config.Consents.Documents
+}
+
+// GetPendingConsents returns the consent documents that the specified user
+// has not accepted yet
+func GetPendingConsents(user *dataprovider.User) []ConsentDocument {
+	var result []ConsentDocument
+	for _, doc := range Config.Consents.Documents {
+		if !doc.IsAcceptedBy(user) {
+			result = append(result, doc)
+		}
+	}
+	return result
+}
+
+// MustAcceptConsents returns true if the user has consent documents to accept
+func MustAcceptConsents(user *dataprovider.User) bool {
+	for idx := range Config.Consents.Documents {
+		if !Config.Consents.Documents[idx].IsAcceptedBy(user) {
+			return true
+		}
+	}
+	return false
+}
+
+// MustAcceptConsentsForProtocol returns true if the user has consent documents
+// to accept before logging in using the specified protocol
+func MustAcceptConsentsForProtocol(user *dataprovider.User, protocol string) bool {
+	if !Config.Consents.EnforceForProtocols {
+		return false
+	}
+	switch protocol {
+	case ProtocolSSH, ProtocolFTP, ProtocolWebDAV, ProtocolHTTP:
+		return MustAcceptConsents(user)
+	default:
+		return false
+	}
+}
+
+// CheckConsentsForProtocol returns ErrConsentsRequired if the user has consent
+// documents to accept before logging in using the specified protocol
+func CheckConsentsForProtocol(user *dataprovider.User, protocol string) error {
+	if MustAcceptConsentsForProtocol(user, protocol) {
+		return fmt.Errorf("%w, please accept them using the WebClient or the link provided by your administrator",
+			ErrConsentsRequired)
+	}
+	return nil
+}
+
+// GetConsentRecords returns the consent records to save when the specified
+// user accepts the given pending documents
+func GetConsentRecords(documents []ConsentDocument, ipAddr, method string) []dataprovider.UserConsent {
+	now := util.GetTimeAsMsSinceEpoch(time.Now())
+	result := make([]dataprovider.UserConsent, 0, len(documents))
+	for _, doc := range documents {
+		result = append(result, dataprovider.UserConsent{
+			Document:   doc.Name,
+			Version:    doc.Version,
+			AcceptedAt: now,
+			IP:         ipAddr,
+			Method:     method,
+		})
+	}
+	return result
+}
@@ -0,0 +1,132 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+)
+
+func TestConsentsConfig(t *testing.T) {
+	c := ConsentsConfig{}
+	assert.NoError(t, c.validate())
+	docPath := filepath.Join(os.TempDir(), "tos.txt")
+	err := os.WriteFile(docPath, []byte("terms of service"), 0666)
+	require.NoError(t, err)
+	defer os.Remove(docPath)
+
+	c.Documents = []ConsentDocument{
+		{
+			Name:    " tos ",
+			Version: "1",
+			Path:    docPath,
+		},
+	}
+	assert.Error(t, c.validate())
+	c.LinkValidity = 721
+	assert.Error(t, c.validate())
+	c.LinkValidity = 24
+	assert.NoError(t, c.validate())
+	assert.Equal(t, "tos", c.Documents[0].Name)
+	assert.Equal(t, "tos", c.Documents[0].Title)
+	assert.Equal(t, "terms of service", c.Documents[0].GetContent())
+
+	c.Documents = append(c.Documents, c.Documents[0])
+	assert.ErrorContains(t, c.validate(), "duplicate document")
+	c.Documents = c.Documents[:1]
+	c.Documents[0].Path = "relative.txt"
+	assert.Error(t, c.validate())
+	c.Documents[0].Path = filepath.Join(os.TempDir(), "missing_tos.txt")
+	assert.Error(t, c.validate())
+	c.Documents[0].Path = os.TempDir()
+	assert.Error(t, c.validate())
+	c.Documents[0].Path = docPath
+	c.Documents[0].Version = ""
+	assert.Error(t, c.validate())
+	c.Documents[0].Version = "1"
+	c.Documents[0].Name = ""
+	assert.Error(t, c.validate())
+}
+
+func TestPendingConsents(t *testing.T) {
+	oldConfig := Config.Consents
+	defer func() {
+		Config.Consents = oldConfig
+	}()
+
+	user := dataprovider.User{}
+	assert.False(t, MustAcceptConsents(&user))
+	assert.NoError(t, CheckConsentsForProtocol(&user, ProtocolSSH))
+
+	Config.Consents = ConsentsConfig{
+		Documents: []ConsentDocument{
+			{
+				Name:    "tos",
+				Version: "2",
+			},
+			{
+				Name:             "aup",
+				Version:          "2",
+				ReacceptOnUpdate: true,
+			},
+		},
+		LinkValidity: 2,
+	}
+	assert.Equal(t, 2*time.Hour, GetConsentLinkValidity())
+	assert.True(t, IsConsentsEnabled())
+	assert.True(t, MustAcceptConsents(&user))
+	assert.Len(t, GetPendingConsents(&user), 2)
+	assert.False(t, MustAcceptConsentsForProtocol(&user, ProtocolFTP))
+	assert.NoError(t, CheckConsentsForProtocol(&user, ProtocolFTP))
+
+	user.Filters.Consents = GetConsentRecords([]ConsentDocument{
+		{
+			Name:    "tos",
+			Version: "1",
+		},
+		{
+			Name:    "aup",
+			Version: "1",
+		},
+	}, "127.0.0.1", dataprovider.ConsentMethodLink)
+	if assert.Len(t, user.Filters.Consents, 2) {
+		assert.Equal(t, "127.0.0.1", user.Filters.Consents[0].IP)
+		assert.Equal(t, dataprovider.ConsentMethodLink, user.Filters.Consents[0].Method)
+		assert.Greater(t, user.Filters.Consents[0].AcceptedAt, int64(0))
+	}
+	// a new version must be accepted only if reaccept on update is enabled
+	pending := GetPendingConsents(&user)
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, "aup", pending[0].Name)
+	}
+
+	Config.Consents.EnforceForProtocols = true
+	for _, protocol := range []string{ProtocolSSH, ProtocolFTP, ProtocolWebDAV, ProtocolHTTP} {
+		assert.True(t, MustAcceptConsentsForProtocol(&user, protocol))
+		assert.ErrorIs(t, CheckConsentsForProtocol(&user, protocol), ErrConsentsRequired)
+	}
+	assert.False(t, MustAcceptConsentsForProtocol(&user, ProtocolOIDC))
+
+	user.Filters.Consents = append(user.Filters.Consents, GetConsentRecords(pending, "", dataprovider.ConsentMethodWebClient)...)
+	assert.False(t, MustAcceptConsents(&user))
+	assert.NoError(t, CheckConsentsForProtocol(&user, ProtocolSSH))
+}
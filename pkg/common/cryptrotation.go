@@ -0,0 +1,199 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sftpgo/sdk"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+// cryptKeyRotationTarget defines an encrypted filesystem to re-encrypt
+type cryptKeyRotationTarget struct {
+	// the user or the folder that owns the encryption settings
+	username string
+	folder   string
+	rootDir  string
+	config   vfs.CryptFsConfig
+}
+
+// isSameConfig returns false if the encryption settings are not defined in
+// the specified filesystem or if the passphrase was changed again while the
+// files were re-encrypted
+func (t *cryptKeyRotationTarget) isSameConfig(fsConfig *vfs.Filesystem) bool {
+	if fsConfig.Provider != sdk.CryptedFilesystemProvider {
+		return false
+	}
+	config := &fsConfig.CryptConfig
+	if config.Passphrase == nil || len(config.PreviousPassphrases) != len(t.config.PreviousPassphrases) {
+		return false
+	}
+	current := config.Passphrase.Clone()
+	expected := t.config.Passphrase.Clone()
+	if err := current.TryDecrypt(); err != nil {
+		return false
+	}
+	if err := expected.TryDecrypt(); err != nil {
+		return false
+	}
+	return current.GetPayload() == expected.GetPayload()
+}
+
+// clearPreviousPassphrases removes the previous passphrases from the user or
+// the folder, all the files are encrypted using the current passphrase
+func (t *cryptKeyRotationTarget) clearPreviousPassphrases(jobID, executor string) error {
+	if len(t.config.PreviousPassphrases) == 0 {
+		return nil
+	}
+	if t.folder != "" {
+		folder, err := dataprovider.GetFolderByName(t.folder)
+		if err != nil {
+			return err
+		}
+		if !t.isSameConfig(&folder.FsConfig) {
+			logger.Info(jobsLogSender, jobID, "encryption settings changed for folder %q, previous passphrases not removed",
+				t.folder)
+			return nil
+		}
+		folder.FsConfig.CryptConfig.PreviousPassphrases = nil
+		return dataprovider.UpdateFolder(&folder, folder.Users, folder.Groups, executor, "", folder.Role)
+	}
+	user, err := dataprovider.UserExists(t.username, "")
+	if err != nil {
+		return err
+	}
+	if !t.isSameConfig(&user.FsConfig) {
+		// the encryption settings are inherited from a group or changed
+		logger.Info(jobsLogSender, jobID, "encryption settings not defined or changed for user %q, previous passphrases not removed",
+			t.username)
+		return nil
+	}
+	user.FsConfig.CryptConfig.PreviousPassphrases = nil
+	return dataprovider.UpdateUser(&user, executor, "", user.Role)
+}
+
+func getCryptKeyRotationJobRunner(req *JobRequest, targets []cryptKeyRotationTarget) (jobRunner, error) {
+	if len(targets) == 0 {
+		return nil, util.NewValidationError("no encrypted filesystem to re-encrypt")
+	}
+	req.Source = ""
+	req.Target = ""
+	req.Paths = nil
+	req.Retention = nil
+
+	return func(job *backgroundJob) error {
+		return runCryptKeyRotation(job, targets)
+	}, nil
+}
+
+func getUserCryptKeyRotationJobRunner(req *JobRequest, user dataprovider.User) (jobRunner, error) {
+	var targets []cryptKeyRotationTarget
+	if user.FsConfig.Provider == sdk.CryptedFilesystemProvider {
+		targets = append(targets, cryptKeyRotationTarget{
+			username: user.Username,
+			rootDir:  user.GetHomeDir(),
+			config:   user.FsConfig.CryptConfig.GetACopy(),
+		})
+	}
+	for _, folder := range user.VirtualFolders {
+		if folder.FsConfig.Provider == sdk.CryptedFilesystemProvider {
+			targets = append(targets, cryptKeyRotationTarget{
+				folder:  folder.Name,
+				rootDir: folder.MappedPath,
+				config:  folder.FsConfig.CryptConfig.GetACopy(),
+			})
+		}
+	}
+	return getCryptKeyRotationJobRunner(req, targets)
+}
+
+func getFolderCryptKeyRotationJobRunner(req *JobRequest, folder vfs.BaseVirtualFolder) (jobRunner, error) {
+	var targets []cryptKeyRotationTarget
+	if folder.FsConfig.Provider == sdk.CryptedFilesystemProvider {
+		targets = append(targets, cryptKeyRotationTarget{
+			folder:  folder.Name,
+			rootDir: folder.MappedPath,
+			config:  folder.FsConfig.CryptConfig.GetACopy(),
+		})
+	}
+	return getCryptKeyRotationJobRunner(req, targets)
+}
+
+// runCryptKeyRotation re-encrypts, using the current passphrase, the files
+// encrypted using a previous passphrase. The previous passphrases are removed
+// if all the files are successfully re-encrypted
+func runCryptKeyRotation(job *backgroundJob, targets []cryptKeyRotationTarget) error {
+	filesystems := make([]*vfs.CryptFs, 0, len(targets))
+	for _, target := range targets {
+		fs, err := vfs.NewCryptFs(job.info.ID, target.rootDir, "", target.config.GetACopy())
+		if err != nil {
+			return fmt.Errorf("unable to initialize the encrypted filesystem for %q: %w", target.rootDir, err)
+		}
+		filesystems = append(filesystems, fs.(*vfs.CryptFs))
+		if numFiles, _, err := fs.GetDirSize(target.rootDir); err == nil {
+			job.steps.Add(int64(numFiles))
+		}
+	}
+	var failed int
+	for idx, fs := range filesystems {
+		rootDir := targets[idx].rootDir
+		err := filepath.Walk(rootDir, func(walkedPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				if walkedPath == rootDir && os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			// skip the temporary files, for example the uploads in progress
+			if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".sftpgo-") {
+				return nil
+			}
+			if err := job.progress.checkCanceled(); err != nil {
+				return err
+			}
+			job.doneSteps.Add(1)
+			reEncrypted, err := fs.ReEncrypt(walkedPath)
+			if err != nil {
+				failed++
+				logger.Warn(jobsLogSender, job.info.ID, "unable to re-encrypt %q: %v", walkedPath, err)
+				return nil
+			}
+			if reEncrypted {
+				job.progress.add(1, info.Size())
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("unable to re-encrypt %d files, the previous passphrases are still required", failed)
+	}
+	for idx := range targets {
+		if err := targets[idx].clearPreviousPassphrases(job.info.ID, job.info.Admin); err != nil {
+			return fmt.Errorf("files re-encrypted, unable to remove the previous passphrases: %w", err)
+		}
+	}
+	return nil
+}
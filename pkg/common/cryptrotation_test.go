@@ -0,0 +1,321 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/kms"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+func writeCryptFsFile(t *testing.T, conn *BaseConnection, virtualPath string, data []byte) string {
+	fs, fsPath, err := conn.GetFsAndResolvedPath(virtualPath)
+	require.NoError(t, err)
+	_, w, _, err := fs.Create(fsPath, 0, 0)
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return fsPath
+}
+
+func readCryptFsFile(t *testing.T, conn *BaseConnection, virtualPath string) []byte {
+	fs, fsPath, err := conn.GetFsAndResolvedPath(virtualPath)
+	require.NoError(t, err)
+	_, r, _, err := fs.Open(fsPath, 0)
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	return data
+}
+
+func TestCryptFsNamesEncryption(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "crypt_names")
+	defer os.RemoveAll(homeDir)
+
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "crypt_names_user",
+			HomeDir:  homeDir,
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+		FsConfig: vfs.Filesystem{
+			Provider: sdk.CryptedFilesystemProvider,
+			CryptConfig: vfs.CryptFsConfig{
+				Passphrase:   kms.NewPlainSecret("crypt secret"),
+				EncryptNames: true,
+			},
+		},
+	}
+	err := dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+	assert.True(t, user.FsConfig.CryptConfig.NamesKey.IsEncrypted())
+	namesKeyPayload := user.FsConfig.CryptConfig.NamesKey.GetPayload()
+
+	conn := NewBaseConnection("", ProtocolSFTP, "", "", user)
+	require.NoError(t, conn.User.CheckFsRoot(conn.ID))
+	err = conn.CreateDir("/sub dir", false)
+	require.NoError(t, err)
+	data := []byte("crypt data")
+	fsPath := writeCryptFsFile(t, conn, "/sub dir/file.txt", data)
+	assert.NotContains(t, fsPath, "sub dir")
+	assert.NotContains(t, fsPath, "file.txt")
+	assert.FileExists(t, fsPath)
+	assert.Equal(t, data, readCryptFsFile(t, conn, "/sub dir/file.txt"))
+	fs, _, err := conn.GetFsAndResolvedPath("/")
+	require.NoError(t, err)
+	assert.Equal(t, "/sub dir/file.txt", fs.GetRelativePath(fsPath))
+	// the names that cannot be decrypted are not listed
+	err = os.WriteFile(filepath.Join(filepath.Dir(fsPath), "plain.txt"), data, 0666)
+	require.NoError(t, err)
+	entries, err := conn.ListDir("/sub dir")
+	require.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "file.txt", entries[0].Name())
+		assert.Equal(t, int64(len(data)), entries[0].Size())
+	}
+	info, err := conn.DoStat("/sub dir", 0, false)
+	require.NoError(t, err)
+	assert.Equal(t, "sub dir", info.Name())
+	assert.True(t, info.IsDir())
+	err = conn.Rename("/sub dir/file.txt", "/renamed.txt")
+	require.NoError(t, err)
+	assert.Equal(t, data, readCryptFsFile(t, conn, "/renamed.txt"))
+	_, _, err = conn.GetFsAndResolvedPath("/" + strings.Repeat("a", 200))
+	assert.Error(t, err)
+	// the names key cannot be changed
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+	err = dataprovider.UpdateUser(&user, "", "", "")
+	require.NoError(t, err)
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+	assert.Equal(t, namesKeyPayload, user.FsConfig.CryptConfig.NamesKey.GetPayload())
+	// a folder with the same passphrase and a different names key is not the same resource
+	other := user.FsConfig.GetACopy()
+	other.CryptConfig.NamesKey = kms.NewPlainSecret("other key")
+	assert.False(t, user.FsConfig.IsSameResource(other))
+	other.CryptConfig.NamesKey = user.FsConfig.CryptConfig.NamesKey
+	assert.True(t, user.FsConfig.IsSameResource(other))
+	// disabling the names encryption removes the key
+	user.FsConfig.CryptConfig.EncryptNames = false
+	err = dataprovider.UpdateUser(&user, "", "", "")
+	require.NoError(t, err)
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+	assert.True(t, user.FsConfig.CryptConfig.NamesKey.IsEmpty())
+
+	err = dataprovider.DeleteUser(user.Username, "", "", "")
+	assert.NoError(t, err)
+}
+
+func TestCryptKeyRotation(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "crypt_rotation")
+	defer os.RemoveAll(homeDir)
+
+	folder := vfs.BaseVirtualFolder{
+		Name:       "crypt_rotation_folder",
+		MappedPath: filepath.Join(os.TempDir(), "crypt_rotation_folder"),
+		FsConfig: vfs.Filesystem{
+			Provider: sdk.CryptedFilesystemProvider,
+			CryptConfig: vfs.CryptFsConfig{
+				Passphrase: kms.NewPlainSecret("folder secret"),
+			},
+		},
+	}
+	defer os.RemoveAll(folder.MappedPath)
+	err := dataprovider.AddFolder(&folder, "", "", "")
+	require.NoError(t, err)
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "crypt_rotation_user",
+			HomeDir:  homeDir,
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+		FsConfig: vfs.Filesystem{
+			Provider: sdk.CryptedFilesystemProvider,
+			CryptConfig: vfs.CryptFsConfig{
+				Passphrase: kms.NewPlainSecret("user secret"),
+			},
+		},
+		VirtualFolders: []vfs.VirtualFolder{
+			{
+				BaseVirtualFolder: vfs.BaseVirtualFolder{
+					Name: folder.Name,
+				},
+				VirtualPath: "/vdir",
+			},
+		},
+	}
+	err = dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+	user, err = dataprovider.GetUserWithGroupSettings(user.Username, "")
+	require.NoError(t, err)
+
+	data := []byte("data encrypted with the first passphrase")
+	conn := NewBaseConnection("", ProtocolSFTP, "", "", user)
+	require.NoError(t, conn.User.CheckFsRoot(conn.ID))
+	userFile := writeCryptFsFile(t, conn, "/file.txt", data)
+	folderFile := writeCryptFsFile(t, conn, "/vdir/file.txt", data)
+	// start a key rotation for the user
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+	user.FsConfig.CryptConfig.PreviousPassphrases = []*kms.Secret{user.FsConfig.CryptConfig.Passphrase}
+	user.FsConfig.CryptConfig.Passphrase = kms.NewPlainSecret("new user secret")
+	err = dataprovider.UpdateUser(&user, "", "", "")
+	require.NoError(t, err)
+	user, err = dataprovider.GetUserWithGroupSettings(user.Username, "")
+	require.NoError(t, err)
+	require.Len(t, user.FsConfig.CryptConfig.PreviousPassphrases, 1)
+	assert.True(t, user.FsConfig.CryptConfig.PreviousPassphrases[0].IsEncrypted())
+	// the existing files can still be read, the new ones use the new passphrase
+	conn = NewBaseConnection("", ProtocolSFTP, "", "", user)
+	assert.Equal(t, data, readCryptFsFile(t, conn, "/file.txt"))
+	newData := []byte("data encrypted with the new passphrase")
+	writeCryptFsFile(t, conn, "/new.txt", newData)
+	// without the previous passphrase the file cannot be decrypted
+	fs, err := vfs.NewCryptFs("", homeDir, "", vfs.CryptFsConfig{
+		Passphrase: kms.NewPlainSecret("new user secret"),
+	})
+	require.NoError(t, err)
+	_, r, _, err := fs.Open(userFile, 0)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.Error(t, err)
+	r.Close()
+	reEncrypted, err := fs.(*vfs.CryptFs).ReEncrypt(userFile)
+	assert.NoError(t, err)
+	assert.False(t, reEncrypted)
+
+	m := &jobsManager{
+		jobs: make(map[string]*backgroundJob),
+	}
+	m.init(JobsConfig{MaxConcurrentJobs: 1, Retention: 1})
+	_, err = m.StartUserJob(JobRequest{Type: JobTypeCryptKeyRotation}, dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "plain user",
+			HomeDir:  homeDir,
+		},
+	}, "admin")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	info, err := os.Stat(userFile)
+	require.NoError(t, err)
+	job, err := m.StartUserJob(JobRequest{Type: JobTypeCryptKeyRotation, Source: "/"}, user, "admin")
+	require.NoError(t, err)
+	assert.Empty(t, job.Source)
+	assert.Eventually(t, func() bool {
+		job, err = m.Get(job.ID, "")
+		return err == nil && job.Status != JobStatusRunning
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, JobStatusCompleted, job.Status, job.Error)
+	// only the user file was encrypted using a previous passphrase
+	assert.Equal(t, int64(1), job.Files)
+	assert.Equal(t, 100, job.Progress)
+	// the file was replaced preserving its metadata
+	rotatedInfo, err := os.Stat(userFile)
+	require.NoError(t, err)
+	assert.Equal(t, info.ModTime(), rotatedInfo.ModTime())
+	assert.Equal(t, info.Mode(), rotatedInfo.Mode())
+	_, r, _, err = fs.Open(userFile, 0)
+	require.NoError(t, err)
+	contents, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	r.Close()
+	assert.Equal(t, data, contents)
+	// the previous passphrases are removed
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+	assert.Len(t, user.FsConfig.CryptConfig.PreviousPassphrases, 0)
+	user, err = dataprovider.GetUserWithGroupSettings(user.Username, "")
+	require.NoError(t, err)
+	conn = NewBaseConnection("", ProtocolSFTP, "", "", user)
+	assert.Equal(t, data, readCryptFsFile(t, conn, "/file.txt"))
+	assert.Equal(t, newData, readCryptFsFile(t, conn, "/new.txt"))
+	assert.Equal(t, data, readCryptFsFile(t, conn, "/vdir/file.txt"))
+	// folder job, a file that cannot be decrypted makes the job fail
+	folder, err = dataprovider.GetFolderByName(folder.Name)
+	require.NoError(t, err)
+	folder.FsConfig.CryptConfig.PreviousPassphrases = []*kms.Secret{folder.FsConfig.CryptConfig.Passphrase}
+	folder.FsConfig.CryptConfig.Passphrase = kms.NewPlainSecret("new folder secret")
+	err = dataprovider.UpdateFolder(&folder, folder.Users, folder.Groups, "", "", "")
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(folder.MappedPath, "invalid.txt"), []byte("invalid"), 0666)
+	require.NoError(t, err)
+	folder, err = dataprovider.GetFolderByName(folder.Name)
+	require.NoError(t, err)
+	job, err = m.StartFolderJob(JobRequest{Type: JobTypeCryptKeyRotation}, folder, "admin")
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		job, err = m.Get(job.ID, "")
+		return err == nil && job.Status != JobStatusRunning
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, JobStatusFailed, job.Status)
+	assert.Contains(t, job.Error, "unable to re-encrypt 1 files")
+	assert.Equal(t, int64(1), job.Files)
+	folder, err = dataprovider.GetFolderByName(folder.Name)
+	require.NoError(t, err)
+	assert.Len(t, folder.FsConfig.CryptConfig.PreviousPassphrases, 1)
+	err = os.Remove(filepath.Join(folder.MappedPath, "invalid.txt"))
+	require.NoError(t, err)
+	job, err = m.StartFolderJob(JobRequest{Type: JobTypeCryptKeyRotation}, folder, "admin")
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		job, err = m.Get(job.ID, "")
+		return err == nil && job.Status != JobStatusRunning
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, JobStatusCompleted, job.Status, job.Error)
+	assert.Equal(t, int64(0), job.Files)
+	folder, err = dataprovider.GetFolderByName(folder.Name)
+	require.NoError(t, err)
+	assert.Len(t, folder.FsConfig.CryptConfig.PreviousPassphrases, 0)
+	user, err = dataprovider.GetUserWithGroupSettings(user.Username, "")
+	require.NoError(t, err)
+	conn = NewBaseConnection("", ProtocolSFTP, "", "", user)
+	assert.Equal(t, data, readCryptFsFile(t, conn, "/vdir/file.txt"))
+	assert.FileExists(t, folderFile)
+	jobs, err := m.GetAll("")
+	assert.NoError(t, err)
+	for _, j := range jobs {
+		_, err = m.Cancel(j.ID, "")
+		assert.NoError(t, err)
+	}
+	m.cleanup()
+
+	err = dataprovider.DeleteUser(user.Username, "", "", "")
+	assert.NoError(t, err)
+	err = dataprovider.DeleteFolder(folder.Name, "", "", "")
+	assert.NoError(t, err)
+}
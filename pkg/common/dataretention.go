@@ -50,6 +50,9 @@ const (
 	RetentionCheckNotificationEmail = "Email"
 )
 
+// maximum number of files listed in the report of a dry run check
+const maxRetentionDryRunFiles = 1000
+
 var (
 	// RetentionChecks is the list of active retention checks
 	RetentionChecks ActiveRetentionChecks
@@ -79,6 +82,7 @@ func (c *ActiveRetentionChecks) Get(role string) []RetentionCheck {
 				Notifications: notificationsCopy,
 				Email:         check.Email,
 				Folders:       foldersCopy,
+				DryRun:        check.DryRun,
 			})
 		}
 	}
@@ -137,6 +141,8 @@ type folderRetentionCheckResult struct {
 	Elapsed      time.Duration `json:"-"`
 	Info         string        `json:"info,omitempty"`
 	Error        string        `json:"error,omitempty"`
+	// Files that would be deleted, for dry run checks
+	Files []string `json:"files,omitempty"`
 }
 
 // RetentionCheck defines an active retention check
@@ -151,10 +157,14 @@ type RetentionCheck struct {
 	Notifications []RetentionCheckNotification `json:"notifications,omitempty"`
 	// email to use if the notification method is set to email
 	Email string `json:"email,omitempty"`
-	Role  string `json:"-"`
+	// if enabled the files are not deleted, they are only reported
+	DryRun bool   `json:"dry_run,omitempty"`
+	Role   string `json:"-"`
 	// Cleanup results
 	results []folderRetentionCheckResult `json:"-"`
-	conn    *BaseConnection
+	// number of files listed in the dry run results
+	dryRunFiles int
+	conn        *BaseConnection
 }
 
 // Validate returns an error if the specified folders are not valid
@@ -283,22 +293,26 @@ func (c *RetentionCheck) cleanupFolder(folderPath string) error {
 		} else {
 			retentionTime := info.ModTime().Add(time.Duration(folderRetention.Retention) * time.Hour)
 			if retentionTime.Before(time.Now()) {
-				if err := c.removeFile(virtualPath, info); err != nil {
-					result.Elapsed = time.Since(startTime)
-					result.Error = fmt.Sprintf("unable to remove file %q: %v", virtualPath, err)
-					c.conn.Log(logger.LevelError, "unable to remove file %q, retention %v: %v",
-						virtualPath, retentionTime, err)
-					return err
+				if c.DryRun {
+					c.addDryRunFile(&result, virtualPath)
+				} else {
+					if err := c.removeFile(virtualPath, info); err != nil {
+						result.Elapsed = time.Since(startTime)
+						result.Error = fmt.Sprintf("unable to remove file %q: %v", virtualPath, err)
+						c.conn.Log(logger.LevelError, "unable to remove file %q, retention %v: %v",
+							virtualPath, retentionTime, err)
+						return err
+					}
+					c.conn.Log(logger.LevelDebug, "removed file %q, modification time: %v, retention: %v hours, retention time: %v",
+						virtualPath, info.ModTime(), folderRetention.Retention, retentionTime)
 				}
-				c.conn.Log(logger.LevelDebug, "removed file %q, modification time: %v, retention: %v hours, retention time: %v",
-					virtualPath, info.ModTime(), folderRetention.Retention, retentionTime)
 				result.DeletedFiles++
 				result.DeletedSize += info.Size()
 			}
 		}
 	}
 
-	if folderRetention.DeleteEmptyDirs {
+	if folderRetention.DeleteEmptyDirs && !c.DryRun {
 		c.checkEmptyDirRemoval(folderPath)
 	}
 	result.Elapsed = time.Since(startTime)
@@ -308,6 +322,16 @@ func (c *RetentionCheck) cleanupFolder(folderPath string) error {
 	return nil
 }
 
+// addDryRunFile adds a file that would be deleted to the folder result
+func (c *RetentionCheck) addDryRunFile(result *folderRetentionCheckResult, virtualPath string) {
+	c.conn.Log(logger.LevelDebug, "dry run, file %q would be removed", virtualPath)
+	if c.dryRunFiles >= maxRetentionDryRunFiles {
+		return
+	}
+	c.dryRunFiles++
+	result.Files = append(result.Files, virtualPath)
+}
+
 func (c *RetentionCheck) checkEmptyDirRemoval(folderPath string) {
 	if folderPath == "/" {
 		return
@@ -332,12 +356,22 @@ func (c *RetentionCheck) checkEmptyDirRemoval(folderPath string) {
 
 // Start starts the retention check
 func (c *RetentionCheck) Start() error {
-	c.conn.Log(logger.LevelInfo, "retention check started")
+	return c.start(nil, nil)
+}
+
+// start runs the retention check. If not nil, onFolderDone is called after
+// each folder and the check stops before the next folder if canceled
+func (c *RetentionCheck) start(progress *fileOperationProgress, onFolderDone func()) error {
+	c.conn.Log(logger.LevelInfo, "retention check started, dry run: %t", c.DryRun)
 	defer RetentionChecks.remove(c.conn.User.Username)
 	defer c.conn.CloseFS() //nolint:errcheck
 
 	startTime := time.Now()
 	for _, folder := range c.Folders {
+		if err := progress.checkCanceled(); err != nil {
+			c.conn.Log(logger.LevelInfo, "retention check canceled")
+			return err
+		}
 		if folder.Retention > 0 {
 			if err := c.cleanupFolder(folder.Path); err != nil {
 				c.conn.Log(logger.LevelError, "retention check failed, unable to cleanup folder %q", folder.Path)
@@ -345,6 +379,9 @@ func (c *RetentionCheck) Start() error {
 				return err
 			}
 		}
+		if onFolderDone != nil {
+			onFolderDone()
+		}
 	}
 
 	c.conn.Log(logger.LevelInfo, "retention check completed")
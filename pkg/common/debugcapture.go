@@ -0,0 +1,529 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// Debug capture statuses
+const (
+	DebugCaptureStatusRunning   = "running"
+	DebugCaptureStatusCompleted = "completed"
+)
+
+// Directions for the captured events
+const (
+	DebugCaptureDirectionIn  = "in"
+	DebugCaptureDirectionOut = "out"
+)
+
+const (
+	debugCaptureLogSender       = "debugcapture"
+	debugCaptureDefaultDuration = 10 * time.Minute
+	debugCaptureMaxDuration     = time.Hour
+	debugCaptureDefaultSize     = 10 * 1024 * 1024
+	debugCaptureMaxSize         = 50 * 1024 * 1024
+	// completed captures are kept for this duration
+	debugCaptureRetention = time.Hour
+	// maximum number of captures kept in memory
+	maxDebugCaptures  = 10
+	debugRedactedText = "REDACTED"
+)
+
+var (
+	// ErrTooManyDebugCaptures is returned if the maximum number of debug captures is reached
+	ErrTooManyDebugCaptures = errors.New("too many debug captures, delete the unused ones")
+	// DebugCaptures tracks the admin triggered debug captures
+	DebugCaptures = &debugCapturesManager{
+		captures: make(map[string]*debugCapture),
+	}
+	debugCaptureProtocols = []string{ProtocolSFTP, ProtocolFTP, ProtocolHTTP, ProtocolWebDAV}
+	debugSecretKeyRegex   = regexp.MustCompile(`(?i)(auth|cookie|key|otp|pass|secret|signature|token)`)
+)
+
+// DebugCaptureSource defines the connection details used to match the debug captures
+type DebugCaptureSource interface {
+	GetID() string
+	GetProtocol() string
+	GetUsername() string
+	GetLocalAddress() string
+	GetRemoteAddress() string
+}
+
+// DebugCaptureRequest defines the parameters to start a debug capture.
+// At least a binding port or a username is required
+type DebugCaptureRequest struct {
+	// Capture only this protocol, empty means any supported protocol
+	Protocol string `json:"protocol,omitempty"`
+	// Capture the connections to the binding listening on this port
+	Port int `json:"port,omitempty"`
+	// Capture the connections for this username
+	Username string `json:"username,omitempty"`
+	// Capture duration in seconds
+	Duration int `json:"duration,omitempty"`
+	// Maximum size of the captured events in bytes
+	MaxSize int64 `json:"max_size,omitempty"`
+}
+
+func (r *DebugCaptureRequest) validate() error {
+	r.Protocol = strings.ToUpper(strings.TrimSpace(r.Protocol))
+	r.Username = strings.TrimSpace(r.Username)
+	if r.Protocol != "" && !util.Contains(debugCaptureProtocols, r.Protocol) {
+		return util.NewValidationError(fmt.Sprintf("unsupported protocol %q, supported protocols: %s",
+			r.Protocol, strings.Join(debugCaptureProtocols, ", ")))
+	}
+	if r.Port < 0 || r.Port > 65535 {
+		return util.NewValidationError(fmt.Sprintf("invalid port: %d", r.Port))
+	}
+	if r.Port == 0 && r.Username == "" {
+		return util.NewValidationError("a binding port or a username is required")
+	}
+	if r.Duration < 0 || time.Duration(r.Duration)*time.Second > debugCaptureMaxDuration {
+		return util.NewValidationError(fmt.Sprintf("invalid duration %d, the maximum allowed is %d seconds",
+			r.Duration, int(debugCaptureMaxDuration/time.Second)))
+	}
+	if r.Duration == 0 {
+		r.Duration = int(debugCaptureDefaultDuration / time.Second)
+	}
+	if r.MaxSize < 0 || r.MaxSize > debugCaptureMaxSize {
+		return util.NewValidationError(fmt.Sprintf("invalid max size %d, the maximum allowed is %d bytes",
+			r.MaxSize, debugCaptureMaxSize))
+	}
+	if r.MaxSize == 0 {
+		r.MaxSize = debugCaptureDefaultSize
+	}
+	return nil
+}
+
+// DebugCapture defines a time and size bounded capture of the protocol level
+// events for the matching connections
+type DebugCapture struct {
+	ID string `json:"id"`
+	// Admin that started the capture
+	Admin    string `json:"admin"`
+	Protocol string `json:"protocol,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	Username string `json:"username,omitempty"`
+	Duration int    `json:"duration"`
+	MaxSize  int64  `json:"max_size"`
+	// Capture status: running, completed
+	Status string `json:"status"`
+	// Number and size of the captured events
+	Events int   `json:"events"`
+	Size   int64 `json:"size"`
+	// Truncated is set if the capture was stopped because the maximum size was reached
+	Truncated bool `json:"truncated,omitempty"`
+	// Start and end time as unix timestamp in milliseconds
+	StartTime int64 `json:"start_time"`
+	EndTime   int64 `json:"end_time,omitempty"`
+}
+
+// DebugCaptureEvent defines a captured protocol event
+type DebugCaptureEvent struct {
+	// Unix timestamp in microseconds
+	Timestamp     int64  `json:"timestamp"`
+	ConnectionID  string `json:"connection_id"`
+	Protocol      string `json:"protocol"`
+	Username      string `json:"username,omitempty"`
+	LocalAddress  string `json:"local_address,omitempty"`
+	RemoteAddress string `json:"remote_address,omitempty"`
+	// Direction: "in" from the client, "out" to the client
+	Direction string `json:"direction"`
+	Message   string `json:"message"`
+}
+
+type debugCapture struct {
+	sync.RWMutex
+	info  DebugCapture
+	data  bytes.Buffer
+	timer *time.Timer
+}
+
+func (c *debugCapture) getInfo() DebugCapture {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.info
+}
+
+func (c *debugCapture) isRunning() bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.info.Status == DebugCaptureStatusRunning
+}
+
+func (c *debugCapture) isExpired() bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.info.Status != DebugCaptureStatusRunning &&
+		c.info.EndTime < util.GetTimeAsMsSinceEpoch(time.Now().Add(-debugCaptureRetention))
+}
+
+func (c *debugCapture) matches(src DebugCaptureSource) bool {
+	if c.info.Protocol != "" && c.info.Protocol != src.GetProtocol() {
+		return false
+	}
+	if c.info.Username != "" && c.info.Username != src.GetUsername() {
+		return false
+	}
+	if c.info.Port > 0 {
+		_, port, err := net.SplitHostPort(src.GetLocalAddress())
+		if err != nil || port != strconv.Itoa(c.info.Port) {
+			return false
+		}
+	}
+	return true
+}
+
+// stop marks the capture as completed, it returns false if the capture was already stopped
+func (c *debugCapture) stop(truncated bool) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.info.Status != DebugCaptureStatusRunning {
+		return false
+	}
+	c.info.Status = DebugCaptureStatusCompleted
+	c.info.Truncated = truncated
+	c.info.EndTime = util.GetTimeAsMsSinceEpoch(time.Now())
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	return true
+}
+
+// add appends the specified event and returns false if the maximum size is reached
+func (c *debugCapture) add(src DebugCaptureSource, event []byte) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.info.Status != DebugCaptureStatusRunning || !c.matches(src) {
+		return true
+	}
+	if int64(c.data.Len()+len(event)) > c.info.MaxSize {
+		return false
+	}
+	c.data.Write(event)
+	c.info.Events++
+	c.info.Size = int64(c.data.Len())
+	return true
+}
+
+func (c *debugCapture) getBundle() ([]byte, error) {
+	c.RLock()
+	info := c.info
+	data := bytes.Clone(c.data.Bytes())
+	c.RUnlock()
+
+	metadata, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	wr := zip.NewWriter(&buf)
+	for name, content := range map[string][]byte{"capture.json": metadata, "events.jsonl": data} {
+		f, err := wr.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: time.Now(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(content); err != nil {
+			return nil, err
+		}
+	}
+	if err := wr.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type debugCapturesManager struct {
+	sync.RWMutex
+	captures map[string]*debugCapture
+	running  atomic.Int32
+}
+
+// IsActive returns true if at least a debug capture is running.
+// Protocol servers can use it to avoid building the events to capture
+func (m *debugCapturesManager) IsActive() bool {
+	return m.running.Load() > 0
+}
+
+// Start starts a new debug capture
+func (m *debugCapturesManager) Start(req DebugCaptureRequest, admin string) (DebugCapture, error) {
+	if err := req.validate(); err != nil {
+		return DebugCapture{}, err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.removeExpired()
+	if len(m.captures) >= maxDebugCaptures {
+		return DebugCapture{}, ErrTooManyDebugCaptures
+	}
+	c := &debugCapture{
+		info: DebugCapture{
+			ID:        xid.New().String(),
+			Admin:     admin,
+			Protocol:  req.Protocol,
+			Port:      req.Port,
+			Username:  req.Username,
+			Duration:  req.Duration,
+			MaxSize:   req.MaxSize,
+			Status:    DebugCaptureStatusRunning,
+			StartTime: util.GetTimeAsMsSinceEpoch(time.Now()),
+		},
+	}
+	c.timer = time.AfterFunc(time.Duration(req.Duration)*time.Second, func() {
+		m.stopCapture(c, false)
+	})
+	m.captures[c.info.ID] = c
+	m.running.Add(1)
+	logger.Info(debugCaptureLogSender, "", "debug capture %q started by admin %q, protocol: %q, port: %d, username: %q, duration: %d s",
+		c.info.ID, admin, req.Protocol, req.Port, req.Username, req.Duration)
+	return c.getInfo(), nil
+}
+
+func (m *debugCapturesManager) stopCapture(c *debugCapture, truncated bool) {
+	if c.stop(truncated) {
+		m.running.Add(-1)
+		info := c.getInfo()
+		logger.Info(debugCaptureLogSender, "", "debug capture %q completed, events: %d, size: %d, truncated: %t",
+			info.ID, info.Events, info.Size, info.Truncated)
+	}
+}
+
+// Capture adds an event to the running captures matching the specified source.
+// The message is built only if there is at least a matching capture
+func (m *debugCapturesManager) Capture(src DebugCaptureSource, direction string, getMessage func() string) {
+	if !m.IsActive() {
+		return
+	}
+
+	m.RLock()
+	var matching []*debugCapture
+	for _, c := range m.captures {
+		c.RLock()
+		if c.info.Status == DebugCaptureStatusRunning && c.matches(src) {
+			matching = append(matching, c)
+		}
+		c.RUnlock()
+	}
+	m.RUnlock()
+
+	if len(matching) == 0 {
+		return
+	}
+	event, err := json.Marshal(DebugCaptureEvent{
+		Timestamp:     time.Now().UnixMicro(),
+		ConnectionID:  src.GetID(),
+		Protocol:      src.GetProtocol(),
+		Username:      src.GetUsername(),
+		LocalAddress:  src.GetLocalAddress(),
+		RemoteAddress: src.GetRemoteAddress(),
+		Direction:     direction,
+		Message:       getMessage(),
+	})
+	if err != nil {
+		return
+	}
+	event = append(event, '\n')
+	for _, c := range matching {
+		if !c.add(src, event) {
+			m.stopCapture(c, true)
+		}
+	}
+}
+
+// CaptureConnection adds an event for the active connection with the specified ID
+func (m *debugCapturesManager) CaptureConnection(connectionID, direction string, getMessage func() string) {
+	if !m.IsActive() {
+		return
+	}
+
+	var conn ActiveConnection
+	Connections.RLock()
+	if idx, ok := Connections.mapping[connectionID]; ok {
+		conn = Connections.connections[idx]
+	}
+	Connections.RUnlock()
+
+	if conn != nil {
+		m.Capture(conn, direction, getMessage)
+	}
+}
+
+// CaptureHTTPRequest adds the specified HTTP request and its response status
+func (m *debugCapturesManager) CaptureHTTPRequest(src DebugCaptureSource, r *http.Request, status int,
+	written int64, elapsed time.Duration,
+) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	m.Capture(src, DebugCaptureDirectionIn, func() string {
+		var sb strings.Builder
+		sb.WriteString(fmt.Sprintf("%s %s %s", r.Method, RedactDebugURL(r.URL), r.Proto))
+		keys := make([]string, 0, len(r.Header))
+		for k := range r.Header {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			for _, v := range r.Header[k] {
+				if debugSecretKeyRegex.MatchString(k) {
+					v = debugRedactedText
+				}
+				sb.WriteString(fmt.Sprintf("\n%s: %s", k, v))
+			}
+		}
+		return sb.String()
+	})
+	m.Capture(src, DebugCaptureDirectionOut, func() string {
+		return fmt.Sprintf("%d %s, bytes: %d, elapsed: %d ms", status, http.StatusText(status), written,
+			elapsed.Milliseconds())
+	})
+}
+
+// removeExpired must be called with the lock held
+func (m *debugCapturesManager) removeExpired() {
+	for id, c := range m.captures {
+		if c.isExpired() {
+			delete(m.captures, id)
+		}
+	}
+}
+
+func (m *debugCapturesManager) getCapture(id string) (*debugCapture, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	c, ok := m.captures[id]
+	if !ok {
+		return nil, util.NewRecordNotFoundError(fmt.Sprintf("debug capture %q not found", id))
+	}
+	return c, nil
+}
+
+// Get returns the debug capture with the specified ID
+func (m *debugCapturesManager) Get(id string) (DebugCapture, error) {
+	c, err := m.getCapture(id)
+	if err != nil {
+		return DebugCapture{}, err
+	}
+	return c.getInfo(), nil
+}
+
+// GetAll returns all the debug captures sorted by start time
+func (m *debugCapturesManager) GetAll() []DebugCapture {
+	m.RLock()
+	defer m.RUnlock()
+
+	result := make([]DebugCapture, 0, len(m.captures))
+	for _, c := range m.captures {
+		if c.isExpired() {
+			continue
+		}
+		result = append(result, c.getInfo())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartTime < result[j].StartTime
+	})
+	return result
+}
+
+// Stop stops the running debug capture with the specified ID
+func (m *debugCapturesManager) Stop(id string) error {
+	c, err := m.getCapture(id)
+	if err != nil {
+		return err
+	}
+	if !c.isRunning() {
+		return util.NewValidationError(fmt.Sprintf("debug capture %q is not running", id))
+	}
+	m.stopCapture(c, false)
+	return nil
+}
+
+// Delete stops, if running, and removes the debug capture with the specified ID
+func (m *debugCapturesManager) Delete(id string) error {
+	c, err := m.getCapture(id)
+	if err != nil {
+		return err
+	}
+	m.stopCapture(c, false)
+
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.captures, id)
+	return nil
+}
+
+// GetBundle returns the debug capture with the specified ID as zip archive.
+// The archive contains the capture details and the captured events, one JSON
+// object for each line
+func (m *debugCapturesManager) GetBundle(id string) ([]byte, error) {
+	c, err := m.getCapture(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.getBundle()
+}
+
+// RedactDebugURL returns the specified URL as string with the values of the
+// query parameters that could contain secrets redacted
+func RedactDebugURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	redacted := *u
+	redacted.User = nil
+	if redacted.RawQuery != "" {
+		query := redacted.Query()
+		for k := range query {
+			if debugSecretKeyRegex.MatchString(k) {
+				query.Set(k, debugRedactedText)
+			}
+		}
+		redacted.RawQuery = query.Encode()
+	}
+	return redacted.RequestURI()
+}
@@ -0,0 +1,230 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+type captureConnection struct {
+	*BaseConnection
+	localAddr  string
+	remoteAddr string
+}
+
+func (c *captureConnection) GetLocalAddress() string {
+	return c.localAddr
+}
+
+func (c *captureConnection) GetRemoteAddress() string {
+	return c.remoteAddr
+}
+
+func readDebugCaptureBundle(t *testing.T, id string) (DebugCapture, []DebugCaptureEvent) {
+	bundle, err := DebugCaptures.GetBundle(id)
+	require.NoError(t, err)
+	zr, err := zip.NewReader(bytes.NewReader(bundle), int64(len(bundle)))
+	require.NoError(t, err)
+	var info DebugCapture
+	var events []DebugCaptureEvent
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		require.NoError(t, err)
+		data, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		rc.Close()
+		switch f.Name {
+		case "capture.json":
+			err = json.Unmarshal(data, &info)
+			require.NoError(t, err)
+		case "events.jsonl":
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				if line == "" {
+					continue
+				}
+				var ev DebugCaptureEvent
+				err = json.Unmarshal([]byte(line), &ev)
+				require.NoError(t, err)
+				events = append(events, ev)
+			}
+		default:
+			t.Errorf("unexpected file %q", f.Name)
+		}
+	}
+	return info, events
+}
+
+func TestDebugCaptureRequestValidation(t *testing.T) {
+	req := DebugCaptureRequest{}
+	_, err := DebugCaptures.Start(req, "admin")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	req.Username = "user"
+	req.Protocol = "SCP"
+	_, err = DebugCaptures.Start(req, "admin")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	req.Protocol = "sftp"
+	req.Port = 70000
+	_, err = DebugCaptures.Start(req, "admin")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	req.Port = 0
+	req.Duration = 7200
+	_, err = DebugCaptures.Start(req, "admin")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	req.Duration = 0
+	req.MaxSize = debugCaptureMaxSize + 1
+	_, err = DebugCaptures.Start(req, "admin")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	req.MaxSize = 0
+	err = req.validate()
+	require.NoError(t, err)
+	assert.Equal(t, ProtocolSFTP, req.Protocol)
+	assert.Equal(t, int(debugCaptureDefaultDuration/time.Second), req.Duration)
+	assert.Equal(t, int64(debugCaptureDefaultSize), req.MaxSize)
+
+	_, err = DebugCaptures.Get("missing")
+	assert.ErrorIs(t, err, util.ErrNotFound)
+	assert.ErrorIs(t, DebugCaptures.Stop("missing"), util.ErrNotFound)
+	assert.ErrorIs(t, DebugCaptures.Delete("missing"), util.ErrNotFound)
+	_, err = DebugCaptures.GetBundle("missing")
+	assert.ErrorIs(t, err, util.ErrNotFound)
+}
+
+func TestDebugCapture(t *testing.T) {
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "capture_user",
+		},
+	}
+	conn := &captureConnection{
+		BaseConnection: NewBaseConnection("id1", ProtocolFTP, "", "", user),
+		localAddr:      "127.0.0.1:2121",
+		remoteAddr:     "127.0.0.1:54321",
+	}
+	otherConn := &captureConnection{
+		BaseConnection: NewBaseConnection("id2", ProtocolFTP, "", "", user),
+		localAddr:      "127.0.0.1:2122",
+		remoteAddr:     "127.0.0.1:54322",
+	}
+	sftpConn := &captureConnection{
+		BaseConnection: NewBaseConnection("id3", ProtocolSFTP, "", "", user),
+		localAddr:      "127.0.0.1:2022",
+		remoteAddr:     "127.0.0.1:54323",
+	}
+	assert.False(t, DebugCaptures.IsActive())
+	DebugCaptures.Capture(conn, DebugCaptureDirectionIn, func() string {
+		t.Error("the message must not be built without running captures")
+		return ""
+	})
+
+	byPort, err := DebugCaptures.Start(DebugCaptureRequest{Port: 2121}, "admin")
+	require.NoError(t, err)
+	byUser, err := DebugCaptures.Start(DebugCaptureRequest{Username: user.Username, Protocol: ProtocolFTP,
+		MaxSize: 1024}, "admin")
+	require.NoError(t, err)
+	assert.Equal(t, DebugCaptureStatusRunning, byUser.Status)
+	assert.True(t, DebugCaptures.IsActive())
+
+	DebugCaptures.Capture(conn, DebugCaptureDirectionIn, func() string { return "USER capture_user" })
+	DebugCaptures.Capture(otherConn, DebugCaptureDirectionOut, func() string { return "230 logged in" })
+	DebugCaptures.Capture(sftpConn, DebugCaptureDirectionIn, func() string { return "SSH_FXP_INIT" })
+
+	info, events := readDebugCaptureBundle(t, byPort.ID)
+	assert.Equal(t, 1, info.Events)
+	assert.Equal(t, DebugCaptureStatusRunning, info.Status)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "FTP_id1", events[0].ConnectionID)
+		assert.Equal(t, ProtocolFTP, events[0].Protocol)
+		assert.Equal(t, user.Username, events[0].Username)
+		assert.Equal(t, "127.0.0.1:54321", events[0].RemoteAddress)
+		assert.Equal(t, DebugCaptureDirectionIn, events[0].Direction)
+		assert.Equal(t, "USER capture_user", events[0].Message)
+	}
+	_, events = readDebugCaptureBundle(t, byUser.ID)
+	assert.Len(t, events, 2)
+	// the capture is stopped when the maximum size is reached
+	for i := 0; i < 10; i++ {
+		DebugCaptures.Capture(otherConn, DebugCaptureDirectionOut, func() string { return strings.Repeat("a", 100) })
+	}
+	byUser, err = DebugCaptures.Get(byUser.ID)
+	require.NoError(t, err)
+	assert.Equal(t, DebugCaptureStatusCompleted, byUser.Status)
+	assert.True(t, byUser.Truncated)
+	assert.LessOrEqual(t, byUser.Size, int64(1024))
+	assert.Greater(t, byUser.EndTime, int64(0))
+	assert.ErrorIs(t, DebugCaptures.Stop(byUser.ID), util.ErrValidation)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v2/user/files?path=%2Ffile&token=secret", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-SFTPGO-API-KEY", "secret")
+	req.Header.Set("User-Agent", "test client")
+	DebugCaptures.CaptureHTTPRequest(conn, req, 0, 10, time.Second)
+	_, events = readDebugCaptureBundle(t, byPort.ID)
+	if assert.Len(t, events, 3) {
+		assert.NotContains(t, events[1].Message, "secret")
+		assert.Contains(t, events[1].Message, "GET /api/v2/user/files?path=%2Ffile&token=REDACTED HTTP/1.1")
+		assert.Contains(t, events[1].Message, "Authorization: REDACTED")
+		assert.Contains(t, events[1].Message, "User-Agent: test client")
+		assert.Equal(t, DebugCaptureDirectionOut, events[2].Direction)
+		assert.Equal(t, "200 OK, bytes: 10, elapsed: 1000 ms", events[2].Message)
+	}
+
+	assert.Len(t, DebugCaptures.GetAll(), 2)
+	assert.NoError(t, DebugCaptures.Stop(byPort.ID))
+	assert.False(t, DebugCaptures.IsActive())
+	DebugCaptures.Capture(conn, DebugCaptureDirectionIn, func() string { return "QUIT" })
+	byPort, err = DebugCaptures.Get(byPort.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 3, byPort.Events)
+	assert.False(t, byPort.Truncated)
+
+	// the capture is stopped after the configured duration
+	byDuration, err := DebugCaptures.Start(DebugCaptureRequest{Username: user.Username, Duration: 1}, "admin")
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		info, err := DebugCaptures.Get(byDuration.ID)
+		return err == nil && info.Status == DebugCaptureStatusCompleted
+	}, 3*time.Second, 100*time.Millisecond)
+	assert.False(t, DebugCaptures.IsActive())
+
+	for _, c := range DebugCaptures.GetAll() {
+		assert.NoError(t, DebugCaptures.Delete(c.ID))
+	}
+	assert.Len(t, DebugCaptures.GetAll(), 0)
+	for i := 0; i < maxDebugCaptures; i++ {
+		_, err = DebugCaptures.Start(DebugCaptureRequest{Port: 2121}, "admin")
+		assert.NoError(t, err)
+	}
+	_, err = DebugCaptures.Start(DebugCaptureRequest{Port: 2121}, "admin")
+	assert.ErrorIs(t, err, ErrTooManyDebugCaptures)
+	for _, c := range DebugCaptures.GetAll() {
+		assert.NoError(t, DebugCaptures.Delete(c.ID))
+	}
+	assert.False(t, DebugCaptures.IsActive())
+}
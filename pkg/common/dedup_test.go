@@ -0,0 +1,214 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+func TestDedupConfig(t *testing.T) {
+	c := vfs.DedupConfig{}
+	assert.NoError(t, c.Validate())
+	assert.False(t, c.IsEnabled())
+	if runtime.GOOS == osWindows {
+		c.StorePath = filepath.Join(os.TempDir(), "dedup_cfg")
+		assert.Error(t, c.Validate())
+		return
+	}
+	c.StorePath = "relative"
+	assert.Error(t, c.Validate())
+	c.StorePath = filepath.Join(os.TempDir(), "dedup_cfg")
+	c.MinFileSize = -1
+	assert.Error(t, c.Validate())
+	c.MinFileSize = 0
+	c.GCInterval = -1
+	assert.Error(t, c.Validate())
+	c.GCInterval = 0
+	assert.NoError(t, c.Validate())
+	assert.Equal(t, 60, c.GCInterval)
+	assert.DirExists(t, c.StorePath)
+	assert.NoError(t, os.RemoveAll(c.StorePath))
+}
+
+func TestDedupFs(t *testing.T) {
+	if runtime.GOOS == osWindows {
+		t.Skip("this test is not available on Windows")
+	}
+	baseDir := filepath.Join(os.TempDir(), "dedup_test")
+	homeDir := filepath.Join(baseDir, "home")
+	storeDir := filepath.Join(baseDir, "store")
+	require.NoError(t, os.MkdirAll(homeDir, os.ModePerm))
+	defer os.RemoveAll(baseDir)
+
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "dedup_user",
+			HomeDir:  homeDir,
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+	}
+	user.FsConfig.DedupConfig.Enabled = true
+	// deduplication is disabled in the configuration
+	err := dataprovider.AddUser(&user, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	_, err = vfs.NewDedupFs("", homeDir, "")
+	assert.Error(t, err)
+	_, err = vfs.RunDedupGC()
+	assert.Error(t, err)
+
+	config := vfs.DedupConfig{
+		StorePath:   storeDir,
+		MinFileSize: 1,
+	}
+	require.NoError(t, config.Validate())
+	vfs.SetDedupConfig(config)
+	defer vfs.SetDedupConfig(vfs.DedupConfig{})
+
+	err = dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+	defer dataprovider.DeleteUser(user.Username, "", "", "") //nolint:errcheck
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+	assert.True(t, user.FsConfig.DedupConfig.Enabled)
+
+	conn := NewBaseConnection("", ProtocolSFTP, "", "", user)
+	fs, fsPath1, err := conn.GetFsAndResolvedPath("/file1.bin")
+	require.NoError(t, err)
+	_, ok := fs.(*vfs.DedupFs)
+	require.True(t, ok)
+	assert.True(t, vfs.IsLocalOsFs(fs))
+	fsPath2 := filepath.Join(homeDir, "file2.bin")
+	fsPath3 := filepath.Join(homeDir, "file3.bin")
+
+	upload := func(fsPath string, flag int, data []byte) {
+		f, _, _, err := fs.Create(fsPath, flag, 0)
+		require.NoError(t, err)
+		_, err = f.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+	sameFile := func(name1, name2 string) bool {
+		info1, err := os.Stat(name1)
+		require.NoError(t, err)
+		info2, err := os.Stat(name2)
+		require.NoError(t, err)
+		return os.SameFile(info1, info2)
+	}
+	countBlocks := func() int {
+		matches, err := filepath.Glob(filepath.Join(storeDir, "*", "*"))
+		require.NoError(t, err)
+		return len(matches)
+	}
+
+	data := util.GenerateRandomBytes(65535)
+	modTime := time.Now().Add(-1 * time.Hour).Truncate(time.Second)
+	upload(fsPath1, 0, data)
+	assert.Equal(t, 1, countBlocks())
+	upload(fsPath2, 0, data)
+	// different modification times, the files are not deduplicated
+	assert.Equal(t, 2, countBlocks())
+	assert.False(t, sameFile(fsPath1, fsPath2))
+	// preserving the modification time the files are deduplicated
+	require.NoError(t, fs.Chtimes(fsPath1, modTime, modTime, false))
+	require.NoError(t, fs.Chtimes(fsPath2, modTime, modTime, false))
+	assert.True(t, sameFile(fsPath1, fsPath2))
+	// the blocks with the previous modification times are released
+	assert.Equal(t, 1, countBlocks())
+	// small files are not deduplicated
+	upload(fsPath3, 0, []byte("small"))
+	assert.Equal(t, 1, countBlocks())
+	// unreferenced blocks are removed
+	orphan := filepath.Join(storeDir, "00", "orphan")
+	require.NoError(t, os.MkdirAll(filepath.Dir(orphan), 0700))
+	require.NoError(t, os.WriteFile(orphan, []byte("orphan"), 0600))
+	result, err := vfs.RunDedupGC()
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Blocks)
+	assert.Equal(t, int64(len(data)), result.Size)
+	assert.Equal(t, 1, result.RemovedBlocks)
+	assert.Equal(t, int64(len("orphan")), result.RemovedSize)
+	assert.NoFileExists(t, orphan)
+	// appending to a shared file detaches it
+	upload(fsPath1, os.O_WRONLY|os.O_APPEND, []byte("appended"))
+	assert.False(t, sameFile(fsPath1, fsPath2))
+	contents, err := os.ReadFile(fsPath1)
+	require.NoError(t, err)
+	assert.Equal(t, append(data, []byte("appended")...), contents)
+	contents, err = os.ReadFile(fsPath2)
+	require.NoError(t, err)
+	assert.Equal(t, data, contents)
+	// overwriting a shared file does not affect the other links
+	require.NoError(t, fs.Chtimes(fsPath1, modTime, modTime, false))
+	upload(fsPath3, 0, data)
+	require.NoError(t, fs.Chtimes(fsPath3, modTime, modTime, false))
+	assert.True(t, sameFile(fsPath2, fsPath3))
+	upload(fsPath3, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, []byte("overwritten"))
+	assert.False(t, sameFile(fsPath2, fsPath3))
+	contents, err = os.ReadFile(fsPath2)
+	require.NoError(t, err)
+	assert.Equal(t, data, contents)
+	// truncate
+	require.NoError(t, fs.Chtimes(fsPath1, modTime, modTime, false))
+	upload(fsPath3, 0, data)
+	require.NoError(t, fs.Chtimes(fsPath3, modTime, modTime, false))
+	assert.True(t, sameFile(fsPath2, fsPath3))
+	require.NoError(t, fs.Truncate(fsPath3, 10))
+	contents, err = os.ReadFile(fsPath3)
+	require.NoError(t, err)
+	assert.Equal(t, data[:10], contents)
+	contents, err = os.ReadFile(fsPath2)
+	require.NoError(t, err)
+	assert.Equal(t, data, contents)
+	// metadata changes detach the file and deduplicate it again
+	require.NoError(t, fs.Remove(fsPath3, false))
+	upload(fsPath3, 0, data)
+	require.NoError(t, fs.Chtimes(fsPath3, modTime, modTime, false))
+	assert.True(t, sameFile(fsPath2, fsPath3))
+	require.NoError(t, fs.Chmod(fsPath3, 0600))
+	assert.False(t, sameFile(fsPath2, fsPath3))
+	info, err := os.Stat(fsPath2)
+	require.NoError(t, err)
+	assert.NotEqual(t, os.FileMode(0600), info.Mode().Perm())
+	require.NoError(t, fs.Chmod(fsPath2, 0600))
+	assert.True(t, sameFile(fsPath2, fsPath3))
+	// removed files release their blocks
+	require.NoError(t, fs.Remove(fsPath2, false))
+	require.NoError(t, fs.Remove(fsPath3, false))
+	result, err = vfs.RunDedupGC()
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Blocks)
+	assert.Equal(t, int64(len(data)+len("appended")), result.Size)
+	assert.Equal(t, 1, countBlocks())
+	// quota usage is not affected by deduplication
+	numFiles, size, err := fs.ScanRootDirContents()
+	require.NoError(t, err)
+	assert.Equal(t, 1, numFiles)
+	assert.Equal(t, int64(len(data)+len("appended")), size)
+}
@@ -15,10 +15,14 @@
 package common
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/geoip"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
 )
 
 // HostEvent is the enumerable for the supported host events
@@ -36,10 +40,11 @@ const (
 const (
 	DefenderDriverMemory   = "memory"
 	DefenderDriverProvider = "provider"
+	DefenderDriverRedis    = "redis"
 )
 
 var (
-	supportedDefenderDrivers = []string{DefenderDriverMemory, DefenderDriverProvider}
+	supportedDefenderDrivers = []string{DefenderDriverMemory, DefenderDriverProvider, DefenderDriverRedis}
 )
 
 // Defender defines the interface that a defender must implements
@@ -52,17 +57,21 @@ type Defender interface {
 	GetBanTime(ip string) (*time.Time, error)
 	GetScore(ip string) (int, error)
 	DeleteHost(ip string) bool
+	GetHostStatus(ip string) (DefenderHostStatus, error)
+	GetThrottleDelay(ip string) time.Duration
 }
 
 // DefenderConfig defines the "defender" configuration
 type DefenderConfig struct {
 	// Set to true to enable the defender
 	Enabled bool `json:"enabled" mapstructure:"enabled"`
-	// Defender implementation to use, we support "memory" and "provider".
-	// Using "provider" as driver you can share the defender events among
+	// Defender implementation to use, we support "memory", "provider" and "redis".
+	// Using "provider" or "redis" as driver you can share the defender events among
 	// multiple SFTPGo instances. For a single instance "memory" provider will
 	// be much faster
 	Driver string `json:"driver" mapstructure:"driver"`
+	// Redis configuration, used for the "redis" driver
+	Redis DefenderRedisConfig `json:"redis" mapstructure:"redis"`
 	// BanTime is the number of minutes that a host is banned
 	BanTime int `json:"ban_time" mapstructure:"ban_time"`
 	// Percentage increase of the ban time if a banned host tries to connect again
@@ -84,16 +93,46 @@ type DefenderConfig struct {
 	// the last observation time minutes
 	ObservationTime int `json:"observation_time" mapstructure:"observation_time"`
 	// The number of banned IPs and host scores kept in memory will vary between the
-	// soft and hard limit for the "memory" driver. For the "provider" driver the
-	// soft limit is ignored and the hard limit is used to limit the number of entries
+	// soft and hard limit for the "memory" driver. For the "provider" and "redis" drivers
+	// the soft limit is ignored and the hard limit is used to limit the number of entries
 	// to return when you request for the entire host list from the defender
 	EntriesSoftLimit int `json:"entries_soft_limit" mapstructure:"entries_soft_limit"`
 	EntriesHardLimit int `json:"entries_hard_limit" mapstructure:"entries_hard_limit"`
+	// Hosts from these countries are banned on their first defender event.
+	// Countries are defined using ISO 3166-1 alpha-2 codes, a geoip database is required
+	BanCountries []string `json:"ban_countries" mapstructure:"ban_countries"`
+	// Escalation defines the escalating responses for misbehaving hosts
+	Escalation DefenderEscalationConfig `json:"escalation" mapstructure:"escalation"`
+	// CrowdSec integration, to push the bans and pull the decisions
+	CrowdSec DefenderCrowdSecConfig `json:"crowdsec" mapstructure:"crowdsec"`
+	// Blocklists to import in the defender lists on a schedule
+	Blocklists DefenderBlocklistsConfig `json:"blocklists" mapstructure:"blocklists"`
+}
+
+// getRedactedConfig returns a copy of the configuration without secrets
+func (c DefenderConfig) getRedactedConfig() DefenderConfig {
+	lists := c.Blocklists.Lists
+	if c.Redis.Password != "" {
+		c.Redis.Password = "[redacted]"
+	}
+	if c.CrowdSec.Password != "" {
+		c.CrowdSec.Password = "[redacted]"
+	}
+	if c.CrowdSec.APIKey != "" {
+		c.CrowdSec.APIKey = "[redacted]"
+	}
+	c.Blocklists.Lists = nil
+	for _, list := range lists {
+		list.URL = util.GetRedactedURL(list.URL)
+		c.Blocklists.Lists = append(c.Blocklists.Lists, list)
+	}
+	return c
 }
 
 type baseDefender struct {
-	config *DefenderConfig
-	ipList *dataprovider.IPList
+	config     *DefenderConfig
+	ipList     *dataprovider.IPList
+	escalation *defenderEscalation
 }
 
 func (d *baseDefender) isBanned(ip, protocol string) bool {
@@ -116,7 +155,85 @@ func (d *baseDefender) IsSafe(ip, protocol string) bool {
 	return false
 }
 
-func (d *baseDefender) getScore(event HostEvent) int {
+// GetThrottleDelay returns the delay to add to failed authentication
+// attempts for the given IP, if any
+func (d *baseDefender) GetThrottleDelay(ip string) time.Duration {
+	if d.escalation == nil {
+		return 0
+	}
+	return d.escalation.getThrottleDelay(ip)
+}
+
+// getBanDuration returns the duration for a new ban for the given IP
+func (d *baseDefender) getBanDuration(ip string) time.Duration {
+	if d.escalation == nil {
+		return time.Duration(d.config.BanTime) * time.Minute
+	}
+	return d.escalation.addBan(ip)
+}
+
+// hostBanned notifies the event manager and the configured integrations
+// about a newly banned host
+func (d *baseDefender) hostBanned(ip, protocol string, banTime time.Time) {
+	logger.DefenderBanLog(ip, protocol, banTime)
+	eventManager.handleIPBlockedEvent(EventParams{
+		Event:     ipBlockedEventName,
+		IP:        ip,
+		Protocol:  protocol,
+		Timestamp: time.Now().UnixNano(),
+		Status:    1,
+	})
+	if c := crowdSec; c != nil {
+		go func() {
+			if err := c.pushBan(ip, protocol, banTime); err != nil {
+				logger.Warn(logSender, "", "unable to push ban for host %q to CrowdSec: %v", ip, err)
+			}
+		}()
+	}
+}
+
+func (d *baseDefender) updateEscalation(ip string, score int) {
+	if d.escalation != nil {
+		d.escalation.updateScore(ip, score)
+	}
+}
+
+func (d *baseDefender) removeEscalation(ip string) {
+	if d.escalation != nil {
+		d.escalation.removeHost(ip)
+	}
+}
+
+func (d *baseDefender) getHostStatus(ip string, host dataprovider.DefenderEntry, err error) (DefenderHostStatus, error) {
+	if err != nil && !errors.Is(err, util.ErrNotFound) {
+		return DefenderHostStatus{}, err
+	}
+	if d.escalation == nil {
+		if err != nil {
+			return DefenderHostStatus{}, err
+		}
+		stage := DefenderStageObserve
+		if !host.BanTime.IsZero() {
+			stage = DefenderStageTempBan
+		}
+		return DefenderHostStatus{
+			IP:      ip,
+			Stage:   stage,
+			Score:   host.Score,
+			BanTime: host.BanTime,
+		}, nil
+	}
+	status := d.escalation.getStatus(ip, host.Score, host.BanTime)
+	if err != nil && len(status.History) == 0 {
+		return status, err
+	}
+	return status, nil
+}
+
+func (d *baseDefender) getScore(ip string, event HostEvent) int {
+	if geoip.IsCountryMatched(ip, d.config.BanCountries) {
+		return d.config.Threshold + 1
+	}
 	var score int
 
 	switch event {
@@ -196,6 +313,11 @@ func (c *DefenderConfig) validate() error {
 	if c.EntriesHardLimit <= c.EntriesSoftLimit {
 		return fmt.Errorf("invalid entries_hard_limit %v must be > %v", c.EntriesHardLimit, c.EntriesSoftLimit)
 	}
+	banCountries, err := getCountryCodes(c.BanCountries)
+	if err != nil {
+		return err
+	}
+	c.BanCountries = banCountries
 
-	return nil
+	return c.Escalation.validate(c)
 }
@@ -16,6 +16,7 @@ package common
 
 import (
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net"
 	"testing"
@@ -26,6 +27,7 @@ import (
 	"github.com/yl2chen/cidranger"
 
 	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
 )
 
 func TestBasicDefender(t *testing.T) {
@@ -507,6 +509,221 @@ func TestDefenderConfig(t *testing.T) {
 	assert.Equal(t, 0, c.ScoreNoAuth)
 }
 
+func TestDefenderEscalationConfig(t *testing.T) {
+	c := DefenderConfig{
+		Enabled:          true,
+		BanTime:          30,
+		BanTimeIncrement: 50,
+		Threshold:        10,
+		ScoreInvalid:     2,
+		ScoreValid:       1,
+		ObservationTime:  30,
+		EntriesSoftLimit: 10,
+		EntriesHardLimit: 20,
+		Escalation: DefenderEscalationConfig{
+			Enabled: true,
+		},
+	}
+	err := c.validate()
+	require.Error(t, err)
+	c.Escalation.ThrottleThreshold = 10
+	err = c.validate()
+	require.Error(t, err)
+	c.Escalation.ThrottleThreshold = 5
+	c.Escalation.ThrottleDelay = -1
+	err = c.validate()
+	require.Error(t, err)
+	c.Escalation.ThrottleDelay = maxThrottleDelay + 1
+	err = c.validate()
+	require.Error(t, err)
+	c.Escalation.ThrottleDelay = 100
+	c.Escalation.LongBanThreshold = 1
+	err = c.validate()
+	require.Error(t, err)
+	c.Escalation.LongBanThreshold = 2
+	c.Escalation.LongBanTime = 30
+	err = c.validate()
+	require.Error(t, err)
+	c.Escalation.LongBanTime = 60
+	err = c.validate()
+	require.Error(t, err)
+	c.Escalation.DeescalationTime = 120
+	err = c.validate()
+	require.NoError(t, err)
+	c.Escalation.Enabled = false
+	c.Escalation.ThrottleThreshold = 0
+	err = c.validate()
+	require.NoError(t, err)
+}
+
+func TestDefenderEscalation(t *testing.T) {
+	config := &DefenderConfig{
+		Enabled:          true,
+		BanTime:          10,
+		BanTimeIncrement: 50,
+		Threshold:        5,
+		ScoreInvalid:     2,
+		ScoreValid:       1,
+		ObservationTime:  15,
+		EntriesSoftLimit: 10,
+		EntriesHardLimit: 20,
+		Escalation: DefenderEscalationConfig{
+			Enabled:           true,
+			ThrottleThreshold: 3,
+			ThrottleDelay:     100,
+			LongBanThreshold:  2,
+			LongBanTime:       120,
+			DeescalationTime:  60,
+		},
+	}
+	d, err := newInMemoryDefender(config)
+	require.NoError(t, err)
+	defender := d.(*memoryDefender)
+
+	ip := "192.168.1.10"
+	_, err = defender.GetHostStatus(ip)
+	assert.ErrorIs(t, err, util.ErrNotFound)
+	assert.Equal(t, time.Duration(0), defender.GetThrottleDelay(ip))
+
+	defender.AddEvent(ip, ProtocolSSH, HostEventUserNotFound)
+	status, err := defender.GetHostStatus(ip)
+	require.NoError(t, err)
+	assert.Equal(t, DefenderStageObserve, status.Stage)
+	assert.Equal(t, 2, status.Score)
+	assert.Equal(t, time.Duration(0), defender.GetThrottleDelay(ip))
+
+	defender.AddEvent(ip, ProtocolSSH, HostEventLoginFailed)
+	status, err = defender.GetHostStatus(ip)
+	require.NoError(t, err)
+	assert.Equal(t, DefenderStageThrottle, status.Stage)
+	assert.Equal(t, 100*time.Millisecond, defender.GetThrottleDelay(ip))
+
+	defender.AddEvent(ip, ProtocolSSH, HostEventUserNotFound)
+	assert.True(t, defender.IsBanned(ip, ProtocolSSH))
+	status, err = defender.GetHostStatus(ip)
+	require.NoError(t, err)
+	assert.Equal(t, DefenderStageTempBan, status.Stage)
+	assert.Equal(t, 1, status.Bans)
+	assert.Equal(t, time.Duration(0), defender.GetThrottleDelay(ip))
+	banTime, err := defender.GetBanTime(ip)
+	require.NoError(t, err)
+	require.NotNil(t, banTime)
+	assert.True(t, banTime.Before(time.Now().Add(time.Duration(config.Escalation.LongBanTime)*time.Minute)))
+	// simulate an expired ban
+	defender.Lock()
+	defender.banned[ip] = time.Now().Add(-1 * time.Minute)
+	defender.Unlock()
+	status, err = defender.GetHostStatus(ip)
+	require.NoError(t, err)
+	assert.Equal(t, DefenderStageNone, status.Stage)
+
+	for i := 0; i < 3; i++ {
+		defender.AddEvent(ip, ProtocolSSH, HostEventUserNotFound)
+	}
+	status, err = defender.GetHostStatus(ip)
+	require.NoError(t, err)
+	assert.Equal(t, DefenderStageLongBan, status.Stage)
+	assert.Equal(t, 2, status.Bans)
+	banTime, err = defender.GetBanTime(ip)
+	require.NoError(t, err)
+	require.NotNil(t, banTime)
+	assert.True(t, banTime.After(time.Now().Add(time.Duration(config.Escalation.LongBanTime-1)*time.Minute)))
+	stages := make([]DefenderStage, 0, len(status.History))
+	for _, h := range status.History {
+		stages = append(stages, h.Stage)
+	}
+	assert.Equal(t, []DefenderStage{DefenderStageObserve, DefenderStageThrottle, DefenderStageTempBan,
+		DefenderStageNone, DefenderStageObserve, DefenderStageThrottle, DefenderStageLongBan}, stages)
+	// bans older than the de-escalation time are forgotten
+	defender.Lock()
+	defender.banned[ip] = time.Now().Add(-1 * time.Minute)
+	defender.Unlock()
+	defender.escalation.Lock()
+	host := defender.escalation.hosts[ip]
+	for idx := range host.bans {
+		host.bans[idx] = time.Now().Add(-2 * time.Hour)
+	}
+	defender.escalation.Unlock()
+	for i := 0; i < 3; i++ {
+		defender.AddEvent(ip, ProtocolSSH, HostEventUserNotFound)
+	}
+	status, err = defender.GetHostStatus(ip)
+	require.NoError(t, err)
+	assert.Equal(t, DefenderStageTempBan, status.Stage)
+	assert.Equal(t, 1, status.Bans)
+
+	data, err := json.Marshal(&status)
+	require.NoError(t, err)
+	var decoded map[string]any
+	err = json.Unmarshal(data, &decoded)
+	require.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString([]byte(ip)), decoded["id"])
+	assert.Equal(t, string(DefenderStageTempBan), decoded["stage"])
+	assert.Equal(t, status.BanTime.UTC().Format(time.RFC3339), decoded["ban_time"])
+	assert.Len(t, decoded["history"], len(status.History))
+	// removing the host resets the escalation
+	assert.True(t, defender.DeleteHost(ip))
+	_, err = defender.GetHostStatus(ip)
+	assert.ErrorIs(t, err, util.ErrNotFound)
+
+	config.Escalation.Enabled = false
+	d, err = newInMemoryDefender(config)
+	require.NoError(t, err)
+	d.AddEvent(ip, ProtocolSSH, HostEventLoginFailed)
+	status, err = d.GetHostStatus(ip)
+	require.NoError(t, err)
+	assert.Equal(t, DefenderStageObserve, status.Stage)
+	assert.Len(t, status.History, 0)
+	assert.Equal(t, time.Duration(0), d.GetThrottleDelay(ip))
+	for i := 0; i < 3; i++ {
+		d.AddEvent(ip, ProtocolSSH, HostEventUserNotFound)
+	}
+	status, err = d.GetHostStatus(ip)
+	require.NoError(t, err)
+	assert.Equal(t, DefenderStageTempBan, status.Stage)
+	data, err = json.Marshal(&status)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"history":[]`)
+}
+
+func TestDefenderEscalationCleanup(t *testing.T) {
+	config := &DefenderConfig{
+		BanTime:          10,
+		Threshold:        5,
+		ObservationTime:  1,
+		EntriesSoftLimit: 2,
+		EntriesHardLimit: 3,
+		Escalation: DefenderEscalationConfig{
+			Enabled:           true,
+			ThrottleThreshold: 3,
+			LongBanThreshold:  2,
+			LongBanTime:       120,
+			DeescalationTime:  60,
+		},
+	}
+	e := newDefenderEscalation(config)
+	require.NotNil(t, e)
+	e.updateScore("10.0.0.1", 1)
+	e.addBan("10.0.0.2")
+	e.updateScore("10.0.0.3", 1)
+	e.Lock()
+	e.hosts["10.0.0.1"].lastUpdate = time.Now().Add(-5 * time.Minute)
+	e.hosts["10.0.0.2"].lastUpdate = time.Now().Add(-5 * time.Second)
+	e.hosts["10.0.0.3"].lastUpdate = time.Now().Add(-10 * time.Second)
+	e.Unlock()
+	e.updateScore("10.0.0.4", 1)
+	e.Lock()
+	// the de-escalated host is removed and then the oldest
+	// entries are removed up to the soft limit
+	assert.Len(t, e.hosts, 2)
+	assert.Contains(t, e.hosts, "10.0.0.2")
+	assert.Contains(t, e.hosts, "10.0.0.4")
+	e.Unlock()
+
+	config.Escalation.Enabled = false
+	assert.Nil(t, newDefenderEscalation(config))
+}
+
 func BenchmarkDefenderBannedSearch(b *testing.B) {
 	d := getDefenderForBench()
 
@@ -0,0 +1,401 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/httpclient"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/version"
+)
+
+const (
+	defaultCrowdSecPullInterval = 60
+	crowdSecTimeout             = 30 * time.Second
+	crowdSecScenario            = "sftpgo/defender-ban"
+	crowdSecOrigin              = "sftpgo"
+	crowdSecAPIKeyHeader        = "X-Api-Key"
+	crowdSecDescriptionPrefix   = "CrowdSec decision"
+)
+
+// DefenderCrowdSecConfig defines the configuration for the CrowdSec integration.
+// The hosts banned by the defender can be pushed to the CrowdSec Local API as alerts
+// and the CrowdSec decisions can be pulled and imported in the defender deny list
+type DefenderCrowdSecConfig struct {
+	// CrowdSec Local API URL, for example http://127.0.0.1:8080.
+	// Empty means disabled
+	URL string `json:"url" mapstructure:"url"`
+	// Machine ID and password registered in the Local API, used to push
+	// the bans as alerts. Leave empty to disable pushing alerts
+	MachineID string `json:"machine_id" mapstructure:"machine_id"`
+	Password  string `json:"password" mapstructure:"password"`
+	// Bouncer API key, used to pull the decisions. Leave empty to disable
+	// pulling decisions
+	APIKey string `json:"api_key" mapstructure:"api_key"`
+	// Interval, in seconds, to pull the decisions. 0 means the default (60 seconds)
+	PullInterval int `json:"pull_interval" mapstructure:"pull_interval"`
+}
+
+func (c *DefenderCrowdSecConfig) isEnabled() bool {
+	return c.URL != ""
+}
+
+func (c *DefenderCrowdSecConfig) getPullInterval() time.Duration {
+	if c.PullInterval <= 0 {
+		return defaultCrowdSecPullInterval * time.Second
+	}
+	return time.Duration(c.PullInterval) * time.Second
+}
+
+func (c *DefenderCrowdSecConfig) validate() error {
+	if !c.isEnabled() {
+		return nil
+	}
+	if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+		return fmt.Errorf("crowdsec: invalid URL %q", c.URL)
+	}
+	c.URL = strings.TrimSuffix(c.URL, "/")
+	if c.MachineID == "" && c.APIKey == "" {
+		return errors.New("crowdsec: a machine ID or a bouncer API key is required")
+	}
+	if c.MachineID != "" && c.Password == "" {
+		return errors.New("crowdsec: the password is required for the machine ID")
+	}
+	if c.PullInterval < 0 {
+		return fmt.Errorf("crowdsec: invalid pull interval %d", c.PullInterval)
+	}
+	return nil
+}
+
+type crowdSecLoginRequest struct {
+	MachineID string   `json:"machine_id"`
+	Password  string   `json:"password"`
+	Scenarios []string `json:"scenarios"`
+}
+
+type crowdSecLoginResponse struct {
+	Token  string    `json:"token"`
+	Expire time.Time `json:"expire"`
+}
+
+type crowdSecMeta struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type crowdSecEvent struct {
+	Timestamp string         `json:"timestamp"`
+	Meta      []crowdSecMeta `json:"meta"`
+}
+
+type crowdSecSource struct {
+	Scope string `json:"scope"`
+	Value string `json:"value"`
+	IP    string `json:"ip,omitempty"`
+}
+
+type crowdSecDecision struct {
+	Duration string `json:"duration"`
+	Origin   string `json:"origin"`
+	Scenario string `json:"scenario"`
+	Scope    string `json:"scope"`
+	Type     string `json:"type"`
+	Value    string `json:"value"`
+}
+
+type crowdSecAlert struct {
+	Scenario        string             `json:"scenario"`
+	ScenarioHash    string             `json:"scenario_hash"`
+	ScenarioVersion string             `json:"scenario_version"`
+	Message         string             `json:"message"`
+	EventsCount     int                `json:"events_count"`
+	StartAt         string             `json:"start_at"`
+	StopAt          string             `json:"stop_at"`
+	Capacity        int                `json:"capacity"`
+	Leakspeed       string             `json:"leakspeed"`
+	Simulated       bool               `json:"simulated"`
+	Events          []crowdSecEvent    `json:"events"`
+	Source          crowdSecSource     `json:"source"`
+	Decisions       []crowdSecDecision `json:"decisions"`
+}
+
+type crowdSecDecisionsStream struct {
+	New     []crowdSecDecision `json:"new"`
+	Deleted []crowdSecDecision `json:"deleted"`
+}
+
+// getNetwork returns the network for the decision or an empty string
+// if the decision is not supported
+func (d *crowdSecDecision) getNetwork() string {
+	if !strings.EqualFold(d.Type, "ban") {
+		return ""
+	}
+	if !strings.EqualFold(d.Scope, "ip") && !strings.EqualFold(d.Scope, "range") {
+		return ""
+	}
+	network, err := getDefenderListNetwork(d.Value)
+	if err != nil {
+		return ""
+	}
+	return network
+}
+
+type crowdSecClient struct {
+	config    *DefenderCrowdSecConfig
+	source    *defenderListSource
+	isPulling atomic.Bool
+	// true after the first successful decisions pull, the following
+	// pulls will only return the decisions changed since the previous pull
+	streamStarted atomic.Bool
+
+	mu              sync.Mutex
+	token           string
+	tokenExpiration time.Time
+}
+
+func newCrowdSecClient(config *DefenderCrowdSecConfig) *crowdSecClient {
+	return &crowdSecClient{
+		config: config,
+		source: &defenderListSource{
+			descriptionPrefix: crowdSecDescriptionPrefix,
+			mode:              dataprovider.ListModeDeny,
+		},
+	}
+}
+
+func (c *crowdSecClient) doRequest(method, path string, body any, headers map[string]string, result any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewBuffer(data)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), crowdSecTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, c.config.URL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "SFTPGo/"+version.Get().Version)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	client := httpclient.GetHTTPClient()
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusNoContent {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096)) //nolint:errcheck
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	if result == nil {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096)) //nolint:errcheck
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (c *crowdSecClient) getToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Now().Add(time.Minute).Before(c.tokenExpiration) {
+		return c.token, nil
+	}
+	var resp crowdSecLoginResponse
+	err := c.doRequest(http.MethodPost, "/v1/watchers/login", crowdSecLoginRequest{
+		MachineID: c.config.MachineID,
+		Password:  c.config.Password,
+		Scenarios: []string{crowdSecScenario},
+	}, nil, &resp)
+	if err != nil {
+		return "", fmt.Errorf("login error: %w", err)
+	}
+	if resp.Token == "" {
+		return "", errors.New("login error: no token returned")
+	}
+	c.token = resp.Token
+	c.tokenExpiration = resp.Expire
+	return c.token, nil
+}
+
+func (c *crowdSecClient) resetToken() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.token = ""
+}
+
+func (c *crowdSecClient) getAlert(ip, protocol string, banTime time.Time) crowdSecAlert {
+	now := time.Now().UTC().Format(time.RFC3339)
+	duration := time.Until(banTime).Round(time.Second)
+	if duration < time.Second {
+		duration = time.Second
+	}
+	return crowdSecAlert{
+		Scenario:        crowdSecScenario,
+		ScenarioHash:    "",
+		ScenarioVersion: version.Get().Version,
+		Message:         fmt.Sprintf("Host %s banned by the SFTPGo defender, protocol %s", ip, protocol),
+		EventsCount:     1,
+		StartAt:         now,
+		StopAt:          now,
+		Leakspeed:       "0",
+		Events: []crowdSecEvent{
+			{
+				Timestamp: now,
+				Meta: []crowdSecMeta{
+					{
+						Key:   "service",
+						Value: "sftpgo",
+					},
+					{
+						Key:   "protocol",
+						Value: protocol,
+					},
+					{
+						Key:   "source_ip",
+						Value: ip,
+					},
+				},
+			},
+		},
+		Source: crowdSecSource{
+			Scope: "Ip",
+			Value: ip,
+			IP:    ip,
+		},
+		Decisions: []crowdSecDecision{
+			{
+				Duration: duration.String(),
+				Origin:   crowdSecOrigin,
+				Scenario: crowdSecScenario,
+				Scope:    "Ip",
+				Type:     "ban",
+				Value:    ip,
+			},
+		},
+	}
+}
+
+// pushBan sends the specified ban to the Local API as an alert
+func (c *crowdSecClient) pushBan(ip, protocol string, banTime time.Time) error {
+	if c.config.MachineID == "" {
+		return nil
+	}
+	token, err := c.getToken()
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{
+		"Authorization": "Bearer " + token,
+	}
+	err = c.doRequest(http.MethodPost, "/v1/alerts", []crowdSecAlert{c.getAlert(ip, protocol, banTime)}, headers, nil)
+	if err != nil {
+		// the token could be expired or revoked, the next push will login again
+		c.resetToken()
+		return err
+	}
+	logger.Debug(logSender, "", "ban for host %q pushed to CrowdSec", ip)
+	return nil
+}
+
+// pullDecisions imports the CrowdSec ban decisions in the defender deny list
+func (c *crowdSecClient) pullDecisions() {
+	if !c.isPulling.CompareAndSwap(false, true) {
+		logger.Debug(logSender, "", "CrowdSec decisions pull already in progress")
+		return
+	}
+	defer c.isPulling.Store(false)
+
+	startup := !c.streamStarted.Load()
+	var stream crowdSecDecisionsStream
+	headers := map[string]string{
+		crowdSecAPIKeyHeader: c.config.APIKey,
+	}
+	err := c.doRequest(http.MethodGet, fmt.Sprintf("/v1/decisions/stream?startup=%t", startup), nil, headers, &stream)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to pull CrowdSec decisions: %v", err)
+		return
+	}
+	if startup {
+		// we get all the active decisions, the imported entries
+		// not included anymore are removed
+		networks := make(map[string]string)
+		for idx := range stream.New {
+			if network := stream.New[idx].getNetwork(); network != "" {
+				networks[network] = c.getDescription(&stream.New[idx])
+			}
+		}
+		added, removed, err := c.source.sync(networks)
+		if err != nil {
+			logger.Warn(logSender, "", "unable to import CrowdSec decisions: %v", err)
+			return
+		}
+		c.streamStarted.Store(true)
+		logger.Info(logSender, "", "CrowdSec decisions imported, added: %d, removed: %d", added, removed)
+		return
+	}
+	var added, removed int
+	for idx := range stream.Deleted {
+		if network := stream.Deleted[idx].getNetwork(); network != "" {
+			if err := c.source.removeEntry(network); err != nil {
+				logger.Warn(logSender, "", "unable to remove CrowdSec decision for %q: %v", network, err)
+				continue
+			}
+			removed++
+		}
+	}
+	for idx := range stream.New {
+		if network := stream.New[idx].getNetwork(); network != "" {
+			if err := c.source.addEntry(network, c.getDescription(&stream.New[idx])); err != nil {
+				logger.Warn(logSender, "", "unable to import CrowdSec decision for %q: %v", network, err)
+				continue
+			}
+			added++
+		}
+	}
+	logger.Debug(logSender, "", "CrowdSec decisions updated, added: %d, removed: %d", added, removed)
+}
+
+func (c *crowdSecClient) getDescription(d *crowdSecDecision) string {
+	if d.Scenario == "" {
+		return crowdSecDescriptionPrefix
+	}
+	return fmt.Sprintf("%s, scenario: %s", crowdSecDescriptionPrefix, d.Scenario)
+}
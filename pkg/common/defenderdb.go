@@ -39,8 +39,9 @@ func newDBDefender(config *DefenderConfig) (Defender, error) {
 	}
 	defender := &dbDefender{
 		baseDefender: baseDefender{
-			config: config,
-			ipList: ipList,
+			config:     config,
+			ipList:     ipList,
+			escalation: newDefenderEscalation(config),
 		},
 	}
 	defender.lastCleanup.Store(0)
@@ -58,6 +59,12 @@ func (d *dbDefender) GetHost(ip string) (dataprovider.DefenderEntry, error) {
 	return dataprovider.GetDefenderHostByIP(ip, d.getStartObservationTime())
 }
 
+// GetHostStatus returns the escalation stage and history for the given IP
+func (d *dbDefender) GetHostStatus(ip string) (DefenderHostStatus, error) {
+	host, err := d.GetHost(ip)
+	return d.getHostStatus(ip, host, err)
+}
+
 // IsBanned returns true if the specified IP is banned
 // and increase ban time if the IP is found.
 // This method must be called as soon as the client connects
@@ -81,6 +88,7 @@ func (d *dbDefender) IsBanned(ip, protocol string) bool {
 
 // DeleteHost removes the specified IP from the defender lists
 func (d *dbDefender) DeleteHost(ip string) bool {
+	d.removeEscalation(ip)
 	if _, err := d.GetHost(ip); err != nil {
 		return false
 	}
@@ -94,23 +102,20 @@ func (d *dbDefender) AddEvent(ip, protocol string, event HostEvent) {
 		return
 	}
 
-	score := d.baseDefender.getScore(event)
+	score := d.baseDefender.getScore(ip, event)
 
 	host, err := dataprovider.AddDefenderEvent(ip, score, d.getStartObservationTime())
 	if err != nil {
 		return
 	}
 	if host.Score > d.config.Threshold {
-		banTime := time.Now().Add(time.Duration(d.config.BanTime) * time.Minute)
+		banTime := time.Now().Add(d.getBanDuration(ip))
 		err = dataprovider.SetDefenderBanTime(ip, util.GetTimeAsMsSinceEpoch(banTime))
 		if err == nil {
-			eventManager.handleIPBlockedEvent(EventParams{
-				Event:     ipBlockedEventName,
-				IP:        ip,
-				Timestamp: time.Now().UnixNano(),
-				Status:    1,
-			})
+			d.hostBanned(ip, protocol, banTime)
 		}
+	} else {
+		d.updateEscalation(ip, host.Score)
 	}
 
 	if err == nil {
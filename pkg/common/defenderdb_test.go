@@ -312,7 +312,8 @@ func isDbDefenderSupported() bool {
 	// to use it outside test cases
 	switch dataprovider.GetProviderStatus().Driver {
 	case dataprovider.MySQLDataProviderName, dataprovider.PGSQLDataProviderName,
-		dataprovider.CockroachDataProviderName, dataprovider.SQLiteDataProviderName:
+		dataprovider.CockroachDataProviderName, dataprovider.SQLiteDataProviderName,
+		dataprovider.EtcdDataProviderName:
 		return true
 	default:
 		return false
@@ -0,0 +1,354 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// DefenderStage defines the escalation stage of a defender host
+type DefenderStage string
+
+// Supported defender stages
+const (
+	DefenderStageNone     DefenderStage = "none"
+	DefenderStageObserve  DefenderStage = "observe"
+	DefenderStageThrottle DefenderStage = "throttle"
+	DefenderStageTempBan  DefenderStage = "temp_ban"
+	DefenderStageLongBan  DefenderStage = "long_ban"
+)
+
+const (
+	maxDefenderStageHistory = 20
+	maxThrottleDelay        = 30000
+)
+
+// DefenderEscalationConfig defines the configuration for the defender escalation.
+// A host goes through the following stages:
+//   - observe, the host has a score greater than zero
+//   - throttle, the host score reached the throttle threshold, failed
+//     authentication attempts are delayed
+//   - temp_ban, the host score reached the defender threshold, the host
+//     is banned for the configured ban time
+//   - long_ban, the host was banned long_ban_threshold times within the
+//     de-escalation time, the host is banned for long_ban_time minutes
+//
+// Hosts are automatically de-escalated: the score decreases after the
+// observation time and the bans older than the de-escalation time are forgotten
+type DefenderEscalationConfig struct {
+	// Set to true to enable the escalation
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// Score at which the failed authentication attempts are throttled.
+	// Must be lower than the defender threshold
+	ThrottleThreshold int `json:"throttle_threshold" mapstructure:"throttle_threshold"`
+	// Delay, in milliseconds, to add to each failed authentication attempt
+	// for throttled hosts
+	ThrottleDelay int `json:"throttle_delay" mapstructure:"throttle_delay"`
+	// Number of bans, within the de-escalation time, after which a host is
+	// banned for long_ban_time minutes
+	LongBanThreshold int `json:"long_ban_threshold" mapstructure:"long_ban_threshold"`
+	// LongBanTime is the number of minutes that a host is banned in the long ban stage
+	LongBanTime int `json:"long_ban_time" mapstructure:"long_ban_time"`
+	// Bans older than this number of minutes are not considered to escalate
+	// to the long ban stage
+	DeescalationTime int `json:"deescalation_time" mapstructure:"deescalation_time"`
+}
+
+func (c *DefenderEscalationConfig) validate(defenderConfig *DefenderConfig) error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.ThrottleThreshold <= 0 || c.ThrottleThreshold >= defenderConfig.Threshold {
+		return fmt.Errorf("invalid escalation throttle_threshold %d, it must be greater than 0 and lower than threshold %d",
+			c.ThrottleThreshold, defenderConfig.Threshold)
+	}
+	if c.ThrottleDelay < 0 || c.ThrottleDelay > maxThrottleDelay {
+		return fmt.Errorf("invalid escalation throttle_delay %d, valid range: 0-%d", c.ThrottleDelay, maxThrottleDelay)
+	}
+	if c.LongBanThreshold < 2 {
+		return fmt.Errorf("invalid escalation long_ban_threshold %d, it must be at least 2", c.LongBanThreshold)
+	}
+	if c.LongBanTime <= defenderConfig.BanTime {
+		return fmt.Errorf("invalid escalation long_ban_time %d, it must be greater than ban_time %d",
+			c.LongBanTime, defenderConfig.BanTime)
+	}
+	if c.DeescalationTime <= 0 {
+		return fmt.Errorf("invalid escalation deescalation_time %d", c.DeescalationTime)
+	}
+	return nil
+}
+
+// DefenderStageChange defines a stage transition for a defender host
+type DefenderStageChange struct {
+	Stage DefenderStage `json:"stage"`
+	// unix timestamp in milliseconds
+	Timestamp int64 `json:"timestamp"`
+}
+
+// DefenderHostStatus defines the escalation status for a defender host
+type DefenderHostStatus struct {
+	IP      string        `json:"ip"`
+	Stage   DefenderStage `json:"stage"`
+	Score   int           `json:"score,omitempty"`
+	BanTime time.Time     `json:"ban_time,omitempty"`
+	// Number of bans within the de-escalation time
+	Bans    int                   `json:"bans,omitempty"`
+	History []DefenderStageChange `json:"history"`
+}
+
+// MarshalJSON returns the JSON encoding of a DefenderHostStatus.
+func (s *DefenderHostStatus) MarshalJSON() ([]byte, error) {
+	var banTime string
+	if !s.BanTime.IsZero() {
+		banTime = s.BanTime.UTC().Format(time.RFC3339)
+	}
+	history := s.History
+	if history == nil {
+		history = []DefenderStageChange{}
+	}
+	return json.Marshal(&struct {
+		ID      string                `json:"id"`
+		IP      string                `json:"ip"`
+		Stage   DefenderStage         `json:"stage"`
+		Score   int                   `json:"score,omitempty"`
+		BanTime string                `json:"ban_time,omitempty"`
+		Bans    int                   `json:"bans,omitempty"`
+		History []DefenderStageChange `json:"history"`
+	}{
+		ID:      hex.EncodeToString([]byte(s.IP)),
+		IP:      s.IP,
+		Stage:   s.Stage,
+		Score:   s.Score,
+		BanTime: banTime,
+		Bans:    s.Bans,
+		History: history,
+	})
+}
+
+type escalationHost struct {
+	stage DefenderStage
+	// start time for the bans within the de-escalation time
+	bans []time.Time
+	// expiration for the last long ban, if any
+	longBanUntil time.Time
+	lastUpdate   time.Time
+	history      []DefenderStageChange
+}
+
+func (h *escalationHost) setStage(stage DefenderStage, now time.Time) bool {
+	if h.stage == stage {
+		return false
+	}
+	h.stage = stage
+	h.history = append(h.history, DefenderStageChange{
+		Stage:     stage,
+		Timestamp: util.GetTimeAsMsSinceEpoch(now),
+	})
+	if len(h.history) > maxDefenderStageHistory {
+		h.history = h.history[len(h.history)-maxDefenderStageHistory:]
+	}
+	return true
+}
+
+func (h *escalationHost) removeExpiredBans(limit time.Time) {
+	idx := 0
+	for _, t := range h.bans {
+		if t.After(limit) {
+			h.bans[idx] = t
+			idx++
+		}
+	}
+	h.bans = h.bans[:idx]
+}
+
+// defenderEscalation keeps track of the escalation stage for the defender hosts.
+// The escalation state is kept in memory, also for the provider defender
+type defenderEscalation struct {
+	config         *DefenderEscalationConfig
+	defenderConfig *DefenderConfig
+	sync.Mutex
+	hosts map[string]*escalationHost
+}
+
+func newDefenderEscalation(defenderConfig *DefenderConfig) *defenderEscalation {
+	if !defenderConfig.Escalation.Enabled {
+		return nil
+	}
+	return &defenderEscalation{
+		config:         &defenderConfig.Escalation,
+		defenderConfig: defenderConfig,
+		hosts:          make(map[string]*escalationHost),
+	}
+}
+
+func (e *defenderEscalation) getDeescalationLimit(now time.Time) time.Time {
+	return now.Add(-time.Duration(e.config.DeescalationTime) * time.Minute)
+}
+
+// getStage returns the stage for the given score and ban time
+func (e *defenderEscalation) getStage(host *escalationHost, score int, banTime time.Time, now time.Time) DefenderStage {
+	if banTime.After(now) {
+		if host != nil && host.longBanUntil.After(now) {
+			return DefenderStageLongBan
+		}
+		return DefenderStageTempBan
+	}
+	if score >= e.config.ThrottleThreshold {
+		return DefenderStageThrottle
+	}
+	if score > 0 {
+		return DefenderStageObserve
+	}
+	return DefenderStageNone
+}
+
+func (e *defenderEscalation) getOrCreateHost(ip string, now time.Time) *escalationHost {
+	host, ok := e.hosts[ip]
+	if !ok {
+		host = &escalationHost{
+			stage:      DefenderStageNone,
+			lastUpdate: now,
+		}
+		e.hosts[ip] = host
+		e.cleanup(now)
+	}
+	host.lastUpdate = now
+	return host
+}
+
+// updateScore updates the stage for the given IP after a new event
+func (e *defenderEscalation) updateScore(ip string, score int) {
+	now := time.Now()
+
+	e.Lock()
+	defer e.Unlock()
+
+	host := e.getOrCreateHost(ip, now)
+	if host.setStage(e.getStage(host, score, time.Time{}, now), now) {
+		logger.Debug(logSender, "", "defender host %q moved to stage %q, score: %d", ip, host.stage, score)
+	}
+}
+
+// addBan records a new ban for the given IP and returns the ban duration
+func (e *defenderEscalation) addBan(ip string) time.Duration {
+	now := time.Now()
+
+	e.Lock()
+	defer e.Unlock()
+
+	host := e.getOrCreateHost(ip, now)
+	host.removeExpiredBans(e.getDeescalationLimit(now))
+	host.bans = append(host.bans, now)
+
+	stage := DefenderStageTempBan
+	banTime := time.Duration(e.defenderConfig.BanTime) * time.Minute
+	if len(host.bans) >= e.config.LongBanThreshold {
+		stage = DefenderStageLongBan
+		banTime = time.Duration(e.config.LongBanTime) * time.Minute
+		host.longBanUntil = now.Add(banTime)
+	} else {
+		host.longBanUntil = time.Time{}
+	}
+	host.setStage(stage, now)
+	logger.Info(logSender, "", "defender host %q moved to stage %q, bans: %d, ban time: %s", ip, stage,
+		len(host.bans), banTime)
+	return banTime
+}
+
+func (e *defenderEscalation) getThrottleDelay(ip string) time.Duration {
+	e.Lock()
+	defer e.Unlock()
+
+	host, ok := e.hosts[ip]
+	if !ok || host.stage != DefenderStageThrottle {
+		return 0
+	}
+	return time.Duration(e.config.ThrottleDelay) * time.Millisecond
+}
+
+func (e *defenderEscalation) removeHost(ip string) {
+	e.Lock()
+	defer e.Unlock()
+
+	delete(e.hosts, ip)
+}
+
+// getStatus returns the status for the given IP. The current stage is
+// recomputed, so expired bans and decayed scores are reflected in the history
+func (e *defenderEscalation) getStatus(ip string, score int, banTime time.Time) DefenderHostStatus {
+	now := time.Now()
+
+	e.Lock()
+	defer e.Unlock()
+
+	status := DefenderHostStatus{
+		IP:      ip,
+		Score:   score,
+		BanTime: banTime,
+	}
+	host, ok := e.hosts[ip]
+	if !ok {
+		status.Stage = e.getStage(nil, score, banTime, now)
+		return status
+	}
+	host.removeExpiredBans(e.getDeescalationLimit(now))
+	host.setStage(e.getStage(host, score, banTime, now), now)
+	status.Stage = host.stage
+	status.Bans = len(host.bans)
+	status.History = make([]DefenderStageChange, len(host.history))
+	copy(status.History, host.history)
+	return status
+}
+
+// cleanup removes the de-escalated hosts if we have more than the
+// configured hard limit entries. The caller must hold the lock
+func (e *defenderEscalation) cleanup(now time.Time) {
+	if len(e.hosts) <= e.defenderConfig.EntriesHardLimit {
+		return
+	}
+	observationLimit := now.Add(-time.Duration(e.defenderConfig.ObservationTime) * time.Minute)
+	deescalationLimit := e.getDeescalationLimit(now)
+	kvList := make(kvList, 0, len(e.hosts))
+	for ip, host := range e.hosts {
+		host.removeExpiredBans(deescalationLimit)
+		if len(host.bans) == 0 && host.lastUpdate.Before(observationLimit) {
+			delete(e.hosts, ip)
+			continue
+		}
+		kvList = append(kvList, kv{
+			Key:   ip,
+			Value: host.lastUpdate.UnixNano(),
+		})
+	}
+	numToRemove := len(e.hosts) - e.defenderConfig.EntriesSoftLimit
+	if numToRemove <= 0 {
+		return
+	}
+	sort.Sort(kvList)
+	for idx, kv := range kvList {
+		if idx >= numToRemove {
+			break
+		}
+		delete(e.hosts, kv.Key)
+	}
+}
@@ -0,0 +1,341 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/httpclient"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	defaultBlocklistsUpdateInterval = 60
+	defenderListsPageSize           = 500
+	blocklistMaxSize                = 20 * 1024 * 1024
+)
+
+var (
+	// CrowdSec client, nil if the CrowdSec integration is disabled
+	crowdSec *crowdSecClient
+)
+
+// DefenderBlocklist defines a list of IP addresses/networks to import in the defender lists.
+// The list is a text file with an IP address or a network in CIDR format per line.
+// Empty lines and the lines starting with "#" or ";" are ignored, any text after the
+// address is ignored too
+type DefenderBlocklist struct {
+	// Unique name for the list, the imported entries have a description
+	// containing the list name
+	Name string `json:"name" mapstructure:"name"`
+	// URL to download the list from
+	URL string `json:"url" mapstructure:"url"`
+	// 1 means allow list, 2 means deny list
+	Mode int `json:"mode" mapstructure:"mode"`
+	// Protocols the imported entries apply to, 0 means all the supported protocols.
+	// 1 SSH, 2 FTP, 4 WebDAV, 8 HTTP, they can be combined
+	Protocols int `json:"protocols" mapstructure:"protocols"`
+}
+
+func (b *DefenderBlocklist) getSource() *defenderListSource {
+	return &defenderListSource{
+		descriptionPrefix: fmt.Sprintf("Blocklist %q", b.Name),
+		mode:              b.Mode,
+		protocols:         b.Protocols,
+	}
+}
+
+// DefenderBlocklistsConfig defines the blocklists to import in the defender lists
+type DefenderBlocklistsConfig struct {
+	// Interval, in minutes, to update the blocklists. 0 means the default (60 minutes)
+	UpdateInterval int `json:"update_interval" mapstructure:"update_interval"`
+	// Blocklists to import
+	Lists []DefenderBlocklist `json:"lists" mapstructure:"lists"`
+}
+
+func (c *DefenderBlocklistsConfig) getUpdateInterval() time.Duration {
+	if c.UpdateInterval <= 0 {
+		return defaultBlocklistsUpdateInterval * time.Minute
+	}
+	return time.Duration(c.UpdateInterval) * time.Minute
+}
+
+func (c *DefenderBlocklistsConfig) validate() error {
+	if c.UpdateInterval < 0 {
+		return fmt.Errorf("blocklists: invalid update interval %d", c.UpdateInterval)
+	}
+	names := make(map[string]bool)
+	for idx := range c.Lists {
+		list := &c.Lists[idx]
+		if list.Name == "" {
+			return errors.New("blocklists: name is mandatory")
+		}
+		if names[list.Name] {
+			return fmt.Errorf("blocklists: duplicate name %q", list.Name)
+		}
+		names[list.Name] = true
+		if !strings.HasPrefix(list.URL, "http://") && !strings.HasPrefix(list.URL, "https://") {
+			return fmt.Errorf("blocklists: invalid URL %q for list %q", list.URL, list.Name)
+		}
+		if list.Mode != dataprovider.ListModeAllow && list.Mode != dataprovider.ListModeDeny {
+			return fmt.Errorf("blocklists: invalid mode %d for list %q", list.Mode, list.Name)
+		}
+		if list.Protocols < 0 {
+			return fmt.Errorf("blocklists: invalid protocols %d for list %q", list.Protocols, list.Name)
+		}
+	}
+	return nil
+}
+
+// defenderListSource identifies the defender list entries imported from an external source
+type defenderListSource struct {
+	// the imported entries have a description starting with this prefix
+	descriptionPrefix string
+	mode              int
+	protocols         int
+}
+
+// getEntries returns the defender list entries imported from this source
+func (s *defenderListSource) getEntries() (map[string]dataprovider.IPListEntry, error) {
+	result := make(map[string]dataprovider.IPListEntry)
+	from := ""
+	for {
+		entries, err := dataprovider.GetIPListEntries(dataprovider.IPListTypeDefender, "", from, dataprovider.OrderASC,
+			defenderListsPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Description, s.descriptionPrefix) {
+				result[entry.IPOrNet] = entry
+			}
+		}
+		if len(entries) < defenderListsPageSize {
+			return result, nil
+		}
+		from = entries[len(entries)-1].IPOrNet
+	}
+}
+
+// addEntry adds the specified network to the defender lists.
+// Existing entries, for example added by an admin, are not modified
+func (s *defenderListSource) addEntry(network, description string) error {
+	_, err := dataprovider.IPListEntryExists(network, dataprovider.IPListTypeDefender)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, util.ErrNotFound) {
+		return err
+	}
+	entry := &dataprovider.IPListEntry{
+		IPOrNet:     network,
+		Description: description,
+		Type:        dataprovider.IPListTypeDefender,
+		Mode:        s.mode,
+		Protocols:   s.protocols,
+	}
+	return dataprovider.AddIPListEntry(entry, dataprovider.ActionExecutorSystem, "", "")
+}
+
+// removeEntry removes the specified network from the defender lists,
+// if it was imported from this source
+func (s *defenderListSource) removeEntry(network string) error {
+	entry, err := dataprovider.IPListEntryExists(network, dataprovider.IPListTypeDefender)
+	if err != nil {
+		if errors.Is(err, util.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	if !strings.HasPrefix(entry.Description, s.descriptionPrefix) {
+		return nil
+	}
+	return dataprovider.DeleteIPListEntry(network, dataprovider.IPListTypeDefender, dataprovider.ActionExecutorSystem, "", "")
+}
+
+// sync makes the entries imported from this source match the specified networks.
+// The networks map values are the entries descriptions
+func (s *defenderListSource) sync(networks map[string]string) (int, int, error) {
+	existing, err := s.getEntries()
+	if err != nil {
+		return 0, 0, err
+	}
+	var added, removed int
+	for network := range existing {
+		if _, ok := networks[network]; ok {
+			continue
+		}
+		if err := s.removeEntry(network); err != nil {
+			return added, removed, err
+		}
+		removed++
+	}
+	for network, description := range networks {
+		if _, ok := existing[network]; ok {
+			continue
+		}
+		if err := s.addEntry(network, description); err != nil {
+			return added, removed, err
+		}
+		added++
+	}
+	return added, removed, nil
+}
+
+// getDefenderListNetwork returns the specified IP address or network
+// in the format used for the defender list entries
+func getDefenderListNetwork(ipOrNet string) (string, error) {
+	if !strings.Contains(ipOrNet, "/") {
+		addr, err := netip.ParseAddr(ipOrNet)
+		if err != nil {
+			return "", err
+		}
+		addr = addr.Unmap().WithZone("")
+		return netip.PrefixFrom(addr, addr.BitLen()).String(), nil
+	}
+	prefix, err := netip.ParsePrefix(ipOrNet)
+	if err != nil {
+		return "", err
+	}
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked().String(), nil
+}
+
+// parseBlocklist returns the networks included in the specified blocklist
+func parseBlocklist(r io.Reader, description string) (map[string]string, error) {
+	networks := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ' ' || r == '\t' || r == ';' || r == '#' || r == ','
+		})
+		network, err := getDefenderListNetwork(fields[0])
+		if err != nil {
+			logger.Debug(logSender, "", "ignoring invalid blocklist entry %q: %v", fields[0], err)
+			continue
+		}
+		networks[network] = description
+	}
+	return networks, scanner.Err()
+}
+
+func downloadBlocklist(list *DefenderBlocklist) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, list.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := httpclient.GetHTTPClient()
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return parseBlocklist(io.LimitReader(resp.Body, blocklistMaxSize), fmt.Sprintf("Blocklist %q", list.Name))
+}
+
+type blocklistsUpdater struct {
+	config    *DefenderBlocklistsConfig
+	isRunning atomic.Bool
+}
+
+// update downloads the configured blocklists and updates the defender lists
+func (u *blocklistsUpdater) update() {
+	if !u.isRunning.CompareAndSwap(false, true) {
+		logger.Debug(logSender, "", "blocklists update already in progress")
+		return
+	}
+	defer u.isRunning.Store(false)
+
+	for idx := range u.config.Lists {
+		list := &u.config.Lists[idx]
+		startTime := time.Now()
+		networks, err := downloadBlocklist(list)
+		if err != nil {
+			logger.Warn(logSender, "", "unable to download blocklist %q: %v", list.Name, err)
+			continue
+		}
+		added, removed, err := list.getSource().sync(networks)
+		if err != nil {
+			logger.Warn(logSender, "", "unable to update blocklist %q: %v", list.Name, err)
+			continue
+		}
+		logger.Info(logSender, "", "blocklist %q updated, entries: %d, added: %d, removed: %d, elapsed: %s",
+			list.Name, len(networks), added, removed, time.Since(startTime))
+	}
+}
+
+// initializeDefenderIntegrations validates the defender integrations and schedules
+// the CrowdSec decisions pull and the blocklists update
+func initializeDefenderIntegrations(c *DefenderConfig) error {
+	crowdSec = nil
+	if !c.Enabled {
+		return nil
+	}
+	if err := c.CrowdSec.validate(); err != nil {
+		return err
+	}
+	if err := c.Blocklists.validate(); err != nil {
+		return err
+	}
+	if c.CrowdSec.isEnabled() {
+		crowdSec = newCrowdSecClient(&c.CrowdSec)
+		if c.CrowdSec.APIKey != "" {
+			spec := fmt.Sprintf("@every %s", c.CrowdSec.getPullInterval())
+			if _, err := eventScheduler.AddFunc(spec, crowdSec.pullDecisions); err != nil {
+				return fmt.Errorf("unable to schedule CrowdSec decisions pull: %w", err)
+			}
+			go crowdSec.pullDecisions()
+			logger.Info(logSender, "", "CrowdSec decisions pull scheduled, schedule %q", spec)
+		}
+		logger.Info(logSender, "", "CrowdSec integration enabled, URL %q, push alerts: %t",
+			c.CrowdSec.URL, c.CrowdSec.MachineID != "")
+	}
+	if len(c.Blocklists.Lists) > 0 {
+		updater := &blocklistsUpdater{config: &c.Blocklists}
+		spec := fmt.Sprintf("@every %s", c.Blocklists.getUpdateInterval())
+		if _, err := eventScheduler.AddFunc(spec, updater.update); err != nil {
+			return fmt.Errorf("unable to schedule blocklists update: %w", err)
+		}
+		go updater.update()
+		logger.Info(logSender, "", "blocklists update scheduled, lists: %d, schedule %q", len(c.Blocklists.Lists), spec)
+	}
+	return nil
+}
@@ -45,8 +45,9 @@ func newInMemoryDefender(config *DefenderConfig) (Defender, error) {
 	}
 	defender := &memoryDefender{
 		baseDefender: baseDefender{
-			config: config,
-			ipList: ipList,
+			config:     config,
+			ipList:     ipList,
+			escalation: newDefenderEscalation(config),
 		},
 		hosts:  make(map[string]hostScore),
 		banned: make(map[string]time.Time),
@@ -119,6 +120,12 @@ func (d *memoryDefender) GetHost(ip string) (dataprovider.DefenderEntry, error)
 	return dataprovider.DefenderEntry{}, util.NewRecordNotFoundError("host not found")
 }
 
+// GetHostStatus returns the escalation stage and history for the given IP
+func (d *memoryDefender) GetHostStatus(ip string) (DefenderHostStatus, error) {
+	host, err := d.GetHost(ip)
+	return d.getHostStatus(ip, host, err)
+}
+
 // IsBanned returns true if the specified IP is banned
 // and increase ban time if the IP is found.
 // This method must be called as soon as the client connects
@@ -153,6 +160,8 @@ func (d *memoryDefender) IsBanned(ip, protocol string) bool {
 
 // DeleteHost removes the specified IP from the defender lists
 func (d *memoryDefender) DeleteHost(ip string) bool {
+	d.removeEscalation(ip)
+
 	d.Lock()
 	defer d.Unlock()
 
@@ -187,7 +196,7 @@ func (d *memoryDefender) AddEvent(ip, protocol string, event HostEvent) {
 		delete(d.banned, ip)
 	}
 
-	score := d.baseDefender.getScore(event)
+	score := d.baseDefender.getScore(ip, event)
 
 	ev := hostEvent{
 		dateTime: time.Now(),
@@ -209,27 +218,34 @@ func (d *memoryDefender) AddEvent(ip, protocol string, event HostEvent) {
 
 		hs.Events = hs.Events[:idx]
 		if hs.TotalScore >= d.config.Threshold {
-			d.banned[ip] = time.Now().Add(time.Duration(d.config.BanTime) * time.Minute)
-			delete(d.hosts, ip)
-			d.cleanupBanned()
-			eventManager.handleIPBlockedEvent(EventParams{
-				Event:     ipBlockedEventName,
-				IP:        ip,
-				Timestamp: time.Now().UnixNano(),
-				Status:    1,
-			})
+			d.banHost(ip, protocol)
 		} else {
 			d.hosts[ip] = hs
+			d.updateEscalation(ip, hs.TotalScore)
 		}
 	} else {
+		if ev.score >= d.config.Threshold {
+			d.banHost(ip, protocol)
+			return
+		}
 		d.hosts[ip] = hostScore{
 			TotalScore: ev.score,
 			Events:     []hostEvent{ev},
 		}
+		d.updateEscalation(ip, ev.score)
 		d.cleanupHosts()
 	}
 }
 
+// banHost bans the given IP, the lock must be held by the caller
+func (d *memoryDefender) banHost(ip, protocol string) {
+	banTime := time.Now().Add(d.getBanDuration(ip))
+	d.banned[ip] = banTime
+	delete(d.hosts, ip)
+	d.cleanupBanned()
+	d.hostBanned(ip, protocol, banTime)
+}
+
 func (d *memoryDefender) countBanned() int {
 	d.RLock()
 	defer d.RUnlock()
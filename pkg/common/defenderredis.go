@@ -0,0 +1,348 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	redisDefenderTimeout          = 5 * time.Second
+	defaultRedisDefenderKeyPrefix = "sftpgo:defender:"
+	redisDefenderScoreKey         = "score:"
+	redisDefenderBanKey           = "ban:"
+)
+
+var (
+	// increments the host score and sets the observation time as TTL for new keys.
+	// KEYS[1] score key, ARGV[1] score to add, ARGV[2] observation time in milliseconds
+	redisDefenderAddScore = redis.NewScript(`
+local score = redis.call('INCRBY', KEYS[1], ARGV[1])
+if redis.call('PTTL', KEYS[1]) < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return score
+`)
+	// increments the ban time for an already banned host, returns 1 if the host is banned.
+	// KEYS[1] ban key, ARGV[1] increment in milliseconds, ARGV[2] current time in milliseconds
+	redisDefenderIncreaseBan = redis.NewScript(`
+local ban = redis.call('GET', KEYS[1])
+if not ban then
+	return 0
+end
+ban = tonumber(ban) + tonumber(ARGV[1])
+local ttl = ban - tonumber(ARGV[2])
+if ttl > 0 then
+	redis.call('SET', KEYS[1], string.format('%d', ban), 'PX', string.format('%d', ttl))
+end
+return 1
+`)
+)
+
+// DefenderRedisConfig defines the configuration for the "redis" defender driver
+type DefenderRedisConfig struct {
+	// Redis server address as host:port
+	Address string `json:"address" mapstructure:"address"`
+	// Optional username and password for the Redis ACL
+	Username string `json:"username" mapstructure:"username"`
+	Password string `json:"password" mapstructure:"password"`
+	// Redis database to select
+	DB int `json:"db" mapstructure:"db"`
+	// Prefix for the keys, this way a Redis database can be shared with other applications.
+	// Empty means the default prefix "sftpgo:defender:"
+	KeyPrefix string `json:"key_prefix" mapstructure:"key_prefix"`
+	// Set to true to connect to Redis using TLS
+	UseTLS bool `json:"use_tls" mapstructure:"use_tls"`
+}
+
+func (c *DefenderRedisConfig) validate() error {
+	if c.Address == "" {
+		return errors.New("redis defender: address is mandatory")
+	}
+	if c.DB < 0 {
+		return fmt.Errorf("redis defender: invalid db %d", c.DB)
+	}
+	if c.KeyPrefix == "" {
+		c.KeyPrefix = defaultRedisDefenderKeyPrefix
+	}
+	return nil
+}
+
+func (c *DefenderRedisConfig) getOptions() *redis.Options {
+	opts := &redis.Options{
+		Addr:         c.Address,
+		Username:     c.Username,
+		Password:     c.Password,
+		DB:           c.DB,
+		DialTimeout:  redisDefenderTimeout,
+		ReadTimeout:  redisDefenderTimeout,
+		WriteTimeout: redisDefenderTimeout,
+	}
+	if c.UseTLS {
+		opts.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+	return opts
+}
+
+// redisDefender stores the host scores and the banned hosts in Redis.
+// Scores are atomically incremented and expire after the observation time,
+// bans expire automatically after the ban time
+type redisDefender struct {
+	baseDefender
+	client *redis.Client
+}
+
+func newRedisDefender(config *DefenderConfig) (Defender, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Redis.validate(); err != nil {
+		return nil, err
+	}
+	ipList, err := dataprovider.NewIPList(dataprovider.IPListTypeDefender)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(config.Redis.getOptions())
+	ctx, cancel := context.WithTimeout(context.Background(), redisDefenderTimeout)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("unable to connect to redis %q: %w", config.Redis.Address, err)
+	}
+	defender := &redisDefender{
+		baseDefender: baseDefender{
+			config:     config,
+			ipList:     ipList,
+			escalation: newDefenderEscalation(config),
+		},
+		client: client,
+	}
+
+	return defender, nil
+}
+
+func (d *redisDefender) getScoreKey(ip string) string {
+	return d.config.Redis.KeyPrefix + redisDefenderScoreKey + ip
+}
+
+func (d *redisDefender) getBanKey(ip string) string {
+	return d.config.Redis.KeyPrefix + redisDefenderBanKey + ip
+}
+
+// GetHosts returns hosts that are banned or for which some violations have been detected
+func (d *redisDefender) GetHosts() ([]dataprovider.DefenderEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisDefenderTimeout)
+	defer cancel()
+
+	var result []dataprovider.DefenderEntry
+	seen := make(map[string]bool)
+
+	for _, keyType := range []string{redisDefenderBanKey, redisDefenderScoreKey} {
+		prefix := d.config.Redis.KeyPrefix + keyType
+		iter := d.client.Scan(ctx, 0, prefix+"*", 100).Iterator()
+		for iter.Next(ctx) {
+			if len(result) >= d.config.EntriesHardLimit {
+				return result, nil
+			}
+			ip := strings.TrimPrefix(iter.Val(), prefix)
+			if seen[ip] {
+				continue
+			}
+			seen[ip] = true
+			host, err := d.getHost(ctx, ip)
+			if err != nil {
+				if errors.Is(err, util.ErrNotFound) {
+					continue
+				}
+				return result, err
+			}
+			result = append(result, host)
+		}
+		if err := iter.Err(); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// GetHost returns a defender host by ip, if any
+func (d *redisDefender) GetHost(ip string) (dataprovider.DefenderEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisDefenderTimeout)
+	defer cancel()
+
+	return d.getHost(ctx, ip)
+}
+
+func (d *redisDefender) getHost(ctx context.Context, ip string) (dataprovider.DefenderEntry, error) {
+	values, err := d.client.MGet(ctx, d.getBanKey(ip), d.getScoreKey(ip)).Result()
+	if err != nil {
+		return dataprovider.DefenderEntry{}, err
+	}
+	if val, ok := values[0].(string); ok {
+		banTime, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return dataprovider.DefenderEntry{}, fmt.Errorf("invalid ban time for host %q: %w", ip, err)
+		}
+		if banTime > util.GetTimeAsMsSinceEpoch(time.Now()) {
+			return dataprovider.DefenderEntry{
+				IP:      ip,
+				BanTime: util.GetTimeFromMsecSinceEpoch(banTime),
+			}, nil
+		}
+	}
+	if val, ok := values[1].(string); ok {
+		score, err := strconv.Atoi(val)
+		if err != nil {
+			return dataprovider.DefenderEntry{}, fmt.Errorf("invalid score for host %q: %w", ip, err)
+		}
+		if score > 0 {
+			return dataprovider.DefenderEntry{
+				IP:    ip,
+				Score: score,
+			}, nil
+		}
+	}
+
+	return dataprovider.DefenderEntry{}, util.NewRecordNotFoundError("host not found")
+}
+
+// GetHostStatus returns the escalation stage and history for the given IP
+func (d *redisDefender) GetHostStatus(ip string) (DefenderHostStatus, error) {
+	host, err := d.GetHost(ip)
+	return d.getHostStatus(ip, host, err)
+}
+
+// IsBanned returns true if the specified IP is banned
+// and increase ban time if the IP is found.
+// This method must be called as soon as the client connects
+func (d *redisDefender) IsBanned(ip, protocol string) bool {
+	if d.baseDefender.isBanned(ip, protocol) {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisDefenderTimeout)
+	defer cancel()
+
+	increment := d.config.BanTime * d.config.BanTimeIncrement / 100
+	if increment == 0 {
+		increment++
+	}
+	incrementMs := (time.Duration(increment) * time.Minute).Milliseconds()
+	res, err := redisDefenderIncreaseBan.Run(ctx, d.client, []string{d.getBanKey(ip)}, incrementMs,
+		util.GetTimeAsMsSinceEpoch(time.Now())).Int()
+	if err != nil {
+		// we allow this host
+		logger.Warn(logSender, "", "unable to check if host %q is banned: %v", ip, err)
+		return false
+	}
+	return res == 1
+}
+
+// DeleteHost removes the specified IP from the defender lists
+func (d *redisDefender) DeleteHost(ip string) bool {
+	d.removeEscalation(ip)
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisDefenderTimeout)
+	defer cancel()
+
+	deleted, err := d.client.Del(ctx, d.getBanKey(ip), d.getScoreKey(ip)).Result()
+	if err != nil {
+		logger.Warn(logSender, "", "unable to delete defender host %q: %v", ip, err)
+		return false
+	}
+	return deleted > 0
+}
+
+// AddEvent adds an event for the given IP.
+// This method must be called for clients not yet banned
+func (d *redisDefender) AddEvent(ip, protocol string, event HostEvent) {
+	if d.IsSafe(ip, protocol) {
+		return
+	}
+	score := d.baseDefender.getScore(ip, event)
+	if score <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisDefenderTimeout)
+	defer cancel()
+
+	// ignore events for already banned hosts
+	banned, err := d.client.Exists(ctx, d.getBanKey(ip)).Result()
+	if err != nil || banned > 0 {
+		return
+	}
+	observationMs := (time.Duration(d.config.ObservationTime) * time.Minute).Milliseconds()
+	totalScore, err := redisDefenderAddScore.Run(ctx, d.client, []string{d.getScoreKey(ip)}, score, observationMs).Int()
+	if err != nil {
+		logger.Warn(logSender, "", "unable to add defender event for host %q: %v", ip, err)
+		return
+	}
+	if totalScore < d.config.Threshold {
+		d.updateEscalation(ip, totalScore)
+		return
+	}
+	banDuration := d.getBanDuration(ip)
+	banTime := time.Now().Add(banDuration)
+	_, err = d.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, d.getBanKey(ip), util.GetTimeAsMsSinceEpoch(banTime), banDuration)
+		pipe.Del(ctx, d.getScoreKey(ip))
+		return nil
+	})
+	if err != nil {
+		logger.Warn(logSender, "", "unable to ban host %q: %v", ip, err)
+		return
+	}
+	d.hostBanned(ip, protocol, banTime)
+}
+
+// GetBanTime returns the ban time for the given IP or nil if the IP is not banned
+func (d *redisDefender) GetBanTime(ip string) (*time.Time, error) {
+	host, err := d.GetHost(ip)
+	if err != nil {
+		return nil, err
+	}
+	if host.BanTime.IsZero() {
+		return nil, nil
+	}
+	return &host.BanTime, nil
+}
+
+// GetScore returns the score for the given IP
+func (d *redisDefender) GetScore(ip string) (int, error) {
+	host, err := d.GetHost(ip)
+	if err != nil {
+		return 0, err
+	}
+	return host.Score, nil
+}
@@ -0,0 +1,207 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getRedisDefenderTestConfig(address string) *DefenderConfig {
+	return &DefenderConfig{
+		Enabled:            true,
+		Driver:             DefenderDriverRedis,
+		BanTime:            10,
+		BanTimeIncrement:   2,
+		Threshold:          5,
+		ScoreInvalid:       2,
+		ScoreValid:         1,
+		ScoreNoAuth:        2,
+		ScoreLimitExceeded: 3,
+		ObservationTime:    15,
+		EntriesSoftLimit:   1,
+		EntriesHardLimit:   3,
+		Redis: DefenderRedisConfig{
+			Address: address,
+		},
+	}
+}
+
+func TestRedisDefenderConfig(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	config := getRedisDefenderTestConfig("")
+	_, err := newRedisDefender(config)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "address is mandatory")
+	}
+	config.Redis.Address = mr.Addr()
+	config.Redis.DB = -1
+	_, err = newRedisDefender(config)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "invalid db")
+	}
+	config.Redis.DB = 0
+	config.Threshold = 0
+	_, err = newRedisDefender(config)
+	assert.Error(t, err)
+	config.Threshold = 5
+	config.Redis.Address = "127.0.0.1:1"
+	_, err = newRedisDefender(config)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unable to connect to redis")
+	}
+	config.Redis.Address = mr.Addr()
+	_, err = newRedisDefender(config)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultRedisDefenderKeyPrefix, config.Redis.KeyPrefix)
+}
+
+func TestBasicRedisDefender(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	config := getRedisDefenderTestConfig(mr.Addr())
+	config.Redis.KeyPrefix = "test:"
+	d, err := newRedisDefender(config)
+	require.NoError(t, err)
+	defender := d.(*redisDefender)
+
+	testIP := "123.45.67.89"
+	assert.False(t, defender.IsBanned(testIP, ProtocolSSH))
+	hosts, err := defender.GetHosts()
+	assert.NoError(t, err)
+	assert.Len(t, hosts, 0)
+	_, err = defender.GetHost(testIP)
+	assert.Error(t, err)
+	_, err = defender.GetScore(testIP)
+	assert.Error(t, err)
+	// events with a zero score are ignored
+	config.ScoreNoAuth = 0
+	defender.AddEvent(testIP, ProtocolSSH, HostEventNoLoginTried)
+	assert.False(t, mr.Exists("test:score:"+testIP))
+	config.ScoreNoAuth = 2
+
+	defender.AddEvent(testIP, ProtocolSSH, HostEventLoginFailed)
+	score, err := defender.GetScore(testIP)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, score)
+	assert.True(t, mr.Exists("test:score:"+testIP))
+	assert.Equal(t, 15*time.Minute, mr.TTL("test:score:"+testIP))
+	banTime, err := defender.GetBanTime(testIP)
+	assert.NoError(t, err)
+	assert.Nil(t, banTime)
+	// the TTL is not refreshed by new events
+	mr.FastForward(time.Minute)
+	defender.AddEvent(testIP, ProtocolSSH, HostEventLoginFailed)
+	assert.Equal(t, 14*time.Minute, mr.TTL("test:score:"+testIP))
+	score, err = defender.GetScore(testIP)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, score)
+	hosts, err = defender.GetHosts()
+	assert.NoError(t, err)
+	if assert.Len(t, hosts, 1) {
+		assert.Equal(t, testIP, hosts[0].IP)
+		assert.Equal(t, 2, hosts[0].Score)
+		assert.True(t, hosts[0].BanTime.IsZero())
+	}
+	status, err := defender.GetHostStatus(testIP)
+	assert.NoError(t, err)
+	assert.Equal(t, DefenderStageObserve, status.Stage)
+	assert.Equal(t, 2, status.Score)
+	// now the host will be banned
+	defender.AddEvent(testIP, ProtocolSSH, HostEventLimitExceeded)
+	assert.False(t, mr.Exists("test:score:"+testIP))
+	assert.True(t, mr.Exists("test:ban:"+testIP))
+	assert.Equal(t, 10*time.Minute, mr.TTL("test:ban:"+testIP))
+	score, err = defender.GetScore(testIP)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, score)
+	banTime, err = defender.GetBanTime(testIP)
+	assert.NoError(t, err)
+	if assert.NotNil(t, banTime) {
+		assert.True(t, banTime.After(time.Now()))
+	}
+	// events for banned hosts are ignored
+	defender.AddEvent(testIP, ProtocolSSH, HostEventLoginFailed)
+	assert.False(t, mr.Exists("test:score:"+testIP))
+	// ban time should increase
+	assert.True(t, defender.IsBanned(testIP, ProtocolSSH))
+	newBanTime, err := defender.GetBanTime(testIP)
+	assert.NoError(t, err)
+	assert.True(t, newBanTime.After(*banTime))
+	assert.Greater(t, mr.TTL("test:ban:"+testIP), 10*time.Minute)
+	status, err = defender.GetHostStatus(testIP)
+	assert.NoError(t, err)
+	assert.Equal(t, DefenderStageTempBan, status.Stage)
+
+	assert.True(t, defender.DeleteHost(testIP))
+	assert.False(t, defender.DeleteHost(testIP))
+	assert.False(t, defender.IsBanned(testIP, ProtocolSSH))
+	// the ban expires
+	for i := 0; i < 3; i++ {
+		defender.AddEvent(testIP, ProtocolSSH, HostEventUserNotFound)
+	}
+	assert.True(t, defender.IsBanned(testIP, ProtocolSSH))
+	mr.FastForward(time.Hour)
+	assert.False(t, defender.IsBanned(testIP, ProtocolSSH))
+	_, err = defender.GetHost(testIP)
+	assert.Error(t, err)
+	// the number of returned hosts is limited
+	for _, ip := range []string{"123.45.67.90", "123.45.67.91", "123.45.67.92", "123.45.67.93"} {
+		defender.AddEvent(ip, ProtocolSSH, HostEventLoginFailed)
+	}
+	hosts, err = defender.GetHosts()
+	assert.NoError(t, err)
+	assert.Len(t, hosts, config.EntriesHardLimit)
+	// invalid values
+	mr.Set("test:score:"+testIP, "invalid")
+	_, err = defender.GetHost(testIP)
+	assert.Error(t, err)
+	mr.Set("test:ban:"+testIP, "invalid")
+	_, err = defender.GetHost(testIP)
+	assert.Error(t, err)
+	// Redis is not available
+	mr.Close()
+	assert.False(t, defender.IsBanned(testIP, ProtocolSSH))
+	defender.AddEvent(testIP, ProtocolSSH, HostEventLoginFailed)
+	_, err = defender.GetHosts()
+	assert.Error(t, err)
+	assert.False(t, defender.DeleteHost(testIP))
+}
+
+func TestSharedRedisDefender(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	d1, err := newRedisDefender(getRedisDefenderTestConfig(mr.Addr()))
+	require.NoError(t, err)
+	d2, err := newRedisDefender(getRedisDefenderTestConfig(mr.Addr()))
+	require.NoError(t, err)
+
+	testIP := "123.45.68.1"
+	d1.AddEvent(testIP, ProtocolFTP, HostEventUserNotFound)
+	d2.AddEvent(testIP, ProtocolSSH, HostEventUserNotFound)
+	score, err := d1.GetScore(testIP)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, score)
+	d1.AddEvent(testIP, ProtocolFTP, HostEventLoginFailed)
+	assert.True(t, d2.IsBanned(testIP, ProtocolSSH))
+	assert.True(t, d1.IsBanned(testIP, ProtocolFTP))
+	assert.True(t, d2.DeleteHost(testIP))
+	assert.False(t, d1.IsBanned(testIP, ProtocolFTP))
+}
@@ -0,0 +1,165 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eikenb/pipeat"
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+// pipeUploadFs uploads the files in background, as the object storage backends do
+type pipeUploadFs struct {
+	vfs.Fs
+}
+
+func (fs *pipeUploadFs) Create(name string, flag, checks int) (vfs.File, *vfs.PipeWriter, func(), error) {
+	r, w, err := pipeat.Pipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	p := vfs.NewPipeWriter(w)
+	go func() {
+		f, _, _, err := fs.Fs.Create(name, flag, checks)
+		if err == nil {
+			_, err = io.Copy(f, r)
+			f.Close()
+		}
+		r.CloseWithError(err) //nolint:errcheck
+		p.Done(err)
+	}()
+	return nil, p, nil, nil
+}
+
+func TestDirListCacheConfig(t *testing.T) {
+	c := vfs.DirListCacheConfig{}
+	assert.NoError(t, c.Validate())
+	assert.False(t, c.IsEnabled())
+	c.TTL = -1
+	assert.Error(t, c.Validate())
+	c.TTL = 10
+	assert.True(t, c.IsEnabled())
+	assert.Error(t, c.Validate())
+	c.MaxDirs = 10
+	c.MaxDirEntries = -1
+	assert.Error(t, c.Validate())
+	c.MaxDirEntries = 0
+	assert.NoError(t, c.Validate())
+}
+
+func TestDirListCacheFs(t *testing.T) {
+	rootDir := filepath.Join(os.TempDir(), "dir_list_cache_test")
+	require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "dir", "subdir"), os.ModePerm))
+	defer os.RemoveAll(rootDir)
+
+	osFs := vfs.NewOsFs("", rootDir, "", &sdk.OSFsConfig{})
+	// the cache is disabled
+	assert.Equal(t, osFs, vfs.NewDirListCacheFs(osFs, "ns"))
+
+	config := vfs.DirListCacheConfig{
+		TTL:     60,
+		MaxDirs: 10,
+	}
+	require.NoError(t, config.Validate())
+	vfs.SetDirListCacheConfig(config)
+	defer vfs.SetDirListCacheConfig(vfs.DirListCacheConfig{})
+
+	fs := vfs.NewDirListCacheFs(osFs, "ns")
+	assert.NotEqual(t, osFs, fs)
+	assert.Equal(t, osFs.Name(), fs.Name())
+	_, ok := fs.(vfs.FsFileCopier)
+	assert.False(t, ok)
+
+	countEntries := func(fs vfs.Fs, name string) int {
+		files, err := fs.ReadDir(filepath.Join(rootDir, name))
+		require.NoError(t, err)
+		return len(files)
+	}
+	count := func(name string) int {
+		return countEntries(fs, name)
+	}
+
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "file1"), []byte("data"), 0600))
+	assert.Equal(t, 2, count(""))
+	assert.Equal(t, 1, count("dir"))
+	// changes made outside SFTPGo are not visible until the TTL expires
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "file2"), []byte("data"), 0600))
+	assert.Equal(t, 2, count(""))
+	// a namespace does not share the cached listings with another one
+	otherFs := vfs.NewDirListCacheFs(osFs, "other ns")
+	assert.Equal(t, 3, countEntries(otherFs, ""))
+	// write operations invalidate the listings of the parent directories
+	assert.NoError(t, fs.Mkdir(filepath.Join(rootDir, "dir", "subdir", "dir1")))
+	assert.Equal(t, 3, count(""))
+	assert.Equal(t, 1, count(filepath.Join("dir", "subdir")))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "file3"), []byte("data"), 0600))
+	assert.NoError(t, fs.Remove(filepath.Join(rootDir, "file1"), false))
+	assert.Equal(t, 3, count(""))
+	assert.NoError(t, fs.Chtimes(filepath.Join(rootDir, "file2"), time.Now(), time.Now(), false))
+	assert.Equal(t, 3, count(""))
+	// renaming a directory invalidates the listings of its subdirectories
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "dir", "subdir", "file"), []byte("data"), 0600))
+	assert.Equal(t, 1, count(filepath.Join("dir", "subdir")))
+	_, _, err := fs.Rename(filepath.Join(rootDir, "dir"), filepath.Join(rootDir, "dir_renamed"))
+	assert.NoError(t, err)
+	files, err := fs.ReadDir(filepath.Join(rootDir, "dir", "subdir"))
+	assert.Error(t, err)
+	assert.Empty(t, files)
+	assert.Equal(t, 2, count(filepath.Join("dir_renamed", "subdir")))
+	// uploads invalidate the listings after the upload
+	fs = vfs.NewDirListCacheFs(&pipeUploadFs{Fs: osFs}, "ns")
+	assert.Equal(t, 3, count(""))
+	_, w, _, err := fs.Create(filepath.Join(rootDir, "file4"), 0, 0)
+	require.NoError(t, err)
+	require.NotNil(t, w)
+	_, err = w.Write([]byte("data"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, 4, count(""))
+	// listings with too many entries are not cached
+	config.MaxDirEntries = 3
+	vfs.SetDirListCacheConfig(config)
+	fs = vfs.NewDirListCacheFs(osFs, "ns")
+	assert.Equal(t, 4, count(""))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "file5"), []byte("data"), 0600))
+	assert.Equal(t, 5, count(""))
+	// the least recently used listings are evicted
+	config.MaxDirEntries = 0
+	config.MaxDirs = 1
+	vfs.SetDirListCacheConfig(config)
+	fs = vfs.NewDirListCacheFs(osFs, "ns")
+	assert.Equal(t, 5, count(""))
+	assert.Equal(t, 1, count("dir_renamed"))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "file6"), []byte("data"), 0600))
+	assert.Equal(t, 6, count(""))
+	// the cached listings expire
+	config.TTL = 1
+	config.MaxDirs = 10
+	vfs.SetDirListCacheConfig(config)
+	fs = vfs.NewDirListCacheFs(osFs, "ns")
+	assert.Equal(t, 6, count(""))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "file7"), []byte("data"), 0600))
+	assert.Equal(t, 6, count(""))
+	assert.Eventually(t, func() bool { return count("") == 7 }, 3*time.Second, 100*time.Millisecond)
+}
@@ -0,0 +1,285 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// digestEvent defines an event stored, waiting to be notified, within a digest entry
+type digestEvent struct {
+	Event             string   `json:"event"`
+	Status            int      `json:"status"`
+	VirtualPath       string   `json:"virtual_path,omitempty"`
+	VirtualTargetPath string   `json:"virtual_target_path,omitempty"`
+	ObjectName        string   `json:"object_name,omitempty"`
+	ObjectType        string   `json:"object_type,omitempty"`
+	FileSize          int64    `json:"file_size,omitempty"`
+	Protocol          string   `json:"protocol,omitempty"`
+	IP                string   `json:"ip,omitempty"`
+	Role              string   `json:"role,omitempty"`
+	Email             string   `json:"email,omitempty"`
+	Timestamp         int64    `json:"timestamp"`
+	Errors            []string `json:"errors,omitempty"`
+}
+
+func (e *digestEvent) getStatusString() string {
+	if e.Status == 1 {
+		return "OK"
+	}
+	return "KO"
+}
+
+func (e *digestEvent) getAsString() string {
+	parts := []string{time.Unix(0, e.Timestamp).UTC().Format(time.RFC3339), e.Event}
+	if e.VirtualPath != "" {
+		parts = append(parts, e.VirtualPath)
+	}
+	if e.VirtualTargetPath != "" {
+		parts = append(parts, "->", e.VirtualTargetPath)
+	}
+	if e.ObjectType != "" {
+		parts = append(parts, e.ObjectType, fmt.Sprintf("%q", e.ObjectName))
+	}
+	if e.FileSize > 0 {
+		parts = append(parts, fmt.Sprintf("size: %d", e.FileSize))
+	}
+	if e.Protocol != "" {
+		parts = append(parts, fmt.Sprintf("protocol: %s", e.Protocol))
+	}
+	if e.IP != "" {
+		parts = append(parts, fmt.Sprintf("ip: %s", e.IP))
+	}
+	parts = append(parts, fmt.Sprintf("status: %s", e.getStatusString()))
+	if len(e.Errors) > 0 {
+		parts = append(parts, fmt.Sprintf("errors: %s", strings.Join(e.Errors, ", ")))
+	}
+	return strings.Join(parts, " ")
+}
+
+func newDigestEvent(params *EventParams) digestEvent {
+	return digestEvent{
+		Event:             params.Event,
+		Status:            params.Status,
+		VirtualPath:       params.VirtualPath,
+		VirtualTargetPath: params.VirtualTargetPath,
+		ObjectName:        params.ObjectName,
+		ObjectType:        params.ObjectType,
+		FileSize:          params.FileSize,
+		Protocol:          params.Protocol,
+		IP:                params.IP,
+		Role:              params.Role,
+		Email:             params.Email,
+		Timestamp:         params.Timestamp,
+		Errors:            params.errors,
+	}
+}
+
+// eventDigest defines the events aggregated within a digest notification
+type eventDigest struct {
+	Start  time.Time
+	End    time.Time
+	Events []digestEvent
+}
+
+func (d *eventDigest) getEventsAsString() string {
+	var sb strings.Builder
+	for idx := range d.Events {
+		if idx > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(d.Events[idx].getAsString())
+	}
+	return sb.String()
+}
+
+// getParams returns the parameters to use to execute the digest action.
+// The user related fields are taken from the most recent event
+func (d *eventDigest) getParams(name string) *EventParams {
+	last := d.Events[len(d.Events)-1]
+	params := &EventParams{
+		Name:       name,
+		Event:      last.Event,
+		Status:     1,
+		ObjectType: last.ObjectType,
+		Role:       last.Role,
+		Email:      last.Email,
+		Timestamp:  d.End.UnixNano(),
+		digest:     d,
+	}
+	for _, ev := range d.Events {
+		if ev.Status != 1 {
+			params.Status = 2
+			break
+		}
+	}
+	return params
+}
+
+func addEventToDigest(rule *dataprovider.EventRule, action *dataprovider.EventAction, params *EventParams) error {
+	data, err := json.Marshal(newDigestEvent(params))
+	if err != nil {
+		return err
+	}
+	_, end := dataprovider.GetDigestWindow(action.Options.Digest, time.Now())
+	return dataprovider.AddEventDigestEntry(&dataprovider.EventDigestEntry{
+		RuleName:   rule.Name,
+		ActionName: action.Name,
+		Name:       params.Name,
+		WindowEnd:  util.GetTimeAsMsSinceEpoch(end),
+		Data:       data,
+	})
+}
+
+// pendingDigest groups the entries for the same rule, action, name and window
+type pendingDigest struct {
+	ruleName   string
+	actionName string
+	name       string
+	windowEnd  int64
+	entries    []dataprovider.EventDigestEntry
+}
+
+func (d *pendingDigest) getIDs() []int64 {
+	ids := make([]int64, 0, len(d.entries))
+	for _, entry := range d.entries {
+		ids = append(ids, entry.ID)
+	}
+	return ids
+}
+
+func (d *pendingDigest) getDigest(action *dataprovider.EventAction) (*eventDigest, error) {
+	end := util.GetTimeFromMsecSinceEpoch(d.windowEnd)
+	start, _ := dataprovider.GetDigestWindow(action.Options.Digest, end.Add(-time.Millisecond))
+	digest := &eventDigest{
+		Start:  start,
+		End:    end,
+		Events: make([]digestEvent, 0, len(d.entries)),
+	}
+	for _, entry := range d.entries {
+		var ev digestEvent
+		if err := json.Unmarshal(entry.Data, &ev); err != nil {
+			return nil, fmt.Errorf("unable to decode digest entry %d: %w", entry.ID, err)
+		}
+		digest.Events = append(digest.Events, ev)
+	}
+	return digest, nil
+}
+
+// getDigestAction returns the rule and the action with digest enabled
+// the pending digest refers to
+func (d *pendingDigest) getDigestAction() (dataprovider.EventRule, *dataprovider.EventAction, error) {
+	rule, err := dataprovider.EventRuleExists(d.ruleName)
+	if err != nil {
+		return rule, nil, err
+	}
+	for idx := range rule.Actions {
+		action := &rule.Actions[idx]
+		if action.Name == d.actionName && action.Options.Digest > 0 {
+			return rule, action, nil
+		}
+	}
+	return rule, nil, util.NewRecordNotFoundError(fmt.Sprintf("action %q with digest enabled not found in rule %q",
+		d.actionName, d.ruleName))
+}
+
+func groupEventDigestEntries(entries []dataprovider.EventDigestEntry) []*pendingDigest {
+	var result []*pendingDigest
+	digests := make(map[string]*pendingDigest)
+	for _, entry := range entries {
+		key := fmt.Sprintf("%s\x00%s\x00%s\x00%d", entry.RuleName, entry.ActionName, entry.Name, entry.WindowEnd)
+		digest, ok := digests[key]
+		if !ok {
+			digest = &pendingDigest{
+				ruleName:   entry.RuleName,
+				actionName: entry.ActionName,
+				name:       entry.Name,
+				windowEnd:  entry.WindowEnd,
+			}
+			digests[key] = digest
+			result = append(result, digest)
+		}
+		digest.entries = append(digest.entries, entry)
+	}
+	return result
+}
+
+func sendEventDigest(d *pendingDigest) {
+	rule, action, err := d.getDigestAction()
+	if err != nil {
+		if !errors.Is(err, util.ErrNotFound) {
+			eventManagerLog(logger.LevelError, "unable to get rule %q for digest: %v", d.ruleName, err)
+			return
+		}
+		eventManagerLog(logger.LevelInfo, "discarding %d digest entries for rule %q, action %q: %v",
+			len(d.entries), d.ruleName, d.actionName, err)
+		dataprovider.DeleteEventDigestEntries(d.getIDs()) //nolint:errcheck
+		return
+	}
+	digest, err := d.getDigest(action)
+	if err == nil {
+		err = rule.CheckActionsConsistency(digest.Events[0].ObjectType)
+	}
+	if err != nil {
+		eventManagerLog(logger.LevelWarn, "discarding %d digest entries for rule %q, action %q: %v",
+			len(d.entries), d.ruleName, d.actionName, err)
+		dataprovider.DeleteEventDigestEntries(d.getIDs()) //nolint:errcheck
+		return
+	}
+	// entries are removed before sending the digest, this way another
+	// instance cannot send the same digest
+	if err := dataprovider.DeleteEventDigestEntries(d.getIDs()); err != nil {
+		eventManagerLog(logger.LevelDebug, "digest for rule %q, action %q, name %q already processed: %v",
+			d.ruleName, d.actionName, d.name, err)
+		return
+	}
+	params := digest.getParams(d.name)
+	startTime := time.Now()
+	if err := executeRuleAction(action.BaseEventAction, params, rule.Conditions.Options); err != nil {
+		eventManagerLog(logger.LevelError, "unable to execute digest action %q for rule %q, events: %d, elapsed %s, err: %v",
+			action.Name, rule.Name, len(digest.Events), time.Since(startTime), err)
+		params.updateStatusFromError = false
+		executeRuleFailureActions(rule, params)
+		return
+	}
+	eventManagerLog(logger.LevelDebug, "executed digest action %q for rule %q, events: %d, elapsed %s",
+		action.Name, rule.Name, len(digest.Events), time.Since(startTime))
+}
+
+// sendEventDigests sends the digests whose window is ended
+func sendEventDigests() {
+	entries, err := dataprovider.GetEventDigestEntries(time.Now())
+	if err != nil {
+		eventManagerLog(logger.LevelError, "unable to get pending digest entries: %v", err)
+		return
+	}
+	if len(entries) == 0 {
+		return
+	}
+	eventManager.addAsyncTask()
+	defer eventManager.removeAsyncTask()
+
+	for _, d := range groupEventDigestEntries(entries) {
+		sendEventDigest(d)
+	}
+}
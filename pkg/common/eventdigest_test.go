@@ -0,0 +1,279 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+func TestDigestWindow(t *testing.T) {
+	ts := time.Date(2023, 5, 10, 14, 35, 12, 0, time.UTC)
+	start, end := dataprovider.GetDigestWindow(dataprovider.DigestIntervalHourly, ts)
+	assert.Equal(t, time.Date(2023, 5, 10, 14, 0, 0, 0, time.UTC), start)
+	assert.Equal(t, time.Date(2023, 5, 10, 15, 0, 0, 0, time.UTC), end)
+	start, end = dataprovider.GetDigestWindow(dataprovider.DigestIntervalDaily, ts)
+	assert.Equal(t, time.Date(2023, 5, 10, 0, 0, 0, 0, time.UTC), start)
+	assert.Equal(t, time.Date(2023, 5, 11, 0, 0, 0, 0, time.UTC), end)
+	// the end of a window is the start of the next one
+	start, _ = dataprovider.GetDigestWindow(dataprovider.DigestIntervalDaily, end)
+	assert.Equal(t, end, start)
+}
+
+func TestDigestEventAsString(t *testing.T) {
+	ts := time.Date(2023, 5, 10, 14, 35, 12, 0, time.UTC)
+	ev := digestEvent{
+		Event:       operationUpload,
+		Status:      1,
+		VirtualPath: "/dir/file.txt",
+		FileSize:    123,
+		Protocol:    ProtocolSFTP,
+		IP:          "::1",
+		Timestamp:   ts.UnixNano(),
+	}
+	assert.Equal(t, "2023-05-10T14:35:12Z upload /dir/file.txt size: 123 protocol: SFTP ip: ::1 status: OK",
+		ev.getAsString())
+	ev = digestEvent{
+		Event:             operationRename,
+		Status:            2,
+		VirtualPath:       "/a",
+		VirtualTargetPath: "/b",
+		Timestamp:         ts.UnixNano(),
+		Errors:            []string{"err1", "err2"},
+	}
+	assert.Equal(t, "2023-05-10T14:35:12Z rename /a -> /b status: KO errors: err1, err2", ev.getAsString())
+	ev = digestEvent{
+		Event:      "add",
+		Status:     1,
+		ObjectType: "user",
+		ObjectName: "user1",
+		Timestamp:  ts.UnixNano(),
+	}
+	assert.Equal(t, `2023-05-10T14:35:12Z add user "user1" status: OK`, ev.getAsString())
+
+	digest := eventDigest{
+		Start:  ts.Truncate(time.Hour),
+		End:    ts.Truncate(time.Hour).Add(time.Hour),
+		Events: []digestEvent{ev, ev},
+	}
+	params := digest.getParams("admin")
+	replacer := strings.NewReplacer(params.getStringReplacements(false, false)...)
+	assert.Equal(t, "2 2023-05-10T14:00:00Z 2023-05-10T15:00:00Z",
+		replacer.Replace("{{DigestCount}} {{DigestStart}} {{DigestEnd}}"))
+	assert.Equal(t, ev.getAsString()+"\n"+ev.getAsString(), replacer.Replace("{{DigestEvents}}"))
+	replacer = strings.NewReplacer(params.getStringReplacements(false, true)...)
+	assert.Equal(t, `2023-05-10T14:35:12Z add user \"user1\" status: OK\n2023-05-10T14:35:12Z add user \"user1\" status: OK`,
+		replacer.Replace("{{DigestEvents}}"))
+	assert.Equal(t, 1, params.Status)
+	assert.Equal(t, "add", params.Event)
+	digest.Events[0].Status = 2
+	params = digest.getParams("admin")
+	assert.Equal(t, 2, params.Status)
+}
+
+func TestEventDigestValidation(t *testing.T) {
+	a1 := &dataprovider.BaseEventAction{
+		Name: "a1",
+		Type: dataprovider.ActionTypeCommand,
+		Options: dataprovider.BaseEventActionOptions{
+			CmdConfig: dataprovider.EventActionCommandConfig{
+				Cmd:     "/bin/true",
+				Timeout: 10,
+			},
+		},
+	}
+	err := dataprovider.AddEventAction(a1, "", "", "")
+	require.NoError(t, err)
+	r := &dataprovider.EventRule{
+		Name:    "digest rule",
+		Status:  1,
+		Trigger: dataprovider.EventTriggerFsEvent,
+		Conditions: dataprovider.EventConditions{
+			FsEvents: []string{operationUpload},
+		},
+		Actions: []dataprovider.EventAction{
+			{
+				BaseEventAction: dataprovider.BaseEventAction{
+					Name: a1.Name,
+				},
+				Options: dataprovider.EventActionOptions{
+					Digest: 10,
+				},
+			},
+		},
+	}
+	err = dataprovider.AddEventRule(r, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	assert.Contains(t, err.Error(), "invalid digest interval")
+	r.Actions[0].Options.Digest = dataprovider.DigestIntervalHourly
+	r.Actions[0].Options.ExecuteSync = true
+	err = dataprovider.AddEventRule(r, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	assert.Contains(t, err.Error(), "not supported for failure and sync actions")
+	r.Actions[0].Options.ExecuteSync = false
+	r.Trigger = dataprovider.EventTriggerCertificate
+	err = dataprovider.AddEventRule(r, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	assert.Contains(t, err.Error(), "only supported for filesystem and provider events")
+	r.Trigger = dataprovider.EventTriggerFsEvent
+	r.Conditions.FsEvents = []string{operationUpload}
+	err = dataprovider.AddEventRule(r, "", "", "")
+	require.NoError(t, err)
+	// digest is not supported for command actions
+	rule, err := dataprovider.EventRuleExists(r.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, dataprovider.DigestIntervalHourly, rule.Actions[0].Options.Digest)
+	err = rule.CheckActionsConsistency("")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "digest is only supported for email and HTTP actions")
+	}
+
+	err = dataprovider.DeleteEventRule(r.Name, "", "", "")
+	assert.NoError(t, err)
+	err = dataprovider.DeleteEventAction(a1.Name, "", "", "")
+	assert.NoError(t, err)
+}
+
+func TestEventDigest(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	a1 := &dataprovider.BaseEventAction{
+		Name: "digest action",
+		Type: dataprovider.ActionTypeHTTP,
+		Options: dataprovider.BaseEventActionOptions{
+			HTTPConfig: dataprovider.EventActionHTTPConfig{
+				Endpoint: server.URL,
+				Timeout:  10,
+				Method:   http.MethodPost,
+				Body:     "{{Name}} {{DigestCount}}\n{{DigestEvents}}",
+			},
+		},
+	}
+	err := dataprovider.AddEventAction(a1, "", "", "")
+	require.NoError(t, err)
+	r := &dataprovider.EventRule{
+		Name:    "digest rule",
+		Status:  1,
+		Trigger: dataprovider.EventTriggerFsEvent,
+		Conditions: dataprovider.EventConditions{
+			FsEvents: []string{operationUpload},
+		},
+		Actions: []dataprovider.EventAction{
+			{
+				BaseEventAction: dataprovider.BaseEventAction{
+					Name: a1.Name,
+				},
+				Options: dataprovider.EventActionOptions{
+					Digest: dataprovider.DigestIntervalHourly,
+				},
+			},
+		},
+	}
+	err = dataprovider.AddEventRule(r, "", "", "")
+	require.NoError(t, err)
+	rule, err := dataprovider.EventRuleExists(r.Name)
+	require.NoError(t, err)
+
+	for _, p := range []struct {
+		name string
+		path string
+	}{{"user1", "/file1"}, {"user2", "/file2"}, {"user1", "/file3"}} {
+		executeAsyncRulesActions([]dataprovider.EventRule{rule}, EventParams{
+			Name:        p.name,
+			Event:       operationUpload,
+			Status:      1,
+			VirtualPath: p.path,
+			Protocol:    ProtocolSFTP,
+			Timestamp:   time.Now().UnixNano(),
+		})
+	}
+	// no HTTP request is sent until the digest window ends
+	mu.Lock()
+	assert.Len(t, bodies, 0)
+	mu.Unlock()
+	sendEventDigests()
+	entries, err := dataprovider.GetEventDigestEntries(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	processedID := entries[0].ID
+	for _, d := range groupEventDigestEntries(entries) {
+		sendEventDigest(d)
+	}
+	mu.Lock()
+	if assert.Len(t, bodies, 2) {
+		assert.True(t, strings.HasPrefix(bodies[0], "user1 2\n"), bodies[0])
+		assert.Contains(t, bodies[0], "upload /file1")
+		assert.Contains(t, bodies[0], "upload /file3")
+		assert.True(t, strings.HasPrefix(bodies[1], "user2 1\n"), bodies[1])
+		assert.Contains(t, bodies[1], "upload /file2")
+	}
+	bodies = nil
+	mu.Unlock()
+	entries, err = dataprovider.GetEventDigestEntries(time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+	// already processed entries cannot be removed again
+	err = dataprovider.DeleteEventDigestEntries([]int64{processedID})
+	assert.ErrorIs(t, err, util.ErrNotFound)
+	// entries for a rule without digest are discarded
+	executeAsyncRulesActions([]dataprovider.EventRule{rule}, EventParams{
+		Name:        "user1",
+		Event:       operationUpload,
+		Status:      1,
+		VirtualPath: "/file4",
+		Timestamp:   time.Now().UnixNano(),
+	})
+	r.Actions[0].Options.Digest = 0
+	err = dataprovider.UpdateEventRule(r, "", "", "")
+	assert.NoError(t, err)
+	entries, err = dataprovider.GetEventDigestEntries(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	for _, d := range groupEventDigestEntries(entries) {
+		sendEventDigest(d)
+	}
+	entries, err = dataprovider.GetEventDigestEntries(time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+	mu.Lock()
+	assert.Len(t, bodies, 0)
+	mu.Unlock()
+
+	err = dataprovider.DeleteEventRule(r.Name, "", "", "")
+	assert.NoError(t, err)
+	err = dataprovider.DeleteEventAction(a1.Name, "", "", "")
+	assert.NoError(t, err)
+}
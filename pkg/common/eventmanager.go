@@ -22,6 +22,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"mime"
 	"mime/multipart"
 	"net/http"
@@ -43,6 +44,8 @@ import (
 	"github.com/rs/xid"
 	"github.com/sftpgo/sdk"
 	"github.com/wneessen/go-mail"
+	"golang.org/x/crypto/openpgp" //nolint:staticcheck
+	"golang.org/x/crypto/ssh"
 
 	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
 	"github.com/drakkan/sftpgo/v2/pkg/logger"
@@ -78,17 +81,18 @@ func init() {
 		concurrencyGuard: make(chan struct{}, 200),
 	}
 	dataprovider.SetEventRulesCallbacks(eventManager.loadRules, eventManager.RemoveRule,
-		func(operation, executor, ip, objectType, objectName, role string, object plugin.Renderer) {
+		func(ctx context.Context, operation, executor, ip, objectType, objectName, role string, object plugin.Renderer) {
 			p := EventParams{
-				Name:       executor,
-				ObjectName: objectName,
-				Event:      operation,
-				Status:     1,
-				ObjectType: objectType,
-				IP:         ip,
-				Role:       role,
-				Timestamp:  time.Now().UnixNano(),
-				Object:     object,
+				Name:          executor,
+				ObjectName:    objectName,
+				Event:         operation,
+				Status:        1,
+				ObjectType:    objectType,
+				IP:            ip,
+				Role:          role,
+				Timestamp:     time.Now().UnixNano(),
+				CorrelationID: logger.GetCorrelationID(ctx),
+				Object:        object,
 			}
 			if u, ok := object.(*dataprovider.User); ok {
 				p.Email = u.Email
@@ -553,11 +557,20 @@ type EventParams struct {
 	Email                 string
 	Timestamp             int64
 	IDPCustomFields       *map[string]string
+	UploadFields          *map[string]string
+	CorrelationID         string
 	Object                plugin.Renderer
 	sender                string
 	updateStatusFromError bool
 	errors                []string
 	retentionChecks       []executedRetentionCheck
+	digest                *eventDigest
+	// outputs and errors for the executed workflow steps
+	stepOutputs map[string]string
+	stepErrors  map[string]string
+	// if true the output of HTTP and command actions is saved
+	captureOutput bool
+	output        string
 }
 
 func (p *EventParams) getACopy() *EventParams {
@@ -582,6 +595,15 @@ func (p *EventParams) getACopy() *EventParams {
 		}
 		params.IDPCustomFields = &fields
 	}
+	if p.UploadFields != nil {
+		fields := make(map[string]string)
+		for k, v := range *p.UploadFields {
+			fields[k] = v
+		}
+		params.UploadFields = &fields
+	}
+	params.stepOutputs = copyStringMap(p.stepOutputs)
+	params.stepErrors = copyStringMap(p.stepErrors)
 
 	return &params
 }
@@ -753,6 +775,28 @@ func (*EventParams) getStringReplacement(val string, jsonEscaped bool) string {
 	return val
 }
 
+// getDate returns the event date as YYYY-MM-DD, UTC
+func (p *EventParams) getDate() string {
+	t := time.Now()
+	if p.Timestamp > 0 {
+		t = time.Unix(0, p.Timestamp)
+	}
+	return t.UTC().Format("2006-01-02")
+}
+
+// getUsername returns the user filesystem actions are executed for, the user
+// performing the action for filesystem events and the affected user for
+// provider events. Empty in all other cases
+func (p *EventParams) getUsername() string {
+	if p.sender == dataprovider.ActionExecutorSystem {
+		return ""
+	}
+	if p.ObjectType == "" || p.ObjectType == "user" {
+		return p.sender
+	}
+	return ""
+}
+
 func (p *EventParams) getStringReplacements(addObjectData, jsonEscaped bool) []string {
 	replacements := []string{
 		"{{Name}}", p.getStringReplacement(p.Name, jsonEscaped),
@@ -772,6 +816,10 @@ func (p *EventParams) getStringReplacements(addObjectData, jsonEscaped bool) []s
 		"{{Email}}", p.getStringReplacement(p.Email, jsonEscaped),
 		"{{Timestamp}}", fmt.Sprintf("%d", p.Timestamp),
 		"{{StatusString}}", p.getStatusString(),
+		"{{CorrelationID}}", p.CorrelationID,
+		"{{Ext}}", p.getStringReplacement(path.Ext(p.ObjectName), jsonEscaped),
+		"{{Date}}", p.getDate(),
+		"{{Username}}", p.getStringReplacement(p.getUsername(), jsonEscaped),
 	}
 	if p.VirtualPath != "" {
 		replacements = append(replacements, "{{VirtualDirPath}}", p.getStringReplacement(path.Dir(p.VirtualPath), jsonEscaped))
@@ -785,6 +833,13 @@ func (p *EventParams) getStringReplacements(addObjectData, jsonEscaped bool) []s
 	} else {
 		replacements = append(replacements, "{{ErrorString}}", "")
 	}
+	if p.digest != nil {
+		replacements = append(replacements,
+			"{{DigestCount}}", fmt.Sprintf("%d", len(p.digest.Events)),
+			"{{DigestStart}}", p.digest.Start.Format(time.RFC3339),
+			"{{DigestEnd}}", p.digest.End.Format(time.RFC3339),
+			"{{DigestEvents}}", p.getStringReplacement(p.digest.getEventsAsString(), jsonEscaped))
+	}
 	replacements = append(replacements, objDataPlaceholder, "")
 	if addObjectData {
 		data, err := p.Object.RenderAsJSON(p.Event != operationDelete)
@@ -797,6 +852,22 @@ func (p *EventParams) getStringReplacements(addObjectData, jsonEscaped bool) []s
 			replacements = append(replacements, fmt.Sprintf("{{IDPField%s}}", k), p.getStringReplacement(v, jsonEscaped))
 		}
 	}
+	for k, v := range p.stepOutputs {
+		replacements = append(replacements, fmt.Sprintf("{{StepOutput%s}}", k), p.getStringReplacement(v, jsonEscaped))
+	}
+	for k, v := range p.stepErrors {
+		replacements = append(replacements, fmt.Sprintf("{{StepError%s}}", k), p.getStringReplacement(v, jsonEscaped))
+	}
+	uploadMetadata := ""
+	if p.UploadFields != nil {
+		for k, v := range *p.UploadFields {
+			replacements = append(replacements, fmt.Sprintf("{{UploadField%s}}", k), p.getStringReplacement(v, jsonEscaped))
+		}
+		if data, err := json.Marshal(*p.UploadFields); err == nil {
+			uploadMetadata = p.getStringReplacement(string(data), jsonEscaped)
+		}
+	}
+	replacements = append(replacements, "{{UploadMetadata}}", uploadMetadata)
 	return replacements
 }
 
@@ -832,6 +903,13 @@ func closeWriterAndUpdateQuota(w io.WriteCloser, conn *BaseConnection, virtualSo
 	targetPath := virtualSourcePath
 	if virtualTargetPath != "" {
 		targetPath = virtualTargetPath
+	}
+	if cw, ok := w.(*contentCheckWriter); ok && cw.denied && errTransfer == nil {
+		// the buffered data were rejected on close and never written
+		removePartialFile(conn, targetPath, numFiles, truncatedSize)
+		return errWrite
+	}
+	if virtualTargetPath != "" {
 		var fsDst vfs.Fs
 		fsDst, fsDstPath, errDstFs = conn.GetFsAndResolvedPath(virtualTargetPath)
 		if errTransfer != nil && errDstFs == nil {
@@ -921,6 +999,9 @@ func getFileWriter(conn *BaseConnection, virtualPath string, expectedSize int64)
 		if info.IsDir() {
 			return nil, numFiles, truncatedSize, nil, fmt.Errorf("cannot write to a directory: %q", virtualPath)
 		}
+		if err := conn.CheckWORMProtection(virtualPath, info); err != nil {
+			return nil, numFiles, truncatedSize, nil, err
+		}
 		if info.Mode().IsRegular() {
 			isFileOverwrite = true
 			truncatedSize = fileSize
@@ -949,9 +1030,29 @@ func getFileWriter(conn *BaseConnection, virtualPath string, expectedSize int64)
 		cancelFn = func() {}
 	}
 	if f != nil {
-		return f, numFiles, truncatedSize, cancelFn, nil
+		return wrapWriterForContentCheck(conn, f, fsPath, virtualPath), numFiles, truncatedSize, cancelFn, nil
+	}
+	return wrapWriterForContentCheck(conn, w, fsPath, virtualPath), numFiles, truncatedSize, cancelFn, nil
+}
+
+// removePartialFile removes a file partially written using the writer
+// returned by getFileWriter and updates the quota accordingly
+func removePartialFile(conn *BaseConnection, virtualPath string, numFiles int, truncatedSize int64) {
+	fs, fsPath, err := conn.GetFsAndResolvedPath(virtualPath)
+	if err == nil {
+		err = fs.Remove(fsPath, false)
+		if err == nil || fs.IsNotExist(err) {
+			if numFiles == 0 {
+				// the overwritten file no longer exists
+				updateUserQuotaAfterFileWrite(conn, virtualPath, -1, -truncatedSize)
+			}
+			return
+		}
+	}
+	conn.Log(logger.LevelWarn, "unable to remove partial file %q: %v", virtualPath, err)
+	if info, err := conn.doStatInternal(virtualPath, 0, false, false); err == nil {
+		updateUserQuotaAfterFileWrite(conn, virtualPath, numFiles, info.Size()-truncatedSize)
 	}
-	return w, numFiles, truncatedSize, cancelFn, nil
 }
 
 func addZipEntry(wr *zipWriterWrapper, conn *BaseConnection, entryPath, baseDir string) error {
@@ -1003,6 +1104,9 @@ func addZipEntry(wr *zipWriterWrapper, conn *BaseConnection, entryPath, baseDir
 		eventManagerLog(logger.LevelInfo, "skipping zip entry for non regular file %q", entryPath)
 		return nil
 	}
+	if err := conn.progress.checkCanceled(); err != nil {
+		return err
+	}
 	reader, cancelFn, err := getFileReader(conn, entryPath)
 	if err != nil {
 		eventManagerLog(logger.LevelError, "unable to add zip entry %q, cannot open file: %v", entryPath, err)
@@ -1021,6 +1125,9 @@ func addZipEntry(wr *zipWriterWrapper, conn *BaseConnection, entryPath, baseDir
 		return fmt.Errorf("unable to create zip entry %q: %w", entryPath, err)
 	}
 	_, err = io.Copy(f, reader)
+	if err == nil {
+		conn.progress.add(1, info.Size())
+	}
 	return err
 }
 
@@ -1327,8 +1434,11 @@ func getHTTPRuleActionBody(c *dataprovider.EventActionHTTPConfig, replacer *stri
 }
 
 func setHTTPReqHeaders(req *http.Request, c *dataprovider.EventActionHTTPConfig, replacer *strings.Replacer,
-	contentType string,
+	contentType, correlationID string,
 ) {
+	if correlationID != "" {
+		req.Header.Set(logger.CorrelationIDHeader, correlationID)
+	}
 	if contentType != "" {
 		req.Header.Set("Content-Type", contentType)
 	}
@@ -1380,7 +1490,7 @@ func executeHTTPRuleAction(c dataprovider.EventActionHTTPConfig, params *EventPa
 	if err != nil {
 		return err
 	}
-	setHTTPReqHeaders(req, &c, replacer, contentType)
+	setHTTPReqHeaders(req, &c, replacer, contentType, params.CorrelationID)
 
 	client := c.GetHTTPClient()
 	defer client.CloseIdleConnections()
@@ -1402,6 +1512,13 @@ func executeHTTPRuleAction(c dataprovider.EventActionHTTPConfig, params *EventPa
 		}
 		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
+	if params.captureOutput {
+		rb, err := io.ReadAll(io.LimitReader(resp.Body, maxWorkflowStepOutputSize))
+		if err != nil {
+			return fmt.Errorf("unable to read the HTTP response: %w", err)
+		}
+		params.output = string(rb)
+	}
 
 	return nil
 }
@@ -1429,15 +1546,27 @@ func executeCommandRuleAction(c dataprovider.EventActionCommandConfig, params *E
 
 	cmd := exec.CommandContext(ctx, c.Cmd, args...)
 	cmd.Env = []string{}
+	if params.CorrelationID != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", logger.CorrelationIDEnvVar, params.CorrelationID))
+	}
 	for _, keyVal := range c.EnvVars {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", keyVal.Key, replaceWithReplacer(keyVal.Value, replacer)))
 	}
 
+	var stdout *limitedBuffer
+	if params.captureOutput {
+		stdout = &limitedBuffer{limit: maxWorkflowStepOutputSize}
+		cmd.Stdout = stdout
+	}
+
 	startTime := time.Now()
 	err := cmd.Run()
 
 	eventManagerLog(logger.LevelDebug, "executed command %q, elapsed: %s, error: %v",
 		c.Cmd, time.Since(startTime), err)
+	if stdout != nil {
+		params.output = strings.TrimRight(stdout.String(), "\r\n")
+	}
 
 	return err
 }
@@ -1505,7 +1634,7 @@ func executeEmailRuleAction(c dataprovider.EventActionEmailConfig, params *Event
 		}
 		files = append(files, res...)
 	}
-	err := smtp.SendEmail(recipients, bcc, subject, body, smtp.EmailContentType(c.ContentType), files...)
+	err := smtp.SendEmailForRole(params.Role, recipients, bcc, subject, body, smtp.EmailContentType(c.ContentType), files...)
 	eventManagerLog(logger.LevelDebug, "executed email notification action, elapsed: %s, error: %v",
 		time.Since(startTime), err)
 	if err != nil {
@@ -1526,6 +1655,7 @@ func getUserForEventAction(user dataprovider.User) (dataprovider.User, error) {
 	user.Filters.DisableFsChecks = false
 	user.Filters.FilePatterns = nil
 	user.Filters.BandwidthLimits = nil
+	user.Filters.BandwidthSchedules = nil
 	for k := range user.Permissions {
 		user.Permissions[k] = []string{dataprovider.PermAny}
 	}
@@ -1902,6 +2032,11 @@ func executeCompressFsActionForUser(c dataprovider.EventActionFsCompress, replac
 		paths = append(paths, p)
 	}
 	paths = util.RemoveDuplicates(paths, false)
+	return createZipArchive(conn, name, paths)
+}
+
+// createZipArchive creates the zip archive name with the specified paths
+func createZipArchive(conn *BaseConnection, name string, paths []string) error {
 	estimatedSize, err := estimateZipSize(conn, name, paths)
 	if err != nil {
 		eventManagerLog(logger.LevelError, "unable to estimate size for archive %q: %v", name, err)
@@ -2005,6 +2140,108 @@ func executeCompressFsRuleAction(c dataprovider.EventActionFsCompress, replacer
 	return nil
 }
 
+func pgpEncryptFile(conn *BaseConnection, source, target string, keys openpgp.EntityList) error {
+	info, err := conn.DoStat(source, 0, false)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%q is not a regular file", source)
+	}
+	reader, cancelReader, err := getFileReader(conn, source)
+	if err != nil {
+		return err
+	}
+	defer cancelReader()
+	defer reader.Close()
+
+	conn.CheckParentDirs(path.Dir(target)) //nolint:errcheck
+	writer, numFiles, truncatedSize, cancelFn, err := getFileWriter(conn, target, info.Size())
+	if err != nil {
+		return err
+	}
+	defer cancelFn()
+
+	startTime := time.Now()
+	err = util.PGPEncrypt(writer, reader, keys, path.Base(source))
+	return closeWriterAndUpdateQuota(writer, conn, target, "", numFiles, truncatedSize, err, operationUpload, startTime)
+}
+
+func executePGPEncryptFsActionForUser(c dataprovider.EventActionFsPGPEncrypt, keys openpgp.EntityList,
+	replacer *strings.Replacer, user dataprovider.User,
+) error {
+	user, err := getUserForEventAction(user)
+	if err != nil {
+		return err
+	}
+	connectionID := fmt.Sprintf("%s_%s", protocolEventAction, xid.New().String())
+	err = user.CheckFsRoot(connectionID)
+	defer user.CloseFs() //nolint:errcheck
+	if err != nil {
+		return fmt.Errorf("encrypt error, unable to check root fs for user %q: %w", user.Username, err)
+	}
+	conn := NewBaseConnection(connectionID, protocolEventAction, "", "", user)
+	for _, item := range c.Paths {
+		source := util.CleanPath(replaceWithReplacer(item.Key, replacer))
+		target := util.CleanPath(replaceWithReplacer(item.Value, replacer))
+		if source == target {
+			return fmt.Errorf("unable to encrypt %q, user %q: source and target cannot be equal", source, user.Username)
+		}
+		if err = pgpEncryptFile(conn, source, target, keys); err != nil {
+			return fmt.Errorf("unable to encrypt %q->%q, user %q: %w", source, target, user.Username, err)
+		}
+		eventManagerLog(logger.LevelDebug, "encrypt %q->%q ok, user %q", source, target, user.Username)
+		if c.RemoveSource {
+			info, err := conn.DoStat(source, 0, false)
+			if err == nil {
+				err = executeDeleteFileFsAction(conn, source, info)
+			}
+			if err != nil {
+				return fmt.Errorf("unable to remove %q after encryption, user %q: %w", source, user.Username, err)
+			}
+		}
+	}
+	return nil
+}
+
+func executePGPEncryptFsRuleAction(c dataprovider.EventActionFsPGPEncrypt, replacer *strings.Replacer,
+	conditions dataprovider.ConditionOptions, params *EventParams,
+) error {
+	keys, err := util.ReadPGPPublicKeys(c.PublicKey)
+	if err != nil {
+		return err
+	}
+	users, err := params.getUsers()
+	if err != nil {
+		return fmt.Errorf("unable to get users: %w", err)
+	}
+	var failures []string
+	executed := 0
+	for _, user := range users {
+		// if sender is set, the conditions have already been evaluated
+		if params.sender == "" {
+			if !checkUserConditionOptions(&user, &conditions) {
+				eventManagerLog(logger.LevelDebug, "skipping fs encrypt for user %s, condition options don't match",
+					user.Username)
+				continue
+			}
+		}
+		executed++
+		if err = executePGPEncryptFsActionForUser(c, keys, replacer, user); err != nil {
+			failures = append(failures, user.Username)
+			params.AddError(err)
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("fs encrypt failed for users: %s", strings.Join(failures, ", "))
+	}
+	if executed == 0 {
+		eventManagerLog(logger.LevelError, "no file encrypted")
+		return errors.New("no file encrypted")
+	}
+	return nil
+}
+
 func executeFsRuleAction(c dataprovider.EventActionFilesystemConfig, conditions dataprovider.ConditionOptions,
 	params *EventParams,
 ) error {
@@ -2024,6 +2261,8 @@ func executeFsRuleAction(c dataprovider.EventActionFilesystemConfig, conditions
 		return executeCompressFsRuleAction(c.Compress, replacer, conditions, params)
 	case dataprovider.FilesystemActionCopy:
 		return executeCopyFsRuleAction(c.Copy, replacer, conditions, params)
+	case dataprovider.FilesystemActionPGPEncrypt:
+		return executePGPEncryptFsRuleAction(c.PGPEncrypt, replacer, conditions, params)
 	default:
 		return fmt.Errorf("unsupported filesystem action %d", c.Type)
 	}
@@ -2094,6 +2333,11 @@ func executeFoldersQuotaResetRuleAction(conditions dataprovider.ConditionOptions
 	var failures []string
 	executed := 0
 	for _, folder := range folders {
+		if !checkEventConditionPatterns(folder.Role, conditions.RoleNames) {
+			eventManagerLog(logger.LevelDebug, "skipping quota reset for folder %s, role conditions don't match",
+				folder.Name)
+			continue
+		}
 		// if sender is set, the conditions have already been evaluated
 		if params.sender == "" && !checkEventConditionPatterns(folder.Name, conditions.Names) {
 			eventManagerLog(logger.LevelDebug, "skipping scheduled quota reset for folder %s, name conditions don't match",
@@ -2346,14 +2590,14 @@ func executePwdExpirationCheckForUser(user *dataprovider.User, config dataprovid
 	data := make(map[string]any)
 	data["Username"] = user.Username
 	data["Days"] = days
-	if err := smtp.RenderPasswordExpirationTemplate(body, data); err != nil {
+	if err := smtp.RenderPasswordExpirationTemplate(user.Role, body, data); err != nil {
 		eventManagerLog(logger.LevelError, "unable to notify password expiration for user %s: %v",
 			user.Username, err)
 		return err
 	}
 	subject := "SFTPGo password expiration notification"
 	startTime := time.Now()
-	if err := smtp.SendEmail([]string{user.Email}, nil, subject, body.String(), smtp.EmailContentTypeTextHTML); err != nil {
+	if err := smtp.SendEmailForRole(user.Role, []string{user.Email}, nil, subject, body.String(), smtp.EmailContentTypeTextHTML); err != nil {
 		eventManagerLog(logger.LevelError, "unable to notify password expiration for user %s: %v, elapsed: %s",
 			user.Username, err, time.Since(startTime))
 		return err
@@ -2391,6 +2635,108 @@ func executePwdExpirationCheckRuleAction(config dataprovider.EventActionPassword
 	return nil
 }
 
+type pubKeyExpiration struct {
+	Fingerprint string
+	Comment     string
+	Days        int
+}
+
+func getExpiringPublicKeys(user *dataprovider.User, threshold int) []pubKeyExpiration {
+	var result []pubKeyExpiration
+	for _, k := range user.PublicKeys {
+		pubKey, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
+		if err != nil {
+			continue
+		}
+		fp := ssh.FingerprintSHA256(pubKey)
+		expiresAt := user.GetPublicKeyExpiration(fp)
+		if expiresAt == 0 {
+			continue
+		}
+		expiration := util.GetTimeFromMsecSinceEpoch(expiresAt)
+		if expiration.Before(time.Now()) {
+			continue
+		}
+		days := int(math.Round(float64(time.Until(expiration)) / float64(24*time.Hour)))
+		if days == 0 {
+			days = 1
+		}
+		if days > threshold {
+			continue
+		}
+		result = append(result, pubKeyExpiration{
+			Fingerprint: fp,
+			Comment:     comment,
+			Days:        days,
+		})
+	}
+	return result
+}
+
+func executePubKeyExpirationCheckForUser(user *dataprovider.User, config dataprovider.EventActionPublicKeyExpiration) error {
+	if user.ExpirationDate > 0 {
+		if expDate := util.GetTimeFromMsecSinceEpoch(user.ExpirationDate); expDate.Before(time.Now()) {
+			eventManagerLog(logger.LevelDebug, "skipping public key expiration check for expired user %q, expiration date: %s",
+				user.Username, expDate)
+			return nil
+		}
+	}
+	keys := getExpiringPublicKeys(user, config.Threshold)
+	if len(keys) == 0 {
+		eventManagerLog(logger.LevelDebug, "no public key expiring within %d days for user %q, no need to notify",
+			config.Threshold, user.Username)
+		return nil
+	}
+	body := new(bytes.Buffer)
+	data := make(map[string]any)
+	data["Username"] = user.Username
+	data["Keys"] = keys
+	if err := smtp.RenderPublicKeyExpirationTemplate(user.Role, body, data); err != nil {
+		eventManagerLog(logger.LevelError, "unable to notify public key expiration for user %s: %v",
+			user.Username, err)
+		return err
+	}
+	subject := "SFTPGo public key expiration notification"
+	startTime := time.Now()
+	if err := smtp.SendEmailForRole(user.Role, []string{user.Email}, nil, subject, body.String(), smtp.EmailContentTypeTextHTML); err != nil {
+		eventManagerLog(logger.LevelError, "unable to notify public key expiration for user %s: %v, elapsed: %s",
+			user.Username, err, time.Since(startTime))
+		return err
+	}
+	eventManagerLog(logger.LevelDebug, "public key expiration email sent to user %s, keys: %d, elapsed: %s",
+		user.Username, len(keys), time.Since(startTime))
+	return nil
+}
+
+func executePubKeyExpirationCheckRuleAction(config dataprovider.EventActionPublicKeyExpiration,
+	conditions dataprovider.ConditionOptions, params *EventParams,
+) error {
+	users, err := params.getUsers()
+	if err != nil {
+		return fmt.Errorf("unable to get users: %w", err)
+	}
+	var failures []string
+	for _, user := range users {
+		// if sender is set, the conditions have already been evaluated
+		if params.sender == "" {
+			if !checkUserConditionOptions(&user, &conditions) {
+				eventManagerLog(logger.LevelDebug, "skipping public key expiration check for user %q, condition options don't match",
+					user.Username)
+				continue
+			}
+		}
+		if err = executePubKeyExpirationCheckForUser(&user, config); err != nil {
+			params.AddError(err)
+			failures = append(failures, user.Username)
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("public key expiration check failed for users: %s", strings.Join(failures, ", "))
+	}
+
+	return nil
+}
+
 func executeAdminCheckAction(c *dataprovider.EventActionIDPAccountCheck, params *EventParams) (*dataprovider.Admin, error) {
 	admin, err := dataprovider.AdminExists(params.Name)
 	exists := err == nil
@@ -2458,6 +2804,17 @@ func executeUserCheckAction(c *dataprovider.EventActionIDPAccountCheck, params *
 
 func executeRuleAction(action dataprovider.BaseEventAction, params *EventParams,
 	conditions dataprovider.ConditionOptions,
+) error {
+	err := runRuleAction(action, params, conditions)
+	if err != nil {
+		err = fmt.Errorf("action %q failed: %w", action.Name, err)
+	}
+	params.AddError(err)
+	return err
+}
+
+func runRuleAction(action dataprovider.BaseEventAction, params *EventParams,
+	conditions dataprovider.ConditionOptions,
 ) error {
 	var err error
 
@@ -2490,14 +2847,18 @@ func executeRuleAction(action dataprovider.BaseEventAction, params *EventParams,
 		err = executePwdExpirationCheckRuleAction(action.Options.PwdExpirationConfig, conditions, params)
 	case dataprovider.ActionTypeUserExpirationCheck:
 		err = executeUserExpirationCheckRuleAction(conditions, params)
+	case dataprovider.ActionTypePublicKeyExpirationCheck:
+		err = executePubKeyExpirationCheckRuleAction(action.Options.PubKeyExpirationConfig, conditions, params)
+	case dataprovider.ActionTypeTiering:
+		err = executeTieringRuleAction(action.Options.TieringConfig, conditions, params)
+	case dataprovider.ActionTypeWorkflow:
+		err = executeWorkflowRuleAction(action.Options.WorkflowConfig, conditions, params)
+	case dataprovider.ActionTypeReport:
+		err = executeReportRuleAction(action.Options.ReportConfig, conditions, params)
 	default:
 		err = fmt.Errorf("unsupported action type: %d", action.Type)
 	}
 
-	if err != nil {
-		err = fmt.Errorf("action %q failed: %w", action.Name, err)
-	}
-	params.AddError(err)
 	return err
 }
 
@@ -2581,6 +2942,18 @@ func executeAsyncRulesActions(rules []dataprovider.EventRule, params EventParams
 func executeRuleAsyncActions(rule dataprovider.EventRule, params *EventParams, failedActions []string) {
 	for _, action := range rule.Actions {
 		if !action.Options.IsFailureAction && !action.Options.ExecuteSync {
+			if action.Options.Digest > 0 {
+				if err := addEventToDigest(&rule, &action, params); err != nil {
+					eventManagerLog(logger.LevelError, "unable to add event to digest for action %q, rule %q: %v",
+						action.Name, rule.Name, err)
+					params.AddError(fmt.Errorf("unable to add event to digest for action %q: %w", action.Name, err))
+					failedActions = append(failedActions, action.Name)
+					if action.Options.StopOnFailure {
+						break
+					}
+				}
+				continue
+			}
 			startTime := time.Now()
 			if err := executeRuleAction(action.BaseEventAction, params, rule.Conditions.Options); err != nil {
 				eventManagerLog(logger.LevelError, "unable to execute action %q for rule %q, elapsed %s, err: %v",
@@ -2597,20 +2970,23 @@ func executeRuleAsyncActions(rule dataprovider.EventRule, params *EventParams, f
 	}
 	if len(failedActions) > 0 {
 		params.updateStatusFromError = false
-		// execute failure actions
-		for _, action := range rule.Actions {
-			if action.Options.IsFailureAction {
-				startTime := time.Now()
-				if err := executeRuleAction(action.BaseEventAction, params, rule.Conditions.Options); err != nil {
-					eventManagerLog(logger.LevelError, "unable to execute failure action %q for rule %q, elapsed %s, err: %v",
-						action.Name, rule.Name, time.Since(startTime), err)
-					if action.Options.StopOnFailure {
-						break
-					}
-				} else {
-					eventManagerLog(logger.LevelDebug, "executed failure action %q for rule %q, elapsed: %s",
-						action.Name, rule.Name, time.Since(startTime))
+		executeRuleFailureActions(rule, params)
+	}
+}
+
+func executeRuleFailureActions(rule dataprovider.EventRule, params *EventParams) {
+	for _, action := range rule.Actions {
+		if action.Options.IsFailureAction {
+			startTime := time.Now()
+			if err := executeRuleAction(action.BaseEventAction, params, rule.Conditions.Options); err != nil {
+				eventManagerLog(logger.LevelError, "unable to execute failure action %q for rule %q, elapsed %s, err: %v",
+					action.Name, rule.Name, time.Since(startTime), err)
+				if action.Options.StopOnFailure {
+					break
 				}
+			} else {
+				eventManagerLog(logger.LevelDebug, "executed failure action %q for rule %q, elapsed: %s",
+					action.Name, rule.Name, time.Since(startTime))
 			}
 		}
 	}
@@ -2661,6 +3037,11 @@ func (j *eventCronJob) Run() {
 	if err != nil {
 		return
 	}
+	params := EventParams{
+		Status:                1,
+		CorrelationID:         xid.New().String(),
+		updateStatusFromError: true,
+	}
 	if task.Name != "" {
 		updateInterval := 5 * time.Minute
 		updatedAt := util.GetTimeFromMsecSinceEpoch(task.UpdateAt)
@@ -2696,15 +3077,16 @@ func (j *eventCronJob) Run() {
 			}
 		}(task.Name)
 
-		executeAsyncRulesActions([]dataprovider.EventRule{rule}, EventParams{Status: 1, updateStatusFromError: true})
+		executeAsyncRulesActions([]dataprovider.EventRule{rule}, params)
 	} else {
-		executeAsyncRulesActions([]dataprovider.EventRule{rule}, EventParams{Status: 1, updateStatusFromError: true})
+		executeAsyncRulesActions([]dataprovider.EventRule{rule}, params)
 	}
 	eventManagerLog(logger.LevelDebug, "execution for scheduled rule %q finished", j.ruleName)
 }
 
-// RunOnDemandRule executes actions for a rule with on-demand trigger
-func RunOnDemandRule(name string) error {
+// RunOnDemandRule executes actions for a rule with on-demand trigger.
+// The correlation ID carried by ctx, if any, is sent to the rule actions
+func RunOnDemandRule(ctx context.Context, name string) error {
 	eventManagerLog(logger.LevelDebug, "executing on demand rule %q", name)
 	rule, err := dataprovider.EventRuleExists(name)
 	if err != nil {
@@ -2724,7 +3106,11 @@ func RunOnDemandRule(name string) error {
 		return util.NewValidationError(fmt.Sprintf("rule %q has incosistent actions", name))
 	}
 	eventManagerLog(logger.LevelDebug, "on-demand rule %q started", name)
-	go executeAsyncRulesActions([]dataprovider.EventRule{rule}, EventParams{Status: 1, updateStatusFromError: true})
+	go executeAsyncRulesActions([]dataprovider.EventRule{rule}, EventParams{
+		Status:                1,
+		CorrelationID:         logger.GetCorrelationID(ctx),
+		updateStatusFromError: true,
+	})
 	return nil
 }
 
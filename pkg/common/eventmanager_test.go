@@ -16,6 +16,7 @@ package common
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"errors"
 	"fmt"
@@ -37,9 +38,12 @@ import (
 	sdkkms "github.com/sftpgo/sdk/kms"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/openpgp"       //nolint:staticcheck
+	"golang.org/x/crypto/openpgp/armor" //nolint:staticcheck
 
 	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
 	"github.com/drakkan/sftpgo/v2/pkg/kms"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
 	"github.com/drakkan/sftpgo/v2/pkg/util"
 	"github.com/drakkan/sftpgo/v2/pkg/vfs"
 )
@@ -1451,6 +1455,179 @@ func TestEventRuleActionsNoGroupMatching(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestTenantRuleIsolation(t *testing.T) {
+	role1 := dataprovider.Role{
+		Name: "tenant_role1",
+	}
+	role2 := dataprovider.Role{
+		Name: "tenant_role2",
+	}
+	err := dataprovider.AddRole(&role1, "", "", "")
+	require.NoError(t, err)
+	err = dataprovider.AddRole(&role2, "", "", "")
+	require.NoError(t, err)
+
+	backupAction := dataprovider.BaseEventAction{
+		Name: "tenant_backup",
+		Type: dataprovider.ActionTypeBackup,
+	}
+	folderQuotaAction := dataprovider.BaseEventAction{
+		Name: "tenant_folder_quota_reset",
+		Type: dataprovider.ActionTypeFolderQuotaReset,
+	}
+	userQuotaAction := dataprovider.BaseEventAction{
+		Name: "tenant_user_quota_reset",
+		Type: dataprovider.ActionTypeUserQuotaReset,
+	}
+	workflowAction := dataprovider.BaseEventAction{
+		Name: "tenant_workflow",
+		Type: dataprovider.ActionTypeWorkflow,
+		Options: dataprovider.BaseEventActionOptions{
+			WorkflowConfig: dataprovider.EventActionWorkflowConfig{
+				Steps: []dataprovider.WorkflowStep{
+					{
+						Name:   "s1",
+						Action: userQuotaAction.Name,
+					},
+					{
+						Name:   "s2",
+						Action: backupAction.Name,
+					},
+				},
+			},
+		},
+	}
+	for _, a := range []*dataprovider.BaseEventAction{&backupAction, &folderQuotaAction, &userQuotaAction, &workflowAction} {
+		err = dataprovider.AddEventAction(a, "", "", "")
+		require.NoError(t, err)
+	}
+	// global actions cannot be used in rules owned by a role
+	rule := dataprovider.EventRule{
+		Name:    "tenant_isolation_rule",
+		Status:  1,
+		Trigger: dataprovider.EventTriggerOnDemand,
+		Role:    role1.Name,
+	}
+	for _, name := range []string{backupAction.Name, folderQuotaAction.Name, workflowAction.Name} {
+		rule.Actions = []dataprovider.EventAction{
+			{
+				BaseEventAction: dataprovider.BaseEventAction{
+					Name: name,
+				},
+				Order: 1,
+			},
+		}
+		err = dataprovider.AddEventRule(&rule, "", "", "")
+		if assert.ErrorIs(t, err, util.ErrValidation, name) {
+			assert.Contains(t, err.Error(), "is not allowed for tenant rules")
+		}
+	}
+	rule.Actions[0].Name = userQuotaAction.Name
+	err = dataprovider.AddEventRule(&rule, "", "", "")
+	require.NoError(t, err)
+	rule, err = dataprovider.EventRuleExists(rule.Name)
+	require.NoError(t, err)
+	err = rule.CheckActionsConsistency("")
+	assert.NoError(t, err)
+	// the rule only affects the users of its role
+	user1 := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "tenant_user1",
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+			HomeDir: filepath.Join(os.TempDir(), "tenant_user1"),
+			Role:    role1.Name,
+		},
+	}
+	user2 := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "tenant_user2",
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+			HomeDir: filepath.Join(os.TempDir(), "tenant_user2"),
+			Role:    role2.Name,
+		},
+	}
+	for _, u := range []*dataprovider.User{&user1, &user2} {
+		err = dataprovider.AddUser(u, "", "", "")
+		require.NoError(t, err)
+		err = os.MkdirAll(u.GetHomeDir(), os.ModePerm)
+		assert.NoError(t, err)
+		err = os.WriteFile(filepath.Join(u.GetHomeDir(), "file.txt"), []byte("tenant"), 0666)
+		assert.NoError(t, err)
+	}
+	err = executeRuleAction(rule.Actions[0].BaseEventAction, &EventParams{}, rule.Conditions.Options)
+	assert.NoError(t, err)
+	userGet, err := dataprovider.UserExists(user1.Username, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, userGet.UsedQuotaFiles)
+	userGet, err = dataprovider.UserExists(user2.Username, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, userGet.UsedQuotaFiles)
+	// actions are global, the rule cannot execute them after a change
+	userQuotaAction.Type = dataprovider.ActionTypeBackup
+	err = dataprovider.UpdateEventAction(&userQuotaAction, "", "", "")
+	assert.NoError(t, err)
+	rule, err = dataprovider.EventRuleExists(rule.Name)
+	require.NoError(t, err)
+	err = rule.CheckActionsConsistency("")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "is not allowed for tenant rules")
+	}
+	// the folder quota reset only affects the folders matching the role conditions
+	folder1 := vfs.BaseVirtualFolder{
+		Name:       "tenant_folder1",
+		MappedPath: filepath.Join(os.TempDir(), "tenant_folder1"),
+		Role:       role1.Name,
+	}
+	folder2 := vfs.BaseVirtualFolder{
+		Name:       "tenant_folder2",
+		MappedPath: filepath.Join(os.TempDir(), "tenant_folder2"),
+		Role:       role2.Name,
+	}
+	for _, f := range []*vfs.BaseVirtualFolder{&folder1, &folder2} {
+		err = dataprovider.AddFolder(f, "", "", "")
+		require.NoError(t, err)
+		err = os.MkdirAll(f.MappedPath, os.ModePerm)
+		assert.NoError(t, err)
+		err = os.WriteFile(filepath.Join(f.MappedPath, "file.txt"), []byte("tenant"), 0666)
+		assert.NoError(t, err)
+	}
+	err = executeRuleAction(folderQuotaAction, &EventParams{}, rule.Conditions.Options)
+	assert.NoError(t, err)
+	folderGet, err := dataprovider.GetFolderByName(folder1.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, folderGet.UsedQuotaFiles)
+	folderGet, err = dataprovider.GetFolderByName(folder2.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, folderGet.UsedQuotaFiles)
+
+	err = dataprovider.DeleteEventRule(rule.Name, "", "", "")
+	assert.NoError(t, err)
+	for _, a := range []string{backupAction.Name, folderQuotaAction.Name, workflowAction.Name, userQuotaAction.Name} {
+		err = dataprovider.DeleteEventAction(a, "", "", "")
+		assert.NoError(t, err)
+	}
+	for _, u := range []dataprovider.User{user1, user2} {
+		err = dataprovider.DeleteUser(u.Username, "", "", "")
+		assert.NoError(t, err)
+		err = os.RemoveAll(u.GetHomeDir())
+		assert.NoError(t, err)
+	}
+	for _, f := range []vfs.BaseVirtualFolder{folder1, folder2} {
+		err = dataprovider.DeleteFolder(f.Name, "", "", "")
+		assert.NoError(t, err)
+		err = os.RemoveAll(f.MappedPath)
+		assert.NoError(t, err)
+	}
+	err = dataprovider.DeleteRole(role1.Name, "", "", "")
+	assert.NoError(t, err)
+	err = dataprovider.DeleteRole(role2.Name, "", "", "")
+	assert.NoError(t, err)
+}
+
 func TestGetFileContent(t *testing.T) {
 	username := "test_user_get_file_content"
 	user := dataprovider.User{
@@ -1947,6 +2124,20 @@ func TestEventParamsCopy(t *testing.T) {
 	assert.Equal(t, params.IDPCustomFields, paramsCopy.IDPCustomFields)
 	(*paramsCopy.IDPCustomFields)["field1"] = "val2"
 	assert.NotEqual(t, params.IDPCustomFields, paramsCopy.IDPCustomFields)
+	params.UploadFields = &map[string]string{
+		"ref": "123",
+	}
+	paramsCopy = params.getACopy()
+	assert.Equal(t, params.UploadFields, paramsCopy.UploadFields)
+	(*paramsCopy.UploadFields)["ref"] = "456"
+	assert.NotEqual(t, params.UploadFields, paramsCopy.UploadFields)
+	replacer := strings.NewReplacer(params.getStringReplacements(false, false)...)
+	assert.Equal(t, `123 {"ref":"123"}`, replacer.Replace("{{UploadFieldref}} {{UploadMetadata}}"))
+	replacer = strings.NewReplacer(paramsCopy.getStringReplacements(false, true)...)
+	assert.Equal(t, `456 {\"ref\":\"456\"}`, replacer.Replace("{{UploadFieldref}} {{UploadMetadata}}"))
+	params.UploadFields = nil
+	replacer = strings.NewReplacer(params.getStringReplacements(false, false)...)
+	assert.Empty(t, replacer.Replace("{{UploadMetadata}}"))
 }
 
 func TestEventParamsStatusFromError(t *testing.T) {
@@ -1990,6 +2181,37 @@ func TestWriteHTTPPartsError(t *testing.T) {
 	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
 }
 
+func TestEventParamsCorrelationID(t *testing.T) {
+	params := EventParams{
+		Name:          "user",
+		CorrelationID: "SFTP_connID",
+	}
+	replacer := strings.NewReplacer(params.getStringReplacements(false, false)...)
+	assert.Equal(t, "id SFTP_connID", replacer.Replace("id {{CorrelationID}}"))
+
+	req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1/hook", nil)
+	require.NoError(t, err)
+	c := dataprovider.EventActionHTTPConfig{
+		Password: kms.NewEmptySecret(),
+		Headers: []dataprovider.KeyValue{
+			{
+				Key:   "X-User",
+				Value: "{{Name}}",
+			},
+		},
+	}
+	setHTTPReqHeaders(req, &c, replacer, "", params.CorrelationID)
+	assert.Equal(t, "SFTP_connID", req.Header.Get(logger.CorrelationIDHeader))
+	assert.Equal(t, "user", req.Header.Get("X-User"))
+	// the correlation ID can be overridden using a custom header
+	c.Headers = append(c.Headers, dataprovider.KeyValue{
+		Key:   logger.CorrelationIDHeader,
+		Value: "custom",
+	})
+	setHTTPReqHeaders(req, &c, replacer, "", params.CorrelationID)
+	assert.Equal(t, "custom", req.Header.Get(logger.CorrelationIDHeader))
+}
+
 func TestReplacePathsPlaceholders(t *testing.T) {
 	replacer := strings.NewReplacer("{{VirtualPath}}", "/path1")
 	paths := []string{"{{VirtualPath}}", "/path1"}
@@ -2062,13 +2284,13 @@ func TestOnDemandRule(t *testing.T) {
 	err = dataprovider.AddEventRule(r, "", "", "")
 	assert.NoError(t, err)
 
-	err = RunOnDemandRule(r.Name)
+	err = RunOnDemandRule(context.Background(), r.Name)
 	assert.NoError(t, err)
 
 	r.Status = 0
 	err = dataprovider.UpdateEventRule(r, "", "", "")
 	assert.NoError(t, err)
-	err = RunOnDemandRule(r.Name)
+	err = RunOnDemandRule(context.Background(), r.Name)
 	assert.ErrorIs(t, err, util.ErrValidation)
 	assert.Contains(t, err.Error(), "is inactive")
 
@@ -2076,7 +2298,7 @@ func TestOnDemandRule(t *testing.T) {
 	r.Trigger = dataprovider.EventTriggerCertificate
 	err = dataprovider.UpdateEventRule(r, "", "", "")
 	assert.NoError(t, err)
-	err = RunOnDemandRule(r.Name)
+	err = RunOnDemandRule(context.Background(), r.Name)
 	assert.ErrorIs(t, err, util.ErrValidation)
 	assert.Contains(t, err.Error(), "is not defined as on-demand")
 
@@ -2105,7 +2327,7 @@ func TestOnDemandRule(t *testing.T) {
 	}
 	err = dataprovider.UpdateEventRule(r, "", "", "")
 	assert.NoError(t, err)
-	err = RunOnDemandRule(r.Name)
+	err = RunOnDemandRule(context.Background(), r.Name)
 	assert.ErrorIs(t, err, util.ErrValidation)
 	assert.Contains(t, err.Error(), "incosistent actions")
 
@@ -2116,7 +2338,7 @@ func TestOnDemandRule(t *testing.T) {
 	err = dataprovider.DeleteEventAction(a1.Name, "", "", "")
 	assert.NoError(t, err)
 
-	err = RunOnDemandRule(r.Name)
+	err = RunOnDemandRule(context.Background(), r.Name)
 	assert.ErrorIs(t, err, util.ErrNotFound)
 }
 
@@ -2156,3 +2378,160 @@ func TestHTTPEndpointWithPlaceholders(t *testing.T) {
 	expected = c.Endpoint + "?p=" + url.QueryEscape(vPath) + "&u=" + url.QueryEscape(name)
 	assert.Equal(t, expected, u)
 }
+
+func TestEventParamsTemplatePlaceholders(t *testing.T) {
+	ts := time.Date(2023, time.March, 5, 23, 30, 0, 0, time.UTC)
+	params := EventParams{
+		Name:        "user",
+		VirtualPath: "/dir/file.tar.gz",
+		ObjectName:  "file.tar.gz",
+		Timestamp:   ts.UnixNano(),
+		sender:      "user",
+	}
+	replacer := strings.NewReplacer(params.getStringReplacements(false, false)...)
+	assert.Equal(t, "/archive/2023-03-05/user.gz", replacer.Replace("/archive/{{Date}}/{{Username}}{{Ext}}"))
+	// the username is only available for filesystem and user provider events
+	params.ObjectType = "folder"
+	params.ObjectName = "folder"
+	replacer = strings.NewReplacer(params.getStringReplacements(false, false)...)
+	assert.Equal(t, "[]", replacer.Replace("[{{Username}}{{Ext}}]"))
+	params.ObjectType = "user"
+	replacer = strings.NewReplacer(params.getStringReplacements(false, false)...)
+	assert.Equal(t, "[user]", replacer.Replace("[{{Username}}]"))
+	params.sender = dataprovider.ActionExecutorSystem
+	replacer = strings.NewReplacer(params.getStringReplacements(false, false)...)
+	assert.Equal(t, "[]", replacer.Replace("[{{Username}}]"))
+}
+
+func getPGPTestKeys(t *testing.T) (*openpgp.Entity, string, string) {
+	entity, err := openpgp.NewEntity("test", "", "test@example.com", nil)
+	require.NoError(t, err)
+	var pub, priv bytes.Buffer
+	w, err := armor.Encode(&pub, openpgp.PublicKeyType, nil)
+	require.NoError(t, err)
+	require.NoError(t, entity.Serialize(w))
+	require.NoError(t, w.Close())
+	w, err = armor.Encode(&priv, openpgp.PrivateKeyType, nil)
+	require.NoError(t, err)
+	require.NoError(t, entity.SerializePrivate(w, nil))
+	require.NoError(t, w.Close())
+	return entity, pub.String(), priv.String()
+}
+
+func TestPGPEncryptFsAction(t *testing.T) {
+	entity, publicKey, privateKey := getPGPTestKeys(t)
+	action := dataprovider.BaseEventAction{
+		Name: "pgp encrypt",
+		Type: dataprovider.ActionTypeFilesystem,
+		Options: dataprovider.BaseEventActionOptions{
+			FsConfig: dataprovider.EventActionFilesystemConfig{
+				Type: dataprovider.FilesystemActionPGPEncrypt,
+			},
+		},
+	}
+	err := dataprovider.AddEventAction(&action, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	action.Options.FsConfig.PGPEncrypt.Paths = []dataprovider.KeyValue{
+		{
+			Key:   "{{VirtualPath}}",
+			Value: "{{VirtualPath}}",
+		},
+	}
+	action.Options.FsConfig.PGPEncrypt.PublicKey = publicKey
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	action.Options.FsConfig.PGPEncrypt.Paths = []dataprovider.KeyValue{
+		{
+			Key: "{{VirtualPath}}",
+		},
+		{
+			Key:   "/static.txt",
+			Value: "/enc/{{Date}}/{{Username}}{{Ext}}.pgp",
+		},
+	}
+	action.Options.FsConfig.PGPEncrypt.PublicKey = "invalid"
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	action.Options.FsConfig.PGPEncrypt.PublicKey = privateKey
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	if assert.ErrorIs(t, err, util.ErrValidation) {
+		assert.Contains(t, err.Error(), "private key is not allowed")
+	}
+	action.Options.FsConfig.PGPEncrypt.PublicKey = publicKey
+	action.Options.FsConfig.PGPEncrypt.RemoveSource = true
+	action.Options.FsConfig.Copy = []dataprovider.KeyValue{
+		{
+			Key:   "/a",
+			Value: "/b",
+		},
+	}
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	require.NoError(t, err)
+	action, err = dataprovider.EventActionExists(action.Name)
+	require.NoError(t, err)
+	assert.Len(t, action.Options.FsConfig.Copy, 0)
+	c := action.Options.FsConfig.PGPEncrypt
+	if assert.Len(t, c.Paths, 2) {
+		assert.Equal(t, "/{{VirtualPath}}.pgp", c.Paths[0].Value)
+	}
+
+	username := "test_user_pgp_encrypt"
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: username,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+			HomeDir: filepath.Join(os.TempDir(), username),
+		},
+	}
+	err = dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+	err = os.MkdirAll(user.GetHomeDir(), os.ModePerm)
+	require.NoError(t, err)
+	content := []byte("secret content")
+	err = os.WriteFile(filepath.Join(user.GetHomeDir(), "file.txt"), content, 0666)
+	require.NoError(t, err)
+
+	ts := time.Date(2023, time.March, 5, 10, 0, 0, 0, time.UTC)
+	params := &EventParams{
+		Name:        username,
+		VirtualPath: "/file.txt",
+		ObjectName:  "file.txt",
+		Timestamp:   ts.UnixNano(),
+		sender:      username,
+	}
+	// static.txt does not exist
+	err = executeFsRuleAction(action.Options.FsConfig, dataprovider.ConditionOptions{}, params)
+	assert.Error(t, err)
+	// the first file is encrypted and removed anyway
+	assert.NoFileExists(t, filepath.Join(user.GetHomeDir(), "file.txt"))
+	assert.FileExists(t, filepath.Join(user.GetHomeDir(), "file.txt.pgp"))
+	err = os.WriteFile(filepath.Join(user.GetHomeDir(), "static.txt"), content, 0666)
+	require.NoError(t, err)
+	c.Paths = c.Paths[1:]
+	err = executePGPEncryptFsRuleAction(c, strings.NewReplacer(params.getStringReplacements(false, false)...),
+		dataprovider.ConditionOptions{}, params)
+	require.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(user.GetHomeDir(), "static.txt"))
+	for _, p := range []string{"file.txt.pgp", filepath.Join("enc", "2023-03-05", username+".txt.pgp")} {
+		encrypted, err := os.ReadFile(filepath.Join(user.GetHomeDir(), p))
+		require.NoError(t, err)
+		md, err := openpgp.ReadMessage(bytes.NewReader(encrypted), openpgp.EntityList{entity}, nil, nil)
+		require.NoError(t, err)
+		assert.True(t, md.IsEncrypted)
+		decrypted, err := io.ReadAll(md.UnverifiedBody)
+		require.NoError(t, err)
+		assert.Equal(t, content, decrypted)
+	}
+	c.PublicKey = ""
+	err = executePGPEncryptFsRuleAction(c, strings.NewReplacer(), dataprovider.ConditionOptions{}, params)
+	assert.Error(t, err)
+
+	err = dataprovider.DeleteEventAction(action.Name, "", "", "")
+	assert.NoError(t, err)
+	err = dataprovider.DeleteUser(username, "", "", "")
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
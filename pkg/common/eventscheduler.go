@@ -40,5 +40,10 @@ func startEventScheduler() {
 	eventManager.loadRules()
 	_, err := eventScheduler.AddFunc("@every 10m", eventManager.loadRules)
 	util.PanicOnError(err)
+	_, err = eventScheduler.AddFunc("@every 5m", sendEventDigests)
+	util.PanicOnError(err)
+	retentionPolicies.init()
+	_, err = eventScheduler.AddFunc("@every 1m", retentionPolicies.check)
+	util.PanicOnError(err)
 	eventScheduler.Start()
 }
@@ -0,0 +1,334 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zip"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+// Supported formats for server side archive extraction
+const (
+	extractFormatZip   = "zip"
+	extractFormatTar   = "tar"
+	extractFormatTarGz = "tar.gz"
+)
+
+// getExtractFormat returns the archive format based on the file extension
+func getExtractFormat(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return extractFormatZip
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return extractFormatTarGz
+	case strings.HasSuffix(name, ".tar"):
+		return extractFormatTar
+	default:
+		return ""
+	}
+}
+
+type archiveExtractor struct {
+	conn        *BaseConnection
+	archivePath string
+	targetDir   string
+	// directories known to exist
+	dirs  map[string]bool
+	files int
+	size  int64
+}
+
+// getEntryPath returns the virtual path for the specified archive entry,
+// an empty string means that the entry must be skipped
+func (e *archiveExtractor) getEntryPath(name string) (string, error) {
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("archive entry %q is outside the target directory: %w", name,
+				e.conn.GetPermissionDeniedError())
+		}
+	}
+	entryPath := path.Clean("/" + name)
+	if entryPath == "/" {
+		return "", nil
+	}
+	entryPath = path.Join(e.targetDir, entryPath)
+	if entryPath == e.archivePath {
+		return "", fmt.Errorf("archive entry %q overwrites the archive: %w", name, e.conn.GetOpUnsupportedError())
+	}
+	return entryPath, nil
+}
+
+// ensureDir creates the specified directory, and any missing parent, if it
+// does not exist
+func (e *archiveExtractor) ensureDir(virtualPath string) error {
+	if e.dirs[virtualPath] {
+		return nil
+	}
+	info, err := e.conn.DoStat(virtualPath, 1, false)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("cannot extract into %q, it is not a directory: %w", virtualPath,
+				e.conn.GetOpUnsupportedError())
+		}
+		e.dirs[virtualPath] = true
+		return nil
+	}
+	if !e.conn.IsNotExistError(err) {
+		return err
+	}
+	if err := e.ensureDir(path.Dir(virtualPath)); err != nil {
+		return err
+	}
+	if err := e.conn.CreateDir(virtualPath, true); err != nil {
+		return fmt.Errorf("unable to create directory %q: %w", virtualPath, err)
+	}
+	e.dirs[virtualPath] = true
+	return nil
+}
+
+func (e *archiveExtractor) extractDir(name string) error {
+	virtualPath, err := e.getEntryPath(name)
+	if err != nil || virtualPath == "" {
+		return err
+	}
+	return e.ensureDir(virtualPath)
+}
+
+func (e *archiveExtractor) extractFile(name string, size int64, modTime time.Time, reader io.Reader) error {
+	virtualPath, err := e.getEntryPath(name)
+	if err != nil || virtualPath == "" {
+		return err
+	}
+	if ok, _ := e.conn.User.IsFileAllowed(virtualPath); !ok {
+		return fmt.Errorf("file %q is not allowed: %w", virtualPath, e.conn.GetPermissionDeniedError())
+	}
+	if err := e.ensureDir(path.Dir(virtualPath)); err != nil {
+		return err
+	}
+	writer, numFiles, truncatedSize, cancelFn, err := getFileWriter(e.conn, virtualPath, size)
+	if err != nil {
+		return fmt.Errorf("unable to get writer for path %q: %w", virtualPath, err)
+	}
+	defer cancelFn()
+
+	q, _ := e.conn.HasSpace(numFiles > 0, false, virtualPath)
+	maxWriteSize, _ := e.conn.GetMaxWriteSize(q, false, truncatedSize, false)
+	if maxWriteSize > 0 {
+		reader = io.LimitReader(reader, maxWriteSize+1)
+	}
+	var h hash.Hash
+	var w io.Writer = writer
+	checksumEnabled := e.conn.IsChecksumEnabled()
+	if checksumEnabled {
+		h = sha256.New()
+		w = io.MultiWriter(writer, h)
+	}
+	startTime := time.Now()
+	written, err := io.Copy(w, reader)
+	if err == nil && maxWriteSize > 0 && written > maxWriteSize {
+		err = e.conn.GetQuotaExceededError()
+	}
+	if err != nil {
+		writer.Close()
+		removePartialFile(e.conn, virtualPath, numFiles, truncatedSize)
+		return fmt.Errorf("unable to extract %q: %w", virtualPath, err)
+	}
+	if err := closeWriterAndUpdateQuota(writer, e.conn, virtualPath, "", numFiles, truncatedSize, nil,
+		operationUpload, startTime); err != nil {
+		return err
+	}
+	if checksumEnabled {
+		err = setFileChecksum(e.conn.User.Username, virtualPath, hex.EncodeToString(h.Sum(nil)), written)
+	} else if numFiles == 0 {
+		err = removeFileChecksum(e.conn.User.Username, virtualPath)
+	}
+	if err != nil {
+		e.conn.Log(logger.LevelWarn, "unable to update the checksum for file %q: %v", virtualPath, err)
+	}
+	e.setModTime(virtualPath, modTime)
+	e.files++
+	e.size += written
+	e.conn.progress.add(1, written)
+	return nil
+}
+
+// setModTime preserves, if possible, the modification time stored in the archive
+func (e *archiveExtractor) setModTime(virtualPath string, modTime time.Time) {
+	if modTime.IsZero() {
+		return
+	}
+	fs, fsPath, err := e.conn.GetFsAndResolvedPath(virtualPath)
+	if err != nil || e.conn.ignoreSetStat(fs) {
+		return
+	}
+	if err := fs.Chtimes(fsPath, modTime, modTime, false); err != nil {
+		e.conn.Log(logger.LevelDebug, "unable to set modification time for extracted file %q: %v", virtualPath, err)
+	}
+}
+
+func (e *archiveExtractor) extractZip(reader io.Reader, size int64) error {
+	readerAt, ok := reader.(io.ReaderAt)
+	if !ok {
+		// zip archives require random access, the archive is copied to a
+		// local temporary file
+		f, err := os.CreateTemp(vfs.GetTempPath(), "sftpgo-extract-*.zip")
+		if err != nil {
+			return fmt.Errorf("unable to create temporary file: %w", err)
+		}
+		defer func() {
+			f.Close()
+			os.Remove(f.Name())
+		}()
+
+		if size, err = io.Copy(f, reader); err != nil {
+			return fmt.Errorf("unable to read archive %q: %w", e.archivePath, err)
+		}
+		readerAt = f
+	}
+	zr, err := zip.NewReader(readerAt, size)
+	if err != nil {
+		return fmt.Errorf("unable to read zip archive %q: %v: %w", e.archivePath, err, e.conn.GetOpUnsupportedError())
+	}
+	for _, f := range zr.File {
+		mode := f.Mode()
+		if mode.IsDir() {
+			if err := e.extractDir(f.Name); err != nil {
+				return err
+			}
+			continue
+		}
+		if !mode.IsRegular() {
+			e.conn.Log(logger.LevelInfo, "skipping extraction for non regular file %q", f.Name)
+			continue
+		}
+		if err := e.extractZipFile(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *archiveExtractor) extractZipFile(f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("unable to open archive entry %q: %w", f.Name, err)
+	}
+	defer rc.Close()
+
+	return e.extractFile(f.Name, int64(f.UncompressedSize64), f.Modified, rc)
+}
+
+func (e *archiveExtractor) extractTar(reader io.Reader, compressed bool) error {
+	if compressed {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return fmt.Errorf("unable to read gzip archive %q: %v: %w", e.archivePath, err, e.conn.GetOpUnsupportedError())
+		}
+		defer gz.Close()
+
+		reader = gz
+	}
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read tar archive %q: %v: %w", e.archivePath, err, e.conn.GetOpUnsupportedError())
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = e.extractDir(hdr.Name)
+		case tar.TypeReg:
+			err = e.extractFile(hdr.Name, hdr.Size, hdr.ModTime, tr)
+		default:
+			e.conn.Log(logger.LevelInfo, "skipping extraction for non regular file %q, type %q", hdr.Name,
+				string(hdr.Typeflag))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Extract expands the zip, tar or tar.gz archive at virtualArchivePath into
+// the virtualTargetDir directory, which is created if missing. Permissions,
+// file patterns and quota are checked, and fs events are executed, for each
+// extracted file and directory. Only directories and regular files are
+// extracted, existing files are overwritten
+func (c *BaseConnection) Extract(virtualArchivePath, virtualTargetDir string) error {
+	virtualArchivePath = path.Clean(virtualArchivePath)
+	virtualTargetDir = path.Clean(virtualTargetDir)
+	format := getExtractFormat(virtualArchivePath)
+	if format == "" {
+		return fmt.Errorf("unsupported archive %q, only zip, tar and tar.gz are supported: %w", virtualArchivePath,
+			c.GetOpUnsupportedError())
+	}
+	info, err := c.DoStat(virtualArchivePath, 1, false)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("archive %q is not a regular file: %w", virtualArchivePath, c.GetOpUnsupportedError())
+	}
+	if ok, policy := c.User.IsFileAllowed(virtualArchivePath); !ok {
+		return c.GetErrorForDeniedFile(policy)
+	}
+	reader, cancelFn, err := getFileReader(c, virtualArchivePath)
+	if err != nil {
+		return err
+	}
+	defer cancelFn()
+	defer reader.Close()
+
+	e := &archiveExtractor{
+		conn:        c,
+		archivePath: virtualArchivePath,
+		targetDir:   virtualTargetDir,
+		dirs:        make(map[string]bool),
+	}
+	if err := e.ensureDir(virtualTargetDir); err != nil {
+		return err
+	}
+	done := make(chan bool)
+	defer close(done)
+	go keepConnectionAlive(c, done, 2*time.Minute)
+
+	startTime := time.Now()
+	if format == extractFormatZip {
+		err = e.extractZip(reader, info.Size())
+	} else {
+		err = e.extractTar(reader, format == extractFormatTarGz)
+	}
+	c.Log(logger.LevelDebug, "archive %q extracted to %q, files: %d, size: %d, elapsed: %s, err: %v",
+		virtualArchivePath, virtualTargetDir, e.files, e.size, time.Since(startTime), err)
+	return err
+}
@@ -0,0 +1,282 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zip"
+	"github.com/rs/xid"
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+)
+
+type testArchiveEntry struct {
+	name    string
+	content string
+	isDir   bool
+	symlink bool
+}
+
+func createTestZip(t *testing.T, entries []testArchiveEntry) []byte {
+	buf := bytes.NewBuffer(nil)
+	wr := zip.NewWriter(buf)
+	for _, entry := range entries {
+		hdr := &zip.FileHeader{
+			Name:     entry.name,
+			Method:   zip.Deflate,
+			Modified: time.Now().Add(-time.Hour),
+		}
+		switch {
+		case entry.isDir:
+			hdr.SetMode(os.ModeDir | 0755)
+		case entry.symlink:
+			hdr.SetMode(os.ModeSymlink | 0777)
+		default:
+			hdr.SetMode(0644)
+		}
+		w, err := wr.CreateHeader(hdr)
+		require.NoError(t, err)
+		if !entry.isDir {
+			_, err = w.Write([]byte(entry.content))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, wr.Close())
+	return buf.Bytes()
+}
+
+func createTestTar(t *testing.T, entries []testArchiveEntry, compressed bool) []byte {
+	buf := bytes.NewBuffer(nil)
+	var w io.Writer = buf
+	var gz *gzip.Writer
+	if compressed {
+		gz = gzip.NewWriter(buf)
+		w = gz
+	}
+	wr := tar.NewWriter(w)
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name:    entry.name,
+			Mode:    0644,
+			ModTime: time.Now().Add(-time.Hour),
+		}
+		switch {
+		case entry.isDir:
+			hdr.Typeflag = tar.TypeDir
+			hdr.Mode = 0755
+		case entry.symlink:
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = entry.content
+		default:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(entry.content))
+		}
+		require.NoError(t, wr.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := wr.Write([]byte(entry.content))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, wr.Close())
+	if gz != nil {
+		require.NoError(t, gz.Close())
+	}
+	return buf.Bytes()
+}
+
+func TestExtractArchives(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "extract_home")
+	err := os.MkdirAll(homeDir, os.ModePerm)
+	require.NoError(t, err)
+	defer os.RemoveAll(homeDir)
+
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "extract_user",
+			HomeDir:  homeDir,
+			Permissions: map[string][]string{
+				"/":       {dataprovider.PermAny},
+				"/denied": {dataprovider.PermListItems, dataprovider.PermDownload},
+			},
+		},
+		Filters: dataprovider.UserFilters{
+			BaseUserFilters: sdk.BaseUserFilters{
+				FilePatterns: []sdk.PatternsFilter{
+					{
+						Path:            "/",
+						DeniedPatterns:  []string{"*.exe"},
+						DenyPolicy:      sdk.DenyPolicyDefault,
+						AllowedPatterns: []string{},
+					},
+				},
+			},
+		},
+	}
+	conn := NewBaseConnection(xid.New().String(), ProtocolHTTP, "", "", user)
+
+	entries := []testArchiveEntry{
+		{name: "dir/", isDir: true},
+		{name: "dir/file1.txt", content: "content1"},
+		{name: "dir/sub/file2.txt", content: "content2"},
+		{name: "./file3.txt", content: "content3"},
+		{name: "link", content: "/etc/passwd", symlink: true},
+	}
+	archives := map[string][]byte{
+		"archive.zip":    createTestZip(t, entries),
+		"archive.tar":    createTestTar(t, entries, false),
+		"archive.tar.gz": createTestTar(t, entries, true),
+		"archive.tgz":    createTestTar(t, entries, true),
+	}
+	for name, data := range archives {
+		err = os.WriteFile(filepath.Join(homeDir, name), data, 0644)
+		require.NoError(t, err)
+		target := "/extracted/" + name
+		err = conn.Extract("/"+name, target)
+		assert.NoError(t, err, name)
+		targetDir := filepath.Join(homeDir, "extracted", name)
+		for _, entry := range entries[1:4] {
+			data, err := os.ReadFile(filepath.Join(targetDir, entry.name))
+			if assert.NoError(t, err, name) {
+				assert.Equal(t, entry.content, string(data))
+			}
+		}
+		info, err := os.Stat(filepath.Join(targetDir, "dir", "file1.txt"))
+		if assert.NoError(t, err) {
+			assert.True(t, info.ModTime().Before(time.Now().Add(-30*time.Minute)))
+		}
+		assert.NoFileExists(t, filepath.Join(targetDir, "link"))
+		// existing files are overwritten
+		err = conn.Extract("/"+name, target)
+		assert.NoError(t, err, name)
+	}
+	// the archive can be extracted in the same directory
+	err = conn.Extract("/archive.zip", "/")
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(homeDir, "file3.txt"))
+
+	err = os.WriteFile(filepath.Join(homeDir, "archive.rar"), []byte("rar"), 0644)
+	assert.NoError(t, err)
+	err = conn.Extract("/archive.rar", "/dst")
+	assert.ErrorIs(t, err, ErrOpUnsupported)
+	err = os.WriteFile(filepath.Join(homeDir, "invalid.zip"), []byte("not a zip"), 0644)
+	assert.NoError(t, err)
+	err = conn.Extract("/invalid.zip", "/dst")
+	assert.ErrorIs(t, err, ErrOpUnsupported)
+	err = os.WriteFile(filepath.Join(homeDir, "invalid.tar.gz"), []byte("not a tar.gz"), 0644)
+	assert.NoError(t, err)
+	err = conn.Extract("/invalid.tar.gz", "/dst")
+	assert.ErrorIs(t, err, ErrOpUnsupported)
+	err = conn.Extract("/missing.zip", "/dst")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	err = os.Mkdir(filepath.Join(homeDir, "adir.zip"), os.ModePerm)
+	assert.NoError(t, err)
+	err = conn.Extract("/adir.zip", "/dst")
+	assert.ErrorIs(t, err, ErrOpUnsupported)
+	// the target must be a directory
+	err = conn.Extract("/archive.zip", "/file3.txt")
+	assert.ErrorIs(t, err, ErrOpUnsupported)
+	// write permissions are required
+	err = conn.Extract("/archive.zip", "/denied")
+	assert.ErrorIs(t, err, os.ErrPermission)
+	err = os.MkdirAll(filepath.Join(homeDir, "denied"), os.ModePerm)
+	assert.NoError(t, err)
+	err = conn.Extract("/archive.zip", "/denied")
+	assert.ErrorIs(t, err, os.ErrPermission)
+	assert.NoFileExists(t, filepath.Join(homeDir, "denied", "file3.txt"))
+	// entries outside the target directory are rejected
+	data := createTestTar(t, []testArchiveEntry{{name: "../../escaped.txt", content: "escaped"}}, false)
+	err = os.WriteFile(filepath.Join(homeDir, "escape.tar"), data, 0644)
+	assert.NoError(t, err)
+	err = conn.Extract("/escape.tar", "/dst/sub")
+	assert.ErrorIs(t, err, os.ErrPermission)
+	assert.NoFileExists(t, filepath.Join(homeDir, "escaped.txt"))
+	assert.NoFileExists(t, filepath.Join(homeDir, "dst", "escaped.txt"))
+	// denied file patterns
+	data = createTestZip(t, []testArchiveEntry{{name: "bin/file.exe", content: "exe"}})
+	err = os.WriteFile(filepath.Join(homeDir, "exe.zip"), data, 0644)
+	assert.NoError(t, err)
+	err = conn.Extract("/exe.zip", "/dst")
+	assert.ErrorIs(t, err, os.ErrPermission)
+	assert.NoFileExists(t, filepath.Join(homeDir, "dst", "bin", "file.exe"))
+	// an entry cannot overwrite the archive itself
+	data = createTestTar(t, []testArchiveEntry{{name: "self.tar", content: "self"}}, false)
+	err = os.WriteFile(filepath.Join(homeDir, "self.tar"), data, 0644)
+	assert.NoError(t, err)
+	err = conn.Extract("/self.tar", "/")
+	assert.ErrorIs(t, err, ErrOpUnsupported)
+	// background extract
+	op, err := FileOperations.Start(conn, FileOperationExtract, "/archive.tar.gz", "/background")
+	require.NoError(t, err)
+	op = waitFileOperation(t, user.Username, op.ID)
+	assert.Equal(t, FileOperationStatusCompleted, op.Status, op.Error)
+	assert.Equal(t, int64(3), op.Files)
+	assert.Equal(t, int64(24), op.Size)
+	assert.FileExists(t, filepath.Join(homeDir, "background", "dir", "sub", "file2.txt"))
+	_, err = FileOperations.Start(conn, FileOperationExtract, "/archive.tar.gz", "")
+	assert.Error(t, err)
+}
+
+func TestExtractZipWithoutRandomAccess(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "extract_home")
+	err := os.MkdirAll(homeDir, os.ModePerm)
+	require.NoError(t, err)
+	defer os.RemoveAll(homeDir)
+
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "extract_user",
+			HomeDir:  homeDir,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+	}
+	conn := NewBaseConnection(xid.New().String(), ProtocolHTTP, "", "", user)
+	data := createTestZip(t, []testArchiveEntry{{name: "a/b/file.txt", content: "content"}})
+	e := &archiveExtractor{
+		conn:        conn,
+		archivePath: "/archive.zip",
+		targetDir:   "/dst",
+		dirs:        make(map[string]bool),
+	}
+	// the archive is copied to a temporary file
+	err = e.extractZip(io.MultiReader(bytes.NewReader(data)), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, e.files)
+	assert.Equal(t, int64(7), e.size)
+	assert.FileExists(t, filepath.Join(homeDir, "dst", "a", "b", "file.txt"))
+
+	assert.Empty(t, getExtractFormat("/file.txt"))
+	assert.Equal(t, extractFormatTarGz, getExtractFormat("/FILE.TGZ"))
+	entryPath, err := e.getEntryPath("./")
+	assert.NoError(t, err)
+	assert.Empty(t, entryPath)
+	entryPath, err = e.getEntryPath("/abs/file")
+	assert.NoError(t, err)
+	assert.Equal(t, "/dst/abs/file", entryPath)
+	_, err = e.getEntryPath("a/../../file")
+	assert.Error(t, err)
+}
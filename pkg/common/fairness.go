@@ -0,0 +1,175 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/metric"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// Connection rejection reasons, used as metric labels
+const (
+	rejectReasonMaxTotal   = "max_total"
+	rejectReasonMaxPerHost = "max_per_host"
+	rejectReasonHostShare  = "host_share"
+	rejectReasonUserShare  = "user_share"
+	rejectReasonRoleShare  = "role_share"
+)
+
+// FairnessConfig defines the admission policy for client connections.
+// If the server is busy, the max_total_connections budget is shared between
+// hosts, users and roles so a single tenant cannot exhaust all the slots
+type FairnessConfig struct {
+	// Set to true to enable the admission policy. It requires max_total_connections > 0
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// The shares are enforced only if the active sessions are at least this
+	// percentage of max_total_connections. 0 means always
+	BusyThreshold int `json:"busy_threshold" mapstructure:"busy_threshold"`
+	// Maximum percentage of max_total_connections a single host (IP) can use.
+	// 0 means no limit
+	MaxHostShare int `json:"max_host_share" mapstructure:"max_host_share"`
+	// Maximum percentage of max_total_connections a single user can use.
+	// 0 means no limit
+	MaxUserShare int `json:"max_user_share" mapstructure:"max_user_share"`
+	// Roles share the budget proportionally to their weight, only the roles with
+	// active sessions are considered. Users without a role are grouped together.
+	// Each entry has the format "role:weight", for example "tenant1:3"
+	RoleWeights []string `json:"role_weights" mapstructure:"role_weights"`
+	// Weight for roles not included in role_weights. 0 disables the per role share
+	DefaultWeight int `json:"default_weight" mapstructure:"default_weight"`
+	weights       map[string]int
+}
+
+func (c *FairnessConfig) isEnabled() bool {
+	return c.Enabled && Config.MaxTotalConnections > 0
+}
+
+func (c *FairnessConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.BusyThreshold < 0 || c.BusyThreshold > 100 {
+		return fmt.Errorf("fairness: invalid busy threshold %d", c.BusyThreshold)
+	}
+	if c.MaxHostShare < 0 || c.MaxHostShare > 100 {
+		return fmt.Errorf("fairness: invalid max host share %d", c.MaxHostShare)
+	}
+	if c.MaxUserShare < 0 || c.MaxUserShare > 100 {
+		return fmt.Errorf("fairness: invalid max user share %d", c.MaxUserShare)
+	}
+	if c.DefaultWeight < 0 {
+		return fmt.Errorf("fairness: invalid default weight %d", c.DefaultWeight)
+	}
+	c.weights = make(map[string]int)
+	for _, rw := range c.RoleWeights {
+		role, weight, ok := strings.Cut(strings.TrimSpace(rw), ":")
+		if !ok {
+			return fmt.Errorf("fairness: invalid role weight %q", rw)
+		}
+		val, err := strconv.Atoi(weight)
+		if err != nil || val <= 0 {
+			return fmt.Errorf("fairness: invalid weight for role %q: %q", role, weight)
+		}
+		c.weights[role] = val
+	}
+	if Config.MaxTotalConnections == 0 {
+		logger.Warn(logSender, "", "fairness enabled but max_total_connections is unlimited, it will have no effect")
+	}
+	return nil
+}
+
+func (c *FairnessConfig) getWeight(role string) int {
+	if w, ok := c.weights[role]; ok {
+		return w
+	}
+	return c.DefaultWeight
+}
+
+// getMaxShare returns the number of sessions corresponding to the specified
+// percentage of max_total_connections, at least 1
+func getMaxShare(percentage int) int {
+	share := Config.MaxTotalConnections * percentage / 100
+	if share < 1 {
+		return 1
+	}
+	return share
+}
+
+// checkAdmission returns an error if adding a connection with the specified
+// username, role and IP exceeds the allowed shares.
+// It must be called within a locked block
+func (c *FairnessConfig) checkAdmission(conns *ActiveConnections, username, role, ipAddr string) error {
+	if !c.isEnabled() || username == "" {
+		return nil
+	}
+	total := len(conns.connections)
+	if total*100 < Config.MaxTotalConnections*c.BusyThreshold {
+		return nil
+	}
+	if c.MaxUserShare > 0 {
+		maxSessions := getMaxShare(c.MaxUserShare)
+		if val := conns.perUserConns[username]; val >= maxSessions {
+			metric.AddRejectedConnection(rejectReasonUserShare)
+			return fmt.Errorf("%w: user %q has %d/%d sessions and the server is busy", ErrConnectionDenied,
+				username, val, maxSessions)
+		}
+	}
+	hostSessions := 0
+	roleSessions := 0
+	activeRoles := map[string]bool{role: true}
+	for _, conn := range conns.connections {
+		if conn.GetUsername() == "" {
+			continue
+		}
+		if util.GetIPFromRemoteAddress(conn.GetRemoteAddress()) == ipAddr {
+			hostSessions++
+		}
+		connRole := conn.GetRole()
+		if connRole == role {
+			roleSessions++
+		}
+		activeRoles[connRole] = true
+	}
+	if c.MaxHostShare > 0 {
+		if maxSessions := getMaxShare(c.MaxHostShare); hostSessions >= maxSessions {
+			metric.AddRejectedConnection(rejectReasonHostShare)
+			return fmt.Errorf("%w: host %q has %d/%d sessions and the server is busy", ErrConnectionDenied,
+				ipAddr, hostSessions, maxSessions)
+		}
+	}
+	weight := c.getWeight(role)
+	if weight == 0 {
+		return nil
+	}
+	totalWeight := 0
+	for r := range activeRoles {
+		totalWeight += c.getWeight(r)
+	}
+	maxSessions := Config.MaxTotalConnections * weight / totalWeight
+	if maxSessions < 1 {
+		maxSessions = 1
+	}
+	if roleSessions >= maxSessions {
+		metric.AddRejectedConnection(rejectReasonRoleShare)
+		return fmt.Errorf("%w: role %q has %d/%d sessions and the server is busy", ErrConnectionDenied,
+			role, roleSessions, maxSessions)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+)
+
+type fairnessTestConnection struct {
+	*fakeConnection
+	remoteAddr string
+}
+
+func (c *fairnessTestConnection) GetRemoteAddress() string {
+	return c.remoteAddr
+}
+
+func newFairnessTestConnection(id, username, role, ip string) *fairnessTestConnection {
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: username,
+			Role:     role,
+		},
+	}
+	return &fairnessTestConnection{
+		fakeConnection: &fakeConnection{
+			BaseConnection: NewBaseConnection(id, ProtocolSFTP, "", "", user),
+		},
+		remoteAddr: ip + ":1234",
+	}
+}
+
+func TestFairnessConfigValidate(t *testing.T) {
+	c := FairnessConfig{}
+	assert.NoError(t, c.validate())
+	c.Enabled = true
+	c.BusyThreshold = 101
+	assert.Error(t, c.validate())
+	c.BusyThreshold = 50
+	c.MaxHostShare = -1
+	assert.Error(t, c.validate())
+	c.MaxHostShare = 10
+	c.MaxUserShare = 200
+	assert.Error(t, c.validate())
+	c.MaxUserShare = 10
+	c.DefaultWeight = -1
+	assert.Error(t, c.validate())
+	c.DefaultWeight = 1
+	c.RoleWeights = []string{"role1"}
+	assert.Error(t, c.validate())
+	c.RoleWeights = []string{"role1:a"}
+	assert.Error(t, c.validate())
+	c.RoleWeights = []string{"role1:0"}
+	assert.Error(t, c.validate())
+	c.RoleWeights = []string{" role1:3", "role2:2"}
+	require.NoError(t, c.validate())
+	assert.Equal(t, 3, c.getWeight("role1"))
+	assert.Equal(t, 2, c.getWeight("role2"))
+	assert.Equal(t, 1, c.getWeight("role3"))
+}
+
+func TestConnectionsFairness(t *testing.T) {
+	oldMaxTotal := Config.MaxTotalConnections
+	oldFairness := Config.Fairness
+
+	Config.MaxTotalConnections = 10
+	Config.Fairness = FairnessConfig{
+		Enabled:       true,
+		BusyThreshold: 50,
+		MaxUserShare:  30,
+		MaxHostShare:  40,
+		RoleWeights:   []string{"role1:3"},
+		DefaultWeight: 1,
+	}
+	require.NoError(t, Config.Fairness.validate())
+
+	var added []string
+	add := func(id, username, role, ip string) error {
+		c := newFairnessTestConnection(id, username, role, ip)
+		err := Connections.Add(c)
+		if err == nil {
+			added = append(added, c.GetID())
+		}
+		return err
+	}
+	// below the busy threshold any connection is allowed
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, add(fmt.Sprintf("u1_%d", i), "user1", "role1", "127.0.0.1"))
+	}
+	// user1 has 5 sessions, max user share is 3
+	err := add("u1_5", "user1", "role1", "127.0.0.2")
+	assert.ErrorIs(t, err, ErrConnectionDenied)
+	assert.Contains(t, err.Error(), "user")
+	// the host has 5 sessions, max host share is 4
+	err = add("u2_0", "user2", "role1", "127.0.0.1")
+	assert.ErrorIs(t, err, ErrConnectionDenied)
+	assert.Contains(t, err.Error(), "host")
+	// role1 has 5 sessions, while alone its share is the full budget
+	assert.NoError(t, add("u2_0", "user2", "role1", "127.0.0.2"))
+	// role2 is now active: role1 share is 10*3/4 = 7, role2 share is 10*1/4 = 2
+	assert.NoError(t, add("u3_0", "user3", "role2", "127.0.0.3"))
+	assert.NoError(t, add("u4_0", "user4", "role2", "127.0.0.4"))
+	err = add("u5_0", "user5", "role2", "127.0.0.5")
+	assert.ErrorIs(t, err, ErrConnectionDenied)
+	assert.Contains(t, err.Error(), "role")
+	assert.NoError(t, add("u2_1", "user2", "role1", "127.0.0.2"))
+	// role1 has 7 sessions
+	err = add("u6_0", "user6", "role1", "127.0.0.6")
+	assert.ErrorIs(t, err, ErrConnectionDenied)
+	// not logged in connections are not checked
+	assert.NoError(t, add("anonymous", "", "", "127.0.0.1"))
+	// swapping a not logged in connection checks the shares
+	err = Connections.Swap(newFairnessTestConnection("anonymous", "user6", "role1", "127.0.0.6"))
+	assert.ErrorIs(t, err, ErrConnectionDenied)
+	assert.Equal(t, 0, Connections.GetActiveSessions("user6"))
+	// with a weight of 0 the per role share is disabled
+	Config.Fairness.DefaultWeight = 0
+	assert.NoError(t, add("u5_0", "user5", "role2", "127.0.0.5"))
+
+	for _, id := range added {
+		Connections.Remove(id)
+	}
+	assert.Len(t, Connections.GetStats(""), 0)
+
+	Config.MaxTotalConnections = oldMaxTotal
+	Config.Fairness = oldFairness
+}
@@ -0,0 +1,131 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"errors"
+	"path"
+
+	"github.com/sftpgo/sdk"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// GetFileMetadata returns the custom metadata for the specified virtual path.
+// The path must exist and be visible to the connection's user
+func (c *BaseConnection) GetFileMetadata(virtualPath string) (dataprovider.FileMetadata, error) {
+	if !c.User.HasPerm(dataprovider.PermListItems, path.Dir(virtualPath)) {
+		return dataprovider.FileMetadata{}, c.GetPermissionDeniedError()
+	}
+	if _, err := c.DoStat(virtualPath, 0, true); err != nil {
+		return dataprovider.FileMetadata{}, err
+	}
+	return dataprovider.GetFileMetadata(c.User.Username, virtualPath)
+}
+
+// SetFileMetadata adds or replaces the custom metadata for an existing file
+// or directory. Empty metadata and tags remove any existing custom metadata.
+// The overwrite permission is required
+func (c *BaseConnection) SetFileMetadata(metadata *dataprovider.FileMetadata) error {
+	if metadata.Path == "/" {
+		return c.GetPermissionDeniedError()
+	}
+	if !c.User.HasPerm(dataprovider.PermOverwrite, path.Dir(metadata.Path)) {
+		return c.GetPermissionDeniedError()
+	}
+	if _, err := c.DoStat(metadata.Path, 0, true); err != nil {
+		return err
+	}
+	return dataprovider.SetFileMetadata(c.User.Username, metadata)
+}
+
+// SearchFilesMetadata returns the custom metadata for the files and directories
+// inside virtualPath matching all the specified tags and key/value pairs.
+// Paths not visible to the connection's user are excluded
+func (c *BaseConnection) SearchFilesMetadata(virtualPath string, tags []string, metadata map[string]string,
+) ([]dataprovider.FileMetadata, error) {
+	if !c.User.HasPerm(dataprovider.PermListItems, virtualPath) {
+		return nil, c.GetPermissionDeniedError()
+	}
+	files, err := dataprovider.GetFilesMetadata(c.User.Username, virtualPath)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]dataprovider.FileMetadata, 0, len(files))
+	for idx := range files {
+		m := &files[idx]
+		if !m.Match(tags, metadata) || !c.User.HasPerm(dataprovider.PermListItems, path.Dir(m.Path)) {
+			continue
+		}
+		if ok, policy := c.User.IsFileAllowed(m.Path); !ok && policy == sdk.DenyPolicyHide {
+			continue
+		}
+		result = append(result, *m)
+	}
+	return result, nil
+}
+
+// updateFilesMetadata keeps the custom files metadata in sync after
+// successful delete and rename operations and stores the custom fields
+// submitted with uploads. Copies are handled in BaseConnection.Copy so
+// the whole copied tree is processed once
+func updateFilesMetadata(conn *BaseConnection, operation, virtualPath, virtualTarget string, err error) {
+	if err != nil {
+		return
+	}
+	switch operation {
+	case operationDelete:
+		err = dataprovider.DeleteFileMetadata(conn.User.Username, virtualPath, false)
+	case operationRmdir:
+		err = dataprovider.DeleteFileMetadata(conn.User.Username, virtualPath, true)
+	case operationRename:
+		err = dataprovider.RenameFileMetadata(conn.User.Username, virtualPath, virtualTarget)
+	case operationUpload:
+		err = addUploadFieldsMetadata(conn, virtualPath)
+	default:
+		return
+	}
+	if err != nil {
+		conn.Log(logger.LevelWarn, "unable to update custom metadata after %s operation on %q: %v",
+			operation, virtualPath, err)
+	}
+}
+
+// addUploadFieldsMetadata merges the custom fields submitted with an upload
+// into the existing metadata for the uploaded file
+func addUploadFieldsMetadata(conn *BaseConnection, virtualPath string) error {
+	fields := conn.getUploadFields()
+	if fields == nil {
+		return nil
+	}
+	metadata, err := dataprovider.GetFileMetadata(conn.User.Username, virtualPath)
+	if err != nil {
+		if !errors.Is(err, util.ErrNotFound) {
+			return err
+		}
+		metadata = dataprovider.FileMetadata{
+			Path: virtualPath,
+		}
+	}
+	if metadata.Metadata == nil {
+		metadata.Metadata = make(map[string]string)
+	}
+	for k, v := range *fields {
+		metadata.Metadata[k] = v
+	}
+	return dataprovider.SetFileMetadata(conn.User.Username, &metadata)
+}
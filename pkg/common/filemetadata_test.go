@@ -0,0 +1,135 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+func TestFileMetadata(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "metadata_home")
+	err := os.MkdirAll(filepath.Join(homeDir, "dir", "sub"), os.ModePerm)
+	require.NoError(t, err)
+	for _, name := range []string{"dir/file1", "dir/sub/file2", "other"} {
+		err = os.WriteFile(filepath.Join(homeDir, name), []byte("data"), 0666)
+		require.NoError(t, err)
+	}
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "metadata_user",
+			HomeDir:  homeDir,
+			Status:   1,
+			Permissions: map[string][]string{
+				"/":      {dataprovider.PermAny},
+				"/other": {dataprovider.PermListItems},
+			},
+		},
+	}
+	err = dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+	conn := NewBaseConnection("", ProtocolHTTP, "", "", user)
+
+	_, err = conn.GetFileMetadata("/dir/file1")
+	assert.ErrorIs(t, err, util.ErrNotFound)
+	err = conn.SetFileMetadata(&dataprovider.FileMetadata{Path: "/missing", Tags: []string{"a"}})
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	err = conn.SetFileMetadata(&dataprovider.FileMetadata{Path: "/", Tags: []string{"a"}})
+	assert.ErrorIs(t, err, os.ErrPermission)
+	err = conn.SetFileMetadata(&dataprovider.FileMetadata{
+		Path:     "/dir/file1",
+		Metadata: map[string]string{strings.Repeat("k", 200): "v"},
+	})
+	assert.ErrorIs(t, err, util.ErrValidation)
+
+	err = conn.SetFileMetadata(&dataprovider.FileMetadata{
+		Path:     "/dir/file1",
+		Metadata: map[string]string{"author": "john", "project": "p1"},
+		Tags:     []string{"tag2", "tag1", "tag2"},
+	})
+	require.NoError(t, err)
+	err = conn.SetFileMetadata(&dataprovider.FileMetadata{
+		Path: "/dir/sub",
+		Tags: []string{"tag1"},
+	})
+	require.NoError(t, err)
+	metadata, err := conn.GetFileMetadata("/dir/file1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tag1", "tag2"}, metadata.Tags)
+	assert.Equal(t, "john", metadata.Metadata["author"])
+	assert.Greater(t, metadata.UpdatedAt, int64(0))
+
+	results, err := conn.SearchFilesMetadata("/", []string{"tag1"}, nil)
+	require.NoError(t, err)
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, "/dir/file1", results[0].Path)
+		assert.Equal(t, "/dir/sub", results[1].Path)
+	}
+	results, err = conn.SearchFilesMetadata("/", nil, map[string]string{"author": "", "project": "p1"})
+	require.NoError(t, err)
+	assert.Len(t, results, 1)
+	results, err = conn.SearchFilesMetadata("/dir/sub", []string{"tag1"}, nil)
+	require.NoError(t, err)
+	assert.Len(t, results, 1)
+	results, err = conn.SearchFilesMetadata("/", []string{"tag3"}, nil)
+	require.NoError(t, err)
+	assert.Len(t, results, 0)
+	// the overwrite permission is required to set metadata
+	err = conn.SetFileMetadata(&dataprovider.FileMetadata{Path: "/other/file", Tags: []string{"a"}})
+	assert.ErrorIs(t, err, os.ErrPermission)
+	// copy and rename propagate the metadata
+	err = conn.Copy("/dir", "/copy")
+	require.NoError(t, err)
+	metadata, err = conn.GetFileMetadata("/copy/file1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tag1", "tag2"}, metadata.Tags)
+	_, err = conn.GetFileMetadata("/copy/sub")
+	assert.NoError(t, err)
+	err = conn.Rename("/copy", "/renamed")
+	require.NoError(t, err)
+	_, err = conn.GetFileMetadata("/renamed/file1")
+	assert.NoError(t, err)
+	_, err = dataprovider.GetFileMetadata(user.Username, "/copy/file1")
+	assert.ErrorIs(t, err, util.ErrNotFound)
+	// removing files and directories removes the metadata
+	err = conn.RemoveAll("/renamed")
+	require.NoError(t, err)
+	results, err = dataprovider.GetFilesMetadata(user.Username, "/renamed")
+	require.NoError(t, err)
+	assert.Len(t, results, 0)
+	// empty metadata and tags remove the existing ones
+	err = conn.SetFileMetadata(&dataprovider.FileMetadata{Path: "/dir/sub"})
+	require.NoError(t, err)
+	_, err = conn.GetFileMetadata("/dir/sub")
+	assert.ErrorIs(t, err, util.ErrNotFound)
+
+	err = dataprovider.DeleteUser(user.Username, "", "", "")
+	assert.NoError(t, err)
+	results, err = dataprovider.GetFilesMetadata(user.Username, "/")
+	require.NoError(t, err)
+	assert.Len(t, results, 0)
+
+	err = os.RemoveAll(homeDir)
+	assert.NoError(t, err)
+}
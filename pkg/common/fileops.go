@@ -0,0 +1,345 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// Supported background file operations
+const (
+	FileOperationCopy    = "copy"
+	FileOperationMove    = "move"
+	FileOperationDelete  = "delete"
+	FileOperationExtract = "extract"
+)
+
+// Background file operation statuses
+const (
+	FileOperationStatusRunning   = "running"
+	FileOperationStatusCompleted = "completed"
+	FileOperationStatusFailed    = "failed"
+)
+
+const (
+	fileOpsLogSender = "fileops"
+	// maximum number of concurrent background file operations for each user
+	maxRunningFileOperations = 5
+	// completed file operations are kept for this duration
+	fileOperationsRetention = time.Hour
+)
+
+var (
+	// ErrTooManyFileOperations is returned if the user has too many
+	// background file operations in progress
+	ErrTooManyFileOperations = errors.New("too many file operations in progress")
+	// FileOperations tracks the background file operations
+	FileOperations = &fileOperationsManager{
+		operations: make(map[string]*fileOperation),
+	}
+	supportedFileOperations = []string{FileOperationCopy, FileOperationMove, FileOperationDelete,
+		FileOperationExtract}
+)
+
+// fileOperationProgress tracks the files processed by a connection running a
+// background operation. All the methods are safe to call on a nil receiver
+type fileOperationProgress struct {
+	files    atomic.Int64
+	size     atomic.Int64
+	canceled atomic.Bool
+}
+
+func (p *fileOperationProgress) add(files int, size int64) {
+	if p == nil {
+		return
+	}
+	p.files.Add(int64(files))
+	p.size.Add(size)
+}
+
+func (p *fileOperationProgress) cancel() {
+	if p == nil {
+		return
+	}
+	p.canceled.Store(true)
+}
+
+// checkCanceled returns ErrJobCanceled if the operation was canceled, long
+// operations call it between files so they can stop as soon as possible
+func (p *fileOperationProgress) checkCanceled() error {
+	if p == nil || !p.canceled.Load() {
+		return nil
+	}
+	return ErrJobCanceled
+}
+
+// FileOperation defines a server side recursive file operation running in background
+type FileOperation struct {
+	ID string `json:"id"`
+	// Operation type: copy, move, delete, extract
+	Type   string `json:"type"`
+	Source string `json:"source"`
+	Target string `json:"target,omitempty"`
+	// Operation status: running, completed, failed
+	Status string `json:"status"`
+	// Number of files and bytes processed so far
+	Files int64 `json:"files"`
+	Size  int64 `json:"size"`
+	// Number of files and bytes to process. They are available for copy
+	// operations once the source has been scanned
+	TotalFiles int64 `json:"total_files,omitempty"`
+	TotalSize  int64 `json:"total_size,omitempty"`
+	// Error details if the operation failed
+	Error string `json:"error,omitempty"`
+	// Start and end time as unix timestamp in milliseconds
+	StartTime int64 `json:"start_time"`
+	EndTime   int64 `json:"end_time,omitempty"`
+}
+
+type fileOperation struct {
+	sync.RWMutex
+	username string
+	info     FileOperation
+	progress fileOperationProgress
+}
+
+func (o *fileOperation) getInfo() FileOperation {
+	o.RLock()
+	defer o.RUnlock()
+
+	info := o.info
+	info.Files = o.progress.files.Load()
+	info.Size = o.progress.size.Load()
+	return info
+}
+
+func (o *fileOperation) isRunning() bool {
+	o.RLock()
+	defer o.RUnlock()
+
+	return o.info.Status == FileOperationStatusRunning
+}
+
+func (o *fileOperation) isExpired() bool {
+	o.RLock()
+	defer o.RUnlock()
+
+	return o.info.Status != FileOperationStatusRunning &&
+		o.info.EndTime < util.GetTimeAsMsSinceEpoch(time.Now().Add(-fileOperationsRetention))
+}
+
+func (o *fileOperation) setTotals(files int, size int64) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.info.TotalFiles = int64(files)
+	o.info.TotalSize = size
+}
+
+func (o *fileOperation) setDone(err error) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.info.EndTime = util.GetTimeAsMsSinceEpoch(time.Now())
+	if err != nil {
+		o.info.Status = FileOperationStatusFailed
+		o.info.Error = err.Error()
+		return
+	}
+	o.info.Status = FileOperationStatusCompleted
+}
+
+type fileOperationsManager struct {
+	sync.RWMutex
+	operations map[string]*fileOperation
+}
+
+// Start validates and starts the specified file operation in background.
+// conn is the connection requesting the operation, it is not used after
+// this method returns
+func (m *fileOperationsManager) Start(conn *BaseConnection, opType, source, target string) (FileOperation, error) {
+	if !util.Contains(supportedFileOperations, opType) {
+		return FileOperation{}, util.NewValidationError(fmt.Sprintf("unsupported file operation %q", opType))
+	}
+	if source == "/" && (opType == FileOperationMove || opType == FileOperationDelete) {
+		return FileOperation{}, util.NewValidationError("the root directory cannot be moved or deleted")
+	}
+	if opType == FileOperationDelete {
+		target = ""
+	} else if target == "" {
+		return FileOperation{}, util.NewValidationError("the target path is mandatory")
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.removeExpired()
+	running := 0
+	for _, op := range m.operations {
+		if op.username == conn.User.Username && op.isRunning() {
+			running++
+		}
+	}
+	if running >= maxRunningFileOperations {
+		return FileOperation{}, ErrTooManyFileOperations
+	}
+	op := &fileOperation{
+		username: conn.User.Username,
+		info: FileOperation{
+			ID:        xid.New().String(),
+			Type:      opType,
+			Source:    source,
+			Target:    target,
+			Status:    FileOperationStatusRunning,
+			StartTime: util.GetTimeAsMsSinceEpoch(time.Now()),
+		},
+	}
+	m.operations[op.info.ID] = op
+	// the requesting connection could be closed before the operation ends
+	// so we use a dedicated connection
+	opConn := NewBaseConnection(op.info.ID, conn.protocol, conn.localAddr, conn.remoteAddr, conn.User)
+	opConn.progress = &op.progress
+	go m.run(opConn, op)
+
+	return op.getInfo(), nil
+}
+
+func (m *fileOperationsManager) run(conn *BaseConnection, op *fileOperation) {
+	defer conn.CloseFS() //nolint:errcheck
+
+	info := op.getInfo()
+	conn.Log(logger.LevelInfo, "starting background %s operation, id %q, source %q, target %q",
+		info.Type, info.ID, info.Source, info.Target)
+
+	var err error
+	switch info.Type {
+	case FileOperationCopy:
+		m.scanCopySource(conn, op)
+		err = conn.Copy(info.Source, info.Target)
+	case FileOperationMove:
+		if conn.IsSameResource(info.Source, info.Target) {
+			err = conn.Rename(info.Source, info.Target)
+		} else {
+			err = conn.Copy(info.Source, info.Target)
+			if err == nil {
+				err = conn.RemoveAll(info.Source)
+			}
+		}
+	case FileOperationDelete:
+		err = conn.RemoveAll(info.Source)
+	case FileOperationExtract:
+		err = conn.Extract(info.Source, info.Target)
+	}
+	op.setDone(err)
+
+	info = op.getInfo()
+	logger.Debug(fileOpsLogSender, conn.GetID(), "background %s operation %q completed, files: %d, size: %d, "+
+		"elapsed: %d ms, err: %v", info.Type, info.ID, info.Files, info.Size, info.EndTime-info.StartTime, err)
+}
+
+// scanCopySource sets the totals for a copy operation. Errors are ignored,
+// they will be reported by the copy itself
+func (m *fileOperationsManager) scanCopySource(conn *BaseConnection, op *fileOperation) {
+	source := path.Clean(op.getInfo().Source)
+	info, err := conn.DoStat(source, 1, false)
+	if err != nil {
+		return
+	}
+	files, size, err := getFilesAndSizeForPath(conn, source, info)
+	if err != nil {
+		conn.Log(logger.LevelDebug, "unable to scan copy source %q: %v", source, err)
+		return
+	}
+	op.setTotals(files, size)
+}
+
+// getFilesAndSizeForPath returns the number of regular files and their size
+// for the specified virtual path, directories are scanned recursively
+func getFilesAndSizeForPath(conn *BaseConnection, p string, info os.FileInfo) (int, int64, error) {
+	if info.IsDir() {
+		var numFiles int
+		var size int64
+		entries, err := conn.ListDir(p)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, entry := range entries {
+			entryFiles, entrySize, err := getFilesAndSizeForPath(conn, path.Join(p, entry.Name()), entry)
+			if err != nil {
+				return 0, 0, err
+			}
+			numFiles += entryFiles
+			size += entrySize
+		}
+		return numFiles, size, nil
+	}
+	if info.Mode().IsRegular() {
+		return 1, info.Size(), nil
+	}
+	return 0, 0, nil
+}
+
+// removeExpired must be called with the lock held
+func (m *fileOperationsManager) removeExpired() {
+	for id, op := range m.operations {
+		if op.isExpired() {
+			delete(m.operations, id)
+		}
+	}
+}
+
+// Get returns the file operation with the specified id for the given user
+func (m *fileOperationsManager) Get(username, id string) (FileOperation, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	op, ok := m.operations[id]
+	if !ok || op.username != username {
+		return FileOperation{}, util.NewRecordNotFoundError(fmt.Sprintf("file operation %q not found", id))
+	}
+	return op.getInfo(), nil
+}
+
+// GetAll returns the file operations for the given user, sorted by start time
+func (m *fileOperationsManager) GetAll(username string) []FileOperation {
+	m.RLock()
+	defer m.RUnlock()
+
+	result := make([]FileOperation, 0)
+	for _, op := range m.operations {
+		if op.username == username {
+			result = append(result, op.getInfo())
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].StartTime == result[j].StartTime {
+			return result[i].ID < result[j].ID
+		}
+		return result[i].StartTime < result[j].StartTime
+	})
+	return result
+}
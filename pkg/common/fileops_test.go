@@ -0,0 +1,203 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+type mockBatchRemoverFs struct {
+	vfs.Fs
+	batches [][]string
+}
+
+func (fs *mockBatchRemoverFs) RemoveFiles(names []string) error {
+	fs.batches = append(fs.batches, names)
+	for _, name := range names {
+		if err := fs.Remove(name, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func waitFileOperation(t *testing.T, username, id string) FileOperation {
+	var op FileOperation
+	assert.Eventually(t, func() bool {
+		var err error
+		op, err = FileOperations.Get(username, id)
+		return err == nil && op.Status != FileOperationStatusRunning
+	}, 5*time.Second, 50*time.Millisecond)
+	return op
+}
+
+func TestBackgroundFileOperations(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "fileops_home")
+	err := os.MkdirAll(filepath.Join(homeDir, "src", "sub"), os.ModePerm)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(homeDir, "src", "file1"), []byte("data"), 0666)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(homeDir, "src", "sub", "file2"), []byte("more data"), 0666)
+	require.NoError(t, err)
+
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "fileops_user",
+			HomeDir:  homeDir,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+	}
+	conn := NewBaseConnection(xid.New().String(), ProtocolHTTP, "", "", user)
+
+	_, err = FileOperations.Start(conn, "unknown", "/src", "/dst")
+	assert.Error(t, err)
+	_, err = FileOperations.Start(conn, FileOperationDelete, "/", "")
+	assert.Error(t, err)
+	_, err = FileOperations.Start(conn, FileOperationCopy, "/src", "")
+	assert.Error(t, err)
+
+	op, err := FileOperations.Start(conn, FileOperationCopy, "/src", "/copy")
+	require.NoError(t, err)
+	assert.Equal(t, FileOperationStatusRunning, op.Status)
+	op = waitFileOperation(t, user.Username, op.ID)
+	assert.Equal(t, FileOperationStatusCompleted, op.Status, op.Error)
+	assert.Equal(t, int64(2), op.Files)
+	assert.Equal(t, int64(13), op.Size)
+	assert.FileExists(t, filepath.Join(homeDir, "copy", "sub", "file2"))
+
+	op, err = FileOperations.Start(conn, FileOperationMove, "/copy", "/moved")
+	require.NoError(t, err)
+	op = waitFileOperation(t, user.Username, op.ID)
+	assert.Equal(t, FileOperationStatusCompleted, op.Status, op.Error)
+	assert.NoDirExists(t, filepath.Join(homeDir, "copy"))
+	assert.FileExists(t, filepath.Join(homeDir, "moved", "file1"))
+
+	op, err = FileOperations.Start(conn, FileOperationDelete, "/moved", "/ignored")
+	require.NoError(t, err)
+	assert.Empty(t, op.Target)
+	op = waitFileOperation(t, user.Username, op.ID)
+	assert.Equal(t, FileOperationStatusCompleted, op.Status, op.Error)
+	assert.Equal(t, int64(2), op.Files)
+	assert.NoDirExists(t, filepath.Join(homeDir, "moved"))
+
+	op, err = FileOperations.Start(conn, FileOperationDelete, "/missing", "")
+	require.NoError(t, err)
+	op = waitFileOperation(t, user.Username, op.ID)
+	assert.Equal(t, FileOperationStatusFailed, op.Status)
+	assert.NotEmpty(t, op.Error)
+	assert.NotZero(t, op.EndTime)
+
+	ops := FileOperations.GetAll(user.Username)
+	assert.Len(t, ops, 4)
+	assert.Empty(t, FileOperations.GetAll("other_user"))
+	_, err = FileOperations.Get("other_user", op.ID)
+	var notFoundErr *util.RecordNotFoundError
+	assert.ErrorAs(t, err, &notFoundErr)
+	// expired operations are removed
+	FileOperations.Lock()
+	FileOperations.operations[op.ID].info.EndTime = util.GetTimeAsMsSinceEpoch(time.Now().Add(-2 * fileOperationsRetention))
+	FileOperations.removeExpired()
+	FileOperations.Unlock()
+	_, err = FileOperations.Get(user.Username, op.ID)
+	assert.Error(t, err)
+	// too many running operations
+	FileOperations.Lock()
+	for i := 0; i < maxRunningFileOperations; i++ {
+		id := xid.New().String()
+		FileOperations.operations[id] = &fileOperation{
+			username: user.Username,
+			info: FileOperation{
+				ID:     id,
+				Status: FileOperationStatusRunning,
+			},
+		}
+	}
+	FileOperations.Unlock()
+	_, err = FileOperations.Start(conn, FileOperationCopy, "/src", "/copy")
+	assert.ErrorIs(t, err, ErrTooManyFileOperations)
+
+	FileOperations.Lock()
+	FileOperations.operations = make(map[string]*fileOperation)
+	FileOperations.Unlock()
+
+	err = os.RemoveAll(homeDir)
+	assert.NoError(t, err)
+}
+
+func TestBatchRemove(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "batch_remove_home")
+	err := os.MkdirAll(filepath.Join(homeDir, "dir", "sub"), os.ModePerm)
+	require.NoError(t, err)
+	for _, name := range []string{"a", "b", "sub/c"} {
+		err = os.WriteFile(filepath.Join(homeDir, "dir", name), []byte("data"), 0666)
+		require.NoError(t, err)
+	}
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "batch_remove_user",
+			HomeDir:  homeDir,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+	}
+	fs := &mockBatchRemoverFs{
+		Fs: vfs.NewOsFs("", homeDir, "", nil),
+	}
+	conn := NewBaseConnection("", ProtocolHTTP, "", "", user)
+	conn.progress = &fileOperationProgress{}
+	info, err := os.Stat(filepath.Join(homeDir, "dir"))
+	require.NoError(t, err)
+	err = conn.doRecursiveRemove(fs, filepath.Join(homeDir, "dir"), "/dir", info)
+	assert.NoError(t, err)
+	assert.NoDirExists(t, filepath.Join(homeDir, "dir"))
+	// sub directories are resolved using the user's filesystem, so only
+	// the files in the top level directory are removed using the mock
+	if assert.Len(t, fs.batches, 1) {
+		assert.Len(t, fs.batches[0], 2)
+	}
+	assert.Equal(t, int64(3), conn.progress.files.Load())
+	assert.Equal(t, int64(12), conn.progress.size.Load())
+
+	// files not allowed are not removed
+	err = os.MkdirAll(filepath.Join(homeDir, "dir"), os.ModePerm)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(homeDir, "dir", "file.txt"), []byte("data"), 0666)
+	require.NoError(t, err)
+	user.Permissions["/dir"] = []string{dataprovider.PermListItems}
+	conn = NewBaseConnection("", ProtocolHTTP, "", "", user)
+	fs.batches = nil
+	err = conn.removeFiles(fs, "/dir", []os.FileInfo{vfs.NewFileInfo("file.txt", false, 4, time.Now(), false)})
+	assert.ErrorIs(t, err, os.ErrPermission)
+	assert.Empty(t, fs.batches)
+	assert.FileExists(t, filepath.Join(homeDir, "dir", "file.txt"))
+
+	err = os.RemoveAll(homeDir)
+	assert.NoError(t, err)
+}
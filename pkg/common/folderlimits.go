@@ -0,0 +1,153 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/time/rate"
+
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+var folderLimits = newFolderLimitsManager()
+
+// folderTransfers tracks the active transfers for a virtual folder with limits
+type folderTransfers struct {
+	name            string
+	transfers       int
+	uploadLimiter   *rate.Limiter
+	downloadLimiter *rate.Limiter
+}
+
+// folderLimitsManager enforces the virtual folders limits.
+// Limits are enforced for each SFTPGo instance, they are not shared within a cluster
+type folderLimitsManager struct {
+	sync.Mutex
+	folders map[string]*folderTransfers
+}
+
+func newFolderLimitsManager() *folderLimitsManager {
+	return &folderLimitsManager{
+		folders: make(map[string]*folderTransfers),
+	}
+}
+
+// isLimitReached returns true if no more transfers are allowed for the specified folder
+func (m *folderLimitsManager) isLimitReached(name string, limits *vfs.FolderLimits) bool {
+	if limits == nil || limits.MaxConcurrentTransfers <= 0 {
+		return false
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	f, ok := m.folders[name]
+	return ok && f.transfers >= limits.MaxConcurrentTransfers
+}
+
+// add registers a new transfer for the specified folder and returns the tracking
+// struct to use for throttling. ErrFolderTransfers is returned if the maximum
+// number of concurrent transfers is reached
+func (m *folderLimitsManager) add(name string, limits *vfs.FolderLimits) (*folderTransfers, error) {
+	if !limits.HasLimits() {
+		return nil, nil
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	f, ok := m.folders[name]
+	if !ok {
+		f = &folderTransfers{
+			name: name,
+		}
+		m.folders[name] = f
+	}
+	if limits.MaxConcurrentTransfers > 0 && f.transfers >= limits.MaxConcurrentTransfers {
+		return nil, ErrFolderTransfers
+	}
+	f.transfers++
+	// the limits are updated using the ones of the most recent transfer, this way
+	// folder updates apply to the ongoing transfers too
+	f.uploadLimiter = getFolderLimiter(f.uploadLimiter, limits.UploadBandwidth)
+	f.downloadLimiter = getFolderLimiter(f.downloadLimiter, limits.DownloadBandwidth)
+	return f, nil
+}
+
+func (m *folderLimitsManager) remove(f *folderTransfers) {
+	m.Lock()
+	defer m.Unlock()
+
+	f.transfers--
+	if f.transfers <= 0 {
+		delete(m.folders, f.name)
+	}
+}
+
+func (m *folderLimitsManager) getLimiter(f *folderTransfers, transferType int) *rate.Limiter {
+	m.Lock()
+	defer m.Unlock()
+
+	if transferType == TransferDownload {
+		return f.downloadLimiter
+	}
+	return f.uploadLimiter
+}
+
+// getActiveTransfers returns the number of active transfers for the specified folder
+func (m *folderLimitsManager) getActiveTransfers(name string) int {
+	m.Lock()
+	defer m.Unlock()
+
+	if f, ok := m.folders[name]; ok {
+		return f.transfers
+	}
+	return 0
+}
+
+// getFolderLimiter returns a limiter for the specified bandwidth, as KB/s.
+// The existing limiter is updated, if any
+func getFolderLimiter(limiter *rate.Limiter, bandwidth int64) *rate.Limiter {
+	if bandwidth <= 0 {
+		return nil
+	}
+	limit := rate.Limit(bandwidth * 1024)
+	burst := int(bandwidth * 1024)
+	if limiter == nil {
+		return rate.NewLimiter(limit, burst)
+	}
+	if limiter.Limit() != limit {
+		limiter.SetLimit(limit)
+		limiter.SetBurst(burst)
+	}
+	return limiter
+}
+
+// waitBandwidthLimiter waits until the limiter allows the specified number of bytes.
+// The wait is split in chunks so it stops as soon as the transfer is aborted
+func waitBandwidthLimiter(limiter *rate.Limiter, n int64, isAborted func() bool) {
+	for n > 0 && !isAborted() {
+		size := n
+		if burst := int64(limiter.Burst()); size > burst {
+			size = burst
+		}
+		if err := limiter.WaitN(context.Background(), int(size)); err != nil {
+			return
+		}
+		n -= size
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	// events buffered for each subscriber, if a subscriber is too slow
+	// the new events are dropped
+	fsEventsQueueSize = 100
+)
+
+// FsEventSubscriptions allows to receive the filesystem events for a user
+var FsEventSubscriptions = newFsEventsHub()
+
+// UserFsEvent defines a filesystem event as seen by the user that generated it
+type UserFsEvent struct {
+	Action            string `json:"action"`
+	VirtualPath       string `json:"virtual_path"`
+	VirtualTargetPath string `json:"virtual_target_path,omitempty"`
+	FileSize          int64  `json:"file_size,omitempty"`
+	// 1 means no error, 2 means a generic error occurred, 3 means quota exceeded error
+	Status    int    `json:"status"`
+	Protocol  string `json:"protocol"`
+	SessionID string `json:"session_id"`
+	// Unix timestamp in milliseconds
+	Timestamp int64 `json:"timestamp"`
+}
+
+// FsEventSubscription is a subscription to the filesystem events of a user
+type FsEventSubscription struct {
+	id       string
+	username string
+	events   chan UserFsEvent
+	dropped  atomic.Int64
+}
+
+// Events returns the channel to receive the events from, it is closed
+// when the subscription is removed
+func (s *FsEventSubscription) Events() <-chan UserFsEvent {
+	return s.events
+}
+
+// Dropped returns the number of events dropped because the subscriber was too slow
+func (s *FsEventSubscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+type fsEventsHub struct {
+	numSubscriptions atomic.Int32
+	sync.RWMutex
+	subscriptions map[string]map[string]*FsEventSubscription
+}
+
+func newFsEventsHub() *fsEventsHub {
+	return &fsEventsHub{
+		subscriptions: make(map[string]map[string]*FsEventSubscription),
+	}
+}
+
+// Subscribe returns a new subscription to the filesystem events for the specified user
+func (h *fsEventsHub) Subscribe(username string) *FsEventSubscription {
+	sub := &FsEventSubscription{
+		id:       util.GenerateUniqueID(),
+		username: username,
+		events:   make(chan UserFsEvent, fsEventsQueueSize),
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	userSubs, ok := h.subscriptions[username]
+	if !ok {
+		userSubs = make(map[string]*FsEventSubscription)
+		h.subscriptions[username] = userSubs
+	}
+	userSubs[sub.id] = sub
+	h.numSubscriptions.Add(1)
+	return sub
+}
+
+// Unsubscribe removes the specified subscription and closes its events channel
+func (h *fsEventsHub) Unsubscribe(sub *FsEventSubscription) {
+	h.Lock()
+	defer h.Unlock()
+
+	userSubs, ok := h.subscriptions[sub.username]
+	if !ok {
+		return
+	}
+	if _, ok := userSubs[sub.id]; !ok {
+		return
+	}
+	delete(userSubs, sub.id)
+	if len(userSubs) == 0 {
+		delete(h.subscriptions, sub.username)
+	}
+	h.numSubscriptions.Add(-1)
+	close(sub.events)
+}
+
+func (h *fsEventsHub) publish(username string, event UserFsEvent) {
+	if h.numSubscriptions.Load() == 0 {
+		return
+	}
+
+	h.RLock()
+	defer h.RUnlock()
+
+	for _, sub := range h.subscriptions[username] {
+		select {
+		case sub.events <- event:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+func publishUserFsEvent(conn *BaseConnection, operation, virtualPath, virtualTarget string, fileSize int64, err error) {
+	FsEventSubscriptions.publish(conn.User.Username, UserFsEvent{
+		Action:            operation,
+		VirtualPath:       virtualPath,
+		VirtualTargetPath: virtualTarget,
+		FileSize:          fileSize,
+		Status:            conn.getNotificationStatus(err),
+		Protocol:          conn.protocol,
+		SessionID:         conn.ID,
+		Timestamp:         util.GetTimeAsMsSinceEpoch(time.Now()),
+	})
+}
@@ -0,0 +1,87 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+)
+
+func TestFsEventSubscriptions(t *testing.T) {
+	hub := newFsEventsHub()
+	// no subscriptions, nothing to do
+	hub.publish("user1", UserFsEvent{Action: operationMkdir})
+
+	sub1 := hub.Subscribe("user1")
+	sub2 := hub.Subscribe("user1")
+	sub3 := hub.Subscribe("user2")
+	assert.Equal(t, int32(3), hub.numSubscriptions.Load())
+	hub.publish("user1", UserFsEvent{Action: operationMkdir, VirtualPath: "/dir"})
+	for _, sub := range []*FsEventSubscription{sub1, sub2} {
+		require.Len(t, sub.Events(), 1)
+		ev := <-sub.Events()
+		assert.Equal(t, operationMkdir, ev.Action)
+		assert.Equal(t, "/dir", ev.VirtualPath)
+	}
+	assert.Len(t, sub3.Events(), 0)
+	// events are dropped if the subscriber is too slow
+	for i := 0; i < fsEventsQueueSize+5; i++ {
+		hub.publish("user2", UserFsEvent{Action: operationUpload})
+	}
+	assert.Len(t, sub3.Events(), fsEventsQueueSize)
+	assert.Equal(t, int64(5), sub3.Dropped())
+
+	hub.Unsubscribe(sub1)
+	_, ok := <-sub1.Events()
+	assert.False(t, ok)
+	// unsubscribing twice must not panic
+	hub.Unsubscribe(sub1)
+	hub.Unsubscribe(sub2)
+	hub.Unsubscribe(sub3)
+	assert.Equal(t, int32(0), hub.numSubscriptions.Load())
+	assert.Len(t, hub.subscriptions, 0)
+}
+
+func TestPublishUserFsEvent(t *testing.T) {
+	conn := NewBaseConnection("id", ProtocolSFTP, "", "", dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "test_fs_events_user",
+		},
+	})
+	sub := FsEventSubscriptions.Subscribe(conn.User.Username)
+	defer FsEventSubscriptions.Unsubscribe(sub)
+
+	publishUserFsEvent(conn, operationRename, "/a", "/b", 0, nil)
+	publishUserFsEvent(conn, operationUpload, "/file", "", 10, errors.New("error"))
+	require.Len(t, sub.Events(), 2)
+	ev := <-sub.Events()
+	assert.Equal(t, operationRename, ev.Action)
+	assert.Equal(t, "/a", ev.VirtualPath)
+	assert.Equal(t, "/b", ev.VirtualTargetPath)
+	assert.Equal(t, 1, ev.Status)
+	assert.Equal(t, ProtocolSFTP, ev.Protocol)
+	assert.Equal(t, conn.ID, ev.SessionID)
+	assert.Greater(t, ev.Timestamp, int64(0))
+	ev = <-sub.Events()
+	assert.Equal(t, operationUpload, ev.Action)
+	assert.Equal(t, int64(10), ev.FileSize)
+	assert.Equal(t, 2, ev.Status)
+}
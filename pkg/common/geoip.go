@@ -0,0 +1,100 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"github.com/drakkan/sftpgo/v2/pkg/geoip"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// GeoIPConfig defines the configuration for the IP geolocation
+type GeoIPConfig struct {
+	// Absolute path to a MaxMind DB file, for example a GeoLite2 Country or
+	// City database. Empty means disabled. The database is loaded again on
+	// reload, so it can be kept up to date using geoipupdate
+	DatabasePath string `json:"database_path" mapstructure:"database_path"`
+	// If set, only clients from the specified countries can connect.
+	// Countries are defined using ISO 3166-1 alpha-2 codes, for example "IT"
+	AllowedCountries []string `json:"allowed_countries" mapstructure:"allowed_countries"`
+	// Clients from the specified countries cannot connect
+	DeniedCountries []string `json:"denied_countries" mapstructure:"denied_countries"`
+}
+
+func (c *GeoIPConfig) initialize() error {
+	allowed, err := getCountryCodes(c.AllowedCountries)
+	if err != nil {
+		return err
+	}
+	denied, err := getCountryCodes(c.DeniedCountries)
+	if err != nil {
+		return err
+	}
+	c.AllowedCountries = allowed
+	c.DeniedCountries = denied
+	if c.DatabasePath == "" {
+		if len(c.AllowedCountries) > 0 || len(c.DeniedCountries) > 0 {
+			return fmt.Errorf("geoip: a database is required to allow or deny countries")
+		}
+		return geoip.Load("")
+	}
+	if !filepath.IsAbs(c.DatabasePath) {
+		return fmt.Errorf("geoip: invalid database path %q, it must be an absolute path", c.DatabasePath)
+	}
+	if err := geoip.Load(c.DatabasePath); err != nil {
+		return fmt.Errorf("geoip: %w", err)
+	}
+	logger.Info(logSender, "", "geoip database %q loaded", c.DatabasePath)
+	return nil
+}
+
+// isAllowed returns false if connections from the country of the specified IP
+// are not allowed. Loopback and private addresses are always allowed
+func (c *GeoIPConfig) isAllowed(ipAddr string) bool {
+	if len(c.AllowedCountries) == 0 && len(c.DeniedCountries) == 0 {
+		return true
+	}
+	ip := net.ParseIP(ipAddr)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() {
+		return true
+	}
+	if geoip.IsCountryMatched(ipAddr, c.DeniedCountries) {
+		return false
+	}
+	if len(c.AllowedCountries) > 0 {
+		return geoip.IsCountryMatched(ipAddr, c.AllowedCountries)
+	}
+	return true
+}
+
+func getCountryCodes(countries []string) ([]string, error) {
+	result := make([]string, 0, len(countries))
+	for _, country := range countries {
+		country = strings.ToUpper(strings.TrimSpace(country))
+		if country == "" {
+			continue
+		}
+		if !geoip.IsValidCountryCode(country) {
+			return nil, fmt.Errorf("geoip: invalid country code %q", country)
+		}
+		result = append(result, country)
+	}
+	return util.RemoveDuplicates(result, false), nil
+}
@@ -0,0 +1,282 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/geoip"
+)
+
+func appendMMDBControl(buf []byte, dataType, size int) []byte {
+	return append(buf, byte(dataType<<5|size))
+}
+
+func appendMMDBString(buf []byte, value string) []byte {
+	buf = appendMMDBControl(buf, 2, len(value))
+	return append(buf, value...)
+}
+
+// writeTestGeoIPDatabase writes a MaxMind DB file, with 24 bits records,
+// mapping the specified IPv4 networks to countries
+func writeTestGeoIPDatabase(t *testing.T, networks map[string]string) string {
+	const empty = -1
+	// values >= 0 are node indexes, values <= -2 are data indexes
+	nodes := [][2]int{{empty, empty}}
+	var data []byte
+	var dataOffsets []int
+	for network, country := range networks {
+		_, ipNet, err := net.ParseCIDR(network)
+		require.NoError(t, err)
+		ones, _ := ipNet.Mask.Size()
+		dataOffsets = append(dataOffsets, len(data))
+		dataIdx := -(len(dataOffsets) + 1)
+		data = appendMMDBControl(data, 7, 1)
+		data = appendMMDBString(data, "country")
+		data = appendMMDBControl(data, 7, 1)
+		data = appendMMDBString(data, "iso_code")
+		data = appendMMDBString(data, country)
+
+		// IPv4 networks are stored in the ::/96 subtree
+		ip := append(make([]byte, 12), ipNet.IP.To4()...)
+		node := 0
+		for i := 0; i < 96+ones; i++ {
+			bit := int(ip[i/8]>>(7-(i%8))) & 1
+			if i == 95+ones {
+				nodes[node][bit] = dataIdx
+				break
+			}
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+	nodeCount := len(nodes)
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		for _, value := range node {
+			var record int
+			switch {
+			case value == empty:
+				record = nodeCount
+			case value >= 0:
+				record = value
+			default:
+				record = nodeCount + 16 + dataOffsets[-value-2]
+			}
+			buf.Write([]byte{byte(record >> 16), byte(record >> 8), byte(record)})
+		}
+	}
+	buf.Write(make([]byte, 16))
+	buf.Write(data)
+	buf.WriteString("\xAB\xCD\xEFMaxMind.com")
+	metadata := appendMMDBControl(nil, 7, 4)
+	metadata = appendMMDBString(metadata, "node_count")
+	metadata = appendMMDBControl(metadata, 6, 4)
+	metadata = binary.BigEndian.AppendUint32(metadata, uint32(nodeCount))
+	metadata = appendMMDBString(metadata, "record_size")
+	metadata = appendMMDBControl(metadata, 5, 2)
+	metadata = binary.BigEndian.AppendUint16(metadata, 24)
+	metadata = appendMMDBString(metadata, "ip_version")
+	metadata = appendMMDBControl(metadata, 5, 2)
+	metadata = binary.BigEndian.AppendUint16(metadata, 6)
+	metadata = appendMMDBString(metadata, "database_type")
+	metadata = appendMMDBString(metadata, "Test-Country")
+	buf.Write(metadata)
+
+	dbPath := filepath.Join(os.TempDir(), "test_geoip.mmdb")
+	err := os.WriteFile(dbPath, buf.Bytes(), 0644)
+	require.NoError(t, err)
+	return dbPath
+}
+
+func TestGeoIPLookup(t *testing.T) {
+	dbPath := writeTestGeoIPDatabase(t, map[string]string{
+		"2.0.0.0/8":      "IT",
+		"3.0.0.0/16":     "us",
+		"3.1.0.0/16":     "DE",
+		"203.0.113.0/24": "FR",
+	})
+	defer os.Remove(dbPath)
+
+	reader, err := geoip.Open(dbPath)
+	require.NoError(t, err)
+	assert.Equal(t, "Test-Country", reader.DatabaseType())
+	country, err := reader.Country(net.ParseIP("2.1.1.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "IT", country)
+	country, err = reader.Country(net.ParseIP("3.0.200.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "US", country)
+	country, err = reader.Country(net.ParseIP("3.1.0.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "DE", country)
+	country, err = reader.Country(net.ParseIP("4.4.4.4"))
+	assert.NoError(t, err)
+	assert.Empty(t, country)
+	country, err = reader.Country(net.ParseIP("2001:db8::1"))
+	assert.NoError(t, err)
+	assert.Empty(t, country)
+
+	invalidPath := filepath.Join(os.TempDir(), "invalid_geoip.mmdb")
+	err = os.WriteFile(invalidPath, []byte("invalid"), 0644)
+	require.NoError(t, err)
+	defer os.Remove(invalidPath)
+	_, err = geoip.Open(invalidPath)
+	assert.Error(t, err)
+
+	assert.Empty(t, geoip.GetCountry("2.1.1.1"))
+	err = geoip.Load(invalidPath)
+	assert.Error(t, err)
+	err = geoip.Load(dbPath)
+	require.NoError(t, err)
+	assert.True(t, geoip.IsEnabled())
+	assert.Equal(t, "FR", geoip.GetCountry("203.0.113.10"))
+	assert.Empty(t, geoip.GetCountry("invalid"))
+	err = geoip.Reload()
+	assert.NoError(t, err)
+	assert.Equal(t, "IT", geoip.GetCountry("2.2.2.2"))
+	assert.True(t, geoip.IsCountryMatched("2.2.2.2", []string{"fr", "it"}))
+	assert.False(t, geoip.IsCountryMatched("4.4.4.4", []string{"it"}))
+	err = geoip.Load("")
+	assert.NoError(t, err)
+	assert.False(t, geoip.IsEnabled())
+	assert.Empty(t, geoip.GetCountry("2.2.2.2"))
+}
+
+func TestGeoIPConfig(t *testing.T) {
+	dbPath := writeTestGeoIPDatabase(t, map[string]string{
+		"2.0.0.0/8": "IT",
+		"3.0.0.0/8": "US",
+	})
+	defer os.Remove(dbPath)
+
+	c := GeoIPConfig{
+		AllowedCountries: []string{"IT"},
+	}
+	err := c.initialize()
+	assert.Error(t, err)
+	c.DatabasePath = "relative.mmdb"
+	err = c.initialize()
+	assert.Error(t, err)
+	c.DatabasePath = dbPath
+	c.DeniedCountries = []string{"USA"}
+	err = c.initialize()
+	assert.Error(t, err)
+	c.AllowedCountries = nil
+	c.DeniedCountries = []string{" us", "US", ""}
+	err = c.initialize()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"US"}, c.DeniedCountries)
+	assert.False(t, c.isAllowed("3.3.3.3"))
+	assert.True(t, c.isAllowed("2.2.2.2"))
+	assert.True(t, c.isAllowed("4.4.4.4"))
+	c.AllowedCountries = []string{"IT"}
+	assert.True(t, c.isAllowed("2.2.2.2"))
+	assert.False(t, c.isAllowed("4.4.4.4"))
+	assert.True(t, c.isAllowed("127.0.0.1"))
+	assert.True(t, c.isAllowed("192.168.1.1"))
+
+	config := &DefenderConfig{
+		Enabled:            true,
+		BanTime:            10,
+		BanTimeIncrement:   2,
+		Threshold:          5,
+		ScoreInvalid:       2,
+		ScoreValid:         1,
+		ScoreLimitExceeded: 3,
+		ObservationTime:    15,
+		EntriesSoftLimit:   10,
+		EntriesHardLimit:   20,
+		BanCountries:       []string{"invalid"},
+	}
+	_, err = newInMemoryDefender(config)
+	assert.Error(t, err)
+	config.BanCountries = []string{"us"}
+	d, err := newInMemoryDefender(config)
+	require.NoError(t, err)
+	d.AddEvent("2.2.2.2", ProtocolSSH, HostEventLoginFailed)
+	assert.False(t, d.IsBanned("2.2.2.2", ProtocolSSH))
+	d.AddEvent("3.3.3.3", ProtocolSSH, HostEventLoginFailed)
+	assert.True(t, d.IsBanned("3.3.3.3", ProtocolSSH))
+
+	err = geoip.Load("")
+	assert.NoError(t, err)
+}
+
+func TestGeoIPUserAndShareFilters(t *testing.T) {
+	dbPath := writeTestGeoIPDatabase(t, map[string]string{
+		"2.0.0.0/8": "IT",
+		"3.0.0.0/8": "US",
+	})
+	defer os.Remove(dbPath)
+	err := geoip.Load(dbPath)
+	require.NoError(t, err)
+	defer geoip.Load("") //nolint:errcheck
+
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username:    "geoip_user",
+			HomeDir:     filepath.Join(os.TempDir(), "geoip_user"),
+			Status:      1,
+			Permissions: map[string][]string{"/": {dataprovider.PermAny}},
+		},
+	}
+	user.Filters.AllowedIP = []string{"country:ITA"}
+	err = dataprovider.AddUser(&user, "", "", "")
+	assert.Error(t, err)
+	user.Filters.AllowedIP = []string{"country:it", "10.8.0.0/24"}
+	err = dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+	defer dataprovider.DeleteUser(user.Username, "", "", "") //nolint:errcheck
+
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+	assert.Contains(t, user.Filters.AllowedIP, "country:IT")
+	assert.True(t, user.IsLoginFromAddrAllowed("2.2.2.2:1234"))
+	assert.True(t, user.IsLoginFromAddrAllowed("10.8.0.2"))
+	assert.False(t, user.IsLoginFromAddrAllowed("3.3.3.3:1234"))
+	assert.False(t, user.IsLoginFromAddrAllowed("4.4.4.4:1234"))
+	user.Filters.AllowedIP = nil
+	user.Filters.DeniedIP = []string{"country:us"}
+	err = dataprovider.UpdateUser(&user, "", "", "")
+	require.NoError(t, err)
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+	assert.True(t, user.IsLoginFromAddrAllowed("2.2.2.2:1234"))
+	assert.True(t, user.IsLoginFromAddrAllowed("4.4.4.4:1234"))
+	assert.False(t, user.IsLoginFromAddrAllowed("3.3.3.3:1234"))
+
+	share := dataprovider.Share{
+		AllowFrom: []string{"country:IT"},
+	}
+	usable, err := share.IsUsable("2.2.2.2")
+	assert.NoError(t, err)
+	assert.True(t, usable)
+	_, err = share.IsUsable("3.3.3.3")
+	assert.ErrorIs(t, err, dataprovider.ErrLoginNotAllowedFromIP)
+}
@@ -0,0 +1,675 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+// Supported background job types
+const (
+	JobTypeUserQuotaScan   = "user_quota_scan"
+	JobTypeFolderQuotaScan = "folder_quota_scan"
+	JobTypeCopy            = "copy"
+	JobTypeArchive         = "archive"
+	JobTypeRetentionCheck  = "retention_check"
+	// JobTypeCryptKeyRotation re-encrypts the files encrypted using a
+	// previous passphrase, it is supported for users and folders
+	JobTypeCryptKeyRotation = "crypt_key_rotation"
+)
+
+// Background job statuses
+const (
+	JobStatusRunning   = "running"
+	JobStatusCompleted = "completed"
+	JobStatusFailed    = "failed"
+	JobStatusCanceled  = "canceled"
+)
+
+const (
+	jobsLogSender    = "jobs"
+	jobSessionPrefix = "job_"
+	// the progress is unknown, for example while scanning the source paths
+	jobProgressUnknown = -1
+)
+
+var (
+	// ErrTooManyJobs is returned if the maximum number of concurrent
+	// background jobs is reached
+	ErrTooManyJobs = errors.New("too many background jobs in progress")
+	// ErrJobCanceled is returned by the operations interrupted because the
+	// background job was canceled
+	ErrJobCanceled = errors.New("the background job was canceled")
+	// ErrJobConflict is returned if a conflicting operation, for example a
+	// quota scan for the same user, is already in progress
+	ErrJobConflict = errors.New("a conflicting operation is already in progress")
+	// Jobs tracks the background jobs
+	Jobs = &jobsManager{
+		jobs: make(map[string]*backgroundJob),
+	}
+)
+
+// JobsConfig defines the configuration for the background jobs
+type JobsConfig struct {
+	// Maximum number of background jobs running at the same time, 0 means
+	// background jobs disabled
+	MaxConcurrentJobs int `json:"max_concurrent_jobs" mapstructure:"max_concurrent_jobs"`
+	// Completed jobs are kept for this number of hours
+	Retention int `json:"retention" mapstructure:"retention"`
+}
+
+func (c *JobsConfig) isEnabled() bool {
+	return c.MaxConcurrentJobs > 0
+}
+
+func (c *JobsConfig) validate() error {
+	if c.MaxConcurrentJobs < 0 {
+		return fmt.Errorf("invalid background jobs max concurrent jobs: %d", c.MaxConcurrentJobs)
+	}
+	if c.isEnabled() && c.Retention < 1 {
+		return fmt.Errorf("invalid background jobs retention: %d", c.Retention)
+	}
+	return nil
+}
+
+func (c *JobsConfig) getRetention() time.Duration {
+	return time.Duration(c.Retention) * time.Hour
+}
+
+// JobRequest defines the parameters for a background job
+type JobRequest struct {
+	// Job type: user_quota_scan, folder_quota_scan, copy, archive, retention_check,
+	// crypt_key_rotation
+	Type string `json:"type"`
+	// Target user for all the job types except folder quota scans and folder
+	// key rotations
+	Username string `json:"username,omitempty"`
+	// Target folder for folder quota scans and folder key rotations
+	Folder string `json:"folder,omitempty"`
+	// Source path for copies
+	Source string `json:"source,omitempty"`
+	// Target path for copies, archive path for archives
+	Target string `json:"target,omitempty"`
+	// Paths to add to the archive
+	Paths []string `json:"paths,omitempty"`
+	// Folders to check for retention checks
+	Retention []dataprovider.FolderRetention `json:"retention,omitempty"`
+}
+
+// Job defines a background job
+type Job struct {
+	ID string `json:"id"`
+	JobRequest
+	// Job status: running, completed, failed, canceled
+	Status string `json:"status"`
+	// Completion percentage, -1 if unknown
+	Progress int `json:"progress"`
+	// Number of files and bytes processed so far, for copies and archives
+	Files int64 `json:"files,omitempty"`
+	Size  int64 `json:"size,omitempty"`
+	// Error details if the job failed
+	Error string `json:"error,omitempty"`
+	// Admin that started the job
+	Admin string `json:"admin,omitempty"`
+	// Role of the target user or folder, if any
+	Role string `json:"role,omitempty"`
+	// Node running the job, if any
+	Node string `json:"node,omitempty"`
+	// Start and end time as unix timestamp in milliseconds
+	StartTime int64 `json:"start_time"`
+	EndTime   int64 `json:"end_time,omitempty"`
+}
+
+// IsCancelable returns true if the job can be canceled while running.
+// Quota scans cannot be interrupted
+func (j *Job) IsCancelable() bool {
+	return j.Type != JobTypeUserQuotaScan && j.Type != JobTypeFolderQuotaScan
+}
+
+func (j *Job) isVisible(role string) bool {
+	return role == "" || role == j.Role
+}
+
+func (j *Job) getExpiration(retention time.Duration) int64 {
+	if j.EndTime > 0 {
+		return j.EndTime + retention.Milliseconds()
+	}
+	return util.GetTimeAsMsSinceEpoch(time.Now().Add(retention))
+}
+
+type backgroundJob struct {
+	sync.RWMutex
+	info     Job
+	progress fileOperationProgress
+	// number of steps to complete and completed steps, used to compute the
+	// completion percentage
+	steps     atomic.Int64
+	doneSteps atomic.Int64
+	// if true the completed steps are the processed bytes
+	bySize atomic.Bool
+}
+
+func (j *backgroundJob) getInfo() Job {
+	j.RLock()
+	defer j.RUnlock()
+
+	info := j.info
+	info.Files = j.progress.files.Load()
+	info.Size = j.progress.size.Load()
+	if info.Status == JobStatusCompleted {
+		info.Progress = 100
+		return info
+	}
+	steps := j.steps.Load()
+	if steps <= 0 {
+		info.Progress = jobProgressUnknown
+		return info
+	}
+	done := j.doneSteps.Load()
+	if j.bySize.Load() {
+		done = info.Size
+	}
+	info.Progress = int(min(done*100/steps, 99))
+	return info
+}
+
+func (j *backgroundJob) isRunning() bool {
+	j.RLock()
+	defer j.RUnlock()
+
+	return j.info.Status == JobStatusRunning
+}
+
+func (j *backgroundJob) setDone(err error) {
+	j.Lock()
+	defer j.Unlock()
+
+	j.info.EndTime = util.GetTimeAsMsSinceEpoch(time.Now())
+	switch {
+	case errors.Is(err, ErrJobCanceled):
+		j.info.Status = JobStatusCanceled
+	case err != nil:
+		j.info.Status = JobStatusFailed
+		j.info.Error = err.Error()
+	default:
+		j.info.Status = JobStatusCompleted
+	}
+}
+
+// jobRunner executes a background job
+type jobRunner func(job *backgroundJob) error
+
+// jobRunnerBuilder validates the job request and returns the runner. It is
+// called with the jobs lock held, so it must not use the jobs manager
+type jobRunnerBuilder func(req *JobRequest) (jobRunner, error)
+
+type jobsManager struct {
+	sync.RWMutex
+	config JobsConfig
+	jobs   map[string]*backgroundJob
+}
+
+// init sets the configuration and marks the jobs persisted as running by
+// this node as failed, they were interrupted by a restart
+func (m *jobsManager) init(config JobsConfig) {
+	m.Lock()
+	m.config = config
+	m.Unlock()
+
+	if !config.isEnabled() {
+		return
+	}
+	jobs, err := m.getPersisted()
+	if err != nil {
+		logger.Warn(jobsLogSender, "", "unable to load the persisted background jobs: %v", err)
+		return
+	}
+	node := dataprovider.GetNodeName()
+	for idx := range jobs {
+		job := &jobs[idx]
+		if job.Status != JobStatusRunning || job.Node != node || m.isLocal(job.ID) {
+			continue
+		}
+		job.Status = JobStatusFailed
+		job.Error = "interrupted by a service restart"
+		job.EndTime = util.GetTimeAsMsSinceEpoch(time.Now())
+		m.persist(job)
+		logger.Info(jobsLogSender, "", "background job %q, type %q, interrupted by a restart", job.ID, job.Type)
+	}
+}
+
+func (m *jobsManager) getConfig() JobsConfig {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.config
+}
+
+func (m *jobsManager) isLocal(id string) bool {
+	m.RLock()
+	defer m.RUnlock()
+
+	_, ok := m.jobs[id]
+	return ok
+}
+
+func (m *jobsManager) persist(job *Job) {
+	config := m.getConfig()
+	err := dataprovider.AddSharedSession(dataprovider.Session{
+		Key:       jobSessionPrefix + job.ID,
+		Data:      job,
+		Type:      dataprovider.SessionTypeBackgroundJob,
+		Timestamp: job.getExpiration(config.getRetention()),
+	})
+	if err != nil {
+		logger.Warn(jobsLogSender, "", "unable to persist background job %q: %v", job.ID, err)
+	}
+}
+
+func decodeJob(session *dataprovider.Session) (Job, error) {
+	var job Job
+	data, ok := session.Data.([]byte)
+	if !ok {
+		return job, fmt.Errorf("invalid background job data type %T", session.Data)
+	}
+	err := json.Unmarshal(data, &job)
+	return job, err
+}
+
+func (m *jobsManager) getPersisted() ([]Job, error) {
+	sessions, err := dataprovider.GetSharedSessions(dataprovider.SessionTypeBackgroundJob, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]Job, 0, len(sessions))
+	for idx := range sessions {
+		job, err := decodeJob(&sessions[idx])
+		if err != nil {
+			logger.Warn(jobsLogSender, "", "unable to decode background job %q: %v", sessions[idx].Key, err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// StartUserJob validates and starts a background job for the specified user.
+// The user must include the group settings
+func (m *jobsManager) StartUserJob(req JobRequest, user dataprovider.User, admin string) (Job, error) {
+	req.Username = user.Username
+	req.Folder = ""
+
+	return m.start(req, admin, user.Role, func(req *JobRequest) (jobRunner, error) {
+		switch req.Type {
+		case JobTypeUserQuotaScan:
+			return getUserQuotaScanRunner(&user)
+		case JobTypeCopy:
+			return getCopyJobRunner(req, user)
+		case JobTypeArchive:
+			return getArchiveJobRunner(req, user)
+		case JobTypeRetentionCheck:
+			return getRetentionJobRunner(req, user)
+		case JobTypeCryptKeyRotation:
+			return getUserCryptKeyRotationJobRunner(req, user)
+		default:
+			return nil, util.NewValidationError(fmt.Sprintf("unsupported job type %q for users", req.Type))
+		}
+	})
+}
+
+// StartFolderJob validates and starts a background job for the specified folder
+func (m *jobsManager) StartFolderJob(req JobRequest, folder vfs.BaseVirtualFolder, admin string) (Job, error) {
+	req.Folder = folder.Name
+	req.Username = ""
+
+	return m.start(req, admin, folder.Role, func(req *JobRequest) (jobRunner, error) {
+		switch req.Type {
+		case JobTypeFolderQuotaScan:
+			return getFolderQuotaScanRunner(&folder)
+		case JobTypeCryptKeyRotation:
+			return getFolderCryptKeyRotationJobRunner(req, folder)
+		default:
+			return nil, util.NewValidationError(fmt.Sprintf("unsupported job type %q for folders", req.Type))
+		}
+	})
+}
+
+func (m *jobsManager) start(req JobRequest, admin, role string, build jobRunnerBuilder) (Job, error) {
+	config := m.getConfig()
+	if !config.isEnabled() {
+		return Job{}, util.NewMethodDisabledError("background jobs are disabled")
+	}
+
+	m.Lock()
+	running := 0
+	for _, job := range m.jobs {
+		if job.isRunning() {
+			running++
+		}
+	}
+	if running >= config.MaxConcurrentJobs {
+		m.Unlock()
+		return Job{}, ErrTooManyJobs
+	}
+	// the runner is built with the lock held, this way the resources it
+	// reserves, for example the quota scans, are released only by the job
+	runner, err := build(&req)
+	if err != nil {
+		m.Unlock()
+		return Job{}, err
+	}
+	job := &backgroundJob{
+		info: Job{
+			ID:         xid.New().String(),
+			JobRequest: req,
+			Status:     JobStatusRunning,
+			Admin:      admin,
+			Role:       role,
+			Node:       dataprovider.GetNodeName(),
+			StartTime:  util.GetTimeAsMsSinceEpoch(time.Now()),
+		},
+	}
+	m.jobs[job.info.ID] = job
+	m.Unlock()
+
+	info := job.getInfo()
+	m.persist(&info)
+	go m.run(job, runner)
+
+	return info, nil
+}
+
+func (m *jobsManager) run(job *backgroundJob, runner jobRunner) {
+	info := job.getInfo()
+	logger.Info(jobsLogSender, info.ID, "starting background job, type %q, user %q, folder %q, admin %q",
+		info.Type, info.Username, info.Folder, info.Admin)
+
+	err := runner(job)
+	job.setDone(err)
+
+	info = job.getInfo()
+	m.persist(&info)
+	logger.Info(jobsLogSender, info.ID, "background job finished, type %q, status: %s, elapsed: %d ms, err: %v",
+		info.Type, info.Status, info.EndTime-info.StartTime, err)
+}
+
+// Get returns the job with the specified id if visible for the given role
+func (m *jobsManager) Get(id, role string) (Job, error) {
+	m.RLock()
+	job, ok := m.jobs[id]
+	m.RUnlock()
+
+	var info Job
+	if ok {
+		info = job.getInfo()
+	} else {
+		session, err := dataprovider.GetSharedSession(jobSessionPrefix + id)
+		if err != nil || session.Type != dataprovider.SessionTypeBackgroundJob {
+			return info, util.NewRecordNotFoundError(fmt.Sprintf("background job %q not found", id))
+		}
+		info, err = decodeJob(&session)
+		if err != nil {
+			return info, err
+		}
+	}
+	if !info.isVisible(role) {
+		return Job{}, util.NewRecordNotFoundError(fmt.Sprintf("background job %q not found", id))
+	}
+	return info, nil
+}
+
+// GetAll returns the jobs visible for the given role, including the ones
+// started by other nodes, sorted by start time
+func (m *jobsManager) GetAll(role string) ([]Job, error) {
+	persisted, err := m.getPersisted()
+	if err != nil {
+		return nil, err
+	}
+	jobs := make(map[string]Job)
+	for _, job := range persisted {
+		jobs[job.ID] = job
+	}
+	m.RLock()
+	for id, job := range m.jobs {
+		// the local jobs have the most updated progress
+		jobs[id] = job.getInfo()
+	}
+	m.RUnlock()
+
+	result := make([]Job, 0, len(jobs))
+	for _, job := range jobs {
+		if job.isVisible(role) {
+			result = append(result, job)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].StartTime == result[j].StartTime {
+			return result[i].ID < result[j].ID
+		}
+		return result[i].StartTime < result[j].StartTime
+	})
+	return result, nil
+}
+
+// Cancel cancels the running job with the specified id or removes the job
+// if it is not running. It returns the job status before the request
+func (m *jobsManager) Cancel(id, role string) (Job, error) {
+	info, err := m.Get(id, role)
+	if err != nil {
+		return info, err
+	}
+	if info.Status != JobStatusRunning {
+		m.Lock()
+		delete(m.jobs, id)
+		m.Unlock()
+		if err := dataprovider.DeleteSharedSession(jobSessionPrefix + id); err != nil && !errors.Is(err, util.ErrNotFound) {
+			return info, err
+		}
+		return info, nil
+	}
+	if !info.IsCancelable() {
+		return info, util.NewValidationError(fmt.Sprintf("background jobs of type %q cannot be canceled", info.Type))
+	}
+	m.RLock()
+	job, ok := m.jobs[id]
+	m.RUnlock()
+	if !ok {
+		return info, util.NewValidationError(fmt.Sprintf("background job %q is running on node %q", id, info.Node))
+	}
+	job.progress.cancel()
+	logger.Info(jobsLogSender, id, "cancel requested for background job, type %q", info.Type)
+	return info, nil
+}
+
+// cleanup removes the expired jobs
+func (m *jobsManager) cleanup() {
+	config := m.getConfig()
+	limit := util.GetTimeAsMsSinceEpoch(time.Now().Add(-config.getRetention()))
+
+	m.Lock()
+	for id, job := range m.jobs {
+		info := job.getInfo()
+		if info.Status != JobStatusRunning && info.EndTime < limit {
+			delete(m.jobs, id)
+		}
+	}
+	m.Unlock()
+
+	dataprovider.CleanupSharedSessions(dataprovider.SessionTypeBackgroundJob, time.Now()) //nolint:errcheck
+}
+
+// newJobConnection returns the connection to run a background job for the specified user
+func newJobConnection(job *backgroundJob, user dataprovider.User) (*BaseConnection, error) {
+	conn := NewBaseConnection(job.info.ID, ProtocolBackgroundJob, "", "", user)
+	if err := conn.User.CheckFsRoot(conn.ID); err != nil {
+		conn.CloseFS() //nolint:errcheck
+		return nil, fmt.Errorf("unable to check root fs for user %q: %w", user.Username, err)
+	}
+	conn.progress = &job.progress
+	return conn, nil
+}
+
+func getUserQuotaScanRunner(user *dataprovider.User) (jobRunner, error) {
+	if dataprovider.GetQuotaTracking() == 0 {
+		return nil, util.NewMethodDisabledError("quota tracking is disabled")
+	}
+	if !QuotaScans.AddUserQuotaScan(user.Username, user.Role) {
+		return nil, fmt.Errorf("%w: another scan is already in progress for user %q", ErrJobConflict, user.Username)
+	}
+	return func(_ *backgroundJob) error {
+		defer QuotaScans.RemoveUserQuotaScan(user.Username)
+
+		return doUserQuotaScan(user, nil)
+	}, nil
+}
+
+func getFolderQuotaScanRunner(folder *vfs.BaseVirtualFolder) (jobRunner, error) {
+	if dataprovider.GetQuotaTracking() == 0 {
+		return nil, util.NewMethodDisabledError("quota tracking is disabled")
+	}
+	if !QuotaScans.AddVFolderQuotaScan(folder.Name) {
+		return nil, fmt.Errorf("%w: another scan is already in progress for folder %q", ErrJobConflict, folder.Name)
+	}
+	return func(_ *backgroundJob) error {
+		defer QuotaScans.RemoveVFolderQuotaScan(folder.Name)
+
+		return doFolderQuotaScan(folder, nil)
+	}, nil
+}
+
+func getCopyJobRunner(req *JobRequest, user dataprovider.User) (jobRunner, error) {
+	if req.Source == "" || req.Target == "" {
+		return nil, util.NewValidationError("the source and target paths are mandatory")
+	}
+	// a trailing slash has the same meaning of the synchronous copy
+	source := user.GetCleanedPath(req.Source)
+	if strings.HasSuffix(req.Source, "/") && source != "/" {
+		source += "/"
+	}
+	target := user.GetCleanedPath(req.Target)
+	if strings.HasSuffix(req.Target, "/") && target != "/" {
+		target += "/"
+	}
+	req.Source = source
+	req.Target = target
+	req.Paths = nil
+	req.Retention = nil
+
+	return func(job *backgroundJob) error {
+		conn, err := newJobConnection(job, user)
+		if err != nil {
+			return err
+		}
+		defer conn.CloseFS() //nolint:errcheck
+
+		sourcePath := path.Clean(source)
+		if info, err := conn.DoStat(sourcePath, 1, false); err == nil {
+			_, size, err := getFilesAndSizeForPath(conn, sourcePath, info)
+			if err == nil {
+				job.bySize.Store(true)
+				job.steps.Store(size)
+			}
+		}
+		return conn.Copy(source, target)
+	}, nil
+}
+
+func getArchiveJobRunner(req *JobRequest, user dataprovider.User) (jobRunner, error) {
+	if req.Target == "" {
+		return nil, util.NewValidationError("the archive path is mandatory")
+	}
+	if len(req.Paths) == 0 {
+		return nil, util.NewValidationError("at least a path to archive is required")
+	}
+	name := user.GetCleanedPath(req.Target)
+	paths := make([]string, 0, len(req.Paths))
+	for _, p := range req.Paths {
+		p = user.GetCleanedPath(p)
+		if p == name {
+			return nil, util.NewValidationError(fmt.Sprintf("cannot compress the archive to create: %q", name))
+		}
+		paths = append(paths, p)
+	}
+	paths = util.RemoveDuplicates(paths, false)
+	req.Source = ""
+	req.Target = name
+	req.Paths = paths
+	req.Retention = nil
+
+	return func(job *backgroundJob) error {
+		conn, err := newJobConnection(job, user)
+		if err != nil {
+			return err
+		}
+		defer conn.CloseFS() //nolint:errcheck
+
+		var total int64
+		for _, p := range paths {
+			info, err := conn.DoStat(p, 1, false)
+			if err != nil {
+				return err
+			}
+			_, size, err := getFilesAndSizeForPath(conn, p, info)
+			if err != nil {
+				return err
+			}
+			total += size
+		}
+		job.bySize.Store(true)
+		job.steps.Store(total)
+		if err := conn.CheckParentDirs(path.Dir(name)); err != nil {
+			return err
+		}
+		return createZipArchive(conn, name, paths)
+	}, nil
+}
+
+func getRetentionJobRunner(req *JobRequest, user dataprovider.User) (jobRunner, error) {
+	check := RetentionCheck{
+		Folders: req.Retention,
+	}
+	if err := check.Validate(); err != nil {
+		return nil, err
+	}
+	req.Source = ""
+	req.Target = ""
+	req.Paths = nil
+	c := RetentionChecks.Add(check, &user)
+	if c == nil {
+		return nil, fmt.Errorf("%w: another retention check is already in progress for user %q",
+			ErrJobConflict, user.Username)
+	}
+	return func(job *backgroundJob) error {
+		job.steps.Store(int64(len(c.Folders)))
+		return c.start(&job.progress, func() {
+			job.doneSteps.Add(1)
+		})
+	}, nil
+}
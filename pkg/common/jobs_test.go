@@ -0,0 +1,173 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+func TestJobsConfig(t *testing.T) {
+	c := JobsConfig{}
+	assert.NoError(t, c.validate())
+	assert.False(t, c.isEnabled())
+	c.MaxConcurrentJobs = -1
+	assert.Error(t, c.validate())
+	c.MaxConcurrentJobs = 2
+	assert.Error(t, c.validate())
+	c.Retention = 1
+	assert.NoError(t, c.validate())
+	assert.True(t, c.isEnabled())
+	assert.Equal(t, time.Hour, c.getRetention())
+
+	m := &jobsManager{
+		jobs: make(map[string]*backgroundJob),
+	}
+	_, err := m.StartFolderJob(JobRequest{Type: JobTypeFolderQuotaScan}, vfs.BaseVirtualFolder{Name: "folder"}, "admin")
+	assert.ErrorIs(t, err, util.ErrMethodDisabled)
+}
+
+func TestJobProgress(t *testing.T) {
+	job := &backgroundJob{
+		info: Job{
+			ID:     xid.New().String(),
+			Status: JobStatusRunning,
+		},
+	}
+	assert.Equal(t, jobProgressUnknown, job.getInfo().Progress)
+	job.steps.Store(4)
+	job.doneSteps.Add(1)
+	assert.Equal(t, 25, job.getInfo().Progress)
+	job.doneSteps.Add(3)
+	assert.Equal(t, 99, job.getInfo().Progress)
+	job.bySize.Store(true)
+	job.steps.Store(200)
+	job.progress.add(1, 50)
+	info := job.getInfo()
+	assert.Equal(t, 25, info.Progress)
+	assert.Equal(t, int64(1), info.Files)
+	assert.Equal(t, int64(50), info.Size)
+	job.setDone(nil)
+	info = job.getInfo()
+	assert.Equal(t, JobStatusCompleted, info.Status)
+	assert.Equal(t, 100, info.Progress)
+	assert.Greater(t, info.EndTime, int64(0))
+
+	job.setDone(errors.New("test error"))
+	assert.Equal(t, JobStatusFailed, job.getInfo().Status)
+	assert.Equal(t, "test error", job.getInfo().Error)
+	job.setDone(ErrJobCanceled)
+	assert.Equal(t, JobStatusCanceled, job.getInfo().Status)
+
+	assert.False(t, (&Job{JobRequest: JobRequest{Type: JobTypeUserQuotaScan}}).IsCancelable())
+	assert.False(t, (&Job{JobRequest: JobRequest{Type: JobTypeFolderQuotaScan}}).IsCancelable())
+	assert.True(t, (&Job{JobRequest: JobRequest{Type: JobTypeCopy}}).IsCancelable())
+	assert.True(t, (&Job{Role: "role"}).isVisible(""))
+	assert.True(t, (&Job{Role: "role"}).isVisible("role"))
+	assert.False(t, (&Job{Role: "role"}).isVisible("role1"))
+}
+
+func TestCancelBackgroundJob(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "jobs_home")
+	err := os.MkdirAll(filepath.Join(homeDir, "src"), os.ModePerm)
+	require.NoError(t, err)
+	for _, name := range []string{"file1", "file2", "file3"} {
+		err = os.WriteFile(filepath.Join(homeDir, "src", name), []byte("data"), 0666)
+		require.NoError(t, err)
+	}
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "jobs_user",
+			HomeDir:  homeDir,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+	}
+	m := &jobsManager{
+		jobs: make(map[string]*backgroundJob),
+	}
+	m.init(JobsConfig{MaxConcurrentJobs: 1, Retention: 1})
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	job, err := m.start(JobRequest{Type: JobTypeCopy, Username: user.Username}, "admin", "",
+		func(_ *JobRequest) (jobRunner, error) {
+			return func(job *backgroundJob) error {
+				close(started)
+				<-release
+				conn, err := newJobConnection(job, user)
+				if err != nil {
+					return err
+				}
+				defer conn.CloseFS() //nolint:errcheck
+
+				return conn.Copy("/src", "/dst")
+			}, nil
+		})
+	require.NoError(t, err)
+	<-started
+	_, err = m.start(JobRequest{Type: JobTypeCopy}, "admin", "", nil)
+	assert.ErrorIs(t, err, ErrTooManyJobs)
+	_, err = m.Get(job.ID, "role")
+	assert.ErrorIs(t, err, util.ErrNotFound)
+	info, err := m.Cancel(job.ID, "")
+	assert.NoError(t, err)
+	assert.Equal(t, JobStatusRunning, info.Status)
+	close(release)
+
+	assert.Eventually(t, func() bool {
+		info, err = m.Get(job.ID, "")
+		return err == nil && info.Status != JobStatusRunning
+	}, 2*time.Second, 50*time.Millisecond)
+	assert.Equal(t, JobStatusCanceled, info.Status)
+	assert.NoFileExists(t, filepath.Join(homeDir, "dst", "file1"))
+	jobs, err := m.GetAll("")
+	assert.NoError(t, err)
+	assert.Len(t, jobs, 1)
+	// a running job persisted by this node is marked as failed after a restart
+	info.Status = JobStatusRunning
+	info.EndTime = 0
+	info.Node = dataprovider.GetNodeName()
+	m.persist(&info)
+	m.Lock()
+	delete(m.jobs, job.ID)
+	m.Unlock()
+	m.init(JobsConfig{MaxConcurrentJobs: 1, Retention: 1})
+	info, err = m.Get(job.ID, "")
+	assert.NoError(t, err)
+	assert.Equal(t, JobStatusFailed, info.Status)
+	assert.NotEmpty(t, info.Error)
+	_, err = m.Cancel(job.ID, "")
+	assert.NoError(t, err)
+	_, err = m.Get(job.ID, "")
+	assert.ErrorIs(t, err, util.ErrNotFound)
+	m.cleanup()
+
+	err = os.RemoveAll(homeDir)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,161 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// LiveTransfer defines the status of an active transfer
+type LiveTransfer struct {
+	ConnectionID  string `json:"connection_id"`
+	TransferID    int64  `json:"transfer_id"`
+	Username      string `json:"username"`
+	Protocol      string `json:"protocol"`
+	RemoteAddress string `json:"remote_address"`
+	OperationType string `json:"operation_type"`
+	VirtualPath   string `json:"path"`
+	// Transfer start time as unix timestamp in milliseconds
+	StartTime int64 `json:"start_time"`
+	// Transferred bytes
+	Size int64 `json:"size"`
+	// Current speed as bytes/s
+	Speed int64 `json:"speed"`
+	// Bandwidth limit set by an administrator as KB/s, 0 means no limit
+	BandwidthLimit int64 `json:"bandwidth_limit,omitempty"`
+}
+
+func (t *LiveTransfer) getKey() string {
+	return fmt.Sprintf("%s_%d", t.ConnectionID, t.TransferID)
+}
+
+// LiveStats defines a snapshot of the active connections and transfers
+type LiveStats struct {
+	// Snapshot time as unix timestamp in milliseconds
+	Timestamp int64  `json:"timestamp"`
+	Node      string `json:"node,omitempty"`
+	// Number of active connections for each protocol
+	Protocols map[string]int `json:"protocols"`
+	// Aggregated upload and download speed as bytes/s
+	UploadSpeed   int64          `json:"upload_speed"`
+	DownloadSpeed int64          `json:"download_speed"`
+	Transfers     []LiveTransfer `json:"transfers"`
+}
+
+// GetLiveStats returns a snapshot of the active transfers. The speeds are
+// computed against the previous snapshot, if any, otherwise they are the
+// average speeds since the transfers started
+func (conns *ActiveConnections) GetLiveStats(role string, previous *LiveStats) LiveStats {
+	now := time.Now()
+	stats := LiveStats{
+		Timestamp: util.GetTimeAsMsSinceEpoch(now),
+		Node:      dataprovider.GetNodeName(),
+		Protocols: make(map[string]int),
+		Transfers: []LiveTransfer{},
+	}
+	prevSizes := make(map[string]int64)
+	if previous != nil {
+		for _, t := range previous.Transfers {
+			prevSizes[t.getKey()] = t.Size
+		}
+	}
+
+	conns.RLock()
+	defer conns.RUnlock()
+
+	for _, c := range conns.connections {
+		if role != "" && c.GetRole() != role {
+			continue
+		}
+		stats.Protocols[c.GetProtocol()]++
+		for _, t := range c.GetTransfers() {
+			transfer := LiveTransfer{
+				ConnectionID:   c.GetID(),
+				TransferID:     t.ID,
+				Username:       c.GetUsername(),
+				Protocol:       c.GetProtocol(),
+				RemoteAddress:  c.GetRemoteAddress(),
+				OperationType:  t.OperationType,
+				VirtualPath:    t.VirtualPath,
+				StartTime:      t.StartTime,
+				Size:           t.Size,
+				BandwidthLimit: t.BandwidthLimit,
+			}
+			prevSize, ok := prevSizes[transfer.getKey()]
+			elapsed := stats.Timestamp - t.StartTime
+			if ok {
+				elapsed = stats.Timestamp - previous.Timestamp
+			}
+			if elapsed > 0 && transfer.Size > prevSize {
+				transfer.Speed = (transfer.Size - prevSize) * 1000 / elapsed
+			}
+			if transfer.OperationType == operationUpload {
+				stats.UploadSpeed += transfer.Speed
+			} else {
+				stats.DownloadSpeed += transfer.Speed
+			}
+			stats.Transfers = append(stats.Transfers, transfer)
+		}
+	}
+	return stats
+}
+
+func (conns *ActiveConnections) getConnection(connectionID, role string) (ActiveConnection, bool) {
+	if idx, ok := conns.mapping[connectionID]; ok {
+		c := conns.connections[idx]
+		if role == "" || c.GetRole() == role {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// CloseTransfer aborts the transfer with the specified id, the connection
+// stays open. It returns false if the transfer does not exist
+func (conns *ActiveConnections) CloseTransfer(connectionID string, transferID int64, role string) bool {
+	conns.RLock()
+	defer conns.RUnlock()
+
+	c, ok := conns.getConnection(connectionID, role)
+	if !ok {
+		return false
+	}
+	for _, t := range c.GetTransfers() {
+		if t.ID == transferID {
+			logger.Debug(c.GetProtocol(), c.GetID(), "close transfer id %d requested", transferID)
+			c.SignalTransferClose(transferID, ErrTransferAborted)
+			return true
+		}
+	}
+	return false
+}
+
+// ThrottleTransfer sets a bandwidth limit, as KB/s, for the transfer with the
+// specified id, 0 means no limit. It returns false if the transfer does not exist
+func (conns *ActiveConnections) ThrottleTransfer(connectionID string, transferID, bandwidth int64, role string) bool {
+	conns.RLock()
+	defer conns.RUnlock()
+
+	c, ok := conns.getConnection(connectionID, role)
+	if !ok {
+		return false
+	}
+	return c.SetTransferBandwidthLimit(transferID, bandwidth)
+}
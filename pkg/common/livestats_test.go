@@ -0,0 +1,113 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+func TestLiveStats(t *testing.T) {
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "live_user",
+			Role:     "role1",
+		},
+	}
+	fs := vfs.NewOsFs("", os.TempDir(), "", nil)
+	c1 := NewBaseConnection("id1", ProtocolSFTP, "", "", user)
+	fakeConn1 := &fakeConnection{
+		BaseConnection: c1,
+	}
+	t1 := NewBaseTransfer(nil, c1, nil, "/p1", "/p1", "/r1", TransferUpload, 0, 0, 0, 0, true, fs, dataprovider.TransferQuota{})
+	t1.BytesReceived.Store(1000)
+	t2 := NewBaseTransfer(nil, c1, nil, "/p2", "/p2", "/r2", TransferDownload, 0, 0, 0, 0, true, fs, dataprovider.TransferQuota{})
+	t2.BytesSent.Store(2000)
+	c2 := NewBaseConnection("id2", ProtocolFTP, "", "", dataprovider.User{})
+	fakeConn2 := &fakeConnection{
+		BaseConnection: c2,
+	}
+	require.NoError(t, Connections.Add(fakeConn1))
+	require.NoError(t, Connections.Add(fakeConn2))
+
+	stats := Connections.GetLiveStats("", nil)
+	assert.Equal(t, 1, stats.Protocols[ProtocolSFTP])
+	assert.Equal(t, 1, stats.Protocols[ProtocolFTP])
+	require.Len(t, stats.Transfers, 2)
+	for _, tr := range stats.Transfers {
+		assert.Equal(t, "live_user", tr.Username)
+		assert.Equal(t, fakeConn1.GetID(), tr.ConnectionID)
+		assert.Equal(t, ProtocolSFTP, tr.Protocol)
+	}
+	stats = Connections.GetLiveStats("role2", nil)
+	assert.Len(t, stats.Protocols, 0)
+	assert.Len(t, stats.Transfers, 0)
+	// the speed is computed against the previous snapshot
+	previous := Connections.GetLiveStats("role1", nil)
+	previous.Timestamp -= 1000
+	t1.BytesReceived.Store(3000)
+	stats = Connections.GetLiveStats("role1", &previous)
+	require.Len(t, stats.Transfers, 2)
+	for _, tr := range stats.Transfers {
+		if tr.TransferID == t1.GetID() {
+			assert.Equal(t, int64(3000), tr.Size)
+			assert.InDelta(t, 2000, tr.Speed, 100)
+			assert.Equal(t, tr.Speed, stats.UploadSpeed)
+		} else {
+			assert.Equal(t, int64(0), tr.Speed)
+			assert.Equal(t, int64(0), stats.DownloadSpeed)
+		}
+	}
+
+	assert.False(t, Connections.ThrottleTransfer("missing", t1.GetID(), 100, ""))
+	assert.False(t, Connections.ThrottleTransfer(fakeConn1.GetID(), t1.GetID(), 100, "role2"))
+	assert.False(t, Connections.ThrottleTransfer(fakeConn1.GetID(), 1000, 100, ""))
+	assert.True(t, Connections.ThrottleTransfer(fakeConn1.GetID(), t1.GetID(), 100, "role1"))
+	assert.Equal(t, int64(100), t1.GetBandwidthLimit())
+	stats = Connections.GetLiveStats("", nil)
+	for _, tr := range stats.Transfers {
+		if tr.TransferID == t1.GetID() {
+			assert.Equal(t, int64(100), tr.BandwidthLimit)
+		} else {
+			assert.Equal(t, int64(0), tr.BandwidthLimit)
+		}
+	}
+	assert.True(t, Connections.ThrottleTransfer(fakeConn1.GetID(), t1.GetID(), 0, ""))
+	assert.Equal(t, int64(0), t1.GetBandwidthLimit())
+
+	assert.False(t, Connections.CloseTransfer("missing", t2.GetID(), ""))
+	assert.False(t, Connections.CloseTransfer(fakeConn1.GetID(), t2.GetID(), "role2"))
+	assert.False(t, Connections.CloseTransfer(fakeConn1.GetID(), 1000, ""))
+	assert.True(t, Connections.CloseTransfer(fakeConn1.GetID(), t2.GetID(), ""))
+	assert.True(t, t2.AbortTransfer.Load())
+	assert.ErrorIs(t, t2.GetAbortError(), ErrTransferAborted)
+	assert.False(t, t1.AbortTransfer.Load())
+	// the connection is still active
+	assert.Len(t, Connections.GetStats(""), 2)
+
+	assert.NoError(t, t1.Close())
+	assert.NoError(t, t2.Close())
+	Connections.Remove(fakeConn1.GetID())
+	Connections.Remove(fakeConn2.GetID())
+	assert.Eventually(t, func() bool { return len(Connections.GetStats("")) == 0 }, 1*time.Second, 50*time.Millisecond)
+}
@@ -0,0 +1,226 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+)
+
+const (
+	defaultTransferBufferSize = 32
+	maxTransferBufferSize     = 4096
+	defaultBufferWaitTimeout  = 60
+)
+
+var transferBuffers = newTransferBufferPool(MemoryBudgetConfig{})
+
+// MemoryBudgetConfig defines the memory used by the buffers of the SFTP/SCP,
+// FTP and WebDAV transfers. The buffers are reused across transfers and, if
+// the budget is exhausted, new transfers wait for a buffer to be released
+// until the configured timeout expires
+type MemoryBudgetConfig struct {
+	// Size of each transfer buffer in KB. 0 means the default, 32 KB
+	BufferSize int `json:"buffer_size" mapstructure:"buffer_size"`
+	// Maximum memory, in MB, used by the buffers of all the transfers. 0 means no limit
+	MaxMemory int `json:"max_memory" mapstructure:"max_memory"`
+	// Maximum memory, in KB, used by the buffers of the transfers of a single connection.
+	// 0 means no limit
+	MaxConnectionMemory int `json:"max_connection_memory" mapstructure:"max_connection_memory"`
+	// Maximum time, in seconds, to wait for a transfer buffer if the budget is exhausted.
+	// The transfer fails if no buffer is released in time. 0 means the default, 60 seconds
+	WaitTimeout int `json:"wait_timeout" mapstructure:"wait_timeout"`
+}
+
+func (c *MemoryBudgetConfig) getBufferSize() int64 {
+	if c.BufferSize == 0 {
+		return defaultTransferBufferSize * 1024
+	}
+	return int64(c.BufferSize) * 1024
+}
+
+func (c *MemoryBudgetConfig) getWaitTimeout() time.Duration {
+	if c.WaitTimeout == 0 {
+		return defaultBufferWaitTimeout * time.Second
+	}
+	return time.Duration(c.WaitTimeout) * time.Second
+}
+
+func (c *MemoryBudgetConfig) validate() error {
+	if c.BufferSize < 0 || c.BufferSize > maxTransferBufferSize {
+		return fmt.Errorf("memory budget: invalid buffer size %d KB", c.BufferSize)
+	}
+	if c.MaxMemory < 0 {
+		return fmt.Errorf("memory budget: invalid max memory %d MB", c.MaxMemory)
+	}
+	if c.MaxConnectionMemory < 0 {
+		return fmt.Errorf("memory budget: invalid max connection memory %d KB", c.MaxConnectionMemory)
+	}
+	if c.WaitTimeout < 0 {
+		return fmt.Errorf("memory budget: invalid wait timeout %d seconds", c.WaitTimeout)
+	}
+	bufferSize := c.getBufferSize()
+	if c.MaxMemory > 0 && int64(c.MaxMemory)*1024*1024 < bufferSize {
+		return fmt.Errorf("memory budget: max memory %d MB is lower than the buffer size", c.MaxMemory)
+	}
+	if c.MaxConnectionMemory > 0 && int64(c.MaxConnectionMemory)*1024 < bufferSize {
+		return fmt.Errorf("memory budget: max connection memory %d KB is lower than the buffer size",
+			c.MaxConnectionMemory)
+	}
+	return nil
+}
+
+// transferBufferPool reuses the transfer buffers and accounts the memory
+// they use against the global and the per connection budgets
+type transferBufferPool struct {
+	size          int64
+	maxMemory     int64
+	maxConnMemory int64
+	waitTimeout   time.Duration
+	pool          sync.Pool
+	mu            sync.Mutex
+	cond          *sync.Cond
+	used          int64
+	connections   map[*BaseConnection]int64
+}
+
+func newTransferBufferPool(c MemoryBudgetConfig) *transferBufferPool {
+	p := &transferBufferPool{
+		size:          c.getBufferSize(),
+		maxMemory:     int64(c.MaxMemory) * 1024 * 1024,
+		maxConnMemory: int64(c.MaxConnectionMemory) * 1024,
+		waitTimeout:   c.getWaitTimeout(),
+		connections:   make(map[*BaseConnection]int64),
+	}
+	p.pool.New = func() any {
+		buf := make([]byte, p.size)
+		return &buf
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *transferBufferPool) hasSpace(conn *BaseConnection) bool {
+	if p.maxMemory > 0 && p.used+p.size > p.maxMemory {
+		return false
+	}
+	if p.maxConnMemory > 0 && p.connections[conn]+p.size > p.maxConnMemory {
+		return false
+	}
+	return true
+}
+
+func (p *transferBufferPool) reserve(conn *BaseConnection) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.hasSpace(conn) {
+		conn.Log(logger.LevelDebug, "memory budget exhausted, waiting for a transfer buffer, used: %d bytes", p.used)
+		deadline := time.Now().Add(p.waitTimeout)
+		// wake up the waiters when the timeout expires, sync.Cond has no timed wait
+		timer := time.AfterFunc(p.waitTimeout, func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+
+			p.cond.Broadcast()
+		})
+		defer timer.Stop()
+
+		for !p.hasSpace(conn) {
+			if !time.Now().Before(deadline) {
+				conn.Log(logger.LevelWarn, "no transfer buffer released within %s, used: %d bytes",
+					p.waitTimeout, p.used)
+				return ErrMemoryBudgetExhausted
+			}
+			p.cond.Wait()
+		}
+	}
+	p.used += p.size
+	p.connections[conn] += p.size
+	return nil
+}
+
+func (p *transferBufferPool) release(conn *BaseConnection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.used -= p.size
+	p.connections[conn] -= p.size
+	if p.connections[conn] <= 0 {
+		delete(p.connections, conn)
+	}
+	p.cond.Broadcast()
+}
+
+func (p *transferBufferPool) getUsedMemory() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.used
+}
+
+// TransferBuffer is a buffer borrowed from the transfer buffers pool.
+// It must be released after use
+type TransferBuffer struct {
+	// Buf is the buffer to use for the transfer
+	Buf  []byte
+	ptr  *[]byte
+	pool *transferBufferPool
+	conn *BaseConnection
+	once sync.Once
+}
+
+// Release returns the buffer to the pool, Buf must not be used after calling this method
+func (b *TransferBuffer) Release() {
+	b.once.Do(func() {
+		b.Buf = nil
+		b.pool.pool.Put(b.ptr)
+		b.pool.release(b.conn)
+	})
+}
+
+// GetTransferBuffer returns a buffer from the transfer buffers pool. If the memory
+// budget is exhausted it waits until enough memory is released by other transfers
+// and returns ErrMemoryBudgetExhausted if the wait timeout expires
+func (c *BaseConnection) GetTransferBuffer() (*TransferBuffer, error) {
+	pool := transferBuffers
+	if err := pool.reserve(c); err != nil {
+		return nil, err
+	}
+	ptr := pool.pool.Get().(*[]byte)
+	return &TransferBuffer{
+		Buf:  *ptr,
+		ptr:  ptr,
+		pool: pool,
+		conn: c,
+	}, nil
+}
+
+// CopyBuffer copies from src to dst using a buffer from the transfer buffers pool.
+// The io.WriterTo and io.ReaderFrom implementations of src and dst are ignored
+// so the pooled buffer is always used
+func (c *BaseConnection) CopyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	buf, err := c.GetTransferBuffer()
+	if err != nil {
+		return 0, err
+	}
+	defer buf.Release()
+
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, buf.Buf)
+}
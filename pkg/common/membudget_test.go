@@ -0,0 +1,197 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+)
+
+func TestMemoryBudgetConfigValidate(t *testing.T) {
+	c := MemoryBudgetConfig{}
+	assert.NoError(t, c.validate())
+	assert.Equal(t, int64(32768), c.getBufferSize())
+	c.BufferSize = -1
+	assert.Error(t, c.validate())
+	c.BufferSize = maxTransferBufferSize + 1
+	assert.Error(t, c.validate())
+	c.BufferSize = 64
+	c.MaxMemory = -1
+	assert.Error(t, c.validate())
+	c.MaxMemory = 1
+	c.MaxConnectionMemory = -1
+	assert.Error(t, c.validate())
+	c.MaxConnectionMemory = 32
+	assert.Error(t, c.validate())
+	c.MaxConnectionMemory = 128
+	assert.NoError(t, c.validate())
+	c.BufferSize = 2048
+	c.MaxConnectionMemory = 0
+	assert.Error(t, c.validate())
+	c.BufferSize = 64
+	assert.Equal(t, defaultBufferWaitTimeout*time.Second, c.getWaitTimeout())
+	c.WaitTimeout = -1
+	assert.Error(t, c.validate())
+	c.WaitTimeout = 5
+	assert.NoError(t, c.validate())
+	assert.Equal(t, 5*time.Second, c.getWaitTimeout())
+}
+
+func TestTransferBuffersBudget(t *testing.T) {
+	oldPool := transferBuffers
+	defer func() {
+		transferBuffers = oldPool
+	}()
+
+	user := dataprovider.User{}
+	conn1 := NewBaseConnection("id1", ProtocolSFTP, "", "", user)
+	conn2 := NewBaseConnection("id2", ProtocolSFTP, "", "", user)
+	// global budget
+	transferBuffers = newTransferBufferPool(MemoryBudgetConfig{
+		BufferSize: 1024,
+		MaxMemory:  1,
+	})
+	buf, err := conn1.GetTransferBuffer()
+	require.NoError(t, err)
+	assert.Len(t, buf.Buf, 1024*1024)
+	assert.Equal(t, int64(1024*1024), transferBuffers.getUsedMemory())
+	acquired := make(chan *TransferBuffer, 1)
+	go func() {
+		b, err := conn2.GetTransferBuffer()
+		assert.NoError(t, err)
+		acquired <- b
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("the memory budget should be exhausted")
+	case <-time.After(100 * time.Millisecond):
+	}
+	buf.Release()
+	// releasing twice must have no effect
+	buf.Release()
+	assert.Nil(t, buf.Buf)
+	select {
+	case buf = <-acquired:
+	case <-time.After(2 * time.Second):
+		t.Fatal("unable to get a buffer after release")
+	}
+	assert.Equal(t, int64(1024*1024), transferBuffers.getUsedMemory())
+	buf.Release()
+	assert.Equal(t, int64(0), transferBuffers.getUsedMemory())
+	// per connection budget
+	transferBuffers = newTransferBufferPool(MemoryBudgetConfig{
+		BufferSize:          32,
+		MaxConnectionMemory: 64,
+	})
+	buf1, err := conn1.GetTransferBuffer()
+	require.NoError(t, err)
+	buf2, err := conn1.GetTransferBuffer()
+	require.NoError(t, err)
+	buf3, err := conn2.GetTransferBuffer()
+	require.NoError(t, err)
+	go func() {
+		b, err := conn1.GetTransferBuffer()
+		assert.NoError(t, err)
+		acquired <- b
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("the connection memory budget should be exhausted")
+	case <-time.After(100 * time.Millisecond):
+	}
+	buf3.Release()
+	select {
+	case <-acquired:
+		t.Fatal("the connection memory budget should be exhausted")
+	case <-time.After(100 * time.Millisecond):
+	}
+	buf1.Release()
+	select {
+	case buf = <-acquired:
+	case <-time.After(2 * time.Second):
+		t.Fatal("unable to get a buffer after release")
+	}
+	buf.Release()
+	buf2.Release()
+	assert.Equal(t, int64(0), transferBuffers.getUsedMemory())
+	assert.Len(t, transferBuffers.connections, 0)
+}
+
+func TestTransferBuffersWaitTimeout(t *testing.T) {
+	oldPool := transferBuffers
+	defer func() {
+		transferBuffers = oldPool
+	}()
+
+	transferBuffers = newTransferBufferPool(MemoryBudgetConfig{
+		BufferSize:  1024,
+		MaxMemory:   1,
+		WaitTimeout: 1,
+	})
+	conn1 := NewBaseConnection("id1", ProtocolSFTP, "", "", dataprovider.User{})
+	conn2 := NewBaseConnection("id2", ProtocolFTP, "", "", dataprovider.User{})
+	buf, err := conn1.GetTransferBuffer()
+	require.NoError(t, err)
+	// no buffer is released, the waiting transfer must fail after the timeout
+	startTime := time.Now()
+	_, err = conn2.GetTransferBuffer()
+	assert.ErrorIs(t, err, ErrMemoryBudgetExhausted)
+	assert.GreaterOrEqual(t, time.Since(startTime), time.Second)
+	var dst bytes.Buffer
+	_, err = conn2.CopyBuffer(&dst, bytes.NewReader([]byte("data")))
+	assert.ErrorIs(t, err, ErrMemoryBudgetExhausted)
+	assert.Equal(t, 0, dst.Len())
+	assert.Equal(t, int64(1024*1024), transferBuffers.getUsedMemory())
+	assert.Len(t, transferBuffers.connections, 1)
+	assert.ErrorIs(t, conn1.GetGenericError(ErrMemoryBudgetExhausted), sftp.ErrSSHFxFailure)
+	assert.ErrorIs(t, conn2.GetGenericError(ErrMemoryBudgetExhausted), ErrMemoryBudgetExhausted)
+	// a buffer released while waiting is still acquired
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		buf.Release()
+	}()
+	buf, err = conn2.GetTransferBuffer()
+	require.NoError(t, err)
+	buf.Release()
+	assert.Equal(t, int64(0), transferBuffers.getUsedMemory())
+}
+
+func TestCopyBuffer(t *testing.T) {
+	oldPool := transferBuffers
+	defer func() {
+		transferBuffers = oldPool
+	}()
+
+	transferBuffers = newTransferBufferPool(MemoryBudgetConfig{
+		BufferSize:          4,
+		MaxMemory:           1,
+		MaxConnectionMemory: 4,
+	})
+	conn := NewBaseConnection("id", ProtocolFTP, "", "", dataprovider.User{})
+	data := bytes.Repeat([]byte("sftpgo"), 10000)
+	var dst bytes.Buffer
+	n, err := conn.CopyBuffer(&dst, bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.Equal(t, data, dst.Bytes())
+	assert.Equal(t, int64(0), transferBuffers.getUsedMemory())
+}
@@ -0,0 +1,362 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/pkg/sftp"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+const (
+	// the content type detection considers at most the first 512 bytes
+	mimeSniffLen = 512
+)
+
+func getContentTypeDeniedError(protocol string) error {
+	switch protocol {
+	case ProtocolSFTP:
+		return fmt.Errorf("%w: %v", sftp.ErrSSHFxPermissionDenied, ErrContentTypeDenied.Error())
+	case ProtocolWebDAV:
+		// the WebDAV handler only maps permission errors to 403
+		return os.ErrPermission
+	default:
+		return ErrContentTypeDenied
+	}
+}
+
+// GetContentTypeDeniedError returns an appropriate error, for the connection
+// protocol, for the uploads rejected by the MIME policy
+func (c *BaseConnection) GetContentTypeDeniedError() error {
+	return getContentTypeDeniedError(c.protocol)
+}
+
+// IsMIMEPolicyEnabled returns true if the content type of the files uploaded
+// to the specified virtual path must be checked
+func (c *BaseConnection) IsMIMEPolicyEnabled(virtualPath string) bool {
+	_, ok := c.getMIMEPolicy(virtualPath)
+	return ok
+}
+
+// getMIMEPolicy returns the MIME policy for the specified virtual path and
+// true if it is enabled. The files written by the event actions are not
+// checked
+func (c *BaseConnection) getMIMEPolicy(virtualPath string) (vfs.MIMEPolicy, bool) {
+	if c.protocol == protocolEventAction {
+		return vfs.MIMEPolicy{}, false
+	}
+	fsConfig := c.User.GetFsConfigForPath(virtualPath)
+	return fsConfig.MIMEPolicy, fsConfig.MIMEPolicy.IsEnabled()
+}
+
+// checkContentType detects the content type from the first bytes of a file
+// and returns an error if it is not allowed for the specified virtual path.
+// The rejected attempts generate an "upload-rejected" event
+func (c *BaseConnection) checkContentType(policy *vfs.MIMEPolicy, data []byte, fsPath, virtualPath string) error {
+	if len(data) > mimeSniffLen {
+		data = data[:mimeSniffLen]
+	}
+	contentType := http.DetectContentType(data)
+	err := policy.CheckContentType(path.Base(virtualPath), contentType)
+	if err == nil {
+		return nil
+	}
+	c.Log(logger.LevelInfo, "content for file %q rejected by the MIME policy: %v", virtualPath, err)
+	ExecuteActionNotification(c, operationUploadRejected, fsPath, virtualPath, "", "", "", 0, //nolint:errcheck
+		fmt.Errorf("%w: %v", ErrContentTypeDenied, err), 0)
+	return c.GetContentTypeDeniedError()
+}
+
+// checkContentTypeForPath checks the content type of an existing file
+// against the MIME policy for the virtual target path. It is used for
+// renames and copies, so files cannot be moved to a folder or given an
+// extension not allowed by the policy
+func (c *BaseConnection) checkContentTypeForPath(fs vfs.Fs, fsPath, virtualTargetPath string) error {
+	policy, ok := c.getMIMEPolicy(virtualTargetPath)
+	if !ok {
+		return nil
+	}
+	f, r, cancelFn, err := fs.Open(fsPath, 0)
+	if err != nil {
+		return c.GetFsError(fs, err)
+	}
+	if cancelFn != nil {
+		defer cancelFn()
+	}
+	var reader io.ReadCloser = r
+	if f != nil {
+		reader = f
+	}
+	defer reader.Close()
+
+	buf := make([]byte, mimeSniffLen)
+	n, err := io.ReadFull(reader, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return c.GetFsError(fs, err)
+	}
+	if n == 0 {
+		return nil
+	}
+	return c.checkContentType(&policy, buf[:n], fsPath, virtualTargetPath)
+}
+
+// contentSniffer holds the data written at the beginning of an upload until
+// enough data is available to detect the content type. Uploads can be written
+// at random offsets, so the covered bytes are tracked
+type contentSniffer struct {
+	mu      sync.Mutex
+	buf     [mimeSniffLen]byte
+	covered [mimeSniffLen]bool
+	// contiguous bytes buffered from the beginning of the file
+	filled int
+	// end of the farthest buffered write
+	size int
+	done bool
+}
+
+func (s *contentSniffer) add(p []byte, off int64) {
+	n := copy(s.buf[off:], p)
+	for idx := int(off); idx < int(off)+n; idx++ {
+		s.covered[idx] = true
+	}
+	s.size = max(s.size, int(off)+n)
+	for s.filled < mimeSniffLen && s.covered[s.filled] {
+		s.filled++
+	}
+}
+
+// WriteUploadContent appends p to the uploaded file using the specified
+// writer. See WriteUploadContentAt
+func (t *BaseTransfer) WriteUploadContent(w io.Writer, p []byte) (int, error) {
+	return t.writeUploadContent(p, -1, func(b []byte, _ int64) (int, error) {
+		return w.Write(b)
+	})
+}
+
+// WriteUploadContentAt writes p to the uploaded file at the specified offset.
+// If a MIME policy applies, the data for the beginning of the file are
+// buffered until enough data is available to detect the content type and are
+// written once checked. The returned number of bytes includes the buffered ones.
+// FlushUploadContent must be called before closing the file
+func (t *BaseTransfer) WriteUploadContentAt(w io.WriterAt, p []byte, off int64) (int, error) {
+	return t.writeUploadContent(p, off, w.WriteAt)
+}
+
+func (t *BaseTransfer) writeUploadContent(p []byte, off int64, writeAt func([]byte, int64) (int, error)) (int, error) {
+	if off < 0 {
+		off = t.MinWriteOffset + t.BytesReceived.Load()
+	}
+	// resumed uploads are not checked
+	if t.sniffer == nil || t.MinWriteOffset > 0 || off >= mimeSniffLen || len(p) == 0 {
+		return writeAt(p, off)
+	}
+	t.sniffer.mu.Lock()
+	defer t.sniffer.mu.Unlock()
+
+	buffered := min(len(p), mimeSniffLen-int(off))
+	t.sniffer.add(p[:buffered], off)
+	if t.sniffer.done {
+		// the beginning of the file is rewritten after the check
+		if err := t.checkSniffedContent(); err != nil {
+			return 0, err
+		}
+		return writeAt(p, off)
+	}
+	if t.sniffer.filled < mimeSniffLen {
+		if buffered == len(p) {
+			return len(p), nil
+		}
+		// writes at random offsets, the data after the beginning of
+		// the file are removed if the content is rejected
+		n, err := writeAt(p[buffered:], off+int64(buffered))
+		return buffered + n, err
+	}
+	if err := t.writeSniffedContent(writeAt); err != nil {
+		return 0, err
+	}
+	if buffered == len(p) {
+		return len(p), nil
+	}
+	n, err := writeAt(p[buffered:], off+int64(buffered))
+	return buffered + n, err
+}
+
+// checkSniffedContent checks the buffered data, the sniffer lock must be held
+func (t *BaseTransfer) checkSniffedContent() error {
+	t.sniffer.done = true
+	data := t.sniffer.buf[:t.sniffer.size]
+	if err := t.Connection.checkContentType(t.mimePolicy, data, t.fsPath, t.requestPath); err != nil {
+		t.contentDenied.Store(true)
+		return err
+	}
+	return nil
+}
+
+// writeSniffedContent checks the buffered data and writes them if allowed.
+// The sniffer lock must be held
+func (t *BaseTransfer) writeSniffedContent(writeAt func([]byte, int64) (int, error)) error {
+	if err := t.checkSniffedContent(); err != nil {
+		return err
+	}
+	data := t.sniffer.buf[:t.sniffer.size]
+	n, err := writeAt(data, 0)
+	if err == nil && n < len(data) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// FlushUploadContent checks and writes the data buffered by
+// WriteUploadContent, if any. It must be called before closing the file
+func (t *BaseTransfer) FlushUploadContent(w io.Writer) error {
+	return t.flushUploadContent(func(b []byte, _ int64) (int, error) {
+		return w.Write(b)
+	})
+}
+
+// FlushUploadContentAt checks and writes the data buffered by
+// WriteUploadContentAt, if any. It must be called before closing the file
+func (t *BaseTransfer) FlushUploadContentAt(w io.WriterAt) error {
+	return t.flushUploadContent(w.WriteAt)
+}
+
+func (t *BaseTransfer) flushUploadContent(writeAt func([]byte, int64) (int, error)) error {
+	if t.sniffer == nil {
+		return nil
+	}
+	t.sniffer.mu.Lock()
+	defer t.sniffer.mu.Unlock()
+
+	if t.sniffer.done || t.sniffer.size == 0 {
+		return nil
+	}
+	return t.writeSniffedContent(writeAt)
+}
+
+// checkRenameContentType checks a file renamed to the specified virtual
+// target path against its MIME policy. Directories cannot be moved to a
+// folder with a MIME policy from a different folder, their files were not
+// checked
+func (c *BaseConnection) checkRenameContentType(fs vfs.Fs, fsSourcePath, virtualSourcePath, virtualTargetPath string,
+	info os.FileInfo,
+) error {
+	if !c.IsMIMEPolicyEnabled(virtualTargetPath) {
+		return nil
+	}
+	if info.IsDir() {
+		if c.isCrossFoldersRequest(virtualSourcePath, virtualTargetPath) {
+			c.Log(logger.LevelInfo, "denying rename for directory %q to %q, the target has a MIME policy",
+				virtualSourcePath, virtualTargetPath)
+			return c.GetContentTypeDeniedError()
+		}
+		return nil
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	return c.checkContentTypeForPath(fs, fsSourcePath, virtualTargetPath)
+}
+
+// contentCheckWriter checks the content type for the files written outside
+// of the protocol transfers, for example the extracted archives. The data are
+// buffered until enough data is available to detect the content type
+type contentCheckWriter struct {
+	io.WriteCloser
+	conn        *BaseConnection
+	policy      vfs.MIMEPolicy
+	fsPath      string
+	virtualPath string
+	buf         []byte
+	checked     bool
+	denied      bool
+}
+
+func (w *contentCheckWriter) Write(p []byte) (int, error) {
+	if w.denied {
+		return 0, w.conn.GetContentTypeDeniedError()
+	}
+	if w.checked {
+		return w.WriteCloser.Write(p)
+	}
+	if len(w.buf)+len(p) < mimeSniffLen {
+		w.buf = append(w.buf, p...)
+		return len(p), nil
+	}
+	if err := w.check(append(w.buf, p...)); err != nil {
+		return 0, err
+	}
+	n, err := w.WriteCloser.Write(p)
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+// check checks the buffered data and writes them if allowed
+func (w *contentCheckWriter) check(data []byte) error {
+	w.checked = true
+	if err := w.conn.checkContentType(&w.policy, data, w.fsPath, w.virtualPath); err != nil {
+		w.denied = true
+		return err
+	}
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	n, err := w.WriteCloser.Write(buf)
+	if err == nil && n < len(buf) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// Close checks and writes the buffered data, if any, and closes the
+// underlying writer
+func (w *contentCheckWriter) Close() error {
+	var err error
+	if !w.checked && len(w.buf) > 0 {
+		err = w.check(w.buf)
+	}
+	errClose := w.WriteCloser.Close()
+	if err != nil {
+		return err
+	}
+	return errClose
+}
+
+// wrapWriterForContentCheck returns a writer that checks the content type
+// if a MIME policy is defined for the virtual path
+func wrapWriterForContentCheck(conn *BaseConnection, w io.WriteCloser, fsPath, virtualPath string) io.WriteCloser {
+	policy, ok := conn.getMIMEPolicy(virtualPath)
+	if !ok {
+		return w
+	}
+	return &contentCheckWriter{
+		WriteCloser: w,
+		conn:        conn,
+		policy:      policy,
+		fsPath:      fsPath,
+		virtualPath: virtualPath,
+	}
+}
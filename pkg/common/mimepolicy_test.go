@@ -0,0 +1,447 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	"github.com/pkg/sftp"
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+var (
+	testPNGHeader = []byte("\x89PNG\x0D\x0A\x1A\x0A\x00\x00\x00\x0DIHDR")
+	testPDFHeader = []byte("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	testELFHeader = []byte("\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x3e\x00")
+)
+
+func TestMIMEPolicyCheck(t *testing.T) {
+	policy := vfs.MIMEPolicy{}
+	assert.False(t, policy.IsEnabled())
+	policy.AllowedTypes = []string{"image/*", "application/pdf"}
+	assert.True(t, policy.IsEnabled())
+	assert.NoError(t, policy.CheckContentType("a.png", "image/png"))
+	assert.NoError(t, policy.CheckContentType("a.pdf", "application/pdf"))
+	assert.Error(t, policy.CheckContentType("a.txt", "text/plain; charset=utf-8"))
+	policy.DeniedTypes = []string{"image/gif"}
+	assert.Error(t, policy.CheckContentType("a.gif", "image/gif"))
+	assert.NoError(t, policy.CheckContentType("a.gif", "image/png"))
+
+	policy = vfs.MIMEPolicy{
+		CheckExtension: true,
+	}
+	assert.NoError(t, policy.CheckContentType("a.jpg", "image/jpeg"))
+	assert.NoError(t, policy.CheckContentType("a.json", "text/plain; charset=utf-8"))
+	assert.NoError(t, policy.CheckContentType("a.svg", "text/xml; charset=utf-8"))
+	assert.NoError(t, policy.CheckContentType("a.js", "text/plain; charset=utf-8"))
+	// unknown extensions are not checked
+	assert.NoError(t, policy.CheckContentType("file", "application/octet-stream"))
+	assert.NoError(t, policy.CheckContentType("a.unknownext", "application/pdf"))
+	// lying extensions
+	assert.Error(t, policy.CheckContentType("a.jpg", "application/octet-stream"))
+	assert.Error(t, policy.CheckContentType("a.jpg", "image/png"))
+	assert.Error(t, policy.CheckContentType("a.pdf", "text/plain; charset=utf-8"))
+	assert.Error(t, policy.CheckContentType("a.json", "application/zip"))
+
+	assert.ErrorIs(t, getContentTypeDeniedError(ProtocolSFTP), sftp.ErrSSHFxPermissionDenied)
+	assert.ErrorIs(t, getContentTypeDeniedError(ProtocolWebDAV), os.ErrPermission)
+	assert.ErrorIs(t, getContentTypeDeniedError(ProtocolFTP), ErrContentTypeDenied)
+	assert.ErrorIs(t, getContentTypeDeniedError(ProtocolHTTP), ErrContentTypeDenied)
+}
+
+func TestMIMEPolicyValidation(t *testing.T) {
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "mime_validation_user",
+			HomeDir:  filepath.Join(os.TempDir(), "mime_validation_user"),
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+	}
+	for _, invalid := range []string{"image", "*/*", "image/", "text/plain; charset=utf-8", "a/b/c"} {
+		user.FsConfig.MIMEPolicy.AllowedTypes = []string{invalid}
+		err := dataprovider.AddUser(&user, "", "", "")
+		assert.ErrorIs(t, err, util.ErrValidation, invalid)
+	}
+	user.FsConfig.MIMEPolicy.AllowedTypes = []string{" Image/* ", "image/*", "", "application/pdf"}
+	user.FsConfig.MIMEPolicy.DeniedTypes = []string{"image/gif"}
+	err := dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"image/*", "application/pdf"}, user.FsConfig.MIMEPolicy.AllowedTypes)
+	assert.Equal(t, []string{"image/gif"}, user.FsConfig.MIMEPolicy.DeniedTypes)
+	// the upload-rejected event can be used in event rules
+	action := dataprovider.BaseEventAction{
+		Name: "mime action",
+		Type: dataprovider.ActionTypeFilesystem,
+		Options: dataprovider.BaseEventActionOptions{
+			FsConfig: dataprovider.EventActionFilesystemConfig{
+				Type:   dataprovider.FilesystemActionMkdirs,
+				MkDirs: []string{"/rejected"},
+			},
+		},
+	}
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	require.NoError(t, err)
+	rule := dataprovider.EventRule{
+		Name:    "mime rule",
+		Status:  1,
+		Trigger: dataprovider.EventTriggerFsEvent,
+		Conditions: dataprovider.EventConditions{
+			FsEvents: []string{operationUploadRejected},
+		},
+		Actions: []dataprovider.EventAction{
+			{
+				BaseEventAction: dataprovider.BaseEventAction{
+					Name: action.Name,
+				},
+				Order: 1,
+			},
+		},
+	}
+	err = dataprovider.AddEventRule(&rule, "", "", "")
+	assert.NoError(t, err)
+
+	err = dataprovider.DeleteEventRule(rule.Name, "", "", "")
+	assert.NoError(t, err)
+	err = dataprovider.DeleteEventAction(action.Name, "", "", "")
+	assert.NoError(t, err)
+	err = dataprovider.DeleteUser(user.Username, "", "", "")
+	assert.NoError(t, err)
+}
+
+func TestMIMEPolicyFolder(t *testing.T) {
+	baseDir := filepath.Join(os.TempDir(), "mime_test")
+	defer os.RemoveAll(baseDir)
+
+	folder := vfs.BaseVirtualFolder{
+		Name:       "mime_folder",
+		MappedPath: filepath.Join(baseDir, "docs"),
+		FsConfig: vfs.Filesystem{
+			MIMEPolicy: vfs.MIMEPolicy{
+				AllowedTypes:   []string{"application/pdf", "image/*"},
+				CheckExtension: true,
+			},
+		},
+	}
+	err := dataprovider.AddFolder(&folder, "", "", "")
+	require.NoError(t, err)
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "mime_user",
+			HomeDir:  filepath.Join(baseDir, "home"),
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+		VirtualFolders: []vfs.VirtualFolder{
+			{
+				BaseVirtualFolder: vfs.BaseVirtualFolder{
+					Name: folder.Name,
+				},
+				VirtualPath: "/docs",
+			},
+		},
+	}
+	err = dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(folder.MappedPath, os.ModePerm))
+	require.NoError(t, os.MkdirAll(filepath.Join(user.HomeDir, "dir"), os.ModePerm))
+
+	sub := FsEventSubscriptions.Subscribe(user.Username)
+	defer FsEventSubscriptions.Unsubscribe(sub)
+
+	conn := NewBaseConnection("", ProtocolFTP, "", "", user)
+	assert.True(t, conn.IsMIMEPolicyEnabled("/docs/file.pdf"))
+	assert.False(t, conn.IsMIMEPolicyEnabled("/file.pdf"))
+	// rejected upload
+	fs, fsPath, err := conn.GetFsAndResolvedPath("/docs/photo.jpg")
+	require.NoError(t, err)
+	file, err := os.Create(fsPath)
+	require.NoError(t, err)
+	transfer := NewBaseTransfer(file, conn, nil, fsPath, fsPath, "/docs/photo.jpg", TransferUpload, 0, 0, 0, 0,
+		true, fs, dataprovider.TransferQuota{})
+	// the data are buffered until the file is closed, they are too short to detect the content type
+	n, err := transfer.WriteUploadContent(file, testELFHeader)
+	assert.NoError(t, err)
+	assert.Equal(t, len(testELFHeader), n)
+	transfer.BytesReceived.Add(int64(n))
+	err = transfer.FlushUploadContent(file)
+	assert.ErrorIs(t, err, ErrContentTypeDenied)
+	transfer.TransferError(err)
+	info, err := file.Stat()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+	assert.NoError(t, file.Close())
+	err = transfer.Close()
+	assert.ErrorIs(t, err, ErrContentTypeDenied)
+	assert.NoFileExists(t, fsPath)
+	if assert.Len(t, sub.Events(), 2) {
+		ev := <-sub.Events()
+		assert.Equal(t, operationUploadRejected, ev.Action)
+		assert.Equal(t, "/docs/photo.jpg", ev.VirtualPath)
+		assert.Equal(t, 2, ev.Status)
+		ev = <-sub.Events()
+		assert.Equal(t, operationUpload, ev.Action)
+	}
+	// allowed upload, only the beginning of the file is checked
+	fsPath = filepath.Join(folder.MappedPath, "file.pdf")
+	file, err = os.Create(fsPath)
+	require.NoError(t, err)
+	transfer = NewBaseTransfer(file, conn, nil, fsPath, fsPath, "/docs/file.pdf", TransferUpload, 0, 0, 0, 0,
+		true, fs, dataprovider.TransferQuota{})
+	n, err = transfer.WriteUploadContent(file, testPDFHeader)
+	assert.NoError(t, err)
+	transfer.BytesReceived.Add(int64(n))
+	n, err = transfer.WriteUploadContent(file, testELFHeader)
+	assert.NoError(t, err)
+	transfer.BytesReceived.Add(int64(n))
+	assert.NoError(t, transfer.FlushUploadContent(file))
+	assert.NoError(t, file.Close())
+	content, err := os.ReadFile(fsPath)
+	assert.NoError(t, err)
+	assert.Equal(t, append(append([]byte{}, testPDFHeader...), testELFHeader...), content)
+	assert.NoError(t, transfer.Close())
+	assert.FileExists(t, fsPath)
+	for len(sub.Events()) > 0 {
+		<-sub.Events()
+	}
+	// renames and copies
+	require.NoError(t, os.WriteFile(filepath.Join(user.HomeDir, "image.png"), testPNGHeader, 0666))
+	require.NoError(t, os.WriteFile(filepath.Join(user.HomeDir, "app.png"), testELFHeader, 0666))
+	require.NoError(t, os.WriteFile(filepath.Join(user.HomeDir, "empty.txt"), nil, 0666))
+	err = conn.Rename("/app.png", "/docs/app.png")
+	assert.ErrorIs(t, err, ErrContentTypeDenied)
+	err = conn.Copy("/app.png", "/docs/app.png")
+	assert.ErrorIs(t, err, ErrContentTypeDenied)
+	assert.NoFileExists(t, filepath.Join(folder.MappedPath, "app.png"))
+	// the extension does not match
+	err = conn.Rename("/docs/file.pdf", "/docs/file.png")
+	assert.ErrorIs(t, err, ErrContentTypeDenied)
+	err = conn.Rename("/dir", "/docs/dir")
+	assert.ErrorIs(t, err, ErrContentTypeDenied)
+	assert.Len(t, sub.Events(), 3)
+	err = conn.Copy("/image.png", "/docs/image.png")
+	assert.NoError(t, err)
+	err = conn.Rename("/image.png", "/docs/image1.png")
+	assert.NoError(t, err)
+	err = conn.Rename("/empty.txt", "/docs/empty.txt")
+	assert.NoError(t, err)
+	// files outside the folder are not checked
+	err = conn.Rename("/app.png", "/app1.png")
+	assert.NoError(t, err)
+	// the writers used outside the transfers check the content too
+	w, _, _, cancelFn, err := getFileWriter(conn, "/docs/app.pdf", 0)
+	require.NoError(t, err)
+	_, err = w.Write(testELFHeader)
+	assert.NoError(t, err)
+	err = w.Close()
+	assert.ErrorIs(t, err, ErrContentTypeDenied)
+	cancelFn()
+	w, _, _, cancelFn, err = getFileWriter(conn, "/docs/app.pdf", 0)
+	require.NoError(t, err)
+	_, err = w.Write(bytes.Repeat(testELFHeader, 30))
+	assert.ErrorIs(t, err, ErrContentTypeDenied)
+	assert.NoError(t, w.Close())
+	cancelFn()
+	w, _, _, cancelFn, err = getFileWriter(conn, "/docs/doc.pdf", 0)
+	require.NoError(t, err)
+	_, err = io.Copy(w, io.MultiReader(bytes.NewReader(testPDFHeader), bytes.NewReader(testELFHeader)))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	cancelFn()
+	// the event actions are not checked
+	eventConn := NewBaseConnection("", protocolEventAction, "", "", user)
+	assert.False(t, eventConn.IsMIMEPolicyEnabled("/docs/file.pdf"))
+
+	sftpConn := NewBaseConnection("", ProtocolSFTP, "", "", user)
+	err = sftpConn.Rename("/app1.png", "/docs/app.png")
+	assert.ErrorIs(t, err, sftp.ErrSSHFxPermissionDenied)
+
+	err = dataprovider.DeleteUser(user.Username, "", "", "")
+	assert.NoError(t, err)
+	err = dataprovider.DeleteFolder(folder.Name, "", "", "")
+	assert.NoError(t, err)
+}
+
+func TestMIMEPolicyShortWrites(t *testing.T) {
+	baseDir := filepath.Join(os.TempDir(), "mime_short_writes")
+	defer os.RemoveAll(baseDir)
+
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "mime_short_writes_user",
+			HomeDir:  baseDir,
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+		FsConfig: vfs.Filesystem{
+			MIMEPolicy: vfs.MIMEPolicy{
+				AllowedTypes: []string{"application/pdf"},
+			},
+		},
+	}
+	require.NoError(t, os.MkdirAll(baseDir, os.ModePerm))
+	conn := NewBaseConnection("", ProtocolFTP, "", "", user)
+	fs := vfs.NewOsFs(conn.ID, baseDir, "", nil)
+	elfContent := append(append([]byte{}, testELFHeader...), bytes.Repeat([]byte{0}, 1024)...)
+	pdfContent := append(append([]byte{}, testPDFHeader...), bytes.Repeat([]byte("pdf"), 300)...)
+
+	newTransfer := func(name string, minWriteOffset int64) (*BaseTransfer, *os.File) {
+		fsPath := filepath.Join(baseDir, name)
+		file, err := os.Create(fsPath)
+		require.NoError(t, err)
+		transfer := NewBaseTransfer(nil, conn, nil, fsPath, fsPath, "/"+name, TransferUpload, minWriteOffset, 0, 0, 0,
+			true, fs, dataprovider.TransferQuota{})
+		return transfer, file
+	}
+	writeChunks := func(transfer *BaseTransfer, file *os.File, content []byte, chunkSize int) error {
+		for len(content) > 0 {
+			chunk := content[:min(chunkSize, len(content))]
+			n, err := transfer.WriteUploadContent(file, chunk)
+			transfer.BytesReceived.Add(int64(n))
+			if err != nil {
+				return err
+			}
+			content = content[n:]
+		}
+		return transfer.FlushUploadContent(file)
+	}
+
+	for _, chunkSize := range []int{1, 3, 100, 511, 512, 2048} {
+		transfer, file := newTransfer("file.bin", 0)
+		err := writeChunks(transfer, file, elfContent, chunkSize)
+		assert.ErrorIs(t, err, ErrContentTypeDenied, "chunk size %d", chunkSize)
+		assert.True(t, transfer.contentDenied.Load())
+		info, err := file.Stat()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), info.Size(), "chunk size %d", chunkSize)
+		assert.NoError(t, file.Close())
+
+		transfer, file = newTransfer("file.pdf", 0)
+		err = writeChunks(transfer, file, pdfContent, chunkSize)
+		assert.NoError(t, err, "chunk size %d", chunkSize)
+		assert.NoError(t, file.Close())
+		content, err := os.ReadFile(file.Name())
+		assert.NoError(t, err)
+		assert.Equal(t, pdfContent, content, "chunk size %d", chunkSize)
+	}
+	// files shorter than the sniff length are checked when flushed
+	transfer, file := newTransfer("short.bin", 0)
+	err := writeChunks(transfer, file, testELFHeader, 1)
+	assert.ErrorIs(t, err, ErrContentTypeDenied)
+	assert.NoError(t, file.Close())
+	transfer, file = newTransfer("short.pdf", 0)
+	err = writeChunks(transfer, file, testPDFHeader, 2)
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+	content, err := os.ReadFile(file.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, testPDFHeader, content)
+	// random offsets, the data after the beginning of the file are written immediately
+	transfer, file = newTransfer("random.pdf", 0)
+	n, err := transfer.WriteUploadContentAt(file, pdfContent[600:], 600)
+	assert.NoError(t, err)
+	assert.Equal(t, len(pdfContent)-600, n)
+	n, err = transfer.WriteUploadContentAt(file, pdfContent[1:600], 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 599, n)
+	info, err := file.Stat()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(pdfContent)), info.Size())
+	content = make([]byte, mimeSniffLen)
+	_, err = file.ReadAt(content, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, make([]byte, mimeSniffLen), content)
+	n, err = transfer.WriteUploadContentAt(file, pdfContent[:1], 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.NoError(t, transfer.FlushUploadContentAt(file))
+	assert.NoError(t, file.Close())
+	content, err = os.ReadFile(file.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, pdfContent, content)
+	// the beginning of the file cannot be replaced after the check
+	transfer, file = newTransfer("rewrite.pdf", 0)
+	_, err = transfer.WriteUploadContentAt(file, pdfContent, 0)
+	assert.NoError(t, err)
+	_, err = transfer.WriteUploadContentAt(file, testELFHeader, 0)
+	assert.ErrorIs(t, err, ErrContentTypeDenied)
+	assert.NoError(t, file.Close())
+	// resumed uploads are not checked
+	transfer, file = newTransfer("resume.bin", 10)
+	_, err = transfer.WriteUploadContentAt(file, elfContent, 10)
+	assert.NoError(t, err)
+	assert.NoError(t, transfer.FlushUploadContentAt(file))
+	assert.NoError(t, file.Close())
+	// the writers used outside the transfers
+	for _, chunkSize := range []int{1, 7, 600} {
+		cw := &contentCheckWriter{
+			WriteCloser: &bufferWriteCloser{},
+			conn:        conn,
+			policy:      user.FsConfig.MIMEPolicy,
+			virtualPath: "/file.bin",
+		}
+		var err error
+		for content := elfContent; len(content) > 0 && err == nil; {
+			chunk := content[:min(chunkSize, len(content))]
+			_, err = cw.Write(chunk)
+			content = content[len(chunk):]
+		}
+		assert.ErrorIs(t, err, ErrContentTypeDenied, "chunk size %d", chunkSize)
+		assert.NoError(t, cw.Close())
+		assert.True(t, cw.denied)
+		assert.Equal(t, 0, cw.WriteCloser.(*bufferWriteCloser).Len())
+	}
+	for _, content := range [][]byte{testPDFHeader, pdfContent} {
+		cw := &contentCheckWriter{
+			WriteCloser: &bufferWriteCloser{},
+			conn:        conn,
+			policy:      user.FsConfig.MIMEPolicy,
+			virtualPath: "/file.pdf",
+		}
+		_, err = io.Copy(cw, iotest.OneByteReader(bytes.NewReader(content)))
+		assert.NoError(t, err)
+		assert.NoError(t, cw.Close())
+		assert.Equal(t, content, cw.WriteCloser.(*bufferWriteCloser).Bytes())
+	}
+}
+
+type bufferWriteCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,190 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+func TestObjectCacheConfig(t *testing.T) {
+	c := vfs.ObjectCacheConfig{}
+	assert.NoError(t, c.Validate())
+	assert.False(t, c.IsEnabled())
+	c.Path = "relative"
+	assert.Error(t, c.Validate())
+	c.Path = filepath.Join(os.TempDir(), "object_cache_cfg")
+	assert.Error(t, c.Validate())
+	c.MaxSize = 10
+	c.MaxObjectSize = 11
+	assert.Error(t, c.Validate())
+	c.MaxObjectSize = -1
+	assert.Error(t, c.Validate())
+	c.MaxObjectSize = 0
+	assert.NoError(t, c.Validate())
+	assert.DirExists(t, c.Path)
+	assert.NoError(t, os.RemoveAll(c.Path))
+}
+
+func TestObjectCacheFs(t *testing.T) {
+	baseDir := filepath.Join(os.TempDir(), "object_cache_test")
+	cacheDir := filepath.Join(baseDir, "cache")
+	rootDir := filepath.Join(baseDir, "root")
+	require.NoError(t, os.MkdirAll(rootDir, os.ModePerm))
+	defer os.RemoveAll(baseDir)
+
+	osFs := vfs.NewOsFs("", rootDir, "", &sdk.OSFsConfig{ReadBufferSize: 1, WriteBufferSize: 1})
+	// the cache is disabled
+	assert.Equal(t, osFs, vfs.NewObjectCacheFs(osFs, "ns"))
+
+	config := vfs.ObjectCacheConfig{
+		Path:         cacheDir,
+		MaxSize:      1,
+		CacheUploads: true,
+	}
+	require.NoError(t, config.Validate())
+	// a leftover partial object is removed on load
+	require.NoError(t, os.WriteFile(filepath.Join(cacheDir, "leftover.part"), []byte("data"), 0600))
+	vfs.SetObjectCacheConfig(config)
+	defer vfs.SetObjectCacheConfig(vfs.ObjectCacheConfig{})
+	assert.NoFileExists(t, filepath.Join(cacheDir, "leftover.part"))
+
+	fs := vfs.NewObjectCacheFs(osFs, "ns")
+	assert.NotEqual(t, osFs, fs)
+	assert.Equal(t, osFs.Name(), fs.Name())
+	_, ok := fs.(vfs.FsFileCopier)
+	assert.False(t, ok)
+
+	countCached := func() int {
+		matches, err := filepath.Glob(filepath.Join(cacheDir, "*.cache"))
+		require.NoError(t, err)
+		return len(matches)
+	}
+	readFs := func(fs vfs.Fs, name string, offset int64) ([]byte, bool) {
+		f, r, _, err := fs.Open(filepath.Join(rootDir, name), offset)
+		require.NoError(t, err)
+		var reader io.ReadCloser = r
+		if f != nil {
+			reader = f
+		}
+		contents, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		return contents, f != nil
+	}
+	read := func(name string, offset int64) ([]byte, bool) {
+		return readFs(fs, name, offset)
+	}
+
+	data1 := util.GenerateRandomBytes(600 * 1024)
+	data2 := util.GenerateRandomBytes(600 * 1024)
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "file1"), data1, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "file2"), data2, 0600))
+	// partial downloads are not cached
+	contents, cached := read("file1", 10)
+	assert.False(t, cached)
+	assert.Equal(t, data1[10:], contents)
+	assert.Equal(t, 0, countCached())
+	// the first download fills the cache
+	contents, cached = read("file1", 0)
+	assert.False(t, cached)
+	assert.Equal(t, data1, contents)
+	assert.Equal(t, 1, countCached())
+	contents, cached = read("file1", 0)
+	assert.True(t, cached)
+	assert.Equal(t, data1, contents)
+	contents, cached = read("file1", 100)
+	assert.True(t, cached)
+	assert.Equal(t, data1[100:], contents)
+	// the cache size is exceeded, file1 is evicted
+	contents, cached = read("file2", 0)
+	assert.False(t, cached)
+	assert.Equal(t, data2, contents)
+	assert.Equal(t, 1, countCached())
+	contents, cached = read("file2", 0)
+	assert.True(t, cached)
+	assert.Equal(t, data2, contents)
+	_, cached = read("file1", 0)
+	assert.False(t, cached)
+	// changes made outside SFTPGo are detected
+	data1 = util.GenerateRandomBytes(600 * 1024)
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "file1"), data1, 0600))
+	modTime := time.Now().Add(-1 * time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(rootDir, "file1"), modTime, modTime))
+	contents, cached = read("file1", 0)
+	assert.False(t, cached)
+	assert.Equal(t, data1, contents)
+	// the cache is reloaded
+	vfs.SetObjectCacheConfig(config)
+	fs = vfs.NewObjectCacheFs(osFs, "ns")
+	assert.Equal(t, 1, countCached())
+	contents, cached = read("file1", 0)
+	assert.True(t, cached)
+	assert.Equal(t, data1, contents)
+	// renamed and removed objects are removed from the cache
+	_, _, err := fs.Rename(filepath.Join(rootDir, "file1"), filepath.Join(rootDir, "file3"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, countCached())
+	_, cached = read("file3", 0)
+	assert.False(t, cached)
+	assert.NoError(t, fs.Remove(filepath.Join(rootDir, "file3"), false))
+	assert.Equal(t, 0, countCached())
+	// uploads are cached
+	data3 := util.GenerateRandomBytes(65535)
+	_, w, _, err := fs.Create(filepath.Join(rootDir, "file4"), 0, 0)
+	require.NoError(t, err)
+	require.NotNil(t, w)
+	_, err = w.Write(data3)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.Eventually(t, func() bool { return countCached() == 1 }, 2*time.Second, 50*time.Millisecond)
+	contents, cached = read("file4", 0)
+	assert.True(t, cached)
+	assert.Equal(t, data3, contents)
+	stored, err := os.ReadFile(filepath.Join(rootDir, "file4"))
+	assert.NoError(t, err)
+	assert.Equal(t, data3, stored)
+	// another namespace does not share the cached objects
+	otherFs := vfs.NewObjectCacheFs(osFs, "other ns")
+	contents, cached = readFs(otherFs, "file4", 0)
+	assert.False(t, cached)
+	assert.Equal(t, data3, contents)
+	assert.Equal(t, 2, countCached())
+	_, cached = readFs(otherFs, "file4", 0)
+	assert.True(t, cached)
+	// objects bigger than the max object size are not cached
+	config.MaxSize = 2
+	config.MaxObjectSize = 1
+	vfs.SetObjectCacheConfig(config)
+	fs = vfs.NewObjectCacheFs(osFs, "ns")
+	data5 := util.GenerateRandomBytes(1024*1024 + 1)
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "file5"), data5, 0600))
+	contents, cached = read("file5", 0)
+	assert.False(t, cached)
+	assert.Equal(t, data5, contents)
+	_, cached = read("file5", 0)
+	assert.False(t, cached)
+	assert.Equal(t, 2, countCached())
+}
@@ -0,0 +1,199 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/kms"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+func TestPGPFsConfigValidation(t *testing.T) {
+	_, publicKey, privateKey := getPGPTestKeys(t)
+	_, otherPublicKey, otherPrivateKey := getPGPTestKeys(t)
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "pgp_validation_user",
+			HomeDir:  filepath.Join(os.TempDir(), "pgp_validation_user"),
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+	}
+	user.FsConfig.PGPConfig.PublicKeys = []string{"invalid key"}
+	err := dataprovider.AddUser(&user, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	// a private key is not allowed as public key
+	user.FsConfig.PGPConfig.PublicKeys = []string{privateKey}
+	err = dataprovider.AddUser(&user, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	user.FsConfig.PGPConfig.PublicKeys = []string{publicKey, otherPublicKey}
+	user.FsConfig.PGPConfig.DecryptUsers = []string{user.Username}
+	// the private key is required to decrypt the files
+	err = dataprovider.AddUser(&user, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	user.FsConfig.PGPConfig.PrivateKey = kms.NewPlainSecret(publicKey)
+	err = dataprovider.AddUser(&user, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	_, _, unrelatedPrivateKey := getPGPTestKeys(t)
+	user.FsConfig.PGPConfig.PrivateKey = kms.NewPlainSecret(unrelatedPrivateKey)
+	err = dataprovider.AddUser(&user, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	user.FsConfig.PGPConfig.PrivateKey = kms.NewPlainSecret(otherPrivateKey)
+	user.FsConfig.PGPConfig.DecryptUsers = []string{user.Username, " ", user.Username}
+	err = dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+	assert.Len(t, user.FsConfig.PGPConfig.PublicKeys, 2)
+	assert.Equal(t, []string{user.Username}, user.FsConfig.PGPConfig.DecryptUsers)
+	assert.True(t, user.FsConfig.PGPConfig.PrivateKey.IsEncrypted())
+	assert.True(t, user.FsConfig.PGPConfig.CanDecrypt(user.Username))
+	assert.False(t, user.FsConfig.PGPConfig.CanDecrypt("other"))
+	// the encrypted private key is not validated again
+	err = dataprovider.UpdateUser(&user, "", "", "")
+	assert.NoError(t, err)
+	// without public keys the PGP settings are removed
+	user.FsConfig.PGPConfig.PublicKeys = []string{" "}
+	err = dataprovider.UpdateUser(&user, "", "", "")
+	assert.NoError(t, err)
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+	assert.False(t, user.FsConfig.PGPConfig.IsEnabled())
+	assert.True(t, user.FsConfig.PGPConfig.PrivateKey.IsEmpty())
+	assert.Len(t, user.FsConfig.PGPConfig.DecryptUsers, 0)
+
+	err = dataprovider.DeleteUser(user.Username, "", "", "")
+	assert.NoError(t, err)
+}
+
+func TestPGPFs(t *testing.T) {
+	_, publicKey, privateKey := getPGPTestKeys(t)
+	homeDir := filepath.Join(os.TempDir(), "pgp_test")
+	require.NoError(t, os.MkdirAll(homeDir, os.ModePerm))
+	defer os.RemoveAll(homeDir)
+
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "pgp_user",
+			HomeDir:  homeDir,
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+	}
+	user.FsConfig.PGPConfig = vfs.PGPFsConfig{
+		PublicKeys:   []string{publicKey},
+		PrivateKey:   kms.NewPlainSecret(privateKey),
+		DecryptUsers: []string{user.Username},
+	}
+	err := dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+
+	conn := NewBaseConnection("", ProtocolSFTP, "", "", user)
+	fs, fsPath, err := conn.GetFsAndResolvedPath("/file.txt")
+	require.NoError(t, err)
+	assert.True(t, vfs.IsPGPFs(fs))
+	assert.False(t, vfs.IsLocalOsFs(fs))
+	assert.False(t, fs.IsUploadResumeSupported())
+	assert.ErrorIs(t, fs.Truncate(fsPath, 0), vfs.ErrVfsUnsupported)
+	_, _, _, err = fs.Create(fsPath, os.O_WRONLY|os.O_APPEND, 0)
+	assert.ErrorIs(t, err, vfs.ErrVfsUnsupported)
+
+	data := []byte("some plain text contents to encrypt")
+	f, w, cancelFn, err := fs.Create(fsPath, 0, 0)
+	require.NoError(t, err)
+	assert.Nil(t, f)
+	require.NotNil(t, cancelFn)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	// the stored file is encrypted
+	stored, err := os.ReadFile(fsPath)
+	require.NoError(t, err)
+	assert.NotContains(t, string(stored), string(data))
+	keys, err := util.ReadPGPPrivateKeys(privateKey, "")
+	require.NoError(t, err)
+	var decrypted bytes.Buffer
+	_, err = util.PGPDecrypt(&decrypted, bytes.NewReader(stored), keys)
+	require.NoError(t, err)
+	assert.Equal(t, data, decrypted.Bytes())
+	// the user is allowed to download the decrypted file
+	info, err := fs.Stat(fsPath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), info.Size())
+	mimeType, err := fs.GetMimeType(fsPath)
+	require.NoError(t, err)
+	assert.Contains(t, mimeType, "text/plain")
+	readAll := func(fs vfs.Fs, offset int64) []byte {
+		_, r, cancelFn, err := fs.Open(fsPath, offset)
+		require.NoError(t, err)
+		require.NotNil(t, r)
+		defer cancelFn()
+		contents, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		return contents
+	}
+	assert.Equal(t, data, readAll(fs, 0))
+	assert.Equal(t, data[5:], readAll(fs, 5))
+	// the other users download the encrypted file
+	otherFs, err := vfs.NewPGPFs(vfs.NewOsFs("", homeDir, "", nil), user.FsConfig.PGPConfig, "other")
+	require.NoError(t, err)
+	info, err = otherFs.Stat(fsPath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(stored)), info.Size())
+	mimeType, err = otherFs.GetMimeType(fsPath)
+	require.NoError(t, err)
+	assert.Equal(t, "application/pgp-encrypted", mimeType)
+	f, _, _, err = otherFs.Open(fsPath, 0)
+	require.NoError(t, err)
+	contents, err := io.ReadAll(f)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, stored, contents)
+	// an aborted upload is removed
+	abortedPath := filepath.Join(homeDir, "aborted.txt")
+	_, w, cancelFn, err = fs.Create(abortedPath, 0, 0)
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	cancelFn()
+	assert.Error(t, w.Close())
+	assert.NoFileExists(t, abortedPath)
+	// encryption is disabled
+	osFs := vfs.NewOsFs("", homeDir, "", nil)
+	plainFs, err := vfs.NewPGPFs(osFs, vfs.PGPFsConfig{}, user.Username)
+	require.NoError(t, err)
+	assert.Equal(t, osFs, plainFs)
+
+	err = dataprovider.DeleteUser(user.Username, "", "", "")
+	assert.NoError(t, err)
+}
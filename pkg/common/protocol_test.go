@@ -15,9 +15,13 @@
 package common_test
 
 import (
+	"archive/zip"
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -26,10 +30,12 @@ import (
 	"math"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -40,6 +46,7 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/mhale/smtpd"
 	"github.com/minio/sio"
+	"github.com/pires/go-proxyproto"
 	"github.com/pkg/sftp"
 	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
@@ -979,13 +986,15 @@ func TestHiddenRoot(t *testing.T) {
 	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
 	assert.NoError(t, err)
 
+	// use the test user home dir, the returned user is empty if it cannot be added
+	homeDir := u.GetHomeDir()
 	for i := 0; i < 10; i++ {
-		err = os.MkdirAll(filepath.Join(user.HomeDir, fmt.Sprintf("ftp%d", i)), os.ModePerm)
+		err = os.MkdirAll(filepath.Join(homeDir, fmt.Sprintf("ftp%d", i)), os.ModePerm)
 		assert.NoError(t, err)
 	}
-	err = os.WriteFile(filepath.Join(user.HomeDir, testFileName), []byte(""), 0666)
+	err = os.WriteFile(filepath.Join(homeDir, testFileName), []byte(""), 0666)
 	assert.NoError(t, err)
-	err = os.WriteFile(filepath.Join(user.HomeDir, "ftp.txt"), []byte(""), 0666)
+	err = os.WriteFile(filepath.Join(homeDir, "ftp.txt"), []byte(""), 0666)
 	assert.NoError(t, err)
 	conn, client, err := getSftpClient(user)
 	if assert.NoError(t, err) {
@@ -1025,7 +1034,7 @@ func TestHiddenRoot(t *testing.T) {
 
 	_, err = httpdtest.RemoveUser(user, http.StatusOK)
 	assert.NoError(t, err)
-	err = os.RemoveAll(user.GetHomeDir())
+	err = os.RemoveAll(homeDir)
 	assert.NoError(t, err)
 }
 
@@ -1061,6 +1070,101 @@ func TestFileNotAllowedErrors(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestMIMEPolicyShortChunks(t *testing.T) {
+	u := getTestUser()
+	u.FsConfig.MIMEPolicy = vfs.MIMEPolicy{
+		AllowedTypes: []string{"text/*"},
+	}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	conn, client, err := getSftpClient(user)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+
+		writeChunks := func(name string, content []byte, chunkSize int) error {
+			f, err := client.Create(name)
+			if err != nil {
+				return err
+			}
+			for len(content) > 0 {
+				chunk := content[:min(chunkSize, len(content))]
+				if _, err := f.Write(chunk); err != nil {
+					f.Close()
+					return err
+				}
+				content = content[len(chunk):]
+			}
+			return f.Close()
+		}
+		elfContent := []byte("\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x3e\x00")
+		for _, chunkSize := range []int{1, 5, 1024} {
+			// the content type is detected from the first 512 bytes or on close for shorter files
+			err = writeChunks("file.bin", elfContent, chunkSize)
+			assert.ErrorIs(t, err, os.ErrPermission, "chunk size %d", chunkSize)
+			assert.NoFileExists(t, filepath.Join(user.GetHomeDir(), "file.bin"))
+			err = writeChunks("file.bin", append(elfContent, make([]byte, 1024)...), chunkSize)
+			assert.ErrorIs(t, err, os.ErrPermission, "chunk size %d", chunkSize)
+			assert.NoFileExists(t, filepath.Join(user.GetHomeDir(), "file.bin"))
+			err = writeChunks("file.txt", testFileContent, chunkSize)
+			assert.NoError(t, err, "chunk size %d", chunkSize)
+			content, err := os.ReadFile(filepath.Join(user.GetHomeDir(), "file.txt"))
+			assert.NoError(t, err)
+			assert.Equal(t, testFileContent, content)
+		}
+	}
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestWORMBackdateDuringUpload(t *testing.T) {
+	u := getTestUser()
+	u.FsConfig.WORMConfig = vfs.WORMConfig{
+		Enabled:   true,
+		Retention: 1,
+	}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	conn, client, err := getSftpClient(user)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+
+		backdated := time.Now().Add(-24 * time.Hour)
+		f, err := client.Create(testFileName)
+		require.NoError(t, err)
+		_, err = f.Write(testFileContent)
+		assert.NoError(t, err)
+		// the retention cannot be shortened while the file is being uploaded
+		err = client.Chtimes(testFileName, backdated, backdated)
+		assert.ErrorIs(t, err, os.ErrPermission)
+		err = f.Chmod(0644)
+		assert.NoError(t, err)
+		err = f.Close()
+		assert.NoError(t, err)
+
+		info, err := client.Stat(testFileName)
+		if assert.NoError(t, err) {
+			assert.WithinDuration(t, time.Now(), info.ModTime(), time.Minute)
+		}
+		err = client.Chtimes(testFileName, backdated, backdated)
+		assert.ErrorIs(t, err, os.ErrPermission)
+		err = client.Remove(testFileName)
+		assert.Error(t, err)
+		assert.FileExists(t, filepath.Join(user.GetHomeDir(), testFileName))
+		err = client.Rename(testFileName, testFileName+"_rename")
+		assert.ErrorIs(t, err, os.ErrPermission)
+	}
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestRootDirVirtualFolder(t *testing.T) {
 	u := getTestUser()
 	u.QuotaFiles = 1000
@@ -6966,6 +7070,200 @@ func TestEventRulePasswordExpiration(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestEventRulePublicKeyExpiration(t *testing.T) {
+	smtpCfg := smtp.Config{
+		Host:          "127.0.0.1",
+		Port:          2525,
+		From:          "notification@example.com",
+		TemplatesPath: "templates",
+	}
+	err := smtpCfg.Initialize(configDir, true)
+	require.NoError(t, err)
+
+	authorizedKey := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIElL26d02wTylLuNYR0UTsQLJXMsiAksWHl9JL959pBo"
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	require.NoError(t, err)
+	fingerprint := ssh.FingerprintSHA256(pubKey)
+
+	u := getTestUser()
+	u.Email = "user@example.com"
+	u.PublicKeys = []string{authorizedKey}
+	u.Filters.PublicKeysExpiration = []dataprovider.PublicKeyExpiration{
+		{
+			Fingerprint: fingerprint,
+			ExpiresAt:   util.GetTimeAsMsSinceEpoch(time.Now().Add(20 * 24 * time.Hour)),
+		},
+	}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	a1 := dataprovider.BaseEventAction{
+		Name: "a1",
+		Type: dataprovider.ActionTypePublicKeyExpirationCheck,
+		Options: dataprovider.BaseEventActionOptions{
+			PubKeyExpirationConfig: dataprovider.EventActionPublicKeyExpiration{
+				Threshold: 10,
+			},
+		},
+	}
+	action1, _, err := httpdtest.AddEventAction(a1, http.StatusCreated)
+	assert.NoError(t, err)
+	r1 := dataprovider.EventRule{
+		Name:    "rule1",
+		Status:  1,
+		Trigger: dataprovider.EventTriggerFsEvent,
+		Conditions: dataprovider.EventConditions{
+			FsEvents: []string{"mkdir"},
+		},
+		Actions: []dataprovider.EventAction{
+			{
+				BaseEventAction: dataprovider.BaseEventAction{
+					Name: action1.Name,
+				},
+				Order: 1,
+			},
+		},
+	}
+	rule1, resp, err := httpdtest.AddEventRule(r1, http.StatusCreated)
+	assert.NoError(t, err, string(resp))
+	dirName := "aTestDir"
+
+	conn, client, err := getSftpClient(user)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+
+		lastReceivedEmail.reset()
+		err := client.Mkdir(dirName)
+		assert.NoError(t, err)
+		// the public key is not about to expire, no email is sent
+		time.Sleep(300 * time.Millisecond)
+		assert.Empty(t, lastReceivedEmail.get().From)
+		err = client.RemoveDirectory(dirName)
+		assert.NoError(t, err)
+	}
+	user.Filters.PublicKeysExpiration[0].ExpiresAt = util.GetTimeAsMsSinceEpoch(time.Now().Add(3 * 24 * time.Hour))
+	_, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	_, _, err = dataprovider.CheckUserAndPubKey(user.Username, pubKey.Marshal(), "127.0.0.1", common.ProtocolSSH, false)
+	assert.NoError(t, err)
+	conn, client, err = getSftpClient(user)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+
+		lastReceivedEmail.reset()
+		err := client.Mkdir(dirName)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			return lastReceivedEmail.get().From != ""
+		}, 1500*time.Millisecond, 100*time.Millisecond)
+		email := lastReceivedEmail.get()
+		assert.Len(t, email.To, 1)
+		assert.True(t, util.Contains(email.To, user.Email))
+		assert.Contains(t, email.Data, "Subject: SFTPGo public key expiration notification")
+		assert.Contains(t, email.Data, "expires in 3 days")
+		err = client.RemoveDirectory(dirName)
+		assert.NoError(t, err)
+	}
+	// expired keys are refused
+	user.Filters.PublicKeysExpiration[0].ExpiresAt = util.GetTimeAsMsSinceEpoch(time.Now().Add(-1 * time.Hour))
+	_, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	_, _, err = dataprovider.CheckUserAndPubKey(user.Username, pubKey.Marshal(), "127.0.0.1", common.ProtocolSSH, false)
+	assert.Error(t, err)
+	conn, client, err = getSftpClient(user)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+
+		lastReceivedEmail.reset()
+		err := client.Mkdir(dirName)
+		assert.NoError(t, err)
+		// expired keys are not notified
+		time.Sleep(300 * time.Millisecond)
+		assert.Empty(t, lastReceivedEmail.get().From)
+	}
+
+	_, err = httpdtest.RemoveEventRule(rule1, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveEventAction(action1, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+
+	smtpCfg = smtp.Config{}
+	err = smtpCfg.Initialize(configDir, true)
+	require.NoError(t, err)
+}
+
+func TestUserWebhooks(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		var payload map[string]any
+		err = json.Unmarshal(body, &payload)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, r.Header.Get("X-SFTPGo-Signature"))
+		mu.Lock()
+		events = append(events, fmt.Sprintf("%v %v", payload["event"], payload["virtual_path"]))
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	common.Config.UserWebhooks.Enabled = true
+	common.Config.UserWebhooks.Timeout = 5
+	common.Config.UserWebhooks.AllowPrivateNetworks = true
+	defer func() {
+		common.Config.UserWebhooks.Enabled = false
+		common.Config.UserWebhooks.AllowPrivateNetworks = false
+	}()
+
+	u := getTestUser()
+	u.Filters.Webhooks = []dataprovider.UserWebhook{
+		{
+			Name:   "hook",
+			Path:   "/dir",
+			URL:    server.URL,
+			Secret: kms.NewPlainSecret("secret"),
+			Events: []string{"upload", "mkdir"},
+		},
+	}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	conn, client, err := getSftpClient(user)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+
+		err = client.Mkdir("/dir")
+		assert.NoError(t, err)
+		err = writeSFTPFile("/dir/file.txt", 100, client)
+		assert.NoError(t, err)
+		// outside the webhook folder
+		err = writeSFTPFile("/file.txt", 100, client)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(events) == 2
+		}, 3*time.Second, 100*time.Millisecond)
+		time.Sleep(200 * time.Millisecond)
+		mu.Lock()
+		assert.ElementsMatch(t, []string{"mkdir /dir", "upload /dir/file.txt"}, events)
+		mu.Unlock()
+	}
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestSyncUploadAction(t *testing.T) {
 	if runtime.GOOS == osWindows {
 		t.Skip("this test is not available on Windows")
@@ -7550,6 +7848,260 @@ func TestSplittedRenamePerms(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestSFTPUploadStaging(t *testing.T) {
+	u := getTestUser()
+	u.QuotaFiles = 100
+	u.Filters.StagingFolders = []string{"/incoming"}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	conn, client, err := getSftpClient(user)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+
+		err = client.Mkdir("/incoming")
+		assert.NoError(t, err)
+		err = writeSFTPFileNoCheck("/incoming/file", 100, client)
+		assert.NoError(t, err)
+		_, err = client.Stat("/incoming/file")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		_, err = client.Stat(path.Join("/incoming", dataprovider.StagingDirName))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		entries, err := client.ReadDir("/incoming")
+		assert.NoError(t, err)
+		assert.Len(t, entries, 0)
+		items, err := common.GetStagedItems(user.Username)
+		assert.NoError(t, err)
+		if assert.Len(t, items, 1) {
+			assert.Equal(t, "/incoming/file", items[0].Path)
+			assert.Equal(t, int64(100), items[0].Size)
+			assert.Equal(t, common.ProtocolSFTP, items[0].Protocol)
+			err = common.PublishStagedItem(user.Username, items[0].ID, "")
+			assert.NoError(t, err)
+		}
+		info, err := client.Stat("/incoming/file")
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(100), info.Size())
+		}
+		// the existing file is replaced only after publishing
+		err = writeSFTPFileNoCheck("/incoming/file", 200, client)
+		assert.NoError(t, err)
+		info, err = client.Stat("/incoming/file")
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(100), info.Size())
+		}
+		items, err = common.GetStagedItems(user.Username)
+		assert.NoError(t, err)
+		if assert.Len(t, items, 1) {
+			err = common.PublishStagedItem(user.Username, items[0].ID, "")
+			assert.NoError(t, err)
+		}
+		info, err = client.Stat("/incoming/file")
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(200), info.Size())
+		}
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.UsedQuotaFiles)
+		assert.Equal(t, int64(200), user.UsedQuotaSize)
+		err = client.RemoveDirectory("/incoming")
+		assert.Error(t, err)
+		err = client.Remove("/incoming/file")
+		assert.NoError(t, err)
+		err = client.RemoveDirectory("/incoming")
+		assert.NoError(t, err)
+	}
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestDebugCaptureProtocols(t *testing.T) {
+	user, _, err := httpdtest.AddUser(getTestUser(), http.StatusCreated)
+	assert.NoError(t, err)
+	capture, err := common.DebugCaptures.Start(common.DebugCaptureRequest{Username: user.Username}, "admin")
+	require.NoError(t, err)
+	conn, client, err := getSftpClient(user)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+
+		err = writeSFTPFile(testFileName, 100, client)
+		assert.NoError(t, err)
+		_, err = client.Stat("missing")
+		assert.Error(t, err)
+	}
+	webDavClient := getWebDavClient(user)
+	_, err = webDavClient.Stat(testFileName)
+	assert.NoError(t, err)
+
+	err = common.DebugCaptures.Stop(capture.ID)
+	assert.NoError(t, err)
+	bundle, err := common.DebugCaptures.GetBundle(capture.ID)
+	require.NoError(t, err)
+	zr, err := zip.NewReader(bytes.NewReader(bundle), int64(len(bundle)))
+	require.NoError(t, err)
+	rc, err := zr.Open("events.jsonl")
+	require.NoError(t, err)
+	data, err := io.ReadAll(rc)
+	assert.NoError(t, err)
+	rc.Close()
+	var sftpPackets, davRequests []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var ev common.DebugCaptureEvent
+		err = json.Unmarshal([]byte(line), &ev)
+		require.NoError(t, err)
+		assert.Equal(t, user.Username, ev.Username)
+		switch ev.Protocol {
+		case common.ProtocolSFTP:
+			sftpPackets = append(sftpPackets, ev.Direction+" "+ev.Message)
+		case common.ProtocolWebDAV:
+			davRequests = append(davRequests, ev.Direction+" "+ev.Message)
+			assert.NotContains(t, ev.Message, defaultPassword)
+		}
+	}
+	packets := strings.Join(sftpPackets, "\n")
+	assert.Contains(t, packets, "in SSH_FXP_INIT version: 3")
+	assert.Contains(t, packets, "out SSH_FXP_VERSION version: 3")
+	assert.Contains(t, packets, fmt.Sprintf("in SSH_FXP_OPEN id: 1, path: %q, pflags: 0x1b", testFileName))
+	assert.Contains(t, packets, "in SSH_FXP_WRITE")
+	assert.Contains(t, packets, ", offset: 0, len: 100")
+	assert.Contains(t, packets, "in SSH_FXP_STAT id: 5, path: \"missing\"")
+	assert.Contains(t, packets, "out SSH_FXP_STATUS id: 5, code: 2, message: \"no such file\"")
+	if assert.Len(t, davRequests, 2) {
+		assert.Contains(t, davRequests[0], "in PROPFIND /"+testFileName)
+		assert.Contains(t, davRequests[0], "Authorization: REDACTED")
+		assert.Contains(t, davRequests[1], "out 207 Multi-Status")
+	}
+	// events are not captured after stopping
+	_, err = webDavClient.Stat(testFileName)
+	assert.NoError(t, err)
+	info, err := common.DebugCaptures.Get(capture.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, len(sftpPackets)+len(davRequests), info.Events)
+	err = common.DebugCaptures.Delete(capture.ID)
+	assert.NoError(t, err)
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestSFTPUploadChecksum(t *testing.T) {
+	u := getTestUser()
+	u.Filters.StoreChecksums = true
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	conn, client, err := getSftpClient(user)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+
+		data := make([]byte, 131072)
+		_, err = rand.Read(data)
+		assert.NoError(t, err)
+		h := sha256.Sum256(data)
+		checksum := hex.EncodeToString(h[:])
+		f, err := client.Create(testFileName)
+		if assert.NoError(t, err) {
+			_, err = f.Write(data)
+			assert.NoError(t, err)
+			err = f.Close()
+			assert.NoError(t, err)
+		}
+		metadata, err := dataprovider.GetFileMetadata(user.Username, "/"+testFileName)
+		if assert.NoError(t, err) {
+			assert.Equal(t, checksum, metadata.Metadata["sftpgo_sha256"])
+			assert.Equal(t, strconv.Itoa(len(data)), metadata.Metadata["sftpgo_sha256_size"])
+		}
+		out, err := runSSHCommand(fmt.Sprintf("sha256sum %s", testFileName), user)
+		if assert.NoError(t, err) {
+			assert.Contains(t, string(out), checksum)
+		}
+		// the checksum follows the file
+		err = client.Rename(testFileName, testFileName+"_renamed")
+		assert.NoError(t, err)
+		metadata, err = dataprovider.GetFileMetadata(user.Username, "/"+testFileName+"_renamed")
+		if assert.NoError(t, err) {
+			assert.Equal(t, checksum, metadata.Metadata["sftpgo_sha256"])
+		}
+		// the stored checksum is returned without reading the file
+		metadata.Metadata["sftpgo_sha256"] = "stored"
+		err = dataprovider.SetFileMetadata(user.Username, &metadata)
+		assert.NoError(t, err)
+		out, err = runSSHCommand(fmt.Sprintf("sha256sum %s", testFileName+"_renamed"), user)
+		if assert.NoError(t, err) {
+			assert.Contains(t, string(out), "stored")
+		}
+		err = client.Remove(testFileName + "_renamed")
+		assert.NoError(t, err)
+		_, err = dataprovider.GetFileMetadata(user.Username, "/"+testFileName+"_renamed")
+		assert.ErrorIs(t, err, util.ErrNotFound)
+	}
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestSFTPFsPool(t *testing.T) {
+	vfs.SetSFTPPoolConfig(vfs.SFTPPoolConfig{
+		MaxSessionsPerConnection: 1,
+		MaxConnections:           1,
+		HealthCheckInterval:      30,
+		IdleTimeout:              30,
+		MaxBackoff:               60,
+	})
+	defer vfs.SetSFTPPoolConfig(common.Config.SFTPFsPool)
+
+	localUser, _, err := httpdtest.AddUser(getTestUser(), http.StatusCreated)
+	assert.NoError(t, err)
+	sftpUser, _, err := httpdtest.AddUser(getTestSFTPUser(), http.StatusCreated)
+	assert.NoError(t, err)
+
+	var clients []*sftp.Client
+	for i := 0; i < 3; i++ {
+		conn, client, err := getSftpClient(sftpUser)
+		if assert.NoError(t, err) {
+			defer conn.Close()
+			defer client.Close()
+
+			clients = append(clients, client)
+		}
+	}
+	for idx, client := range clients {
+		fileName := fmt.Sprintf("%s%d", testFileName, idx)
+		err = writeSFTPFile(fileName, 32768, client)
+		assert.NoError(t, err)
+		info, err := client.Stat(fileName)
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(32768), info.Size())
+		}
+	}
+	// all the sessions share a single upstream connection
+	assert.Equal(t, 1, common.Connections.GetActiveSessions(localUser.Username))
+	status := vfs.GetSFTPPoolStatus()
+	// idle connections opened by other tests could be still in the pool
+	assert.GreaterOrEqual(t, status.Connections, 1)
+	assert.GreaterOrEqual(t, status.Sessions, len(clients))
+	assert.Equal(t, 1, status.MaxSessionsPerConnection)
+	assert.Equal(t, 1, status.MaxConnections)
+	entries, err := os.ReadDir(localUser.GetHomeDir())
+	assert.NoError(t, err)
+	assert.Len(t, entries, len(clients))
+
+	_, err = httpdtest.RemoveUser(sftpUser, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(localUser, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(localUser.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestSFTPLoopError(t *testing.T) {
 	smtpCfg := smtp.Config{
 		Host:          "127.0.0.1",
@@ -8282,6 +8834,84 @@ func TestProxyProtocol(t *testing.T) {
 	}
 }
 
+func TestSFTPFsProxyProtocol(t *testing.T) {
+	vfs.SetSFTPPoolConfig(vfs.SFTPPoolConfig{
+		MaxSessionsPerConnection: 5,
+		HealthCheckInterval:      30,
+		IdleTimeout:              30,
+		MaxBackoff:               60,
+		ProxyProtocol:            2,
+	})
+	defer vfs.SetSFTPPoolConfig(common.Config.SFTPFsPool)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	proxyListener := &proxyproto.Listener{Listener: listener}
+	defer proxyListener.Close()
+
+	remoteAddrs := make(chan string, 1)
+	go func() {
+		conn, err := proxyListener.Accept()
+		if err != nil {
+			remoteAddrs <- ""
+			return
+		}
+		// the remote address is parsed from the PROXY header on first read
+		conn.Read(make([]byte, 1)) //nolint:errcheck
+		remoteAddrs <- conn.RemoteAddr().String()
+		conn.Close()
+	}()
+
+	u := getTestSFTPUser()
+	u.FsConfig.SFTPConfig.Endpoint = listener.Addr().String()
+	conn := common.NewBaseConnection(xid.New().String(), common.ProtocolSFTP, "", "172.16.1.2:1234", u)
+	_, _, err = conn.GetFsAndResolvedPath("/")
+	assert.Error(t, err)
+	select {
+	case remoteAddr := <-remoteAddrs:
+		assert.Equal(t, "172.16.1.2", util.GetIPFromRemoteAddress(remoteAddr))
+	case <-time.After(5 * time.Second):
+		t.Error("PROXY protocol header not received")
+	}
+}
+
+func TestHooksClientIPHeader(t *testing.T) {
+	headers := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Get("X-Forwarded-For")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	httpConfig := config.GetHTTPConfig()
+	httpConfig.Timeout = 5
+	httpConfig.RetryMax = 0
+	httpConfig.ClientIPHeader = "x forwarded for"
+	assert.Error(t, httpConfig.Initialize(configDir))
+	httpConfig.ClientIPHeader = "x-forwarded-for"
+	require.NoError(t, httpConfig.Initialize(configDir))
+	defer func() {
+		httpConfig.ClientIPHeader = ""
+		httpConfig.Initialize(configDir) //nolint:errcheck
+	}()
+
+	resp, err := httpclient.PostWithClientIP(context.Background(), server.URL, "application/json", bytes.NewBuffer([]byte("{}")), "10.1.2.3")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, "10.1.2.3", <-headers)
+	}
+	resp, err = httpclient.RetryablePostWithClientIP(context.Background(), server.URL, "application/json", bytes.NewBuffer([]byte("{}")), "10.1.2.4")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, "10.1.2.4", <-headers)
+	}
+	resp, err = httpclient.Post(server.URL, "application/json", bytes.NewBuffer([]byte("{}")))
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Empty(t, <-headers)
+	}
+}
+
 func TestSetProtocol(t *testing.T) {
 	conn := common.NewBaseConnection("id", "sshd_exec", "", "", dataprovider.User{BaseUser: sdk.BaseUser{HomeDir: os.TempDir()}})
 	conn.SetProtocol(common.ProtocolSCP)
@@ -8524,7 +9154,8 @@ func isDbDefenderSupported() bool {
 	// to use it outside test cases
 	switch dataprovider.GetProviderStatus().Driver {
 	case dataprovider.MySQLDataProviderName, dataprovider.PGSQLDataProviderName,
-		dataprovider.CockroachDataProviderName, dataprovider.SQLiteDataProviderName:
+		dataprovider.CockroachDataProviderName, dataprovider.SQLiteDataProviderName,
+		dataprovider.EtcdDataProviderName:
 		return true
 	default:
 		return false
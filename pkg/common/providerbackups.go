@@ -0,0 +1,554 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/sio"
+	"github.com/robfig/cron/v3"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/kms"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+const (
+	providerBackupsLogSender   = "provider_backups"
+	providerBackupsTaskName    = "provider_backups"
+	providerBackupPrefix       = "sftpgo_backup_"
+	providerBackupTimeFormat   = "20060102T150405Z"
+	providerBackupExt          = ".json"
+	providerBackupEncryptedExt = ".json.enc"
+	providerBackupMagic        = "SFTPGOBK"
+	providerBackupVersion      = 1
+	providerBackupKeyData      = "provider_backup"
+)
+
+var (
+	// ErrProviderBackupRunning is returned if a provider backup is started
+	// while a previous one is still in progress
+	ErrProviderBackupRunning = errors.New("a provider backup is already in progress")
+	providerBackupRunning    atomic.Bool
+)
+
+// ProviderBackupsConfig defines the configuration for the scheduled data provider backups
+type ProviderBackupsConfig struct {
+	// Standard cron expression with 5 fields: minute, hour, day of month, month,
+	// day of week. The schedule is evaluated in UTC. Empty means disabled
+	Schedule string `json:"schedule" mapstructure:"schedule"`
+	// Encrypt the backups using the configured KMS
+	Encrypt bool `json:"encrypt" mapstructure:"encrypt"`
+	// Number of days for which the most recent backup is kept
+	KeepDaily int `json:"keep_daily" mapstructure:"keep_daily"`
+	// Number of weeks for which the most recent backup is kept
+	KeepWeekly int `json:"keep_weekly" mapstructure:"keep_weekly"`
+	// Name of the virtual folder whose storage backend is used as remote
+	// target. Empty means the backups are only saved locally
+	RemoteFolder string `json:"remote_folder" mapstructure:"remote_folder"`
+	// Path, inside the remote virtual folder, for the backups
+	RemotePath string `json:"remote_path" mapstructure:"remote_path"`
+}
+
+func (c *ProviderBackupsConfig) isEnabled() bool {
+	return c.Schedule != ""
+}
+
+func (c *ProviderBackupsConfig) validate() error {
+	c.Schedule = strings.Join(strings.Fields(c.Schedule), " ")
+	if c.isEnabled() {
+		if _, err := cron.ParseStandard(c.Schedule); err != nil {
+			return fmt.Errorf("invalid provider backups schedule %q: %w", c.Schedule, err)
+		}
+	}
+	if c.KeepDaily < 0 {
+		return fmt.Errorf("invalid provider backups keep daily: %d", c.KeepDaily)
+	}
+	if c.KeepWeekly < 0 {
+		return fmt.Errorf("invalid provider backups keep weekly: %d", c.KeepWeekly)
+	}
+	c.RemoteFolder = strings.TrimSpace(c.RemoteFolder)
+	return nil
+}
+
+func (c *ProviderBackupsConfig) getRemotePath() string {
+	return util.CleanPath(c.RemotePath)
+}
+
+// ProviderBackup defines a data provider backup
+type ProviderBackup struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	Encrypted bool      `json:"encrypted"`
+}
+
+func newProviderBackup(info os.FileInfo) (ProviderBackup, bool) {
+	name := info.Name()
+	if info.IsDir() || !strings.HasPrefix(name, providerBackupPrefix) {
+		return ProviderBackup{}, false
+	}
+	backup := ProviderBackup{
+		Name: name,
+		Size: info.Size(),
+	}
+	timestamp := strings.TrimPrefix(name, providerBackupPrefix)
+	if strings.HasSuffix(timestamp, providerBackupEncryptedExt) {
+		timestamp = strings.TrimSuffix(timestamp, providerBackupEncryptedExt)
+		backup.Encrypted = true
+	} else if strings.HasSuffix(timestamp, providerBackupExt) {
+		timestamp = strings.TrimSuffix(timestamp, providerBackupExt)
+	} else {
+		return ProviderBackup{}, false
+	}
+	createdAt, err := time.Parse(providerBackupTimeFormat, timestamp)
+	if err != nil {
+		return ProviderBackup{}, false
+	}
+	backup.CreatedAt = createdAt
+	return backup, true
+}
+
+func getProviderBackups(infos []os.FileInfo) []ProviderBackup {
+	var backups []ProviderBackup
+	for _, info := range infos {
+		if backup, ok := newProviderBackup(info); ok {
+			backups = append(backups, backup)
+		}
+	}
+	// most recent first
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].CreatedAt.After(backups[j].CreatedAt)
+	})
+	return backups
+}
+
+// getExpiredProviderBackups returns the backups to remove. The most recent backup
+// for each of the last keepDaily days and for each of the last keepWeekly ISO weeks
+// is kept, the backups must be sorted from the most recent
+func getExpiredProviderBackups(backups []ProviderBackup, keepDaily, keepWeekly int) []ProviderBackup {
+	if keepDaily == 0 && keepWeekly == 0 {
+		return nil
+	}
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	var expired []ProviderBackup
+	for _, backup := range backups {
+		keep := false
+		day := backup.CreatedAt.Format("2006-01-02")
+		if !days[day] && len(days) < keepDaily {
+			days[day] = true
+			keep = true
+		}
+		year, week := backup.CreatedAt.ISOWeek()
+		weekKey := fmt.Sprintf("%d-%d", year, week)
+		if !weeks[weekKey] && len(weeks) < keepWeekly {
+			weeks[weekKey] = true
+			keep = true
+		}
+		if !keep {
+			expired = append(expired, backup)
+		}
+	}
+	return expired
+}
+
+// ListLocalBackups returns the data provider backups saved in the backups path
+func (c *ProviderBackupsConfig) ListLocalBackups() ([]ProviderBackup, error) {
+	entries, err := os.ReadDir(dataprovider.GetBackupsPath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return getProviderBackups(infos), nil
+}
+
+// ListRemoteBackups returns the data provider backups saved in the remote target
+func (c *ProviderBackupsConfig) ListRemoteBackups() ([]ProviderBackup, error) {
+	fs, err := c.getRemoteFs()
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+
+	return c.listRemoteBackups(fs)
+}
+
+func (c *ProviderBackupsConfig) listRemoteBackups(fs vfs.Fs) ([]ProviderBackup, error) {
+	fsPath, err := fs.ResolvePath(c.getRemotePath())
+	if err != nil {
+		return nil, err
+	}
+	infos, err := fs.ReadDir(fsPath)
+	if err != nil {
+		if fs.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return getProviderBackups(infos), nil
+}
+
+// ReadBackup returns the content of the specified data provider backup, decrypted if required.
+// If remote is true the backup is read from the remote target
+func (c *ProviderBackupsConfig) ReadBackup(name string, remote bool) ([]byte, error) {
+	if _, ok := newProviderBackup(vfs.NewFileInfo(name, false, 0, time.Time{}, false)); !ok || name != path.Base(name) {
+		return nil, util.NewValidationError(fmt.Sprintf("invalid backup name %q", name))
+	}
+	var content []byte
+	var err error
+	if remote {
+		content, err = c.readRemoteBackup(name)
+	} else {
+		content, err = os.ReadFile(filepath.Join(dataprovider.GetBackupsPath(), name))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return DecodeProviderBackup(content)
+}
+
+func (c *ProviderBackupsConfig) readRemoteBackup(name string) ([]byte, error) {
+	fs, err := c.getRemoteFs()
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+
+	fsPath, err := fs.ResolvePath(path.Join(c.getRemotePath(), name))
+	if err != nil {
+		return nil, err
+	}
+	f, r, cancelFn, err := fs.Open(fsPath, 0)
+	if err != nil {
+		return nil, err
+	}
+	if cancelFn != nil {
+		defer cancelFn()
+	}
+	var reader io.ReadCloser = r
+	if f != nil {
+		reader = f
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+func (c *ProviderBackupsConfig) getRemoteFs() (vfs.Fs, error) {
+	if c.RemoteFolder == "" {
+		return nil, util.NewValidationError("no remote target configured for provider backups")
+	}
+	folder, err := dataprovider.GetFolderByName(c.RemoteFolder)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the remote folder %q: %w", c.RemoteFolder, err)
+	}
+	vFolder := vfs.VirtualFolder{
+		BaseVirtualFolder: folder,
+		VirtualPath:       "/",
+	}
+	return vFolder.GetFilesystem(providerBackupsLogSender, nil)
+}
+
+// Run executes a data provider backup, uploads it to the remote target, if
+// any, and removes the expired backups. It returns the backup name
+func (c *ProviderBackupsConfig) Run() (string, error) {
+	if !providerBackupRunning.CompareAndSwap(false, true) {
+		return "", ErrProviderBackupRunning
+	}
+	defer providerBackupRunning.Store(false)
+
+	startTime := time.Now()
+	name, err := c.saveLocalBackup(startTime.UTC())
+	if err != nil {
+		logger.Error(providerBackupsLogSender, "", "unable to save backup: %v", err)
+		return "", err
+	}
+	logger.Info(providerBackupsLogSender, "", "backup %q saved, encrypted: %t", name, c.Encrypt)
+	c.removeExpiredLocalBackups()
+	if c.RemoteFolder != "" {
+		if err := c.upload(name); err != nil {
+			logger.Error(providerBackupsLogSender, "", "unable to upload backup %q to folder %q: %v",
+				name, c.RemoteFolder, err)
+			return name, err
+		}
+	}
+	logger.Info(providerBackupsLogSender, "", "backup %q completed, elapsed: %s", name, time.Since(startTime))
+	return name, nil
+}
+
+func (c *ProviderBackupsConfig) runScheduled() {
+	if dataprovider.GetProviderConfig().IsShared == 1 {
+		// only a node must execute the backup
+		if !claimScheduledTask(providerBackupsLogSender, providerBackupsTaskName, time.Now().Truncate(time.Minute)) {
+			return
+		}
+	}
+	c.Run() //nolint:errcheck
+}
+
+func (c *ProviderBackupsConfig) saveLocalBackup(now time.Time) (string, error) {
+	backup, err := dataprovider.DumpData(nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to dump backup data: %w", err)
+	}
+	dump, err := json.Marshal(backup)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal backup data as JSON: %w", err)
+	}
+	name := providerBackupPrefix + now.Format(providerBackupTimeFormat) + providerBackupExt
+	if c.Encrypt {
+		name = providerBackupPrefix + now.Format(providerBackupTimeFormat) + providerBackupEncryptedExt
+	}
+	outputFile := filepath.Join(dataprovider.GetBackupsPath(), name)
+	if err := os.MkdirAll(filepath.Dir(outputFile), 0700); err != nil {
+		return "", fmt.Errorf("unable to create backup dir: %w", err)
+	}
+	f, err := os.OpenFile(outputFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	if c.Encrypt {
+		err = encryptProviderBackup(f, dump)
+	} else {
+		_, err = f.Write(dump)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(outputFile) //nolint:errcheck
+		return "", fmt.Errorf("unable to save backup: %w", err)
+	}
+	return name, nil
+}
+
+func (c *ProviderBackupsConfig) removeExpiredLocalBackups() {
+	backups, err := c.ListLocalBackups()
+	if err != nil {
+		logger.Warn(providerBackupsLogSender, "", "unable to list local backups: %v", err)
+		return
+	}
+	for _, backup := range getExpiredProviderBackups(backups, c.KeepDaily, c.KeepWeekly) {
+		if err := os.Remove(filepath.Join(dataprovider.GetBackupsPath(), backup.Name)); err != nil {
+			logger.Warn(providerBackupsLogSender, "", "unable to remove expired local backup %q: %v", backup.Name, err)
+			continue
+		}
+		logger.Debug(providerBackupsLogSender, "", "expired local backup %q removed", backup.Name)
+	}
+}
+
+func (c *ProviderBackupsConfig) upload(name string) error {
+	fs, err := c.getRemoteFs()
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	if err := c.createRemoteDirs(fs); err != nil {
+		return err
+	}
+	src, err := os.Open(filepath.Join(dataprovider.GetBackupsPath(), name))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	fsPath, err := fs.ResolvePath(path.Join(c.getRemotePath(), name))
+	if err != nil {
+		return err
+	}
+	f, w, cancelFn, err := fs.Create(fsPath, 0, 0)
+	if err != nil {
+		return err
+	}
+	var writer io.WriteCloser = w
+	if f != nil {
+		writer = f
+	}
+	_, err = io.Copy(writer, src)
+	if err != nil && cancelFn != nil {
+		cancelFn()
+	}
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	logger.Info(providerBackupsLogSender, "", "backup %q uploaded to folder %q", name, c.RemoteFolder)
+	c.removeExpiredRemoteBackups(fs)
+	return nil
+}
+
+// createRemoteDirs creates the remote path, if required, for storage backends
+// with real directories
+func (c *ProviderBackupsConfig) createRemoteDirs(fs vfs.Fs) error {
+	if vfs.HasImplicitAtomicUploads(fs) {
+		return nil
+	}
+	fs.CheckRootPath(providerBackupsLogSender, -1, -1)
+	return mkdirAllFs(fs, c.getRemotePath())
+}
+
+// mkdirAllFs creates the specified directory, including any missing parent,
+// inside the specified filesystem
+func mkdirAllFs(fs vfs.Fs, remotePath string) error {
+	if remotePath == "/" {
+		return nil
+	}
+	dirPath := "/"
+	for _, dir := range strings.Split(strings.TrimPrefix(remotePath, "/"), "/") {
+		dirPath = path.Join(dirPath, dir)
+		fsPath, err := fs.ResolvePath(dirPath)
+		if err != nil {
+			return err
+		}
+		if _, err := fs.Stat(fsPath); err == nil {
+			continue
+		}
+		if err := fs.Mkdir(fsPath); err != nil {
+			return fmt.Errorf("unable to create remote dir %q: %w", dirPath, err)
+		}
+	}
+	return nil
+}
+
+func (c *ProviderBackupsConfig) removeExpiredRemoteBackups(fs vfs.Fs) {
+	backups, err := c.listRemoteBackups(fs)
+	if err != nil {
+		logger.Warn(providerBackupsLogSender, "", "unable to list remote backups: %v", err)
+		return
+	}
+	for _, backup := range getExpiredProviderBackups(backups, c.KeepDaily, c.KeepWeekly) {
+		fsPath, err := fs.ResolvePath(path.Join(c.getRemotePath(), backup.Name))
+		if err == nil {
+			err = fs.Remove(fsPath, false)
+		}
+		if err != nil {
+			logger.Warn(providerBackupsLogSender, "", "unable to remove expired remote backup %q: %v", backup.Name, err)
+			continue
+		}
+		logger.Debug(providerBackupsLogSender, "", "expired remote backup %q removed", backup.Name)
+	}
+}
+
+// providerBackupHeader is stored, JSON serialized, at the beginning of the
+// encrypted backups. The data key is encrypted using the configured KMS
+type providerBackupHeader struct {
+	Key *kms.Secret `json:"key"`
+}
+
+func getProviderBackupSIOConfig(key []byte) sio.Config {
+	return sio.Config{
+		MinVersion:   sio.Version20,
+		MaxVersion:   sio.Version20,
+		CipherSuites: []byte{sio.AES_256_GCM, sio.CHACHA20_POLY1305},
+		Key:          key,
+	}
+}
+
+// encryptProviderBackup writes the encrypted backup to w. The backup is encrypted
+// using a random data key and the data key is encrypted using the configured KMS
+func encryptProviderBackup(w io.Writer, data []byte) error {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+	secret := kms.NewPlainSecret(hex.EncodeToString(key))
+	secret.SetAdditionalData(providerBackupKeyData)
+	if err := secret.Encrypt(); err != nil {
+		return fmt.Errorf("unable to encrypt the backup key: %w", err)
+	}
+	header, err := json.Marshal(providerBackupHeader{Key: secret})
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 0, len(providerBackupMagic)+5+len(header))
+	buf = append(buf, providerBackupMagic...)
+	buf = append(buf, providerBackupVersion)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(header)))
+	buf = append(buf, header...)
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	_, err = sio.Encrypt(w, bytes.NewReader(data), getProviderBackupSIOConfig(key))
+	return err
+}
+
+// DecodeProviderBackup returns the decrypted content for backups encrypted by
+// the scheduled provider backups. Other contents are returned unchanged
+func DecodeProviderBackup(content []byte) ([]byte, error) {
+	if !bytes.HasPrefix(content, []byte(providerBackupMagic)) {
+		return content, nil
+	}
+	content = content[len(providerBackupMagic):]
+	if len(content) < 5 {
+		return nil, errors.New("invalid encrypted backup: truncated header")
+	}
+	if content[0] != providerBackupVersion {
+		return nil, fmt.Errorf("unsupported encrypted backup version %d", content[0])
+	}
+	headerLen := int(binary.BigEndian.Uint32(content[1:5]))
+	content = content[5:]
+	if headerLen > len(content) {
+		return nil, errors.New("invalid encrypted backup: truncated header")
+	}
+	var header providerBackupHeader
+	if err := json.Unmarshal(content[:headerLen], &header); err != nil {
+		return nil, fmt.Errorf("invalid encrypted backup header: %w", err)
+	}
+	if header.Key == nil || !header.Key.IsEncrypted() {
+		return nil, errors.New("invalid encrypted backup: missing key")
+	}
+	if err := header.Key.Decrypt(); err != nil {
+		return nil, fmt.Errorf("unable to decrypt the backup key: %w", err)
+	}
+	key, err := hex.DecodeString(header.Key.GetPayload())
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("invalid encrypted backup: invalid key")
+	}
+	var decrypted bytes.Buffer
+	if _, err := sio.Decrypt(&decrypted, bytes.NewReader(content[headerLen:]), getProviderBackupSIOConfig(key)); err != nil {
+		return nil, fmt.Errorf("unable to decrypt backup: %w", err)
+	}
+	return decrypted.Bytes(), nil
+}
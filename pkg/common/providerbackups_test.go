@@ -0,0 +1,206 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+func TestProviderBackupsConfig(t *testing.T) {
+	c := ProviderBackupsConfig{}
+	assert.NoError(t, c.validate())
+	assert.False(t, c.isEnabled())
+	assert.Equal(t, "/", c.getRemotePath())
+	c.Schedule = " 0  2 * * * "
+	assert.NoError(t, c.validate())
+	assert.True(t, c.isEnabled())
+	assert.Equal(t, "0 2 * * *", c.Schedule)
+	c.Schedule = "invalid"
+	assert.Error(t, c.validate())
+	c.Schedule = "@daily"
+	assert.NoError(t, c.validate())
+	c.KeepDaily = -1
+	assert.Error(t, c.validate())
+	c.KeepDaily = 0
+	c.KeepWeekly = -1
+	assert.Error(t, c.validate())
+	c.KeepWeekly = 0
+	c.RemotePath = "backups/sftpgo/"
+	assert.Equal(t, "/backups/sftpgo", c.getRemotePath())
+
+	_, err := c.ListRemoteBackups()
+	assert.Error(t, err)
+	_, err = c.ReadBackup("../backup.json", false)
+	assert.Error(t, err)
+	_, err = c.ReadBackup("sftpgo_backup_invalid.json", false)
+	assert.Error(t, err)
+}
+
+func TestExpiredProviderBackups(t *testing.T) {
+	now := time.Date(2023, 5, 10, 2, 0, 0, 0, time.UTC)
+	var infos []os.FileInfo
+	for i := 0; i < 30; i++ {
+		createdAt := now.Add(-time.Duration(i) * 24 * time.Hour)
+		name := providerBackupPrefix + createdAt.Format(providerBackupTimeFormat) + providerBackupExt
+		infos = append(infos, vfs.NewFileInfo(name, false, 100, createdAt, false))
+		// a second backup for the same day
+		createdAt = createdAt.Add(-time.Hour)
+		name = providerBackupPrefix + createdAt.Format(providerBackupTimeFormat) + providerBackupEncryptedExt
+		infos = append(infos, vfs.NewFileInfo(name, false, 100, createdAt, false))
+	}
+	infos = append(infos, vfs.NewFileInfo("backup_Monday_2.json", false, 100, now, false))
+	infos = append(infos, vfs.NewFileInfo(providerBackupPrefix+"dir", true, 0, now, false))
+	backups := getProviderBackups(infos)
+	require.Len(t, backups, 60)
+	assert.Equal(t, now, backups[0].CreatedAt)
+	assert.False(t, backups[0].Encrypted)
+	assert.True(t, backups[1].Encrypted)
+
+	assert.Len(t, getExpiredProviderBackups(backups, 0, 0), 0)
+	expired := getExpiredProviderBackups(backups, 7, 0)
+	assert.Len(t, expired, 53)
+	expired = getExpiredProviderBackups(backups, 7, 4)
+	kept := make(map[string]bool)
+	for _, backup := range backups {
+		kept[backup.Name] = true
+	}
+	for _, backup := range expired {
+		delete(kept, backup.Name)
+	}
+	// 7 daily backups, from 2023-05-04 to 2023-05-10, they already include the
+	// most recent backups for the current and the previous week
+	assert.Len(t, kept, 9)
+	assert.True(t, kept[backups[0].Name])
+	assert.False(t, kept[backups[1].Name])
+	expired = getExpiredProviderBackups(backups, 0, 2)
+	assert.Len(t, expired, 58)
+}
+
+func TestProviderBackupEncryption(t *testing.T) {
+	data := []byte(`{"version":1}`)
+	decoded, err := DecodeProviderBackup(data)
+	assert.NoError(t, err)
+	assert.Equal(t, data, decoded)
+
+	var buf bytes.Buffer
+	err = encryptProviderBackup(&buf, data)
+	require.NoError(t, err)
+	encrypted := buf.Bytes()
+	assert.True(t, bytes.HasPrefix(encrypted, []byte(providerBackupMagic)))
+	assert.False(t, bytes.Contains(encrypted, data))
+	decoded, err = DecodeProviderBackup(encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, data, decoded)
+
+	_, err = DecodeProviderBackup([]byte(providerBackupMagic))
+	assert.Error(t, err)
+	invalid := append([]byte{}, encrypted...)
+	invalid[len(providerBackupMagic)] = 2
+	_, err = DecodeProviderBackup(invalid)
+	assert.Error(t, err)
+	_, err = DecodeProviderBackup(encrypted[:len(providerBackupMagic)+10])
+	assert.Error(t, err)
+	invalid = append([]byte{}, encrypted...)
+	invalid[len(invalid)-1] ^= 0xff
+	_, err = DecodeProviderBackup(invalid)
+	assert.Error(t, err)
+}
+
+func TestProviderBackupRun(t *testing.T) {
+	mappedPath := filepath.Join(os.TempDir(), "provider_backups_remote")
+	folder := vfs.BaseVirtualFolder{
+		Name:       "provider_backups_folder",
+		MappedPath: mappedPath,
+	}
+	err := dataprovider.AddFolder(&folder, "", "", "")
+	require.NoError(t, err)
+
+	c := ProviderBackupsConfig{
+		Schedule:     "0 2 * * *",
+		Encrypt:      true,
+		KeepDaily:    1,
+		RemoteFolder: folder.Name,
+		RemotePath:   "/sftpgo/backups",
+	}
+	require.NoError(t, c.validate())
+	// a backup from yesterday is removed
+	oldName := providerBackupPrefix + time.Now().UTC().Add(-24*time.Hour).Format(providerBackupTimeFormat) + providerBackupExt
+	err = os.MkdirAll(dataprovider.GetBackupsPath(), os.ModePerm)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dataprovider.GetBackupsPath(), oldName), []byte("{}"), 0600)
+	require.NoError(t, err)
+
+	providerBackupRunning.Store(true)
+	_, err = c.Run()
+	assert.ErrorIs(t, err, ErrProviderBackupRunning)
+	providerBackupRunning.Store(false)
+
+	name, err := c.Run()
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(dataprovider.GetBackupsPath(), name))
+	assert.NoFileExists(t, filepath.Join(dataprovider.GetBackupsPath(), oldName))
+	assert.FileExists(t, filepath.Join(mappedPath, "sftpgo", "backups", name))
+
+	backups, err := c.ListLocalBackups()
+	assert.NoError(t, err)
+	if assert.Len(t, backups, 1) {
+		assert.Equal(t, name, backups[0].Name)
+		assert.True(t, backups[0].Encrypted)
+	}
+	backups, err = c.ListRemoteBackups()
+	assert.NoError(t, err)
+	assert.Len(t, backups, 1)
+
+	for _, remote := range []bool{false, true} {
+		content, err := c.ReadBackup(name, remote)
+		assert.NoError(t, err)
+		dump, err := dataprovider.ParseDumpData(content)
+		assert.NoError(t, err)
+		found := false
+		for _, f := range dump.Folders {
+			if f.Name == folder.Name {
+				found = true
+			}
+		}
+		assert.True(t, found)
+	}
+	_, err = c.ReadBackup(oldName, true)
+	assert.Error(t, err)
+
+	c.RemoteFolder = "missing folder"
+	_, err = c.Run()
+	assert.Error(t, err)
+
+	backups, err = c.ListLocalBackups()
+	assert.NoError(t, err)
+	for _, backup := range backups {
+		err = os.Remove(filepath.Join(dataprovider.GetBackupsPath(), backup.Name))
+		assert.NoError(t, err)
+	}
+	err = dataprovider.DeleteFolder(folder.Name, "", "", "")
+	assert.NoError(t, err)
+	err = os.RemoveAll(mappedPath)
+	assert.NoError(t, err)
+}
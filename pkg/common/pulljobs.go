@@ -0,0 +1,521 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/httpclient"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// Pull job statuses
+const (
+	PullJobStatusRunning   = "running"
+	PullJobStatusCompleted = "completed"
+	PullJobStatusFailed    = "failed"
+	PullJobStatusCanceled  = "canceled"
+)
+
+const (
+	pullJobsLogSender = "pulljobs"
+	// completed pull jobs are kept for this duration
+	pullJobsRetention = time.Hour
+	// maximum wait time between attempts
+	pullJobsMaxRetryWait = 30 * time.Second
+	pullJobsMaxRedirects = 10
+)
+
+var (
+	// ErrTooManyPullJobs is returned if the user has too many pull jobs in progress
+	ErrTooManyPullJobs = errors.New("too many pull jobs in progress")
+	// PullJobs tracks the server side downloads from external URLs
+	PullJobs = &pullJobsManager{
+		jobs: make(map[string]*pullJob),
+	}
+	errPullJobsDisabled        = util.NewMethodDisabledError("pull jobs are disabled")
+	errPullJobChecksumMismatch = errors.New("the downloaded file does not match the expected SHA-256 checksum")
+	// initial wait time between attempts, it is doubled after each attempt
+	pullJobsRetryWait = 2 * time.Second
+)
+
+// PullJobsConfig defines the configuration for pull jobs, server side
+// downloads from external URLs to the users' storage
+type PullJobsConfig struct {
+	// Set to true to allow users to start pull jobs
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// Shell-like patterns, for example "*.s3.amazonaws.com", for the hosts
+	// users can download from. Empty means any host
+	AllowedHosts []string `json:"allowed_hosts" mapstructure:"allowed_hosts"`
+	// Allow downloads from loopback, private and link-local addresses
+	AllowPrivateNetworks bool `json:"allow_private_networks" mapstructure:"allow_private_networks"`
+	// Maximum number of attempts for each download
+	MaxAttempts int `json:"max_attempts" mapstructure:"max_attempts"`
+	// Maximum number of concurrent pull jobs for each user
+	MaxConcurrentJobs int `json:"max_concurrent_jobs" mapstructure:"max_concurrent_jobs"`
+}
+
+func (c *PullJobsConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.MaxAttempts < 1 {
+		return fmt.Errorf("invalid pull jobs max attempts: %d", c.MaxAttempts)
+	}
+	if c.MaxConcurrentJobs < 1 {
+		return fmt.Errorf("invalid pull jobs max concurrent jobs: %d", c.MaxConcurrentJobs)
+	}
+	for idx, host := range c.AllowedHosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" {
+			return errors.New("pull jobs allowed hosts cannot contain empty patterns")
+		}
+		if _, err := path.Match(host, ""); err != nil {
+			return fmt.Errorf("invalid pull jobs allowed host %q: %w", host, err)
+		}
+		c.AllowedHosts[idx] = host
+	}
+	return nil
+}
+
+func (c *PullJobsConfig) isHostAllowed(host string) bool {
+	if len(c.AllowedHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range c.AllowedHosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *PullJobsConfig) checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return util.NewValidationError(fmt.Sprintf("unsupported URL scheme %q", u.Scheme))
+	}
+	if u.Hostname() == "" {
+		return util.NewValidationError("the URL host is mandatory")
+	}
+	if !c.isHostAllowed(u.Hostname()) {
+		return util.NewValidationError(fmt.Sprintf("downloads from host %q are not allowed", u.Hostname()))
+	}
+	return nil
+}
+
+// checkAddress is called before connecting to each resolved address, this
+// way host names resolving to private addresses are refused too
+func (c *PullJobsConfig) checkAddress(_, address string, _ syscall.RawConn) error {
+	if c.AllowPrivateNetworks {
+		return nil
+	}
+	return checkPublicAddress(address)
+}
+
+// checkPublicAddress returns an error if the specified address, in the form
+// host:port, is a loopback, private, link-local or multicast address
+func checkPublicAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("unable to parse IP address %q", host)
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return util.NewValidationError(fmt.Sprintf("connections to the address %q are not allowed", host))
+	}
+	return nil
+}
+
+// PullJob defines a server side download from an external URL
+type PullJob struct {
+	ID string `json:"id"`
+	// Source URL without the query string, so the credentials included
+	// in presigned URLs are not exposed
+	URL string `json:"url"`
+	// Virtual path for the downloaded file
+	Path string `json:"path"`
+	// Optional expected SHA-256 checksum
+	ExpectedSHA256 string `json:"expected_sha256,omitempty"`
+	// SHA-256 checksum of the downloaded file, available once completed
+	SHA256 string `json:"sha256,omitempty"`
+	// Job status: running, completed, failed, canceled
+	Status string `json:"status"`
+	// File size as reported by the remote server, 0 if unknown
+	Size int64 `json:"size"`
+	// Bytes downloaded by the current attempt
+	Downloaded int64 `json:"downloaded"`
+	// Number of download attempts
+	Attempts int `json:"attempts"`
+	// Error details if the job failed
+	Error string `json:"error,omitempty"`
+	// Start and end time as unix timestamp in milliseconds
+	StartTime int64 `json:"start_time"`
+	EndTime   int64 `json:"end_time,omitempty"`
+}
+
+type pullJob struct {
+	sync.RWMutex
+	username   string
+	url        string
+	info       PullJob
+	downloaded atomic.Int64
+	cancel     context.CancelFunc
+}
+
+func (j *pullJob) getInfo() PullJob {
+	j.RLock()
+	defer j.RUnlock()
+
+	info := j.info
+	info.Downloaded = j.downloaded.Load()
+	return info
+}
+
+func (j *pullJob) isRunning() bool {
+	j.RLock()
+	defer j.RUnlock()
+
+	return j.info.Status == PullJobStatusRunning
+}
+
+func (j *pullJob) isExpired() bool {
+	j.RLock()
+	defer j.RUnlock()
+
+	return j.info.Status != PullJobStatusRunning &&
+		j.info.EndTime < util.GetTimeAsMsSinceEpoch(time.Now().Add(-pullJobsRetention))
+}
+
+func (j *pullJob) startAttempt(attempt int) {
+	j.Lock()
+	defer j.Unlock()
+
+	j.info.Attempts = attempt
+	j.info.Size = 0
+	j.downloaded.Store(0)
+}
+
+func (j *pullJob) setSize(size int64) {
+	j.Lock()
+	defer j.Unlock()
+
+	if size > 0 {
+		j.info.Size = size
+	}
+}
+
+func (j *pullJob) setDone(checksum string, err error, canceled bool) {
+	j.Lock()
+	defer j.Unlock()
+
+	j.info.EndTime = util.GetTimeAsMsSinceEpoch(time.Now())
+	switch {
+	case canceled:
+		j.info.Status = PullJobStatusCanceled
+	case err != nil:
+		j.info.Status = PullJobStatusFailed
+		j.info.Error = err.Error()
+	default:
+		j.info.Status = PullJobStatusCompleted
+		j.info.SHA256 = checksum
+	}
+}
+
+// Write implements io.Writer to track the download progress
+func (j *pullJob) Write(p []byte) (int, error) {
+	j.downloaded.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// download executes a download attempt, it returns the SHA-256 checksum of
+// the downloaded file and, on error, if the download can be retried
+func (j *pullJob) download(ctx context.Context, client *http.Client, conn *BaseConnection) (string, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.url, nil)
+	if err != nil {
+		return "", false, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", !errors.Is(err, util.ErrValidation), err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		retry := resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests ||
+			resp.StatusCode == http.StatusRequestTimeout
+		return "", retry, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	j.setSize(resp.ContentLength)
+
+	virtualPath := j.info.Path
+	writer, numFiles, truncatedSize, cancelFn, err := getFileWriter(conn, virtualPath, resp.ContentLength)
+	if err != nil {
+		return "", false, err
+	}
+	defer cancelFn()
+
+	q, _ := conn.HasSpace(numFiles > 0, false, virtualPath)
+	maxWriteSize, _ := conn.GetMaxWriteSize(q, false, truncatedSize, false)
+	var reader io.Reader = resp.Body
+	if maxWriteSize > 0 {
+		reader = io.LimitReader(resp.Body, maxWriteSize+1)
+	}
+	h := sha256.New()
+	startTime := time.Now()
+	written, err := io.Copy(io.MultiWriter(writer, h, j), reader)
+	retry := err != nil && !errors.Is(err, ErrContentTypeDenied)
+	if err == nil && maxWriteSize > 0 && written > maxWriteSize {
+		err = conn.GetQuotaExceededError()
+	}
+	checksum := hex.EncodeToString(h.Sum(nil))
+	if err == nil && j.info.ExpectedSHA256 != "" && checksum != j.info.ExpectedSHA256 {
+		err = errPullJobChecksumMismatch
+		retry = true
+	}
+	if err != nil {
+		writer.Close()
+		removePartialFile(conn, virtualPath, numFiles, truncatedSize)
+		return "", retry, err
+	}
+	if err := closeWriterAndUpdateQuota(writer, conn, virtualPath, "", numFiles, truncatedSize, nil,
+		operationUpload, startTime); err != nil {
+		return "", false, err
+	}
+	if conn.IsChecksumEnabled() {
+		err = setFileChecksum(conn.User.Username, virtualPath, checksum, written)
+	} else if numFiles == 0 {
+		err = removeFileChecksum(conn.User.Username, virtualPath)
+	}
+	if err != nil {
+		conn.Log(logger.LevelWarn, "unable to update the checksum for file %q: %v", virtualPath, err)
+	}
+	return checksum, false, nil
+}
+
+type pullJobsManager struct {
+	sync.RWMutex
+	jobs map[string]*pullJob
+}
+
+// Start validates and starts a pull job that downloads the specified URL
+// to the given virtual path. checksum is the optional expected SHA-256.
+// conn is the connection requesting the job, it is not used after this
+// method returns
+func (m *pullJobsManager) Start(conn *BaseConnection, rawURL, virtualPath, checksum string) (PullJob, error) {
+	if !Config.PullJobs.Enabled {
+		return PullJob{}, errPullJobsDisabled
+	}
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return PullJob{}, util.NewValidationError(fmt.Sprintf("invalid URL: %v", err))
+	}
+	if err := Config.PullJobs.checkURL(u); err != nil {
+		return PullJob{}, err
+	}
+	if virtualPath == "/" {
+		return PullJob{}, util.NewValidationError("the target path must be a file")
+	}
+	checksum = strings.ToLower(strings.TrimSpace(checksum))
+	if checksum != "" {
+		if decoded, err := hex.DecodeString(checksum); err != nil || len(decoded) != sha256.Size {
+			return PullJob{}, util.NewValidationError("invalid SHA-256 checksum")
+		}
+	}
+	if conn.IsStagedUpload(virtualPath) || conn.User.GetClientEncryptedFolder(virtualPath) != "" {
+		return PullJob{}, util.NewValidationError("pull jobs are not supported for staging and client encrypted folders")
+	}
+	if ok, _ := conn.User.IsFileAllowed(virtualPath); !ok {
+		return PullJob{}, conn.GetPermissionDeniedError()
+	}
+	if !conn.User.HasAnyPerm([]string{dataprovider.PermUpload, dataprovider.PermOverwrite}, path.Dir(virtualPath)) {
+		return PullJob{}, conn.GetPermissionDeniedError()
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.removeExpired()
+	running := 0
+	for _, job := range m.jobs {
+		if job.username == conn.User.Username && job.isRunning() {
+			running++
+		}
+	}
+	if running >= Config.PullJobs.MaxConcurrentJobs {
+		return PullJob{}, ErrTooManyPullJobs
+	}
+	redactedURL := *u
+	redactedURL.User = nil
+	redactedURL.RawQuery = ""
+	redactedURL.Fragment = ""
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &pullJob{
+		username: conn.User.Username,
+		url:      u.String(),
+		info: PullJob{
+			ID:             xid.New().String(),
+			URL:            redactedURL.String(),
+			Path:           virtualPath,
+			ExpectedSHA256: checksum,
+			Status:         PullJobStatusRunning,
+			StartTime:      util.GetTimeAsMsSinceEpoch(time.Now()),
+		},
+		cancel: cancel,
+	}
+	m.jobs[job.info.ID] = job
+	// the requesting connection could be closed before the job ends
+	// so we use a dedicated connection
+	jobConn := NewBaseConnection(job.info.ID, conn.protocol, conn.localAddr, conn.remoteAddr, conn.User)
+	go m.run(ctx, jobConn, job)
+
+	return job.getInfo(), nil
+}
+
+func (m *pullJobsManager) run(ctx context.Context, conn *BaseConnection, job *pullJob) {
+	defer conn.CloseFS() //nolint:errcheck
+	defer job.cancel()
+
+	info := job.getInfo()
+	conn.Log(logger.LevelInfo, "starting pull job %q, url %q, path %q", info.ID, info.URL, info.Path)
+
+	config := Config.PullJobs
+	client := httpclient.GetDownloadHTTPClient(config.checkAddress)
+	defer client.CloseIdleConnections()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= pullJobsMaxRedirects {
+			return fmt.Errorf("stopped after %d redirects", pullJobsMaxRedirects)
+		}
+		return config.checkURL(req.URL)
+	}
+
+	var checksum string
+	var err error
+	retryWait := pullJobsRetryWait
+	for attempt := 1; attempt <= config.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			conn.Log(logger.LevelDebug, "retrying pull job %q in %s, attempt %d, previous error: %v",
+				info.ID, retryWait, attempt, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(retryWait):
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			retryWait = min(2*retryWait, pullJobsMaxRetryWait)
+		}
+		job.startAttempt(attempt)
+		var retry bool
+		checksum, retry, err = job.download(ctx, client, conn)
+		if err == nil || !retry || ctx.Err() != nil {
+			break
+		}
+	}
+	job.setDone(checksum, err, ctx.Err() != nil)
+
+	info = job.getInfo()
+	logger.Debug(pullJobsLogSender, conn.GetID(), "pull job %q finished, status: %s, attempts: %d, downloaded: %d, "+
+		"elapsed: %d ms, err: %v", info.ID, info.Status, info.Attempts, info.Downloaded, info.EndTime-info.StartTime, err)
+}
+
+// removeExpired must be called with the lock held
+func (m *pullJobsManager) removeExpired() {
+	for id, job := range m.jobs {
+		if job.isExpired() {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+func (m *pullJobsManager) getJob(username, id string) (*pullJob, error) {
+	job, ok := m.jobs[id]
+	if !ok || job.username != username {
+		return nil, util.NewRecordNotFoundError(fmt.Sprintf("pull job %q not found", id))
+	}
+	return job, nil
+}
+
+// Get returns the pull job with the specified id for the given user
+func (m *pullJobsManager) Get(username, id string) (PullJob, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	job, err := m.getJob(username, id)
+	if err != nil {
+		return PullJob{}, err
+	}
+	return job.getInfo(), nil
+}
+
+// GetAll returns the pull jobs for the given user, sorted by start time
+func (m *pullJobsManager) GetAll(username string) []PullJob {
+	m.RLock()
+	defer m.RUnlock()
+
+	result := make([]PullJob, 0)
+	for _, job := range m.jobs {
+		if job.username == username {
+			result = append(result, job.getInfo())
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].StartTime == result[j].StartTime {
+			return result[i].ID < result[j].ID
+		}
+		return result[i].StartTime < result[j].StartTime
+	})
+	return result
+}
+
+// Cancel stops the running pull job with the specified id for the given user.
+// The partially downloaded file is removed
+func (m *pullJobsManager) Cancel(username, id string) error {
+	m.RLock()
+	defer m.RUnlock()
+
+	job, err := m.getJob(username, id)
+	if err != nil {
+		return err
+	}
+	if !job.isRunning() {
+		return util.NewValidationError(fmt.Sprintf("pull job %q is not running", id))
+	}
+	job.cancel()
+	return nil
+}
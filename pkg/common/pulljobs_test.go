@@ -0,0 +1,265 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+func waitPullJob(t *testing.T, username, id string) PullJob {
+	var job PullJob
+	assert.Eventually(t, func() bool {
+		var err error
+		job, err = PullJobs.Get(username, id)
+		return err == nil && job.Status != PullJobStatusRunning
+	}, 10*time.Second, 50*time.Millisecond)
+	return job
+}
+
+func TestPullJobsConfig(t *testing.T) {
+	c := PullJobsConfig{}
+	assert.NoError(t, c.validate())
+	c.Enabled = true
+	assert.Error(t, c.validate())
+	c.MaxAttempts = 1
+	assert.Error(t, c.validate())
+	c.MaxConcurrentJobs = 1
+	c.AllowedHosts = []string{" "}
+	assert.Error(t, c.validate())
+	c.AllowedHosts = []string{"[a-"}
+	assert.Error(t, c.validate())
+	c.AllowedHosts = []string{" *.Example.com "}
+	require.NoError(t, c.validate())
+	assert.Equal(t, []string{"*.example.com"}, c.AllowedHosts)
+	assert.True(t, c.isHostAllowed("files.EXAMPLE.com"))
+	assert.False(t, c.isHostAllowed("example.org"))
+
+	u, err := url.Parse("ftp://files.example.com/file")
+	require.NoError(t, err)
+	assert.ErrorIs(t, c.checkURL(u), util.ErrValidation)
+	u, err = url.Parse("https://example.org/file")
+	require.NoError(t, err)
+	assert.ErrorIs(t, c.checkURL(u), util.ErrValidation)
+	u, err = url.Parse("https://files.example.com/file")
+	require.NoError(t, err)
+	assert.NoError(t, c.checkURL(u))
+
+	for _, addr := range []string{"127.0.0.1:80", "10.1.2.3:443", "192.168.1.1:80", "169.254.169.254:80", "[::1]:443",
+		"[fe80::1]:80", "0.0.0.0:80"} {
+		assert.ErrorIs(t, c.checkAddress("tcp", addr, nil), util.ErrValidation, addr)
+	}
+	assert.NoError(t, c.checkAddress("tcp", "93.184.216.34:443", nil))
+	assert.Error(t, c.checkAddress("tcp", "invalid", nil))
+	c.AllowPrivateNetworks = true
+	assert.NoError(t, c.checkAddress("tcp", "127.0.0.1:80", nil))
+}
+
+func TestPullJobs(t *testing.T) {
+	data := []byte("content downloaded from an external URL")
+	h := sha256.Sum256(data)
+	checksum := hex.EncodeToString(h[:])
+	var failures atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/file":
+			w.Write(data) //nolint:errcheck
+		case "/flaky":
+			if failures.Add(-1) >= 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write(data) //nolint:errcheck
+		case "/redirect":
+			http.Redirect(w, r, "http://example.com/file", http.StatusFound)
+		case "/slow":
+			w.Header().Set("Content-Length", "100000")
+			w.Write(data) //nolint:errcheck
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	homeDir := filepath.Join(os.TempDir(), "pulljobs_home")
+	err := os.MkdirAll(homeDir, os.ModePerm)
+	require.NoError(t, err)
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username:   "pulljobs_user",
+			HomeDir:    homeDir,
+			Status:     1,
+			QuotaFiles: 100,
+			Permissions: map[string][]string{
+				"/":   {dataprovider.PermAny},
+				"/ro": {dataprovider.PermListItems, dataprovider.PermDownload},
+			},
+		},
+	}
+	user.Filters.StagingFolders = []string{"/staging"}
+	err = dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+	conn := NewBaseConnection(xid.New().String(), ProtocolHTTP, "", "", user)
+	numJobs := len(PullJobs.GetAll(user.Username))
+
+	_, err = PullJobs.Start(conn, server.URL+"/file", "/file", "")
+	assert.ErrorIs(t, err, util.ErrMethodDisabled)
+
+	pullConfig := Config.PullJobs
+	retryWait := pullJobsRetryWait
+	Config.PullJobs = PullJobsConfig{
+		Enabled:           true,
+		MaxAttempts:       3,
+		MaxConcurrentJobs: 1,
+	}
+	pullJobsRetryWait = 10 * time.Millisecond
+	defer func() {
+		Config.PullJobs = pullConfig
+		pullJobsRetryWait = retryWait
+	}()
+	// private addresses are not allowed by default
+	job, err := PullJobs.Start(conn, server.URL+"/file", "/file", "")
+	require.NoError(t, err)
+	job = waitPullJob(t, user.Username, job.ID)
+	assert.Equal(t, PullJobStatusFailed, job.Status)
+	assert.Equal(t, 1, job.Attempts)
+	assert.Contains(t, job.Error, "not allowed")
+	assert.NoFileExists(t, filepath.Join(homeDir, "file"))
+
+	Config.PullJobs.AllowPrivateNetworks = true
+	for _, target := range []string{"/", "/ro/file", "/staging/file"} {
+		_, err = PullJobs.Start(conn, server.URL+"/file", target, "")
+		assert.Error(t, err, target)
+	}
+	_, err = PullJobs.Start(conn, "file:///etc/passwd", "/file", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	_, err = PullJobs.Start(conn, server.URL+"/file", "/file", "invalid")
+	assert.ErrorIs(t, err, util.ErrValidation)
+
+	job, err = PullJobs.Start(conn, server.URL+"/file?X-Amz-Signature=secret", "/file", checksum)
+	require.NoError(t, err)
+	assert.NotContains(t, job.URL, "secret")
+	job = waitPullJob(t, user.Username, job.ID)
+	assert.Equal(t, PullJobStatusCompleted, job.Status, job.Error)
+	assert.Equal(t, checksum, job.SHA256)
+	assert.Equal(t, int64(len(data)), job.Size)
+	assert.Equal(t, int64(len(data)), job.Downloaded)
+	content, err := os.ReadFile(filepath.Join(homeDir, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, data, content)
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, user.UsedQuotaFiles)
+	assert.Equal(t, int64(len(data)), user.UsedQuotaSize)
+	// checksum mismatches are retried, the partial file is removed
+	job, err = PullJobs.Start(conn, server.URL+"/file", "/file1", checksum[1:]+"0")
+	require.NoError(t, err)
+	job = waitPullJob(t, user.Username, job.ID)
+	assert.Equal(t, PullJobStatusFailed, job.Status)
+	assert.Equal(t, 3, job.Attempts)
+	assert.NoFileExists(t, filepath.Join(homeDir, "file1"))
+	// server errors are retried
+	failures.Store(2)
+	job, err = PullJobs.Start(conn, server.URL+"/flaky", "/file1", "")
+	require.NoError(t, err)
+	job = waitPullJob(t, user.Username, job.ID)
+	assert.Equal(t, PullJobStatusCompleted, job.Status, job.Error)
+	assert.Equal(t, 3, job.Attempts)
+	assert.FileExists(t, filepath.Join(homeDir, "file1"))
+	// client errors are not retried
+	job, err = PullJobs.Start(conn, server.URL+"/missing", "/file2", "")
+	require.NoError(t, err)
+	job = waitPullJob(t, user.Username, job.ID)
+	assert.Equal(t, PullJobStatusFailed, job.Status)
+	assert.Equal(t, 1, job.Attempts)
+	// redirects to hosts not allowed are refused
+	Config.PullJobs.AllowedHosts = []string{"127.0.0.1"}
+	job, err = PullJobs.Start(conn, server.URL+"/redirect", "/file2", "")
+	require.NoError(t, err)
+	job = waitPullJob(t, user.Username, job.ID)
+	assert.Equal(t, PullJobStatusFailed, job.Status)
+	assert.Equal(t, 1, job.Attempts)
+	assert.Contains(t, job.Error, "example.com")
+	_, err = PullJobs.Start(conn, "http://example.com/file", "/file2", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	Config.PullJobs.AllowedHosts = nil
+	// cancel a running job, the concurrent jobs are limited
+	job, err = PullJobs.Start(conn, server.URL+"/slow", "/file2", "")
+	require.NoError(t, err)
+	_, err = PullJobs.Start(conn, server.URL+"/file", "/file3", "")
+	assert.ErrorIs(t, err, ErrTooManyPullJobs)
+	assert.Eventually(t, func() bool {
+		info, err := PullJobs.Get(user.Username, job.ID)
+		return err == nil && info.Downloaded == int64(len(data))
+	}, 5*time.Second, 50*time.Millisecond)
+	err = PullJobs.Cancel(user.Username, job.ID)
+	assert.NoError(t, err)
+	job = waitPullJob(t, user.Username, job.ID)
+	assert.Equal(t, PullJobStatusCanceled, job.Status)
+	assert.NoFileExists(t, filepath.Join(homeDir, "file2"))
+	err = PullJobs.Cancel(user.Username, job.ID)
+	assert.ErrorIs(t, err, util.ErrValidation)
+	err = PullJobs.Cancel(user.Username, "missing")
+	assert.ErrorIs(t, err, util.ErrNotFound)
+	_, err = PullJobs.Get("missing", job.ID)
+	assert.ErrorIs(t, err, util.ErrNotFound)
+	// the quota is enforced
+	user.QuotaSize = int64(len(data))*2 + int64(len(data))/2
+	err = dataprovider.UpdateUser(&user, "", "", "")
+	require.NoError(t, err)
+	conn = NewBaseConnection(xid.New().String(), ProtocolHTTP, "", "", user)
+	job, err = PullJobs.Start(conn, server.URL+"/file", "/file3", "")
+	require.NoError(t, err)
+	job = waitPullJob(t, user.Username, job.ID)
+	assert.Equal(t, PullJobStatusFailed, job.Status)
+	assert.Equal(t, 1, job.Attempts)
+	assert.NoFileExists(t, filepath.Join(homeDir, "file3"))
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+	assert.Equal(t, 2, user.UsedQuotaFiles)
+	assert.Equal(t, int64(len(data))*2, user.UsedQuotaSize)
+
+	jobs := PullJobs.GetAll(user.Username)
+	assert.Len(t, jobs, numJobs+8)
+	for idx := range jobs {
+		assert.NotEqual(t, PullJobStatusRunning, jobs[idx].Status, fmt.Sprintf("job %d", idx))
+	}
+
+	err = dataprovider.DeleteUser(user.Username, "", "", "")
+	assert.NoError(t, err)
+	err = os.RemoveAll(homeDir)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,236 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/metric"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	qosDirectionUpload   = "upload"
+	qosDirectionDownload = "download"
+)
+
+var qos *qosScheduler
+
+// QoSClass defines a transfer priority class
+type QoSClass struct {
+	// Unique class name, users and groups refer to it
+	Name string `json:"name" mapstructure:"name"`
+	// Relative weight, the global bandwidth is shared between the classes with
+	// active transfers proportionally to their weight
+	Weight int `json:"weight" mapstructure:"weight"`
+}
+
+// QoSConfig defines the global bandwidth limits and the priority classes
+// used to share them. If the global limits are saturated, each class with
+// active transfers gets a share proportional to its weight, unused shares
+// are redistributed to the active classes
+type QoSConfig struct {
+	// Global upload bandwidth limit as KB/s shared by all transfers. 0 means no limit
+	UploadBandwidth int64 `json:"upload_bandwidth" mapstructure:"upload_bandwidth"`
+	// Global download bandwidth limit as KB/s shared by all transfers. 0 means no limit
+	DownloadBandwidth int64 `json:"download_bandwidth" mapstructure:"download_bandwidth"`
+	// Priority classes
+	Classes []QoSClass `json:"classes" mapstructure:"classes"`
+	// Class for users without a priority class or with an undefined one.
+	// It is added with weight 1 if not defined in classes
+	DefaultClass string `json:"default_class" mapstructure:"default_class"`
+}
+
+func (c *QoSConfig) isEnabled() bool {
+	return c.UploadBandwidth > 0 || c.DownloadBandwidth > 0
+}
+
+func (c *QoSConfig) validate() error {
+	if !c.isEnabled() {
+		return nil
+	}
+	c.DefaultClass = strings.TrimSpace(c.DefaultClass)
+	if c.DefaultClass == "" {
+		c.DefaultClass = "default"
+	}
+	var names []string
+	for idx := range c.Classes {
+		class := &c.Classes[idx]
+		class.Name = strings.TrimSpace(class.Name)
+		if class.Name == "" {
+			return fmt.Errorf("qos: class name is mandatory, index %d", idx)
+		}
+		if util.Contains(names, class.Name) {
+			return fmt.Errorf("qos: duplicate class %q", class.Name)
+		}
+		if class.Weight <= 0 {
+			return fmt.Errorf("qos: invalid weight %d for class %q", class.Weight, class.Name)
+		}
+		names = append(names, class.Name)
+	}
+	if !util.Contains(names, c.DefaultClass) {
+		c.Classes = append(c.Classes, QoSClass{
+			Name:   c.DefaultClass,
+			Weight: 1,
+		})
+	}
+	return nil
+}
+
+// qosClassState tracks the active transfers for a priority class
+// and the limiter with the assigned bandwidth
+type qosClassState struct {
+	name      string
+	weight    int
+	transfers int
+	limiter   *rate.Limiter
+	bucket    *qosBucket
+}
+
+// qosBucket shares a global bandwidth limit between the priority classes
+type qosBucket struct {
+	sync.Mutex
+	direction string
+	bandwidth int64
+	classes   map[string]*qosClassState
+}
+
+func newQoSBucket(direction string, bandwidth int64, classes []QoSClass) *qosBucket {
+	b := &qosBucket{
+		direction: direction,
+		bandwidth: bandwidth * 1024,
+		classes:   make(map[string]*qosClassState),
+	}
+	for _, class := range classes {
+		b.classes[class.Name] = &qosClassState{
+			name:    class.Name,
+			weight:  class.Weight,
+			limiter: rate.NewLimiter(rate.Limit(b.bandwidth), int(b.bandwidth)),
+			bucket:  b,
+		}
+	}
+	return b
+}
+
+func (b *qosBucket) add(className, defaultClass string) *qosClassState {
+	b.Lock()
+	defer b.Unlock()
+
+	class, ok := b.classes[className]
+	if !ok {
+		class = b.classes[defaultClass]
+	}
+	class.transfers++
+	b.rebalance()
+	return class
+}
+
+func (b *qosBucket) remove(class *qosClassState) {
+	b.Lock()
+	defer b.Unlock()
+
+	class.transfers--
+	b.rebalance()
+}
+
+// getBandwidth returns the bandwidth, as bytes/s, currently assigned to the
+// specified class, 0 means no active transfers
+func (b *qosBucket) getBandwidth(className string) int64 {
+	b.Lock()
+	defer b.Unlock()
+
+	class, ok := b.classes[className]
+	if !ok || class.transfers == 0 {
+		return 0
+	}
+	return int64(class.limiter.Limit())
+}
+
+// rebalance assigns the bandwidth to the classes with active transfers
+// proportionally to their weight. It must be called within a locked block
+func (b *qosBucket) rebalance() {
+	totalWeight := 0
+	for _, class := range b.classes {
+		if class.transfers > 0 {
+			totalWeight += class.weight
+		}
+	}
+	for _, class := range b.classes {
+		var bandwidth int64
+		if class.transfers > 0 {
+			bandwidth = b.bandwidth * int64(class.weight) / int64(totalWeight)
+			if bandwidth < 1 {
+				bandwidth = 1
+			}
+			if class.limiter.Limit() != rate.Limit(bandwidth) {
+				class.limiter.SetLimit(rate.Limit(bandwidth))
+				class.limiter.SetBurst(int(bandwidth))
+			}
+		}
+		metric.UpdateQoSClassStatus(class.name, b.direction, class.transfers, bandwidth)
+	}
+}
+
+// qosScheduler applies the global bandwidth limits
+type qosScheduler struct {
+	defaultClass string
+	upload       *qosBucket
+	download     *qosBucket
+}
+
+func newQoSScheduler(c QoSConfig) *qosScheduler {
+	s := &qosScheduler{
+		defaultClass: c.DefaultClass,
+	}
+	if c.UploadBandwidth > 0 {
+		s.upload = newQoSBucket(qosDirectionUpload, c.UploadBandwidth, c.Classes)
+	}
+	if c.DownloadBandwidth > 0 {
+		s.download = newQoSBucket(qosDirectionDownload, c.DownloadBandwidth, c.Classes)
+	}
+	return s
+}
+
+func (s *qosScheduler) getBucket(transferType int) *qosBucket {
+	if transferType == TransferDownload {
+		return s.download
+	}
+	return s.upload
+}
+
+// add registers a transfer for the specified user and returns the class state
+// to use for throttling, nil means no global limit for this transfer type
+func (s *qosScheduler) add(user *dataprovider.User, transferType int) *qosClassState {
+	bucket := s.getBucket(transferType)
+	if bucket == nil {
+		return nil
+	}
+	className := user.Filters.PriorityClass
+	if className == "" {
+		className = s.defaultClass
+	}
+	class := bucket.add(className, s.defaultClass)
+	if class.name != className {
+		logger.Debug(logSender, "", "priority class %q for user %q is not defined, using the default class",
+			className, user.Username)
+	}
+	return class
+}
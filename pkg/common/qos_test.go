@@ -0,0 +1,175 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+func getQoSTestUser(username, class string) dataprovider.User {
+	return dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: username,
+			HomeDir:  os.TempDir(),
+		},
+		Filters: dataprovider.UserFilters{
+			PriorityClass: class,
+		},
+	}
+}
+
+func TestQoSConfigValidate(t *testing.T) {
+	c := QoSConfig{
+		Classes: []QoSClass{
+			{
+				Name: "",
+			},
+		},
+	}
+	// disabled, the classes are not validated
+	assert.NoError(t, c.validate())
+	c.UploadBandwidth = 1024
+	assert.ErrorContains(t, c.validate(), "class name is mandatory")
+	c.Classes = []QoSClass{
+		{
+			Name:   " gold ",
+			Weight: 3,
+		},
+		{
+			Name:   "gold",
+			Weight: 1,
+		},
+	}
+	assert.ErrorContains(t, c.validate(), "duplicate class")
+	c.Classes[1].Name = "silver"
+	c.Classes[1].Weight = 0
+	assert.ErrorContains(t, c.validate(), "invalid weight")
+	c.Classes[1].Weight = 2
+	require.NoError(t, c.validate())
+	assert.Equal(t, "default", c.DefaultClass)
+	require.Len(t, c.Classes, 3)
+	assert.Equal(t, "gold", c.Classes[0].Name)
+	assert.Equal(t, "default", c.Classes[2].Name)
+	assert.Equal(t, 1, c.Classes[2].Weight)
+
+	c.DefaultClass = "silver"
+	c.Classes = c.Classes[:2]
+	require.NoError(t, c.validate())
+	assert.Len(t, c.Classes, 2)
+
+	configCopy := Config
+	err := Initialize(Configuration{
+		QoS: QoSConfig{
+			DownloadBandwidth: 100,
+			Classes: []QoSClass{
+				{
+					Name: "gold",
+				},
+			},
+		},
+	}, 0)
+	assert.ErrorContains(t, err, "invalid weight")
+	Config = configCopy
+}
+
+func TestQoSScheduler(t *testing.T) {
+	c := QoSConfig{
+		UploadBandwidth: 100,
+		Classes: []QoSClass{
+			{
+				Name:   "gold",
+				Weight: 3,
+			},
+		},
+	}
+	require.NoError(t, c.validate())
+	s := newQoSScheduler(c)
+	assert.Nil(t, s.download)
+	gold := getQoSTestUser("user1", "gold")
+	user := getQoSTestUser("user2", "")
+	unknown := getQoSTestUser("user3", "unknown")
+
+	assert.Nil(t, s.add(&gold, TransferDownload))
+	class1 := s.add(&gold, TransferUpload)
+	require.NotNil(t, class1)
+	assert.Equal(t, "gold", class1.name)
+	// a single active class gets all the bandwidth
+	assert.Equal(t, int64(102400), s.upload.getBandwidth("gold"))
+	assert.Equal(t, int64(0), s.upload.getBandwidth("default"))
+	class2 := s.add(&user, TransferUpload)
+	require.NotNil(t, class2)
+	assert.Equal(t, "default", class2.name)
+	assert.Equal(t, int64(76800), s.upload.getBandwidth("gold"))
+	assert.Equal(t, int64(25600), s.upload.getBandwidth("default"))
+	// undefined classes use the default one
+	class3 := s.add(&unknown, TransferUpload)
+	require.NotNil(t, class3)
+	assert.Equal(t, "default", class3.name)
+	assert.Equal(t, 2, class3.transfers)
+	assert.Equal(t, int64(76800), s.upload.getBandwidth("gold"))
+
+	class1.bucket.remove(class1)
+	assert.Equal(t, int64(0), s.upload.getBandwidth("gold"))
+	assert.Equal(t, int64(102400), s.upload.getBandwidth("default"))
+	class2.bucket.remove(class2)
+	class3.bucket.remove(class3)
+	assert.Equal(t, int64(0), s.upload.getBandwidth("default"))
+	assert.Equal(t, int64(0), s.upload.getBandwidth("missing"))
+}
+
+func TestQoSThrottle(t *testing.T) {
+	c := QoSConfig{
+		DownloadBandwidth: 64,
+	}
+	require.NoError(t, c.validate())
+	qos = newQoSScheduler(c)
+	defer func() {
+		qos = nil
+	}()
+
+	fs := vfs.NewOsFs("", os.TempDir(), "", nil)
+	conn := NewBaseConnection("id", ProtocolSFTP, "", "", getQoSTestUser("user", ""))
+	upload := NewBaseTransfer(nil, conn, nil, "", "", "/file1", TransferUpload, 0, 0, 0, 0, true, fs,
+		dataprovider.TransferQuota{})
+	assert.Nil(t, upload.qosClass)
+	transfer := NewBaseTransfer(nil, conn, nil, "", "", "/file2", TransferDownload, 0, 0, 0, 0, true, fs,
+		dataprovider.TransferQuota{})
+	require.NotNil(t, transfer.qosClass)
+	assert.Equal(t, int64(65536), qos.download.getBandwidth("default"))
+	// the first 64 KB are allowed as burst
+	transfer.BytesSent.Store(131072)
+	startTime := time.Now()
+	transfer.HandleThrottle()
+	elapsed := time.Since(startTime)
+	assert.GreaterOrEqual(t, elapsed, 900*time.Millisecond, "global bandwidth throttling not respected")
+
+	err := upload.Close()
+	assert.NoError(t, err)
+	err = transfer.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), qos.download.getBandwidth("default"))
+	// closing again has no effect
+	transfer.removeFromQoS()
+	assert.Equal(t, 0, transfer.qosClass.transfers)
+}
@@ -0,0 +1,306 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+const (
+	quotaScansLogSender = "quotascans"
+)
+
+var (
+	// ScheduledQuotaScans runs the periodic quota scans for users and folders
+	ScheduledQuotaScans = &quotaScansScheduler{
+		states: vfs.NewQuotaScanStates(),
+	}
+	// ErrQuotaScansRunning is returned if the scheduled quota scans are already running
+	ErrQuotaScansRunning = errors.New("the scheduled quota scans are already running")
+)
+
+// ScheduledQuotaScansConfig defines the configuration for the periodic quota
+// scans of users and virtual folders
+type ScheduledQuotaScansConfig struct {
+	// Interval between the scans as minutes, 0 means disabled
+	Interval int `json:"interval" mapstructure:"interval"`
+	// For local filesystems, only list the directories modified since the
+	// previous scan. Files modified in place, without adding or removing
+	// directory entries, are only detected by full scans
+	Incremental bool `json:"incremental" mapstructure:"incremental"`
+	// If incremental scans are enabled, run a full scan every this number
+	// of scans. 0 means that only the first scan after startup is full
+	FullScanEvery int `json:"full_scan_every" mapstructure:"full_scan_every"`
+}
+
+func (c *ScheduledQuotaScansConfig) isEnabled() bool {
+	return c.Interval > 0
+}
+
+func (c *ScheduledQuotaScansConfig) validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("invalid scheduled quota scans interval: %d", c.Interval)
+	}
+	if c.FullScanEvery < 0 {
+		return fmt.Errorf("invalid scheduled quota scans full scan every: %d", c.FullScanEvery)
+	}
+	return nil
+}
+
+// ScheduledQuotaScansStatus defines the status of the scheduled quota scans
+type ScheduledQuotaScansStatus struct {
+	Enabled bool `json:"enabled"`
+	// Interval between the scans as minutes
+	Interval    int  `json:"interval"`
+	Incremental bool `json:"incremental"`
+	// True if a scan is in progress
+	Running bool `json:"running"`
+	// True if the current or the last scan is full
+	Full bool `json:"full"`
+	// Start and end time of the current or the last scan as unix timestamp in milliseconds
+	StartTime int64 `json:"start_time,omitempty"`
+	EndTime   int64 `json:"end_time,omitempty"`
+	// Users and folders to scan and already scanned
+	Users          int `json:"users"`
+	ScannedUsers   int `json:"scanned_users"`
+	Folders        int `json:"folders"`
+	ScannedFolders int `json:"scanned_folders"`
+	// Users and folders that could not be scanned
+	Failures []string `json:"failures,omitempty"`
+}
+
+type quotaScansScheduler struct {
+	sync.RWMutex
+	config ScheduledQuotaScansConfig
+	status ScheduledQuotaScansStatus
+	// number of completed scans since the last full scan
+	scans  int
+	states *vfs.QuotaScanStates
+}
+
+func (s *quotaScansScheduler) init(config ScheduledQuotaScansConfig) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.config = config
+	s.status = ScheduledQuotaScansStatus{}
+	s.scans = 0
+	s.states.Reset()
+}
+
+// GetStatus returns the status of the scheduled quota scans
+func (s *quotaScansScheduler) GetStatus() ScheduledQuotaScansStatus {
+	s.RLock()
+	defer s.RUnlock()
+
+	status := s.status
+	status.Enabled = s.config.isEnabled()
+	status.Interval = s.config.Interval
+	status.Incremental = s.config.Incremental
+	status.Failures = make([]string, len(s.status.Failures))
+	copy(status.Failures, s.status.Failures)
+	return status
+}
+
+// Start runs the quota scans in the background. It returns an error if
+// they are already running
+func (s *quotaScansScheduler) Start() error {
+	full, err := s.setRunning()
+	if err != nil {
+		return err
+	}
+	go s.run(full)
+	return nil
+}
+
+func (s *quotaScansScheduler) runScheduled() {
+	full, err := s.setRunning()
+	if err != nil {
+		logger.Debug(quotaScansLogSender, "", "skipping scheduled quota scans: %v", err)
+		return
+	}
+	s.run(full)
+}
+
+func (s *quotaScansScheduler) setRunning() (bool, error) {
+	if dataprovider.GetQuotaTracking() == 0 {
+		return false, util.NewMethodDisabledError("quota tracking is disabled")
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	if s.status.Running {
+		return false, ErrQuotaScansRunning
+	}
+	full := !s.config.Incremental || s.status.StartTime == 0 ||
+		(s.config.FullScanEvery > 0 && s.scans >= s.config.FullScanEvery)
+	s.status = ScheduledQuotaScansStatus{
+		Running:   true,
+		Full:      full,
+		StartTime: util.GetTimeAsMsSinceEpoch(time.Now()),
+	}
+	return full, nil
+}
+
+func (s *quotaScansScheduler) update(fn func(status *ScheduledQuotaScansStatus)) {
+	s.Lock()
+	defer s.Unlock()
+
+	fn(&s.status)
+}
+
+func (s *quotaScansScheduler) run(full bool) {
+	startTime := time.Now()
+	logger.Info(quotaScansLogSender, "", "starting quota scans, full: %t", full)
+	s.RLock()
+	incremental := s.config.Incremental
+	s.RUnlock()
+
+	var states *vfs.QuotaScanStates
+	if incremental {
+		states = s.states
+		if full {
+			// a full scan replaces the previous results
+			states.Reset()
+		}
+	}
+
+	dump, err := dataprovider.DumpData([]string{dataprovider.DumpScopeUsers, dataprovider.DumpScopeFolders})
+	if err != nil {
+		logger.Error(quotaScansLogSender, "", "unable to get users and folders: %v", err)
+		s.update(func(status *ScheduledQuotaScansStatus) {
+			status.Running = false
+			status.EndTime = util.GetTimeAsMsSinceEpoch(time.Now())
+			status.Failures = append(status.Failures, "unable to get users and folders")
+		})
+		return
+	}
+	s.update(func(status *ScheduledQuotaScansStatus) {
+		status.Users = len(dump.Users)
+		status.Folders = len(dump.Folders)
+	})
+
+	for idx := range dump.Users {
+		if CheckClosing() != nil {
+			break
+		}
+		user := &dump.Users[idx]
+		err := scanUserQuota(user, states)
+		s.update(func(status *ScheduledQuotaScansStatus) {
+			status.ScannedUsers++
+			if err != nil {
+				status.Failures = append(status.Failures, fmt.Sprintf("user %q: %v", user.Username, err))
+			}
+		})
+	}
+	for idx := range dump.Folders {
+		if CheckClosing() != nil {
+			break
+		}
+		folder := &dump.Folders[idx]
+		err := scanFolderQuota(folder, states)
+		s.update(func(status *ScheduledQuotaScansStatus) {
+			status.ScannedFolders++
+			if err != nil {
+				status.Failures = append(status.Failures, fmt.Sprintf("folder %q: %v", folder.Name, err))
+			}
+		})
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if full {
+		s.scans = 0
+	}
+	s.scans++
+	s.status.Running = false
+	s.status.EndTime = util.GetTimeAsMsSinceEpoch(time.Now())
+	logger.Info(quotaScansLogSender, "", "quota scans completed in %s, users: %d/%d, folders: %d/%d, failures: %d",
+		time.Since(startTime), s.status.ScannedUsers, s.status.Users, s.status.ScannedFolders, s.status.Folders,
+		len(s.status.Failures))
+}
+
+func scanUserQuota(user *dataprovider.User, states *vfs.QuotaScanStates) error {
+	if err := user.LoadAndApplyGroupSettings(); err != nil {
+		logger.Warn(quotaScansLogSender, "", "unable to apply group settings for user %q: %v", user.Username, err)
+		return err
+	}
+	if !QuotaScans.AddUserQuotaScan(user.Username, user.Role) {
+		logger.Debug(quotaScansLogSender, "", "another quota scan is already in progress for user %q", user.Username)
+		return nil
+	}
+	defer QuotaScans.RemoveUserQuotaScan(user.Username)
+
+	return doUserQuotaScan(user, states)
+}
+
+// doUserQuotaScan scans and updates the quota for the specified user, the
+// scan must be already registered in QuotaScans
+func doUserQuotaScan(user *dataprovider.User, states *vfs.QuotaScanStates) error {
+	numFiles, size, err := user.ScanQuotaIncremental(states, func(numFiles int, size int64) {
+		QuotaScans.UpdateUserQuotaScanProgress(user.Username, numFiles, size)
+	})
+	if err != nil {
+		logger.Warn(quotaScansLogSender, "", "error scanning quota for user %q: %v", user.Username, err)
+		return err
+	}
+	if err := dataprovider.UpdateUserQuota(user, numFiles, size, true); err != nil {
+		logger.Warn(quotaScansLogSender, "", "error updating quota for user %q: %v", user.Username, err)
+		return err
+	}
+	logger.Debug(quotaScansLogSender, "", "quota scanned for user %q, files: %d, size: %d", user.Username, numFiles, size)
+	return nil
+}
+
+func scanFolderQuota(folder *vfs.BaseVirtualFolder, states *vfs.QuotaScanStates) error {
+	if !QuotaScans.AddVFolderQuotaScan(folder.Name) {
+		logger.Debug(quotaScansLogSender, "", "another quota scan is already in progress for folder %q", folder.Name)
+		return nil
+	}
+	defer QuotaScans.RemoveVFolderQuotaScan(folder.Name)
+
+	return doFolderQuotaScan(folder, states)
+}
+
+// doFolderQuotaScan scans and updates the quota for the specified folder, the
+// scan must be already registered in QuotaScans
+func doFolderQuotaScan(folder *vfs.BaseVirtualFolder, states *vfs.QuotaScanStates) error {
+	f := vfs.VirtualFolder{
+		BaseVirtualFolder: *folder,
+		VirtualPath:       "/",
+	}
+	numFiles, size, err := f.ScanQuotaIncremental(states, func(numFiles int, size int64) {
+		QuotaScans.UpdateVFolderQuotaScanProgress(folder.Name, numFiles, size)
+	})
+	if err != nil {
+		logger.Warn(quotaScansLogSender, "", "error scanning quota for folder %q: %v", folder.Name, err)
+		return err
+	}
+	if err := dataprovider.UpdateVirtualFolderQuota(folder, numFiles, size, true); err != nil {
+		logger.Warn(quotaScansLogSender, "", "error updating quota for folder %q: %v", folder.Name, err)
+		return err
+	}
+	logger.Debug(quotaScansLogSender, "", "quota scanned for folder %q, files: %d, size: %d", folder.Name, numFiles, size)
+	return nil
+}
@@ -0,0 +1,245 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+func TestIncrementalQuotaScan(t *testing.T) {
+	rootDir := filepath.Join(os.TempDir(), "quota_scan_root")
+	require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "sub1", "sub2"), os.ModePerm))
+	defer os.RemoveAll(rootDir)
+
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "file1"), []byte("1"), os.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "sub1", "file2"), []byte("12"), os.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "sub1", "sub2", "file3"), []byte("123"), os.ModePerm))
+
+	fs := vfs.NewOsFs("", rootDir, "", nil)
+	states := vfs.NewQuotaScanStates()
+	var progressFiles int
+	var progressSize int64
+	progress := func(numFiles int, size int64) {
+		progressFiles = numFiles
+		progressSize = size
+	}
+	numFiles, size, err := vfs.ScanRootDirContentsIncremental(fs, states, progress)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, numFiles)
+	assert.Equal(t, int64(6), size)
+	assert.Equal(t, numFiles, progressFiles)
+	assert.Equal(t, size, progressSize)
+	// the results must match a full scan
+	numFiles, size, err = fs.ScanRootDirContents()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, numFiles)
+	assert.Equal(t, int64(6), size)
+	// add and remove some entries
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "sub1", "sub2", "file4"), []byte("1234"), os.ModePerm))
+	require.NoError(t, os.Remove(filepath.Join(rootDir, "file1")))
+	require.NoError(t, os.Mkdir(filepath.Join(rootDir, "sub3"), os.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "sub3", "file5"), []byte("12345"), os.ModePerm))
+	numFiles, size, err = vfs.ScanRootDirContentsIncremental(fs, states, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, numFiles)
+	assert.Equal(t, int64(14), size)
+	// a file modified in place does not change the directory modification time
+	f, err := os.OpenFile(filepath.Join(rootDir, "sub1", "file2"), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("3"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	numFiles, size, err = vfs.ScanRootDirContentsIncremental(fs, states, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, numFiles)
+	assert.Equal(t, int64(14), size)
+	// a full scan detects it
+	states.Reset()
+	numFiles, size, err = vfs.ScanRootDirContentsIncremental(fs, states, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, numFiles)
+	assert.Equal(t, int64(15), size)
+	numFiles, size, err = vfs.ScanRootDirContentsIncremental(fs, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, numFiles)
+	assert.Equal(t, int64(15), size)
+	// removed directories are not counted anymore
+	require.NoError(t, os.RemoveAll(filepath.Join(rootDir, "sub1")))
+	numFiles, size, err = vfs.ScanRootDirContentsIncremental(fs, states, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numFiles)
+	assert.Equal(t, int64(5), size)
+
+	require.NoError(t, os.RemoveAll(rootDir))
+	_, _, err = vfs.ScanRootDirContentsIncremental(fs, states, nil)
+	assert.Error(t, err)
+}
+
+func TestScheduledQuotaScans(t *testing.T) {
+	c := ScheduledQuotaScansConfig{
+		Interval: -1,
+	}
+	assert.Error(t, c.validate())
+	c.Interval = 10
+	c.FullScanEvery = -1
+	assert.Error(t, c.validate())
+	c.FullScanEvery = 2
+	c.Incremental = true
+	assert.NoError(t, c.validate())
+	ScheduledQuotaScans.init(c)
+	defer ScheduledQuotaScans.init(ScheduledQuotaScansConfig{})
+
+	homeDir := filepath.Join(os.TempDir(), "scheduled_quota_user")
+	folderPath := filepath.Join(os.TempDir(), "scheduled_quota_folder")
+	require.NoError(t, os.MkdirAll(homeDir, os.ModePerm))
+	require.NoError(t, os.MkdirAll(folderPath, os.ModePerm))
+	defer os.RemoveAll(homeDir)
+	defer os.RemoveAll(folderPath)
+	require.NoError(t, os.WriteFile(filepath.Join(homeDir, "file1"), []byte("12"), os.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(folderPath, "file2"), []byte("123"), os.ModePerm))
+
+	folder := vfs.BaseVirtualFolder{
+		Name:       "scheduled_quota_folder",
+		MappedPath: folderPath,
+	}
+	require.NoError(t, dataprovider.AddFolder(&folder, "", "", ""))
+	defer dataprovider.DeleteFolder(folder.Name, "", "", "") //nolint:errcheck
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "scheduled_quota_user",
+			HomeDir:  homeDir,
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+		VirtualFolders: []vfs.VirtualFolder{
+			{
+				BaseVirtualFolder: vfs.BaseVirtualFolder{
+					Name: folder.Name,
+				},
+				VirtualPath: "/vdir",
+				QuotaSize:   -1,
+				QuotaFiles:  -1,
+			},
+		},
+	}
+	require.NoError(t, dataprovider.AddUser(&user, "", "", ""))
+	defer dataprovider.DeleteUser(user.Username, "", "", "") //nolint:errcheck
+
+	status := ScheduledQuotaScans.GetStatus()
+	assert.True(t, status.Enabled)
+	assert.True(t, status.Incremental)
+	assert.Equal(t, 10, status.Interval)
+	assert.False(t, status.Running)
+	assert.Equal(t, int64(0), status.StartTime)
+
+	waitScans := func() ScheduledQuotaScansStatus {
+		assert.Eventually(t, func() bool {
+			return !ScheduledQuotaScans.GetStatus().Running
+		}, 5*time.Second, 50*time.Millisecond)
+		return ScheduledQuotaScans.GetStatus()
+	}
+	checkQuota := func(userFiles int, userSize int64, folderFiles int, folderSize int64) {
+		u, err := dataprovider.UserExists(user.Username, "")
+		assert.NoError(t, err)
+		assert.Equal(t, userFiles, u.UsedQuotaFiles)
+		assert.Equal(t, userSize, u.UsedQuotaSize)
+		f, err := dataprovider.GetFolderByName(folder.Name)
+		assert.NoError(t, err)
+		assert.Equal(t, folderFiles, f.UsedQuotaFiles)
+		assert.Equal(t, folderSize, f.UsedQuotaSize)
+	}
+
+	require.NoError(t, ScheduledQuotaScans.Start())
+	status = waitScans()
+	assert.True(t, status.Full)
+	assert.Greater(t, status.EndTime, int64(0))
+	assert.GreaterOrEqual(t, status.Users, 1)
+	assert.Equal(t, status.Users, status.ScannedUsers)
+	assert.GreaterOrEqual(t, status.Folders, 1)
+	assert.Equal(t, status.Folders, status.ScannedFolders)
+	checkQuota(2, 5, 1, 3)
+
+	require.NoError(t, os.WriteFile(filepath.Join(homeDir, "file3"), []byte("1234"), os.ModePerm))
+	ScheduledQuotaScans.runScheduled()
+	status = ScheduledQuotaScans.GetStatus()
+	assert.False(t, status.Full)
+	assert.False(t, status.Running)
+	checkQuota(3, 9, 1, 3)
+	// the third scan is full again
+	ScheduledQuotaScans.runScheduled()
+	assert.True(t, ScheduledQuotaScans.GetStatus().Full)
+	ScheduledQuotaScans.runScheduled()
+	assert.False(t, ScheduledQuotaScans.GetStatus().Full)
+	checkQuota(3, 9, 1, 3)
+
+	// scans already in progress for the user and the folder are skipped
+	assert.True(t, QuotaScans.AddUserQuotaScan(user.Username, ""))
+	assert.True(t, QuotaScans.AddVFolderQuotaScan(folder.Name))
+	require.NoError(t, os.WriteFile(filepath.Join(homeDir, "file4"), []byte("1"), os.ModePerm))
+	ScheduledQuotaScans.runScheduled()
+	checkQuota(3, 9, 1, 3)
+	QuotaScans.UpdateUserQuotaScanProgress(user.Username, 10, 100)
+	QuotaScans.UpdateVFolderQuotaScanProgress(folder.Name, 20, 200)
+	for _, scan := range QuotaScans.GetUsersQuotaScans("") {
+		if scan.Username == user.Username {
+			assert.Equal(t, 10, scan.ScannedFiles)
+			assert.Equal(t, int64(100), scan.ScannedSize)
+		}
+	}
+	for _, scan := range QuotaScans.GetVFoldersQuotaScans() {
+		if scan.Name == folder.Name {
+			assert.Equal(t, 20, scan.ScannedFiles)
+			assert.Equal(t, int64(200), scan.ScannedSize)
+		}
+	}
+	assert.True(t, QuotaScans.RemoveUserQuotaScan(user.Username))
+	assert.True(t, QuotaScans.RemoveVFolderQuotaScan(folder.Name))
+
+	// a failing scan is reported
+	require.NoError(t, os.RemoveAll(folderPath))
+	ScheduledQuotaScans.runScheduled()
+	status = ScheduledQuotaScans.GetStatus()
+	var userFailed, folderFailed bool
+	for _, failure := range status.Failures {
+		if strings.HasPrefix(failure, fmt.Sprintf("user %q", user.Username)) {
+			userFailed = true
+		}
+		if strings.HasPrefix(failure, fmt.Sprintf("folder %q", folder.Name)) {
+			folderFailed = true
+		}
+	}
+	assert.True(t, userFailed)
+	assert.True(t, folderFailed)
+	checkQuota(3, 9, 1, 3)
+
+	ScheduledQuotaScans.Lock()
+	ScheduledQuotaScans.status.Running = true
+	ScheduledQuotaScans.Unlock()
+	assert.ErrorIs(t, ScheduledQuotaScans.Start(), ErrQuotaScansRunning)
+}
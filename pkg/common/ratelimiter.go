@@ -17,7 +17,9 @@ package common
 import (
 	"errors"
 	"fmt"
+	"path"
 	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -40,6 +42,7 @@ type RateLimiterType int
 const (
 	rateLimiterTypeGlobal RateLimiterType = iota + 1
 	rateLimiterTypeSource
+	rateLimiterTypeUser
 )
 
 // RateLimiterConfig defines the configuration for a rate limiter
@@ -56,6 +59,8 @@ type RateLimiterConfig struct {
 	// Type defines the rate limiter type:
 	// - rateLimiterTypeGlobal is a global rate limiter independent from the source
 	// - rateLimiterTypeSource is a per-source rate limiter
+	// - rateLimiterTypeUser is a per-user, or per API key, rate limiter. It
+	//   can be used for the HTTP protocol only and applies to authenticated requests
 	Type int `json:"type" mapstructure:"type"`
 	// Protocols defines the protocols for this rate limiter.
 	// Available protocols are: "SFTP", "FTP", "DAV".
@@ -64,6 +69,10 @@ type RateLimiterConfig struct {
 	// If the rate limit is exceeded, the defender is enabled, and this is a per-source limiter,
 	// a new defender event will be generated
 	GenerateDefenderEvents bool `json:"generate_defender_events" mapstructure:"generate_defender_events"`
+	// HTTPRoutes restricts the rate limiter to the HTTP requests matching these
+	// routes, for example "/api/v2/token". A route matches its sub paths too.
+	// Empty means all the requests. It can be set for the HTTP protocol only
+	HTTPRoutes []string `json:"http_routes" mapstructure:"http_routes"`
 	// The number of per-ip rate limiters kept in memory will vary between the
 	// soft and hard limit
 	EntriesSoftLimit int `json:"entries_soft_limit" mapstructure:"entries_soft_limit"`
@@ -81,7 +90,7 @@ func (r *RateLimiterConfig) validate() error {
 	if r.Period < 100 {
 		return fmt.Errorf("invalid period %v. It must be >= 100", r.Period)
 	}
-	if r.Type != int(rateLimiterTypeGlobal) && r.Type != int(rateLimiterTypeSource) {
+	if r.Type != int(rateLimiterTypeGlobal) && r.Type != int(rateLimiterTypeSource) && r.Type != int(rateLimiterTypeUser) {
 		return fmt.Errorf("invalid type %v", r.Type)
 	}
 	if r.Type != int(rateLimiterTypeGlobal) {
@@ -98,14 +107,30 @@ func (r *RateLimiterConfig) validate() error {
 			return fmt.Errorf("invalid protocol %q", protocol)
 		}
 	}
+	if r.Type == int(rateLimiterTypeUser) || len(r.HTTPRoutes) > 0 {
+		if len(r.Protocols) != 1 || r.Protocols[0] != ProtocolHTTP {
+			return fmt.Errorf("per-user rate limiters and HTTP routes require the %q protocol only", ProtocolHTTP)
+		}
+	}
+	routes := make([]string, 0, len(r.HTTPRoutes))
+	for _, route := range r.HTTPRoutes {
+		route = strings.TrimSpace(route)
+		if !path.IsAbs(route) {
+			return fmt.Errorf("invalid HTTP route %q, it must be absolute", route)
+		}
+		routes = append(routes, path.Clean(route))
+	}
+	r.HTTPRoutes = util.RemoveDuplicates(routes, false)
 	return nil
 }
 
 func (r *RateLimiterConfig) getLimiter() *rateLimiter {
 	limiter := &rateLimiter{
+		limiterType:            RateLimiterType(r.Type),
 		burst:                  r.Burst,
 		globalBucket:           nil,
 		generateDefenderEvents: r.GenerateDefenderEvents,
+		httpRoutes:             r.HTTPRoutes,
 	}
 	var maxDelay time.Duration
 	period := time.Duration(r.Period) * time.Millisecond
@@ -125,7 +150,7 @@ func (r *RateLimiterConfig) getLimiter() *rateLimiter {
 		hardLimit: r.EntriesHardLimit,
 		softLimit: r.EntriesSoftLimit,
 	}
-	if r.Type != int(rateLimiterTypeSource) {
+	if r.Type != int(rateLimiterTypeSource) && r.Type != int(rateLimiterTypeUser) {
 		limiter.globalBucket = rate.NewLimiter(limiter.rate, limiter.burst)
 	}
 	return limiter
@@ -133,12 +158,43 @@ func (r *RateLimiterConfig) getLimiter() *rateLimiter {
 
 // RateLimiter defines a rate limiter
 type rateLimiter struct {
+	limiterType            RateLimiterType
 	rate                   rate.Limit
 	burst                  int
 	maxDelay               time.Duration
 	globalBucket           *rate.Limiter
 	buckets                sourceBuckets
 	generateDefenderEvents bool
+	httpRoutes             []string
+}
+
+func (rl *rateLimiter) isUserLimiter() bool {
+	return rl.limiterType == rateLimiterTypeUser
+}
+
+func (rl *rateLimiter) getTypeAsString() string {
+	switch rl.limiterType {
+	case rateLimiterTypeGlobal:
+		return "global"
+	case rateLimiterTypeUser:
+		return "user"
+	default:
+		return "source"
+	}
+}
+
+// matchesHTTPRoute returns true if the rate limiter applies to the specified
+// URL path
+func (rl *rateLimiter) matchesHTTPRoute(urlPath string) bool {
+	if len(rl.httpRoutes) == 0 {
+		return true
+	}
+	for _, route := range rl.httpRoutes {
+		if route == "/" || urlPath == route || strings.HasPrefix(urlPath, route+"/") {
+			return true
+		}
+	}
+	return false
 }
 
 // Wait blocks until the limit allows one event to happen
@@ -162,7 +218,7 @@ func (rl *rateLimiter) Wait(source, protocol string) (time.Duration, error) {
 	delay := res.Delay()
 	if delay > rl.maxDelay {
 		res.Cancel()
-		if rl.generateDefenderEvents && rl.globalBucket == nil {
+		if rl.generateDefenderEvents && rl.limiterType == rateLimiterTypeSource {
 			AddDefenderEvent(source, protocol, HostEventLimitExceeded)
 		}
 		return delay, fmt.Errorf("rate limit exceed, wait time to respect rate %v, max wait time allowed %v", delay, rl.maxDelay)
@@ -242,3 +298,34 @@ func (b *sourceBuckets) cleanup() {
 		}
 	}
 }
+
+// SourceRateLimiter is a per-source rate limiter not bound to a protocol, it
+// can be used, for example, to limit the requests to specific HTTP routes
+type SourceRateLimiter struct {
+	limiter *rateLimiter
+}
+
+// NewSourceRateLimiter returns a per-source rate limiter allowing average
+// events every period, as milliseconds, with the specified burst
+func NewSourceRateLimiter(average, period int64, burst int) (*SourceRateLimiter, error) {
+	config := RateLimiterConfig{
+		Average:          average,
+		Period:           period,
+		Burst:            burst,
+		Type:             int(rateLimiterTypeSource),
+		EntriesSoftLimit: 1000,
+		EntriesHardLimit: 1500,
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &SourceRateLimiter{
+		limiter: config.getLimiter(),
+	}, nil
+}
+
+// Wait blocks until the limit allows one event for the specified source or
+// returns an error and the time to wait if it exceeds the max allowed delay
+func (l *SourceRateLimiter) Wait(source string) (time.Duration, error) {
+	return l.limiter.Wait(source, "")
+}
@@ -103,6 +103,54 @@ func TestRateLimiter(t *testing.T) {
 	require.ErrorIs(t, err, errReserve)
 }
 
+func TestHTTPRateLimiters(t *testing.T) {
+	config := RateLimiterConfig{
+		Average:          1,
+		Period:           1000,
+		Burst:            1,
+		Type:             int(rateLimiterTypeUser),
+		Protocols:        []string{ProtocolHTTP, ProtocolFTP},
+		EntriesSoftLimit: 5,
+		EntriesHardLimit: 10,
+	}
+	err := config.validate()
+	require.Error(t, err)
+	config.Protocols = []string{ProtocolHTTP}
+	config.HTTPRoutes = []string{"api/v2"}
+	err = config.validate()
+	require.Error(t, err)
+	config.HTTPRoutes = []string{"/api/v2/", "/api/v2", "/web/client/files"}
+	err = config.validate()
+	require.NoError(t, err)
+	require.Equal(t, []string{"/api/v2", "/web/client/files"}, config.HTTPRoutes)
+	config.Type = int(rateLimiterTypeSource)
+	config.Protocols = []string{ProtocolHTTP, ProtocolSSH}
+	err = config.validate()
+	require.Error(t, err)
+	config.Protocols = []string{ProtocolHTTP}
+	config.Type = int(rateLimiterTypeUser)
+
+	limiter := config.getLimiter()
+	require.True(t, limiter.isUserLimiter())
+	require.Equal(t, "user", limiter.getTypeAsString())
+	require.Nil(t, limiter.globalBucket)
+	require.True(t, limiter.matchesHTTPRoute("/api/v2"))
+	require.True(t, limiter.matchesHTTPRoute("/api/v2/user/files"))
+	require.False(t, limiter.matchesHTTPRoute("/api/v20"))
+	require.False(t, limiter.matchesHTTPRoute("/web/client/login"))
+
+	_, err = limiter.Wait("user_a", ProtocolHTTP)
+	require.NoError(t, err)
+	_, err = limiter.Wait("user_a", ProtocolHTTP)
+	require.Error(t, err)
+	_, err = limiter.Wait("user_b", ProtocolHTTP)
+	require.NoError(t, err)
+
+	config.HTTPRoutes = nil
+	limiter = config.getLimiter()
+	require.True(t, limiter.matchesHTTPRoute("/web/client/login"))
+}
+
 func TestLimiterCleanup(t *testing.T) {
 	config := RateLimiterConfig{
 		Average:          100,
@@ -0,0 +1,472 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/sftpgo/sdk/plugin/eventsearcher"
+	"github.com/sftpgo/sdk/plugin/notifier"
+	"github.com/wneessen/go-mail"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/plugin"
+	"github.com/drakkan/sftpgo/v2/pkg/smtp"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+const (
+	reportTimeFormat  = "20060102T150405"
+	reportSearchLimit = 1000
+)
+
+// reportRow defines a row of a generated report
+type reportRow interface {
+	getCSVData() []string
+}
+
+// reportFile defines a generated report ready to be delivered
+type reportFile struct {
+	name string
+	data []byte
+}
+
+func (f *reportFile) getAsMailAttachment() *mail.File {
+	return &mail.File{
+		Name:   f.name,
+		Header: make(map[string][]string),
+		Writer: func(w io.Writer) (int64, error) {
+			n, err := w.Write(f.data)
+			return int64(n), err
+		},
+	}
+}
+
+type transfersReportRow struct {
+	Username     string `json:"username"`
+	Uploads      int64  `json:"uploads"`
+	UploadSize   int64  `json:"upload_size"`
+	Downloads    int64  `json:"downloads"`
+	DownloadSize int64  `json:"download_size"`
+	// Failed uploads and downloads
+	Failures int64 `json:"failures"`
+}
+
+func (r *transfersReportRow) getCSVData() []string {
+	return []string{r.Username, strconv.FormatInt(r.Uploads, 10), strconv.FormatInt(r.UploadSize, 10),
+		strconv.FormatInt(r.Downloads, 10), strconv.FormatInt(r.DownloadSize, 10), strconv.FormatInt(r.Failures, 10)}
+}
+
+type quotaUsageReportRow struct {
+	Username                 string `json:"username"`
+	UsedQuotaSize            int64  `json:"used_quota_size"`
+	QuotaSize                int64  `json:"quota_size"`
+	UsedQuotaFiles           int    `json:"used_quota_files"`
+	QuotaFiles               int    `json:"quota_files"`
+	UsedUploadDataTransfer   int64  `json:"used_upload_data_transfer"`
+	UsedDownloadDataTransfer int64  `json:"used_download_data_transfer"`
+	// Total data transfer limit as bytes, 0 means unlimited
+	TotalDataTransfer int64 `json:"total_data_transfer"`
+}
+
+func (r *quotaUsageReportRow) getCSVData() []string {
+	return []string{r.Username, strconv.FormatInt(r.UsedQuotaSize, 10), strconv.FormatInt(r.QuotaSize, 10),
+		strconv.Itoa(r.UsedQuotaFiles), strconv.Itoa(r.QuotaFiles), strconv.FormatInt(r.UsedUploadDataTransfer, 10),
+		strconv.FormatInt(r.UsedDownloadDataTransfer, 10), strconv.FormatInt(r.TotalDataTransfer, 10)}
+}
+
+type failedLoginsReportRow struct {
+	Username string   `json:"username"`
+	Attempts int64    `json:"attempts"`
+	IPs      []string `json:"ips"`
+	// Last failed login as unix timestamp in milliseconds
+	LastAttempt int64 `json:"last_attempt"`
+}
+
+func (r *failedLoginsReportRow) getCSVData() []string {
+	return []string{r.Username, strconv.FormatInt(r.Attempts, 10), strings.Join(r.IPs, " "),
+		util.GetTimeFromMsecSinceEpoch(r.LastAttempt).UTC().Format(time.RFC3339)}
+}
+
+var reportCSVHeaders = map[string][]string{
+	dataprovider.ReportTypeTransfers: {"Username", "Uploads", "Upload size", "Downloads", "Download size",
+		"Failures"},
+	dataprovider.ReportTypeQuotaUsage: {"Username", "Used quota size", "Quota size", "Used quota files",
+		"Quota files", "Used upload data transfer", "Used download data transfer", "Total data transfer"},
+	dataprovider.ReportTypeFailedLogins: {"Username", "Attempts", "IPs", "Last attempt"},
+}
+
+// reportFsEvent defines the filesystem event fields used to generate the reports
+type reportFsEvent struct {
+	ID        string `json:"id"`
+	Timestamp int64  `json:"timestamp"`
+	Action    string `json:"action"`
+	Username  string `json:"username"`
+	FileSize  int64  `json:"file_size,omitempty"`
+	Status    int    `json:"status"`
+	Role      string `json:"role,omitempty"`
+}
+
+// reportLogEvent defines the log event fields used to generate the reports
+type reportLogEvent struct {
+	ID        string `json:"id"`
+	Timestamp int64  `json:"timestamp"`
+	Username  string `json:"username,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	Role      string `json:"role,omitempty"`
+}
+
+// checkReportConditions returns true if the specified username and role match
+// the name and role conditions. Group conditions are only checked for the quota
+// usage report, the events don't include the user groups
+func checkReportConditions(username, role string, conditions *dataprovider.ConditionOptions) bool {
+	if !checkEventConditionPatterns(username, conditions.Names) {
+		return false
+	}
+	return checkEventConditionPatterns(role, conditions.RoleNames)
+}
+
+func getTransfersReport(start, end time.Time, conditions *dataprovider.ConditionOptions) ([]reportRow, error) {
+	filters := &eventsearcher.FsEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			StartTimestamp: start.UnixNano(),
+			EndTimestamp:   end.UnixNano(),
+			Limit:          reportSearchLimit,
+			Order:          1,
+		},
+		Actions:    []string{operationUpload, operationDownload},
+		FsProvider: -1,
+	}
+	results := make(map[string]*transfersReportRow)
+	for {
+		data, err := plugin.Handler.SearchFsEvents(filters)
+		if err != nil {
+			return nil, fmt.Errorf("unable to search filesystem events: %w", err)
+		}
+		var events []reportFsEvent
+		if err := json.Unmarshal(data, &events); err != nil {
+			return nil, fmt.Errorf("unable to decode filesystem events: %w", err)
+		}
+		for _, ev := range events {
+			if !checkReportConditions(ev.Username, ev.Role, conditions) {
+				continue
+			}
+			row, ok := results[ev.Username]
+			if !ok {
+				row = &transfersReportRow{Username: ev.Username}
+				results[ev.Username] = row
+			}
+			if ev.Status != 1 {
+				row.Failures++
+				continue
+			}
+			if ev.Action == operationUpload {
+				row.Uploads++
+				row.UploadSize += ev.FileSize
+			} else {
+				row.Downloads++
+				row.DownloadSize += ev.FileSize
+			}
+		}
+		if len(events) < filters.Limit {
+			break
+		}
+		filters.StartTimestamp = events[len(events)-1].Timestamp
+		filters.FromID = events[len(events)-1].ID
+	}
+	rows := make([]reportRow, 0, len(results))
+	for _, username := range getSortedReportKeys(results) {
+		rows = append(rows, results[username])
+	}
+	return rows, nil
+}
+
+func getFailedLoginsReport(start, end time.Time, conditions *dataprovider.ConditionOptions) ([]reportRow, error) {
+	filters := &eventsearcher.LogEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			StartTimestamp: start.UnixNano(),
+			EndTimestamp:   end.UnixNano(),
+			Limit:          reportSearchLimit,
+			Order:          1,
+		},
+		Events: []int32{int32(notifier.LogEventTypeLoginFailed), int32(notifier.LogEventTypeLoginNoUser)},
+	}
+	results := make(map[string]*failedLoginsReportRow)
+	for {
+		data, err := plugin.Handler.SearchLogEvents(filters)
+		if err != nil {
+			return nil, fmt.Errorf("unable to search log events: %w", err)
+		}
+		var events []reportLogEvent
+		if err := json.Unmarshal(data, &events); err != nil {
+			return nil, fmt.Errorf("unable to decode log events: %w", err)
+		}
+		for _, ev := range events {
+			if !checkReportConditions(ev.Username, ev.Role, conditions) {
+				continue
+			}
+			row, ok := results[ev.Username]
+			if !ok {
+				row = &failedLoginsReportRow{Username: ev.Username}
+				results[ev.Username] = row
+			}
+			row.Attempts++
+			if ev.IP != "" && !util.Contains(row.IPs, ev.IP) {
+				row.IPs = append(row.IPs, ev.IP)
+			}
+			lastAttempt := util.GetTimeAsMsSinceEpoch(time.Unix(0, ev.Timestamp))
+			if lastAttempt > row.LastAttempt {
+				row.LastAttempt = lastAttempt
+			}
+		}
+		if len(events) < filters.Limit {
+			break
+		}
+		filters.StartTimestamp = events[len(events)-1].Timestamp
+		filters.FromID = events[len(events)-1].ID
+	}
+	rows := make([]reportRow, 0, len(results))
+	for _, username := range getSortedReportKeys(results) {
+		row := results[username]
+		if row.IPs == nil {
+			row.IPs = []string{}
+		}
+		sort.Strings(row.IPs)
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func getQuotaUsageReport(conditions *dataprovider.ConditionOptions) ([]reportRow, error) {
+	dump, err := dataprovider.DumpData([]string{dataprovider.DumpScopeUsers})
+	if err != nil {
+		eventManagerLog(logger.LevelError, "unable to get users: %+v", err)
+		return nil, errors.New("unable to get users")
+	}
+	rows := make([]reportRow, 0, len(dump.Users))
+	for _, user := range dump.Users {
+		if !checkUserConditionOptions(&user, conditions) {
+			continue
+		}
+		if err := user.LoadAndApplyGroupSettings(); err != nil {
+			eventManagerLog(logger.LevelError, "unable to get group for user %q: %+v", user.Username, err)
+			return nil, fmt.Errorf("unable to get groups for user %q", user.Username)
+		}
+		rows = append(rows, &quotaUsageReportRow{
+			Username:                 user.Username,
+			UsedQuotaSize:            user.UsedQuotaSize,
+			QuotaSize:                user.QuotaSize,
+			UsedQuotaFiles:           user.UsedQuotaFiles,
+			QuotaFiles:               user.QuotaFiles,
+			UsedUploadDataTransfer:   user.UsedUploadDataTransfer,
+			UsedDownloadDataTransfer: user.UsedDownloadDataTransfer,
+			TotalDataTransfer:        user.TotalDataTransfer * 1048576,
+		})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].(*quotaUsageReportRow).Username < rows[j].(*quotaUsageReportRow).Username
+	})
+	return rows, nil
+}
+
+func getSortedReportKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func serializeReport(reportType, format string, rows []reportRow) ([]byte, error) {
+	if format == dataprovider.ReportFormatJSON {
+		return json.Marshal(rows)
+	}
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	if err := w.Write(reportCSVHeaders[reportType]); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		if err := w.Write(row.getCSVData()); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func generateReport(reportType, format string, start, end time.Time,
+	conditions *dataprovider.ConditionOptions,
+) (reportFile, error) {
+	var rows []reportRow
+	var err error
+
+	switch reportType {
+	case dataprovider.ReportTypeTransfers:
+		rows, err = getTransfersReport(start, end, conditions)
+	case dataprovider.ReportTypeFailedLogins:
+		rows, err = getFailedLoginsReport(start, end, conditions)
+	case dataprovider.ReportTypeQuotaUsage:
+		rows, err = getQuotaUsageReport(conditions)
+	default:
+		err = fmt.Errorf("unsupported report type %q", reportType)
+	}
+	if err != nil {
+		return reportFile{}, err
+	}
+	data, err := serializeReport(reportType, format, rows)
+	if err != nil {
+		return reportFile{}, fmt.Errorf("unable to serialize the report: %w", err)
+	}
+	return reportFile{
+		name: fmt.Sprintf("%s-%s.%s", reportType, end.UTC().Format(reportTimeFormat), format),
+		data: data,
+	}, nil
+}
+
+func sendReportsByEmail(c *dataprovider.EventActionReportConfig, files []reportFile, start, end time.Time,
+	params *EventParams,
+) error {
+	var totalSize int64
+	attachments := make([]*mail.File, 0, len(files))
+	for idx := range files {
+		totalSize += int64(len(files[idx].data))
+		attachments = append(attachments, files[idx].getAsMailAttachment())
+	}
+	if totalSize > maxAttachmentsSize {
+		return fmt.Errorf("unable to send the reports via email, size too large: %s", util.ByteCountIEC(totalSize))
+	}
+	subject := fmt.Sprintf("Reports %s", end.UTC().Format(time.RFC3339))
+	var body strings.Builder
+	fmt.Fprintf(&body, "Reports: %s\n", strings.Join(c.Reports, ", "))
+	if c.HasPeriodReports() {
+		fmt.Fprintf(&body, "Period: %s - %s\n", start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339))
+	}
+	startTime := time.Now()
+	err := smtp.SendEmailForRole(params.Role, c.Recipients, nil, subject, body.String(),
+		smtp.EmailContentTypeTextPlain, attachments...)
+	eventManagerLog(logger.LevelDebug, "reports sent via email, elapsed: %s, error: %v", time.Since(startTime), err)
+	if err != nil {
+		return fmt.Errorf("unable to send the reports via email: %w", err)
+	}
+	return nil
+}
+
+func writeReportToFs(fs vfs.Fs, fsPath string, data []byte) error {
+	f, w, cancelFn, err := fs.Create(fsPath, 0, 0)
+	if err != nil {
+		return err
+	}
+	var writer io.WriteCloser = w
+	if f != nil {
+		writer = f
+	}
+	_, err = writer.Write(data)
+	if err != nil && cancelFn != nil {
+		cancelFn()
+	}
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func uploadReportsToFolder(c *dataprovider.EventActionReportConfig, files []reportFile, params *EventParams) error {
+	folder, err := dataprovider.GetFolderByName(c.Folder)
+	if err != nil {
+		return fmt.Errorf("unable to get the reports folder %q: %w", c.Folder, err)
+	}
+	vFolder := vfs.VirtualFolder{
+		BaseVirtualFolder: folder,
+		VirtualPath:       "/",
+	}
+	connectionID := fmt.Sprintf("%s_%s", protocolEventAction, xid.New().String())
+	fs, err := vFolder.GetFilesystem(connectionID, nil)
+	if err != nil {
+		return fmt.Errorf("unable to get the filesystem for the reports folder %q: %w", c.Folder, err)
+	}
+	defer fs.Close()
+
+	replacer := strings.NewReplacer(params.getStringReplacements(false, false)...)
+	dirPath := util.CleanPath(replaceWithReplacer(c.Path, replacer))
+	if !vfs.HasImplicitAtomicUploads(fs) {
+		fs.CheckRootPath(connectionID, -1, -1)
+		if err := mkdirAllFs(fs, dirPath); err != nil {
+			return err
+		}
+	}
+	for idx := range files {
+		virtualPath := path.Join(dirPath, files[idx].name)
+		fsPath, err := fs.ResolvePath(virtualPath)
+		if err != nil {
+			return fmt.Errorf("unable to resolve report path %q: %w", virtualPath, err)
+		}
+		if err := writeReportToFs(fs, fsPath, files[idx].data); err != nil {
+			return fmt.Errorf("unable to upload report %q to folder %q: %w", virtualPath, c.Folder, err)
+		}
+		eventManagerLog(logger.LevelDebug, "report %q uploaded to folder %q", virtualPath, c.Folder)
+	}
+	return nil
+}
+
+func executeReportRuleAction(c dataprovider.EventActionReportConfig, conditions dataprovider.ConditionOptions,
+	params *EventParams,
+) error {
+	end := time.Now()
+	start := end.Add(-time.Duration(c.Period) * time.Hour)
+	files := make([]reportFile, 0, len(c.Reports))
+	for _, reportType := range c.Reports {
+		f, err := generateReport(reportType, c.Format, start, end, &conditions)
+		if err != nil {
+			return fmt.Errorf("unable to generate the %q report: %w", reportType, err)
+		}
+		files = append(files, f)
+	}
+	// the reports are delivered to all the configured targets even if one fails
+	var failures []string
+	if c.Folder != "" {
+		if err := uploadReportsToFolder(&c, files, params); err != nil {
+			params.AddError(err)
+			failures = append(failures, "folder")
+		}
+	}
+	if len(c.Recipients) > 0 {
+		if err := sendReportsByEmail(&c, files, start, end, params); err != nil {
+			params.AddError(err)
+			failures = append(failures, "email")
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("unable to deliver the reports, failed targets: %s", strings.Join(failures, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/plugin"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+func TestReportActionValidation(t *testing.T) {
+	action := dataprovider.BaseEventAction{
+		Name: "report action",
+		Type: dataprovider.ActionTypeReport,
+	}
+	err := dataprovider.AddEventAction(&action, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	action.Options.ReportConfig.Reports = []string{"unknown"}
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	action.Options.ReportConfig.Reports = []string{dataprovider.ReportTypeTransfers}
+	action.Options.ReportConfig.Format = "xml"
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	action.Options.ReportConfig.Format = ""
+	// the period is required for the transfers report
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	action.Options.ReportConfig.Period = 10000
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	action.Options.ReportConfig.Period = 24
+	// no delivery target
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	action.Options.ReportConfig.Recipients = []string{" "}
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	action.Options.ReportConfig.Recipients = nil
+	action.Options.ReportConfig.Folder = " reports "
+	action.Options.ReportConfig.Path = "sub/{{Date}}"
+	action.Options.ReportConfig.Reports = []string{dataprovider.ReportTypeQuotaUsage, dataprovider.ReportTypeQuotaUsage}
+	action.Options.WorkflowConfig.Steps = []dataprovider.WorkflowStep{
+		{
+			Name:   "s1",
+			Action: "a1",
+		},
+	}
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	require.NoError(t, err)
+	action, err = dataprovider.EventActionExists(action.Name)
+	require.NoError(t, err)
+	assert.Len(t, action.Options.WorkflowConfig.Steps, 0)
+	assert.Equal(t, []string{dataprovider.ReportTypeQuotaUsage}, action.Options.ReportConfig.Reports)
+	assert.Equal(t, dataprovider.ReportFormatCSV, action.Options.ReportConfig.Format)
+	// the period is not used for the quota usage report
+	assert.Equal(t, 0, action.Options.ReportConfig.Period)
+	assert.Equal(t, "reports", action.Options.ReportConfig.Folder)
+	assert.Equal(t, "/sub/{{Date}}", action.Options.ReportConfig.Path)
+	err = dataprovider.DeleteEventAction(action.Name, "", "", "")
+	assert.NoError(t, err)
+}
+
+func TestReportSerialization(t *testing.T) {
+	rows := []reportRow{
+		&failedLoginsReportRow{
+			Username:    "user1",
+			Attempts:    2,
+			IPs:         []string{"127.0.0.1", "::1"},
+			LastAttempt: util.GetTimeAsMsSinceEpoch(time.Date(2023, 5, 6, 7, 8, 9, 0, time.UTC)),
+		},
+	}
+	data, err := serializeReport(dataprovider.ReportTypeFailedLogins, dataprovider.ReportFormatCSV, rows)
+	require.NoError(t, err)
+	assert.Equal(t, "Username,Attempts,IPs,Last attempt\nuser1,2,127.0.0.1 ::1,2023-05-06T07:08:09Z\n", string(data))
+	data, err = serializeReport(dataprovider.ReportTypeFailedLogins, dataprovider.ReportFormatJSON, rows)
+	require.NoError(t, err)
+	var results []failedLoginsReportRow
+	err = json.Unmarshal(data, &results)
+	require.NoError(t, err)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, "user1", results[0].Username)
+		assert.Len(t, results[0].IPs, 2)
+	}
+	data, err = serializeReport(dataprovider.ReportTypeTransfers, dataprovider.ReportFormatJSON, []reportRow{})
+	require.NoError(t, err)
+	assert.Equal(t, "[]", string(data))
+	// no events searcher is configured
+	_, err = generateReport(dataprovider.ReportTypeTransfers, dataprovider.ReportFormatCSV, time.Now(),
+		time.Now(), &dataprovider.ConditionOptions{})
+	assert.ErrorIs(t, err, plugin.ErrNoSearcher)
+	_, err = generateReport(dataprovider.ReportTypeFailedLogins, dataprovider.ReportFormatCSV, time.Now(),
+		time.Now(), &dataprovider.ConditionOptions{})
+	assert.ErrorIs(t, err, plugin.ErrNoSearcher)
+	_, err = generateReport("unknown", dataprovider.ReportFormatCSV, time.Now(), time.Now(),
+		&dataprovider.ConditionOptions{})
+	assert.Error(t, err)
+}
+
+func TestReportAction(t *testing.T) {
+	baseDir := filepath.Join(os.TempDir(), "reports_test")
+	defer os.RemoveAll(baseDir)
+
+	folder := vfs.BaseVirtualFolder{
+		Name:       "reports_folder",
+		MappedPath: filepath.Join(baseDir, "reports"),
+	}
+	err := dataprovider.AddFolder(&folder, "", "", "")
+	require.NoError(t, err)
+
+	users := []dataprovider.User{
+		{
+			BaseUser: sdk.BaseUser{
+				Username:  "report_user1",
+				HomeDir:   filepath.Join(baseDir, "user1"),
+				Status:    1,
+				QuotaSize: 1048576,
+				Permissions: map[string][]string{
+					"/": {dataprovider.PermAny},
+				},
+			},
+		},
+		{
+			BaseUser: sdk.BaseUser{
+				Username:          "report_user2",
+				HomeDir:           filepath.Join(baseDir, "user2"),
+				Status:            1,
+				QuotaFiles:        100,
+				TotalDataTransfer: 2,
+				Permissions: map[string][]string{
+					"/": {dataprovider.PermAny},
+				},
+			},
+		},
+	}
+	for idx := range users {
+		err = dataprovider.AddUser(&users[idx], "", "", "")
+		require.NoError(t, err)
+	}
+	err = dataprovider.UpdateUserQuota(&users[0], 3, 1024, true)
+	require.NoError(t, err)
+
+	c := dataprovider.EventActionReportConfig{
+		Reports: []string{dataprovider.ReportTypeQuotaUsage},
+		Format:  dataprovider.ReportFormatJSON,
+		Folder:  folder.Name,
+		Path:    "/reports/{{Date}}",
+	}
+	conditions := dataprovider.ConditionOptions{
+		Names: []dataprovider.ConditionPattern{
+			{
+				Pattern: "report_user*",
+			},
+		},
+	}
+	params := &EventParams{}
+	err = executeReportRuleAction(c, conditions, params)
+	require.NoError(t, err)
+	reportsDir := filepath.Join(folder.MappedPath, "reports", params.getDate())
+	entries, err := os.ReadDir(reportsDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.True(t, strings.HasPrefix(entries[0].Name(), dataprovider.ReportTypeQuotaUsage+"-"))
+	assert.True(t, strings.HasSuffix(entries[0].Name(), ".json"))
+	data, err := os.ReadFile(filepath.Join(reportsDir, entries[0].Name()))
+	require.NoError(t, err)
+	var rows []quotaUsageReportRow
+	err = json.Unmarshal(data, &rows)
+	require.NoError(t, err)
+	if assert.Len(t, rows, 2) {
+		assert.Equal(t, "report_user1", rows[0].Username)
+		assert.Equal(t, int64(1024), rows[0].UsedQuotaSize)
+		assert.Equal(t, 3, rows[0].UsedQuotaFiles)
+		assert.Equal(t, int64(1048576), rows[0].QuotaSize)
+		assert.Equal(t, "report_user2", rows[1].Username)
+		assert.Equal(t, 100, rows[1].QuotaFiles)
+		assert.Equal(t, int64(2*1048576), rows[1].TotalDataTransfer)
+	}
+	// the email delivery fails, SMTP is not configured, the reports are
+	// uploaded to the folder anyway
+	require.NoError(t, os.RemoveAll(folder.MappedPath))
+	c.Recipients = []string{"example@example.com"}
+	c.Format = dataprovider.ReportFormatCSV
+	conditions.Names[0].Pattern = "report_user2"
+	params = &EventParams{}
+	err = executeReportRuleAction(c, conditions, params)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed targets: email")
+	}
+	assert.Len(t, params.errors, 1)
+	entries, err = os.ReadDir(reportsDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	data, err = os.ReadFile(filepath.Join(reportsDir, entries[0].Name()))
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.True(t, strings.HasPrefix(lines[1], "report_user2,"))
+	}
+	// missing folder
+	c.Recipients = nil
+	c.Folder = "missing folder"
+	err = executeReportRuleAction(c, conditions, &EventParams{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed targets: folder")
+	}
+	// the transfers report requires an events searcher
+	c.Reports = []string{dataprovider.ReportTypeTransfers}
+	c.Period = 1
+	err = executeReportRuleAction(c, conditions, &EventParams{})
+	assert.ErrorIs(t, err, plugin.ErrNoSearcher)
+
+	for _, user := range users {
+		err = dataprovider.DeleteUser(user.Username, "", "", "")
+		assert.NoError(t, err)
+	}
+	err = dataprovider.DeleteFolder(folder.Name, "", "", "")
+	assert.NoError(t, err)
+}
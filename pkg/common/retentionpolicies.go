@@ -0,0 +1,435 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wneessen/go-mail"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/httpclient"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/smtp"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	retentionPoliciesLogSender  = "retention_policies"
+	retentionReportPrefix       = "retention_report_"
+	retentionReportExpiration   = 30 * 24 * time.Hour
+	retentionReportsCleanupFreq = time.Hour
+)
+
+var (
+	// ErrRetentionPolicyRunning is returned if a retention policy is started
+	// while a previous run is still in progress
+	ErrRetentionPolicyRunning = errors.New("the retention policy is already running")
+	retentionPolicies         = &retentionPoliciesScheduler{
+		running: make(map[string]bool),
+	}
+)
+
+// RetentionPolicyUserReport defines the results of a retention policy for a user
+type RetentionPolicyUserReport struct {
+	Username string `json:"username"`
+	// Deleted files and size, for dry runs the files that would be deleted
+	DeletedFiles int                          `json:"deleted_files"`
+	DeletedSize  int64                        `json:"deleted_size"`
+	Results      []folderRetentionCheckResult `json:"results,omitempty"`
+	Error        string                       `json:"error,omitempty"`
+}
+
+// RetentionPolicyReport defines the report for a retention policy run
+type RetentionPolicyReport struct {
+	Policy string `json:"policy"`
+	DryRun bool   `json:"dry_run,omitempty"`
+	// 1 if the check succeeded for all the users, 0 otherwise
+	Status int `json:"status"`
+	// Start and end time as unix timestamp in milliseconds
+	StartTime    int64                       `json:"start_time"`
+	EndTime      int64                       `json:"end_time"`
+	DeletedFiles int                         `json:"deleted_files"`
+	DeletedSize  int64                       `json:"deleted_size"`
+	Users        []RetentionPolicyUserReport `json:"users"`
+	// Node that executed the policy, if any
+	Node string `json:"node,omitempty"`
+}
+
+func (r *RetentionPolicyReport) getSummary() string {
+	var sb strings.Builder
+	action := "Deleted"
+	if r.DryRun {
+		action = "Files to delete"
+	}
+	sb.WriteString(fmt.Sprintf("Retention policy %q, started at %s, elapsed %d ms, dry run: %t\n\n", r.Policy,
+		util.GetTimeFromMsecSinceEpoch(r.StartTime).UTC().Format(time.RFC3339), r.EndTime-r.StartTime, r.DryRun))
+	sb.WriteString(fmt.Sprintf("%s: %d, size: %s\n\n", action, r.DeletedFiles, util.ByteCountIEC(r.DeletedSize)))
+	for _, user := range r.Users {
+		if user.Error != "" {
+			sb.WriteString(fmt.Sprintf("User %q: %s\n", user.Username, user.Error))
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("User %q: %d files, size: %s\n", user.Username, user.DeletedFiles,
+			util.ByteCountIEC(user.DeletedSize)))
+	}
+	return sb.String()
+}
+
+type retentionPoliciesScheduler struct {
+	sync.Mutex
+	lastCheck   time.Time
+	lastCleanup time.Time
+	running     map[string]bool
+}
+
+func (s *retentionPoliciesScheduler) init() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.lastCheck = time.Now()
+}
+
+// setRunning marks the policy as running, it returns false if it is
+// already running
+func (s *retentionPoliciesScheduler) setRunning(name string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.running[name] {
+		return false
+	}
+	s.running[name] = true
+	return true
+}
+
+func (s *retentionPoliciesScheduler) setDone(name string) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.running, name)
+}
+
+// check starts the policies scheduled since the previous check
+func (s *retentionPoliciesScheduler) check() {
+	now := time.Now()
+	s.Lock()
+	from := s.lastCheck
+	s.lastCheck = now
+	cleanup := now.Sub(s.lastCleanup) > retentionReportsCleanupFreq
+	if cleanup {
+		s.lastCleanup = now
+	}
+	s.Unlock()
+
+	if cleanup {
+		dataprovider.CleanupSharedSessions(dataprovider.SessionTypeRetentionReport, now) //nolint:errcheck
+	}
+	configs, err := dataprovider.GetConfigs()
+	if err != nil {
+		logger.Warn(retentionPoliciesLogSender, "", "unable to load the retention policies: %v", err)
+		return
+	}
+	for idx := range configs.RetentionPolicies {
+		policy := configs.RetentionPolicies[idx]
+		scheduled, ok := policy.GetDueRun(from, now)
+		if !ok {
+			continue
+		}
+		if !s.claimRun(&policy, scheduled) {
+			continue
+		}
+		if !s.setRunning(policy.Name) {
+			logger.Info(retentionPoliciesLogSender, "", "retention policy %q still running, scheduled run skipped",
+				policy.Name)
+			continue
+		}
+		go s.run(policy)
+	}
+}
+
+// claimRun returns false if another node already started the policy for the
+// specified scheduled time
+func (s *retentionPoliciesScheduler) claimRun(policy *dataprovider.RetentionPolicy, scheduled time.Time) bool {
+	if !policy.GuardFromConcurrentExecution() {
+		return true
+	}
+	return claimScheduledTask(retentionPoliciesLogSender, policy.GetTaskName(), scheduled)
+}
+
+// claimScheduledTask returns true if this node must execute the task scheduled
+// at the specified time. The task is used to guard against concurrent executions
+// from multiple nodes sharing the same data provider
+func claimScheduledTask(sender, name string, scheduled time.Time) bool {
+	task, err := dataprovider.GetTaskByName(name)
+	if err != nil {
+		if errors.Is(err, util.ErrNotFound) {
+			// the node that adds the task runs it
+			if err := dataprovider.AddTask(name); err != nil {
+				logger.Debug(sender, "", "unable to add task %q: %v", name, err)
+				return false
+			}
+			return true
+		}
+		logger.Warn(sender, "", "unable to get task %q: %v", name, err)
+		return false
+	}
+	if task.UpdateAt >= util.GetTimeAsMsSinceEpoch(scheduled) {
+		logger.Debug(sender, "", "task %q already started by another node", name)
+		return false
+	}
+	if err := dataprovider.UpdateTask(name, task.Version); err != nil {
+		logger.Debug(sender, "", "unable to update task %q, skip execution: %v", name, err)
+		return false
+	}
+	return true
+}
+
+func (s *retentionPoliciesScheduler) run(policy dataprovider.RetentionPolicy) RetentionPolicyReport {
+	defer s.setDone(policy.Name)
+
+	logger.Info(retentionPoliciesLogSender, "", "retention policy %q started, dry run: %t", policy.Name, policy.DryRun)
+	report := RetentionPolicyReport{
+		Policy:    policy.Name,
+		DryRun:    policy.DryRun,
+		Status:    1,
+		StartTime: util.GetTimeAsMsSinceEpoch(time.Now()),
+		Users:     []RetentionPolicyUserReport{},
+		Node:      dataprovider.GetNodeName(),
+	}
+	for _, username := range getRetentionPolicyUsers(&policy) {
+		userReport := runRetentionPolicyForUser(&policy, username)
+		if userReport.Error != "" {
+			report.Status = 0
+		}
+		report.DeletedFiles += userReport.DeletedFiles
+		report.DeletedSize += userReport.DeletedSize
+		report.Users = append(report.Users, userReport)
+	}
+	report.EndTime = util.GetTimeAsMsSinceEpoch(time.Now())
+	logger.Info(retentionPoliciesLogSender, "", "retention policy %q completed, users: %d, files: %d, size: %d, status: %d",
+		policy.Name, len(report.Users), report.DeletedFiles, report.DeletedSize, report.Status)
+
+	err := dataprovider.AddSharedSession(dataprovider.Session{
+		Key:       retentionReportPrefix + policy.Name,
+		Data:      report,
+		Type:      dataprovider.SessionTypeRetentionReport,
+		Timestamp: util.GetTimeAsMsSinceEpoch(time.Now().Add(retentionReportExpiration)),
+	})
+	if err != nil {
+		logger.Warn(retentionPoliciesLogSender, "", "unable to save the report for retention policy %q: %v",
+			policy.Name, err)
+	}
+	sendRetentionPolicyNotifications(&policy, &report)
+	return report
+}
+
+// getRetentionPolicyUsers returns the users the policy applies to, members of
+// the groups included
+func getRetentionPolicyUsers(policy *dataprovider.RetentionPolicy) []string {
+	users := make(map[string]bool)
+	for _, username := range policy.Users {
+		users[username] = true
+	}
+	for _, name := range policy.Groups {
+		group, err := dataprovider.GroupExists(name)
+		if err != nil {
+			logger.Warn(retentionPoliciesLogSender, "", "unable to get group %q for retention policy %q: %v",
+				name, policy.Name, err)
+			continue
+		}
+		for _, username := range group.Users {
+			users[username] = true
+		}
+	}
+	result := make([]string, 0, len(users))
+	for username := range users {
+		result = append(result, username)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func runRetentionPolicyForUser(policy *dataprovider.RetentionPolicy, username string) RetentionPolicyUserReport {
+	report := RetentionPolicyUserReport{
+		Username: username,
+	}
+	user, err := dataprovider.GetUserWithGroupSettings(username, "")
+	if err != nil {
+		report.Error = fmt.Sprintf("unable to get user: %v", err)
+		return report
+	}
+	folders := make([]dataprovider.FolderRetention, len(policy.Folders))
+	copy(folders, policy.Folders)
+	check := RetentionCheck{
+		Folders: folders,
+		DryRun:  policy.DryRun,
+	}
+	c := RetentionChecks.Add(check, &user)
+	if c == nil {
+		report.Error = "another retention check is already in progress"
+		return report
+	}
+	err = c.Start()
+	report.Results = c.results
+	for _, result := range c.results {
+		report.DeletedFiles += result.DeletedFiles
+		report.DeletedSize += result.DeletedSize
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	return report
+}
+
+func sendRetentionPolicyNotifications(policy *dataprovider.RetentionPolicy, report *RetentionPolicyReport) {
+	if len(policy.Emails) > 0 {
+		sendRetentionPolicyEmail(policy, report) //nolint:errcheck
+	}
+	if policy.WebhookURL != "" {
+		sendRetentionPolicyWebhook(policy, report) //nolint:errcheck
+	}
+}
+
+func sendRetentionPolicyEmail(policy *dataprovider.RetentionPolicy, report *RetentionPolicyReport) error {
+	if !smtp.IsEnabled() {
+		logger.Warn(retentionPoliciesLogSender, "", "unable to notify retention policy %q result via email: SMTP is not configured",
+			policy.Name)
+		return errors.New("smtp not configured")
+	}
+	params := EventParams{}
+	for _, user := range report.Users {
+		if len(user.Results) > 0 {
+			params.retentionChecks = append(params.retentionChecks, executedRetentionCheck{
+				Username:   user.Username,
+				ActionName: policy.Name,
+				Results:    user.Results,
+			})
+		}
+	}
+	var files []*mail.File
+	if len(params.retentionChecks) > 0 {
+		f, err := params.getRetentionReportsAsMailAttachment()
+		if err != nil {
+			logger.Error(retentionPoliciesLogSender, "", "unable to get retention report as mail attachment: %v", err)
+			return err
+		}
+		f.Name = "retention-report.zip"
+		files = append(files, f)
+	}
+	subject := fmt.Sprintf("Retention policy %q completed", policy.Name)
+	if report.Status != 1 {
+		subject = fmt.Sprintf("Retention policy %q completed with errors", policy.Name)
+	}
+	if report.DryRun {
+		subject = "[Dry run] " + subject
+	}
+	startTime := time.Now()
+	err := smtp.SendEmail(policy.Emails, nil, subject, report.getSummary(), smtp.EmailContentTypeTextPlain, files...)
+	if err != nil {
+		logger.Error(retentionPoliciesLogSender, "", "unable to notify retention policy %q result via email: %v, elapsed: %s",
+			policy.Name, err, time.Since(startTime))
+		return err
+	}
+	logger.Info(retentionPoliciesLogSender, "", "retention policy %q result notified via email, elapsed: %s",
+		policy.Name, time.Since(startTime))
+	return nil
+}
+
+func sendRetentionPolicyWebhook(policy *dataprovider.RetentionPolicy, report *RetentionPolicyReport) error {
+	startNewHook()
+	defer hookEnded()
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	startTime := time.Now()
+	respCode := 0
+	resp, err := httpclient.RetryablePost(policy.WebhookURL, "application/json", bytes.NewBuffer(data))
+	if err == nil {
+		respCode = resp.StatusCode
+		resp.Body.Close()
+
+		if respCode != http.StatusOK {
+			err = errUnexpectedHTTResponse
+		}
+	}
+	logger.Debug(retentionPoliciesLogSender, "", "retention policy %q result notified to webhook, status code: %d, elapsed: %s, err: %v",
+		policy.Name, respCode, time.Since(startTime), err)
+	return err
+}
+
+// RunRetentionPolicy starts the retention policy with the specified name now,
+// even if disabled
+func RunRetentionPolicy(name string) error {
+	configs, err := dataprovider.GetConfigs()
+	if err != nil {
+		return err
+	}
+	for idx := range configs.RetentionPolicies {
+		if configs.RetentionPolicies[idx].Name == name {
+			if !retentionPolicies.setRunning(name) {
+				return ErrRetentionPolicyRunning
+			}
+			go retentionPolicies.run(configs.RetentionPolicies[idx])
+			return nil
+		}
+	}
+	return util.NewRecordNotFoundError(fmt.Sprintf("retention policy %q does not exist", name))
+}
+
+// IsRetentionPolicyRunning returns true if the policy with the specified name
+// is running on this node
+func IsRetentionPolicyRunning(name string) bool {
+	retentionPolicies.Lock()
+	defer retentionPolicies.Unlock()
+
+	return retentionPolicies.running[name]
+}
+
+// GetRetentionPolicyReport returns the report for the last run of the
+// specified retention policy
+func GetRetentionPolicyReport(name string) (RetentionPolicyReport, error) {
+	var report RetentionPolicyReport
+
+	session, err := dataprovider.GetSharedSession(retentionReportPrefix + name)
+	if err != nil || session.Type != dataprovider.SessionTypeRetentionReport {
+		return report, util.NewRecordNotFoundError(fmt.Sprintf("no report for retention policy %q", name))
+	}
+	data, ok := session.Data.([]byte)
+	if !ok {
+		return report, fmt.Errorf("invalid retention report data type %T", session.Data)
+	}
+	err = json.Unmarshal(data, &report)
+	return report, err
+}
+
+// DeleteRetentionPolicyReport removes the report for the specified retention policy
+func DeleteRetentionPolicyReport(name string) error {
+	err := dataprovider.DeleteSharedSession(retentionReportPrefix + name)
+	if errors.Is(err, util.ErrNotFound) {
+		return nil
+	}
+	return err
+}
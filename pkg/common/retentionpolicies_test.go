@@ -0,0 +1,254 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+func TestRetentionPolicySchedule(t *testing.T) {
+	policy := dataprovider.RetentionPolicy{
+		Name:     "policy",
+		Status:   1,
+		Schedule: "0 * * * *",
+	}
+	from := time.Date(2023, 5, 10, 10, 59, 30, 0, time.UTC)
+	scheduled, ok := policy.GetDueRun(from, from.Add(time.Minute))
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2023, 5, 10, 11, 0, 0, 0, time.UTC), scheduled)
+	_, ok = policy.GetDueRun(from.Add(time.Minute), from.Add(2*time.Minute))
+	assert.False(t, ok)
+	policy.Status = 0
+	_, ok = policy.GetDueRun(from, from.Add(time.Minute))
+	assert.False(t, ok)
+	policy.Status = 1
+	policy.Schedule = "invalid"
+	_, ok = policy.GetDueRun(from, from.Add(time.Minute))
+	assert.False(t, ok)
+	// the providers used in test cases are not shared
+	assert.False(t, policy.GuardFromConcurrentExecution())
+	assert.True(t, retentionPolicies.claimRun(&policy, from))
+}
+
+func TestRetentionPoliciesValidation(t *testing.T) {
+	configs, err := dataprovider.GetConfigs()
+	require.NoError(t, err)
+	defer func() {
+		err := dataprovider.UpdateConfigs(&configs, "", "", "")
+		assert.NoError(t, err)
+	}()
+
+	policy := dataprovider.RetentionPolicy{
+		Name:     "policy",
+		Status:   1,
+		Schedule: "0 2 * * *",
+		Users:    []string{"user1"},
+		Folders: []dataprovider.FolderRetention{
+			{
+				Path:      "/logs",
+				Retention: 24,
+			},
+		},
+	}
+	check := func(update func(p *dataprovider.RetentionPolicy), errContains string) {
+		p := policy
+		p.Folders = append([]dataprovider.FolderRetention{}, policy.Folders...)
+		update(&p)
+		c := configs
+		c.RetentionPolicies = []dataprovider.RetentionPolicy{p}
+		err := dataprovider.UpdateConfigs(&c, "", "", "")
+		if errContains == "" {
+			assert.NoError(t, err)
+			return
+		}
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), errContains)
+		}
+	}
+	check(func(p *dataprovider.RetentionPolicy) {}, "")
+	check(func(p *dataprovider.RetentionPolicy) { p.Name = "" }, "a name is required")
+	check(func(p *dataprovider.RetentionPolicy) { p.Status = 2 }, "invalid status")
+	check(func(p *dataprovider.RetentionPolicy) { p.Schedule = "* *" }, "invalid schedule")
+	check(func(p *dataprovider.RetentionPolicy) { p.Users = nil }, "at least a user or a group")
+	check(func(p *dataprovider.RetentionPolicy) { p.Folders[0].Retention = 0 }, "nothing to delete")
+	check(func(p *dataprovider.RetentionPolicy) { p.Emails = []string{"invalid"} }, "invalid email")
+	check(func(p *dataprovider.RetentionPolicy) { p.WebhookURL = "ftp://host" }, "invalid webhook URL")
+
+	c := configs
+	c.RetentionPolicies = []dataprovider.RetentionPolicy{policy, policy}
+	err = dataprovider.UpdateConfigs(&c, "", "", "")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "duplicated retention policy")
+	}
+}
+
+func TestRetentionPolicyRun(t *testing.T) {
+	configs, err := dataprovider.GetConfigs()
+	require.NoError(t, err)
+
+	homeDir := filepath.Join(os.TempDir(), "retention_policy_home")
+	oldFile := filepath.Join(homeDir, "logs", "old.log")
+	newFile := filepath.Join(homeDir, "logs", "new.log")
+	err = os.MkdirAll(filepath.Dir(oldFile), os.ModePerm)
+	require.NoError(t, err)
+	err = os.WriteFile(oldFile, []byte("old data"), 0666)
+	require.NoError(t, err)
+	err = os.WriteFile(newFile, []byte("new data"), 0666)
+	require.NoError(t, err)
+	oldTime := time.Now().Add(-48 * time.Hour)
+	err = os.Chtimes(oldFile, oldTime, oldTime)
+	require.NoError(t, err)
+
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "retention_policy_user",
+			HomeDir:  homeDir,
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+	}
+	err = dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+
+	var webhookReport RetentionPolicyReport
+	webhookCalls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		webhookCalls++
+		err := json.NewDecoder(r.Body).Decode(&webhookReport)
+		assert.NoError(t, err)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	policy := dataprovider.RetentionPolicy{
+		Name:     "logs_policy",
+		Status:   1,
+		Schedule: "* * * * *",
+		Users:    []string{user.Username, "missing_user"},
+		Groups:   []string{"missing_group"},
+		Folders: []dataprovider.FolderRetention{
+			{
+				Path:      "/logs",
+				Retention: 24,
+			},
+		},
+		DryRun:     true,
+		WebhookURL: server.URL,
+	}
+	assert.Equal(t, []string{"missing_user", user.Username}, getRetentionPolicyUsers(&policy))
+	// dry run, nothing is deleted
+	require.True(t, retentionPolicies.setRunning(policy.Name))
+	report := retentionPolicies.run(policy)
+	assert.False(t, IsRetentionPolicyRunning(policy.Name))
+	assert.True(t, report.DryRun)
+	assert.Equal(t, 0, report.Status)
+	assert.Equal(t, 1, report.DeletedFiles)
+	assert.Equal(t, int64(8), report.DeletedSize)
+	if assert.Len(t, report.Users, 2) {
+		assert.NotEmpty(t, report.Users[0].Error)
+		assert.Empty(t, report.Users[1].Error)
+		if assert.Len(t, report.Users[1].Results, 1) {
+			assert.Equal(t, []string{"/logs/old.log"}, report.Users[1].Results[0].Files)
+		}
+	}
+	assert.FileExists(t, oldFile)
+	assert.Equal(t, 1, webhookCalls)
+	assert.Equal(t, policy.Name, webhookReport.Policy)
+	assert.Contains(t, report.getSummary(), "Files to delete: 1")
+
+	savedReport, err := GetRetentionPolicyReport(policy.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, report.StartTime, savedReport.StartTime)
+	assert.True(t, savedReport.DryRun)
+	// a retention check for the same user is already in progress
+	c := RetentionChecks.Add(RetentionCheck{Folders: policy.Folders}, &user)
+	require.NotNil(t, c)
+	report = retentionPolicies.run(policy)
+	if assert.Len(t, report.Users, 2) {
+		assert.Contains(t, report.Users[1].Error, "already in progress")
+	}
+	assert.True(t, RetentionChecks.remove(user.Username))
+
+	policy.DryRun = false
+	policy.Users = []string{user.Username}
+	policy.WebhookURL = ""
+	newConfigs := configs
+	newConfigs.RetentionPolicies = []dataprovider.RetentionPolicy{policy}
+	err = dataprovider.UpdateConfigs(&newConfigs, "", "", "")
+	require.NoError(t, err)
+
+	err = RunRetentionPolicy("missing")
+	assert.ErrorIs(t, err, util.ErrNotFound)
+	require.True(t, retentionPolicies.setRunning(policy.Name))
+	err = RunRetentionPolicy(policy.Name)
+	assert.ErrorIs(t, err, ErrRetentionPolicyRunning)
+	retentionPolicies.setDone(policy.Name)
+	// the policy is executed by the scheduler
+	retentionPolicies.Lock()
+	retentionPolicies.lastCheck = time.Now().Add(-2 * time.Minute)
+	retentionPolicies.Unlock()
+	retentionPolicies.check()
+	assert.Eventually(t, func() bool {
+		report, err := GetRetentionPolicyReport(policy.Name)
+		return err == nil && !report.DryRun && !IsRetentionPolicyRunning(policy.Name)
+	}, 2*time.Second, 50*time.Millisecond)
+	assert.NoFileExists(t, oldFile)
+	assert.FileExists(t, newFile)
+	report, err = GetRetentionPolicyReport(policy.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Status)
+	assert.Equal(t, 1, report.DeletedFiles)
+	if assert.Len(t, report.Users, 1) {
+		assert.Empty(t, report.Users[0].Results[0].Files)
+	}
+	// nothing to delete now
+	err = RunRetentionPolicy(policy.Name)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return !IsRetentionPolicyRunning(policy.Name)
+	}, 2*time.Second, 50*time.Millisecond)
+	report, err = GetRetentionPolicyReport(policy.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, report.DeletedFiles)
+
+	err = DeleteRetentionPolicyReport(policy.Name)
+	assert.NoError(t, err)
+	err = DeleteRetentionPolicyReport(policy.Name)
+	assert.NoError(t, err)
+	_, err = GetRetentionPolicyReport(policy.Name)
+	assert.ErrorIs(t, err, util.ErrNotFound)
+
+	err = dataprovider.UpdateConfigs(&configs, "", "", "")
+	assert.NoError(t, err)
+	err = dataprovider.DeleteUser(user.Username, "", "", "")
+	assert.NoError(t, err)
+	err = os.RemoveAll(homeDir)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,273 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/drakkan/sftpgo/v2/pkg/httpclient"
+)
+
+var elasticsearchMapping = map[string]any{
+	"mappings": map[string]any{
+		"properties": map[string]any{
+			"username":      map[string]any{"type": "keyword"},
+			"path":          map[string]any{"type": "keyword"},
+			"name":          map[string]any{"type": "keyword"},
+			"extension":     map[string]any{"type": "keyword"},
+			"size":          map[string]any{"type": "long"},
+			"last_modified": map[string]any{"type": "long"},
+			"is_dir":        map[string]any{"type": "boolean"},
+			"content":       map[string]any{"type": "text"},
+		},
+	},
+}
+
+type elasticsearchIndex struct {
+	config  ElasticsearchConfig
+	baseURL string
+}
+
+func newElasticsearchIndex(config ElasticsearchConfig) (*elasticsearchIndex, error) {
+	i := &elasticsearchIndex{
+		config:  config,
+		baseURL: fmt.Sprintf("%s/%s", strings.TrimSuffix(config.URL, "/"), url.PathEscape(config.Index)),
+	}
+	if err := i.createIndex(); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+func (i *elasticsearchIndex) createIndex() error {
+	resp, err := i.doRequest(http.MethodHead, i.baseURL, "", nil)
+	if err != nil {
+		return fmt.Errorf("unable to check elasticsearch index: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	body, err := json.Marshal(elasticsearchMapping)
+	if err != nil {
+		return err
+	}
+	return i.doJSONRequest(http.MethodPut, i.baseURL, "application/json", body, nil)
+}
+
+func (i *elasticsearchIndex) getDocumentID(doc *SearchDocument) string {
+	h := sha256.Sum256([]byte(doc.Username + "\x00" + doc.VirtualPath))
+	return hex.EncodeToString(h[:])
+}
+
+func (i *elasticsearchIndex) indexDocuments(docs []SearchDocument) error {
+	var buf bytes.Buffer
+
+	encoder := json.NewEncoder(&buf)
+	for idx := range docs {
+		action := map[string]any{
+			"index": map[string]string{
+				"_id": i.getDocumentID(&docs[idx]),
+			},
+		}
+		if err := encoder.Encode(action); err != nil {
+			return err
+		}
+		if err := encoder.Encode(&docs[idx]); err != nil {
+			return err
+		}
+	}
+	var result struct {
+		Errors bool `json:"errors"`
+	}
+	if err := i.doJSONRequest(http.MethodPost, i.baseURL+"/_bulk", "application/x-ndjson", buf.Bytes(), &result); err != nil {
+		return err
+	}
+	if result.Errors {
+		return fmt.Errorf("elasticsearch bulk indexing completed with errors")
+	}
+	return nil
+}
+
+func (i *elasticsearchIndex) deleteDocuments(username, virtualPath string) error {
+	filters := []any{
+		map[string]any{"term": map[string]any{"username": username}},
+	}
+	if virtualPath != "/" {
+		filters = append(filters, map[string]any{
+			"bool": map[string]any{
+				"should": []any{
+					map[string]any{"term": map[string]any{"path": virtualPath}},
+					map[string]any{"prefix": map[string]any{"path": virtualPath + "/"}},
+				},
+				"minimum_should_match": 1,
+			},
+		})
+	}
+	body, err := json.Marshal(map[string]any{
+		"query": map[string]any{
+			"bool": map[string]any{
+				"filter": filters,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return i.doJSONRequest(http.MethodPost, i.baseURL+"/_delete_by_query?refresh=true&conflicts=proceed",
+		"application/json", body, nil)
+}
+
+func (i *elasticsearchIndex) getSearchFilters(username string, query *SearchQuery) []any {
+	filters := []any{
+		map[string]any{"term": map[string]any{"username": username}},
+	}
+	switch query.Type {
+	case SearchTypeFiles:
+		filters = append(filters, map[string]any{"term": map[string]any{"is_dir": false}})
+	case SearchTypeDirs:
+		filters = append(filters, map[string]any{"term": map[string]any{"is_dir": true}})
+	}
+	if query.Path != "" && query.Path != "/" {
+		filters = append(filters, map[string]any{
+			"bool": map[string]any{
+				"should": []any{
+					map[string]any{"term": map[string]any{"path": query.Path}},
+					map[string]any{"prefix": map[string]any{"path": query.Path + "/"}},
+				},
+				"minimum_should_match": 1,
+			},
+		})
+	}
+	if len(query.Extensions) > 0 {
+		filters = append(filters, map[string]any{"terms": map[string]any{"extension": query.Extensions}})
+	}
+	sizeRange := make(map[string]any)
+	if query.MinSize > 0 {
+		sizeRange["gte"] = query.MinSize
+	}
+	if query.MaxSize > 0 {
+		sizeRange["lte"] = query.MaxSize
+	}
+	if len(sizeRange) > 0 {
+		filters = append(filters, map[string]any{"range": map[string]any{"size": sizeRange}})
+	}
+	timeRange := make(map[string]any)
+	if query.ModifiedAfter > 0 {
+		timeRange["gte"] = query.ModifiedAfter
+	}
+	if query.ModifiedBefore > 0 {
+		timeRange["lte"] = query.ModifiedBefore
+	}
+	if len(timeRange) > 0 {
+		filters = append(filters, map[string]any{"range": map[string]any{"last_modified": timeRange}})
+	}
+	for _, term := range query.getTerms() {
+		filters = append(filters, map[string]any{
+			"bool": map[string]any{
+				"should": []any{
+					map[string]any{
+						"wildcard": map[string]any{
+							"path": map[string]any{
+								"value":            "*" + term + "*",
+								"case_insensitive": true,
+							},
+						},
+					},
+					map[string]any{"match": map[string]any{"content": term}},
+				},
+				"minimum_should_match": 1,
+			},
+		})
+	}
+	return filters
+}
+
+func (i *elasticsearchIndex) search(username string, query *SearchQuery, limit int) ([]SearchDocument, error) {
+	body, err := json.Marshal(map[string]any{
+		"size":    limit,
+		"_source": map[string]any{"excludes": []string{"content"}},
+		"sort":    []any{map[string]any{"path": "asc"}},
+		"query": map[string]any{
+			"bool": map[string]any{
+				"filter": i.getSearchFilters(username, query),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Hits struct {
+			Hits []struct {
+				Source SearchDocument `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := i.doJSONRequest(http.MethodPost, i.baseURL+"/_search", "application/json", body, &result); err != nil {
+		return nil, err
+	}
+	docs := make([]SearchDocument, 0, len(result.Hits.Hits))
+	for _, hit := range result.Hits.Hits {
+		docs = append(docs, hit.Source)
+	}
+	return docs, nil
+}
+
+func (i *elasticsearchIndex) doJSONRequest(method, url, contentType string, body []byte, result any) error {
+	resp, err := i.doRequest(method, url, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("unexpected elasticsearch response code %d: %s", resp.StatusCode, string(respBody))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (i *elasticsearchIndex) doRequest(method, url, contentType string, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if i.config.Username != "" || i.config.Password != "" {
+		req.SetBasicAuth(i.config.Username, i.config.Password)
+	}
+	client := httpclient.GetHTTPClient()
+	defer client.CloseIdleConnections()
+
+	return client.Do(req)
+}
@@ -0,0 +1,583 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// Supported search index drivers
+const (
+	SearchDriverMemory        = "memory"
+	SearchDriverElasticsearch = "elasticsearch"
+)
+
+// Supported search types
+const (
+	SearchTypeAll = iota
+	SearchTypeFiles
+	SearchTypeDirs
+)
+
+const (
+	searchLogSender       = "search"
+	protocolSearchIndex   = "SearchIndex"
+	searchQueueSize       = 1024
+	searchIndexBatchSize  = 500
+	maxSearchMatches      = 5000
+	searchContentSniffLen = 512
+)
+
+var (
+	searchIndexer          *searchManager
+	supportedSearchDrivers = []string{SearchDriverMemory, SearchDriverElasticsearch}
+	errSearchDisabled      = errors.New("search is disabled")
+)
+
+type searchJobType int
+
+const (
+	searchJobIndex searchJobType = iota
+	searchJobDelete
+	searchJobScan
+)
+
+// ElasticsearchConfig defines the configuration to use an external Elasticsearch
+// cluster as search index
+type ElasticsearchConfig struct {
+	// Base URL, for example http://127.0.0.1:9200
+	URL string `json:"url" mapstructure:"url"`
+	// Index name. It will be created, if missing, at startup
+	Index string `json:"index" mapstructure:"index"`
+	// Username and password for basic authentication. Leave empty to disable authentication
+	Username string `json:"username" mapstructure:"username"`
+	Password string `json:"password" mapstructure:"password"`
+}
+
+// SearchConfig defines the configuration for the files search index
+type SearchConfig struct {
+	// Set to true to enable the search index
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// Index driver, supported values:
+	// - "memory", the index is kept in memory and rebuilt after a restart
+	// - "elasticsearch", the index is stored in an external Elasticsearch cluster
+	Driver string `json:"driver" mapstructure:"driver"`
+	// Set to true to also index the contents of text files
+	IndexContents bool `json:"index_contents" mapstructure:"index_contents"`
+	// Maximum size, as KB, for text files whose contents will be indexed
+	MaxContentSize int64 `json:"max_content_size" mapstructure:"max_content_size"`
+	// Elasticsearch configuration, used if the driver is "elasticsearch"
+	Elasticsearch ElasticsearchConfig `json:"elasticsearch" mapstructure:"elasticsearch"`
+}
+
+func (c *SearchConfig) validate() error {
+	if !util.Contains(supportedSearchDrivers, c.Driver) {
+		return fmt.Errorf("unsupported search driver %q", c.Driver)
+	}
+	if c.Driver == SearchDriverElasticsearch {
+		if c.Elasticsearch.URL == "" {
+			return errors.New("elasticsearch URL is required")
+		}
+		if c.Elasticsearch.Index == "" {
+			return errors.New("elasticsearch index is required")
+		}
+	}
+	if c.MaxContentSize < 0 {
+		c.MaxContentSize = 0
+	}
+	return nil
+}
+
+// SearchDocument defines an indexed file or directory
+type SearchDocument struct {
+	Username    string `json:"username,omitempty"`
+	VirtualPath string `json:"path"`
+	Name        string `json:"name"`
+	Extension   string `json:"extension,omitempty"`
+	Size        int64  `json:"size"`
+	// Last modification time as unix timestamp in milliseconds
+	ModTime int64  `json:"last_modified"`
+	IsDir   bool   `json:"is_dir"`
+	Content string `json:"content,omitempty"`
+}
+
+func (d *SearchDocument) isInside(virtualPath string) bool {
+	if virtualPath == "/" || d.VirtualPath == virtualPath {
+		return true
+	}
+	return strings.HasPrefix(d.VirtualPath, virtualPath+"/")
+}
+
+func (d *SearchDocument) matches(query *SearchQuery, terms []string) bool {
+	switch query.Type {
+	case SearchTypeFiles:
+		if d.IsDir {
+			return false
+		}
+	case SearchTypeDirs:
+		if !d.IsDir {
+			return false
+		}
+	}
+	if query.Path != "" && !d.isInside(query.Path) {
+		return false
+	}
+	if len(query.Extensions) > 0 && !util.Contains(query.Extensions, d.Extension) {
+		return false
+	}
+	if query.MinSize > 0 && d.Size < query.MinSize {
+		return false
+	}
+	if query.MaxSize > 0 && d.Size > query.MaxSize {
+		return false
+	}
+	if query.ModifiedAfter > 0 && d.ModTime < query.ModifiedAfter {
+		return false
+	}
+	if query.ModifiedBefore > 0 && d.ModTime > query.ModifiedBefore {
+		return false
+	}
+	for _, term := range terms {
+		if !strings.Contains(strings.ToLower(d.VirtualPath), term) && !strings.Contains(d.Content, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// SearchQuery defines the supported search filters
+type SearchQuery struct {
+	// Space separated terms, all terms must be contained in the path or in the indexed contents
+	Text string
+	// Restrict the search to this virtual directory
+	Path string
+	// Restrict the search to these extensions, without the dot, for example "pdf"
+	Extensions []string
+	// 0 all, 1 files only, 2 directories only
+	Type    int
+	MinSize int64
+	MaxSize int64
+	// Unix timestamps in milliseconds
+	ModifiedAfter  int64
+	ModifiedBefore int64
+	Limit          int
+	Offset         int
+}
+
+func (q *SearchQuery) normalize() {
+	if q.Path != "" {
+		q.Path = util.CleanPath(q.Path)
+	}
+	for idx := range q.Extensions {
+		q.Extensions[idx] = strings.ToLower(strings.TrimPrefix(q.Extensions[idx], "."))
+	}
+	if q.Limit <= 0 {
+		q.Limit = 100
+	}
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+}
+
+func (q *SearchQuery) getTerms() []string {
+	return strings.Fields(strings.ToLower(q.Text))
+}
+
+// SearchResults defines the result of a search query
+type SearchResults struct {
+	// Total number of matches, capped to 5000
+	Total int              `json:"total"`
+	Items []SearchDocument `json:"items"`
+	// true if the index for the user is being built
+	Indexing bool `json:"indexing"`
+}
+
+type searchIndex interface {
+	indexDocuments(docs []SearchDocument) error
+	deleteDocuments(username, virtualPath string) error
+	search(username string, query *SearchQuery, limit int) ([]SearchDocument, error)
+}
+
+type searchJob struct {
+	jobType     searchJobType
+	user        dataprovider.User
+	virtualPath string
+}
+
+type searchManager struct {
+	config SearchConfig
+	index  searchIndex
+	jobs   chan searchJob
+	mu     sync.RWMutex
+	// usernames for which a full scan was started, the value is true
+	// while the scan is in progress
+	scans map[string]bool
+}
+
+func newSearchManager(config SearchConfig) (*searchManager, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	var index searchIndex
+	var err error
+	switch config.Driver {
+	case SearchDriverElasticsearch:
+		index, err = newElasticsearchIndex(config.Elasticsearch)
+	default:
+		index = newMemorySearchIndex()
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &searchManager{
+		config: config,
+		index:  index,
+		jobs:   make(chan searchJob, searchQueueSize),
+		scans:  make(map[string]bool),
+	}
+	go m.processJobs()
+	return m, nil
+}
+
+func (m *searchManager) addJob(job searchJob) {
+	select {
+	case m.jobs <- job:
+	default:
+		logger.Warn(searchLogSender, "", "search queue is full, job type %d for path %q, user %q discarded",
+			job.jobType, job.virtualPath, job.user.Username)
+	}
+}
+
+func (m *searchManager) processJobs() {
+	for job := range m.jobs {
+		var err error
+		switch job.jobType {
+		case searchJobIndex:
+			err = m.indexPath(job.user, job.virtualPath)
+		case searchJobDelete:
+			err = m.index.deleteDocuments(job.user.Username, job.virtualPath)
+		case searchJobScan:
+			err = m.scanUser(job.user)
+		}
+		if err != nil {
+			logger.Warn(searchLogSender, "", "unable to process job type %d for path %q, user %q: %v",
+				job.jobType, job.virtualPath, job.user.Username, err)
+		}
+	}
+}
+
+func (m *searchManager) onFsEvent(conn *BaseConnection, operation, virtualPath, virtualTarget string) {
+	switch operation {
+	case operationUpload, operationMkdir, operationCopy:
+		if virtualTarget == "" {
+			virtualTarget = virtualPath
+		}
+		m.addJob(searchJob{jobType: searchJobIndex, user: conn.User, virtualPath: virtualTarget})
+	case operationDelete, operationRmdir:
+		m.addJob(searchJob{jobType: searchJobDelete, user: conn.User, virtualPath: virtualPath})
+	case operationRename:
+		m.addJob(searchJob{jobType: searchJobDelete, user: conn.User, virtualPath: virtualPath})
+		m.addJob(searchJob{jobType: searchJobIndex, user: conn.User, virtualPath: virtualTarget})
+	}
+}
+
+func (m *searchManager) isScanning(username string) (bool, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	inProgress, ok := m.scans[username]
+	return inProgress, ok
+}
+
+func (m *searchManager) setScanStatus(username string, inProgress bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.scans[username] = inProgress
+}
+
+func (m *searchManager) getConnection(user dataprovider.User) *BaseConnection {
+	connID := xid.New().String()
+	return NewBaseConnection(fmt.Sprintf("%s_%s", protocolSearchIndex, connID), protocolSearchIndex, "", "", user)
+}
+
+func (m *searchManager) getDocument(conn *BaseConnection, virtualPath string, info os.FileInfo) SearchDocument {
+	doc := SearchDocument{
+		Username:    conn.User.Username,
+		VirtualPath: virtualPath,
+		Name:        info.Name(),
+		ModTime:     util.GetTimeAsMsSinceEpoch(info.ModTime()),
+		IsDir:       info.IsDir(),
+	}
+	if virtualPath == "/" {
+		doc.Name = "/"
+	}
+	if !doc.IsDir {
+		doc.Size = info.Size()
+		doc.Extension = strings.ToLower(strings.TrimPrefix(path.Ext(info.Name()), "."))
+		if m.config.IndexContents && info.Mode().IsRegular() && info.Size() > 0 &&
+			info.Size() <= m.config.MaxContentSize*1024 {
+			content, err := m.getTextContent(conn, virtualPath, info.Size())
+			if err != nil {
+				conn.Log(logger.LevelDebug, "unable to index contents for %q: %v", virtualPath, err)
+			}
+			doc.Content = content
+		}
+	}
+	return doc
+}
+
+func (m *searchManager) getTextContent(conn *BaseConnection, virtualPath string, size int64) (string, error) {
+	reader, cancelFn, err := getFileReader(conn, virtualPath)
+	if err != nil {
+		return "", err
+	}
+	defer cancelFn()
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, size))
+	if err != nil {
+		return "", err
+	}
+	sniffLen := len(data)
+	if sniffLen > searchContentSniffLen {
+		sniffLen = searchContentSniffLen
+	}
+	if !strings.HasPrefix(http.DetectContentType(data[:sniffLen]), "text/") || !utf8.Valid(data) {
+		return "", nil
+	}
+	return strings.ToLower(string(data)), nil
+}
+
+func (m *searchManager) indexPath(user dataprovider.User, virtualPath string) error {
+	conn := m.getConnection(user)
+	defer conn.CloseFS() //nolint:errcheck
+
+	info, err := conn.DoStat(virtualPath, 0, false)
+	if err != nil {
+		if conn.IsNotExistError(err) {
+			return m.index.deleteDocuments(user.Username, virtualPath)
+		}
+		return err
+	}
+	docs := []SearchDocument{m.getDocument(conn, virtualPath, info)}
+	if info.IsDir() {
+		return m.walk(conn, virtualPath, docs)
+	}
+	return m.index.indexDocuments(docs)
+}
+
+// walk recursively indexes the contents of the specified directory.
+// docs are pending documents to index
+func (m *searchManager) walk(conn *BaseConnection, virtualPath string, docs []SearchDocument) error {
+	var walkDir func(string) error
+
+	walkDir = func(dirPath string) error {
+		if !conn.User.HasPerm(dataprovider.PermListItems, dirPath) {
+			return nil
+		}
+		contents, err := conn.ListDir(dirPath)
+		if err != nil {
+			return fmt.Errorf("unable to list directory %q: %w", dirPath, err)
+		}
+		for _, info := range contents {
+			p := path.Join(dirPath, info.Name())
+			docs = append(docs, m.getDocument(conn, p, info))
+			if len(docs) >= searchIndexBatchSize {
+				if err := m.index.indexDocuments(docs); err != nil {
+					return err
+				}
+				docs = docs[:0]
+			}
+			if info.IsDir() {
+				if err := walkDir(p); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := walkDir(virtualPath); err != nil {
+		return err
+	}
+	if len(docs) > 0 {
+		return m.index.indexDocuments(docs)
+	}
+	return nil
+}
+
+func (m *searchManager) scanUser(user dataprovider.User) error {
+	defer m.setScanStatus(user.Username, false)
+
+	startTime := time.Now()
+	if err := m.index.deleteDocuments(user.Username, "/"); err != nil {
+		return err
+	}
+	conn := m.getConnection(user)
+	defer conn.CloseFS() //nolint:errcheck
+
+	err := m.walk(conn, "/", nil)
+	logger.Debug(searchLogSender, conn.GetID(), "index scan completed for user %q, elapsed: %s, err: %v",
+		user.Username, time.Since(startTime), err)
+	return err
+}
+
+func (m *searchManager) search(user *dataprovider.User, query SearchQuery) (SearchResults, error) {
+	query.normalize()
+	results := SearchResults{
+		Items: []SearchDocument{},
+	}
+	inProgress, ok := m.isScanning(user.Username)
+	if !ok {
+		// the index for this user was never built since the service started,
+		// the built index is valid until the next restart, after that we need
+		// a full rescan to detect the changes done while the service was down
+		m.setScanStatus(user.Username, true)
+		m.addJob(searchJob{jobType: searchJobScan, user: *user})
+		inProgress = true
+	}
+	results.Indexing = inProgress
+
+	matches, err := m.index.search(user.Username, &query, maxSearchMatches)
+	if err != nil {
+		return results, err
+	}
+	for idx := range matches {
+		doc := &matches[idx]
+		if !isSearchDocumentVisible(user, doc) {
+			continue
+		}
+		if results.Total >= query.Offset && len(results.Items) < query.Limit {
+			doc.Username = ""
+			doc.Content = ""
+			results.Items = append(results.Items, *doc)
+		}
+		results.Total++
+	}
+	return results, nil
+}
+
+func isSearchDocumentVisible(user *dataprovider.User, doc *SearchDocument) bool {
+	if doc.VirtualPath == "/" {
+		return false
+	}
+	if !user.HasPerm(dataprovider.PermListItems, path.Dir(doc.VirtualPath)) {
+		return false
+	}
+	ok, _ := user.IsFileAllowed(doc.VirtualPath)
+	return ok
+}
+
+// IsSearchEnabled returns true if the search index is enabled
+func IsSearchEnabled() bool {
+	return searchIndexer != nil
+}
+
+// SearchFiles searches the files and directories visible to the specified user.
+// The first search for a user starts a background scan to build the index
+func SearchFiles(user *dataprovider.User, query SearchQuery) (SearchResults, error) {
+	if searchIndexer == nil {
+		return SearchResults{}, util.NewMethodDisabledError(errSearchDisabled.Error())
+	}
+	return searchIndexer.search(user, query)
+}
+
+func updateSearchIndex(conn *BaseConnection, operation, virtualPath, virtualTarget string, err error) {
+	if searchIndexer == nil || err != nil {
+		return
+	}
+	searchIndexer.onFsEvent(conn, operation, virtualPath, virtualTarget)
+}
+
+type memorySearchIndex struct {
+	sync.RWMutex
+	// username -> virtual path -> document
+	docs map[string]map[string]SearchDocument
+}
+
+func newMemorySearchIndex() *memorySearchIndex {
+	return &memorySearchIndex{
+		docs: make(map[string]map[string]SearchDocument),
+	}
+}
+
+func (i *memorySearchIndex) indexDocuments(docs []SearchDocument) error {
+	i.Lock()
+	defer i.Unlock()
+
+	for _, doc := range docs {
+		userDocs, ok := i.docs[doc.Username]
+		if !ok {
+			userDocs = make(map[string]SearchDocument)
+			i.docs[doc.Username] = userDocs
+		}
+		userDocs[doc.VirtualPath] = doc
+	}
+	return nil
+}
+
+func (i *memorySearchIndex) deleteDocuments(username, virtualPath string) error {
+	i.Lock()
+	defer i.Unlock()
+
+	if virtualPath == "/" {
+		delete(i.docs, username)
+		return nil
+	}
+	userDocs := i.docs[username]
+	for p, doc := range userDocs {
+		if doc.isInside(virtualPath) {
+			delete(userDocs, p)
+		}
+	}
+	return nil
+}
+
+func (i *memorySearchIndex) search(username string, query *SearchQuery, limit int) ([]SearchDocument, error) {
+	i.RLock()
+	defer i.RUnlock()
+
+	terms := query.getTerms()
+	var results []SearchDocument
+	for _, doc := range i.docs[username] {
+		if doc.matches(query, terms) {
+			results = append(results, doc)
+		}
+	}
+	sort.Slice(results, func(a, b int) bool {
+		return results[a].VirtualPath < results[b].VirtualPath
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
@@ -0,0 +1,310 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+)
+
+func TestSearchConfigValidate(t *testing.T) {
+	c := SearchConfig{
+		Driver: "unknown",
+	}
+	assert.Error(t, c.validate())
+	c.Driver = SearchDriverElasticsearch
+	assert.Error(t, c.validate())
+	c.Elasticsearch.URL = "http://127.0.0.1:9200"
+	assert.Error(t, c.validate())
+	c.Elasticsearch.Index = "sftpgo"
+	assert.NoError(t, c.validate())
+	c.Driver = SearchDriverMemory
+	c.MaxContentSize = -1
+	assert.NoError(t, c.validate())
+	assert.Equal(t, int64(0), c.MaxContentSize)
+}
+
+func TestMemorySearchIndex(t *testing.T) {
+	username := "search_user"
+	index := newMemorySearchIndex()
+	err := index.indexDocuments([]SearchDocument{
+		{Username: username, VirtualPath: "/docs", Name: "docs", IsDir: true},
+		{Username: username, VirtualPath: "/docs/report.pdf", Name: "report.pdf", Extension: "pdf", Size: 100, ModTime: 1000},
+		{Username: username, VirtualPath: "/docs/notes.txt", Name: "notes.txt", Extension: "txt", Size: 10, ModTime: 2000,
+			Content: "meeting with sftpgo team"},
+		{Username: username, VirtualPath: "/docs2/file.txt", Name: "file.txt", Extension: "txt", Size: 1000, ModTime: 3000},
+		{Username: "other_user", VirtualPath: "/docs/report.pdf", Name: "report.pdf", Extension: "pdf"},
+	})
+	require.NoError(t, err)
+
+	search := func(query SearchQuery) []string {
+		query.normalize()
+		docs, err := index.search(username, &query, maxSearchMatches)
+		require.NoError(t, err)
+		var paths []string
+		for _, doc := range docs {
+			paths = append(paths, doc.VirtualPath)
+		}
+		return paths
+	}
+
+	assert.Equal(t, []string{"/docs", "/docs/notes.txt", "/docs/report.pdf", "/docs2/file.txt"}, search(SearchQuery{}))
+	assert.Equal(t, []string{"/docs/report.pdf"}, search(SearchQuery{Text: "REPORT"}))
+	assert.Equal(t, []string{"/docs/notes.txt"}, search(SearchQuery{Text: "sftpgo Meeting"}))
+	assert.Empty(t, search(SearchQuery{Text: "sftpgo missing"}))
+	assert.Equal(t, []string{"/docs/notes.txt", "/docs2/file.txt"}, search(SearchQuery{Extensions: []string{".TXT"}}))
+	assert.Equal(t, []string{"/docs", "/docs/notes.txt", "/docs/report.pdf"}, search(SearchQuery{Path: "/docs/"}))
+	assert.Equal(t, []string{"/docs"}, search(SearchQuery{Type: SearchTypeDirs}))
+	assert.Equal(t, []string{"/docs/report.pdf", "/docs2/file.txt"}, search(SearchQuery{Type: SearchTypeFiles, MinSize: 50}))
+	assert.Equal(t, []string{"/docs/notes.txt"}, search(SearchQuery{Type: SearchTypeFiles, MaxSize: 50}))
+	assert.Equal(t, []string{"/docs/notes.txt", "/docs2/file.txt"}, search(SearchQuery{ModifiedAfter: 1500}))
+	assert.Equal(t, []string{"/docs", "/docs/report.pdf"}, search(SearchQuery{ModifiedBefore: 1500}))
+
+	err = index.deleteDocuments(username, "/docs")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/docs2/file.txt"}, search(SearchQuery{}))
+	err = index.deleteDocuments(username, "/")
+	require.NoError(t, err)
+	assert.Empty(t, search(SearchQuery{}))
+	docs, err := index.search("other_user", &SearchQuery{}, maxSearchMatches)
+	require.NoError(t, err)
+	assert.Len(t, docs, 1)
+}
+
+func TestSearchManager(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "search_home")
+	err := os.MkdirAll(filepath.Join(homeDir, "dir", "sub"), os.ModePerm)
+	require.NoError(t, err)
+	err = os.MkdirAll(filepath.Join(homeDir, "private"), os.ModePerm)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(homeDir, "dir", "sub", "file.txt"), []byte("Hello SFTPGo"), 0666)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(homeDir, "dir", "image.bin"), []byte{0x00, 0x01, 0x02, 0xff}, 0666)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(homeDir, "private", "secret.txt"), []byte("secret"), 0666)
+	require.NoError(t, err)
+
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "search_test_user",
+			HomeDir:  homeDir,
+			Permissions: map[string][]string{
+				"/":        {dataprovider.PermAny},
+				"/private": {dataprovider.PermUpload},
+			},
+		},
+	}
+	user.Filters.FilePatterns = []sdk.PatternsFilter{
+		{
+			Path:            "/dir",
+			DeniedPatterns:  []string{"*.bin"},
+			DenyPolicy:      sdk.DenyPolicyDefault,
+			AllowedPatterns: []string{},
+		},
+	}
+
+	_, err = SearchFiles(&user, SearchQuery{})
+	assert.Error(t, err)
+	assert.False(t, IsSearchEnabled())
+
+	m, err := newSearchManager(SearchConfig{
+		Driver:         SearchDriverMemory,
+		IndexContents:  true,
+		MaxContentSize: 1,
+	})
+	require.NoError(t, err)
+	searchIndexer = m
+	defer func() {
+		searchIndexer = nil
+	}()
+	assert.True(t, IsSearchEnabled())
+
+	results, err := SearchFiles(&user, SearchQuery{})
+	require.NoError(t, err)
+	assert.True(t, results.Indexing)
+	assert.Eventually(t, func() bool {
+		inProgress, ok := m.isScanning(user.Username)
+		return ok && !inProgress
+	}, 2*time.Second, 50*time.Millisecond)
+
+	results, err = SearchFiles(&user, SearchQuery{})
+	require.NoError(t, err)
+	assert.False(t, results.Indexing)
+	// the private dir is visible, its contents are not listable,
+	// image.bin is not allowed
+	if assert.Equal(t, 4, results.Total) {
+		assert.Equal(t, "/dir", results.Items[0].VirtualPath)
+		assert.Equal(t, "/dir/sub", results.Items[1].VirtualPath)
+		assert.Equal(t, "/dir/sub/file.txt", results.Items[2].VirtualPath)
+		assert.Equal(t, "/private", results.Items[3].VirtualPath)
+		assert.Empty(t, results.Items[2].Content)
+		assert.Empty(t, results.Items[2].Username)
+	}
+	results, err = SearchFiles(&user, SearchQuery{Limit: 2, Offset: 1})
+	require.NoError(t, err)
+	assert.Equal(t, 4, results.Total)
+	if assert.Len(t, results.Items, 2) {
+		assert.Equal(t, "/dir/sub", results.Items[0].VirtualPath)
+	}
+	results, err = SearchFiles(&user, SearchQuery{Text: "hello"})
+	require.NoError(t, err)
+	if assert.Len(t, results.Items, 1) {
+		assert.Equal(t, "/dir/sub/file.txt", results.Items[0].VirtualPath)
+	}
+	// binary contents must not be indexed
+	docs, err := m.index.search(user.Username, &SearchQuery{Extensions: []string{"bin"}}, maxSearchMatches)
+	require.NoError(t, err)
+	if assert.Len(t, docs, 1) {
+		assert.Empty(t, docs[0].Content)
+	}
+
+	conn := NewBaseConnection("", ProtocolSFTP, "", "", user)
+	err = os.Rename(filepath.Join(homeDir, "dir", "sub"), filepath.Join(homeDir, "dir", "renamed"))
+	require.NoError(t, err)
+	updateSearchIndex(conn, operationRename, "/dir/sub", "/dir/renamed", nil)
+	assert.Eventually(t, func() bool {
+		results, err := SearchFiles(&user, SearchQuery{Text: "hello"})
+		return err == nil && len(results.Items) == 1 && results.Items[0].VirtualPath == "/dir/renamed/file.txt"
+	}, 2*time.Second, 50*time.Millisecond)
+
+	err = os.RemoveAll(filepath.Join(homeDir, "dir", "renamed"))
+	require.NoError(t, err)
+	updateSearchIndex(conn, operationRmdir, "/dir/renamed", "", nil)
+	assert.Eventually(t, func() bool {
+		results, err := SearchFiles(&user, SearchQuery{Path: "/dir"})
+		return err == nil && results.Total == 1
+	}, 2*time.Second, 50*time.Millisecond)
+
+	err = os.WriteFile(filepath.Join(homeDir, "upload.txt"), []byte("uploaded"), 0666)
+	require.NoError(t, err)
+	// failed operations are ignored
+	updateSearchIndex(conn, operationUpload, "/upload.txt", "", os.ErrPermission)
+	updateSearchIndex(conn, operationUpload, "/upload.txt", "", nil)
+	assert.Eventually(t, func() bool {
+		results, err := SearchFiles(&user, SearchQuery{Text: "uploaded", Type: SearchTypeFiles})
+		return err == nil && results.Total == 1
+	}, 2*time.Second, 50*time.Millisecond)
+
+	err = os.RemoveAll(homeDir)
+	assert.NoError(t, err)
+}
+
+func TestElasticsearchIndex(t *testing.T) {
+	var requests []string
+	var lastBody string
+	indexExists := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lastBody = string(body)
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "elastic" || password != "pwd" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodHead:
+			if indexExists {
+				w.WriteHeader(http.StatusOK)
+			} else {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case r.Method == http.MethodPut:
+			indexExists = true
+			w.WriteHeader(http.StatusOK)
+		case strings.HasSuffix(r.URL.Path, "/_bulk"):
+			if strings.Contains(lastBody, "bulk_error") {
+				w.Write([]byte(`{"errors": true}`)) //nolint:errcheck
+				return
+			}
+			w.Write([]byte(`{"errors": false}`)) //nolint:errcheck
+		case strings.HasSuffix(r.URL.Path, "/_delete_by_query"):
+			w.Write([]byte(`{}`)) //nolint:errcheck
+		case strings.HasSuffix(r.URL.Path, "/_search"):
+			w.Write([]byte(`{"hits":{"hits":[{"_source":{"username":"user1","path":"/file.pdf","name":"file.pdf","extension":"pdf","size":10}}]}}`)) //nolint:errcheck
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	config := ElasticsearchConfig{
+		URL:      server.URL,
+		Index:    "sftpgo",
+		Username: "elastic",
+		Password: "wrong",
+	}
+	_, err := newElasticsearchIndex(config)
+	assert.Error(t, err)
+
+	config.Password = "pwd"
+	index, err := newElasticsearchIndex(config)
+	require.NoError(t, err)
+	assert.True(t, indexExists)
+	_, err = newElasticsearchIndex(config)
+	require.NoError(t, err)
+
+	err = index.indexDocuments([]SearchDocument{
+		{Username: "user1", VirtualPath: "/file.pdf", Name: "file.pdf", Extension: "pdf"},
+	})
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(lastBody), "\n")
+	assert.Len(t, lines, 2)
+	err = index.indexDocuments([]SearchDocument{
+		{Username: "user1", VirtualPath: "/bulk_error", Name: "bulk_error"},
+	})
+	assert.Error(t, err)
+
+	err = index.deleteDocuments("user1", "/dir")
+	assert.NoError(t, err)
+	assert.Contains(t, lastBody, `"/dir/"`)
+
+	query := SearchQuery{
+		Text:           "file",
+		Path:           "/",
+		Extensions:     []string{"pdf"},
+		Type:           SearchTypeFiles,
+		MinSize:        1,
+		MaxSize:        100,
+		ModifiedAfter:  1,
+		ModifiedBefore: 2,
+	}
+	docs, err := index.search("user1", &query, 10)
+	require.NoError(t, err)
+	if assert.Len(t, docs, 1) {
+		assert.Equal(t, "/file.pdf", docs[0].VirtualPath)
+	}
+	var searchBody map[string]any
+	err = json.Unmarshal([]byte(lastBody), &searchBody)
+	require.NoError(t, err)
+	assert.Equal(t, float64(10), searchBody["size"])
+	filters := index.getSearchFilters("user1", &query)
+	// username, type, extensions, size, time and one text term, the root path is not a filter
+	assert.Len(t, filters, 6)
+	assert.Contains(t, requests, http.MethodPut+" /sftpgo")
+}
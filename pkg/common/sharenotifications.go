@@ -0,0 +1,193 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/smtp"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	sharesCheckInterval = "@every 1h"
+	// burnt shares are removed after this delay so in progress downloads
+	// can restore the share usage if they fail
+	burntShareRemoveDelay = time.Hour
+)
+
+var (
+	// uploads to a file request within this delay are notified using a single email
+	fileRequestNotificationDelay = time.Minute
+	fileRequestNotifications     = fileRequestNotifier{
+		pending: make(map[string]*fileRequestUploads),
+	}
+)
+
+// FileRequestUpload defines a file uploaded to a file request
+type FileRequestUpload struct {
+	Name     string
+	Uploader string
+	IP       string
+}
+
+type fileRequestUploads struct {
+	name     string
+	username string
+	uploads  []FileRequestUpload
+}
+
+type fileRequestNotifier struct {
+	sync.Mutex
+	pending map[string]*fileRequestUploads
+}
+
+func (n *fileRequestNotifier) add(share *dataprovider.Share, uploads []FileRequestUpload) {
+	n.Lock()
+	defer n.Unlock()
+
+	if pending, ok := n.pending[share.ShareID]; ok {
+		pending.uploads = append(pending.uploads, uploads...)
+		return
+	}
+	n.pending[share.ShareID] = &fileRequestUploads{
+		name:     share.Name,
+		username: share.Username,
+		uploads:  uploads,
+	}
+	shareID := share.ShareID
+	time.AfterFunc(fileRequestNotificationDelay, func() {
+		n.send(shareID)
+	})
+}
+
+func (n *fileRequestNotifier) remove(shareID string) *fileRequestUploads {
+	n.Lock()
+	defer n.Unlock()
+
+	pending := n.pending[shareID]
+	delete(n.pending, shareID)
+	return pending
+}
+
+func (n *fileRequestNotifier) send(shareID string) {
+	pending := n.remove(shareID)
+	if pending == nil {
+		return
+	}
+	data := map[string]any{
+		"Name":    pending.name,
+		"Uploads": pending.uploads,
+	}
+	if err := sendShareNotification(pending.username, "SFTPGo file request notification", data,
+		smtp.RenderShareFileRequestTemplate); err != nil {
+		logger.Warn(logSender, "", "unable to notify uploads for file request %q: %v", shareID, err)
+	}
+}
+
+// NotifyFileRequestUploads sends an email to the share owner listing the
+// files uploaded to a file request. Uploads received within a short delay are
+// notified together
+func NotifyFileRequestUploads(share *dataprovider.Share, uploads []FileRequestUpload) {
+	if len(uploads) == 0 {
+		return
+	}
+	fileRequestNotifications.add(share, uploads)
+}
+
+// NotifyShareUse sends an email to the share owner, in the background, to
+// notify that the share was used from the specified IP address
+func NotifyShareUse(share *dataprovider.Share, ipAddr string, numTokens int) {
+	data := map[string]any{
+		"Name":       share.Name,
+		"IP":         ipAddr,
+		"UsedTokens": share.UsedTokens + numTokens,
+		"MaxTokens":  share.MaxTokens,
+	}
+	go func(shareID, username string) {
+		if err := sendShareNotification(username, "SFTPGo share usage notification", data,
+			smtp.RenderShareUsageTemplate); err != nil {
+			logger.Warn(logSender, "", "unable to notify usage for share %q: %v", shareID, err)
+		}
+	}(share.ShareID, share.Username)
+}
+
+func sendShareNotification(username, subject string, data map[string]any,
+	render func(string, *bytes.Buffer, any) error,
+) error {
+	user, err := dataprovider.UserExists(username, "")
+	if err != nil {
+		return err
+	}
+	if user.Email == "" {
+		return errors.New("no email address configured for the share owner")
+	}
+	data["Username"] = user.Username
+	body := new(bytes.Buffer)
+	if err := render(user.Role, body, data); err != nil {
+		return err
+	}
+	return smtp.SendEmailForRole(user.Role, []string{user.Email}, nil, subject, body.String(),
+		smtp.EmailContentTypeTextHTML)
+}
+
+// checkShares removes burnt shares, cleans up the per IP downloads and
+// notifies the share owners about shares expiring soon. It runs every hour
+// so the expiration is notified once within the configured hours window
+func checkShares() {
+	shares, err := dataprovider.DumpShares()
+	if err != nil {
+		logger.Warn(logSender, "", "unable to check shares: %v", err)
+		return
+	}
+	dataprovider.CleanupShareDownloads(shares)
+	for idx := range shares {
+		share := &shares[idx]
+		if share.IsBurnt() {
+			lastUse := util.GetTimeFromMsecSinceEpoch(share.LastUseAt)
+			if time.Since(lastUse) > burntShareRemoveDelay {
+				err := dataprovider.DeleteShare(share.ShareID, share.Username, "", "")
+				logger.Debug(logSender, "", "burnt share %q removed, err: %v", share.ShareID, err)
+			}
+			continue
+		}
+		if !needsShareExpirationNotification(share) {
+			continue
+		}
+		data := map[string]any{
+			"Name":      share.Name,
+			"Hours":     share.NotifyBeforeExpiration,
+			"ExpiresAt": util.GetTimeFromMsecSinceEpoch(share.ExpiresAt).UTC().Format(time.RFC1123),
+		}
+		err := sendShareNotification(share.Username, "SFTPGo share expiration notification", data,
+			smtp.RenderShareExpirationTemplate)
+		if err != nil {
+			logger.Warn(logSender, "", "unable to notify expiration for share %q: %v", share.ShareID, err)
+		}
+	}
+}
+
+func needsShareExpirationNotification(share *dataprovider.Share) bool {
+	if share.NotifyBeforeExpiration <= 0 {
+		return false
+	}
+	threshold := time.Duration(share.NotifyBeforeExpiration) * time.Hour
+	return share.ExpiresWithin(threshold) && !share.ExpiresWithin(threshold-time.Hour)
+}
@@ -0,0 +1,178 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/smtp"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+func TestShareExpirationNotification(t *testing.T) {
+	share := dataprovider.Share{
+		ExpiresAt: util.GetTimeAsMsSinceEpoch(time.Now().Add(150 * time.Minute)),
+	}
+	assert.False(t, needsShareExpirationNotification(&share))
+	share.NotifyBeforeExpiration = 2
+	assert.False(t, needsShareExpirationNotification(&share))
+	share.NotifyBeforeExpiration = 3
+	assert.True(t, needsShareExpirationNotification(&share))
+	share.NotifyBeforeExpiration = 4
+	assert.False(t, needsShareExpirationNotification(&share))
+	share.ExpiresAt = util.GetTimeAsMsSinceEpoch(time.Now().Add(-time.Minute))
+	share.NotifyBeforeExpiration = 1
+	assert.False(t, needsShareExpirationNotification(&share))
+}
+
+func TestCheckShares(t *testing.T) {
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "share_checks_user",
+			Password: "pwd",
+			HomeDir:  os.TempDir(),
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+	}
+	err := dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+
+	err = sendShareNotification(user.Username, "subject", map[string]any{}, smtp.RenderShareUsageTemplate)
+	assert.ErrorContains(t, err, "no email address")
+	err = sendShareNotification("missing user", "subject", map[string]any{}, smtp.RenderShareUsageTemplate)
+	assert.Error(t, err)
+
+	burnt := dataprovider.Share{
+		ShareID:           util.GenerateUniqueID(),
+		Name:              "burnt",
+		Username:          user.Username,
+		Scope:             dataprovider.ShareScopeRead,
+		Paths:             []string{"/"},
+		BurnAfterDownload: true,
+		UsedTokens:        1,
+		LastUseAt:         util.GetTimeAsMsSinceEpoch(time.Now().Add(-2 * time.Hour)),
+		IsRestore:         true,
+	}
+	err = dataprovider.AddShare(&burnt, "", "", "")
+	require.NoError(t, err)
+	recent := dataprovider.Share{
+		ShareID:           util.GenerateUniqueID(),
+		Name:              "recently burnt",
+		Username:          user.Username,
+		Scope:             dataprovider.ShareScopeRead,
+		Paths:             []string{"/"},
+		BurnAfterDownload: true,
+		UsedTokens:        1,
+		LastUseAt:         util.GetTimeAsMsSinceEpoch(time.Now()),
+		IsRestore:         true,
+	}
+	err = dataprovider.AddShare(&recent, "", "", "")
+	require.NoError(t, err)
+	expiring := dataprovider.Share{
+		ShareID:                util.GenerateUniqueID(),
+		Name:                   "expiring",
+		Username:               user.Username,
+		Scope:                  dataprovider.ShareScopeRead,
+		Paths:                  []string{"/"},
+		ExpiresAt:              util.GetTimeAsMsSinceEpoch(time.Now().Add(90 * time.Minute)),
+		NotifyBeforeExpiration: 2,
+		IsRestore:              true,
+	}
+	err = dataprovider.AddShare(&expiring, "", "", "")
+	require.NoError(t, err)
+
+	checkShares()
+
+	_, err = dataprovider.ShareExists(burnt.ShareID, user.Username)
+	var notFoundErr *util.RecordNotFoundError
+	assert.ErrorAs(t, err, &notFoundErr)
+	_, err = dataprovider.ShareExists(recent.ShareID, user.Username)
+	assert.NoError(t, err)
+	_, err = dataprovider.ShareExists(expiring.ShareID, user.Username)
+	assert.NoError(t, err)
+
+	err = dataprovider.DeleteUser(user.Username, "", "", "")
+	assert.NoError(t, err)
+}
+
+func TestFileRequestNotifications(t *testing.T) {
+	delay := fileRequestNotificationDelay
+	fileRequestNotificationDelay = 100 * time.Millisecond
+	defer func() {
+		fileRequestNotificationDelay = delay
+	}()
+
+	share := dataprovider.Share{
+		ShareID:  util.GenerateUniqueID(),
+		Name:     "file request",
+		Username: "missing user",
+		Scope:    dataprovider.ShareScopeFileRequest,
+	}
+	NotifyFileRequestUploads(&share, nil)
+	fileRequestNotifications.Lock()
+	assert.Len(t, fileRequestNotifications.pending, 0)
+	fileRequestNotifications.Unlock()
+
+	NotifyFileRequestUploads(&share, []FileRequestUpload{{Name: "/file1.txt", Uploader: "john", IP: "127.0.0.1"}})
+	NotifyFileRequestUploads(&share, []FileRequestUpload{{Name: "/file2.txt", IP: "127.0.0.1"}})
+	fileRequestNotifications.Lock()
+	if assert.Contains(t, fileRequestNotifications.pending, share.ShareID) {
+		assert.Len(t, fileRequestNotifications.pending[share.ShareID].uploads, 2)
+	}
+	fileRequestNotifications.Unlock()
+
+	assert.Eventually(t, func() bool {
+		fileRequestNotifications.Lock()
+		defer fileRequestNotifications.Unlock()
+
+		return len(fileRequestNotifications.pending) == 0
+	}, 2*time.Second, 50*time.Millisecond)
+	// sending again is a no-op
+	fileRequestNotifications.send(share.ShareID)
+}
+
+func TestShareFileRequestNames(t *testing.T) {
+	fileRequest := dataprovider.ShareFileRequest{
+		NameTemplate: dataprovider.ShareFileRequestDefaultTemplate,
+	}
+	now := time.Date(2023, 5, 10, 14, 30, 15, 0, time.UTC)
+	assert.Equal(t, "2023-05-10-anonymous-report.pdf", fileRequest.GetFileName("report.pdf", "", now))
+	assert.Equal(t, "2023-05-10-anonymous-report.pdf", fileRequest.GetFileName("/dir/report.pdf", " .. ", now))
+	assert.Equal(t, "2023-05-10-J_rg_Doe_Co-report.pdf", fileRequest.GetFileName("report.pdf", "J/rg Doe&Co.", now))
+	assert.Equal(t, "2023-05-10-user@example.com-report.pdf", fileRequest.GetFileName("report.pdf", "user@example.com", now))
+	assert.Equal(t, "2023-05-10-Jörg-a", fileRequest.GetFileName("../a", "Jörg", now))
+	fileRequest.NameTemplate = "{{basename}}_{{time}}{{ext}}"
+	assert.Equal(t, "archive.tar_143015.gz", fileRequest.GetFileName("archive.tar.gz", "", now))
+	fileRequest.NameTemplate = "{{uploader}}"
+	assert.Len(t, fileRequest.GetFileName("a.txt", strings.Repeat("a", 100), now), 64)
+	fileRequest.NameTemplate = " "
+	assert.Equal(t, "a.txt", fileRequest.GetFileName("a.txt", "", now))
+
+	assert.Equal(t, "report.pdf", dataprovider.GetShareFileNameVariant("report.pdf", 0))
+	assert.Equal(t, "report-2.pdf", dataprovider.GetShareFileNameVariant("report.pdf", 2))
+	assert.Equal(t, "report-1", dataprovider.GetShareFileNameVariant("report", 1))
+	assert.Equal(t, ".bashrc-1", dataprovider.GetShareFileNameVariant(".bashrc", 1))
+}
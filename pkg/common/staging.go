@@ -0,0 +1,489 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/v2/pkg/command"
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/httpclient"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+// Staged items status
+const (
+	StagedItemStatusPending    = "pending"
+	StagedItemStatusValidating = "validating"
+	StagedItemStatusFailed     = "failed"
+)
+
+// the staged items are stored as custom metadata for the staged files
+const (
+	stagingKeyTarget     = "sftpgo_staging_target"
+	stagingKeySize       = "sftpgo_staging_size"
+	stagingKeyStatus     = "sftpgo_staging_status"
+	stagingKeyMessage    = "sftpgo_staging_message"
+	stagingKeyProtocol   = "sftpgo_staging_protocol"
+	stagingKeyIP         = "sftpgo_staging_ip"
+	stagingKeyUploadedAt = "sftpgo_staging_uploaded_at"
+	stagingKeySHA256     = "sftpgo_staging_sha256"
+	stagingKeyTx         = "sftpgo_staging_transaction"
+	maxStagingMessageLen = 1024
+)
+
+var (
+	stagingOps = stagingOperations{
+		items: make(map[string]bool),
+	}
+	errStagedItemBusy = util.NewValidationError("the staged item is being processed")
+)
+
+// StagedItem defines an upload to a staging folder waiting to be published
+type StagedItem struct {
+	// Unique identifier
+	ID string `json:"id"`
+	// Virtual path where the file will be published
+	Path string `json:"path"`
+	// File size in bytes
+	Size int64 `json:"size"`
+	// pending, validating or failed
+	Status string `json:"status"`
+	// Error returned by the last validation, if any
+	Message string `json:"message,omitempty"`
+	// Protocol and IP address used for the upload
+	Protocol string `json:"protocol"`
+	IP       string `json:"ip"`
+	// Upload time as unix timestamp in milliseconds
+	UploadedAt int64 `json:"uploaded_at"`
+	// SHA-256 checksum computed while uploading, if checksums are enabled
+	SHA256 string `json:"sha256,omitempty"`
+	// Staging transaction, if any. These items are published when the
+	// transaction is committed
+	Transaction string `json:"transaction,omitempty"`
+}
+
+func (i *StagedItem) getStagingPath() string {
+	return path.Join(path.Dir(i.Path), dataprovider.StagingDirName, i.ID)
+}
+
+func (i *StagedItem) getFileMetadata() dataprovider.FileMetadata {
+	metadata := map[string]string{
+		stagingKeyTarget:     i.Path,
+		stagingKeySize:       strconv.FormatInt(i.Size, 10),
+		stagingKeyStatus:     i.Status,
+		stagingKeyProtocol:   i.Protocol,
+		stagingKeyIP:         i.IP,
+		stagingKeyUploadedAt: strconv.FormatInt(i.UploadedAt, 10),
+	}
+	if i.SHA256 != "" {
+		metadata[stagingKeySHA256] = i.SHA256
+	}
+	if i.Transaction != "" {
+		metadata[stagingKeyTx] = i.Transaction
+	}
+	if i.Message != "" {
+		message := i.Message
+		if len(message) > maxStagingMessageLen {
+			message = message[:maxStagingMessageLen]
+		}
+		metadata[stagingKeyMessage] = message
+	}
+	return dataprovider.FileMetadata{
+		Path:     i.getStagingPath(),
+		Metadata: metadata,
+	}
+}
+
+func newStagedItemFromMetadata(m *dataprovider.FileMetadata) (StagedItem, bool) {
+	target, ok := m.Metadata[stagingKeyTarget]
+	if !ok || path.Base(path.Dir(m.Path)) != dataprovider.StagingDirName {
+		return StagedItem{}, false
+	}
+	size, _ := strconv.ParseInt(m.Metadata[stagingKeySize], 10, 64)
+	uploadedAt, _ := strconv.ParseInt(m.Metadata[stagingKeyUploadedAt], 10, 64)
+	return StagedItem{
+		ID:          path.Base(m.Path),
+		Path:        target,
+		Size:        size,
+		Status:      m.Metadata[stagingKeyStatus],
+		Message:     m.Metadata[stagingKeyMessage],
+		Protocol:    m.Metadata[stagingKeyProtocol],
+		IP:          m.Metadata[stagingKeyIP],
+		UploadedAt:  uploadedAt,
+		SHA256:      m.Metadata[stagingKeySHA256],
+		Transaction: m.Metadata[stagingKeyTx],
+	}, true
+}
+
+// stagingOperations tracks the staged items being published, rejected or
+// validated so that concurrent operations on the same item are refused
+type stagingOperations struct {
+	sync.Mutex
+	items map[string]bool
+}
+
+func (s *stagingOperations) add(id string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.items[id] {
+		return false
+	}
+	s.items[id] = true
+	return true
+}
+
+func (s *stagingOperations) remove(id string) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.items, id)
+}
+
+// IsStagedUpload returns true if uploads to the specified virtual path must
+// be staged before they become visible
+func (c *BaseConnection) IsStagedUpload(virtualPath string) bool {
+	return c.stagingTx != "" || c.User.GetStagingFolder(virtualPath) != ""
+}
+
+// GetUploadFsPath returns the filesystem path to write while uploading to
+// fsPath. Uploads to staging folders are written inside the hidden staging
+// directory, atomic uploads use a temporary file
+func (c *BaseConnection) GetUploadFsPath(fs vfs.Fs, fsPath, virtualPath string) (string, error) {
+	if c.IsStagedUpload(virtualPath) {
+		stagingDir, err := fs.ResolvePath(path.Join(path.Dir(virtualPath), dataprovider.StagingDirName))
+		if err != nil {
+			return "", c.GetFsError(fs, err)
+		}
+		if _, err := fs.Stat(stagingDir); fs.IsNotExist(err) {
+			if err := fs.Mkdir(stagingDir); err != nil {
+				c.Log(logger.LevelError, "unable to create staging dir %q: %v", stagingDir, err)
+				return "", c.GetFsError(fs, err)
+			}
+			vfs.SetPathPermissions(fs, stagingDir, c.User.GetUID(), c.User.GetGID())
+		}
+		return fs.Join(stagingDir, xid.New().String()), nil
+	}
+	if Config.IsAtomicUploadEnabled() && fs.IsAtomicUploadSupported() {
+		return fs.GetAtomicUploadPath(fsPath), nil
+	}
+	return fsPath, nil
+}
+
+// stageUpload records the completed upload as a staged item and starts
+// the validation hook, if any
+func (t *BaseTransfer) stageUpload(fileSize int64, checksum string) error {
+	item := StagedItem{
+		ID:          path.Base(t.effectiveFsPath),
+		Path:        t.requestPath,
+		Size:        fileSize,
+		Status:      StagedItemStatusPending,
+		Protocol:    t.Connection.protocol,
+		IP:          t.Connection.GetRemoteIP(),
+		UploadedAt:  util.GetTimeAsMsSinceEpoch(time.Now()),
+		SHA256:      checksum,
+		Transaction: t.Connection.stagingTx,
+	}
+	validate := Config.StagingHook != "" && item.Transaction == ""
+	if validate {
+		item.Status = StagedItemStatusValidating
+		stagingOps.add(item.ID)
+	}
+	metadata := item.getFileMetadata()
+	if err := dataprovider.SetFileMetadata(t.Connection.User.Username, &metadata); err != nil {
+		stagingOps.remove(item.ID)
+		t.Connection.Log(logger.LevelError, "unable to save staged item for upload %q: %v", t.requestPath, err)
+		return err
+	}
+	t.Connection.Log(logger.LevelInfo, "upload %q staged, id %q, transaction %q", t.requestPath, item.ID,
+		item.Transaction)
+	if validate {
+		go validateStagedItem(t.Connection.User.Username, item, t.effectiveFsPath)
+	}
+	return nil
+}
+
+func validateStagedItem(username string, item StagedItem, fsPath string) {
+	defer stagingOps.remove(item.ID)
+
+	err := executeStagingHook(username, &item, fsPath)
+	if err == nil {
+		err = publishStagedItem(username, &item, "")
+		if err == nil {
+			return
+		}
+	}
+	logger.Warn(logSender, "", "unable to validate staged item %q for user %q: %v", item.ID, username, err)
+	item.Status = StagedItemStatusFailed
+	item.Message = err.Error()
+	metadata := item.getFileMetadata()
+	if err := dataprovider.SetFileMetadata(username, &metadata); err != nil {
+		logger.Error(logSender, "", "unable to update staged item %q for user %q: %v", item.ID, username, err)
+	}
+}
+
+func executeStagingHook(username string, item *StagedItem, fsPath string) error {
+	data := map[string]any{
+		"username":    username,
+		"id":          item.ID,
+		"path":        item.Path,
+		"fs_path":     fsPath,
+		"size":        item.Size,
+		"protocol":    item.Protocol,
+		"ip":          item.IP,
+		"uploaded_at": item.UploadedAt,
+	}
+	if item.SHA256 != "" {
+		data["sha256"] = item.SHA256
+	}
+	jsonData, _ := json.Marshal(data)
+	startTime := time.Now()
+
+	if strings.HasPrefix(Config.StagingHook, "http") {
+		var url *url.URL
+		url, err := url.Parse(Config.StagingHook)
+		if err != nil {
+			return fmt.Errorf("invalid staging hook %q: %w", Config.StagingHook, err)
+		}
+		respCode := 0
+
+		resp, err := httpclient.RetryablePost(url.String(), "application/json", bytes.NewBuffer(jsonData))
+		if err == nil {
+			respCode = resp.StatusCode
+			resp.Body.Close()
+
+			if respCode != http.StatusOK {
+				err = fmt.Errorf("staging hook response code: %d", respCode)
+			}
+		}
+		logger.Debug(logSender, "", "staging hook for item %q, user %q notified to URL: %q, status code: %v, elapsed: %v err: %v",
+			item.ID, username, url.Redacted(), respCode, time.Since(startTime), err)
+		return err
+	}
+	if !filepath.IsAbs(Config.StagingHook) {
+		return fmt.Errorf("invalid staging hook %q", Config.StagingHook)
+	}
+	timeout, env, args := command.GetConfig(Config.StagingHook, command.HookStaging)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, Config.StagingHook, args...)
+	cmd.Env = append(env,
+		fmt.Sprintf("SFTPGO_STAGING_USERNAME=%s", username),
+		fmt.Sprintf("SFTPGO_STAGING_ID=%s", item.ID),
+		fmt.Sprintf("SFTPGO_STAGING_PATH=%s", item.Path),
+		fmt.Sprintf("SFTPGO_STAGING_FS_PATH=%s", fsPath),
+		fmt.Sprintf("SFTPGO_STAGING_SIZE=%d", item.Size),
+		fmt.Sprintf("SFTPGO_STAGING_PROTOCOL=%s", item.Protocol),
+		fmt.Sprintf("SFTPGO_STAGING_IP=%s", item.IP),
+		fmt.Sprintf("SFTPGO_STAGING_SHA256=%s", item.SHA256))
+	err := cmd.Run()
+	logger.Debug(logSender, "", "staging hook for item %q, user %q executed using command: %q, elapsed: %s err: %v",
+		item.ID, username, Config.StagingHook, time.Since(startTime), err)
+	if err != nil {
+		return fmt.Errorf("staging hook error: %w", err)
+	}
+	return nil
+}
+
+// GetStagedItems returns the staged items for the specified user
+func GetStagedItems(username string) ([]StagedItem, error) {
+	files, err := dataprovider.GetFilesMetadata(username, "/")
+	if err != nil {
+		return nil, err
+	}
+	result := make([]StagedItem, 0)
+	for idx := range files {
+		if item, ok := newStagedItemFromMetadata(&files[idx]); ok {
+			result = append(result, item)
+		}
+	}
+	return result, nil
+}
+
+func getStagedItem(username, id string) (StagedItem, error) {
+	items, err := GetStagedItems(username)
+	if err != nil {
+		return StagedItem{}, err
+	}
+	for _, item := range items {
+		if item.ID == id {
+			return item, nil
+		}
+	}
+	return StagedItem{}, util.NewRecordNotFoundError(fmt.Sprintf("staged item %q does not exist", id))
+}
+
+func getStagingConnection(username string, item *StagedItem) (*BaseConnection, error) {
+	user, err := dataprovider.GetUserWithGroupSettings(username, "")
+	if err != nil {
+		return nil, err
+	}
+	connID := xid.New().String()
+	if err := user.CheckFsRoot(connID); err != nil {
+		user.CloseFs() //nolint:errcheck
+		return nil, fmt.Errorf("unable to check root fs for user %q: %w", username, err)
+	}
+	return NewBaseConnection(connID, item.Protocol, "", item.IP, user), nil
+}
+
+// PublishStagedItem atomically moves the specified staged item to its final
+// path. If checksum is not empty it must match the SHA-256 of the staged file
+func PublishStagedItem(username, id, checksum string) error {
+	if !stagingOps.add(id) {
+		return errStagedItemBusy
+	}
+	defer stagingOps.remove(id)
+
+	item, err := getStagedItem(username, id)
+	if err != nil {
+		return err
+	}
+	if item.Transaction != "" {
+		return util.NewValidationError(fmt.Sprintf("the staged item %q is part of the transaction %q, commit the transaction to publish it",
+			id, item.Transaction))
+	}
+	return publishStagedItem(username, &item, checksum)
+}
+
+func publishStagedItem(username string, item *StagedItem, checksum string) error {
+	conn, err := getStagingConnection(username, item)
+	if err != nil {
+		return err
+	}
+	defer conn.User.CloseFs() //nolint:errcheck
+
+	fs, fsPath, err := conn.GetFsAndResolvedPath(item.Path)
+	if err != nil {
+		return err
+	}
+	stagingPath, err := fs.ResolvePath(item.getStagingPath())
+	if err != nil {
+		return conn.GetFsError(fs, err)
+	}
+	if checksum != "" {
+		if err := item.checkChecksum(fs, stagingPath, checksum); err != nil {
+			return err
+		}
+	}
+	var replacedSize int64 = -1
+	if info, err := fs.Lstat(fsPath); err == nil {
+		if info.IsDir() {
+			return util.NewValidationError(fmt.Sprintf("cannot publish %q, the target path is a directory", item.Path))
+		}
+		if err := conn.CheckWORMProtection(item.Path, info); err != nil {
+			return err
+		}
+		replacedSize = info.Size()
+	}
+	if _, _, err := fs.Rename(stagingPath, fsPath); err != nil {
+		conn.Log(logger.LevelError, "unable to publish staged item %q: %v", item.ID, err)
+		return conn.GetFsError(fs, err)
+	}
+	if replacedSize >= 0 {
+		conn.updateQuotaAfterRemove(item.Path, replacedSize)
+	}
+	removeStagedItemMetadata(conn, fs, item)
+	if item.SHA256 != "" {
+		err = setFileChecksum(username, item.Path, item.SHA256, item.Size)
+	} else if replacedSize >= 0 {
+		err = removeFileChecksum(username, item.Path)
+	}
+	if err != nil {
+		conn.Log(logger.LevelWarn, "unable to update the checksum for published item %q: %v", item.ID, err)
+	}
+	conn.Log(logger.LevelInfo, "staged item %q published to %q", item.ID, item.Path)
+	ExecuteActionNotification(conn, operationUpload, fsPath, item.Path, "", "", "", item.Size, nil, 0) //nolint:errcheck
+	return nil
+}
+
+// RejectStagedItem removes the specified staged item
+func RejectStagedItem(username, id string) error {
+	if !stagingOps.add(id) {
+		return errStagedItemBusy
+	}
+	defer stagingOps.remove(id)
+
+	item, err := getStagedItem(username, id)
+	if err != nil {
+		return err
+	}
+	conn, err := getStagingConnection(username, &item)
+	if err != nil {
+		return err
+	}
+	defer conn.User.CloseFs() //nolint:errcheck
+
+	return rejectStagedItem(conn, &item)
+}
+
+func rejectStagedItem(conn *BaseConnection, item *StagedItem) error {
+	fs, stagingPath, err := conn.GetFsAndResolvedPath(item.getStagingPath())
+	if err != nil {
+		return err
+	}
+	if err := fs.Remove(stagingPath, false); err != nil && !fs.IsNotExist(err) {
+		conn.Log(logger.LevelError, "unable to remove staged item %q: %v", item.ID, err)
+		return conn.GetFsError(fs, err)
+	}
+	conn.updateQuotaAfterRemove(item.Path, item.Size)
+	removeStagedItemMetadata(conn, fs, item)
+	conn.Log(logger.LevelInfo, "staged item %q for path %q rejected", item.ID, item.Path)
+	return nil
+}
+
+func removeStagedItemMetadata(conn *BaseConnection, fs vfs.Fs, item *StagedItem) {
+	if err := dataprovider.DeleteFileMetadata(conn.User.Username, item.getStagingPath(), false); err != nil {
+		conn.Log(logger.LevelWarn, "unable to remove metadata for staged item %q: %v", item.ID, err)
+	}
+	// the staging directory is removed once empty, the removal fails otherwise
+	if stagingDir, err := fs.ResolvePath(path.Dir(item.getStagingPath())); err == nil {
+		fs.Remove(stagingDir, true) //nolint:errcheck
+	}
+}
+
+// checkChecksum compares the provided checksum with the one computed while
+// uploading, if any, or with the one computed reading the staged file
+func (i *StagedItem) checkChecksum(fs vfs.Fs, fsPath, checksum string) error {
+	actual := i.SHA256
+	if actual == "" {
+		var err error
+		actual, err = computeFileChecksum(fs, fsPath)
+		if err != nil {
+			return err
+		}
+	}
+	if !strings.EqualFold(actual, strings.TrimSpace(checksum)) {
+		return util.NewValidationError("the SHA-256 checksum does not match")
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+func TestStagingFoldersValidation(t *testing.T) {
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "staging_validation_user",
+			HomeDir:  filepath.Join(os.TempDir(), "staging_validation_user"),
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+	}
+	user.Filters.StagingFolders = []string{"incoming"}
+	err := dataprovider.AddUser(&user, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	user.Filters.StagingFolders = []string{"/incoming", "/incoming/sub"}
+	err = dataprovider.AddUser(&user, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	user.Filters.StagingFolders = []string{"/a/" + dataprovider.StagingDirName}
+	err = dataprovider.AddUser(&user, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+
+	assert.True(t, dataprovider.IsStagingPath("/a/"+dataprovider.StagingDirName+"/file"))
+	assert.False(t, dataprovider.IsStagingPath("/a/file"+dataprovider.StagingDirName))
+	ok, policy := user.IsFileAllowed("/" + dataprovider.StagingDirName)
+	assert.False(t, ok)
+	assert.Equal(t, sdk.DenyPolicyHide, policy)
+}
+
+func TestUploadStaging(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "staging_home")
+	err := os.MkdirAll(filepath.Join(homeDir, "incoming"), os.ModePerm)
+	require.NoError(t, err)
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "staging_user",
+			HomeDir:  homeDir,
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+	}
+	user.Filters.StagingFolders = []string{" /incoming/ ", ""}
+	err = dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/incoming"}, user.Filters.StagingFolders)
+	conn := NewBaseConnection("", ProtocolSFTP, "", "127.0.0.1:1234", user)
+	assert.False(t, conn.IsStagedUpload("/file"))
+	assert.True(t, conn.IsStagedUpload("/incoming/file"))
+
+	upload := func(virtualPath string, data []byte) string {
+		fs, fsPath, err := conn.GetFsAndResolvedPath(virtualPath)
+		require.NoError(t, err)
+		filePath, err := conn.GetUploadFsPath(fs, fsPath, virtualPath)
+		require.NoError(t, err)
+		require.Equal(t, filepath.Join(filepath.Dir(fsPath), dataprovider.StagingDirName), filepath.Dir(filePath))
+		err = os.WriteFile(filePath, data, 0666)
+		require.NoError(t, err)
+		transfer := NewBaseTransfer(nil, conn, nil, fsPath, filePath, virtualPath, TransferUpload, 0, 0, 0, 0, true,
+			fs, dataprovider.TransferQuota{})
+		transfer.BytesReceived.Store(int64(len(data)))
+		err = transfer.Close()
+		require.NoError(t, err)
+		return filepath.Base(filePath)
+	}
+
+	data := []byte("staged content")
+	id := upload("/incoming/file.txt", data)
+	// the staged file is not visible
+	_, err = conn.DoStat("/incoming/file.txt", 0, true)
+	assert.True(t, conn.IsNotExistError(err))
+	_, err = conn.DoStat("/incoming/"+dataprovider.StagingDirName, 0, true)
+	assert.True(t, conn.IsNotExistError(err))
+	files, err := conn.ListDir("/incoming")
+	require.NoError(t, err)
+	assert.Len(t, files, 0)
+	assert.FileExists(t, filepath.Join(homeDir, "incoming", dataprovider.StagingDirName, id))
+	items, err := GetStagedItems(user.Username)
+	require.NoError(t, err)
+	if assert.Len(t, items, 1) {
+		assert.Equal(t, id, items[0].ID)
+		assert.Equal(t, "/incoming/file.txt", items[0].Path)
+		assert.Equal(t, int64(len(data)), items[0].Size)
+		assert.Equal(t, StagedItemStatusPending, items[0].Status)
+		assert.Equal(t, ProtocolSFTP, items[0].Protocol)
+		assert.Equal(t, "127.0.0.1", items[0].IP)
+		assert.Greater(t, items[0].UploadedAt, int64(0))
+	}
+	// concurrent operations on the same item are not allowed
+	assert.True(t, stagingOps.add(id))
+	err = PublishStagedItem(user.Username, id, "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	err = RejectStagedItem(user.Username, id)
+	assert.ErrorIs(t, err, util.ErrValidation)
+	stagingOps.remove(id)
+
+	err = PublishStagedItem(user.Username, "missing", "")
+	assert.ErrorIs(t, err, util.ErrNotFound)
+	err = PublishStagedItem(user.Username, id, "invalid")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	h := sha256.Sum256(data)
+	err = PublishStagedItem(user.Username, id, hex.EncodeToString(h[:]))
+	require.NoError(t, err)
+	content, err := os.ReadFile(filepath.Join(homeDir, "incoming", "file.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, data, content)
+	assert.NoDirExists(t, filepath.Join(homeDir, "incoming", dataprovider.StagingDirName))
+	items, err = GetStagedItems(user.Username)
+	require.NoError(t, err)
+	assert.Len(t, items, 0)
+	// overwriting an existing file does not modify it until the upload is published
+	id = upload("/incoming/file.txt", []byte("new content"))
+	content, err = os.ReadFile(filepath.Join(homeDir, "incoming", "file.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, data, content)
+	err = RejectStagedItem(user.Username, id)
+	require.NoError(t, err)
+	err = RejectStagedItem(user.Username, id)
+	assert.ErrorIs(t, err, util.ErrNotFound)
+	content, err = os.ReadFile(filepath.Join(homeDir, "incoming", "file.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, data, content)
+	assert.NoDirExists(t, filepath.Join(homeDir, "incoming", dataprovider.StagingDirName))
+	// publishing to a directory fails
+	err = os.Mkdir(filepath.Join(homeDir, "incoming", "dir"), os.ModePerm)
+	require.NoError(t, err)
+	id = upload("/incoming/dir", data)
+	err = PublishStagedItem(user.Username, id, "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	err = RejectStagedItem(user.Username, id)
+	assert.NoError(t, err)
+
+	err = dataprovider.DeleteUser(user.Username, "", "", "")
+	assert.NoError(t, err)
+	err = os.RemoveAll(homeDir)
+	assert.NoError(t, err)
+}
+
+func TestUploadStagingHook(t *testing.T) {
+	if runtime.GOOS == osWindows {
+		t.Skip("this test is not available on Windows")
+	}
+	homeDir := filepath.Join(os.TempDir(), "staging_hook_home")
+	err := os.MkdirAll(homeDir, os.ModePerm)
+	require.NoError(t, err)
+	hookPath := filepath.Join(os.TempDir(), "staging_hook.sh")
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "staging_hook_user",
+			HomeDir:  homeDir,
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+	}
+	user.Filters.StagingFolders = []string{"/"}
+	err = dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+	conn := NewBaseConnection("", ProtocolHTTP, "", "", user)
+
+	stagingHook := Config.StagingHook
+	Config.StagingHook = hookPath
+	defer func() {
+		Config.StagingHook = stagingHook
+	}()
+
+	upload := func(virtualPath string) string {
+		fs, fsPath, err := conn.GetFsAndResolvedPath(virtualPath)
+		require.NoError(t, err)
+		filePath, err := conn.GetUploadFsPath(fs, fsPath, virtualPath)
+		require.NoError(t, err)
+		err = os.WriteFile(filePath, []byte("data"), 0666)
+		require.NoError(t, err)
+		transfer := NewBaseTransfer(nil, conn, nil, fsPath, filePath, virtualPath, TransferUpload, 0, 0, 0, 0, true,
+			fs, dataprovider.TransferQuota{})
+		err = transfer.Close()
+		require.NoError(t, err)
+		return filepath.Base(filePath)
+	}
+
+	err = os.WriteFile(hookPath, []byte("#!/bin/sh\n\nexit 0"), 0755)
+	require.NoError(t, err)
+	upload("/file1")
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(homeDir, "file1"))
+		return err == nil
+	}, 2*time.Second, 50*time.Millisecond)
+
+	err = os.WriteFile(hookPath, []byte("#!/bin/sh\n\n[ \"$SFTPGO_STAGING_PATH\" = \"/file1\" ] && exit 0\nexit 1"), 0755)
+	require.NoError(t, err)
+	id := upload("/file2")
+	assert.Eventually(t, func() bool {
+		items, err := GetStagedItems(user.Username)
+		return err == nil && len(items) == 1 && items[0].Status == StagedItemStatusFailed
+	}, 2*time.Second, 50*time.Millisecond)
+	items, err := GetStagedItems(user.Username)
+	require.NoError(t, err)
+	if assert.Len(t, items, 1) {
+		assert.Equal(t, id, items[0].ID)
+		assert.NotEmpty(t, items[0].Message)
+	}
+	assert.NoFileExists(t, filepath.Join(homeDir, "file2"))
+	err = PublishStagedItem(user.Username, id, "")
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(homeDir, "file2"))
+
+	err = dataprovider.DeleteUser(user.Username, "", "", "")
+	assert.NoError(t, err)
+	err = os.RemoveAll(homeDir)
+	assert.NoError(t, err)
+	err = os.Remove(hookPath)
+	assert.NoError(t, err)
+}
+
+func TestStagingTransactionRollback(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "staging_tx_home")
+	err := os.MkdirAll(homeDir, os.ModePerm)
+	require.NoError(t, err)
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "staging_tx_user",
+			HomeDir:  homeDir,
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+	}
+	err = dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+	// the staging hook is not executed for the items in a transaction
+	oldHook := Config.StagingHook
+	Config.StagingHook = filepath.Join(os.TempDir(), "missing_staging_hook")
+	defer func() {
+		Config.StagingHook = oldHook
+	}()
+
+	txID := NewStagingTransactionID()
+	assert.NoError(t, ValidateStagingTransactionID(txID))
+	assert.ErrorIs(t, ValidateStagingTransactionID("invalid"), util.ErrValidation)
+	conn := NewBaseConnection("", ProtocolHTTP, "", "127.0.0.1:1234", user)
+	assert.False(t, conn.IsStagedUpload("/a.txt"))
+	conn.SetStagingTransaction(txID)
+	assert.True(t, conn.IsStagedUpload("/a.txt"))
+
+	oldContent := []byte("old content")
+	err = os.WriteFile(filepath.Join(homeDir, "a.txt"), oldContent, 0666)
+	require.NoError(t, err)
+	for _, name := range []string{"/a.txt", "/b.txt"} {
+		fs, fsPath, err := conn.GetFsAndResolvedPath(name)
+		require.NoError(t, err)
+		filePath, err := conn.GetUploadFsPath(fs, fsPath, name)
+		require.NoError(t, err)
+		err = os.WriteFile(filePath, []byte("new content"), 0666)
+		require.NoError(t, err)
+		transfer := NewBaseTransfer(nil, conn, nil, fsPath, filePath, name, TransferUpload, 0, 0, 0, 0, true,
+			fs, dataprovider.TransferQuota{})
+		transfer.BytesReceived.Store(11)
+		err = transfer.Close()
+		require.NoError(t, err)
+	}
+	tx, err := GetStagingTransaction(user.Username, txID)
+	require.NoError(t, err)
+	require.Len(t, tx.Items, 2)
+	assert.Equal(t, StagedItemStatusPending, tx.Items[0].Status)
+	assert.Equal(t, StagedItemStatusPending, tx.Items[1].Status)
+
+	var entries []*stagedTxEntry
+	for idx := range tx.Items {
+		entry, err := newStagedTxEntry(conn, &tx.Items[idx])
+		require.NoError(t, err)
+		entries = append(entries, entry)
+	}
+	assert.Equal(t, int64(len(oldContent)), entries[0].replacedSize)
+	assert.Equal(t, int64(-1), entries[1].replacedSize)
+	// the second item cannot be published, the first one must be rolled back
+	err = os.Remove(entries[1].stagingPath)
+	require.NoError(t, err)
+	err = publishStagedTxEntries(conn, entries)
+	assert.Error(t, err)
+	data, err := os.ReadFile(filepath.Join(homeDir, "a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, oldContent, data)
+	assert.FileExists(t, entries[0].stagingPath)
+	assert.NoFileExists(t, entries[0].backupPath)
+	assert.NoFileExists(t, filepath.Join(homeDir, "b.txt"))
+	// a commit fails without changes too
+	_, err = CommitStagingTransaction(user.Username, txID)
+	assert.Error(t, err)
+	data, err = os.ReadFile(filepath.Join(homeDir, "a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, oldContent, data)
+
+	removed, err := AbortStagingTransaction(user.Username, txID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	_, err = GetStagingTransaction(user.Username, txID)
+	assert.ErrorIs(t, err, util.ErrNotFound)
+	assert.NoDirExists(t, filepath.Join(homeDir, dataprovider.StagingDirName))
+
+	err = dataprovider.DeleteUser(user.Username, "", "", "")
+	assert.NoError(t, err)
+	err = os.RemoveAll(homeDir)
+	assert.NoError(t, err)
+}
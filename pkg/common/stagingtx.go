@@ -0,0 +1,324 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+// StagingTransaction groups the staged uploads that must be published together.
+// A transaction exists as long as it has staged items
+type StagingTransaction struct {
+	// Unique identifier
+	ID string `json:"id"`
+	// Staged uploads included in the transaction
+	Items []StagedItem `json:"items"`
+}
+
+// NewStagingTransactionID returns the identifier for a new staging transaction
+func NewStagingTransactionID() string {
+	return xid.New().String()
+}
+
+// ValidateStagingTransactionID returns an error if the specified identifier
+// was not generated by NewStagingTransactionID
+func ValidateStagingTransactionID(id string) error {
+	if _, err := xid.FromString(id); err != nil {
+		return util.NewValidationError(fmt.Sprintf("invalid staging transaction %q", id))
+	}
+	return nil
+}
+
+// SetStagingTransaction sets the staging transaction for the uploads of this
+// connection, they are staged and published when the transaction is committed
+func (c *BaseConnection) SetStagingTransaction(id string) {
+	c.stagingTx = id
+}
+
+// GetStagingTransactions returns the open staging transactions for the specified user
+func GetStagingTransactions(username string) ([]StagingTransaction, error) {
+	items, err := GetStagedItems(username)
+	if err != nil {
+		return nil, err
+	}
+	transactions := make(map[string][]StagedItem)
+	for _, item := range items {
+		if item.Transaction != "" {
+			transactions[item.Transaction] = append(transactions[item.Transaction], item)
+		}
+	}
+	result := make([]StagingTransaction, 0, len(transactions))
+	for id, txItems := range transactions {
+		sortStagedItems(txItems)
+		result = append(result, StagingTransaction{
+			ID:    id,
+			Items: txItems,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result, nil
+}
+
+// GetStagingTransaction returns the specified staging transaction
+func GetStagingTransaction(username, id string) (StagingTransaction, error) {
+	items, err := GetStagedItems(username)
+	if err != nil {
+		return StagingTransaction{}, err
+	}
+	tx := StagingTransaction{
+		ID: id,
+	}
+	for _, item := range items {
+		if item.Transaction == id {
+			tx.Items = append(tx.Items, item)
+		}
+	}
+	if len(tx.Items) == 0 {
+		return tx, util.NewRecordNotFoundError(fmt.Sprintf("staging transaction %q does not exist", id))
+	}
+	sortStagedItems(tx.Items)
+	return tx, nil
+}
+
+// sortStagedItems sorts the items by upload order, the IDs are sortable by creation time
+func sortStagedItems(items []StagedItem) {
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].ID < items[j].ID
+	})
+}
+
+// lockStagingTransaction prevents concurrent operations on the transaction and
+// on its items. The returned function releases the locks
+func lockStagingTransaction(tx *StagingTransaction) (func(), error) {
+	if !stagingOps.add(tx.ID) {
+		return nil, errStagedItemBusy
+	}
+	locked := []string{tx.ID}
+	unlock := func() {
+		for _, id := range locked {
+			stagingOps.remove(id)
+		}
+	}
+	for _, item := range tx.Items {
+		if !stagingOps.add(item.ID) {
+			unlock()
+			return nil, errStagedItemBusy
+		}
+		locked = append(locked, item.ID)
+	}
+	return unlock, nil
+}
+
+// stagedTxEntry is a staged item to publish while committing a transaction
+type stagedTxEntry struct {
+	item         *StagedItem
+	fs           vfs.Fs
+	fsPath       string
+	stagingPath  string
+	backupPath   string
+	replacedSize int64
+	backedUp     bool
+	published    bool
+}
+
+func newStagedTxEntry(conn *BaseConnection, item *StagedItem) (*stagedTxEntry, error) {
+	fs, fsPath, err := conn.GetFsAndResolvedPath(item.Path)
+	if err != nil {
+		return nil, err
+	}
+	stagingPath, err := fs.ResolvePath(item.getStagingPath())
+	if err != nil {
+		return nil, conn.GetFsError(fs, err)
+	}
+	if _, err := fs.Stat(stagingPath); err != nil {
+		return nil, conn.GetFsError(fs, err)
+	}
+	entry := &stagedTxEntry{
+		item:         item,
+		fs:           fs,
+		fsPath:       fsPath,
+		stagingPath:  stagingPath,
+		backupPath:   stagingPath + ".replaced",
+		replacedSize: -1,
+	}
+	if info, err := fs.Lstat(fsPath); err == nil {
+		if info.IsDir() {
+			return nil, util.NewValidationError(fmt.Sprintf("cannot publish %q, the target path is a directory", item.Path))
+		}
+		if err := conn.CheckWORMProtection(item.Path, info); err != nil {
+			return nil, err
+		}
+		entry.replacedSize = info.Size()
+	}
+	return entry, nil
+}
+
+// CommitStagingTransaction publishes all the staged items in the specified
+// transaction or none of them. The existing files are moved aside and restored
+// if an item cannot be published. If the same path was uploaded more than
+// once the last upload is published. It returns the number of published files
+func CommitStagingTransaction(username, id string) (int, error) {
+	tx, err := GetStagingTransaction(username, id)
+	if err != nil {
+		return 0, err
+	}
+	unlock, err := lockStagingTransaction(&tx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	conn, err := getStagingConnection(username, &tx.Items[0])
+	if err != nil {
+		return 0, err
+	}
+	defer conn.User.CloseFs() //nolint:errcheck
+
+	// items are sorted by upload order, the last upload for each path wins
+	latest := make(map[string]int)
+	for idx := range tx.Items {
+		latest[tx.Items[idx].Path] = idx
+	}
+	var entries []*stagedTxEntry
+	var superseded []*StagedItem
+	for idx := range tx.Items {
+		item := &tx.Items[idx]
+		if latest[item.Path] != idx {
+			superseded = append(superseded, item)
+			continue
+		}
+		entry, err := newStagedTxEntry(conn, item)
+		if err != nil {
+			conn.Log(logger.LevelError, "unable to commit staging transaction %q, item %q: %v", id, item.ID, err)
+			return 0, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := publishStagedTxEntries(conn, entries); err != nil {
+		conn.Log(logger.LevelError, "unable to commit staging transaction %q: %v", id, err)
+		return 0, err
+	}
+	for _, entry := range entries {
+		finalizeStagedTxEntry(conn, entry)
+	}
+	for _, item := range superseded {
+		if err := rejectStagedItem(conn, item); err != nil {
+			conn.Log(logger.LevelWarn, "unable to remove superseded staged item %q: %v", item.ID, err)
+		}
+	}
+	conn.Log(logger.LevelInfo, "staging transaction %q committed, published files: %d", id, len(entries))
+	return len(entries), nil
+}
+
+func publishStagedTxEntries(conn *BaseConnection, entries []*stagedTxEntry) error {
+	for _, entry := range entries {
+		if entry.replacedSize >= 0 {
+			if _, _, err := entry.fs.Rename(entry.fsPath, entry.backupPath); err != nil {
+				rollbackStagedTxEntries(conn, entries)
+				return conn.GetFsError(entry.fs, err)
+			}
+			entry.backedUp = true
+		}
+		if _, _, err := entry.fs.Rename(entry.stagingPath, entry.fsPath); err != nil {
+			rollbackStagedTxEntries(conn, entries)
+			return conn.GetFsError(entry.fs, err)
+		}
+		entry.published = true
+	}
+	return nil
+}
+
+func rollbackStagedTxEntries(conn *BaseConnection, entries []*stagedTxEntry) {
+	for idx := len(entries) - 1; idx >= 0; idx-- {
+		entry := entries[idx]
+		if entry.published {
+			if _, _, err := entry.fs.Rename(entry.fsPath, entry.stagingPath); err != nil {
+				conn.Log(logger.LevelError, "unable to rollback published item %q: %v", entry.item.ID, err)
+			}
+			entry.published = false
+		}
+		if entry.backedUp {
+			if _, _, err := entry.fs.Rename(entry.backupPath, entry.fsPath); err != nil {
+				conn.Log(logger.LevelError, "unable to restore file %q replaced by staged item %q: %v",
+					entry.fsPath, entry.item.ID, err)
+			}
+			entry.backedUp = false
+		}
+	}
+}
+
+// finalizeStagedTxEntry removes the replaced file and the staging metadata for
+// a published item and executes the upload actions
+func finalizeStagedTxEntry(conn *BaseConnection, entry *stagedTxEntry) {
+	item := entry.item
+	if entry.backedUp {
+		if err := entry.fs.Remove(entry.backupPath, false); err != nil {
+			conn.Log(logger.LevelWarn, "unable to remove file %q replaced by staged item %q: %v",
+				entry.backupPath, item.ID, err)
+		}
+		conn.updateQuotaAfterRemove(item.Path, entry.replacedSize)
+	}
+	removeStagedItemMetadata(conn, entry.fs, item)
+	var err error
+	if item.SHA256 != "" {
+		err = setFileChecksum(conn.User.Username, item.Path, item.SHA256, item.Size)
+	} else if entry.backedUp {
+		err = removeFileChecksum(conn.User.Username, item.Path)
+	}
+	if err != nil {
+		conn.Log(logger.LevelWarn, "unable to update the checksum for published item %q: %v", item.ID, err)
+	}
+	conn.Log(logger.LevelInfo, "staged item %q published to %q", item.ID, item.Path)
+	ExecuteActionNotification(conn, operationUpload, entry.fsPath, item.Path, "", "", "", item.Size, nil, 0) //nolint:errcheck
+}
+
+// AbortStagingTransaction removes all the staged items in the specified
+// transaction. It returns the number of removed files
+func AbortStagingTransaction(username, id string) (int, error) {
+	tx, err := GetStagingTransaction(username, id)
+	if err != nil {
+		return 0, err
+	}
+	unlock, err := lockStagingTransaction(&tx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	conn, err := getStagingConnection(username, &tx.Items[0])
+	if err != nil {
+		return 0, err
+	}
+	defer conn.User.CloseFs() //nolint:errcheck
+
+	removed := 0
+	for idx := range tx.Items {
+		if err := rejectStagedItem(conn, &tx.Items[idx]); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	conn.Log(logger.LevelInfo, "staging transaction %q aborted, removed files: %d", id, removed)
+	return removed, nil
+}
@@ -0,0 +1,206 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+// tieringCheck moves the files matching the configured policies from
+// the user's local filesystem to the cold storage folder
+type tieringCheck struct {
+	conn       *BaseConnection
+	config     dataprovider.EventActionTieringConfig
+	now        time.Time
+	movedFiles int
+	movedSize  int64
+}
+
+// getPolicy returns the most specific policy for the specified directory
+func (c *tieringCheck) getPolicy(dirPath string) (dataprovider.TieringPolicy, bool) {
+	for _, p := range util.GetDirsForVirtualPath(dirPath) {
+		for _, policy := range c.config.Policies {
+			if policy.Path == p {
+				return policy, true
+			}
+		}
+	}
+	return dataprovider.TieringPolicy{}, false
+}
+
+func (c *tieringCheck) hasPolicy(dirPath string) bool {
+	for _, policy := range c.config.Policies {
+		if policy.Path == dirPath {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *tieringCheck) isEligible(policy *dataprovider.TieringPolicy, info os.FileInfo) bool {
+	if !info.Mode().IsRegular() || info.Size() == 0 || info.Size() < policy.MinSize {
+		return false
+	}
+	if policy.MinAge > 0 && info.ModTime().After(c.now.Add(-time.Duration(policy.MinAge)*time.Hour)) {
+		return false
+	}
+	if policy.MinIdleTime > 0 &&
+		vfs.GetFileAccessTime(info).After(c.now.Add(-time.Duration(policy.MinIdleTime)*time.Hour)) {
+		return false
+	}
+	return true
+}
+
+func (c *tieringCheck) checkFolder(folderPath string) error {
+	policy, ok := c.getPolicy(folderPath)
+	if !ok || policy.IsExcluded() {
+		return nil
+	}
+	files, err := c.conn.ListDir(folderPath)
+	if err != nil {
+		if err == c.conn.GetNotExistError() {
+			c.conn.Log(logger.LevelDebug, "folder %q does not exist, tiering skipped", folderPath)
+			return nil
+		}
+		return fmt.Errorf("unable to list directory %q: %w", folderPath, err)
+	}
+	for _, info := range files {
+		virtualPath := path.Join(folderPath, info.Name())
+		if info.IsDir() {
+			// directories with a specific policy are checked separately, virtual
+			// folders are never tiered
+			if c.hasPolicy(virtualPath) || c.conn.User.IsVirtualFolder(virtualPath) {
+				continue
+			}
+			if err := c.checkFolder(virtualPath); err != nil {
+				return err
+			}
+			continue
+		}
+		if !c.isEligible(&policy, info) {
+			continue
+		}
+		if err := c.moveFile(virtualPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *tieringCheck) moveFile(virtualPath string) error {
+	fs, fsPath, err := c.conn.GetFsAndResolvedPath(virtualPath)
+	if err != nil {
+		return err
+	}
+	tieredFs, ok := fs.(*vfs.TieredFs)
+	if !ok {
+		return nil
+	}
+	moved, err := tieredFs.TierFile(fsPath, c.config.Folder, c.conn.User.Username)
+	if err != nil {
+		return fmt.Errorf("unable to move file %q: %w", virtualPath, err)
+	}
+	if moved {
+		info, err := fs.Stat(fsPath)
+		if err == nil {
+			c.movedSize += info.Size()
+		}
+		c.movedFiles++
+		c.conn.Log(logger.LevelDebug, "file %q moved to the cold storage folder %q", virtualPath, c.config.Folder)
+	}
+	return nil
+}
+
+func (c *tieringCheck) start() error {
+	startTime := time.Now()
+	c.now = startTime
+	for _, policy := range c.config.Policies {
+		if err := c.checkFolder(policy.Path); err != nil {
+			c.conn.Log(logger.LevelError, "tiering failed after moving %d files, size %d: %v",
+				c.movedFiles, c.movedSize, err)
+			return err
+		}
+	}
+	c.conn.Log(logger.LevelInfo, "tiering completed, moved files: %d, moved size: %d, elapsed: %s",
+		c.movedFiles, c.movedSize, time.Since(startTime))
+	return nil
+}
+
+func executeTieringForUser(user dataprovider.User, config dataprovider.EventActionTieringConfig) error {
+	user, err := getUserForEventAction(user)
+	if err != nil {
+		return err
+	}
+	connectionID := fmt.Sprintf("%s_%s", protocolEventAction, xid.New().String())
+	err = user.CheckFsRoot(connectionID)
+	defer user.CloseFs() //nolint:errcheck
+	if err != nil {
+		return fmt.Errorf("tiering error, unable to check root fs for user %q: %w", user.Username, err)
+	}
+	check := tieringCheck{
+		conn:   NewBaseConnection(connectionID, protocolEventAction, "", "", user),
+		config: config,
+	}
+	if err := check.start(); err != nil {
+		return fmt.Errorf("tiering error for user %q: %w", user.Username, err)
+	}
+	return nil
+}
+
+func executeTieringRuleAction(config dataprovider.EventActionTieringConfig,
+	conditions dataprovider.ConditionOptions, params *EventParams,
+) error {
+	users, err := params.getUsers()
+	if err != nil {
+		return fmt.Errorf("unable to get users: %w", err)
+	}
+	var failures []string
+	executed := 0
+	for _, user := range users {
+		// if sender is set, the conditions have already been evaluated
+		if params.sender == "" {
+			if !checkUserConditionOptions(&user, &conditions) {
+				eventManagerLog(logger.LevelDebug, "skipping tiering for user %s, condition options don't match",
+					user.Username)
+				continue
+			}
+		}
+		executed++
+		if err = executeTieringForUser(user, config); err != nil {
+			params.AddError(err)
+			failures = append(failures, user.Username)
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("tiering failed for users: %s", strings.Join(failures, ", "))
+	}
+	if executed == 0 {
+		eventManagerLog(logger.LevelError, "no tiering executed")
+		return errors.New("no tiering executed")
+	}
+	return nil
+}
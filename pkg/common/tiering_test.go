@@ -0,0 +1,263 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+func TestTieringActionValidation(t *testing.T) {
+	action := dataprovider.BaseEventAction{
+		Name: "tiering action",
+		Type: dataprovider.ActionTypeTiering,
+	}
+	err := dataprovider.AddEventAction(&action, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	action.Options.TieringConfig.Folder = "cold"
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	action.Options.TieringConfig.Policies = []dataprovider.TieringPolicy{
+		{
+			Path:   "/",
+			MinAge: -1,
+		},
+	}
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	action.Options.TieringConfig.Policies = []dataprovider.TieringPolicy{
+		{
+			Path:    "/",
+			MinSize: 100,
+		},
+	}
+	// only exclusions, nothing to move
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	action.Options.TieringConfig.Policies = []dataprovider.TieringPolicy{
+		{
+			Path:   "/",
+			MinAge: 1,
+		},
+		{
+			Path:        "/",
+			MinIdleTime: 1,
+		},
+	}
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	action.Options.TieringConfig.Policies = []dataprovider.TieringPolicy{
+		{
+			Path:   "sub/",
+			MinAge: 1,
+		},
+	}
+	action.Options.RetentionConfig.Folders = []dataprovider.FolderRetention{
+		{
+			Path:      "/",
+			Retention: 10,
+		},
+	}
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	require.NoError(t, err)
+	assert.Len(t, action.Options.RetentionConfig.Folders, 0)
+	action, err = dataprovider.EventActionExists(action.Name)
+	require.NoError(t, err)
+	assert.Equal(t, "cold", action.Options.TieringConfig.Folder)
+	if assert.Len(t, action.Options.TieringConfig.Policies, 1) {
+		assert.Equal(t, "/sub", action.Options.TieringConfig.Policies[0].Path)
+	}
+	err = dataprovider.DeleteEventAction(action.Name, "", "", "")
+	assert.NoError(t, err)
+}
+
+func TestTieringFs(t *testing.T) {
+	if runtime.GOOS == osWindows {
+		t.Skip("this test is not available on Windows")
+	}
+	baseDir := filepath.Join(os.TempDir(), "tiering_test")
+	homeDir := filepath.Join(baseDir, "home")
+	coldDir := filepath.Join(baseDir, "cold")
+	require.NoError(t, os.MkdirAll(filepath.Join(homeDir, "sub"), os.ModePerm))
+	require.NoError(t, os.MkdirAll(filepath.Join(homeDir, "excluded"), os.ModePerm))
+	defer os.RemoveAll(baseDir)
+
+	folder := vfs.BaseVirtualFolder{
+		Name:       "tiering_cold",
+		MappedPath: coldDir,
+	}
+	err := dataprovider.AddFolder(&folder, "", "", "")
+	require.NoError(t, err)
+	defer dataprovider.DeleteFolder(folder.Name, "", "", "") //nolint:errcheck
+
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "tiering_user",
+			HomeDir:  homeDir,
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+	}
+	err = dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+	defer dataprovider.DeleteUser(user.Username, "", "", "") //nolint:errcheck
+
+	conn := NewBaseConnection("", ProtocolSFTP, "", "", user)
+	fs, _, err := conn.GetFsAndResolvedPath("/")
+	require.NoError(t, err)
+	_, ok := fs.(*vfs.TieredFs)
+	require.True(t, ok)
+	assert.True(t, vfs.IsLocalOsFs(fs))
+
+	data := util.GenerateRandomBytes(65535)
+	oldTime := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	writeFile := func(name string, contents []byte, modTime time.Time) string {
+		fsPath := filepath.Join(homeDir, name)
+		require.NoError(t, os.WriteFile(fsPath, contents, 0640))
+		require.NoError(t, os.Chtimes(fsPath, modTime, modTime))
+		return fsPath
+	}
+	isStub := func(fsPath string) bool {
+		_, err := dataprovider.GetFileMetadata(user.Username, "/"+filepath.ToSlash(fsPath[len(homeDir)+1:]))
+		return err == nil
+	}
+	countColdObjects := func() int {
+		matches, err := filepath.Glob(filepath.Join(coldDir, user.Username, "*"))
+		require.NoError(t, err)
+		return len(matches)
+	}
+	readFile := func(fsPath string) []byte {
+		f, _, _, err := fs.Open(fsPath, 0)
+		require.NoError(t, err)
+		defer f.Close()
+		contents, err := io.ReadAll(f)
+		require.NoError(t, err)
+		return contents
+	}
+
+	file1 := writeFile("file1.bin", data, oldTime)
+	file2 := writeFile("file2.bin", data, time.Now())
+	file3 := writeFile("sub/file3.bin", data, oldTime)
+	file4 := writeFile("sub/small.bin", []byte("small"), oldTime)
+	file5 := writeFile("excluded/file5.bin", data, oldTime)
+
+	config := dataprovider.EventActionTieringConfig{
+		Folder: folder.Name,
+		Policies: []dataprovider.TieringPolicy{
+			{
+				Path:   "/",
+				MinAge: 24,
+			},
+			{
+				Path: "/excluded",
+			},
+			{
+				Path:    "/sub",
+				MinAge:  1,
+				MinSize: 100,
+			},
+		},
+	}
+	// the cold storage folder must exist
+	err = executeTieringForUser(user, dataprovider.EventActionTieringConfig{
+		Folder:   "missing folder",
+		Policies: config.Policies,
+	})
+	assert.Error(t, err)
+	err = executeTieringForUser(user, config)
+	require.NoError(t, err)
+	assert.True(t, isStub(file1))
+	assert.False(t, isStub(file2))
+	assert.True(t, isStub(file3))
+	assert.False(t, isStub(file4))
+	assert.False(t, isStub(file5))
+	assert.Equal(t, 2, countColdObjects())
+	// stubs have the original size and modification time
+	info, err := os.Stat(file1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), info.Size())
+	assert.True(t, info.ModTime().Equal(oldTime))
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	// stubs are not moved again
+	err = executeTieringForUser(user, config)
+	require.NoError(t, err)
+	assert.Equal(t, 2, countColdObjects())
+	// reading a stub recalls the file
+	assert.Equal(t, data, readFile(file1))
+	assert.False(t, isStub(file1))
+	assert.Equal(t, 1, countColdObjects())
+	info, err = os.Stat(file1)
+	require.NoError(t, err)
+	assert.True(t, info.ModTime().Equal(oldTime))
+	// changing the modification time keeps the stub valid
+	newTime := oldTime.Add(-time.Hour)
+	require.NoError(t, fs.Chtimes(file3, newTime, newTime, false))
+	assert.True(t, isStub(file3))
+	assert.Equal(t, data, readFile(file3))
+	assert.Equal(t, 0, countColdObjects())
+	// overwriting a stub releases the cold object
+	err = executeTieringForUser(user, config)
+	require.NoError(t, err)
+	assert.Equal(t, 2, countColdObjects())
+	f, _, _, err := fs.Create(file1, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("overwritten"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	assert.False(t, isStub(file1))
+	assert.Equal(t, 1, countColdObjects())
+	// removing a stub releases the cold object
+	require.NoError(t, fs.Remove(file3, false))
+	assert.Equal(t, 0, countColdObjects())
+	// renamed stubs are still recalled
+	file3 = writeFile("sub/file3.bin", data, oldTime)
+	err = executeTieringForUser(user, config)
+	require.NoError(t, err)
+	assert.True(t, isStub(file3))
+	renamed := filepath.Join(homeDir, "renamed.bin")
+	err = conn.Rename("/sub/file3.bin", "/renamed.bin")
+	require.NoError(t, err)
+	assert.Equal(t, data, readFile(renamed))
+	assert.Equal(t, 0, countColdObjects())
+	// files accessed recently are not moved
+	config.Policies = []dataprovider.TieringPolicy{
+		{
+			Path:        "/",
+			MinIdleTime: 1,
+		},
+	}
+	require.NoError(t, os.Chtimes(file2, time.Now(), oldTime))
+	require.NoError(t, os.Chtimes(renamed, oldTime, oldTime))
+	err = executeTieringForUser(user, config)
+	require.NoError(t, err)
+	assert.False(t, isStub(file2))
+	assert.True(t, isStub(renamed))
+	assert.True(t, isStub(file5))
+	assert.Equal(t, 3, countColdObjects())
+}
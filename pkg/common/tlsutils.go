@@ -39,13 +39,32 @@ const (
 
 var (
 	pemCRLPrefix = []byte("-----BEGIN X509 CRL")
+	// function to obtain a certificate, for the specified server name, on demand
+	onDemandCertificateFn func(serverName string) (*tls.Certificate, error)
 )
 
+// SetOnDemandCertificateFn sets the function to call to obtain a certificate,
+// for a server name requested by a TLS client, on demand
+func SetOnDemandCertificateFn(fn func(serverName string) (*tls.Certificate, error)) {
+	onDemandCertificateFn = fn
+}
+
+// SNICertificate defines an additional certificate for a binding. Additional
+// certificates are selected based on the server name requested by the client
+type SNICertificate struct {
+	CertificateFile    string `json:"certificate_file" mapstructure:"certificate_file"`
+	CertificateKeyFile string `json:"certificate_key_file" mapstructure:"certificate_key_file"`
+}
+
 // TLSKeyPair defines the paths and the unique identifier for a TLS key pair
 type TLSKeyPair struct {
 	Cert string
 	Key  string
 	ID   string
+	// SNI defines an additional key pair for the ID, selected based on the
+	// server name requested by the client. Multiple SNI key pairs are allowed
+	// for the same ID
+	SNI bool
 }
 
 // CertManager defines a TLS certificate manager
@@ -58,6 +77,7 @@ type CertManager struct {
 	caRevocationLists []string
 	monitorList       []string
 	certs             map[string]*tls.Certificate
+	sniCerts          map[string][]*tls.Certificate
 	certsInfo         map[string]fs.FileInfo
 	rootCAs           *x509.CertPool
 	crls              []*x509.RevocationList
@@ -80,6 +100,7 @@ func (m *CertManager) loadCertificates() error {
 		return errors.New("no key pairs defined")
 	}
 	certs := make(map[string]*tls.Certificate)
+	sniCerts := make(map[string][]*tls.Certificate)
 	for _, keyPair := range m.keyPairs {
 		if keyPair.ID == "" {
 			return errors.New("TLS certificate without ID")
@@ -90,21 +111,35 @@ func (m *CertManager) loadCertificates() error {
 				keyPair.Cert, keyPair.Key, err)
 			return err
 		}
+		if !util.Contains(m.monitorList, keyPair.Cert) {
+			m.monitorList = append(m.monitorList, keyPair.Cert)
+		}
+		if keyPair.SNI {
+			if newCert.Leaf == nil {
+				newCert.Leaf, err = x509.ParseCertificate(newCert.Certificate[0])
+				if err != nil {
+					logger.Error(m.logSender, "", "unable to parse certificate %q: %v", keyPair.Cert, err)
+					return err
+				}
+			}
+			logger.Debug(m.logSender, "", "SNI certificate %q successfully loaded, id %v, DNS names: %v",
+				keyPair.Cert, keyPair.ID, newCert.Leaf.DNSNames)
+			sniCerts[keyPair.ID] = append(sniCerts[keyPair.ID], &newCert)
+			continue
+		}
 		if _, ok := certs[keyPair.ID]; ok {
 			logger.Error(m.logSender, "", "TLS certificate with id %q is duplicated", keyPair.ID)
 			return fmt.Errorf("TLS certificate with id %q is duplicated", keyPair.ID)
 		}
 		logger.Debug(m.logSender, "", "TLS certificate %q successfully loaded, id %v", keyPair.Cert, keyPair.ID)
 		certs[keyPair.ID] = &newCert
-		if !util.Contains(m.monitorList, keyPair.Cert) {
-			m.monitorList = append(m.monitorList, keyPair.Cert)
-		}
 	}
 
 	m.Lock()
 	defer m.Unlock()
 
 	m.certs = certs
+	m.sniCerts = sniCerts
 	return nil
 }
 
@@ -124,6 +159,47 @@ func (m *CertManager) GetCertificateFunc(certID string) func(*tls.ClientHelloInf
 	}
 }
 
+// GetCertificateFuncWithSNI returns a function that selects, based on the server
+// name requested by the client, one of the SNI certificates loaded for sniID.
+// If no SNI certificate matches and onDemand is true, a certificate for the
+// requested server name is obtained on demand, if allowed. The certificate for
+// certID is returned otherwise
+func (m *CertManager) GetCertificateFuncWithSNI(certID, sniID string,
+	onDemand bool,
+) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	getCertificate := m.GetCertificateFunc(certID)
+
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName == "" {
+			return getCertificate(hello)
+		}
+		if cert := m.getSNICertificate(sniID, hello.ServerName); cert != nil {
+			return cert, nil
+		}
+		if onDemand && onDemandCertificateFn != nil {
+			cert, err := onDemandCertificateFn(hello.ServerName)
+			if err == nil {
+				return cert, nil
+			}
+			logger.Debug(m.logSender, "", "unable to get on demand certificate for server name %q: %v",
+				hello.ServerName, err)
+		}
+		return getCertificate(hello)
+	}
+}
+
+func (m *CertManager) getSNICertificate(sniID, serverName string) *tls.Certificate {
+	m.RLock()
+	defer m.RUnlock()
+
+	for _, cert := range m.sniCerts[sniID] {
+		if cert.Leaf.VerifyHostname(serverName) == nil {
+			return cert
+		}
+	}
+	return nil
+}
+
 // IsRevoked returns true if the specified certificate has been revoked
 func (m *CertManager) IsRevoked(crt *x509.Certificate, caCrt *x509.Certificate) bool {
 	m.RLock()
@@ -291,6 +367,7 @@ func NewCertManager(keyPairs []TLSKeyPair, configDir, logSender string) (*CertMa
 		configDir: configDir,
 		logSender: logSender,
 		certs:     make(map[string]*tls.Certificate),
+		sniCerts:  make(map[string][]*tls.Certificate),
 		certsInfo: make(map[string]fs.FileInfo),
 	}
 	err := manager.loadCertificates()
@@ -15,8 +15,15 @@
 package common
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
 	"os"
 	"path/filepath"
 	"testing"
@@ -522,3 +529,125 @@ func TestCertificateMonitor(t *testing.T) {
 	err = os.Remove(keyPath)
 	assert.NoError(t, err)
 }
+
+func TestSNICertificates(t *testing.T) {
+	startEventScheduler()
+	defer stopEventScheduler()
+
+	certPath := filepath.Join(os.TempDir(), "test.crt")
+	keyPath := filepath.Join(os.TempDir(), "test.key")
+	sniCertPath := filepath.Join(os.TempDir(), "testsni.crt")
+	sniKeyPath := filepath.Join(os.TempDir(), "testsni.key")
+	err := os.WriteFile(certPath, []byte(serverCert), os.ModePerm)
+	assert.NoError(t, err)
+	err = os.WriteFile(keyPath, []byte(serverKey), os.ModePerm)
+	assert.NoError(t, err)
+	sniCert, sniKey := generateTestCertificate(t, "sni.example.com", "*.sni.example.net")
+	err = os.WriteFile(sniCertPath, sniCert, os.ModePerm)
+	assert.NoError(t, err)
+	err = os.WriteFile(sniKeyPath, sniKey, os.ModePerm)
+	assert.NoError(t, err)
+
+	sniID := "127.0.0.1:443"
+	keyPairs := []TLSKeyPair{
+		{
+			Cert: certPath,
+			Key:  keyPath,
+			ID:   DefaultTLSKeyPaidID,
+		},
+		{
+			Cert: sniCertPath,
+			Key:  sniKeyPath,
+			ID:   sniID,
+			SNI:  true,
+		},
+		{
+			Cert: sniCertPath,
+			Key:  sniKeyPath,
+			ID:   sniID,
+			SNI:  true,
+		},
+	}
+	certManager, err := NewCertManager(keyPairs, configDir, logSenderTest)
+	require.NoError(t, err)
+	assert.Len(t, certManager.certs, 1)
+	assert.Len(t, certManager.sniCerts[sniID], 2)
+	assert.Len(t, certManager.monitorList, 2)
+
+	certFunc := certManager.GetCertificateFuncWithSNI(DefaultTLSKeyPaidID, sniID, false)
+	cert, err := certFunc(&tls.ClientHelloInfo{ServerName: "sni.example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, certManager.sniCerts[sniID][0], cert)
+	cert, err = certFunc(&tls.ClientHelloInfo{ServerName: "a.sni.example.net"})
+	assert.NoError(t, err)
+	assert.Equal(t, certManager.sniCerts[sniID][0], cert)
+	cert, err = certFunc(&tls.ClientHelloInfo{ServerName: "sni.example.net"})
+	assert.NoError(t, err)
+	assert.Equal(t, certManager.certs[DefaultTLSKeyPaidID], cert)
+	cert, err = certFunc(&tls.ClientHelloInfo{})
+	assert.NoError(t, err)
+	assert.Equal(t, certManager.certs[DefaultTLSKeyPaidID], cert)
+	// SNI certificates are not shared among different IDs
+	certFunc = certManager.GetCertificateFuncWithSNI(DefaultTLSKeyPaidID, DefaultTLSKeyPaidID, false)
+	cert, err = certFunc(&tls.ClientHelloInfo{ServerName: "sni.example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, certManager.certs[DefaultTLSKeyPaidID], cert)
+
+	onDemandCert := &tls.Certificate{}
+	SetOnDemandCertificateFn(func(serverName string) (*tls.Certificate, error) {
+		if serverName == "ondemand.example.com" {
+			return onDemandCert, nil
+		}
+		return nil, errors.New("not allowed")
+	})
+	defer SetOnDemandCertificateFn(nil)
+
+	certFunc = certManager.GetCertificateFuncWithSNI(DefaultTLSKeyPaidID, sniID, false)
+	cert, err = certFunc(&tls.ClientHelloInfo{ServerName: "ondemand.example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, certManager.certs[DefaultTLSKeyPaidID], cert)
+	certFunc = certManager.GetCertificateFuncWithSNI(DefaultTLSKeyPaidID, sniID, true)
+	cert, err = certFunc(&tls.ClientHelloInfo{ServerName: "ondemand.example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, onDemandCert, cert)
+	cert, err = certFunc(&tls.ClientHelloInfo{ServerName: "sni.example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, certManager.sniCerts[sniID][0], cert)
+	cert, err = certFunc(&tls.ClientHelloInfo{ServerName: "other.example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, certManager.certs[DefaultTLSKeyPaidID], cert)
+	certFunc = certManager.GetCertificateFuncWithSNI("unknownID", sniID, true)
+	_, err = certFunc(&tls.ClientHelloInfo{ServerName: "other.example.com"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no certificate for id unknownID")
+	}
+
+	err = os.Remove(certPath)
+	assert.NoError(t, err)
+	err = os.Remove(keyPath)
+	assert.NoError(t, err)
+	err = os.Remove(sniCertPath)
+	assert.NoError(t, err)
+	err = os.Remove(sniKeyPath)
+	assert.NoError(t, err)
+}
+
+func generateTestCertificate(t *testing.T, dnsNames ...string) ([]byte, []byte) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(privateKey)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
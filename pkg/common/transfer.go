@@ -21,9 +21,14 @@ import (
 	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+
 	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
 	"github.com/drakkan/sftpgo/v2/pkg/logger"
 	"github.com/drakkan/sftpgo/v2/pkg/metric"
+	"github.com/drakkan/sftpgo/v2/pkg/tracing"
 	"github.com/drakkan/sftpgo/v2/pkg/vfs"
 )
 
@@ -51,16 +56,43 @@ type BaseTransfer struct { //nolint:maligned
 	InitialSize     int64
 	truncatedSize   int64
 	isNewFile       bool
+	staged          bool
+	checksum        *transferChecksum
+	mimePolicy      *vfs.MIMEPolicy
+	sniffer         *contentSniffer
+	contentDenied   atomic.Bool
 	transferType    int
 	AbortTransfer   atomic.Bool
 	aTime           time.Time
 	mTime           time.Time
 	transferQuota   dataprovider.TransferQuota
+	throttle        transferThrottle
+	folder          *folderTransfers
+	folderThrottled atomic.Int64
+	folderRemoved   atomic.Bool
+	errFolderLimit  error
+	qosClass        *qosClassState
+	qosThrottled    atomic.Int64
+	qosRemoved      atomic.Bool
+	adminLimiter    atomic.Pointer[rate.Limiter]
+	adminThrottled  atomic.Int64
+	span            trace.Span
 	sync.Mutex
 	errAbort    error
 	ErrTransfer error
 }
 
+// transferThrottle tracks the scheduled bandwidth limit for a transfer.
+// The limit is evaluated again at the start of each hour and, if it changes,
+// the throttling restarts from the bytes transferred so far
+type transferThrottle struct {
+	sync.Mutex
+	bandwidth int64
+	start     time.Time
+	offset    int64
+	nextCheck time.Time
+}
+
 // NewBaseTransfer returns a new BaseTransfer and adds it to the given connection
 func NewBaseTransfer(file vfs.File, conn *BaseConnection, cancelFn func(), fsPath, effectiveFsPath, requestPath string,
 	transferType int, minWriteOffset, initialSize, maxWriteSize, truncatedSize int64, isNewFile bool, fs vfs.Fs,
@@ -84,14 +116,82 @@ func NewBaseTransfer(file vfs.File, conn *BaseConnection, cancelFn func(), fsPat
 		transferQuota:   transferQuota,
 		Fs:              fs,
 	}
+	t.staged = transferType == TransferUpload && fsPath != effectiveFsPath && conn.IsStagedUpload(requestPath)
+	if transferType == TransferUpload && conn.IsChecksumEnabled() {
+		t.checksum = newTransferChecksum()
+	}
+	if transferType == TransferUpload {
+		if policy, ok := conn.getMIMEPolicy(requestPath); ok {
+			t.mimePolicy = &policy
+			t.sniffer = &contentSniffer{}
+		}
+	}
 	t.AbortTransfer.Store(false)
 	t.BytesSent.Store(0)
 	t.BytesReceived.Store(0)
+	t.startSpan()
+	t.addToFolderLimits()
+	if qos != nil {
+		t.qosClass = qos.add(&conn.User, transferType)
+	}
 
 	conn.AddTransfer(t)
 	return t
 }
 
+func (t *BaseTransfer) startSpan() {
+	if !tracing.IsEnabled() {
+		return
+	}
+	name := "download"
+	if t.transferType == TransferUpload {
+		name = "upload"
+	}
+	t.span = tracing.StartSpan(t.Connection.ID, name,
+		attribute.String("sftpgo.protocol", t.Connection.protocol),
+		attribute.String("sftpgo.username", t.Connection.User.Username),
+		attribute.String("sftpgo.path", t.requestPath),
+		attribute.String("sftpgo.fs_provider", getFsProviderName(t.Fs)),
+		attribute.Int64("sftpgo.write_offset", t.MinWriteOffset),
+	)
+}
+
+func (t *BaseTransfer) endSpan(err error) {
+	if t.span == nil {
+		return
+	}
+	t.span.SetAttributes(
+		attribute.Int64("sftpgo.bytes_sent", t.BytesSent.Load()),
+		attribute.Int64("sftpgo.bytes_received", t.BytesReceived.Load()),
+	)
+	tracing.EndSpan(t.span, err)
+}
+
+func getFsProviderName(fs vfs.Fs) string {
+	if fs == nil {
+		return ""
+	}
+	return fs.Name()
+}
+
+// addToFolderLimits registers the transfer for the limits of the virtual folder
+// that includes it, if any. If the maximum number of concurrent transfers is
+// reached, the transfer will fail on the first read/write
+func (t *BaseTransfer) addToFolderLimits() {
+	vfolder, err := t.Connection.User.GetVirtualFolderForPath(path.Dir(t.requestPath))
+	if err != nil {
+		return
+	}
+	folder, err := folderLimits.add(vfolder.Name, vfolder.Limits)
+	if err != nil {
+		t.Connection.Log(logger.LevelInfo, "transfer for %q denied, too many concurrent transfers for folder %q",
+			t.requestPath, vfolder.Name)
+		t.errFolderLimit = err
+		return
+	}
+	t.folder = folder
+}
+
 // GetTransferQuota returns data transfer quota limits
 func (t *BaseTransfer) GetTransferQuota() dataprovider.TransferQuota {
 	return t.transferQuota
@@ -156,6 +256,26 @@ func (t *BaseTransfer) SignalClose(err error) {
 	t.AbortTransfer.Store(true)
 }
 
+// SetBandwidthLimit sets a bandwidth limit, as KB/s, for this transfer.
+// It applies in addition to the user and folder limits, 0 means no limit
+func (t *BaseTransfer) SetBandwidthLimit(bandwidth int64) {
+	// the bytes already transferred are not throttled
+	if t.transferType == TransferDownload {
+		t.adminThrottled.Store(t.BytesSent.Load())
+	} else {
+		t.adminThrottled.Store(t.BytesReceived.Load())
+	}
+	t.adminLimiter.Store(getFolderLimiter(nil, bandwidth))
+}
+
+// GetBandwidthLimit returns the bandwidth limit, as KB/s, set for this transfer
+func (t *BaseTransfer) GetBandwidthLimit() int64 {
+	if limiter := t.adminLimiter.Load(); limiter != nil {
+		return int64(limiter.Limit()) / 1024
+	}
+	return 0
+}
+
 // GetTruncatedSize returns the truncated sized if this is an upload overwriting
 // an existing file
 func (t *BaseTransfer) GetTruncatedSize() int64 {
@@ -184,9 +304,14 @@ func (t *BaseTransfer) GetFsPath() string {
 	return t.fsPath
 }
 
-// SetTimes stores access and modification times if fsPath matches the current file
+// SetTimes stores access and modification times if fsPath matches the current file.
+// The requested times are ignored inside WORM folders, the retention starts
+// from the modification time set by the server when the upload ends
 func (t *BaseTransfer) SetTimes(fsPath string, atime time.Time, mtime time.Time) bool {
 	if fsPath == t.GetFsPath() {
+		if t.Connection.IsWORMEnabled(t.requestPath) {
+			return true
+		}
 		t.aTime = atime
 		t.mTime = mtime
 		return true
@@ -225,6 +350,9 @@ func (t *BaseTransfer) ConvertError(err error) error {
 
 // CheckRead returns an error if read if not allowed
 func (t *BaseTransfer) CheckRead() error {
+	if t.errFolderLimit != nil {
+		return t.errFolderLimit
+	}
 	if t.transferQuota.AllowedDLSize == 0 && t.transferQuota.AllowedTotalSize == 0 {
 		return nil
 	}
@@ -242,6 +370,9 @@ func (t *BaseTransfer) CheckRead() error {
 
 // CheckWrite returns an error if write if not allowed
 func (t *BaseTransfer) CheckWrite() error {
+	if t.errFolderLimit != nil {
+		return t.errFolderLimit
+	}
 	if t.MaxWriteSize > 0 && t.BytesReceived.Load() > t.MaxWriteSize {
 		return t.Connection.GetQuotaExceededError()
 	}
@@ -322,14 +453,15 @@ func (t *BaseTransfer) getUploadFileSize() (int64, int, error) {
 	var fileSize int64
 	var deletedFiles int
 
-	info, err := t.Fs.Stat(t.fsPath)
+	fsPath := t.getUploadedFsPath()
+	info, err := t.Fs.Stat(fsPath)
 	if err == nil {
 		fileSize = info.Size()
 	}
 	if t.ErrTransfer != nil && vfs.IsCryptOsFs(t.Fs) {
-		errDelete := t.Fs.Remove(t.fsPath, false)
+		errDelete := t.Fs.Remove(fsPath, false)
 		if errDelete != nil {
-			t.Connection.Log(logger.LevelWarn, "error removing partial crypto file %q: %v", t.fsPath, errDelete)
+			t.Connection.Log(logger.LevelWarn, "error removing partial crypto file %q: %v", fsPath, errDelete)
 		} else {
 			fileSize = 0
 			deletedFiles = 1
@@ -364,6 +496,8 @@ func (t *BaseTransfer) checkUploadOutsideHomeDir(err error) int {
 // we try to delete the temporary file
 func (t *BaseTransfer) Close() error {
 	defer t.Connection.RemoveTransfer(t)
+	defer t.removeFromFolderLimits()
+	defer t.removeFromQoS()
 
 	var err error
 	numFiles := t.getUploadedFiles()
@@ -382,6 +516,25 @@ func (t *BaseTransfer) Close() error {
 		}
 		t.Connection.Log(logger.LevelWarn, "upload denied due to space limit, delete temporary file: %q, deletion error: %v",
 			t.effectiveFsPath, err)
+	} else if (t.File != nil || vfs.IsLocalOsFs(t.Fs)) && t.contentDenied.Load() {
+		// the rejected contents were never written, remove the partial file
+		err = t.Fs.Remove(t.effectiveFsPath, false)
+		if err == nil {
+			t.BytesReceived.Store(0)
+			t.MinWriteOffset = 0
+		}
+		t.Connection.Log(logger.LevelWarn, "upload denied by the MIME policy, delete file: %q, deletion error: %v",
+			t.effectiveFsPath, err)
+	} else if t.staged {
+		if t.ErrTransfer != nil {
+			err = t.Fs.Remove(t.effectiveFsPath, false)
+			t.Connection.Log(logger.LevelWarn, "staged upload completed with error: \"%v\", delete staged file: %q, deletion error: %v",
+				t.ErrTransfer, t.effectiveFsPath, err)
+			if err == nil {
+				t.BytesReceived.Store(0)
+				t.MinWriteOffset = 0
+			}
+		}
 	} else if t.isAtomicUpload() {
 		if t.ErrTransfer == nil || Config.UploadMode == UploadModeAtomicWithResume {
 			_, _, err = t.Fs.Rename(t.effectiveFsPath, t.fsPath)
@@ -420,7 +573,13 @@ func (t *BaseTransfer) Close() error {
 		numFiles -= deletedFiles
 		t.Connection.Log(logger.LevelDebug, "upload file size %d, num files %d, deleted files %d, fs path %q",
 			uploadFileSize, numFiles, deletedFiles, t.fsPath)
-		numFiles, uploadFileSize = t.executeUploadHook(numFiles, uploadFileSize, elapsed)
+		checksum := t.getChecksum(uploadFileSize)
+		if t.staged {
+			numFiles, uploadFileSize = t.handleStagedUpload(numFiles, uploadFileSize, checksum)
+		} else {
+			numFiles, uploadFileSize = t.executeUploadHook(numFiles, uploadFileSize, elapsed)
+			t.storeChecksum(checksum, uploadFileSize)
+		}
 		t.updateQuota(numFiles, uploadFileSize)
 		t.updateTimes()
 		logger.TransferLog(uploadLogSender, t.fsPath, elapsed, t.BytesReceived.Load(), t.Connection.User.Username,
@@ -433,6 +592,7 @@ func (t *BaseTransfer) Close() error {
 		}
 	}
 	t.updateTransferTimestamps(uploadFileSize, elapsed)
+	t.endSpan(err)
 	return err
 }
 
@@ -484,6 +644,34 @@ func (t *BaseTransfer) executeUploadHook(numFiles int, fileSize, elapsed int64)
 	return numFiles, fileSize
 }
 
+// handleStagedUpload records a successful staged upload, the upload hook
+// is executed when the staged file is published
+func (t *BaseTransfer) handleStagedUpload(numFiles int, fileSize int64, checksum string) (int, int64) {
+	if t.ErrTransfer != nil || numFiles <= 0 {
+		return numFiles, fileSize
+	}
+	if err := t.stageUpload(fileSize, checksum); err != nil {
+		t.ErrTransfer = err
+		if err := t.Fs.Remove(t.effectiveFsPath, false); err != nil {
+			t.Connection.Log(logger.LevelWarn, "unable to remove staged file %q: %v", t.effectiveFsPath, err)
+			return numFiles, fileSize
+		}
+		numFiles--
+		fileSize = 0
+		t.BytesReceived.Store(0)
+		t.MinWriteOffset = 0
+	}
+	return numFiles, fileSize
+}
+
+// getUploadedFsPath returns the filesystem path of the uploaded file
+func (t *BaseTransfer) getUploadedFsPath() string {
+	if t.staged {
+		return t.effectiveFsPath
+	}
+	return t.fsPath
+}
+
 func (t *BaseTransfer) getUploadedFiles() int {
 	numFiles := 0
 	if t.isNewFile {
@@ -494,9 +682,10 @@ func (t *BaseTransfer) getUploadedFiles() int {
 
 func (t *BaseTransfer) updateTimes() {
 	if !t.aTime.IsZero() && !t.mTime.IsZero() {
-		err := t.Fs.Chtimes(t.fsPath, t.aTime, t.mTime, true)
+		fsPath := t.getUploadedFsPath()
+		err := t.Fs.Chtimes(fsPath, t.aTime, t.mTime, true)
 		t.Connection.Log(logger.LevelDebug, "set times for file %q, atime: %v, mtime: %v, err: %v",
-			t.fsPath, t.aTime, t.mTime, err)
+			fsPath, t.aTime, t.mTime, err)
 	}
 }
 
@@ -522,25 +711,89 @@ func (t *BaseTransfer) updateQuota(numFiles int, fileSize int64) bool {
 	return false
 }
 
+// getThrottleParams returns the wanted bandwidth, the throttling start time and
+// the bytes transferred before it
+func (t *BaseTransfer) getThrottleParams(trasferredBytes int64) (int64, time.Time, int64) {
+	user := &t.Connection.User
+	if len(user.Filters.BandwidthSchedules) == 0 {
+		if t.transferType == TransferDownload {
+			return user.DownloadBandwidth, t.start, 0
+		}
+		return user.UploadBandwidth, t.start, 0
+	}
+
+	t.throttle.Lock()
+	defer t.throttle.Unlock()
+
+	now := time.Now()
+	if now.Before(t.throttle.nextCheck) {
+		return t.throttle.bandwidth, t.throttle.start, t.throttle.offset
+	}
+	uploadBandwidth, downloadBandwidth, ok := user.GetScheduledBandwidth(now)
+	if !ok {
+		uploadBandwidth, downloadBandwidth = user.UploadBandwidth, user.DownloadBandwidth
+	}
+	bandwidth := uploadBandwidth
+	if t.transferType == TransferDownload {
+		bandwidth = downloadBandwidth
+	}
+	if t.throttle.nextCheck.IsZero() {
+		t.throttle.start = t.start
+	} else if bandwidth != t.throttle.bandwidth {
+		t.Connection.Log(logger.LevelDebug, "scheduled bandwidth limit changed for transfer %q from %d KB/s to %d KB/s",
+			t.requestPath, t.throttle.bandwidth, bandwidth)
+		t.throttle.start = now
+		t.throttle.offset = trasferredBytes
+	}
+	t.throttle.bandwidth = bandwidth
+	t.throttle.nextCheck = now.Truncate(time.Hour).Add(time.Hour)
+	return t.throttle.bandwidth, t.throttle.start, t.throttle.offset
+}
+
 // HandleThrottle manage bandwidth throttling
 func (t *BaseTransfer) HandleThrottle() {
-	var wantedBandwidth int64
 	var trasferredBytes int64
 	if t.transferType == TransferDownload {
-		wantedBandwidth = t.Connection.User.DownloadBandwidth
 		trasferredBytes = t.BytesSent.Load()
 	} else {
-		wantedBandwidth = t.Connection.User.UploadBandwidth
 		trasferredBytes = t.BytesReceived.Load()
 	}
+	wantedBandwidth, start, offset := t.getThrottleParams(trasferredBytes)
 	if wantedBandwidth > 0 {
 		// real and wanted elapsed as milliseconds, bytes as kilobytes
-		realElapsed := time.Since(t.start).Nanoseconds() / 1000000
+		realElapsed := time.Since(start).Nanoseconds() / 1000000
 		// trasferredBytes / 1024 = KB/s, we multiply for 1000 to get milliseconds
-		wantedElapsed := 1000 * (trasferredBytes / 1024) / wantedBandwidth
+		wantedElapsed := 1000 * ((trasferredBytes - offset) / 1024) / wantedBandwidth
 		if wantedElapsed > realElapsed {
 			toSleep := time.Duration(wantedElapsed - realElapsed)
 			time.Sleep(toSleep * time.Millisecond)
 		}
 	}
+	if t.folder != nil {
+		if limiter := folderLimits.getLimiter(t.folder, t.transferType); limiter != nil {
+			waitBandwidthLimiter(limiter, trasferredBytes-t.folderThrottled.Swap(trasferredBytes), t.AbortTransfer.Load)
+		}
+	}
+	if n := trasferredBytes - t.adminThrottled.Swap(trasferredBytes); n > 0 {
+		if limiter := t.adminLimiter.Load(); limiter != nil {
+			waitBandwidthLimiter(limiter, n, t.AbortTransfer.Load)
+		}
+	}
+	if t.qosClass != nil {
+		n := trasferredBytes - t.qosThrottled.Swap(trasferredBytes)
+		metric.AddQoSTransferredBytes(t.qosClass.name, t.qosClass.bucket.direction, n)
+		waitBandwidthLimiter(t.qosClass.limiter, n, t.AbortTransfer.Load)
+	}
+}
+
+func (t *BaseTransfer) removeFromQoS() {
+	if t.qosClass != nil && t.qosRemoved.CompareAndSwap(false, true) {
+		t.qosClass.bucket.remove(t.qosClass)
+	}
+}
+
+func (t *BaseTransfer) removeFromFolderLimits() {
+	if t.folder != nil && t.folderRemoved.CompareAndSwap(false, true) {
+		folderLimits.remove(t.folder)
+	}
 }
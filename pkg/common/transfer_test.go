@@ -105,6 +105,197 @@ func TestTransferThrottling(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestAdminTransferThrottling(t *testing.T) {
+	u := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "test",
+		},
+	}
+	fs := vfs.NewOsFs("", os.TempDir(), "", nil)
+	conn := NewBaseConnection("id", ProtocolSFTP, "", "", u)
+	transfer := NewBaseTransfer(nil, conn, nil, "", "", "", TransferDownload, 0, 0, 0, 0, true, fs, dataprovider.TransferQuota{})
+	// the bytes transferred before setting the limit are not throttled
+	transfer.BytesSent.Store(1048576)
+	transfer.SetBandwidthLimit(64)
+	assert.Equal(t, int64(64), transfer.GetBandwidthLimit())
+	startTime := time.Now()
+	transfer.HandleThrottle()
+	assert.Less(t, time.Since(startTime), 500*time.Millisecond)
+	// the first 64KB are allowed by the limiter burst
+	transfer.BytesSent.Add(131072)
+	transfer.HandleThrottle()
+	assert.GreaterOrEqual(t, time.Since(startTime), 900*time.Millisecond)
+	transfer.SetBandwidthLimit(0)
+	assert.Equal(t, int64(0), transfer.GetBandwidthLimit())
+	startTime = time.Now()
+	transfer.BytesSent.Add(131072)
+	transfer.HandleThrottle()
+	assert.Less(t, time.Since(startTime), 500*time.Millisecond)
+	err := transfer.Close()
+	assert.NoError(t, err)
+}
+
+func TestScheduledTransferThrottling(t *testing.T) {
+	// Monday
+	now := time.Date(2023, 6, 5, 10, 30, 0, 0, time.UTC)
+	businessHours := dataprovider.Schedule{
+		Hours:      "9-17",
+		DayOfWeek:  "1-5",
+		DayOfMonth: "*",
+		Month:      "*",
+	}
+	assert.True(t, businessHours.IsActive(now))
+	assert.True(t, businessHours.IsActive(now.Add(-30*time.Minute)))
+	assert.False(t, businessHours.IsActive(now.Add(-91*time.Minute)))
+	assert.False(t, businessHours.IsActive(now.Add(-48*time.Hour)))
+	assert.True(t, businessHours.IsActive(now.In(time.FixedZone("test", 3600*5))))
+	invalidSchedule := dataprovider.Schedule{
+		Hours: "25",
+	}
+	assert.False(t, invalidSchedule.IsActive(now))
+
+	u := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username:          "test",
+			UploadBandwidth:   100,
+			DownloadBandwidth: 90,
+		},
+	}
+	u.Filters.BandwidthSchedules = []dataprovider.BandwidthSchedule{
+		{
+			Schedule: dataprovider.Schedule{
+				Hours:      "18-23,0-8",
+				DayOfWeek:  "*",
+				DayOfMonth: "*",
+				Month:      "*",
+			},
+		},
+		{
+			Schedule:          businessHours,
+			UploadBandwidth:   10,
+			DownloadBandwidth: 20,
+		},
+		{
+			Schedule:        businessHours,
+			UploadBandwidth: 30,
+		},
+	}
+	ul, dl, ok := u.GetScheduledBandwidth(now)
+	assert.True(t, ok)
+	assert.Equal(t, int64(10), ul)
+	assert.Equal(t, int64(20), dl)
+	ul, dl, ok = u.GetScheduledBandwidth(now.Add(12 * time.Hour))
+	assert.True(t, ok)
+	assert.Equal(t, int64(0), ul)
+	assert.Equal(t, int64(0), dl)
+	_, _, ok = u.GetScheduledBandwidth(now.Add(-48 * time.Hour))
+	assert.False(t, ok)
+
+	u.Filters.BandwidthSchedules = []dataprovider.BandwidthSchedule{
+		{
+			Schedule: dataprovider.Schedule{
+				Hours:      "*",
+				DayOfWeek:  "*",
+				DayOfMonth: "*",
+				Month:      "*",
+			},
+			UploadBandwidth: 50,
+		},
+	}
+	fs := vfs.NewOsFs("", os.TempDir(), "", nil)
+	testFileSize := int64(131072)
+	wantedUploadElapsed := 1000 * (testFileSize / 1024) / u.Filters.BandwidthSchedules[0].UploadBandwidth
+	wantedUploadElapsed -= wantedUploadElapsed / 10
+	conn := NewBaseConnection("id", ProtocolSCP, "", "", u)
+	transfer := NewBaseTransfer(nil, conn, nil, "", "", "", TransferUpload, 0, 0, 0, 0, true, fs, dataprovider.TransferQuota{})
+	transfer.BytesReceived.Store(testFileSize)
+	startTime := time.Now()
+	transfer.HandleThrottle()
+	elapsed := time.Since(startTime).Nanoseconds() / 1000000
+	assert.GreaterOrEqual(t, elapsed, wantedUploadElapsed, "scheduled upload bandwidth throttling not respected")
+	bandwidth, start, offset := transfer.getThrottleParams(testFileSize)
+	assert.Equal(t, int64(50), bandwidth)
+	assert.Equal(t, transfer.start, start)
+	assert.Equal(t, int64(0), offset)
+	// the schedule is no longer active, the user limit applies from now on
+	transfer.Connection.User.Filters.BandwidthSchedules[0].Schedule.Month = "13"
+	transfer.throttle.nextCheck = time.Now().Add(-time.Second)
+	bandwidth, start, offset = transfer.getThrottleParams(testFileSize)
+	assert.Equal(t, int64(100), bandwidth)
+	assert.True(t, start.After(transfer.start))
+	assert.Equal(t, testFileSize, offset)
+	assert.True(t, transfer.throttle.nextCheck.After(time.Now()))
+	err := transfer.Close()
+	assert.NoError(t, err)
+
+	transfer = NewBaseTransfer(nil, conn, nil, "", "", "", TransferDownload, 0, 0, 0, 0, true, fs, dataprovider.TransferQuota{})
+	bandwidth, _, _ = transfer.getThrottleParams(0)
+	assert.Equal(t, int64(90), bandwidth)
+	err = transfer.Close()
+	assert.NoError(t, err)
+}
+
+func TestFolderLimits(t *testing.T) {
+	u := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "test",
+			HomeDir:  filepath.Join(os.TempDir(), "home"),
+		},
+		VirtualFolders: []vfs.VirtualFolder{
+			{
+				BaseVirtualFolder: vfs.BaseVirtualFolder{
+					Name:       "ingest",
+					MappedPath: filepath.Join(os.TempDir(), "ingest"),
+					Limits: &vfs.FolderLimits{
+						UploadBandwidth:        64,
+						MaxConcurrentTransfers: 1,
+					},
+				},
+				VirtualPath: "/ingest",
+			},
+		},
+	}
+	fs := vfs.NewOsFs("", os.TempDir(), "", nil)
+	conn := NewBaseConnection("id", ProtocolSFTP, "", "", u)
+	transfer := NewBaseTransfer(nil, conn, nil, "", "", "/ingest/file1", TransferUpload, 0, 0, 0, 0, true, fs,
+		dataprovider.TransferQuota{})
+	assert.Equal(t, 1, folderLimits.getActiveTransfers("ingest"))
+	assert.NoError(t, transfer.CheckWrite())
+	// the limit is reached
+	_, err := ExecutePreAction(conn, OperationPreUpload, "", "/ingest/file2", 0, 0)
+	assert.ErrorIs(t, err, ErrFolderTransfers)
+	_, err = ExecutePreAction(conn, OperationPreUpload, "", "/file2", 0, 0)
+	assert.NoError(t, err)
+	transfer1 := NewBaseTransfer(nil, conn, nil, "", "", "/ingest/file2", TransferDownload, 0, 0, 0, 0, true, fs,
+		dataprovider.TransferQuota{})
+	assert.ErrorIs(t, transfer1.CheckRead(), ErrFolderTransfers)
+	assert.Equal(t, 1, folderLimits.getActiveTransfers("ingest"))
+	err = transfer1.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, folderLimits.getActiveTransfers("ingest"))
+	// the folder bandwidth is shared among all the transfers, the first 64 KB are allowed as burst
+	testFileSize := int64(131072)
+	transfer.BytesReceived.Store(testFileSize)
+	startTime := time.Now()
+	transfer.HandleThrottle()
+	elapsed := time.Since(startTime)
+	assert.GreaterOrEqual(t, elapsed, 900*time.Millisecond, "folder bandwidth throttling not respected")
+	// downloads have no limits
+	assert.Nil(t, folderLimits.getLimiter(transfer.folder, TransferDownload))
+	err = transfer.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, folderLimits.getActiveTransfers("ingest"))
+
+	_, err = ExecutePreAction(conn, OperationPreUpload, "", "/ingest/file2", 0, 0)
+	assert.NoError(t, err)
+	transfer = NewBaseTransfer(nil, conn, nil, "", "", "/ingest/file2", TransferDownload, 0, 0, 0, 0, true, fs,
+		dataprovider.TransferQuota{})
+	assert.NoError(t, transfer.CheckRead())
+	err = transfer.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, folderLimits.getActiveTransfers("ingest"))
+}
+
 func TestRealPath(t *testing.T) {
 	testFile := filepath.Join(os.TempDir(), "afile.txt")
 	fs := vfs.NewOsFs("123", os.TempDir(), "", nil)
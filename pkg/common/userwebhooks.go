@@ -0,0 +1,223 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/httpclient"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+)
+
+const (
+	userWebhookSignatureHeader = "X-SFTPGo-Signature"
+	userWebhookEventHeader     = "X-SFTPGo-Event"
+	userWebhookMaxRedirects    = 5
+)
+
+var (
+	userWebhooksLimiter *rateLimiter
+)
+
+// UserWebhooksConfig defines the configuration for the webhooks that users can
+// register for their folders
+type UserWebhooksConfig struct {
+	// Set to true to allow users to register webhooks from the WebClient and the REST API
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// Maximum number of notifications per minute for each user, the notifications
+	// exceeding this limit are discarded. 0 means no limit
+	RateLimit int `json:"rate_limit" mapstructure:"rate_limit"`
+	// Timeout for each notification as seconds
+	Timeout int `json:"timeout" mapstructure:"timeout"`
+	// Allow notifications to loopback, private and link-local addresses.
+	// The webhook URLs are defined by the users so they are refused by default
+	AllowPrivateNetworks bool `json:"allow_private_networks" mapstructure:"allow_private_networks"`
+}
+
+func (c *UserWebhooksConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.RateLimit < 0 {
+		return fmt.Errorf("user webhooks: invalid rate limit %d", c.RateLimit)
+	}
+	if c.Timeout < 1 || c.Timeout > 120 {
+		return fmt.Errorf("user webhooks: invalid timeout %d", c.Timeout)
+	}
+	return nil
+}
+
+// checkAddress is called before connecting to each resolved address, the
+// redirects are checked the same way
+func (c *UserWebhooksConfig) checkAddress(_, address string, _ syscall.RawConn) error {
+	if c.AllowPrivateNetworks {
+		return nil
+	}
+	return checkPublicAddress(address)
+}
+
+func (c *UserWebhooksConfig) getHTTPClient() *http.Client {
+	client := httpclient.GetDownloadHTTPClient(c.checkAddress)
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= userWebhookMaxRedirects {
+			return fmt.Errorf("stopped after %d redirects", userWebhookMaxRedirects)
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("unsupported redirect URL scheme %q", req.URL.Scheme)
+		}
+		return nil
+	}
+	return client
+}
+
+func (c *UserWebhooksConfig) getLimiter() *rateLimiter {
+	if c.RateLimit == 0 {
+		return nil
+	}
+	limiterConfig := RateLimiterConfig{
+		Average:          int64(c.RateLimit),
+		Period:           60000,
+		Burst:            c.RateLimit,
+		Type:             int(rateLimiterTypeSource),
+		EntriesSoftLimit: 1000,
+		EntriesHardLimit: 1500,
+	}
+	return limiterConfig.getLimiter()
+}
+
+// IsUserWebhooksEnabled returns true if users can register webhooks for their folders
+func IsUserWebhooksEnabled() bool {
+	return Config.UserWebhooks.Enabled
+}
+
+type userWebhookPayload struct {
+	Webhook           string `json:"webhook"`
+	Event             string `json:"event"`
+	Username          string `json:"username"`
+	VirtualPath       string `json:"virtual_path"`
+	VirtualTargetPath string `json:"virtual_target_path,omitempty"`
+	FileSize          int64  `json:"file_size,omitempty"`
+	Status            int    `json:"status"`
+	Protocol          string `json:"protocol"`
+	IP                string `json:"ip"`
+	Timestamp         int64  `json:"timestamp"`
+}
+
+func getUserWebhookSignature(secret string, payload []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(payload)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// getMatchingUserWebhooks returns the user webhooks to notify for the specified event
+func getMatchingUserWebhooks(user *dataprovider.User, operation, virtualPath, virtualTargetPath string) []dataprovider.UserWebhook {
+	if !Config.UserWebhooks.Enabled {
+		return nil
+	}
+	var result []dataprovider.UserWebhook
+	for _, webhook := range user.Filters.Webhooks {
+		if webhook.IsMatch(operation, virtualPath) ||
+			(virtualTargetPath != "" && webhook.IsMatch(operation, virtualTargetPath)) {
+			result = append(result, webhook)
+		}
+	}
+	return result
+}
+
+func executeUserWebhooks(webhooks []dataprovider.UserWebhook, params EventParams) {
+	eventManager.addAsyncTask()
+	defer eventManager.removeAsyncTask()
+
+	if userWebhooksLimiter != nil {
+		if _, err := userWebhooksLimiter.Wait(params.Name, params.Protocol); err != nil {
+			eventManagerLog(logger.LevelWarn, "user webhooks for user %q not executed, event %q: %v",
+				params.Name, params.Event, err)
+			return
+		}
+	}
+	for _, webhook := range webhooks {
+		if err := executeUserWebhook(webhook, &params); err != nil {
+			eventManagerLog(logger.LevelWarn, "unable to notify webhook %q for user %q, event %q: %v",
+				webhook.Name, params.Name, params.Event, err)
+		}
+	}
+}
+
+func executeUserWebhook(webhook dataprovider.UserWebhook, params *EventParams) error {
+	if webhook.Secret == nil {
+		return fmt.Errorf("webhook %q has no secret", webhook.Name)
+	}
+	secret := webhook.Secret.Clone()
+	if err := secret.TryDecrypt(); err != nil {
+		return fmt.Errorf("unable to decrypt secret: %w", err)
+	}
+	payload, err := json.Marshal(userWebhookPayload{
+		Webhook:           webhook.Name,
+		Event:             params.Event,
+		Username:          params.Name,
+		VirtualPath:       params.VirtualPath,
+		VirtualTargetPath: params.VirtualTargetPath,
+		FileSize:          params.FileSize,
+		Status:            params.Status,
+		Protocol:          params.Protocol,
+		IP:                params.IP,
+		Timestamp:         params.Timestamp,
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(Config.UserWebhooks.Timeout)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(userWebhookEventHeader, params.Event)
+	req.Header.Set(userWebhookSignatureHeader, getUserWebhookSignature(secret.GetPayload(), payload))
+	if params.CorrelationID != "" {
+		req.Header.Set(logger.CorrelationIDHeader, params.CorrelationID)
+	}
+
+	client := Config.UserWebhooks.getHTTPClient()
+	defer client.CloseIdleConnections()
+
+	startTime := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending HTTP request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096)) //nolint:errcheck
+	eventManagerLog(logger.LevelDebug, "webhook %q for user %q notified, event %q, elapsed: %s, status code: %d",
+		webhook.Name, params.Name, params.Event, time.Since(startTime), resp.StatusCode)
+	if resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusNoContent {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/kms"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+)
+
+func TestUserWebhooksConfig(t *testing.T) {
+	c := UserWebhooksConfig{}
+	assert.NoError(t, c.validate())
+	c.Enabled = true
+	c.RateLimit = -1
+	assert.Error(t, c.validate())
+	c.RateLimit = 0
+	assert.Error(t, c.validate())
+	c.Timeout = 121
+	assert.Error(t, c.validate())
+	c.Timeout = 10
+	assert.NoError(t, c.validate())
+	assert.Nil(t, c.getLimiter())
+	c.RateLimit = 5
+	limiter := c.getLimiter()
+	if assert.NotNil(t, limiter) {
+		assert.Equal(t, 5, limiter.burst)
+	}
+}
+
+func TestGetMatchingUserWebhooks(t *testing.T) {
+	user := dataprovider.User{}
+	user.Filters.Webhooks = []dataprovider.UserWebhook{
+		{
+			Name:   "hook1",
+			Path:   "/dir",
+			Events: []string{operationUpload, operationRename},
+		},
+		{
+			Name:   "hook2",
+			Path:   "/",
+			Events: []string{operationDownload},
+		},
+	}
+	assert.Len(t, getMatchingUserWebhooks(&user, operationUpload, "/dir/file", ""), 0)
+
+	oldConfig := Config.UserWebhooks
+	Config.UserWebhooks.Enabled = true
+	defer func() {
+		Config.UserWebhooks = oldConfig
+	}()
+
+	webhooks := getMatchingUserWebhooks(&user, operationUpload, "/dir/file", "")
+	if assert.Len(t, webhooks, 1) {
+		assert.Equal(t, "hook1", webhooks[0].Name)
+	}
+	assert.Len(t, getMatchingUserWebhooks(&user, operationUpload, "/dir", ""), 1)
+	assert.Len(t, getMatchingUserWebhooks(&user, operationUpload, "/dir1/file", ""), 0)
+	assert.Len(t, getMatchingUserWebhooks(&user, operationRename, "/file", "/dir/sub/file"), 1)
+	assert.Len(t, getMatchingUserWebhooks(&user, operationDelete, "/dir/file", ""), 0)
+	webhooks = getMatchingUserWebhooks(&user, operationDownload, "/dir1/file", "")
+	if assert.Len(t, webhooks, 1) {
+		assert.Equal(t, "hook2", webhooks[0].Name)
+	}
+}
+
+func TestExecuteUserWebhooks(t *testing.T) {
+	var mu sync.Mutex
+	var payloads []userWebhookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		if r.Header.Get(userWebhookSignatureHeader) != getUserWebhookSignature("secret", body) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var payload userWebhookPayload
+		err = json.Unmarshal(body, &payload)
+		assert.NoError(t, err)
+		assert.Equal(t, payload.Event, r.Header.Get(userWebhookEventHeader))
+		assert.Equal(t, "connID", r.Header.Get(logger.CorrelationIDHeader))
+		mu.Lock()
+		payloads = append(payloads, payload)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	oldConfig := Config.UserWebhooks
+	oldLimiter := userWebhooksLimiter
+	Config.UserWebhooks = UserWebhooksConfig{
+		Enabled:              true,
+		RateLimit:            1,
+		Timeout:              5,
+		AllowPrivateNetworks: true,
+	}
+	userWebhooksLimiter = Config.UserWebhooks.getLimiter()
+	defer func() {
+		Config.UserWebhooks = oldConfig
+		userWebhooksLimiter = oldLimiter
+	}()
+
+	secret := kms.NewPlainSecret("secret")
+	secret.SetAdditionalData("user")
+	err := secret.Encrypt()
+	assert.NoError(t, err)
+	webhook := dataprovider.UserWebhook{
+		Name:   "hook",
+		Path:   "/",
+		URL:    server.URL,
+		Secret: secret,
+		Events: []string{operationUpload},
+	}
+	params := EventParams{
+		Name:          "user",
+		Event:         operationUpload,
+		Status:        1,
+		VirtualPath:   "/file.txt",
+		FileSize:      123,
+		Protocol:      ProtocolSFTP,
+		IP:            "127.0.0.1",
+		Timestamp:     time.Now().UnixNano(),
+		CorrelationID: "connID",
+	}
+	executeUserWebhooks([]dataprovider.UserWebhook{webhook}, params)
+	// the rate limit is exceeded, the notification is discarded
+	executeUserWebhooks([]dataprovider.UserWebhook{webhook}, params)
+	mu.Lock()
+	if assert.Len(t, payloads, 1) {
+		assert.Equal(t, "hook", payloads[0].Webhook)
+		assert.Equal(t, "user", payloads[0].Username)
+		assert.Equal(t, "/file.txt", payloads[0].VirtualPath)
+		assert.Equal(t, int64(123), payloads[0].FileSize)
+		assert.Equal(t, ProtocolSFTP, payloads[0].Protocol)
+	}
+	mu.Unlock()
+	// wrong secret
+	webhook.Secret = kms.NewPlainSecret("wrong secret")
+	err = executeUserWebhook(webhook, &params)
+	assert.ErrorContains(t, err, "unexpected status code")
+	webhook.Secret = nil
+	err = executeUserWebhook(webhook, &params)
+	assert.Error(t, err)
+	webhook.Secret = kms.NewPlainSecret("secret")
+	webhook.URL = "http://127.0.0.1:1/invalid"
+	err = executeUserWebhook(webhook, &params)
+	assert.Error(t, err)
+	// loopback and private addresses are refused by default
+	Config.UserWebhooks.AllowPrivateNetworks = false
+	webhook.URL = server.URL
+	err = executeUserWebhook(webhook, &params)
+	assert.ErrorContains(t, err, "are not allowed")
+	webhook.URL = "http://169.254.169.254/latest/meta-data"
+	err = executeUserWebhook(webhook, &params)
+	assert.ErrorContains(t, err, "are not allowed")
+}
+
+func TestUserWebhooksRedirect(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL, http.StatusTemporaryRedirect)
+	}))
+	defer redirect.Close()
+
+	c := UserWebhooksConfig{
+		AllowPrivateNetworks: true,
+	}
+	client := c.getHTTPClient()
+	resp, err := client.Post(redirect.URL, "application/json", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp.Body.Close()
+	}
+	c.AllowPrivateNetworks = false
+	client = c.getHTTPClient()
+	_, err = client.Post(redirect.URL, "application/json", nil) //nolint:bodyclose
+	assert.ErrorContains(t, err, "are not allowed")
+}
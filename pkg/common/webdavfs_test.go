@@ -0,0 +1,316 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/drakkan/webdav"
+	"github.com/sftpgo/sdk"
+	sdkkms "github.com/sftpgo/sdk/kms"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/kms"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+const (
+	webDAVTestPrefix   = "/remote.php/dav/files/webdav_user"
+	webDAVTestUsername = "remote_user"
+	webDAVTestPassword = "remote_password"
+)
+
+func generateWebDAVClientCert(t *testing.T) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sftpgo"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return cert, string(certPEM), string(keyPEM)
+}
+
+func startWebDAVTestServer(t *testing.T, rootDir string, clientCert *x509.Certificate) *httptest.Server {
+	handler := &webdav.Handler{
+		Prefix:     webDAVTestPrefix,
+		FileSystem: webdav.Dir(rootDir),
+		LockSystem: webdav.NewMemLS(),
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != webDAVTestUsername || password != webDAVTestPassword {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	pool := x509.NewCertPool()
+	pool.AddCert(clientCert)
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+		MinVersion: tls.VersionTLS12,
+	}
+	server.StartTLS()
+	return server
+}
+
+func TestWebDAVFsConfig(t *testing.T) {
+	_, certPEM, keyPEM := generateWebDAVClientCert(t)
+	fsConfig := vfs.Filesystem{
+		Provider: vfs.WebDAVFilesystemProvider,
+	}
+	err := fsConfig.Validate("")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	fsConfig.WebDAVConfig.Endpoint = "ftp://127.0.0.1/dav"
+	err = fsConfig.Validate("")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	fsConfig.WebDAVConfig.Endpoint = "https://127.0.0.1/dav?a=b"
+	err = fsConfig.Validate("")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	fsConfig.WebDAVConfig.Endpoint = "https://127.0.0.1/dav/"
+	fsConfig.WebDAVConfig.ClientCert = "invalid cert"
+	err = fsConfig.Validate("")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	fsConfig.WebDAVConfig.ClientCert = certPEM
+	err = fsConfig.Validate("")
+	if assert.ErrorIs(t, err, util.ErrValidation) {
+		assert.Contains(t, err.Error(), "requires a client key")
+	}
+	_, _, otherKeyPEM := generateWebDAVClientCert(t)
+	fsConfig.WebDAVConfig.ClientKey = kms.NewPlainSecret(otherKeyPEM)
+	err = fsConfig.Validate("")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	fsConfig.WebDAVConfig.ClientCert = ""
+	err = fsConfig.Validate("")
+	if assert.ErrorIs(t, err, util.ErrValidation) {
+		assert.Contains(t, err.Error(), "requires a client certificate")
+	}
+	fsConfig.WebDAVConfig.ClientCert = certPEM
+	fsConfig.WebDAVConfig.ClientKey = kms.NewPlainSecret(keyPEM)
+	fsConfig.WebDAVConfig.Password = kms.NewPlainSecret("pwd")
+	fsConfig.HTTPConfig.Endpoint = "http://127.0.0.1"
+	err = fsConfig.Validate("")
+	require.NoError(t, err)
+	assert.Equal(t, "https://127.0.0.1/dav", fsConfig.WebDAVConfig.Endpoint)
+	assert.Empty(t, fsConfig.HTTPConfig.Endpoint)
+	assert.True(t, fsConfig.WebDAVConfig.Password.IsEncrypted())
+	assert.True(t, fsConfig.WebDAVConfig.ClientKey.IsEncrypted())
+
+	fsCopy := fsConfig.GetACopy()
+	assert.True(t, fsCopy.IsEqual(fsConfig))
+	assert.True(t, fsCopy.IsSameResource(fsConfig))
+	fsCopy.WebDAVConfig.Username = "user"
+	assert.False(t, fsCopy.IsEqual(fsConfig))
+	assert.True(t, fsCopy.IsSameResource(fsConfig))
+	fsCopy.WebDAVConfig.EqualityCheckMode = 1
+	assert.False(t, fsCopy.IsSameResource(fsConfig))
+	fsCopy.HideConfidentialData()
+	assert.Empty(t, fsCopy.WebDAVConfig.ClientKey.GetKey())
+	assert.False(t, fsCopy.HasRedactedSecret())
+	fsCopy.WebDAVConfig.ClientKey = kms.NewSecret(sdkkms.SecretStatusRedacted, "", "", "")
+	assert.True(t, fsCopy.HasRedactedSecret())
+
+	assert.Equal(t, vfs.WebDAVFilesystemProvider, vfs.GetProviderByName("webdavfs"))
+	assert.Equal(t, vfs.WebDAVFilesystemProvider, vfs.GetProviderByName("7"))
+	assert.Equal(t, sdk.SFTPFilesystemProvider, vfs.GetProviderByName("sftpfs"))
+	assert.Equal(t, "webdavfs", vfs.GetProviderName(vfs.WebDAVFilesystemProvider))
+	assert.Equal(t, "WebDAV", vfs.GetProviderShortInfo(vfs.WebDAVFilesystemProvider))
+	assert.Equal(t, "sftpfs", vfs.GetProviderName(sdk.SFTPFilesystemProvider))
+}
+
+func TestWebDAVFs(t *testing.T) {
+	remoteDir := t.TempDir()
+	clientCert, certPEM, keyPEM := generateWebDAVClientCert(t)
+	server := startWebDAVTestServer(t, remoteDir, clientCert)
+	defer server.Close()
+
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "webdav_user",
+			HomeDir:  filepath.Join(os.TempDir(), "webdav_user"),
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+	}
+	user.FsConfig.Provider = vfs.WebDAVFilesystemProvider
+	user.FsConfig.WebDAVConfig = vfs.WebDAVFsConfig{
+		Endpoint:      server.URL + webDAVTestPrefix,
+		Username:      webDAVTestUsername,
+		Password:      kms.NewPlainSecret(webDAVTestPassword),
+		SkipTLSVerify: true,
+		ClientCert:    certPEM,
+		ClientKey:     kms.NewPlainSecret(keyPEM),
+	}
+	err := dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+	assert.Equal(t, "WebDAV: "+server.URL+webDAVTestPrefix, user.GetStorageDescrition())
+
+	conn := NewBaseConnection("", ProtocolSFTP, "", "", user)
+	fs, fsPath, err := conn.GetFsAndResolvedPath("/dir/file.txt")
+	require.NoError(t, err)
+	assert.True(t, vfs.IsWebDAVFs(fs))
+	assert.False(t, fs.IsUploadResumeSupported())
+	assert.False(t, fs.IsAtomicUploadSupported())
+	assert.Equal(t, "/dir/file.txt", fsPath)
+	// the local home directory is used for temporary files
+	assert.True(t, fs.CheckRootPath(user.Username, -1, -1))
+
+	// the parent directory does not exist
+	_, err = fs.Stat(fsPath)
+	assert.True(t, fs.IsNotExist(err))
+	err = conn.CreateDir("/dir", false)
+	require.NoError(t, err)
+	err = fs.Mkdir("/dir")
+	assert.ErrorIs(t, err, os.ErrExist)
+	assert.DirExists(t, filepath.Join(remoteDir, "dir"))
+
+	data := util.GenerateRandomBytes(65535)
+	_, w, cancelFn, err := fs.Create(fsPath, 0, 0)
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	cancelFn()
+	contents, err := os.ReadFile(filepath.Join(remoteDir, "dir", "file.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, data, contents)
+
+	info, err := fs.Stat(fsPath)
+	require.NoError(t, err)
+	assert.Equal(t, "file.txt", info.Name())
+	assert.Equal(t, int64(len(data)), info.Size())
+	assert.False(t, info.IsDir())
+	info, err = fs.Stat("/dir")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	entries, err := fs.ReadDir("/")
+	require.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "dir", entries[0].Name())
+		assert.True(t, entries[0].IsDir())
+	}
+	entries, err = fs.ReadDir("/dir")
+	require.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "file.txt", entries[0].Name())
+		assert.Equal(t, int64(len(data)), entries[0].Size())
+	}
+	_, err = fs.ReadDir(fsPath)
+	assert.Error(t, err)
+	mimeType, err := fs.GetMimeType(fsPath)
+	require.NoError(t, err)
+	assert.Contains(t, mimeType, "text/plain")
+	numFiles, size, err := fs.ScanRootDirContents()
+	require.NoError(t, err)
+	assert.Equal(t, 1, numFiles)
+	assert.Equal(t, int64(len(data)), size)
+	// ranged reads
+	for _, offset := range []int64{0, 100, int64(len(data))} {
+		_, r, cancelFn, err := fs.Open(fsPath, offset)
+		require.NoError(t, err)
+		contents, err = io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, data[offset:], contents)
+		require.NoError(t, r.Close())
+		cancelFn()
+	}
+	_, r, cancelFn, err := fs.Open("/missing", 0)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.True(t, fs.IsNotExist(err))
+	cancelFn()
+	// unsupported operations
+	assert.True(t, fs.IsNotSupported(fs.Chmod(fsPath, 0644)))
+	assert.True(t, fs.IsNotSupported(fs.Chtimes(fsPath, time.Now(), time.Now(), false)))
+	assert.True(t, fs.IsNotSupported(fs.Truncate(fsPath, 0)))
+	assert.True(t, fs.IsNotSupported(fs.Symlink(fsPath, "/link")))
+	_, err = fs.GetAvailableDiskSize("/")
+	assert.ErrorIs(t, err, vfs.ErrStorageSizeUnavailable)
+	// non empty directories cannot be removed
+	err = fs.Remove("/dir", true)
+	assert.Error(t, err)
+	err = conn.Rename("/dir/file.txt", "/dir/renamed file.txt")
+	require.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(remoteDir, "dir", "file.txt"))
+	assert.FileExists(t, filepath.Join(remoteDir, "dir", "renamed file.txt"))
+	err = conn.Rename("/dir", "/newdir")
+	require.NoError(t, err)
+	info, err = fs.Stat(path.Join("/newdir", "renamed file.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "renamed file.txt", info.Name())
+	err = conn.RemoveFile(fs, path.Join("/newdir", "renamed file.txt"), path.Join("/newdir", "renamed file.txt"), info)
+	require.NoError(t, err)
+	err = conn.RemoveDir("/newdir")
+	require.NoError(t, err)
+	assert.NoDirExists(t, filepath.Join(remoteDir, "newdir"))
+	_, err = fs.Stat("/newdir")
+	assert.True(t, fs.IsNotExist(err))
+	require.NoError(t, fs.Close())
+	// wrong credentials
+	user.FsConfig.WebDAVConfig.Password = kms.NewPlainSecret("wrong")
+	fs, err = user.GetFilesystem("")
+	require.NoError(t, err)
+	_, err = fs.Stat("/")
+	assert.True(t, fs.IsPermission(err))
+	// the client certificate is required
+	user.FsConfig.WebDAVConfig.Password = kms.NewPlainSecret(webDAVTestPassword)
+	user.FsConfig.WebDAVConfig.ClientCert = ""
+	fs, err = user.GetFilesystem("")
+	require.NoError(t, err)
+	_, err = fs.Stat("/")
+	assert.Error(t, err)
+
+	err = dataprovider.DeleteUser(user.Username, "", "", "")
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
@@ -0,0 +1,135 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+)
+
+const (
+	// the output of HTTP and command steps is truncated to this size
+	maxWorkflowStepOutputSize = 65536
+)
+
+// limitedBuffer is an io.Writer that keeps at most limit bytes, the
+// remaining data is discarded
+type limitedBuffer struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if remaining := b.limit - b.buf.Len(); remaining > 0 {
+		if len(p) > remaining {
+			b.buf.Write(p[:remaining])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	return b.buf.String()
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	result := make(map[string]string, len(m))
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
+}
+
+func (p *EventParams) setStepResult(name string, err error) {
+	if p.stepOutputs == nil {
+		p.stepOutputs = make(map[string]string)
+	}
+	if p.stepErrors == nil {
+		p.stepErrors = make(map[string]string)
+	}
+	p.stepOutputs[name] = p.output
+	if err != nil {
+		p.stepErrors[name] = err.Error()
+	} else {
+		p.stepErrors[name] = ""
+	}
+	p.output = ""
+}
+
+func executeWorkflowStep(step dataprovider.WorkflowStep, conditions dataprovider.ConditionOptions,
+	params *EventParams,
+) error {
+	action, err := dataprovider.EventActionExists(step.Action)
+	if err != nil {
+		return fmt.Errorf("unable to get action %q: %w", step.Action, err)
+	}
+	if action.Type == dataprovider.ActionTypeWorkflow {
+		return fmt.Errorf("action %q is a workflow, nested workflows are not supported", action.Name)
+	}
+	captureOutput := params.captureOutput
+	params.captureOutput = true
+	params.output = ""
+	err = runRuleAction(action, params, conditions)
+	params.captureOutput = captureOutput
+	return err
+}
+
+// executeWorkflowRuleAction executes the workflow steps in order. A failed step
+// stops the workflow unless an on failure step is defined. The output and the
+// error of each executed step are available to the next steps as placeholders
+func executeWorkflowRuleAction(c dataprovider.EventActionWorkflowConfig, conditions dataprovider.ConditionOptions,
+	params *EventParams,
+) error {
+	idx := 0
+	for idx < len(c.Steps) {
+		step := c.Steps[idx]
+		startTime := time.Now()
+		err := executeWorkflowStep(step, conditions, params)
+		params.setStepResult(step.Name, err)
+		eventManagerLog(logger.LevelDebug, "workflow step %q, action %q executed, elapsed: %s, error: %v",
+			step.Name, step.Action, time.Since(startTime), err)
+
+		next := step.OnSuccess
+		if err != nil {
+			if step.OnFailure == "" {
+				return fmt.Errorf("workflow step %q failed: %w", step.Name, err)
+			}
+			next = step.OnFailure
+		}
+		switch next {
+		case "":
+			idx++
+		case dataprovider.WorkflowStepEnd:
+			return nil
+		default:
+			nextIdx := c.GetStepIndex(next)
+			if nextIdx <= idx {
+				// validation prevents this, we check it anyway to avoid loops
+				return fmt.Errorf("workflow step %q: invalid next step %q", step.Name, next)
+			}
+			idx = nextIdx
+		}
+	}
+	return nil
+}
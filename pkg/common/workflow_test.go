@@ -0,0 +1,291 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+func TestWorkflowActionValidation(t *testing.T) {
+	action := dataprovider.BaseEventAction{
+		Name: "workflow",
+		Type: dataprovider.ActionTypeWorkflow,
+	}
+	err := dataprovider.AddEventAction(&action, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	action.Options.WorkflowConfig.Steps = []dataprovider.WorkflowStep{
+		{
+			Name: "s1",
+		},
+	}
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	action.Options.WorkflowConfig.Steps[0].Action = action.Name
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	action.Options.WorkflowConfig.Steps = []dataprovider.WorkflowStep{
+		{
+			Name:   dataprovider.WorkflowStepEnd,
+			Action: "a1",
+		},
+	}
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	action.Options.WorkflowConfig.Steps = []dataprovider.WorkflowStep{
+		{
+			Name:   "s1",
+			Action: "a1",
+		},
+		{
+			Name:   "s1",
+			Action: "a2",
+		},
+	}
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	action.Options.WorkflowConfig.Steps = []dataprovider.WorkflowStep{
+		{
+			Name:      "s1",
+			Action:    "a1",
+			OnSuccess: "missing",
+		},
+	}
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	// branches can only jump forward
+	action.Options.WorkflowConfig.Steps = []dataprovider.WorkflowStep{
+		{
+			Name:   "s1",
+			Action: "a1",
+		},
+		{
+			Name:      "s2",
+			Action:    "a2",
+			OnFailure: "s1",
+		},
+	}
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	action.Options.WorkflowConfig.Steps = []dataprovider.WorkflowStep{
+		{
+			Action:    "a1",
+			OnFailure: "step2",
+		},
+		{
+			Action:    "a2",
+			OnSuccess: dataprovider.WorkflowStepEnd,
+		},
+	}
+	action.Options.TieringConfig.Folder = "cold"
+	err = dataprovider.AddEventAction(&action, "", "", "")
+	require.NoError(t, err)
+	action, err = dataprovider.EventActionExists(action.Name)
+	require.NoError(t, err)
+	assert.Empty(t, action.Options.TieringConfig.Folder)
+	if assert.Len(t, action.Options.WorkflowConfig.Steps, 2) {
+		assert.Equal(t, "step1", action.Options.WorkflowConfig.Steps[0].Name)
+		assert.Equal(t, "step2", action.Options.WorkflowConfig.Steps[1].Name)
+	}
+	err = dataprovider.DeleteEventAction(action.Name, "", "", "")
+	assert.NoError(t, err)
+}
+
+func TestWorkflowExecution(t *testing.T) {
+	if runtime.GOOS == osWindows {
+		t.Skip("this test is not available on Windows")
+	}
+	outputFile := filepath.Join(os.TempDir(), "workflow_output.txt")
+	scriptPath := filepath.Join(os.TempDir(), "workflow_step.sh")
+	err := os.WriteFile(scriptPath, []byte("#!/bin/sh\necho \"$@\" > "+outputFile+"\n"), 0755)
+	require.NoError(t, err)
+
+	actions := []dataprovider.BaseEventAction{
+		{
+			Name: "workflow_echo",
+			Type: dataprovider.ActionTypeCommand,
+			Options: dataprovider.BaseEventActionOptions{
+				CmdConfig: dataprovider.EventActionCommandConfig{
+					Cmd:     "/bin/echo",
+					Args:    []string{"hello"},
+					Timeout: 10,
+				},
+			},
+		},
+		{
+			Name: "workflow_fail",
+			Type: dataprovider.ActionTypeCommand,
+			Options: dataprovider.BaseEventActionOptions{
+				CmdConfig: dataprovider.EventActionCommandConfig{
+					Cmd:     filepath.Join(os.TempDir(), "missing_workflow_cmd"),
+					Timeout: 10,
+				},
+			},
+		},
+		{
+			Name: "workflow_write",
+			Type: dataprovider.ActionTypeCommand,
+			Options: dataprovider.BaseEventActionOptions{
+				CmdConfig: dataprovider.EventActionCommandConfig{
+					Cmd:     scriptPath,
+					Args:    []string{"{{StepOutputgreet}}", "{{StepErrorfail}}"},
+					Timeout: 10,
+				},
+			},
+		},
+	}
+	for idx := range actions {
+		err = dataprovider.AddEventAction(&actions[idx], "", "", "")
+		require.NoError(t, err)
+	}
+
+	c := dataprovider.EventActionWorkflowConfig{
+		Steps: []dataprovider.WorkflowStep{
+			{
+				Name:   "greet",
+				Action: "workflow_echo",
+			},
+			{
+				Name:      "fail",
+				Action:    "workflow_fail",
+				OnFailure: "write",
+			},
+			{
+				// skipped, the previous step jumps to the write step
+				Name:   "skipped",
+				Action: "missing_action",
+			},
+			{
+				Name:   "write",
+				Action: "workflow_write",
+			},
+		},
+	}
+	params := &EventParams{}
+	err = executeWorkflowRuleAction(c, dataprovider.ConditionOptions{}, params)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", params.stepOutputs["greet"])
+	assert.NotEmpty(t, params.stepErrors["fail"])
+	_, ok := params.stepOutputs["skipped"]
+	assert.False(t, ok)
+	content, err := os.ReadFile(outputFile)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(content), "hello "))
+	assert.Contains(t, string(content), "missing_workflow_cmd")
+	assert.False(t, params.captureOutput)
+	// without an on failure step the workflow fails
+	c.Steps[1].OnFailure = ""
+	err = executeWorkflowRuleAction(c, dataprovider.ConditionOptions{}, &EventParams{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `workflow step "fail" failed`)
+	}
+	// the missing action is executed now
+	c.Steps[1].OnFailure = "skipped"
+	err = executeWorkflowRuleAction(c, dataprovider.ConditionOptions{}, &EventParams{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `unable to get action "missing_action"`)
+	}
+	// the end step stops the workflow
+	c.Steps[0].OnSuccess = dataprovider.WorkflowStepEnd
+	params = &EventParams{}
+	err = executeWorkflowRuleAction(c, dataprovider.ConditionOptions{}, params)
+	assert.NoError(t, err)
+	assert.Len(t, params.stepOutputs, 1)
+
+	for _, action := range actions {
+		err = dataprovider.DeleteEventAction(action.Name, "", "", "")
+		assert.NoError(t, err)
+	}
+	err = os.Remove(outputFile)
+	assert.NoError(t, err)
+	err = os.Remove(scriptPath)
+	assert.NoError(t, err)
+}
+
+func TestWorkflowActionsConsistency(t *testing.T) {
+	quotaReset := dataprovider.BaseEventAction{
+		Name: "workflow_quota_reset",
+		Type: dataprovider.ActionTypeUserQuotaReset,
+	}
+	err := dataprovider.AddEventAction(&quotaReset, "", "", "")
+	require.NoError(t, err)
+
+	r := dataprovider.EventRule{
+		Name:    "workflow_rule",
+		Trigger: dataprovider.EventTriggerIPBlocked,
+		Actions: []dataprovider.EventAction{
+			{
+				BaseEventAction: dataprovider.BaseEventAction{
+					Name: "workflow",
+					Type: dataprovider.ActionTypeWorkflow,
+					Options: dataprovider.BaseEventActionOptions{
+						WorkflowConfig: dataprovider.EventActionWorkflowConfig{
+							Steps: []dataprovider.WorkflowStep{
+								{
+									Name:   "s1",
+									Action: "missing_action",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	err = r.CheckActionsConsistency("")
+	assert.NoError(t, err)
+	r.Actions[0].BaseEventAction.Options.WorkflowConfig.Steps = append(r.Actions[0].BaseEventAction.Options.WorkflowConfig.Steps,
+		dataprovider.WorkflowStep{
+			Name:   "s2",
+			Action: quotaReset.Name,
+		})
+	err = r.CheckActionsConsistency("")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "is not supported for event trigger")
+	}
+	r.Trigger = dataprovider.EventTriggerProviderEvent
+	err = r.CheckActionsConsistency("folder")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "is only supported for provider user events")
+	}
+	err = r.CheckActionsConsistency("user")
+	assert.NoError(t, err)
+
+	err = dataprovider.DeleteEventAction(quotaReset.Name, "", "", "")
+	assert.NoError(t, err)
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	b := &limitedBuffer{limit: 5}
+	n, err := b.Write([]byte("abc"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	n, err = b.Write([]byte("defgh"))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+	n, err = b.Write([]byte("ijk"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, "abcde", b.String())
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/sftp"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+)
+
+func getWORMProtectedError(protocol string) error {
+	switch protocol {
+	case ProtocolSFTP:
+		return fmt.Errorf("%w: %v", sftp.ErrSSHFxPermissionDenied, ErrWORMProtected.Error())
+	case ProtocolWebDAV:
+		// the WebDAV handler only maps permission errors to 403
+		return os.ErrPermission
+	default:
+		return ErrWORMProtected
+	}
+}
+
+// GetWORMProtectedError returns an appropriate error, for the connection
+// protocol, for the operations not allowed on WORM protected files
+func (c *BaseConnection) GetWORMProtectedError() error {
+	return getWORMProtectedError(c.protocol)
+}
+
+// IsWORMEnabled returns true if the files at the specified virtual path
+// are protected by a write once read many policy
+func (c *BaseConnection) IsWORMEnabled(virtualPath string) bool {
+	fsConfig := c.User.GetFsConfigForPath(virtualPath)
+	return fsConfig.WORMConfig.Enabled
+}
+
+// CheckWORMProtection returns an error if the existing file at the specified
+// virtual path cannot be modified, renamed or deleted because of the WORM
+// policy. Directories are not checked, the protected files inside them are
+func (c *BaseConnection) CheckWORMProtection(virtualPath string, info os.FileInfo) error {
+	if info == nil || info.IsDir() {
+		return nil
+	}
+	fsConfig := c.User.GetFsConfigForPath(virtualPath)
+	if !fsConfig.WORMConfig.IsProtected(info.ModTime()) {
+		return nil
+	}
+	c.Log(logger.LevelInfo, "denying change for WORM protected file %q, modification time: %s", virtualPath,
+		info.ModTime().UTC().Format(chtimesFormat))
+	return c.GetWORMProtectedError()
+}
+
+// checkWORMDirRename returns an error if the directory at the specified
+// virtual path is inside a WORM folder. Renaming a directory renames all
+// the files inside it, so it is never allowed
+func (c *BaseConnection) checkWORMDirRename(virtualPath string) error {
+	if !c.IsWORMEnabled(virtualPath) {
+		return nil
+	}
+	c.Log(logger.LevelInfo, "denying rename for directory %q inside a WORM folder", virtualPath)
+	return c.GetWORMProtectedError()
+}
+
+// isUploading returns true if the file at the specified virtual path is
+// being uploaded within this connection
+func (c *BaseConnection) isUploading(virtualPath string) bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	for _, t := range c.activeTransfers {
+		if t.GetType() == TransferUpload && t.GetVirtualPath() == virtualPath {
+			return true
+		}
+	}
+	return false
+}
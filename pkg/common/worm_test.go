@@ -0,0 +1,196 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+func TestWORMConfig(t *testing.T) {
+	c := vfs.WORMConfig{}
+	assert.False(t, c.IsProtected(time.Now()))
+	c.Enabled = true
+	assert.True(t, c.IsProtected(time.Now().Add(-1000*time.Hour)))
+	assert.True(t, c.GetRetainUntil(time.Now()).IsZero())
+	c.Retention = 2
+	assert.True(t, c.IsProtected(time.Now().Add(-1*time.Hour)))
+	assert.False(t, c.IsProtected(time.Now().Add(-3*time.Hour)))
+	modTime := time.Now()
+	assert.Equal(t, modTime.Add(2*time.Hour), c.GetRetainUntil(modTime))
+
+	assert.ErrorIs(t, getWORMProtectedError(ProtocolSFTP), sftp.ErrSSHFxPermissionDenied)
+	assert.ErrorIs(t, getWORMProtectedError(ProtocolWebDAV), os.ErrPermission)
+	assert.ErrorIs(t, getWORMProtectedError(ProtocolFTP), ErrWORMProtected)
+	assert.ErrorIs(t, getWORMProtectedError(ProtocolHTTP), ErrWORMProtected)
+}
+
+func TestWORMConfigValidation(t *testing.T) {
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "worm_validation_user",
+			HomeDir:  filepath.Join(os.TempDir(), "worm_validation_user"),
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+	}
+	user.FsConfig.WORMConfig = vfs.WORMConfig{
+		Enabled:   true,
+		Retention: -1,
+	}
+	err := dataprovider.AddUser(&user, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	user.FsConfig.WORMConfig.Retention = 100*365*24 + 1
+	err = dataprovider.AddUser(&user, "", "", "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	// the retention is ignored if WORM is disabled
+	user.FsConfig.WORMConfig.Enabled = false
+	err = dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+	assert.Equal(t, 0, user.FsConfig.WORMConfig.Retention)
+	user.FsConfig.WORMConfig = vfs.WORMConfig{
+		Enabled:   true,
+		Retention: 24,
+	}
+	err = dataprovider.UpdateUser(&user, "", "", "")
+	require.NoError(t, err)
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+	assert.True(t, user.FsConfig.WORMConfig.Enabled)
+	assert.Equal(t, 24, user.FsConfig.WORMConfig.Retention)
+
+	err = dataprovider.DeleteUser(user.Username, "", "", "")
+	assert.NoError(t, err)
+}
+
+func TestWORMFolder(t *testing.T) {
+	baseDir := filepath.Join(os.TempDir(), "worm_test")
+	defer os.RemoveAll(baseDir)
+
+	folder := vfs.BaseVirtualFolder{
+		Name:       "worm_folder",
+		MappedPath: filepath.Join(baseDir, "worm"),
+		FsConfig: vfs.Filesystem{
+			WORMConfig: vfs.WORMConfig{
+				Enabled:   true,
+				Retention: 1,
+			},
+		},
+	}
+	err := dataprovider.AddFolder(&folder, "", "", "")
+	require.NoError(t, err)
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "worm_user",
+			HomeDir:  filepath.Join(baseDir, "home"),
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+		VirtualFolders: []vfs.VirtualFolder{
+			{
+				BaseVirtualFolder: vfs.BaseVirtualFolder{
+					Name: folder.Name,
+				},
+				VirtualPath: "/worm",
+			},
+		},
+	}
+	err = dataprovider.AddUser(&user, "", "", "")
+	require.NoError(t, err)
+	user, err = dataprovider.UserExists(user.Username, "")
+	require.NoError(t, err)
+
+	conn := NewBaseConnection("", ProtocolFTP, "", "", user)
+	assert.True(t, conn.IsWORMEnabled("/worm/file.txt"))
+	assert.False(t, conn.IsWORMEnabled("/file.txt"))
+	require.NoError(t, os.MkdirAll(filepath.Join(folder.MappedPath, "dir"), os.ModePerm))
+	require.NoError(t, os.MkdirAll(user.HomeDir, os.ModePerm))
+	protectedPath := filepath.Join(folder.MappedPath, "file.txt")
+	require.NoError(t, os.WriteFile(protectedPath, []byte("data"), 0666))
+	expiredPath := filepath.Join(folder.MappedPath, "expired.txt")
+	require.NoError(t, os.WriteFile(expiredPath, []byte("data"), 0666))
+	expiredTime := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(expiredPath, expiredTime, expiredTime))
+	require.NoError(t, os.WriteFile(filepath.Join(user.HomeDir, "file.txt"), []byte("data"), 0666))
+
+	fs, fsPath, err := conn.GetFsAndResolvedPath("/worm/file.txt")
+	require.NoError(t, err)
+	info, err := fs.Lstat(fsPath)
+	require.NoError(t, err)
+	err = conn.RemoveFile(fs, fsPath, "/worm/file.txt", info)
+	assert.ErrorIs(t, err, ErrWORMProtected)
+	err = conn.Rename("/worm/file.txt", "/worm/renamed.txt")
+	assert.ErrorIs(t, err, ErrWORMProtected)
+	// a protected file cannot be replaced
+	err = conn.Rename("/file.txt", "/worm/file.txt")
+	assert.ErrorIs(t, err, ErrWORMProtected)
+	err = conn.Rename("/worm/dir", "/worm/dir1")
+	assert.ErrorIs(t, err, ErrWORMProtected)
+	err = conn.SetStat("/worm/file.txt", &StatAttributes{
+		Flags: StatAttrTimes,
+		Atime: time.Now(),
+		Mtime: time.Now().Add(-24 * time.Hour),
+	})
+	assert.ErrorIs(t, err, ErrWORMProtected)
+	err = conn.CreateSymlink("/worm/file.txt", "/worm/link")
+	assert.ErrorIs(t, err, ErrWORMProtected)
+	err = conn.RemoveAll("/worm")
+	assert.Error(t, err)
+	assert.FileExists(t, protectedPath)
+	// files outside the WORM folder are not protected
+	err = conn.Rename("/file.txt", "/file1.txt")
+	assert.NoError(t, err)
+	// new files can be added to the WORM folder
+	err = conn.Rename("/file1.txt", "/worm/file1.txt")
+	assert.NoError(t, err)
+	// empty directories can be removed
+	err = conn.RemoveDir("/worm/dir")
+	assert.NoError(t, err)
+	// the retention is expired
+	err = conn.Rename("/worm/expired.txt", "/worm/expired1.txt")
+	assert.NoError(t, err)
+	fs, fsPath, err = conn.GetFsAndResolvedPath("/worm/expired1.txt")
+	require.NoError(t, err)
+	info, err = fs.Lstat(fsPath)
+	require.NoError(t, err)
+	err = conn.RemoveFile(fs, fsPath, "/worm/expired1.txt", info)
+	assert.NoError(t, err)
+
+	sftpConn := NewBaseConnection("", ProtocolSFTP, "", "", user)
+	err = sftpConn.Rename("/worm/file.txt", "/worm/renamed.txt")
+	assert.ErrorIs(t, err, sftp.ErrSSHFxPermissionDenied)
+
+	err = dataprovider.DeleteUser(user.Username, "", "", "")
+	assert.NoError(t, err)
+	err = dataprovider.DeleteFolder(folder.Name, "", "", "")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,78 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"io"
+	"os"
+)
+
+// zeroCopyChunkSize is the size of each chunk sent using sendfile. The quota and
+// bandwidth limits are checked after each chunk, as for the standard reads
+const zeroCopyChunkSize = 256 * 1024
+
+// CanZeroCopy returns true if the downloaded file can be sent to w
+// avoiding to copy its contents in user space
+func (t *BaseTransfer) CanZeroCopy(w io.Writer) bool {
+	if !Config.ZeroCopyDownloads || t.transferType != TransferDownload {
+		return false
+	}
+	if _, ok := t.File.(*os.File); !ok {
+		return false
+	}
+	_, ok := w.(io.ReaderFrom)
+	return ok
+}
+
+// ZeroCopyWriteTo sends up to size bytes of the downloaded file to w, a negative
+// size means up to the end of the file. The contents are sent in chunks using the
+// w ReadFrom method, that uses sendfile if w is a TCP connection and the source
+// is a local file. CanZeroCopy must return true before calling this method
+func (t *BaseTransfer) ZeroCopyWriteTo(w io.Writer, size int64) (int64, error) {
+	rf := w.(io.ReaderFrom)
+	f := t.File.(*os.File)
+	var written int64
+
+	for size < 0 || written < size {
+		if t.AbortTransfer.Load() {
+			err := t.GetAbortError()
+			t.TransferError(err)
+			return written, err
+		}
+		t.Connection.UpdateLastActivity()
+
+		chunkSize := int64(zeroCopyChunkSize)
+		if size >= 0 {
+			chunkSize = min(chunkSize, size-written)
+		}
+		n, err := rf.ReadFrom(&io.LimitedReader{R: f, N: chunkSize})
+		written += n
+		t.BytesSent.Add(n)
+
+		if err == nil {
+			err = t.CheckRead()
+		}
+		if err != nil {
+			t.TransferError(err)
+			return written, t.ConvertError(err)
+		}
+		t.HandleThrottle()
+		if n < chunkSize {
+			// end of file
+			break
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,171 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+// startTCPSink returns a connected TCP client, the bytes received by the
+// server side are sent to the returned channel after the client is closed
+func startTCPSink(tb testing.TB) (*net.TCPConn, chan int64) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(tb, err)
+	received := make(chan int64, 1)
+	go func() {
+		defer l.Close()
+
+		c, err := l.Accept()
+		if err != nil {
+			received <- -1
+			return
+		}
+		n, _ := io.Copy(io.Discard, c)
+		c.Close()
+		received <- n
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(tb, err)
+	return c.(*net.TCPConn), received
+}
+
+func createZeroCopyTestFile(tb testing.TB, size int64) string {
+	name := filepath.Join(os.TempDir(), "zero_copy_test_file")
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	require.NoError(tb, err)
+	require.NoError(tb, os.WriteFile(name, data, 0666))
+	return name
+}
+
+func TestZeroCopyDownload(t *testing.T) {
+	testFileSize := int64(1048576 + 123)
+	testFile := createZeroCopyTestFile(t, testFileSize)
+	defer os.Remove(testFile)
+
+	fs := vfs.NewOsFs("", os.TempDir(), "", nil)
+	conn := NewBaseConnection("", ProtocolFTP, "", "", dataprovider.User{})
+	f, err := os.Open(testFile)
+	require.NoError(t, err)
+	transfer := NewBaseTransfer(f, conn, nil, testFile, testFile, "/file", TransferDownload, 0, 0, 0, 0, false, fs,
+		dataprovider.TransferQuota{})
+
+	c, received := startTCPSink(t)
+	assert.False(t, transfer.CanZeroCopy(c))
+
+	Config.ZeroCopyDownloads = true
+	defer func() {
+		Config.ZeroCopyDownloads = false
+	}()
+
+	assert.True(t, transfer.CanZeroCopy(c))
+	var buf bytes.Buffer
+	assert.False(t, transfer.CanZeroCopy(struct{ io.Writer }{&buf}))
+
+	n, err := transfer.ZeroCopyWriteTo(c, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, testFileSize, n)
+	assert.Equal(t, testFileSize, transfer.BytesSent.Load())
+	// partial download
+	_, err = f.Seek(100, io.SeekStart)
+	require.NoError(t, err)
+	n, err = transfer.ZeroCopyWriteTo(c, 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), n)
+	c.Close()
+	assert.Equal(t, testFileSize+1000, <-received)
+	assert.NoError(t, transfer.Close())
+	// the transfer quota is enforced
+	f, err = os.Open(testFile)
+	require.NoError(t, err)
+	transfer = NewBaseTransfer(f, conn, nil, testFile, testFile, "/file", TransferDownload, 0, 0, 0, 0, false, fs,
+		dataprovider.TransferQuota{AllowedDLSize: 1000})
+	c, received = startTCPSink(t)
+	_, err = transfer.ZeroCopyWriteTo(c, -1)
+	assert.ErrorIs(t, err, conn.GetReadQuotaExceededError())
+	c.Close()
+	assert.Equal(t, int64(zeroCopyChunkSize), <-received)
+	assert.Error(t, transfer.Close())
+	// uploads and files not opened locally are not supported
+	transfer = NewBaseTransfer(nil, conn, nil, testFile, testFile, "/file", TransferDownload, 0, 0, 0, 0, false, fs,
+		dataprovider.TransferQuota{})
+	assert.False(t, transfer.CanZeroCopy(&buf))
+	assert.NoError(t, transfer.Close())
+	f, err = os.Open(testFile)
+	require.NoError(t, err)
+	transfer = NewBaseTransfer(f, conn, nil, testFile, testFile, "/file", TransferUpload, 0, 0, 0, 0, false, fs,
+		dataprovider.TransferQuota{})
+	assert.False(t, transfer.CanZeroCopy(&buf))
+	assert.NoError(t, f.Close())
+}
+
+func benchmarkDownload(b *testing.B, zeroCopy bool) {
+	testFileSize := int64(8 * 1048576)
+	testFile := createZeroCopyTestFile(b, testFileSize)
+	defer os.Remove(testFile)
+
+	fs := vfs.NewOsFs("", os.TempDir(), "", nil)
+	conn := NewBaseConnection("", ProtocolFTP, "", "", dataprovider.User{})
+	Config.ZeroCopyDownloads = zeroCopy
+	defer func() {
+		Config.ZeroCopyDownloads = false
+	}()
+
+	b.SetBytes(testFileSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		f, err := os.Open(testFile)
+		require.NoError(b, err)
+		transfer := NewBaseTransfer(f, conn, nil, testFile, testFile, "/file", TransferDownload, 0, 0, 0, 0, false, fs,
+			dataprovider.TransferQuota{})
+		c, received := startTCPSink(b)
+		b.StartTimer()
+
+		if transfer.CanZeroCopy(c) {
+			_, err = transfer.ZeroCopyWriteTo(c, -1)
+		} else {
+			// the same copy used for the standard downloads
+			_, err = io.Copy(c, struct{ io.Reader }{f})
+		}
+		require.NoError(b, err)
+		c.Close()
+		require.Equal(b, testFileSize, <-received)
+
+		b.StopTimer()
+		transfer.Close() //nolint:errcheck
+		b.StartTimer()
+	}
+}
+
+func BenchmarkDownloadStandardCopy(b *testing.B) {
+	benchmarkDownload(b, false)
+}
+
+func BenchmarkDownloadZeroCopy(b *testing.B) {
+	benchmarkDownload(b, true)
+}
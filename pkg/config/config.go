@@ -22,6 +22,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/spf13/viper"
 	"github.com/subosito/gotenv"
@@ -40,8 +41,10 @@ import (
 	"github.com/drakkan/sftpgo/v2/pkg/sftpd"
 	"github.com/drakkan/sftpgo/v2/pkg/smtp"
 	"github.com/drakkan/sftpgo/v2/pkg/telemetry"
+	"github.com/drakkan/sftpgo/v2/pkg/tracing"
 	"github.com/drakkan/sftpgo/v2/pkg/util"
 	"github.com/drakkan/sftpgo/v2/pkg/version"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
 	"github.com/drakkan/sftpgo/v2/pkg/webdavd"
 )
 
@@ -58,6 +61,9 @@ const (
 
 var (
 	globalConf             globalConfig
+	loadedConfigDir        string
+	loadedConfigFile       string
+	configReportMutex      sync.Mutex
 	defaultSFTPDBanner     = fmt.Sprintf("SFTPGo_%v", version.Get().Version)
 	defaultFTPDBanner      = fmt.Sprintf("SFTPGo %v ready", version.Get().Version)
 	defaultInstallCodeHint = "Installation code"
@@ -65,6 +71,7 @@ var (
 		Address:          "",
 		Port:             2022,
 		ApplyProxyConfig: true,
+		SecurityProfile:  "",
 	}
 	defaultFTPDBinding = ftpd.Binding{
 		Address:                    "",
@@ -73,14 +80,19 @@ var (
 		TLSMode:                    0,
 		CertificateFile:            "",
 		CertificateKeyFile:         "",
+		SNICertificates:            nil,
+		ACMEOnDemand:               false,
 		MinTLSVersion:              12,
 		ForcePassiveIP:             "",
 		PassiveIPOverrides:         nil,
 		PassiveHost:                "",
+		PassivePortRange:           ftpd.PortRange{},
 		ClientAuthType:             0,
 		TLSCipherSuites:            nil,
 		PassiveConnectionsSecurity: 0,
 		ActiveConnectionsSecurity:  0,
+		ActiveSourcePort:           0,
+		ExtendedCommandsPolicy:     0,
 		Debug:                      false,
 	}
 	defaultWebDAVDBinding = webdavd.Binding{
@@ -89,6 +101,8 @@ var (
 		EnableHTTPS:          false,
 		CertificateFile:      "",
 		CertificateKeyFile:   "",
+		SNICertificates:      nil,
+		ACMEOnDemand:         false,
 		MinTLSVersion:        12,
 		ClientAuthType:       0,
 		TLSCipherSuites:      nil,
@@ -104,10 +118,13 @@ var (
 		EnableWebAdmin:        true,
 		EnableWebClient:       true,
 		EnableRESTAPI:         true,
+		EnableGraphQL:         false,
 		EnabledLoginMethods:   0,
 		EnableHTTPS:           false,
 		CertificateFile:       "",
 		CertificateKeyFile:    "",
+		SNICertificates:       nil,
+		ACMEOnDemand:          false,
 		MinTLSVersion:         12,
 		ClientAuthType:        0,
 		TLSCipherSuites:       nil,
@@ -130,6 +147,23 @@ var (
 			InsecureSkipSignatureCheck: false,
 			Debug:                      false,
 		},
+		SAML: httpd.SAML{
+			IDPMetadataURL:     "",
+			IDPMetadataFile:    "",
+			EntityID:           "",
+			BaseURL:            "",
+			CertificateFile:    "",
+			CertificateKeyFile: "",
+			SignRequests:       false,
+			UsernameAttribute:  "",
+			RoleAttribute:      "",
+			AdminRoleValues:    []string{},
+			ImplicitRoles:      false,
+			CustomAttributes:   []string{},
+			AutoProvisioning:   false,
+			ProvisioningGroup:  "",
+			Debug:              false,
+		},
 		Security: httpd.SecurityConf{
 			Enabled:                 false,
 			AllowedHosts:            nil,
@@ -147,6 +181,14 @@ var (
 			CrossOriginOpenerPolicy: "",
 			ExpectCTHeader:          "",
 		},
+		RequestFilter: httpd.RequestFilter{
+			Enabled:                false,
+			DenyPathTraversal:      true,
+			MaxHeadersSize:         0,
+			DeniedPatterns:         nil,
+			Routes:                 nil,
+			GenerateDefenderEvents: false,
+		},
 		Branding: httpd.Branding{},
 	}
 	defaultRateLimiter = common.RateLimiterConfig{
@@ -156,6 +198,7 @@ var (
 		Type:                   2,
 		Protocols:              []string{common.ProtocolSSH, common.ProtocolFTP, common.ProtocolWebDAV, common.ProtocolHTTP},
 		GenerateDefenderEvents: false,
+		HTTPRoutes:             nil,
 		EntriesSoftLimit:       100,
 		EntriesHardLimit:       150,
 	}
@@ -181,6 +224,7 @@ type globalConfig struct {
 	TelemetryConfig telemetry.Conf        `json:"telemetry" mapstructure:"telemetry"`
 	PluginsConfig   []plugin.Config       `json:"plugins" mapstructure:"plugins"`
 	SMTPConfig      smtp.Config           `json:"smtp" mapstructure:"smtp"`
+	SecretRefs      SecretRefsConfig      `json:"secret_refs" mapstructure:"secret_refs"`
 }
 
 func init() {
@@ -191,6 +235,10 @@ func init() {
 // It is not supposed to be called outside of this package.
 // It is exported to minimize refactoring efforts. Will eventually disappear.
 func Init() {
+	initConfig(true)
+}
+
+func initConfig(useEnv bool) {
 	// create a default configuration to use if no config file is provided
 	globalConf = globalConfig{
 		Common: common.Configuration{
@@ -210,10 +258,27 @@ func Init() {
 			PostConnectHook:       "",
 			PostDisconnectHook:    "",
 			DataRetentionHook:     "",
+			StagingHook:           "",
+			StoreChecksums:        false,
 			MaxTotalConnections:   0,
 			MaxPerHostConnections: 20,
-			AllowListStatus:       0,
-			AllowSelfConnections:  0,
+			Fairness: common.FairnessConfig{
+				Enabled:       false,
+				BusyThreshold: 80,
+				MaxHostShare:  0,
+				MaxUserShare:  0,
+				RoleWeights:   []string{},
+				DefaultWeight: 1,
+			},
+			AllowListStatus:      0,
+			AllowSelfConnections: 0,
+			ZeroCopyDownloads:    false,
+			MemoryBudget: common.MemoryBudgetConfig{
+				BufferSize:          32,
+				MaxMemory:           0,
+				MaxConnectionMemory: 0,
+				WaitTimeout:         60,
+			},
 			DefenderConfig: common.DefenderConfig{
 				Enabled:            false,
 				Driver:             common.DefenderDriverMemory,
@@ -227,8 +292,133 @@ func Init() {
 				ObservationTime:    30,
 				EntriesSoftLimit:   100,
 				EntriesHardLimit:   150,
+				BanCountries:       []string{},
+				Escalation: common.DefenderEscalationConfig{
+					Enabled:           false,
+					ThrottleThreshold: 8,
+					ThrottleDelay:     2000,
+					LongBanThreshold:  3,
+					LongBanTime:       1440,
+					DeescalationTime:  1440,
+				},
+				Redis: common.DefenderRedisConfig{
+					Address:   "",
+					Username:  "",
+					Password:  "",
+					DB:        0,
+					KeyPrefix: "sftpgo:defender:",
+					UseTLS:    false,
+				},
+				CrowdSec: common.DefenderCrowdSecConfig{
+					URL:          "",
+					MachineID:    "",
+					Password:     "",
+					APIKey:       "",
+					PullInterval: 60,
+				},
+				Blocklists: common.DefenderBlocklistsConfig{
+					UpdateInterval: 60,
+					Lists:          nil,
+				},
 			},
 			RateLimitersConfig: []common.RateLimiterConfig{defaultRateLimiter},
+			Search: common.SearchConfig{
+				Enabled:        false,
+				Driver:         common.SearchDriverMemory,
+				IndexContents:  false,
+				MaxContentSize: 1024,
+				Elasticsearch: common.ElasticsearchConfig{
+					URL:      "",
+					Index:    "sftpgo",
+					Username: "",
+					Password: "",
+				},
+			},
+			Analytics: common.AnalyticsConfig{
+				Enabled:         false,
+				MaxTrackedFiles: 100000,
+			},
+			UserWebhooks: common.UserWebhooksConfig{
+				Enabled:              false,
+				RateLimit:            60,
+				Timeout:              10,
+				AllowPrivateNetworks: false,
+			},
+			Cluster: common.ClusterConfig{
+				Enabled:      false,
+				SyncInterval: 10,
+			},
+			Consents: common.ConsentsConfig{
+				Documents:           nil,
+				EnforceForProtocols: false,
+				LinkValidity:        72,
+			},
+			SFTPFsPool: vfs.SFTPPoolConfig{
+				MaxSessionsPerConnection: 5,
+				MaxConnections:           0,
+				HealthCheckInterval:      30,
+				IdleTimeout:              30,
+				MaxBackoff:               60,
+				ProxyProtocol:            0,
+			},
+			QoS: common.QoSConfig{
+				UploadBandwidth:   0,
+				DownloadBandwidth: 0,
+				Classes:           nil,
+				DefaultClass:      "default",
+			},
+			PullJobs: common.PullJobsConfig{
+				Enabled:              false,
+				AllowedHosts:         []string{},
+				AllowPrivateNetworks: false,
+				MaxAttempts:          3,
+				MaxConcurrentJobs:    2,
+			},
+			ObjectCache: vfs.ObjectCacheConfig{
+				Path:          "",
+				MaxSize:       1024,
+				MaxObjectSize: 0,
+				CacheUploads:  false,
+			},
+			DirListCache: vfs.DirListCacheConfig{
+				TTL:           0,
+				MaxDirs:       1000,
+				MaxDirEntries: 10000,
+			},
+			Dedup: vfs.DedupConfig{
+				StorePath:   "",
+				MinFileSize: 4,
+				GCInterval:  60,
+			},
+			ScheduledQuotaScans: common.ScheduledQuotaScansConfig{
+				Interval:      0,
+				Incremental:   false,
+				FullScanEvery: 0,
+			},
+			Jobs: common.JobsConfig{
+				MaxConcurrentJobs: 10,
+				Retention:         24,
+			},
+			ProviderBackups: common.ProviderBackupsConfig{
+				Schedule:     "",
+				Encrypt:      false,
+				KeepDaily:    7,
+				KeepWeekly:   4,
+				RemoteFolder: "",
+				RemotePath:   "/",
+			},
+			AuditLog: logger.AuditLogConfig{
+				Address:       "",
+				Network:       "udp",
+				Format:        logger.AuditFormatRFC5424,
+				Categories:    []string{},
+				CACertificate: "",
+			},
+			GeoIP: common.GeoIPConfig{
+				DatabasePath:     "",
+				AllowedCountries: []string{},
+				DeniedCountries:  []string{},
+			},
 		},
 		ACME: acme.Configuration{
 			Email:      "",
@@ -245,6 +435,9 @@ func Init() {
 			TLSALPN01Challenge: acme.TLSALPN01Challenge{
 				Port: 0,
 			},
+			OnDemand: acme.OnDemand{
+				AllowedHosts: []string{},
+			},
 		},
 		SFTPD: sftpd.Configuration{
 			Bindings:                          []sftpd.Binding{defaultSFTPDBinding},
@@ -257,6 +450,7 @@ func Init() {
 			KexAlgorithms:                     []string{},
 			Ciphers:                           []string{},
 			MACs:                              []string{},
+			SecurityProfile:                   "",
 			TrustedUserCAKeys:                 []string{},
 			RevokedUserCertsFile:              "",
 			LoginBannerFile:                   "",
@@ -368,12 +562,28 @@ func Init() {
 			DelayedQuotaUpdate: 0,
 			CreateDefaultAdmin: false,
 			NamingRules:        1,
-			IsShared:           0,
+			UsernameMapping: dataprovider.UsernameMappingConfig{
+				StripDomains: []string{},
+				CaseFolding:  false,
+			},
+			IsShared: 0,
 			Node: dataprovider.NodeConfig{
 				Host:  "",
 				Port:  0,
 				Proto: "http",
 			},
+			AuditLog: dataprovider.AuditLogConfig{
+				Enabled:   false,
+				Retention: 0,
+			},
+			ShareEvents: dataprovider.ShareEventsConfig{
+				Enabled:   false,
+				Retention: 30,
+			},
+			Snapshots: dataprovider.ConfigSnapshotsConfig{
+				Enabled:   false,
+				Retention: 30,
+			},
 			BackupsPath: "backups",
 		},
 		HTTPDConfig: httpd.Conf{
@@ -406,6 +616,34 @@ func Init() {
 				InstallationCodeHint: defaultInstallCodeHint,
 			},
 			HideSupportLink: false,
+			ArchiveJobs: httpd.ArchiveJobsConfig{
+				Enabled:           true,
+				MaxConcurrentJobs: 2,
+				MaxSize:           0,
+				Bandwidth:         0,
+				Retention:         2,
+			},
+			Thumbnails: httpd.ThumbnailsConfig{
+				Enabled:            true,
+				Sizes:              []int{64, 256},
+				MaxFileSize:        20971520,
+				CacheDir:           "",
+				BackendCacheDirs:   map[string]string{},
+				Retention:          168,
+				PDFRenderer:        "",
+				PDFRendererTimeout: 30,
+			},
+			Media: httpd.MediaConfig{
+				TranscodingHook: "",
+				MaxTranscodings: 2,
+				VideoExtensions: []string{".avi", ".mkv", ".wmv", ".flv", ".mpg", ".mpeg", ".3gp", ".ts", ".m2ts"},
+				AudioExtensions: []string{".wma", ".aiff", ".aif", ".ape", ".amr", ".ac3"},
+			},
+			Registration: httpd.RegistrationConfig{
+				Enabled:      false,
+				TemplateUser: "",
+				NotifyEmails: nil,
+			},
 		},
 		HTTPConfig: httpclient.Config{
 			Timeout:        20,
@@ -416,6 +654,7 @@ func Init() {
 			Certificates:   nil,
 			SkipTLSVerify:  false,
 			Headers:        nil,
+			ClientIPHeader: "",
 		},
 		CommandConfig: command.Config{
 			Timeout:  30,
@@ -441,6 +680,13 @@ func Init() {
 			CertificateKeyFile: "",
 			MinTLSVersion:      12,
 			TLSCipherSuites:    nil,
+			Tracing: tracing.Config{
+				Enabled:     false,
+				Endpoint:    "",
+				Insecure:    false,
+				ServiceName: "sftpgo",
+				SampleRatio: 1,
+			},
 		},
 		SMTPConfig: smtp.Config{
 			Host:          "",
@@ -454,15 +700,20 @@ func Init() {
 			TemplatesPath: "templates",
 		},
 		PluginsConfig: nil,
+		SecretRefs: SecretRefsConfig{
+			RefreshInterval: 0,
+		},
 	}
 
-	viper.SetEnvPrefix(configEnvPrefix)
-	replacer := strings.NewReplacer(".", "__")
-	viper.SetEnvKeyReplacer(replacer)
 	viper.SetConfigName(configName)
 	setViperDefaults()
-	viper.AutomaticEnv()
-	viper.AllowEmptyEnv(true)
+	if useEnv {
+		viper.SetEnvPrefix(configEnvPrefix)
+		replacer := strings.NewReplacer(".", "__")
+		viper.SetEnvKeyReplacer(replacer)
+		viper.AutomaticEnv()
+		viper.AllowEmptyEnv(true)
+	}
 }
 
 // GetCommonConfig returns the common protocols configuration
@@ -520,6 +771,25 @@ func GetProviderConf() dataprovider.Config {
 	return globalConf.ProviderConf
 }
 
+// GetProviderConfFromFile returns the data provider configuration defined in
+// the specified configuration file. Settings not defined in the file are
+// inherited from the loaded configuration. Environment variables are ignored
+func GetProviderConfFromFile(configFile string) (dataprovider.Config, error) {
+	conf := globalConf.ProviderConf
+	v := viper.New()
+	v.SetConfigFile(configFile)
+	if err := v.ReadInConfig(); err != nil {
+		return conf, fmt.Errorf("unable to read configuration file %q: %w", configFile, err)
+	}
+	if !v.IsSet("data_provider") {
+		return conf, fmt.Errorf("configuration file %q has no data_provider section", configFile)
+	}
+	if err := v.UnmarshalKey("data_provider", &conf); err != nil {
+		return conf, fmt.Errorf("unable to parse the data_provider section in %q: %w", configFile, err)
+	}
+	return conf, nil
+}
+
 // SetProviderConf sets the configuration for the data provider
 func SetProviderConf(config dataprovider.Config) {
 	globalConf.ProviderConf = config
@@ -606,12 +876,28 @@ func getRedactedPassword(value string) string {
 }
 
 func getRedactedGlobalConf() globalConfig {
-	conf := globalConf
+	return getRedactedConf(globalConf)
+}
+
+func getRedactedConf(conf globalConfig) globalConfig {
+	headers := conf.HTTPConfig.Headers
+	bindings := conf.HTTPDConfig.Bindings
+	blocklists := conf.Common.DefenderConfig.Blocklists.Lists
 	conf.Common.Actions.Hook = util.GetRedactedURL(conf.Common.Actions.Hook)
 	conf.Common.StartupHook = util.GetRedactedURL(conf.Common.StartupHook)
 	conf.Common.PostConnectHook = util.GetRedactedURL(conf.Common.PostConnectHook)
 	conf.Common.PostDisconnectHook = util.GetRedactedURL(conf.Common.PostDisconnectHook)
 	conf.Common.DataRetentionHook = util.GetRedactedURL(conf.Common.DataRetentionHook)
+	conf.Common.StagingHook = util.GetRedactedURL(conf.Common.StagingHook)
+	conf.Common.Search.Elasticsearch.Password = getRedactedPassword(conf.Common.Search.Elasticsearch.Password)
+	conf.Common.DefenderConfig.Redis.Password = getRedactedPassword(conf.Common.DefenderConfig.Redis.Password)
+	conf.Common.DefenderConfig.CrowdSec.Password = getRedactedPassword(conf.Common.DefenderConfig.CrowdSec.Password)
+	conf.Common.DefenderConfig.CrowdSec.APIKey = getRedactedPassword(conf.Common.DefenderConfig.CrowdSec.APIKey)
+	conf.Common.DefenderConfig.Blocklists.Lists = nil
+	for _, list := range blocklists {
+		list.URL = util.GetRedactedURL(list.URL)
+		conf.Common.DefenderConfig.Blocklists.Lists = append(conf.Common.DefenderConfig.Blocklists.Lists, list)
+	}
 	conf.SFTPD.KeyboardInteractiveHook = util.GetRedactedURL(conf.SFTPD.KeyboardInteractiveHook)
 	conf.HTTPDConfig.SigningPassphrase = getRedactedPassword(conf.HTTPDConfig.SigningPassphrase)
 	conf.HTTPDConfig.Setup.InstallationCode = getRedactedPassword(conf.HTTPDConfig.Setup.InstallationCode)
@@ -622,8 +908,14 @@ func getRedactedGlobalConf() globalConfig {
 	conf.ProviderConf.PostLoginHook = util.GetRedactedURL(conf.ProviderConf.PostLoginHook)
 	conf.ProviderConf.CheckPasswordHook = util.GetRedactedURL(conf.ProviderConf.CheckPasswordHook)
 	conf.SMTPConfig.Password = getRedactedPassword(conf.SMTPConfig.Password)
+	conf.KMSConfig.Secrets.MasterKeyString = getRedactedPassword(conf.KMSConfig.Secrets.MasterKeyString)
+	conf.HTTPConfig.Headers = nil
+	for _, header := range headers {
+		header.Value = getRedactedPassword(header.Value)
+		conf.HTTPConfig.Headers = append(conf.HTTPConfig.Headers, header)
+	}
 	conf.HTTPDConfig.Bindings = nil
-	for _, binding := range globalConf.HTTPDConfig.Bindings {
+	for _, binding := range bindings {
 		binding.OIDC.ClientID = getRedactedPassword(binding.OIDC.ClientID)
 		binding.OIDC.ClientSecret = getRedactedPassword(binding.OIDC.ClientSecret)
 		conf.HTTPDConfig.Bindings = append(conf.HTTPDConfig.Bindings, binding)
@@ -709,8 +1001,19 @@ func checkOverrideDefaultSettings() {
 // $HOME/.config/sftpgo and /etc/sftpgo too.
 // configFile is an absolute or relative path (to the config dir) to the configuration file.
 func LoadConfig(configDir, configFile string) error {
+	err := loadConfig(configDir, configFile, true)
+	if err == nil {
+		loadedConfigDir = configDir
+		loadedConfigFile = configFile
+	}
+	return err
+}
+
+func loadConfig(configDir, configFile string, useEnv bool) error {
 	var err error
-	readEnvFiles(configDir)
+	if useEnv {
+		readEnvFiles(configDir)
+	}
 	viper.AddConfigPath(configDir)
 	setViperAdditionalConfigPaths()
 	viper.AddConfigPath(".")
@@ -734,11 +1037,20 @@ func LoadConfig(configDir, configFile string) error {
 		logger.WarnToConsole("error parsing configuration file: %v", err)
 		return err
 	}
-	// viper only supports slice of strings from env vars, so we use our custom method
-	loadBindingsFromEnv()
-	loadWebDAVCacheMappingsFromEnv()
+	if useEnv {
+		// viper only supports slice of strings from env vars, so we use our custom method
+		loadBindingsFromEnv()
+		loadWebDAVCacheMappingsFromEnv()
+	}
 	resetInvalidConfigs()
 	logger.Debug(logSender, "", "config file used: '%q', config loaded: %+v", viper.ConfigFileUsed(), getRedactedGlobalConf())
+	// resolve the secret references after logging the configuration so the
+	// referenced values are never logged
+	if err := resolveSecretRefs(); err != nil {
+		logger.Warn(logSender, "", "error resolving secret references: %v", err)
+		logger.WarnToConsole("error resolving secret references: %v", err)
+		return err
+	}
 	return nil
 }
 
@@ -807,6 +1119,9 @@ func loadBindingsFromEnv() {
 	for idx := 0; idx < 10; idx++ {
 		getTOTPFromEnv(idx)
 		getRateLimitersFromEnv(idx)
+		getDefenderBlocklistsFromEnv(idx)
+		getConsentDocumentsFromEnv(idx)
+		getQoSClassesFromEnv(idx)
 		getPluginsFromEnv(idx)
 		getSFTPDBindindFromEnv(idx)
 		getFTPDBindingFromEnv(idx)
@@ -853,6 +1168,123 @@ func getTOTPFromEnv(idx int) {
 	}
 }
 
+func getDefenderBlocklistsFromEnv(idx int) {
+	var list common.DefenderBlocklist
+	if len(globalConf.Common.DefenderConfig.Blocklists.Lists) > idx {
+		list = globalConf.Common.DefenderConfig.Blocklists.Lists[idx]
+	}
+
+	isSet := false
+
+	name, ok := os.LookupEnv(fmt.Sprintf("SFTPGO_COMMON__DEFENDER__BLOCKLISTS__LISTS__%v__NAME", idx))
+	if ok {
+		list.Name = name
+		isSet = true
+	}
+
+	listURL, ok := os.LookupEnv(fmt.Sprintf("SFTPGO_COMMON__DEFENDER__BLOCKLISTS__LISTS__%v__URL", idx))
+	if ok {
+		list.URL = listURL
+		isSet = true
+	}
+
+	mode, ok := lookupIntFromEnv(fmt.Sprintf("SFTPGO_COMMON__DEFENDER__BLOCKLISTS__LISTS__%v__MODE", idx), 0)
+	if ok {
+		list.Mode = int(mode)
+		isSet = true
+	}
+
+	protocols, ok := lookupIntFromEnv(fmt.Sprintf("SFTPGO_COMMON__DEFENDER__BLOCKLISTS__LISTS__%v__PROTOCOLS", idx), 0)
+	if ok {
+		list.Protocols = int(protocols)
+		isSet = true
+	}
+
+	if isSet {
+		if len(globalConf.Common.DefenderConfig.Blocklists.Lists) > idx {
+			globalConf.Common.DefenderConfig.Blocklists.Lists[idx] = list
+		} else {
+			globalConf.Common.DefenderConfig.Blocklists.Lists = append(globalConf.Common.DefenderConfig.Blocklists.Lists, list)
+		}
+	}
+}
+
+func getConsentDocumentsFromEnv(idx int) {
+	var doc common.ConsentDocument
+	if len(globalConf.Common.Consents.Documents) > idx {
+		doc = globalConf.Common.Consents.Documents[idx]
+	}
+
+	isSet := false
+
+	name, ok := os.LookupEnv(fmt.Sprintf("SFTPGO_COMMON__CONSENTS__DOCUMENTS__%v__NAME", idx))
+	if ok {
+		doc.Name = name
+		isSet = true
+	}
+
+	title, ok := os.LookupEnv(fmt.Sprintf("SFTPGO_COMMON__CONSENTS__DOCUMENTS__%v__TITLE", idx))
+	if ok {
+		doc.Title = title
+		isSet = true
+	}
+
+	version, ok := os.LookupEnv(fmt.Sprintf("SFTPGO_COMMON__CONSENTS__DOCUMENTS__%v__VERSION", idx))
+	if ok {
+		doc.Version = version
+		isSet = true
+	}
+
+	docPath, ok := os.LookupEnv(fmt.Sprintf("SFTPGO_COMMON__CONSENTS__DOCUMENTS__%v__PATH", idx))
+	if ok {
+		doc.Path = docPath
+		isSet = true
+	}
+
+	reaccept, ok := lookupBoolFromEnv(fmt.Sprintf("SFTPGO_COMMON__CONSENTS__DOCUMENTS__%v__REACCEPT_ON_UPDATE", idx))
+	if ok {
+		doc.ReacceptOnUpdate = reaccept
+		isSet = true
+	}
+
+	if isSet {
+		if len(globalConf.Common.Consents.Documents) > idx {
+			globalConf.Common.Consents.Documents[idx] = doc
+		} else {
+			globalConf.Common.Consents.Documents = append(globalConf.Common.Consents.Documents, doc)
+		}
+	}
+}
+
+func getQoSClassesFromEnv(idx int) {
+	var class common.QoSClass
+	if len(globalConf.Common.QoS.Classes) > idx {
+		class = globalConf.Common.QoS.Classes[idx]
+	}
+
+	isSet := false
+
+	name, ok := os.LookupEnv(fmt.Sprintf("SFTPGO_COMMON__QOS__CLASSES__%v__NAME", idx))
+	if ok {
+		class.Name = name
+		isSet = true
+	}
+
+	weight, ok := lookupIntFromEnv(fmt.Sprintf("SFTPGO_COMMON__QOS__CLASSES__%v__WEIGHT", idx), 0)
+	if ok {
+		class.Weight = int(weight)
+		isSet = true
+	}
+
+	if isSet {
+		if len(globalConf.Common.QoS.Classes) > idx {
+			globalConf.Common.QoS.Classes[idx] = class
+		} else {
+			globalConf.Common.QoS.Classes = append(globalConf.Common.QoS.Classes, class)
+		}
+	}
+}
+
 func getRateLimitersFromEnv(idx int) {
 	rtlConfig := defaultRateLimiter
 	if len(globalConf.Common.RateLimitersConfig) > idx {
@@ -897,6 +1329,12 @@ func getRateLimitersFromEnv(idx int) {
 		isSet = true
 	}
 
+	httpRoutes, ok := lookupStringListFromEnv(fmt.Sprintf("SFTPGO_COMMON__RATE_LIMITERS__%v__HTTP_ROUTES", idx))
+	if ok {
+		rtlConfig.HTTPRoutes = httpRoutes
+		isSet = true
+	}
+
 	softLimit, ok := lookupIntFromEnv(fmt.Sprintf("SFTPGO_COMMON__RATE_LIMITERS__%v__ENTRIES_SOFT_LIMIT", idx), 0)
 	if ok {
 		rtlConfig.EntriesSoftLimit = int(softLimit)
@@ -1084,6 +1522,12 @@ func getSFTPDBindindFromEnv(idx int) {
 		isSet = true
 	}
 
+	securityProfile, ok := os.LookupEnv(fmt.Sprintf("SFTPGO_SFTPD__BINDINGS__%v__SECURITY_PROFILE", idx))
+	if ok {
+		binding.SecurityProfile = securityProfile
+		isSet = true
+	}
+
 	if isSet {
 		if len(globalConf.SFTPD.Bindings) > idx {
 			globalConf.SFTPD.Bindings[idx] = binding
@@ -1130,6 +1574,40 @@ func getFTPDPassiveIPOverridesFromEnv(idx int) []ftpd.PassiveIPOverride {
 	return overrides
 }
 
+func getSNICertificatesFromEnv(prefix string, sniCertificates []common.SNICertificate) ([]common.SNICertificate, bool) {
+	isSet := false
+
+	for subIdx := 0; subIdx < 10; subIdx++ {
+		var sniCert common.SNICertificate
+		replace := false
+		if len(sniCertificates) > subIdx {
+			sniCert = sniCertificates[subIdx]
+			replace = true
+		}
+
+		certificateFile, certOK := os.LookupEnv(fmt.Sprintf("%s__SNI_CERTIFICATES__%v__CERTIFICATE_FILE", prefix, subIdx))
+		if certOK {
+			sniCert.CertificateFile = certificateFile
+		}
+		certificateKeyFile, keyOK := os.LookupEnv(fmt.Sprintf("%s__SNI_CERTIFICATES__%v__CERTIFICATE_KEY_FILE",
+			prefix, subIdx))
+		if keyOK {
+			sniCert.CertificateKeyFile = certificateKeyFile
+		}
+
+		if certOK || keyOK {
+			isSet = true
+			if replace {
+				sniCertificates[subIdx] = sniCert
+			} else {
+				sniCertificates = append(sniCertificates, sniCert)
+			}
+		}
+	}
+
+	return sniCertificates, isSet
+}
+
 func getDefaultFTPDBinding(idx int) ftpd.Binding {
 	binding := defaultFTPDBinding
 	if len(globalConf.FTPD.Bindings) > idx {
@@ -1153,6 +1631,19 @@ func getFTPDBindingSecurityFromEnv(idx int, binding *ftpd.Binding) bool {
 		isSet = true
 	}
 
+	sniCertificates, ok := getSNICertificatesFromEnv(fmt.Sprintf("SFTPGO_FTPD__BINDINGS__%v", idx),
+		binding.SNICertificates)
+	if ok {
+		binding.SNICertificates = sniCertificates
+		isSet = true
+	}
+
+	acmeOnDemand, ok := lookupBoolFromEnv(fmt.Sprintf("SFTPGO_FTPD__BINDINGS__%v__ACME_ON_DEMAND", idx))
+	if ok {
+		binding.ACMEOnDemand = acmeOnDemand
+		isSet = true
+	}
+
 	tlsMode, ok := lookupIntFromEnv(fmt.Sprintf("SFTPGO_FTPD__BINDINGS__%v__TLS_MODE", idx), 0)
 	if ok {
 		binding.TLSMode = int(tlsMode)
@@ -1189,6 +1680,18 @@ func getFTPDBindingSecurityFromEnv(idx int, binding *ftpd.Binding) bool {
 		isSet = true
 	}
 
+	activeSourcePort, ok := lookupIntFromEnv(fmt.Sprintf("SFTPGO_FTPD__BINDINGS__%v__ACTIVE_SOURCE_PORT", idx), 0)
+	if ok {
+		binding.ActiveSourcePort = int(activeSourcePort)
+		isSet = true
+	}
+
+	extendedCommandsPolicy, ok := lookupIntFromEnv(fmt.Sprintf("SFTPGO_FTPD__BINDINGS__%v__EXTENDED_COMMANDS_POLICY", idx), 0)
+	if ok {
+		binding.ExtendedCommandsPolicy = int(extendedCommandsPolicy)
+		isSet = true
+	}
+
 	return isSet
 }
 
@@ -1232,6 +1735,18 @@ func getFTPDBindingFromEnv(idx int) {
 		isSet = true
 	}
 
+	passivePortStart, ok := lookupIntFromEnv(fmt.Sprintf("SFTPGO_FTPD__BINDINGS__%v__PASSIVE_PORT_RANGE__START", idx), 0)
+	if ok {
+		binding.PassivePortRange.Start = int(passivePortStart)
+		isSet = true
+	}
+
+	passivePortEnd, ok := lookupIntFromEnv(fmt.Sprintf("SFTPGO_FTPD__BINDINGS__%v__PASSIVE_PORT_RANGE__END", idx), 0)
+	if ok {
+		binding.PassivePortRange.End = int(passivePortEnd)
+		isSet = true
+	}
+
 	debug, ok := lookupBoolFromEnv(fmt.Sprintf("SFTPGO_FTPD__BINDINGS__%v__DEBUG", idx))
 	if ok {
 		binding.Debug = debug
@@ -1338,6 +1853,19 @@ func getWebDAVDBindingFromEnv(idx int) {
 		isSet = true
 	}
 
+	sniCertificates, ok := getSNICertificatesFromEnv(fmt.Sprintf("SFTPGO_WEBDAVD__BINDINGS__%v", idx),
+		binding.SNICertificates)
+	if ok {
+		binding.SNICertificates = sniCertificates
+		isSet = true
+	}
+
+	acmeOnDemand, ok := lookupBoolFromEnv(fmt.Sprintf("SFTPGO_WEBDAVD__BINDINGS__%v__ACME_ON_DEMAND", idx))
+	if ok {
+		binding.ACMEOnDemand = acmeOnDemand
+		isSet = true
+	}
+
 	tlsVer, ok := lookupIntFromEnv(fmt.Sprintf("SFTPGO_WEBDAVD__BINDINGS__%v__MIN_TLS_VERSION", idx), 0)
 	if ok {
 		binding.MinTLSVersion = int(tlsVer)
@@ -1516,6 +2044,104 @@ func getHTTPDSecurityConfFromEnv(idx int) (httpd.SecurityConf, bool) { //nolint:
 	return result, isSet
 }
 
+func getHTTPDRequestFilterRoutesFromEnv(idx int) []httpd.RequestFilterRoute {
+	var routes []httpd.RequestFilterRoute
+	if len(globalConf.HTTPDConfig.Bindings) > idx {
+		routes = globalConf.HTTPDConfig.Bindings[idx].RequestFilter.Routes
+	}
+
+	for subIdx := 0; subIdx < 10; subIdx++ {
+		var route httpd.RequestFilterRoute
+		var replace bool
+		if len(routes) > subIdx {
+			route = routes[subIdx]
+			replace = true
+		}
+		prefix := fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__REQUEST_FILTER__ROUTES__%v", idx, subIdx)
+		isSet := false
+
+		path, ok := os.LookupEnv(fmt.Sprintf("%v__PATH", prefix))
+		if ok {
+			route.Path = path
+			isSet = true
+		}
+		methods, ok := lookupStringListFromEnv(fmt.Sprintf("%v__METHODS", prefix))
+		if ok {
+			route.Methods = methods
+			isSet = true
+		}
+		average, ok := lookupIntFromEnv(fmt.Sprintf("%v__RATE_LIMIT__AVERAGE", prefix), 64)
+		if ok {
+			route.RateLimit.Average = average
+			isSet = true
+		}
+		period, ok := lookupIntFromEnv(fmt.Sprintf("%v__RATE_LIMIT__PERIOD", prefix), 64)
+		if ok {
+			route.RateLimit.Period = period
+			isSet = true
+		}
+		burst, ok := lookupIntFromEnv(fmt.Sprintf("%v__RATE_LIMIT__BURST", prefix), 0)
+		if ok {
+			route.RateLimit.Burst = int(burst)
+			isSet = true
+		}
+		if isSet && route.Path != "" {
+			if replace {
+				routes[subIdx] = route
+			} else {
+				routes = append(routes, route)
+			}
+		}
+	}
+	return routes
+}
+
+func getHTTPDRequestFilterFromEnv(idx int) (httpd.RequestFilter, bool) {
+	result := defaultHTTPDBinding.RequestFilter
+	if len(globalConf.HTTPDConfig.Bindings) > idx {
+		result = globalConf.HTTPDConfig.Bindings[idx].RequestFilter
+	}
+	isSet := false
+
+	enabled, ok := lookupBoolFromEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__REQUEST_FILTER__ENABLED", idx))
+	if ok {
+		result.Enabled = enabled
+		isSet = true
+	}
+
+	denyPathTraversal, ok := lookupBoolFromEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__REQUEST_FILTER__DENY_PATH_TRAVERSAL", idx))
+	if ok {
+		result.DenyPathTraversal = denyPathTraversal
+		isSet = true
+	}
+
+	maxHeadersSize, ok := lookupIntFromEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__REQUEST_FILTER__MAX_HEADERS_SIZE", idx), 0)
+	if ok {
+		result.MaxHeadersSize = int(maxHeadersSize)
+		isSet = true
+	}
+
+	deniedPatterns, ok := lookupStringListFromEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__REQUEST_FILTER__DENIED_PATTERNS", idx))
+	if ok {
+		result.DeniedPatterns = deniedPatterns
+		isSet = true
+	}
+
+	routes := getHTTPDRequestFilterRoutesFromEnv(idx)
+	if len(routes) > 0 {
+		result.Routes = routes
+		isSet = true
+	}
+
+	generateDefenderEvents, ok := lookupBoolFromEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__REQUEST_FILTER__GENERATE_DEFENDER_EVENTS", idx))
+	if ok {
+		result.GenerateDefenderEvents = generateDefenderEvents
+		isSet = true
+	}
+
+	return result, isSet
+}
+
 func getHTTPDOIDCFromEnv(idx int) (httpd.OIDC, bool) {
 	result := defaultHTTPDBinding.OIDC
 	if len(globalConf.HTTPDConfig.Bindings) > idx {
@@ -1592,6 +2218,106 @@ func getHTTPDOIDCFromEnv(idx int) (httpd.OIDC, bool) {
 	return result, isSet
 }
 
+func getHTTPDSAMLFromEnv(idx int) (httpd.SAML, bool) {
+	result := defaultHTTPDBinding.SAML
+	if len(globalConf.HTTPDConfig.Bindings) > idx {
+		result = globalConf.HTTPDConfig.Bindings[idx].SAML
+	}
+	isSet := false
+
+	idpMetadataURL, ok := os.LookupEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__SAML__IDP_METADATA_URL", idx))
+	if ok {
+		result.IDPMetadataURL = idpMetadataURL
+		isSet = true
+	}
+
+	idpMetadataFile, ok := os.LookupEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__SAML__IDP_METADATA_FILE", idx))
+	if ok {
+		result.IDPMetadataFile = idpMetadataFile
+		isSet = true
+	}
+
+	entityID, ok := os.LookupEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__SAML__ENTITY_ID", idx))
+	if ok {
+		result.EntityID = entityID
+		isSet = true
+	}
+
+	baseURL, ok := os.LookupEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__SAML__BASE_URL", idx))
+	if ok {
+		result.BaseURL = baseURL
+		isSet = true
+	}
+
+	certificateFile, ok := os.LookupEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__SAML__CERTIFICATE_FILE", idx))
+	if ok {
+		result.CertificateFile = certificateFile
+		isSet = true
+	}
+
+	certificateKeyFile, ok := os.LookupEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__SAML__CERTIFICATE_KEY_FILE", idx))
+	if ok {
+		result.CertificateKeyFile = certificateKeyFile
+		isSet = true
+	}
+
+	signRequests, ok := lookupBoolFromEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__SAML__SIGN_REQUESTS", idx))
+	if ok {
+		result.SignRequests = signRequests
+		isSet = true
+	}
+
+	usernameAttribute, ok := os.LookupEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__SAML__USERNAME_ATTRIBUTE", idx))
+	if ok {
+		result.UsernameAttribute = usernameAttribute
+		isSet = true
+	}
+
+	roleAttribute, ok := os.LookupEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__SAML__ROLE_ATTRIBUTE", idx))
+	if ok {
+		result.RoleAttribute = roleAttribute
+		isSet = true
+	}
+
+	adminRoleValues, ok := lookupStringListFromEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__SAML__ADMIN_ROLE_VALUES", idx))
+	if ok {
+		result.AdminRoleValues = adminRoleValues
+		isSet = true
+	}
+
+	implicitRoles, ok := lookupBoolFromEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__SAML__IMPLICIT_ROLES", idx))
+	if ok {
+		result.ImplicitRoles = implicitRoles
+		isSet = true
+	}
+
+	customAttributes, ok := lookupStringListFromEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__SAML__CUSTOM_ATTRIBUTES", idx))
+	if ok {
+		result.CustomAttributes = customAttributes
+		isSet = true
+	}
+
+	autoProvisioning, ok := lookupBoolFromEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__SAML__AUTO_PROVISIONING", idx))
+	if ok {
+		result.AutoProvisioning = autoProvisioning
+		isSet = true
+	}
+
+	provisioningGroup, ok := os.LookupEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__SAML__PROVISIONING_GROUP", idx))
+	if ok {
+		result.ProvisioningGroup = provisioningGroup
+		isSet = true
+	}
+
+	debug, ok := lookupBoolFromEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__SAML__DEBUG", idx))
+	if ok {
+		result.Debug = debug
+		isSet = true
+	}
+
+	return result, isSet
+}
+
 func getHTTPDUIBrandingFromEnv(prefix string, branding httpd.UIBranding) (httpd.UIBranding, bool) {
 	isSet := false
 
@@ -1737,12 +2463,24 @@ func getHTTPDNestedObjectsFromEnv(idx int, binding *httpd.Binding) bool {
 		isSet = true
 	}
 
+	saml, ok := getHTTPDSAMLFromEnv(idx)
+	if ok {
+		binding.SAML = saml
+		isSet = true
+	}
+
 	securityConf, ok := getHTTPDSecurityConfFromEnv(idx)
 	if ok {
 		binding.Security = securityConf
 		isSet = true
 	}
 
+	requestFilter, ok := getHTTPDRequestFilterFromEnv(idx)
+	if ok {
+		binding.RequestFilter = requestFilter
+		isSet = true
+	}
+
 	brandingConf, ok := getHTTPDBrandingFromEnv(idx)
 	if ok {
 		binding.Branding = brandingConf
@@ -1804,6 +2542,19 @@ func getHTTPDBindingFromEnv(idx int) { //nolint:gocyclo
 		isSet = true
 	}
 
+	sniCertificates, ok := getSNICertificatesFromEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v", idx),
+		binding.SNICertificates)
+	if ok {
+		binding.SNICertificates = sniCertificates
+		isSet = true
+	}
+
+	acmeOnDemand, ok := lookupBoolFromEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__ACME_ON_DEMAND", idx))
+	if ok {
+		binding.ACMEOnDemand = acmeOnDemand
+		isSet = true
+	}
+
 	enableWebAdmin, ok := lookupBoolFromEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__ENABLE_WEB_ADMIN", idx))
 	if ok {
 		binding.EnableWebAdmin = enableWebAdmin
@@ -1822,6 +2573,12 @@ func getHTTPDBindingFromEnv(idx int) { //nolint:gocyclo
 		isSet = true
 	}
 
+	enableGraphQL, ok := lookupBoolFromEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__ENABLE_GRAPHQL", idx))
+	if ok {
+		binding.EnableGraphQL = enableGraphQL
+		isSet = true
+	}
+
 	enabledLoginMethods, ok := lookupIntFromEnv(fmt.Sprintf("SFTPGO_HTTPD__BINDINGS__%v__ENABLED_LOGIN_METHODS", idx), 0)
 	if ok {
 		binding.EnabledLoginMethods = int(enabledLoginMethods)
@@ -1990,10 +2747,23 @@ func setViperDefaults() {
 	viper.SetDefault("common.post_connect_hook", globalConf.Common.PostConnectHook)
 	viper.SetDefault("common.post_disconnect_hook", globalConf.Common.PostDisconnectHook)
 	viper.SetDefault("common.data_retention_hook", globalConf.Common.DataRetentionHook)
+	viper.SetDefault("common.staging_hook", globalConf.Common.StagingHook)
+	viper.SetDefault("common.store_checksums", globalConf.Common.StoreChecksums)
 	viper.SetDefault("common.max_total_connections", globalConf.Common.MaxTotalConnections)
 	viper.SetDefault("common.max_per_host_connections", globalConf.Common.MaxPerHostConnections)
+	viper.SetDefault("common.fairness.enabled", globalConf.Common.Fairness.Enabled)
+	viper.SetDefault("common.fairness.busy_threshold", globalConf.Common.Fairness.BusyThreshold)
+	viper.SetDefault("common.fairness.max_host_share", globalConf.Common.Fairness.MaxHostShare)
+	viper.SetDefault("common.fairness.max_user_share", globalConf.Common.Fairness.MaxUserShare)
+	viper.SetDefault("common.fairness.role_weights", globalConf.Common.Fairness.RoleWeights)
+	viper.SetDefault("common.fairness.default_weight", globalConf.Common.Fairness.DefaultWeight)
 	viper.SetDefault("common.allowlist_status", globalConf.Common.AllowListStatus)
 	viper.SetDefault("common.allow_self_connections", globalConf.Common.AllowSelfConnections)
+	viper.SetDefault("common.zero_copy_downloads", globalConf.Common.ZeroCopyDownloads)
+	viper.SetDefault("common.memory_budget.buffer_size", globalConf.Common.MemoryBudget.BufferSize)
+	viper.SetDefault("common.memory_budget.max_memory", globalConf.Common.MemoryBudget.MaxMemory)
+	viper.SetDefault("common.memory_budget.max_connection_memory", globalConf.Common.MemoryBudget.MaxConnectionMemory)
+	viper.SetDefault("common.memory_budget.wait_timeout", globalConf.Common.MemoryBudget.WaitTimeout)
 	viper.SetDefault("common.defender.enabled", globalConf.Common.DefenderConfig.Enabled)
 	viper.SetDefault("common.defender.driver", globalConf.Common.DefenderConfig.Driver)
 	viper.SetDefault("common.defender.ban_time", globalConf.Common.DefenderConfig.BanTime)
@@ -2006,6 +2776,86 @@ func setViperDefaults() {
 	viper.SetDefault("common.defender.observation_time", globalConf.Common.DefenderConfig.ObservationTime)
 	viper.SetDefault("common.defender.entries_soft_limit", globalConf.Common.DefenderConfig.EntriesSoftLimit)
 	viper.SetDefault("common.defender.entries_hard_limit", globalConf.Common.DefenderConfig.EntriesHardLimit)
+	viper.SetDefault("common.defender.ban_countries", globalConf.Common.DefenderConfig.BanCountries)
+	viper.SetDefault("common.defender.escalation.enabled", globalConf.Common.DefenderConfig.Escalation.Enabled)
+	viper.SetDefault("common.defender.escalation.throttle_threshold", globalConf.Common.DefenderConfig.Escalation.ThrottleThreshold)
+	viper.SetDefault("common.defender.escalation.throttle_delay", globalConf.Common.DefenderConfig.Escalation.ThrottleDelay)
+	viper.SetDefault("common.defender.escalation.long_ban_threshold", globalConf.Common.DefenderConfig.Escalation.LongBanThreshold)
+	viper.SetDefault("common.defender.escalation.long_ban_time", globalConf.Common.DefenderConfig.Escalation.LongBanTime)
+	viper.SetDefault("common.defender.escalation.deescalation_time", globalConf.Common.DefenderConfig.Escalation.DeescalationTime)
+	viper.SetDefault("common.defender.redis.address", globalConf.Common.DefenderConfig.Redis.Address)
+	viper.SetDefault("common.defender.redis.username", globalConf.Common.DefenderConfig.Redis.Username)
+	viper.SetDefault("common.defender.redis.password", globalConf.Common.DefenderConfig.Redis.Password)
+	viper.SetDefault("common.defender.redis.db", globalConf.Common.DefenderConfig.Redis.DB)
+	viper.SetDefault("common.defender.redis.key_prefix", globalConf.Common.DefenderConfig.Redis.KeyPrefix)
+	viper.SetDefault("common.defender.redis.use_tls", globalConf.Common.DefenderConfig.Redis.UseTLS)
+	viper.SetDefault("common.defender.crowdsec.url", globalConf.Common.DefenderConfig.CrowdSec.URL)
+	viper.SetDefault("common.defender.crowdsec.machine_id", globalConf.Common.DefenderConfig.CrowdSec.MachineID)
+	viper.SetDefault("common.defender.crowdsec.password", globalConf.Common.DefenderConfig.CrowdSec.Password)
+	viper.SetDefault("common.defender.crowdsec.api_key", globalConf.Common.DefenderConfig.CrowdSec.APIKey)
+	viper.SetDefault("common.defender.crowdsec.pull_interval", globalConf.Common.DefenderConfig.CrowdSec.PullInterval)
+	viper.SetDefault("common.defender.blocklists.update_interval", globalConf.Common.DefenderConfig.Blocklists.UpdateInterval)
+	viper.SetDefault("common.search.enabled", globalConf.Common.Search.Enabled)
+	viper.SetDefault("common.search.driver", globalConf.Common.Search.Driver)
+	viper.SetDefault("common.search.index_contents", globalConf.Common.Search.IndexContents)
+	viper.SetDefault("common.search.max_content_size", globalConf.Common.Search.MaxContentSize)
+	viper.SetDefault("common.search.elasticsearch.url", globalConf.Common.Search.Elasticsearch.URL)
+	viper.SetDefault("common.search.elasticsearch.index", globalConf.Common.Search.Elasticsearch.Index)
+	viper.SetDefault("common.search.elasticsearch.username", globalConf.Common.Search.Elasticsearch.Username)
+	viper.SetDefault("common.search.elasticsearch.password", globalConf.Common.Search.Elasticsearch.Password)
+	viper.SetDefault("common.analytics.enabled", globalConf.Common.Analytics.Enabled)
+	viper.SetDefault("common.analytics.max_tracked_files", globalConf.Common.Analytics.MaxTrackedFiles)
+	viper.SetDefault("common.user_webhooks.enabled", globalConf.Common.UserWebhooks.Enabled)
+	viper.SetDefault("common.user_webhooks.rate_limit", globalConf.Common.UserWebhooks.RateLimit)
+	viper.SetDefault("common.user_webhooks.timeout", globalConf.Common.UserWebhooks.Timeout)
+	viper.SetDefault("common.user_webhooks.allow_private_networks", globalConf.Common.UserWebhooks.AllowPrivateNetworks)
+	viper.SetDefault("common.cluster.enabled", globalConf.Common.Cluster.Enabled)
+	viper.SetDefault("common.cluster.sync_interval", globalConf.Common.Cluster.SyncInterval)
+	viper.SetDefault("common.consents.enforce_for_protocols", globalConf.Common.Consents.EnforceForProtocols)
+	viper.SetDefault("common.consents.link_validity", globalConf.Common.Consents.LinkValidity)
+	viper.SetDefault("common.sftpfs_pool.max_sessions_per_connection", globalConf.Common.SFTPFsPool.MaxSessionsPerConnection)
+	viper.SetDefault("common.sftpfs_pool.max_connections", globalConf.Common.SFTPFsPool.MaxConnections)
+	viper.SetDefault("common.sftpfs_pool.health_check_interval", globalConf.Common.SFTPFsPool.HealthCheckInterval)
+	viper.SetDefault("common.sftpfs_pool.idle_timeout", globalConf.Common.SFTPFsPool.IdleTimeout)
+	viper.SetDefault("common.sftpfs_pool.max_backoff", globalConf.Common.SFTPFsPool.MaxBackoff)
+	viper.SetDefault("common.sftpfs_pool.proxy_protocol", globalConf.Common.SFTPFsPool.ProxyProtocol)
+	viper.SetDefault("common.qos.upload_bandwidth", globalConf.Common.QoS.UploadBandwidth)
+	viper.SetDefault("common.qos.download_bandwidth", globalConf.Common.QoS.DownloadBandwidth)
+	viper.SetDefault("common.qos.default_class", globalConf.Common.QoS.DefaultClass)
+	viper.SetDefault("common.pull_jobs.enabled", globalConf.Common.PullJobs.Enabled)
+	viper.SetDefault("common.pull_jobs.allowed_hosts", globalConf.Common.PullJobs.AllowedHosts)
+	viper.SetDefault("common.pull_jobs.allow_private_networks", globalConf.Common.PullJobs.AllowPrivateNetworks)
+	viper.SetDefault("common.pull_jobs.max_attempts", globalConf.Common.PullJobs.MaxAttempts)
+	viper.SetDefault("common.pull_jobs.max_concurrent_jobs", globalConf.Common.PullJobs.MaxConcurrentJobs)
+	viper.SetDefault("common.object_cache.path", globalConf.Common.ObjectCache.Path)
+	viper.SetDefault("common.object_cache.max_size", globalConf.Common.ObjectCache.MaxSize)
+	viper.SetDefault("common.object_cache.max_object_size", globalConf.Common.ObjectCache.MaxObjectSize)
+	viper.SetDefault("common.object_cache.cache_uploads", globalConf.Common.ObjectCache.CacheUploads)
+	viper.SetDefault("common.dir_list_cache.ttl", globalConf.Common.DirListCache.TTL)
+	viper.SetDefault("common.dir_list_cache.max_dirs", globalConf.Common.DirListCache.MaxDirs)
+	viper.SetDefault("common.dir_list_cache.max_dir_entries", globalConf.Common.DirListCache.MaxDirEntries)
+	viper.SetDefault("common.dedup.store_path", globalConf.Common.Dedup.StorePath)
+	viper.SetDefault("common.dedup.min_file_size", globalConf.Common.Dedup.MinFileSize)
+	viper.SetDefault("common.dedup.gc_interval", globalConf.Common.Dedup.GCInterval)
+	viper.SetDefault("common.scheduled_quota_scans.interval", globalConf.Common.ScheduledQuotaScans.Interval)
+	viper.SetDefault("common.scheduled_quota_scans.incremental", globalConf.Common.ScheduledQuotaScans.Incremental)
+	viper.SetDefault("common.scheduled_quota_scans.full_scan_every", globalConf.Common.ScheduledQuotaScans.FullScanEvery)
+	viper.SetDefault("common.jobs.max_concurrent_jobs", globalConf.Common.Jobs.MaxConcurrentJobs)
+	viper.SetDefault("common.jobs.retention", globalConf.Common.Jobs.Retention)
+	viper.SetDefault("common.provider_backups.schedule", globalConf.Common.ProviderBackups.Schedule)
+	viper.SetDefault("common.provider_backups.encrypt", globalConf.Common.ProviderBackups.Encrypt)
+	viper.SetDefault("common.provider_backups.keep_daily", globalConf.Common.ProviderBackups.KeepDaily)
+	viper.SetDefault("common.provider_backups.keep_weekly", globalConf.Common.ProviderBackups.KeepWeekly)
+	viper.SetDefault("common.provider_backups.remote_folder", globalConf.Common.ProviderBackups.RemoteFolder)
+	viper.SetDefault("common.provider_backups.remote_path", globalConf.Common.ProviderBackups.RemotePath)
+	viper.SetDefault("common.audit_log.address", globalConf.Common.AuditLog.Address)
+	viper.SetDefault("common.audit_log.network", globalConf.Common.AuditLog.Network)
+	viper.SetDefault("common.audit_log.format", globalConf.Common.AuditLog.Format)
+	viper.SetDefault("common.audit_log.categories", globalConf.Common.AuditLog.Categories)
+	viper.SetDefault("common.audit_log.ca_certificate", globalConf.Common.AuditLog.CACertificate)
+	viper.SetDefault("common.geoip.database_path", globalConf.Common.GeoIP.DatabasePath)
+	viper.SetDefault("common.geoip.allowed_countries", globalConf.Common.GeoIP.AllowedCountries)
+	viper.SetDefault("common.geoip.denied_countries", globalConf.Common.GeoIP.DeniedCountries)
 	viper.SetDefault("acme.email", globalConf.ACME.Email)
 	viper.SetDefault("acme.key_type", globalConf.ACME.KeyType)
 	viper.SetDefault("acme.certs_path", globalConf.ACME.CertsPath)
@@ -2016,6 +2866,7 @@ func setViperDefaults() {
 	viper.SetDefault("acme.http01_challenge.webroot", globalConf.ACME.HTTP01Challenge.WebRoot)
 	viper.SetDefault("acme.http01_challenge.proxy_header", globalConf.ACME.HTTP01Challenge.ProxyHeader)
 	viper.SetDefault("acme.tls_alpn01_challenge.port", globalConf.ACME.TLSALPN01Challenge.Port)
+	viper.SetDefault("acme.on_demand.allowed_hosts", globalConf.ACME.OnDemand.AllowedHosts)
 	viper.SetDefault("sftpd.max_auth_tries", globalConf.SFTPD.MaxAuthTries)
 	viper.SetDefault("sftpd.banner", globalConf.SFTPD.Banner)
 	viper.SetDefault("sftpd.host_keys", globalConf.SFTPD.HostKeys)
@@ -2025,6 +2876,7 @@ func setViperDefaults() {
 	viper.SetDefault("sftpd.kex_algorithms", globalConf.SFTPD.KexAlgorithms)
 	viper.SetDefault("sftpd.ciphers", globalConf.SFTPD.Ciphers)
 	viper.SetDefault("sftpd.macs", globalConf.SFTPD.MACs)
+	viper.SetDefault("sftpd.security_profile", globalConf.SFTPD.SecurityProfile)
 	viper.SetDefault("sftpd.trusted_user_ca_keys", globalConf.SFTPD.TrustedUserCAKeys)
 	viper.SetDefault("sftpd.revoked_user_certs_file", globalConf.SFTPD.RevokedUserCertsFile)
 	viper.SetDefault("sftpd.login_banner_file", globalConf.SFTPD.LoginBannerFile)
@@ -2104,10 +2956,18 @@ func setViperDefaults() {
 	viper.SetDefault("data_provider.delayed_quota_update", globalConf.ProviderConf.DelayedQuotaUpdate)
 	viper.SetDefault("data_provider.create_default_admin", globalConf.ProviderConf.CreateDefaultAdmin)
 	viper.SetDefault("data_provider.naming_rules", globalConf.ProviderConf.NamingRules)
+	viper.SetDefault("data_provider.username_mapping.strip_domains", globalConf.ProviderConf.UsernameMapping.StripDomains)
+	viper.SetDefault("data_provider.username_mapping.case_folding", globalConf.ProviderConf.UsernameMapping.CaseFolding)
 	viper.SetDefault("data_provider.is_shared", globalConf.ProviderConf.IsShared)
 	viper.SetDefault("data_provider.node.host", globalConf.ProviderConf.Node.Host)
 	viper.SetDefault("data_provider.node.port", globalConf.ProviderConf.Node.Port)
 	viper.SetDefault("data_provider.node.proto", globalConf.ProviderConf.Node.Proto)
+	viper.SetDefault("data_provider.audit_log.enabled", globalConf.ProviderConf.AuditLog.Enabled)
+	viper.SetDefault("data_provider.audit_log.retention", globalConf.ProviderConf.AuditLog.Retention)
+	viper.SetDefault("data_provider.share_events.enabled", globalConf.ProviderConf.ShareEvents.Enabled)
+	viper.SetDefault("data_provider.share_events.retention", globalConf.ProviderConf.ShareEvents.Retention)
+	viper.SetDefault("data_provider.snapshots.enabled", globalConf.ProviderConf.Snapshots.Enabled)
+	viper.SetDefault("data_provider.snapshots.retention", globalConf.ProviderConf.Snapshots.Retention)
 	viper.SetDefault("data_provider.backups_path", globalConf.ProviderConf.BackupsPath)
 	viper.SetDefault("httpd.templates_path", globalConf.HTTPDConfig.TemplatesPath)
 	viper.SetDefault("httpd.static_files_path", globalConf.HTTPDConfig.StaticFilesPath)
@@ -2133,12 +2993,33 @@ func setViperDefaults() {
 	viper.SetDefault("httpd.setup.installation_code", globalConf.HTTPDConfig.Setup.InstallationCode)
 	viper.SetDefault("httpd.setup.installation_code_hint", globalConf.HTTPDConfig.Setup.InstallationCodeHint)
 	viper.SetDefault("httpd.hide_support_link", globalConf.HTTPDConfig.HideSupportLink)
+	viper.SetDefault("httpd.archive_jobs.enabled", globalConf.HTTPDConfig.ArchiveJobs.Enabled)
+	viper.SetDefault("httpd.archive_jobs.max_concurrent_jobs", globalConf.HTTPDConfig.ArchiveJobs.MaxConcurrentJobs)
+	viper.SetDefault("httpd.archive_jobs.max_size", globalConf.HTTPDConfig.ArchiveJobs.MaxSize)
+	viper.SetDefault("httpd.archive_jobs.bandwidth", globalConf.HTTPDConfig.ArchiveJobs.Bandwidth)
+	viper.SetDefault("httpd.archive_jobs.retention", globalConf.HTTPDConfig.ArchiveJobs.Retention)
+	viper.SetDefault("httpd.thumbnails.enabled", globalConf.HTTPDConfig.Thumbnails.Enabled)
+	viper.SetDefault("httpd.thumbnails.sizes", globalConf.HTTPDConfig.Thumbnails.Sizes)
+	viper.SetDefault("httpd.thumbnails.max_file_size", globalConf.HTTPDConfig.Thumbnails.MaxFileSize)
+	viper.SetDefault("httpd.thumbnails.cache_dir", globalConf.HTTPDConfig.Thumbnails.CacheDir)
+	viper.SetDefault("httpd.thumbnails.backend_cache_dirs", globalConf.HTTPDConfig.Thumbnails.BackendCacheDirs)
+	viper.SetDefault("httpd.thumbnails.retention", globalConf.HTTPDConfig.Thumbnails.Retention)
+	viper.SetDefault("httpd.thumbnails.pdf_renderer", globalConf.HTTPDConfig.Thumbnails.PDFRenderer)
+	viper.SetDefault("httpd.thumbnails.pdf_renderer_timeout", globalConf.HTTPDConfig.Thumbnails.PDFRendererTimeout)
+	viper.SetDefault("httpd.media.transcoding_hook", globalConf.HTTPDConfig.Media.TranscodingHook)
+	viper.SetDefault("httpd.media.max_transcodings", globalConf.HTTPDConfig.Media.MaxTranscodings)
+	viper.SetDefault("httpd.media.video_extensions", globalConf.HTTPDConfig.Media.VideoExtensions)
+	viper.SetDefault("httpd.media.audio_extensions", globalConf.HTTPDConfig.Media.AudioExtensions)
+	viper.SetDefault("httpd.registration.enabled", globalConf.HTTPDConfig.Registration.Enabled)
+	viper.SetDefault("httpd.registration.template_user", globalConf.HTTPDConfig.Registration.TemplateUser)
+	viper.SetDefault("httpd.registration.notify_emails", globalConf.HTTPDConfig.Registration.NotifyEmails)
 	viper.SetDefault("http.timeout", globalConf.HTTPConfig.Timeout)
 	viper.SetDefault("http.retry_wait_min", globalConf.HTTPConfig.RetryWaitMin)
 	viper.SetDefault("http.retry_wait_max", globalConf.HTTPConfig.RetryWaitMax)
 	viper.SetDefault("http.retry_max", globalConf.HTTPConfig.RetryMax)
 	viper.SetDefault("http.ca_certificates", globalConf.HTTPConfig.CACertificates)
 	viper.SetDefault("http.skip_tls_verify", globalConf.HTTPConfig.SkipTLSVerify)
+	viper.SetDefault("http.client_ip_header", globalConf.HTTPConfig.ClientIPHeader)
 	viper.SetDefault("command.timeout", globalConf.CommandConfig.Timeout)
 	viper.SetDefault("command.env", globalConf.CommandConfig.Env)
 	viper.SetDefault("kms.secrets.url", globalConf.KMSConfig.Secrets.URL)
@@ -2152,6 +3033,11 @@ func setViperDefaults() {
 	viper.SetDefault("telemetry.certificate_key_file", globalConf.TelemetryConfig.CertificateKeyFile)
 	viper.SetDefault("telemetry.min_tls_version", globalConf.TelemetryConfig.MinTLSVersion)
 	viper.SetDefault("telemetry.tls_cipher_suites", globalConf.TelemetryConfig.TLSCipherSuites)
+	viper.SetDefault("telemetry.tracing.enabled", globalConf.TelemetryConfig.Tracing.Enabled)
+	viper.SetDefault("telemetry.tracing.endpoint", globalConf.TelemetryConfig.Tracing.Endpoint)
+	viper.SetDefault("telemetry.tracing.insecure", globalConf.TelemetryConfig.Tracing.Insecure)
+	viper.SetDefault("telemetry.tracing.service_name", globalConf.TelemetryConfig.Tracing.ServiceName)
+	viper.SetDefault("telemetry.tracing.sample_ratio", globalConf.TelemetryConfig.Tracing.SampleRatio)
 	viper.SetDefault("smtp.host", globalConf.SMTPConfig.Host)
 	viper.SetDefault("smtp.port", globalConf.SMTPConfig.Port)
 	viper.SetDefault("smtp.from", globalConf.SMTPConfig.From)
@@ -2161,6 +3047,7 @@ func setViperDefaults() {
 	viper.SetDefault("smtp.encryption", globalConf.SMTPConfig.Encryption)
 	viper.SetDefault("smtp.domain", globalConf.SMTPConfig.Domain)
 	viper.SetDefault("smtp.templates_path", globalConf.SMTPConfig.TemplatesPath)
+	viper.SetDefault("secret_refs.refresh_interval", globalConf.SecretRefs.RefreshInterval)
 }
 
 func lookupBoolFromEnv(envName string) (bool, bool) {
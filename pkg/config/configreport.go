@@ -0,0 +1,157 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/spf13/viper"
+
+	"github.com/drakkan/sftpgo/v2/pkg/httpd"
+)
+
+// GetConfigReport returns the effective runtime configuration and the
+// differences against the configuration that would be loaded after a restart.
+// Secrets are redacted
+func GetConfigReport() (httpd.ConfigReport, error) {
+	configReportMutex.Lock()
+	defer configReportMutex.Unlock()
+
+	runtimeConf := globalConf
+	defer func() {
+		globalConf = runtimeConf
+	}()
+
+	// the configuration with env vars is loaded last, this way viper
+	// is left in the same state as after the startup
+	fileConf, err := reloadConfig(false)
+	if err != nil {
+		return httpd.ConfigReport{}, fmt.Errorf("unable to load the configuration file: %w", err)
+	}
+	restartConf, err := reloadConfig(true)
+	if err != nil {
+		return httpd.ConfigReport{}, fmt.Errorf("unable to load the configuration: %w", err)
+	}
+	report := httpd.ConfigReport{
+		ConfigFile:  viper.ConfigFileUsed(),
+		Differences: []httpd.ConfigDifference{},
+	}
+	if err := convertConf(getRedactedConf(runtimeConf), &report.Config); err != nil {
+		return report, err
+	}
+	views := make([]map[string]any, 0, 6)
+	for _, conf := range []globalConfig{runtimeConf, fileConf, restartConf, getRedactedConf(runtimeConf),
+		getRedactedConf(fileConf), getRedactedConf(restartConf)} {
+		view, err := flattenConf(conf)
+		if err != nil {
+			return report, err
+		}
+		views = append(views, view)
+	}
+	runtimeView, fileView, restartView := views[0], views[1], views[2]
+	for _, key := range getConfKeys(runtimeView, fileView, restartView) {
+		restartRequired := !reflect.DeepEqual(runtimeView[key], restartView[key])
+		envOverride := !reflect.DeepEqual(fileView[key], restartView[key])
+		if !restartRequired && !envOverride {
+			continue
+		}
+		report.Differences = append(report.Differences, httpd.ConfigDifference{
+			Key:             key,
+			RuntimeValue:    views[3][key],
+			FileValue:       views[4][key],
+			RestartValue:    views[5][key],
+			EnvOverride:     envOverride,
+			RestartRequired: restartRequired,
+		})
+	}
+	return report, nil
+}
+
+// reloadConfig loads the configuration from scratch using the same configuration
+// directory and file used at startup and returns the loaded configuration
+func reloadConfig(useEnv bool) (globalConfig, error) {
+	viper.Reset()
+	initConfig(useEnv)
+	err := loadConfig(loadedConfigDir, loadedConfigFile, useEnv)
+	return globalConf, err
+}
+
+func convertConf(conf globalConfig, result *map[string]any) error {
+	data, err := json.Marshal(conf)
+	if err != nil {
+		return fmt.Errorf("unable to serialize the configuration: %w", err)
+	}
+	return json.Unmarshal(data, result)
+}
+
+// flattenConf returns the configuration as a map of dotted keys, for example
+// "sftpd.bindings.0.port", to leaf values
+func flattenConf(conf globalConfig) (map[string]any, error) {
+	var values map[string]any
+	if err := convertConf(conf, &values); err != nil {
+		return nil, err
+	}
+	result := make(map[string]any)
+	flattenConfValue("", values, result)
+	return result, nil
+}
+
+func flattenConfValue(key string, value any, result map[string]any) {
+	switch v := value.(type) {
+	case map[string]any:
+		if len(v) == 0 && key != "" {
+			result[key] = nil
+		}
+		for k, val := range v {
+			flattenConfValue(getConfKey(key, k), val, result)
+		}
+	case []any:
+		// nil and empty slices are equivalent
+		if len(v) == 0 {
+			result[key] = nil
+		}
+		for idx, val := range v {
+			flattenConfValue(getConfKey(key, strconv.Itoa(idx)), val, result)
+		}
+	default:
+		result[key] = v
+	}
+}
+
+func getConfKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+func getConfKeys(views ...map[string]any) []string {
+	keys := make(map[string]bool)
+	for _, view := range views {
+		for k := range view {
+			keys[k] = true
+		}
+	}
+	result := make([]string, 0, len(keys))
+	for k := range keys {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,364 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/httpclient"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// Supported schemes for configuration values stored outside the configuration
+const (
+	secretRefSchemeSecretsManager = "secretsmanager://"
+	secretRefSchemeSSM            = "ssm://"
+)
+
+const secretRefTimeout = 30 * time.Second
+
+// SecretRefsConfig defines the configuration for the configuration values
+// referenced as AWS Secrets Manager secrets or SSM Parameter Store parameters
+type SecretRefsConfig struct {
+	// Interval, in minutes, to refresh the referenced values. 0 means no refresh
+	RefreshInterval int `json:"refresh_interval" mapstructure:"refresh_interval"`
+}
+
+// secretRef defines a configuration value resolved from a secret reference
+type secretRef struct {
+	// configuration key, for example "data_provider.password"
+	key   string
+	ref   string
+	value string
+	field reflect.Value
+}
+
+var (
+	secretRefs struct {
+		sync.Mutex
+		refs   []secretRef
+		ticker *time.Ticker
+		done   chan bool
+	}
+	// secretRefResolvers maps each supported scheme to its resolver
+	secretRefResolvers = map[string]func(ctx context.Context, ref string) (string, error){
+		secretRefSchemeSecretsManager: resolveSecretsManagerRef,
+		secretRefSchemeSSM:            resolveSSMRef,
+	}
+)
+
+func isSecretRef(value string) bool {
+	for scheme := range secretRefResolvers {
+		if strings.HasPrefix(value, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func resolveSecretRef(ctx context.Context, ref string) (string, error) {
+	for scheme, resolver := range secretRefResolvers {
+		if strings.HasPrefix(ref, scheme) {
+			return resolver(ctx, ref)
+		}
+	}
+	return "", fmt.Errorf("unsupported secret reference %q", ref)
+}
+
+// collectSecretRefs returns the string fields, referencing a secret, of the
+// specified value walking structs and slices recursively
+func collectSecretRefs(v reflect.Value, key string, refs []secretRef) []secretRef {
+	switch v.Kind() {
+	case reflect.String:
+		if v.CanSet() && isSecretRef(v.String()) {
+			refs = append(refs, secretRef{
+				key:   key,
+				ref:   v.String(),
+				field: v,
+			})
+		}
+	case reflect.Pointer:
+		if !v.IsNil() {
+			return collectSecretRefs(v.Elem(), key, refs)
+		}
+	case reflect.Struct:
+		for idx := 0; idx < v.NumField(); idx++ {
+			field := v.Type().Field(idx)
+			if !field.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+			switch {
+			case opts == "squash":
+				name = key
+			case name == "":
+				name = strings.ToLower(field.Name)
+			}
+			if key != "" && name != key {
+				name = key + "." + name
+			}
+			refs = collectSecretRefs(v.Field(idx), name, refs)
+		}
+	case reflect.Slice, reflect.Array:
+		for idx := 0; idx < v.Len(); idx++ {
+			refs = collectSecretRefs(v.Index(idx), fmt.Sprintf("%s[%d]", key, idx), refs)
+		}
+	}
+	return refs
+}
+
+// resolveSecretRefs replaces the configuration values referencing a secret
+// with the referenced values
+func resolveSecretRefs() error {
+	secretRefs.Lock()
+	defer secretRefs.Unlock()
+
+	secretRefs.refs = collectSecretRefs(reflect.ValueOf(&globalConf), "", nil)
+	for idx := range secretRefs.refs {
+		ref := &secretRefs.refs[idx]
+		ctx, cancel := context.WithTimeout(context.Background(), secretRefTimeout)
+		value, err := resolveSecretRef(ctx, ref.ref)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("unable to resolve the secret reference for %q: %w", ref.key, err)
+		}
+		ref.value = value
+		ref.field.SetString(value)
+		logger.Debug(logSender, "", "configuration value for %q resolved from %q", ref.key, ref.ref)
+	}
+	return nil
+}
+
+// refreshSecretRefs resolves the secret references again and applies the
+// changed values to the components supporting them
+func refreshSecretRefs() {
+	secretRefs.Lock()
+	var changed []string
+	for idx := range secretRefs.refs {
+		ref := &secretRefs.refs[idx]
+		ctx, cancel := context.WithTimeout(context.Background(), secretRefTimeout)
+		value, err := resolveSecretRef(ctx, ref.ref)
+		cancel()
+		if err != nil {
+			logger.Warn(logSender, "", "unable to refresh the secret reference for %q: %v", ref.key, err)
+			continue
+		}
+		if value == ref.value {
+			continue
+		}
+		ref.value = value
+		ref.field.SetString(value)
+		changed = append(changed, ref.key)
+	}
+	secretRefs.Unlock()
+
+	for _, key := range changed {
+		switch {
+		case key == "data_provider.password":
+			dataprovider.UpdatePassword(globalConf.ProviderConf.Password)
+			logger.Info(logSender, "", "data provider password updated from the secret reference")
+		case strings.HasPrefix(key, "smtp."):
+			smtpConfig := globalConf.SMTPConfig
+			if err := smtpConfig.Initialize(loadedConfigDir, true); err != nil {
+				logger.Warn(logSender, "", "unable to apply the refreshed SMTP configuration: %v", err)
+			} else {
+				logger.Info(logSender, "", "SMTP configuration updated from the secret reference for %q", key)
+			}
+		default:
+			logger.Warn(logSender, "", "the value referenced for %q changed, a restart is required to apply it", key)
+		}
+	}
+}
+
+// StartSecretRefsRefresh starts refreshing the configuration values
+// referencing a secret at the configured interval
+func StartSecretRefsRefresh() {
+	StopSecretRefsRefresh()
+
+	secretRefs.Lock()
+	defer secretRefs.Unlock()
+
+	if globalConf.SecretRefs.RefreshInterval <= 0 || len(secretRefs.refs) == 0 {
+		return
+	}
+	interval := time.Duration(globalConf.SecretRefs.RefreshInterval) * time.Minute
+	logger.Info(logSender, "", "start refreshing %d secret references, interval: %s", len(secretRefs.refs), interval)
+	secretRefs.done = make(chan bool)
+	secretRefs.ticker = time.NewTicker(interval)
+
+	go func(ticker *time.Ticker, done chan bool) {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				refreshSecretRefs()
+			}
+		}
+	}(secretRefs.ticker, secretRefs.done)
+}
+
+// StopSecretRefsRefresh stops refreshing the secret references
+func StopSecretRefsRefresh() {
+	secretRefs.Lock()
+	defer secretRefs.Unlock()
+
+	if secretRefs.ticker != nil {
+		secretRefs.ticker.Stop()
+		close(secretRefs.done)
+		secretRefs.ticker = nil
+	}
+}
+
+func getAWSConfigForSecretRefs(ctx context.Context) (aws.Config, error) {
+	cfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return cfg, fmt.Errorf("unable to get AWS config: %w", err)
+	}
+	if cfg.Region == "" {
+		return cfg, errors.New("unable to determine the AWS region")
+	}
+	return cfg, nil
+}
+
+// resolveSecretsManagerRef resolves references such as:
+//
+//	secretsmanager://<secret name or ARN>[#<JSON key>]
+func resolveSecretsManagerRef(ctx context.Context, ref string) (string, error) {
+	secretID := strings.TrimPrefix(ref, secretRefSchemeSecretsManager)
+	var jsonKey string
+	if idx := strings.LastIndex(secretID, "#"); idx >= 0 {
+		secretID, jsonKey = secretID[:idx], secretID[idx+1:]
+	}
+	if secretID == "" {
+		return "", fmt.Errorf("invalid secrets manager reference %q", ref)
+	}
+	cfg, err := getAWSConfigForSecretRefs(ctx)
+	if err != nil {
+		return "", err
+	}
+	svc := secretsmanager.NewFromConfig(cfg)
+	result, err := svc.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretID),
+	})
+	if err != nil {
+		return "", err
+	}
+	value := util.GetStringFromPointer(result.SecretString)
+	if jsonKey == "" {
+		return value, nil
+	}
+	var values map[string]any
+	if err := json.Unmarshal([]byte(value), &values); err != nil {
+		return "", fmt.Errorf("the secret %q is not a JSON object: %w", secretID, err)
+	}
+	val, ok := values[jsonKey]
+	if !ok {
+		return "", fmt.Errorf("the key %q does not exist in secret %q", jsonKey, secretID)
+	}
+	if s, ok := val.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprintf("%v", val), nil
+}
+
+// resolveSSMRef resolves references such as:
+//
+//	ssm://<parameter name>
+//
+// SecureString parameters are decrypted
+func resolveSSMRef(ctx context.Context, ref string) (string, error) {
+	name := strings.TrimPrefix(ref, secretRefSchemeSSM)
+	if name == "" {
+		return "", fmt.Errorf("invalid ssm reference %q", ref)
+	}
+	cfg, err := getAWSConfigForSecretRefs(ctx)
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(map[string]any{
+		"Name":           name,
+		"WithDecryption": true,
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("https://ssm.%s.amazonaws.com/", cfg.Region),
+		bytes.NewBuffer(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "AmazonSSM.GetParameter")
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return "", fmt.Errorf("unable to get AWS credentials: %w", err)
+	}
+	payloadHash := sha256.Sum256(body)
+	err = v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(payloadHash[:]), "ssm", cfg.Region, time.Now())
+	if err != nil {
+		return "", fmt.Errorf("unable to sign the ssm request: %w", err)
+	}
+	client := httpclient.GetHTTPClient()
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1048576))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(respBody, &errResp) //nolint:errcheck
+		return "", fmt.Errorf("unable to get ssm parameter %q, status code: %d, error: %s %s", name,
+			resp.StatusCode, errResp.Type, errResp.Message)
+	}
+	var result struct {
+		Parameter struct {
+			Value string `json:"Value"`
+		} `json:"Parameter"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return "", fmt.Errorf("unable to decode the ssm response for parameter %q: %w", name, err)
+	}
+	return result.Parameter.Value, nil
+}
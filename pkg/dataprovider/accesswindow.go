@@ -0,0 +1,184 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	accessWindowTimeFormat = "15:04"
+)
+
+// AccessWindow defines a time range, within the specified days of the week,
+// during which users are allowed to log in
+type AccessWindow struct {
+	// Days of the week, 0 is Sunday. Empty means every day
+	DaysOfWeek []int `json:"days_of_week,omitempty"`
+	// Start and end time as HH:MM. If the end time is before the start time,
+	// the window ends the next day
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// HasDay returns true if the window starts in the specified day of the week
+func (w *AccessWindow) HasDay(day time.Weekday) bool {
+	return len(w.DaysOfWeek) == 0 || util.Contains(w.DaysOfWeek, int(day))
+}
+
+func (w *AccessWindow) validate() error {
+	w.From = strings.TrimSpace(w.From)
+	w.To = strings.TrimSpace(w.To)
+	from, err := time.Parse(accessWindowTimeFormat, w.From)
+	if err != nil {
+		return util.NewValidationError(fmt.Sprintf("invalid access window start time %q, the expected format is HH:MM", w.From))
+	}
+	to, err := time.Parse(accessWindowTimeFormat, w.To)
+	if err != nil {
+		return util.NewValidationError(fmt.Sprintf("invalid access window end time %q, the expected format is HH:MM", w.To))
+	}
+	if from.Equal(to) {
+		return util.NewValidationError(fmt.Sprintf("the access window start and end time cannot be equal: %q", w.From))
+	}
+	w.From = from.Format(accessWindowTimeFormat)
+	w.To = to.Format(accessWindowTimeFormat)
+	for _, day := range w.DaysOfWeek {
+		if day < int(time.Sunday) || day > int(time.Saturday) {
+			return util.NewValidationError(fmt.Sprintf("invalid access window day of week: %d", day))
+		}
+	}
+	var days []int
+	for _, day := range w.DaysOfWeek {
+		if !util.Contains(days, day) {
+			days = append(days, day)
+		}
+	}
+	sort.Ints(days)
+	w.DaysOfWeek = days
+	return nil
+}
+
+// isActive returns true if the specified time, already converted to the
+// configured timezone, is within the window
+func (w *AccessWindow) isActive(t time.Time) bool {
+	from, err := time.Parse(accessWindowTimeFormat, w.From)
+	if err != nil {
+		return false
+	}
+	to, err := time.Parse(accessWindowTimeFormat, w.To)
+	if err != nil {
+		return false
+	}
+	minutes := t.Hour()*60 + t.Minute()
+	fromMinutes := from.Hour()*60 + from.Minute()
+	toMinutes := to.Hour()*60 + to.Minute()
+	if fromMinutes < toMinutes {
+		return w.HasDay(t.Weekday()) && minutes >= fromMinutes && minutes < toMinutes
+	}
+	// the window ends the next day
+	if w.HasDay(t.Weekday()) && minutes >= fromMinutes {
+		return true
+	}
+	return w.HasDay(t.AddDate(0, 0, -1).Weekday()) && minutes < toMinutes
+}
+
+func copyAccessWindows(windows []AccessWindow) []AccessWindow {
+	if len(windows) == 0 {
+		return nil
+	}
+	result := make([]AccessWindow, 0, len(windows))
+	for _, w := range windows {
+		days := make([]int, len(w.DaysOfWeek))
+		copy(days, w.DaysOfWeek)
+		result = append(result, AccessWindow{
+			DaysOfWeek: days,
+			From:       w.From,
+			To:         w.To,
+		})
+	}
+	return result
+}
+
+func validateAccessWindows(windows []AccessWindow, timezone string) (string, error) {
+	timezone = strings.TrimSpace(timezone)
+	if timezone != "" {
+		if _, err := time.LoadLocation(timezone); err != nil {
+			return "", util.NewValidationError(fmt.Sprintf("invalid access windows timezone %q: %v", timezone, err))
+		}
+	}
+	for idx := range windows {
+		if err := windows[idx].validate(); err != nil {
+			return "", err
+		}
+	}
+	return timezone, nil
+}
+
+func validateUserAccessConditions(user *User) error {
+	timezone, err := validateAccessWindows(user.Filters.AccessWindows, user.Filters.AccessTimezone)
+	if err != nil {
+		return err
+	}
+	user.Filters.AccessTimezone = timezone
+	if user.Filters.ActivationDate < 0 {
+		user.Filters.ActivationDate = 0
+	}
+	if user.Filters.ActivationDate > 0 && user.ExpirationDate > 0 && user.Filters.ActivationDate >= user.ExpirationDate {
+		return util.NewValidationError("the activation date must be before the expiration date")
+	}
+	return nil
+}
+
+// IsWithinAccessWindows returns true if the user has no access windows or if
+// the specified time is within at least one of them
+func (u *User) IsWithinAccessWindows(t time.Time) bool {
+	if len(u.Filters.AccessWindows) == 0 {
+		return true
+	}
+	location := time.UTC
+	if u.Filters.AccessTimezone != "" {
+		loc, err := time.LoadLocation(u.Filters.AccessTimezone)
+		if err != nil {
+			providerLog(logger.LevelError, "unable to load access timezone %q for user %q: %v",
+				u.Filters.AccessTimezone, u.Username, err)
+			return false
+		}
+		location = loc
+	}
+	t = t.In(location)
+	for idx := range u.Filters.AccessWindows {
+		if u.Filters.AccessWindows[idx].isActive(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) checkAccessConditions(now time.Time) error {
+	if u.Filters.ActivationDate > 0 && util.GetTimeAsMsSinceEpoch(now) < u.Filters.ActivationDate {
+		return fmt.Errorf("user %q is not yet active, activation timestamp: %v current timestamp: %v", u.Username,
+			u.Filters.ActivationDate, util.GetTimeAsMsSinceEpoch(now))
+	}
+	if !u.IsWithinAccessWindows(now) {
+		return fmt.Errorf("user %q is not allowed to log in at this time", u.Username)
+	}
+	return nil
+}
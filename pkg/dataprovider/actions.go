@@ -25,11 +25,13 @@ import (
 	"time"
 
 	"github.com/sftpgo/sdk/plugin/notifier"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/drakkan/sftpgo/v2/pkg/command"
 	"github.com/drakkan/sftpgo/v2/pkg/httpclient"
 	"github.com/drakkan/sftpgo/v2/pkg/logger"
 	"github.com/drakkan/sftpgo/v2/pkg/plugin"
+	"github.com/drakkan/sftpgo/v2/pkg/tracing"
 	"github.com/drakkan/sftpgo/v2/pkg/util"
 )
 
@@ -51,6 +53,7 @@ const (
 	actionObjectEventAction = "event_action"
 	actionObjectEventRule   = "event_rule"
 	actionObjectRole        = "role"
+	actionObjectAdminRole   = "admin_role"
 	actionObjectIPListEntry = "ip_list_entry"
 	actionObjectConfigs     = "configs"
 )
@@ -60,7 +63,9 @@ var (
 	reservedUsers           = []string{ActionExecutorSelf, ActionExecutorSystem}
 )
 
-func executeAction(operation, executor, ip, objectType, objectName, role string, object plugin.Renderer) {
+func executeAction(ctx context.Context, operation, executor, ip, objectType, objectName, role string,
+	object plugin.Renderer,
+) {
 	if plugin.Handler.HasNotifiers() {
 		plugin.Handler.NotifyProviderEvent(&notifier.ProviderEvent{
 			Action:     operation,
@@ -73,7 +78,7 @@ func executeAction(operation, executor, ip, objectType, objectName, role string,
 		}, object)
 	}
 	if fnHandleRuleForProviderEvent != nil {
-		fnHandleRuleForProviderEvent(operation, executor, ip, objectType, objectName, role, object)
+		fnHandleRuleForProviderEvent(ctx, operation, executor, ip, objectType, objectName, role, object)
 	}
 	if config.Actions.Hook == "" {
 		return
@@ -89,6 +94,12 @@ func executeAction(operation, executor, ip, objectType, objectName, role string,
 			<-actionsConcurrencyGuard
 		}()
 
+		span := tracing.StartSpan("", "provider action hook",
+			attribute.String("sftpgo.action", operation),
+			attribute.String("sftpgo.object_type", objectType),
+			attribute.String("sftpgo.object_name", objectName))
+		defer span.End()
+
 		dataAsJSON, err := object.RenderAsJSON(operation != operationDelete)
 		if err != nil {
 			providerLog(logger.LevelError, "unable to serialize user as JSON for operation %q: %v", operation, err)
@@ -114,7 +125,8 @@ func executeAction(operation, executor, ip, objectType, objectName, role string,
 			q.Add("timestamp", fmt.Sprintf("%d", time.Now().UnixNano()))
 			url.RawQuery = q.Encode()
 			startTime := time.Now()
-			resp, err := httpclient.RetryablePost(url.String(), "application/json", bytes.NewBuffer(dataAsJSON))
+			resp, err := httpclient.RetryablePostWithCorrelationID(url.String(), "application/json",
+				bytes.NewBuffer(dataAsJSON), logger.GetCorrelationID(ctx))
 			respCode := 0
 			if err == nil {
 				respCode = resp.StatusCode
@@ -124,11 +136,13 @@ func executeAction(operation, executor, ip, objectType, objectName, role string,
 				operation, url.Redacted(), respCode, time.Since(startTime), err)
 			return
 		}
-		executeNotificationCommand(operation, executor, ip, objectType, objectName, role, dataAsJSON) //nolint:errcheck // the error is used in test cases only
+		executeNotificationCommand(ctx, operation, executor, ip, objectType, objectName, role, dataAsJSON) //nolint:errcheck // the error is used in test cases only
 	}()
 }
 
-func executeNotificationCommand(operation, executor, ip, objectType, objectName, role string, objectAsJSON []byte) error {
+func executeNotificationCommand(ctx context.Context, operation, executor, ip, objectType, objectName, role string,
+	objectAsJSON []byte,
+) error {
 	if !filepath.IsAbs(config.Actions.Hook) {
 		err := fmt.Errorf("invalid notification command %q", config.Actions.Hook)
 		logger.Warn(logSender, "", "unable to execute notification command: %v", err)
@@ -136,10 +150,10 @@ func executeNotificationCommand(operation, executor, ip, objectType, objectName,
 	}
 
 	timeout, env, args := command.GetConfig(config.Actions.Hook, command.HookProviderActions)
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	cmdCtx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, config.Actions.Hook, args...)
+	cmd := exec.CommandContext(cmdCtx, config.Actions.Hook, args...)
 	cmd.Env = append(env,
 		fmt.Sprintf("SFTPGO_PROVIDER_ACTION=%vs", operation),
 		fmt.Sprintf("SFTPGO_PROVIDER_OBJECT_TYPE=%s", objectType),
@@ -148,7 +162,8 @@ func executeNotificationCommand(operation, executor, ip, objectType, objectName,
 		fmt.Sprintf("SFTPGO_PROVIDER_IP=%s", ip),
 		fmt.Sprintf("SFTPGO_PROVIDER_ROLE=%s", role),
 		fmt.Sprintf("SFTPGO_PROVIDER_TIMESTAMP=%d", util.GetTimeAsMsSinceEpoch(time.Now())),
-		fmt.Sprintf("SFTPGO_PROVIDER_OBJECT=%s", string(objectAsJSON)))
+		fmt.Sprintf("SFTPGO_PROVIDER_OBJECT=%s", string(objectAsJSON)),
+		fmt.Sprintf("%s=%s", logger.CorrelationIDEnvVar, logger.GetCorrelationID(ctx)))
 
 	startTime := time.Now()
 	err := cmd.Run()
@@ -70,14 +70,14 @@ const (
 )
 
 var (
-	validAdminPerms = []string{PermAdminAny, PermAdminAddUsers, PermAdminChangeUsers, PermAdminDeleteUsers,
+	legacyAdminPerms = []string{PermAdminAny, PermAdminAddUsers, PermAdminChangeUsers, PermAdminDeleteUsers,
 		PermAdminViewUsers, PermAdminManageGroups, PermAdminViewConnections, PermAdminCloseConnections,
 		PermAdminViewServerStatus, PermAdminManageAdmins, PermAdminManageRoles, PermAdminManageEventRules,
 		PermAdminManageAPIKeys, PermAdminQuotaScans, PermAdminManageSystem, PermAdminManageDefender,
 		PermAdminViewDefender, PermAdminManageIPLists, PermAdminRetentionChecks, PermAdminMetadataChecks,
 		PermAdminViewEvents}
-	forbiddenPermsForRoleAdmins = []string{PermAdminAny, PermAdminManageAdmins, PermAdminManageSystem,
-		PermAdminManageEventRules, PermAdminManageIPLists, PermAdminManageRoles}
+	validAdminPerms             = append(append([]string{}, legacyAdminPerms...), granularAdminPerms...)
+	forbiddenPermsForRoleAdmins = getForbiddenPermsForRoleAdmins()
 )
 
 // AdminTOTPConfig defines the time-based one time password configuration
@@ -265,9 +265,11 @@ type Admin struct {
 	// - manage_admins
 	// - manage_apikeys
 	// - manage_system
-	// - manage_event_rules
 	// - manage_roles
 	Role string `json:"role,omitempty"`
+	// Admin role name. The admin is granted the permissions defined in the
+	// admin role in addition to the ones directly assigned
+	AdminRole string `json:"admin_role,omitempty"`
 }
 
 // CountUnusedRecoveryCodes returns the number of unused recovery codes
@@ -326,24 +328,17 @@ func (a *Admin) validateRecoveryCodes() error {
 }
 
 func (a *Admin) validatePermissions() error {
-	a.Permissions = util.RemoveDuplicates(a.Permissions, false)
-	if len(a.Permissions) == 0 {
-		return util.NewValidationError("please grant some permissions to this admin")
-	}
-	if util.Contains(a.Permissions, PermAdminAny) {
-		a.Permissions = []string{PermAdminAny}
+	permissions, err := validateAdminPermissions(a.Permissions, a.Role != "")
+	if err != nil {
+		return err
 	}
-	for _, perm := range a.Permissions {
-		if !util.Contains(validAdminPerms, perm) {
-			return util.NewValidationError(fmt.Sprintf("invalid permission: %q", perm))
-		}
-		if a.Role != "" {
-			if util.Contains(forbiddenPermsForRoleAdmins, perm) {
-				return util.NewValidationError(fmt.Sprintf("a role admin cannot have the following permissions: %q",
-					strings.Join(forbiddenPermsForRoleAdmins, ",")))
-			}
+	if len(permissions) == 0 {
+		if a.AdminRole == "" {
+			return util.NewValidationError("please grant some permissions to this admin")
 		}
+		permissions = []string{}
 	}
+	a.Permissions = permissions
 	return nil
 }
 
@@ -547,10 +542,29 @@ func (a *Admin) SetNilSecretsIfEmpty() {
 
 // HasPermission returns true if the admin has the specified permission
 func (a *Admin) HasPermission(perm string) bool {
-	if util.Contains(a.Permissions, PermAdminAny) {
-		return true
+	return HasAdminPermission(a.Permissions, perm)
+}
+
+// GetAccessSettings returns the permissions granted to the admin, directly or
+// through the associated admin role, and the groups the managed users must be
+// members of. Empty groups mean no restrictions
+func (a *Admin) GetAccessSettings() ([]string, []string, error) {
+	if a.AdminRole == "" {
+		return a.Permissions, nil, nil
+	}
+	role, err := provider.adminRoleExists(a.AdminRole)
+	if err != nil {
+		providerLog(logger.LevelError, "unable to get admin role %q for admin %q: %v", a.AdminRole, a.Username, err)
+		return nil, nil, err
+	}
+	permissions := make([]string, 0, len(a.Permissions)+len(role.Permissions))
+	permissions = append(permissions, a.Permissions...)
+	for _, perm := range role.Permissions {
+		if !util.Contains(permissions, perm) {
+			permissions = append(permissions, perm)
+		}
 	}
-	return util.Contains(a.Permissions, perm)
+	return permissions, role.Filters.UserGroups, nil
 }
 
 // GetPermissionsAsString returns permission as string
@@ -571,9 +585,10 @@ func (a *Admin) GetAllowedIPAsString() string {
 	return strings.Join(a.Filters.AllowList, ",")
 }
 
-// GetValidPerms returns the allowed admin permissions
+// GetValidPerms returns the admin permissions that can be directly assigned
+// using the WebAdmin, the granular permissions are assigned using admin roles
 func (a *Admin) GetValidPerms() []string {
-	return validAdminPerms
+	return legacyAdminPerms
 }
 
 // CanManageMFA returns true if the admin can add a multi-factor authentication configuration
@@ -637,6 +652,7 @@ func (a *Admin) getACopy() Admin {
 		CreatedAt:      a.CreatedAt,
 		UpdatedAt:      a.UpdatedAt,
 		Role:           a.Role,
+		AdminRole:      a.AdminRole,
 	}
 }
 
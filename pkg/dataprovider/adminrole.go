@@ -0,0 +1,312 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// Granular admin permissions, they allow a single action on an object type
+const (
+	PermAdminUsersCreate      = "users:create"
+	PermAdminUsersRead        = "users:read"
+	PermAdminUsersUpdate      = "users:update"
+	PermAdminUsersDelete      = "users:delete"
+	PermAdminFoldersCreate    = "folders:create"
+	PermAdminFoldersRead      = "folders:read"
+	PermAdminFoldersUpdate    = "folders:update"
+	PermAdminFoldersDelete    = "folders:delete"
+	PermAdminGroupsCreate     = "groups:create"
+	PermAdminGroupsRead       = "groups:read"
+	PermAdminGroupsUpdate     = "groups:update"
+	PermAdminGroupsDelete     = "groups:delete"
+	PermAdminAdminsCreate     = "admins:create"
+	PermAdminAdminsRead       = "admins:read"
+	PermAdminAdminsUpdate     = "admins:update"
+	PermAdminAdminsDelete     = "admins:delete"
+	PermAdminAdminRolesCreate = "admin_roles:create"
+	PermAdminAdminRolesRead   = "admin_roles:read"
+	PermAdminAdminRolesUpdate = "admin_roles:update"
+	PermAdminAdminRolesDelete = "admin_roles:delete"
+	PermAdminRolesCreate      = "roles:create"
+	PermAdminRolesRead        = "roles:read"
+	PermAdminRolesUpdate      = "roles:update"
+	PermAdminRolesDelete      = "roles:delete"
+	PermAdminAPIKeysCreate    = "api_keys:create"
+	PermAdminAPIKeysRead      = "api_keys:read"
+	PermAdminAPIKeysUpdate    = "api_keys:update"
+	PermAdminAPIKeysDelete    = "api_keys:delete"
+	PermAdminEventRulesCreate = "event_rules:create"
+	PermAdminEventRulesRead   = "event_rules:read"
+	PermAdminEventRulesUpdate = "event_rules:update"
+	PermAdminEventRulesDelete = "event_rules:delete"
+	PermAdminIPListsCreate    = "ip_lists:create"
+	PermAdminIPListsRead      = "ip_lists:read"
+	PermAdminIPListsUpdate    = "ip_lists:update"
+	PermAdminIPListsDelete    = "ip_lists:delete"
+)
+
+var (
+	// AdminPermObjects defines the object types supported by the granular admin permissions
+	AdminPermObjects = []string{"users", "folders", "groups", "admins", "admin_roles", "roles", "api_keys",
+		"event_rules", "ip_lists"}
+	// AdminPermActions defines the actions supported by the granular admin permissions
+	AdminPermActions = []string{"create", "read", "update", "delete"}
+	// legacy permissions that grant all the actions on an object type
+	adminPermObjectsManagers = map[string]string{
+		"groups":      PermAdminManageGroups,
+		"admins":      PermAdminManageAdmins,
+		"admin_roles": PermAdminManageAdmins,
+		"roles":       PermAdminManageRoles,
+		"api_keys":    PermAdminManageAPIKeys,
+		"event_rules": PermAdminManageEventRules,
+		"ip_lists":    PermAdminManageIPLists,
+	}
+	// object types that role admins cannot manage
+	forbiddenObjectsForRoleAdmins = []string{"admins", "admin_roles", "roles", "ip_lists"}
+	granularAdminPerms            = getGranularAdminPerms()
+	// maps a permission to the equivalent ones that also grant it
+	adminPermGrants = getAdminPermGrants()
+)
+
+func getGranularAdminPerms() []string {
+	perms := make([]string, 0, len(AdminPermObjects)*len(AdminPermActions))
+	for _, object := range AdminPermObjects {
+		for _, action := range AdminPermActions {
+			perms = append(perms, GetAdminObjectPermission(object, action))
+		}
+	}
+	return perms
+}
+
+func getAdminPermGrants() map[string][]string {
+	grants := map[string][]string{
+		PermAdminAddUsers:      {PermAdminUsersCreate},
+		PermAdminViewUsers:     {PermAdminUsersRead},
+		PermAdminChangeUsers:   {PermAdminUsersUpdate},
+		PermAdminDeleteUsers:   {PermAdminUsersDelete},
+		PermAdminUsersCreate:   {PermAdminAddUsers},
+		PermAdminUsersRead:     {PermAdminViewUsers},
+		PermAdminUsersUpdate:   {PermAdminChangeUsers},
+		PermAdminUsersDelete:   {PermAdminDeleteUsers},
+		PermAdminFoldersCreate: {PermAdminAddUsers},
+		PermAdminFoldersRead:   {PermAdminViewUsers},
+		PermAdminFoldersUpdate: {PermAdminChangeUsers},
+		PermAdminFoldersDelete: {PermAdminDeleteUsers},
+	}
+	for object, perm := range adminPermObjectsManagers {
+		for _, action := range AdminPermActions {
+			grants[GetAdminObjectPermission(object, action)] = []string{perm}
+		}
+	}
+	return grants
+}
+
+func getForbiddenPermsForRoleAdmins() []string {
+	perms := []string{PermAdminAny, PermAdminManageAdmins, PermAdminManageSystem, PermAdminManageIPLists,
+		PermAdminManageRoles}
+	for _, object := range forbiddenObjectsForRoleAdmins {
+		for _, action := range AdminPermActions {
+			perms = append(perms, GetAdminObjectPermission(object, action))
+		}
+	}
+	return perms
+}
+
+// GetAdminObjectPermission returns the granular permission for the specified
+// object type and action
+func GetAdminObjectPermission(object, action string) string {
+	return fmt.Sprintf("%s:%s", object, action)
+}
+
+// HasAdminPermission returns true if the specified permissions grant perm,
+// directly or through an equivalent permission
+func HasAdminPermission(permissions []string, perm string) bool {
+	if util.Contains(permissions, PermAdminAny) || util.Contains(permissions, perm) {
+		return true
+	}
+	for _, p := range adminPermGrants[perm] {
+		if util.Contains(permissions, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUserInAdminScope returns true if the user is a member of at least one of
+// the specified groups. Empty groups mean no restrictions
+func IsUserInAdminScope(user *User, groups []string) bool {
+	if len(groups) == 0 {
+		return true
+	}
+	for _, g := range user.Groups {
+		if util.Contains(groups, g.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateAdminPermissions(permissions []string, isRoleAdmin bool) ([]string, error) {
+	permissions = util.RemoveDuplicates(permissions, false)
+	if util.Contains(permissions, PermAdminAny) {
+		permissions = []string{PermAdminAny}
+	}
+	for _, perm := range permissions {
+		if !util.Contains(validAdminPerms, perm) {
+			return permissions, util.NewValidationError(fmt.Sprintf("invalid permission: %q", perm))
+		}
+		if isRoleAdmin && util.Contains(forbiddenPermsForRoleAdmins, perm) {
+			return permissions, util.NewValidationError(fmt.Sprintf("a role admin cannot have the following permissions: %q",
+				strings.Join(forbiddenPermsForRoleAdmins, ",")))
+		}
+	}
+	return permissions, nil
+}
+
+// AdminRoleFilters defines the restrictions for the users managed by the
+// admins associated with an admin role
+type AdminRoleFilters struct {
+	// If set, the admins can only manage users that are members of
+	// at least one of these groups
+	UserGroups []string `json:"user_groups,omitempty"`
+}
+
+// AdminRole defines a named set of permissions that can be assigned to admins
+type AdminRole struct {
+	// Data provider unique identifier
+	ID int64 `json:"id"`
+	// Admin role name
+	Name string `json:"name"`
+	// optional description
+	Description string `json:"description,omitempty"`
+	// Granted permissions, both the granular and the legacy permissions are allowed
+	Permissions []string `json:"permissions"`
+	// Restrictions for the managed users
+	Filters AdminRoleFilters `json:"filters"`
+	// Creation time as unix timestamp in milliseconds
+	CreatedAt int64 `json:"created_at"`
+	// last update time as unix timestamp in milliseconds
+	UpdatedAt int64 `json:"updated_at"`
+	// list of admins associated with this admin role
+	Admins []string `json:"admins,omitempty"`
+}
+
+// RenderAsJSON implements the renderer interface used within plugins
+func (r *AdminRole) RenderAsJSON(reload bool) ([]byte, error) {
+	if reload {
+		role, err := provider.adminRoleExists(r.Name)
+		if err != nil {
+			providerLog(logger.LevelError, "unable to reload admin role before rendering as json: %v", err)
+			return nil, err
+		}
+		return json.Marshal(role)
+	}
+	return json.Marshal(r)
+}
+
+// GetPermissionsAsString returns the permissions as string
+func (r *AdminRole) GetPermissionsAsString() string {
+	return strings.Join(r.Permissions, ", ")
+}
+
+// GetUserGroupsAsString returns the groups that restrict the managed users as string
+func (r *AdminRole) GetUserGroupsAsString() string {
+	return strings.Join(r.Filters.UserGroups, ", ")
+}
+
+// GetMembersAsString returns a string representation for the admin role members
+func (r *AdminRole) GetMembersAsString() string {
+	if len(r.Admins) > 0 {
+		return fmt.Sprintf("Admins: %d. ", len(r.Admins))
+	}
+	return ""
+}
+
+// GetLegacyPerms returns the legacy admin permissions, each one grants all the
+// actions on one or more object types
+func (r *AdminRole) GetLegacyPerms() []string {
+	return legacyAdminPerms
+}
+
+// HasPermission returns true if the admin role grants the specified permission
+func (r *AdminRole) HasPermission(perm string) bool {
+	return util.Contains(r.Permissions, perm)
+}
+
+func (r *AdminRole) hasForbiddenPermsForRoleAdmins() bool {
+	for _, perm := range r.Permissions {
+		if util.Contains(forbiddenPermsForRoleAdmins, perm) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *AdminRole) validate() error {
+	if r.Name == "" {
+		return util.NewValidationError("name is mandatory")
+	}
+	if len(r.Name) > 255 {
+		return util.NewValidationError("name is too long, 255 is the maximum length allowed")
+	}
+	if config.NamingRules&1 == 0 && !usernameRegex.MatchString(r.Name) {
+		return util.NewValidationError(fmt.Sprintf("name %q is not valid, the following characters are allowed: a-zA-Z0-9-_.~", r.Name))
+	}
+	permissions, err := validateAdminPermissions(r.Permissions, false)
+	if err != nil {
+		return err
+	}
+	if len(permissions) == 0 {
+		return util.NewValidationError("please grant some permissions to this admin role")
+	}
+	r.Permissions = permissions
+	var groups []string
+	for _, group := range r.Filters.UserGroups {
+		group = strings.TrimSpace(group)
+		if group != "" && !util.Contains(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+	r.Filters.UserGroups = groups
+	return nil
+}
+
+func (r *AdminRole) getACopy() AdminRole {
+	permissions := make([]string, len(r.Permissions))
+	copy(permissions, r.Permissions)
+	groups := make([]string, len(r.Filters.UserGroups))
+	copy(groups, r.Filters.UserGroups)
+	admins := make([]string, len(r.Admins))
+	copy(admins, r.Admins)
+
+	return AdminRole{
+		ID:          r.ID,
+		Name:        r.Name,
+		Description: r.Description,
+		Permissions: permissions,
+		Filters: AdminRoleFilters{
+			UserGroups: groups,
+		},
+		CreatedAt: r.CreatedAt,
+		UpdatedAt: r.UpdatedAt,
+		Admins:    admins,
+	}
+}
@@ -17,6 +17,8 @@ package dataprovider
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
 	"strings"
 	"time"
 
@@ -38,6 +40,96 @@ const (
 	APIKeyScopeUser
 )
 
+var apiKeyAllowedMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete}
+
+// APIKeyEndpoint defines a REST API endpoint an API key is allowed to access
+type APIKeyEndpoint struct {
+	// Path to allow, for example "/api/v2/users". A trailing "*" allows all
+	// the paths with the given prefix, for example "/api/v2/users*"
+	Path string `json:"path"`
+	// Allowed HTTP methods, empty means all
+	Methods []string `json:"methods,omitempty"`
+}
+
+func (e *APIKeyEndpoint) matches(method, urlPath string) bool {
+	if strings.HasSuffix(e.Path, "*") {
+		if !strings.HasPrefix(urlPath, strings.TrimSuffix(e.Path, "*")) {
+			return false
+		}
+	} else if urlPath != e.Path {
+		return false
+	}
+	return len(e.Methods) == 0 || util.Contains(e.Methods, method)
+}
+
+// APIKeyFilters defines additional restrictions for an API key
+type APIKeyFilters struct {
+	// only requests originating from these IP/Mask are allowed.
+	// An empty list means from any IP address
+	AllowList []string `json:"allow_list,omitempty"`
+	// REST API endpoints the key can be used for. An empty list means all
+	Endpoints []APIKeyEndpoint `json:"endpoints,omitempty"`
+	// Hash of the key replaced by the last rotation. It is still accepted
+	// until PreviousKeyExpiresAt so clients can be updated without downtime
+	PreviousKey string `json:"previous_key,omitempty"`
+	// Expiration for the previous key as unix timestamp in milliseconds
+	PreviousKeyExpiresAt int64 `json:"previous_key_expires_at,omitempty"`
+}
+
+func (f *APIKeyFilters) getACopy() APIKeyFilters {
+	filters := APIKeyFilters{
+		AllowList:            make([]string, len(f.AllowList)),
+		Endpoints:            make([]APIKeyEndpoint, 0, len(f.Endpoints)),
+		PreviousKey:          f.PreviousKey,
+		PreviousKeyExpiresAt: f.PreviousKeyExpiresAt,
+	}
+	copy(filters.AllowList, f.AllowList)
+	for _, endpoint := range f.Endpoints {
+		methods := make([]string, len(endpoint.Methods))
+		copy(methods, endpoint.Methods)
+		filters.Endpoints = append(filters.Endpoints, APIKeyEndpoint{
+			Path:    endpoint.Path,
+			Methods: methods,
+		})
+	}
+	return filters
+}
+
+func (f *APIKeyFilters) hasValidPreviousKey() bool {
+	return f.PreviousKey != "" && f.PreviousKeyExpiresAt > util.GetTimeAsMsSinceEpoch(time.Now())
+}
+
+func (f *APIKeyFilters) validate() error {
+	f.AllowList = util.RemoveDuplicates(f.AllowList, false)
+	for _, IPMask := range f.AllowList {
+		if _, _, err := net.ParseCIDR(IPMask); err != nil {
+			return util.NewValidationError(fmt.Sprintf("could not parse allow list entry %q : %v", IPMask, err))
+		}
+	}
+	for idx := range f.Endpoints {
+		endpoint := &f.Endpoints[idx]
+		endpoint.Path = strings.TrimSpace(endpoint.Path)
+		if !strings.HasPrefix(endpoint.Path, "/") {
+			return util.NewValidationError(fmt.Sprintf("invalid endpoint path %q, it must be absolute", endpoint.Path))
+		}
+		var methods []string
+		for _, method := range endpoint.Methods {
+			method = strings.ToUpper(strings.TrimSpace(method))
+			if !util.Contains(apiKeyAllowedMethods, method) {
+				return util.NewValidationError(fmt.Sprintf("invalid method %q for endpoint %q", method, endpoint.Path))
+			}
+			methods = append(methods, method)
+		}
+		endpoint.Methods = util.RemoveDuplicates(methods, false)
+	}
+	if !f.hasValidPreviousKey() {
+		f.PreviousKey = ""
+		f.PreviousKeyExpiresAt = 0
+	}
+	return nil
+}
+
 // APIKey defines a SFTPGo API key.
 // API keys can be used as authentication alternative to short lived tokens
 // for REST API
@@ -66,6 +158,8 @@ type APIKey struct {
 	// Admin username associated with this API key.
 	// If empty and the scope is APIKeyScopeAdmin the key is valid for any admin
 	Admin string `json:"admin,omitempty"`
+	// Additional restrictions
+	Filters APIKeyFilters `json:"filters"`
 	// these fields are for internal use
 	userID   int64
 	adminID  int64
@@ -86,6 +180,7 @@ func (k *APIKey) getACopy() APIKey {
 		Description: k.Description,
 		User:        k.User,
 		Admin:       k.Admin,
+		Filters:     k.Filters.getACopy(),
 		userID:      k.userID,
 		adminID:     k.adminID,
 	}
@@ -109,6 +204,7 @@ func (k *APIKey) RenderAsJSON(reload bool) ([]byte, error) {
 // HideConfidentialData hides API key confidential data
 func (k *APIKey) HideConfidentialData() {
 	k.Key = ""
+	k.Filters.PreviousKey = ""
 }
 
 func (k *APIKey) hashKey() error {
@@ -155,6 +251,9 @@ func (k *APIKey) validate() error {
 	if err := k.hashKey(); err != nil {
 		return err
 	}
+	if err := k.Filters.validate(); err != nil {
+		return err
+	}
 	if k.User != "" && k.Admin != "" {
 		return util.NewValidationError("an API key can be related to a user or an admin, not both")
 	}
@@ -179,14 +278,71 @@ func (k *APIKey) validate() error {
 	return nil
 }
 
+// rotate replaces the key with a newly generated one. If gracePeriod is
+// greater than zero the current key is still accepted for the specified time
+func (k *APIKey) rotate(gracePeriod time.Duration) {
+	k.Filters.PreviousKey = ""
+	k.Filters.PreviousKeyExpiresAt = 0
+	if gracePeriod > 0 {
+		k.Filters.PreviousKey = k.Key
+		k.Filters.PreviousKeyExpiresAt = util.GetTimeAsMsSinceEpoch(time.Now().Add(gracePeriod))
+	}
+	k.Key = util.GenerateUniqueID()
+	k.plainKey = k.Key
+}
+
+// IsAllowedFromIP returns true if the API key can be used from the specified IP
+func (k *APIKey) IsAllowedFromIP(ip string) bool {
+	if len(k.Filters.AllowList) == 0 {
+		return true
+	}
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return false
+	}
+	for _, ipMask := range k.Filters.AllowList {
+		_, network, err := net.ParseCIDR(ipMask)
+		if err != nil {
+			continue
+		}
+		if network.Contains(parsedIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsEndpointAllowed returns true if the API key can be used for the specified
+// HTTP method and URL path
+func (k *APIKey) IsEndpointAllowed(method, urlPath string) bool {
+	if len(k.Filters.Endpoints) == 0 {
+		return true
+	}
+	for _, endpoint := range k.Filters.Endpoints {
+		if endpoint.matches(method, urlPath) {
+			return true
+		}
+	}
+	return false
+}
+
 // Authenticate tries to authenticate the provided plain key
 func (k *APIKey) Authenticate(plainKey string) error {
 	if k.ExpiresAt > 0 && k.ExpiresAt < util.GetTimeAsMsSinceEpoch(time.Now()) {
 		return fmt.Errorf("API key %q is expired, expiration timestamp: %v current timestamp: %v", k.KeyID,
 			k.ExpiresAt, util.GetTimeAsMsSinceEpoch(time.Now()))
 	}
+	err := checkAPIKeyHash(k.KeyID, plainKey, k.Key)
+	if err != nil && k.Filters.hasValidPreviousKey() {
+		// the key was rotated, the previous one is accepted until it expires
+		return checkAPIKeyHash(fmt.Sprintf("%s_previous", k.KeyID), plainKey, k.Filters.PreviousKey)
+	}
+	return err
+}
+
+func checkAPIKeyHash(cacheKey, plainKey, hash string) error {
 	if config.PasswordCaching {
-		found, match := cachedAPIKeys.Check(k.KeyID, plainKey, k.Key)
+		found, match := cachedAPIKeys.Check(cacheKey, plainKey, hash)
 		if found {
 			if !match {
 				return ErrInvalidCredentials
@@ -194,17 +350,17 @@ func (k *APIKey) Authenticate(plainKey string) error {
 			return nil
 		}
 	}
-	if strings.HasPrefix(k.Key, bcryptPwdPrefix) {
-		if err := bcrypt.CompareHashAndPassword([]byte(k.Key), []byte(plainKey)); err != nil {
+	if strings.HasPrefix(hash, bcryptPwdPrefix) {
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(plainKey)); err != nil {
 			return ErrInvalidCredentials
 		}
-	} else if strings.HasPrefix(k.Key, argonPwdPrefix) {
-		match, err := argon2id.ComparePasswordAndHash(plainKey, k.Key)
+	} else if strings.HasPrefix(hash, argonPwdPrefix) {
+		match, err := argon2id.ComparePasswordAndHash(plainKey, hash)
 		if err != nil || !match {
 			return ErrInvalidCredentials
 		}
 	}
 
-	cachedAPIKeys.Add(k.KeyID, plainKey, k.Key)
+	cachedAPIKeys.Add(cacheKey, plainKey, hash)
 	return nil
 }
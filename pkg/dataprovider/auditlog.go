@@ -0,0 +1,425 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/plugin"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	// AuditLogMaxLimit defines the maximum number of audit log entries
+	// that can be returned in a single search
+	AuditLogMaxLimit = 1000
+)
+
+var (
+	// fields that change for each update and are not reported as audit log changes
+	auditLogIgnoredFields = []string{"updated_at"}
+	// AuditLogActions defines the supported audit log actions
+	AuditLogActions = []string{operationAdd, operationUpdate, operationDelete}
+	// AuditLogObjectTypes defines the supported audit log object types
+	AuditLogObjectTypes = []string{actionObjectUser, actionObjectFolder, actionObjectGroup, actionObjectAdmin,
+		actionObjectAPIKey, actionObjectShare, actionObjectEventAction, actionObjectEventRule, actionObjectRole,
+		actionObjectAdminRole, actionObjectIPListEntry, actionObjectConfigs}
+)
+
+// AuditLogConfig defines the configuration for the audit log of the
+// create, update and delete operations performed by admins
+type AuditLogConfig struct {
+	// Set to true to record the objects mutations performed using the REST API
+	// and the WebAdmin within the data provider
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// Number of days to keep the audit log entries, older entries are
+	// periodically removed. 0 means no automatic cleanup
+	Retention int `json:"retention" mapstructure:"retention"`
+}
+
+func (c *AuditLogConfig) validate() error {
+	if c.Retention < 0 {
+		return fmt.Errorf("invalid audit log retention: %d", c.Retention)
+	}
+	return nil
+}
+
+// AuditLogChange defines a field changed by an update
+type AuditLogChange struct {
+	// Field name, nested fields are separated by a dot, for example "filters.max_upload_file_size"
+	Field  string `json:"field"`
+	Before any    `json:"before,omitempty"`
+	After  any    `json:"after,omitempty"`
+}
+
+// AuditLogEntry defines an audit log entry
+type AuditLogEntry struct {
+	ID int64 `json:"id"`
+	// Unix timestamp in milliseconds
+	Timestamp int64 `json:"timestamp"`
+	// add, update, delete
+	Action string `json:"action"`
+	// Admin that performed the action
+	Executor   string `json:"executor"`
+	IP         string `json:"ip,omitempty"`
+	Role       string `json:"role,omitempty"`
+	ObjectType string `json:"object_type"`
+	ObjectName string `json:"object_name"`
+	// Object before and after the action, confidential data are hidden
+	Before  json.RawMessage  `json:"before,omitempty"`
+	After   json.RawMessage  `json:"after,omitempty"`
+	Changes []AuditLogChange `json:"changes,omitempty"`
+}
+
+func (e *AuditLogEntry) validate() error {
+	if !util.Contains(AuditLogActions, e.Action) {
+		return util.NewValidationError(fmt.Sprintf("invalid audit log action: %q", e.Action))
+	}
+	if e.Executor == "" {
+		return util.NewValidationError("audit log executor is mandatory")
+	}
+	if !util.Contains(AuditLogObjectTypes, e.ObjectType) {
+		return util.NewValidationError(fmt.Sprintf("invalid audit log object type: %q", e.ObjectType))
+	}
+	if e.ObjectName == "" {
+		return util.NewValidationError("audit log object name is mandatory")
+	}
+	return nil
+}
+
+func (e *AuditLogEntry) getACopy() AuditLogEntry {
+	var before, after json.RawMessage
+	if len(e.Before) > 0 {
+		before = make(json.RawMessage, len(e.Before))
+		copy(before, e.Before)
+	}
+	if len(e.After) > 0 {
+		after = make(json.RawMessage, len(e.After))
+		copy(after, e.After)
+	}
+	var changes []AuditLogChange
+	if len(e.Changes) > 0 {
+		changes = make([]AuditLogChange, len(e.Changes))
+		copy(changes, e.Changes)
+	}
+	return AuditLogEntry{
+		ID:         e.ID,
+		Timestamp:  e.Timestamp,
+		Action:     e.Action,
+		Executor:   e.Executor,
+		IP:         e.IP,
+		Role:       e.Role,
+		ObjectType: e.ObjectType,
+		ObjectName: e.ObjectName,
+		Before:     before,
+		After:      after,
+		Changes:    changes,
+	}
+}
+
+func (e *AuditLogEntry) getChangesAsJSON() (string, error) {
+	if len(e.Changes) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(e.Changes)
+	return string(data), err
+}
+
+func (e *AuditLogEntry) setChangesFromJSON(data string) error {
+	if data == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(data), &e.Changes)
+}
+
+// AuditLogSearch defines the criteria to search the audit log
+type AuditLogSearch struct {
+	// Unix timestamps in milliseconds, 0 means no limit
+	StartTimestamp int64
+	EndTimestamp   int64
+	Executor       string
+	IP             string
+	// If set only the entries for this role are returned
+	Role        string
+	Actions     []string
+	ObjectTypes []string
+	ObjectName  string
+	// Return the entries with an ID greater, for ASC order, or lower,
+	// for DESC order, than this one. Used for pagination
+	FromID int64
+	Limit  int
+	Order  string
+	// Set to true to omit the objects data from the results
+	OmitObjectData bool
+}
+
+func (s *AuditLogSearch) validate() error {
+	if s.Limit <= 0 {
+		s.Limit = 100
+	}
+	if s.Limit > AuditLogMaxLimit {
+		return util.NewValidationError(fmt.Sprintf("limit is out of the 1-%d range: %d", AuditLogMaxLimit, s.Limit))
+	}
+	if s.Order == "" {
+		s.Order = OrderDESC
+	}
+	if s.Order != OrderASC && s.Order != OrderDESC {
+		return util.NewValidationError(fmt.Sprintf("invalid order %q", s.Order))
+	}
+	for _, action := range s.Actions {
+		if !util.Contains(AuditLogActions, action) {
+			return util.NewValidationError(fmt.Sprintf("invalid action %q", action))
+		}
+	}
+	for _, objectType := range s.ObjectTypes {
+		if !util.Contains(AuditLogObjectTypes, objectType) {
+			return util.NewValidationError(fmt.Sprintf("invalid object type %q", objectType))
+		}
+	}
+	s.Actions = util.RemoveDuplicates(s.Actions, false)
+	s.ObjectTypes = util.RemoveDuplicates(s.ObjectTypes, false)
+	return nil
+}
+
+// match returns true if the given entry matches the search criteria,
+// used by the providers that cannot filter using a query
+func (s *AuditLogSearch) match(e *AuditLogEntry) bool {
+	if s.FromID > 0 {
+		if s.Order == OrderASC && e.ID <= s.FromID {
+			return false
+		}
+		if s.Order == OrderDESC && e.ID >= s.FromID {
+			return false
+		}
+	}
+	if s.StartTimestamp > 0 && e.Timestamp < s.StartTimestamp {
+		return false
+	}
+	if s.EndTimestamp > 0 && e.Timestamp > s.EndTimestamp {
+		return false
+	}
+	if s.Executor != "" && e.Executor != s.Executor {
+		return false
+	}
+	if s.IP != "" && e.IP != s.IP {
+		return false
+	}
+	if s.Role != "" && e.Role != s.Role {
+		return false
+	}
+	if s.ObjectName != "" && e.ObjectName != s.ObjectName {
+		return false
+	}
+	if len(s.Actions) > 0 && !util.Contains(s.Actions, e.Action) {
+		return false
+	}
+	if len(s.ObjectTypes) > 0 && !util.Contains(s.ObjectTypes, e.ObjectType) {
+		return false
+	}
+	return true
+}
+
+func (s *AuditLogSearch) prepareEntry(e *AuditLogEntry) AuditLogEntry {
+	entry := e.getACopy()
+	if s.OmitObjectData {
+		entry.Before = nil
+		entry.After = nil
+	}
+	return entry
+}
+
+func sortAuditLogEntries(entries []AuditLogEntry, order string) {
+	sort.Slice(entries, func(i, j int) bool {
+		if order == OrderASC {
+			return entries[i].ID < entries[j].ID
+		}
+		return entries[i].ID > entries[j].ID
+	})
+}
+
+func flattenAuditLogObject(prefix string, value any, result map[string]any) {
+	if obj, ok := value.(map[string]any); ok && len(obj) > 0 {
+		for k, v := range obj {
+			key := k
+			if prefix != "" {
+				key = prefix + "." + k
+			}
+			flattenAuditLogObject(key, v, result)
+		}
+		return
+	}
+	if prefix != "" {
+		result[prefix] = value
+	}
+}
+
+// getAuditLogChanges returns the fields that differ between the given
+// JSON serialized objects. Arrays are compared as a whole
+func getAuditLogChanges(before, after []byte) []AuditLogChange {
+	var beforeObj, afterObj any
+	if err := json.Unmarshal(before, &beforeObj); err != nil {
+		return nil
+	}
+	if err := json.Unmarshal(after, &afterObj); err != nil {
+		return nil
+	}
+	beforeFields := make(map[string]any)
+	afterFields := make(map[string]any)
+	flattenAuditLogObject("", beforeObj, beforeFields)
+	flattenAuditLogObject("", afterObj, afterFields)
+
+	keys := make([]string, 0, len(beforeFields)+len(afterFields))
+	for k := range beforeFields {
+		keys = append(keys, k)
+	}
+	for k := range afterFields {
+		if _, ok := beforeFields[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var changes []AuditLogChange
+	for _, k := range keys {
+		if util.Contains(auditLogIgnoredFields, k) {
+			continue
+		}
+		if !reflect.DeepEqual(beforeFields[k], afterFields[k]) {
+			changes = append(changes, AuditLogChange{
+				Field:  k,
+				Before: beforeFields[k],
+				After:  afterFields[k],
+			})
+		}
+	}
+	return changes
+}
+
+// isAuditLogRequired returns true if the action must be recorded in the audit log.
+// Actions performed by the system and by users on their own objects are not recorded
+func isAuditLogRequired(executor, objectType string, object plugin.Renderer) bool {
+	if !config.AuditLog.Enabled {
+		return false
+	}
+	switch executor {
+	case "", ActionExecutorSystem:
+		return false
+	case ActionExecutorSelf:
+		return objectType == actionObjectAdmin
+	}
+	if share, ok := object.(*Share); ok && share.Username == executor {
+		return false
+	}
+	return true
+}
+
+// getAuditLogSnapshot returns the current object as stored within the data
+// provider, it must be called before updating the object
+func getAuditLogSnapshot(executor, objectType string, object plugin.Renderer) []byte {
+	if !isAuditLogRequired(executor, objectType, object) {
+		return nil
+	}
+	data, err := object.RenderAsJSON(true)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to get audit log snapshot for object type %q: %v", objectType, err)
+		return nil
+	}
+	return data
+}
+
+// executeAuditedAction executes the provider action and records it in the audit log
+// and in the configuration snapshots.
+// For update actions before must contain the snapshot of the object before the update
+func executeAuditedAction(ctx context.Context, operation, executor, ip, objectType, objectName, role string, before []byte,
+	object plugin.Renderer,
+) {
+	if isAuditLogRequired(executor, objectType, object) {
+		addAuditLogEntry(operation, executor, ip, objectType, objectName, role, before, object)
+	}
+	addConfigSnapshot(operation, executor, ip, objectType, objectName, role, object)
+	executeAction(ctx, operation, executor, ip, objectType, objectName, role, object)
+}
+
+func addAuditLogEntry(operation, executor, ip, objectType, objectName, role string, before []byte,
+	object plugin.Renderer,
+) {
+	if executor == ActionExecutorSelf {
+		executor = objectName
+	}
+	entry := AuditLogEntry{
+		Timestamp:  util.GetTimeAsMsSinceEpoch(time.Now()),
+		Action:     operation,
+		Executor:   executor,
+		IP:         ip,
+		Role:       role,
+		ObjectType: objectType,
+		ObjectName: objectName,
+	}
+	var err error
+	switch operation {
+	case operationDelete:
+		entry.Before, err = object.RenderAsJSON(false)
+	default:
+		entry.Before = before
+		entry.After, err = object.RenderAsJSON(true)
+	}
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to render object type %q, name %q for the audit log: %v",
+			objectType, objectName, err)
+	}
+	if operation == operationUpdate && len(entry.Before) > 0 && len(entry.After) > 0 {
+		entry.Changes = getAuditLogChanges(entry.Before, entry.After)
+	}
+	if err := provider.addAuditLogEntry(&entry); err != nil {
+		providerLog(logger.LevelError, "unable to add audit log entry, action %q, object type %q, name %q: %v",
+			operation, objectType, objectName, err)
+	}
+}
+
+// IsAuditLogEnabled returns true if the audit log is enabled
+func IsAuditLogEnabled() bool {
+	return config.AuditLog.Enabled
+}
+
+// SearchAuditLog returns the audit log entries matching the specified criteria
+func SearchAuditLog(filters *AuditLogSearch) ([]AuditLogEntry, error) {
+	if err := filters.validate(); err != nil {
+		return nil, err
+	}
+	return provider.searchAuditLog(filters)
+}
+
+// CleanupAuditLog removes the audit log entries older than the specified time
+func CleanupAuditLog(before time.Time) error {
+	return provider.cleanupAuditLog(util.GetTimeAsMsSinceEpoch(before))
+}
+
+func checkAuditLogRetention() {
+	if !config.AuditLog.Enabled || config.AuditLog.Retention <= 0 {
+		return
+	}
+	before := time.Now().Add(-time.Duration(config.AuditLog.Retention) * 24 * time.Hour)
+	if err := CleanupAuditLog(before); err != nil {
+		providerLog(logger.LevelError, "unable to cleanup audit log entries older than %s: %v", before, err)
+		return
+	}
+	providerLog(logger.LevelDebug, "audit log entries older than %s removed", before)
+}
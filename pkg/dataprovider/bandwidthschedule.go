@@ -0,0 +1,92 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// BandwidthSchedule defines the bandwidth limits to apply within a cron-like
+// time window. As for event rules, schedules are evaluated in UTC and with hour
+// granularity
+type BandwidthSchedule struct {
+	Schedule Schedule `json:"schedule"`
+	// Upload and download bandwidth as KB/s, 0 means unlimited
+	UploadBandwidth   int64 `json:"upload_bandwidth"`
+	DownloadBandwidth int64 `json:"download_bandwidth"`
+}
+
+func (s *BandwidthSchedule) validate() error {
+	for _, field := range []*string{&s.Schedule.Hours, &s.Schedule.DayOfWeek, &s.Schedule.DayOfMonth, &s.Schedule.Month} {
+		*field = strings.TrimSpace(*field)
+		if *field == "" {
+			*field = "*"
+		}
+	}
+	if _, err := cron.ParseStandard(s.Schedule.GetCronSpec()); err != nil {
+		return util.NewValidationError(fmt.Sprintf("invalid bandwidth schedule, hour: %q, day of month: %q, month: %q, day of week: %q",
+			s.Schedule.Hours, s.Schedule.DayOfMonth, s.Schedule.Month, s.Schedule.DayOfWeek))
+	}
+	if s.UploadBandwidth < 0 {
+		s.UploadBandwidth = 0
+	}
+	if s.DownloadBandwidth < 0 {
+		s.DownloadBandwidth = 0
+	}
+	return nil
+}
+
+// IsActive returns true if the schedule includes the hour of the specified time
+func (s *Schedule) IsActive(t time.Time) bool {
+	schedule, err := cron.ParseStandard(s.GetCronSpec())
+	if err != nil {
+		return false
+	}
+	hour := t.UTC().Truncate(time.Hour)
+	return schedule.Next(hour.Add(-time.Second)).Equal(hour)
+}
+
+func validateBandwidthSchedules(user *User) error {
+	for idx := range user.Filters.BandwidthSchedules {
+		if err := user.Filters.BandwidthSchedules[idx].validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyBandwidthSchedules(schedules []BandwidthSchedule) []BandwidthSchedule {
+	result := make([]BandwidthSchedule, len(schedules))
+	copy(result, schedules)
+	return result
+}
+
+// GetScheduledBandwidth returns the upload and download bandwidth defined by the
+// first bandwidth schedule active at the specified time. The last return value
+// is false if no schedule is active
+func (u *User) GetScheduledBandwidth(t time.Time) (int64, int64, bool) {
+	for _, schedule := range u.Filters.BandwidthSchedules {
+		if schedule.Schedule.IsActive(t) {
+			return schedule.UploadBandwidth, schedule.DownloadBandwidth, true
+		}
+	}
+	return 0, 0, false
+}
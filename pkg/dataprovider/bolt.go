@@ -19,7 +19,9 @@ package dataprovider
 
 import (
 	"bytes"
+	"context"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -41,22 +43,29 @@ const (
 )
 
 var (
-	usersBucket     = []byte("users")
-	groupsBucket    = []byte("groups")
-	foldersBucket   = []byte("folders")
-	adminsBucket    = []byte("admins")
-	apiKeysBucket   = []byte("api_keys")
-	sharesBucket    = []byte("shares")
-	actionsBucket   = []byte("events_actions")
-	rulesBucket     = []byte("events_rules")
-	rolesBucket     = []byte("roles")
-	ipListsBucket   = []byte("ip_lists")
-	configsBucket   = []byte("configs")
-	dbVersionBucket = []byte("db_version")
-	dbVersionKey    = []byte("version")
-	configsKey      = []byte("configs")
-	boltBuckets     = [][]byte{usersBucket, groupsBucket, foldersBucket, adminsBucket, apiKeysBucket,
-		sharesBucket, actionsBucket, rulesBucket, rolesBucket, ipListsBucket, configsBucket, dbVersionBucket}
+	usersBucket      = []byte("users")
+	groupsBucket     = []byte("groups")
+	foldersBucket    = []byte("folders")
+	adminsBucket     = []byte("admins")
+	apiKeysBucket    = []byte("api_keys")
+	sharesBucket     = []byte("shares")
+	actionsBucket    = []byte("events_actions")
+	rulesBucket      = []byte("events_rules")
+	rolesBucket      = []byte("roles")
+	adminRolesBucket = []byte("admin_roles")
+	ipListsBucket    = []byte("ip_lists")
+	configsBucket    = []byte("configs")
+	filesMetaBucket  = []byte("files_metadata")
+	digestsBucket    = []byte("events_digests")
+	auditLogsBucket  = []byte("audit_logs")
+	shareEvsBucket   = []byte("share_events")
+	sessionsBucket   = []byte("shared_sessions")
+	dbVersionBucket  = []byte("db_version")
+	dbVersionKey     = []byte("version")
+	configsKey       = []byte("configs")
+	boltBuckets      = [][]byte{usersBucket, groupsBucket, foldersBucket, adminsBucket, apiKeysBucket,
+		sharesBucket, actionsBucket, rulesBucket, rolesBucket, adminRolesBucket, ipListsBucket, configsBucket,
+		filesMetaBucket, digestsBucket, auditLogsBucket, shareEvsBucket, sessionsBucket, dbVersionBucket}
 )
 
 // BoltProvider defines the auth provider for bolt key/value store
@@ -119,13 +128,13 @@ func (p *BoltProvider) validateUserAndTLSCert(username, protocol string, tlsCert
 	return checkUserAndTLSCertificate(&user, protocol, tlsCert)
 }
 
-func (p *BoltProvider) validateUserAndPass(username, password, ip, protocol string) (User, error) {
+func (p *BoltProvider) validateUserAndPass(ctx context.Context, username, password, ip, protocol string) (User, error) {
 	user, err := p.userExists(username, "")
 	if err != nil {
 		providerLog(logger.LevelWarn, "error authenticating user %q: %v", username, err)
 		return user, err
 	}
-	return checkUserAndPass(&user, password, ip, protocol)
+	return checkUserAndPass(ctx, &user, password, ip, protocol)
 }
 
 func (p *BoltProvider) validateAdminAndPass(username, password, ip string) (Admin, error) {
@@ -406,6 +415,13 @@ func (p *BoltProvider) addAdmin(admin *Admin) error {
 		if err = p.addAdminToRole(admin.Username, admin.Role, rolesBucket); err != nil {
 			return err
 		}
+		adminRolesBucket, err := p.getAdminRolesBucket(tx)
+		if err != nil {
+			return err
+		}
+		if err = p.addAdminToAdminRole(admin.Username, admin.AdminRole, adminRolesBucket); err != nil {
+			return err
+		}
 
 		buf, err := json.Marshal(admin)
 		if err != nil {
@@ -455,6 +471,16 @@ func (p *BoltProvider) updateAdmin(admin *Admin) error {
 		if err = p.addAdminToRole(admin.Username, admin.Role, rolesBucket); err != nil {
 			return err
 		}
+		adminRolesBucket, err := p.getAdminRolesBucket(tx)
+		if err != nil {
+			return err
+		}
+		if err = p.removeAdminFromAdminRole(oldAdmin.Username, oldAdmin.AdminRole, adminRolesBucket); err != nil {
+			return err
+		}
+		if err = p.addAdminToAdminRole(admin.Username, admin.AdminRole, adminRolesBucket); err != nil {
+			return err
+		}
 		for idx := range admin.Groups {
 			err = p.addAdminToGroupMapping(admin.Username, admin.Groups[idx].Name, groupBucket)
 			if err != nil {
@@ -510,6 +536,15 @@ func (p *BoltProvider) deleteAdmin(admin Admin) error {
 				return err
 			}
 		}
+		if oldAdmin.AdminRole != "" {
+			adminRolesBucket, err := p.getAdminRolesBucket(tx)
+			if err != nil {
+				return err
+			}
+			if err = p.removeAdminFromAdminRole(oldAdmin.Username, oldAdmin.AdminRole, adminRolesBucket); err != nil {
+				return err
+			}
+		}
 
 		if err := p.deleteRelatedAPIKey(tx, admin.Username, APIKeyScopeAdmin); err != nil {
 			return err
@@ -777,6 +812,9 @@ func (p *BoltProvider) deleteUser(user User, _ bool) error {
 		if err := p.deleteRelatedShares(tx, user.Username); err != nil {
 			return err
 		}
+		if err := p.deleteRelatedFilesMetadata(tx, user.Username); err != nil {
+			return err
+		}
 		return bucket.Delete([]byte(user.Username))
 	})
 }
@@ -1032,7 +1070,7 @@ func (p *BoltProvider) dumpFolders() ([]vfs.BaseVirtualFolder, error) {
 	return folders, err
 }
 
-func (p *BoltProvider) getFolders(limit, offset int, order string, _ bool) ([]vfs.BaseVirtualFolder, error) {
+func (p *BoltProvider) getFolders(limit, offset int, order string, _ bool, role string) ([]vfs.BaseVirtualFolder, error) {
 	folders := make([]vfs.BaseVirtualFolder, 0, limit)
 	var err error
 	if limit <= 0 {
@@ -1056,6 +1094,9 @@ func (p *BoltProvider) getFolders(limit, offset int, order string, _ bool) ([]vf
 				if err != nil {
 					return err
 				}
+				if !folderHasRole(&folder, role) {
+					continue
+				}
 				folder.PrepareForRendering()
 				folders = append(folders, folder)
 				if len(folders) >= limit {
@@ -1073,6 +1114,9 @@ func (p *BoltProvider) getFolders(limit, offset int, order string, _ bool) ([]vf
 				if err != nil {
 					return err
 				}
+				if !folderHasRole(&folder, role) {
+					continue
+				}
 				folder.PrepareForRendering()
 				folders = append(folders, folder)
 				if len(folders) >= limit {
@@ -1280,7 +1324,7 @@ func (p *BoltProvider) getUsedFolderQuota(name string) (int, int64, error) {
 	return folder.UsedQuotaFiles, folder.UsedQuotaSize, err
 }
 
-func (p *BoltProvider) getGroups(limit, offset int, order string, _ bool) ([]Group, error) {
+func (p *BoltProvider) getGroups(limit, offset int, order string, _ bool, role string) ([]Group, error) {
 	groups := make([]Group, 0, limit)
 	var err error
 	if limit <= 0 {
@@ -1308,6 +1352,9 @@ func (p *BoltProvider) getGroups(limit, offset int, order string, _ bool) ([]Gro
 				if err != nil {
 					return err
 				}
+				if !group.hasRole(role) {
+					continue
+				}
 				group.PrepareForRendering()
 				groups = append(groups, group)
 				if len(groups) >= limit {
@@ -1325,6 +1372,9 @@ func (p *BoltProvider) getGroups(limit, offset int, order string, _ bool) ([]Gro
 				if err != nil {
 					return err
 				}
+				if !group.hasRole(role) {
+					continue
+				}
 				group.PrepareForRendering()
 				groups = append(groups, group)
 				if len(groups) >= limit {
@@ -1667,6 +1717,38 @@ func (p *BoltProvider) updateAPIKey(apiKey *APIKey) error {
 	})
 }
 
+func (p *BoltProvider) rotateAPIKey(apiKey *APIKey) error {
+	err := apiKey.validate()
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := p.getAPIKeysBucket(tx)
+		if err != nil {
+			return err
+		}
+		var a []byte
+
+		if a = bucket.Get([]byte(apiKey.KeyID)); a == nil {
+			return util.NewRecordNotFoundError(fmt.Sprintf("API key %v does not exist", apiKey.KeyID))
+		}
+		var oldAPIKey APIKey
+		err = json.Unmarshal(a, &oldAPIKey)
+		if err != nil {
+			return err
+		}
+
+		oldAPIKey.Key = apiKey.Key
+		oldAPIKey.Filters = apiKey.Filters
+		oldAPIKey.UpdatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+		buf, err := json.Marshal(oldAPIKey)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(apiKey.KeyID), buf)
+	})
+}
+
 func (p *BoltProvider) deleteAPIKey(apiKey APIKey) error {
 	return p.dbHandle.Update(func(tx *bolt.Tx) error {
 		bucket, err := p.getAPIKeysBucket(tx)
@@ -1887,6 +1969,9 @@ func (p *BoltProvider) deleteShare(share Share) error {
 		if oldObject.Username != share.Username {
 			return util.NewRecordNotFoundError(fmt.Sprintf("Share %v does not exist", share.ShareID))
 		}
+		if err := p.deleteRelatedShareEvents(tx, map[string]bool{share.ShareID: true}); err != nil {
+			return err
+		}
 
 		return bucket.Delete([]byte(share.ShareID))
 	})
@@ -2054,20 +2139,102 @@ func (p *BoltProvider) getActiveTransfers(_ time.Time) ([]ActiveTransfer, error)
 	return nil, ErrNotImplemented
 }
 
-func (p *BoltProvider) addSharedSession(_ Session) error {
-	return ErrNotImplemented
+func (p *BoltProvider) addSharedSession(session Session) error {
+	buf, err := encodeSession(session)
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := p.getSessionsBucket(tx)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(session.Key), buf)
+	})
 }
 
-func (p *BoltProvider) deleteSharedSession(_ string) error {
-	return ErrNotImplemented
+func (p *BoltProvider) deleteSharedSession(key string) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := p.getSessionsBucket(tx)
+		if err != nil {
+			return err
+		}
+		if bucket.Get([]byte(key)) == nil {
+			return util.NewRecordNotFoundError(fmt.Sprintf("session %q does not exist", key))
+		}
+		return bucket.Delete([]byte(key))
+	})
 }
 
-func (p *BoltProvider) getSharedSession(_ string) (Session, error) {
-	return Session{}, ErrNotImplemented
+func (p *BoltProvider) getSharedSession(key string) (Session, error) {
+	var session Session
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := p.getSessionsBucket(tx)
+		if err != nil {
+			return err
+		}
+		v := bucket.Get([]byte(key))
+		if v == nil {
+			return util.NewRecordNotFoundError(fmt.Sprintf("session %q does not exist", key))
+		}
+		s, err := decodeSession(v)
+		if err != nil {
+			return err
+		}
+		session = s.getSession()
+		return nil
+	})
+	return session, err
 }
 
-func (p *BoltProvider) cleanupSharedSessions(_ SessionType, _ int64) error {
-	return ErrNotImplemented
+func (p *BoltProvider) cleanupSharedSessions(sessionType SessionType, before int64) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := p.getSessionsBucket(tx)
+		if err != nil {
+			return err
+		}
+		var toRemove [][]byte
+		err = bucket.ForEach(func(k, v []byte) error {
+			session, err := decodeSession(v)
+			if err != nil {
+				return err
+			}
+			if session.Type == sessionType && session.Timestamp < before {
+				toRemove = append(toRemove, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range toRemove {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (p *BoltProvider) getSharedSessions(sessionType SessionType, after int64) ([]Session, error) {
+	var sessions []Session
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := p.getSessionsBucket(tx)
+		if err != nil {
+			return err
+		}
+		return bucket.ForEach(func(_, v []byte) error {
+			session, err := decodeSession(v)
+			if err != nil {
+				return err
+			}
+			if session.Type == sessionType && session.Timestamp >= after {
+				sessions = append(sessions, session.getSession())
+			}
+			return nil
+		})
+	})
+	return sessions, err
 }
 
 func (p *BoltProvider) getEventActions(limit, offset int, order string, _ bool) ([]BaseEventAction, error) {
@@ -2268,7 +2435,7 @@ func (p *BoltProvider) deleteEventAction(action BaseEventAction) error {
 	})
 }
 
-func (p *BoltProvider) getEventRules(limit, offset int, order string) ([]EventRule, error) {
+func (p *BoltProvider) getEventRules(limit, offset int, order, role string) ([]EventRule, error) {
 	if limit <= 0 {
 		return nil, nil
 	}
@@ -2295,6 +2462,9 @@ func (p *BoltProvider) getEventRules(limit, offset int, order string) ([]EventRu
 				if err != nil {
 					return err
 				}
+				if !rule.hasRole(role) {
+					continue
+				}
 				rule.PrepareForRendering()
 				rules = append(rules, rule)
 				if len(rules) >= limit {
@@ -2312,6 +2482,9 @@ func (p *BoltProvider) getEventRules(limit, offset int, order string) ([]EventRu
 				if err != nil {
 					return err
 				}
+				if !rule.hasRole(role) {
+					continue
+				}
 				rule.PrepareForRendering()
 				rules = append(rules, rule)
 				if len(rules) >= limit {
@@ -2570,6 +2743,10 @@ func (*BoltProvider) updateNodeTimestamp() error {
 	return ErrNotImplemented
 }
 
+func (*BoltProvider) updateNodeConnections() error {
+	return ErrNotImplemented
+}
+
 func (*BoltProvider) cleanupNodes() error {
 	return ErrNotImplemented
 }
@@ -2755,152 +2932,319 @@ func (p *BoltProvider) dumpRoles() ([]Role, error) {
 	return roles, err
 }
 
-func (p *BoltProvider) ipListEntryExists(ipOrNet string, listType IPListType) (IPListEntry, error) {
-	entry := IPListEntry{
-		IPOrNet: ipOrNet,
-		Type:    listType,
-	}
+func (p *BoltProvider) adminRoleExists(name string) (AdminRole, error) {
+	var role AdminRole
 	err := p.dbHandle.View(func(tx *bolt.Tx) error {
-		bucket, err := p.getIPListsBucket(tx)
+		bucket, err := p.getAdminRolesBucket(tx)
 		if err != nil {
 			return err
 		}
-		e := bucket.Get([]byte(entry.getKey()))
-		if e == nil {
-			return util.NewRecordNotFoundError(fmt.Sprintf("entry %q does not exist", entry.IPOrNet))
-		}
-		err = json.Unmarshal(e, &entry)
-		if err == nil {
-			entry.PrepareForRendering()
+		r := bucket.Get([]byte(name))
+		if r == nil {
+			return util.NewRecordNotFoundError(fmt.Sprintf("admin role %q does not exist", name))
 		}
-		return err
+		return json.Unmarshal(r, &role)
 	})
-	return entry, err
+	return role, err
 }
 
-func (p *BoltProvider) addIPListEntry(entry *IPListEntry) error {
-	if err := entry.validate(); err != nil {
+func (p *BoltProvider) addAdminRole(role *AdminRole) error {
+	if err := role.validate(); err != nil {
 		return err
 	}
 	return p.dbHandle.Update(func(tx *bolt.Tx) error {
-		bucket, err := p.getIPListsBucket(tx)
+		bucket, err := p.getAdminRolesBucket(tx)
 		if err != nil {
 			return err
 		}
-		if e := bucket.Get([]byte(entry.getKey())); e != nil {
-			return fmt.Errorf("entry %q already exists", entry.IPOrNet)
+		if r := bucket.Get([]byte(role.Name)); r != nil {
+			return fmt.Errorf("admin role %q already exists", role.Name)
 		}
-		entry.CreatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
-		entry.UpdatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
-		buf, err := json.Marshal(entry)
+		id, err := bucket.NextSequence()
 		if err != nil {
 			return err
 		}
-		return bucket.Put([]byte(entry.getKey()), buf)
+		role.ID = int64(id)
+		role.CreatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+		role.UpdatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+		role.Admins = nil
+		buf, err := json.Marshal(role)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(role.Name), buf)
 	})
 }
 
-func (p *BoltProvider) updateIPListEntry(entry *IPListEntry) error {
-	if err := entry.validate(); err != nil {
+func (p *BoltProvider) updateAdminRole(role *AdminRole) error {
+	if err := role.validate(); err != nil {
 		return err
 	}
 	return p.dbHandle.Update(func(tx *bolt.Tx) error {
-		bucket, err := p.getIPListsBucket(tx)
+		bucket, err := p.getAdminRolesBucket(tx)
 		if err != nil {
 			return err
 		}
-		var e []byte
-		if e = bucket.Get([]byte(entry.getKey())); e == nil {
-			return fmt.Errorf("entry %q does not exist", entry.IPOrNet)
+		var r []byte
+		if r = bucket.Get([]byte(role.Name)); r == nil {
+			return util.NewRecordNotFoundError(fmt.Sprintf("admin role %q does not exist", role.Name))
 		}
-		var oldEntry IPListEntry
-		err = json.Unmarshal(e, &oldEntry)
+		var oldRole AdminRole
+		err = json.Unmarshal(r, &oldRole)
 		if err != nil {
 			return err
 		}
-		entry.CreatedAt = oldEntry.CreatedAt
-		entry.UpdatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
-		buf, err := json.Marshal(entry)
+		role.ID = oldRole.ID
+		role.CreatedAt = oldRole.CreatedAt
+		role.UpdatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+		role.Admins = oldRole.Admins
+		buf, err := json.Marshal(role)
 		if err != nil {
 			return err
 		}
-		return bucket.Put([]byte(entry.getKey()), buf)
+		return bucket.Put([]byte(role.Name), buf)
 	})
 }
 
-func (p *BoltProvider) deleteIPListEntry(entry IPListEntry, _ bool) error {
+func (p *BoltProvider) deleteAdminRole(role AdminRole) error {
 	return p.dbHandle.Update(func(tx *bolt.Tx) error {
-		bucket, err := p.getIPListsBucket(tx)
+		bucket, err := p.getAdminRolesBucket(tx)
 		if err != nil {
 			return err
 		}
-		if e := bucket.Get([]byte(entry.getKey())); e == nil {
-			return fmt.Errorf("entry %q does not exist", entry.IPOrNet)
+		var r []byte
+		if r = bucket.Get([]byte(role.Name)); r == nil {
+			return util.NewRecordNotFoundError(fmt.Sprintf("admin role %q does not exist", role.Name))
 		}
-		return bucket.Delete([]byte(entry.getKey()))
+		var oldRole AdminRole
+		err = json.Unmarshal(r, &oldRole)
+		if err != nil {
+			return err
+		}
+		if len(oldRole.Admins) > 0 {
+			return util.NewValidationError(fmt.Sprintf("the admin role %q is referenced, it cannot be removed", oldRole.Name))
+		}
+		return bucket.Delete([]byte(role.Name))
 	})
 }
 
-func (p *BoltProvider) getIPListEntries(listType IPListType, filter, from, order string, limit int) ([]IPListEntry, error) {
-	entries := make([]IPListEntry, 0, 15)
+func (p *BoltProvider) getAdminRoles(limit int, offset int, order string, _ bool) ([]AdminRole, error) {
+	roles := make([]AdminRole, 0, limit)
+	if limit <= 0 {
+		return roles, nil
+	}
 	err := p.dbHandle.View(func(tx *bolt.Tx) error {
-		bucket, err := p.getIPListsBucket(tx)
+		bucket, err := p.getAdminRolesBucket(tx)
 		if err != nil {
 			return err
 		}
-		prefix := []byte(fmt.Sprintf("%d_", listType))
-		acceptKey := func(k []byte) bool {
-			return k != nil && bytes.HasPrefix(k, prefix)
-		}
 		cursor := bucket.Cursor()
+		itNum := 0
 		if order == OrderASC {
-			for k, v := cursor.Seek(prefix); acceptKey(k); k, v = cursor.Next() {
-				var entry IPListEntry
-				err = json.Unmarshal(v, &entry)
+			for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+				itNum++
+				if itNum <= offset {
+					continue
+				}
+				var role AdminRole
+				err = json.Unmarshal(v, &role)
 				if err != nil {
 					return err
 				}
-				if entry.satisfySearchConstraints(filter, from, order) {
-					entry.PrepareForRendering()
-					entries = append(entries, entry)
-					if limit > 0 && len(entries) >= limit {
-						break
-					}
+				roles = append(roles, role)
+				if len(roles) >= limit {
+					break
 				}
 			}
 		} else {
-			for k, v := cursor.Last(); acceptKey(k); k, v = cursor.Prev() {
-				var entry IPListEntry
-				err = json.Unmarshal(v, &entry)
+			for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+				itNum++
+				if itNum <= offset {
+					continue
+				}
+				var role AdminRole
+				err = json.Unmarshal(v, &role)
 				if err != nil {
 					return err
 				}
-				if entry.satisfySearchConstraints(filter, from, order) {
-					entry.PrepareForRendering()
-					entries = append(entries, entry)
-					if limit > 0 && len(entries) >= limit {
-						break
-					}
+				roles = append(roles, role)
+				if len(roles) >= limit {
+					break
 				}
 			}
 		}
 		return nil
 	})
-	return entries, err
-}
-
-func (p *BoltProvider) getRecentlyUpdatedIPListEntries(_ int64) ([]IPListEntry, error) {
-	return nil, ErrNotImplemented
+	return roles, err
 }
 
-func (p *BoltProvider) dumpIPListEntries() ([]IPListEntry, error) {
-	entries := make([]IPListEntry, 0, 10)
+func (p *BoltProvider) dumpAdminRoles() ([]AdminRole, error) {
+	roles := make([]AdminRole, 0, 10)
 	err := p.dbHandle.View(func(tx *bolt.Tx) error {
-		bucket, err := p.getIPListsBucket(tx)
+		bucket, err := p.getAdminRolesBucket(tx)
 		if err != nil {
 			return err
 		}
-		if count := bucket.Stats().KeyN; count > ipListMemoryLimit {
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var role AdminRole
+			err = json.Unmarshal(v, &role)
+			if err != nil {
+				return err
+			}
+			roles = append(roles, role)
+		}
+		return err
+	})
+	return roles, err
+}
+
+func (p *BoltProvider) ipListEntryExists(ipOrNet string, listType IPListType) (IPListEntry, error) {
+	entry := IPListEntry{
+		IPOrNet: ipOrNet,
+		Type:    listType,
+	}
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := p.getIPListsBucket(tx)
+		if err != nil {
+			return err
+		}
+		e := bucket.Get([]byte(entry.getKey()))
+		if e == nil {
+			return util.NewRecordNotFoundError(fmt.Sprintf("entry %q does not exist", entry.IPOrNet))
+		}
+		err = json.Unmarshal(e, &entry)
+		if err == nil {
+			entry.PrepareForRendering()
+		}
+		return err
+	})
+	return entry, err
+}
+
+func (p *BoltProvider) addIPListEntry(entry *IPListEntry) error {
+	if err := entry.validate(); err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := p.getIPListsBucket(tx)
+		if err != nil {
+			return err
+		}
+		if e := bucket.Get([]byte(entry.getKey())); e != nil {
+			return fmt.Errorf("entry %q already exists", entry.IPOrNet)
+		}
+		entry.CreatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+		entry.UpdatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+		buf, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(entry.getKey()), buf)
+	})
+}
+
+func (p *BoltProvider) updateIPListEntry(entry *IPListEntry) error {
+	if err := entry.validate(); err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := p.getIPListsBucket(tx)
+		if err != nil {
+			return err
+		}
+		var e []byte
+		if e = bucket.Get([]byte(entry.getKey())); e == nil {
+			return fmt.Errorf("entry %q does not exist", entry.IPOrNet)
+		}
+		var oldEntry IPListEntry
+		err = json.Unmarshal(e, &oldEntry)
+		if err != nil {
+			return err
+		}
+		entry.CreatedAt = oldEntry.CreatedAt
+		entry.UpdatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+		buf, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(entry.getKey()), buf)
+	})
+}
+
+func (p *BoltProvider) deleteIPListEntry(entry IPListEntry, _ bool) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := p.getIPListsBucket(tx)
+		if err != nil {
+			return err
+		}
+		if e := bucket.Get([]byte(entry.getKey())); e == nil {
+			return fmt.Errorf("entry %q does not exist", entry.IPOrNet)
+		}
+		return bucket.Delete([]byte(entry.getKey()))
+	})
+}
+
+func (p *BoltProvider) getIPListEntries(listType IPListType, filter, from, order string, limit int) ([]IPListEntry, error) {
+	entries := make([]IPListEntry, 0, 15)
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := p.getIPListsBucket(tx)
+		if err != nil {
+			return err
+		}
+		prefix := []byte(fmt.Sprintf("%d_", listType))
+		acceptKey := func(k []byte) bool {
+			return k != nil && bytes.HasPrefix(k, prefix)
+		}
+		cursor := bucket.Cursor()
+		if order == OrderASC {
+			for k, v := cursor.Seek(prefix); acceptKey(k); k, v = cursor.Next() {
+				var entry IPListEntry
+				err = json.Unmarshal(v, &entry)
+				if err != nil {
+					return err
+				}
+				if entry.satisfySearchConstraints(filter, from, order) {
+					entry.PrepareForRendering()
+					entries = append(entries, entry)
+					if limit > 0 && len(entries) >= limit {
+						break
+					}
+				}
+			}
+		} else {
+			for k, v := cursor.Last(); acceptKey(k); k, v = cursor.Prev() {
+				var entry IPListEntry
+				err = json.Unmarshal(v, &entry)
+				if err != nil {
+					return err
+				}
+				if entry.satisfySearchConstraints(filter, from, order) {
+					entry.PrepareForRendering()
+					entries = append(entries, entry)
+					if limit > 0 && len(entries) >= limit {
+						break
+					}
+				}
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (p *BoltProvider) getRecentlyUpdatedIPListEntries(_ int64) ([]IPListEntry, error) {
+	return nil, ErrNotImplemented
+}
+
+func (p *BoltProvider) dumpIPListEntries() ([]IPListEntry, error) {
+	entries := make([]IPListEntry, 0, 10)
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := p.getIPListsBucket(tx)
+		if err != nil {
+			return err
+		}
+		if count := bucket.Stats().KeyN; count > ipListMemoryLimit {
 			providerLog(logger.LevelInfo, "IP lists excluded from dump, too many entries: %d", count)
 			return nil
 		}
@@ -3013,6 +3357,380 @@ func (p *BoltProvider) setConfigs(configs *Configs) error {
 	})
 }
 
+func (p *BoltProvider) getFileMetadata(username, virtualPath string) (FileMetadata, error) {
+	var metadata FileMetadata
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := p.getFilesMetadataBucket(tx)
+		if err != nil {
+			return err
+		}
+		var m []byte
+		if userBucket := bucket.Bucket([]byte(username)); userBucket != nil {
+			m = userBucket.Get([]byte(virtualPath))
+		}
+		if m == nil {
+			return util.NewRecordNotFoundError(fmt.Sprintf("no metadata for path %q", virtualPath))
+		}
+		return json.Unmarshal(m, &metadata)
+	})
+	return metadata, err
+}
+
+func (p *BoltProvider) getFilesMetadata(username, virtualPath string) ([]FileMetadata, error) {
+	result := make([]FileMetadata, 0)
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := p.getFilesMetadataBucket(tx)
+		if err != nil {
+			return err
+		}
+		userBucket := bucket.Bucket([]byte(username))
+		if userBucket == nil {
+			return nil
+		}
+		cursor := userBucket.Cursor()
+		for k, v := cursor.Seek([]byte(virtualPath)); k != nil && bytes.HasPrefix(k, []byte(virtualPath)); k, v = cursor.Next() {
+			if !isFileMetadataInPath(string(k), virtualPath) {
+				continue
+			}
+			var metadata FileMetadata
+			if err := json.Unmarshal(v, &metadata); err != nil {
+				return err
+			}
+			result = append(result, metadata)
+		}
+		return nil
+	})
+	sortFilesMetadata(result)
+	return result, err
+}
+
+func (p *BoltProvider) setFileMetadata(username string, metadata *FileMetadata) error {
+	if err := metadata.validate(); err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		usersBucket, err := p.getUsersBucket(tx)
+		if err != nil {
+			return err
+		}
+		if u := usersBucket.Get([]byte(username)); u == nil {
+			return util.NewGenericError(fmt.Sprintf("unable to validate user %q", username))
+		}
+		bucket, err := p.getFilesMetadataBucket(tx)
+		if err != nil {
+			return err
+		}
+		userBucket, err := bucket.CreateBucketIfNotExists([]byte(username))
+		if err != nil {
+			return err
+		}
+		buf, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		return userBucket.Put([]byte(metadata.Path), buf)
+	})
+}
+
+func (p *BoltProvider) deleteFilesMetadata(username, virtualPath string, recursive bool) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := p.getFilesMetadataBucket(tx)
+		if err != nil {
+			return err
+		}
+		userBucket := bucket.Bucket([]byte(username))
+		if userBucket == nil {
+			return nil
+		}
+		if !recursive {
+			return userBucket.Delete([]byte(virtualPath))
+		}
+		var toRemove [][]byte
+		cursor := userBucket.Cursor()
+		for k, _ := cursor.Seek([]byte(virtualPath)); k != nil && bytes.HasPrefix(k, []byte(virtualPath)); k, _ = cursor.Next() {
+			if isFileMetadataInPath(string(k), virtualPath) {
+				toRemove = append(toRemove, append([]byte(nil), k...))
+			}
+		}
+		for _, k := range toRemove {
+			if err := userBucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (p *BoltProvider) renameFilesMetadata(username, source, target string) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := p.getFilesMetadataBucket(tx)
+		if err != nil {
+			return err
+		}
+		userBucket := bucket.Bucket([]byte(username))
+		if userBucket == nil {
+			return nil
+		}
+		var toRemove [][]byte
+		var toRename []FileMetadata
+		err = userBucket.ForEach(func(k, v []byte) error {
+			if isFileMetadataInPath(string(k), source) {
+				var metadata FileMetadata
+				if err := json.Unmarshal(v, &metadata); err != nil {
+					return err
+				}
+				toRename = append(toRename, metadata)
+			} else if !isFileMetadataInPath(string(k), target) {
+				return nil
+			}
+			toRemove = append(toRemove, append([]byte(nil), k...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range toRemove {
+			if err := userBucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		for _, metadata := range toRename {
+			metadata.Path = getRenamedFileMetadataPath(metadata.Path, source, target)
+			metadata.UpdatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+			buf, err := json.Marshal(metadata)
+			if err != nil {
+				return err
+			}
+			if err := userBucket.Put([]byte(metadata.Path), buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (p *BoltProvider) addEventDigestEntry(entry *EventDigestEntry) error {
+	if err := entry.validate(); err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := p.getEventDigestsBucket(tx)
+		if err != nil {
+			return err
+		}
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		entry.ID = int64(id)
+		buf, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(getEventDigestEntryKey(entry.ID), buf)
+	})
+}
+
+func (p *BoltProvider) getEventDigestEntries(before int64) ([]EventDigestEntry, error) {
+	result := make([]EventDigestEntry, 0)
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := p.getEventDigestsBucket(tx)
+		if err != nil {
+			return err
+		}
+		return bucket.ForEach(func(_, v []byte) error {
+			var entry EventDigestEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			if entry.WindowEnd <= before {
+				result = append(result, entry)
+			}
+			return nil
+		})
+	})
+	return result, err
+}
+
+func (p *BoltProvider) deleteEventDigestEntries(ids []int64) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := p.getEventDigestsBucket(tx)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			key := getEventDigestEntryKey(id)
+			if bucket.Get(key) == nil {
+				return util.NewRecordNotFoundError(fmt.Sprintf("digest entry %d does not exist", id))
+			}
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (p *BoltProvider) addAuditLogEntry(entry *AuditLogEntry) error {
+	if err := entry.validate(); err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := p.getAuditLogsBucket(tx)
+		if err != nil {
+			return err
+		}
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		entry.ID = int64(id)
+		buf, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(getEventDigestEntryKey(entry.ID), buf)
+	})
+}
+
+func (p *BoltProvider) searchAuditLog(filters *AuditLogSearch) ([]AuditLogEntry, error) {
+	result := make([]AuditLogEntry, 0, filters.Limit)
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := p.getAuditLogsBucket(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		next := cursor.Prev
+		k, v := cursor.Last()
+		if filters.Order == OrderASC {
+			next = cursor.Next
+			k, v = cursor.First()
+		}
+		for ; k != nil && len(result) < filters.Limit; k, v = next() {
+			var entry AuditLogEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			if filters.match(&entry) {
+				result = append(result, filters.prepareEntry(&entry))
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (p *BoltProvider) cleanupAuditLog(before int64) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := p.getAuditLogsBucket(tx)
+		if err != nil {
+			return err
+		}
+		var toRemove [][]byte
+		err = bucket.ForEach(func(k, v []byte) error {
+			var entry AuditLogEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			if entry.Timestamp < before {
+				toRemove = append(toRemove, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range toRemove {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (p *BoltProvider) addShareEvent(event *ShareEvent) error {
+	if err := event.validate(); err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		sharesBucket, err := p.getSharesBucket(tx)
+		if err != nil {
+			return err
+		}
+		if sharesBucket.Get([]byte(event.ShareID)) == nil {
+			return util.NewRecordNotFoundError(fmt.Sprintf("share %q does not exist", event.ShareID))
+		}
+		bucket, err := p.getShareEventsBucket(tx)
+		if err != nil {
+			return err
+		}
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		event.ID = int64(id)
+		buf, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(getEventDigestEntryKey(event.ID), buf)
+	})
+}
+
+func (p *BoltProvider) getShareEvents(shareID string, from, to int64, limit int) ([]ShareEvent, error) {
+	result := make([]ShareEvent, 0)
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := p.getShareEventsBucket(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.Last(); k != nil && len(result) < limit; k, v = cursor.Prev() {
+			var event ShareEvent
+			if err := json.Unmarshal(v, &event); err != nil {
+				return err
+			}
+			if event.ShareID == shareID && event.Timestamp >= from && event.Timestamp <= to {
+				result = append(result, event)
+			}
+		}
+		return nil
+	})
+	sortShareEvents(result)
+	return result, err
+}
+
+func (p *BoltProvider) cleanupShareEvents(before int64) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := p.getShareEventsBucket(tx)
+		if err != nil {
+			return err
+		}
+		var toRemove [][]byte
+		err = bucket.ForEach(func(k, v []byte) error {
+			var event ShareEvent
+			if err := json.Unmarshal(v, &event); err != nil {
+				return err
+			}
+			if event.Timestamp < before {
+				toRemove = append(toRemove, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range toRemove {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (p *BoltProvider) setFirstDownloadTimestamp(username string) error {
 	return p.dbHandle.Update(func(tx *bolt.Tx) error {
 		bucket, err := p.getUsersBucket(tx)
@@ -3181,7 +3899,7 @@ func (p *BoltProvider) revertDatabase(targetVersion int) error { //nolint:gocycl
 					}
 				}
 			}
-			for _, b := range [][]byte{rolesBucket, configsBucket} {
+			for _, b := range [][]byte{rolesBucket, adminRolesBucket, configsBucket, filesMetaBucket} {
 				err = tx.DeleteBucket(b)
 				if err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
 					return err
@@ -3418,6 +4136,61 @@ func (p *BoltProvider) removeAdminFromRole(username, roleName string, bucket *bo
 	return nil
 }
 
+func (p *BoltProvider) addAdminToAdminRole(username, roleName string, bucket *bolt.Bucket) error {
+	if roleName == "" {
+		return nil
+	}
+	r := bucket.Get([]byte(roleName))
+	if r == nil {
+		return util.NewGenericError(fmt.Sprintf("admin role %q does not exist", roleName))
+	}
+	var role AdminRole
+	err := json.Unmarshal(r, &role)
+	if err != nil {
+		return err
+	}
+	if !util.Contains(role.Admins, username) {
+		role.Admins = append(role.Admins, username)
+		buf, err := json.Marshal(role)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(role.Name), buf)
+	}
+	return nil
+}
+
+func (p *BoltProvider) removeAdminFromAdminRole(username, roleName string, bucket *bolt.Bucket) error {
+	if roleName == "" {
+		return nil
+	}
+	r := bucket.Get([]byte(roleName))
+	if r == nil {
+		providerLog(logger.LevelWarn, "admin role %q does not exist, cannot remove admin %q", roleName, username)
+		return nil
+	}
+	var role AdminRole
+	err := json.Unmarshal(r, &role)
+	if err != nil {
+		return err
+	}
+	if util.Contains(role.Admins, username) {
+		var admins []string
+		for _, admin := range role.Admins {
+			if admin != username {
+				admins = append(admins, admin)
+			}
+		}
+		role.Admins = admins
+		buf, err := json.Marshal(role)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(role.Name), buf)
+	}
+	return nil
+}
+
 func (p *BoltProvider) addUserToRole(username, roleName string, bucket *bolt.Bucket) error {
 	if roleName == "" {
 		return nil
@@ -3664,6 +4437,7 @@ func (p *BoltProvider) addRelationToFolderMapping(baseFolder *vfs.BaseVirtualFol
 	baseFolder.UsedQuotaSize = oldFolder.UsedQuotaSize
 	baseFolder.Users = oldFolder.Users
 	baseFolder.Groups = oldFolder.Groups
+	baseFolder.Role = oldFolder.Role
 	if user != nil && !util.Contains(baseFolder.Users, user.Username) {
 		baseFolder.Users = append(baseFolder.Users, user.Username)
 	}
@@ -3806,12 +4580,44 @@ func (p *BoltProvider) deleteRelatedShares(tx *bolt.Tx, username string) error {
 		}
 	}
 
+	removed := make(map[string]bool)
 	for _, k := range toRemove {
 		if err := bucket.Delete([]byte(k)); err != nil {
 			return err
 		}
+		removed[k] = true
+	}
+	if len(removed) == 0 {
+		return nil
 	}
 
+	return p.deleteRelatedShareEvents(tx, removed)
+}
+
+func (p *BoltProvider) deleteRelatedShareEvents(tx *bolt.Tx, shareIDs map[string]bool) error {
+	bucket, err := p.getShareEventsBucket(tx)
+	if err != nil {
+		return err
+	}
+	var toRemove [][]byte
+	err = bucket.ForEach(func(k, v []byte) error {
+		var event ShareEvent
+		if err := json.Unmarshal(v, &event); err != nil {
+			return err
+		}
+		if shareIDs[event.ShareID] {
+			toRemove = append(toRemove, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range toRemove {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -3848,6 +4654,67 @@ func (p *BoltProvider) deleteRelatedAPIKey(tx *bolt.Tx, username string, scope A
 	return nil
 }
 
+func (p *BoltProvider) getFilesMetadataBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	var err error
+
+	bucket := tx.Bucket(filesMetaBucket)
+	if bucket == nil {
+		err = errors.New("unable to find files metadata bucket, bolt database structure not correcly defined")
+	}
+	return bucket, err
+}
+
+func (p *BoltProvider) getEventDigestsBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	var err error
+
+	bucket := tx.Bucket(digestsBucket)
+	if bucket == nil {
+		err = errors.New("unable to find events digests bucket, bolt database structure not correcly defined")
+	}
+	return bucket, err
+}
+
+func (p *BoltProvider) getAuditLogsBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	var err error
+
+	bucket := tx.Bucket(auditLogsBucket)
+	if bucket == nil {
+		err = errors.New("unable to find audit logs bucket, bolt database structure not correcly defined")
+	}
+	return bucket, err
+}
+
+func (p *BoltProvider) getSessionsBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	var err error
+
+	bucket := tx.Bucket(sessionsBucket)
+	if bucket == nil {
+		err = errors.New("unable to find shared sessions bucket, bolt database structure not correcly defined")
+	}
+	return bucket, err
+}
+
+func (p *BoltProvider) getShareEventsBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	var err error
+
+	bucket := tx.Bucket(shareEvsBucket)
+	if bucket == nil {
+		err = errors.New("unable to find share events bucket, bolt database structure not correcly defined")
+	}
+	return bucket, err
+}
+
+func (p *BoltProvider) deleteRelatedFilesMetadata(tx *bolt.Tx, username string) error {
+	bucket, err := p.getFilesMetadataBucket(tx)
+	if err != nil {
+		return err
+	}
+	if bucket.Bucket([]byte(username)) == nil {
+		return nil
+	}
+	return bucket.DeleteBucket([]byte(username))
+}
+
 func (p *BoltProvider) getSharesBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
 	var err error
 
@@ -3905,6 +4772,15 @@ func (p *BoltProvider) getRolesBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
 	return bucket, err
 }
 
+func (p *BoltProvider) getAdminRolesBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(adminRolesBucket)
+	if bucket == nil {
+		err = fmt.Errorf("unable to find admin roles bucket, bolt database structure not correcly defined")
+	}
+	return bucket, err
+}
+
 func (p *BoltProvider) getIPListsBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
 	var err error
 	bucket := tx.Bucket(rolesBucket)
@@ -3977,3 +4853,11 @@ func updateBoltDatabaseVersion(dbHandle *bolt.DB, version int) error {
 	})
 	return err
 }
+
+// getEventDigestEntryKey returns a key that preserves the insertion order,
+// it is used for audit log entries too
+func getEventDigestEntryKey(id int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
@@ -0,0 +1,380 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/sftpgo/sdk"
+
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+// Supported bulk update actions
+const (
+	BulkActionUpdate = "update"
+	BulkActionError  = "error"
+)
+
+const (
+	bulkPageSize = 100
+)
+
+// BulkFilter defines the objects to update. All the defined conditions must match
+type BulkFilter struct {
+	// Names of the objects to update
+	Names []string `json:"names,omitempty"`
+	// Shell pattern matched against the object name, for example "customer_*"
+	Pattern string `json:"pattern,omitempty"`
+	// Users only, match the users that are members of at least one of these groups
+	Groups []string `json:"groups,omitempty"`
+	// Users only, match the users with this status
+	Status *int `json:"status,omitempty"`
+}
+
+func (f *BulkFilter) validate(isUser bool) error {
+	if len(f.Names) == 0 && f.Pattern == "" && len(f.Groups) == 0 && f.Status == nil {
+		return util.NewValidationError("at least a filter condition is required")
+	}
+	if f.Pattern != "" {
+		if _, err := path.Match(f.Pattern, ""); err != nil {
+			return util.NewValidationError(fmt.Sprintf("invalid pattern %q: %v", f.Pattern, err))
+		}
+	}
+	if !isUser && (len(f.Groups) > 0 || f.Status != nil) {
+		return util.NewValidationError("groups and status filters are only supported for users")
+	}
+	for idx := range f.Names {
+		f.Names[idx] = config.convertName(f.Names[idx])
+	}
+	f.Names = util.RemoveDuplicates(f.Names, false)
+	return nil
+}
+
+func (f *BulkFilter) matchName(name string) bool {
+	if len(f.Names) > 0 && !util.Contains(f.Names, name) {
+		return false
+	}
+	if f.Pattern != "" {
+		if matched, _ := path.Match(f.Pattern, name); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *BulkFilter) matchUser(user *User) bool {
+	if !f.matchName(user.Username) {
+		return false
+	}
+	if f.Status != nil && user.Status != *f.Status {
+		return false
+	}
+	if len(f.Groups) > 0 && !IsUserInAdminScope(user, f.Groups) {
+		return false
+	}
+	return true
+}
+
+// UserBulkUpdate defines the changes to apply to the matching users,
+// only the defined fields are updated
+type UserBulkUpdate struct {
+	Status            *int    `json:"status,omitempty"`
+	ExpirationDate    *int64  `json:"expiration_date,omitempty"`
+	QuotaSize         *int64  `json:"quota_size,omitempty"`
+	QuotaFiles        *int    `json:"quota_files,omitempty"`
+	MaxSessions       *int    `json:"max_sessions,omitempty"`
+	UploadBandwidth   *int64  `json:"upload_bandwidth,omitempty"`
+	DownloadBandwidth *int64  `json:"download_bandwidth,omitempty"`
+	Description       *string `json:"description,omitempty"`
+	// Groups to add, an added primary group replaces the existing one
+	AddGroups []sdk.GroupMapping `json:"add_groups,omitempty"`
+	// Names of the groups to remove
+	RemoveGroups []string `json:"remove_groups,omitempty"`
+}
+
+func (u *UserBulkUpdate) isEmpty() bool {
+	return u.Status == nil && u.ExpirationDate == nil && u.QuotaSize == nil && u.QuotaFiles == nil &&
+		u.MaxSessions == nil && u.UploadBandwidth == nil && u.DownloadBandwidth == nil && u.Description == nil &&
+		len(u.AddGroups) == 0 && len(u.RemoveGroups) == 0
+}
+
+func (u *UserBulkUpdate) apply(user *User) {
+	if u.Status != nil {
+		user.Status = *u.Status
+	}
+	if u.ExpirationDate != nil {
+		user.ExpirationDate = *u.ExpirationDate
+	}
+	if u.QuotaSize != nil {
+		user.QuotaSize = *u.QuotaSize
+	}
+	if u.QuotaFiles != nil {
+		user.QuotaFiles = *u.QuotaFiles
+	}
+	if u.MaxSessions != nil {
+		user.MaxSessions = *u.MaxSessions
+	}
+	if u.UploadBandwidth != nil {
+		user.UploadBandwidth = *u.UploadBandwidth
+	}
+	if u.DownloadBandwidth != nil {
+		user.DownloadBandwidth = *u.DownloadBandwidth
+	}
+	if u.Description != nil {
+		user.Description = *u.Description
+	}
+	var groups []sdk.GroupMapping
+	for _, g := range user.Groups {
+		if util.Contains(u.RemoveGroups, g.Name) {
+			continue
+		}
+		replaced := false
+		for _, added := range u.AddGroups {
+			if added.Name == g.Name || (added.Type == sdk.GroupTypePrimary && g.Type == sdk.GroupTypePrimary) {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			groups = append(groups, g)
+		}
+	}
+	user.Groups = append(groups, u.AddGroups...)
+}
+
+// UserBulkRequest defines a bulk update for users
+type UserBulkRequest struct {
+	Filter BulkFilter     `json:"filter"`
+	Update UserBulkUpdate `json:"update"`
+	// If true the matching users are validated but not saved
+	DryRun bool `json:"dry_run"`
+}
+
+func (r *UserBulkRequest) validate() error {
+	if err := r.Filter.validate(true); err != nil {
+		return err
+	}
+	if r.Update.isEmpty() {
+		return util.NewValidationError("nothing to update")
+	}
+	return nil
+}
+
+// FolderBulkUpdate defines the changes to apply to the matching folders,
+// only the defined fields are updated
+type FolderBulkUpdate struct {
+	Description *string `json:"description,omitempty"`
+	// Limits shared by all the transfers inside the folder, they replace the existing ones
+	Limits *vfs.FolderLimits `json:"limits,omitempty"`
+}
+
+func (u *FolderBulkUpdate) apply(folder *vfs.BaseVirtualFolder) {
+	if u.Description != nil {
+		folder.Description = *u.Description
+	}
+	if u.Limits != nil {
+		folder.Limits = u.Limits.GetACopy()
+	}
+}
+
+// FolderBulkRequest defines a bulk update for virtual folders
+type FolderBulkRequest struct {
+	Filter BulkFilter       `json:"filter"`
+	Update FolderBulkUpdate `json:"update"`
+	// If true the matching folders are validated but not saved
+	DryRun bool `json:"dry_run"`
+}
+
+func (r *FolderBulkRequest) validate() error {
+	if err := r.Filter.validate(false); err != nil {
+		return err
+	}
+	if r.Update.Description == nil && r.Update.Limits == nil {
+		return util.NewValidationError("nothing to update")
+	}
+	return nil
+}
+
+// BulkResult defines the result for a single object
+type BulkResult struct {
+	Name string `json:"name"`
+	// update, error
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BulkReport defines the result of a bulk update
+type BulkReport struct {
+	DryRun  bool         `json:"dry_run"`
+	Matched int          `json:"matched"`
+	Updated int          `json:"updated"`
+	Errors  int          `json:"errors"`
+	Results []BulkResult `json:"results"`
+}
+
+func (r *BulkReport) addResult(name string, err error) {
+	r.Matched++
+	result := BulkResult{
+		Name:   name,
+		Action: BulkActionUpdate,
+	}
+	if err != nil {
+		result.Action = BulkActionError
+		result.Error = err.Error()
+		r.Errors++
+	} else {
+		r.Updated++
+	}
+	r.Results = append(r.Results, result)
+}
+
+// getBulkUsers returns the users matching the specified filter and visible to
+// an admin with the specified role and groups scope
+func getBulkUsers(filter *BulkFilter, role string, scopeGroups []string, report *BulkReport) ([]User, error) {
+	var users []User
+	if len(filter.Names) > 0 {
+		for _, name := range filter.Names {
+			user, err := UserExists(name, role)
+			if err == nil && !IsUserInAdminScope(&user, scopeGroups) {
+				err = util.NewRecordNotFoundError(fmt.Sprintf("username %q does not exist", name))
+			}
+			if err != nil {
+				report.addResult(name, err)
+				continue
+			}
+			if filter.matchUser(&user) {
+				users = append(users, user)
+			}
+		}
+		return users, nil
+	}
+	for offset := 0; ; offset += bulkPageSize {
+		page, err := provider.getUsers(bulkPageSize, offset, OrderASC, role)
+		if err != nil {
+			return nil, err
+		}
+		for idx := range page {
+			if filter.matchUser(&page[idx]) && IsUserInAdminScope(&page[idx], scopeGroups) {
+				users = append(users, page[idx])
+			}
+		}
+		if len(page) < bulkPageSize {
+			return users, nil
+		}
+	}
+}
+
+// BulkUpdateUsers applies the specified changes to all the matching users.
+// The update is not stopped if a user cannot be saved, the report contains the
+// result for each user. If scopeGroups is not empty only the users that are
+// members of at least one of these groups are updated and they must remain
+// members after the update
+func BulkUpdateUsers(req *UserBulkRequest, executor, ipAddress, role string, scopeGroups []string) (BulkReport, error) {
+	report := BulkReport{
+		DryRun:  req.DryRun,
+		Results: []BulkResult{},
+	}
+	if err := req.validate(); err != nil {
+		return report, err
+	}
+	users, err := getBulkUsers(&req.Filter, role, scopeGroups, &report)
+	if err != nil {
+		return report, err
+	}
+	for idx := range users {
+		user := &users[idx]
+		req.Update.apply(user)
+		if !IsUserInAdminScope(user, scopeGroups) {
+			report.addResult(user.Username, util.NewValidationError("the user must remain a member of the groups in the admin scope"))
+			continue
+		}
+		if req.DryRun {
+			userCopy := user.getACopy()
+			err = ValidateUser(&userCopy)
+		} else {
+			err = UpdateUser(user, executor, ipAddress, role)
+		}
+		report.addResult(user.Username, err)
+	}
+	return report, nil
+}
+
+func getBulkFolders(filter *BulkFilter, role string, report *BulkReport) ([]vfs.BaseVirtualFolder, error) {
+	var names []string
+	if len(filter.Names) > 0 {
+		names = filter.Names
+	} else {
+		for offset := 0; ; offset += bulkPageSize {
+			page, err := provider.getFolders(bulkPageSize, offset, OrderASC, true, role)
+			if err != nil {
+				return nil, err
+			}
+			for idx := range page {
+				names = append(names, page[idx].Name)
+			}
+			if len(page) < bulkPageSize {
+				break
+			}
+		}
+	}
+	var folders []vfs.BaseVirtualFolder
+	for _, name := range names {
+		if !filter.matchName(name) {
+			continue
+		}
+		folder, err := provider.getFolderByName(name)
+		if err == nil && role != "" && folder.Role != role {
+			err = util.NewRecordNotFoundError(fmt.Sprintf("folder %q does not exist", name))
+		}
+		if err != nil {
+			report.addResult(name, err)
+			continue
+		}
+		folders = append(folders, folder)
+	}
+	return folders, nil
+}
+
+// BulkUpdateFolders applies the specified changes to all the matching virtual folders.
+// The update is not stopped if a folder cannot be saved, the report contains the
+// result for each folder
+func BulkUpdateFolders(req *FolderBulkRequest, executor, ipAddress, role string) (BulkReport, error) {
+	report := BulkReport{
+		DryRun:  req.DryRun,
+		Results: []BulkResult{},
+	}
+	if err := req.validate(); err != nil {
+		return report, err
+	}
+	folders, err := getBulkFolders(&req.Filter, role, &report)
+	if err != nil {
+		return report, err
+	}
+	for idx := range folders {
+		folder := &folders[idx]
+		req.Update.apply(folder)
+		if req.DryRun {
+			folderCopy := folder.GetACopy()
+			err = ValidateFolder(&folderCopy)
+		} else {
+			err = UpdateFolder(folder, folder.Users, folder.Groups, executor, ipAddress, role)
+		}
+		report.addResult(folder.Name, err)
+	}
+	return report, nil
+}
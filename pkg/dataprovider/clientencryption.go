@@ -0,0 +1,56 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+func validateClientEncryptedFolders(user *User) error {
+	var folders []string
+	for _, folder := range user.Filters.ClientEncryptedFolders {
+		folder = strings.TrimSpace(folder)
+		if folder == "" {
+			continue
+		}
+		if !path.IsAbs(folder) {
+			return util.NewValidationError(fmt.Sprintf("invalid client encrypted folder %q, it must be an absolute path", folder))
+		}
+		folder = util.CleanPath(folder)
+		for _, f := range folders {
+			if util.IsDirOverlapped(f, folder, true, "/") {
+				return util.NewValidationError(fmt.Sprintf("client encrypted folder %q overlaps with %q", folder, f))
+			}
+		}
+		folders = append(folders, folder)
+	}
+	user.Filters.ClientEncryptedFolders = folders
+	return nil
+}
+
+// GetClientEncryptedFolder returns the client side encrypted folder that includes
+// the specified virtual path, an empty string means that the path is not encrypted
+func (u *User) GetClientEncryptedFolder(virtualPath string) string {
+	for _, folder := range u.Filters.ClientEncryptedFolders {
+		if folder == "/" || virtualPath == folder || strings.HasPrefix(virtualPath, folder+"/") {
+			return folder
+		}
+	}
+	return ""
+}
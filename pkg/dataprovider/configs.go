@@ -41,6 +41,7 @@ var (
 		"hmac-sha2-512-etm@openssh.com", "hmac-sha2-512",
 		"hmac-sha1", "hmac-sha1-96",
 	}
+	supportedSecurityProfiles = []string{"modern", "intermediate", "legacy"}
 )
 
 // SFTPDConfigs defines configurations for SFTPD
@@ -50,6 +51,11 @@ type SFTPDConfigs struct {
 	KexAlgorithms []string `json:"kex_algorithms,omitempty"`
 	Ciphers       []string `json:"ciphers,omitempty"`
 	MACs          []string `json:"macs,omitempty"`
+	// SecurityProfile selects a named set of KEX algorithms, ciphers and MACs,
+	// it overrides the one defined in the configuration file
+	SecurityProfile string `json:"security_profile,omitempty"`
+	// Host keys managed using the REST API or the WebAdmin
+	HostKeys []SSHHostKey `json:"host_keys,omitempty"`
 }
 
 func (c *SFTPDConfigs) isEmpty() bool {
@@ -68,6 +74,12 @@ func (c *SFTPDConfigs) isEmpty() bool {
 	if len(c.MACs) > 0 {
 		return false
 	}
+	if len(c.HostKeys) > 0 {
+		return false
+	}
+	if c.SecurityProfile != "" {
+		return false
+	}
 	return true
 }
 
@@ -91,6 +103,11 @@ func (*SFTPDConfigs) GetSupportedMACs() []string {
 	return supportedMACs
 }
 
+// GetSupportedSecurityProfiles returns the supported security profiles
+func (*SFTPDConfigs) GetSupportedSecurityProfiles() []string {
+	return supportedSecurityProfiles
+}
+
 // GetModuliAsString returns moduli files as comma separated string
 func (c *SFTPDConfigs) GetModuliAsString() string {
 	return strings.Join(c.Moduli, ",")
@@ -129,9 +146,31 @@ func (c *SFTPDConfigs) validate() error {
 			return util.NewValidationError(fmt.Sprintf("unsupported MAC algorithm %q", mac))
 		}
 	}
+	if c.SecurityProfile != "" && !util.Contains(supportedSecurityProfiles, c.SecurityProfile) {
+		return util.NewValidationError(fmt.Sprintf("unsupported security profile %q", c.SecurityProfile))
+	}
+	return validateSSHHostKeys(c.HostKeys)
+}
+
+// TryDecrypt tries to decrypt the host keys
+func (c *SFTPDConfigs) TryDecrypt() error {
+	for idx := range c.HostKeys {
+		k := &c.HostKeys[idx]
+		if err := k.PrivateKey.TryDecrypt(); err != nil {
+			return fmt.Errorf("unable to decrypt host key %q: %w", k.ID, err)
+		}
+	}
 	return nil
 }
 
+func (c *SFTPDConfigs) hideConfidentialData() {
+	for idx := range c.HostKeys {
+		if c.HostKeys[idx].PrivateKey != nil {
+			c.HostKeys[idx].PrivateKey.Hide()
+		}
+	}
+}
+
 func (c *SFTPDConfigs) getACopy() *SFTPDConfigs {
 	hostKeys := make([]string, len(c.HostKeyAlgos))
 	copy(hostKeys, c.HostKeyAlgos)
@@ -143,13 +182,19 @@ func (c *SFTPDConfigs) getACopy() *SFTPDConfigs {
 	copy(ciphers, c.Ciphers)
 	macs := make([]string, len(c.MACs))
 	copy(macs, c.MACs)
+	var managedKeys []SSHHostKey
+	for idx := range c.HostKeys {
+		managedKeys = append(managedKeys, c.HostKeys[idx].getACopy())
+	}
 
 	return &SFTPDConfigs{
-		HostKeyAlgos:  hostKeys,
-		Moduli:        moduli,
-		KexAlgorithms: kexs,
-		Ciphers:       ciphers,
-		MACs:          macs,
+		HostKeyAlgos:    hostKeys,
+		Moduli:          moduli,
+		KexAlgorithms:   kexs,
+		Ciphers:         ciphers,
+		MACs:            macs,
+		SecurityProfile: c.SecurityProfile,
+		HostKeys:        managedKeys,
 	}
 }
 
@@ -288,6 +333,27 @@ func (c *SMTPConfigs) TryDecrypt() error {
 	return nil
 }
 
+func (c *SMTPConfigs) hideConfidentialData() {
+	if c.Password != nil {
+		c.Password.Hide()
+		if c.Password.IsEmpty() {
+			c.Password = nil
+		}
+	}
+	if c.OAuth2.ClientSecret != nil {
+		c.OAuth2.ClientSecret.Hide()
+		if c.OAuth2.ClientSecret.IsEmpty() {
+			c.OAuth2.ClientSecret = nil
+		}
+	}
+	if c.OAuth2.RefreshToken != nil {
+		c.OAuth2.RefreshToken.Hide()
+		if c.OAuth2.RefreshToken.IsEmpty() {
+			c.OAuth2.RefreshToken = nil
+		}
+	}
+}
+
 func (c *SMTPConfigs) getACopy() *SMTPConfigs {
 	var password *kms.Secret
 	if c.Password != nil {
@@ -370,10 +436,16 @@ func (c *ACMEConfigs) getACopy() *ACMEConfigs {
 // Configs allows to set configuration keys disabled by default without
 // modifying the config file or setting env vars
 type Configs struct {
-	SFTPD     *SFTPDConfigs `json:"sftpd,omitempty"`
-	SMTP      *SMTPConfigs  `json:"smtp,omitempty"`
-	ACME      *ACMEConfigs  `json:"acme,omitempty"`
-	UpdatedAt int64         `json:"updated_at,omitempty"`
+	SFTPD *SFTPDConfigs `json:"sftpd,omitempty"`
+	SMTP  *SMTPConfigs  `json:"smtp,omitempty"`
+	ACME  *ACMEConfigs  `json:"acme,omitempty"`
+	// UsernameAliases maps login names to usernames, aliases are case insensitive
+	UsernameAliases map[string]string `json:"username_aliases,omitempty"`
+	// Data retention checks executed on a schedule
+	RetentionPolicies []RetentionPolicy `json:"retention_policies,omitempty"`
+	// Named templates to provision users
+	UserTemplates []UserTemplate `json:"user_templates,omitempty"`
+	UpdatedAt     int64          `json:"updated_at,omitempty"`
 }
 
 func (c *Configs) validate() error {
@@ -392,7 +464,15 @@ func (c *Configs) validate() error {
 			return err
 		}
 	}
-	return nil
+	aliases, err := validateUsernameAliases(c.UsernameAliases)
+	if err != nil {
+		return err
+	}
+	c.UsernameAliases = aliases
+	if err := validateRetentionPolicies(c.RetentionPolicies); err != nil {
+		return err
+	}
+	return validateUserTemplates(c.UserTemplates)
 }
 
 // PrepareForRendering prepares configs for rendering.
@@ -409,24 +489,13 @@ func (c *Configs) PrepareForRendering() {
 		c.ACME = nil
 	}
 	if c.SMTP != nil {
-		if c.SMTP.Password != nil {
-			c.SMTP.Password.Hide()
-			if c.SMTP.Password.IsEmpty() {
-				c.SMTP.Password = nil
-			}
-		}
-		if c.SMTP.OAuth2.ClientSecret != nil {
-			c.SMTP.OAuth2.ClientSecret.Hide()
-			if c.SMTP.OAuth2.ClientSecret.IsEmpty() {
-				c.SMTP.OAuth2.ClientSecret = nil
-			}
-		}
-		if c.SMTP.OAuth2.RefreshToken != nil {
-			c.SMTP.OAuth2.RefreshToken.Hide()
-			if c.SMTP.OAuth2.RefreshToken.IsEmpty() {
-				c.SMTP.OAuth2.RefreshToken = nil
-			}
-		}
+		c.SMTP.hideConfidentialData()
+	}
+	if c.SFTPD != nil {
+		c.SFTPD.hideConfidentialData()
+	}
+	for idx := range c.UserTemplates {
+		c.UserTemplates[idx].PrepareForRendering()
 	}
 }
 
@@ -478,6 +547,18 @@ func (c *Configs) getACopy() Configs {
 	if c.ACME != nil {
 		result.ACME = c.ACME.getACopy()
 	}
+	if len(c.UsernameAliases) > 0 {
+		result.UsernameAliases = make(map[string]string)
+		for k, v := range c.UsernameAliases {
+			result.UsernameAliases[k] = v
+		}
+	}
+	for idx := range c.RetentionPolicies {
+		result.RetentionPolicies = append(result.RetentionPolicies, c.RetentionPolicies[idx].getACopy())
+	}
+	for idx := range c.UserTemplates {
+		result.UserTemplates = append(result.UserTemplates, c.UserTemplates[idx].getACopy())
+	}
 	result.UpdatedAt = c.UpdatedAt
 	return result
 }
@@ -0,0 +1,227 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/plugin"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	configSnapshotPrefix = "snapshot_"
+)
+
+var (
+	// ConfigSnapshotObjectTypes defines the object types for which configuration
+	// snapshots are recorded
+	ConfigSnapshotObjectTypes = []string{actionObjectUser, actionObjectFolder, actionObjectGroup, actionObjectEventRule}
+)
+
+// ConfigSnapshotsConfig defines the configuration for the point-in-time
+// snapshots of users, folders, groups and event rules
+type ConfigSnapshotsConfig struct {
+	// Set to true to record a snapshot of the affected object for each
+	// add, update and delete
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// Number of days to keep the snapshots, older snapshots are periodically removed
+	Retention int `json:"retention" mapstructure:"retention"`
+}
+
+func (c *ConfigSnapshotsConfig) validate() error {
+	if c.Enabled && c.Retention < 1 {
+		return fmt.Errorf("invalid snapshots retention: %d", c.Retention)
+	}
+	return nil
+}
+
+// ConfigSnapshot defines the state of an object after an add, update or delete.
+// For delete actions the object is the last state before the deletion
+type ConfigSnapshot struct {
+	ID string `json:"id"`
+	// Unix timestamp in milliseconds
+	Timestamp int64 `json:"timestamp"`
+	// add, update, delete
+	Action     string `json:"action"`
+	Executor   string `json:"executor"`
+	IP         string `json:"ip,omitempty"`
+	Role       string `json:"role,omitempty"`
+	ObjectType string `json:"object_type"`
+	ObjectName string `json:"object_name"`
+	// Object as stored within the data provider, using the same format as the backups
+	Object json.RawMessage `json:"object,omitempty"`
+}
+
+// IsDelete returns true if the snapshot was recorded for a delete action
+func (s *ConfigSnapshot) IsDelete() bool {
+	return s.Action == operationDelete
+}
+
+func (s *ConfigSnapshot) isBefore(other *ConfigSnapshot) bool {
+	if s.Timestamp == other.Timestamp {
+		return s.ID < other.ID
+	}
+	return s.Timestamp < other.Timestamp
+}
+
+func isConfigSnapshotRequired(objectType string) bool {
+	return config.Snapshots.Enabled && util.Contains(ConfigSnapshotObjectTypes, objectType)
+}
+
+// getConfigSnapshotObject returns the object, as stored within the data provider,
+// to save within the snapshot
+func getConfigSnapshotObject(operation, objectType, objectName string, object plugin.Renderer) (any, error) {
+	if operation == operationDelete {
+		if folder, ok := object.(*wrappedFolder); ok {
+			return folder.Folder, nil
+		}
+		return object, nil
+	}
+	switch objectType {
+	case actionObjectUser:
+		return provider.userExists(objectName, "")
+	case actionObjectFolder:
+		return provider.getFolderByName(objectName)
+	case actionObjectGroup:
+		return provider.groupExists(objectName)
+	case actionObjectEventRule:
+		return provider.eventRuleExists(objectName)
+	default:
+		return nil, fmt.Errorf("unsupported snapshot object type %q", objectType)
+	}
+}
+
+func addConfigSnapshot(operation, executor, ip, objectType, objectName, role string, object plugin.Renderer) {
+	if !isConfigSnapshotRequired(objectType) {
+		return
+	}
+	obj, err := getConfigSnapshotObject(operation, objectType, objectName, object)
+	if err != nil {
+		providerLog(logger.LevelError, "unable to get snapshot object, type %q, name %q: %v", objectType, objectName, err)
+		return
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		providerLog(logger.LevelError, "unable to serialize snapshot object, type %q, name %q: %v",
+			objectType, objectName, err)
+		return
+	}
+	if executor == ActionExecutorSelf {
+		executor = objectName
+	}
+	now := time.Now()
+	snapshot := ConfigSnapshot{
+		ID:         xid.New().String(),
+		Timestamp:  util.GetTimeAsMsSinceEpoch(now),
+		Action:     operation,
+		Executor:   executor,
+		IP:         ip,
+		Role:       role,
+		ObjectType: objectType,
+		ObjectName: objectName,
+		Object:     data,
+	}
+	expiration := now.Add(time.Duration(config.Snapshots.Retention) * 24 * time.Hour)
+	err = provider.addSharedSession(Session{
+		Key:       configSnapshotPrefix + snapshot.ID,
+		Data:      snapshot,
+		Type:      SessionTypeConfigSnapshot,
+		Timestamp: util.GetTimeAsMsSinceEpoch(expiration),
+	})
+	if err != nil {
+		providerLog(logger.LevelError, "unable to add snapshot, action %q, object type %q, name %q: %v",
+			operation, objectType, objectName, err)
+	}
+}
+
+func decodeConfigSnapshot(session *Session) (ConfigSnapshot, error) {
+	var snapshot ConfigSnapshot
+	data, ok := session.Data.([]byte)
+	if !ok {
+		return snapshot, fmt.Errorf("invalid snapshot data type %T", session.Data)
+	}
+	err := json.Unmarshal(data, &snapshot)
+	return snapshot, err
+}
+
+// IsConfigSnapshotsEnabled returns true if the configuration snapshots are enabled
+func IsConfigSnapshotsEnabled() bool {
+	return config.Snapshots.Enabled
+}
+
+// GetConfigSnapshots returns the snapshots for the specified object, the most
+// recent first
+func GetConfigSnapshots(objectType, objectName string) ([]ConfigSnapshot, error) {
+	if !util.Contains(ConfigSnapshotObjectTypes, objectType) {
+		return nil, util.NewValidationError(fmt.Sprintf("invalid snapshot object type: %q", objectType))
+	}
+	objectName = config.convertName(objectName)
+	sessions, err := provider.getSharedSessions(SessionTypeConfigSnapshot, util.GetTimeAsMsSinceEpoch(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []ConfigSnapshot
+	for idx := range sessions {
+		snapshot, err := decodeConfigSnapshot(&sessions[idx])
+		if err != nil {
+			providerLog(logger.LevelWarn, "unable to decode snapshot %q: %v", sessions[idx].Key, err)
+			continue
+		}
+		if snapshot.ObjectType == objectType && snapshot.ObjectName == objectName {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[j].isBefore(&snapshots[i])
+	})
+	return snapshots, nil
+}
+
+// GetConfigSnapshot returns the snapshot with the specified id
+func GetConfigSnapshot(id string) (ConfigSnapshot, error) {
+	session, err := provider.getSharedSession(configSnapshotPrefix + id)
+	if err != nil || session.Type != SessionTypeConfigSnapshot {
+		return ConfigSnapshot{}, util.NewRecordNotFoundError(fmt.Sprintf("snapshot %q does not exist", id))
+	}
+	return decodeConfigSnapshot(&session)
+}
+
+// GetConfigSnapshotAt returns the most recent snapshot for the specified object
+// recorded at or before the specified time
+func GetConfigSnapshotAt(objectType, objectName string, asOf time.Time) (ConfigSnapshot, error) {
+	snapshots, err := GetConfigSnapshots(objectType, objectName)
+	if err != nil {
+		return ConfigSnapshot{}, err
+	}
+	ts := util.GetTimeAsMsSinceEpoch(asOf)
+	for _, snapshot := range snapshots {
+		if snapshot.Timestamp <= ts {
+			return snapshot, nil
+		}
+	}
+	return ConfigSnapshot{}, util.NewRecordNotFoundError(fmt.Sprintf("no snapshot for %s %q at %s",
+		objectType, objectName, asOf.UTC().Format(time.RFC3339)))
+}
+
+func checkConfigSnapshotsRetention() {
+	CleanupSharedSessions(SessionTypeConfigSnapshot, time.Now()) //nolint:errcheck
+}
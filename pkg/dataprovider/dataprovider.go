@@ -58,16 +58,20 @@ import (
 	"github.com/rs/xid"
 	"github.com/sftpgo/sdk"
 	passwordvalidator "github.com/wagslane/go-password-validator"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/pbkdf2"
 	"golang.org/x/crypto/ssh"
 
 	"github.com/drakkan/sftpgo/v2/pkg/command"
+	"github.com/drakkan/sftpgo/v2/pkg/geoip"
 	"github.com/drakkan/sftpgo/v2/pkg/httpclient"
 	"github.com/drakkan/sftpgo/v2/pkg/kms"
 	"github.com/drakkan/sftpgo/v2/pkg/logger"
 	"github.com/drakkan/sftpgo/v2/pkg/mfa"
 	"github.com/drakkan/sftpgo/v2/pkg/plugin"
+	"github.com/drakkan/sftpgo/v2/pkg/tracing"
 	"github.com/drakkan/sftpgo/v2/pkg/util"
 	"github.com/drakkan/sftpgo/v2/pkg/vfs"
 )
@@ -85,6 +89,8 @@ const (
 	MemoryDataProviderName = "memory"
 	// CockroachDataProviderName defines the for CockroachDB provider
 	CockroachDataProviderName = "cockroachdb"
+	// EtcdDataProviderName defines the name for etcd provider
+	EtcdDataProviderName = "etcd"
 	// DumpVersion defines the version for the dump.
 	// For restore/load we support the current version and the previous one
 	DumpVersion = 16
@@ -134,23 +140,26 @@ const (
 
 // Dump scopes
 const (
-	DumpScopeUsers   = "users"
-	DumpScopeFolders = "folders"
-	DumpScopeGroups  = "groups"
-	DumpScopeAdmins  = "admins"
-	DumpScopeAPIKeys = "api_keys"
-	DumpScopeShares  = "shares"
-	DumpScopeActions = "actions"
-	DumpScopeRules   = "rules"
-	DumpScopeRoles   = "roles"
-	DumpScopeIPLists = "ip_lists"
-	DumpScopeConfigs = "configs"
+	DumpScopeUsers      = "users"
+	DumpScopeFolders    = "folders"
+	DumpScopeGroups     = "groups"
+	DumpScopeAdmins     = "admins"
+	DumpScopeAPIKeys    = "api_keys"
+	DumpScopeShares     = "shares"
+	DumpScopeActions    = "actions"
+	DumpScopeRules      = "rules"
+	DumpScopeRoles      = "roles"
+	DumpScopeAdminRoles = "admin_roles"
+	DumpScopeIPLists    = "ip_lists"
+	DumpScopeConfigs    = "configs"
 )
 
 var (
+	// password for new connections to SQL based data providers
+	providerPassword atomic.Pointer[string]
 	// SupportedProviders defines the supported data providers
 	SupportedProviders = []string{SQLiteDataProviderName, PGSQLDataProviderName, MySQLDataProviderName,
-		BoltDataProviderName, MemoryDataProviderName, CockroachDataProviderName}
+		BoltDataProviderName, MemoryDataProviderName, CockroachDataProviderName, EtcdDataProviderName}
 	// ValidPerms defines all the valid permissions for a user
 	ValidPerms = []string{PermAny, PermListItems, PermDownload, PermUpload, PermOverwrite, PermCreateDirs, PermRename,
 		PermRenameFiles, PermRenameDirs, PermDelete, PermDeleteFiles, PermDeleteDirs, PermCreateSymlinks, PermChmod,
@@ -176,7 +185,7 @@ var (
 	// ErrLoginNotAllowedFromIP defines the error to return if login is denied from the current IP
 	ErrLoginNotAllowedFromIP = errors.New("login is not allowed from this IP")
 	isAdminCreated           atomic.Bool
-	validTLSUsernames        = []string{string(sdk.TLSUsernameNone), string(sdk.TLSUsernameCN)}
+	validTLSUsernames        = []string{string(sdk.TLSUsernameNone), string(sdk.TLSUsernameCN), string(TLSUsernameSAN)}
 	config                   Config
 	provider                 Provider
 	sqlPlaceholders          []string
@@ -189,7 +198,7 @@ var (
 	unixPwdPrefixes         = []string{md5cryptPwdPrefix, md5cryptApr1PwdPrefix, sha256cryptPwdPrefix, sha512cryptPwdPrefix,
 		yescryptPwdPrefix}
 	digestPwdPrefixes            = []string{md5DigestPwdPrefix, sha256DigestPwdPrefix, sha512DigestPwdPrefix}
-	sharedProviders              = []string{PGSQLDataProviderName, MySQLDataProviderName, CockroachDataProviderName}
+	sharedProviders              = []string{PGSQLDataProviderName, MySQLDataProviderName, CockroachDataProviderName, EtcdDataProviderName}
 	logSender                    = "dataprovider"
 	sqlTableUsers                string
 	sqlTableFolders              string
@@ -211,8 +220,13 @@ var (
 	sqlTableTasks                string
 	sqlTableNodes                string
 	sqlTableRoles                string
+	sqlTableAdminRoles           string
 	sqlTableIPLists              string
 	sqlTableConfigs              string
+	sqlTableFilesMetadata        string
+	sqlTableEventsDigests        string
+	sqlTableAuditLogs            string
+	sqlTableShareEvents          string
 	sqlTableSchemaVersion        string
 	argon2Params                 *argon2id.Params
 	lastLoginMinDelay            = 10 * time.Minute
@@ -245,8 +259,13 @@ func initSQLTables() {
 	sqlTableTasks = "tasks"
 	sqlTableNodes = "nodes"
 	sqlTableRoles = "roles"
+	sqlTableAdminRoles = "admin_roles"
 	sqlTableIPLists = "ip_lists"
 	sqlTableConfigs = "configurations"
+	sqlTableFilesMetadata = "files_metadata"
+	sqlTableEventsDigests = "events_digests"
+	sqlTableAuditLogs = "audit_logs"
+	sqlTableShareEvents = "share_events"
 	sqlTableSchemaVersion = "schema_version"
 }
 
@@ -256,8 +275,10 @@ type FnReloadRules func()
 // FnRemoveRule defines the callback to remove an event rule
 type FnRemoveRule func(name string)
 
-// FnHandleRuleForProviderEvent define the callback to handle event rules for provider events
-type FnHandleRuleForProviderEvent func(operation, executor, ip, objectType, objectName, role string, object plugin.Renderer)
+// FnHandleRuleForProviderEvent define the callback to handle event rules for provider events.
+// The context carries the correlation ID for the change, if any
+type FnHandleRuleForProviderEvent func(ctx context.Context, operation, executor, ip, objectType, objectName, role string,
+	object plugin.Renderer)
 
 // SetEventRulesCallbacks sets the event rules callbacks
 func SetEventRulesCallbacks(reload FnReloadRules, remove FnRemoveRule, handle FnHandleRuleForProviderEvent) {
@@ -488,8 +509,12 @@ type Config struct {
 	// could be unable to login, for example existing users with mixed cases in their usernames.
 	// You have to ensure that all existing users respect the defined rules.
 	NamingRules int `json:"naming_rules" mapstructure:"naming_rules"`
+	// UsernameMapping defines the rules to canonicalize the login names before looking up users,
+	// so the same account can be reached using different login names, for example
+	// "user", "user@corp.com" and "CORP\user"
+	UsernameMapping UsernameMappingConfig `json:"username_mapping" mapstructure:"username_mapping"`
 	// If the data provider is shared across multiple SFTPGo instances, set this parameter to 1.
-	// MySQL, PostgreSQL and CockroachDB can be shared, this setting is ignored for other data
+	// MySQL, PostgreSQL, CockroachDB and etcd can be shared, this setting is ignored for other data
 	// providers. For shared data providers, SFTPGo periodically reloads the latest updated users,
 	// based on the "updated_at" field, and updates its internal caches if users are updated from
 	// a different instance. This check, if enabled, is executed every 10 minutes.
@@ -499,6 +524,13 @@ type Config struct {
 	// Node defines the configuration for this cluster node.
 	// Ignored if the provider is not shared/shareable
 	Node NodeConfig `json:"node" mapstructure:"node"`
+	// AuditLog defines the configuration for the audit log of the admins actions
+	AuditLog AuditLogConfig `json:"audit_log" mapstructure:"audit_log"`
+	// ShareEvents defines the configuration for the share access events
+	ShareEvents ShareEventsConfig `json:"share_events" mapstructure:"share_events"`
+	// Snapshots defines the configuration for the point-in-time snapshots of
+	// users, folders, groups and event rules
+	Snapshots ConfigSnapshotsConfig `json:"snapshots" mapstructure:"snapshots"`
 	// Path to the backup directory. This can be an absolute path or a path relative to the config dir
 	BackupsPath string `json:"backups_path" mapstructure:"backups_path"`
 }
@@ -529,7 +561,7 @@ func (c *Config) convertName(name string) string {
 // IsDefenderSupported returns true if the configured provider supports the defender
 func (c *Config) IsDefenderSupported() bool {
 	switch c.Driver {
-	case MySQLDataProviderName, PGSQLDataProviderName, CockroachDataProviderName:
+	case MySQLDataProviderName, PGSQLDataProviderName, CockroachDataProviderName, EtcdDataProviderName:
 		return true
 	default:
 		return false
@@ -687,6 +719,7 @@ type BackupData struct {
 	EventActions []BaseEventAction       `json:"event_actions"`
 	EventRules   []EventRule             `json:"event_rules"`
 	Roles        []Role                  `json:"roles"`
+	AdminRoles   []AdminRole             `json:"admin_roles"`
 	IPLists      []IPListEntry           `json:"ip_lists"`
 	Configs      *Configs                `json:"configs"`
 	Version      int                     `json:"version"`
@@ -729,7 +762,7 @@ func HasUsersBaseDir() bool {
 
 // Provider defines the interface that data providers must implement.
 type Provider interface {
-	validateUserAndPass(username, password, ip, protocol string) (User, error)
+	validateUserAndPass(ctx context.Context, username, password, ip, protocol string) (User, error)
 	validateUserAndPubKey(username string, pubKey []byte, isSSHCert bool) (User, string, error)
 	validateUserAndTLSCert(username, protocol string, tlsCert *x509.Certificate) (User, error)
 	updateQuota(username string, filesAdd int, sizeAdd int64, reset bool) error
@@ -747,7 +780,7 @@ type Provider interface {
 	updateLastLogin(username string) error
 	updateAdminLastLogin(username string) error
 	setUpdatedAt(username string)
-	getFolders(limit, offset int, order string, minimal bool) ([]vfs.BaseVirtualFolder, error)
+	getFolders(limit, offset int, order string, minimal bool, role string) ([]vfs.BaseVirtualFolder, error)
 	getFolderByName(name string) (vfs.BaseVirtualFolder, error)
 	addFolder(folder *vfs.BaseVirtualFolder) error
 	updateFolder(folder *vfs.BaseVirtualFolder) error
@@ -755,7 +788,7 @@ type Provider interface {
 	updateFolderQuota(name string, filesAdd int, sizeAdd int64, reset bool) error
 	getUsedFolderQuota(name string) (int, int64, error)
 	dumpFolders() ([]vfs.BaseVirtualFolder, error)
-	getGroups(limit, offset int, order string, minimal bool) ([]Group, error)
+	getGroups(limit, offset int, order string, minimal bool, role string) ([]Group, error)
 	getGroupsWithNames(names []string) ([]Group, error)
 	getUsersInGroups(names []string) ([]string, error)
 	groupExists(name string) (Group, error)
@@ -773,6 +806,7 @@ type Provider interface {
 	apiKeyExists(keyID string) (APIKey, error)
 	addAPIKey(apiKey *APIKey) error
 	updateAPIKey(apiKey *APIKey) error
+	rotateAPIKey(apiKey *APIKey) error
 	deleteAPIKey(apiKey APIKey) error
 	getAPIKeys(limit int, offset int, order string) ([]APIKey, error)
 	dumpAPIKeys() ([]APIKey, error)
@@ -801,13 +835,14 @@ type Provider interface {
 	deleteSharedSession(key string) error
 	getSharedSession(key string) (Session, error)
 	cleanupSharedSessions(sessionType SessionType, before int64) error
+	getSharedSessions(sessionType SessionType, after int64) ([]Session, error)
 	getEventActions(limit, offset int, order string, minimal bool) ([]BaseEventAction, error)
 	dumpEventActions() ([]BaseEventAction, error)
 	eventActionExists(name string) (BaseEventAction, error)
 	addEventAction(action *BaseEventAction) error
 	updateEventAction(action *BaseEventAction) error
 	deleteEventAction(action BaseEventAction) error
-	getEventRules(limit, offset int, order string) ([]EventRule, error)
+	getEventRules(limit, offset int, order, role string) ([]EventRule, error)
 	dumpEventRules() ([]EventRule, error)
 	getRecentlyUpdatedRules(after int64) ([]EventRule, error)
 	eventRuleExists(name string) (EventRule, error)
@@ -824,6 +859,7 @@ type Provider interface {
 	getNodeByName(name string) (Node, error)
 	getNodes() ([]Node, error)
 	updateNodeTimestamp() error
+	updateNodeConnections() error
 	cleanupNodes() error
 	roleExists(name string) (Role, error)
 	addRole(role *Role) error
@@ -831,6 +867,12 @@ type Provider interface {
 	deleteRole(role Role) error
 	getRoles(limit int, offset int, order string, minimal bool) ([]Role, error)
 	dumpRoles() ([]Role, error)
+	adminRoleExists(name string) (AdminRole, error)
+	addAdminRole(role *AdminRole) error
+	updateAdminRole(role *AdminRole) error
+	deleteAdminRole(role AdminRole) error
+	getAdminRoles(limit int, offset int, order string, minimal bool) ([]AdminRole, error)
+	dumpAdminRoles() ([]AdminRole, error)
 	ipListEntryExists(ipOrNet string, listType IPListType) (IPListEntry, error)
 	addIPListEntry(entry *IPListEntry) error
 	updateIPListEntry(entry *IPListEntry) error
@@ -842,6 +884,20 @@ type Provider interface {
 	getListEntriesForIP(ip string, listType IPListType) ([]IPListEntry, error)
 	getConfigs() (Configs, error)
 	setConfigs(configs *Configs) error
+	getFileMetadata(username, virtualPath string) (FileMetadata, error)
+	getFilesMetadata(username, virtualPath string) ([]FileMetadata, error)
+	setFileMetadata(username string, metadata *FileMetadata) error
+	deleteFilesMetadata(username, virtualPath string, recursive bool) error
+	renameFilesMetadata(username, source, target string) error
+	addEventDigestEntry(entry *EventDigestEntry) error
+	getEventDigestEntries(before int64) ([]EventDigestEntry, error)
+	deleteEventDigestEntries(ids []int64) error
+	addAuditLogEntry(entry *AuditLogEntry) error
+	searchAuditLog(filters *AuditLogSearch) ([]AuditLogEntry, error)
+	cleanupAuditLog(before int64) error
+	addShareEvent(event *ShareEvent) error
+	getShareEvents(shareID string, from, to int64, limit int) ([]ShareEvent, error)
+	cleanupShareEvents(before int64) error
 	checkAvailability() error
 	close() error
 	reloadConfig() error
@@ -867,10 +923,26 @@ func checkSharedMode() {
 	}
 }
 
+// UpdatePassword updates the password used for new connections to SQL based
+// data providers, for example after a credentials rotation. The existing
+// connections are not affected. It has no effect if a connection string is
+// configured
+func UpdatePassword(password string) {
+	providerPassword.Store(&password)
+}
+
+func getProviderPassword() string {
+	if password := providerPassword.Load(); password != nil {
+		return *password
+	}
+	return config.Password
+}
+
 // Initialize the data provider.
 // An error is returned if the configured driver is invalid or if the data provider cannot be initialized
 func Initialize(cnf Config, basePath string, checkAdmins bool) error {
 	config = cnf
+	UpdatePassword(config.Password)
 	checkSharedMode()
 	config.Actions.ExecuteOn = util.RemoveDuplicates(config.Actions.ExecuteOn, true)
 	config.Actions.ExecuteFor = util.RemoveDuplicates(config.Actions.ExecuteFor, true)
@@ -891,6 +963,15 @@ func Initialize(cnf Config, basePath string, checkAdmins bool) error {
 	if err := validateHooks(); err != nil {
 		return err
 	}
+	if err := config.AuditLog.validate(); err != nil {
+		return err
+	}
+	if err := config.ShareEvents.validate(); err != nil {
+		return err
+	}
+	if err := config.Snapshots.validate(); err != nil {
+		return err
+	}
 	if err := createProvider(basePath); err != nil {
 		return err
 	}
@@ -902,6 +983,7 @@ func Initialize(cnf Config, basePath string, checkAdmins bool) error {
 		return err
 	}
 	isAdminCreated.Store(len(admins) > 0)
+	loadUsernameAliases()
 	if err := config.Node.validate(); err != nil {
 		return err
 	}
@@ -1024,19 +1106,25 @@ func validateSQLTablesPrefix() error {
 		sqlTableTasks = config.SQLTablesPrefix + sqlTableTasks
 		sqlTableNodes = config.SQLTablesPrefix + sqlTableNodes
 		sqlTableRoles = config.SQLTablesPrefix + sqlTableRoles
+		sqlTableAdminRoles = config.SQLTablesPrefix + sqlTableAdminRoles
 		sqlTableIPLists = config.SQLTablesPrefix + sqlTableIPLists
 		sqlTableConfigs = config.SQLTablesPrefix + sqlTableConfigs
+		sqlTableFilesMetadata = config.SQLTablesPrefix + sqlTableFilesMetadata
+		sqlTableEventsDigests = config.SQLTablesPrefix + sqlTableEventsDigests
+		sqlTableAuditLogs = config.SQLTablesPrefix + sqlTableAuditLogs
+		sqlTableShareEvents = config.SQLTablesPrefix + sqlTableShareEvents
 		sqlTableSchemaVersion = config.SQLTablesPrefix + sqlTableSchemaVersion
 		providerLog(logger.LevelDebug, "sql table for users %q, folders %q users folders mapping %q admins %q "+
 			"api keys %q shares %q defender hosts %q defender events %q transfers %q  groups %q "+
 			"users groups mapping %q admins groups mapping %q groups folders mapping %q shared sessions %q "+
 			"schema version %q events actions %q events rules %q rules actions mapping %q tasks %q nodes %q roles %q"+
-			"ip lists %q configs %q",
+			"admin roles %q ip lists %q configs %q files metadata %q events digests %q audit logs %q share events %q",
 			sqlTableUsers, sqlTableFolders, sqlTableUsersFoldersMapping, sqlTableAdmins, sqlTableAPIKeys,
 			sqlTableShares, sqlTableDefenderHosts, sqlTableDefenderEvents, sqlTableActiveTransfers, sqlTableGroups,
 			sqlTableUsersGroupsMapping, sqlTableAdminsGroupsMapping, sqlTableGroupsFoldersMapping, sqlTableSharedSessions,
 			sqlTableSchemaVersion, sqlTableEventsActions, sqlTableEventsRules, sqlTableRulesActionsMapping,
-			sqlTableTasks, sqlTableNodes, sqlTableRoles, sqlTableIPLists, sqlTableConfigs)
+			sqlTableTasks, sqlTableNodes, sqlTableRoles, sqlTableAdminRoles, sqlTableIPLists, sqlTableConfigs,
+			sqlTableFilesMetadata, sqlTableEventsDigests, sqlTableAuditLogs, sqlTableShareEvents)
 	}
 	return nil
 }
@@ -1103,15 +1191,21 @@ func ResetDatabase(cnf Config, basePath string) error {
 }
 
 // CheckAdminAndPass validates the given admin and password connecting from ip
-func CheckAdminAndPass(username, password, ip string) (Admin, error) {
+func CheckAdminAndPass(username, password, ip string) (admin Admin, err error) {
+	span := startAuthSpan(username, ip, protocolHTTP, LoginMethodPassword)
+	defer func() {
+		tracing.EndSpan(span, err)
+	}()
+
 	username = config.convertName(username)
 	return provider.validateAdminAndPass(username, password, ip)
 }
 
-// CheckCachedUserCredentials checks the credentials for a cached user
-func CheckCachedUserCredentials(user *CachedUser, password, ip, loginMethod, protocol string, tlsCert *x509.Certificate) (*CachedUser, *User, error) {
+// CheckCachedUserCredentials checks the credentials for a cached user.
+// The external authentication hooks get the correlation ID carried by ctx, if any
+func CheckCachedUserCredentials(ctx context.Context, user *CachedUser, password, ip, loginMethod, protocol string, tlsCert *x509.Certificate) (*CachedUser, *User, error) {
 	if !user.User.skipExternalAuth() && isExternalAuthConfigured(loginMethod) {
-		u, _, err := CheckCompositeCredentials(user.User.Username, password, ip, loginMethod, protocol, tlsCert)
+		u, _, err := CheckCompositeCredentialsContext(ctx, user.User.Username, password, ip, loginMethod, protocol, tlsCert)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -1155,19 +1249,33 @@ func CheckCachedUserCredentials(user *CachedUser, password, ip, loginMethod, pro
 // CheckCompositeCredentials checks multiple credentials.
 // WebDAV users can send both a password and a TLS certificate within the same request
 func CheckCompositeCredentials(username, password, ip, loginMethod, protocol string, tlsCert *x509.Certificate) (User, string, error) {
-	username = config.convertName(username)
+	return CheckCompositeCredentialsContext(context.Background(), username, password, ip, loginMethod, protocol, tlsCert)
+}
+
+// CheckCompositeCredentialsContext is like CheckCompositeCredentials but the executed hooks get
+// the correlation ID carried by ctx, if any
+func CheckCompositeCredentialsContext(ctx context.Context, username, password, ip, loginMethod, protocol string, tlsCert *x509.Certificate) (User, string, error) {
+	username = canonicalizeLoginName(username)
 	if loginMethod == LoginMethodPassword {
-		user, err := CheckUserAndPass(username, password, ip, protocol)
+		user, err := CheckUserAndPassContext(ctx, username, password, ip, protocol)
 		return user, loginMethod, err
 	}
-	user, err := CheckUserBeforeTLSAuth(username, ip, protocol, tlsCert)
+	user, method, err := checkCompositeCredentials(ctx, username, password, ip, loginMethod, protocol, tlsCert)
+	if method != LoginMethodPassword {
+		logTLSCertificateAuth(username, ip, method, protocol, tlsCert, err)
+	}
+	return user, method, err
+}
+
+func checkCompositeCredentials(ctx context.Context, username, password, ip, loginMethod, protocol string, tlsCert *x509.Certificate) (User, string, error) {
+	user, err := CheckUserBeforeTLSAuth(ctx, username, ip, protocol, tlsCert)
 	if err != nil {
 		return user, loginMethod, err
 	}
 	if !user.IsTLSUsernameVerificationEnabled() {
 		// for backward compatibility with 2.0.x we only check the password and change the login method here
 		// in future updates we have to return an error
-		user, err := CheckUserAndPass(username, password, ip, protocol)
+		user, err := CheckUserAndPassContext(ctx, username, password, ip, protocol)
 		return user, LoginMethodPassword, err
 	}
 	user, err = checkUserAndTLSCertificate(&user, protocol, tlsCert)
@@ -1181,21 +1289,27 @@ func CheckCompositeCredentials(username, password, ip, loginMethod, protocol str
 		if plugin.Handler.HasAuthScope(plugin.AuthScopePassword) {
 			user, err = doPluginAuth(username, password, nil, ip, protocol, nil, plugin.AuthScopePassword)
 		} else if config.ExternalAuthHook != "" && (config.ExternalAuthScope == 0 || config.ExternalAuthScope&1 != 0) {
-			user, err = doExternalAuth(username, password, nil, "", ip, protocol, nil)
+			user, err = doExternalAuth(ctx, username, password, nil, "", ip, protocol, nil)
 		} else if config.PreLoginHook != "" {
-			user, err = executePreLoginHook(username, LoginMethodPassword, ip, protocol, nil)
+			user, err = executePreLoginHook(ctx, username, LoginMethodPassword, ip, protocol, nil)
 		}
 		if err != nil {
 			return user, loginMethod, err
 		}
-		user, err = checkUserAndPass(&user, password, ip, protocol)
+		user, err = checkUserAndPass(ctx, &user, password, ip, protocol)
 	}
 	return user, loginMethod, err
 }
 
-// CheckUserBeforeTLSAuth checks if a user exits before trying mutual TLS
-func CheckUserBeforeTLSAuth(username, ip, protocol string, tlsCert *x509.Certificate) (User, error) {
-	username = config.convertName(username)
+// CheckUserBeforeTLSAuth checks if a user exits before trying mutual TLS.
+// The executed hooks get the correlation ID carried by ctx, if any
+func CheckUserBeforeTLSAuth(ctx context.Context, username, ip, protocol string, tlsCert *x509.Certificate) (u User, e error) {
+	span := startAuthSpan(username, ip, protocol, LoginMethodTLSCertificate)
+	defer func() {
+		tracing.EndSpan(span, e)
+	}()
+
+	username = canonicalizeLoginName(username)
 	if plugin.Handler.HasAuthScope(plugin.AuthScopeTLSCertificate) {
 		user, err := doPluginAuth(username, "", nil, ip, protocol, tlsCert, plugin.AuthScopeTLSCertificate)
 		if err != nil {
@@ -1205,7 +1319,7 @@ func CheckUserBeforeTLSAuth(username, ip, protocol string, tlsCert *x509.Certifi
 		return user, err
 	}
 	if config.ExternalAuthHook != "" && (config.ExternalAuthScope == 0 || config.ExternalAuthScope&8 != 0) {
-		user, err := doExternalAuth(username, "", nil, "", ip, protocol, tlsCert)
+		user, err := doExternalAuth(ctx, username, "", nil, "", ip, protocol, tlsCert)
 		if err != nil {
 			return user, err
 		}
@@ -1213,7 +1327,7 @@ func CheckUserBeforeTLSAuth(username, ip, protocol string, tlsCert *x509.Certifi
 		return user, err
 	}
 	if config.PreLoginHook != "" {
-		user, err := executePreLoginHook(username, LoginMethodTLSCertificate, ip, protocol, nil)
+		user, err := executePreLoginHook(ctx, username, LoginMethodTLSCertificate, ip, protocol, nil)
 		if err != nil {
 			return user, err
 		}
@@ -1230,8 +1344,20 @@ func CheckUserBeforeTLSAuth(username, ip, protocol string, tlsCert *x509.Certifi
 
 // CheckUserAndTLSCert returns the SFTPGo user with the given username and check if the
 // given TLS certificate allow authentication without password
-func CheckUserAndTLSCert(username, ip, protocol string, tlsCert *x509.Certificate) (User, error) {
-	username = config.convertName(username)
+func CheckUserAndTLSCert(username, ip, protocol string, tlsCert *x509.Certificate) (u User, e error) {
+	return CheckUserAndTLSCertContext(context.Background(), username, ip, protocol, tlsCert)
+}
+
+// CheckUserAndTLSCertContext is like CheckUserAndTLSCert but the executed hooks get
+// the correlation ID carried by ctx, if any
+func CheckUserAndTLSCertContext(ctx context.Context, username, ip, protocol string, tlsCert *x509.Certificate) (u User, e error) {
+	span := startAuthSpan(username, ip, protocol, LoginMethodTLSCertificate)
+	defer func() {
+		logTLSCertificateAuth(username, ip, LoginMethodTLSCertificate, protocol, tlsCert, e)
+		tracing.EndSpan(span, e)
+	}()
+
+	username = canonicalizeLoginName(username)
 	if plugin.Handler.HasAuthScope(plugin.AuthScopeTLSCertificate) {
 		user, err := doPluginAuth(username, "", nil, ip, protocol, tlsCert, plugin.AuthScopeTLSCertificate)
 		if err != nil {
@@ -1240,14 +1366,14 @@ func CheckUserAndTLSCert(username, ip, protocol string, tlsCert *x509.Certificat
 		return checkUserAndTLSCertificate(&user, protocol, tlsCert)
 	}
 	if config.ExternalAuthHook != "" && (config.ExternalAuthScope == 0 || config.ExternalAuthScope&8 != 0) {
-		user, err := doExternalAuth(username, "", nil, "", ip, protocol, tlsCert)
+		user, err := doExternalAuth(ctx, username, "", nil, "", ip, protocol, tlsCert)
 		if err != nil {
 			return user, err
 		}
 		return checkUserAndTLSCertificate(&user, protocol, tlsCert)
 	}
 	if config.PreLoginHook != "" {
-		user, err := executePreLoginHook(username, LoginMethodTLSCertificate, ip, protocol, nil)
+		user, err := executePreLoginHook(ctx, username, LoginMethodTLSCertificate, ip, protocol, nil)
 		if err != nil {
 			return user, err
 		}
@@ -1257,35 +1383,57 @@ func CheckUserAndTLSCert(username, ip, protocol string, tlsCert *x509.Certificat
 }
 
 // CheckUserAndPass retrieves the SFTPGo user with the given username and password if a match is found or an error
-func CheckUserAndPass(username, password, ip, protocol string) (User, error) {
-	username = config.convertName(username)
+func CheckUserAndPass(username, password, ip, protocol string) (u User, e error) {
+	return CheckUserAndPassContext(context.Background(), username, password, ip, protocol)
+}
+
+// CheckUserAndPassContext is like CheckUserAndPass but the executed hooks get
+// the correlation ID carried by ctx, if any
+func CheckUserAndPassContext(ctx context.Context, username, password, ip, protocol string) (u User, e error) {
+	span := startAuthSpan(username, ip, protocol, LoginMethodPassword)
+	defer func() {
+		tracing.EndSpan(span, e)
+	}()
+
+	username = canonicalizeLoginName(username)
 	if plugin.Handler.HasAuthScope(plugin.AuthScopePassword) {
 		user, err := doPluginAuth(username, password, nil, ip, protocol, nil, plugin.AuthScopePassword)
 		if err != nil {
 			return user, err
 		}
-		return checkUserAndPass(&user, password, ip, protocol)
+		return checkUserAndPass(ctx, &user, password, ip, protocol)
 	}
 	if config.ExternalAuthHook != "" && (config.ExternalAuthScope == 0 || config.ExternalAuthScope&1 != 0) {
-		user, err := doExternalAuth(username, password, nil, "", ip, protocol, nil)
+		user, err := doExternalAuth(ctx, username, password, nil, "", ip, protocol, nil)
 		if err != nil {
 			return user, err
 		}
-		return checkUserAndPass(&user, password, ip, protocol)
+		return checkUserAndPass(ctx, &user, password, ip, protocol)
 	}
 	if config.PreLoginHook != "" {
-		user, err := executePreLoginHook(username, LoginMethodPassword, ip, protocol, nil)
+		user, err := executePreLoginHook(ctx, username, LoginMethodPassword, ip, protocol, nil)
 		if err != nil {
 			return user, err
 		}
-		return checkUserAndPass(&user, password, ip, protocol)
+		return checkUserAndPass(ctx, &user, password, ip, protocol)
 	}
-	return provider.validateUserAndPass(username, password, ip, protocol)
+	return provider.validateUserAndPass(ctx, username, password, ip, protocol)
 }
 
 // CheckUserAndPubKey retrieves the SFTP user with the given username and public key if a match is found or an error
-func CheckUserAndPubKey(username string, pubKey []byte, ip, protocol string, isSSHCert bool) (User, string, error) {
-	username = config.convertName(username)
+func CheckUserAndPubKey(username string, pubKey []byte, ip, protocol string, isSSHCert bool) (u User, info string, e error) {
+	return CheckUserAndPubKeyContext(context.Background(), username, pubKey, ip, protocol, isSSHCert)
+}
+
+// CheckUserAndPubKeyContext is like CheckUserAndPubKey but the executed hooks get
+// the correlation ID carried by ctx, if any
+func CheckUserAndPubKeyContext(ctx context.Context, username string, pubKey []byte, ip, protocol string, isSSHCert bool) (u User, info string, e error) {
+	span := startAuthSpan(username, ip, protocol, SSHLoginMethodPublicKey)
+	defer func() {
+		tracing.EndSpan(span, e)
+	}()
+
+	username = canonicalizeLoginName(username)
 	if plugin.Handler.HasAuthScope(plugin.AuthScopePublicKey) {
 		user, err := doPluginAuth(username, "", pubKey, ip, protocol, nil, plugin.AuthScopePublicKey)
 		if err != nil {
@@ -1294,14 +1442,14 @@ func CheckUserAndPubKey(username string, pubKey []byte, ip, protocol string, isS
 		return checkUserAndPubKey(&user, pubKey, isSSHCert)
 	}
 	if config.ExternalAuthHook != "" && (config.ExternalAuthScope == 0 || config.ExternalAuthScope&2 != 0) {
-		user, err := doExternalAuth(username, "", pubKey, "", ip, protocol, nil)
+		user, err := doExternalAuth(ctx, username, "", pubKey, "", ip, protocol, nil)
 		if err != nil {
 			return user, "", err
 		}
 		return checkUserAndPubKey(&user, pubKey, isSSHCert)
 	}
 	if config.PreLoginHook != "" {
-		user, err := executePreLoginHook(username, SSHLoginMethodPublicKey, ip, protocol, nil)
+		user, err := executePreLoginHook(ctx, username, SSHLoginMethodPublicKey, ip, protocol, nil)
 		if err != nil {
 			return user, "", err
 		}
@@ -1311,35 +1459,42 @@ func CheckUserAndPubKey(username string, pubKey []byte, ip, protocol string, isS
 }
 
 // CheckKeyboardInteractiveAuth checks the keyboard interactive authentication and returns
-// the authenticated user or an error
-func CheckKeyboardInteractiveAuth(username, authHook string, client ssh.KeyboardInteractiveChallenge, ip, protocol string) (User, error) {
+// the authenticated user or an error. The executed hooks get the correlation ID carried
+// by ctx, if any
+func CheckKeyboardInteractiveAuth(ctx context.Context, username, authHook string, client ssh.KeyboardInteractiveChallenge, ip, protocol string) (u User, e error) {
+	span := startAuthSpan(username, ip, protocol, SSHLoginMethodKeyboardInteractive)
+	defer func() {
+		tracing.EndSpan(span, e)
+	}()
+
 	var user User
 	var err error
-	username = config.convertName(username)
+	username = canonicalizeLoginName(username)
 	if plugin.Handler.HasAuthScope(plugin.AuthScopeKeyboardInteractive) {
 		user, err = doPluginAuth(username, "", nil, ip, protocol, nil, plugin.AuthScopeKeyboardInteractive)
 	} else if config.ExternalAuthHook != "" && (config.ExternalAuthScope == 0 || config.ExternalAuthScope&4 != 0) {
-		user, err = doExternalAuth(username, "", nil, "1", ip, protocol, nil)
+		user, err = doExternalAuth(ctx, username, "", nil, "1", ip, protocol, nil)
 	} else if config.PreLoginHook != "" {
-		user, err = executePreLoginHook(username, SSHLoginMethodKeyboardInteractive, ip, protocol, nil)
+		user, err = executePreLoginHook(ctx, username, SSHLoginMethodKeyboardInteractive, ip, protocol, nil)
 	} else {
 		user, err = provider.userExists(username, "")
 	}
 	if err != nil {
 		return user, err
 	}
-	return doKeyboardInteractiveAuth(&user, authHook, client, ip, protocol)
+	return doKeyboardInteractiveAuth(ctx, &user, authHook, client, ip, protocol)
 }
 
 // GetFTPPreAuthUser returns the SFTPGo user with the specified username
 // after receiving the FTP "USER" command.
 // If a pre-login hook is defined it will be executed so the SFTPGo user
-// can be created if it does not exist
-func GetFTPPreAuthUser(username, ip string) (User, error) {
+// can be created if it does not exist. The hook gets the correlation ID
+// carried by ctx, if any
+func GetFTPPreAuthUser(ctx context.Context, username, ip string) (User, error) {
 	var user User
 	var err error
 	if config.PreLoginHook != "" {
-		user, err = executePreLoginHook(username, "", ip, protocolFTP, nil)
+		user, err = executePreLoginHook(ctx, username, "", ip, protocolFTP, nil)
 	} else {
 		user, err = UserExists(username, "")
 	}
@@ -1355,10 +1510,16 @@ func GetFTPPreAuthUser(username, ip string) (User, error) {
 // If a pre-login hook is defined it will be executed so the SFTPGo user
 // can be created if it does not exist
 func GetUserAfterIDPAuth(username, ip, protocol string, oidcTokenFields *map[string]any) (User, error) {
+	return GetUserAfterIDPAuthContext(context.Background(), username, ip, protocol, oidcTokenFields)
+}
+
+// GetUserAfterIDPAuthContext is like GetUserAfterIDPAuth but the executed hooks get
+// the correlation ID carried by ctx, if any
+func GetUserAfterIDPAuthContext(ctx context.Context, username, ip, protocol string, oidcTokenFields *map[string]any) (User, error) {
 	var user User
 	var err error
 	if config.PreLoginHook != "" {
-		user, err = executePreLoginHook(username, LoginMethodIDP, ip, protocol, oidcTokenFields)
+		user, err = executePreLoginHook(ctx, username, LoginMethodIDP, ip, protocol, oidcTokenFields)
 		user.Filters.RequirePasswordChange = false
 	} else {
 		user, err = UserExists(username, "")
@@ -1419,6 +1580,20 @@ func UpdateShareLastUse(share *Share, numTokens int) error {
 	return provider.updateShareLastUse(share.ShareID, numTokens)
 }
 
+// UpdateShareUsage is like UpdateShareLastUse but it also updates the
+// downloads for the specified IP address if the share limits them
+func UpdateShareUsage(share *Share, ip string, numTokens int) error {
+	if share.MaxDownloadsPerIP > 0 {
+		shareDownloadsTracker.add(share.ShareID, ip, numTokens)
+	}
+	return UpdateShareLastUse(share, numTokens)
+}
+
+// DumpShares returns all the shares
+func DumpShares() ([]Share, error) {
+	return provider.dumpShares()
+}
+
 // UpdateAPIKeyLastUse updates the LastUseAt field for the given API key
 func UpdateAPIKeyLastUse(apiKey *APIKey) error {
 	lastUse := util.GetTimeFromMsecSinceEpoch(apiKey.LastUseAt)
@@ -1563,45 +1738,73 @@ func GetConfigs() (Configs, error) {
 
 // UpdateConfigs updates configurations
 func UpdateConfigs(configs *Configs, executor, ipAddress, role string) error {
+	return UpdateConfigsContext(context.Background(), configs, executor, ipAddress, role)
+}
+
+// UpdateConfigsContext is like UpdateConfigs but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func UpdateConfigsContext(ctx context.Context, configs *Configs, executor, ipAddress, role string) error {
 	if configs == nil {
 		configs = &Configs{}
 	} else {
 		configs.UpdatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
 	}
+	before := getAuditLogSnapshot(executor, actionObjectConfigs, configs)
 	err := provider.setConfigs(configs)
 	if err == nil {
-		executeAction(operationUpdate, executor, ipAddress, actionObjectConfigs, "configs", role, configs)
+		setUsernameAliases(configs)
+		executeAuditedAction(ctx, operationUpdate, executor, ipAddress, actionObjectConfigs, "configs", role, before, configs)
 	}
 	return err
 }
 
 // AddShare adds a new share
 func AddShare(share *Share, executor, ipAddress, role string) error {
+	return AddShareContext(context.Background(), share, executor, ipAddress, role)
+}
+
+// AddShareContext is like AddShare but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func AddShareContext(ctx context.Context, share *Share, executor, ipAddress, role string) error {
 	err := provider.addShare(share)
 	if err == nil {
-		executeAction(operationAdd, executor, ipAddress, actionObjectShare, share.ShareID, role, share)
+		executeAuditedAction(ctx, operationAdd, executor, ipAddress, actionObjectShare, share.ShareID, role, nil, share)
 	}
 	return err
 }
 
 // UpdateShare updates an existing share
 func UpdateShare(share *Share, executor, ipAddress, role string) error {
+	return UpdateShareContext(context.Background(), share, executor, ipAddress, role)
+}
+
+// UpdateShareContext is like UpdateShare but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func UpdateShareContext(ctx context.Context, share *Share, executor, ipAddress, role string) error {
+	before := getAuditLogSnapshot(executor, actionObjectShare, share)
 	err := provider.updateShare(share)
 	if err == nil {
-		executeAction(operationUpdate, executor, ipAddress, actionObjectShare, share.ShareID, role, share)
+		executeAuditedAction(ctx, operationUpdate, executor, ipAddress, actionObjectShare, share.ShareID, role, before, share)
 	}
 	return err
 }
 
 // DeleteShare deletes an existing share
 func DeleteShare(shareID string, executor, ipAddress, role string) error {
+	return DeleteShareContext(context.Background(), shareID, executor, ipAddress, role)
+}
+
+// DeleteShareContext is like DeleteShare but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func DeleteShareContext(ctx context.Context, shareID string, executor, ipAddress, role string) error {
 	share, err := provider.shareExists(shareID, executor)
 	if err != nil {
 		return err
 	}
 	err = provider.deleteShare(share)
 	if err == nil {
-		executeAction(operationDelete, executor, ipAddress, actionObjectShare, shareID, role, &share)
+		shareDownloadsTracker.remove(shareID)
+		executeAuditedAction(ctx, operationDelete, executor, ipAddress, actionObjectShare, shareID, role, nil, &share)
 	}
 	return err
 }
@@ -1616,9 +1819,15 @@ func ShareExists(shareID, username string) (Share, error) {
 
 // AddIPListEntry adds a new IP list entry
 func AddIPListEntry(entry *IPListEntry, executor, ipAddress, executorRole string) error {
+	return AddIPListEntryContext(context.Background(), entry, executor, ipAddress, executorRole)
+}
+
+// AddIPListEntryContext is like AddIPListEntry but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func AddIPListEntryContext(ctx context.Context, entry *IPListEntry, executor, ipAddress, executorRole string) error {
 	err := provider.addIPListEntry(entry)
 	if err == nil {
-		executeAction(operationAdd, executor, ipAddress, actionObjectIPListEntry, entry.getName(), executorRole, entry)
+		executeAuditedAction(ctx, operationAdd, executor, ipAddress, actionObjectIPListEntry, entry.getName(), executorRole, nil, entry)
 		for _, l := range inMemoryLists {
 			l.addEntry(entry)
 		}
@@ -1628,9 +1837,17 @@ func AddIPListEntry(entry *IPListEntry, executor, ipAddress, executorRole string
 
 // UpdateIPListEntry updates an existing IP list entry
 func UpdateIPListEntry(entry *IPListEntry, executor, ipAddress, executorRole string) error {
+	return UpdateIPListEntryContext(context.Background(), entry, executor, ipAddress, executorRole)
+}
+
+// UpdateIPListEntryContext is like UpdateIPListEntry but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func UpdateIPListEntryContext(ctx context.Context, entry *IPListEntry, executor, ipAddress, executorRole string) error {
+	before := getAuditLogSnapshot(executor, actionObjectIPListEntry, entry)
 	err := provider.updateIPListEntry(entry)
 	if err == nil {
-		executeAction(operationUpdate, executor, ipAddress, actionObjectIPListEntry, entry.getName(), executorRole, entry)
+		executeAuditedAction(ctx, operationUpdate, executor, ipAddress, actionObjectIPListEntry, entry.getName(), executorRole,
+			before, entry)
 		for _, l := range inMemoryLists {
 			l.updateEntry(entry)
 		}
@@ -1640,13 +1857,20 @@ func UpdateIPListEntry(entry *IPListEntry, executor, ipAddress, executorRole str
 
 // DeleteIPListEntry deletes an existing IP list entry
 func DeleteIPListEntry(ipOrNet string, listType IPListType, executor, ipAddress, executorRole string) error {
+	return DeleteIPListEntryContext(context.Background(), ipOrNet, listType, executor, ipAddress, executorRole)
+}
+
+// DeleteIPListEntryContext is like DeleteIPListEntry but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func DeleteIPListEntryContext(ctx context.Context, ipOrNet string, listType IPListType, executor, ipAddress, executorRole string) error {
 	entry, err := provider.ipListEntryExists(ipOrNet, listType)
 	if err != nil {
 		return err
 	}
 	err = provider.deleteIPListEntry(entry, config.IsShared == 1)
 	if err == nil {
-		executeAction(operationDelete, executor, ipAddress, actionObjectIPListEntry, entry.getName(), executorRole, &entry)
+		executeAuditedAction(ctx, operationDelete, executor, ipAddress, actionObjectIPListEntry, entry.getName(), executorRole,
+			nil, &entry)
 		for _, l := range inMemoryLists {
 			l.removeEntry(&entry)
 		}
@@ -1669,25 +1893,50 @@ func GetIPListEntries(listType IPListType, filter, from, order string, limit int
 
 // AddRole adds a new role
 func AddRole(role *Role, executor, ipAddress, executorRole string) error {
+	return AddRoleContext(context.Background(), role, executor, ipAddress, executorRole)
+}
+
+// AddRoleContext is like AddRole but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func AddRoleContext(ctx context.Context, role *Role, executor, ipAddress, executorRole string) error {
 	role.Name = config.convertName(role.Name)
+	if err := checkRoleTenantConflicts(role); err != nil {
+		return err
+	}
 	err := provider.addRole(role)
 	if err == nil {
-		executeAction(operationAdd, executor, ipAddress, actionObjectRole, role.Name, executorRole, role)
+		executeAuditedAction(ctx, operationAdd, executor, ipAddress, actionObjectRole, role.Name, executorRole, nil, role)
 	}
 	return err
 }
 
 // UpdateRole updates an existing Role
 func UpdateRole(role *Role, executor, ipAddress, executorRole string) error {
+	return UpdateRoleContext(context.Background(), role, executor, ipAddress, executorRole)
+}
+
+// UpdateRoleContext is like UpdateRole but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func UpdateRoleContext(ctx context.Context, role *Role, executor, ipAddress, executorRole string) error {
+	if err := checkRoleTenantConflicts(role); err != nil {
+		return err
+	}
+	before := getAuditLogSnapshot(executor, actionObjectRole, role)
 	err := provider.updateRole(role)
 	if err == nil {
-		executeAction(operationUpdate, executor, ipAddress, actionObjectRole, role.Name, executorRole, role)
+		executeAuditedAction(ctx, operationUpdate, executor, ipAddress, actionObjectRole, role.Name, executorRole, before, role)
 	}
 	return err
 }
 
 // DeleteRole deletes an existing Role
 func DeleteRole(name string, executor, ipAddress, executorRole string) error {
+	return DeleteRoleContext(context.Background(), name, executor, ipAddress, executorRole)
+}
+
+// DeleteRoleContext is like DeleteRole but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func DeleteRoleContext(ctx context.Context, name string, executor, ipAddress, executorRole string) error {
 	name = config.convertName(name)
 	role, err := provider.roleExists(name)
 	if err != nil {
@@ -1697,39 +1946,240 @@ func DeleteRole(name string, executor, ipAddress, executorRole string) error {
 		errorString := fmt.Sprintf("the role %q is referenced, it cannot be removed", role.Name)
 		return util.NewValidationError(errorString)
 	}
+	if err := checkRoleOwnsObjects(role.Name); err != nil {
+		return err
+	}
 	err = provider.deleteRole(role)
 	if err == nil {
-		executeAction(operationDelete, executor, ipAddress, actionObjectRole, role.Name, executorRole, &role)
+		executeAuditedAction(ctx, operationDelete, executor, ipAddress, actionObjectRole, role.Name, executorRole, nil, &role)
 		for _, user := range role.Users {
 			provider.setUpdatedAt(user)
 			u, err := provider.userExists(user, "")
 			if err == nil {
 				webDAVUsersCache.swap(&u, "")
-				executeAction(operationUpdate, executor, ipAddress, actionObjectUser, u.Username, u.Role, &u)
+				executeAction(ctx, operationUpdate, executor, ipAddress, actionObjectUser, u.Username, u.Role, &u)
+			}
+		}
+	}
+	return err
+}
+
+// AddAdminRole adds a new admin role
+func AddAdminRole(role *AdminRole, executor, ipAddress, executorRole string) error {
+	return AddAdminRoleContext(context.Background(), role, executor, ipAddress, executorRole)
+}
+
+// AddAdminRoleContext is like AddAdminRole but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func AddAdminRoleContext(ctx context.Context, role *AdminRole, executor, ipAddress, executorRole string) error {
+	role.Name = config.convertName(role.Name)
+	err := provider.addAdminRole(role)
+	if err == nil {
+		executeAuditedAction(ctx, operationAdd, executor, ipAddress, actionObjectAdminRole, role.Name, executorRole, nil, role)
+	}
+	return err
+}
+
+// UpdateAdminRole updates an existing admin role
+func UpdateAdminRole(role *AdminRole, executor, ipAddress, executorRole string) error {
+	return UpdateAdminRoleContext(context.Background(), role, executor, ipAddress, executorRole)
+}
+
+// UpdateAdminRoleContext is like UpdateAdminRole but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func UpdateAdminRoleContext(ctx context.Context, role *AdminRole, executor, ipAddress, executorRole string) error {
+	oldRole, err := provider.adminRoleExists(role.Name)
+	if err != nil {
+		return err
+	}
+	if role.hasForbiddenPermsForRoleAdmins() {
+		for _, username := range oldRole.Admins {
+			admin, err := provider.adminExists(username)
+			if err == nil && admin.Role != "" {
+				return util.NewValidationError(fmt.Sprintf("the admin role %q is associated with the role admin %q, "+
+					"a role admin cannot have the following permissions: %q", role.Name, admin.Username,
+					strings.Join(forbiddenPermsForRoleAdmins, ",")))
 			}
 		}
 	}
+	before := getAuditLogSnapshot(executor, actionObjectAdminRole, role)
+	err = provider.updateAdminRole(role)
+	if err == nil {
+		executeAuditedAction(ctx, operationUpdate, executor, ipAddress, actionObjectAdminRole, role.Name, executorRole, before, role)
+	}
+	return err
+}
+
+// DeleteAdminRole deletes an existing admin role
+func DeleteAdminRole(name string, executor, ipAddress, executorRole string) error {
+	return DeleteAdminRoleContext(context.Background(), name, executor, ipAddress, executorRole)
+}
+
+// DeleteAdminRoleContext is like DeleteAdminRole but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func DeleteAdminRoleContext(ctx context.Context, name string, executor, ipAddress, executorRole string) error {
+	name = config.convertName(name)
+	role, err := provider.adminRoleExists(name)
+	if err != nil {
+		return err
+	}
+	if len(role.Admins) > 0 {
+		errorString := fmt.Sprintf("the admin role %q is referenced, it cannot be removed", role.Name)
+		return util.NewValidationError(errorString)
+	}
+	err = provider.deleteAdminRole(role)
+	if err == nil {
+		executeAuditedAction(ctx, operationDelete, executor, ipAddress, actionObjectAdminRole, role.Name, executorRole, nil, &role)
+	}
 	return err
 }
 
+// AdminRoleExists returns the admin role with the given name if it exists
+func AdminRoleExists(name string) (AdminRole, error) {
+	name = config.convertName(name)
+	return provider.adminRoleExists(name)
+}
+
+// checkAdminRole checks that the admin role associated with the specified
+// admin exists and that it does not grant forbidden permissions to role admins
+func checkAdminRole(admin *Admin) error {
+	if admin.AdminRole == "" {
+		return nil
+	}
+	admin.AdminRole = config.convertName(admin.AdminRole)
+	role, err := provider.adminRoleExists(admin.AdminRole)
+	if err != nil {
+		if errors.Is(err, util.ErrNotFound) {
+			return util.NewValidationError(fmt.Sprintf("admin role %q does not exist", admin.AdminRole))
+		}
+		return err
+	}
+	if admin.Role != "" && role.hasForbiddenPermsForRoleAdmins() {
+		return util.NewValidationError(fmt.Sprintf("the admin role %q cannot be assigned to a role admin, "+
+			"a role admin cannot have the following permissions: %q", role.Name, strings.Join(forbiddenPermsForRoleAdmins, ",")))
+	}
+	return nil
+}
+
 // RoleExists returns the Role with the given name if it exists
 func RoleExists(name string) (Role, error) {
 	name = config.convertName(name)
 	return provider.roleExists(name)
 }
 
+// GetTenantRole returns the role configured as tenant for the specified slug or,
+// if the slug is empty, for the specified login domain
+func GetTenantRole(slug, domain string) (Role, error) {
+	slug = strings.ToLower(slug)
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if slug == "" && domain == "" {
+		return Role{}, util.NewRecordNotFoundError("no tenant slug or domain specified")
+	}
+	var result *Role
+	err := forEachTenantRole(func(role *Role) bool {
+		if slug != "" {
+			if role.Tenant.Slug == slug {
+				result = role
+			}
+		} else if util.Contains(role.Tenant.Domains, domain) {
+			result = role
+		}
+		return result == nil
+	})
+	if err != nil {
+		return Role{}, err
+	}
+	if result == nil {
+		return Role{}, util.NewRecordNotFoundError(fmt.Sprintf("no tenant found for slug %q, domain %q", slug, domain))
+	}
+	return *result, nil
+}
+
+// forEachTenantRole calls fn for each role with tenant settings
+// until fn returns false
+func forEachTenantRole(fn func(role *Role) bool) error {
+	limit := 100
+	offset := 0
+	for {
+		roles, err := provider.getRoles(limit, offset, OrderASC, false)
+		if err != nil {
+			return err
+		}
+		for idx := range roles {
+			if roles[idx].Tenant == nil {
+				continue
+			}
+			if !fn(&roles[idx]) {
+				return nil
+			}
+		}
+		if len(roles) < limit {
+			return nil
+		}
+		offset += limit
+	}
+}
+
+// checkRoleTenantConflicts checks that the tenant slug and domains of the specified
+// role are not used by other roles
+func checkRoleTenantConflicts(role *Role) error {
+	if role.Tenant == nil {
+		return nil
+	}
+	if err := role.validate(); err != nil {
+		return err
+	}
+	if role.Tenant == nil {
+		return nil
+	}
+	var conflictErr error
+	err := forEachTenantRole(func(r *Role) bool {
+		if r.Name == role.Name {
+			return true
+		}
+		conflictErr = role.Tenant.conflictsWith(r.Tenant)
+		return conflictErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if conflictErr != nil {
+		return util.NewValidationError(conflictErr.Error())
+	}
+	return nil
+}
+
 // AddGroup adds a new group
 func AddGroup(group *Group, executor, ipAddress, role string) error {
+	return AddGroupContext(context.Background(), group, executor, ipAddress, role)
+}
+
+// AddGroupContext is like AddGroup but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func AddGroupContext(ctx context.Context, group *Group, executor, ipAddress, role string) error {
 	group.Name = config.convertName(group.Name)
+	if err := checkGroupTenant(group, nil); err != nil {
+		return err
+	}
 	err := provider.addGroup(group)
 	if err == nil {
-		executeAction(operationAdd, executor, ipAddress, actionObjectGroup, group.Name, role, group)
+		executeAuditedAction(ctx, operationAdd, executor, ipAddress, actionObjectGroup, group.Name, role, nil, group)
 	}
 	return err
 }
 
 // UpdateGroup updates an existing Group
 func UpdateGroup(group *Group, users []string, executor, ipAddress, role string) error {
+	return UpdateGroupContext(context.Background(), group, users, executor, ipAddress, role)
+}
+
+// UpdateGroupContext is like UpdateGroup but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func UpdateGroupContext(ctx context.Context, group *Group, users []string, executor, ipAddress, role string) error {
+	if err := checkGroupTenant(group, users); err != nil {
+		return err
+	}
+	before := getAuditLogSnapshot(executor, actionObjectGroup, group)
 	err := provider.updateGroup(group)
 	if err == nil {
 		for _, user := range users {
@@ -1741,13 +2191,19 @@ func UpdateGroup(group *Group, users []string, executor, ipAddress, role string)
 				RemoveCachedWebDAVUser(user)
 			}
 		}
-		executeAction(operationUpdate, executor, ipAddress, actionObjectGroup, group.Name, role, group)
+		executeAuditedAction(ctx, operationUpdate, executor, ipAddress, actionObjectGroup, group.Name, role, before, group)
 	}
 	return err
 }
 
 // DeleteGroup deletes an existing Group
 func DeleteGroup(name string, executor, ipAddress, role string) error {
+	return DeleteGroupContext(context.Background(), name, executor, ipAddress, role)
+}
+
+// DeleteGroupContext is like DeleteGroup but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func DeleteGroupContext(ctx context.Context, name string, executor, ipAddress, role string) error {
 	name = config.convertName(name)
 	group, err := provider.groupExists(name)
 	if err != nil {
@@ -1763,11 +2219,11 @@ func DeleteGroup(name string, executor, ipAddress, role string) error {
 			provider.setUpdatedAt(user)
 			u, err := provider.userExists(user, "")
 			if err == nil {
-				executeAction(operationUpdate, executor, ipAddress, actionObjectUser, u.Username, u.Role, &u)
+				executeAction(ctx, operationUpdate, executor, ipAddress, actionObjectUser, u.Username, u.Role, &u)
 			}
 			RemoveCachedWebDAVUser(user)
 		}
-		executeAction(operationDelete, executor, ipAddress, actionObjectGroup, group.Name, role, &group)
+		executeAuditedAction(ctx, operationDelete, executor, ipAddress, actionObjectGroup, group.Name, role, nil, &group)
 	}
 	return err
 }
@@ -1780,31 +2236,67 @@ func GroupExists(name string) (Group, error) {
 
 // AddAPIKey adds a new API key
 func AddAPIKey(apiKey *APIKey, executor, ipAddress, role string) error {
+	return AddAPIKeyContext(context.Background(), apiKey, executor, ipAddress, role)
+}
+
+// AddAPIKeyContext is like AddAPIKey but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func AddAPIKeyContext(ctx context.Context, apiKey *APIKey, executor, ipAddress, role string) error {
 	err := provider.addAPIKey(apiKey)
 	if err == nil {
-		executeAction(operationAdd, executor, ipAddress, actionObjectAPIKey, apiKey.KeyID, role, apiKey)
+		executeAuditedAction(ctx, operationAdd, executor, ipAddress, actionObjectAPIKey, apiKey.KeyID, role, nil, apiKey)
 	}
 	return err
 }
 
 // UpdateAPIKey updates an existing API key
 func UpdateAPIKey(apiKey *APIKey, executor, ipAddress, role string) error {
+	return UpdateAPIKeyContext(context.Background(), apiKey, executor, ipAddress, role)
+}
+
+// UpdateAPIKeyContext is like UpdateAPIKey but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func UpdateAPIKeyContext(ctx context.Context, apiKey *APIKey, executor, ipAddress, role string) error {
+	before := getAuditLogSnapshot(executor, actionObjectAPIKey, apiKey)
 	err := provider.updateAPIKey(apiKey)
 	if err == nil {
-		executeAction(operationUpdate, executor, ipAddress, actionObjectAPIKey, apiKey.KeyID, role, apiKey)
+		executeAuditedAction(ctx, operationUpdate, executor, ipAddress, actionObjectAPIKey, apiKey.KeyID, role, before, apiKey)
 	}
 	return err
 }
 
+// RotateAPIKey generates a new secret for the API key with the given ID.
+// If gracePeriod is greater than zero the replaced key is still accepted
+// for the specified time
+func RotateAPIKey(keyID string, gracePeriod time.Duration, executor, ipAddress, role string) (APIKey, error) {
+	apiKey, err := provider.apiKeyExists(keyID)
+	if err != nil {
+		return apiKey, err
+	}
+	before := getAuditLogSnapshot(executor, actionObjectAPIKey, &apiKey)
+	apiKey.rotate(gracePeriod)
+	err = provider.rotateAPIKey(&apiKey)
+	if err == nil {
+		executeAuditedAction(context.Background(), operationUpdate, executor, ipAddress, actionObjectAPIKey, apiKey.KeyID, role, before, &apiKey)
+	}
+	return apiKey, err
+}
+
 // DeleteAPIKey deletes an existing API key
 func DeleteAPIKey(keyID string, executor, ipAddress, role string) error {
+	return DeleteAPIKeyContext(context.Background(), keyID, executor, ipAddress, role)
+}
+
+// DeleteAPIKeyContext is like DeleteAPIKey but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func DeleteAPIKeyContext(ctx context.Context, keyID string, executor, ipAddress, role string) error {
 	apiKey, err := provider.apiKeyExists(keyID)
 	if err != nil {
 		return err
 	}
 	err = provider.deleteAPIKey(apiKey)
 	if err == nil {
-		executeAction(operationDelete, executor, ipAddress, actionObjectAPIKey, apiKey.KeyID, role, &apiKey)
+		executeAuditedAction(ctx, operationDelete, executor, ipAddress, actionObjectAPIKey, apiKey.KeyID, role, nil, &apiKey)
 		cachedAPIKeys.Remove(keyID)
 	}
 	return err
@@ -1831,28 +2323,47 @@ func EventActionExists(name string) (BaseEventAction, error) {
 
 // AddEventAction adds a new event action
 func AddEventAction(action *BaseEventAction, executor, ipAddress, role string) error {
+	return AddEventActionContext(context.Background(), action, executor, ipAddress, role)
+}
+
+// AddEventActionContext is like AddEventAction but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func AddEventActionContext(ctx context.Context, action *BaseEventAction, executor, ipAddress, role string) error {
 	action.Name = config.convertName(action.Name)
 	err := provider.addEventAction(action)
 	if err == nil {
-		executeAction(operationAdd, executor, ipAddress, actionObjectEventAction, action.Name, role, action)
+		executeAuditedAction(ctx, operationAdd, executor, ipAddress, actionObjectEventAction, action.Name, role, nil, action)
 	}
 	return err
 }
 
 // UpdateEventAction updates an existing event action
 func UpdateEventAction(action *BaseEventAction, executor, ipAddress, role string) error {
+	return UpdateEventActionContext(context.Background(), action, executor, ipAddress, role)
+}
+
+// UpdateEventActionContext is like UpdateEventAction but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func UpdateEventActionContext(ctx context.Context, action *BaseEventAction, executor, ipAddress, role string) error {
+	before := getAuditLogSnapshot(executor, actionObjectEventAction, action)
 	err := provider.updateEventAction(action)
 	if err == nil {
 		if fnReloadRules != nil {
 			fnReloadRules()
 		}
-		executeAction(operationUpdate, executor, ipAddress, actionObjectEventAction, action.Name, role, action)
+		executeAuditedAction(ctx, operationUpdate, executor, ipAddress, actionObjectEventAction, action.Name, role, before, action)
 	}
 	return err
 }
 
 // DeleteEventAction deletes an existing event action
 func DeleteEventAction(name string, executor, ipAddress, role string) error {
+	return DeleteEventActionContext(context.Background(), name, executor, ipAddress, role)
+}
+
+// DeleteEventActionContext is like DeleteEventAction but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func DeleteEventActionContext(ctx context.Context, name string, executor, ipAddress, role string) error {
 	name = config.convertName(name)
 	action, err := provider.eventActionExists(name)
 	if err != nil {
@@ -1864,14 +2375,15 @@ func DeleteEventAction(name string, executor, ipAddress, role string) error {
 	}
 	err = provider.deleteEventAction(action)
 	if err == nil {
-		executeAction(operationDelete, executor, ipAddress, actionObjectEventAction, action.Name, role, &action)
+		executeAuditedAction(ctx, operationDelete, executor, ipAddress, actionObjectEventAction, action.Name, role, nil, &action)
 	}
 	return err
 }
 
-// GetEventRules returns an array of event rules respecting limit and offset
-func GetEventRules(limit, offset int, order string) ([]EventRule, error) {
-	return provider.getEventRules(limit, offset, order)
+// GetEventRules returns an array of event rules respecting limit and offset,
+// if role is not empty only the rules owned by the role are returned
+func GetEventRules(limit, offset int, order, role string) ([]EventRule, error) {
+	return provider.getEventRules(limit, offset, order, role)
 }
 
 // GetRecentlyUpdatedRules returns the event rules updated after the specified time
@@ -1887,31 +2399,56 @@ func EventRuleExists(name string) (EventRule, error) {
 
 // AddEventRule adds a new event rule
 func AddEventRule(rule *EventRule, executor, ipAddress, role string) error {
+	return AddEventRuleContext(context.Background(), rule, executor, ipAddress, role)
+}
+
+// AddEventRuleContext is like AddEventRule but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func AddEventRuleContext(ctx context.Context, rule *EventRule, executor, ipAddress, role string) error {
 	rule.Name = config.convertName(rule.Name)
+	if err := checkEventRuleTenant(rule); err != nil {
+		return err
+	}
 	err := provider.addEventRule(rule)
 	if err == nil {
 		if fnReloadRules != nil {
 			fnReloadRules()
 		}
-		executeAction(operationAdd, executor, ipAddress, actionObjectEventRule, rule.Name, role, rule)
+		executeAuditedAction(ctx, operationAdd, executor, ipAddress, actionObjectEventRule, rule.Name, role, nil, rule)
 	}
 	return err
 }
 
 // UpdateEventRule updates an existing event rule
 func UpdateEventRule(rule *EventRule, executor, ipAddress, role string) error {
+	return UpdateEventRuleContext(context.Background(), rule, executor, ipAddress, role)
+}
+
+// UpdateEventRuleContext is like UpdateEventRule but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func UpdateEventRuleContext(ctx context.Context, rule *EventRule, executor, ipAddress, role string) error {
+	if err := checkEventRuleTenant(rule); err != nil {
+		return err
+	}
+	before := getAuditLogSnapshot(executor, actionObjectEventRule, rule)
 	err := provider.updateEventRule(rule)
 	if err == nil {
 		if fnReloadRules != nil {
 			fnReloadRules()
 		}
-		executeAction(operationUpdate, executor, ipAddress, actionObjectEventRule, rule.Name, role, rule)
+		executeAuditedAction(ctx, operationUpdate, executor, ipAddress, actionObjectEventRule, rule.Name, role, before, rule)
 	}
 	return err
 }
 
 // DeleteEventRule deletes an existing event rule
 func DeleteEventRule(name string, executor, ipAddress, role string) error {
+	return DeleteEventRuleContext(context.Background(), name, executor, ipAddress, role)
+}
+
+// DeleteEventRuleContext is like DeleteEventRule but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func DeleteEventRuleContext(ctx context.Context, name string, executor, ipAddress, role string) error {
 	name = config.convertName(name)
 	rule, err := provider.eventRuleExists(name)
 	if err != nil {
@@ -1922,7 +2459,7 @@ func DeleteEventRule(name string, executor, ipAddress, role string) error {
 		if fnRemoveRule != nil {
 			fnRemoveRule(rule.Name)
 		}
-		executeAction(operationDelete, executor, ipAddress, actionObjectEventRule, rule.Name, role, &rule)
+		executeAuditedAction(ctx, operationDelete, executor, ipAddress, actionObjectEventRule, rule.Name, role, nil, &rule)
 	}
 	return err
 }
@@ -1983,30 +2520,55 @@ func HasAdmin() bool {
 
 // AddAdmin adds a new SFTPGo admin
 func AddAdmin(admin *Admin, executor, ipAddress, role string) error {
+	return AddAdminContext(context.Background(), admin, executor, ipAddress, role)
+}
+
+// AddAdminContext is like AddAdmin but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func AddAdminContext(ctx context.Context, admin *Admin, executor, ipAddress, role string) error {
 	admin.Filters.RecoveryCodes = nil
 	admin.Filters.TOTPConfig = AdminTOTPConfig{
 		Enabled: false,
 	}
 	admin.Username = config.convertName(admin.Username)
+	if err := checkAdminRole(admin); err != nil {
+		return err
+	}
 	err := provider.addAdmin(admin)
 	if err == nil {
 		isAdminCreated.Store(true)
-		executeAction(operationAdd, executor, ipAddress, actionObjectAdmin, admin.Username, role, admin)
+		executeAuditedAction(ctx, operationAdd, executor, ipAddress, actionObjectAdmin, admin.Username, role, nil, admin)
 	}
 	return err
 }
 
 // UpdateAdmin updates an existing SFTPGo admin
 func UpdateAdmin(admin *Admin, executor, ipAddress, role string) error {
+	return UpdateAdminContext(context.Background(), admin, executor, ipAddress, role)
+}
+
+// UpdateAdminContext is like UpdateAdmin but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func UpdateAdminContext(ctx context.Context, admin *Admin, executor, ipAddress, role string) error {
+	if err := checkAdminRole(admin); err != nil {
+		return err
+	}
+	before := getAuditLogSnapshot(executor, actionObjectAdmin, admin)
 	err := provider.updateAdmin(admin)
 	if err == nil {
-		executeAction(operationUpdate, executor, ipAddress, actionObjectAdmin, admin.Username, role, admin)
+		executeAuditedAction(ctx, operationUpdate, executor, ipAddress, actionObjectAdmin, admin.Username, role, before, admin)
 	}
 	return err
 }
 
 // DeleteAdmin deletes an existing SFTPGo admin
 func DeleteAdmin(username, executor, ipAddress, role string) error {
+	return DeleteAdminContext(context.Background(), username, executor, ipAddress, role)
+}
+
+// DeleteAdminContext is like DeleteAdmin but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func DeleteAdminContext(ctx context.Context, username, executor, ipAddress, role string) error {
 	username = config.convertName(username)
 	admin, err := provider.adminExists(username)
 	if err != nil {
@@ -2014,7 +2576,7 @@ func DeleteAdmin(username, executor, ipAddress, role string) error {
 	}
 	err = provider.deleteAdmin(admin)
 	if err == nil {
-		executeAction(operationDelete, executor, ipAddress, actionObjectAdmin, admin.Username, role, &admin)
+		executeAuditedAction(ctx, operationDelete, executor, ipAddress, actionObjectAdmin, admin.Username, role, nil, &admin)
 		cachedAdminPasswords.Remove(username)
 	}
 	return err
@@ -2059,10 +2621,19 @@ func GetUserVariants(username, role string) (User, User, error) {
 
 // AddUser adds a new SFTPGo user.
 func AddUser(user *User, executor, ipAddress, role string) error {
+	return AddUserContext(context.Background(), user, executor, ipAddress, role)
+}
+
+// AddUserContext is like AddUser but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func AddUserContext(ctx context.Context, user *User, executor, ipAddress, role string) error {
 	user.Username = config.convertName(user.Username)
+	if err := applyTenantSettings(user); err != nil {
+		return err
+	}
 	err := provider.addUser(user)
 	if err == nil {
-		executeAction(operationAdd, executor, ipAddress, actionObjectUser, user.Username, role, user)
+		executeAuditedAction(ctx, operationAdd, executor, ipAddress, actionObjectUser, user.Username, role, nil, user)
 	}
 	return err
 }
@@ -2084,30 +2655,47 @@ func UpdateUserPassword(username, plainPwd, executor, ipAddress, role string) er
 	user.LastPasswordChange = userCopy.LastPasswordChange
 	user.Password = userCopy.Password
 	user.Filters.RequirePasswordChange = false
+	before := getAuditLogSnapshot(executor, actionObjectUser, &user)
 	// the last password change is set when validating the user
 	if err := provider.updateUser(&user); err != nil {
 		return err
 	}
 	webDAVUsersCache.swap(&user, plainPwd)
-	executeAction(operationUpdate, executor, ipAddress, actionObjectUser, username, role, &user)
+	executeAuditedAction(context.Background(), operationUpdate, executor, ipAddress, actionObjectUser, username, role, before, &user)
 	return nil
 }
 
 // UpdateUser updates an existing SFTPGo user.
 func UpdateUser(user *User, executor, ipAddress, role string) error {
+	return UpdateUserContext(context.Background(), user, executor, ipAddress, role)
+}
+
+// UpdateUserContext is like UpdateUser but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func UpdateUserContext(ctx context.Context, user *User, executor, ipAddress, role string) error {
 	if user.groupSettingsApplied {
 		return errors.New("cannot save a user with group settings applied")
 	}
+	if err := applyTenantSettings(user); err != nil {
+		return err
+	}
+	before := getAuditLogSnapshot(executor, actionObjectUser, user)
 	err := provider.updateUser(user)
 	if err == nil {
 		webDAVUsersCache.swap(user, "")
-		executeAction(operationUpdate, executor, ipAddress, actionObjectUser, user.Username, role, user)
+		executeAuditedAction(ctx, operationUpdate, executor, ipAddress, actionObjectUser, user.Username, role, before, user)
 	}
 	return err
 }
 
 // DeleteUser deletes an existing SFTPGo user.
 func DeleteUser(username, executor, ipAddress, role string) error {
+	return DeleteUserContext(context.Background(), username, executor, ipAddress, role)
+}
+
+// DeleteUserContext is like DeleteUser but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func DeleteUserContext(ctx context.Context, username, executor, ipAddress, role string) error {
 	username = config.convertName(username)
 	user, err := provider.userExists(username, role)
 	if err != nil {
@@ -2118,7 +2706,7 @@ func DeleteUser(username, executor, ipAddress, role string) error {
 		RemoveCachedWebDAVUser(user.Username)
 		delayedQuotaUpdater.resetUserQuota(user.Username)
 		cachedUserPasswords.Remove(username)
-		executeAction(operationDelete, executor, ipAddress, actionObjectUser, user.Username, role, &user)
+		executeAuditedAction(ctx, operationDelete, executor, ipAddress, actionObjectUser, user.Username, role, nil, &user)
 	}
 	return err
 }
@@ -2187,6 +2775,12 @@ func GetSharedSession(key string) (Session, error) {
 	return provider.getSharedSession(key)
 }
 
+// GetSharedSessions returns the shared sessions with the specified type that
+// expire after the specified time
+func GetSharedSessions(sessionType SessionType, after time.Time) ([]Session, error) {
+	return provider.getSharedSessions(sessionType, util.GetTimeAsMsSinceEpoch(after))
+}
+
 // CleanupSharedSessions removes the shared session with the specified type and
 // before the specified time
 func CleanupSharedSessions(sessionType SessionType, before time.Time) error {
@@ -2221,14 +2815,20 @@ func GetAdmins(limit, offset int, order string) ([]Admin, error) {
 	return provider.getAdmins(limit, offset, order)
 }
 
+// GetAdminRoles returns an array of admin roles respecting limit and offset
+func GetAdminRoles(limit, offset int, order string, minimal bool) ([]AdminRole, error) {
+	return provider.getAdminRoles(limit, offset, order, minimal)
+}
+
 // GetRoles returns an array of roles respecting limit and offset
 func GetRoles(limit, offset int, order string, minimal bool) ([]Role, error) {
 	return provider.getRoles(limit, offset, order, minimal)
 }
 
-// GetGroups returns an array of groups respecting limit and offset
-func GetGroups(limit, offset int, order string, minimal bool) ([]Group, error) {
-	return provider.getGroups(limit, offset, order, minimal)
+// GetGroups returns an array of groups respecting limit and offset,
+// if role is not empty only the groups owned by the role are returned
+func GetGroups(limit, offset int, order string, minimal bool, role string) ([]Group, error) {
+	return provider.getGroups(limit, offset, order, minimal, role)
 }
 
 // GetUsers returns an array of users respecting limit and offset
@@ -2243,19 +2843,40 @@ func GetUsersForQuotaCheck(toFetch map[string]bool) ([]User, error) {
 
 // AddFolder adds a new virtual folder.
 func AddFolder(folder *vfs.BaseVirtualFolder, executor, ipAddress, role string) error {
+	return AddFolderContext(context.Background(), folder, executor, ipAddress, role)
+}
+
+// AddFolderContext is like AddFolder but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func AddFolderContext(ctx context.Context, folder *vfs.BaseVirtualFolder, executor, ipAddress, role string) error {
 	folder.Name = config.convertName(folder.Name)
+	if err := checkFolderTenant(folder, nil, nil); err != nil {
+		return err
+	}
 	err := provider.addFolder(folder)
 	if err == nil {
-		executeAction(operationAdd, executor, ipAddress, actionObjectFolder, folder.Name, role, &wrappedFolder{Folder: *folder})
+		executeAuditedAction(ctx, operationAdd, executor, ipAddress, actionObjectFolder, folder.Name, role, nil,
+			&wrappedFolder{Folder: *folder})
 	}
 	return err
 }
 
 // UpdateFolder updates the specified virtual folder
 func UpdateFolder(folder *vfs.BaseVirtualFolder, users []string, groups []string, executor, ipAddress, role string) error {
+	return UpdateFolderContext(context.Background(), folder, users, groups, executor, ipAddress, role)
+}
+
+// UpdateFolderContext is like UpdateFolder but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func UpdateFolderContext(ctx context.Context, folder *vfs.BaseVirtualFolder, users []string, groups []string, executor, ipAddress, role string) error {
+	if err := checkFolderTenant(folder, users, groups); err != nil {
+		return err
+	}
+	before := getAuditLogSnapshot(executor, actionObjectFolder, &wrappedFolder{Folder: *folder})
 	err := provider.updateFolder(folder)
 	if err == nil {
-		executeAction(operationUpdate, executor, ipAddress, actionObjectFolder, folder.Name, role, &wrappedFolder{Folder: *folder})
+		executeAuditedAction(ctx, operationUpdate, executor, ipAddress, actionObjectFolder, folder.Name, role, before,
+			&wrappedFolder{Folder: *folder})
 		usersInGroups, errGrp := provider.getUsersInGroups(groups)
 		if errGrp == nil {
 			users = append(users, usersInGroups...)
@@ -2268,7 +2889,7 @@ func UpdateFolder(folder *vfs.BaseVirtualFolder, users []string, groups []string
 			u, err := provider.userExists(user, "")
 			if err == nil {
 				webDAVUsersCache.swap(&u, "")
-				executeAction(operationUpdate, executor, ipAddress, actionObjectUser, u.Username, u.Role, &u)
+				executeAction(ctx, operationUpdate, executor, ipAddress, actionObjectUser, u.Username, u.Role, &u)
 			} else {
 				RemoveCachedWebDAVUser(user)
 			}
@@ -2279,6 +2900,12 @@ func UpdateFolder(folder *vfs.BaseVirtualFolder, users []string, groups []string
 
 // DeleteFolder deletes an existing folder.
 func DeleteFolder(folderName, executor, ipAddress, role string) error {
+	return DeleteFolderContext(context.Background(), folderName, executor, ipAddress, role)
+}
+
+// DeleteFolderContext is like DeleteFolder but the provider actions and the event rules
+// get the correlation ID carried by ctx, if any
+func DeleteFolderContext(ctx context.Context, folderName, executor, ipAddress, role string) error {
 	folderName = config.convertName(folderName)
 	folder, err := provider.getFolderByName(folderName)
 	if err != nil {
@@ -2286,7 +2913,8 @@ func DeleteFolder(folderName, executor, ipAddress, role string) error {
 	}
 	err = provider.deleteFolder(folder)
 	if err == nil {
-		executeAction(operationDelete, executor, ipAddress, actionObjectFolder, folder.Name, role, &wrappedFolder{Folder: folder})
+		executeAuditedAction(ctx, operationDelete, executor, ipAddress, actionObjectFolder, folder.Name, role, nil,
+			&wrappedFolder{Folder: folder})
 		users := folder.Users
 		usersInGroups, errGrp := provider.getUsersInGroups(folder.Groups)
 		if errGrp == nil {
@@ -2299,11 +2927,12 @@ func DeleteFolder(folderName, executor, ipAddress, role string) error {
 			provider.setUpdatedAt(user)
 			u, err := provider.userExists(user, "")
 			if err == nil {
-				executeAction(operationUpdate, executor, ipAddress, actionObjectUser, u.Username, u.Role, &u)
+				executeAction(ctx, operationUpdate, executor, ipAddress, actionObjectUser, u.Username, u.Role, &u)
 			}
 			RemoveCachedWebDAVUser(user)
 		}
 		delayedQuotaUpdater.resetFolderQuota(folderName)
+		vfs.RemoveFolderFailoverStatus(folderName)
 	}
 	return err
 }
@@ -2314,9 +2943,10 @@ func GetFolderByName(name string) (vfs.BaseVirtualFolder, error) {
 	return provider.getFolderByName(name)
 }
 
-// GetFolders returns an array of folders respecting limit and offset
-func GetFolders(limit, offset int, order string, minimal bool) ([]vfs.BaseVirtualFolder, error) {
-	return provider.getFolders(limit, offset, order, minimal)
+// GetFolders returns an array of folders respecting limit and offset,
+// if role is not empty only the folders owned by the role are returned
+func GetFolders(limit, offset int, order string, minimal bool, role string) ([]vfs.BaseVirtualFolder, error) {
+	return provider.getFolders(limit, offset, order, minimal, role)
 }
 
 func dumpUsers(data *BackupData, scopes []string) error {
@@ -2418,6 +3048,17 @@ func dumpRoles(data *BackupData, scopes []string) error {
 	return nil
 }
 
+func dumpAdminRoles(data *BackupData, scopes []string) error {
+	if len(scopes) == 0 || util.Contains(scopes, DumpScopeAdminRoles) {
+		roles, err := provider.dumpAdminRoles()
+		if err != nil {
+			return err
+		}
+		data.AdminRoles = roles
+	}
+	return nil
+}
+
 func dumpIPLists(data *BackupData, scopes []string) error {
 	if len(scopes) == 0 || util.Contains(scopes, DumpScopeIPLists) {
 		ipLists, err := provider.dumpIPListEntries()
@@ -2473,6 +3114,9 @@ func DumpData(scopes []string) (BackupData, error) {
 	if err := dumpRoles(&data, scopes); err != nil {
 		return data, err
 	}
+	if err := dumpAdminRoles(&data, scopes); err != nil {
+		return data, err
+	}
 	if err := dumpIPLists(&data, scopes); err != nil {
 		return data, err
 	}
@@ -2538,6 +3182,8 @@ func createProvider(basePath string) error {
 	case MemoryDataProviderName:
 		initializeMemoryProvider(basePath)
 		return nil
+	case EtcdDataProviderName:
+		return initializeEtcdProvider()
 	default:
 		return fmt.Errorf("unsupported data provider: %v", config.Driver)
 	}
@@ -2595,7 +3241,8 @@ func buildUserHomeDir(user *User) {
 			return
 		}
 		switch user.FsConfig.Provider {
-		case sdk.SFTPFilesystemProvider, sdk.S3FilesystemProvider, sdk.AzureBlobFilesystemProvider, sdk.GCSFilesystemProvider, sdk.HTTPFilesystemProvider:
+		case sdk.SFTPFilesystemProvider, sdk.S3FilesystemProvider, sdk.AzureBlobFilesystemProvider, sdk.GCSFilesystemProvider,
+			sdk.HTTPFilesystemProvider, vfs.WebDAVFilesystemProvider:
 			if tempPath != "" {
 				user.HomeDir = filepath.Join(tempPath, user.Username)
 			} else {
@@ -2809,17 +3456,31 @@ func validatePublicKeys(user *User) error {
 		user.PublicKeys = []string{}
 	}
 	var validatedKeys []string
+	var fingerprints []string
 	for i, k := range user.PublicKeys {
 		if k == "" {
 			continue
 		}
-		_, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
 		if err != nil {
 			return util.NewValidationError(fmt.Sprintf("could not parse key nr. %d: %s", i+1, err))
 		}
 		validatedKeys = append(validatedKeys, k)
+		fingerprints = append(fingerprints, ssh.FingerprintSHA256(pubKey))
 	}
 	user.PublicKeys = util.RemoveDuplicates(validatedKeys, false)
+	// expiration dates for keys no longer associated to the user are silently removed,
+	// only the first expiration date is kept for each key
+	fingerprints = util.RemoveDuplicates(fingerprints, false)
+	var expirations []PublicKeyExpiration
+	for _, exp := range user.Filters.PublicKeysExpiration {
+		if exp.ExpiresAt <= 0 || !util.Contains(fingerprints, exp.Fingerprint) {
+			continue
+		}
+		fingerprints = util.Remove(fingerprints, exp.Fingerprint)
+		expirations = append(expirations, exp)
+	}
+	user.Filters.PublicKeysExpiration = expirations
 	return nil
 }
 
@@ -2887,22 +3548,37 @@ func checkEmptyFiltersStruct(filters *sdk.BaseUserFilters) {
 
 func validateIPFilters(filters *sdk.BaseUserFilters) error {
 	filters.DeniedIP = util.RemoveDuplicates(filters.DeniedIP, false)
-	for _, IPMask := range filters.DeniedIP {
-		_, _, err := net.ParseCIDR(IPMask)
+	for idx, IPMask := range filters.DeniedIP {
+		filter, err := validateIPFilter(IPMask)
 		if err != nil {
 			return util.NewValidationError(fmt.Sprintf("could not parse denied IP/Mask %q: %v", IPMask, err))
 		}
+		filters.DeniedIP[idx] = filter
 	}
 	filters.AllowedIP = util.RemoveDuplicates(filters.AllowedIP, false)
-	for _, IPMask := range filters.AllowedIP {
-		_, _, err := net.ParseCIDR(IPMask)
+	for idx, IPMask := range filters.AllowedIP {
+		filter, err := validateIPFilter(IPMask)
 		if err != nil {
 			return util.NewValidationError(fmt.Sprintf("could not parse allowed IP/Mask %q: %v", IPMask, err))
 		}
+		filters.AllowedIP[idx] = filter
 	}
 	return nil
 }
 
+// validateIPFilter validates an IP/Mask or a country filter such as
+// "country:IT" and returns the normalized filter
+func validateIPFilter(filter string) (string, error) {
+	if country, ok := geoip.ParseCountryEntry(filter); ok {
+		if !geoip.IsValidCountryCode(country) {
+			return "", fmt.Errorf("invalid country code %q", country)
+		}
+		return geoip.CountryPrefix + country, nil
+	}
+	_, _, err := net.ParseCIDR(filter)
+	return filter, err
+}
+
 func validateBandwidthLimit(bl sdk.BandwidthLimit) error {
 	if len(bl.Sources) == 0 {
 		return util.NewValidationError("no bandwidth limit source specified")
@@ -3082,6 +3758,9 @@ func createUserPasswordHash(user *User) error {
 // FIXME: this should be defined as Folder struct method
 func ValidateFolder(folder *vfs.BaseVirtualFolder) error {
 	folder.FsConfig.SetEmptySecretsIfNil()
+	if folder.Failover != nil {
+		folder.Failover.FsConfig.SetEmptySecretsIfNil()
+	}
 	if folder.Name == "" {
 		return util.NewValidationError("folder name is mandatory")
 	}
@@ -3100,7 +3779,61 @@ func ValidateFolder(folder *vfs.BaseVirtualFolder) error {
 	if folder.HasRedactedSecret() {
 		return errors.New("cannot save a folder with a redacted secret")
 	}
-	return folder.FsConfig.Validate(folder.GetEncryptionAdditionalData())
+	if err := folder.FsConfig.Validate(folder.GetEncryptionAdditionalData()); err != nil {
+		return err
+	}
+	if err := validateFolderLimits(folder); err != nil {
+		return err
+	}
+	return validateFolderFailover(folder)
+}
+
+func validateFolderLimits(folder *vfs.BaseVirtualFolder) error {
+	if folder.Limits == nil {
+		return nil
+	}
+	if folder.Limits.UploadBandwidth < 0 || folder.Limits.DownloadBandwidth < 0 {
+		return util.NewValidationError("folder bandwidth limits cannot be negative")
+	}
+	if folder.Limits.MaxConcurrentTransfers < 0 {
+		return util.NewValidationError("the maximum number of concurrent transfers cannot be negative")
+	}
+	if !folder.Limits.HasLimits() {
+		folder.Limits = nil
+	}
+	return nil
+}
+
+func validateFolderFailover(folder *vfs.BaseVirtualFolder) error {
+	if folder.Failover == nil {
+		return nil
+	}
+	failover := folder.Failover
+	if folder.HasFailoverPathPlaceholder() {
+		return util.NewValidationError("a secondary storage backend is not supported for folders with path placeholders")
+	}
+	if failover.FsConfig.Provider == sdk.LocalFilesystemProvider || failover.FsConfig.Provider == sdk.CryptedFilesystemProvider ||
+		failover.MappedPath != "" {
+		cleanedMPath := filepath.Clean(failover.MappedPath)
+		if !filepath.IsAbs(cleanedMPath) {
+			return util.NewValidationError(fmt.Sprintf("invalid failover mapped path %q", failover.MappedPath))
+		}
+		failover.MappedPath = cleanedMPath
+	}
+	if (folder.FsConfig.Provider == sdk.LocalFilesystemProvider || folder.FsConfig.Provider == sdk.CryptedFilesystemProvider) &&
+		failover.FsConfig.Provider == folder.FsConfig.Provider && failover.MappedPath == folder.MappedPath {
+		return util.NewValidationError("the secondary storage backend must be different from the primary one")
+	}
+	if failover.Timeout < 0 {
+		return util.NewValidationError(fmt.Sprintf("invalid failover timeout: %d", failover.Timeout))
+	}
+	if failover.RetryInterval < 0 {
+		return util.NewValidationError(fmt.Sprintf("invalid failover retry interval: %d", failover.RetryInterval))
+	}
+	if err := failover.FsConfig.Validate(folder.GetFailoverEncryptionAdditionalData()); err != nil {
+		return util.NewValidationError(fmt.Sprintf("invalid failover filesystem: %v", err))
+	}
+	return nil
 }
 
 // ValidateUser returns an error if the user is not valid
@@ -3139,15 +3872,67 @@ func ValidateUser(user *User) error {
 	if err := validatePublicKeys(user); err != nil {
 		return err
 	}
+	if err := validateUserWebhooks(user); err != nil {
+		return err
+	}
+	if err := validateClientEncryptedFolders(user); err != nil {
+		return err
+	}
+	if err := validateStagingFolders(user); err != nil {
+		return err
+	}
+	if err := validateBandwidthSchedules(user); err != nil {
+		return err
+	}
+	if err := validateUserConsents(user); err != nil {
+		return err
+	}
+	if err := validateUserAccessConditions(user); err != nil {
+		return err
+	}
+	if err := validateUserCertSettings(user); err != nil {
+		return err
+	}
+	if err := validateUserSSHCommands(user); err != nil {
+		return err
+	}
+	// enabled users are no longer awaiting the registration approval
+	if user.Filters.PendingRegistration < 0 || user.Status == 1 {
+		user.Filters.PendingRegistration = 0
+	}
 	if err := validateBaseFilters(&user.Filters.BaseUserFilters); err != nil {
 		return err
 	}
+	policies, err := validateSessionPolicies(user.Filters.SessionPolicies)
+	if err != nil {
+		return err
+	}
+	user.Filters.SessionPolicies = policies
+	priorityClass, err := validatePriorityClass(user.Filters.PriorityClass)
+	if err != nil {
+		return err
+	}
+	user.Filters.PriorityClass = priorityClass
+	if user.Filters.FTPMaxTransfers < 0 {
+		return util.NewValidationError(fmt.Sprintf("invalid FTP max transfers: %d", user.Filters.FTPMaxTransfers))
+	}
+	if err := user.Filters.PassivePortRange.validate(); err != nil {
+		return err
+	}
 	if !user.HasExternalAuth() {
 		user.Filters.ExternalAuthCacheTime = 0
 	}
 	return validateCombinedUserFilters(user)
 }
 
+func validatePriorityClass(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if len(name) > 255 {
+		return "", util.NewValidationError("priority class too long, max 255 characters")
+	}
+	return name, nil
+}
+
 func isPasswordOK(user *User, password string) (bool, error) {
 	if config.PasswordCaching {
 		found, match := cachedUserPasswords.Check(user.Username, password, user.Password)
@@ -3216,20 +4001,67 @@ func checkUserAndTLSCertificate(user *User, protocol string, tlsCert *x509.Certi
 		return *user, err
 	}
 	switch protocol {
-	case protocolFTP, protocolWebDAV:
-		if user.Filters.TLSUsername == sdk.TLSUsernameCN {
-			if user.Username == tlsCert.Subject.CommonName {
-				return *user, nil
+	case protocolFTP, protocolWebDAV, protocolHTTP:
+		return *user, checkTLSUsername(user, tlsCert)
+	default:
+		return *user, fmt.Errorf("certificate authentication is not supported for protocol %v", protocol)
+	}
+}
+
+// checkTLSUsername checks that the TLS certificate field configured for the
+// user matches the username
+func checkTLSUsername(user *User, tlsCert *x509.Certificate) error {
+	switch user.Filters.TLSUsername {
+	case sdk.TLSUsernameCN:
+		if user.Username == tlsCert.Subject.CommonName {
+			return nil
+		}
+		return fmt.Errorf("CN %q does not match username %q", tlsCert.Subject.CommonName, user.Username)
+	case TLSUsernameSAN:
+		for _, name := range tlsCert.DNSNames {
+			if strings.EqualFold(name, user.Username) {
+				return nil
 			}
-			return *user, fmt.Errorf("CN %q does not match username %q", tlsCert.Subject.CommonName, user.Username)
 		}
-		return *user, errors.New("TLS certificate is not valid")
+		for _, email := range tlsCert.EmailAddresses {
+			if strings.EqualFold(email, user.Username) {
+				return nil
+			}
+		}
+		return fmt.Errorf("no subject alternative name matches username %q, DNS names: %v, emails: %v",
+			user.Username, tlsCert.DNSNames, tlsCert.EmailAddresses)
 	default:
-		return *user, fmt.Errorf("certificate authentication is not supported for protocol %v", protocol)
+		return errors.New("TLS certificate is not valid")
 	}
 }
 
-func checkUserAndPass(user *User, password, ip, protocol string) (User, error) {
+func logTLSCertificateAuth(username, ip, loginMethod, protocol string, tlsCert *x509.Certificate, err error) {
+	if tlsCert == nil {
+		return
+	}
+	var errString string
+	if err != nil {
+		errString = err.Error()
+	}
+	logger.TLSCertificateAuthLog(username, ip, loginMethod, protocol, tlsCert.Subject.String(),
+		getTLSCertificateSerial(tlsCert), errString)
+}
+
+// getTLSCertificateSerial returns the serial number of the specified
+// certificate as colon separated hex bytes, the format used by OpenSSL
+func getTLSCertificateSerial(tlsCert *x509.Certificate) string {
+	if tlsCert.SerialNumber == nil {
+		return ""
+	}
+	serial := tlsCert.SerialNumber.Bytes()
+	parts := make([]string, 0, len(serial))
+	for _, b := range serial {
+		parts = append(parts, fmt.Sprintf("%02X", b))
+	}
+	return strings.Join(parts, ":")
+}
+
+func checkUserAndPass(ctx context.Context, user *User, password, ip, protocol string) (User, error) {
 	err := user.LoadAndApplyGroupSettings()
 	if err != nil {
 		return *user, err
@@ -3253,7 +4085,7 @@ func checkUserAndPass(user *User, password, ip, protocol string) (User, error) {
 		return *user, errors.New("credentials cannot be null or empty")
 	}
 	if !user.Filters.Hooks.CheckPasswordDisabled {
-		hookResponse, err := executeCheckPasswordHook(user.Username, password, ip, protocol)
+		hookResponse, err := executeCheckPasswordHook(ctx, user.Username, password, ip, protocol)
 		if err != nil {
 			providerLog(logger.LevelDebug, "error executing check password hook for user %q, ip %v, protocol %v: %v",
 				user.Username, ip, protocol, err)
@@ -3340,7 +4172,12 @@ func checkUserAndPubKey(user *User, pubKey []byte, isSSHCert bool) (User, string
 			return *user, "", err
 		}
 		if bytes.Equal(storedPubKey.Marshal(), pubKey) {
-			return *user, fmt.Sprintf("%s:%s", ssh.FingerprintSHA256(storedPubKey), comment), nil
+			fp := ssh.FingerprintSHA256(storedPubKey)
+			if user.IsPublicKeyExpired(fp) {
+				providerLog(logger.LevelInfo, "public key %q for user %q is expired", fp, user.Username)
+				return *user, "", ErrInvalidCredentials
+			}
+			return *user, fmt.Sprintf("%s:%s", fp, comment), nil
 		}
 	}
 	return *user, "", ErrInvalidCredentials
@@ -3464,13 +4301,13 @@ func terminateInteractiveAuthProgram(cmd *exec.Cmd, isFinished bool) {
 	}
 }
 
-func sendKeyboardAuthHTTPReq(url string, request *plugin.KeyboardAuthRequest) (*plugin.KeyboardAuthResponse, error) {
+func sendKeyboardAuthHTTPReq(ctx context.Context, url string, request *plugin.KeyboardAuthRequest) (*plugin.KeyboardAuthResponse, error) {
 	reqAsJSON, err := json.Marshal(request)
 	if err != nil {
 		providerLog(logger.LevelError, "error serializing keyboard interactive auth request: %v", err)
 		return nil, err
 	}
-	resp, err := httpclient.Post(url, "application/json", bytes.NewBuffer(reqAsJSON))
+	resp, err := httpclient.PostWithClientIP(ctx, url, "application/json", bytes.NewBuffer(reqAsJSON), request.IP)
 	if err != nil {
 		providerLog(logger.LevelError, "error getting keyboard interactive auth hook HTTP response: %v", err)
 		return nil, err
@@ -3484,7 +4321,7 @@ func sendKeyboardAuthHTTPReq(url string, request *plugin.KeyboardAuthRequest) (*
 	return &response, err
 }
 
-func doBuiltinKeyboardInteractiveAuth(user *User, client ssh.KeyboardInteractiveChallenge, ip, protocol string) (int, error) {
+func doBuiltinKeyboardInteractiveAuth(ctx context.Context, user *User, client ssh.KeyboardInteractiveChallenge, ip, protocol string) (int, error) {
 	answers, err := client("", "", []string{"Password: "}, []bool{false})
 	if err != nil {
 		return 0, err
@@ -3496,7 +4333,7 @@ func doBuiltinKeyboardInteractiveAuth(user *User, client ssh.KeyboardInteractive
 	if err != nil {
 		return 0, err
 	}
-	_, err = checkUserAndPass(user, answers[0], ip, protocol)
+	_, err = checkUserAndPass(ctx, user, answers[0], ip, protocol)
 	if err != nil {
 		return 0, err
 	}
@@ -3530,7 +4367,7 @@ func checkKeyboardInteractiveSecondFactor(user *User, client ssh.KeyboardInterac
 	return 1, nil
 }
 
-func executeKeyboardInteractivePlugin(user *User, client ssh.KeyboardInteractiveChallenge, ip, protocol string) (int, error) {
+func executeKeyboardInteractivePlugin(ctx context.Context, user *User, client ssh.KeyboardInteractiveChallenge, ip, protocol string) (int, error) {
 	authResult := 0
 	requestID := xid.New().String()
 	authStep := 1
@@ -3555,7 +4392,7 @@ func executeKeyboardInteractivePlugin(user *User, client ssh.KeyboardInteractive
 			providerLog(logger.LevelInfo, "invalid response from keyboard interactive plugin: %v", err)
 			return authResult, err
 		}
-		answers, err := getKeyboardInteractiveAnswers(client, response, user, ip, protocol)
+		answers, err := getKeyboardInteractiveAnswers(ctx, client, response, user, ip, protocol)
 		if err != nil {
 			return authResult, err
 		}
@@ -3571,7 +4408,7 @@ func executeKeyboardInteractivePlugin(user *User, client ssh.KeyboardInteractive
 	}
 }
 
-func executeKeyboardInteractiveHTTPHook(user *User, authHook string, client ssh.KeyboardInteractiveChallenge, ip, protocol string) (int, error) {
+func executeKeyboardInteractiveHTTPHook(ctx context.Context, user *User, authHook string, client ssh.KeyboardInteractiveChallenge, ip, protocol string) (int, error) {
 	authResult := 0
 	requestID := xid.New().String()
 	authStep := 1
@@ -3585,7 +4422,7 @@ func executeKeyboardInteractiveHTTPHook(user *User, authHook string, client ssh.
 	var response *plugin.KeyboardAuthResponse
 	var err error
 	for {
-		response, err = sendKeyboardAuthHTTPReq(authHook, req)
+		response, err = sendKeyboardAuthHTTPReq(ctx, authHook, req)
 		if err != nil {
 			return authResult, err
 		}
@@ -3596,7 +4433,7 @@ func executeKeyboardInteractiveHTTPHook(user *User, authHook string, client ssh.
 			providerLog(logger.LevelInfo, "invalid response from keyboard interactive http hook: %v", err)
 			return authResult, err
 		}
-		answers, err := getKeyboardInteractiveAnswers(client, response, user, ip, protocol)
+		answers, err := getKeyboardInteractiveAnswers(ctx, client, response, user, ip, protocol)
 		if err != nil {
 			return authResult, err
 		}
@@ -3612,7 +4449,7 @@ func executeKeyboardInteractiveHTTPHook(user *User, authHook string, client ssh.
 	}
 }
 
-func getKeyboardInteractiveAnswers(client ssh.KeyboardInteractiveChallenge, response *plugin.KeyboardAuthResponse,
+func getKeyboardInteractiveAnswers(ctx context.Context, client ssh.KeyboardInteractiveChallenge, response *plugin.KeyboardAuthResponse,
 	user *User, ip, protocol string,
 ) ([]string, error) {
 	questions := response.Questions
@@ -3647,7 +4484,7 @@ func getKeyboardInteractiveAnswers(client ssh.KeyboardInteractiveChallenge, resp
 				return answers, errors.New("unable to validate TOTP passcode")
 			}
 		} else {
-			_, err = checkUserAndPass(user, answers[0], ip, protocol)
+			_, err = checkUserAndPass(ctx, user, answers[0], ip, protocol)
 			providerLog(logger.LevelInfo, "interactive auth hook requested password validation for user %q, validation error: %v",
 				user.Username, err)
 			if err != nil {
@@ -3659,10 +4496,10 @@ func getKeyboardInteractiveAnswers(client ssh.KeyboardInteractiveChallenge, resp
 	return answers, err
 }
 
-func handleProgramInteractiveQuestions(client ssh.KeyboardInteractiveChallenge, response *plugin.KeyboardAuthResponse,
+func handleProgramInteractiveQuestions(ctx context.Context, client ssh.KeyboardInteractiveChallenge, response *plugin.KeyboardAuthResponse,
 	user *User, stdin io.WriteCloser, ip, protocol string,
 ) error {
-	answers, err := getKeyboardInteractiveAnswers(client, response, user, ip, protocol)
+	answers, err := getKeyboardInteractiveAnswers(ctx, client, response, user, ip, protocol)
 	if err != nil {
 		return err
 	}
@@ -3680,17 +4517,18 @@ func handleProgramInteractiveQuestions(client ssh.KeyboardInteractiveChallenge,
 	return nil
 }
 
-func executeKeyboardInteractiveProgram(user *User, authHook string, client ssh.KeyboardInteractiveChallenge, ip, protocol string) (int, error) {
+func executeKeyboardInteractiveProgram(ctx context.Context, user *User, authHook string, client ssh.KeyboardInteractiveChallenge, ip, protocol string) (int, error) {
 	authResult := 0
 	timeout, env, args := command.GetConfig(authHook, command.HookKeyboardInteractive)
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	cmdCtx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, authHook, args...)
+	cmd := exec.CommandContext(cmdCtx, authHook, args...)
 	cmd.Env = append(env,
 		fmt.Sprintf("SFTPGO_AUTHD_USERNAME=%s", user.Username),
 		fmt.Sprintf("SFTPGO_AUTHD_IP=%s", ip),
-		fmt.Sprintf("SFTPGO_AUTHD_PASSWORD=%s", user.Password))
+		fmt.Sprintf("SFTPGO_AUTHD_PASSWORD=%s", user.Password),
+		fmt.Sprintf("%s=%s", logger.CorrelationIDEnvVar, logger.GetCorrelationID(ctx)))
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return authResult, err
@@ -3723,7 +4561,7 @@ func executeKeyboardInteractiveProgram(user *User, authHook string, client ssh.K
 			break
 		}
 		go func() {
-			err := handleProgramInteractiveQuestions(client, &response, user, stdin, ip, protocol)
+			err := handleProgramInteractiveQuestions(ctx, client, &response, user, stdin, ip, protocol)
 			if err != nil {
 				once.Do(func() { terminateInteractiveAuthProgram(cmd, false) })
 			}
@@ -3741,22 +4579,24 @@ func executeKeyboardInteractiveProgram(user *User, authHook string, client ssh.K
 	return authResult, err
 }
 
-func doKeyboardInteractiveAuth(user *User, authHook string, client ssh.KeyboardInteractiveChallenge, ip, protocol string) (User, error) {
+func doKeyboardInteractiveAuth(ctx context.Context, user *User, authHook string, client ssh.KeyboardInteractiveChallenge, ip, protocol string) (User, error) {
 	var authResult int
 	var err error
 	if plugin.Handler.HasAuthScope(plugin.AuthScopeKeyboardInteractive) {
-		authResult, err = executeKeyboardInteractivePlugin(user, client, ip, protocol)
+		authResult, err = executeKeyboardInteractivePlugin(ctx, user, client, ip, protocol)
 		if authResult == 1 && err == nil {
 			authResult, err = checkKeyboardInteractiveSecondFactor(user, client, protocol)
 		}
 	} else if authHook != "" {
+		span := startHookSpan("keyboard interactive hook", user.Username, ip, protocol)
 		if strings.HasPrefix(authHook, "http") {
-			authResult, err = executeKeyboardInteractiveHTTPHook(user, authHook, client, ip, protocol)
+			authResult, err = executeKeyboardInteractiveHTTPHook(ctx, user, authHook, client, ip, protocol)
 		} else {
-			authResult, err = executeKeyboardInteractiveProgram(user, authHook, client, ip, protocol)
+			authResult, err = executeKeyboardInteractiveProgram(ctx, user, authHook, client, ip, protocol)
 		}
+		tracing.EndSpan(span, err)
 	} else {
-		authResult, err = doBuiltinKeyboardInteractiveAuth(user, client, ip, protocol)
+		authResult, err = doBuiltinKeyboardInteractiveAuth(ctx, user, client, ip, protocol)
 	}
 	if err != nil {
 		return *user, err
@@ -3794,7 +4634,7 @@ func isCheckPasswordHookDefined(protocol string) bool {
 	}
 }
 
-func getPasswordHookResponse(username, password, ip, protocol string) ([]byte, error) {
+func getPasswordHookResponse(ctx context.Context, username, password, ip, protocol string) ([]byte, error) {
 	if strings.HasPrefix(config.CheckPasswordHook, "http") {
 		var result []byte
 		req := checkPasswordRequest{
@@ -3807,7 +4647,7 @@ func getPasswordHookResponse(username, password, ip, protocol string) ([]byte, e
 		if err != nil {
 			return result, err
 		}
-		resp, err := httpclient.Post(config.CheckPasswordHook, "application/json", bytes.NewBuffer(reqAsJSON))
+		resp, err := httpclient.PostWithClientIP(ctx, config.CheckPasswordHook, "application/json", bytes.NewBuffer(reqAsJSON), ip)
 		if err != nil {
 			providerLog(logger.LevelError, "error getting check password hook response: %v", err)
 			return result, err
@@ -3819,20 +4659,21 @@ func getPasswordHookResponse(username, password, ip, protocol string) ([]byte, e
 		return io.ReadAll(io.LimitReader(resp.Body, maxHookResponseSize))
 	}
 	timeout, env, args := command.GetConfig(config.CheckPasswordHook, command.HookCheckPassword)
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	cmdCtx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, config.CheckPasswordHook, args...)
+	cmd := exec.CommandContext(cmdCtx, config.CheckPasswordHook, args...)
 	cmd.Env = append(env,
 		fmt.Sprintf("SFTPGO_AUTHD_USERNAME=%s", username),
 		fmt.Sprintf("SFTPGO_AUTHD_PASSWORD=%s", password),
 		fmt.Sprintf("SFTPGO_AUTHD_IP=%s", ip),
 		fmt.Sprintf("SFTPGO_AUTHD_PROTOCOL=%s", protocol),
+		fmt.Sprintf("%s=%s", logger.CorrelationIDEnvVar, logger.GetCorrelationID(ctx)),
 	)
 	return getCmdOutput(cmd, "check_password_hook")
 }
 
-func executeCheckPasswordHook(username, password, ip, protocol string) (checkPasswordResponse, error) {
+func executeCheckPasswordHook(ctx context.Context, username, password, ip, protocol string) (checkPasswordResponse, error) {
 	var response checkPasswordResponse
 
 	if !isCheckPasswordHookDefined(protocol) {
@@ -3841,7 +4682,9 @@ func executeCheckPasswordHook(username, password, ip, protocol string) (checkPas
 	}
 
 	startTime := time.Now()
-	out, err := getPasswordHookResponse(username, password, ip, protocol)
+	span := startHookSpan("check password hook", username, ip, protocol)
+	out, err := getPasswordHookResponse(ctx, username, password, ip, protocol)
+	tracing.EndSpan(span, err)
 	providerLog(logger.LevelDebug, "check password hook executed, error: %v, elapsed: %v", err, time.Since(startTime))
 	if err != nil {
 		return response, err
@@ -3850,7 +4693,7 @@ func executeCheckPasswordHook(username, password, ip, protocol string) (checkPas
 	return response, err
 }
 
-func getPreLoginHookResponse(loginMethod, ip, protocol string, userAsJSON []byte) ([]byte, error) {
+func getPreLoginHookResponse(ctx context.Context, loginMethod, ip, protocol string, userAsJSON []byte) ([]byte, error) {
 	if strings.HasPrefix(config.PreLoginHook, "http") {
 		var url *url.URL
 		var result []byte
@@ -3865,7 +4708,7 @@ func getPreLoginHookResponse(loginMethod, ip, protocol string, userAsJSON []byte
 		q.Add("protocol", protocol)
 		url.RawQuery = q.Encode()
 
-		resp, err := httpclient.Post(url.String(), "application/json", bytes.NewBuffer(userAsJSON))
+		resp, err := httpclient.PostWithClientIP(ctx, url.String(), "application/json", bytes.NewBuffer(userAsJSON), ip)
 		if err != nil {
 			providerLog(logger.LevelWarn, "error getting pre-login hook response: %v", err)
 			return result, err
@@ -3880,20 +4723,21 @@ func getPreLoginHookResponse(loginMethod, ip, protocol string, userAsJSON []byte
 		return io.ReadAll(io.LimitReader(resp.Body, maxHookResponseSize))
 	}
 	timeout, env, args := command.GetConfig(config.PreLoginHook, command.HookPreLogin)
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	cmdCtx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, config.PreLoginHook, args...)
+	cmd := exec.CommandContext(cmdCtx, config.PreLoginHook, args...)
 	cmd.Env = append(env,
 		fmt.Sprintf("SFTPGO_LOGIND_USER=%s", string(userAsJSON)),
 		fmt.Sprintf("SFTPGO_LOGIND_METHOD=%s", loginMethod),
 		fmt.Sprintf("SFTPGO_LOGIND_IP=%s", ip),
 		fmt.Sprintf("SFTPGO_LOGIND_PROTOCOL=%s", protocol),
+		fmt.Sprintf("%s=%s", logger.CorrelationIDEnvVar, logger.GetCorrelationID(ctx)),
 	)
 	return getCmdOutput(cmd, "pre_login_hook")
 }
 
-func executePreLoginHook(username, loginMethod, ip, protocol string, oidcTokenFields *map[string]any) (User, error) {
+func executePreLoginHook(ctx context.Context, username, loginMethod, ip, protocol string, oidcTokenFields *map[string]any) (User, error) {
 	u, mergedUser, userAsJSON, err := getUserAndJSONForHook(username, oidcTokenFields)
 	if err != nil {
 		return u, err
@@ -3902,7 +4746,9 @@ func executePreLoginHook(username, loginMethod, ip, protocol string, oidcTokenFi
 		return u, nil
 	}
 	startTime := time.Now()
-	out, err := getPreLoginHookResponse(loginMethod, ip, protocol, userAsJSON)
+	span := startHookSpan("pre-login hook", username, ip, protocol)
+	out, err := getPreLoginHookResponse(ctx, loginMethod, ip, protocol, userAsJSON)
+	tracing.EndSpan(span, err)
 	if err != nil {
 		return u, fmt.Errorf("pre-login hook error: %v, username %q, ip %v, protocol %v elapsed %v",
 			err, username, ip, protocol, time.Since(startTime))
@@ -3967,8 +4813,17 @@ func executePreLoginHook(username, loginMethod, ip, protocol string, oidcTokenFi
 	return u, nil
 }
 
-// ExecutePostLoginHook executes the post login hook if defined
-func ExecutePostLoginHook(user *User, loginMethod, ip, protocol string, err error) {
+// ExecutePostLoginHook executes the post login hook if defined and sends the
+// login outcome to the audit log. The hook gets the correlation ID carried by
+// ctx, if any
+func ExecutePostLoginHook(ctx context.Context, user *User, loginMethod, ip, protocol string, err error) {
+	if loginMethod != LoginMethodNoAuthTried {
+		errString := ""
+		if err != nil {
+			errString = err.Error()
+		}
+		logger.AuditLoginLog(user.Username, ip, loginMethod, protocol, errString)
+	}
 	if config.PostLoginHook == "" {
 		return
 	}
@@ -3990,6 +4845,9 @@ func ExecutePostLoginHook(user *User, loginMethod, ip, protocol string, err erro
 			status = "1"
 		}
 
+		span := startHookSpan("post-login hook", user.Username, ip, protocol)
+		defer span.End()
+
 		user.PrepareForRendering()
 		userAsJSON, err := json.Marshal(user)
 		if err != nil {
@@ -4012,7 +4870,7 @@ func ExecutePostLoginHook(user *User, loginMethod, ip, protocol string, err erro
 
 			startTime := time.Now()
 			respCode := 0
-			resp, err := httpclient.RetryablePost(url.String(), "application/json", bytes.NewBuffer(userAsJSON))
+			resp, err := httpclient.RetryablePostWithClientIP(ctx, url.String(), "application/json", bytes.NewBuffer(userAsJSON), ip)
 			if err == nil {
 				respCode = resp.StatusCode
 				resp.Body.Close()
@@ -4022,16 +4880,17 @@ func ExecutePostLoginHook(user *User, loginMethod, ip, protocol string, err erro
 			return
 		}
 		timeout, env, args := command.GetConfig(config.PostLoginHook, command.HookPostLogin)
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		cmdCtx, cancel := context.WithTimeout(context.Background(), timeout)
 		defer cancel()
 
-		cmd := exec.CommandContext(ctx, config.PostLoginHook, args...)
+		cmd := exec.CommandContext(cmdCtx, config.PostLoginHook, args...)
 		cmd.Env = append(env,
 			fmt.Sprintf("SFTPGO_LOGIND_USER=%s", string(userAsJSON)),
 			fmt.Sprintf("SFTPGO_LOGIND_IP=%s", ip),
 			fmt.Sprintf("SFTPGO_LOGIND_METHOD=%s", loginMethod),
 			fmt.Sprintf("SFTPGO_LOGIND_STATUS=%s", status),
-			fmt.Sprintf("SFTPGO_LOGIND_PROTOCOL=%s", protocol))
+			fmt.Sprintf("SFTPGO_LOGIND_PROTOCOL=%s", protocol),
+			fmt.Sprintf("%s=%s", logger.CorrelationIDEnvVar, logger.GetCorrelationID(ctx)))
 		startTime := time.Now()
 		err = cmd.Run()
 		providerLog(logger.LevelDebug, "post login hook executed for user %q, ip %v, protocol %v, elapsed %v err: %v",
@@ -4039,7 +4898,22 @@ func ExecutePostLoginHook(user *User, loginMethod, ip, protocol string, err erro
 	}()
 }
 
-func getExternalAuthResponse(username, password, pkey, keyboardInteractive, ip, protocol string, cert *x509.Certificate,
+func startAuthSpan(username, ip, protocol, loginMethod string) trace.Span {
+	return tracing.StartSpan("", "authenticate",
+		attribute.String("sftpgo.username", username),
+		attribute.String("sftpgo.protocol", protocol),
+		attribute.String("sftpgo.login_method", loginMethod),
+		attribute.String("net.sock.peer.addr", ip))
+}
+
+func startHookSpan(name, username, ip, protocol string) trace.Span {
+	return tracing.StartSpan("", name,
+		attribute.String("sftpgo.username", username),
+		attribute.String("sftpgo.protocol", protocol),
+		attribute.String("net.sock.peer.addr", ip))
+}
+
+func getExternalAuthResponse(ctx context.Context, username, password, pkey, keyboardInteractive, ip, protocol string, cert *x509.Certificate,
 	user User,
 ) ([]byte, error) {
 	var tlsCert string
@@ -4068,7 +4942,7 @@ func getExternalAuthResponse(username, password, pkey, keyboardInteractive, ip,
 			providerLog(logger.LevelError, "error serializing external auth request: %v", err)
 			return result, err
 		}
-		resp, err := httpclient.Post(config.ExternalAuthHook, "application/json", bytes.NewBuffer(authRequestAsJSON))
+		resp, err := httpclient.PostWithClientIP(ctx, config.ExternalAuthHook, "application/json", bytes.NewBuffer(authRequestAsJSON), ip)
 		if err != nil {
 			providerLog(logger.LevelWarn, "error getting external auth hook HTTP response: %v", err)
 			return result, err
@@ -4090,10 +4964,10 @@ func getExternalAuthResponse(username, password, pkey, keyboardInteractive, ip,
 		}
 	}
 	timeout, env, args := command.GetConfig(config.ExternalAuthHook, command.HookExternalAuth)
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	cmdCtx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, config.ExternalAuthHook, args...)
+	cmd := exec.CommandContext(cmdCtx, config.ExternalAuthHook, args...)
 	cmd.Env = append(env,
 		fmt.Sprintf("SFTPGO_AUTHD_USERNAME=%s", username),
 		fmt.Sprintf("SFTPGO_AUTHD_USER=%s", string(userAsJSON)),
@@ -4102,7 +4976,8 @@ func getExternalAuthResponse(username, password, pkey, keyboardInteractive, ip,
 		fmt.Sprintf("SFTPGO_AUTHD_PUBLIC_KEY=%s", pkey),
 		fmt.Sprintf("SFTPGO_AUTHD_PROTOCOL=%s", protocol),
 		fmt.Sprintf("SFTPGO_AUTHD_TLS_CERT=%s", strings.ReplaceAll(tlsCert, "\n", "\\n")),
-		fmt.Sprintf("SFTPGO_AUTHD_KEYBOARD_INTERACTIVE=%v", keyboardInteractive))
+		fmt.Sprintf("SFTPGO_AUTHD_KEYBOARD_INTERACTIVE=%v", keyboardInteractive),
+		fmt.Sprintf("%s=%s", logger.CorrelationIDEnvVar, logger.GetCorrelationID(ctx)))
 
 	return getCmdOutput(cmd, "external_auth_hook")
 }
@@ -4146,7 +5021,7 @@ func checkPasswordAfterEmptyExtAuthResponse(user *User, plainPwd, protocol strin
 	return nil
 }
 
-func doExternalAuth(username, password string, pubKey []byte, keyboardInteractive, ip, protocol string,
+func doExternalAuth(ctx context.Context, username, password string, pubKey []byte, keyboardInteractive, ip, protocol string,
 	tlsCert *x509.Certificate,
 ) (User, error) {
 	var user User
@@ -4166,7 +5041,9 @@ func doExternalAuth(username, password string, pubKey []byte, keyboardInteractiv
 	}
 
 	startTime := time.Now()
-	out, err := getExternalAuthResponse(username, password, pkey, keyboardInteractive, ip, protocol, tlsCert, u)
+	span := startHookSpan("external auth hook", username, ip, protocol)
+	out, err := getExternalAuthResponse(ctx, username, password, pkey, keyboardInteractive, ip, protocol, tlsCert, u)
+	tracing.EndSpan(span, err)
 	if err != nil {
 		return user, fmt.Errorf("external auth error for user %q, elapsed: %s: %w", username, time.Since(startTime), err)
 	}
@@ -0,0 +1,2011 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !noetcd
+// +build !noetcd
+
+package dataprovider
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"go.uber.org/zap"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/version"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+const (
+	etcdDatabaseVersion = 1
+	// TTL, as seconds, for the lease used to register the cluster node and its active transfers
+	etcdSessionTTL     = 60
+	etcdRequestTimeout = 10 * time.Second
+	etcdMutateTimeout  = 30 * time.Second
+	etcdCatchUpTimeout = 5 * time.Second
+	// etcd limits the number of operations in a transaction, 128 by default
+	etcdMaxTxnOps    = 100
+	etcdMaxRetries   = 10
+	etcdVersionKey   = "version"
+	etcdUsers        = "users"
+	etcdGroups       = "groups"
+	etcdFolders      = "folders"
+	etcdAdmins       = "admins"
+	etcdAPIKeys      = "apikeys"
+	etcdShares       = "shares"
+	etcdActions      = "actions"
+	etcdRules        = "rules"
+	etcdRoles        = "roles"
+	etcdAdminRoles   = "adminroles"
+	etcdIPLists      = "iplists"
+	etcdConfigs      = "configs"
+	etcdFilesMeta    = "metadata"
+	etcdDigest       = "digest"
+	etcdAuditLog     = "auditlog"
+	etcdShareEvents  = "shareevents"
+	etcdConfigsKeyID = "current"
+)
+
+var (
+	etcdCollections = map[string]etcdCollection{
+		etcdUsers: etcdMapCollection[User]{
+			objects: func(h *memoryProviderHandle) map[string]User { return h.users },
+			names:   func(h *memoryProviderHandle) *[]string { return &h.usernames },
+		},
+		etcdGroups: etcdMapCollection[Group]{
+			objects: func(h *memoryProviderHandle) map[string]Group { return h.groups },
+			names:   func(h *memoryProviderHandle) *[]string { return &h.groupnames },
+		},
+		etcdFolders: etcdMapCollection[vfs.BaseVirtualFolder]{
+			objects: func(h *memoryProviderHandle) map[string]vfs.BaseVirtualFolder { return h.vfolders },
+			names:   func(h *memoryProviderHandle) *[]string { return &h.vfoldersNames },
+		},
+		etcdAdmins: etcdMapCollection[Admin]{
+			objects: func(h *memoryProviderHandle) map[string]Admin { return h.admins },
+			names:   func(h *memoryProviderHandle) *[]string { return &h.adminsUsernames },
+		},
+		etcdAPIKeys: etcdMapCollection[APIKey]{
+			objects: func(h *memoryProviderHandle) map[string]APIKey { return h.apiKeys },
+			names:   func(h *memoryProviderHandle) *[]string { return &h.apiKeysIDs },
+		},
+		etcdShares: etcdMapCollection[Share]{
+			objects: func(h *memoryProviderHandle) map[string]Share { return h.shares },
+			names:   func(h *memoryProviderHandle) *[]string { return &h.sharesIDs },
+		},
+		etcdActions: etcdMapCollection[BaseEventAction]{
+			objects: func(h *memoryProviderHandle) map[string]BaseEventAction { return h.actions },
+			names:   func(h *memoryProviderHandle) *[]string { return &h.actionsNames },
+		},
+		etcdRules: etcdMapCollection[EventRule]{
+			objects: func(h *memoryProviderHandle) map[string]EventRule { return h.rules },
+			names:   func(h *memoryProviderHandle) *[]string { return &h.rulesNames },
+		},
+		etcdRoles: etcdMapCollection[Role]{
+			objects: func(h *memoryProviderHandle) map[string]Role { return h.roles },
+			names:   func(h *memoryProviderHandle) *[]string { return &h.roleNames },
+		},
+		etcdAdminRoles: etcdMapCollection[AdminRole]{
+			objects: func(h *memoryProviderHandle) map[string]AdminRole { return h.adminRoles },
+			names:   func(h *memoryProviderHandle) *[]string { return &h.adminRoleNames },
+		},
+		etcdIPLists: etcdMapCollection[IPListEntry]{
+			objects: func(h *memoryProviderHandle) map[string]IPListEntry { return h.ipListEntries },
+			names:   func(h *memoryProviderHandle) *[]string { return &h.ipListEntriesKeys },
+		},
+		etcdFilesMeta: etcdMapCollection[map[string]FileMetadata]{
+			objects: func(h *memoryProviderHandle) map[string]map[string]FileMetadata { return h.filesMetadata },
+		},
+		etcdConfigs:     etcdConfigsCollection{},
+		etcdDigest:      etcdDigestCollection{},
+		etcdAuditLog:    etcdAuditLogCollection{},
+		etcdShareEvents: etcdShareEventsCollection{},
+	}
+)
+
+func init() {
+	version.AddFeature("+etcd")
+}
+
+// etcdCollection defines how to convert the objects stored inside the memory
+// provider handle to and from etcd key/value pairs.
+// The caller must hold the memory provider handle lock
+type etcdCollection interface {
+	list(h *memoryProviderHandle) (map[string][]byte, error)
+	get(h *memoryProviderHandle, id string) ([]byte, bool, error)
+	set(h *memoryProviderHandle, id string, data []byte) error
+	remove(h *memoryProviderHandle, id string)
+}
+
+type etcdMapCollection[T any] struct {
+	objects func(h *memoryProviderHandle) map[string]T
+	// optional, sorted object identifiers
+	names func(h *memoryProviderHandle) *[]string
+}
+
+func (c etcdMapCollection[T]) list(h *memoryProviderHandle) (map[string][]byte, error) {
+	objects := c.objects(h)
+	result := make(map[string][]byte, len(objects))
+	for id, obj := range objects {
+		data, err := json.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+		result[id] = data
+	}
+	return result, nil
+}
+
+func (c etcdMapCollection[T]) get(h *memoryProviderHandle, id string) ([]byte, bool, error) {
+	obj, ok := c.objects(h)[id]
+	if !ok {
+		return nil, false, nil
+	}
+	data, err := json.Marshal(obj)
+	return data, true, err
+}
+
+func (c etcdMapCollection[T]) set(h *memoryProviderHandle, id string, data []byte) error {
+	var obj T
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	objects := c.objects(h)
+	_, exists := objects[id]
+	objects[id] = obj
+	if !exists && c.names != nil {
+		names := c.names(h)
+		*names = append(*names, id)
+		sort.Strings(*names)
+	}
+	return nil
+}
+
+func (c etcdMapCollection[T]) remove(h *memoryProviderHandle, id string) {
+	objects := c.objects(h)
+	if _, ok := objects[id]; !ok {
+		return
+	}
+	delete(objects, id)
+	if c.names != nil {
+		names := c.names(h)
+		*names = util.Remove(*names, id)
+	}
+}
+
+type etcdConfigsCollection struct{}
+
+func (c etcdConfigsCollection) list(h *memoryProviderHandle) (map[string][]byte, error) {
+	result := make(map[string][]byte)
+	data, ok, err := c.get(h, etcdConfigsKeyID)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		result[etcdConfigsKeyID] = data
+	}
+	return result, nil
+}
+
+func (c etcdConfigsCollection) get(h *memoryProviderHandle, id string) ([]byte, bool, error) {
+	if id != etcdConfigsKeyID || h.configs.UpdatedAt == 0 {
+		return nil, false, nil
+	}
+	data, err := json.Marshal(h.configs)
+	return data, true, err
+}
+
+func (c etcdConfigsCollection) set(h *memoryProviderHandle, _ string, data []byte) error {
+	var configs Configs
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return err
+	}
+	h.configs = configs
+	return nil
+}
+
+func (c etcdConfigsCollection) remove(h *memoryProviderHandle, _ string) {
+	h.configs = Configs{}
+}
+
+type etcdDigestCollection struct{}
+
+func (c etcdDigestCollection) list(h *memoryProviderHandle) (map[string][]byte, error) {
+	result := make(map[string][]byte, len(h.digestEntries))
+	for id, entry := range h.digestEntries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		result[strconv.FormatInt(id, 10)] = data
+	}
+	return result, nil
+}
+
+func (c etcdDigestCollection) get(h *memoryProviderHandle, id string) ([]byte, bool, error) {
+	entryID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, false, nil
+	}
+	entry, ok := h.digestEntries[entryID]
+	if !ok {
+		return nil, false, nil
+	}
+	data, err := json.Marshal(entry)
+	return data, true, err
+}
+
+func (c etcdDigestCollection) set(h *memoryProviderHandle, _ string, data []byte) error {
+	var entry EventDigestEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return err
+	}
+	h.digestEntries[entry.ID] = entry
+	if entry.ID > h.lastDigestEntryID {
+		h.lastDigestEntryID = entry.ID
+	}
+	return nil
+}
+
+func (c etcdDigestCollection) remove(h *memoryProviderHandle, id string) {
+	entryID, err := strconv.ParseInt(id, 10, 64)
+	if err == nil {
+		delete(h.digestEntries, entryID)
+	}
+}
+
+type etcdAuditLogCollection struct{}
+
+func (c etcdAuditLogCollection) list(h *memoryProviderHandle) (map[string][]byte, error) {
+	result := make(map[string][]byte, len(h.auditLogEntries))
+	for id, entry := range h.auditLogEntries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		result[strconv.FormatInt(id, 10)] = data
+	}
+	return result, nil
+}
+
+func (c etcdAuditLogCollection) get(h *memoryProviderHandle, id string) ([]byte, bool, error) {
+	entryID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, false, nil
+	}
+	entry, ok := h.auditLogEntries[entryID]
+	if !ok {
+		return nil, false, nil
+	}
+	data, err := json.Marshal(entry)
+	return data, true, err
+}
+
+func (c etcdAuditLogCollection) set(h *memoryProviderHandle, _ string, data []byte) error {
+	var entry AuditLogEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return err
+	}
+	h.auditLogEntries[entry.ID] = entry
+	if entry.ID > h.lastAuditLogEntryID {
+		h.lastAuditLogEntryID = entry.ID
+	}
+	return nil
+}
+
+func (c etcdAuditLogCollection) remove(h *memoryProviderHandle, id string) {
+	entryID, err := strconv.ParseInt(id, 10, 64)
+	if err == nil {
+		delete(h.auditLogEntries, entryID)
+	}
+}
+
+type etcdShareEventsCollection struct{}
+
+func (c etcdShareEventsCollection) list(h *memoryProviderHandle) (map[string][]byte, error) {
+	result := make(map[string][]byte, len(h.shareEvents))
+	for id, event := range h.shareEvents {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return nil, err
+		}
+		result[strconv.FormatInt(id, 10)] = data
+	}
+	return result, nil
+}
+
+func (c etcdShareEventsCollection) get(h *memoryProviderHandle, id string) ([]byte, bool, error) {
+	eventID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, false, nil
+	}
+	event, ok := h.shareEvents[eventID]
+	if !ok {
+		return nil, false, nil
+	}
+	data, err := json.Marshal(event)
+	return data, true, err
+}
+
+func (c etcdShareEventsCollection) set(h *memoryProviderHandle, _ string, data []byte) error {
+	var event ShareEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return err
+	}
+	h.shareEvents[event.ID] = event
+	if event.ID > h.lastShareEventID {
+		h.lastShareEventID = event.ID
+	}
+	return nil
+}
+
+func (c etcdShareEventsCollection) remove(h *memoryProviderHandle, id string) {
+	eventID, err := strconv.ParseInt(id, 10, 64)
+	if err == nil {
+		delete(h.shareEvents, eventID)
+	}
+}
+
+// etcdChange defines a change to apply to the memory provider handle
+type etcdChange struct {
+	// key relative to the data prefix, for example users/username
+	key     string
+	data    []byte
+	deleted bool
+}
+
+type etcdKeys struct {
+	data      string
+	version   string
+	lock      string
+	nodes     string
+	transfers string
+	sessions  string
+	defender  string
+	tasks     string
+}
+
+func newEtcdKeys(name string) etcdKeys {
+	base := "/" + strings.Trim(name, "/") + "/"
+	return etcdKeys{
+		data:      base + "data/",
+		version:   base + "data/" + etcdVersionKey,
+		lock:      base + "lock",
+		nodes:     base + "nodes/",
+		transfers: base + "transfers/",
+		sessions:  base + "sessions/",
+		defender:  base + "defender/",
+		tasks:     base + "tasks/",
+	}
+}
+
+type etcdDefenderEvent struct {
+	DateTime int64 `json:"date_time"`
+	Score    int   `json:"score"`
+}
+
+type etcdDefenderHost struct {
+	IP        string              `json:"ip"`
+	BanTime   int64               `json:"ban_time"`
+	UpdatedAt int64               `json:"updated_at"`
+	Events    []etcdDefenderEvent `json:"events,omitempty"`
+}
+
+func (h *etcdDefenderHost) getScore(from int64) int {
+	score := 0
+	for _, ev := range h.Events {
+		if ev.DateTime >= from {
+			score += ev.Score
+		}
+	}
+	return score
+}
+
+// getEntry returns the defender entry for this host, ok is false if the
+// host is not banned and has no score
+func (h *etcdDefenderHost) getEntry(from int64) (DefenderEntry, bool) {
+	entry := DefenderEntry{
+		IP: h.IP,
+	}
+	if h.BanTime > 0 {
+		banTime := util.GetTimeFromMsecSinceEpoch(h.BanTime)
+		if banTime.After(time.Now()) {
+			entry.BanTime = banTime
+			return entry, true
+		}
+	}
+	entry.Score = h.getScore(from)
+	return entry, entry.Score > 0
+}
+
+// EtcdProvider defines the auth provider for etcd.
+// The data is cached in memory and kept in sync between the cluster nodes
+// using etcd watches, each update is executed while holding a cluster wide lock
+type EtcdProvider struct {
+	*MemoryProvider
+	client *clientv3.Client
+	keys   etcdKeys
+	// serializes the updates executed by this node
+	mutateMu sync.Mutex
+	// protects state and revision
+	mu sync.Mutex
+	// the applied data as JSON, the key is relative to the data prefix
+	state map[string][]byte
+	// last applied revision
+	revision int64
+	// lease for cluster wide lock, node registration and active transfers
+	sessionMu sync.Mutex
+	session   *concurrency.Session
+	cancel    context.CancelFunc
+}
+
+func initializeEtcdProvider() error {
+	tlsConfig, err := getEtcdTLSConfig()
+	if err != nil {
+		return err
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   getEtcdEndpoints(),
+		Username:    config.Username,
+		Password:    config.Password,
+		TLS:         tlsConfig,
+		DialTimeout: 10 * time.Second,
+		Logger:      zap.NewNop(),
+	})
+	if err != nil {
+		providerLog(logger.LevelError, "error creating etcd client: %v", err)
+		return err
+	}
+	p := &EtcdProvider{
+		MemoryProvider: &MemoryProvider{
+			dbHandle: newMemoryProviderHandle(""),
+		},
+		client: client,
+		keys:   newEtcdKeys(config.Name),
+		state:  make(map[string][]byte),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	p.mu.Lock()
+	err = p.reload(ctx)
+	revision := p.revision
+	p.mu.Unlock()
+	if err != nil {
+		providerLog(logger.LevelError, "error loading data from etcd: %v", err)
+		client.Close()
+		return err
+	}
+	watchCtx, watchCancel := context.WithCancel(context.Background())
+	p.cancel = watchCancel
+	go p.watch(watchCtx, revision+1)
+	providerLog(logger.LevelDebug, "etcd provider initialized, key prefix %q, revision %d", p.keys.data, revision)
+	provider = p
+	return nil
+}
+
+func getEtcdEndpoints() []string {
+	if config.ConnectionString != "" {
+		return strings.Split(config.ConnectionString, ",")
+	}
+	var endpoints []string
+	for _, host := range strings.Split(config.Host, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if config.Port > 0 && !strings.Contains(host, ":") {
+			host = fmt.Sprintf("%s:%d", host, config.Port)
+		}
+		endpoints = append(endpoints, host)
+	}
+	return endpoints
+}
+
+func getEtcdTLSConfig() (*tls.Config, error) {
+	if config.SSLMode == 0 {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if config.RootCert != "" {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			rootCAs = x509.NewCertPool()
+		}
+		rootCrt, err := os.ReadFile(config.RootCert)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load root certificate %q: %v", config.RootCert, err)
+		}
+		if !rootCAs.AppendCertsFromPEM(rootCrt) {
+			return nil, fmt.Errorf("unable to parse root certificate %q", config.RootCert)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	if config.ClientCert != "" && config.ClientKey != "" {
+		tlsCert, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load key pair %q, %q: %v", config.ClientCert, config.ClientKey, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{tlsCert}
+	}
+	if config.SSLMode == 2 {
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return tlsConfig, nil
+}
+
+// getSession returns the session used for the cluster wide lock and the
+// leased keys, a new session is created if the previous one expired
+func (p *EtcdProvider) getSession() (*concurrency.Session, error) {
+	p.sessionMu.Lock()
+	defer p.sessionMu.Unlock()
+
+	if p.session != nil {
+		select {
+		case <-p.session.Done():
+			providerLog(logger.LevelWarn, "etcd session expired, creating a new one")
+		default:
+			return p.session, nil
+		}
+	}
+	session, err := concurrency.NewSession(p.client, concurrency.WithTTL(etcdSessionTTL))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create etcd session: %w", err)
+	}
+	p.session = session
+	return session, nil
+}
+
+func (p *EtcdProvider) watch(ctx context.Context, revision int64) {
+	for {
+		wch := p.client.Watch(clientv3.WithRequireLeader(ctx), p.keys.data, clientv3.WithPrefix(),
+			clientv3.WithRev(revision))
+		for resp := range wch {
+			if err := resp.Err(); err != nil {
+				providerLog(logger.LevelWarn, "etcd watch error: %v, compact revision: %d", err, resp.CompactRevision)
+				if resp.CompactRevision > 0 {
+					revision = p.reloadAfterWatchError(ctx, revision)
+				}
+				break
+			}
+			p.applyEvents(resp.Events)
+			if resp.Header.Revision >= revision {
+				revision = resp.Header.Revision + 1
+			}
+		}
+		select {
+		case <-ctx.Done():
+			providerLog(logger.LevelDebug, "etcd watch stopped")
+			return
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+func (p *EtcdProvider) reloadAfterWatchError(ctx context.Context, revision int64) int64 {
+	reloadCtx, cancel := context.WithTimeout(ctx, etcdRequestTimeout)
+	defer cancel()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.reload(reloadCtx); err != nil {
+		providerLog(logger.LevelError, "unable to reload data after a watch error: %v", err)
+		return revision
+	}
+	return p.revision + 1
+}
+
+func (p *EtcdProvider) applyEvents(events []*clientv3.Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var changes []etcdChange
+	revision := p.revision
+	for _, ev := range events {
+		if ev.Kv.ModRevision <= p.revision {
+			// already applied, for example an update from this node
+			continue
+		}
+		if ev.Kv.ModRevision > revision {
+			revision = ev.Kv.ModRevision
+		}
+		key := strings.TrimPrefix(string(ev.Kv.Key), p.keys.data)
+		if key == etcdVersionKey {
+			continue
+		}
+		changes = append(changes, etcdChange{
+			key:     key,
+			data:    ev.Kv.Value,
+			deleted: ev.Type == mvccpb.DELETE,
+		})
+	}
+	if len(changes) > 0 {
+		providerLog(logger.LevelDebug, "applying %d changes from etcd, revision %d", len(changes), revision)
+		p.applyChanges(changes)
+	}
+	p.revision = revision
+}
+
+// reload loads all the data from etcd and applies the differences with
+// the current state. The caller must hold p.mu
+func (p *EtcdProvider) reload(ctx context.Context) error {
+	resp, err := p.client.Get(ctx, p.keys.data, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	data := make(map[string][]byte, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		key := strings.TrimPrefix(string(kv.Key), p.keys.data)
+		if key == etcdVersionKey {
+			continue
+		}
+		data[key] = kv.Value
+	}
+	var changes []etcdChange
+	for key, value := range data {
+		if current, ok := p.state[key]; !ok || !bytes.Equal(current, value) {
+			changes = append(changes, etcdChange{key: key, data: value})
+		}
+	}
+	for key := range p.state {
+		if _, ok := data[key]; !ok {
+			changes = append(changes, etcdChange{key: key, deleted: true})
+		}
+	}
+	p.applyChanges(changes)
+	p.revision = resp.Header.Revision
+	return nil
+}
+
+// applyChanges applies the given changes to the memory provider handle and
+// invalidates the affected caches. The caller must hold p.mu
+func (p *EtcdProvider) applyChanges(changes []etcdChange) {
+	// apply users after their relations, a partial state is never visible
+	// since we hold the handle lock, but this way the logs are more meaningful
+	sort.SliceStable(changes, func(i, j int) bool {
+		return !strings.HasPrefix(changes[i].key, etcdUsers+"/") && strings.HasPrefix(changes[j].key, etcdUsers+"/")
+	})
+	var invalidations []func()
+	h := p.dbHandle
+
+	h.Lock()
+	for _, change := range changes {
+		name, id, ok := strings.Cut(change.key, "/")
+		if !ok {
+			continue
+		}
+		collection, ok := etcdCollections[name]
+		if !ok {
+			providerLog(logger.LevelWarn, "ignoring unsupported etcd key %q", change.key)
+			continue
+		}
+		previous := p.state[change.key]
+		if change.deleted {
+			collection.remove(h, id)
+			delete(p.state, change.key)
+		} else {
+			if err := collection.set(h, id, change.data); err != nil {
+				providerLog(logger.LevelError, "unable to apply etcd key %q: %v", change.key, err)
+				continue
+			}
+			p.state[change.key] = change.data
+		}
+		if fn := getEtcdCacheInvalidation(name, id, previous, change); fn != nil {
+			invalidations = append(invalidations, fn)
+		}
+	}
+	h.Unlock()
+
+	for _, fn := range invalidations {
+		fn()
+	}
+}
+
+func getEtcdCacheInvalidation(collection, id string, previous []byte, change etcdChange) func() {
+	data := change.data
+	if change.deleted {
+		data = previous
+	}
+	switch collection {
+	case etcdUsers:
+		return func() {
+			webDAVUsersCache.remove(id)
+			if change.deleted {
+				cachedUserPasswords.Remove(id)
+				delayedQuotaUpdater.resetUserQuota(id)
+			}
+			setLastUserUpdate()
+		}
+	case etcdGroups, etcdFolders:
+		var relations struct {
+			Users []string `json:"users"`
+		}
+		if err := json.Unmarshal(data, &relations); err != nil || len(relations.Users) == 0 {
+			return nil
+		}
+		return func() {
+			for _, username := range relations.Users {
+				webDAVUsersCache.remove(username)
+			}
+		}
+	case etcdAdmins:
+		if change.deleted {
+			return func() {
+				cachedAdminPasswords.Remove(id)
+			}
+		}
+	case etcdAPIKeys:
+		if change.deleted {
+			return func() {
+				cachedAPIKeys.Remove(id)
+			}
+		}
+	case etcdRules:
+		return setLastRuleUpdate
+	case etcdIPLists:
+		var entry IPListEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil
+		}
+		return func() {
+			for _, l := range inMemoryLists {
+				if change.deleted {
+					l.removeEntry(&entry)
+				} else {
+					l.updateEntry(&entry)
+				}
+			}
+		}
+	case etcdConfigs:
+		return loadUsernameAliases
+	}
+	return nil
+}
+
+// mutate executes fn, that updates the memory provider handle, while holding
+// the cluster wide lock and persists the changes for the given scopes.
+// A scope can be a collection, for example "users", or a single object,
+// for example "users/username"
+func (p *EtcdProvider) mutate(fn func() error, scopes ...string) error {
+	p.mutateMu.Lock()
+	defer p.mutateMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdMutateTimeout)
+	defer cancel()
+
+	session, err := p.getSession()
+	if err != nil {
+		return err
+	}
+	mutex := concurrency.NewMutex(session, p.keys.lock)
+	if err := mutex.Lock(ctx); err != nil {
+		return fmt.Errorf("unable to acquire the etcd lock: %w", err)
+	}
+	defer func() {
+		unlockCtx, unlockCancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+		defer unlockCancel()
+
+		if err := mutex.Unlock(unlockCtx); err != nil {
+			providerLog(logger.LevelError, "unable to release the etcd lock: %v", err)
+		}
+	}()
+
+	if err := p.catchUp(ctx); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := fn(); err != nil {
+		return err
+	}
+	if err := p.persist(ctx, scopes); err != nil {
+		providerLog(logger.LevelError, "unable to persist changes, scopes %+v: %v", scopes, err)
+		// restore the stored state
+		if errReload := p.reload(ctx); errReload != nil {
+			providerLog(logger.LevelError, "unable to reload data after a failed update: %v", errReload)
+		}
+		return err
+	}
+	return nil
+}
+
+// catchUp waits for the updates from the other nodes to be applied
+func (p *EtcdProvider) catchUp(ctx context.Context) error {
+	resp, err := p.client.Get(ctx, p.keys.version)
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil
+	}
+	revision := resp.Kvs[0].ModRevision
+	deadline := time.Now().Add(etcdCatchUpTimeout)
+	for {
+		p.mu.Lock()
+		if p.revision >= revision {
+			p.mu.Unlock()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			providerLog(logger.LevelWarn, "applied revision %d, expected %d, reloading data", p.revision, revision)
+			err = p.reload(ctx)
+			p.mu.Unlock()
+			return err
+		}
+		p.mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// persist writes the changes for the given scopes to etcd. The caller must hold p.mu
+func (p *EtcdProvider) persist(ctx context.Context, scopes []string) error {
+	changes, err := p.getChanges(scopes)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	versionData, err := json.Marshal(map[string]any{
+		"version":    etcdDatabaseVersion,
+		"updated_at": util.GetTimeAsMsSinceEpoch(time.Now()),
+	})
+	if err != nil {
+		return err
+	}
+	ops := make([]clientv3.Op, 0, len(changes)+1)
+	for _, change := range changes {
+		if change.deleted {
+			ops = append(ops, clientv3.OpDelete(p.keys.data+change.key))
+		} else {
+			ops = append(ops, clientv3.OpPut(p.keys.data+change.key, string(change.data)))
+		}
+	}
+	ops = append(ops, clientv3.OpPut(p.keys.version, string(versionData)))
+	var revision int64
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > etcdMaxTxnOps {
+			n = etcdMaxTxnOps
+		}
+		resp, err := p.client.Txn(ctx).Then(ops[:n]...).Commit()
+		if err != nil {
+			return err
+		}
+		revision = resp.Header.Revision
+		ops = ops[n:]
+	}
+	for _, change := range changes {
+		if change.deleted {
+			delete(p.state, change.key)
+		} else {
+			p.state[change.key] = change.data
+		}
+	}
+	p.revision = revision
+	return nil
+}
+
+// getChanges returns the differences between the memory provider handle and
+// the persisted state for the given scopes. The caller must hold p.mu
+func (p *EtcdProvider) getChanges(scopes []string) ([]etcdChange, error) {
+	h := p.dbHandle
+	h.Lock()
+	defer h.Unlock()
+
+	current := make(map[string][]byte)
+	checked := make(map[string]bool)
+	for _, scope := range scopes {
+		name, id, isKey := strings.Cut(scope, "/")
+		collection, ok := etcdCollections[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported etcd scope %q", scope)
+		}
+		if isKey {
+			data, ok, err := collection.get(h, id)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				current[scope] = data
+			}
+			checked[scope] = true
+			continue
+		}
+		objects, err := collection.list(h)
+		if err != nil {
+			return nil, err
+		}
+		for objectID, data := range objects {
+			key := name + "/" + objectID
+			current[key] = data
+			checked[key] = true
+		}
+		for key := range p.state {
+			if strings.HasPrefix(key, name+"/") {
+				checked[key] = true
+			}
+		}
+	}
+	var changes []etcdChange
+	for key := range checked {
+		data, exists := current[key]
+		stored, isStored := p.state[key]
+		switch {
+		case exists && (!isStored || !bytes.Equal(stored, data)):
+			changes = append(changes, etcdChange{key: key, data: data})
+		case !exists && isStored:
+			changes = append(changes, etcdChange{key: key, deleted: true})
+		}
+	}
+	return changes, nil
+}
+
+func etcdScope(collection, id string) string {
+	return collection + "/" + id
+}
+
+// atomicUpdate updates the specified key using an optimistic transaction.
+// fn receives the current value, nil if the key does not exist, and returns
+// the new value, nil means delete
+func (p *EtcdProvider) atomicUpdate(key string, fn func(data []byte) ([]byte, error), opts ...clientv3.OpOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	for i := 0; i < etcdMaxRetries; i++ {
+		resp, err := p.client.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		var current []byte
+		var modRevision int64
+		if len(resp.Kvs) > 0 {
+			current = resp.Kvs[0].Value
+			modRevision = resp.Kvs[0].ModRevision
+		}
+		data, err := fn(current)
+		if err != nil {
+			return err
+		}
+		var op clientv3.Op
+		if data == nil {
+			op = clientv3.OpDelete(key)
+		} else {
+			op = clientv3.OpPut(key, string(data), opts...)
+		}
+		txnResp, err := p.client.Txn(ctx).If(clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)).
+			Then(op).Commit()
+		if err != nil {
+			return err
+		}
+		if txnResp.Succeeded {
+			return nil
+		}
+	}
+	return fmt.Errorf("unable to update key %q, too many concurrent updates", key)
+}
+
+func (p *EtcdProvider) getPrefix(prefix string) ([][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	resp, err := p.client.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	result := make([][]byte, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		result = append(result, kv.Value)
+	}
+	return result, nil
+}
+
+func (p *EtcdProvider) getKey(key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	resp, err := p.client.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, util.NewRecordNotFoundError(fmt.Sprintf("key %q does not exist", key))
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+func (p *EtcdProvider) putKey(key string, data []byte, opts ...clientv3.OpOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	_, err := p.client.Put(ctx, key, string(data), opts...)
+	return err
+}
+
+// deleteKeys deletes the given keys, if requireDelete is true and no key is
+// deleted a not found error is returned
+func (p *EtcdProvider) deleteKeys(requireDelete bool, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	var deleted int64
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > etcdMaxTxnOps {
+			n = etcdMaxTxnOps
+		}
+		ops := make([]clientv3.Op, 0, n)
+		for _, key := range keys[:n] {
+			ops = append(ops, clientv3.OpDelete(key))
+		}
+		resp, err := p.client.Txn(ctx).Then(ops...).Commit()
+		if err != nil {
+			return err
+		}
+		for _, r := range resp.Responses {
+			if dr := r.GetResponseDeleteRange(); dr != nil {
+				deleted += dr.Deleted
+			}
+		}
+		keys = keys[n:]
+	}
+	if requireDelete && deleted == 0 {
+		return util.NewRecordNotFoundError("no key deleted")
+	}
+	return nil
+}
+
+func (p *EtcdProvider) checkAvailability() error {
+	if err := p.MemoryProvider.checkAvailability(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	_, err := p.client.Get(ctx, p.keys.version)
+	return err
+}
+
+func (p *EtcdProvider) updateQuota(username string, filesAdd int, sizeAdd int64, reset bool) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.updateQuota(username, filesAdd, sizeAdd, reset)
+	}, etcdScope(etcdUsers, username))
+}
+
+func (p *EtcdProvider) updateTransferQuota(username string, uploadSize, downloadSize int64, reset bool) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.updateTransferQuota(username, uploadSize, downloadSize, reset)
+	}, etcdScope(etcdUsers, username))
+}
+
+func (p *EtcdProvider) addUser(user *User) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.addUser(user)
+	}, etcdScope(etcdUsers, user.Username), etcdGroups, etcdFolders, etcdRoles)
+}
+
+func (p *EtcdProvider) updateUser(user *User) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.updateUser(user)
+	}, etcdScope(etcdUsers, user.Username), etcdGroups, etcdFolders, etcdRoles)
+}
+
+func (p *EtcdProvider) deleteUser(user User, softDelete bool) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.deleteUser(user, softDelete)
+	}, etcdScope(etcdUsers, user.Username), etcdGroups, etcdFolders, etcdRoles, etcdAPIKeys, etcdShares,
+		etcdShareEvents, etcdScope(etcdFilesMeta, user.Username))
+}
+
+func (p *EtcdProvider) updateUserPassword(username, password string) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.updateUserPassword(username, password)
+	}, etcdScope(etcdUsers, username))
+}
+
+func (p *EtcdProvider) updateLastLogin(username string) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.updateLastLogin(username)
+	}, etcdScope(etcdUsers, username))
+}
+
+func (p *EtcdProvider) updateAdminLastLogin(username string) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.updateAdminLastLogin(username)
+	}, etcdScope(etcdAdmins, username))
+}
+
+func (p *EtcdProvider) setUpdatedAt(username string) {
+	err := p.mutate(func() error {
+		p.MemoryProvider.setUpdatedAt(username)
+		return nil
+	}, etcdScope(etcdUsers, username))
+	if err != nil {
+		providerLog(logger.LevelError, "unable to set updated_at for user %q: %v", username, err)
+	}
+}
+
+func (p *EtcdProvider) setFirstDownloadTimestamp(username string) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.setFirstDownloadTimestamp(username)
+	}, etcdScope(etcdUsers, username))
+}
+
+func (p *EtcdProvider) setFirstUploadTimestamp(username string) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.setFirstUploadTimestamp(username)
+	}, etcdScope(etcdUsers, username))
+}
+
+func (p *EtcdProvider) addFolder(folder *vfs.BaseVirtualFolder) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.addFolder(folder)
+	}, etcdScope(etcdFolders, folder.Name))
+}
+
+func (p *EtcdProvider) updateFolder(folder *vfs.BaseVirtualFolder) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.updateFolder(folder)
+	}, etcdScope(etcdFolders, folder.Name), etcdUsers, etcdGroups)
+}
+
+func (p *EtcdProvider) deleteFolder(folder vfs.BaseVirtualFolder) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.deleteFolder(folder)
+	}, etcdScope(etcdFolders, folder.Name), etcdUsers, etcdGroups)
+}
+
+func (p *EtcdProvider) updateFolderQuota(name string, filesAdd int, sizeAdd int64, reset bool) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.updateFolderQuota(name, filesAdd, sizeAdd, reset)
+	}, etcdScope(etcdFolders, name))
+}
+
+func (p *EtcdProvider) addGroup(group *Group) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.addGroup(group)
+	}, etcdScope(etcdGroups, group.Name), etcdFolders)
+}
+
+func (p *EtcdProvider) updateGroup(group *Group) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.updateGroup(group)
+	}, etcdScope(etcdGroups, group.Name), etcdFolders)
+}
+
+func (p *EtcdProvider) deleteGroup(group Group) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.deleteGroup(group)
+	}, etcdScope(etcdGroups, group.Name), etcdFolders, etcdAdmins)
+}
+
+func (p *EtcdProvider) addAdmin(admin *Admin) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.addAdmin(admin)
+	}, etcdScope(etcdAdmins, admin.Username), etcdRoles, etcdAdminRoles, etcdGroups)
+}
+
+func (p *EtcdProvider) updateAdmin(admin *Admin) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.updateAdmin(admin)
+	}, etcdScope(etcdAdmins, admin.Username), etcdRoles, etcdAdminRoles, etcdGroups)
+}
+
+func (p *EtcdProvider) deleteAdmin(admin Admin) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.deleteAdmin(admin)
+	}, etcdScope(etcdAdmins, admin.Username), etcdRoles, etcdAdminRoles, etcdGroups, etcdAPIKeys)
+}
+
+func (p *EtcdProvider) addAPIKey(apiKey *APIKey) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.addAPIKey(apiKey)
+	}, etcdScope(etcdAPIKeys, apiKey.KeyID))
+}
+
+func (p *EtcdProvider) updateAPIKey(apiKey *APIKey) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.updateAPIKey(apiKey)
+	}, etcdScope(etcdAPIKeys, apiKey.KeyID))
+}
+
+func (p *EtcdProvider) rotateAPIKey(apiKey *APIKey) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.rotateAPIKey(apiKey)
+	}, etcdScope(etcdAPIKeys, apiKey.KeyID))
+}
+
+func (p *EtcdProvider) deleteAPIKey(apiKey APIKey) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.deleteAPIKey(apiKey)
+	}, etcdScope(etcdAPIKeys, apiKey.KeyID))
+}
+
+func (p *EtcdProvider) updateAPIKeyLastUse(keyID string) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.updateAPIKeyLastUse(keyID)
+	}, etcdScope(etcdAPIKeys, keyID))
+}
+
+func (p *EtcdProvider) addShare(share *Share) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.addShare(share)
+	}, etcdScope(etcdShares, share.ShareID))
+}
+
+func (p *EtcdProvider) updateShare(share *Share) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.updateShare(share)
+	}, etcdScope(etcdShares, share.ShareID))
+}
+
+func (p *EtcdProvider) deleteShare(share Share) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.deleteShare(share)
+	}, etcdScope(etcdShares, share.ShareID), etcdShareEvents)
+}
+
+func (p *EtcdProvider) updateShareLastUse(shareID string, numTokens int) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.updateShareLastUse(shareID, numTokens)
+	}, etcdScope(etcdShares, shareID))
+}
+
+func (p *EtcdProvider) addEventAction(action *BaseEventAction) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.addEventAction(action)
+	}, etcdActions, etcdRules)
+}
+
+func (p *EtcdProvider) updateEventAction(action *BaseEventAction) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.updateEventAction(action)
+	}, etcdActions, etcdRules)
+}
+
+func (p *EtcdProvider) deleteEventAction(action BaseEventAction) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.deleteEventAction(action)
+	}, etcdActions, etcdRules)
+}
+
+func (p *EtcdProvider) addEventRule(rule *EventRule) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.addEventRule(rule)
+	}, etcdScope(etcdRules, rule.Name), etcdActions)
+}
+
+func (p *EtcdProvider) updateEventRule(rule *EventRule) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.updateEventRule(rule)
+	}, etcdScope(etcdRules, rule.Name), etcdActions)
+}
+
+func (p *EtcdProvider) deleteEventRule(rule EventRule, softDelete bool) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.deleteEventRule(rule, softDelete)
+	}, etcdScope(etcdRules, rule.Name), etcdActions)
+}
+
+func (p *EtcdProvider) addRole(role *Role) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.addRole(role)
+	}, etcdScope(etcdRoles, role.Name))
+}
+
+func (p *EtcdProvider) updateRole(role *Role) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.updateRole(role)
+	}, etcdScope(etcdRoles, role.Name))
+}
+
+func (p *EtcdProvider) deleteRole(role Role) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.deleteRole(role)
+	}, etcdScope(etcdRoles, role.Name), etcdUsers)
+}
+
+func (p *EtcdProvider) addAdminRole(role *AdminRole) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.addAdminRole(role)
+	}, etcdScope(etcdAdminRoles, role.Name))
+}
+
+func (p *EtcdProvider) updateAdminRole(role *AdminRole) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.updateAdminRole(role)
+	}, etcdScope(etcdAdminRoles, role.Name))
+}
+
+func (p *EtcdProvider) deleteAdminRole(role AdminRole) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.deleteAdminRole(role)
+	}, etcdScope(etcdAdminRoles, role.Name))
+}
+
+func (p *EtcdProvider) addIPListEntry(entry *IPListEntry) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.addIPListEntry(entry)
+	}, etcdScope(etcdIPLists, entry.getKey()))
+}
+
+func (p *EtcdProvider) updateIPListEntry(entry *IPListEntry) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.updateIPListEntry(entry)
+	}, etcdScope(etcdIPLists, entry.getKey()))
+}
+
+func (p *EtcdProvider) deleteIPListEntry(entry IPListEntry, softDelete bool) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.deleteIPListEntry(entry, softDelete)
+	}, etcdScope(etcdIPLists, entry.getKey()))
+}
+
+func (p *EtcdProvider) getRecentlyUpdatedIPListEntries(_ int64) ([]IPListEntry, error) {
+	// the in memory lists are updated when the changes are received from etcd
+	return nil, nil
+}
+
+func (p *EtcdProvider) setConfigs(configs *Configs) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.setConfigs(configs)
+	}, etcdConfigs)
+}
+
+func (p *EtcdProvider) setFileMetadata(username string, metadata *FileMetadata) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.setFileMetadata(username, metadata)
+	}, etcdScope(etcdFilesMeta, username))
+}
+
+func (p *EtcdProvider) deleteFilesMetadata(username, virtualPath string, recursive bool) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.deleteFilesMetadata(username, virtualPath, recursive)
+	}, etcdScope(etcdFilesMeta, username))
+}
+
+func (p *EtcdProvider) renameFilesMetadata(username, source, target string) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.renameFilesMetadata(username, source, target)
+	}, etcdScope(etcdFilesMeta, username))
+}
+
+func (p *EtcdProvider) addEventDigestEntry(entry *EventDigestEntry) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.addEventDigestEntry(entry)
+	}, etcdDigest)
+}
+
+func (p *EtcdProvider) deleteEventDigestEntries(ids []int64) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.deleteEventDigestEntries(ids)
+	}, etcdDigest)
+}
+
+func (p *EtcdProvider) addAuditLogEntry(entry *AuditLogEntry) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.addAuditLogEntry(entry)
+	}, etcdAuditLog)
+}
+
+func (p *EtcdProvider) cleanupAuditLog(before int64) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.cleanupAuditLog(before)
+	}, etcdAuditLog)
+}
+
+func (p *EtcdProvider) addShareEvent(event *ShareEvent) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.addShareEvent(event)
+	}, etcdShareEvents)
+}
+
+func (p *EtcdProvider) cleanupShareEvents(before int64) error {
+	return p.mutate(func() error {
+		return p.MemoryProvider.cleanupShareEvents(before)
+	}, etcdShareEvents)
+}
+
+func (p *EtcdProvider) getDefenderHosts(from int64, limit int) ([]DefenderEntry, error) {
+	values, err := p.getPrefix(p.keys.defender)
+	if err != nil {
+		providerLog(logger.LevelError, "unable to get defender hosts: %v", err)
+		return nil, err
+	}
+	hosts := make([]etcdDefenderHost, 0, len(values))
+	for _, data := range values {
+		var host etcdDefenderHost
+		if err := json.Unmarshal(data, &host); err != nil {
+			return nil, err
+		}
+		if host.UpdatedAt >= from || host.BanTime > 0 {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].UpdatedAt > hosts[j].UpdatedAt
+	})
+	if len(hosts) > limit {
+		hosts = hosts[:limit]
+	}
+	result := make([]DefenderEntry, 0, len(hosts))
+	for idx := range hosts {
+		if entry, ok := hosts[idx].getEntry(from); ok {
+			result = append(result, entry)
+		}
+	}
+	return result, nil
+}
+
+func (p *EtcdProvider) getDefenderHost(ip string) (etcdDefenderHost, error) {
+	var host etcdDefenderHost
+	data, err := p.getKey(p.keys.defender + ip)
+	if err != nil {
+		if errors.Is(err, util.ErrNotFound) {
+			return host, util.NewRecordNotFoundError("host not found")
+		}
+		return host, err
+	}
+	err = json.Unmarshal(data, &host)
+	return host, err
+}
+
+func (p *EtcdProvider) getDefenderHostByIP(ip string, from int64) (DefenderEntry, error) {
+	host, err := p.getDefenderHost(ip)
+	if err != nil {
+		return DefenderEntry{}, err
+	}
+	if host.UpdatedAt < from && host.BanTime == 0 {
+		return DefenderEntry{}, util.NewRecordNotFoundError("host not found")
+	}
+	entry, ok := host.getEntry(from)
+	if !ok {
+		return entry, util.NewRecordNotFoundError("host not found")
+	}
+	return entry, nil
+}
+
+func (p *EtcdProvider) isDefenderHostBanned(ip string) (DefenderEntry, error) {
+	host, err := p.getDefenderHost(ip)
+	if err != nil {
+		return DefenderEntry{}, err
+	}
+	if host.BanTime < util.GetTimeAsMsSinceEpoch(time.Now()) {
+		return DefenderEntry{}, util.NewRecordNotFoundError("host not found")
+	}
+	return DefenderEntry{IP: host.IP, BanTime: util.GetTimeFromMsecSinceEpoch(host.BanTime)}, nil
+}
+
+func (p *EtcdProvider) updateDefenderHost(ip string, fn func(host *etcdDefenderHost)) error {
+	return p.atomicUpdate(p.keys.defender+ip, func(data []byte) ([]byte, error) {
+		if data == nil {
+			// no host, nothing to update
+			return nil, nil
+		}
+		var host etcdDefenderHost
+		if err := json.Unmarshal(data, &host); err != nil {
+			return nil, err
+		}
+		fn(&host)
+		return json.Marshal(host)
+	})
+}
+
+func (p *EtcdProvider) updateDefenderBanTime(ip string, minutes int) error {
+	err := p.updateDefenderHost(ip, func(host *etcdDefenderHost) {
+		host.BanTime += int64(minutes) * 60000
+	})
+	if err == nil {
+		providerLog(logger.LevelDebug, "ban time updated for ip %q, increment (minutes): %v", ip, minutes)
+	} else {
+		providerLog(logger.LevelError, "error updating ban time for ip %q: %v", ip, err)
+	}
+	return err
+}
+
+func (p *EtcdProvider) setDefenderBanTime(ip string, banTime int64) error {
+	err := p.updateDefenderHost(ip, func(host *etcdDefenderHost) {
+		host.BanTime = banTime
+	})
+	if err == nil {
+		providerLog(logger.LevelDebug, "ip %q banned until %v", ip, util.GetTimeFromMsecSinceEpoch(banTime))
+	} else {
+		providerLog(logger.LevelError, "error setting ban time for ip %q: %v", ip, err)
+	}
+	return err
+}
+
+func (p *EtcdProvider) deleteDefenderHost(ip string) error {
+	err := p.deleteKeys(true, p.keys.defender+ip)
+	if err != nil {
+		providerLog(logger.LevelError, "unable to delete defender host %q: %v", ip, err)
+	}
+	return err
+}
+
+func (p *EtcdProvider) addDefenderEvent(ip string, score int) error {
+	err := p.atomicUpdate(p.keys.defender+ip, func(data []byte) ([]byte, error) {
+		host := etcdDefenderHost{
+			IP: ip,
+		}
+		if data != nil {
+			if err := json.Unmarshal(data, &host); err != nil {
+				return nil, err
+			}
+		}
+		now := util.GetTimeAsMsSinceEpoch(time.Now())
+		host.UpdatedAt = now
+		host.Events = append(host.Events, etcdDefenderEvent{
+			DateTime: now,
+			Score:    score,
+		})
+		return json.Marshal(host)
+	})
+	if err != nil {
+		providerLog(logger.LevelError, "unable to add defender event for %q: %v", ip, err)
+	}
+	return err
+}
+
+func (p *EtcdProvider) cleanupDefender(from int64) error {
+	values, err := p.getPrefix(p.keys.defender)
+	if err != nil {
+		return err
+	}
+	now := util.GetTimeAsMsSinceEpoch(time.Now())
+	for _, data := range values {
+		var host etcdDefenderHost
+		if err := json.Unmarshal(data, &host); err != nil {
+			return err
+		}
+		err = p.atomicUpdate(p.keys.defender+host.IP, func(data []byte) ([]byte, error) {
+			if data == nil {
+				return nil, nil
+			}
+			var h etcdDefenderHost
+			if err := json.Unmarshal(data, &h); err != nil {
+				return nil, err
+			}
+			events := make([]etcdDefenderEvent, 0, len(h.Events))
+			for _, ev := range h.Events {
+				if ev.DateTime >= from {
+					events = append(events, ev)
+				}
+			}
+			h.Events = events
+			if h.BanTime < now && len(h.Events) == 0 {
+				return nil, nil
+			}
+			return json.Marshal(h)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *EtcdProvider) getTransferKey(transferID int64, connectionID string) string {
+	return fmt.Sprintf("%s%s/%d", p.keys.transfers, connectionID, transferID)
+}
+
+func (p *EtcdProvider) addActiveTransfer(transfer ActiveTransfer) error {
+	session, err := p.getSession()
+	if err != nil {
+		return err
+	}
+	now := util.GetTimeAsMsSinceEpoch(time.Now())
+	transfer.CreatedAt = now
+	transfer.UpdatedAt = now
+	data, err := json.Marshal(transfer)
+	if err != nil {
+		return err
+	}
+	// the active transfers are removed if this node dies
+	return p.putKey(p.getTransferKey(transfer.ID, transfer.ConnID), data, clientv3.WithLease(session.Lease()))
+}
+
+func (p *EtcdProvider) updateActiveTransferSizes(ulSize, dlSize, transferID int64, connectionID string) error {
+	session, err := p.getSession()
+	if err != nil {
+		return err
+	}
+	return p.atomicUpdate(p.getTransferKey(transferID, connectionID), func(data []byte) ([]byte, error) {
+		if data == nil {
+			return nil, nil
+		}
+		var transfer ActiveTransfer
+		if err := json.Unmarshal(data, &transfer); err != nil {
+			return nil, err
+		}
+		transfer.CurrentULSize = ulSize
+		transfer.CurrentDLSize = dlSize
+		transfer.UpdatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+		return json.Marshal(transfer)
+	}, clientv3.WithLease(session.Lease()))
+}
+
+func (p *EtcdProvider) removeActiveTransfer(transferID int64, connectionID string) error {
+	return p.deleteKeys(false, p.getTransferKey(transferID, connectionID))
+}
+
+func (p *EtcdProvider) getAllActiveTransfers() ([]ActiveTransfer, error) {
+	values, err := p.getPrefix(p.keys.transfers)
+	if err != nil {
+		return nil, err
+	}
+	transfers := make([]ActiveTransfer, 0, len(values))
+	for _, data := range values {
+		var transfer ActiveTransfer
+		if err := json.Unmarshal(data, &transfer); err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, transfer)
+	}
+	return transfers, nil
+}
+
+func (p *EtcdProvider) cleanupActiveTransfers(before time.Time) error {
+	transfers, err := p.getAllActiveTransfers()
+	if err != nil {
+		return err
+	}
+	limit := util.GetTimeAsMsSinceEpoch(before)
+	var keys []string
+	for _, transfer := range transfers {
+		if transfer.UpdatedAt < limit {
+			keys = append(keys, p.getTransferKey(transfer.ID, transfer.ConnID))
+		}
+	}
+	return p.deleteKeys(false, keys...)
+}
+
+func (p *EtcdProvider) getActiveTransfers(from time.Time) ([]ActiveTransfer, error) {
+	transfers, err := p.getAllActiveTransfers()
+	if err != nil {
+		return nil, err
+	}
+	limit := util.GetTimeAsMsSinceEpoch(from)
+	result := make([]ActiveTransfer, 0, len(transfers))
+	for _, transfer := range transfers {
+		if transfer.UpdatedAt > limit {
+			result = append(result, transfer)
+		}
+	}
+	return result, nil
+}
+
+func (p *EtcdProvider) addSharedSession(session Session) error {
+	value, err := encodeSession(session)
+	if err != nil {
+		return err
+	}
+	return p.putKey(p.keys.sessions+session.Key, value)
+}
+
+func (p *EtcdProvider) deleteSharedSession(key string) error {
+	return p.deleteKeys(true, p.keys.sessions+key)
+}
+
+func (p *EtcdProvider) getSharedSession(key string) (Session, error) {
+	data, err := p.getKey(p.keys.sessions + key)
+	if err != nil {
+		return Session{}, err
+	}
+	session, err := decodeSession(data)
+	if err != nil {
+		return Session{}, err
+	}
+	return session.getSession(), nil
+}
+
+func (p *EtcdProvider) cleanupSharedSessions(sessionType SessionType, before int64) error {
+	values, err := p.getPrefix(p.keys.sessions)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for _, data := range values {
+		session, err := decodeSession(data)
+		if err != nil {
+			return err
+		}
+		if session.Type == sessionType && session.Timestamp < before {
+			keys = append(keys, p.keys.sessions+session.Key)
+		}
+	}
+	return p.deleteKeys(false, keys...)
+}
+
+func (p *EtcdProvider) getSharedSessions(sessionType SessionType, after int64) ([]Session, error) {
+	values, err := p.getPrefix(p.keys.sessions)
+	if err != nil {
+		return nil, err
+	}
+	var sessions []Session
+	for _, data := range values {
+		session, err := decodeSession(data)
+		if err != nil {
+			return nil, err
+		}
+		if session.Type == sessionType && session.Timestamp >= after {
+			sessions = append(sessions, session.getSession())
+		}
+	}
+	return sessions, nil
+}
+
+func (p *EtcdProvider) getTaskByName(name string) (Task, error) {
+	task := Task{
+		Name: name,
+	}
+	data, err := p.getKey(p.keys.tasks + name)
+	if err != nil {
+		return task, err
+	}
+	err = json.Unmarshal(data, &task)
+	return task, err
+}
+
+func (p *EtcdProvider) addTask(name string) error {
+	data, err := json.Marshal(Task{
+		Name:     name,
+		UpdateAt: util.GetTimeAsMsSinceEpoch(time.Now()),
+		Version:  0,
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	key := p.keys.tasks + name
+	resp, err := p.client.Txn(ctx).If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, string(data))).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("task %q already exists", name)
+	}
+	return nil
+}
+
+func (p *EtcdProvider) updateTaskInternal(name string, fn func(task *Task) error) error {
+	return p.atomicUpdate(p.keys.tasks+name, func(data []byte) ([]byte, error) {
+		if data == nil {
+			return nil, util.NewRecordNotFoundError(fmt.Sprintf("task %q does not exist", name))
+		}
+		var task Task
+		if err := json.Unmarshal(data, &task); err != nil {
+			return nil, err
+		}
+		if err := fn(&task); err != nil {
+			return nil, err
+		}
+		task.UpdateAt = util.GetTimeAsMsSinceEpoch(time.Now())
+		return json.Marshal(task)
+	})
+}
+
+func (p *EtcdProvider) updateTask(name string, version int64) error {
+	return p.updateTaskInternal(name, func(task *Task) error {
+		if task.Version != version {
+			return util.NewRecordNotFoundError(fmt.Sprintf("task %q, version mismatch", name))
+		}
+		task.Version++
+		return nil
+	})
+}
+
+func (p *EtcdProvider) updateTaskTimestamp(name string) error {
+	return p.updateTaskInternal(name, func(_ *Task) error {
+		return nil
+	})
+}
+
+func (p *EtcdProvider) putNode(node *Node) error {
+	session, err := p.getSession()
+	if err != nil {
+		return err
+	}
+	n := *node
+	if n.Name == currentNode.Name {
+		n.Data = getCurrentNodeData()
+	}
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	// the node is automatically unregistered if the lease expires
+	return p.putKey(p.keys.nodes+node.Name, data, clientv3.WithLease(session.Lease()))
+}
+
+func (p *EtcdProvider) addNode() error {
+	if err := currentNode.validate(); err != nil {
+		return fmt.Errorf("unable to register cluster node: %w", err)
+	}
+	now := util.GetTimeAsMsSinceEpoch(time.Now())
+	currentNode.CreatedAt = now
+	currentNode.UpdatedAt = now
+	if err := p.putNode(currentNode); err != nil {
+		return fmt.Errorf("unable to register cluster node: %w", err)
+	}
+	providerLog(logger.LevelInfo, "registered as cluster node %q, port: %d, proto: %s",
+		currentNode.Name, currentNode.Data.Port, currentNode.Data.Proto)
+	return nil
+}
+
+func (p *EtcdProvider) getNodeByName(name string) (Node, error) {
+	var node Node
+	data, err := p.getKey(p.keys.nodes + name)
+	if err != nil {
+		return node, err
+	}
+	if err := json.Unmarshal(data, &node); err != nil {
+		return node, err
+	}
+	if node.UpdatedAt < util.GetTimeAsMsSinceEpoch(time.Now().Add(activeNodeTimeDiff)) {
+		return node, util.NewRecordNotFoundError(fmt.Sprintf("node %q is not active", name))
+	}
+	return node, nil
+}
+
+func (p *EtcdProvider) getNodes() ([]Node, error) {
+	values, err := p.getPrefix(p.keys.nodes)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []Node
+	limit := util.GetTimeAsMsSinceEpoch(time.Now().Add(activeNodeTimeDiff))
+	for _, data := range values {
+		var node Node
+		if err := json.Unmarshal(data, &node); err != nil {
+			return nodes, err
+		}
+		if node.Name != currentNode.Name && node.UpdatedAt > limit {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name < nodes[j].Name
+	})
+	return nodes, nil
+}
+
+func (p *EtcdProvider) updateNodeTimestamp() error {
+	currentNode.UpdatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+	// we store the node again, this way it is registered again if the
+	// previous lease expired, for example after a network partition
+	return p.putNode(currentNode)
+}
+
+func (p *EtcdProvider) updateNodeConnections() error {
+	return p.updateNodeTimestamp()
+}
+
+func (p *EtcdProvider) cleanupNodes() error {
+	// nodes are leased keys, etcd removes them if not refreshed
+	return nil
+}
+
+func (p *EtcdProvider) close() error {
+	if p.cancel != nil {
+		p.cancel()
+	}
+	p.sessionMu.Lock()
+	if p.session != nil {
+		if err := p.session.Close(); err != nil {
+			providerLog(logger.LevelWarn, "unable to close etcd session: %v", err)
+		}
+		p.session = nil
+	}
+	p.sessionMu.Unlock()
+
+	if err := p.client.Close(); err != nil {
+		providerLog(logger.LevelWarn, "unable to close etcd client: %v", err)
+	}
+	return p.MemoryProvider.close()
+}
+
+func (p *EtcdProvider) reloadConfig() error {
+	return nil
+}
+
+func (p *EtcdProvider) initializeDatabase() error {
+	data, err := json.Marshal(map[string]any{
+		"version":    etcdDatabaseVersion,
+		"updated_at": util.GetTimeAsMsSinceEpoch(time.Now()),
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	resp, err := p.client.Txn(ctx).If(clientv3.Compare(clientv3.CreateRevision(p.keys.version), "=", 0)).
+		Then(clientv3.OpPut(p.keys.version, string(data))).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return ErrNoInitRequired
+	}
+	return nil
+}
+
+func (p *EtcdProvider) migrateDatabase() error {
+	data, err := p.getKey(p.keys.version)
+	if err != nil {
+		return err
+	}
+	var dbVersion struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &dbVersion); err != nil {
+		return err
+	}
+	switch v := dbVersion.Version; {
+	case v == etcdDatabaseVersion:
+		providerLog(logger.LevelDebug, "etcd database is up to date, current version: %d", v)
+		return ErrNoInitRequired
+	case v > etcdDatabaseVersion:
+		providerLog(logger.LevelError, "database schema version %d is newer than the supported one: %d", v,
+			etcdDatabaseVersion)
+		logger.WarnToConsole("database schema version %d is newer than the supported one: %d", v,
+			etcdDatabaseVersion)
+		return nil
+	default:
+		return fmt.Errorf("database schema version not handled: %d", v)
+	}
+}
+
+func (p *EtcdProvider) revertDatabase(targetVersion int) error {
+	if targetVersion >= etcdDatabaseVersion {
+		return ErrNoInitRequired
+	}
+	return errors.New("etcd provider does not support reverting the database schema")
+}
+
+func (p *EtcdProvider) resetDatabase() error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	prefix := strings.TrimSuffix(p.keys.data, "data/")
+	_, err := p.client.Delete(ctx, prefix, clientv3.WithPrefix())
+	return err
+}
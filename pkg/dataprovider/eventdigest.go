@@ -0,0 +1,135 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// Supported digest intervals
+const (
+	DigestIntervalHourly = iota + 1
+	DigestIntervalDaily
+)
+
+var (
+	supportedDigestIntervals = []int{DigestIntervalHourly, DigestIntervalDaily}
+)
+
+func isDigestIntervalValid(interval int) bool {
+	return util.Contains(supportedDigestIntervals, interval)
+}
+
+func getDigestIntervalAsString(interval int) string {
+	switch interval {
+	case DigestIntervalHourly:
+		return "hourly"
+	case DigestIntervalDaily:
+		return "daily"
+	default:
+		return ""
+	}
+}
+
+// GetDigestWindow returns the start and the end of the digest window, for
+// the specified interval, containing the given time
+func GetDigestWindow(interval int, t time.Time) (time.Time, time.Time) {
+	t = t.UTC()
+	switch interval {
+	case DigestIntervalDaily:
+		start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1)
+	default:
+		start := t.Truncate(time.Hour)
+		return start, start.Add(time.Hour)
+	}
+}
+
+// EventDigestEntry defines an event waiting to be notified within a digest
+type EventDigestEntry struct {
+	ID int64 `json:"id"`
+	// Rule and action that generated the entry
+	RuleName   string `json:"rule_name"`
+	ActionName string `json:"action_name"`
+	// User or object name the event refers to. Events are aggregated
+	// per rule, action and name
+	Name string `json:"name"`
+	// End of the digest window as unix timestamp in milliseconds
+	WindowEnd int64 `json:"window_end"`
+	// Serialized event
+	Data []byte `json:"data"`
+	// Creation time as unix timestamp in milliseconds
+	CreatedAt int64 `json:"created_at"`
+}
+
+func (e *EventDigestEntry) validate() error {
+	if e.RuleName == "" {
+		return util.NewValidationError("digest entry rule name is mandatory")
+	}
+	if e.ActionName == "" {
+		return util.NewValidationError("digest entry action name is mandatory")
+	}
+	if e.WindowEnd <= 0 {
+		return util.NewValidationError(fmt.Sprintf("invalid digest entry window end: %d", e.WindowEnd))
+	}
+	return nil
+}
+
+func (e *EventDigestEntry) getACopy() EventDigestEntry {
+	data := make([]byte, len(e.Data))
+	copy(data, e.Data)
+	return EventDigestEntry{
+		ID:         e.ID,
+		RuleName:   e.RuleName,
+		ActionName: e.ActionName,
+		Name:       e.Name,
+		WindowEnd:  e.WindowEnd,
+		Data:       data,
+		CreatedAt:  e.CreatedAt,
+	}
+}
+
+func sortEventDigestEntries(entries []EventDigestEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+}
+
+// AddEventDigestEntry stores a new event waiting to be notified within a digest
+func AddEventDigestEntry(entry *EventDigestEntry) error {
+	entry.CreatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+	return provider.addEventDigestEntry(entry)
+}
+
+// GetEventDigestEntries returns the digest entries whose window ended
+// before the specified time, sorted by ID
+func GetEventDigestEntries(before time.Time) ([]EventDigestEntry, error) {
+	return provider.getEventDigestEntries(util.GetTimeAsMsSinceEpoch(before))
+}
+
+// DeleteEventDigestEntries removes the digest entries with the specified IDs.
+// If some entries no longer exist, for example because they were already
+// processed by another instance, nothing is removed and a not found error
+// is returned
+func DeleteEventDigestEntries(ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return provider.deleteEventDigestEntries(ids)
+}
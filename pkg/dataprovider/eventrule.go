@@ -23,6 +23,7 @@ import (
 	"net/http"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
@@ -48,13 +49,18 @@ const (
 	ActionTypePasswordExpirationCheck
 	ActionTypeUserExpirationCheck
 	ActionTypeIDPAccountCheck
+	ActionTypePublicKeyExpirationCheck
+	ActionTypeTiering
+	ActionTypeWorkflow
+	ActionTypeReport
 )
 
 var (
 	supportedEventActions = []int{ActionTypeHTTP, ActionTypeCommand, ActionTypeEmail, ActionTypeFilesystem,
 		ActionTypeBackup, ActionTypeUserQuotaReset, ActionTypeFolderQuotaReset, ActionTypeTransferQuotaReset,
 		ActionTypeDataRetentionCheck, ActionTypeMetadataCheck, ActionTypePasswordExpirationCheck,
-		ActionTypeUserExpirationCheck, ActionTypeIDPAccountCheck}
+		ActionTypeUserExpirationCheck, ActionTypeIDPAccountCheck, ActionTypePublicKeyExpirationCheck,
+		ActionTypeTiering, ActionTypeWorkflow, ActionTypeReport}
 )
 
 func isActionTypeValid(action int) bool {
@@ -87,6 +93,14 @@ func getActionTypeAsString(action int) string {
 		return "User expiration check"
 	case ActionTypeIDPAccountCheck:
 		return "Identity Provider account check"
+	case ActionTypePublicKeyExpirationCheck:
+		return "Public key expiration check"
+	case ActionTypeTiering:
+		return "Tiering"
+	case ActionTypeWorkflow:
+		return "Workflow"
+	case ActionTypeReport:
+		return "Report"
 	default:
 		return "Command"
 	}
@@ -108,6 +122,16 @@ const (
 var (
 	supportedEventTriggers = []int{EventTriggerFsEvent, EventTriggerProviderEvent, EventTriggerSchedule,
 		EventTriggerIPBlocked, EventTriggerCertificate, EventTriggerIDPLogin, EventTriggerOnDemand}
+	// triggers allowed for the rules owned by a role, the other triggers are not
+	// related to the role objects
+	tenantEventTriggers = []int{EventTriggerFsEvent, EventTriggerProviderEvent, EventTriggerSchedule,
+		EventTriggerOnDemand}
+	// actions allowed for the rules owned by a role, they only affect the users matching
+	// the rule conditions. Backups and folder quota resets are global
+	tenantEventActions = []int{ActionTypeHTTP, ActionTypeCommand, ActionTypeEmail, ActionTypeFilesystem,
+		ActionTypeUserQuotaReset, ActionTypeTransferQuotaReset, ActionTypeDataRetentionCheck,
+		ActionTypeMetadataCheck, ActionTypePasswordExpirationCheck, ActionTypeUserExpirationCheck,
+		ActionTypePublicKeyExpirationCheck, ActionTypeTiering, ActionTypeWorkflow, ActionTypeReport}
 )
 
 func isEventTriggerValid(trigger int) bool {
@@ -152,6 +176,7 @@ const (
 	FilesystemActionExist
 	FilesystemActionCompress
 	FilesystemActionCopy
+	FilesystemActionPGPEncrypt
 )
 
 const (
@@ -161,7 +186,7 @@ const (
 
 var (
 	supportedFsActions = []int{FilesystemActionRename, FilesystemActionDelete, FilesystemActionMkdirs,
-		FilesystemActionCopy, FilesystemActionCompress, FilesystemActionExist}
+		FilesystemActionCopy, FilesystemActionCompress, FilesystemActionExist, FilesystemActionPGPEncrypt}
 )
 
 func isFilesystemActionValid(value int) bool {
@@ -180,6 +205,8 @@ func getFsActionTypeAsString(value int) string {
 		return "Compress"
 	case FilesystemActionCopy:
 		return "Copy"
+	case FilesystemActionPGPEncrypt:
+		return "PGP encrypt"
 	default:
 		return "Create directories"
 	}
@@ -189,12 +216,13 @@ func getFsActionTypeAsString(value int) string {
 var (
 	// SupportedFsEvents defines the supported filesystem events
 	SupportedFsEvents = []string{"upload", "pre-upload", "first-upload", "download", "pre-download",
-		"first-download", "delete", "pre-delete", "rename", "mkdir", "rmdir", "pre-lsdir", "copy", "ssh_cmd"}
+		"first-download", "delete", "pre-delete", "rename", "mkdir", "rmdir", "pre-lsdir", "copy", "ssh_cmd",
+		"session-terminated", "upload-rejected"}
 	// SupportedProviderEvents defines the supported provider events
 	SupportedProviderEvents = []string{operationAdd, operationUpdate, operationDelete}
 	// SupportedRuleConditionProtocols defines the supported protcols for rule conditions
 	SupportedRuleConditionProtocols = []string{"SFTP", "SCP", "SSH", "FTP", "DAV", "HTTP", "HTTPShare",
-		"OIDC"}
+		"OIDC", "SAML"}
 	// SupporteRuleConditionProviderObjects defines the supported provider objects for rule conditions
 	SupporteRuleConditionProviderObjects = []string{actionObjectUser, actionObjectFolder, actionObjectGroup,
 		actionObjectAdmin, actionObjectAPIKey, actionObjectShare, actionObjectEventRule, actionObjectEventAction}
@@ -600,6 +628,304 @@ func (c *EventActionDataRetentionConfig) validate() error {
 	return nil
 }
 
+// TieringPolicy defines the conditions to move the files inside a directory
+// to the cold storage. All the defined conditions must match
+type TieringPolicy struct {
+	// Path is the virtual directory path, if no other specific policy is defined,
+	// the policy applies for sub directories too. For example if policies are defined
+	// for the paths "/" and "/sub" then the policy for "/" is applied for any file outside
+	// the "/sub" directory
+	Path string `json:"path"`
+	// Files not modified for at least this number of hours are moved
+	MinAge int `json:"min_age,omitempty"`
+	// Files not accessed for at least this number of hours are moved
+	MinIdleTime int `json:"min_idle_time,omitempty"`
+	// Files smaller than this size, as bytes, are not moved
+	MinSize int64 `json:"min_size,omitempty"`
+}
+
+// IsExcluded returns true if no age or last access condition is defined,
+// the files inside this path are never moved
+func (p *TieringPolicy) IsExcluded() bool {
+	return p.MinAge == 0 && p.MinIdleTime == 0
+}
+
+// Validate returns an error if the policy is not valid
+func (p *TieringPolicy) Validate() error {
+	p.Path = util.CleanPath(p.Path)
+	if p.MinAge < 0 {
+		return util.NewValidationError(fmt.Sprintf("invalid tiering min age %d, it must be greater or equal to zero",
+			p.MinAge))
+	}
+	if p.MinIdleTime < 0 {
+		return util.NewValidationError(fmt.Sprintf("invalid tiering min idle time %d, it must be greater or equal to zero",
+			p.MinIdleTime))
+	}
+	if p.MinSize < 0 {
+		return util.NewValidationError(fmt.Sprintf("invalid tiering min size %d, it must be greater or equal to zero",
+			p.MinSize))
+	}
+	return nil
+}
+
+// EventActionTieringConfig defines the configuration for a tiering action.
+// The matching files are moved from the users' local filesystem to the
+// cold storage folder and replaced with stubs recalled on access
+type EventActionTieringConfig struct {
+	// Name of the virtual folder used as cold storage
+	Folder   string          `json:"folder,omitempty"`
+	Policies []TieringPolicy `json:"policies,omitempty"`
+}
+
+func (c *EventActionTieringConfig) validate() error {
+	c.Folder = strings.TrimSpace(c.Folder)
+	if c.Folder == "" {
+		return util.NewValidationError("cold storage folder is mandatory")
+	}
+	policyPaths := make(map[string]bool)
+	nothingToDo := true
+	for idx := range c.Policies {
+		p := &c.Policies[idx]
+		if err := p.Validate(); err != nil {
+			return err
+		}
+		if !p.IsExcluded() {
+			nothingToDo = false
+		}
+		if _, ok := policyPaths[p.Path]; ok {
+			return util.NewValidationError(fmt.Sprintf("duplicated tiering path %q", p.Path))
+		}
+		policyPaths[p.Path] = true
+	}
+	if nothingToDo {
+		return util.NewValidationError("nothing to move!")
+	}
+	return nil
+}
+
+// WorkflowStepEnd can be used as on success or on failure target to end the
+// workflow without executing the remaining steps
+const WorkflowStepEnd = "end"
+
+const maxWorkflowSteps = 50
+
+var workflowStepNameRegex = regexp.MustCompile("^[a-zA-Z0-9_]+$")
+
+// WorkflowStep defines a step of a workflow action
+type WorkflowStep struct {
+	// Step name, the output of the step is available to the next steps
+	// using the {{StepOutput<name>}} placeholder
+	Name string `json:"name"`
+	// Name of the event action to execute
+	Action string `json:"action"`
+	// Step to execute if the action succeeds, empty means the next step
+	OnSuccess string `json:"on_success,omitempty"`
+	// Step to execute if the action fails, empty means that the workflow fails
+	OnFailure string `json:"on_failure,omitempty"`
+}
+
+// EventActionWorkflowConfig defines the configuration for a workflow action.
+// The steps are executed in order, the on success and on failure branches
+// can only jump to a later step, so loops are not possible
+type EventActionWorkflowConfig struct {
+	Steps []WorkflowStep `json:"steps,omitempty"`
+}
+
+// GetStepIndex returns the index of the step with the specified name, -1 if
+// the step does not exist
+func (c *EventActionWorkflowConfig) GetStepIndex(name string) int {
+	for idx := range c.Steps {
+		if c.Steps[idx].Name == name {
+			return idx
+		}
+	}
+	return -1
+}
+
+func (c *EventActionWorkflowConfig) validateTarget(idx int, target, branch string) error {
+	if target == "" || target == WorkflowStepEnd {
+		return nil
+	}
+	targetIdx := c.GetStepIndex(target)
+	if targetIdx < 0 {
+		return util.NewValidationError(fmt.Sprintf("workflow step %q: %s step %q does not exist",
+			c.Steps[idx].Name, branch, target))
+	}
+	if targetIdx <= idx {
+		return util.NewValidationError(fmt.Sprintf("workflow step %q: %s step %q must be a later step",
+			c.Steps[idx].Name, branch, target))
+	}
+	return nil
+}
+
+func (c *EventActionWorkflowConfig) validate(name string) error {
+	if len(c.Steps) == 0 {
+		return util.NewValidationError("at least a workflow step is required")
+	}
+	if len(c.Steps) > maxWorkflowSteps {
+		return util.NewValidationError(fmt.Sprintf("too many workflow steps, %d is the maximum allowed", maxWorkflowSteps))
+	}
+	names := make(map[string]bool)
+	for idx := range c.Steps {
+		step := &c.Steps[idx]
+		step.Name = strings.TrimSpace(step.Name)
+		step.Action = strings.TrimSpace(step.Action)
+		step.OnSuccess = strings.TrimSpace(step.OnSuccess)
+		step.OnFailure = strings.TrimSpace(step.OnFailure)
+		if step.Name == "" {
+			step.Name = fmt.Sprintf("step%d", idx+1)
+		}
+		if !workflowStepNameRegex.MatchString(step.Name) || step.Name == WorkflowStepEnd {
+			return util.NewValidationError(fmt.Sprintf("invalid workflow step name %q, the following characters are allowed: a-zA-Z0-9_ and %q is reserved",
+				step.Name, WorkflowStepEnd))
+		}
+		if names[step.Name] {
+			return util.NewValidationError(fmt.Sprintf("duplicated workflow step %q", step.Name))
+		}
+		names[step.Name] = true
+		if step.Action == "" {
+			return util.NewValidationError(fmt.Sprintf("workflow step %q: action is mandatory", step.Name))
+		}
+		if step.Action == name {
+			return util.NewValidationError(fmt.Sprintf("workflow step %q: a workflow cannot execute itself", step.Name))
+		}
+	}
+	for idx := range c.Steps {
+		if err := c.validateTarget(idx, c.Steps[idx].OnSuccess, "on success"); err != nil {
+			return err
+		}
+		if err := c.validateTarget(idx, c.Steps[idx].OnFailure, "on failure"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *EventActionWorkflowConfig) getACopy() EventActionWorkflowConfig {
+	steps := make([]WorkflowStep, len(c.Steps))
+	copy(steps, c.Steps)
+	return EventActionWorkflowConfig{
+		Steps: steps,
+	}
+}
+
+// Supported report types
+const (
+	// Uploads and downloads per user
+	ReportTypeTransfers = "transfers"
+	// Disk and transfer quota usage per user
+	ReportTypeQuotaUsage = "quota_usage"
+	// Failed logins per username
+	ReportTypeFailedLogins = "failed_logins"
+)
+
+// Supported report formats
+const (
+	ReportFormatCSV  = "csv"
+	ReportFormatJSON = "json"
+)
+
+// one year
+const maxReportPeriod = 8784
+
+var (
+	// SupportedReportTypes defines the supported report types
+	SupportedReportTypes   = []string{ReportTypeTransfers, ReportTypeQuotaUsage, ReportTypeFailedLogins}
+	supportedReportFormats = []string{ReportFormatCSV, ReportFormatJSON}
+)
+
+// EventActionReportConfig defines the configuration for a report action.
+// The generated reports are sent via email, uploaded to a virtual folder
+// or both
+type EventActionReportConfig struct {
+	// Reports to generate, see the supported report types
+	Reports []string `json:"reports,omitempty"`
+	// Report format: csv or json
+	Format string `json:"format,omitempty"`
+	// Reporting period, as hours, ending when the action is executed.
+	// Not used for the quota usage report
+	Period int `json:"period,omitempty"`
+	// Email recipients for the reports
+	Recipients []string `json:"recipients,omitempty"`
+	// Name of the virtual folder where the reports are uploaded
+	Folder string `json:"folder,omitempty"`
+	// Directory, inside the virtual folder, for the reports.
+	// Placeholders are supported
+	Path string `json:"path,omitempty"`
+}
+
+// HasPeriodReports returns true if at least a report covers the reporting period
+func (c *EventActionReportConfig) HasPeriodReports() bool {
+	for _, r := range c.Reports {
+		if r != ReportTypeQuotaUsage {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *EventActionReportConfig) validate() error {
+	reports := make([]string, 0, len(c.Reports))
+	for _, r := range c.Reports {
+		r = strings.TrimSpace(r)
+		if !util.Contains(SupportedReportTypes, r) {
+			return util.NewValidationError(fmt.Sprintf("invalid report type %q", r))
+		}
+		if !util.Contains(reports, r) {
+			reports = append(reports, r)
+		}
+	}
+	if len(reports) == 0 {
+		return util.NewValidationError("at least a report is required")
+	}
+	c.Reports = reports
+	if c.Format == "" {
+		c.Format = ReportFormatCSV
+	}
+	if !util.Contains(supportedReportFormats, c.Format) {
+		return util.NewValidationError(fmt.Sprintf("invalid report format %q", c.Format))
+	}
+	if c.HasPeriodReports() {
+		if c.Period <= 0 || c.Period > maxReportPeriod {
+			return util.NewValidationError(fmt.Sprintf("invalid report period %d, it must be between 1 and %d hours",
+				c.Period, maxReportPeriod))
+		}
+	} else {
+		c.Period = 0
+	}
+	c.Recipients = util.RemoveDuplicates(c.Recipients, true)
+	for _, r := range c.Recipients {
+		if r == "" {
+			return util.NewValidationError("invalid report recipients")
+		}
+	}
+	c.Folder = strings.TrimSpace(c.Folder)
+	if c.Folder == "" {
+		c.Path = ""
+	} else {
+		c.Path = util.CleanPath(c.Path)
+	}
+	if len(c.Recipients) == 0 && c.Folder == "" {
+		return util.NewValidationError("at least an email recipient or a folder is required to deliver the reports")
+	}
+	return nil
+}
+
+func (c *EventActionReportConfig) getACopy() EventActionReportConfig {
+	reports := make([]string, len(c.Reports))
+	copy(reports, c.Reports)
+	recipients := make([]string, len(c.Recipients))
+	copy(recipients, c.Recipients)
+	return EventActionReportConfig{
+		Reports:    reports,
+		Format:     c.Format,
+		Period:     c.Period,
+		Recipients: recipients,
+		Folder:     c.Folder,
+		Path:       c.Path,
+	}
+}
+
 // EventActionFsCompress defines the configuration for the compress filesystem action
 type EventActionFsCompress struct {
 	// Archive path
@@ -630,6 +956,58 @@ func (c *EventActionFsCompress) validate() error {
 	return nil
 }
 
+// EventActionFsPGPEncrypt defines the configuration for the PGP encrypt filesystem action
+type EventActionFsPGPEncrypt struct {
+	// Files to encrypt, key is the source and value the target. An empty
+	// target means the source path with the ".pgp" extension
+	Paths []KeyValue `json:"paths,omitempty"`
+	// Armored OpenPGP public key used to encrypt the files
+	PublicKey string `json:"public_key,omitempty"`
+	// If true the source files are removed after a successful encryption
+	RemoveSource bool `json:"remove_source,omitempty"`
+}
+
+func (c *EventActionFsPGPEncrypt) validate() error {
+	if len(c.Paths) == 0 {
+		return util.NewValidationError("no path to encrypt specified")
+	}
+	for idx, kv := range c.Paths {
+		key := strings.TrimSpace(kv.Key)
+		value := strings.TrimSpace(kv.Value)
+		if key == "" {
+			return util.NewValidationError("invalid path to encrypt")
+		}
+		key = util.CleanPath(key)
+		if value == "" {
+			value = key + ".pgp"
+		}
+		value = util.CleanPath(value)
+		if key == value {
+			return util.NewValidationError("encryption source and target cannot be equal")
+		}
+		if key == "/" || value == "/" {
+			return util.NewValidationError("encrypting the root directory is not allowed")
+		}
+		c.Paths[idx] = KeyValue{
+			Key:   key,
+			Value: value,
+		}
+	}
+	c.PublicKey = strings.TrimSpace(c.PublicKey)
+	if _, err := util.ReadPGPPublicKeys(c.PublicKey); err != nil {
+		return util.NewValidationError(err.Error())
+	}
+	return nil
+}
+
+func (c *EventActionFsPGPEncrypt) getACopy() EventActionFsPGPEncrypt {
+	return EventActionFsPGPEncrypt{
+		Paths:        cloneKeyValues(c.Paths),
+		PublicKey:    c.PublicKey,
+		RemoveSource: c.RemoveSource,
+	}
+}
+
 // EventActionFilesystemConfig defines the configuration for filesystem actions
 type EventActionFilesystemConfig struct {
 	// Filesystem actions, see the above enum
@@ -646,6 +1024,8 @@ type EventActionFilesystemConfig struct {
 	Copy []KeyValue `json:"copy,omitempty"`
 	// paths to compress and archive name
 	Compress EventActionFsCompress `json:"compress"`
+	// files to encrypt and public key
+	PGPEncrypt EventActionFsPGPEncrypt `json:"pgp_encrypt"`
 }
 
 // GetDeletesAsString returns the list of items to delete as comma separated string.
@@ -786,6 +1166,7 @@ func (c *EventActionFilesystemConfig) validate() error {
 		c.Exist = nil
 		c.Copy = nil
 		c.Compress = EventActionFsCompress{}
+		c.PGPEncrypt = EventActionFsPGPEncrypt{}
 		if err := c.validateRenames(); err != nil {
 			return err
 		}
@@ -795,6 +1176,7 @@ func (c *EventActionFilesystemConfig) validate() error {
 		c.Exist = nil
 		c.Copy = nil
 		c.Compress = EventActionFsCompress{}
+		c.PGPEncrypt = EventActionFsPGPEncrypt{}
 		if err := c.validateDeletes(); err != nil {
 			return err
 		}
@@ -804,6 +1186,7 @@ func (c *EventActionFilesystemConfig) validate() error {
 		c.Exist = nil
 		c.Copy = nil
 		c.Compress = EventActionFsCompress{}
+		c.PGPEncrypt = EventActionFsPGPEncrypt{}
 		if err := c.validateMkdirs(); err != nil {
 			return err
 		}
@@ -813,6 +1196,7 @@ func (c *EventActionFilesystemConfig) validate() error {
 		c.MkDirs = nil
 		c.Copy = nil
 		c.Compress = EventActionFsCompress{}
+		c.PGPEncrypt = EventActionFsPGPEncrypt{}
 		if err := c.validateExist(); err != nil {
 			return err
 		}
@@ -822,6 +1206,7 @@ func (c *EventActionFilesystemConfig) validate() error {
 		c.Deletes = nil
 		c.Exist = nil
 		c.Copy = nil
+		c.PGPEncrypt = EventActionFsPGPEncrypt{}
 		if err := c.Compress.validate(); err != nil {
 			return err
 		}
@@ -831,9 +1216,20 @@ func (c *EventActionFilesystemConfig) validate() error {
 		c.MkDirs = nil
 		c.Exist = nil
 		c.Compress = EventActionFsCompress{}
+		c.PGPEncrypt = EventActionFsPGPEncrypt{}
 		if err := c.validateCopy(); err != nil {
 			return err
 		}
+	case FilesystemActionPGPEncrypt:
+		c.Renames = nil
+		c.Deletes = nil
+		c.MkDirs = nil
+		c.Exist = nil
+		c.Copy = nil
+		c.Compress = EventActionFsCompress{}
+		if err := c.PGPEncrypt.validate(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -859,6 +1255,7 @@ func (c *EventActionFilesystemConfig) getACopy() EventActionFilesystemConfig {
 			Paths: compressPaths,
 			Name:  c.Compress.Name,
 		},
+		PGPEncrypt: c.PGPEncrypt.getACopy(),
 	}
 }
 
@@ -876,6 +1273,20 @@ func (c *EventActionPasswordExpiration) validate() error {
 	return nil
 }
 
+// EventActionPublicKeyExpiration defines the configuration for public key expiration actions
+type EventActionPublicKeyExpiration struct {
+	// An email notification will be generated for users with public keys expiring in a
+	// number of days less than or equal to this threshold
+	Threshold int `json:"threshold,omitempty"`
+}
+
+func (c *EventActionPublicKeyExpiration) validate() error {
+	if c.Threshold <= 0 {
+		return util.NewValidationError("threshold must be greater than 0")
+	}
+	return nil
+}
+
 // EventActionIDPAccountCheck defines the check to execute after a successful IDP login
 type EventActionIDPAccountCheck struct {
 	// 0 create/update, 1 create the account if it doesn't exist
@@ -896,13 +1307,17 @@ func (c *EventActionIDPAccountCheck) validate() error {
 
 // BaseEventActionOptions defines the supported configuration options for a base event actions
 type BaseEventActionOptions struct {
-	HTTPConfig          EventActionHTTPConfig          `json:"http_config"`
-	CmdConfig           EventActionCommandConfig       `json:"cmd_config"`
-	EmailConfig         EventActionEmailConfig         `json:"email_config"`
-	RetentionConfig     EventActionDataRetentionConfig `json:"retention_config"`
-	FsConfig            EventActionFilesystemConfig    `json:"fs_config"`
-	PwdExpirationConfig EventActionPasswordExpiration  `json:"pwd_expiration_config"`
-	IDPConfig           EventActionIDPAccountCheck     `json:"idp_config"`
+	HTTPConfig             EventActionHTTPConfig          `json:"http_config"`
+	CmdConfig              EventActionCommandConfig       `json:"cmd_config"`
+	EmailConfig            EventActionEmailConfig         `json:"email_config"`
+	RetentionConfig        EventActionDataRetentionConfig `json:"retention_config"`
+	FsConfig               EventActionFilesystemConfig    `json:"fs_config"`
+	PwdExpirationConfig    EventActionPasswordExpiration  `json:"pwd_expiration_config"`
+	PubKeyExpirationConfig EventActionPublicKeyExpiration `json:"pubkey_expiration_config"`
+	IDPConfig              EventActionIDPAccountCheck     `json:"idp_config"`
+	TieringConfig          EventActionTieringConfig       `json:"tiering_config"`
+	WorkflowConfig         EventActionWorkflowConfig      `json:"workflow_config"`
+	ReportConfig           EventActionReportConfig        `json:"report_config"`
 }
 
 func (o *BaseEventActionOptions) getACopy() BaseEventActionOptions {
@@ -924,6 +1339,15 @@ func (o *BaseEventActionOptions) getACopy() BaseEventActionOptions {
 			IgnoreUserPermissions: folder.IgnoreUserPermissions,
 		})
 	}
+	tieringPolicies := make([]TieringPolicy, 0, len(o.TieringConfig.Policies))
+	for _, p := range o.TieringConfig.Policies {
+		tieringPolicies = append(tieringPolicies, TieringPolicy{
+			Path:        p.Path,
+			MinAge:      p.MinAge,
+			MinIdleTime: p.MinIdleTime,
+			MinSize:     p.MinSize,
+		})
+	}
 	httpParts := make([]HTTPPart, 0, len(o.HTTPConfig.Parts))
 	for _, part := range o.HTTPConfig.Parts {
 		httpParts = append(httpParts, HTTPPart{
@@ -967,12 +1391,21 @@ func (o *BaseEventActionOptions) getACopy() BaseEventActionOptions {
 		PwdExpirationConfig: EventActionPasswordExpiration{
 			Threshold: o.PwdExpirationConfig.Threshold,
 		},
+		PubKeyExpirationConfig: EventActionPublicKeyExpiration{
+			Threshold: o.PubKeyExpirationConfig.Threshold,
+		},
 		IDPConfig: EventActionIDPAccountCheck{
 			Mode:          o.IDPConfig.Mode,
 			TemplateUser:  o.IDPConfig.TemplateUser,
 			TemplateAdmin: o.IDPConfig.TemplateAdmin,
 		},
-		FsConfig: o.FsConfig.getACopy(),
+		TieringConfig: EventActionTieringConfig{
+			Folder:   o.TieringConfig.Folder,
+			Policies: tieringPolicies,
+		},
+		WorkflowConfig: o.WorkflowConfig.getACopy(),
+		ReportConfig:   o.ReportConfig.getACopy(),
+		FsConfig:       o.FsConfig.getACopy(),
 	}
 }
 
@@ -1004,7 +1437,11 @@ func (o *BaseEventActionOptions) validate(action int, name string) error {
 		o.RetentionConfig = EventActionDataRetentionConfig{}
 		o.FsConfig = EventActionFilesystemConfig{}
 		o.PwdExpirationConfig = EventActionPasswordExpiration{}
+		o.PubKeyExpirationConfig = EventActionPublicKeyExpiration{}
 		o.IDPConfig = EventActionIDPAccountCheck{}
+		o.TieringConfig = EventActionTieringConfig{}
+		o.WorkflowConfig = EventActionWorkflowConfig{}
+		o.ReportConfig = EventActionReportConfig{}
 		return o.HTTPConfig.validate(name)
 	case ActionTypeCommand:
 		o.HTTPConfig = EventActionHTTPConfig{}
@@ -1012,7 +1449,11 @@ func (o *BaseEventActionOptions) validate(action int, name string) error {
 		o.RetentionConfig = EventActionDataRetentionConfig{}
 		o.FsConfig = EventActionFilesystemConfig{}
 		o.PwdExpirationConfig = EventActionPasswordExpiration{}
+		o.PubKeyExpirationConfig = EventActionPublicKeyExpiration{}
 		o.IDPConfig = EventActionIDPAccountCheck{}
+		o.TieringConfig = EventActionTieringConfig{}
+		o.WorkflowConfig = EventActionWorkflowConfig{}
+		o.ReportConfig = EventActionReportConfig{}
 		return o.CmdConfig.validate()
 	case ActionTypeEmail:
 		o.HTTPConfig = EventActionHTTPConfig{}
@@ -1020,7 +1461,11 @@ func (o *BaseEventActionOptions) validate(action int, name string) error {
 		o.RetentionConfig = EventActionDataRetentionConfig{}
 		o.FsConfig = EventActionFilesystemConfig{}
 		o.PwdExpirationConfig = EventActionPasswordExpiration{}
+		o.PubKeyExpirationConfig = EventActionPublicKeyExpiration{}
 		o.IDPConfig = EventActionIDPAccountCheck{}
+		o.TieringConfig = EventActionTieringConfig{}
+		o.WorkflowConfig = EventActionWorkflowConfig{}
+		o.ReportConfig = EventActionReportConfig{}
 		return o.EmailConfig.validate()
 	case ActionTypeDataRetentionCheck:
 		o.HTTPConfig = EventActionHTTPConfig{}
@@ -1028,7 +1473,11 @@ func (o *BaseEventActionOptions) validate(action int, name string) error {
 		o.EmailConfig = EventActionEmailConfig{}
 		o.FsConfig = EventActionFilesystemConfig{}
 		o.PwdExpirationConfig = EventActionPasswordExpiration{}
+		o.PubKeyExpirationConfig = EventActionPublicKeyExpiration{}
 		o.IDPConfig = EventActionIDPAccountCheck{}
+		o.TieringConfig = EventActionTieringConfig{}
+		o.WorkflowConfig = EventActionWorkflowConfig{}
+		o.ReportConfig = EventActionReportConfig{}
 		return o.RetentionConfig.validate()
 	case ActionTypeFilesystem:
 		o.HTTPConfig = EventActionHTTPConfig{}
@@ -1036,7 +1485,11 @@ func (o *BaseEventActionOptions) validate(action int, name string) error {
 		o.EmailConfig = EventActionEmailConfig{}
 		o.RetentionConfig = EventActionDataRetentionConfig{}
 		o.PwdExpirationConfig = EventActionPasswordExpiration{}
+		o.PubKeyExpirationConfig = EventActionPublicKeyExpiration{}
 		o.IDPConfig = EventActionIDPAccountCheck{}
+		o.TieringConfig = EventActionTieringConfig{}
+		o.WorkflowConfig = EventActionWorkflowConfig{}
+		o.ReportConfig = EventActionReportConfig{}
 		return o.FsConfig.validate()
 	case ActionTypePasswordExpirationCheck:
 		o.HTTPConfig = EventActionHTTPConfig{}
@@ -1044,8 +1497,24 @@ func (o *BaseEventActionOptions) validate(action int, name string) error {
 		o.EmailConfig = EventActionEmailConfig{}
 		o.RetentionConfig = EventActionDataRetentionConfig{}
 		o.FsConfig = EventActionFilesystemConfig{}
+		o.PubKeyExpirationConfig = EventActionPublicKeyExpiration{}
 		o.IDPConfig = EventActionIDPAccountCheck{}
+		o.TieringConfig = EventActionTieringConfig{}
+		o.WorkflowConfig = EventActionWorkflowConfig{}
+		o.ReportConfig = EventActionReportConfig{}
 		return o.PwdExpirationConfig.validate()
+	case ActionTypePublicKeyExpirationCheck:
+		o.HTTPConfig = EventActionHTTPConfig{}
+		o.CmdConfig = EventActionCommandConfig{}
+		o.EmailConfig = EventActionEmailConfig{}
+		o.RetentionConfig = EventActionDataRetentionConfig{}
+		o.FsConfig = EventActionFilesystemConfig{}
+		o.PwdExpirationConfig = EventActionPasswordExpiration{}
+		o.IDPConfig = EventActionIDPAccountCheck{}
+		o.TieringConfig = EventActionTieringConfig{}
+		o.WorkflowConfig = EventActionWorkflowConfig{}
+		o.ReportConfig = EventActionReportConfig{}
+		return o.PubKeyExpirationConfig.validate()
 	case ActionTypeIDPAccountCheck:
 		o.HTTPConfig = EventActionHTTPConfig{}
 		o.CmdConfig = EventActionCommandConfig{}
@@ -1053,7 +1522,47 @@ func (o *BaseEventActionOptions) validate(action int, name string) error {
 		o.RetentionConfig = EventActionDataRetentionConfig{}
 		o.FsConfig = EventActionFilesystemConfig{}
 		o.PwdExpirationConfig = EventActionPasswordExpiration{}
+		o.PubKeyExpirationConfig = EventActionPublicKeyExpiration{}
+		o.TieringConfig = EventActionTieringConfig{}
+		o.WorkflowConfig = EventActionWorkflowConfig{}
+		o.ReportConfig = EventActionReportConfig{}
 		return o.IDPConfig.validate()
+	case ActionTypeTiering:
+		o.HTTPConfig = EventActionHTTPConfig{}
+		o.CmdConfig = EventActionCommandConfig{}
+		o.EmailConfig = EventActionEmailConfig{}
+		o.RetentionConfig = EventActionDataRetentionConfig{}
+		o.FsConfig = EventActionFilesystemConfig{}
+		o.PwdExpirationConfig = EventActionPasswordExpiration{}
+		o.PubKeyExpirationConfig = EventActionPublicKeyExpiration{}
+		o.IDPConfig = EventActionIDPAccountCheck{}
+		o.WorkflowConfig = EventActionWorkflowConfig{}
+		o.ReportConfig = EventActionReportConfig{}
+		return o.TieringConfig.validate()
+	case ActionTypeWorkflow:
+		o.HTTPConfig = EventActionHTTPConfig{}
+		o.CmdConfig = EventActionCommandConfig{}
+		o.EmailConfig = EventActionEmailConfig{}
+		o.RetentionConfig = EventActionDataRetentionConfig{}
+		o.FsConfig = EventActionFilesystemConfig{}
+		o.PwdExpirationConfig = EventActionPasswordExpiration{}
+		o.PubKeyExpirationConfig = EventActionPublicKeyExpiration{}
+		o.IDPConfig = EventActionIDPAccountCheck{}
+		o.TieringConfig = EventActionTieringConfig{}
+		o.ReportConfig = EventActionReportConfig{}
+		return o.WorkflowConfig.validate(name)
+	case ActionTypeReport:
+		o.HTTPConfig = EventActionHTTPConfig{}
+		o.CmdConfig = EventActionCommandConfig{}
+		o.EmailConfig = EventActionEmailConfig{}
+		o.RetentionConfig = EventActionDataRetentionConfig{}
+		o.FsConfig = EventActionFilesystemConfig{}
+		o.PwdExpirationConfig = EventActionPasswordExpiration{}
+		o.PubKeyExpirationConfig = EventActionPublicKeyExpiration{}
+		o.IDPConfig = EventActionIDPAccountCheck{}
+		o.TieringConfig = EventActionTieringConfig{}
+		o.WorkflowConfig = EventActionWorkflowConfig{}
+		return o.ReportConfig.validate()
 	default:
 		o.HTTPConfig = EventActionHTTPConfig{}
 		o.CmdConfig = EventActionCommandConfig{}
@@ -1061,7 +1570,11 @@ func (o *BaseEventActionOptions) validate(action int, name string) error {
 		o.RetentionConfig = EventActionDataRetentionConfig{}
 		o.FsConfig = EventActionFilesystemConfig{}
 		o.PwdExpirationConfig = EventActionPasswordExpiration{}
+		o.PubKeyExpirationConfig = EventActionPublicKeyExpiration{}
 		o.IDPConfig = EventActionIDPAccountCheck{}
+		o.TieringConfig = EventActionTieringConfig{}
+		o.WorkflowConfig = EventActionWorkflowConfig{}
+		o.ReportConfig = EventActionReportConfig{}
 	}
 	return nil
 }
@@ -1143,6 +1656,9 @@ type EventActionOptions struct {
 	IsFailureAction bool `json:"is_failure_action"`
 	StopOnFailure   bool `json:"stop_on_failure"`
 	ExecuteSync     bool `json:"execute_sync"`
+	// If set, the matching events are aggregated and notified within
+	// a single digest at the end of the configured interval
+	Digest int `json:"digest,omitempty"`
 }
 
 // EventAction defines an event action
@@ -1161,11 +1677,31 @@ func (a *EventAction) getACopy() EventAction {
 			IsFailureAction: a.Options.IsFailureAction,
 			StopOnFailure:   a.Options.StopOnFailure,
 			ExecuteSync:     a.Options.ExecuteSync,
+			Digest:          a.Options.Digest,
 		},
 	}
 }
 
+func (a *EventAction) validateDigest(trigger int) error {
+	if a.Options.Digest == 0 {
+		return nil
+	}
+	if !isDigestIntervalValid(a.Options.Digest) {
+		return util.NewValidationError(fmt.Sprintf("invalid digest interval: %d", a.Options.Digest))
+	}
+	if a.Options.IsFailureAction || a.Options.ExecuteSync {
+		return util.NewValidationError("digest is not supported for failure and sync actions")
+	}
+	if trigger != EventTriggerFsEvent && trigger != EventTriggerProviderEvent {
+		return util.NewValidationError("digest is only supported for filesystem and provider events")
+	}
+	return nil
+}
+
 func (a *EventAction) validateAssociation(trigger int, fsEvents []string) error {
+	if err := a.validateDigest(trigger); err != nil {
+		return err
+	}
 	if a.Options.IsFailureAction {
 		if a.Options.ExecuteSync {
 			return util.NewValidationError("sync execution is not supported for failure actions")
@@ -1186,6 +1722,25 @@ func (a *EventAction) validateAssociation(trigger int, fsEvents []string) error
 	return nil
 }
 
+func (a *EventAction) checkDigestConsistency() error {
+	switch a.Type {
+	case ActionTypeEmail:
+		if a.BaseEventAction.Options.EmailConfig.hasFilesAttachments() {
+			return fmt.Errorf("action %q: %s digest is not supported for emails with attachments",
+				a.Name, getDigestIntervalAsString(a.Options.Digest))
+		}
+	case ActionTypeHTTP:
+		if a.BaseEventAction.Options.HTTPConfig.HasMultipartFiles() {
+			return fmt.Errorf("action %q: %s digest is not supported for HTTP requests with files",
+				a.Name, getDigestIntervalAsString(a.Options.Digest))
+		}
+	default:
+		return fmt.Errorf("action %q, type %q: digest is only supported for email and HTTP actions",
+			a.Name, getActionTypeAsString(a.Type))
+	}
+	return nil
+}
+
 // ConditionPattern defines a pattern for condition filters
 type ConditionPattern struct {
 	Pattern      string `json:"pattern,omitempty"`
@@ -1463,6 +2018,8 @@ type EventRule struct {
 	Actions []EventAction `json:"actions"`
 	// in multi node setups we mark the rule as deleted to be able to update the cache
 	DeletedAt int64 `json:"-"`
+	// Role (tenant) owning this rule, empty means a global rule
+	Role string `json:"role,omitempty"`
 }
 
 func (r *EventRule) getACopy() EventRule {
@@ -1482,9 +2039,61 @@ func (r *EventRule) getACopy() EventRule {
 		Conditions:  r.Conditions.getACopy(),
 		Actions:     actions,
 		DeletedAt:   r.DeletedAt,
+		Role:        r.Role,
 	}
 }
 
+func (r *EventRule) hasRole(role string) bool {
+	if role == "" {
+		return true
+	}
+	return role == r.Role
+}
+
+// applyTenantRestrictions limits a rule owned by a role to the events generated
+// by the role itself
+func (r *EventRule) applyTenantRestrictions() error {
+	if r.Role == "" {
+		return nil
+	}
+	if !util.Contains(tenantEventTriggers, r.Trigger) {
+		return util.NewValidationError(fmt.Sprintf("trigger %d is not allowed for tenant rules", r.Trigger))
+	}
+	r.Conditions.Options.RoleNames = []ConditionPattern{
+		{
+			Pattern: r.Role,
+		},
+	}
+	// the rule actions only contain the names here, missing actions are
+	// reported by the provider
+	rule := EventRule{
+		Role:    r.Role,
+		Actions: make([]EventAction, 0, len(r.Actions)),
+	}
+	for _, action := range r.Actions {
+		baseAction, err := provider.eventActionExists(action.Name)
+		if err == nil {
+			rule.Actions = append(rule.Actions, EventAction{BaseEventAction: baseAction})
+		}
+	}
+	return rule.checkTenantActions()
+}
+
+// checkTenantActions returns an error if a rule owned by a role has actions,
+// including workflow steps, that are not limited to the role
+func (r *EventRule) checkTenantActions() error {
+	if r.Role == "" {
+		return nil
+	}
+	for _, action := range r.getEffectiveActions() {
+		if !util.Contains(tenantEventActions, action.Type) {
+			return util.NewValidationError(fmt.Sprintf("action %q, type %q is not allowed for tenant rules",
+				action.Name, getActionTypeAsString(action.Type)))
+		}
+	}
+	return nil
+}
+
 // GuardFromConcurrentExecution returns true if the rule cannot be executed concurrently
 // from multiple instances
 func (r *EventRule) GuardFromConcurrentExecution() bool {
@@ -1576,11 +2185,31 @@ func (r *EventRule) validateMandatorySyncActions() error {
 	return nil
 }
 
+// getEffectiveActions returns the actions to check against the rule trigger.
+// Workflow actions are replaced with the actions executed by their steps,
+// missing actions are ignored, they will fail at runtime
+func (r *EventRule) getEffectiveActions() []BaseEventAction {
+	actions := make([]BaseEventAction, 0, len(r.Actions))
+	for _, action := range r.Actions {
+		if action.Type != ActionTypeWorkflow {
+			actions = append(actions, action.BaseEventAction)
+			continue
+		}
+		for _, step := range action.BaseEventAction.Options.WorkflowConfig.Steps {
+			stepAction, err := provider.eventActionExists(step.Action)
+			if err == nil {
+				actions = append(actions, stepAction)
+			}
+		}
+	}
+	return actions
+}
+
 func (r *EventRule) checkIPBlockedAndCertificateActions() error {
 	unavailableActions := []int{ActionTypeUserQuotaReset, ActionTypeFolderQuotaReset, ActionTypeTransferQuotaReset,
 		ActionTypeDataRetentionCheck, ActionTypeMetadataCheck, ActionTypeFilesystem, ActionTypePasswordExpirationCheck,
-		ActionTypeUserExpirationCheck}
-	for _, action := range r.Actions {
+		ActionTypeUserExpirationCheck, ActionTypePublicKeyExpirationCheck, ActionTypeTiering}
+	for _, action := range r.getEffectiveActions() {
 		if util.Contains(unavailableActions, action.Type) {
 			return fmt.Errorf("action %q, type %q is not supported for event trigger %q",
 				action.Name, getActionTypeAsString(action.Type), getTriggerTypeAsString(r.Trigger))
@@ -1590,13 +2219,14 @@ func (r *EventRule) checkIPBlockedAndCertificateActions() error {
 }
 
 func (r *EventRule) checkProviderEventActions(providerObjectType string) error {
-	// user quota reset, transfer quota reset, data retention check and filesystem actions
-	// can be executed only if we modify a user. They will be executed for the
+	// user quota reset, transfer quota reset, data retention check, tiering and filesystem
+	// actions can be executed only if we modify a user. They will be executed for the
 	// affected user. Folder quota reset can be executed only for folders.
 	userSpecificActions := []int{ActionTypeUserQuotaReset, ActionTypeTransferQuotaReset,
 		ActionTypeDataRetentionCheck, ActionTypeMetadataCheck, ActionTypeFilesystem,
-		ActionTypePasswordExpirationCheck, ActionTypeUserExpirationCheck}
-	for _, action := range r.Actions {
+		ActionTypePasswordExpirationCheck, ActionTypeUserExpirationCheck, ActionTypePublicKeyExpirationCheck,
+		ActionTypeTiering}
+	for _, action := range r.getEffectiveActions() {
 		if util.Contains(userSpecificActions, action.Type) && providerObjectType != actionObjectUser {
 			return fmt.Errorf("action %q, type %q is only supported for provider user events",
 				action.Name, getActionTypeAsString(action.Type))
@@ -1642,6 +2272,11 @@ func (r *EventRule) checkActions(providerObjectType string) error {
 				return errors.New("cannot upload file/s for a rule with no user associated")
 			}
 		}
+		if action.Options.Digest > 0 {
+			if err := action.checkDigestConsistency(); err != nil {
+				return err
+			}
+		}
 		if action.Type == ActionTypeIDPAccountCheck {
 			if r.Trigger != EventTriggerIDPLogin {
 				return errors.New("IDP account check action is only supported for IDP login trigger")
@@ -1667,7 +2302,7 @@ func (r *EventRule) CheckActionsConsistency(providerObjectType string) error {
 		}
 	case EventTriggerFsEvent:
 		// folder quota reset cannot be executed
-		for _, action := range r.Actions {
+		for _, action := range r.getEffectiveActions() {
 			if action.Type == ActionTypeFolderQuotaReset {
 				return fmt.Errorf("action %q, type %q is not supported for filesystem events",
 					action.Name, getActionTypeAsString(action.Type))
@@ -1678,6 +2313,10 @@ func (r *EventRule) CheckActionsConsistency(providerObjectType string) error {
 			return err
 		}
 	}
+	// actions are global and can be modified after saving the rule
+	if err := r.checkTenantActions(); err != nil {
+		return err
+	}
 	return r.checkActions(providerObjectType)
 }
 
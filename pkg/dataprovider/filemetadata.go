@@ -0,0 +1,220 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	maxFileMetadataKeys     = 50
+	maxFileMetadataKeyLen   = 128
+	maxFileMetadataValueLen = 1024
+	maxFileTags             = 50
+	maxFileTagLen           = 128
+)
+
+// FileMetadata defines custom key/value metadata and tags for a file or directory
+type FileMetadata struct {
+	// Virtual path of the file or directory
+	Path string `json:"path"`
+	// Custom key/value metadata
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Custom tags
+	Tags []string `json:"tags,omitempty"`
+	// Last update as unix timestamp in milliseconds
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+// IsEmpty returns true if no metadata and no tags are defined
+func (m *FileMetadata) IsEmpty() bool {
+	return len(m.Metadata) == 0 && len(m.Tags) == 0
+}
+
+// Match returns true if the metadata contains all the specified tags and
+// key/value pairs. An empty value matches any value for the related key
+func (m *FileMetadata) Match(tags []string, metadata map[string]string) bool {
+	for _, tag := range tags {
+		if !util.Contains(m.Tags, tag) {
+			return false
+		}
+	}
+	for k, v := range metadata {
+		val, ok := m.Metadata[k]
+		if !ok {
+			return false
+		}
+		if v != "" && val != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *FileMetadata) getPathHash() string {
+	return getFileMetadataPathHash(m.Path)
+}
+
+func (m *FileMetadata) getACopy() FileMetadata {
+	var metadata map[string]string
+	if m.Metadata != nil {
+		metadata = make(map[string]string, len(m.Metadata))
+		for k, v := range m.Metadata {
+			metadata[k] = v
+		}
+	}
+	tags := make([]string, len(m.Tags))
+	copy(tags, m.Tags)
+
+	return FileMetadata{
+		Path:      m.Path,
+		Metadata:  metadata,
+		Tags:      tags,
+		UpdatedAt: m.UpdatedAt,
+	}
+}
+
+func (m *FileMetadata) validate() error {
+	if m.Path == "" {
+		return util.NewValidationError("path is mandatory")
+	}
+	m.Path = util.CleanPath(m.Path)
+	if len(m.Metadata) > maxFileMetadataKeys {
+		return util.NewValidationError(fmt.Sprintf("too many metadata keys: %d, max allowed: %d",
+			len(m.Metadata), maxFileMetadataKeys))
+	}
+	for k, v := range m.Metadata {
+		if k == "" || len(k) > maxFileMetadataKeyLen {
+			return util.NewValidationError(fmt.Sprintf("invalid metadata key %q, the length must be between 1 and %d",
+				k, maxFileMetadataKeyLen))
+		}
+		if len(v) > maxFileMetadataValueLen {
+			return util.NewValidationError(fmt.Sprintf("the value for the metadata key %q is too long, max allowed: %d",
+				k, maxFileMetadataValueLen))
+		}
+	}
+	m.Tags = util.RemoveDuplicates(m.Tags, true)
+	if len(m.Tags) > maxFileTags {
+		return util.NewValidationError(fmt.Sprintf("too many tags: %d, max allowed: %d", len(m.Tags), maxFileTags))
+	}
+	for _, tag := range m.Tags {
+		if tag == "" || len(tag) > maxFileTagLen {
+			return util.NewValidationError(fmt.Sprintf("invalid tag %q, the length must be between 1 and %d",
+				tag, maxFileTagLen))
+		}
+	}
+	sort.Strings(m.Tags)
+	if m.IsEmpty() {
+		return util.NewValidationError("metadata and/or tags are required")
+	}
+	m.UpdatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+	return nil
+}
+
+func getFileMetadataPathHash(p string) string {
+	h := sha256.Sum256([]byte(p))
+	return hex.EncodeToString(h[:])
+}
+
+// isFileMetadataInPath returns true if p is equal to or inside root
+func isFileMetadataInPath(p, root string) bool {
+	if root == "/" || p == root {
+		return true
+	}
+	return strings.HasPrefix(p, root+"/")
+}
+
+// getRenamedFileMetadataPath returns the new path for p after renaming
+// source to target, p must be equal to or inside source
+func getRenamedFileMetadataPath(p, source, target string) string {
+	if p == source {
+		return target
+	}
+	return path.Join(target, strings.TrimPrefix(p, source))
+}
+
+func sortFilesMetadata(files []FileMetadata) {
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+}
+
+// GetFileMetadata returns the custom metadata for the specified user and virtual path
+func GetFileMetadata(username, virtualPath string) (FileMetadata, error) {
+	return provider.getFileMetadata(username, util.CleanPath(virtualPath))
+}
+
+// GetFilesMetadata returns the custom metadata for the specified virtual path
+// and for all the files and directories inside it, sorted by path
+func GetFilesMetadata(username, virtualPath string) ([]FileMetadata, error) {
+	return provider.getFilesMetadata(username, util.CleanPath(virtualPath))
+}
+
+// SetFileMetadata adds or replaces the custom metadata for the specified user.
+// If no metadata and no tags are defined the existing metadata are removed
+func SetFileMetadata(username string, metadata *FileMetadata) error {
+	if metadata.IsEmpty() && metadata.Path != "" {
+		return provider.deleteFilesMetadata(username, util.CleanPath(metadata.Path), false)
+	}
+	return provider.setFileMetadata(username, metadata)
+}
+
+// DeleteFileMetadata removes the custom metadata for the specified virtual path.
+// If recursive is true the metadata for files and directories inside it are removed too
+func DeleteFileMetadata(username, virtualPath string, recursive bool) error {
+	return provider.deleteFilesMetadata(username, util.CleanPath(virtualPath), recursive)
+}
+
+// RenameFileMetadata moves the custom metadata from the source virtual path,
+// and from files and directories inside it, to the target virtual path.
+// Existing metadata for the target path are replaced
+func RenameFileMetadata(username, source, target string) error {
+	source = util.CleanPath(source)
+	target = util.CleanPath(target)
+	if source == target || source == "/" {
+		return nil
+	}
+	return provider.renameFilesMetadata(username, source, target)
+}
+
+// CopyFileMetadata copies the custom metadata from the source virtual path,
+// and from files and directories inside it, to the target virtual path
+func CopyFileMetadata(username, source, target string) error {
+	source = util.CleanPath(source)
+	target = util.CleanPath(target)
+	if source == target {
+		return nil
+	}
+	files, err := provider.getFilesMetadata(username, source)
+	if err != nil {
+		return err
+	}
+	for idx := range files {
+		m := files[idx]
+		m.Path = getRenamedFileMetadataPath(m.Path, source, target)
+		if err := provider.setFileMetadata(username, &m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
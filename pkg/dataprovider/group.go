@@ -33,6 +33,32 @@ type GroupUserSettings struct {
 	sdk.BaseGroupUserSettings
 	// Filesystem configuration details
 	FsConfig vfs.Filesystem `json:"filesystem"`
+	// Per-protocol idle timeout, keepalive and max session duration
+	SessionPolicies []SessionPolicy `json:"session_policies,omitempty"`
+	// Transfer priority class for users without one
+	PriorityClass string `json:"priority_class,omitempty"`
+	// Maximum number of simultaneous FTP file transfers for users without a limit
+	FTPMaxTransfers int `json:"ftp_max_transfers,omitempty"`
+	// Port range for the FTP passive data connections of the users without one
+	PassivePortRange PortRange `json:"passive_port_range"`
+	// Settings applied only to the connections matching a protocol or a source network
+	Overrides []GroupOverride `json:"overrides,omitempty"`
+	// Time ranges during which the users without access windows can log in
+	AccessWindows []AccessWindow `json:"access_windows,omitempty"`
+	// IANA timezone for the access windows, empty means UTC
+	AccessTimezone string `json:"access_timezone,omitempty"`
+	// Certificate authorities trusted to sign SSH certificates for the group members
+	TrustedCAKeys []string `json:"trusted_ca_keys,omitempty"`
+	// SSH certificate principals for the users without a mapping, the
+	// placeholders are replaced as for the other group settings
+	CertPrincipals []string `json:"cert_principals,omitempty"`
+	// If enabled, the members can use the SFTP subsystem only
+	SFTPOnly bool `json:"sftp_only,omitempty"`
+	// SSH commands allowed for the members without allowed commands, if this
+	// is their primary group
+	AllowedSSHCommands []string `json:"allowed_ssh_commands,omitempty"`
+	// SSH commands denied for the members
+	DeniedSSHCommands []string `json:"denied_ssh_commands,omitempty"`
 }
 
 // Group defines an SFTPGo group.
@@ -43,6 +69,8 @@ type Group struct {
 	UserSettings GroupUserSettings `json:"user_settings,omitempty"`
 	// Mapping between virtual paths and virtual folders
 	VirtualFolders []vfs.VirtualFolder `json:"virtual_folders,omitempty"`
+	// Role (tenant) owning this group, empty means a global group
+	Role string `json:"role,omitempty"`
 }
 
 // GetPermissions returns the permissions as list
@@ -85,6 +113,9 @@ func (g *Group) SetEmptySecretsIfNil() {
 	for idx := range g.VirtualFolders {
 		vfolder := &g.VirtualFolders[idx]
 		vfolder.FsConfig.SetEmptySecretsIfNil()
+		if vfolder.Failover != nil {
+			vfolder.Failover.FsConfig.SetEmptySecretsIfNil()
+		}
 	}
 }
 
@@ -177,6 +208,48 @@ func (g *Group) validateUserSettings() error {
 	if err := validateBaseFilters(&g.UserSettings.Filters); err != nil {
 		return err
 	}
+	policies, err := validateSessionPolicies(g.UserSettings.SessionPolicies)
+	if err != nil {
+		return err
+	}
+	g.UserSettings.SessionPolicies = policies
+	timezone, err := validateAccessWindows(g.UserSettings.AccessWindows, g.UserSettings.AccessTimezone)
+	if err != nil {
+		return err
+	}
+	g.UserSettings.AccessTimezone = timezone
+	keys, err := validateTrustedCAKeys(g.UserSettings.TrustedCAKeys)
+	if err != nil {
+		return err
+	}
+	g.UserSettings.TrustedCAKeys = keys
+	g.UserSettings.CertPrincipals = validateCertPrincipals(g.UserSettings.CertPrincipals)
+	allowedSSHCommands, err := validateSSHCommandNames(g.UserSettings.AllowedSSHCommands)
+	if err != nil {
+		return err
+	}
+	g.UserSettings.AllowedSSHCommands = allowedSSHCommands
+	deniedSSHCommands, err := validateSSHCommandNames(g.UserSettings.DeniedSSHCommands)
+	if err != nil {
+		return err
+	}
+	g.UserSettings.DeniedSSHCommands = deniedSSHCommands
+	priorityClass, err := validatePriorityClass(g.UserSettings.PriorityClass)
+	if err != nil {
+		return err
+	}
+	g.UserSettings.PriorityClass = priorityClass
+	overrides, err := validateGroupOverrides(g.UserSettings.Overrides)
+	if err != nil {
+		return err
+	}
+	g.UserSettings.Overrides = overrides
+	if g.UserSettings.FTPMaxTransfers < 0 {
+		return util.NewValidationError(fmt.Sprintf("invalid FTP max transfers: %d", g.UserSettings.FTPMaxTransfers))
+	}
+	if err := g.UserSettings.PassivePortRange.validate(); err != nil {
+		return err
+	}
 	if !g.HasExternalAuth() {
 		g.UserSettings.Filters.ExternalAuthCacheTime = 0
 	}
@@ -200,6 +273,14 @@ func (g *Group) getACopy() Group {
 		copy(perms, v)
 		permissions[k] = perms
 	}
+	trustedCAKeys := make([]string, len(g.UserSettings.TrustedCAKeys))
+	copy(trustedCAKeys, g.UserSettings.TrustedCAKeys)
+	certPrincipals := make([]string, len(g.UserSettings.CertPrincipals))
+	copy(certPrincipals, g.UserSettings.CertPrincipals)
+	allowedSSHCommands := make([]string, len(g.UserSettings.AllowedSSHCommands))
+	copy(allowedSSHCommands, g.UserSettings.AllowedSSHCommands)
+	deniedSSHCommands := make([]string, len(g.UserSettings.DeniedSSHCommands))
+	copy(deniedSSHCommands, g.UserSettings.DeniedSSHCommands)
 
 	return Group{
 		BaseGroup: sdk.BaseGroup{
@@ -226,10 +307,30 @@ func (g *Group) getACopy() Group {
 				ExpiresIn:            g.UserSettings.ExpiresIn,
 				Filters:              copyBaseUserFilters(g.UserSettings.Filters),
 			},
-			FsConfig: g.UserSettings.FsConfig.GetACopy(),
+			FsConfig:           g.UserSettings.FsConfig.GetACopy(),
+			SessionPolicies:    copySessionPolicies(g.UserSettings.SessionPolicies),
+			PriorityClass:      g.UserSettings.PriorityClass,
+			FTPMaxTransfers:    g.UserSettings.FTPMaxTransfers,
+			PassivePortRange:   g.UserSettings.PassivePortRange,
+			Overrides:          copyGroupOverrides(g.UserSettings.Overrides),
+			AccessWindows:      copyAccessWindows(g.UserSettings.AccessWindows),
+			AccessTimezone:     g.UserSettings.AccessTimezone,
+			TrustedCAKeys:      trustedCAKeys,
+			CertPrincipals:     certPrincipals,
+			SFTPOnly:           g.UserSettings.SFTPOnly,
+			AllowedSSHCommands: allowedSSHCommands,
+			DeniedSSHCommands:  deniedSSHCommands,
 		},
 		VirtualFolders: virtualFolders,
+		Role:           g.Role,
+	}
+}
+
+func (g *Group) hasRole(role string) bool {
+	if role == "" {
+		return true
 	}
+	return role == g.Role
 }
 
 // GetMembersAsString returns a string representation for the group members
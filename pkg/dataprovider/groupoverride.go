@@ -0,0 +1,233 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// GroupOverride defines settings that apply to the members of a primary group
+// only if the connection matches the specified conditions. Overrides are
+// evaluated at login, the first matching override is applied
+type GroupOverride struct {
+	// Protocols the override applies to: SSH, FTP, DAV, HTTP. Empty means all protocols
+	Protocols []string `json:"protocols,omitempty"`
+	// Source networks, as IP/Mask in CIDR format, the override applies to.
+	// Empty means any source
+	SourceNetworks []string `json:"source_networks,omitempty"`
+	// Bandwidth limits as KB/s, 0 means the inherited limit is not overridden
+	UploadBandwidth   int64 `json:"upload_bandwidth,omitempty"`
+	DownloadBandwidth int64 `json:"download_bandwidth,omitempty"`
+	// Permissions for the specified directories, they replace the inherited ones
+	Permissions map[string][]string `json:"permissions,omitempty"`
+}
+
+// GetSourceNetworksAsString returns the source networks as comma separated string
+func (o *GroupOverride) GetSourceNetworksAsString() string {
+	return strings.Join(o.SourceNetworks, ",")
+}
+
+// GetPermissionsAsString returns the permissions as string, one directory
+// per line using the format "/dir: perm1,perm2"
+func (o *GroupOverride) GetPermissionsAsString() string {
+	dirs := make([]string, 0, len(o.Permissions))
+	for dir := range o.Permissions {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	lines := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		lines = append(lines, fmt.Sprintf("%s: %s", dir, strings.Join(o.Permissions[dir], ",")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// HasProtocol returns true if the override explicitly applies to the specified protocol
+func (o *GroupOverride) HasProtocol(protocol string) bool {
+	return util.Contains(o.Protocols, protocol)
+}
+
+func (o *GroupOverride) isEmpty() bool {
+	return o.UploadBandwidth == 0 && o.DownloadBandwidth == 0 && len(o.Permissions) == 0
+}
+
+func (o *GroupOverride) matches(protocol string, ip net.IP) bool {
+	if len(o.Protocols) > 0 && !util.Contains(o.Protocols, getSessionPolicyProtocol(protocol)) {
+		return false
+	}
+	if len(o.SourceNetworks) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, source := range o.SourceNetworks {
+		_, ipNet, err := net.ParseCIDR(source)
+		if err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *GroupOverride) validate() error {
+	if len(o.Protocols) == 0 && len(o.SourceNetworks) == 0 {
+		return util.NewValidationError("group overrides require at least a protocol or a source network")
+	}
+	if o.UploadBandwidth < 0 || o.DownloadBandwidth < 0 {
+		return util.NewValidationError("group override bandwidth limits cannot be negative")
+	}
+	o.Protocols = util.RemoveDuplicates(o.Protocols, false)
+	for _, proto := range o.Protocols {
+		if !util.Contains(ValidProtocols, proto) {
+			return util.NewValidationError(fmt.Sprintf("invalid group override protocol %q", proto))
+		}
+	}
+	o.SourceNetworks = util.RemoveDuplicates(o.SourceNetworks, false)
+	for _, source := range o.SourceNetworks {
+		if _, _, err := net.ParseCIDR(source); err != nil {
+			return util.NewValidationError(fmt.Sprintf("could not parse group override source network %q: %v", source, err))
+		}
+	}
+	if len(o.Permissions) > 0 {
+		permissions, err := validateUserPermissions(o.Permissions)
+		if err != nil {
+			return err
+		}
+		o.Permissions = permissions
+	}
+	if o.isEmpty() {
+		return util.NewValidationError("group overrides must override at least a setting")
+	}
+	return nil
+}
+
+func (o *GroupOverride) getACopy() GroupOverride {
+	protocols := make([]string, len(o.Protocols))
+	copy(protocols, o.Protocols)
+	sources := make([]string, len(o.SourceNetworks))
+	copy(sources, o.SourceNetworks)
+	var permissions map[string][]string
+	if len(o.Permissions) > 0 {
+		permissions = make(map[string][]string)
+		for k, v := range o.Permissions {
+			perms := make([]string, len(v))
+			copy(perms, v)
+			permissions[k] = perms
+		}
+	}
+
+	return GroupOverride{
+		Protocols:         protocols,
+		SourceNetworks:    sources,
+		UploadBandwidth:   o.UploadBandwidth,
+		DownloadBandwidth: o.DownloadBandwidth,
+		Permissions:       permissions,
+	}
+}
+
+func copyGroupOverrides(overrides []GroupOverride) []GroupOverride {
+	if len(overrides) == 0 {
+		return nil
+	}
+	result := make([]GroupOverride, 0, len(overrides))
+	for idx := range overrides {
+		result = append(result, overrides[idx].getACopy())
+	}
+	return result
+}
+
+func validateGroupOverrides(overrides []GroupOverride) ([]GroupOverride, error) {
+	var result []GroupOverride
+	for _, o := range overrides {
+		if err := o.validate(); err != nil {
+			return nil, err
+		}
+		result = append(result, o)
+	}
+	return result, nil
+}
+
+// mergeGroupOverrides stores the overrides defined in the primary group.
+// The settings defined for the user itself have precedence, so they are
+// removed from the stored overrides. It must be called before merging
+// the group settings
+func (u *User) mergeGroupOverrides(group *Group, replacer *strings.Replacer) {
+	u.groupOverrides = nil
+	for idx := range group.UserSettings.Overrides {
+		o := group.UserSettings.Overrides[idx].getACopy()
+		if u.UploadBandwidth != 0 {
+			o.UploadBandwidth = 0
+		}
+		if u.DownloadBandwidth != 0 {
+			o.DownloadBandwidth = 0
+		}
+		if len(o.Permissions) > 0 {
+			permissions := make(map[string][]string)
+			for dir, perms := range o.Permissions {
+				if dir != "/" {
+					dir = u.replacePlaceholder(dir, replacer)
+					// the root permissions are always inherited from the primary group
+					if _, ok := u.Permissions[dir]; ok {
+						continue
+					}
+				}
+				permissions[dir] = perms
+			}
+			o.Permissions = permissions
+		}
+		u.groupOverrides = append(u.groupOverrides, o)
+	}
+}
+
+// ApplyGroupOverrides applies the first conditional override, inherited from
+// the primary group, matching the specified protocol and client IP
+func (u *User) ApplyGroupOverrides(protocol, clientIP, connectionID string) {
+	if len(u.groupOverrides) == 0 {
+		return
+	}
+	ip := net.ParseIP(clientIP)
+	for idx := range u.groupOverrides {
+		o := &u.groupOverrides[idx]
+		if !o.matches(protocol, ip) {
+			continue
+		}
+		logger.Debug(logSender, connectionID, "apply group override #%d for protocol %q, ip %q", idx+1, protocol, clientIP)
+		if o.UploadBandwidth > 0 {
+			u.UploadBandwidth = o.UploadBandwidth
+		}
+		if o.DownloadBandwidth > 0 {
+			u.DownloadBandwidth = o.DownloadBandwidth
+		}
+		if len(o.Permissions) > 0 {
+			// the permissions map can be shared with cached users
+			permissions := make(map[string][]string)
+			for k, v := range u.Permissions {
+				permissions[k] = v
+			}
+			for k, v := range o.Permissions {
+				permissions[k] = v
+			}
+			u.Permissions = permissions
+		}
+		return
+	}
+}
@@ -16,7 +16,9 @@ package dataprovider
 
 import (
 	"bytes"
+	"context"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/netip"
@@ -76,12 +78,33 @@ type memoryProviderHandle struct {
 	roles map[string]Role
 	// slice with ordered roles
 	roleNames []string
+	// map for admin roles, name is the key
+	adminRoles map[string]AdminRole
+	// slice with ordered admin roles
+	adminRoleNames []string
 	// map for IP List entry
 	ipListEntries map[string]IPListEntry
 	// slice with ordered IP list entries
 	ipListEntriesKeys []string
 	// configurations
 	configs Configs
+	// custom files metadata, username is the key for the outer map
+	// and the virtual path is the key for the inner one
+	filesMetadata map[string]map[string]FileMetadata
+	// events waiting to be notified within a digest, the ID is the key
+	digestEntries map[int64]EventDigestEntry
+	// last used digest entry ID
+	lastDigestEntryID int64
+	// audit log entries, the ID is the key
+	auditLogEntries map[int64]AuditLogEntry
+	// last used audit log entry ID
+	lastAuditLogEntryID int64
+	// share access events, the ID is the key
+	shareEvents map[int64]ShareEvent
+	// last used share event ID
+	lastShareEventID int64
+	// shared sessions, the key is the session key
+	sharedSessions map[string]Session
 }
 
 // MemoryProvider defines the auth provider for a memory store
@@ -89,6 +112,41 @@ type MemoryProvider struct {
 	dbHandle *memoryProviderHandle
 }
 
+func newMemoryProviderHandle(configFile string) *memoryProviderHandle {
+	return &memoryProviderHandle{
+		isClosed:          false,
+		usernames:         []string{},
+		users:             make(map[string]User),
+		groupnames:        []string{},
+		groups:            make(map[string]Group),
+		vfolders:          make(map[string]vfs.BaseVirtualFolder),
+		vfoldersNames:     []string{},
+		admins:            make(map[string]Admin),
+		adminsUsernames:   []string{},
+		apiKeys:           make(map[string]APIKey),
+		apiKeysIDs:        []string{},
+		shares:            make(map[string]Share),
+		sharesIDs:         []string{},
+		actions:           make(map[string]BaseEventAction),
+		actionsNames:      []string{},
+		rules:             make(map[string]EventRule),
+		rulesNames:        []string{},
+		roles:             map[string]Role{},
+		roleNames:         []string{},
+		adminRoles:        map[string]AdminRole{},
+		adminRoleNames:    []string{},
+		ipListEntries:     map[string]IPListEntry{},
+		ipListEntriesKeys: []string{},
+		configs:           Configs{},
+		filesMetadata:     make(map[string]map[string]FileMetadata),
+		digestEntries:     make(map[int64]EventDigestEntry),
+		auditLogEntries:   make(map[int64]AuditLogEntry),
+		shareEvents:       make(map[int64]ShareEvent),
+		sharedSessions:    make(map[string]Session),
+		configFile:        configFile,
+	}
+}
+
 func initializeMemoryProvider(basePath string) {
 	configFile := ""
 	if util.IsFileInputValid(config.Name) {
@@ -98,31 +156,7 @@ func initializeMemoryProvider(basePath string) {
 		}
 	}
 	provider = &MemoryProvider{
-		dbHandle: &memoryProviderHandle{
-			isClosed:          false,
-			usernames:         []string{},
-			users:             make(map[string]User),
-			groupnames:        []string{},
-			groups:            make(map[string]Group),
-			vfolders:          make(map[string]vfs.BaseVirtualFolder),
-			vfoldersNames:     []string{},
-			admins:            make(map[string]Admin),
-			adminsUsernames:   []string{},
-			apiKeys:           make(map[string]APIKey),
-			apiKeysIDs:        []string{},
-			shares:            make(map[string]Share),
-			sharesIDs:         []string{},
-			actions:           make(map[string]BaseEventAction),
-			actionsNames:      []string{},
-			rules:             make(map[string]EventRule),
-			rulesNames:        []string{},
-			roles:             map[string]Role{},
-			roleNames:         []string{},
-			ipListEntries:     map[string]IPListEntry{},
-			ipListEntriesKeys: []string{},
-			configs:           Configs{},
-			configFile:        configFile,
-		},
+		dbHandle: newMemoryProviderHandle(configFile),
 	}
 	if err := provider.reloadConfig(); err != nil {
 		logger.Error(logSender, "", "unable to load initial data: %v", err)
@@ -162,13 +196,13 @@ func (p *MemoryProvider) validateUserAndTLSCert(username, protocol string, tlsCe
 	return checkUserAndTLSCertificate(&user, protocol, tlsCert)
 }
 
-func (p *MemoryProvider) validateUserAndPass(username, password, ip, protocol string) (User, error) {
+func (p *MemoryProvider) validateUserAndPass(ctx context.Context, username, password, ip, protocol string) (User, error) {
 	user, err := p.userExists(username, "")
 	if err != nil {
 		providerLog(logger.LevelWarn, "error authenticating user %q: %v", username, err)
 		return user, err
 	}
-	return checkUserAndPass(&user, password, ip, protocol)
+	return checkUserAndPass(ctx, &user, password, ip, protocol)
 }
 
 func (p *MemoryProvider) validateUserAndPubKey(username string, pubKey []byte, isSSHCert bool) (User, string, error) {
@@ -457,6 +491,7 @@ func (p *MemoryProvider) deleteUser(user User, _ bool) error {
 	sort.Strings(p.dbHandle.usernames)
 	p.deleteAPIKeysWithUser(user.Username)
 	p.deleteSharesWithUser(user.Username)
+	delete(p.dbHandle.filesMetadata, user.Username)
 	return nil
 }
 
@@ -710,6 +745,10 @@ func (p *MemoryProvider) addAdmin(admin *Admin) error {
 	if err := p.addAdminToRole(admin.Username, admin.Role); err != nil {
 		return err
 	}
+	if err := p.addAdminToAdminRole(admin.Username, admin.AdminRole); err != nil {
+		p.removeAdminFromRole(admin.Username, admin.Role)
+		return err
+	}
 	var mappedAdmins []string
 	for idx := range admin.Groups {
 		if err = p.addAdminToGroupMapping(admin.Username, admin.Groups[idx].Name); err != nil {
@@ -750,6 +789,15 @@ func (p *MemoryProvider) updateAdmin(admin *Admin) error {
 		}
 		return err
 	}
+	p.removeAdminFromAdminRole(a.Username, a.AdminRole)
+	if err := p.addAdminToAdminRole(admin.Username, admin.AdminRole); err != nil {
+		// try ro add old admin role
+		if errRollback := p.addAdminToAdminRole(a.Username, a.AdminRole); errRollback != nil {
+			providerLog(logger.LevelError, "unable to rollback old admin role %q for admin %q, error: %v",
+				a.AdminRole, a.Username, errRollback)
+		}
+		return err
+	}
 	for idx := range a.Groups {
 		p.removeAdminFromGroupMapping(a.Username, a.Groups[idx].Name)
 	}
@@ -784,6 +832,7 @@ func (p *MemoryProvider) deleteAdmin(admin Admin) error {
 		return err
 	}
 	p.removeAdminFromRole(a.Username, a.Role)
+	p.removeAdminFromAdminRole(a.Username, a.AdminRole)
 	for idx := range a.Groups {
 		p.removeAdminFromGroupMapping(a.Username, a.Groups[idx].Name)
 	}
@@ -899,7 +948,7 @@ func (p *MemoryProvider) updateFolderQuota(name string, filesAdd int, sizeAdd in
 	return nil
 }
 
-func (p *MemoryProvider) getGroups(limit, offset int, order string, _ bool) ([]Group, error) {
+func (p *MemoryProvider) getGroups(limit, offset int, order string, _ bool, role string) ([]Group, error) {
 	p.dbHandle.Lock()
 	defer p.dbHandle.Unlock()
 	if p.dbHandle.isClosed {
@@ -918,6 +967,9 @@ func (p *MemoryProvider) getGroups(limit, offset int, order string, _ bool) ([]G
 			}
 			g := p.dbHandle.groups[name]
 			group := g.getACopy()
+			if !group.hasRole(role) {
+				continue
+			}
 			p.addVirtualFoldersToGroup(&group)
 			group.PrepareForRendering()
 			groups = append(groups, group)
@@ -934,6 +986,9 @@ func (p *MemoryProvider) getGroups(limit, offset int, order string, _ bool) ([]G
 			name := p.dbHandle.groupnames[i]
 			g := p.dbHandle.groups[name]
 			group := g.getACopy()
+			if !group.hasRole(role) {
+				continue
+			}
 			p.addVirtualFoldersToGroup(&group)
 			group.PrepareForRendering()
 			groups = append(groups, group)
@@ -1284,6 +1339,40 @@ func (p *MemoryProvider) removeAdminFromRole(username, role string) {
 	p.dbHandle.roles[role] = r
 }
 
+func (p *MemoryProvider) addAdminToAdminRole(username, role string) error {
+	if role == "" {
+		return nil
+	}
+	r, err := p.adminRoleExistsInternal(role)
+	if err != nil {
+		return util.NewGenericError(fmt.Sprintf("admin role %q does not exist", role))
+	}
+	if !util.Contains(r.Admins, username) {
+		r.Admins = append(r.Admins, username)
+		p.dbHandle.adminRoles[role] = r
+	}
+	return nil
+}
+
+func (p *MemoryProvider) removeAdminFromAdminRole(username, role string) {
+	if role == "" {
+		return
+	}
+	r, err := p.adminRoleExistsInternal(role)
+	if err != nil {
+		providerLog(logger.LevelWarn, "admin role %q does not exist, cannot remove admin %q", role, username)
+		return
+	}
+	var admins []string
+	for _, a := range r.Admins {
+		if a != username {
+			admins = append(admins, a)
+		}
+	}
+	r.Admins = admins
+	p.dbHandle.adminRoles[role] = r
+}
+
 func (p *MemoryProvider) addUserToRole(username, role string) error {
 	if role == "" {
 		return nil
@@ -1389,6 +1478,8 @@ func (p *MemoryProvider) addOrUpdateFolderInternal(baseFolder *vfs.BaseVirtualFo
 		folder.MappedPath = baseFolder.MappedPath
 		folder.Description = baseFolder.Description
 		folder.FsConfig = baseFolder.FsConfig.GetACopy()
+		folder.Failover = baseFolder.Failover.GetACopy()
+		folder.Limits = baseFolder.Limits.GetACopy()
 		if username != "" && !util.Contains(folder.Users, username) {
 			folder.Users = append(folder.Users, username)
 		}
@@ -1423,7 +1514,7 @@ func (p *MemoryProvider) folderExistsInternal(name string) (vfs.BaseVirtualFolde
 	return vfs.BaseVirtualFolder{}, util.NewRecordNotFoundError(fmt.Sprintf("folder %q does not exist", name))
 }
 
-func (p *MemoryProvider) getFolders(limit, offset int, order string, _ bool) ([]vfs.BaseVirtualFolder, error) {
+func (p *MemoryProvider) getFolders(limit, offset int, order string, _ bool, role string) ([]vfs.BaseVirtualFolder, error) {
 	folders := make([]vfs.BaseVirtualFolder, 0, limit)
 	var err error
 	p.dbHandle.Lock()
@@ -1443,6 +1534,9 @@ func (p *MemoryProvider) getFolders(limit, offset int, order string, _ bool) ([]
 			}
 			f := p.dbHandle.vfolders[name]
 			folder := f.GetACopy()
+			if !folderHasRole(&folder, role) {
+				continue
+			}
 			folder.PrepareForRendering()
 			folders = append(folders, folder)
 			if len(folders) >= limit {
@@ -1458,6 +1552,9 @@ func (p *MemoryProvider) getFolders(limit, offset int, order string, _ bool) ([]
 			name := p.dbHandle.vfoldersNames[i]
 			f := p.dbHandle.vfolders[name]
 			folder := f.GetACopy()
+			if !folderHasRole(&folder, role) {
+				continue
+			}
 			folder.PrepareForRendering()
 			folders = append(folders, folder)
 			if len(folders) >= limit {
@@ -1681,6 +1778,28 @@ func (p *MemoryProvider) updateAPIKey(apiKey *APIKey) error {
 	return nil
 }
 
+func (p *MemoryProvider) rotateAPIKey(apiKey *APIKey) error {
+	err := apiKey.validate()
+	if err != nil {
+		return err
+	}
+
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	k, err := p.apiKeyExistsInternal(apiKey.KeyID)
+	if err != nil {
+		return err
+	}
+	k.Key = apiKey.Key
+	k.Filters = apiKey.Filters.getACopy()
+	k.UpdatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+	p.dbHandle.apiKeys[k.KeyID] = k
+	return nil
+}
+
 func (p *MemoryProvider) deleteAPIKey(apiKey APIKey) error {
 	p.dbHandle.Lock()
 	defer p.dbHandle.Unlock()
@@ -1786,15 +1905,24 @@ func (p *MemoryProvider) deleteAPIKeysWithAdmin(username string) {
 }
 
 func (p *MemoryProvider) deleteSharesWithUser(username string) {
-	found := false
+	removed := make(map[string]bool)
 	for k, v := range p.dbHandle.shares {
 		if v.Username == username {
 			delete(p.dbHandle.shares, k)
-			found = true
+			removed[k] = true
 		}
 	}
-	if found {
+	if len(removed) > 0 {
 		p.updateSharesOrdering()
+		p.deleteShareEventsInternal(removed)
+	}
+}
+
+func (p *MemoryProvider) deleteShareEventsInternal(shareIDs map[string]bool) {
+	for id, event := range p.dbHandle.shareEvents {
+		if shareIDs[event.ShareID] {
+			delete(p.dbHandle.shareEvents, id)
+		}
 	}
 }
 
@@ -1921,6 +2049,7 @@ func (p *MemoryProvider) deleteShare(share Share) error {
 
 	delete(p.dbHandle.shares, share.ShareID)
 	p.updateSharesOrdering()
+	p.deleteShareEventsInternal(map[string]bool{share.ShareID: true})
 
 	return nil
 }
@@ -2059,20 +2188,77 @@ func (p *MemoryProvider) getActiveTransfers(_ time.Time) ([]ActiveTransfer, erro
 	return nil, ErrNotImplemented
 }
 
-func (p *MemoryProvider) addSharedSession(_ Session) error {
-	return ErrNotImplemented
+func (p *MemoryProvider) addSharedSession(session Session) error {
+	if err := session.validate(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(session.Data)
+	if err != nil {
+		return err
+	}
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	session.Data = data
+	p.dbHandle.sharedSessions[session.Key] = session
+	return nil
 }
 
-func (p *MemoryProvider) deleteSharedSession(_ string) error {
-	return ErrNotImplemented
+func (p *MemoryProvider) deleteSharedSession(key string) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	if _, ok := p.dbHandle.sharedSessions[key]; !ok {
+		return util.NewRecordNotFoundError(fmt.Sprintf("session %q does not exist", key))
+	}
+	delete(p.dbHandle.sharedSessions, key)
+	return nil
 }
 
-func (p *MemoryProvider) getSharedSession(_ string) (Session, error) {
-	return Session{}, ErrNotImplemented
+func (p *MemoryProvider) getSharedSession(key string) (Session, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return Session{}, errMemoryProviderClosed
+	}
+	session, ok := p.dbHandle.sharedSessions[key]
+	if !ok {
+		return Session{}, util.NewRecordNotFoundError(fmt.Sprintf("session %q does not exist", key))
+	}
+	return session, nil
 }
 
-func (p *MemoryProvider) cleanupSharedSessions(_ SessionType, _ int64) error {
-	return ErrNotImplemented
+func (p *MemoryProvider) cleanupSharedSessions(sessionType SessionType, before int64) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	for key, session := range p.dbHandle.sharedSessions {
+		if session.Type == sessionType && session.Timestamp < before {
+			delete(p.dbHandle.sharedSessions, key)
+		}
+	}
+	return nil
+}
+
+func (p *MemoryProvider) getSharedSessions(sessionType SessionType, after int64) ([]Session, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return nil, errMemoryProviderClosed
+	}
+	var sessions []Session
+	for _, session := range p.dbHandle.sharedSessions {
+		if session.Type == sessionType && session.Timestamp >= after {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
 }
 
 func (p *MemoryProvider) getEventActions(limit, offset int, order string, _ bool) ([]BaseEventAction, error) {
@@ -2222,7 +2408,7 @@ func (p *MemoryProvider) deleteEventAction(action BaseEventAction) error {
 	return nil
 }
 
-func (p *MemoryProvider) getEventRules(limit, offset int, order string) ([]EventRule, error) {
+func (p *MemoryProvider) getEventRules(limit, offset int, order, role string) ([]EventRule, error) {
 	p.dbHandle.Lock()
 	defer p.dbHandle.Unlock()
 	if p.dbHandle.isClosed {
@@ -2241,6 +2427,9 @@ func (p *MemoryProvider) getEventRules(limit, offset int, order string) ([]Event
 			}
 			r := p.dbHandle.rules[name]
 			rule := r.getACopy()
+			if !rule.hasRole(role) {
+				continue
+			}
 			p.addActionsToRule(&rule)
 			rule.PrepareForRendering()
 			rules = append(rules, rule)
@@ -2257,6 +2446,9 @@ func (p *MemoryProvider) getEventRules(limit, offset int, order string) ([]Event
 			name := p.dbHandle.rulesNames[i]
 			r := p.dbHandle.rules[name]
 			rule := r.getACopy()
+			if !rule.hasRole(role) {
+				continue
+			}
 			p.addActionsToRule(&rule)
 			rule.PrepareForRendering()
 			rules = append(rules, rule)
@@ -2453,6 +2645,10 @@ func (*MemoryProvider) updateNodeTimestamp() error {
 	return ErrNotImplemented
 }
 
+func (*MemoryProvider) updateNodeConnections() error {
+	return ErrNotImplemented
+}
+
 func (*MemoryProvider) cleanupNodes() error {
 	return ErrNotImplemented
 }
@@ -2609,6 +2805,144 @@ func (p *MemoryProvider) dumpRoles() ([]Role, error) {
 	return roles, nil
 }
 
+func (p *MemoryProvider) adminRoleExistsInternal(name string) (AdminRole, error) {
+	if val, ok := p.dbHandle.adminRoles[name]; ok {
+		return val.getACopy(), nil
+	}
+	return AdminRole{}, util.NewRecordNotFoundError(fmt.Sprintf("admin role %q does not exist", name))
+}
+
+func (p *MemoryProvider) adminRoleExists(name string) (AdminRole, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return AdminRole{}, errMemoryProviderClosed
+	}
+	return p.adminRoleExistsInternal(name)
+}
+
+func (p *MemoryProvider) addAdminRole(role *AdminRole) error {
+	if err := role.validate(); err != nil {
+		return err
+	}
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+
+	_, err := p.adminRoleExistsInternal(role.Name)
+	if err == nil {
+		return fmt.Errorf("admin role %q already exists", role.Name)
+	}
+	role.ID = p.getNextAdminRoleID()
+	role.CreatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+	role.UpdatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+	role.Admins = nil
+	p.dbHandle.adminRoles[role.Name] = role.getACopy()
+	p.dbHandle.adminRoleNames = append(p.dbHandle.adminRoleNames, role.Name)
+	sort.Strings(p.dbHandle.adminRoleNames)
+	return nil
+}
+
+func (p *MemoryProvider) updateAdminRole(role *AdminRole) error {
+	if err := role.validate(); err != nil {
+		return err
+	}
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	oldRole, err := p.adminRoleExistsInternal(role.Name)
+	if err != nil {
+		return err
+	}
+	role.ID = oldRole.ID
+	role.CreatedAt = oldRole.CreatedAt
+	role.UpdatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+	role.Admins = oldRole.Admins
+	p.dbHandle.adminRoles[role.Name] = role.getACopy()
+	return nil
+}
+
+func (p *MemoryProvider) deleteAdminRole(role AdminRole) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	oldRole, err := p.adminRoleExistsInternal(role.Name)
+	if err != nil {
+		return err
+	}
+	if len(oldRole.Admins) > 0 {
+		return util.NewValidationError(fmt.Sprintf("the admin role %q is referenced, it cannot be removed", oldRole.Name))
+	}
+	delete(p.dbHandle.adminRoles, role.Name)
+	p.dbHandle.adminRoleNames = make([]string, 0, len(p.dbHandle.adminRoles))
+	for name := range p.dbHandle.adminRoles {
+		p.dbHandle.adminRoleNames = append(p.dbHandle.adminRoleNames, name)
+	}
+	sort.Strings(p.dbHandle.adminRoleNames)
+	return nil
+}
+
+func (p *MemoryProvider) getAdminRoles(limit int, offset int, order string, _ bool) ([]AdminRole, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return nil, errMemoryProviderClosed
+	}
+	if limit <= 0 {
+		return nil, nil
+	}
+	roles := make([]AdminRole, 0, 10)
+	itNum := 0
+	if order == OrderASC {
+		for _, name := range p.dbHandle.adminRoleNames {
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+			r := p.dbHandle.adminRoles[name]
+			roles = append(roles, r.getACopy())
+			if len(roles) >= limit {
+				break
+			}
+		}
+	} else {
+		for i := len(p.dbHandle.adminRoleNames) - 1; i >= 0; i-- {
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+			name := p.dbHandle.adminRoleNames[i]
+			r := p.dbHandle.adminRoles[name]
+			roles = append(roles, r.getACopy())
+			if len(roles) >= limit {
+				break
+			}
+		}
+	}
+	return roles, nil
+}
+
+func (p *MemoryProvider) dumpAdminRoles() ([]AdminRole, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return nil, errMemoryProviderClosed
+	}
+
+	roles := make([]AdminRole, 0, len(p.dbHandle.adminRoles))
+	for _, name := range p.dbHandle.adminRoleNames {
+		r := p.dbHandle.adminRoles[name]
+		roles = append(roles, r.getACopy())
+	}
+	return roles, nil
+}
+
 func (p *MemoryProvider) ipListEntryExists(ipOrNet string, listType IPListType) (IPListEntry, error) {
 	p.dbHandle.Lock()
 	defer p.dbHandle.Unlock()
@@ -2823,6 +3157,243 @@ func (p *MemoryProvider) setConfigs(configs *Configs) error {
 	return nil
 }
 
+func (p *MemoryProvider) getFileMetadata(username, virtualPath string) (FileMetadata, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return FileMetadata{}, errMemoryProviderClosed
+	}
+	m, ok := p.dbHandle.filesMetadata[username][virtualPath]
+	if !ok {
+		return FileMetadata{}, util.NewRecordNotFoundError(fmt.Sprintf("no metadata for path %q", virtualPath))
+	}
+	return m.getACopy(), nil
+}
+
+func (p *MemoryProvider) getFilesMetadata(username, virtualPath string) ([]FileMetadata, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return nil, errMemoryProviderClosed
+	}
+	result := make([]FileMetadata, 0)
+	for filePath, m := range p.dbHandle.filesMetadata[username] {
+		if isFileMetadataInPath(filePath, virtualPath) {
+			result = append(result, m.getACopy())
+		}
+	}
+	sortFilesMetadata(result)
+	return result, nil
+}
+
+func (p *MemoryProvider) setFileMetadata(username string, metadata *FileMetadata) error {
+	if err := metadata.validate(); err != nil {
+		return err
+	}
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	if _, err := p.userExistsInternal(username); err != nil {
+		return util.NewGenericError(fmt.Sprintf("unable to validate user %q", username))
+	}
+	if _, ok := p.dbHandle.filesMetadata[username]; !ok {
+		p.dbHandle.filesMetadata[username] = make(map[string]FileMetadata)
+	}
+	p.dbHandle.filesMetadata[username][metadata.Path] = metadata.getACopy()
+	return nil
+}
+
+func (p *MemoryProvider) deleteFilesMetadata(username, virtualPath string, recursive bool) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	if !recursive {
+		delete(p.dbHandle.filesMetadata[username], virtualPath)
+		return nil
+	}
+	for filePath := range p.dbHandle.filesMetadata[username] {
+		if isFileMetadataInPath(filePath, virtualPath) {
+			delete(p.dbHandle.filesMetadata[username], filePath)
+		}
+	}
+	return nil
+}
+
+func (p *MemoryProvider) renameFilesMetadata(username, source, target string) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	files := p.dbHandle.filesMetadata[username]
+	renamed := make(map[string]FileMetadata)
+	for filePath, m := range files {
+		if isFileMetadataInPath(filePath, source) {
+			m.Path = getRenamedFileMetadataPath(filePath, source, target)
+			m.UpdatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+			renamed[m.Path] = m
+			delete(files, filePath)
+		} else if isFileMetadataInPath(filePath, target) {
+			delete(files, filePath)
+		}
+	}
+	for filePath, m := range renamed {
+		files[filePath] = m
+	}
+	return nil
+}
+
+func (p *MemoryProvider) addEventDigestEntry(entry *EventDigestEntry) error {
+	if err := entry.validate(); err != nil {
+		return err
+	}
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	p.dbHandle.lastDigestEntryID++
+	entry.ID = p.dbHandle.lastDigestEntryID
+	p.dbHandle.digestEntries[entry.ID] = entry.getACopy()
+	return nil
+}
+
+func (p *MemoryProvider) getEventDigestEntries(before int64) ([]EventDigestEntry, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return nil, errMemoryProviderClosed
+	}
+	result := make([]EventDigestEntry, 0)
+	for _, entry := range p.dbHandle.digestEntries {
+		if entry.WindowEnd <= before {
+			result = append(result, entry.getACopy())
+		}
+	}
+	sortEventDigestEntries(result)
+	return result, nil
+}
+
+func (p *MemoryProvider) deleteEventDigestEntries(ids []int64) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	for _, id := range ids {
+		if _, ok := p.dbHandle.digestEntries[id]; !ok {
+			return util.NewRecordNotFoundError(fmt.Sprintf("digest entry %d does not exist", id))
+		}
+	}
+	for _, id := range ids {
+		delete(p.dbHandle.digestEntries, id)
+	}
+	return nil
+}
+
+func (p *MemoryProvider) addAuditLogEntry(entry *AuditLogEntry) error {
+	if err := entry.validate(); err != nil {
+		return err
+	}
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	p.dbHandle.lastAuditLogEntryID++
+	entry.ID = p.dbHandle.lastAuditLogEntryID
+	p.dbHandle.auditLogEntries[entry.ID] = entry.getACopy()
+	return nil
+}
+
+func (p *MemoryProvider) searchAuditLog(filters *AuditLogSearch) ([]AuditLogEntry, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return nil, errMemoryProviderClosed
+	}
+	result := make([]AuditLogEntry, 0)
+	for _, entry := range p.dbHandle.auditLogEntries {
+		if filters.match(&entry) {
+			result = append(result, filters.prepareEntry(&entry))
+		}
+	}
+	sortAuditLogEntries(result, filters.Order)
+	if len(result) > filters.Limit {
+		result = result[:filters.Limit]
+	}
+	return result, nil
+}
+
+func (p *MemoryProvider) cleanupAuditLog(before int64) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	for id, entry := range p.dbHandle.auditLogEntries {
+		if entry.Timestamp < before {
+			delete(p.dbHandle.auditLogEntries, id)
+		}
+	}
+	return nil
+}
+
+func (p *MemoryProvider) addShareEvent(event *ShareEvent) error {
+	if err := event.validate(); err != nil {
+		return err
+	}
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	if _, ok := p.dbHandle.shares[event.ShareID]; !ok {
+		return util.NewRecordNotFoundError(fmt.Sprintf("share %q does not exist", event.ShareID))
+	}
+	p.dbHandle.lastShareEventID++
+	event.ID = p.dbHandle.lastShareEventID
+	p.dbHandle.shareEvents[event.ID] = *event
+	return nil
+}
+
+func (p *MemoryProvider) getShareEvents(shareID string, from, to int64, limit int) ([]ShareEvent, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return nil, errMemoryProviderClosed
+	}
+	result := make([]ShareEvent, 0)
+	for _, event := range p.dbHandle.shareEvents {
+		if event.ShareID == shareID && event.Timestamp >= from && event.Timestamp <= to {
+			result = append(result, event)
+		}
+	}
+	sortShareEvents(result)
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+func (p *MemoryProvider) cleanupShareEvents(before int64) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	for id, event := range p.dbHandle.shareEvents {
+		if event.Timestamp < before {
+			delete(p.dbHandle.shareEvents, id)
+		}
+	}
+	return nil
+}
+
 func (p *MemoryProvider) setFirstDownloadTimestamp(username string) error {
 	p.dbHandle.Lock()
 	defer p.dbHandle.Unlock()
@@ -2931,6 +3502,16 @@ func (p *MemoryProvider) getNextRoleID() int64 {
 	return nextID
 }
 
+func (p *MemoryProvider) getNextAdminRoleID() int64 {
+	nextID := int64(1)
+	for _, r := range p.dbHandle.adminRoles {
+		if r.ID >= nextID {
+			nextID = r.ID + 1
+		}
+	}
+	return nextID
+}
+
 func (p *MemoryProvider) clear() {
 	p.dbHandle.Lock()
 	defer p.dbHandle.Unlock()
@@ -2953,9 +3534,12 @@ func (p *MemoryProvider) clear() {
 	p.dbHandle.rulesNames = []string{}
 	p.dbHandle.roles = map[string]Role{}
 	p.dbHandle.roleNames = []string{}
+	p.dbHandle.adminRoles = map[string]AdminRole{}
+	p.dbHandle.adminRoleNames = []string{}
 	p.dbHandle.ipListEntries = map[string]IPListEntry{}
 	p.dbHandle.ipListEntriesKeys = []string{}
 	p.dbHandle.configs = Configs{}
+	p.dbHandle.filesMetadata = make(map[string]map[string]FileMetadata)
 }
 
 func (p *MemoryProvider) reloadConfig() error {
@@ -3007,6 +3591,10 @@ func (p *MemoryProvider) restoreDump(dump *BackupData) error {
 		return err
 	}
 
+	if err := p.restoreAdminRoles(dump); err != nil {
+		return err
+	}
+
 	if err := p.restoreFolders(dump); err != nil {
 		return err
 	}
@@ -3214,6 +3802,30 @@ func (p *MemoryProvider) restoreRoles(dump *BackupData) error {
 	return nil
 }
 
+func (p *MemoryProvider) restoreAdminRoles(dump *BackupData) error {
+	for idx := range dump.AdminRoles {
+		role := dump.AdminRoles[idx]
+		role.Name = config.convertName(role.Name)
+		r, err := p.adminRoleExists(role.Name)
+		if err == nil {
+			role.ID = r.ID
+			err = UpdateAdminRole(&role, ActionExecutorSystem, "", "")
+			if err != nil {
+				providerLog(logger.LevelError, "error updating admin role %q: %v", role.Name, err)
+				return err
+			}
+		} else {
+			role.Admins = nil
+			err = AddAdminRole(&role, ActionExecutorSystem, "", "")
+			if err != nil {
+				providerLog(logger.LevelError, "error adding admin role %q: %v", role.Name, err)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (p *MemoryProvider) restoreGroups(dump *BackupData) error {
 	for idx := range dump.Groups {
 		group := dump.Groups[idx]
@@ -22,6 +22,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"fmt"
 	"os"
@@ -37,13 +38,15 @@ import (
 )
 
 const (
-	mysqlResetSQL = "DROP TABLE IF EXISTS `{{api_keys}}` CASCADE;" +
+	mysqlResetSQL = "DROP TABLE IF EXISTS `{{share_events}}` CASCADE;" +
+		"DROP TABLE IF EXISTS `{{api_keys}}` CASCADE;" +
 		"DROP TABLE IF EXISTS `{{folders_mapping}}` CASCADE;" +
 		"DROP TABLE IF EXISTS `{{users_folders_mapping}}` CASCADE;" +
 		"DROP TABLE IF EXISTS `{{users_groups_mapping}}` CASCADE;" +
 		"DROP TABLE IF EXISTS `{{admins_groups_mapping}}` CASCADE;" +
 		"DROP TABLE IF EXISTS `{{groups_folders_mapping}}` CASCADE;" +
 		"DROP TABLE IF EXISTS `{{admins}}` CASCADE;" +
+		"DROP TABLE IF EXISTS `{{admin_roles}}` CASCADE;" +
 		"DROP TABLE IF EXISTS `{{folders}}` CASCADE;" +
 		"DROP TABLE IF EXISTS `{{shares}}` CASCADE;" +
 		"DROP TABLE IF EXISTS `{{users}}` CASCADE;" +
@@ -60,6 +63,9 @@ const (
 		"DROP TABLE IF EXISTS `{{roles}}` CASCADE;" +
 		"DROP TABLE IF EXISTS `{{ip_lists}}` CASCADE;" +
 		"DROP TABLE IF EXISTS `{{configs}}` CASCADE;" +
+		"DROP TABLE IF EXISTS `{{files_metadata}}` CASCADE;" +
+		"DROP TABLE IF EXISTS `{{events_digests}}` CASCADE;" +
+		"DROP TABLE IF EXISTS `{{audit_logs}}` CASCADE;" +
 		"DROP TABLE IF EXISTS `{{schema_version}}` CASCADE;"
 	mysqlInitialSQL = "CREATE TABLE `{{schema_version}}` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, `version` integer NOT NULL);" +
 		"CREATE TABLE `{{admins}}` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, `username` varchar(255) NOT NULL UNIQUE, " +
@@ -206,6 +212,66 @@ const (
 	mysqlV28SQL     = "CREATE TABLE `{{configs}}` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, `configs` longtext NOT NULL);" +
 		"INSERT INTO {{configs}} (configs) VALUES ('{}');"
 	mysqlV28DownSQL = "DROP TABLE `{{configs}}` CASCADE;"
+	mysqlV29SQL     = "CREATE TABLE `{{files_metadata}}` (`id` bigint AUTO_INCREMENT NOT NULL PRIMARY KEY, " +
+		"`path` longtext NOT NULL, `path_hash` varchar(64) NOT NULL, `metadata` longtext NULL, `tags` longtext NULL, " +
+		"`updated_at` bigint NOT NULL, `user_id` integer NOT NULL, " +
+		"CONSTRAINT `{{prefix}}unique_files_metadata_path` UNIQUE (`user_id`, `path_hash`));" +
+		"ALTER TABLE `{{files_metadata}}` ADD CONSTRAINT `{{prefix}}files_metadata_user_id_fk_users_id` " +
+		"FOREIGN KEY (`user_id`) REFERENCES `{{users}}` (`id`) ON DELETE CASCADE;"
+	mysqlV29DownSQL = "DROP TABLE `{{files_metadata}}` CASCADE;"
+	mysqlV30SQL     = "CREATE TABLE `{{events_digests}}` (`id` bigint AUTO_INCREMENT NOT NULL PRIMARY KEY, " +
+		"`rule_name` varchar(255) NOT NULL, `action_name` varchar(255) NOT NULL, `name` varchar(255) NOT NULL, " +
+		"`window_end` bigint NOT NULL, `data` longtext NOT NULL, `created_at` bigint NOT NULL);" +
+		"CREATE INDEX `{{prefix}}events_digests_window_end_idx` ON `{{events_digests}}` (`window_end`);"
+	mysqlV30DownSQL = "DROP TABLE `{{events_digests}}` CASCADE;"
+	mysqlV31SQL     = "CREATE TABLE `{{audit_logs}}` (`id` bigint AUTO_INCREMENT NOT NULL PRIMARY KEY, " +
+		"`created_at` bigint NOT NULL, `action` varchar(32) NOT NULL, `executor` varchar(255) NOT NULL, " +
+		"`ip` varchar(50) NOT NULL, `role` varchar(255) NOT NULL, `object_type` varchar(50) NOT NULL, " +
+		"`object_name` varchar(512) NOT NULL, `before_data` longtext NULL, `after_data` longtext NULL, " +
+		"`changes` longtext NULL);" +
+		"CREATE INDEX `{{prefix}}audit_logs_created_at_idx` ON `{{audit_logs}}` (`created_at`);" +
+		"CREATE INDEX `{{prefix}}audit_logs_executor_idx` ON `{{audit_logs}}` (`executor`);" +
+		"CREATE INDEX `{{prefix}}audit_logs_object_name_idx` ON `{{audit_logs}}` (`object_name`);"
+	mysqlV31DownSQL = "DROP TABLE `{{audit_logs}}` CASCADE;"
+	mysqlV32SQL     = "ALTER TABLE `{{folders}}` ADD COLUMN `failover` longtext NULL;"
+	mysqlV32DownSQL = "ALTER TABLE `{{folders}}` DROP COLUMN `failover`;"
+	mysqlV33SQL     = "ALTER TABLE `{{roles}}` ADD COLUMN `tenant` longtext NULL;"
+	mysqlV33DownSQL = "ALTER TABLE `{{roles}}` DROP COLUMN `tenant`;"
+	mysqlV34SQL     = "ALTER TABLE `{{folders}}` ADD COLUMN `limits` longtext NULL;"
+	mysqlV34DownSQL = "ALTER TABLE `{{folders}}` DROP COLUMN `limits`;"
+	mysqlV35SQL     = "ALTER TABLE `{{shares}}` ADD COLUMN `options` longtext NULL;"
+	mysqlV35DownSQL = "ALTER TABLE `{{shares}}` DROP COLUMN `options`;"
+	mysqlV36SQL     = "CREATE TABLE `{{share_events}}` (`id` bigint AUTO_INCREMENT NOT NULL PRIMARY KEY, " +
+		"`share_id` varchar(60) NOT NULL, `created_at` bigint NOT NULL, `ip` varchar(50) NOT NULL, " +
+		"`user_agent` varchar(255) NOT NULL, `path` longtext NOT NULL, `size` bigint NOT NULL);" +
+		"ALTER TABLE `{{share_events}}` ADD CONSTRAINT `{{prefix}}share_events_share_id_fk_shares_share_id` " +
+		"FOREIGN KEY (`share_id`) REFERENCES `{{shares}}` (`share_id`) ON DELETE CASCADE;" +
+		"CREATE INDEX `{{prefix}}share_events_share_id_created_at_idx` ON `{{share_events}}` (`share_id`, `created_at`);" +
+		"CREATE INDEX `{{prefix}}share_events_created_at_idx` ON `{{share_events}}` (`created_at`);"
+	mysqlV36DownSQL = "DROP TABLE `{{share_events}}` CASCADE;"
+	mysqlV37SQL     = "CREATE TABLE `{{admin_roles}}` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, " +
+		"`name` varchar(255) NOT NULL UNIQUE, `description` varchar(512) NULL, `created_at` bigint NOT NULL, " +
+		"`updated_at` bigint NOT NULL, `permissions` longtext NOT NULL, `filters` longtext NULL);" +
+		"ALTER TABLE `{{admins}}` ADD COLUMN `admin_role_id` integer NULL , " +
+		"ADD CONSTRAINT `{{prefix}}admins_admin_role_id_fk_admin_roles_id` FOREIGN KEY (`admin_role_id`) " +
+		"REFERENCES `{{admin_roles}}`(`id`) ON DELETE NO ACTION;"
+	mysqlV37DownSQL = "ALTER TABLE `{{admins}}` DROP FOREIGN KEY `{{prefix}}admins_admin_role_id_fk_admin_roles_id`;" +
+		"ALTER TABLE `{{admins}}` DROP COLUMN `admin_role_id`;" +
+		"DROP TABLE `{{admin_roles}}` CASCADE;"
+	mysqlV38SQL = "ALTER TABLE `{{groups}}` ADD COLUMN `role_id` integer NULL , " +
+		"ADD CONSTRAINT `{{prefix}}groups_role_id_fk_roles_id` FOREIGN KEY (`role_id`) REFERENCES `{{roles}}`(`id`) ON DELETE NO ACTION;" +
+		"ALTER TABLE `{{folders}}` ADD COLUMN `role_id` integer NULL , " +
+		"ADD CONSTRAINT `{{prefix}}folders_role_id_fk_roles_id` FOREIGN KEY (`role_id`) REFERENCES `{{roles}}`(`id`) ON DELETE NO ACTION;" +
+		"ALTER TABLE `{{events_rules}}` ADD COLUMN `role_id` integer NULL , " +
+		"ADD CONSTRAINT `{{prefix}}events_rules_role_id_fk_roles_id` FOREIGN KEY (`role_id`) REFERENCES `{{roles}}`(`id`) ON DELETE NO ACTION;"
+	mysqlV38DownSQL = "ALTER TABLE `{{events_rules}}` DROP FOREIGN KEY `{{prefix}}events_rules_role_id_fk_roles_id`;" +
+		"ALTER TABLE `{{folders}}` DROP FOREIGN KEY `{{prefix}}folders_role_id_fk_roles_id`;" +
+		"ALTER TABLE `{{groups}}` DROP FOREIGN KEY `{{prefix}}groups_role_id_fk_roles_id`;" +
+		"ALTER TABLE `{{events_rules}}` DROP COLUMN `role_id`;" +
+		"ALTER TABLE `{{folders}}` DROP COLUMN `role_id`;" +
+		"ALTER TABLE `{{groups}}` DROP COLUMN `role_id`;"
+	mysqlV39SQL     = "ALTER TABLE `{{api_keys}}` ADD COLUMN `filters` longtext NULL;"
+	mysqlV39DownSQL = "ALTER TABLE `{{api_keys}}` DROP COLUMN `filters`;"
 )
 
 // MySQLProvider defines the auth provider for MySQL/MariaDB database
@@ -226,7 +292,16 @@ func initializeMySQLProvider() error {
 	if err != nil {
 		return err
 	}
-	dbHandle, err := sql.Open("mysql", connString)
+	var dbHandle *sql.DB
+	if config.ConnectionString == "" {
+		var mysqlConfig *mysql.Config
+		mysqlConfig, err = mysql.ParseDSN(connString)
+		if err == nil {
+			dbHandle = sql.OpenDB(&mysqlConnector{config: mysqlConfig})
+		}
+	} else {
+		dbHandle, err = sql.Open("mysql", connString)
+	}
 	if err != nil {
 		providerLog(logger.LevelError, "error creating mysql database handler, connection string: %q, error: %v",
 			redactedConnString, err)
@@ -249,6 +324,27 @@ func initializeMySQLProvider() error {
 
 	return dbHandle.PingContext(ctx)
 }
+
+// mysqlConnector creates new connections using the current password, it may
+// change at runtime
+type mysqlConnector struct {
+	config *mysql.Config
+}
+
+func (c *mysqlConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	cfg := c.config.Clone()
+	cfg.Passwd = getProviderPassword()
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(ctx)
+}
+
+func (c *mysqlConnector) Driver() driver.Driver {
+	return &mysql.MySQLDriver{}
+}
+
 func getMySQLConnectionString(redactedPwd bool) (string, error) {
 	var connectionString string
 	if config.ConnectionString == "" {
@@ -313,8 +409,8 @@ func (p *MySQLProvider) checkAvailability() error {
 	return sqlCommonCheckAvailability(p.dbHandle)
 }
 
-func (p *MySQLProvider) validateUserAndPass(username, password, ip, protocol string) (User, error) {
-	return sqlCommonValidateUserAndPass(username, password, ip, protocol, p.dbHandle)
+func (p *MySQLProvider) validateUserAndPass(ctx context.Context, username, password, ip, protocol string) (User, error) {
+	return sqlCommonValidateUserAndPass(ctx, username, password, ip, protocol, p.dbHandle)
 }
 
 func (p *MySQLProvider) validateUserAndTLSCert(username, protocol string, tlsCert *x509.Certificate) (User, error) {
@@ -389,8 +485,8 @@ func (p *MySQLProvider) dumpFolders() ([]vfs.BaseVirtualFolder, error) {
 	return sqlCommonDumpFolders(p.dbHandle)
 }
 
-func (p *MySQLProvider) getFolders(limit, offset int, order string, minimal bool) ([]vfs.BaseVirtualFolder, error) {
-	return sqlCommonGetFolders(limit, offset, order, minimal, p.dbHandle)
+func (p *MySQLProvider) getFolders(limit, offset int, order string, minimal bool, role string) ([]vfs.BaseVirtualFolder, error) {
+	return sqlCommonGetFolders(limit, offset, order, minimal, role, p.dbHandle)
 }
 
 func (p *MySQLProvider) getFolderByName(name string) (vfs.BaseVirtualFolder, error) {
@@ -419,8 +515,8 @@ func (p *MySQLProvider) getUsedFolderQuota(name string) (int, int64, error) {
 	return sqlCommonGetFolderUsedQuota(name, p.dbHandle)
 }
 
-func (p *MySQLProvider) getGroups(limit, offset int, order string, minimal bool) ([]Group, error) {
-	return sqlCommonGetGroups(limit, offset, order, minimal, p.dbHandle)
+func (p *MySQLProvider) getGroups(limit, offset int, order string, minimal bool, role string) ([]Group, error) {
+	return sqlCommonGetGroups(limit, offset, order, minimal, role, p.dbHandle)
 }
 
 func (p *MySQLProvider) getGroupsWithNames(names []string) ([]Group, error) {
@@ -491,6 +587,10 @@ func (p *MySQLProvider) updateAPIKey(apiKey *APIKey) error {
 	return sqlCommonUpdateAPIKey(apiKey, p.dbHandle)
 }
 
+func (p *MySQLProvider) rotateAPIKey(apiKey *APIKey) error {
+	return sqlCommonRotateAPIKey(apiKey, p.dbHandle)
+}
+
 func (p *MySQLProvider) deleteAPIKey(apiKey APIKey) error {
 	return sqlCommonDeleteAPIKey(apiKey, p.dbHandle)
 }
@@ -603,6 +703,10 @@ func (p *MySQLProvider) cleanupSharedSessions(sessionType SessionType, before in
 	return sqlCommonCleanupSessions(sessionType, before, p.dbHandle)
 }
 
+func (p *MySQLProvider) getSharedSessions(sessionType SessionType, after int64) ([]Session, error) {
+	return sqlCommonGetSessions(sessionType, after, p.dbHandle)
+}
+
 func (p *MySQLProvider) getEventActions(limit, offset int, order string, minimal bool) ([]BaseEventAction, error) {
 	return sqlCommonGetEventActions(limit, offset, order, minimal, p.dbHandle)
 }
@@ -627,8 +731,8 @@ func (p *MySQLProvider) deleteEventAction(action BaseEventAction) error {
 	return sqlCommonDeleteEventAction(action, p.dbHandle)
 }
 
-func (p *MySQLProvider) getEventRules(limit, offset int, order string) ([]EventRule, error) {
-	return sqlCommonGetEventRules(limit, offset, order, p.dbHandle)
+func (p *MySQLProvider) getEventRules(limit, offset int, order, role string) ([]EventRule, error) {
+	return sqlCommonGetEventRules(limit, offset, order, role, p.dbHandle)
 }
 
 func (p *MySQLProvider) dumpEventRules() ([]EventRule, error) {
@@ -687,6 +791,10 @@ func (p *MySQLProvider) updateNodeTimestamp() error {
 	return sqlCommonUpdateNodeTimestamp(p.dbHandle)
 }
 
+func (p *MySQLProvider) updateNodeConnections() error {
+	return sqlCommonUpdateNodeData(p.dbHandle)
+}
+
 func (p *MySQLProvider) cleanupNodes() error {
 	return sqlCommonCleanupNodes(p.dbHandle)
 }
@@ -715,6 +823,30 @@ func (p *MySQLProvider) dumpRoles() ([]Role, error) {
 	return sqlCommonDumpRoles(p.dbHandle)
 }
 
+func (p *MySQLProvider) adminRoleExists(name string) (AdminRole, error) {
+	return sqlCommonGetAdminRoleByName(name, p.dbHandle)
+}
+
+func (p *MySQLProvider) addAdminRole(role *AdminRole) error {
+	return sqlCommonAddAdminRole(role, p.dbHandle)
+}
+
+func (p *MySQLProvider) updateAdminRole(role *AdminRole) error {
+	return sqlCommonUpdateAdminRole(role, p.dbHandle)
+}
+
+func (p *MySQLProvider) deleteAdminRole(role AdminRole) error {
+	return sqlCommonDeleteAdminRole(role, p.dbHandle)
+}
+
+func (p *MySQLProvider) getAdminRoles(limit int, offset int, order string, minimal bool) ([]AdminRole, error) {
+	return sqlCommonGetAdminRoles(limit, offset, order, minimal, p.dbHandle)
+}
+
+func (p *MySQLProvider) dumpAdminRoles() ([]AdminRole, error) {
+	return sqlCommonDumpAdminRoles(p.dbHandle)
+}
+
 func (p *MySQLProvider) ipListEntryExists(ipOrNet string, listType IPListType) (IPListEntry, error) {
 	return sqlCommonGetIPListEntry(ipOrNet, listType, p.dbHandle)
 }
@@ -759,6 +891,62 @@ func (p *MySQLProvider) setConfigs(configs *Configs) error {
 	return sqlCommonSetConfigs(configs, p.dbHandle)
 }
 
+func (p *MySQLProvider) getFileMetadata(username, virtualPath string) (FileMetadata, error) {
+	return sqlCommonGetFileMetadata(username, virtualPath, p.dbHandle)
+}
+
+func (p *MySQLProvider) getFilesMetadata(username, virtualPath string) ([]FileMetadata, error) {
+	return sqlCommonGetFilesMetadata(username, virtualPath, p.dbHandle)
+}
+
+func (p *MySQLProvider) setFileMetadata(username string, metadata *FileMetadata) error {
+	return sqlCommonSetFileMetadata(username, metadata, p.dbHandle)
+}
+
+func (p *MySQLProvider) deleteFilesMetadata(username, virtualPath string, recursive bool) error {
+	return sqlCommonDeleteFilesMetadata(username, virtualPath, recursive, p.dbHandle)
+}
+
+func (p *MySQLProvider) renameFilesMetadata(username, source, target string) error {
+	return sqlCommonRenameFilesMetadata(username, source, target, p.dbHandle)
+}
+
+func (p *MySQLProvider) addEventDigestEntry(entry *EventDigestEntry) error {
+	return sqlCommonAddEventDigestEntry(entry, p.dbHandle)
+}
+
+func (p *MySQLProvider) getEventDigestEntries(before int64) ([]EventDigestEntry, error) {
+	return sqlCommonGetEventDigestEntries(before, p.dbHandle)
+}
+
+func (p *MySQLProvider) deleteEventDigestEntries(ids []int64) error {
+	return sqlCommonDeleteEventDigestEntries(ids, p.dbHandle)
+}
+
+func (p *MySQLProvider) addAuditLogEntry(entry *AuditLogEntry) error {
+	return sqlCommonAddAuditLogEntry(entry, p.dbHandle)
+}
+
+func (p *MySQLProvider) searchAuditLog(filters *AuditLogSearch) ([]AuditLogEntry, error) {
+	return sqlCommonSearchAuditLog(filters, p.dbHandle)
+}
+
+func (p *MySQLProvider) cleanupAuditLog(before int64) error {
+	return sqlCommonCleanupAuditLog(before, p.dbHandle)
+}
+
+func (p *MySQLProvider) addShareEvent(event *ShareEvent) error {
+	return sqlCommonAddShareEvent(event, p.dbHandle)
+}
+
+func (p *MySQLProvider) getShareEvents(shareID string, from, to int64, limit int) ([]ShareEvent, error) {
+	return sqlCommonGetShareEvents(shareID, from, to, limit, p.dbHandle)
+}
+
+func (p *MySQLProvider) cleanupShareEvents(before int64) error {
+	return sqlCommonCleanupShareEvents(before, p.dbHandle)
+}
+
 func (p *MySQLProvider) setFirstDownloadTimestamp(username string) error {
 	return sqlCommonSetFirstDownloadTimestamp(username, p.dbHandle)
 }
@@ -816,6 +1004,28 @@ func (p *MySQLProvider) migrateDatabase() error { //nolint:dupl
 		return updateMySQLDatabaseFromV26(p.dbHandle)
 	case version == 27:
 		return updateMySQLDatabaseFromV27(p.dbHandle)
+	case version == 28:
+		return updateMySQLDatabaseFromV28(p.dbHandle)
+	case version == 29:
+		return updateMySQLDatabaseFromV29(p.dbHandle)
+	case version == 30:
+		return updateMySQLDatabaseFromV30(p.dbHandle)
+	case version == 31:
+		return updateMySQLDatabaseFromV31(p.dbHandle)
+	case version == 32:
+		return updateMySQLDatabaseFromV32(p.dbHandle)
+	case version == 33:
+		return updateMySQLDatabaseFromV33(p.dbHandle)
+	case version == 34:
+		return updateMySQLDatabaseFromV34(p.dbHandle)
+	case version == 35:
+		return updateMySQLDatabaseFromV35(p.dbHandle)
+	case version == 36:
+		return updateMySQLDatabaseFromV36(p.dbHandle)
+	case version == 37:
+		return updateMySQLDatabaseFromV37(p.dbHandle)
+	case version == 38:
+		return updateMySQLDatabaseFromV38(p.dbHandle)
 	default:
 		if version > sqlDatabaseVersion {
 			providerLog(logger.LevelError, "database schema version %d is newer than the supported one: %d", version,
@@ -848,6 +1058,28 @@ func (p *MySQLProvider) revertDatabase(targetVersion int) error {
 		return downgradeMySQLDatabaseFromV27(p.dbHandle)
 	case 28:
 		return downgradeMySQLDatabaseFromV28(p.dbHandle)
+	case 29:
+		return downgradeMySQLDatabaseFromV29(p.dbHandle)
+	case 30:
+		return downgradeMySQLDatabaseFromV30(p.dbHandle)
+	case 31:
+		return downgradeMySQLDatabaseFromV31(p.dbHandle)
+	case 32:
+		return downgradeMySQLDatabaseFromV32(p.dbHandle)
+	case 33:
+		return downgradeMySQLDatabaseFromV33(p.dbHandle)
+	case 34:
+		return downgradeMySQLDatabaseFromV34(p.dbHandle)
+	case 35:
+		return downgradeMySQLDatabaseFromV35(p.dbHandle)
+	case 36:
+		return downgradeMySQLDatabaseFromV36(p.dbHandle)
+	case 37:
+		return downgradeMySQLDatabaseFromV37(p.dbHandle)
+	case 38:
+		return downgradeMySQLDatabaseFromV38(p.dbHandle)
+	case 39:
+		return downgradeMySQLDatabaseFromV39(p.dbHandle)
 	default:
 		return fmt.Errorf("database schema version not handled: %d", dbVersion.Version)
 	}
@@ -887,7 +1119,84 @@ func updateMySQLDatabaseFromV26(dbHandle *sql.DB) error {
 }
 
 func updateMySQLDatabaseFromV27(dbHandle *sql.DB) error {
-	return updateMySQLDatabaseFrom27To28(dbHandle)
+	if err := updateMySQLDatabaseFrom27To28(dbHandle); err != nil {
+		return err
+	}
+	return updateMySQLDatabaseFromV28(dbHandle)
+}
+
+func updateMySQLDatabaseFromV28(dbHandle *sql.DB) error {
+	if err := updateMySQLDatabaseFrom28To29(dbHandle); err != nil {
+		return err
+	}
+	return updateMySQLDatabaseFromV29(dbHandle)
+}
+
+func updateMySQLDatabaseFromV29(dbHandle *sql.DB) error {
+	if err := updateMySQLDatabaseFrom29To30(dbHandle); err != nil {
+		return err
+	}
+	return updateMySQLDatabaseFromV30(dbHandle)
+}
+
+func updateMySQLDatabaseFromV30(dbHandle *sql.DB) error {
+	if err := updateMySQLDatabaseFrom30To31(dbHandle); err != nil {
+		return err
+	}
+	return updateMySQLDatabaseFromV31(dbHandle)
+}
+
+func updateMySQLDatabaseFromV31(dbHandle *sql.DB) error {
+	if err := updateMySQLDatabaseFrom31To32(dbHandle); err != nil {
+		return err
+	}
+	return updateMySQLDatabaseFromV32(dbHandle)
+}
+
+func updateMySQLDatabaseFromV32(dbHandle *sql.DB) error {
+	if err := updateMySQLDatabaseFrom32To33(dbHandle); err != nil {
+		return err
+	}
+	return updateMySQLDatabaseFromV33(dbHandle)
+}
+
+func updateMySQLDatabaseFromV33(dbHandle *sql.DB) error {
+	if err := updateMySQLDatabaseFrom33To34(dbHandle); err != nil {
+		return err
+	}
+	return updateMySQLDatabaseFromV34(dbHandle)
+}
+
+func updateMySQLDatabaseFromV34(dbHandle *sql.DB) error {
+	if err := updateMySQLDatabaseFrom34To35(dbHandle); err != nil {
+		return err
+	}
+	return updateMySQLDatabaseFromV35(dbHandle)
+}
+
+func updateMySQLDatabaseFromV35(dbHandle *sql.DB) error {
+	if err := updateMySQLDatabaseFrom35To36(dbHandle); err != nil {
+		return err
+	}
+	return updateMySQLDatabaseFromV36(dbHandle)
+}
+
+func updateMySQLDatabaseFromV36(dbHandle *sql.DB) error {
+	if err := updateMySQLDatabaseFrom36To37(dbHandle); err != nil {
+		return err
+	}
+	return updateMySQLDatabaseFromV37(dbHandle)
+}
+
+func updateMySQLDatabaseFromV37(dbHandle *sql.DB) error {
+	if err := updateMySQLDatabaseFrom37To38(dbHandle); err != nil {
+		return err
+	}
+	return updateMySQLDatabaseFromV38(dbHandle)
+}
+
+func updateMySQLDatabaseFromV38(dbHandle *sql.DB) error {
+	return updateMySQLDatabaseFrom38To39(dbHandle)
 }
 
 func downgradeMySQLDatabaseFromV24(dbHandle *sql.DB) error {
@@ -922,6 +1231,83 @@ func downgradeMySQLDatabaseFromV28(dbHandle *sql.DB) error {
 	return downgradeMySQLDatabaseFromV27(dbHandle)
 }
 
+func downgradeMySQLDatabaseFromV29(dbHandle *sql.DB) error {
+	if err := downgradeMySQLDatabaseFrom29To28(dbHandle); err != nil {
+		return err
+	}
+	return downgradeMySQLDatabaseFromV28(dbHandle)
+}
+
+func downgradeMySQLDatabaseFromV30(dbHandle *sql.DB) error {
+	if err := downgradeMySQLDatabaseFrom30To29(dbHandle); err != nil {
+		return err
+	}
+	return downgradeMySQLDatabaseFromV29(dbHandle)
+}
+
+func downgradeMySQLDatabaseFromV31(dbHandle *sql.DB) error {
+	if err := downgradeMySQLDatabaseFrom31To30(dbHandle); err != nil {
+		return err
+	}
+	return downgradeMySQLDatabaseFromV30(dbHandle)
+}
+
+func downgradeMySQLDatabaseFromV32(dbHandle *sql.DB) error {
+	if err := downgradeMySQLDatabaseFrom32To31(dbHandle); err != nil {
+		return err
+	}
+	return downgradeMySQLDatabaseFromV31(dbHandle)
+}
+
+func downgradeMySQLDatabaseFromV33(dbHandle *sql.DB) error {
+	if err := downgradeMySQLDatabaseFrom33To32(dbHandle); err != nil {
+		return err
+	}
+	return downgradeMySQLDatabaseFromV32(dbHandle)
+}
+
+func downgradeMySQLDatabaseFromV34(dbHandle *sql.DB) error {
+	if err := downgradeMySQLDatabaseFrom34To33(dbHandle); err != nil {
+		return err
+	}
+	return downgradeMySQLDatabaseFromV33(dbHandle)
+}
+
+func downgradeMySQLDatabaseFromV35(dbHandle *sql.DB) error {
+	if err := downgradeMySQLDatabaseFrom35To34(dbHandle); err != nil {
+		return err
+	}
+	return downgradeMySQLDatabaseFromV34(dbHandle)
+}
+
+func downgradeMySQLDatabaseFromV36(dbHandle *sql.DB) error {
+	if err := downgradeMySQLDatabaseFrom36To35(dbHandle); err != nil {
+		return err
+	}
+	return downgradeMySQLDatabaseFromV35(dbHandle)
+}
+
+func downgradeMySQLDatabaseFromV37(dbHandle *sql.DB) error {
+	if err := downgradeMySQLDatabaseFrom37To36(dbHandle); err != nil {
+		return err
+	}
+	return downgradeMySQLDatabaseFromV36(dbHandle)
+}
+
+func downgradeMySQLDatabaseFromV38(dbHandle *sql.DB) error {
+	if err := downgradeMySQLDatabaseFrom38To37(dbHandle); err != nil {
+		return err
+	}
+	return downgradeMySQLDatabaseFromV37(dbHandle)
+}
+
+func downgradeMySQLDatabaseFromV39(dbHandle *sql.DB) error {
+	if err := downgradeMySQLDatabaseFrom39To38(dbHandle); err != nil {
+		return err
+	}
+	return downgradeMySQLDatabaseFromV38(dbHandle)
+}
+
 func updateMySQLDatabaseFrom23To24(dbHandle *sql.DB) error {
 	logger.InfoToConsole("updating database schema version: 23 -> 24")
 	providerLog(logger.LevelInfo, "updating database schema version: 23 -> 24")
@@ -961,6 +1347,95 @@ func updateMySQLDatabaseFrom27To28(dbHandle *sql.DB) error {
 	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 28, true)
 }
 
+func updateMySQLDatabaseFrom28To29(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 28 -> 29")
+	providerLog(logger.LevelInfo, "updating database schema version: 28 -> 29")
+	sql := strings.ReplaceAll(mysqlV29SQL, "{{files_metadata}}", sqlTableFilesMetadata)
+	sql = strings.ReplaceAll(sql, "{{users}}", sqlTableUsers)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 29, true)
+}
+
+func updateMySQLDatabaseFrom29To30(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 29 -> 30")
+	providerLog(logger.LevelInfo, "updating database schema version: 29 -> 30")
+	sql := strings.ReplaceAll(mysqlV30SQL, "{{events_digests}}", sqlTableEventsDigests)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 30, true)
+}
+
+func updateMySQLDatabaseFrom30To31(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 30 -> 31")
+	providerLog(logger.LevelInfo, "updating database schema version: 30 -> 31")
+	sql := strings.ReplaceAll(mysqlV31SQL, "{{audit_logs}}", sqlTableAuditLogs)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 31, true)
+}
+
+func updateMySQLDatabaseFrom31To32(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 31 -> 32")
+	providerLog(logger.LevelInfo, "updating database schema version: 31 -> 32")
+	sql := strings.ReplaceAll(mysqlV32SQL, "{{folders}}", sqlTableFolders)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 32, true)
+}
+
+func updateMySQLDatabaseFrom32To33(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 32 -> 33")
+	providerLog(logger.LevelInfo, "updating database schema version: 32 -> 33")
+	sql := strings.ReplaceAll(mysqlV33SQL, "{{roles}}", sqlTableRoles)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 33, true)
+}
+
+func updateMySQLDatabaseFrom33To34(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 33 -> 34")
+	providerLog(logger.LevelInfo, "updating database schema version: 33 -> 34")
+	sql := strings.ReplaceAll(mysqlV34SQL, "{{folders}}", sqlTableFolders)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 34, true)
+}
+
+func updateMySQLDatabaseFrom34To35(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 34 -> 35")
+	providerLog(logger.LevelInfo, "updating database schema version: 34 -> 35")
+	sql := strings.ReplaceAll(mysqlV35SQL, "{{shares}}", sqlTableShares)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 35, true)
+}
+
+func updateMySQLDatabaseFrom35To36(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 35 -> 36")
+	providerLog(logger.LevelInfo, "updating database schema version: 35 -> 36")
+	sql := strings.ReplaceAll(mysqlV36SQL, "{{share_events}}", sqlTableShareEvents)
+	sql = strings.ReplaceAll(sql, "{{shares}}", sqlTableShares)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 36, true)
+}
+
+func updateMySQLDatabaseFrom36To37(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 36 -> 37")
+	providerLog(logger.LevelInfo, "updating database schema version: 36 -> 37")
+	sql := strings.ReplaceAll(mysqlV37SQL, "{{admin_roles}}", sqlTableAdminRoles)
+	sql = strings.ReplaceAll(sql, "{{admins}}", sqlTableAdmins)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 37, true)
+}
+
+func updateMySQLDatabaseFrom37To38(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 37 -> 38")
+	providerLog(logger.LevelInfo, "updating database schema version: 37 -> 38")
+	sql := strings.ReplaceAll(mysqlV38SQL, "{{groups}}", sqlTableGroups)
+	sql = strings.ReplaceAll(sql, "{{folders}}", sqlTableFolders)
+	sql = strings.ReplaceAll(sql, "{{events_rules}}", sqlTableEventsRules)
+	sql = strings.ReplaceAll(sql, "{{roles}}", sqlTableRoles)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 38, true)
+}
+
+func updateMySQLDatabaseFrom38To39(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 38 -> 39")
+	providerLog(logger.LevelInfo, "updating database schema version: 38 -> 39")
+	sql := strings.ReplaceAll(mysqlV39SQL, "{{api_keys}}", sqlTableAPIKeys)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 39, true)
+}
+
 func downgradeMySQLDatabaseFrom24To23(dbHandle *sql.DB) error {
 	logger.InfoToConsole("downgrading database schema version: 24 -> 23")
 	providerLog(logger.LevelInfo, "downgrading database schema version: 24 -> 23")
@@ -998,3 +1473,85 @@ func downgradeMySQLDatabaseFrom28To27(dbHandle *sql.DB) error {
 	sql := strings.ReplaceAll(mysqlV28DownSQL, "{{configs}}", sqlTableConfigs)
 	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 27, false)
 }
+
+func downgradeMySQLDatabaseFrom29To28(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 29 -> 28")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 29 -> 28")
+	sql := strings.ReplaceAll(mysqlV29DownSQL, "{{files_metadata}}", sqlTableFilesMetadata)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 28, false)
+}
+
+func downgradeMySQLDatabaseFrom30To29(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 30 -> 29")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 30 -> 29")
+	sql := strings.ReplaceAll(mysqlV30DownSQL, "{{events_digests}}", sqlTableEventsDigests)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 29, false)
+}
+
+func downgradeMySQLDatabaseFrom31To30(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 31 -> 30")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 31 -> 30")
+	sql := strings.ReplaceAll(mysqlV31DownSQL, "{{audit_logs}}", sqlTableAuditLogs)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 30, false)
+}
+
+func downgradeMySQLDatabaseFrom32To31(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 32 -> 31")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 32 -> 31")
+	sql := strings.ReplaceAll(mysqlV32DownSQL, "{{folders}}", sqlTableFolders)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 31, false)
+}
+
+func downgradeMySQLDatabaseFrom33To32(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 33 -> 32")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 33 -> 32")
+	sql := strings.ReplaceAll(mysqlV33DownSQL, "{{roles}}", sqlTableRoles)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 32, false)
+}
+
+func downgradeMySQLDatabaseFrom34To33(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 34 -> 33")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 34 -> 33")
+	sql := strings.ReplaceAll(mysqlV34DownSQL, "{{folders}}", sqlTableFolders)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 33, false)
+}
+
+func downgradeMySQLDatabaseFrom35To34(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 35 -> 34")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 35 -> 34")
+	sql := strings.ReplaceAll(mysqlV35DownSQL, "{{shares}}", sqlTableShares)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 34, false)
+}
+
+func downgradeMySQLDatabaseFrom36To35(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 36 -> 35")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 36 -> 35")
+	sql := strings.ReplaceAll(mysqlV36DownSQL, "{{share_events}}", sqlTableShareEvents)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 35, false)
+}
+
+func downgradeMySQLDatabaseFrom37To36(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 37 -> 36")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 37 -> 36")
+	sql := strings.ReplaceAll(mysqlV37DownSQL, "{{admin_roles}}", sqlTableAdminRoles)
+	sql = strings.ReplaceAll(sql, "{{admins}}", sqlTableAdmins)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 36, false)
+}
+
+func downgradeMySQLDatabaseFrom38To37(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 38 -> 37")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 38 -> 37")
+	sql := strings.ReplaceAll(mysqlV38DownSQL, "{{groups}}", sqlTableGroups)
+	sql = strings.ReplaceAll(sql, "{{folders}}", sqlTableFolders)
+	sql = strings.ReplaceAll(sql, "{{events_rules}}", sqlTableEventsRules)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 37, false)
+}
+
+func downgradeMySQLDatabaseFrom39To38(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 39 -> 38")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 39 -> 38")
+	sql := strings.ReplaceAll(mysqlV39DownSQL, "{{api_keys}}", sqlTableAPIKeys)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 38, false)
+}
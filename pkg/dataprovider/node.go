@@ -25,6 +25,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/lestrrat-go/jwx/v2/jwa"
@@ -54,6 +55,8 @@ var (
 	errNoClusterNodes  = errors.New("no cluster node defined")
 	activeNodeTimeDiff = -2 * time.Minute
 	nodeReqTimeout     = 8 * time.Second
+	// last connection counters published by the current node
+	currentNodeConnections atomic.Pointer[NodeConnections]
 )
 
 // NodeConfig defines the node configuration
@@ -65,6 +68,7 @@ type NodeConfig struct {
 
 func (n *NodeConfig) validate() error {
 	currentNode = nil
+	currentNodeConnections.Store(nil)
 	if config.IsShared != 1 {
 		return nil
 	}
@@ -87,6 +91,8 @@ type NodeData struct {
 	Port  int         `json:"port"`
 	Proto string      `json:"proto"`
 	Key   *kms.Secret `json:"api_key"`
+	// Connections published by the node, if clustering is enabled
+	Connections *NodeConnections `json:"connections,omitempty"`
 }
 
 func (n *NodeData) validate() error {
@@ -116,6 +122,21 @@ func (n *NodeData) getNodeName() string {
 	return strconv.FormatUint(h.Sum64(), 10)
 }
 
+// NodeConnections defines the connection counters published by a cluster node.
+// They are used to enforce the connection limits cluster-wide
+type NodeConnections struct {
+	// Client connections, both authenticated and waiting for authentication
+	Clients int `json:"clients"`
+	// Established sessions
+	Sessions int `json:"sessions"`
+	// Client connections per host (IP)
+	Hosts map[string]int `json:"hosts,omitempty"`
+	// Sessions per user
+	Users map[string]int `json:"users,omitempty"`
+	// Last update as unix timestamp in milliseconds
+	UpdatedAt int64 `json:"updated_at"`
+}
+
 // Node defines a cluster node
 type Node struct {
 	Name      string   `json:"name"`
@@ -263,6 +284,35 @@ func (n *Node) SendDeleteRequest(username, role, relativeURL string) error {
 	return nil
 }
 
+// SendPutRequest sends an HTTP PUT request, with the JSON encoded body, to this node
+func (n *Node) SendPutRequest(username, role, relativeURL string, body any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), nodeReqTimeout)
+	defer cancel()
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := n.prepareRequest(ctx, username, role, relativeURL, http.MethodPut, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := httpclient.GetHTTPClient()
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to send HTTP PUT to node %s: %w", n.Name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusNoContent {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
 // AuthenticateNodeToken check the validity of the provided token
 func AuthenticateNodeToken(token string) (string, string, error) {
 	if currentNode == nil {
@@ -271,6 +321,24 @@ func AuthenticateNodeToken(token string) (string, string, error) {
 	return currentNode.authenticate(token)
 }
 
+// UpdateNodeConnections publishes the connection counters for the current node
+func UpdateNodeConnections(connections *NodeConnections) error {
+	if currentNode == nil {
+		return errNoClusterNodes
+	}
+	connections.UpdatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+	currentNodeConnections.Store(connections)
+	return provider.updateNodeConnections()
+}
+
+// getCurrentNodeData returns a copy of the current node data including
+// the last published connection counters
+func getCurrentNodeData() NodeData {
+	data := currentNode.Data
+	data.Connections = currentNodeConnections.Load()
+	return data
+}
+
 // GetNodeName returns the node name or an empty string
 func GetNodeName() string {
 	if currentNode == nil {
@@ -37,13 +37,15 @@ import (
 )
 
 const (
-	pgsqlResetSQL = `DROP TABLE IF EXISTS "{{api_keys}}" CASCADE;
+	pgsqlResetSQL = `DROP TABLE IF EXISTS "{{share_events}}" CASCADE;
+DROP TABLE IF EXISTS "{{api_keys}}" CASCADE;
 DROP TABLE IF EXISTS "{{folders_mapping}}" CASCADE;
 DROP TABLE IF EXISTS "{{users_folders_mapping}}" CASCADE;
 DROP TABLE IF EXISTS "{{users_groups_mapping}}" CASCADE;
 DROP TABLE IF EXISTS "{{admins_groups_mapping}}" CASCADE;
 DROP TABLE IF EXISTS "{{groups_folders_mapping}}" CASCADE;
 DROP TABLE IF EXISTS "{{admins}}" CASCADE;
+DROP TABLE IF EXISTS "{{admin_roles}}" CASCADE;
 DROP TABLE IF EXISTS "{{folders}}" CASCADE;
 DROP TABLE IF EXISTS "{{shares}}" CASCADE;
 DROP TABLE IF EXISTS "{{users}}" CASCADE;
@@ -60,6 +62,9 @@ DROP TABLE IF EXISTS "{{nodes}}" CASCADE;
 DROP TABLE IF EXISTS "{{roles}}" CASCADE;
 DROP TABLE IF EXISTS "{{ip_lists}}" CASCADE;
 DROP TABLE IF EXISTS "{{configs}}" CASCADE;
+DROP TABLE IF EXISTS "{{files_metadata}}" CASCADE;
+DROP TABLE IF EXISTS "{{events_digests}}" CASCADE;
+DROP TABLE IF EXISTS "{{audit_logs}}" CASCADE;
 DROP TABLE IF EXISTS "{{schema_version}}" CASCADE;
 `
 	pgsqlInitial = `CREATE TABLE "{{schema_version}}" ("id" serial NOT NULL PRIMARY KEY, "version" integer NOT NULL);
@@ -223,6 +228,73 @@ CREATE INDEX "{{prefix}}ip_lists_first_last_idx" ON "{{ip_lists}}" ("first", "la
 INSERT INTO {{configs}} (configs) VALUES ('{}');
 `
 	pgsqlV28DownSQL = `DROP TABLE "{{configs}}" CASCADE;`
+	pgsqlV29SQL     = `CREATE TABLE "{{files_metadata}}" ("id" bigserial NOT NULL PRIMARY KEY,
+"path" text NOT NULL, "path_hash" varchar(64) NOT NULL, "metadata" text NULL, "tags" text NULL,
+"updated_at" bigint NOT NULL, "user_id" integer NOT NULL,
+CONSTRAINT "{{prefix}}unique_files_metadata_path" UNIQUE ("user_id", "path_hash"));
+ALTER TABLE "{{files_metadata}}" ADD CONSTRAINT "{{prefix}}files_metadata_user_id_fk_users_id" FOREIGN KEY ("user_id")
+REFERENCES "{{users}}" ("id") MATCH SIMPLE ON UPDATE NO ACTION ON DELETE CASCADE;
+CREATE INDEX "{{prefix}}files_metadata_user_id_idx" ON "{{files_metadata}}" ("user_id");
+`
+	pgsqlV29DownSQL = `DROP TABLE "{{files_metadata}}" CASCADE;`
+	pgsqlV30SQL     = `CREATE TABLE "{{events_digests}}" ("id" bigserial NOT NULL PRIMARY KEY,
+"rule_name" varchar(255) NOT NULL, "action_name" varchar(255) NOT NULL, "name" varchar(255) NOT NULL,
+"window_end" bigint NOT NULL, "data" text NOT NULL, "created_at" bigint NOT NULL);
+CREATE INDEX "{{prefix}}events_digests_window_end_idx" ON "{{events_digests}}" ("window_end");
+`
+	pgsqlV30DownSQL = `DROP TABLE "{{events_digests}}" CASCADE;`
+	pgsqlV31SQL     = `CREATE TABLE "{{audit_logs}}" ("id" bigserial NOT NULL PRIMARY KEY,
+"created_at" bigint NOT NULL, "action" varchar(32) NOT NULL, "executor" varchar(255) NOT NULL,
+"ip" varchar(50) NOT NULL, "role" varchar(255) NOT NULL, "object_type" varchar(50) NOT NULL,
+"object_name" varchar(512) NOT NULL, "before_data" text NULL, "after_data" text NULL, "changes" text NULL);
+CREATE INDEX "{{prefix}}audit_logs_created_at_idx" ON "{{audit_logs}}" ("created_at");
+CREATE INDEX "{{prefix}}audit_logs_executor_idx" ON "{{audit_logs}}" ("executor");
+CREATE INDEX "{{prefix}}audit_logs_object_name_idx" ON "{{audit_logs}}" ("object_name");
+`
+	pgsqlV31DownSQL = `DROP TABLE "{{audit_logs}}" CASCADE;`
+	pgsqlV32SQL     = `ALTER TABLE "{{folders}}" ADD COLUMN "failover" text NULL;`
+	pgsqlV32DownSQL = `ALTER TABLE "{{folders}}" DROP COLUMN "failover" CASCADE;`
+	pgsqlV33SQL     = `ALTER TABLE "{{roles}}" ADD COLUMN "tenant" text NULL;`
+	pgsqlV33DownSQL = `ALTER TABLE "{{roles}}" DROP COLUMN "tenant" CASCADE;`
+	pgsqlV34SQL     = `ALTER TABLE "{{folders}}" ADD COLUMN "limits" text NULL;`
+	pgsqlV34DownSQL = `ALTER TABLE "{{folders}}" DROP COLUMN "limits" CASCADE;`
+	pgsqlV35SQL     = `ALTER TABLE "{{shares}}" ADD COLUMN "options" text NULL;`
+	pgsqlV35DownSQL = `ALTER TABLE "{{shares}}" DROP COLUMN "options" CASCADE;`
+	pgsqlV36SQL     = `CREATE TABLE "{{share_events}}" ("id" bigserial NOT NULL PRIMARY KEY,
+"share_id" varchar(60) NOT NULL, "created_at" bigint NOT NULL, "ip" varchar(50) NOT NULL,
+"user_agent" varchar(255) NOT NULL, "path" text NOT NULL, "size" bigint NOT NULL);
+ALTER TABLE "{{share_events}}" ADD CONSTRAINT "{{prefix}}share_events_share_id_fk_shares_share_id" FOREIGN KEY ("share_id")
+REFERENCES "{{shares}}" ("share_id") MATCH SIMPLE ON UPDATE NO ACTION ON DELETE CASCADE;
+CREATE INDEX "{{prefix}}share_events_share_id_created_at_idx" ON "{{share_events}}" ("share_id", "created_at");
+CREATE INDEX "{{prefix}}share_events_created_at_idx" ON "{{share_events}}" ("created_at");
+`
+	pgsqlV36DownSQL = `DROP TABLE "{{share_events}}" CASCADE;`
+	pgsqlV37SQL     = `CREATE TABLE "{{admin_roles}}" ("id" serial NOT NULL PRIMARY KEY, "name" varchar(255) NOT NULL UNIQUE,
+"description" varchar(512) NULL, "created_at" bigint NOT NULL, "updated_at" bigint NOT NULL,
+"permissions" text NOT NULL, "filters" text NULL);
+ALTER TABLE "{{admins}}" ADD COLUMN "admin_role_id" integer NULL CONSTRAINT "{{prefix}}admins_admin_role_id_fk_admin_roles_id"
+REFERENCES "{{admin_roles}}"("id") ON DELETE NO ACTION;
+CREATE INDEX "{{prefix}}admins_admin_role_id_idx" ON "{{admins}}" ("admin_role_id");
+`
+	pgsqlV37DownSQL = `ALTER TABLE "{{admins}}" DROP COLUMN "admin_role_id" CASCADE;
+DROP TABLE "{{admin_roles}}" CASCADE;
+`
+	pgsqlV38SQL = `ALTER TABLE "{{groups}}" ADD COLUMN "role_id" integer NULL CONSTRAINT "{{prefix}}groups_role_id_fk_roles_id"
+REFERENCES "{{roles}}"("id") ON DELETE NO ACTION;
+ALTER TABLE "{{folders}}" ADD COLUMN "role_id" integer NULL CONSTRAINT "{{prefix}}folders_role_id_fk_roles_id"
+REFERENCES "{{roles}}"("id") ON DELETE NO ACTION;
+ALTER TABLE "{{events_rules}}" ADD COLUMN "role_id" integer NULL CONSTRAINT "{{prefix}}events_rules_role_id_fk_roles_id"
+REFERENCES "{{roles}}"("id") ON DELETE NO ACTION;
+CREATE INDEX "{{prefix}}groups_role_id_idx" ON "{{groups}}" ("role_id");
+CREATE INDEX "{{prefix}}folders_role_id_idx" ON "{{folders}}" ("role_id");
+CREATE INDEX "{{prefix}}events_rules_role_id_idx" ON "{{events_rules}}" ("role_id");
+`
+	pgsqlV38DownSQL = `ALTER TABLE "{{events_rules}}" DROP COLUMN "role_id" CASCADE;
+ALTER TABLE "{{folders}}" DROP COLUMN "role_id" CASCADE;
+ALTER TABLE "{{groups}}" DROP COLUMN "role_id" CASCADE;
+`
+	pgsqlV39SQL     = `ALTER TABLE "{{api_keys}}" ADD COLUMN "filters" text NULL;`
+	pgsqlV39DownSQL = `ALTER TABLE "{{api_keys}}" DROP COLUMN "filters" CASCADE;`
 )
 
 // PGSQLProvider defines the auth provider for PostgreSQL database
@@ -236,14 +308,14 @@ func init() {
 
 func initializePGSQLProvider() error {
 	var dbHandle *sql.DB
-	if config.TargetSessionAttrs == "any" {
+	if config.TargetSessionAttrs == "any" || config.ConnectionString == "" {
 		pgxConfig, err := pgx.ParseConfig(getPGSQLConnectionString(false))
 		if err != nil {
 			providerLog(logger.LevelError, "error parsing postgres configuration, connection string: %q, error: %v",
 				getPGSQLConnectionString(true), err)
 			return err
 		}
-		dbHandle = stdlib.OpenDB(*pgxConfig, stdlib.OptionBeforeConnect(stdlib.RandomizeHostOrderFunc))
+		dbHandle = stdlib.OpenDB(*pgxConfig, stdlib.OptionBeforeConnect(pgsqlBeforeConnect))
 	} else {
 		var err error
 		dbHandle, err = sql.Open("pgx", getPGSQLConnectionString(false))
@@ -271,6 +343,18 @@ func initializePGSQLProvider() error {
 	return dbHandle.PingContext(ctx)
 }
 
+// pgsqlBeforeConnect sets the current password, it may change at runtime,
+// for new connections
+func pgsqlBeforeConnect(ctx context.Context, connConfig *pgx.ConnConfig) error {
+	if config.ConnectionString == "" {
+		connConfig.Password = getProviderPassword()
+	}
+	if config.TargetSessionAttrs == "any" {
+		return stdlib.RandomizeHostOrderFunc(ctx, connConfig)
+	}
+	return nil
+}
+
 func getPGSQLHostsAndPorts(configHost string, configPort int) (string, string) {
 	var hosts, ports []string
 	defaultPort := strconv.Itoa(configPort)
@@ -328,8 +412,8 @@ func (p *PGSQLProvider) checkAvailability() error {
 	return sqlCommonCheckAvailability(p.dbHandle)
 }
 
-func (p *PGSQLProvider) validateUserAndPass(username, password, ip, protocol string) (User, error) {
-	return sqlCommonValidateUserAndPass(username, password, ip, protocol, p.dbHandle)
+func (p *PGSQLProvider) validateUserAndPass(ctx context.Context, username, password, ip, protocol string) (User, error) {
+	return sqlCommonValidateUserAndPass(ctx, username, password, ip, protocol, p.dbHandle)
 }
 
 func (p *PGSQLProvider) validateUserAndTLSCert(username, protocol string, tlsCert *x509.Certificate) (User, error) {
@@ -404,8 +488,8 @@ func (p *PGSQLProvider) dumpFolders() ([]vfs.BaseVirtualFolder, error) {
 	return sqlCommonDumpFolders(p.dbHandle)
 }
 
-func (p *PGSQLProvider) getFolders(limit, offset int, order string, minimal bool) ([]vfs.BaseVirtualFolder, error) {
-	return sqlCommonGetFolders(limit, offset, order, minimal, p.dbHandle)
+func (p *PGSQLProvider) getFolders(limit, offset int, order string, minimal bool, role string) ([]vfs.BaseVirtualFolder, error) {
+	return sqlCommonGetFolders(limit, offset, order, minimal, role, p.dbHandle)
 }
 
 func (p *PGSQLProvider) getFolderByName(name string) (vfs.BaseVirtualFolder, error) {
@@ -434,8 +518,8 @@ func (p *PGSQLProvider) getUsedFolderQuota(name string) (int, int64, error) {
 	return sqlCommonGetFolderUsedQuota(name, p.dbHandle)
 }
 
-func (p *PGSQLProvider) getGroups(limit, offset int, order string, minimal bool) ([]Group, error) {
-	return sqlCommonGetGroups(limit, offset, order, minimal, p.dbHandle)
+func (p *PGSQLProvider) getGroups(limit, offset int, order string, minimal bool, role string) ([]Group, error) {
+	return sqlCommonGetGroups(limit, offset, order, minimal, role, p.dbHandle)
 }
 
 func (p *PGSQLProvider) getGroupsWithNames(names []string) ([]Group, error) {
@@ -506,6 +590,10 @@ func (p *PGSQLProvider) updateAPIKey(apiKey *APIKey) error {
 	return sqlCommonUpdateAPIKey(apiKey, p.dbHandle)
 }
 
+func (p *PGSQLProvider) rotateAPIKey(apiKey *APIKey) error {
+	return sqlCommonRotateAPIKey(apiKey, p.dbHandle)
+}
+
 func (p *PGSQLProvider) deleteAPIKey(apiKey APIKey) error {
 	return sqlCommonDeleteAPIKey(apiKey, p.dbHandle)
 }
@@ -618,6 +706,10 @@ func (p *PGSQLProvider) cleanupSharedSessions(sessionType SessionType, before in
 	return sqlCommonCleanupSessions(sessionType, before, p.dbHandle)
 }
 
+func (p *PGSQLProvider) getSharedSessions(sessionType SessionType, after int64) ([]Session, error) {
+	return sqlCommonGetSessions(sessionType, after, p.dbHandle)
+}
+
 func (p *PGSQLProvider) getEventActions(limit, offset int, order string, minimal bool) ([]BaseEventAction, error) {
 	return sqlCommonGetEventActions(limit, offset, order, minimal, p.dbHandle)
 }
@@ -642,8 +734,8 @@ func (p *PGSQLProvider) deleteEventAction(action BaseEventAction) error {
 	return sqlCommonDeleteEventAction(action, p.dbHandle)
 }
 
-func (p *PGSQLProvider) getEventRules(limit, offset int, order string) ([]EventRule, error) {
-	return sqlCommonGetEventRules(limit, offset, order, p.dbHandle)
+func (p *PGSQLProvider) getEventRules(limit, offset int, order, role string) ([]EventRule, error) {
+	return sqlCommonGetEventRules(limit, offset, order, role, p.dbHandle)
 }
 
 func (p *PGSQLProvider) dumpEventRules() ([]EventRule, error) {
@@ -702,6 +794,10 @@ func (p *PGSQLProvider) updateNodeTimestamp() error {
 	return sqlCommonUpdateNodeTimestamp(p.dbHandle)
 }
 
+func (p *PGSQLProvider) updateNodeConnections() error {
+	return sqlCommonUpdateNodeData(p.dbHandle)
+}
+
 func (p *PGSQLProvider) cleanupNodes() error {
 	return sqlCommonCleanupNodes(p.dbHandle)
 }
@@ -730,6 +826,30 @@ func (p *PGSQLProvider) dumpRoles() ([]Role, error) {
 	return sqlCommonDumpRoles(p.dbHandle)
 }
 
+func (p *PGSQLProvider) adminRoleExists(name string) (AdminRole, error) {
+	return sqlCommonGetAdminRoleByName(name, p.dbHandle)
+}
+
+func (p *PGSQLProvider) addAdminRole(role *AdminRole) error {
+	return sqlCommonAddAdminRole(role, p.dbHandle)
+}
+
+func (p *PGSQLProvider) updateAdminRole(role *AdminRole) error {
+	return sqlCommonUpdateAdminRole(role, p.dbHandle)
+}
+
+func (p *PGSQLProvider) deleteAdminRole(role AdminRole) error {
+	return sqlCommonDeleteAdminRole(role, p.dbHandle)
+}
+
+func (p *PGSQLProvider) getAdminRoles(limit int, offset int, order string, minimal bool) ([]AdminRole, error) {
+	return sqlCommonGetAdminRoles(limit, offset, order, minimal, p.dbHandle)
+}
+
+func (p *PGSQLProvider) dumpAdminRoles() ([]AdminRole, error) {
+	return sqlCommonDumpAdminRoles(p.dbHandle)
+}
+
 func (p *PGSQLProvider) ipListEntryExists(ipOrNet string, listType IPListType) (IPListEntry, error) {
 	return sqlCommonGetIPListEntry(ipOrNet, listType, p.dbHandle)
 }
@@ -774,6 +894,62 @@ func (p *PGSQLProvider) setConfigs(configs *Configs) error {
 	return sqlCommonSetConfigs(configs, p.dbHandle)
 }
 
+func (p *PGSQLProvider) getFileMetadata(username, virtualPath string) (FileMetadata, error) {
+	return sqlCommonGetFileMetadata(username, virtualPath, p.dbHandle)
+}
+
+func (p *PGSQLProvider) getFilesMetadata(username, virtualPath string) ([]FileMetadata, error) {
+	return sqlCommonGetFilesMetadata(username, virtualPath, p.dbHandle)
+}
+
+func (p *PGSQLProvider) setFileMetadata(username string, metadata *FileMetadata) error {
+	return sqlCommonSetFileMetadata(username, metadata, p.dbHandle)
+}
+
+func (p *PGSQLProvider) deleteFilesMetadata(username, virtualPath string, recursive bool) error {
+	return sqlCommonDeleteFilesMetadata(username, virtualPath, recursive, p.dbHandle)
+}
+
+func (p *PGSQLProvider) renameFilesMetadata(username, source, target string) error {
+	return sqlCommonRenameFilesMetadata(username, source, target, p.dbHandle)
+}
+
+func (p *PGSQLProvider) addEventDigestEntry(entry *EventDigestEntry) error {
+	return sqlCommonAddEventDigestEntry(entry, p.dbHandle)
+}
+
+func (p *PGSQLProvider) getEventDigestEntries(before int64) ([]EventDigestEntry, error) {
+	return sqlCommonGetEventDigestEntries(before, p.dbHandle)
+}
+
+func (p *PGSQLProvider) deleteEventDigestEntries(ids []int64) error {
+	return sqlCommonDeleteEventDigestEntries(ids, p.dbHandle)
+}
+
+func (p *PGSQLProvider) addAuditLogEntry(entry *AuditLogEntry) error {
+	return sqlCommonAddAuditLogEntry(entry, p.dbHandle)
+}
+
+func (p *PGSQLProvider) searchAuditLog(filters *AuditLogSearch) ([]AuditLogEntry, error) {
+	return sqlCommonSearchAuditLog(filters, p.dbHandle)
+}
+
+func (p *PGSQLProvider) cleanupAuditLog(before int64) error {
+	return sqlCommonCleanupAuditLog(before, p.dbHandle)
+}
+
+func (p *PGSQLProvider) addShareEvent(event *ShareEvent) error {
+	return sqlCommonAddShareEvent(event, p.dbHandle)
+}
+
+func (p *PGSQLProvider) getShareEvents(shareID string, from, to int64, limit int) ([]ShareEvent, error) {
+	return sqlCommonGetShareEvents(shareID, from, to, limit, p.dbHandle)
+}
+
+func (p *PGSQLProvider) cleanupShareEvents(before int64) error {
+	return sqlCommonCleanupShareEvents(before, p.dbHandle)
+}
+
 func (p *PGSQLProvider) setFirstDownloadTimestamp(username string) error {
 	return sqlCommonSetFirstDownloadTimestamp(username, p.dbHandle)
 }
@@ -790,6 +966,26 @@ func (p *PGSQLProvider) reloadConfig() error {
 	return nil
 }
 
+func (p *PGSQLProvider) resetSequences() error {
+	if config.Driver == CockroachDataProviderName {
+		// CockroachDB uses unique_rowid() for serial columns
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), longSQLQueryTimeout)
+	defer cancel()
+
+	for _, table := range []string{sqlTableRoles, sqlTableAdminRoles, sqlTableIPLists, sqlTableFolders, sqlTableGroups, sqlTableUsers,
+		sqlTableAdmins, sqlTableAPIKeys, sqlTableShares, sqlTableEventsActions, sqlTableEventsRules} {
+		q := fmt.Sprintf(`SELECT setval(pg_get_serial_sequence('"%s"', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM "%s"`,
+			table, table)
+		if _, err := p.dbHandle.ExecContext(ctx, q); err != nil {
+			return fmt.Errorf("unable to reset the sequence for table %q: %w", table, err)
+		}
+		providerLog(logger.LevelDebug, "sequence reset for table %q", table)
+	}
+	return nil
+}
+
 // initializeDatabase creates the initial database structure
 func (p *PGSQLProvider) initializeDatabase() error {
 	dbVersion, err := sqlCommonGetDatabaseVersion(p.dbHandle, false)
@@ -831,6 +1027,28 @@ func (p *PGSQLProvider) migrateDatabase() error { //nolint:dupl
 		return updatePgSQLDatabaseFromV26(p.dbHandle)
 	case version == 27:
 		return updatePgSQLDatabaseFromV27(p.dbHandle)
+	case version == 28:
+		return updatePgSQLDatabaseFromV28(p.dbHandle)
+	case version == 29:
+		return updatePgSQLDatabaseFromV29(p.dbHandle)
+	case version == 30:
+		return updatePgSQLDatabaseFromV30(p.dbHandle)
+	case version == 31:
+		return updatePgSQLDatabaseFromV31(p.dbHandle)
+	case version == 32:
+		return updatePgSQLDatabaseFromV32(p.dbHandle)
+	case version == 33:
+		return updatePgSQLDatabaseFromV33(p.dbHandle)
+	case version == 34:
+		return updatePgSQLDatabaseFromV34(p.dbHandle)
+	case version == 35:
+		return updatePgSQLDatabaseFromV35(p.dbHandle)
+	case version == 36:
+		return updatePgSQLDatabaseFromV36(p.dbHandle)
+	case version == 37:
+		return updatePgSQLDatabaseFromV37(p.dbHandle)
+	case version == 38:
+		return updatePgSQLDatabaseFromV38(p.dbHandle)
 	default:
 		if version > sqlDatabaseVersion {
 			providerLog(logger.LevelError, "database schema version %d is newer than the supported one: %d", version,
@@ -863,6 +1081,28 @@ func (p *PGSQLProvider) revertDatabase(targetVersion int) error {
 		return downgradePgSQLDatabaseFromV27(p.dbHandle)
 	case 28:
 		return downgradePgSQLDatabaseFromV28(p.dbHandle)
+	case 29:
+		return downgradePgSQLDatabaseFromV29(p.dbHandle)
+	case 30:
+		return downgradePgSQLDatabaseFromV30(p.dbHandle)
+	case 31:
+		return downgradePgSQLDatabaseFromV31(p.dbHandle)
+	case 32:
+		return downgradePgSQLDatabaseFromV32(p.dbHandle)
+	case 33:
+		return downgradePgSQLDatabaseFromV33(p.dbHandle)
+	case 34:
+		return downgradePgSQLDatabaseFromV34(p.dbHandle)
+	case 35:
+		return downgradePgSQLDatabaseFromV35(p.dbHandle)
+	case 36:
+		return downgradePgSQLDatabaseFromV36(p.dbHandle)
+	case 37:
+		return downgradePgSQLDatabaseFromV37(p.dbHandle)
+	case 38:
+		return downgradePgSQLDatabaseFromV38(p.dbHandle)
+	case 39:
+		return downgradePgSQLDatabaseFromV39(p.dbHandle)
 	default:
 		return fmt.Errorf("database schema version not handled: %d", dbVersion.Version)
 	}
@@ -902,7 +1142,84 @@ func updatePgSQLDatabaseFromV26(dbHandle *sql.DB) error {
 }
 
 func updatePgSQLDatabaseFromV27(dbHandle *sql.DB) error {
-	return updatePgSQLDatabaseFrom27To28(dbHandle)
+	if err := updatePgSQLDatabaseFrom27To28(dbHandle); err != nil {
+		return err
+	}
+	return updatePgSQLDatabaseFromV28(dbHandle)
+}
+
+func updatePgSQLDatabaseFromV28(dbHandle *sql.DB) error {
+	if err := updatePgSQLDatabaseFrom28To29(dbHandle); err != nil {
+		return err
+	}
+	return updatePgSQLDatabaseFromV29(dbHandle)
+}
+
+func updatePgSQLDatabaseFromV29(dbHandle *sql.DB) error {
+	if err := updatePgSQLDatabaseFrom29To30(dbHandle); err != nil {
+		return err
+	}
+	return updatePgSQLDatabaseFromV30(dbHandle)
+}
+
+func updatePgSQLDatabaseFromV30(dbHandle *sql.DB) error {
+	if err := updatePgSQLDatabaseFrom30To31(dbHandle); err != nil {
+		return err
+	}
+	return updatePgSQLDatabaseFromV31(dbHandle)
+}
+
+func updatePgSQLDatabaseFromV31(dbHandle *sql.DB) error {
+	if err := updatePgSQLDatabaseFrom31To32(dbHandle); err != nil {
+		return err
+	}
+	return updatePgSQLDatabaseFromV32(dbHandle)
+}
+
+func updatePgSQLDatabaseFromV32(dbHandle *sql.DB) error {
+	if err := updatePgSQLDatabaseFrom32To33(dbHandle); err != nil {
+		return err
+	}
+	return updatePgSQLDatabaseFromV33(dbHandle)
+}
+
+func updatePgSQLDatabaseFromV33(dbHandle *sql.DB) error {
+	if err := updatePgSQLDatabaseFrom33To34(dbHandle); err != nil {
+		return err
+	}
+	return updatePgSQLDatabaseFromV34(dbHandle)
+}
+
+func updatePgSQLDatabaseFromV34(dbHandle *sql.DB) error {
+	if err := updatePgSQLDatabaseFrom34To35(dbHandle); err != nil {
+		return err
+	}
+	return updatePgSQLDatabaseFromV35(dbHandle)
+}
+
+func updatePgSQLDatabaseFromV35(dbHandle *sql.DB) error {
+	if err := updatePgSQLDatabaseFrom35To36(dbHandle); err != nil {
+		return err
+	}
+	return updatePgSQLDatabaseFromV36(dbHandle)
+}
+
+func updatePgSQLDatabaseFromV36(dbHandle *sql.DB) error {
+	if err := updatePgSQLDatabaseFrom36To37(dbHandle); err != nil {
+		return err
+	}
+	return updatePgSQLDatabaseFromV37(dbHandle)
+}
+
+func updatePgSQLDatabaseFromV37(dbHandle *sql.DB) error {
+	if err := updatePgSQLDatabaseFrom37To38(dbHandle); err != nil {
+		return err
+	}
+	return updatePgSQLDatabaseFromV38(dbHandle)
+}
+
+func updatePgSQLDatabaseFromV38(dbHandle *sql.DB) error {
+	return updatePgSQLDatabaseFrom38To39(dbHandle)
 }
 
 func downgradePgSQLDatabaseFromV24(dbHandle *sql.DB) error {
@@ -937,6 +1254,83 @@ func downgradePgSQLDatabaseFromV28(dbHandle *sql.DB) error {
 	return downgradePgSQLDatabaseFromV27(dbHandle)
 }
 
+func downgradePgSQLDatabaseFromV29(dbHandle *sql.DB) error {
+	if err := downgradePgSQLDatabaseFrom29To28(dbHandle); err != nil {
+		return err
+	}
+	return downgradePgSQLDatabaseFromV28(dbHandle)
+}
+
+func downgradePgSQLDatabaseFromV30(dbHandle *sql.DB) error {
+	if err := downgradePgSQLDatabaseFrom30To29(dbHandle); err != nil {
+		return err
+	}
+	return downgradePgSQLDatabaseFromV29(dbHandle)
+}
+
+func downgradePgSQLDatabaseFromV31(dbHandle *sql.DB) error {
+	if err := downgradePgSQLDatabaseFrom31To30(dbHandle); err != nil {
+		return err
+	}
+	return downgradePgSQLDatabaseFromV30(dbHandle)
+}
+
+func downgradePgSQLDatabaseFromV32(dbHandle *sql.DB) error {
+	if err := downgradePgSQLDatabaseFrom32To31(dbHandle); err != nil {
+		return err
+	}
+	return downgradePgSQLDatabaseFromV31(dbHandle)
+}
+
+func downgradePgSQLDatabaseFromV33(dbHandle *sql.DB) error {
+	if err := downgradePgSQLDatabaseFrom33To32(dbHandle); err != nil {
+		return err
+	}
+	return downgradePgSQLDatabaseFromV32(dbHandle)
+}
+
+func downgradePgSQLDatabaseFromV34(dbHandle *sql.DB) error {
+	if err := downgradePgSQLDatabaseFrom34To33(dbHandle); err != nil {
+		return err
+	}
+	return downgradePgSQLDatabaseFromV33(dbHandle)
+}
+
+func downgradePgSQLDatabaseFromV35(dbHandle *sql.DB) error {
+	if err := downgradePgSQLDatabaseFrom35To34(dbHandle); err != nil {
+		return err
+	}
+	return downgradePgSQLDatabaseFromV34(dbHandle)
+}
+
+func downgradePgSQLDatabaseFromV36(dbHandle *sql.DB) error {
+	if err := downgradePgSQLDatabaseFrom36To35(dbHandle); err != nil {
+		return err
+	}
+	return downgradePgSQLDatabaseFromV35(dbHandle)
+}
+
+func downgradePgSQLDatabaseFromV37(dbHandle *sql.DB) error {
+	if err := downgradePgSQLDatabaseFrom37To36(dbHandle); err != nil {
+		return err
+	}
+	return downgradePgSQLDatabaseFromV36(dbHandle)
+}
+
+func downgradePgSQLDatabaseFromV38(dbHandle *sql.DB) error {
+	if err := downgradePgSQLDatabaseFrom38To37(dbHandle); err != nil {
+		return err
+	}
+	return downgradePgSQLDatabaseFromV37(dbHandle)
+}
+
+func downgradePgSQLDatabaseFromV39(dbHandle *sql.DB) error {
+	if err := downgradePgSQLDatabaseFrom39To38(dbHandle); err != nil {
+		return err
+	}
+	return downgradePgSQLDatabaseFromV38(dbHandle)
+}
+
 func updatePgSQLDatabaseFrom23To24(dbHandle *sql.DB) error {
 	logger.InfoToConsole("updating database schema version: 23 -> 24")
 	providerLog(logger.LevelInfo, "updating database schema version: 23 -> 24")
@@ -988,6 +1382,95 @@ func updatePgSQLDatabaseFrom27To28(dbHandle *sql.DB) error {
 	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 28, true)
 }
 
+func updatePgSQLDatabaseFrom28To29(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 28 -> 29")
+	providerLog(logger.LevelInfo, "updating database schema version: 28 -> 29")
+	sql := strings.ReplaceAll(pgsqlV29SQL, "{{files_metadata}}", sqlTableFilesMetadata)
+	sql = strings.ReplaceAll(sql, "{{users}}", sqlTableUsers)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 29, true)
+}
+
+func updatePgSQLDatabaseFrom29To30(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 29 -> 30")
+	providerLog(logger.LevelInfo, "updating database schema version: 29 -> 30")
+	sql := strings.ReplaceAll(pgsqlV30SQL, "{{events_digests}}", sqlTableEventsDigests)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 30, true)
+}
+
+func updatePgSQLDatabaseFrom30To31(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 30 -> 31")
+	providerLog(logger.LevelInfo, "updating database schema version: 30 -> 31")
+	sql := strings.ReplaceAll(pgsqlV31SQL, "{{audit_logs}}", sqlTableAuditLogs)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 31, true)
+}
+
+func updatePgSQLDatabaseFrom31To32(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 31 -> 32")
+	providerLog(logger.LevelInfo, "updating database schema version: 31 -> 32")
+	sql := strings.ReplaceAll(pgsqlV32SQL, "{{folders}}", sqlTableFolders)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 32, true)
+}
+
+func updatePgSQLDatabaseFrom32To33(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 32 -> 33")
+	providerLog(logger.LevelInfo, "updating database schema version: 32 -> 33")
+	sql := strings.ReplaceAll(pgsqlV33SQL, "{{roles}}", sqlTableRoles)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 33, true)
+}
+
+func updatePgSQLDatabaseFrom33To34(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 33 -> 34")
+	providerLog(logger.LevelInfo, "updating database schema version: 33 -> 34")
+	sql := strings.ReplaceAll(pgsqlV34SQL, "{{folders}}", sqlTableFolders)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 34, true)
+}
+
+func updatePgSQLDatabaseFrom34To35(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 34 -> 35")
+	providerLog(logger.LevelInfo, "updating database schema version: 34 -> 35")
+	sql := strings.ReplaceAll(pgsqlV35SQL, "{{shares}}", sqlTableShares)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 35, true)
+}
+
+func updatePgSQLDatabaseFrom35To36(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 35 -> 36")
+	providerLog(logger.LevelInfo, "updating database schema version: 35 -> 36")
+	sql := strings.ReplaceAll(pgsqlV36SQL, "{{share_events}}", sqlTableShareEvents)
+	sql = strings.ReplaceAll(sql, "{{shares}}", sqlTableShares)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 36, true)
+}
+
+func updatePgSQLDatabaseFrom36To37(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 36 -> 37")
+	providerLog(logger.LevelInfo, "updating database schema version: 36 -> 37")
+	sql := strings.ReplaceAll(pgsqlV37SQL, "{{admin_roles}}", sqlTableAdminRoles)
+	sql = strings.ReplaceAll(sql, "{{admins}}", sqlTableAdmins)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 37, true)
+}
+
+func updatePgSQLDatabaseFrom37To38(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 37 -> 38")
+	providerLog(logger.LevelInfo, "updating database schema version: 37 -> 38")
+	sql := strings.ReplaceAll(pgsqlV38SQL, "{{groups}}", sqlTableGroups)
+	sql = strings.ReplaceAll(sql, "{{folders}}", sqlTableFolders)
+	sql = strings.ReplaceAll(sql, "{{events_rules}}", sqlTableEventsRules)
+	sql = strings.ReplaceAll(sql, "{{roles}}", sqlTableRoles)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 38, true)
+}
+
+func updatePgSQLDatabaseFrom38To39(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 38 -> 39")
+	providerLog(logger.LevelInfo, "updating database schema version: 38 -> 39")
+	sql := strings.ReplaceAll(pgsqlV39SQL, "{{api_keys}}", sqlTableAPIKeys)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 39, true)
+}
+
 func downgradePgSQLDatabaseFrom24To23(dbHandle *sql.DB) error {
 	logger.InfoToConsole("downgrading database schema version: 24 -> 23")
 	providerLog(logger.LevelInfo, "downgrading database schema version: 24 -> 23")
@@ -1025,3 +1508,83 @@ func downgradePgSQLDatabaseFrom28To27(dbHandle *sql.DB) error {
 	sql := strings.ReplaceAll(pgsqlV28DownSQL, "{{configs}}", sqlTableConfigs)
 	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 27, false)
 }
+
+func downgradePgSQLDatabaseFrom29To28(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 29 -> 28")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 29 -> 28")
+	sql := strings.ReplaceAll(pgsqlV29DownSQL, "{{files_metadata}}", sqlTableFilesMetadata)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 28, false)
+}
+
+func downgradePgSQLDatabaseFrom30To29(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 30 -> 29")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 30 -> 29")
+	sql := strings.ReplaceAll(pgsqlV30DownSQL, "{{events_digests}}", sqlTableEventsDigests)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 29, false)
+}
+
+func downgradePgSQLDatabaseFrom31To30(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 31 -> 30")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 31 -> 30")
+	sql := strings.ReplaceAll(pgsqlV31DownSQL, "{{audit_logs}}", sqlTableAuditLogs)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 30, false)
+}
+
+func downgradePgSQLDatabaseFrom32To31(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 32 -> 31")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 32 -> 31")
+	sql := strings.ReplaceAll(pgsqlV32DownSQL, "{{folders}}", sqlTableFolders)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 31, false)
+}
+
+func downgradePgSQLDatabaseFrom33To32(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 33 -> 32")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 33 -> 32")
+	sql := strings.ReplaceAll(pgsqlV33DownSQL, "{{roles}}", sqlTableRoles)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 32, false)
+}
+
+func downgradePgSQLDatabaseFrom34To33(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 34 -> 33")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 34 -> 33")
+	sql := strings.ReplaceAll(pgsqlV34DownSQL, "{{folders}}", sqlTableFolders)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 33, false)
+}
+
+func downgradePgSQLDatabaseFrom35To34(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 35 -> 34")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 35 -> 34")
+	sql := strings.ReplaceAll(pgsqlV35DownSQL, "{{shares}}", sqlTableShares)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 34, false)
+}
+
+func downgradePgSQLDatabaseFrom36To35(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 36 -> 35")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 36 -> 35")
+	sql := strings.ReplaceAll(pgsqlV36DownSQL, "{{share_events}}", sqlTableShareEvents)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 35, false)
+}
+
+func downgradePgSQLDatabaseFrom37To36(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 37 -> 36")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 37 -> 36")
+	sql := strings.ReplaceAll(pgsqlV37DownSQL, "{{admin_roles}}", sqlTableAdminRoles)
+	sql = strings.ReplaceAll(sql, "{{admins}}", sqlTableAdmins)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 36, false)
+}
+
+func downgradePgSQLDatabaseFrom38To37(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 38 -> 37")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 38 -> 37")
+	sql := strings.ReplaceAll(pgsqlV38DownSQL, "{{groups}}", sqlTableGroups)
+	sql = strings.ReplaceAll(sql, "{{folders}}", sqlTableFolders)
+	sql = strings.ReplaceAll(sql, "{{events_rules}}", sqlTableEventsRules)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 37, false)
+}
+
+func downgradePgSQLDatabaseFrom39To38(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 39 -> 38")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 39 -> 38")
+	sql := strings.ReplaceAll(pgsqlV39DownSQL, "{{api_keys}}", sqlTableAPIKeys)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 38, false)
+}
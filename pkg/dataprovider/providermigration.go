@@ -0,0 +1,190 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"fmt"
+	"sort"
+)
+
+// MigrationSummary defines the result of a data migration between
+// two providers for a given object type
+type MigrationSummary struct {
+	// Object type, for example "users"
+	Object string
+	// Number of objects in the source provider
+	Source int
+	// Number of objects in the target provider
+	Target int
+	// Objects available in the source provider and missing in the target one
+	Missing []string
+	// Objects available in the target provider and not in the source one
+	Unexpected []string
+}
+
+// IsValid returns true if the target provider contains exactly the same
+// objects as the source one
+func (s *MigrationSummary) IsValid() bool {
+	return len(s.Missing) == 0 && len(s.Unexpected) == 0
+}
+
+// sequencesResetter is implemented by the providers that need to
+// reset their sequences after a data migration
+type sequencesResetter interface {
+	resetSequences() error
+}
+
+type dumpObjects struct {
+	name string
+	keys func(*BackupData) []string
+}
+
+var migrationObjects = []dumpObjects{
+	{name: "roles", keys: func(d *BackupData) []string {
+		keys := make([]string, 0, len(d.Roles))
+		for _, role := range d.Roles {
+			keys = append(keys, role.Name)
+		}
+		return keys
+	}},
+	{name: "admin roles", keys: func(d *BackupData) []string {
+		keys := make([]string, 0, len(d.AdminRoles))
+		for _, role := range d.AdminRoles {
+			keys = append(keys, role.Name)
+		}
+		return keys
+	}},
+	{name: "ip list entries", keys: func(d *BackupData) []string {
+		keys := make([]string, 0, len(d.IPLists))
+		for _, entry := range d.IPLists {
+			keys = append(keys, fmt.Sprintf("%s (%s)", entry.IPOrNet, entry.Type.AsString()))
+		}
+		return keys
+	}},
+	{name: "folders", keys: func(d *BackupData) []string {
+		keys := make([]string, 0, len(d.Folders))
+		for _, folder := range d.Folders {
+			keys = append(keys, folder.Name)
+		}
+		return keys
+	}},
+	{name: "groups", keys: func(d *BackupData) []string {
+		keys := make([]string, 0, len(d.Groups))
+		for _, group := range d.Groups {
+			keys = append(keys, group.Name)
+		}
+		return keys
+	}},
+	{name: "users", keys: func(d *BackupData) []string {
+		keys := make([]string, 0, len(d.Users))
+		for _, user := range d.Users {
+			keys = append(keys, user.Username)
+		}
+		return keys
+	}},
+	{name: "admins", keys: func(d *BackupData) []string {
+		keys := make([]string, 0, len(d.Admins))
+		for _, admin := range d.Admins {
+			keys = append(keys, admin.Username)
+		}
+		return keys
+	}},
+	{name: "API keys", keys: func(d *BackupData) []string {
+		keys := make([]string, 0, len(d.APIKeys))
+		for _, apiKey := range d.APIKeys {
+			keys = append(keys, apiKey.KeyID)
+		}
+		return keys
+	}},
+	{name: "shares", keys: func(d *BackupData) []string {
+		keys := make([]string, 0, len(d.Shares))
+		for _, share := range d.Shares {
+			keys = append(keys, share.ShareID)
+		}
+		return keys
+	}},
+	{name: "event actions", keys: func(d *BackupData) []string {
+		keys := make([]string, 0, len(d.EventActions))
+		for _, action := range d.EventActions {
+			keys = append(keys, action.Name)
+		}
+		return keys
+	}},
+	{name: "event rules", keys: func(d *BackupData) []string {
+		keys := make([]string, 0, len(d.EventRules))
+		for _, rule := range d.EventRules {
+			keys = append(keys, rule.Name)
+		}
+		return keys
+	}},
+}
+
+func getKeysDiff(keys []string, other map[string]bool) []string {
+	var result []string
+	for _, key := range keys {
+		if !other[key] {
+			result = append(result, key)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func getKeysMap(keys []string) map[string]bool {
+	result := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		result[key] = true
+	}
+	return result
+}
+
+// CompareDumps compares the dumps taken from the source and target providers
+// of a data migration and returns a summary for each object type
+func CompareDumps(source, target *BackupData) []MigrationSummary {
+	result := make([]MigrationSummary, 0, len(migrationObjects))
+	for _, obj := range migrationObjects {
+		sourceKeys := obj.keys(source)
+		targetKeys := obj.keys(target)
+		result = append(result, MigrationSummary{
+			Object:     obj.name,
+			Source:     len(sourceKeys),
+			Target:     len(targetKeys),
+			Missing:    getKeysDiff(sourceKeys, getKeysMap(targetKeys)),
+			Unexpected: getKeysDiff(targetKeys, getKeysMap(sourceKeys)),
+		})
+	}
+	return result
+}
+
+// HasObjects returns true if the dump contains at least an object
+// of the types copied by a data migration
+func (d *BackupData) HasObjects() bool {
+	for _, obj := range migrationObjects {
+		if len(obj.keys(d)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ResetSequences sets the sequences used to generate the objects IDs to the
+// maximum used value. This is only required for PostgreSQL, the other
+// providers compute the next ID from the existing rows
+func ResetSequences() error {
+	if p, ok := provider.(sequencesResetter); ok {
+		return p.resetSequences()
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// RetentionPolicy defines a data retention check executed on a schedule
+type RetentionPolicy struct {
+	// Unique name
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// 1 enabled, 0 disabled
+	Status int `json:"status"`
+	// Standard cron expression with 5 fields: minute, hour, day of month,
+	// month, day of week. The schedule is evaluated in UTC
+	Schedule string `json:"schedule"`
+	// The policy applies to these users and to the members of these groups
+	Users  []string `json:"users,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	// Virtual paths to check and their retention
+	Folders []FolderRetention `json:"folders"`
+	// If enabled the files are not deleted, the run report lists the files
+	// that would be deleted
+	DryRun bool `json:"dry_run,omitempty"`
+	// Email recipients for the summary after each run
+	Emails []string `json:"emails,omitempty"`
+	// HTTP/HTTPS URL to which the summary is sent, as JSON, after each run
+	WebhookURL string `json:"webhook_url,omitempty"`
+	CreatedAt  int64  `json:"created_at"`
+	UpdatedAt  int64  `json:"updated_at"`
+}
+
+// GetCronSchedule returns the parsed schedule
+func (p *RetentionPolicy) GetCronSchedule() (cron.Schedule, error) {
+	return cron.ParseStandard(p.Schedule)
+}
+
+// GetDueRun returns the first scheduled run in the interval (from, to] and
+// true if the policy is enabled and must run in this interval
+func (p *RetentionPolicy) GetDueRun(from, to time.Time) (time.Time, bool) {
+	if p.Status != 1 {
+		return time.Time{}, false
+	}
+	schedule, err := p.GetCronSchedule()
+	if err != nil {
+		return time.Time{}, false
+	}
+	next := schedule.Next(from.UTC())
+	return next, !next.IsZero() && !next.After(to.UTC())
+}
+
+// GetTaskName returns the name of the task used to guard against concurrent
+// executions from multiple instances
+func (p *RetentionPolicy) GetTaskName() string {
+	return "retention_policy_" + p.Name
+}
+
+// GuardFromConcurrentExecution returns true if the policy cannot be executed
+// concurrently from multiple instances
+func (p *RetentionPolicy) GuardFromConcurrentExecution() bool {
+	return config.IsShared == 1
+}
+
+func (p *RetentionPolicy) validate() error {
+	if p.Name == "" {
+		return util.NewValidationError("retention policy: a name is required")
+	}
+	if len(p.Name) > 255 {
+		return util.NewValidationError("retention policy: name is too long, 255 is the maximum length allowed")
+	}
+	if config.NamingRules&1 == 0 && !usernameRegex.MatchString(p.Name) {
+		return util.NewValidationError(fmt.Sprintf("retention policy name %q is not valid, the following characters are allowed: a-zA-Z0-9-_.~", p.Name))
+	}
+	if p.Status < 0 || p.Status > 1 {
+		return util.NewValidationError(fmt.Sprintf("retention policy %q: invalid status %d", p.Name, p.Status))
+	}
+	p.Schedule = strings.Join(strings.Fields(p.Schedule), " ")
+	if _, err := p.GetCronSchedule(); err != nil {
+		return util.NewValidationError(fmt.Sprintf("retention policy %q: invalid schedule %q: %v", p.Name, p.Schedule, err))
+	}
+	p.Users = util.RemoveDuplicates(p.Users, true)
+	p.Groups = util.RemoveDuplicates(p.Groups, true)
+	if len(p.Users) == 0 && len(p.Groups) == 0 {
+		return util.NewValidationError(fmt.Sprintf("retention policy %q: at least a user or a group is required", p.Name))
+	}
+	retention := EventActionDataRetentionConfig{
+		Folders: p.Folders,
+	}
+	if err := retention.validate(); err != nil {
+		var validationErr *util.ValidationError
+		if errors.As(err, &validationErr) {
+			return util.NewValidationError(fmt.Sprintf("retention policy %q: %s", p.Name, validationErr.GetErrorString()))
+		}
+		return err
+	}
+	p.Emails = util.RemoveDuplicates(p.Emails, true)
+	for _, email := range p.Emails {
+		if _, err := mail.ParseAddress(email); err != nil {
+			return util.NewValidationError(fmt.Sprintf("retention policy %q: invalid email %q", p.Name, email))
+		}
+	}
+	if p.WebhookURL != "" {
+		u, err := url.Parse(p.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return util.NewValidationError(fmt.Sprintf("retention policy %q: invalid webhook URL", p.Name))
+		}
+	}
+	if p.CreatedAt == 0 {
+		p.CreatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+	}
+	if p.UpdatedAt == 0 {
+		p.UpdatedAt = p.CreatedAt
+	}
+	return nil
+}
+
+func (p *RetentionPolicy) getACopy() RetentionPolicy {
+	folders := make([]FolderRetention, len(p.Folders))
+	copy(folders, p.Folders)
+
+	return RetentionPolicy{
+		Name:        p.Name,
+		Description: p.Description,
+		Status:      p.Status,
+		Schedule:    p.Schedule,
+		Users:       slices.Clone(p.Users),
+		Groups:      slices.Clone(p.Groups),
+		Folders:     folders,
+		DryRun:      p.DryRun,
+		Emails:      slices.Clone(p.Emails),
+		WebhookURL:  p.WebhookURL,
+		CreatedAt:   p.CreatedAt,
+		UpdatedAt:   p.UpdatedAt,
+	}
+}
+
+func validateRetentionPolicies(policies []RetentionPolicy) error {
+	names := make(map[string]bool)
+	for idx := range policies {
+		p := &policies[idx]
+		if err := p.validate(); err != nil {
+			return err
+		}
+		if names[p.Name] {
+			return util.NewValidationError(fmt.Sprintf("duplicated retention policy %q", p.Name))
+		}
+		names[p.Name] = true
+	}
+	return nil
+}
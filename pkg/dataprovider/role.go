@@ -16,13 +16,308 @@ package dataprovider
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"regexp"
 	"strings"
 
+	"github.com/drakkan/sftpgo/v2/pkg/kms"
 	"github.com/drakkan/sftpgo/v2/pkg/logger"
 	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
 )
 
+var (
+	tenantSlugRegex   = regexp.MustCompile("^[a-z0-9][a-z0-9-_]*$")
+	tenantDomainRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*$`)
+)
+
+// RoleTenantOIDC defines the OpenID Connect configuration used for the WebClient
+// login of the users associated with a tenant role
+type RoleTenantOIDC struct {
+	// ClientID is the application's ID
+	ClientID string `json:"client_id"`
+	// ClientSecret is the application's secret
+	ClientSecret *kms.Secret `json:"client_secret,omitempty"`
+	// ConfigURL is the identifier for the service
+	ConfigURL string `json:"config_url"`
+	// Base URL to redirect to after OpenID authentication, if empty the redirect
+	// base URL configured for the HTTP binding will be used
+	RedirectBaseURL string `json:"redirect_base_url,omitempty"`
+	// ID token claims field to map to the SFTPGo username, "preferred_username" if empty
+	UsernameField string `json:"username_field,omitempty"`
+	// Scopes required by the OAuth provider, if empty "openid", "profile" and "email"
+	// will be used
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+func (c *RoleTenantOIDC) isEmpty() bool {
+	return c.ConfigURL == ""
+}
+
+func (c *RoleTenantOIDC) validate(roleName string) error {
+	if !strings.HasPrefix(c.ConfigURL, "http://") && !strings.HasPrefix(c.ConfigURL, "https://") {
+		return util.NewValidationError(fmt.Sprintf("oidc: invalid config URL %q", c.ConfigURL))
+	}
+	if c.ClientID == "" {
+		return util.NewValidationError("oidc: client ID is mandatory")
+	}
+	c.RedirectBaseURL = strings.TrimSpace(c.RedirectBaseURL)
+	if c.RedirectBaseURL != "" && !strings.HasPrefix(c.RedirectBaseURL, "http://") &&
+		!strings.HasPrefix(c.RedirectBaseURL, "https://") {
+		return util.NewValidationError(fmt.Sprintf("oidc: invalid redirect base URL %q", c.RedirectBaseURL))
+	}
+	c.UsernameField = strings.TrimSpace(c.UsernameField)
+	var scopes []string
+	for _, scope := range c.Scopes {
+		scope = strings.TrimSpace(scope)
+		if scope != "" && !util.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	c.Scopes = scopes
+	if len(c.Scopes) > 0 && !util.Contains(c.Scopes, "openid") {
+		return util.NewValidationError(`oidc: the "openid" scope is required`)
+	}
+	if c.ClientSecret == nil {
+		c.ClientSecret = kms.NewEmptySecret()
+	}
+	if c.ClientSecret.IsRedacted() {
+		return util.NewValidationError("oidc: cannot save a redacted client secret")
+	}
+	if c.ClientSecret.IsEncrypted() && !c.ClientSecret.IsValid() {
+		return util.NewValidationError("oidc: invalid encrypted client secret")
+	}
+	if !c.ClientSecret.IsEmpty() && !c.ClientSecret.IsValidInput() {
+		return util.NewValidationError("oidc: invalid client secret")
+	}
+	if c.ClientSecret.IsPlain() {
+		c.ClientSecret.SetAdditionalData(roleName)
+		if err := c.ClientSecret.Encrypt(); err != nil {
+			return util.NewValidationError(fmt.Sprintf("oidc: could not encrypt client secret: %v", err))
+		}
+	}
+	return nil
+}
+
+func (c *RoleTenantOIDC) getACopy() *RoleTenantOIDC {
+	var clientSecret *kms.Secret
+	if c.ClientSecret != nil {
+		clientSecret = c.ClientSecret.Clone()
+	}
+	scopes := make([]string, len(c.Scopes))
+	copy(scopes, c.Scopes)
+
+	return &RoleTenantOIDC{
+		ClientID:        c.ClientID,
+		ClientSecret:    clientSecret,
+		ConfigURL:       c.ConfigURL,
+		RedirectBaseURL: c.RedirectBaseURL,
+		UsernameField:   c.UsernameField,
+		Scopes:          scopes,
+	}
+}
+
+// RoleTenantLimits defines the quota and bandwidth ceilings for the users
+// associated with a tenant role. 0 means no ceiling
+type RoleTenantLimits struct {
+	// Maximum quota as size in bytes
+	MaxUserQuotaSize int64 `json:"max_user_quota_size,omitempty"`
+	// Maximum quota as number of files
+	MaxUserQuotaFiles int `json:"max_user_quota_files,omitempty"`
+	// Maximum upload and download bandwidth as KB/s
+	MaxUserUploadBandwidth   int64 `json:"max_user_upload_bandwidth,omitempty"`
+	MaxUserDownloadBandwidth int64 `json:"max_user_download_bandwidth,omitempty"`
+}
+
+func (l *RoleTenantLimits) isEmpty() bool {
+	return l.MaxUserQuotaSize == 0 && l.MaxUserQuotaFiles == 0 && l.MaxUserUploadBandwidth == 0 &&
+		l.MaxUserDownloadBandwidth == 0
+}
+
+func (l *RoleTenantLimits) validate() error {
+	if l.MaxUserQuotaSize < 0 || l.MaxUserQuotaFiles < 0 {
+		return util.NewValidationError("tenant limits: quota ceilings cannot be negative")
+	}
+	if l.MaxUserUploadBandwidth < 0 || l.MaxUserDownloadBandwidth < 0 {
+		return util.NewValidationError("tenant limits: bandwidth ceilings cannot be negative")
+	}
+	return nil
+}
+
+func (l *RoleTenantLimits) getACopy() *RoleTenantLimits {
+	return &RoleTenantLimits{
+		MaxUserQuotaSize:         l.MaxUserQuotaSize,
+		MaxUserQuotaFiles:        l.MaxUserQuotaFiles,
+		MaxUserUploadBandwidth:   l.MaxUserUploadBandwidth,
+		MaxUserDownloadBandwidth: l.MaxUserDownloadBandwidth,
+	}
+}
+
+// applyToUser enforces the ceilings on the specified user. Unlimited values are
+// replaced with the ceiling, values above the ceiling are rejected
+func (l *RoleTenantLimits) applyToUser(user *User) error {
+	var err error
+	if user.QuotaSize, err = applyTenantLimit(user.QuotaSize, l.MaxUserQuotaSize, "quota size"); err != nil {
+		return err
+	}
+	quotaFiles, err := applyTenantLimit(int64(user.QuotaFiles), int64(l.MaxUserQuotaFiles), "quota files")
+	if err != nil {
+		return err
+	}
+	user.QuotaFiles = int(quotaFiles)
+	user.UploadBandwidth, err = applyTenantLimit(user.UploadBandwidth, l.MaxUserUploadBandwidth, "upload bandwidth")
+	if err != nil {
+		return err
+	}
+	user.DownloadBandwidth, err = applyTenantLimit(user.DownloadBandwidth, l.MaxUserDownloadBandwidth,
+		"download bandwidth")
+	if err != nil {
+		return err
+	}
+	for idx := range user.Filters.BandwidthLimits {
+		bwLimit := &user.Filters.BandwidthLimits[idx]
+		bwLimit.UploadBandwidth, err = applyTenantLimit(bwLimit.UploadBandwidth, l.MaxUserUploadBandwidth,
+			"upload bandwidth")
+		if err != nil {
+			return err
+		}
+		bwLimit.DownloadBandwidth, err = applyTenantLimit(bwLimit.DownloadBandwidth, l.MaxUserDownloadBandwidth,
+			"download bandwidth")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyTenantLimit(value, limit int64, name string) (int64, error) {
+	if limit <= 0 {
+		return value, nil
+	}
+	if value <= 0 {
+		return limit, nil
+	}
+	if value > limit {
+		return value, util.NewValidationError(fmt.Sprintf("%s %d exceeds the tenant limit %d", name, value, limit))
+	}
+	return value, nil
+}
+
+// RoleTenant defines the settings that allow a role to act as a tenant.
+// The users associated with a tenant role log in to the WebClient using the
+// tenant OpenID Connect provider and receive notifications using the tenant
+// SMTP server, if configured
+type RoleTenant struct {
+	// Slug identifies the tenant within the WebClient login URLs,
+	// for example "/web/client/login?tenant=<slug>"
+	Slug string `json:"slug,omitempty"`
+	// Login domains, the tenant is selected if the HTTP Host header matches one of them
+	Domains []string `json:"domains,omitempty"`
+	// Optional OpenID Connect configuration
+	OIDC *RoleTenantOIDC `json:"oidc,omitempty"`
+	// Optional SMTP configuration
+	SMTP *SMTPConfigs `json:"smtp,omitempty"`
+	// Optional ceilings for the users associated with the tenant
+	Limits *RoleTenantLimits `json:"limits,omitempty"`
+}
+
+func (t *RoleTenant) isEmpty() bool {
+	return t.Slug == "" && len(t.Domains) == 0 && t.OIDC == nil && t.SMTP == nil && t.Limits == nil
+}
+
+func (t *RoleTenant) validate(roleName string) error {
+	t.Slug = strings.ToLower(strings.TrimSpace(t.Slug))
+	if t.Slug != "" && !tenantSlugRegex.MatchString(t.Slug) {
+		return util.NewValidationError(fmt.Sprintf("tenant slug %q is not valid, the following characters are allowed: a-z0-9-_", t.Slug))
+	}
+	var domains []string
+	for _, domain := range t.Domains {
+		domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+		if domain == "" {
+			continue
+		}
+		if !tenantDomainRegex.MatchString(domain) {
+			return util.NewValidationError(fmt.Sprintf("tenant domain %q is not valid", domain))
+		}
+		if !util.Contains(domains, domain) {
+			domains = append(domains, domain)
+		}
+	}
+	t.Domains = domains
+	if t.OIDC != nil {
+		if t.OIDC.isEmpty() {
+			t.OIDC = nil
+		} else {
+			if t.Slug == "" && len(t.Domains) == 0 {
+				return util.NewValidationError("tenant OpenID Connect requires a slug or at least one login domain")
+			}
+			if err := t.OIDC.validate(roleName); err != nil {
+				return err
+			}
+		}
+	}
+	if t.SMTP != nil {
+		if t.SMTP.IsEmpty() {
+			t.SMTP = nil
+		} else if err := t.SMTP.validate(); err != nil {
+			return err
+		}
+	}
+	if t.Limits != nil {
+		if err := t.Limits.validate(); err != nil {
+			return err
+		}
+		if t.Limits.isEmpty() {
+			t.Limits = nil
+		}
+	}
+	return nil
+}
+
+func (t *RoleTenant) conflictsWith(other *RoleTenant) error {
+	if t.Slug != "" && t.Slug == other.Slug {
+		return fmt.Errorf("tenant slug %q is already in use", t.Slug)
+	}
+	for _, domain := range t.Domains {
+		if util.Contains(other.Domains, domain) {
+			return fmt.Errorf("tenant domain %q is already in use", domain)
+		}
+	}
+	return nil
+}
+
+func (t *RoleTenant) hideConfidentialData() {
+	if t.OIDC != nil && t.OIDC.ClientSecret != nil {
+		t.OIDC.ClientSecret.Hide()
+		if t.OIDC.ClientSecret.IsEmpty() {
+			t.OIDC.ClientSecret = nil
+		}
+	}
+	if t.SMTP != nil {
+		t.SMTP.hideConfidentialData()
+	}
+}
+
+func (t *RoleTenant) getACopy() *RoleTenant {
+	domains := make([]string, len(t.Domains))
+	copy(domains, t.Domains)
+	result := &RoleTenant{
+		Slug:    t.Slug,
+		Domains: domains,
+	}
+	if t.OIDC != nil {
+		result.OIDC = t.OIDC.getACopy()
+	}
+	if t.SMTP != nil {
+		result.SMTP = t.SMTP.getACopy()
+	}
+	if t.Limits != nil {
+		result.Limits = t.Limits.getACopy()
+	}
+	return result
+}
+
 // Role defines an SFTPGo role.
 type Role struct {
 	// Data provider unique identifier
@@ -39,6 +334,25 @@ type Role struct {
 	Admins []string `json:"admins,omitempty"`
 	// list of usernames associated with this role
 	Users []string `json:"users,omitempty"`
+	// optional tenant settings
+	Tenant *RoleTenant `json:"tenant,omitempty"`
+}
+
+// HasTenantOIDC returns true if the role defines its own OpenID Connect configuration
+func (r *Role) HasTenantOIDC() bool {
+	return r.Tenant != nil && r.Tenant.OIDC != nil && !r.Tenant.OIDC.isEmpty()
+}
+
+// HasTenantSMTP returns true if the role defines its own SMTP configuration
+func (r *Role) HasTenantSMTP() bool {
+	return r.Tenant != nil && r.Tenant.SMTP != nil && !r.Tenant.SMTP.IsEmpty()
+}
+
+// PrepareForRendering hides the confidential data
+func (r *Role) PrepareForRendering() {
+	if r.Tenant != nil {
+		r.Tenant.hideConfidentialData()
+	}
 }
 
 // RenderAsJSON implements the renderer interface used within plugins
@@ -49,8 +363,10 @@ func (r *Role) RenderAsJSON(reload bool) ([]byte, error) {
 			providerLog(logger.LevelError, "unable to reload role before rendering as json: %v", err)
 			return nil, err
 		}
+		role.PrepareForRendering()
 		return json.Marshal(role)
 	}
+	r.PrepareForRendering()
 	return json.Marshal(r)
 }
 
@@ -64,6 +380,14 @@ func (r *Role) validate() error {
 	if config.NamingRules&1 == 0 && !usernameRegex.MatchString(r.Name) {
 		return util.NewValidationError(fmt.Sprintf("name %q is not valid, the following characters are allowed: a-zA-Z0-9-_.~", r.Name))
 	}
+	if r.Tenant != nil {
+		if err := r.Tenant.validate(r.Name); err != nil {
+			return err
+		}
+		if r.Tenant.isEmpty() {
+			r.Tenant = nil
+		}
+	}
 	return nil
 }
 
@@ -72,6 +396,10 @@ func (r *Role) getACopy() Role {
 	copy(users, r.Users)
 	admins := make([]string, len(r.Admins))
 	copy(admins, r.Admins)
+	var tenant *RoleTenant
+	if r.Tenant != nil {
+		tenant = r.Tenant.getACopy()
+	}
 
 	return Role{
 		ID:          r.ID,
@@ -81,6 +409,7 @@ func (r *Role) getACopy() Role {
 		UpdatedAt:   r.UpdatedAt,
 		Users:       users,
 		Admins:      admins,
+		Tenant:      tenant,
 	}
 }
 
@@ -95,3 +424,149 @@ func (r *Role) GetMembersAsString() string {
 	}
 	return sb.String()
 }
+
+func folderHasRole(folder *vfs.BaseVirtualFolder, role string) bool {
+	if role == "" {
+		return true
+	}
+	return role == folder.Role
+}
+
+// checkObjectRole returns a validation error if the role owning an object
+// does not exist
+func checkObjectRole(role string) error {
+	if role == "" {
+		return nil
+	}
+	if _, err := provider.roleExists(role); err != nil {
+		if errors.Is(err, util.ErrNotFound) {
+			return util.NewValidationError(fmt.Sprintf("role %q does not exist", role))
+		}
+		return err
+	}
+	return nil
+}
+
+// checkTenantReferences ensures that an object owned by the specified role
+// only references groups and folders owned by the same role or global ones.
+// The role of the referenced folders is updated so that the folders created
+// inline are owned by the referencing role
+func checkTenantReferences(role string, groups []string, folders []vfs.VirtualFolder) error {
+	for _, name := range groups {
+		group, err := provider.groupExists(name)
+		if err != nil {
+			continue
+		}
+		if group.Role != "" && group.Role != role {
+			return util.NewValidationError(fmt.Sprintf("group %q belongs to a different tenant", name))
+		}
+	}
+	for idx := range folders {
+		vfolder := &folders[idx]
+		folder, err := provider.getFolderByName(vfolder.Name)
+		if err != nil {
+			vfolder.Role = role
+			continue
+		}
+		if folder.Role != "" && folder.Role != role {
+			return util.NewValidationError(fmt.Sprintf("folder %q belongs to a different tenant", vfolder.Name))
+		}
+		vfolder.Role = folder.Role
+	}
+	return nil
+}
+
+// applyTenantSettings enforces the tenant restrictions on the specified user
+func applyTenantSettings(user *User) error {
+	groups := make([]string, 0, len(user.Groups))
+	for _, g := range user.Groups {
+		groups = append(groups, g.Name)
+	}
+	if err := checkTenantReferences(user.Role, groups, user.VirtualFolders); err != nil {
+		return err
+	}
+	if user.Role == "" {
+		return nil
+	}
+	role, err := provider.roleExists(user.Role)
+	if err != nil {
+		// a missing role is reported by the provider
+		return nil
+	}
+	if role.Tenant != nil && role.Tenant.Limits != nil {
+		return role.Tenant.Limits.applyToUser(user)
+	}
+	return nil
+}
+
+func checkGroupTenant(group *Group, members []string) error {
+	if err := checkObjectRole(group.Role); err != nil {
+		return err
+	}
+	if err := checkTenantReferences(group.Role, nil, group.VirtualFolders); err != nil {
+		return err
+	}
+	return checkMembersRole(group.Role, members, nil)
+}
+
+func checkFolderTenant(folder *vfs.BaseVirtualFolder, users, groups []string) error {
+	if err := checkObjectRole(folder.Role); err != nil {
+		return err
+	}
+	return checkMembersRole(folder.Role, users, groups)
+}
+
+func checkEventRuleTenant(rule *EventRule) error {
+	if err := checkObjectRole(rule.Role); err != nil {
+		return err
+	}
+	return rule.applyTenantRestrictions()
+}
+
+// checkMembersRole ensures that the users and groups referencing an object
+// owned by the specified role are owned by the same role
+func checkMembersRole(role string, users, groups []string) error {
+	if role == "" {
+		return nil
+	}
+	for _, username := range users {
+		user, err := provider.userExists(username, "")
+		if err == nil && user.Role != role {
+			return util.NewValidationError(fmt.Sprintf("user %q belongs to a different tenant", username))
+		}
+	}
+	for _, name := range groups {
+		group, err := provider.groupExists(name)
+		if err == nil && group.Role != role {
+			return util.NewValidationError(fmt.Sprintf("group %q belongs to a different tenant", name))
+		}
+	}
+	return nil
+}
+
+// checkRoleOwnsObjects returns a validation error if the specified role owns
+// groups, folders or event rules
+func checkRoleOwnsObjects(role string) error {
+	groups, err := provider.getGroups(1, 0, OrderASC, true, role)
+	if err != nil {
+		return err
+	}
+	if len(groups) > 0 {
+		return util.NewValidationError(fmt.Sprintf("the role %q owns groups, it cannot be removed", role))
+	}
+	folders, err := provider.getFolders(1, 0, OrderASC, true, role)
+	if err != nil {
+		return err
+	}
+	if len(folders) > 0 {
+		return util.NewValidationError(fmt.Sprintf("the role %q owns folders, it cannot be removed", role))
+	}
+	rules, err := provider.getEventRules(1, 0, OrderASC, role)
+	if err != nil {
+		return err
+	}
+	if len(rules) > 0 {
+		return util.NewValidationError(fmt.Sprintf("the role %q owns event rules, it cannot be removed", role))
+	}
+	return nil
+}
@@ -68,6 +68,24 @@ func startScheduler() error {
 	if err != nil {
 		return fmt.Errorf("unable to schedule nodes cleanup: %w", err)
 	}
+	if config.AuditLog.Enabled && config.AuditLog.Retention > 0 {
+		_, err = scheduler.AddFunc("@every 1h", checkAuditLogRetention)
+		if err != nil {
+			return fmt.Errorf("unable to schedule audit log cleanup: %w", err)
+		}
+	}
+	if config.ShareEvents.Enabled && config.ShareEvents.Retention > 0 {
+		_, err = scheduler.AddFunc("@every 1h", checkShareEventsRetention)
+		if err != nil {
+			return fmt.Errorf("unable to schedule share events cleanup: %w", err)
+		}
+	}
+	if config.Snapshots.Enabled {
+		_, err = scheduler.AddFunc("@every 1h", checkConfigSnapshotsRetention)
+		if err != nil {
+			return fmt.Errorf("unable to schedule snapshots cleanup: %w", err)
+		}
+	}
 	scheduler.Start()
 	return nil
 }
@@ -100,6 +118,9 @@ func checkDataprovider() {
 func checkCacheUpdates() {
 	checkUserCache()
 	checkIPListEntryCache()
+	if config.IsShared == 1 {
+		loadUsernameAliases()
+	}
 	cachedUserPasswords.cleanup()
 	cachedAdminPasswords.cleanup()
 	cachedAPIKeys.cleanup()
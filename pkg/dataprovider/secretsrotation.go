@@ -0,0 +1,244 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/drakkan/sftpgo/v2/pkg/kms"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+)
+
+var secretType = reflect.TypeOf((*kms.Secret)(nil))
+
+// SecretsRotationResult defines the number of secrets re-encrypted for each
+// object type
+type SecretsRotationResult struct {
+	Users        int `json:"users"`
+	Groups       int `json:"groups"`
+	Folders      int `json:"folders"`
+	Admins       int `json:"admins"`
+	Roles        int `json:"roles"`
+	EventActions int `json:"event_actions"`
+	Configs      int `json:"configs"`
+}
+
+// GetTotal returns the total number of re-encrypted secrets
+func (r *SecretsRotationResult) GetTotal() int {
+	return r.Users + r.Groups + r.Folders + r.Admins + r.Roles + r.EventActions + r.Configs
+}
+
+// collectSecrets returns the secrets referenced by the specified value,
+// walking structs, pointers, slices and maps recursively
+func collectSecrets(v reflect.Value, secrets []*kms.Secret) []*kms.Secret {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return secrets
+		}
+		if v.Type() == secretType {
+			return append(secrets, v.Interface().(*kms.Secret))
+		}
+		return collectSecrets(v.Elem(), secrets)
+	case reflect.Interface:
+		if !v.IsNil() {
+			return collectSecrets(v.Elem(), secrets)
+		}
+	case reflect.Struct:
+		for idx := 0; idx < v.NumField(); idx++ {
+			if v.Type().Field(idx).IsExported() {
+				secrets = collectSecrets(v.Field(idx), secrets)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for idx := 0; idx < v.Len(); idx++ {
+			secrets = collectSecrets(v.Index(idx), secrets)
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			secrets = collectSecrets(iter.Value(), secrets)
+		}
+	}
+	return secrets
+}
+
+// decryptSecretsForRotation decrypts the secrets, referenced by the specified
+// objects, that must be re-encrypted. The decrypted secrets are encrypted again,
+// using the configured secret provider, while validating the updated object.
+// If all is false only the secrets encrypted using a different secret provider
+// are decrypted
+func decryptSecretsForRotation(all bool, objects ...any) (int, error) {
+	var secrets []*kms.Secret
+	for _, obj := range objects {
+		secrets = collectSecrets(reflect.ValueOf(obj), secrets)
+	}
+	encryptedStatus := kms.GetEncryptedStatus()
+	decrypted := 0
+	for _, secret := range secrets {
+		if !secret.IsEncrypted() {
+			continue
+		}
+		if !all && secret.GetStatus() == encryptedStatus {
+			continue
+		}
+		if err := secret.Decrypt(); err != nil {
+			return decrypted, err
+		}
+		decrypted++
+	}
+	return decrypted, nil
+}
+
+// RotateSecrets re-encrypts the secrets stored in the data provider using the
+// configured secret provider. The secret providers used to encrypt the existing
+// secrets must be available for decryption. If all is false only the secrets
+// encrypted using a different secret provider are re-encrypted
+func RotateSecrets(all bool, executor, ipAddress string) (SecretsRotationResult, error) {
+	var result SecretsRotationResult
+
+	users, err := provider.dumpUsers()
+	if err != nil {
+		return result, err
+	}
+	for idx := range users {
+		user := &users[idx]
+		n, err := decryptSecretsForRotation(all, &user.FsConfig, &user.Filters)
+		if err != nil {
+			return result, fmt.Errorf("unable to decrypt the secrets for user %q: %w", user.Username, err)
+		}
+		if n == 0 {
+			continue
+		}
+		if err := UpdateUser(user, executor, ipAddress, ""); err != nil {
+			return result, fmt.Errorf("unable to update user %q: %w", user.Username, err)
+		}
+		result.Users += n
+	}
+
+	groups, err := provider.dumpGroups()
+	if err != nil {
+		return result, err
+	}
+	for idx := range groups {
+		group := &groups[idx]
+		n, err := decryptSecretsForRotation(all, &group.UserSettings.FsConfig)
+		if err != nil {
+			return result, fmt.Errorf("unable to decrypt the secrets for group %q: %w", group.Name, err)
+		}
+		if n == 0 {
+			continue
+		}
+		if err := UpdateGroup(group, group.Users, executor, ipAddress, ""); err != nil {
+			return result, fmt.Errorf("unable to update group %q: %w", group.Name, err)
+		}
+		result.Groups += n
+	}
+
+	folders, err := provider.dumpFolders()
+	if err != nil {
+		return result, err
+	}
+	for idx := range folders {
+		folder := &folders[idx]
+		n, err := decryptSecretsForRotation(all, &folder.FsConfig)
+		if err != nil {
+			return result, fmt.Errorf("unable to decrypt the secrets for folder %q: %w", folder.Name, err)
+		}
+		if n == 0 {
+			continue
+		}
+		if err := UpdateFolder(folder, folder.Users, folder.Groups, executor, ipAddress, ""); err != nil {
+			return result, fmt.Errorf("unable to update folder %q: %w", folder.Name, err)
+		}
+		result.Folders += n
+	}
+
+	admins, err := provider.dumpAdmins()
+	if err != nil {
+		return result, err
+	}
+	for idx := range admins {
+		admin := &admins[idx]
+		n, err := decryptSecretsForRotation(all, &admin.Filters)
+		if err != nil {
+			return result, fmt.Errorf("unable to decrypt the secrets for admin %q: %w", admin.Username, err)
+		}
+		if n == 0 {
+			continue
+		}
+		if err := UpdateAdmin(admin, executor, ipAddress, ""); err != nil {
+			return result, fmt.Errorf("unable to update admin %q: %w", admin.Username, err)
+		}
+		result.Admins += n
+	}
+
+	roles, err := provider.dumpRoles()
+	if err != nil {
+		return result, err
+	}
+	for idx := range roles {
+		role := &roles[idx]
+		n, err := decryptSecretsForRotation(all, role)
+		if err != nil {
+			return result, fmt.Errorf("unable to decrypt the secrets for role %q: %w", role.Name, err)
+		}
+		if n == 0 {
+			continue
+		}
+		if err := UpdateRole(role, executor, ipAddress, ""); err != nil {
+			return result, fmt.Errorf("unable to update role %q: %w", role.Name, err)
+		}
+		result.Roles += n
+	}
+
+	actions, err := provider.dumpEventActions()
+	if err != nil {
+		return result, err
+	}
+	for idx := range actions {
+		action := &actions[idx]
+		n, err := decryptSecretsForRotation(all, &action.Options)
+		if err != nil {
+			return result, fmt.Errorf("unable to decrypt the secrets for event action %q: %w", action.Name, err)
+		}
+		if n == 0 {
+			continue
+		}
+		if err := UpdateEventAction(action, executor, ipAddress, ""); err != nil {
+			return result, fmt.Errorf("unable to update event action %q: %w", action.Name, err)
+		}
+		result.EventActions += n
+	}
+
+	configs, err := provider.getConfigs()
+	if err != nil {
+		return result, err
+	}
+	n, err := decryptSecretsForRotation(all, &configs)
+	if err != nil {
+		return result, fmt.Errorf("unable to decrypt the secrets for configs: %w", err)
+	}
+	if n > 0 {
+		if err := UpdateConfigs(&configs, executor, ipAddress, ""); err != nil {
+			return result, fmt.Errorf("unable to update configs: %w", err)
+		}
+		result.Configs += n
+	}
+
+	providerLog(logger.LevelInfo, "secrets rotation completed, re-encrypted secrets: %+v", result)
+	return result, nil
+}
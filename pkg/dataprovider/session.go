@@ -15,6 +15,7 @@
 package dataprovider
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 )
@@ -28,6 +29,12 @@ const (
 	SessionTypeOIDCToken
 	SessionTypeResetCode
 	SessionTypeOAuth2Auth
+	SessionTypeConsentLink
+	SessionTypeWebSession
+	SessionTypeRevokedWebSession
+	SessionTypeBackgroundJob
+	SessionTypeRetentionReport
+	SessionTypeConfigSnapshot
 )
 
 // Session defines a shared session persisted in the data provider
@@ -42,8 +49,48 @@ func (s *Session) validate() error {
 	if s.Key == "" {
 		return errors.New("unable to save a session with an empty key")
 	}
-	if s.Type < SessionTypeOIDCAuth || s.Type > SessionTypeOAuth2Auth {
+	if s.Type < SessionTypeOIDCAuth || s.Type > SessionTypeConfigSnapshot {
 		return fmt.Errorf("invalid session type: %v", s.Type)
 	}
 	return nil
 }
+
+// encodedSession defines the JSON representation of a shared session for the
+// providers without a dedicated sessions table
+type encodedSession struct {
+	Key       string          `json:"key"`
+	Data      json.RawMessage `json:"data"`
+	Type      SessionType     `json:"type"`
+	Timestamp int64           `json:"timestamp"`
+}
+
+func (s *encodedSession) getSession() Session {
+	return Session{
+		Key:       s.Key,
+		Data:      []byte(s.Data),
+		Type:      s.Type,
+		Timestamp: s.Timestamp,
+	}
+}
+
+func encodeSession(session Session) ([]byte, error) {
+	if err := session.validate(); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(session.Data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(encodedSession{
+		Key:       session.Key,
+		Data:      data,
+		Type:      session.Type,
+		Timestamp: session.Timestamp,
+	})
+}
+
+func decodeSession(data []byte) (encodedSession, error) {
+	var session encodedSession
+	err := json.Unmarshal(data, &session)
+	return session, err
+}
@@ -0,0 +1,157 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// SessionPolicy defines the session limits for the specified protocols.
+// Zero values mean the global settings are used
+type SessionPolicy struct {
+	// Protocols the policy applies to, empty means all protocols.
+	// Policies defined for a specific protocol have precedence
+	Protocols []string `json:"protocols,omitempty"`
+	// Idle timeout in minutes. Idle connections are closed
+	IdleTimeout int `json:"idle_timeout,omitempty"`
+	// Interval in seconds for sending keepalive requests to SSH clients.
+	// Clients not responding are disconnected
+	KeepaliveInterval int `json:"keepalive_interval,omitempty"`
+	// Maximum session duration in minutes. Sessions exceeding this duration are
+	// closed even if not idle. For the WebClient the login expires
+	MaxSessionDuration int `json:"max_session_duration,omitempty"`
+}
+
+// GetIdleTimeout returns the idle timeout as duration
+func (p *SessionPolicy) GetIdleTimeout() time.Duration {
+	return time.Duration(p.IdleTimeout) * time.Minute
+}
+
+// GetKeepaliveInterval returns the keepalive interval as duration
+func (p *SessionPolicy) GetKeepaliveInterval() time.Duration {
+	return time.Duration(p.KeepaliveInterval) * time.Second
+}
+
+// GetMaxSessionDuration returns the max session duration as duration
+func (p *SessionPolicy) GetMaxSessionDuration() time.Duration {
+	return time.Duration(p.MaxSessionDuration) * time.Minute
+}
+
+// IsEmpty returns true if no limit is defined
+func (p *SessionPolicy) IsEmpty() bool {
+	return p.IdleTimeout == 0 && p.KeepaliveInterval == 0 && p.MaxSessionDuration == 0
+}
+
+func (p *SessionPolicy) getACopy() SessionPolicy {
+	protocols := make([]string, len(p.Protocols))
+	copy(protocols, p.Protocols)
+
+	return SessionPolicy{
+		Protocols:          protocols,
+		IdleTimeout:        p.IdleTimeout,
+		KeepaliveInterval:  p.KeepaliveInterval,
+		MaxSessionDuration: p.MaxSessionDuration,
+	}
+}
+
+func copySessionPolicies(policies []SessionPolicy) []SessionPolicy {
+	if len(policies) == 0 {
+		return nil
+	}
+	result := make([]SessionPolicy, 0, len(policies))
+	for idx := range policies {
+		result = append(result, policies[idx].getACopy())
+	}
+	return result
+}
+
+func validateSessionPolicies(policies []SessionPolicy) ([]SessionPolicy, error) {
+	var result []SessionPolicy
+	var protocols []string
+	hasDefault := false
+
+	for _, p := range policies {
+		if p.IdleTimeout < 0 || p.KeepaliveInterval < 0 || p.MaxSessionDuration < 0 {
+			return nil, util.NewValidationError("session policy limits cannot be negative")
+		}
+		if p.IsEmpty() {
+			continue
+		}
+		p.Protocols = util.RemoveDuplicates(p.Protocols, false)
+		if len(p.Protocols) == 0 {
+			if hasDefault {
+				return nil, util.NewValidationError("only one session policy can apply to all protocols")
+			}
+			hasDefault = true
+		}
+		for _, proto := range p.Protocols {
+			if !util.Contains(ValidProtocols, proto) {
+				return nil, util.NewValidationError(fmt.Sprintf("invalid session policy protocol %q", proto))
+			}
+			if util.Contains(protocols, proto) {
+				return nil, util.NewValidationError(fmt.Sprintf("duplicate session policy for protocol %q", proto))
+			}
+			protocols = append(protocols, proto)
+		}
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+// getSessionPolicyProtocol maps the connection protocols to the protocols used
+// for session policies
+func getSessionPolicyProtocol(protocol string) string {
+	switch protocol {
+	case "SFTP", "SCP", protocolSSH:
+		return protocolSSH
+	case "HTTPShare", "OIDC", "SAML", protocolHTTP:
+		return protocolHTTP
+	default:
+		return protocol
+	}
+}
+
+// GetSessionPolicy returns the session policy to apply for the given protocol
+func (u *User) GetSessionPolicy(protocol string) SessionPolicy {
+	protocol = getSessionPolicyProtocol(protocol)
+	var result SessionPolicy
+	for _, p := range u.Filters.SessionPolicies {
+		if len(p.Protocols) == 0 {
+			result = p
+			continue
+		}
+		if util.Contains(p.Protocols, protocol) {
+			return p
+		}
+	}
+	return result
+}
+
+// GetSessionPolicyForProtocol returns the session policy explicitly defined for the
+// given protocol. An empty protocol returns the policy defined for all protocols
+func (s *GroupUserSettings) GetSessionPolicyForProtocol(protocol string) SessionPolicy {
+	for _, p := range s.SessionPolicies {
+		if protocol == "" && len(p.Protocols) == 0 {
+			return p
+		}
+		if protocol != "" && util.Contains(p.Protocols, protocol) {
+			return p
+		}
+	}
+	return SessionPolicy{}
+}
@@ -37,6 +37,8 @@ const (
 	ShareScopeRead ShareScope = iota + 1
 	ShareScopeWrite
 	ShareScopeReadWrite
+	ShareScopeUploadPortal
+	ShareScopeFileRequest
 )
 
 const (
@@ -52,7 +54,8 @@ type Share struct {
 	Name        string     `json:"name"`
 	Description string     `json:"description,omitempty"`
 	Scope       ShareScope `json:"scope"`
-	// Paths to files or directories, for ShareScopeWrite it must be exactly one directory
+	// Paths to files or directories, for ShareScopeWrite, ShareScopeReadWrite,
+	// ShareScopeUploadPortal and ShareScopeFileRequest it must be exactly one directory
 	Paths []string `json:"paths"`
 	// Username who shared this object
 	Username  string `json:"username"`
@@ -70,6 +73,22 @@ type Share struct {
 	UsedTokens int `json:"used_tokens,omitempty"`
 	// Limit the share availability to these IPs/CIDR networks
 	AllowFrom []string `json:"allow_from,omitempty"`
+	// Public page configuration, supported for ShareScopeUploadPortal and
+	// ShareScopeFileRequest
+	Portal *SharePortal `json:"portal,omitempty"`
+	// Naming rules for the uploaded files, required for ShareScopeFileRequest
+	FileRequest *ShareFileRequest `json:"file_request,omitempty"`
+	// Limit the downloads from the same IP address, 0 means no limit.
+	// Supported for ShareScopeRead only
+	MaxDownloadsPerIP int `json:"max_downloads_per_ip,omitempty"`
+	// The share can be downloaded only once and it is automatically removed.
+	// Supported for ShareScopeRead only
+	BurnAfterDownload bool `json:"burn_after_download,omitempty"`
+	// Notify the owner via email each time the share is used
+	NotifyOnUse bool `json:"notify_on_use,omitempty"`
+	// Notify the owner via email the specified number of hours before the
+	// share expires, 0 means no notification
+	NotifyBeforeExpiration int `json:"notify_before_expiration,omitempty"`
 	// set for restores, we don't have to validate the expiration date
 	// otherwise we fail to restore existing shares and we have to insert
 	// all the previous values with no modifications
@@ -84,6 +103,10 @@ func (s *Share) GetScopeAsString() string {
 		return "Write"
 	case ShareScopeReadWrite:
 		return "Read/Write"
+	case ShareScopeUploadPortal:
+		return "Upload portal"
+	case ShareScopeFileRequest:
+		return "File request"
 	default:
 		return "Read"
 	}
@@ -147,7 +170,83 @@ func (s *Share) getACopy() Share {
 		MaxTokens:   s.MaxTokens,
 		UsedTokens:  s.UsedTokens,
 		AllowFrom:   allowFrom,
+		Portal:      s.Portal.getACopy(),
+		FileRequest: s.FileRequest.getACopy(),
+
+		MaxDownloadsPerIP:      s.MaxDownloadsPerIP,
+		BurnAfterDownload:      s.BurnAfterDownload,
+		NotifyOnUse:            s.NotifyOnUse,
+		NotifyBeforeExpiration: s.NotifyBeforeExpiration,
+	}
+}
+
+// GetPortalTitle returns the title for the upload portal page
+func (s *Share) GetPortalTitle() string {
+	if s.Portal != nil && s.Portal.Title != "" {
+		return s.Portal.Title
+	}
+	return s.Name
+}
+
+func (s *Share) validateLimits() error {
+	if s.MaxDownloadsPerIP < 0 {
+		return util.NewValidationError("invalid max downloads per IP")
+	}
+	if s.Scope != ShareScopeRead && (s.MaxDownloadsPerIP > 0 || s.BurnAfterDownload) {
+		return util.NewValidationError("max downloads per IP and burn after download are supported for the read scope only")
+	}
+	if s.BurnAfterDownload {
+		s.MaxTokens = 1
+	}
+	if s.NotifyBeforeExpiration < 0 {
+		return util.NewValidationError("invalid expiration notification")
+	}
+	if s.NotifyBeforeExpiration > 0 && s.ExpiresAt == 0 {
+		return util.NewValidationError("an expiration date is required for the expiration notification")
+	}
+	return nil
+}
+
+// IsBurnt returns true if the share must be removed after a download
+// and it was already downloaded
+func (s *Share) IsBurnt() bool {
+	return s.BurnAfterDownload && s.UsedTokens > 0
+}
+
+// ExpiresWithin returns true if the share expires within the specified duration
+func (s *Share) ExpiresWithin(d time.Duration) bool {
+	if s.ExpiresAt == 0 {
+		return false
 	}
+	remaining := time.Until(util.GetTimeFromMsecSinceEpoch(s.ExpiresAt))
+	return remaining > 0 && remaining <= d
+}
+
+// HasPortal returns true if the share has a customizable upload page
+func (s *Share) HasPortal() bool {
+	return s.Scope == ShareScopeUploadPortal || s.Scope == ShareScopeFileRequest
+}
+
+func (s *Share) validatePortal() error {
+	if !s.HasPortal() {
+		s.Portal = nil
+		return nil
+	}
+	if s.Portal == nil {
+		s.Portal = &SharePortal{}
+	}
+	return s.Portal.validate()
+}
+
+func (s *Share) validateFileRequest() error {
+	if s.Scope != ShareScopeFileRequest {
+		s.FileRequest = nil
+		return nil
+	}
+	if s.FileRequest == nil {
+		s.FileRequest = &ShareFileRequest{}
+	}
+	return s.FileRequest.validate()
 }
 
 // RenderAsJSON implements the renderer interface used within plugins
@@ -246,12 +345,18 @@ func (s *Share) validate() error {
 	if s.Name == "" {
 		return util.NewValidationError("name is mandatory")
 	}
-	if s.Scope < ShareScopeRead || s.Scope > ShareScopeReadWrite {
+	if s.Scope < ShareScopeRead || s.Scope > ShareScopeFileRequest {
 		return util.NewValidationError(fmt.Sprintf("invalid scope: %v", s.Scope))
 	}
 	if err := s.validatePaths(); err != nil {
 		return err
 	}
+	if err := s.validatePortal(); err != nil {
+		return err
+	}
+	if err := s.validateFileRequest(); err != nil {
+		return err
+	}
 	if s.ExpiresAt > 0 {
 		if !s.IsRestore && s.ExpiresAt < util.GetTimeAsMsSinceEpoch(time.Now()) {
 			return util.NewValidationError("expiration must be in the future")
@@ -262,6 +367,9 @@ func (s *Share) validate() error {
 	if s.MaxTokens < 0 {
 		return util.NewValidationError("invalid max tokens")
 	}
+	if err := s.validateLimits(); err != nil {
+		return err
+	}
 	if s.Username == "" {
 		return util.NewValidationError("username is mandatory")
 	}
@@ -272,11 +380,12 @@ func (s *Share) validate() error {
 		return err
 	}
 	s.AllowFrom = util.RemoveDuplicates(s.AllowFrom, false)
-	for _, IPMask := range s.AllowFrom {
-		_, _, err := net.ParseCIDR(IPMask)
+	for idx, IPMask := range s.AllowFrom {
+		filter, err := validateIPFilter(IPMask)
 		if err != nil {
 			return util.NewValidationError(fmt.Sprintf("could not parse allow from entry %q : %v", IPMask, err))
 		}
+		s.AllowFrom[idx] = filter
 	}
 	return nil
 }
@@ -315,6 +424,9 @@ func (s *Share) IsUsable(ip string) (bool, error) {
 	if s.MaxTokens > 0 && s.UsedTokens >= s.MaxTokens {
 		return false, util.NewRecordNotFoundError("max share usage exceeded")
 	}
+	if s.MaxDownloadsPerIP > 0 && shareDownloadsTracker.get(s.ShareID, ip) >= s.MaxDownloadsPerIP {
+		return false, util.NewRecordNotFoundError("max share usage exceeded for this IP address")
+	}
 	if s.ExpiresAt > 0 {
 		if s.ExpiresAt < util.GetTimeAsMsSinceEpoch(time.Now()) {
 			return false, util.NewRecordNotFoundError("share expired")
@@ -328,11 +440,11 @@ func (s *Share) IsUsable(ip string) (bool, error) {
 		return false, ErrLoginNotAllowedFromIP
 	}
 	for _, ipMask := range s.AllowFrom {
-		_, network, err := net.ParseCIDR(ipMask)
+		matched, err := isIPMatchedByFilter(parsedIP, ipMask)
 		if err != nil {
 			continue
 		}
-		if network.Contains(parsedIP) {
+		if matched {
 			return true, nil
 		}
 	}
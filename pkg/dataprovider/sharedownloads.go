@@ -0,0 +1,94 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"sync"
+)
+
+var (
+	shareDownloadsTracker = &shareDownloads{
+		downloads: make(map[string]map[string]int),
+	}
+)
+
+// shareDownloads keeps track of the downloads per IP address for the shares
+// with a max downloads per IP limit. Counters are kept in memory so they are
+// local to each SFTPGo instance and they are reset on restart
+type shareDownloads struct {
+	mu        sync.RWMutex
+	downloads map[string]map[string]int
+}
+
+func (d *shareDownloads) get(shareID, ip string) int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.downloads[shareID][ip]
+}
+
+func (d *shareDownloads) add(shareID, ip string, num int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	counters, ok := d.downloads[shareID]
+	if !ok {
+		if num <= 0 {
+			return
+		}
+		counters = make(map[string]int)
+		d.downloads[shareID] = counters
+	}
+	counters[ip] += num
+	if counters[ip] <= 0 {
+		delete(counters, ip)
+	}
+	if len(counters) == 0 {
+		delete(d.downloads, shareID)
+	}
+}
+
+func (d *shareDownloads) remove(shareID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.downloads, shareID)
+}
+
+// cleanup removes the counters for shares that no longer exist or no
+// longer limit the downloads per IP
+func (d *shareDownloads) cleanup(shares []Share) {
+	limited := make(map[string]bool)
+	for idx := range shares {
+		if shares[idx].MaxDownloadsPerIP > 0 {
+			limited[shares[idx].ShareID] = true
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for shareID := range d.downloads {
+		if !limited[shareID] {
+			delete(d.downloads, shareID)
+		}
+	}
+}
+
+// CleanupShareDownloads removes the per IP download counters not
+// referenced by the specified shares
+func CleanupShareDownloads(shares []Share) {
+	shareDownloadsTracker.cleanup(shares)
+}
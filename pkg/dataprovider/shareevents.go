@@ -0,0 +1,283 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// Supported share stats granularities
+const (
+	ShareStatsGranularityHour = "hour"
+	ShareStatsGranularityDay  = "day"
+)
+
+const (
+	// ShareEventsMaxLimit defines the maximum number of share events,
+	// the most recent ones, used to compute the share stats
+	ShareEventsMaxLimit        = 100000
+	shareStatsMaxBuckets       = 1000
+	shareStatsDefaultTopFiles  = 10
+	shareStatsMaxTopFiles      = 100
+	shareStatsRecentEvents     = 10
+	shareEventMaxUserAgentSize = 255
+)
+
+// ShareEventsConfig defines the configuration for the share access events
+type ShareEventsConfig struct {
+	// Set to true to record the share downloads within the data provider.
+	// The recorded events are used to compute the share stats
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// Number of days to keep the share events, older events are
+	// periodically removed. 0 means no automatic cleanup
+	Retention int `json:"retention" mapstructure:"retention"`
+}
+
+func (c *ShareEventsConfig) validate() error {
+	if c.Retention < 0 {
+		return fmt.Errorf("invalid share events retention: %d", c.Retention)
+	}
+	return nil
+}
+
+// ShareEvent defines a share access event
+type ShareEvent struct {
+	ID      int64  `json:"id"`
+	ShareID string `json:"share_id"`
+	// Unix timestamp in milliseconds
+	Timestamp int64  `json:"timestamp"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent,omitempty"`
+	// Virtual path of the downloaded file or directory
+	Path string `json:"path"`
+	// Downloaded bytes
+	Size int64 `json:"size"`
+}
+
+func (e *ShareEvent) validate() error {
+	if e.ShareID == "" {
+		return util.NewValidationError("share event share id is mandatory")
+	}
+	if e.Timestamp <= 0 {
+		return util.NewValidationError("share event timestamp is mandatory")
+	}
+	if len(e.UserAgent) > shareEventMaxUserAgentSize {
+		e.UserAgent = e.UserAgent[:shareEventMaxUserAgentSize]
+	}
+	return nil
+}
+
+// ShareStatsSearch defines the criteria to compute the share stats
+type ShareStatsSearch struct {
+	// Unix timestamps in milliseconds. By default the stats for the last
+	// 30 days are returned
+	From        int64
+	To          int64
+	Granularity string
+	// Number of most downloaded files to return
+	TopFiles int
+}
+
+func (s *ShareStatsSearch) validate() error {
+	if s.To <= 0 {
+		s.To = util.GetTimeAsMsSinceEpoch(time.Now())
+	}
+	if s.From <= 0 {
+		s.From = s.To - (30 * 24 * time.Hour).Milliseconds()
+	}
+	if s.From >= s.To {
+		return util.NewValidationError("the start time must be before the end time")
+	}
+	if s.Granularity == "" {
+		s.Granularity = ShareStatsGranularityDay
+	}
+	if s.Granularity != ShareStatsGranularityHour && s.Granularity != ShareStatsGranularityDay {
+		return util.NewValidationError(fmt.Sprintf("invalid granularity %q", s.Granularity))
+	}
+	if (s.To-s.From)/s.getBucketSize() >= shareStatsMaxBuckets {
+		return util.NewValidationError(fmt.Sprintf("the requested time range exceeds %d %ss",
+			shareStatsMaxBuckets, s.Granularity))
+	}
+	if s.TopFiles <= 0 {
+		s.TopFiles = shareStatsDefaultTopFiles
+	}
+	if s.TopFiles > shareStatsMaxTopFiles {
+		return util.NewValidationError(fmt.Sprintf("top files is out of the 1-%d range: %d",
+			shareStatsMaxTopFiles, s.TopFiles))
+	}
+	return nil
+}
+
+func (s *ShareStatsSearch) getBucketSize() int64 {
+	if s.Granularity == ShareStatsGranularityHour {
+		return time.Hour.Milliseconds()
+	}
+	return (24 * time.Hour).Milliseconds()
+}
+
+// ShareStatsBucket defines the share downloads within a time interval
+type ShareStatsBucket struct {
+	// Unix timestamp in milliseconds for the interval start
+	Timestamp int64 `json:"timestamp"`
+	Downloads int64 `json:"downloads"`
+	Bytes     int64 `json:"bytes"`
+}
+
+// ShareFileStats defines the downloads for a shared file or directory
+type ShareFileStats struct {
+	Path      string `json:"path"`
+	Downloads int64  `json:"downloads"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// ShareStats defines the aggregated stats for a share
+type ShareStats struct {
+	From        int64  `json:"from"`
+	To          int64  `json:"to"`
+	Granularity string `json:"granularity"`
+	Downloads   int64  `json:"downloads"`
+	Bytes       int64  `json:"bytes"`
+	UniqueIPs   int    `json:"unique_ips"`
+	// Unix timestamp in milliseconds of the most recent download
+	LastAccess   int64              `json:"last_access,omitempty"`
+	Timeline     []ShareStatsBucket `json:"timeline"`
+	TopFiles     []ShareFileStats   `json:"top_files"`
+	RecentEvents []ShareEvent       `json:"recent_events"`
+	// True if the stats are computed on the most recent events only
+	// because the events limit was reached
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// getShareStats aggregates the given events, they must be sorted by
+// timestamp in descending order
+func getShareStats(events []ShareEvent, filters *ShareStatsSearch) ShareStats {
+	bucketSize := filters.getBucketSize()
+	start := filters.From - filters.From%bucketSize
+	stats := ShareStats{
+		From:         filters.From,
+		To:           filters.To,
+		Granularity:  filters.Granularity,
+		Timeline:     make([]ShareStatsBucket, 0, (filters.To-start)/bucketSize+1),
+		TopFiles:     []ShareFileStats{},
+		RecentEvents: []ShareEvent{},
+		Truncated:    len(events) >= ShareEventsMaxLimit,
+	}
+	for ts := start; ts <= filters.To; ts += bucketSize {
+		stats.Timeline = append(stats.Timeline, ShareStatsBucket{Timestamp: ts})
+	}
+	ips := make(map[string]bool)
+	files := make(map[string]*ShareFileStats)
+	for idx := range events {
+		event := &events[idx]
+		stats.Downloads++
+		stats.Bytes += event.Size
+		ips[event.IP] = true
+		if event.Timestamp > stats.LastAccess {
+			stats.LastAccess = event.Timestamp
+		}
+		if pos := (event.Timestamp - start) / bucketSize; pos >= 0 && pos < int64(len(stats.Timeline)) {
+			stats.Timeline[pos].Downloads++
+			stats.Timeline[pos].Bytes += event.Size
+		}
+		fileStats, ok := files[event.Path]
+		if !ok {
+			fileStats = &ShareFileStats{Path: event.Path}
+			files[event.Path] = fileStats
+		}
+		fileStats.Downloads++
+		fileStats.Bytes += event.Size
+		if len(stats.RecentEvents) < shareStatsRecentEvents {
+			stats.RecentEvents = append(stats.RecentEvents, *event)
+		}
+	}
+	stats.UniqueIPs = len(ips)
+	for _, fileStats := range files {
+		stats.TopFiles = append(stats.TopFiles, *fileStats)
+	}
+	sort.Slice(stats.TopFiles, func(i, j int) bool {
+		if stats.TopFiles[i].Downloads == stats.TopFiles[j].Downloads {
+			return stats.TopFiles[i].Path < stats.TopFiles[j].Path
+		}
+		return stats.TopFiles[i].Downloads > stats.TopFiles[j].Downloads
+	})
+	if len(stats.TopFiles) > filters.TopFiles {
+		stats.TopFiles = stats.TopFiles[:filters.TopFiles]
+	}
+	return stats
+}
+
+func sortShareEvents(events []ShareEvent) {
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Timestamp == events[j].Timestamp {
+			return events[i].ID > events[j].ID
+		}
+		return events[i].Timestamp > events[j].Timestamp
+	})
+}
+
+// IsShareEventsEnabled returns true if the share access events are recorded
+func IsShareEventsEnabled() bool {
+	return config.ShareEvents.Enabled
+}
+
+// AddShareEvent records a share access event, if enabled
+func AddShareEvent(event *ShareEvent) {
+	if !config.ShareEvents.Enabled {
+		return
+	}
+	if event.Timestamp == 0 {
+		event.Timestamp = util.GetTimeAsMsSinceEpoch(time.Now())
+	}
+	if err := provider.addShareEvent(event); err != nil {
+		providerLog(logger.LevelError, "unable to add event for share %q: %v", event.ShareID, err)
+	}
+}
+
+// GetShareStats returns the aggregated stats for the specified share
+func GetShareStats(shareID, username string, filters *ShareStatsSearch) (ShareStats, error) {
+	if err := filters.validate(); err != nil {
+		return ShareStats{}, err
+	}
+	if _, err := provider.shareExists(shareID, username); err != nil {
+		return ShareStats{}, err
+	}
+	events, err := provider.getShareEvents(shareID, filters.From, filters.To, ShareEventsMaxLimit)
+	if err != nil {
+		return ShareStats{}, err
+	}
+	return getShareStats(events, filters), nil
+}
+
+// CleanupShareEvents removes the share events older than the specified time
+func CleanupShareEvents(before time.Time) error {
+	return provider.cleanupShareEvents(util.GetTimeAsMsSinceEpoch(before))
+}
+
+func checkShareEventsRetention() {
+	if !config.ShareEvents.Enabled || config.ShareEvents.Retention <= 0 {
+		return
+	}
+	before := time.Now().Add(-time.Duration(config.ShareEvents.Retention) * 24 * time.Hour)
+	if err := CleanupShareEvents(before); err != nil {
+		providerLog(logger.LevelError, "unable to cleanup share events older than %s: %v", before, err)
+		return
+	}
+	providerLog(logger.LevelDebug, "share events older than %s removed", before)
+}
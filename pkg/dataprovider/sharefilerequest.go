@@ -0,0 +1,139 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	// ShareFileRequestDefaultTemplate defines the default naming template
+	// for the files uploaded to a file request
+	ShareFileRequestDefaultTemplate = "{{date}}-{{uploader}}-{{name}}"
+	// ShareFileRequestUploaderField defines the form field, and the metadata
+	// key, for the uploader name
+	ShareFileRequestUploaderField  = "uploader"
+	maxShareFileRequestTemplateLen = 255
+	maxShareFileRequestUploaderLen = 255
+	// max length, in runes, of the uploader name used within file names
+	maxShareFileRequestUploaderNameLen = 64
+	shareFileRequestAnonymous          = "anonymous"
+)
+
+// ShareFileRequest defines the settings for shares with the file request scope
+type ShareFileRequest struct {
+	// Template used to name the uploaded files. Supported placeholders:
+	// {{date}}, {{time}}, {{uploader}}, {{name}}, {{basename}}, {{ext}}
+	NameTemplate string `json:"name_template,omitempty"`
+	// If true the uploaders must provide their name
+	RequireUploader bool `json:"require_uploader,omitempty"`
+}
+
+func (r *ShareFileRequest) getACopy() *ShareFileRequest {
+	if r == nil {
+		return nil
+	}
+	return &ShareFileRequest{
+		NameTemplate:    r.NameTemplate,
+		RequireUploader: r.RequireUploader,
+	}
+}
+
+func (r *ShareFileRequest) validate() error {
+	r.NameTemplate = strings.TrimSpace(r.NameTemplate)
+	if r.NameTemplate == "" {
+		r.NameTemplate = ShareFileRequestDefaultTemplate
+	}
+	if len(r.NameTemplate) > maxShareFileRequestTemplateLen {
+		return util.NewValidationError("the file request name template is too long")
+	}
+	if strings.ContainsAny(r.NameTemplate, `/\`) {
+		return util.NewValidationError("the file request name template cannot contain path separators")
+	}
+	return nil
+}
+
+// GetUploader validates and returns the submitted uploader name
+func (r *ShareFileRequest) GetUploader(values url.Values) (string, error) {
+	uploader := strings.TrimSpace(values.Get(ShareFileRequestUploaderField))
+	if uploader == "" && r.RequireUploader {
+		return "", util.NewValidationError("your name is required")
+	}
+	if len(uploader) > maxShareFileRequestUploaderLen {
+		return "", util.NewValidationError("your name is too long")
+	}
+	return uploader, nil
+}
+
+// GetFileName returns the name for an uploaded file applying the configured
+// template. The returned name never contains path separators
+func (r *ShareFileRequest) GetFileName(name, uploader string, t time.Time) string {
+	name = path.Base(util.CleanPath(name))
+	ext := path.Ext(name)
+	uploader = sanitizeShareFileRequestUploader(uploader)
+	replacer := strings.NewReplacer(
+		"{{date}}", t.Format("2006-01-02"),
+		"{{time}}", t.Format("150405"),
+		"{{uploader}}", uploader,
+		"{{name}}", name,
+		"{{basename}}", strings.TrimSuffix(name, ext),
+		"{{ext}}", ext,
+	)
+	result := strings.TrimSpace(replacer.Replace(r.NameTemplate))
+	result = strings.NewReplacer("/", "_", `\`, "_").Replace(result)
+	if result == "" || result == "." || result == ".." {
+		return name
+	}
+	return result
+}
+
+// GetShareFileNameVariant returns the specified file name with a numeric
+// suffix before the extension, it is used to avoid overwriting existing files
+func GetShareFileNameVariant(name string, n int) string {
+	if n <= 0 {
+		return name
+	}
+	ext := path.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), n, ext)
+}
+
+func sanitizeShareFileRequestUploader(uploader string) string {
+	var result []rune
+	for _, c := range strings.TrimSpace(uploader) {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) || strings.ContainsRune("._-@", c) {
+			result = append(result, c)
+		} else {
+			result = append(result, '_')
+		}
+		if len(result) == maxShareFileRequestUploaderNameLen {
+			break
+		}
+	}
+	sanitized := strings.Trim(string(result), ".")
+	if sanitized == "" {
+		return shareFileRequestAnonymous
+	}
+	return sanitized
+}
@@ -0,0 +1,210 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// Supported field types for upload portals
+const (
+	SharePortalFieldText     = "text"
+	SharePortalFieldTextArea = "textarea"
+	SharePortalFieldEmail    = "email"
+	SharePortalFieldNumber   = "number"
+	SharePortalFieldDate     = "date"
+)
+
+const (
+	maxSharePortalFields   = 20
+	maxSharePortalTitleLen = 255
+	maxSharePortalTextLen  = 4096
+	maxSharePortalLabelLen = 255
+	maxSharePortalValueLen = maxFileMetadataValueLen
+	sharePortalDateFormat  = "2006-01-02"
+)
+
+var (
+	sharePortalFieldTypes     = []string{SharePortalFieldText, SharePortalFieldTextArea, SharePortalFieldEmail, SharePortalFieldNumber, SharePortalFieldDate}
+	sharePortalFieldNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+	sharePortalReservedFields = []string{"filenames", ShareFileRequestUploaderField}
+)
+
+// SharePortalField defines a form field for an upload portal
+type SharePortalField struct {
+	// Field name, the submitted value is stored as file metadata using this key
+	Name string `json:"name"`
+	// Label to show in the portal page, the name is used if empty
+	Label string `json:"label,omitempty"`
+	// Field type: text, textarea, email, number, date
+	Type string `json:"type"`
+	// Required fields must be filled before uploading
+	Required bool `json:"required,omitempty"`
+}
+
+// GetLabel returns the label to show for this field
+func (f *SharePortalField) GetLabel() string {
+	if f.Label != "" {
+		return f.Label
+	}
+	return f.Name
+}
+
+func (f *SharePortalField) validate() error {
+	if !sharePortalFieldNameRegex.MatchString(f.Name) {
+		return util.NewValidationError(fmt.Sprintf("invalid portal field name %q, only letters, numbers, _ and - are allowed, max 64 characters",
+			f.Name))
+	}
+	if util.Contains(sharePortalReservedFields, f.Name) {
+		return util.NewValidationError(fmt.Sprintf("%q is a reserved portal field name", f.Name))
+	}
+	f.Label = strings.TrimSpace(f.Label)
+	if len(f.Label) > maxSharePortalLabelLen {
+		return util.NewValidationError(fmt.Sprintf("the label for the portal field %q is too long", f.Name))
+	}
+	if f.Type == "" {
+		f.Type = SharePortalFieldText
+	}
+	if !util.Contains(sharePortalFieldTypes, f.Type) {
+		return util.NewValidationError(fmt.Sprintf("invalid type %q for the portal field %q", f.Type, f.Name))
+	}
+	return nil
+}
+
+func (f *SharePortalField) validateValue(value string) error {
+	if value == "" {
+		if f.Required {
+			return util.NewValidationError(fmt.Sprintf("%q is required", f.GetLabel()))
+		}
+		return nil
+	}
+	if len(value) > maxSharePortalValueLen {
+		return util.NewValidationError(fmt.Sprintf("%q is too long", f.GetLabel()))
+	}
+	switch f.Type {
+	case SharePortalFieldEmail:
+		if !util.IsEmailValid(value) {
+			return util.NewValidationError(fmt.Sprintf("%q must be a valid email address", f.GetLabel()))
+		}
+	case SharePortalFieldNumber:
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return util.NewValidationError(fmt.Sprintf("%q must be a number", f.GetLabel()))
+		}
+	case SharePortalFieldDate:
+		if _, err := time.Parse(sharePortalDateFormat, value); err != nil {
+			return util.NewValidationError(fmt.Sprintf("%q must be a date in YYYY-MM-DD format", f.GetLabel()))
+		}
+	}
+	return nil
+}
+
+// SharePortal defines the customizable public page for shares with the
+// upload portal scope
+type SharePortal struct {
+	// Title for the portal page, the share name is used if empty
+	Title string `json:"title,omitempty"`
+	// Text to show above the upload form
+	Text string `json:"text,omitempty"`
+	// Logo URL, it must be an HTTP/S URL or an absolute path
+	LogoURL string `json:"logo_url,omitempty"`
+	// Form fields to fill before uploading
+	Fields []SharePortalField `json:"fields,omitempty"`
+}
+
+func (p *SharePortal) getACopy() *SharePortal {
+	if p == nil {
+		return nil
+	}
+	fields := make([]SharePortalField, len(p.Fields))
+	copy(fields, p.Fields)
+	return &SharePortal{
+		Title:   p.Title,
+		Text:    p.Text,
+		LogoURL: p.LogoURL,
+		Fields:  fields,
+	}
+}
+
+func (p *SharePortal) validateLogoURL() error {
+	if p.LogoURL == "" {
+		return nil
+	}
+	u, err := url.Parse(p.LogoURL)
+	if err != nil {
+		return util.NewValidationError(fmt.Sprintf("invalid portal logo URL: %v", err))
+	}
+	if u.Scheme == "" && u.Host == "" && strings.HasPrefix(p.LogoURL, "/") && !strings.HasPrefix(p.LogoURL, "//") {
+		return nil
+	}
+	if (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+		return nil
+	}
+	return util.NewValidationError("the portal logo URL must be an HTTP/S URL or an absolute path")
+}
+
+func (p *SharePortal) validate() error {
+	p.Title = strings.TrimSpace(p.Title)
+	if len(p.Title) > maxSharePortalTitleLen {
+		return util.NewValidationError("the portal title is too long")
+	}
+	p.Text = strings.TrimSpace(p.Text)
+	if len(p.Text) > maxSharePortalTextLen {
+		return util.NewValidationError("the portal text is too long")
+	}
+	p.LogoURL = strings.TrimSpace(p.LogoURL)
+	if err := p.validateLogoURL(); err != nil {
+		return err
+	}
+	if len(p.Fields) > maxSharePortalFields {
+		return util.NewValidationError(fmt.Sprintf("too many portal fields, max allowed: %d", maxSharePortalFields))
+	}
+	names := make(map[string]bool)
+	for idx := range p.Fields {
+		f := &p.Fields[idx]
+		f.Name = strings.TrimSpace(f.Name)
+		if err := f.validate(); err != nil {
+			return err
+		}
+		if names[f.Name] {
+			return util.NewValidationError(fmt.Sprintf("duplicated portal field %q", f.Name))
+		}
+		names[f.Name] = true
+	}
+	return nil
+}
+
+// GetMetadata validates the submitted values for the portal fields and
+// returns them as file metadata. Values for unknown fields are ignored
+func (p *SharePortal) GetMetadata(values url.Values) (map[string]string, error) {
+	result := make(map[string]string)
+	for idx := range p.Fields {
+		f := &p.Fields[idx]
+		value := strings.TrimSpace(values.Get(f.Name))
+		if err := f.validateValue(value); err != nil {
+			return nil, err
+		}
+		if value != "" {
+			result[f.Name] = value
+		}
+	}
+	return result, nil
+}
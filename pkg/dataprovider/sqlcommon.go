@@ -35,7 +35,7 @@ import (
 )
 
 const (
-	sqlDatabaseVersion     = 28
+	sqlDatabaseVersion     = 39
 	defaultSQLQueryTimeout = 10 * time.Second
 	longSQLQueryTimeout    = 60 * time.Second
 )
@@ -80,8 +80,13 @@ func sqlReplaceAll(sql string) string {
 	sql = strings.ReplaceAll(sql, "{{tasks}}", sqlTableTasks)
 	sql = strings.ReplaceAll(sql, "{{nodes}}", sqlTableNodes)
 	sql = strings.ReplaceAll(sql, "{{roles}}", sqlTableRoles)
+	sql = strings.ReplaceAll(sql, "{{admin_roles}}", sqlTableAdminRoles)
 	sql = strings.ReplaceAll(sql, "{{ip_lists}}", sqlTableIPLists)
 	sql = strings.ReplaceAll(sql, "{{configs}}", sqlTableConfigs)
+	sql = strings.ReplaceAll(sql, "{{files_metadata}}", sqlTableFilesMetadata)
+	sql = strings.ReplaceAll(sql, "{{events_digests}}", sqlTableEventsDigests)
+	sql = strings.ReplaceAll(sql, "{{audit_logs}}", sqlTableAuditLogs)
+	sql = strings.ReplaceAll(sql, "{{share_events}}", sqlTableShareEvents)
 	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
 	return sql
 }
@@ -126,6 +131,11 @@ func sqlCommonAddShare(share *Share, dbHandle *sql.DB) error {
 		}
 	}
 
+	options, err := getShareOptionsForDB(share)
+	if err != nil {
+		return err
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
 
@@ -146,7 +156,7 @@ func sqlCommonAddShare(share *Share, dbHandle *sql.DB) error {
 	}
 	_, err = dbHandle.ExecContext(ctx, q, share.ShareID, share.Name, share.Description, share.Scope,
 		paths, createdAt, updatedAt, lastUseAt, share.ExpiresAt, share.Password,
-		share.MaxTokens, usedTokens, allowFrom, user.ID)
+		share.MaxTokens, usedTokens, allowFrom, options, user.ID)
 	return err
 }
 
@@ -169,6 +179,11 @@ func sqlCommonUpdateShare(share *Share, dbHandle *sql.DB) error {
 		}
 	}
 
+	options, err := getShareOptionsForDB(share)
+	if err != nil {
+		return err
+	}
+
 	user, err := provider.userExists(share.Username, "")
 	if err != nil {
 		return util.NewGenericError(fmt.Sprintf("unable to validate user %q", share.Username))
@@ -194,11 +209,11 @@ func sqlCommonUpdateShare(share *Share, dbHandle *sql.DB) error {
 		}
 		res, err = dbHandle.ExecContext(ctx, q, share.Name, share.Description, share.Scope, paths,
 			share.CreatedAt, share.UpdatedAt, share.LastUseAt, share.ExpiresAt, share.Password, share.MaxTokens,
-			share.UsedTokens, allowFrom, user.ID, share.ShareID)
+			share.UsedTokens, allowFrom, options, user.ID, share.ShareID)
 	} else {
 		res, err = dbHandle.ExecContext(ctx, q, share.Name, share.Description, share.Scope, paths,
 			util.GetTimeAsMsSinceEpoch(time.Now()), share.ExpiresAt, share.Password, share.MaxTokens,
-			allowFrom, user.ID, share.ShareID)
+			allowFrom, options, user.ID, share.ShareID)
 	}
 	if err != nil {
 		return err
@@ -290,13 +305,18 @@ func sqlCommonAddAPIKey(apiKey *APIKey, dbHandle *sql.DB) error {
 		return err
 	}
 
+	filters, err := json.Marshal(apiKey.Filters)
+	if err != nil {
+		return err
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
 
 	q := getAddAPIKeyQuery()
 	_, err = dbHandle.ExecContext(ctx, q, apiKey.KeyID, apiKey.Name, apiKey.Key, apiKey.Scope,
 		util.GetTimeAsMsSinceEpoch(time.Now()), util.GetTimeAsMsSinceEpoch(time.Now()), apiKey.LastUseAt,
-		apiKey.ExpiresAt, apiKey.Description, userID, adminID)
+		apiKey.ExpiresAt, apiKey.Description, userID, adminID, filters)
 	return err
 }
 
@@ -311,12 +331,39 @@ func sqlCommonUpdateAPIKey(apiKey *APIKey, dbHandle *sql.DB) error {
 		return err
 	}
 
+	filters, err := json.Marshal(apiKey.Filters)
+	if err != nil {
+		return err
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
 
 	q := getUpdateAPIKeyQuery()
 	res, err := dbHandle.ExecContext(ctx, q, apiKey.Name, apiKey.Scope, apiKey.ExpiresAt, userID, adminID,
-		apiKey.Description, util.GetTimeAsMsSinceEpoch(time.Now()), apiKey.KeyID)
+		apiKey.Description, util.GetTimeAsMsSinceEpoch(time.Now()), filters, apiKey.KeyID)
+	if err != nil {
+		return err
+	}
+	return sqlCommonRequireRowAffected(res)
+}
+
+func sqlCommonRotateAPIKey(apiKey *APIKey, dbHandle *sql.DB) error {
+	err := apiKey.validate()
+	if err != nil {
+		return err
+	}
+
+	filters, err := json.Marshal(apiKey.Filters)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+
+	q := getRotateAPIKeyQuery()
+	res, err := dbHandle.ExecContext(ctx, q, apiKey.Key, filters, util.GetTimeAsMsSinceEpoch(time.Now()), apiKey.KeyID)
 	if err != nil {
 		return err
 	}
@@ -442,10 +489,10 @@ func sqlCommonAddAdmin(admin *Admin, dbHandle *sql.DB) error {
 	defer cancel()
 
 	return sqlCommonExecuteTx(ctx, dbHandle, func(tx *sql.Tx) error {
-		q := getAddAdminQuery(admin.Role)
+		q := getAddAdminQuery(admin.Role, admin.AdminRole)
 		_, err = tx.ExecContext(ctx, q, admin.Username, admin.Password, admin.Status, admin.Email, perms,
 			filters, admin.AdditionalInfo, admin.Description, util.GetTimeAsMsSinceEpoch(time.Now()),
-			util.GetTimeAsMsSinceEpoch(time.Now()), admin.Role)
+			util.GetTimeAsMsSinceEpoch(time.Now()), admin.Role, admin.AdminRole)
 		if err != nil {
 			return err
 		}
@@ -473,9 +520,10 @@ func sqlCommonUpdateAdmin(admin *Admin, dbHandle *sql.DB) error {
 	defer cancel()
 
 	return sqlCommonExecuteTx(ctx, dbHandle, func(tx *sql.Tx) error {
-		q := getUpdateAdminQuery(admin.Role)
+		q := getUpdateAdminQuery(admin.Role, admin.AdminRole)
 		_, err = tx.ExecContext(ctx, q, admin.Password, admin.Status, admin.Email, perms, filters,
-			admin.AdditionalInfo, admin.Description, util.GetTimeAsMsSinceEpoch(time.Now()), admin.Role, admin.Username)
+			admin.AdditionalInfo, admin.Description, util.GetTimeAsMsSinceEpoch(time.Now()), admin.Role,
+			admin.AdminRole, admin.Username)
 		if err != nil {
 			return err
 		}
@@ -869,12 +917,16 @@ func sqlCommonAddRole(role *Role, dbHandle *sql.DB) error {
 	if err := role.validate(); err != nil {
 		return err
 	}
+	tenant, err := getRoleTenantForDB(role)
+	if err != nil {
+		return err
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
 
 	q := getAddRoleQuery()
-	_, err := dbHandle.ExecContext(ctx, q, role.Name, role.Description, util.GetTimeAsMsSinceEpoch(time.Now()),
-		util.GetTimeAsMsSinceEpoch(time.Now()))
+	_, err = dbHandle.ExecContext(ctx, q, role.Name, role.Description, util.GetTimeAsMsSinceEpoch(time.Now()),
+		util.GetTimeAsMsSinceEpoch(time.Now()), tenant)
 	return err
 }
 
@@ -882,11 +934,15 @@ func sqlCommonUpdateRole(role *Role, dbHandle *sql.DB) error {
 	if err := role.validate(); err != nil {
 		return err
 	}
+	tenant, err := getRoleTenantForDB(role)
+	if err != nil {
+		return err
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
 
 	q := getUpdateRoleQuery()
-	res, err := dbHandle.ExecContext(ctx, q, role.Description, util.GetTimeAsMsSinceEpoch(time.Now()), role.Name)
+	res, err := dbHandle.ExecContext(ctx, q, role.Description, util.GetTimeAsMsSinceEpoch(time.Now()), tenant, role.Name)
 	if err != nil {
 		return err
 	}
@@ -905,6 +961,141 @@ func sqlCommonDeleteRole(role Role, dbHandle *sql.DB) error {
 	return sqlCommonRequireRowAffected(res)
 }
 
+func sqlCommonGetAdminRoleByName(name string, dbHandle sqlQuerier) (AdminRole, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+
+	q := getAdminRoleByNameQuery()
+	row := dbHandle.QueryRowContext(ctx, q, name)
+	role, err := getAdminRoleFromDbRow(row)
+	if err != nil {
+		return role, err
+	}
+	roles, err := getAdminRolesWithAdmins(ctx, []AdminRole{role}, dbHandle)
+	if err != nil {
+		return role, err
+	}
+	if len(roles) == 0 {
+		return role, errors.New("unable to associate admins with admin role")
+	}
+	return roles[0], nil
+}
+
+func sqlCommonDumpAdminRoles(dbHandle sqlQuerier) ([]AdminRole, error) {
+	roles := make([]AdminRole, 0, 10)
+	ctx, cancel := context.WithTimeout(context.Background(), longSQLQueryTimeout)
+	defer cancel()
+
+	q := getDumpAdminRolesQuery()
+
+	rows, err := dbHandle.QueryContext(ctx, q)
+	if err != nil {
+		return roles, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		role, err := getAdminRoleFromDbRow(rows)
+		if err != nil {
+			return roles, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func sqlCommonGetAdminRoles(limit int, offset int, order string, minimal bool, dbHandle sqlQuerier) ([]AdminRole, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+
+	q := getAdminRolesQuery(order, minimal)
+
+	roles := make([]AdminRole, 0, limit)
+	rows, err := dbHandle.QueryContext(ctx, q, limit, offset)
+	if err != nil {
+		return roles, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var role AdminRole
+		if minimal {
+			err = rows.Scan(&role.ID, &role.Name)
+		} else {
+			role, err = getAdminRoleFromDbRow(rows)
+		}
+		if err != nil {
+			return roles, err
+		}
+		roles = append(roles, role)
+	}
+	err = rows.Err()
+	if err != nil {
+		return roles, err
+	}
+	if minimal {
+		return roles, nil
+	}
+	return getAdminRolesWithAdmins(ctx, roles, dbHandle)
+}
+
+func sqlCommonAddAdminRole(role *AdminRole, dbHandle *sql.DB) error {
+	if err := role.validate(); err != nil {
+		return err
+	}
+	perms, err := json.Marshal(role.Permissions)
+	if err != nil {
+		return err
+	}
+	filters, err := json.Marshal(role.Filters)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+
+	q := getAddAdminRoleQuery()
+	_, err = dbHandle.ExecContext(ctx, q, role.Name, role.Description, util.GetTimeAsMsSinceEpoch(time.Now()),
+		util.GetTimeAsMsSinceEpoch(time.Now()), perms, filters)
+	return err
+}
+
+func sqlCommonUpdateAdminRole(role *AdminRole, dbHandle *sql.DB) error {
+	if err := role.validate(); err != nil {
+		return err
+	}
+	perms, err := json.Marshal(role.Permissions)
+	if err != nil {
+		return err
+	}
+	filters, err := json.Marshal(role.Filters)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+
+	q := getUpdateAdminRoleQuery()
+	res, err := dbHandle.ExecContext(ctx, q, role.Description, util.GetTimeAsMsSinceEpoch(time.Now()), perms,
+		filters, role.Name)
+	if err != nil {
+		return err
+	}
+	return sqlCommonRequireRowAffected(res)
+}
+
+func sqlCommonDeleteAdminRole(role AdminRole, dbHandle *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+
+	q := getDeleteAdminRoleQuery()
+	res, err := dbHandle.ExecContext(ctx, q, role.Name)
+	if err != nil {
+		return err
+	}
+	return sqlCommonRequireRowAffected(res)
+}
+
 func sqlCommonGetGroupByName(name string, dbHandle sqlQuerier) (Group, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
@@ -1041,14 +1232,20 @@ func sqlCommonGetGroupsWithNames(names []string, dbHandle sqlQuerier) ([]Group,
 	return getGroupsWithVirtualFolders(ctx, groups, dbHandle)
 }
 
-func sqlCommonGetGroups(limit int, offset int, order string, minimal bool, dbHandle sqlQuerier) ([]Group, error) {
+func sqlCommonGetGroups(limit int, offset int, order string, minimal bool, role string, dbHandle sqlQuerier) ([]Group, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
 
-	q := getGroupsQuery(order, minimal)
+	q := getGroupsQuery(order, minimal, role)
+	var args []any
+	if role == "" {
+		args = append(args, limit, offset)
+	} else {
+		args = append(args, role, limit, offset)
+	}
 
 	groups := make([]Group, 0, limit)
-	rows, err := dbHandle.QueryContext(ctx, q, limit, offset)
+	rows, err := dbHandle.QueryContext(ctx, q, args...)
 	if err != nil {
 		return groups, err
 	}
@@ -1103,9 +1300,9 @@ func sqlCommonAddGroup(group *Group, dbHandle *sql.DB) error {
 	defer cancel()
 
 	return sqlCommonExecuteTx(ctx, dbHandle, func(tx *sql.Tx) error {
-		q := getAddGroupQuery()
+		q := getAddGroupQuery(group.Role)
 		_, err := tx.ExecContext(ctx, q, group.Name, group.Description, util.GetTimeAsMsSinceEpoch(time.Now()),
-			util.GetTimeAsMsSinceEpoch(time.Now()), settings)
+			util.GetTimeAsMsSinceEpoch(time.Now()), settings, group.Role)
 		if err != nil {
 			return err
 		}
@@ -1126,8 +1323,9 @@ func sqlCommonUpdateGroup(group *Group, dbHandle *sql.DB) error {
 	defer cancel()
 
 	return sqlCommonExecuteTx(ctx, dbHandle, func(tx *sql.Tx) error {
-		q := getUpdateGroupQuery()
-		_, err := tx.ExecContext(ctx, q, group.Description, settings, util.GetTimeAsMsSinceEpoch(time.Now()), group.Name)
+		q := getUpdateGroupQuery(group.Role)
+		_, err := tx.ExecContext(ctx, q, group.Description, settings, util.GetTimeAsMsSinceEpoch(time.Now()), group.Role,
+			group.Name)
 		if err != nil {
 			return err
 		}
@@ -1168,13 +1366,13 @@ func sqlCommonGetUserByUsername(username, role string, dbHandle sqlQuerier) (Use
 	return getUserWithGroups(ctx, user, dbHandle)
 }
 
-func sqlCommonValidateUserAndPass(username, password, ip, protocol string, dbHandle *sql.DB) (User, error) {
+func sqlCommonValidateUserAndPass(ctx context.Context, username, password, ip, protocol string, dbHandle *sql.DB) (User, error) {
 	user, err := sqlCommonGetUserByUsername(username, "", dbHandle)
 	if err != nil {
 		providerLog(logger.LevelWarn, "error authenticating user %q: %v", username, err)
 		return user, err
 	}
-	return checkUserAndPass(&user, password, ip, protocol)
+	return checkUserAndPass(ctx, &user, password, ip, protocol)
 }
 
 func sqlCommonValidateUserAndTLSCertificate(username, protocol string, tlsCert *x509.Certificate, dbHandle *sql.DB) (User, error) {
@@ -2009,13 +2207,13 @@ func sqlCommonCleanupDefenderEvents(from int64, dbHandle *sql.DB) error {
 
 func getShareFromDbRow(row sqlScanner) (Share, error) {
 	var share Share
-	var description, password sql.NullString
+	var description, password, options sql.NullString
 	var allowFrom, paths []byte
 
 	err := row.Scan(&share.ShareID, &share.Name, &description, &share.Scope,
 		&paths, &share.Username, &share.CreatedAt, &share.UpdatedAt,
 		&share.LastUseAt, &share.ExpiresAt, &password, &share.MaxTokens,
-		&share.UsedTokens, &allowFrom)
+		&share.UsedTokens, &allowFrom, &options)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return share, util.NewRecordNotFoundError(err.Error())
@@ -2039,16 +2237,64 @@ func getShareFromDbRow(row sqlScanner) (Share, error) {
 	if err == nil {
 		share.AllowFrom = list
 	}
+	setShareOptionsFromDB(&share, options)
 	return share, nil
 }
 
+// shareOptions defines the share settings stored as JSON in the options column
+type shareOptions struct {
+	Portal                 *SharePortal      `json:"portal,omitempty"`
+	FileRequest            *ShareFileRequest `json:"file_request,omitempty"`
+	MaxDownloadsPerIP      int               `json:"max_downloads_per_ip,omitempty"`
+	BurnAfterDownload      bool              `json:"burn_after_download,omitempty"`
+	NotifyOnUse            bool              `json:"notify_on_use,omitempty"`
+	NotifyBeforeExpiration int               `json:"notify_before_expiration,omitempty"`
+}
+
+func getShareOptionsForDB(share *Share) (sql.NullString, error) {
+	options := shareOptions{
+		Portal:                 share.Portal,
+		FileRequest:            share.FileRequest,
+		MaxDownloadsPerIP:      share.MaxDownloadsPerIP,
+		BurnAfterDownload:      share.BurnAfterDownload,
+		NotifyOnUse:            share.NotifyOnUse,
+		NotifyBeforeExpiration: share.NotifyBeforeExpiration,
+	}
+	if options == (shareOptions{}) {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(options)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+func setShareOptionsFromDB(share *Share, options sql.NullString) {
+	if !options.Valid || options.String == "" {
+		return
+	}
+	var result shareOptions
+	if err := json.Unmarshal([]byte(options.String), &result); err != nil {
+		providerLog(logger.LevelError, "unable to decode the options for share %q: %v", share.ShareID, err)
+		return
+	}
+	share.Portal = result.Portal
+	share.FileRequest = result.FileRequest
+	share.MaxDownloadsPerIP = result.MaxDownloadsPerIP
+	share.BurnAfterDownload = result.BurnAfterDownload
+	share.NotifyOnUse = result.NotifyOnUse
+	share.NotifyBeforeExpiration = result.NotifyBeforeExpiration
+}
+
 func getAPIKeyFromDbRow(row sqlScanner) (APIKey, error) {
 	var apiKey APIKey
 	var userID, adminID sql.NullInt64
 	var description sql.NullString
+	var filters []byte
 
 	err := row.Scan(&apiKey.KeyID, &apiKey.Name, &apiKey.Key, &apiKey.Scope, &apiKey.CreatedAt, &apiKey.UpdatedAt,
-		&apiKey.LastUseAt, &apiKey.ExpiresAt, &description, &userID, &adminID)
+		&apiKey.LastUseAt, &apiKey.ExpiresAt, &description, &userID, &adminID, &filters)
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -2066,17 +2312,24 @@ func getAPIKeyFromDbRow(row sqlScanner) (APIKey, error) {
 	if description.Valid {
 		apiKey.Description = description.String
 	}
+	if len(filters) > 0 {
+		var keyFilters APIKeyFilters
+		if err := json.Unmarshal(filters, &keyFilters); err == nil {
+			apiKey.Filters = keyFilters
+		}
+	}
 
 	return apiKey, nil
 }
 
 func getAdminFromDbRow(row sqlScanner) (Admin, error) {
 	var admin Admin
-	var email, additionalInfo, description, role sql.NullString
+	var email, additionalInfo, description, role, adminRole sql.NullString
 	var permissions, filters []byte
 
 	err := row.Scan(&admin.ID, &admin.Username, &admin.Password, &admin.Status, &email, &permissions,
-		&filters, &additionalInfo, &description, &admin.CreatedAt, &admin.UpdatedAt, &admin.LastLogin, &role)
+		&filters, &additionalInfo, &description, &admin.CreatedAt, &admin.UpdatedAt, &admin.LastLogin, &role,
+		&adminRole)
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -2110,6 +2363,9 @@ func getAdminFromDbRow(row sqlScanner) (Admin, error) {
 	if role.Valid {
 		admin.Role = role.String
 	}
+	if adminRole.Valid {
+		admin.AdminRole = adminRole.String
+	}
 
 	admin.SetEmptySecretsIfNil()
 	return admin, nil
@@ -2140,11 +2396,11 @@ func getEventActionFromDbRow(row sqlScanner) (BaseEventAction, error) {
 
 func getEventRuleFromDbRow(row sqlScanner) (EventRule, error) {
 	var rule EventRule
-	var description sql.NullString
+	var description, role sql.NullString
 	var conditions []byte
 
 	err := row.Scan(&rule.ID, &rule.Name, &description, &rule.CreatedAt, &rule.UpdatedAt, &rule.Trigger,
-		&conditions, &rule.DeletedAt, &rule.Status)
+		&conditions, &rule.DeletedAt, &rule.Status, &role)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return rule, util.NewRecordNotFoundError(err.Error())
@@ -2160,6 +2416,9 @@ func getEventRuleFromDbRow(row sqlScanner) (EventRule, error) {
 	if description.Valid {
 		rule.Description = description.String
 	}
+	if role.Valid {
+		rule.Role = role.String
+	}
 	return rule, nil
 }
 
@@ -2183,9 +2442,29 @@ func getIPListEntryFromDbRow(row sqlScanner) (IPListEntry, error) {
 
 func getRoleFromDbRow(row sqlScanner) (Role, error) {
 	var role Role
-	var description sql.NullString
+	var description, tenant sql.NullString
+
+	err := row.Scan(&role.ID, &role.Name, &description, &role.CreatedAt, &role.UpdatedAt, &tenant)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return role, util.NewRecordNotFoundError(err.Error())
+		}
+		return role, err
+	}
+	if description.Valid {
+		role.Description = description.String
+	}
+	role.Tenant = getRoleTenantFromDB(role.Name, tenant)
+
+	return role, nil
+}
 
-	err := row.Scan(&role.ID, &role.Name, &description, &role.CreatedAt, &role.UpdatedAt)
+func getAdminRoleFromDbRow(row sqlScanner) (AdminRole, error) {
+	var role AdminRole
+	var description, filters sql.NullString
+	var permissions []byte
+
+	err := row.Scan(&role.ID, &role.Name, &description, &role.CreatedAt, &role.UpdatedAt, &permissions, &filters)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return role, util.NewRecordNotFoundError(err.Error())
@@ -2195,16 +2474,52 @@ func getRoleFromDbRow(row sqlScanner) (Role, error) {
 	if description.Valid {
 		role.Description = description.String
 	}
+	var perms []string
+	err = json.Unmarshal(permissions, &perms)
+	if err != nil {
+		return role, err
+	}
+	role.Permissions = perms
+	if filters.Valid {
+		var roleFilters AdminRoleFilters
+		err = json.Unmarshal([]byte(filters.String), &roleFilters)
+		if err == nil {
+			role.Filters = roleFilters
+		}
+	}
 
 	return role, nil
 }
 
+func getRoleTenantForDB(role *Role) (sql.NullString, error) {
+	if role.Tenant == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(role.Tenant)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+func getRoleTenantFromDB(name string, tenant sql.NullString) *RoleTenant {
+	if !tenant.Valid || tenant.String == "" {
+		return nil
+	}
+	var result RoleTenant
+	if err := json.Unmarshal([]byte(tenant.String), &result); err != nil {
+		providerLog(logger.LevelError, "unable to decode the tenant settings for role %q: %v", name, err)
+		return nil
+	}
+	return &result
+}
+
 func getGroupFromDbRow(row sqlScanner) (Group, error) {
 	var group Group
-	var description sql.NullString
+	var description, role sql.NullString
 	var userSettings []byte
 
-	err := row.Scan(&group.ID, &group.Name, &description, &group.CreatedAt, &group.UpdatedAt, &userSettings)
+	err := row.Scan(&group.ID, &group.Name, &description, &group.CreatedAt, &group.UpdatedAt, &userSettings, &role)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return group, util.NewRecordNotFoundError(err.Error())
@@ -2214,6 +2529,9 @@ func getGroupFromDbRow(row sqlScanner) (Group, error) {
 	if description.Valid {
 		group.Description = description.String
 	}
+	if role.Valid {
+		group.Role = role.String
+	}
 
 	var settings GroupUserSettings
 	err = json.Unmarshal(userSettings, &settings)
@@ -2290,10 +2608,10 @@ func sqlCommonGetFolder(ctx context.Context, name string, dbHandle sqlQuerier) (
 	var folder vfs.BaseVirtualFolder
 	q := getFolderByNameQuery()
 	row := dbHandle.QueryRowContext(ctx, q, name)
-	var mappedPath, description sql.NullString
+	var mappedPath, description, failover, limits, role sql.NullString
 	var fsConfig []byte
 	err := row.Scan(&folder.ID, &mappedPath, &folder.UsedQuotaSize, &folder.UsedQuotaFiles, &folder.LastQuotaUpdate,
-		&folder.Name, &description, &fsConfig)
+		&folder.Name, &description, &fsConfig, &failover, &limits, &role)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return folder, util.NewRecordNotFoundError(err.Error())
@@ -2311,9 +2629,60 @@ func sqlCommonGetFolder(ctx context.Context, name string, dbHandle sqlQuerier) (
 	if err == nil {
 		folder.FsConfig = fs
 	}
+	folder.Failover = getFolderFailoverFromDB(folder.Name, failover)
+	folder.Limits = getFolderLimitsFromDB(folder.Name, limits)
+	if role.Valid {
+		folder.Role = role.String
+	}
 	return folder, err
 }
 
+func getFolderFailoverForDB(folder *vfs.BaseVirtualFolder) (sql.NullString, error) {
+	if folder.Failover == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(folder.Failover)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+func getFolderFailoverFromDB(name string, failover sql.NullString) *vfs.FolderFailover {
+	if !failover.Valid || failover.String == "" {
+		return nil
+	}
+	var result vfs.FolderFailover
+	if err := json.Unmarshal([]byte(failover.String), &result); err != nil {
+		providerLog(logger.LevelError, "unable to decode the failover configuration for folder %q: %v", name, err)
+		return nil
+	}
+	return &result
+}
+
+func getFolderLimitsForDB(folder *vfs.BaseVirtualFolder) (sql.NullString, error) {
+	if !folder.Limits.HasLimits() {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(folder.Limits)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+func getFolderLimitsFromDB(name string, limits sql.NullString) *vfs.FolderLimits {
+	if !limits.Valid || limits.String == "" {
+		return nil
+	}
+	var result vfs.FolderLimits
+	if err := json.Unmarshal([]byte(limits.String), &result); err != nil {
+		providerLog(logger.LevelError, "unable to decode the limits for folder %q: %v", name, err)
+		return nil
+	}
+	return &result
+}
+
 func sqlCommonGetFolderByName(ctx context.Context, name string, dbHandle sqlQuerier) (vfs.BaseVirtualFolder, error) {
 	folder, err := sqlCommonGetFolder(ctx, name, dbHandle)
 	if err != nil {
@@ -2343,9 +2712,17 @@ func sqlCommonAddOrUpdateFolder(ctx context.Context, baseFolder *vfs.BaseVirtual
 	if err != nil {
 		return err
 	}
-	q := getUpsertFolderQuery()
+	failover, err := getFolderFailoverForDB(baseFolder)
+	if err != nil {
+		return err
+	}
+	limits, err := getFolderLimitsForDB(baseFolder)
+	if err != nil {
+		return err
+	}
+	q := getUpsertFolderQuery(baseFolder.Role)
 	_, err = dbHandle.ExecContext(ctx, q, baseFolder.MappedPath, usedQuotaSize, usedQuotaFiles,
-		lastQuotaUpdate, baseFolder.Name, baseFolder.Description, fsConfig)
+		lastQuotaUpdate, baseFolder.Name, baseFolder.Description, fsConfig, failover, limits, baseFolder.Role)
 	return err
 }
 
@@ -2358,12 +2735,20 @@ func sqlCommonAddFolder(folder *vfs.BaseVirtualFolder, dbHandle sqlQuerier) erro
 	if err != nil {
 		return err
 	}
+	failover, err := getFolderFailoverForDB(folder)
+	if err != nil {
+		return err
+	}
+	limits, err := getFolderLimitsForDB(folder)
+	if err != nil {
+		return err
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
 
-	q := getAddFolderQuery()
+	q := getAddFolderQuery(folder.Role)
 	_, err = dbHandle.ExecContext(ctx, q, folder.MappedPath, folder.UsedQuotaSize, folder.UsedQuotaFiles,
-		folder.LastQuotaUpdate, folder.Name, folder.Description, fsConfig)
+		folder.LastQuotaUpdate, folder.Name, folder.Description, fsConfig, failover, limits, folder.Role)
 	return err
 }
 
@@ -2376,11 +2761,20 @@ func sqlCommonUpdateFolder(folder *vfs.BaseVirtualFolder, dbHandle sqlQuerier) e
 	if err != nil {
 		return err
 	}
+	failover, err := getFolderFailoverForDB(folder)
+	if err != nil {
+		return err
+	}
+	limits, err := getFolderLimitsForDB(folder)
+	if err != nil {
+		return err
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
 
-	q := getUpdateFolderQuery()
-	res, err := dbHandle.ExecContext(ctx, q, folder.MappedPath, folder.Description, fsConfig, folder.Name)
+	q := getUpdateFolderQuery(folder.Role)
+	res, err := dbHandle.ExecContext(ctx, q, folder.MappedPath, folder.Description, fsConfig, failover, limits,
+		folder.Role, folder.Name)
 	if err != nil {
 		return err
 	}
@@ -2412,10 +2806,10 @@ func sqlCommonDumpFolders(dbHandle sqlQuerier) ([]vfs.BaseVirtualFolder, error)
 	defer rows.Close()
 	for rows.Next() {
 		var folder vfs.BaseVirtualFolder
-		var mappedPath, description sql.NullString
+		var mappedPath, description, failover, limits, role sql.NullString
 		var fsConfig []byte
 		err = rows.Scan(&folder.ID, &mappedPath, &folder.UsedQuotaSize, &folder.UsedQuotaFiles,
-			&folder.LastQuotaUpdate, &folder.Name, &description, &fsConfig)
+			&folder.LastQuotaUpdate, &folder.Name, &description, &fsConfig, &failover, &limits, &role)
 		if err != nil {
 			return folders, err
 		}
@@ -2430,18 +2824,31 @@ func sqlCommonDumpFolders(dbHandle sqlQuerier) ([]vfs.BaseVirtualFolder, error)
 		if err == nil {
 			folder.FsConfig = fs
 		}
+		folder.Failover = getFolderFailoverFromDB(folder.Name, failover)
+		folder.Limits = getFolderLimitsFromDB(folder.Name, limits)
+		if role.Valid {
+			folder.Role = role.String
+		}
 		folders = append(folders, folder)
 	}
 	return folders, rows.Err()
 }
 
-func sqlCommonGetFolders(limit, offset int, order string, minimal bool, dbHandle sqlQuerier) ([]vfs.BaseVirtualFolder, error) {
+func sqlCommonGetFolders(limit, offset int, order string, minimal bool, role string,
+	dbHandle sqlQuerier,
+) ([]vfs.BaseVirtualFolder, error) {
 	folders := make([]vfs.BaseVirtualFolder, 0, limit)
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
 
-	q := getFoldersQuery(order, minimal)
-	rows, err := dbHandle.QueryContext(ctx, q, limit, offset)
+	q := getFoldersQuery(order, minimal, role)
+	var args []any
+	if role == "" {
+		args = append(args, limit, offset)
+	} else {
+		args = append(args, role, limit, offset)
+	}
+	rows, err := dbHandle.QueryContext(ctx, q, args...)
 	if err != nil {
 		return folders, err
 	}
@@ -2454,10 +2861,10 @@ func sqlCommonGetFolders(limit, offset int, order string, minimal bool, dbHandle
 				return folders, err
 			}
 		} else {
-			var mappedPath, description sql.NullString
+			var mappedPath, description, failover, limits, role sql.NullString
 			var fsConfig []byte
 			err = rows.Scan(&folder.ID, &mappedPath, &folder.UsedQuotaSize, &folder.UsedQuotaFiles,
-				&folder.LastQuotaUpdate, &folder.Name, &description, &fsConfig)
+				&folder.LastQuotaUpdate, &folder.Name, &description, &fsConfig, &failover, &limits, &role)
 			if err != nil {
 				return folders, err
 			}
@@ -2472,6 +2879,11 @@ func sqlCommonGetFolders(limit, offset int, order string, minimal bool, dbHandle
 			if err == nil {
 				folder.FsConfig = fs
 			}
+			folder.Failover = getFolderFailoverFromDB(folder.Name, failover)
+			folder.Limits = getFolderLimitsFromDB(folder.Name, limits)
+			if role.Valid {
+				folder.Role = role.String
+			}
 		}
 		folder.PrepareForRendering()
 		folders = append(folders, folder)
@@ -2736,11 +3148,11 @@ func getUsersWithVirtualFolders(ctx context.Context, users []User, dbHandle sqlQ
 	for rows.Next() {
 		var folder vfs.VirtualFolder
 		var userID int64
-		var mappedPath, description sql.NullString
+		var mappedPath, description, failover, limits sql.NullString
 		var fsConfig []byte
 		err = rows.Scan(&folder.ID, &folder.Name, &mappedPath, &folder.UsedQuotaSize, &folder.UsedQuotaFiles,
 			&folder.LastQuotaUpdate, &folder.VirtualPath, &folder.QuotaSize, &folder.QuotaFiles, &userID, &fsConfig,
-			&description)
+			&description, &failover, &limits)
 		if err != nil {
 			return users, err
 		}
@@ -2755,6 +3167,8 @@ func getUsersWithVirtualFolders(ctx context.Context, users []User, dbHandle sqlQ
 		if err == nil {
 			folder.FsConfig = fs
 		}
+		folder.Failover = getFolderFailoverFromDB(folder.Name, failover)
+		folder.Limits = getFolderLimitsFromDB(folder.Name, limits)
 		usersVirtualFolders[userID] = append(usersVirtualFolders[userID], folder)
 	}
 	err = rows.Err()
@@ -2887,11 +3301,11 @@ func getGroupsWithVirtualFolders(ctx context.Context, groups []Group, dbHandle s
 	for rows.Next() {
 		var groupID int64
 		var folder vfs.VirtualFolder
-		var mappedPath, description sql.NullString
+		var mappedPath, description, failover, limits sql.NullString
 		var fsConfig []byte
 		err = rows.Scan(&folder.ID, &folder.Name, &mappedPath, &folder.UsedQuotaSize, &folder.UsedQuotaFiles,
 			&folder.LastQuotaUpdate, &folder.VirtualPath, &folder.QuotaSize, &folder.QuotaFiles, &groupID, &fsConfig,
-			&description)
+			&description, &failover, &limits)
 		if err != nil {
 			return groups, err
 		}
@@ -2906,6 +3320,8 @@ func getGroupsWithVirtualFolders(ctx context.Context, groups []Group, dbHandle s
 		if err == nil {
 			folder.FsConfig = fs
 		}
+		folder.Failover = getFolderFailoverFromDB(folder.Name, failover)
+		folder.Limits = getFolderLimitsFromDB(folder.Name, limits)
 		groupsVirtualFolders[groupID] = append(groupsVirtualFolders[groupID], folder)
 	}
 	err = rows.Err()
@@ -3022,6 +3438,38 @@ func getRolesWithAdmins(ctx context.Context, roles []Role, dbHandle sqlQuerier)
 	return roles, nil
 }
 
+func getAdminRolesWithAdmins(ctx context.Context, roles []AdminRole, dbHandle sqlQuerier) ([]AdminRole, error) {
+	if len(roles) == 0 {
+		return roles, nil
+	}
+	rows, err := dbHandle.QueryContext(ctx, getAdminsWithAdminRolesQuery(roles))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rolesAdmins := make(map[int64][]string)
+	for rows.Next() {
+		var roleID int64
+		var username string
+		err = rows.Scan(&roleID, &username)
+		if err != nil {
+			return roles, err
+		}
+		rolesAdmins[roleID] = append(rolesAdmins[roleID], username)
+	}
+	if err = rows.Err(); err != nil {
+		return roles, err
+	}
+	if len(rolesAdmins) > 0 {
+		for idx := range roles {
+			ref := &roles[idx]
+			ref.Admins = rolesAdmins[ref.ID]
+		}
+	}
+	return roles, nil
+}
+
 func getGroupsWithAdmins(ctx context.Context, groups []Group, dbHandle sqlQuerier) ([]Group, error) {
 	if len(groups) == 0 {
 		return groups, nil
@@ -3286,6 +3734,30 @@ func sqlCommonDeleteSession(key string, dbHandle *sql.DB) error {
 	return sqlCommonRequireRowAffected(res)
 }
 
+func sqlCommonGetSessions(sessionType SessionType, after int64, dbHandle sqlQuerier) ([]Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+
+	q := getSessionsQuery()
+	rows, err := dbHandle.QueryContext(ctx, q, sessionType, after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		var session Session
+		var data []byte
+		if err := rows.Scan(&session.Key, &data, &session.Type, &session.Timestamp); err != nil {
+			return nil, err
+		}
+		session.Data = data
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
 func sqlCommonCleanupSessions(sessionType SessionType, before int64, dbHandle *sql.DB) error {
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
@@ -3614,14 +4086,20 @@ func sqlCommonGetRecentlyUpdatedRules(after int64, dbHandle sqlQuerier) ([]Event
 	return getRulesWithActions(ctx, rules, dbHandle)
 }
 
-func sqlCommonGetEventRules(limit int, offset int, order string, dbHandle sqlQuerier) ([]EventRule, error) {
+func sqlCommonGetEventRules(limit int, offset int, order, role string, dbHandle sqlQuerier) ([]EventRule, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
 
-	q := getEventRulesQuery(order)
+	q := getEventRulesQuery(order, role)
+	var args []any
+	if role == "" {
+		args = append(args, limit, offset)
+	} else {
+		args = append(args, role, limit, offset)
+	}
 
 	rules := make([]EventRule, 0, limit)
-	rows, err := dbHandle.QueryContext(ctx, q, limit, offset)
+	rows, err := dbHandle.QueryContext(ctx, q, args...)
 	if err != nil {
 		return rules, err
 	}
@@ -3666,9 +4144,9 @@ func sqlCommonAddEventRule(rule *EventRule, dbHandle *sql.DB) error {
 				return err
 			}
 		}
-		q := getAddEventRuleQuery()
+		q := getAddEventRuleQuery(rule.Role)
 		_, err := tx.ExecContext(ctx, q, rule.Name, rule.Description, util.GetTimeAsMsSinceEpoch(time.Now()),
-			util.GetTimeAsMsSinceEpoch(time.Now()), rule.Trigger, conditions, rule.Status)
+			util.GetTimeAsMsSinceEpoch(time.Now()), rule.Trigger, conditions, rule.Status, rule.Role)
 		if err != nil {
 			return err
 		}
@@ -3688,9 +4166,9 @@ func sqlCommonUpdateEventRule(rule *EventRule, dbHandle *sql.DB) error {
 	defer cancel()
 
 	return sqlCommonExecuteTx(ctx, dbHandle, func(tx *sql.Tx) error {
-		q := getUpdateEventRuleQuery()
+		q := getUpdateEventRuleQuery(rule.Role)
 		_, err := tx.ExecContext(ctx, q, rule.Description, util.GetTimeAsMsSinceEpoch(time.Now()),
-			rule.Trigger, conditions, rule.Status, rule.Name)
+			rule.Trigger, conditions, rule.Status, rule.Role, rule.Name)
 		if err != nil {
 			return err
 		}
@@ -3876,6 +4354,22 @@ func sqlCommonUpdateNodeTimestamp(dbHandle *sql.DB) error {
 	return sqlCommonRequireRowAffected(res)
 }
 
+func sqlCommonUpdateNodeData(dbHandle *sql.DB) error {
+	data, err := json.Marshal(getCurrentNodeData())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+
+	q := getUpdateNodeDataQuery()
+	res, err := dbHandle.ExecContext(ctx, q, data, util.GetTimeAsMsSinceEpoch(time.Now()), currentNode.Name)
+	if err != nil {
+		return err
+	}
+	return sqlCommonRequireRowAffected(res)
+}
+
 func sqlCommonCleanupNodes(dbHandle *sql.DB) error {
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
@@ -3919,6 +4413,175 @@ func sqlCommonSetConfigs(configs *Configs, dbHandle *sql.DB) error {
 	return sqlCommonRequireRowAffected(res)
 }
 
+func getFileMetadataFromDbRow(row sqlScanner) (FileMetadata, error) {
+	var m FileMetadata
+	var metadata, tags sql.NullString
+
+	err := row.Scan(&m.Path, &metadata, &tags, &m.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return m, util.NewRecordNotFoundError(err.Error())
+		}
+		return m, err
+	}
+	if metadata.Valid && metadata.String != "" {
+		if err := json.Unmarshal([]byte(metadata.String), &m.Metadata); err != nil {
+			return m, err
+		}
+	}
+	if tags.Valid && tags.String != "" {
+		if err := json.Unmarshal([]byte(tags.String), &m.Tags); err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
+
+func sqlCommonGetFileMetadata(username, virtualPath string, dbHandle sqlQuerier) (FileMetadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+
+	q := getFileMetadataQuery()
+	row := dbHandle.QueryRowContext(ctx, q, username, getFileMetadataPathHash(virtualPath))
+	m, err := getFileMetadataFromDbRow(row)
+	if errors.Is(err, util.ErrNotFound) {
+		return m, util.NewRecordNotFoundError(fmt.Sprintf("no metadata for path %q", virtualPath))
+	}
+	return m, err
+}
+
+func sqlCommonGetFilesMetadata(username, virtualPath string, dbHandle sqlQuerier) ([]FileMetadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), longSQLQueryTimeout)
+	defer cancel()
+
+	q := getFilesMetadataQuery()
+	rows, err := dbHandle.QueryContext(ctx, q, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]FileMetadata, 0)
+	for rows.Next() {
+		m, err := getFileMetadataFromDbRow(rows)
+		if err != nil {
+			return result, err
+		}
+		if isFileMetadataInPath(m.Path, virtualPath) {
+			result = append(result, m)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+	sortFilesMetadata(result)
+	return result, nil
+}
+
+func sqlCommonSetFileMetadata(username string, metadata *FileMetadata, dbHandle *sql.DB) error {
+	if err := metadata.validate(); err != nil {
+		return err
+	}
+	user, err := provider.userExists(username, "")
+	if err != nil {
+		return util.NewGenericError(fmt.Sprintf("unable to validate user %q", username))
+	}
+	var values, tags []byte
+	if len(metadata.Metadata) > 0 {
+		values, err = json.Marshal(metadata.Metadata)
+		if err != nil {
+			return err
+		}
+	}
+	if len(metadata.Tags) > 0 {
+		tags, err = json.Marshal(metadata.Tags)
+		if err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+
+	return sqlCommonExecuteTx(ctx, dbHandle, func(tx *sql.Tx) error {
+		pathHash := metadata.getPathHash()
+		if _, err := tx.ExecContext(ctx, getDeleteFileMetadataQuery(), username, pathHash); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, getAddFileMetadataQuery(), metadata.Path, pathHash, string(values),
+			string(tags), metadata.UpdatedAt, user.ID)
+		return err
+	})
+}
+
+func sqlCommonDeleteFilesMetadata(username, virtualPath string, recursive bool, dbHandle *sql.DB) error {
+	paths := []string{virtualPath}
+	if recursive {
+		files, err := sqlCommonGetFilesMetadata(username, virtualPath, dbHandle)
+		if err != nil {
+			return err
+		}
+		paths = paths[:0]
+		for _, m := range files {
+			paths = append(paths, m.Path)
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), longSQLQueryTimeout)
+	defer cancel()
+
+	return sqlCommonExecuteTx(ctx, dbHandle, func(tx *sql.Tx) error {
+		q := getDeleteFileMetadataQuery()
+		for _, p := range paths {
+			if _, err := tx.ExecContext(ctx, q, username, getFileMetadataPathHash(p)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func sqlCommonRenameFilesMetadata(username, source, target string, dbHandle *sql.DB) error {
+	files, err := sqlCommonGetFilesMetadata(username, "/", dbHandle)
+	if err != nil {
+		return err
+	}
+	var toDelete, toRename []string
+	for _, m := range files {
+		if isFileMetadataInPath(m.Path, source) {
+			toRename = append(toRename, m.Path)
+		} else if isFileMetadataInPath(m.Path, target) {
+			toDelete = append(toDelete, m.Path)
+		}
+	}
+	if len(toRename) == 0 && len(toDelete) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), longSQLQueryTimeout)
+	defer cancel()
+
+	return sqlCommonExecuteTx(ctx, dbHandle, func(tx *sql.Tx) error {
+		q := getDeleteFileMetadataQuery()
+		for _, p := range toDelete {
+			if _, err := tx.ExecContext(ctx, q, username, getFileMetadataPathHash(p)); err != nil {
+				return err
+			}
+		}
+		q = getRenameFileMetadataQuery()
+		updatedAt := util.GetTimeAsMsSinceEpoch(time.Now())
+		for _, p := range toRename {
+			newPath := getRenamedFileMetadataPath(p, source, target)
+			_, err := tx.ExecContext(ctx, q, newPath, getFileMetadataPathHash(newPath), updatedAt, username,
+				getFileMetadataPathHash(p))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func sqlCommonGetDatabaseVersion(dbHandle sqlQuerier, showInitWarn bool) (schemaVersion, error) {
 	var result schemaVersion
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
@@ -4041,6 +4704,170 @@ func sqlReleaseLock(dbHandle *sql.DB) {
 	}
 }
 
+func sqlCommonAddEventDigestEntry(entry *EventDigestEntry, dbHandle *sql.DB) error {
+	if err := entry.validate(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+
+	q := getAddEventDigestEntryQuery()
+	_, err := dbHandle.ExecContext(ctx, q, entry.RuleName, entry.ActionName, entry.Name, entry.WindowEnd,
+		string(entry.Data), entry.CreatedAt)
+	return err
+}
+
+func sqlCommonGetEventDigestEntries(before int64, dbHandle sqlQuerier) ([]EventDigestEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), longSQLQueryTimeout)
+	defer cancel()
+
+	q := getEventDigestEntriesQuery()
+	rows, err := dbHandle.QueryContext(ctx, q, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]EventDigestEntry, 0)
+	for rows.Next() {
+		var entry EventDigestEntry
+		var data string
+		err = rows.Scan(&entry.ID, &entry.RuleName, &entry.ActionName, &entry.Name, &entry.WindowEnd, &data,
+			&entry.CreatedAt)
+		if err != nil {
+			return result, err
+		}
+		entry.Data = []byte(data)
+		result = append(result, entry)
+	}
+	return result, rows.Err()
+}
+
+func sqlCommonDeleteEventDigestEntries(ids []int64, dbHandle *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+
+	return sqlCommonExecuteTx(ctx, dbHandle, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, getDeleteEventDigestEntriesQuery(ids))
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected != int64(len(ids)) {
+			return util.NewRecordNotFoundError(fmt.Sprintf("unable to delete digest entries, expected: %d, deleted: %d",
+				len(ids), affected))
+		}
+		return nil
+	})
+}
+
+func sqlCommonAddAuditLogEntry(entry *AuditLogEntry, dbHandle *sql.DB) error {
+	if err := entry.validate(); err != nil {
+		return err
+	}
+	changes, err := entry.getChangesAsJSON()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+
+	q := getAddAuditLogEntryQuery()
+	_, err = dbHandle.ExecContext(ctx, q, entry.Timestamp, entry.Action, entry.Executor, entry.IP, entry.Role,
+		entry.ObjectType, entry.ObjectName, string(entry.Before), string(entry.After), changes)
+	return err
+}
+
+func sqlCommonSearchAuditLog(filters *AuditLogSearch, dbHandle sqlQuerier) ([]AuditLogEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), longSQLQueryTimeout)
+	defer cancel()
+
+	q, args := getSearchAuditLogQuery(filters)
+	rows, err := dbHandle.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]AuditLogEntry, 0, filters.Limit)
+	for rows.Next() {
+		var entry AuditLogEntry
+		var before, after, changes sql.NullString
+		err = rows.Scan(&entry.ID, &entry.Timestamp, &entry.Action, &entry.Executor, &entry.IP, &entry.Role,
+			&entry.ObjectType, &entry.ObjectName, &before, &after, &changes)
+		if err != nil {
+			return result, err
+		}
+		if before.Valid && before.String != "" {
+			entry.Before = []byte(before.String)
+		}
+		if after.Valid && after.String != "" {
+			entry.After = []byte(after.String)
+		}
+		if changes.Valid {
+			if err := entry.setChangesFromJSON(changes.String); err != nil {
+				return result, err
+			}
+		}
+		result = append(result, entry)
+	}
+	return result, rows.Err()
+}
+
+func sqlCommonCleanupAuditLog(before int64, dbHandle *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), longSQLQueryTimeout)
+	defer cancel()
+
+	_, err := dbHandle.ExecContext(ctx, getCleanupAuditLogQuery(), before)
+	return err
+}
+
+func sqlCommonAddShareEvent(event *ShareEvent, dbHandle *sql.DB) error {
+	if err := event.validate(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+
+	_, err := dbHandle.ExecContext(ctx, getAddShareEventQuery(), event.ShareID, event.Timestamp, event.IP,
+		event.UserAgent, event.Path, event.Size)
+	return err
+}
+
+func sqlCommonGetShareEvents(shareID string, from, to int64, limit int, dbHandle sqlQuerier) ([]ShareEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), longSQLQueryTimeout)
+	defer cancel()
+
+	rows, err := dbHandle.QueryContext(ctx, getShareEventsQuery(), shareID, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]ShareEvent, 0)
+	for rows.Next() {
+		var event ShareEvent
+		err = rows.Scan(&event.ID, &event.ShareID, &event.Timestamp, &event.IP, &event.UserAgent, &event.Path,
+			&event.Size)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, event)
+	}
+	return result, rows.Err()
+}
+
+func sqlCommonCleanupShareEvents(before int64, dbHandle *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), longSQLQueryTimeout)
+	defer cancel()
+
+	_, err := dbHandle.ExecContext(ctx, getCleanupShareEventsQuery(), before)
+	return err
+}
+
 func sqlCommonExecuteTx(ctx context.Context, dbHandle *sql.DB, txFn func(*sql.Tx) error) error {
 	if config.Driver == CockroachDataProviderName {
 		return crdb.ExecuteTx(ctx, dbHandle, nil, txFn)
@@ -37,13 +37,15 @@ import (
 )
 
 const (
-	sqliteResetSQL = `DROP TABLE IF EXISTS "{{api_keys}}";
+	sqliteResetSQL = `DROP TABLE IF EXISTS "{{share_events}}";
+DROP TABLE IF EXISTS "{{api_keys}}";
 DROP TABLE IF EXISTS "{{folders_mapping}}";
 DROP TABLE IF EXISTS "{{users_folders_mapping}}";
 DROP TABLE IF EXISTS "{{users_groups_mapping}}";
 DROP TABLE IF EXISTS "{{admins_groups_mapping}}";
 DROP TABLE IF EXISTS "{{groups_folders_mapping}}";
 DROP TABLE IF EXISTS "{{admins}}";
+DROP TABLE IF EXISTS "{{admin_roles}}";
 DROP TABLE IF EXISTS "{{folders}}";
 DROP TABLE IF EXISTS "{{shares}}";
 DROP TABLE IF EXISTS "{{users}}";
@@ -59,6 +61,9 @@ DROP TABLE IF EXISTS "{{tasks}}";
 DROP TABLE IF EXISTS "{{roles}}";
 DROP TABLE IF EXISTS "{{ip_lists}}";
 DROP TABLE IF EXISTS "{{configs}}";
+DROP TABLE IF EXISTS "{{files_metadata}}";
+DROP TABLE IF EXISTS "{{events_digests}}";
+DROP TABLE IF EXISTS "{{audit_logs}}";
 DROP TABLE IF EXISTS "{{schema_version}}";
 `
 	sqliteInitialSQL = `CREATE TABLE "{{schema_version}}" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT, "version" integer NOT NULL);
@@ -198,6 +203,70 @@ CREATE INDEX "{{prefix}}ip_lists_first_last_idx" ON "{{ip_lists}}" ("first", "la
 INSERT INTO {{configs}} (configs) VALUES ('{}');
 `
 	sqliteV28DownSQL = `DROP TABLE "{{configs}}";`
+	sqliteV29SQL     = `CREATE TABLE "{{files_metadata}}" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+"path" text NOT NULL, "path_hash" varchar(64) NOT NULL, "metadata" text NULL, "tags" text NULL,
+"updated_at" bigint NOT NULL, "user_id" integer NOT NULL REFERENCES "{{users}}" ("id") ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED,
+CONSTRAINT "{{prefix}}unique_files_metadata_path" UNIQUE ("user_id", "path_hash"));
+CREATE INDEX "{{prefix}}files_metadata_user_id_idx" ON "{{files_metadata}}" ("user_id");
+`
+	sqliteV29DownSQL = `DROP TABLE "{{files_metadata}}";`
+	sqliteV30SQL     = `CREATE TABLE "{{events_digests}}" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+"rule_name" varchar(255) NOT NULL, "action_name" varchar(255) NOT NULL, "name" varchar(255) NOT NULL,
+"window_end" bigint NOT NULL, "data" text NOT NULL, "created_at" bigint NOT NULL);
+CREATE INDEX "{{prefix}}events_digests_window_end_idx" ON "{{events_digests}}" ("window_end");
+`
+	sqliteV30DownSQL = `DROP TABLE "{{events_digests}}";`
+	sqliteV31SQL     = `CREATE TABLE "{{audit_logs}}" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+"created_at" bigint NOT NULL, "action" varchar(32) NOT NULL, "executor" varchar(255) NOT NULL,
+"ip" varchar(50) NOT NULL, "role" varchar(255) NOT NULL, "object_type" varchar(50) NOT NULL,
+"object_name" varchar(512) NOT NULL, "before_data" text NULL, "after_data" text NULL, "changes" text NULL);
+CREATE INDEX "{{prefix}}audit_logs_created_at_idx" ON "{{audit_logs}}" ("created_at");
+CREATE INDEX "{{prefix}}audit_logs_executor_idx" ON "{{audit_logs}}" ("executor");
+CREATE INDEX "{{prefix}}audit_logs_object_name_idx" ON "{{audit_logs}}" ("object_name");
+`
+	sqliteV31DownSQL = `DROP TABLE "{{audit_logs}}";`
+	sqliteV32SQL     = `ALTER TABLE "{{folders}}" ADD COLUMN "failover" text NULL;`
+	sqliteV32DownSQL = `ALTER TABLE "{{folders}}" DROP COLUMN "failover";`
+	sqliteV33SQL     = `ALTER TABLE "{{roles}}" ADD COLUMN "tenant" text NULL;`
+	sqliteV33DownSQL = `ALTER TABLE "{{roles}}" DROP COLUMN "tenant";`
+	sqliteV34SQL     = `ALTER TABLE "{{folders}}" ADD COLUMN "limits" text NULL;`
+	sqliteV34DownSQL = `ALTER TABLE "{{folders}}" DROP COLUMN "limits";`
+	sqliteV35SQL     = `ALTER TABLE "{{shares}}" ADD COLUMN "options" text NULL;`
+	sqliteV35DownSQL = `ALTER TABLE "{{shares}}" DROP COLUMN "options";`
+	sqliteV36SQL     = `CREATE TABLE "{{share_events}}" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+"share_id" varchar(60) NOT NULL REFERENCES "{{shares}}" ("share_id") ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED,
+"created_at" bigint NOT NULL, "ip" varchar(50) NOT NULL, "user_agent" varchar(255) NOT NULL, "path" text NOT NULL,
+"size" bigint NOT NULL);
+CREATE INDEX "{{prefix}}share_events_share_id_created_at_idx" ON "{{share_events}}" ("share_id", "created_at");
+CREATE INDEX "{{prefix}}share_events_created_at_idx" ON "{{share_events}}" ("created_at");
+`
+	sqliteV36DownSQL = `DROP TABLE "{{share_events}}";`
+	sqliteV37SQL     = `CREATE TABLE "{{admin_roles}}" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+"name" varchar(255) NOT NULL UNIQUE, "description" varchar(512) NULL, "created_at" bigint NOT NULL,
+"updated_at" bigint NOT NULL, "permissions" text NOT NULL, "filters" text NULL);
+ALTER TABLE "{{admins}}" ADD COLUMN "admin_role_id" integer NULL REFERENCES "{{admin_roles}}" ("id") ON DELETE NO ACTION;
+CREATE INDEX "{{prefix}}admins_admin_role_id_idx" ON "{{admins}}" ("admin_role_id");
+`
+	sqliteV37DownSQL = `DROP INDEX "{{prefix}}admins_admin_role_id_idx";
+ALTER TABLE "{{admins}}" DROP COLUMN admin_role_id;
+DROP TABLE "{{admin_roles}}";
+`
+	sqliteV38SQL = `ALTER TABLE "{{groups}}" ADD COLUMN "role_id" integer NULL REFERENCES "{{roles}}" ("id") ON DELETE NO ACTION;
+ALTER TABLE "{{folders}}" ADD COLUMN "role_id" integer NULL REFERENCES "{{roles}}" ("id") ON DELETE NO ACTION;
+ALTER TABLE "{{events_rules}}" ADD COLUMN "role_id" integer NULL REFERENCES "{{roles}}" ("id") ON DELETE NO ACTION;
+CREATE INDEX "{{prefix}}groups_role_id_idx" ON "{{groups}}" ("role_id");
+CREATE INDEX "{{prefix}}folders_role_id_idx" ON "{{folders}}" ("role_id");
+CREATE INDEX "{{prefix}}events_rules_role_id_idx" ON "{{events_rules}}" ("role_id");
+`
+	sqliteV38DownSQL = `DROP INDEX "{{prefix}}events_rules_role_id_idx";
+DROP INDEX "{{prefix}}folders_role_id_idx";
+DROP INDEX "{{prefix}}groups_role_id_idx";
+ALTER TABLE "{{events_rules}}" DROP COLUMN role_id;
+ALTER TABLE "{{folders}}" DROP COLUMN role_id;
+ALTER TABLE "{{groups}}" DROP COLUMN role_id;
+`
+	sqliteV39SQL     = `ALTER TABLE "{{api_keys}}" ADD COLUMN "filters" text NULL;`
+	sqliteV39DownSQL = `ALTER TABLE "{{api_keys}}" DROP COLUMN "filters";`
 )
 
 // SQLiteProvider defines the auth provider for SQLite database
@@ -240,8 +309,8 @@ func (p *SQLiteProvider) checkAvailability() error {
 	return sqlCommonCheckAvailability(p.dbHandle)
 }
 
-func (p *SQLiteProvider) validateUserAndPass(username, password, ip, protocol string) (User, error) {
-	return sqlCommonValidateUserAndPass(username, password, ip, protocol, p.dbHandle)
+func (p *SQLiteProvider) validateUserAndPass(ctx context.Context, username, password, ip, protocol string) (User, error) {
+	return sqlCommonValidateUserAndPass(ctx, username, password, ip, protocol, p.dbHandle)
 }
 
 func (p *SQLiteProvider) validateUserAndTLSCert(username, protocol string, tlsCert *x509.Certificate) (User, error) {
@@ -316,8 +385,8 @@ func (p *SQLiteProvider) dumpFolders() ([]vfs.BaseVirtualFolder, error) {
 	return sqlCommonDumpFolders(p.dbHandle)
 }
 
-func (p *SQLiteProvider) getFolders(limit, offset int, order string, minimal bool) ([]vfs.BaseVirtualFolder, error) {
-	return sqlCommonGetFolders(limit, offset, order, minimal, p.dbHandle)
+func (p *SQLiteProvider) getFolders(limit, offset int, order string, minimal bool, role string) ([]vfs.BaseVirtualFolder, error) {
+	return sqlCommonGetFolders(limit, offset, order, minimal, role, p.dbHandle)
 }
 
 func (p *SQLiteProvider) getFolderByName(name string) (vfs.BaseVirtualFolder, error) {
@@ -346,8 +415,8 @@ func (p *SQLiteProvider) getUsedFolderQuota(name string) (int, int64, error) {
 	return sqlCommonGetFolderUsedQuota(name, p.dbHandle)
 }
 
-func (p *SQLiteProvider) getGroups(limit, offset int, order string, minimal bool) ([]Group, error) {
-	return sqlCommonGetGroups(limit, offset, order, minimal, p.dbHandle)
+func (p *SQLiteProvider) getGroups(limit, offset int, order string, minimal bool, role string) ([]Group, error) {
+	return sqlCommonGetGroups(limit, offset, order, minimal, role, p.dbHandle)
 }
 
 func (p *SQLiteProvider) getGroupsWithNames(names []string) ([]Group, error) {
@@ -418,6 +487,10 @@ func (p *SQLiteProvider) updateAPIKey(apiKey *APIKey) error {
 	return sqlCommonUpdateAPIKey(apiKey, p.dbHandle)
 }
 
+func (p *SQLiteProvider) rotateAPIKey(apiKey *APIKey) error {
+	return sqlCommonRotateAPIKey(apiKey, p.dbHandle)
+}
+
 func (p *SQLiteProvider) deleteAPIKey(apiKey APIKey) error {
 	return sqlCommonDeleteAPIKey(apiKey, p.dbHandle)
 }
@@ -530,6 +603,10 @@ func (p *SQLiteProvider) cleanupSharedSessions(sessionType SessionType, before i
 	return sqlCommonCleanupSessions(sessionType, before, p.dbHandle)
 }
 
+func (p *SQLiteProvider) getSharedSessions(sessionType SessionType, after int64) ([]Session, error) {
+	return sqlCommonGetSessions(sessionType, after, p.dbHandle)
+}
+
 func (p *SQLiteProvider) getEventActions(limit, offset int, order string, minimal bool) ([]BaseEventAction, error) {
 	return sqlCommonGetEventActions(limit, offset, order, minimal, p.dbHandle)
 }
@@ -554,8 +631,8 @@ func (p *SQLiteProvider) deleteEventAction(action BaseEventAction) error {
 	return sqlCommonDeleteEventAction(action, p.dbHandle)
 }
 
-func (p *SQLiteProvider) getEventRules(limit, offset int, order string) ([]EventRule, error) {
-	return sqlCommonGetEventRules(limit, offset, order, p.dbHandle)
+func (p *SQLiteProvider) getEventRules(limit, offset int, order, role string) ([]EventRule, error) {
+	return sqlCommonGetEventRules(limit, offset, order, role, p.dbHandle)
 }
 
 func (p *SQLiteProvider) dumpEventRules() ([]EventRule, error) {
@@ -614,6 +691,10 @@ func (*SQLiteProvider) updateNodeTimestamp() error {
 	return ErrNotImplemented
 }
 
+func (*SQLiteProvider) updateNodeConnections() error {
+	return ErrNotImplemented
+}
+
 func (*SQLiteProvider) cleanupNodes() error {
 	return ErrNotImplemented
 }
@@ -642,6 +723,30 @@ func (p *SQLiteProvider) dumpRoles() ([]Role, error) {
 	return sqlCommonDumpRoles(p.dbHandle)
 }
 
+func (p *SQLiteProvider) adminRoleExists(name string) (AdminRole, error) {
+	return sqlCommonGetAdminRoleByName(name, p.dbHandle)
+}
+
+func (p *SQLiteProvider) addAdminRole(role *AdminRole) error {
+	return sqlCommonAddAdminRole(role, p.dbHandle)
+}
+
+func (p *SQLiteProvider) updateAdminRole(role *AdminRole) error {
+	return sqlCommonUpdateAdminRole(role, p.dbHandle)
+}
+
+func (p *SQLiteProvider) deleteAdminRole(role AdminRole) error {
+	return sqlCommonDeleteAdminRole(role, p.dbHandle)
+}
+
+func (p *SQLiteProvider) getAdminRoles(limit int, offset int, order string, minimal bool) ([]AdminRole, error) {
+	return sqlCommonGetAdminRoles(limit, offset, order, minimal, p.dbHandle)
+}
+
+func (p *SQLiteProvider) dumpAdminRoles() ([]AdminRole, error) {
+	return sqlCommonDumpAdminRoles(p.dbHandle)
+}
+
 func (p *SQLiteProvider) ipListEntryExists(ipOrNet string, listType IPListType) (IPListEntry, error) {
 	return sqlCommonGetIPListEntry(ipOrNet, listType, p.dbHandle)
 }
@@ -686,6 +791,62 @@ func (p *SQLiteProvider) setConfigs(configs *Configs) error {
 	return sqlCommonSetConfigs(configs, p.dbHandle)
 }
 
+func (p *SQLiteProvider) getFileMetadata(username, virtualPath string) (FileMetadata, error) {
+	return sqlCommonGetFileMetadata(username, virtualPath, p.dbHandle)
+}
+
+func (p *SQLiteProvider) getFilesMetadata(username, virtualPath string) ([]FileMetadata, error) {
+	return sqlCommonGetFilesMetadata(username, virtualPath, p.dbHandle)
+}
+
+func (p *SQLiteProvider) setFileMetadata(username string, metadata *FileMetadata) error {
+	return sqlCommonSetFileMetadata(username, metadata, p.dbHandle)
+}
+
+func (p *SQLiteProvider) deleteFilesMetadata(username, virtualPath string, recursive bool) error {
+	return sqlCommonDeleteFilesMetadata(username, virtualPath, recursive, p.dbHandle)
+}
+
+func (p *SQLiteProvider) renameFilesMetadata(username, source, target string) error {
+	return sqlCommonRenameFilesMetadata(username, source, target, p.dbHandle)
+}
+
+func (p *SQLiteProvider) addEventDigestEntry(entry *EventDigestEntry) error {
+	return sqlCommonAddEventDigestEntry(entry, p.dbHandle)
+}
+
+func (p *SQLiteProvider) getEventDigestEntries(before int64) ([]EventDigestEntry, error) {
+	return sqlCommonGetEventDigestEntries(before, p.dbHandle)
+}
+
+func (p *SQLiteProvider) deleteEventDigestEntries(ids []int64) error {
+	return sqlCommonDeleteEventDigestEntries(ids, p.dbHandle)
+}
+
+func (p *SQLiteProvider) addAuditLogEntry(entry *AuditLogEntry) error {
+	return sqlCommonAddAuditLogEntry(entry, p.dbHandle)
+}
+
+func (p *SQLiteProvider) searchAuditLog(filters *AuditLogSearch) ([]AuditLogEntry, error) {
+	return sqlCommonSearchAuditLog(filters, p.dbHandle)
+}
+
+func (p *SQLiteProvider) cleanupAuditLog(before int64) error {
+	return sqlCommonCleanupAuditLog(before, p.dbHandle)
+}
+
+func (p *SQLiteProvider) addShareEvent(event *ShareEvent) error {
+	return sqlCommonAddShareEvent(event, p.dbHandle)
+}
+
+func (p *SQLiteProvider) getShareEvents(shareID string, from, to int64, limit int) ([]ShareEvent, error) {
+	return sqlCommonGetShareEvents(shareID, from, to, limit, p.dbHandle)
+}
+
+func (p *SQLiteProvider) cleanupShareEvents(before int64) error {
+	return sqlCommonCleanupShareEvents(before, p.dbHandle)
+}
+
 func (p *SQLiteProvider) setFirstDownloadTimestamp(username string) error {
 	return sqlCommonSetFirstDownloadTimestamp(username, p.dbHandle)
 }
@@ -742,6 +903,28 @@ func (p *SQLiteProvider) migrateDatabase() error { //nolint:dupl
 		return updateSQLiteDatabaseFromV26(p.dbHandle)
 	case version == 27:
 		return updateSQLiteDatabaseFromV27(p.dbHandle)
+	case version == 28:
+		return updateSQLiteDatabaseFromV28(p.dbHandle)
+	case version == 29:
+		return updateSQLiteDatabaseFromV29(p.dbHandle)
+	case version == 30:
+		return updateSQLiteDatabaseFromV30(p.dbHandle)
+	case version == 31:
+		return updateSQLiteDatabaseFromV31(p.dbHandle)
+	case version == 32:
+		return updateSQLiteDatabaseFromV32(p.dbHandle)
+	case version == 33:
+		return updateSQLiteDatabaseFromV33(p.dbHandle)
+	case version == 34:
+		return updateSQLiteDatabaseFromV34(p.dbHandle)
+	case version == 35:
+		return updateSQLiteDatabaseFromV35(p.dbHandle)
+	case version == 36:
+		return updateSQLiteDatabaseFromV36(p.dbHandle)
+	case version == 37:
+		return updateSQLiteDatabaseFromV37(p.dbHandle)
+	case version == 38:
+		return updateSQLiteDatabaseFromV38(p.dbHandle)
 	default:
 		if version > sqlDatabaseVersion {
 			providerLog(logger.LevelError, "database schema version %d is newer than the supported one: %d", version,
@@ -774,6 +957,28 @@ func (p *SQLiteProvider) revertDatabase(targetVersion int) error {
 		return downgradeSQLiteDatabaseFromV27(p.dbHandle)
 	case 28:
 		return downgradeSQLiteDatabaseFromV28(p.dbHandle)
+	case 29:
+		return downgradeSQLiteDatabaseFromV29(p.dbHandle)
+	case 30:
+		return downgradeSQLiteDatabaseFromV30(p.dbHandle)
+	case 31:
+		return downgradeSQLiteDatabaseFromV31(p.dbHandle)
+	case 32:
+		return downgradeSQLiteDatabaseFromV32(p.dbHandle)
+	case 33:
+		return downgradeSQLiteDatabaseFromV33(p.dbHandle)
+	case 34:
+		return downgradeSQLiteDatabaseFromV34(p.dbHandle)
+	case 35:
+		return downgradeSQLiteDatabaseFromV35(p.dbHandle)
+	case 36:
+		return downgradeSQLiteDatabaseFromV36(p.dbHandle)
+	case 37:
+		return downgradeSQLiteDatabaseFromV37(p.dbHandle)
+	case 38:
+		return downgradeSQLiteDatabaseFromV38(p.dbHandle)
+	case 39:
+		return downgradeSQLiteDatabaseFromV39(p.dbHandle)
 	default:
 		return fmt.Errorf("database schema version not handled: %d", dbVersion.Version)
 	}
@@ -813,7 +1018,84 @@ func updateSQLiteDatabaseFromV26(dbHandle *sql.DB) error {
 }
 
 func updateSQLiteDatabaseFromV27(dbHandle *sql.DB) error {
-	return updateSQLiteDatabaseFrom27To28(dbHandle)
+	if err := updateSQLiteDatabaseFrom27To28(dbHandle); err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV28(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV28(dbHandle *sql.DB) error {
+	if err := updateSQLiteDatabaseFrom28To29(dbHandle); err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV29(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV29(dbHandle *sql.DB) error {
+	if err := updateSQLiteDatabaseFrom29To30(dbHandle); err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV30(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV30(dbHandle *sql.DB) error {
+	if err := updateSQLiteDatabaseFrom30To31(dbHandle); err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV31(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV31(dbHandle *sql.DB) error {
+	if err := updateSQLiteDatabaseFrom31To32(dbHandle); err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV32(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV32(dbHandle *sql.DB) error {
+	if err := updateSQLiteDatabaseFrom32To33(dbHandle); err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV33(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV33(dbHandle *sql.DB) error {
+	if err := updateSQLiteDatabaseFrom33To34(dbHandle); err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV34(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV34(dbHandle *sql.DB) error {
+	if err := updateSQLiteDatabaseFrom34To35(dbHandle); err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV35(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV35(dbHandle *sql.DB) error {
+	if err := updateSQLiteDatabaseFrom35To36(dbHandle); err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV36(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV36(dbHandle *sql.DB) error {
+	if err := updateSQLiteDatabaseFrom36To37(dbHandle); err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV37(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV37(dbHandle *sql.DB) error {
+	if err := updateSQLiteDatabaseFrom37To38(dbHandle); err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV38(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV38(dbHandle *sql.DB) error {
+	return updateSQLiteDatabaseFrom38To39(dbHandle)
 }
 
 func downgradeSQLiteDatabaseFromV24(dbHandle *sql.DB) error {
@@ -848,6 +1130,83 @@ func downgradeSQLiteDatabaseFromV28(dbHandle *sql.DB) error {
 	return downgradeSQLiteDatabaseFromV27(dbHandle)
 }
 
+func downgradeSQLiteDatabaseFromV29(dbHandle *sql.DB) error {
+	if err := downgradeSQLiteDatabaseFrom29To28(dbHandle); err != nil {
+		return err
+	}
+	return downgradeSQLiteDatabaseFromV28(dbHandle)
+}
+
+func downgradeSQLiteDatabaseFromV30(dbHandle *sql.DB) error {
+	if err := downgradeSQLiteDatabaseFrom30To29(dbHandle); err != nil {
+		return err
+	}
+	return downgradeSQLiteDatabaseFromV29(dbHandle)
+}
+
+func downgradeSQLiteDatabaseFromV31(dbHandle *sql.DB) error {
+	if err := downgradeSQLiteDatabaseFrom31To30(dbHandle); err != nil {
+		return err
+	}
+	return downgradeSQLiteDatabaseFromV30(dbHandle)
+}
+
+func downgradeSQLiteDatabaseFromV32(dbHandle *sql.DB) error {
+	if err := downgradeSQLiteDatabaseFrom32To31(dbHandle); err != nil {
+		return err
+	}
+	return downgradeSQLiteDatabaseFromV31(dbHandle)
+}
+
+func downgradeSQLiteDatabaseFromV33(dbHandle *sql.DB) error {
+	if err := downgradeSQLiteDatabaseFrom33To32(dbHandle); err != nil {
+		return err
+	}
+	return downgradeSQLiteDatabaseFromV32(dbHandle)
+}
+
+func downgradeSQLiteDatabaseFromV34(dbHandle *sql.DB) error {
+	if err := downgradeSQLiteDatabaseFrom34To33(dbHandle); err != nil {
+		return err
+	}
+	return downgradeSQLiteDatabaseFromV33(dbHandle)
+}
+
+func downgradeSQLiteDatabaseFromV35(dbHandle *sql.DB) error {
+	if err := downgradeSQLiteDatabaseFrom35To34(dbHandle); err != nil {
+		return err
+	}
+	return downgradeSQLiteDatabaseFromV34(dbHandle)
+}
+
+func downgradeSQLiteDatabaseFromV36(dbHandle *sql.DB) error {
+	if err := downgradeSQLiteDatabaseFrom36To35(dbHandle); err != nil {
+		return err
+	}
+	return downgradeSQLiteDatabaseFromV35(dbHandle)
+}
+
+func downgradeSQLiteDatabaseFromV37(dbHandle *sql.DB) error {
+	if err := downgradeSQLiteDatabaseFrom37To36(dbHandle); err != nil {
+		return err
+	}
+	return downgradeSQLiteDatabaseFromV36(dbHandle)
+}
+
+func downgradeSQLiteDatabaseFromV38(dbHandle *sql.DB) error {
+	if err := downgradeSQLiteDatabaseFrom38To37(dbHandle); err != nil {
+		return err
+	}
+	return downgradeSQLiteDatabaseFromV37(dbHandle)
+}
+
+func downgradeSQLiteDatabaseFromV39(dbHandle *sql.DB) error {
+	if err := downgradeSQLiteDatabaseFrom39To38(dbHandle); err != nil {
+		return err
+	}
+	return downgradeSQLiteDatabaseFromV38(dbHandle)
+}
+
 func updateSQLiteDatabaseFrom23To24(dbHandle *sql.DB) error {
 	logger.InfoToConsole("updating database schema version: 23 -> 24")
 	providerLog(logger.LevelInfo, "updating database schema version: 23 -> 24")
@@ -887,6 +1246,95 @@ func updateSQLiteDatabaseFrom27To28(dbHandle *sql.DB) error {
 	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 28, true)
 }
 
+func updateSQLiteDatabaseFrom28To29(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 28 -> 29")
+	providerLog(logger.LevelInfo, "updating database schema version: 28 -> 29")
+	sql := strings.ReplaceAll(sqliteV29SQL, "{{files_metadata}}", sqlTableFilesMetadata)
+	sql = strings.ReplaceAll(sql, "{{users}}", sqlTableUsers)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 29, true)
+}
+
+func updateSQLiteDatabaseFrom29To30(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 29 -> 30")
+	providerLog(logger.LevelInfo, "updating database schema version: 29 -> 30")
+	sql := strings.ReplaceAll(sqliteV30SQL, "{{events_digests}}", sqlTableEventsDigests)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 30, true)
+}
+
+func updateSQLiteDatabaseFrom30To31(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 30 -> 31")
+	providerLog(logger.LevelInfo, "updating database schema version: 30 -> 31")
+	sql := strings.ReplaceAll(sqliteV31SQL, "{{audit_logs}}", sqlTableAuditLogs)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 31, true)
+}
+
+func updateSQLiteDatabaseFrom31To32(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 31 -> 32")
+	providerLog(logger.LevelInfo, "updating database schema version: 31 -> 32")
+	sql := strings.ReplaceAll(sqliteV32SQL, "{{folders}}", sqlTableFolders)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 32, true)
+}
+
+func updateSQLiteDatabaseFrom32To33(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 32 -> 33")
+	providerLog(logger.LevelInfo, "updating database schema version: 32 -> 33")
+	sql := strings.ReplaceAll(sqliteV33SQL, "{{roles}}", sqlTableRoles)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 33, true)
+}
+
+func updateSQLiteDatabaseFrom33To34(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 33 -> 34")
+	providerLog(logger.LevelInfo, "updating database schema version: 33 -> 34")
+	sql := strings.ReplaceAll(sqliteV34SQL, "{{folders}}", sqlTableFolders)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 34, true)
+}
+
+func updateSQLiteDatabaseFrom34To35(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 34 -> 35")
+	providerLog(logger.LevelInfo, "updating database schema version: 34 -> 35")
+	sql := strings.ReplaceAll(sqliteV35SQL, "{{shares}}", sqlTableShares)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 35, true)
+}
+
+func updateSQLiteDatabaseFrom35To36(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 35 -> 36")
+	providerLog(logger.LevelInfo, "updating database schema version: 35 -> 36")
+	sql := strings.ReplaceAll(sqliteV36SQL, "{{share_events}}", sqlTableShareEvents)
+	sql = strings.ReplaceAll(sql, "{{shares}}", sqlTableShares)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 36, true)
+}
+
+func updateSQLiteDatabaseFrom36To37(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 36 -> 37")
+	providerLog(logger.LevelInfo, "updating database schema version: 36 -> 37")
+	sql := strings.ReplaceAll(sqliteV37SQL, "{{admin_roles}}", sqlTableAdminRoles)
+	sql = strings.ReplaceAll(sql, "{{admins}}", sqlTableAdmins)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 37, true)
+}
+
+func updateSQLiteDatabaseFrom37To38(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 37 -> 38")
+	providerLog(logger.LevelInfo, "updating database schema version: 37 -> 38")
+	sql := strings.ReplaceAll(sqliteV38SQL, "{{groups}}", sqlTableGroups)
+	sql = strings.ReplaceAll(sql, "{{folders}}", sqlTableFolders)
+	sql = strings.ReplaceAll(sql, "{{events_rules}}", sqlTableEventsRules)
+	sql = strings.ReplaceAll(sql, "{{roles}}", sqlTableRoles)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 38, true)
+}
+
+func updateSQLiteDatabaseFrom38To39(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database schema version: 38 -> 39")
+	providerLog(logger.LevelInfo, "updating database schema version: 38 -> 39")
+	sql := strings.ReplaceAll(sqliteV39SQL, "{{api_keys}}", sqlTableAPIKeys)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 39, true)
+}
+
 func downgradeSQLiteDatabaseFrom24To23(dbHandle *sql.DB) error {
 	logger.InfoToConsole("downgrading database schema version: 24 -> 23")
 	providerLog(logger.LevelInfo, "downgrading database schema version: 24 -> 23")
@@ -925,6 +1373,88 @@ func downgradeSQLiteDatabaseFrom28To27(dbHandle *sql.DB) error {
 	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 27, false)
 }
 
+func downgradeSQLiteDatabaseFrom29To28(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 29 -> 28")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 29 -> 28")
+	sql := strings.ReplaceAll(sqliteV29DownSQL, "{{files_metadata}}", sqlTableFilesMetadata)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 28, false)
+}
+
+func downgradeSQLiteDatabaseFrom30To29(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 30 -> 29")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 30 -> 29")
+	sql := strings.ReplaceAll(sqliteV30DownSQL, "{{events_digests}}", sqlTableEventsDigests)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 29, false)
+}
+
+func downgradeSQLiteDatabaseFrom31To30(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 31 -> 30")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 31 -> 30")
+	sql := strings.ReplaceAll(sqliteV31DownSQL, "{{audit_logs}}", sqlTableAuditLogs)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 30, false)
+}
+
+func downgradeSQLiteDatabaseFrom32To31(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 32 -> 31")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 32 -> 31")
+	sql := strings.ReplaceAll(sqliteV32DownSQL, "{{folders}}", sqlTableFolders)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 31, false)
+}
+
+func downgradeSQLiteDatabaseFrom33To32(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 33 -> 32")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 33 -> 32")
+	sql := strings.ReplaceAll(sqliteV33DownSQL, "{{roles}}", sqlTableRoles)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 32, false)
+}
+
+func downgradeSQLiteDatabaseFrom34To33(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 34 -> 33")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 34 -> 33")
+	sql := strings.ReplaceAll(sqliteV34DownSQL, "{{folders}}", sqlTableFolders)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 33, false)
+}
+
+func downgradeSQLiteDatabaseFrom35To34(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 35 -> 34")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 35 -> 34")
+	sql := strings.ReplaceAll(sqliteV35DownSQL, "{{shares}}", sqlTableShares)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 34, false)
+}
+
+func downgradeSQLiteDatabaseFrom36To35(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 36 -> 35")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 36 -> 35")
+	sql := strings.ReplaceAll(sqliteV36DownSQL, "{{share_events}}", sqlTableShareEvents)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 35, false)
+}
+
+func downgradeSQLiteDatabaseFrom37To36(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 37 -> 36")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 37 -> 36")
+	sql := strings.ReplaceAll(sqliteV37DownSQL, "{{admin_roles}}", sqlTableAdminRoles)
+	sql = strings.ReplaceAll(sql, "{{admins}}", sqlTableAdmins)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 36, false)
+}
+
+func downgradeSQLiteDatabaseFrom38To37(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 38 -> 37")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 38 -> 37")
+	sql := strings.ReplaceAll(sqliteV38DownSQL, "{{groups}}", sqlTableGroups)
+	sql = strings.ReplaceAll(sql, "{{folders}}", sqlTableFolders)
+	sql = strings.ReplaceAll(sql, "{{events_rules}}", sqlTableEventsRules)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 37, false)
+}
+
+func downgradeSQLiteDatabaseFrom39To38(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database schema version: 39 -> 38")
+	providerLog(logger.LevelInfo, "downgrading database schema version: 39 -> 38")
+	sql := strings.ReplaceAll(sqliteV39DownSQL, "{{api_keys}}", sqlTableAPIKeys)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 38, false)
+}
+
 /*func setPragmaFK(dbHandle *sql.DB, value string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), longSQLQueryTimeout)
 	defer cancel()
@@ -28,16 +28,20 @@ const (
 		"u.expiration_date,u.last_login,u.status,u.filters,u.filesystem,u.additional_info,u.description,u.email,u.created_at," +
 		"u.updated_at,u.upload_data_transfer,u.download_data_transfer,u.total_data_transfer," +
 		"u.used_upload_data_transfer,u.used_download_data_transfer,u.deleted_at,u.first_download,u.first_upload,r.name,u.last_password_change"
-	selectFolderFields = "id,path,used_quota_size,used_quota_files,last_quota_update,name,description,filesystem"
-	selectAdminFields  = "a.id,a.username,a.password,a.status,a.email,a.permissions,a.filters,a.additional_info,a.description,a.created_at,a.updated_at,a.last_login,r.name"
-	selectAPIKeyFields = "key_id,name,api_key,scope,created_at,updated_at,last_use_at,expires_at,description,user_id,admin_id"
+	selectAdminFields  = "a.id,a.username,a.password,a.status,a.email,a.permissions,a.filters,a.additional_info,a.description,a.created_at,a.updated_at,a.last_login,r.name,ar.name"
+	selectAPIKeyFields = "key_id,name,api_key,scope,created_at,updated_at,last_use_at,expires_at,description,user_id,admin_id,filters"
 	selectShareFields  = "s.share_id,s.name,s.description,s.scope,s.paths,u.username,s.created_at,s.updated_at,s.last_use_at," +
-		"s.expires_at,s.password,s.max_tokens,s.used_tokens,s.allow_from"
-	selectGroupFields       = "id,name,description,created_at,updated_at,user_settings"
-	selectEventActionFields = "id,name,description,type,options"
-	selectRoleFields        = "id,name,description,created_at,updated_at"
-	selectIPListEntryFields = "type,ipornet,mode,protocols,description,created_at,updated_at,deleted_at"
-	selectMinimalFields     = "id,name"
+		"s.expires_at,s.password,s.max_tokens,s.used_tokens,s.allow_from,s.options"
+	selectEventActionFields  = "id,name,description,type,options"
+	selectRoleFields         = "id,name,description,created_at,updated_at,tenant"
+	selectAdminRoleFields    = "id,name,description,created_at,updated_at,permissions,filters"
+	selectIPListEntryFields  = "type,ipornet,mode,protocols,description,created_at,updated_at,deleted_at"
+	selectMinimalFields      = "id,name"
+	selectFileMetadataFields = "m.path,m.metadata,m.tags,m.updated_at"
+	selectEventDigestFields  = "id,rule_name,action_name,name,window_end,data,created_at"
+	selectAuditLogFields     = "id,created_at,action,executor,ip,role,object_type,object_name,before_data,after_data,changes"
+	selectAuditLogMinFields  = "id,created_at,action,executor,ip,role,object_type,object_name,'','',changes"
+	selectShareEventFields   = "id,share_id,created_at,ip,user_agent,path,size"
 )
 
 func getSQLPlaceholders() []string {
@@ -62,10 +66,32 @@ func getSQLQuotedName(name string) string {
 
 func getSelectEventRuleFields() string {
 	if config.Driver == MySQLDataProviderName {
-		return "id,name,description,created_at,updated_at,`trigger`,conditions,deleted_at,status"
+		return "id,name,description,created_at,updated_at,`trigger`,conditions,deleted_at,status," +
+			getSelectRoleNameField(sqlTableEventsRules)
 	}
 
-	return `id,name,description,created_at,updated_at,"trigger",conditions,deleted_at,status`
+	return `id,name,description,created_at,updated_at,"trigger",conditions,deleted_at,status,` +
+		getSelectRoleNameField(sqlTableEventsRules)
+}
+
+func getSelectGroupFields() string {
+	return "id,name,description,created_at,updated_at,user_settings," +
+		getSelectRoleNameField(getSQLQuotedName(sqlTableGroups))
+}
+
+func getSelectFolderFields() string {
+	return "id,path,used_quota_size,used_quota_files,last_quota_update,name,description,filesystem,failover,limits," +
+		getSelectRoleNameField(sqlTableFolders)
+}
+
+// getSelectRoleNameField returns a sub-select for the name of the role owning
+// the rows of the specified table
+func getSelectRoleNameField(table string) string {
+	return fmt.Sprintf("(SELECT r.name FROM %s r WHERE r.id = %s.role_id)", sqlTableRoles, table)
+}
+
+func getRoleIDFromName(placeholder string) string {
+	return fmt.Sprintf("(SELECT id FROM %s WHERE name = %s)", sqlTableRoles, placeholder)
 }
 
 func getCoalesceDefaultForRole(role string) string {
@@ -102,6 +128,15 @@ func getSessionQuery() string {
 		sqlPlaceholders[0])
 }
 
+func getSessionsQuery() string {
+	if config.Driver == MySQLDataProviderName {
+		return fmt.Sprintf("SELECT `key`,`data`,`type`,`timestamp` FROM %s WHERE `type` = %s AND `timestamp` >= %s",
+			sqlTableSharedSessions, sqlPlaceholders[0], sqlPlaceholders[1])
+	}
+	return fmt.Sprintf(`SELECT key,data,type,timestamp FROM %s WHERE type = %s AND timestamp >= %s`,
+		sqlTableSharedSessions, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
 func getCleanupSessionsQuery() string {
 	return fmt.Sprintf(`DELETE from %s WHERE type = %s AND timestamp < %s`,
 		sqlTableSharedSessions, sqlPlaceholders[0], sqlPlaceholders[1])
@@ -337,34 +372,93 @@ func getDumpRolesQuery() string {
 }
 
 func getAddRoleQuery() string {
-	return fmt.Sprintf(`INSERT INTO %s (name,description,created_at,updated_at)
-		VALUES (%s,%s,%s,%s)`, sqlTableRoles, sqlPlaceholders[0], sqlPlaceholders[1],
-		sqlPlaceholders[2], sqlPlaceholders[3])
+	return fmt.Sprintf(`INSERT INTO %s (name,description,created_at,updated_at,tenant)
+		VALUES (%s,%s,%s,%s,%s)`, sqlTableRoles, sqlPlaceholders[0], sqlPlaceholders[1],
+		sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4])
 }
 
 func getUpdateRoleQuery() string {
-	return fmt.Sprintf(`UPDATE %s SET description=%s,updated_at=%s
-		WHERE name = %s`, sqlTableRoles, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2])
+	return fmt.Sprintf(`UPDATE %s SET description=%s,updated_at=%s,tenant=%s
+		WHERE name = %s`, sqlTableRoles, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2],
+		sqlPlaceholders[3])
 }
 
 func getDeleteRoleQuery() string {
 	return fmt.Sprintf(`DELETE FROM %s WHERE name = %s`, sqlTableRoles, sqlPlaceholders[0])
 }
 
-func getGroupByNameQuery() string {
-	return fmt.Sprintf(`SELECT %s FROM %s WHERE name = %s`, selectGroupFields, getSQLQuotedName(sqlTableGroups),
+func getAdminRoleByNameQuery() string {
+	return fmt.Sprintf(`SELECT %s FROM %s WHERE name = %s`, selectAdminRoleFields, sqlTableAdminRoles,
 		sqlPlaceholders[0])
 }
 
-func getGroupsQuery(order string, minimal bool) string {
+func getAdminRolesQuery(order string, minimal bool) string {
 	var fieldSelection string
 	if minimal {
 		fieldSelection = selectMinimalFields
 	} else {
-		fieldSelection = selectGroupFields
+		fieldSelection = selectAdminRoleFields
 	}
 	return fmt.Sprintf(`SELECT %s FROM %s ORDER BY name %s LIMIT %s OFFSET %s`, fieldSelection,
-		getSQLQuotedName(sqlTableGroups), order, sqlPlaceholders[0], sqlPlaceholders[1])
+		sqlTableAdminRoles, order, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getAdminsWithAdminRolesQuery(roles []AdminRole) string {
+	var sb strings.Builder
+	for _, r := range roles {
+		if sb.Len() == 0 {
+			sb.WriteString("(")
+		} else {
+			sb.WriteString(",")
+		}
+		sb.WriteString(strconv.FormatInt(r.ID, 10))
+	}
+	if sb.Len() > 0 {
+		sb.WriteString(")")
+	}
+	return fmt.Sprintf(`SELECT r.id, a.username FROM %s a INNER JOIN %s r ON a.admin_role_id = r.id WHERE a.admin_role_id IN %s`,
+		sqlTableAdmins, sqlTableAdminRoles, sb.String())
+}
+
+func getDumpAdminRolesQuery() string {
+	return fmt.Sprintf(`SELECT %s FROM %s`, selectAdminRoleFields, sqlTableAdminRoles)
+}
+
+func getAddAdminRoleQuery() string {
+	return fmt.Sprintf(`INSERT INTO %s (name,description,created_at,updated_at,permissions,filters)
+		VALUES (%s,%s,%s,%s,%s,%s)`, sqlTableAdminRoles, sqlPlaceholders[0], sqlPlaceholders[1],
+		sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5])
+}
+
+func getUpdateAdminRoleQuery() string {
+	return fmt.Sprintf(`UPDATE %s SET description=%s,updated_at=%s,permissions=%s,filters=%s
+		WHERE name = %s`, sqlTableAdminRoles, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2],
+		sqlPlaceholders[3], sqlPlaceholders[4])
+}
+
+func getDeleteAdminRoleQuery() string {
+	return fmt.Sprintf(`DELETE FROM %s WHERE name = %s`, sqlTableAdminRoles, sqlPlaceholders[0])
+}
+
+func getGroupByNameQuery() string {
+	return fmt.Sprintf(`SELECT %s FROM %s WHERE name = %s`, getSelectGroupFields(), getSQLQuotedName(sqlTableGroups),
+		sqlPlaceholders[0])
+}
+
+func getGroupsQuery(order string, minimal bool, role string) string {
+	var fieldSelection string
+	if minimal {
+		fieldSelection = selectMinimalFields
+	} else {
+		fieldSelection = getSelectGroupFields()
+	}
+	if role == "" {
+		return fmt.Sprintf(`SELECT %s FROM %s ORDER BY name %s LIMIT %s OFFSET %s`, fieldSelection,
+			getSQLQuotedName(sqlTableGroups), order, sqlPlaceholders[0], sqlPlaceholders[1])
+	}
+	return fmt.Sprintf(`SELECT %s FROM %s WHERE role_id = %s ORDER BY name %s LIMIT %s OFFSET %s`, fieldSelection,
+		getSQLQuotedName(sqlTableGroups), getRoleIDFromName(sqlPlaceholders[0]), order, sqlPlaceholders[1],
+		sqlPlaceholders[2])
 }
 
 func getGroupsWithNamesQuery(numArgs int) string {
@@ -382,7 +476,8 @@ func getGroupsWithNamesQuery(numArgs int) string {
 	} else {
 		sb.WriteString("('')")
 	}
-	return fmt.Sprintf(`SELECT %s FROM %s WHERE name in %s`, selectGroupFields, getSQLQuotedName(sqlTableGroups), sb.String())
+	return fmt.Sprintf(`SELECT %s FROM %s WHERE name in %s`, getSelectGroupFields(), getSQLQuotedName(sqlTableGroups),
+		sb.String())
 }
 
 func getUsersInGroupsQuery(numArgs int) string {
@@ -405,19 +500,21 @@ func getUsersInGroupsQuery(numArgs int) string {
 }
 
 func getDumpGroupsQuery() string {
-	return fmt.Sprintf(`SELECT %s FROM %s`, selectGroupFields, getSQLQuotedName(sqlTableGroups))
+	return fmt.Sprintf(`SELECT %s FROM %s`, getSelectGroupFields(), getSQLQuotedName(sqlTableGroups))
 }
 
-func getAddGroupQuery() string {
-	return fmt.Sprintf(`INSERT INTO %s (name,description,created_at,updated_at,user_settings)
-		VALUES (%s,%s,%s,%s,%s)`, getSQLQuotedName(sqlTableGroups), sqlPlaceholders[0], sqlPlaceholders[1],
-		sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4])
+func getAddGroupQuery(role string) string {
+	return fmt.Sprintf(`INSERT INTO %s (name,description,created_at,updated_at,user_settings,role_id)
+		VALUES (%s,%s,%s,%s,%s,COALESCE((SELECT id from %s WHERE name=%s),%s))`, getSQLQuotedName(sqlTableGroups),
+		sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4],
+		sqlTableRoles, sqlPlaceholders[5], getCoalesceDefaultForRole(role))
 }
 
-func getUpdateGroupQuery() string {
-	return fmt.Sprintf(`UPDATE %s SET description=%s,user_settings=%s,updated_at=%s
-		WHERE name = %s`, getSQLQuotedName(sqlTableGroups), sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2],
-		sqlPlaceholders[3])
+func getUpdateGroupQuery(role string) string {
+	return fmt.Sprintf(`UPDATE %s SET description=%s,user_settings=%s,updated_at=%s,
+		role_id=COALESCE((SELECT id from %s WHERE name=%s),%s) WHERE name = %s`, getSQLQuotedName(sqlTableGroups),
+		sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlTableRoles, sqlPlaceholders[3],
+		getCoalesceDefaultForRole(role), sqlPlaceholders[4])
 }
 
 func getDeleteGroupQuery() string {
@@ -425,33 +522,38 @@ func getDeleteGroupQuery() string {
 }
 
 func getAdminByUsernameQuery() string {
-	return fmt.Sprintf(`SELECT %s FROM %s a LEFT JOIN %s r on r.id = a.role_id WHERE a.username = %s`,
-		selectAdminFields, sqlTableAdmins, sqlTableRoles, sqlPlaceholders[0])
+	return fmt.Sprintf(`SELECT %s FROM %s a LEFT JOIN %s r on r.id = a.role_id LEFT JOIN %s ar on ar.id = a.admin_role_id
+		WHERE a.username = %s`, selectAdminFields, sqlTableAdmins, sqlTableRoles, sqlTableAdminRoles, sqlPlaceholders[0])
 }
 
 func getAdminsQuery(order string) string {
-	return fmt.Sprintf(`SELECT %s FROM %s a LEFT JOIN %s r on r.id = a.role_id ORDER BY a.username %s LIMIT %s OFFSET %s`,
-		selectAdminFields, sqlTableAdmins, sqlTableRoles, order, sqlPlaceholders[0], sqlPlaceholders[1])
+	return fmt.Sprintf(`SELECT %s FROM %s a LEFT JOIN %s r on r.id = a.role_id LEFT JOIN %s ar on ar.id = a.admin_role_id
+		ORDER BY a.username %s LIMIT %s OFFSET %s`, selectAdminFields, sqlTableAdmins, sqlTableRoles, sqlTableAdminRoles,
+		order, sqlPlaceholders[0], sqlPlaceholders[1])
 }
 
 func getDumpAdminsQuery() string {
-	return fmt.Sprintf(`SELECT %s FROM %s a LEFT JOIN %s r on r.id = a.role_id`,
-		selectAdminFields, sqlTableAdmins, sqlTableRoles)
+	return fmt.Sprintf(`SELECT %s FROM %s a LEFT JOIN %s r on r.id = a.role_id LEFT JOIN %s ar on ar.id = a.admin_role_id`,
+		selectAdminFields, sqlTableAdmins, sqlTableRoles, sqlTableAdminRoles)
 }
 
-func getAddAdminQuery(role string) string {
-	return fmt.Sprintf(`INSERT INTO %s (username,password,status,email,permissions,filters,additional_info,description,created_at,updated_at,last_login,role_id)
-		VALUES (%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,0,COALESCE((SELECT id from %s WHERE name = %s),%s))`,
+func getAddAdminQuery(role, adminRole string) string {
+	return fmt.Sprintf(`INSERT INTO %s (username,password,status,email,permissions,filters,additional_info,description,created_at,updated_at,last_login,role_id,admin_role_id)
+		VALUES (%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,0,COALESCE((SELECT id from %s WHERE name = %s),%s),
+		COALESCE((SELECT id from %s WHERE name = %s),%s))`,
 		sqlTableAdmins, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4],
 		sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7], sqlPlaceholders[8], sqlPlaceholders[9],
-		sqlTableRoles, sqlPlaceholders[10], getCoalesceDefaultForRole(role))
+		sqlTableRoles, sqlPlaceholders[10], getCoalesceDefaultForRole(role), sqlTableAdminRoles, sqlPlaceholders[11],
+		getCoalesceDefaultForRole(adminRole))
 }
 
-func getUpdateAdminQuery(role string) string {
+func getUpdateAdminQuery(role, adminRole string) string {
 	return fmt.Sprintf(`UPDATE %s SET password=%s,status=%s,email=%s,permissions=%s,filters=%s,additional_info=%s,description=%s,updated_at=%s,
-		role_id=COALESCE((SELECT id from %s WHERE name = %s),%s) WHERE username = %s`, sqlTableAdmins, sqlPlaceholders[0],
+		role_id=COALESCE((SELECT id from %s WHERE name = %s),%s),admin_role_id=COALESCE((SELECT id from %s WHERE name = %s),%s)
+		WHERE username = %s`, sqlTableAdmins, sqlPlaceholders[0],
 		sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6],
-		sqlPlaceholders[7], sqlTableRoles, sqlPlaceholders[8], getCoalesceDefaultForRole(role), sqlPlaceholders[9])
+		sqlPlaceholders[7], sqlTableRoles, sqlPlaceholders[8], getCoalesceDefaultForRole(role), sqlTableAdminRoles,
+		sqlPlaceholders[9], getCoalesceDefaultForRole(adminRole), sqlPlaceholders[10])
 }
 
 func getDeleteAdminQuery() string {
@@ -479,33 +581,192 @@ func getDumpSharesQuery() string {
 
 func getAddShareQuery() string {
 	return fmt.Sprintf(`INSERT INTO %s (share_id,name,description,scope,paths,created_at,updated_at,last_use_at,
-		expires_at,password,max_tokens,used_tokens,allow_from,user_id) VALUES (%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s)`,
+		expires_at,password,max_tokens,used_tokens,allow_from,options,user_id) VALUES (%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s)`,
 		sqlTableShares, sqlPlaceholders[0], sqlPlaceholders[1],
 		sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6],
 		sqlPlaceholders[7], sqlPlaceholders[8], sqlPlaceholders[9], sqlPlaceholders[10], sqlPlaceholders[11],
-		sqlPlaceholders[12], sqlPlaceholders[13])
+		sqlPlaceholders[12], sqlPlaceholders[13], sqlPlaceholders[14])
 }
 
 func getUpdateShareRestoreQuery() string {
 	return fmt.Sprintf(`UPDATE %s SET name=%s,description=%s,scope=%s,paths=%s,created_at=%s,updated_at=%s,
-		last_use_at=%s,expires_at=%s,password=%s,max_tokens=%s,used_tokens=%s,allow_from=%s,user_id=%s WHERE share_id = %s`, sqlTableShares,
+		last_use_at=%s,expires_at=%s,password=%s,max_tokens=%s,used_tokens=%s,allow_from=%s,options=%s,user_id=%s
+		WHERE share_id = %s`, sqlTableShares,
 		sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4],
 		sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7], sqlPlaceholders[8], sqlPlaceholders[9],
-		sqlPlaceholders[10], sqlPlaceholders[11], sqlPlaceholders[12], sqlPlaceholders[13])
+		sqlPlaceholders[10], sqlPlaceholders[11], sqlPlaceholders[12], sqlPlaceholders[13], sqlPlaceholders[14])
 }
 
 func getUpdateShareQuery() string {
 	return fmt.Sprintf(`UPDATE %s SET name=%s,description=%s,scope=%s,paths=%s,updated_at=%s,expires_at=%s,
-		password=%s,max_tokens=%s,allow_from=%s,user_id=%s WHERE share_id = %s`, sqlTableShares,
+		password=%s,max_tokens=%s,allow_from=%s,options=%s,user_id=%s WHERE share_id = %s`, sqlTableShares,
 		sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4],
 		sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7], sqlPlaceholders[8], sqlPlaceholders[9],
-		sqlPlaceholders[10])
+		sqlPlaceholders[10], sqlPlaceholders[11])
 }
 
 func getDeleteShareQuery() string {
 	return fmt.Sprintf(`DELETE FROM %s WHERE share_id = %s`, sqlTableShares, sqlPlaceholders[0])
 }
 
+func getFileMetadataQuery() string {
+	return fmt.Sprintf(`SELECT %s FROM %s m INNER JOIN %s u ON m.user_id = u.id WHERE u.username = %s AND m.path_hash = %s`,
+		selectFileMetadataFields, sqlTableFilesMetadata, sqlTableUsers, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getFilesMetadataQuery() string {
+	return fmt.Sprintf(`SELECT %s FROM %s m INNER JOIN %s u ON m.user_id = u.id WHERE u.username = %s`,
+		selectFileMetadataFields, sqlTableFilesMetadata, sqlTableUsers, sqlPlaceholders[0])
+}
+
+func getAddFileMetadataQuery() string {
+	return fmt.Sprintf(`INSERT INTO %s (path,path_hash,metadata,tags,updated_at,user_id) VALUES (%s,%s,%s,%s,%s,%s)`,
+		sqlTableFilesMetadata, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3],
+		sqlPlaceholders[4], sqlPlaceholders[5])
+}
+
+func getRenameFileMetadataQuery() string {
+	return fmt.Sprintf(`UPDATE %s SET path=%s,path_hash=%s,updated_at=%s WHERE user_id = (SELECT id FROM %s WHERE username = %s)
+		AND path_hash = %s`, sqlTableFilesMetadata, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2],
+		sqlTableUsers, sqlPlaceholders[3], sqlPlaceholders[4])
+}
+
+func getDeleteFileMetadataQuery() string {
+	return fmt.Sprintf(`DELETE FROM %s WHERE user_id = (SELECT id FROM %s WHERE username = %s) AND path_hash = %s`,
+		sqlTableFilesMetadata, sqlTableUsers, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getAddEventDigestEntryQuery() string {
+	return fmt.Sprintf(`INSERT INTO %s (rule_name,action_name,name,window_end,data,created_at) VALUES (%s,%s,%s,%s,%s,%s)`,
+		sqlTableEventsDigests, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3],
+		sqlPlaceholders[4], sqlPlaceholders[5])
+}
+
+func getEventDigestEntriesQuery() string {
+	return fmt.Sprintf(`SELECT %s FROM %s WHERE window_end <= %s ORDER BY id ASC`, selectEventDigestFields,
+		sqlTableEventsDigests, sqlPlaceholders[0])
+}
+
+func getDeleteEventDigestEntriesQuery(ids []int64) string {
+	var sb strings.Builder
+	for _, id := range ids {
+		if sb.Len() == 0 {
+			sb.WriteString("(")
+		} else {
+			sb.WriteString(",")
+		}
+		sb.WriteString(strconv.FormatInt(id, 10))
+	}
+	if sb.Len() > 0 {
+		sb.WriteString(")")
+	}
+	return fmt.Sprintf(`DELETE FROM %s WHERE id IN %s`, sqlTableEventsDigests, sb.String())
+}
+
+func getAddAuditLogEntryQuery() string {
+	return fmt.Sprintf(`INSERT INTO %s (created_at,action,executor,ip,role,object_type,object_name,before_data,after_data,changes)
+		VALUES (%s,%s,%s,%s,%s,%s,%s,%s,%s,%s)`, sqlTableAuditLogs, sqlPlaceholders[0], sqlPlaceholders[1],
+		sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6],
+		sqlPlaceholders[7], sqlPlaceholders[8], sqlPlaceholders[9])
+}
+
+func getAuditLogQueryInClause(column string, values []string, args []any) (string, []any) {
+	var sb strings.Builder
+	for _, val := range values {
+		if sb.Len() == 0 {
+			sb.WriteString(" AND ")
+			sb.WriteString(column)
+			sb.WriteString(" IN (")
+		} else {
+			sb.WriteString(",")
+		}
+		sb.WriteString(sqlPlaceholders[len(args)])
+		args = append(args, val)
+	}
+	if sb.Len() > 0 {
+		sb.WriteString(")")
+	}
+	return sb.String(), args
+}
+
+func getSearchAuditLogQuery(filters *AuditLogSearch) (string, []any) {
+	var sb strings.Builder
+	var args []any
+
+	addCondition := func(condition string, arg any) {
+		sb.WriteString(" AND ")
+		sb.WriteString(condition)
+		sb.WriteString(sqlPlaceholders[len(args)])
+		args = append(args, arg)
+	}
+
+	sb.WriteString("SELECT ")
+	if filters.OmitObjectData {
+		sb.WriteString(selectAuditLogMinFields)
+	} else {
+		sb.WriteString(selectAuditLogFields)
+	}
+	sb.WriteString(" FROM ")
+	sb.WriteString(sqlTableAuditLogs)
+	sb.WriteString(" WHERE 1=1")
+	if filters.FromID > 0 {
+		if filters.Order == OrderASC {
+			addCondition("id > ", filters.FromID)
+		} else {
+			addCondition("id < ", filters.FromID)
+		}
+	}
+	if filters.StartTimestamp > 0 {
+		addCondition("created_at >= ", filters.StartTimestamp)
+	}
+	if filters.EndTimestamp > 0 {
+		addCondition("created_at <= ", filters.EndTimestamp)
+	}
+	if filters.Executor != "" {
+		addCondition("executor = ", filters.Executor)
+	}
+	if filters.IP != "" {
+		addCondition("ip = ", filters.IP)
+	}
+	if filters.Role != "" {
+		addCondition("role = ", filters.Role)
+	}
+	if filters.ObjectName != "" {
+		addCondition("object_name = ", filters.ObjectName)
+	}
+	var clause string
+	clause, args = getAuditLogQueryInClause("action", filters.Actions, args)
+	sb.WriteString(clause)
+	clause, args = getAuditLogQueryInClause("object_type", filters.ObjectTypes, args)
+	sb.WriteString(clause)
+	sb.WriteString(" ORDER BY id ")
+	sb.WriteString(filters.Order)
+	sb.WriteString(" LIMIT ")
+	sb.WriteString(sqlPlaceholders[len(args)])
+	args = append(args, filters.Limit)
+	return sb.String(), args
+}
+
+func getCleanupAuditLogQuery() string {
+	return fmt.Sprintf(`DELETE FROM %s WHERE created_at < %s`, sqlTableAuditLogs, sqlPlaceholders[0])
+}
+
+func getAddShareEventQuery() string {
+	return fmt.Sprintf(`INSERT INTO %s (share_id,created_at,ip,user_agent,path,size) VALUES (%s,%s,%s,%s,%s,%s)`,
+		sqlTableShareEvents, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3],
+		sqlPlaceholders[4], sqlPlaceholders[5])
+}
+
+func getShareEventsQuery() string {
+	return fmt.Sprintf(`SELECT %s FROM %s WHERE share_id = %s AND created_at >= %s AND created_at <= %s
+		ORDER BY created_at DESC, id DESC LIMIT %s`, selectShareEventFields, sqlTableShareEvents, sqlPlaceholders[0],
+		sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3])
+}
+
+func getCleanupShareEventsQuery() string {
+	return fmt.Sprintf(`DELETE FROM %s WHERE created_at < %s`, sqlTableShareEvents, sqlPlaceholders[0])
+}
+
 func getAPIKeyByIDQuery() string {
 	return fmt.Sprintf(`SELECT %s FROM %s WHERE key_id = %s`, selectAPIKeyFields, sqlTableAPIKeys, sqlPlaceholders[0])
 }
@@ -520,16 +781,22 @@ func getDumpAPIKeysQuery() string {
 }
 
 func getAddAPIKeyQuery() string {
-	return fmt.Sprintf(`INSERT INTO %s (key_id,name,api_key,scope,created_at,updated_at,last_use_at,expires_at,description,user_id,admin_id)
-		VALUES (%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s)`, sqlTableAPIKeys, sqlPlaceholders[0], sqlPlaceholders[1],
+	return fmt.Sprintf(`INSERT INTO %s (key_id,name,api_key,scope,created_at,updated_at,last_use_at,expires_at,description,user_id,admin_id,filters)
+		VALUES (%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s)`, sqlTableAPIKeys, sqlPlaceholders[0], sqlPlaceholders[1],
 		sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6],
-		sqlPlaceholders[7], sqlPlaceholders[8], sqlPlaceholders[9], sqlPlaceholders[10])
+		sqlPlaceholders[7], sqlPlaceholders[8], sqlPlaceholders[9], sqlPlaceholders[10], sqlPlaceholders[11])
 }
 
 func getUpdateAPIKeyQuery() string {
-	return fmt.Sprintf(`UPDATE %s SET name=%s,scope=%s,expires_at=%s,user_id=%s,admin_id=%s,description=%s,updated_at=%s
-		WHERE key_id = %s`, sqlTableAPIKeys, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2],
-		sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7])
+	return fmt.Sprintf(`UPDATE %s SET name=%s,scope=%s,expires_at=%s,user_id=%s,admin_id=%s,description=%s,updated_at=%s,
+		filters=%s WHERE key_id = %s`, sqlTableAPIKeys, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2],
+		sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7],
+		sqlPlaceholders[8])
+}
+
+func getRotateAPIKeyQuery() string {
+	return fmt.Sprintf(`UPDATE %s SET api_key=%s,filters=%s,updated_at=%s WHERE key_id = %s`, sqlTableAPIKeys,
+		sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3])
 }
 
 func getDeleteAPIKeyQuery() string {
@@ -628,7 +895,7 @@ func getDumpUsersQuery() string {
 }
 
 func getDumpFoldersQuery() string {
-	return fmt.Sprintf(`SELECT %s FROM %s`, selectFolderFields, sqlTableFolders)
+	return fmt.Sprintf(`SELECT %s FROM %s`, getSelectFolderFields(), sqlTableFolders)
 }
 
 func getUpdateTransferQuotaQuery(reset bool) string {
@@ -733,36 +1000,48 @@ func getRemoveSoftDeletedUserQuery() string {
 }
 
 func getFolderByNameQuery() string {
-	return fmt.Sprintf(`SELECT %s FROM %s WHERE name = %s`, selectFolderFields, sqlTableFolders, sqlPlaceholders[0])
+	return fmt.Sprintf(`SELECT %s FROM %s WHERE name = %s`, getSelectFolderFields(), sqlTableFolders, sqlPlaceholders[0])
 }
 
-func getAddFolderQuery() string {
-	return fmt.Sprintf(`INSERT INTO %s (path,used_quota_size,used_quota_files,last_quota_update,name,description,filesystem)
-		VALUES (%s,%s,%s,%s,%s,%s,%s)`, sqlTableFolders, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2],
-		sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6])
+func getAddFolderQuery(role string) string {
+	return fmt.Sprintf(`INSERT INTO %s (path,used_quota_size,used_quota_files,last_quota_update,name,description,filesystem,
+		failover,limits,role_id) VALUES (%s,%s,%s,%s,%s,%s,%s,%s,%s,COALESCE((SELECT id from %s WHERE name=%s),%s))`,
+		sqlTableFolders, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4],
+		sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7], sqlPlaceholders[8], sqlTableRoles, sqlPlaceholders[9],
+		getCoalesceDefaultForRole(role))
 }
 
-func getUpdateFolderQuery() string {
-	return fmt.Sprintf(`UPDATE %s SET path=%s,description=%s,filesystem=%s WHERE name = %s`, sqlTableFolders, sqlPlaceholders[0],
-		sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3])
+func getUpdateFolderQuery(role string) string {
+	return fmt.Sprintf(`UPDATE %s SET path=%s,description=%s,filesystem=%s,failover=%s,limits=%s,
+		role_id=COALESCE((SELECT id from %s WHERE name=%s),%s) WHERE name = %s`,
+		sqlTableFolders, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4],
+		sqlTableRoles, sqlPlaceholders[5], getCoalesceDefaultForRole(role), sqlPlaceholders[6])
 }
 
 func getDeleteFolderQuery() string {
 	return fmt.Sprintf(`DELETE FROM %s WHERE name = %s`, sqlTableFolders, sqlPlaceholders[0])
 }
 
-func getUpsertFolderQuery() string {
+// getUpsertFolderQuery returns the query to add or update a folder, the owner
+// role is only set for new folders
+func getUpsertFolderQuery(role string) string {
 	if config.Driver == MySQLDataProviderName {
 		return fmt.Sprintf("INSERT INTO %s (`path`,`used_quota_size`,`used_quota_files`,`last_quota_update`,`name`,"+
-			"`description`,`filesystem`) VALUES (%s,%s,%s,%s,%s,%s,%s) ON DUPLICATE KEY UPDATE "+
-			"`path`=VALUES(`path`),`description`=VALUES(`description`),`filesystem`=VALUES(`filesystem`)",
+			"`description`,`filesystem`,`failover`,`limits`,`role_id`) VALUES (%s,%s,%s,%s,%s,%s,%s,%s,%s,"+
+			"COALESCE((SELECT id from %s WHERE name=%s),%s)) ON DUPLICATE KEY UPDATE "+
+			"`path`=VALUES(`path`),`description`=VALUES(`description`),`filesystem`=VALUES(`filesystem`),"+
+			"`failover`=VALUES(`failover`),`limits`=VALUES(`limits`)",
 			sqlTableFolders, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4],
-			sqlPlaceholders[5], sqlPlaceholders[6])
+			sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7], sqlPlaceholders[8], sqlTableRoles, sqlPlaceholders[9],
+			getCoalesceDefaultForRole(role))
 	}
-	return fmt.Sprintf(`INSERT INTO %s (path,used_quota_size,used_quota_files,last_quota_update,name,description,filesystem)
-		VALUES (%s,%s,%s,%s,%s,%s,%s) ON CONFLICT (name) DO UPDATE SET path = EXCLUDED.path,description=EXCLUDED.description,
-		filesystem=EXCLUDED.filesystem`, sqlTableFolders, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2],
-		sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6])
+	return fmt.Sprintf(`INSERT INTO %s (path,used_quota_size,used_quota_files,last_quota_update,name,description,filesystem,
+		failover,limits,role_id) VALUES (%s,%s,%s,%s,%s,%s,%s,%s,%s,COALESCE((SELECT id from %s WHERE name=%s),%s))
+		ON CONFLICT (name) DO UPDATE SET path = EXCLUDED.path,
+		description=EXCLUDED.description,filesystem=EXCLUDED.filesystem,failover=EXCLUDED.failover,limits=EXCLUDED.limits`,
+		sqlTableFolders, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4],
+		sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7], sqlPlaceholders[8], sqlTableRoles, sqlPlaceholders[9],
+		getCoalesceDefaultForRole(role))
 }
 
 func getClearUserGroupMappingQuery() string {
@@ -813,15 +1092,19 @@ func getAddUserFolderMappingQuery() string {
 		sqlPlaceholders[3], sqlTableUsers, sqlPlaceholders[4])
 }
 
-func getFoldersQuery(order string, minimal bool) string {
+func getFoldersQuery(order string, minimal bool, role string) string {
 	var fieldSelection string
 	if minimal {
 		fieldSelection = selectMinimalFields
 	} else {
-		fieldSelection = selectFolderFields
+		fieldSelection = getSelectFolderFields()
 	}
-	return fmt.Sprintf(`SELECT %s FROM %s ORDER BY name %s LIMIT %s OFFSET %s`, fieldSelection, sqlTableFolders,
-		order, sqlPlaceholders[0], sqlPlaceholders[1])
+	if role == "" {
+		return fmt.Sprintf(`SELECT %s FROM %s ORDER BY name %s LIMIT %s OFFSET %s`, fieldSelection, sqlTableFolders,
+			order, sqlPlaceholders[0], sqlPlaceholders[1])
+	}
+	return fmt.Sprintf(`SELECT %s FROM %s WHERE role_id = %s ORDER BY name %s LIMIT %s OFFSET %s`, fieldSelection,
+		sqlTableFolders, getRoleIDFromName(sqlPlaceholders[0]), order, sqlPlaceholders[1], sqlPlaceholders[2])
 }
 
 func getUpdateFolderQuotaQuery(reset bool) string {
@@ -886,7 +1169,7 @@ func getRelatedFoldersForUsersQuery(users []User) string {
 		sb.WriteString(")")
 	}
 	return fmt.Sprintf(`SELECT f.id,f.name,f.path,f.used_quota_size,f.used_quota_files,f.last_quota_update,fm.virtual_path,
-		fm.quota_size,fm.quota_files,fm.user_id,f.filesystem,f.description FROM %s f INNER JOIN %s fm ON f.id = fm.folder_id WHERE
+		fm.quota_size,fm.quota_files,fm.user_id,f.filesystem,f.description,f.failover,f.limits FROM %s f INNER JOIN %s fm ON f.id = fm.folder_id WHERE
 		fm.user_id IN %s ORDER BY fm.user_id`, sqlTableFolders, sqlTableUsersFoldersMapping, sb.String())
 }
 
@@ -973,7 +1256,7 @@ func getRelatedFoldersForGroupsQuery(groups []Group) string {
 		sb.WriteString(")")
 	}
 	return fmt.Sprintf(`SELECT f.id,f.name,f.path,f.used_quota_size,f.used_quota_files,f.last_quota_update,fm.virtual_path,
-		fm.quota_size,fm.quota_files,fm.group_id,f.filesystem,f.description FROM %s f INNER JOIN %s fm ON f.id = fm.folder_id WHERE
+		fm.quota_size,fm.quota_files,fm.group_id,f.filesystem,f.description,f.failover,f.limits FROM %s f INNER JOIN %s fm ON f.id = fm.folder_id WHERE
 		fm.group_id IN %s ORDER BY fm.group_id`, sqlTableFolders, sqlTableGroupsFoldersMapping, sb.String())
 }
 
@@ -1056,9 +1339,14 @@ func getDeleteEventActionQuery() string {
 	return fmt.Sprintf(`DELETE FROM %s WHERE name = %s`, sqlTableEventsActions, sqlPlaceholders[0])
 }
 
-func getEventRulesQuery(order string) string {
-	return fmt.Sprintf(`SELECT %s FROM %s WHERE deleted_at = 0 ORDER BY name %s LIMIT %s OFFSET %s`,
-		getSelectEventRuleFields(), sqlTableEventsRules, order, sqlPlaceholders[0], sqlPlaceholders[1])
+func getEventRulesQuery(order, role string) string {
+	if role == "" {
+		return fmt.Sprintf(`SELECT %s FROM %s WHERE deleted_at = 0 ORDER BY name %s LIMIT %s OFFSET %s`,
+			getSelectEventRuleFields(), sqlTableEventsRules, order, sqlPlaceholders[0], sqlPlaceholders[1])
+	}
+	return fmt.Sprintf(`SELECT %s FROM %s WHERE deleted_at = 0 AND role_id = %s ORDER BY name %s LIMIT %s OFFSET %s`,
+		getSelectEventRuleFields(), sqlTableEventsRules, getRoleIDFromName(sqlPlaceholders[0]), order,
+		sqlPlaceholders[1], sqlPlaceholders[2])
 }
 
 func getDumpEventRulesQuery() string {
@@ -1075,17 +1363,20 @@ func getEventRulesByNameQuery() string {
 		sqlPlaceholders[0])
 }
 
-func getAddEventRuleQuery() string {
-	return fmt.Sprintf(`INSERT INTO %s (name,description,created_at,updated_at,%s,conditions,deleted_at,status)
-		VALUES (%s,%s,%s,%s,%s,%s,0,%s)`,
+func getAddEventRuleQuery(role string) string {
+	return fmt.Sprintf(`INSERT INTO %s (name,description,created_at,updated_at,%s,conditions,deleted_at,status,role_id)
+		VALUES (%s,%s,%s,%s,%s,%s,0,%s,COALESCE((SELECT id from %s WHERE name=%s),%s))`,
 		sqlTableEventsRules, getSQLQuotedName("trigger"), sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2],
-		sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6])
+		sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6], sqlTableRoles,
+		sqlPlaceholders[7], getCoalesceDefaultForRole(role))
 }
 
-func getUpdateEventRuleQuery() string {
-	return fmt.Sprintf(`UPDATE %s SET description=%s,updated_at=%s,%s=%s,conditions=%s,status=%s WHERE name = %s`,
+func getUpdateEventRuleQuery(role string) string {
+	return fmt.Sprintf(`UPDATE %s SET description=%s,updated_at=%s,%s=%s,conditions=%s,status=%s,
+		role_id=COALESCE((SELECT id from %s WHERE name=%s),%s) WHERE name = %s`,
 		sqlTableEventsRules, sqlPlaceholders[0], sqlPlaceholders[1], getSQLQuotedName("trigger"), sqlPlaceholders[2],
-		sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5])
+		sqlPlaceholders[3], sqlPlaceholders[4], sqlTableRoles, sqlPlaceholders[5], getCoalesceDefaultForRole(role),
+		sqlPlaceholders[6])
 }
 
 func getDeleteEventRuleQuery(softDelete bool) string {
@@ -1175,6 +1466,11 @@ func getUpdateNodeTimestampQuery() string {
 		sqlTableNodes, sqlPlaceholders[0], sqlPlaceholders[1])
 }
 
+func getUpdateNodeDataQuery() string {
+	return fmt.Sprintf(`UPDATE %s SET data=%s,updated_at=%s WHERE name = %s`,
+		sqlTableNodes, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2])
+}
+
 func getNodeByNameQuery() string {
 	return fmt.Sprintf(`SELECT name,data,created_at,updated_at FROM %s WHERE name = %s AND updated_at > %s`,
 		sqlTableNodes, sqlPlaceholders[0], sqlPlaceholders[1])
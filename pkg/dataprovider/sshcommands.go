@@ -0,0 +1,87 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// validateSSHCommandNames trims the specified SSH command names and removes
+// empty values and duplicates
+func validateSSHCommandNames(commands []string) ([]string, error) {
+	var result []string
+	for _, command := range commands {
+		command = strings.TrimSpace(command)
+		if command == "" {
+			continue
+		}
+		if strings.ContainsAny(command, " \t/") {
+			return nil, util.NewValidationError(fmt.Sprintf("invalid SSH command name %q", command))
+		}
+		if !util.Contains(result, command) {
+			result = append(result, command)
+		}
+	}
+	return result, nil
+}
+
+func validateUserSSHCommands(user *User) error {
+	allowed, err := validateSSHCommandNames(user.Filters.AllowedSSHCommands)
+	if err != nil {
+		return err
+	}
+	denied, err := validateSSHCommandNames(user.Filters.DeniedSSHCommands)
+	if err != nil {
+		return err
+	}
+	user.Filters.AllowedSSHCommands = allowed
+	user.Filters.DeniedSSHCommands = denied
+	return nil
+}
+
+// IsSSHCommandAllowed returns true if the user policy allows the specified
+// SSH command. The command must be enabled in the SFTP server configuration too
+func (u *User) IsSSHCommandAllowed(command string) bool {
+	if u.Filters.SFTPOnly {
+		return false
+	}
+	if len(u.Filters.AllowedSSHCommands) > 0 && !util.Contains(u.Filters.AllowedSSHCommands, command) {
+		return false
+	}
+	return !util.Contains(u.Filters.DeniedSSHCommands, command)
+}
+
+// GetAllowedSSHCommandsAsString returns the allowed SSH commands as comma separated string
+func (u *User) GetAllowedSSHCommandsAsString() string {
+	return strings.Join(u.Filters.AllowedSSHCommands, ",")
+}
+
+// GetDeniedSSHCommandsAsString returns the denied SSH commands as comma separated string
+func (u *User) GetDeniedSSHCommandsAsString() string {
+	return strings.Join(u.Filters.DeniedSSHCommands, ",")
+}
+
+// GetAllowedSSHCommandsAsString returns the allowed SSH commands as comma separated string
+func (g *Group) GetAllowedSSHCommandsAsString() string {
+	return strings.Join(g.UserSettings.AllowedSSHCommands, ",")
+}
+
+// GetDeniedSSHCommandsAsString returns the denied SSH commands as comma separated string
+func (g *Group) GetDeniedSSHCommandsAsString() string {
+	return strings.Join(g.UserSettings.DeniedSSHCommands, ",")
+}
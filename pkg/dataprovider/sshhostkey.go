@@ -0,0 +1,234 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/drakkan/sftpgo/v2/pkg/kms"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// Supported statuses for SSH host keys
+const (
+	SSHHostKeyStatusPending = "pending"
+	SSHHostKeyStatusActive  = "active"
+	SSHHostKeyStatusRetired = "retired"
+)
+
+const sshHostKeyAdditionalData = "sftpd_host_key"
+
+// SSHHostKey defines an SSH host key stored in the data provider
+type SSHHostKey struct {
+	// Unique identifier
+	ID string `json:"id"`
+	// Private key, PEM or OpenSSH format. Encrypted keys are not supported
+	PrivateKey *kms.Secret `json:"private_key,omitempty"`
+	// Public key in authorized keys format, it is set automatically
+	PublicKey string `json:"public_key,omitempty"`
+	// Optional OpenSSH host certificate, in authorized keys format, for this key
+	Certificate string `json:"certificate,omitempty"`
+	// The key is used for the SSH handshake starting from this date, as unix
+	// timestamp in milliseconds. Before this date the key is only advertised to
+	// the clients supporting the OpenSSH host keys update extension.
+	// 0 means active since its creation
+	ActivateAt int64 `json:"activate_at,omitempty"`
+	// The key is not used anymore starting from this date, as unix timestamp
+	// in milliseconds. 0 means never
+	RetireAt  int64 `json:"retire_at,omitempty"`
+	CreatedAt int64 `json:"created_at"`
+}
+
+// GetStatus returns the key status at the specified time
+func (k *SSHHostKey) GetStatus(now time.Time) string {
+	ts := util.GetTimeAsMsSinceEpoch(now)
+	if k.RetireAt > 0 && ts >= k.RetireAt {
+		return SSHHostKeyStatusRetired
+	}
+	if k.ActivateAt > ts {
+		return SSHHostKeyStatusPending
+	}
+	return SSHHostKeyStatusActive
+}
+
+// GetFingerprint returns the SHA256 fingerprint of the public key
+func (k *SSHHostKey) GetFingerprint() string {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k.PublicKey))
+	if err != nil {
+		return ""
+	}
+	return ssh.FingerprintSHA256(pubKey)
+}
+
+// GetKeyType returns the public key type
+func (k *SSHHostKey) GetKeyType() string {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k.PublicKey))
+	if err != nil {
+		return ""
+	}
+	return pubKey.Type()
+}
+
+// GetActivateAtAsString returns the activation date as string
+func (k *SSHHostKey) GetActivateAtAsString() string {
+	if k.ActivateAt > 0 {
+		return util.GetTimeFromMsecSinceEpoch(k.ActivateAt).UTC().Format(time.RFC3339)
+	}
+	return ""
+}
+
+// GetRetireAtAsString returns the retirement date as string
+func (k *SSHHostKey) GetRetireAtAsString() string {
+	if k.RetireAt > 0 {
+		return util.GetTimeFromMsecSinceEpoch(k.RetireAt).UTC().Format(time.RFC3339)
+	}
+	return ""
+}
+
+// GetSigner returns an SSH signer for this key, the private key must be
+// decrypted. If a certificate is defined a certificate signer is returned too
+func (k *SSHHostKey) GetSigner() (ssh.Signer, ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey([]byte(k.PrivateKey.GetPayload()))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse host key %q: %w", k.ID, err)
+	}
+	if k.Certificate == "" {
+		return signer, nil, nil
+	}
+	cert, err := parseSSHHostCertificate(k.Certificate)
+	if err != nil {
+		return nil, nil, err
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create a certificate signer for host key %q: %w", k.ID, err)
+	}
+	return signer, certSigner, nil
+}
+
+// GetRotationKeyType returns the type of key to generate to rotate this key
+func (k *SSHHostKey) GetRotationKeyType() (string, error) {
+	switch keyType := k.GetKeyType(); keyType {
+	case ssh.KeyAlgoRSA:
+		return "rsa", nil
+	case ssh.KeyAlgoECDSA256:
+		return "ecdsa", nil
+	case ssh.KeyAlgoED25519:
+		return "ed25519", nil
+	default:
+		return "", util.NewValidationError(fmt.Sprintf("cannot generate a key of type %q, import a new key instead", keyType))
+	}
+}
+
+func (k *SSHHostKey) validate() error {
+	if k.ID == "" {
+		return util.NewValidationError("host key: an ID is required")
+	}
+	if k.PrivateKey == nil || k.PrivateKey.IsEmpty() {
+		return util.NewValidationError(fmt.Sprintf("host key %q: a private key is required", k.ID))
+	}
+	if k.PrivateKey.IsRedacted() {
+		return util.NewValidationError(fmt.Sprintf("host key %q: cannot save a redacted private key", k.ID))
+	}
+	if k.PrivateKey.IsEncrypted() && !k.PrivateKey.IsValid() {
+		return util.NewValidationError(fmt.Sprintf("host key %q: invalid encrypted private key", k.ID))
+	}
+	if k.PrivateKey.IsPlain() {
+		signer, err := ssh.ParsePrivateKey([]byte(k.PrivateKey.GetPayload()))
+		if err != nil {
+			return util.NewValidationError(fmt.Sprintf("host key %q: unable to parse private key: %v", k.ID, err))
+		}
+		k.PublicKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+		k.PrivateKey.SetAdditionalData(sshHostKeyAdditionalData)
+		if err := k.PrivateKey.Encrypt(); err != nil {
+			return util.NewValidationError(fmt.Sprintf("host key %q: could not encrypt private key: %v", k.ID, err))
+		}
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k.PublicKey))
+	if err != nil {
+		return util.NewValidationError(fmt.Sprintf("host key %q: invalid public key: %v", k.ID, err))
+	}
+	k.Certificate = strings.TrimSpace(k.Certificate)
+	if k.Certificate != "" {
+		cert, err := parseSSHHostCertificate(k.Certificate)
+		if err != nil {
+			return util.NewValidationError(err.Error())
+		}
+		if !bytes.Equal(cert.Key.Marshal(), pubKey.Marshal()) {
+			return util.NewValidationError(fmt.Sprintf("host key %q: the certificate does not match the key", k.ID))
+		}
+	}
+	if k.ActivateAt < 0 || k.RetireAt < 0 {
+		return util.NewValidationError(fmt.Sprintf("host key %q: invalid activation or retirement date", k.ID))
+	}
+	if k.RetireAt > 0 && k.RetireAt <= k.ActivateAt {
+		return util.NewValidationError(fmt.Sprintf("host key %q: the retirement date must be after the activation date", k.ID))
+	}
+	if k.CreatedAt == 0 {
+		k.CreatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+	}
+	return nil
+}
+
+func (k *SSHHostKey) getACopy() SSHHostKey {
+	var privateKey *kms.Secret
+	if k.PrivateKey != nil {
+		privateKey = k.PrivateKey.Clone()
+	}
+	return SSHHostKey{
+		ID:          k.ID,
+		PrivateKey:  privateKey,
+		PublicKey:   k.PublicKey,
+		Certificate: k.Certificate,
+		ActivateAt:  k.ActivateAt,
+		RetireAt:    k.RetireAt,
+		CreatedAt:   k.CreatedAt,
+	}
+}
+
+func parseSSHHostCertificate(certificate string) (*ssh.Certificate, error) {
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(certificate))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse host certificate: %w", err)
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%q is not an SSH certificate", parsed.Type())
+	}
+	if cert.CertType != ssh.HostCert {
+		return nil, fmt.Errorf("the certificate with ID %q is not an host certificate", cert.KeyId)
+	}
+	return cert, nil
+}
+
+func validateSSHHostKeys(keys []SSHHostKey) error {
+	ids := make(map[string]bool)
+	for idx := range keys {
+		k := &keys[idx]
+		if err := k.validate(); err != nil {
+			return err
+		}
+		if ids[k.ID] {
+			return util.NewValidationError(fmt.Sprintf("duplicated host key ID %q", k.ID))
+		}
+		ids[k.ID] = true
+	}
+	return nil
+}
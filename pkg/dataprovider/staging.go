@@ -0,0 +1,84 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// StagingDirName is the name of the hidden directory where the uploads to
+// staging folders are stored until they are published
+const StagingDirName = ".sftpgo-staging"
+
+func validateStagingFolders(user *User) error {
+	var folders []string
+	for _, folder := range user.Filters.StagingFolders {
+		folder = strings.TrimSpace(folder)
+		if folder == "" {
+			continue
+		}
+		if !path.IsAbs(folder) {
+			return util.NewValidationError(fmt.Sprintf("invalid staging folder %q, it must be an absolute path", folder))
+		}
+		folder = util.CleanPath(folder)
+		if IsStagingPath(folder) {
+			return util.NewValidationError(fmt.Sprintf("invalid staging folder %q", folder))
+		}
+		for _, f := range folders {
+			if util.IsDirOverlapped(f, folder, true, "/") {
+				return util.NewValidationError(fmt.Sprintf("staging folder %q overlaps with %q", folder, f))
+			}
+		}
+		folders = append(folders, folder)
+	}
+	user.Filters.StagingFolders = folders
+	return nil
+}
+
+// GetStagingFolder returns the staging folder that includes the specified
+// virtual path, an empty string means that uploads to the path are not staged
+func (u *User) GetStagingFolder(virtualPath string) string {
+	for _, folder := range u.Filters.StagingFolders {
+		if folder == "/" || virtualPath == folder || strings.HasPrefix(virtualPath, folder+"/") {
+			return folder
+		}
+	}
+	return ""
+}
+
+// IsStagingPath returns true if the specified virtual path is a staging
+// directory or is inside a staging directory
+func IsStagingPath(virtualPath string) bool {
+	for _, name := range strings.Split(virtualPath, "/") {
+		if name == StagingDirName {
+			return true
+		}
+	}
+	return false
+}
+
+func filterStagingDirs(dirContents []os.FileInfo) []os.FileInfo {
+	for idx, fi := range dirContents {
+		if fi.Name() == StagingDirName {
+			return append(dirContents[:idx], dirContents[idx+1:]...)
+		}
+	}
+	return dirContents
+}
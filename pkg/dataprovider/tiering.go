@@ -0,0 +1,117 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+// the tiered objects are stored as custom metadata for the related files,
+// this way they follow renames and are removed together with the files
+const (
+	tieringKeyFolder  = "sftpgo_tiering_folder"
+	tieringKeyObject  = "sftpgo_tiering_object"
+	tieringKeySize    = "sftpgo_tiering_size"
+	tieringKeyModTime = "sftpgo_tiering_mtime"
+)
+
+// tieringMetadataStore implements vfs.TieringStore for the specified user
+type tieringMetadataStore struct {
+	username     string
+	connectionID string
+}
+
+func (s *tieringMetadataStore) GetObject(virtualPath string) (vfs.TieredObject, error) {
+	metadata, err := GetFileMetadata(s.username, virtualPath)
+	if err != nil {
+		return vfs.TieredObject{}, err
+	}
+	objectPath, ok := metadata.Metadata[tieringKeyObject]
+	if !ok {
+		return vfs.TieredObject{}, util.NewRecordNotFoundError("no tiered object for path " + virtualPath)
+	}
+	size, err := strconv.ParseInt(metadata.Metadata[tieringKeySize], 10, 64)
+	if err != nil {
+		return vfs.TieredObject{}, err
+	}
+	modTime, err := strconv.ParseInt(metadata.Metadata[tieringKeyModTime], 10, 64)
+	if err != nil {
+		return vfs.TieredObject{}, err
+	}
+	return vfs.TieredObject{
+		Folder:  metadata.Metadata[tieringKeyFolder],
+		Path:    objectPath,
+		Size:    size,
+		ModTime: time.Unix(0, modTime),
+	}, nil
+}
+
+func (s *tieringMetadataStore) SetObject(virtualPath string, object vfs.TieredObject) error {
+	metadata, err := GetFileMetadata(s.username, virtualPath)
+	if err != nil {
+		if !errors.Is(err, util.ErrNotFound) {
+			return err
+		}
+		metadata = FileMetadata{
+			Path: virtualPath,
+		}
+	}
+	if metadata.Metadata == nil {
+		metadata.Metadata = make(map[string]string)
+	}
+	metadata.Metadata[tieringKeyFolder] = object.Folder
+	metadata.Metadata[tieringKeyObject] = object.Path
+	metadata.Metadata[tieringKeySize] = strconv.FormatInt(object.Size, 10)
+	metadata.Metadata[tieringKeyModTime] = strconv.FormatInt(object.ModTime.UnixNano(), 10)
+	return SetFileMetadata(s.username, &metadata)
+}
+
+func (s *tieringMetadataStore) RemoveObject(virtualPath string) error {
+	metadata, err := GetFileMetadata(s.username, virtualPath)
+	if err != nil {
+		if errors.Is(err, util.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	if _, ok := metadata.Metadata[tieringKeyObject]; !ok {
+		return nil
+	}
+	delete(metadata.Metadata, tieringKeyFolder)
+	delete(metadata.Metadata, tieringKeyObject)
+	delete(metadata.Metadata, tieringKeySize)
+	delete(metadata.Metadata, tieringKeyModTime)
+	return SetFileMetadata(s.username, &metadata)
+}
+
+func (s *tieringMetadataStore) GetColdFs(folder string) (vfs.Fs, error) {
+	baseFolder, err := provider.getFolderByName(folder)
+	if err != nil {
+		return nil, err
+	}
+	if baseFolder.HasFailoverPathPlaceholder() {
+		return nil, fmt.Errorf("path placeholders are not supported for the cold storage folder %q", folder)
+	}
+	f := vfs.VirtualFolder{
+		BaseVirtualFolder: baseFolder,
+	}
+	return f.GetFilesystem(s.connectionID, nil)
+}
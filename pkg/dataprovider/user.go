@@ -28,7 +28,9 @@ import (
 
 	"github.com/rs/xid"
 	"github.com/sftpgo/sdk"
+	"golang.org/x/crypto/ssh"
 
+	"github.com/drakkan/sftpgo/v2/pkg/geoip"
 	"github.com/drakkan/sftpgo/v2/pkg/kms"
 	"github.com/drakkan/sftpgo/v2/pkg/logger"
 	"github.com/drakkan/sftpgo/v2/pkg/mfa"
@@ -88,6 +90,10 @@ const (
 	LoginMethodIDP                    = "IDP"
 )
 
+// TLSUsernameSAN defines that the username must match a DNS name or an email
+// address in the subject alternative names of the TLS client certificate
+const TLSUsernameSAN sdk.TLSUsername = "SubjectAltName"
+
 var (
 	errNoMatchingVirtualFolder = errors.New("no matching virtual folder found")
 	permsRenameAny             = []string{PermRename, PermRenameDirs, PermRenameFiles}
@@ -115,6 +121,35 @@ type UserTOTPConfig struct {
 	Protocols []string `json:"protocols,omitempty"`
 }
 
+// PublicKeyExpiration defines the expiration date for a user public key
+type PublicKeyExpiration struct {
+	// SHA256 fingerprint of the public key, for example "SHA256:bsBRHC/xgiqBJdSuvSTNpJNLTISP/G356jNMCRYC5Es"
+	Fingerprint string `json:"fingerprint"`
+	// Expiration date as unix timestamp in milliseconds
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// PortRange defines a range of ports
+type PortRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// IsDefined returns true if the port range is set
+func (r *PortRange) IsDefined() bool {
+	return r.Start > 0 || r.End > 0
+}
+
+func (r *PortRange) validate() error {
+	if !r.IsDefined() {
+		return nil
+	}
+	if r.Start <= 0 || r.End <= r.Start || r.End > 65535 {
+		return util.NewValidationError(fmt.Sprintf("invalid passive port range: %d-%d", r.Start, r.End))
+	}
+	return nil
+}
+
 // UserFilters defines additional restrictions for a user
 // TODO: rename to UserOptions in v3
 type UserFilters struct {
@@ -127,6 +162,62 @@ type UserFilters struct {
 	// Each code can only be used once, you should use these codes to login and disable or
 	// reset 2FA for your account
 	RecoveryCodes []RecoveryCode `json:"recovery_codes,omitempty"`
+	// Per-protocol idle timeout, keepalive and max session duration
+	SessionPolicies []SessionPolicy `json:"session_policies,omitempty"`
+	// Optional expiration dates for the public keys. Expired keys are refused
+	PublicKeysExpiration []PublicKeyExpiration `json:"public_keys_expiration,omitempty"`
+	// Webhooks registered by the user to be notified about filesystem events
+	// inside their folders
+	Webhooks []UserWebhook `json:"webhooks,omitempty"`
+	// Virtual paths whose files are encrypted and decrypted within the browser
+	// by the WebClient. The server only stores the encrypted contents
+	ClientEncryptedFolders []string `json:"client_encrypted_folders,omitempty"`
+	// Virtual paths where uploads are staged in a hidden directory and become
+	// visible only after they are published
+	StagingFolders []string `json:"staging_folders,omitempty"`
+	// If enabled, the SHA-256 checksum is computed while uploading and stored
+	// as file metadata, regardless of the global setting
+	StoreChecksums bool `json:"store_checksums,omitempty"`
+	// Bandwidth limits to apply within cron-like time windows, they override
+	// the user and per-source bandwidth limits. The first active schedule wins
+	BandwidthSchedules []BandwidthSchedule `json:"bandwidth_schedules,omitempty"`
+	// Transfer priority class, it defines the share of the global bandwidth
+	// when the server is saturated. Empty means the default class
+	PriorityClass string `json:"priority_class,omitempty"`
+	// Maximum number of simultaneous FTP file transfers, directory listings are
+	// not limited. 0 means unlimited
+	FTPMaxTransfers int `json:"ftp_max_transfers,omitempty"`
+	// Port range for the FTP passive data connections, it overrides the
+	// binding and the global ranges. Not set means the range defined in the
+	// primary group, if any
+	PassivePortRange PortRange `json:"passive_port_range"`
+	// Consent documents, such as the terms of service, accepted by the user.
+	// They are managed by the users themselves and cannot be set by admins
+	Consents []UserConsent `json:"consents,omitempty"`
+	// Time ranges during which the user can log in. Empty means no restriction
+	AccessWindows []AccessWindow `json:"access_windows,omitempty"`
+	// IANA timezone for the access windows, empty means UTC
+	AccessTimezone string `json:"access_timezone,omitempty"`
+	// The user cannot log in before this date as unix timestamp in milliseconds.
+	// 0 means no restriction
+	ActivationDate int64 `json:"activation_date,omitempty"`
+	// Unix timestamp in milliseconds of the self-service registration for
+	// accounts awaiting admin approval. 0 means no pending registration
+	PendingRegistration int64 `json:"pending_registration,omitempty"`
+	// Public keys, in authorized_keys format, of the certificate authorities
+	// trusted to sign SSH certificates for this user, in addition to the global ones
+	TrustedCAKeys []string `json:"trusted_ca_keys,omitempty"`
+	// SSH certificate principals allowed to log in as this user, the
+	// %username% placeholder is supported. Empty means the username
+	CertPrincipals []string `json:"cert_principals,omitempty"`
+	// If enabled, SSH commands, including SCP, are denied and only the SFTP
+	// subsystem can be used
+	SFTPOnly bool `json:"sftp_only,omitempty"`
+	// SSH commands allowed for this user, empty means all the commands
+	// enabled in the SFTP server configuration
+	AllowedSSHCommands []string `json:"allowed_ssh_commands,omitempty"`
+	// SSH commands denied for this user
+	DeniedSSHCommands []string `json:"denied_ssh_commands,omitempty"`
 }
 
 // User defines a SFTPGo user
@@ -144,10 +235,20 @@ type User struct {
 	fsCache map[string]vfs.Fs `json:"-"`
 	// true if group settings are already applied for this user
 	groupSettingsApplied bool `json:"-"`
+	// conditional overrides inherited from the primary group
+	groupOverrides []GroupOverride
+	// IP address of the client this user is connected from, if any
+	clientIP string
 	// in multi node setups we mark the user as deleted to be able to update the webdav cache
 	DeletedAt int64 `json:"-"`
 }
 
+// SetClientIP sets the IP address of the client this user is connected from.
+// It is propagated to the storage backends that support it
+func (u *User) SetClientIP(ip string) {
+	u.clientIP = ip
+}
+
 // GetFilesystem returns the base filesystem for this user
 func (u *User) GetFilesystem(connectionID string) (fs vfs.Fs, err error) {
 	return u.GetFilesystemForPath("/", connectionID)
@@ -169,11 +270,19 @@ func (u *User) getRootFs(connectionID string) (fs vfs.Fs, err error) {
 			return nil, err
 		}
 		forbiddenSelfUsers = append(forbiddenSelfUsers, u.Username)
-		return vfs.NewSFTPFs(connectionID, "", u.GetHomeDir(), forbiddenSelfUsers, u.FsConfig.SFTPConfig)
+		sftpConfig := u.FsConfig.SFTPConfig
+		sftpConfig.SetClientIP(u.clientIP)
+		return vfs.NewSFTPFs(connectionID, "", u.GetHomeDir(), forbiddenSelfUsers, sftpConfig)
 	case sdk.HTTPFilesystemProvider:
 		return vfs.NewHTTPFs(connectionID, u.GetHomeDir(), "", u.FsConfig.HTTPConfig)
+	case vfs.WebDAVFilesystemProvider:
+		return vfs.NewWebDAVFs(connectionID, u.GetHomeDir(), "", u.FsConfig.WebDAVConfig)
 	default:
-		return vfs.NewOsFs(connectionID, u.GetHomeDir(), "", &u.FsConfig.OSConfig), nil
+		if u.FsConfig.DedupConfig.Enabled {
+			return vfs.NewDedupFs(connectionID, u.GetHomeDir(), "")
+		}
+		return vfs.NewTieredFs(connectionID, u.GetHomeDir(), "", &u.FsConfig.OSConfig,
+			&tieringMetadataStore{username: u.Username, connectionID: connectionID}), nil
 	}
 }
 
@@ -342,7 +451,7 @@ func (u *User) CheckLoginConditions() error {
 		return fmt.Errorf("user %q is expired, expiration timestamp: %v current timestamp: %v", u.Username,
 			u.ExpirationDate, util.GetTimeAsMsSinceEpoch(time.Now()))
 	}
-	return nil
+	return u.checkAccessConditions(time.Now())
 }
 
 // hideConfidentialData hides user confidential data
@@ -357,6 +466,11 @@ func (u *User) hideConfidentialData() {
 			code.Secret.Hide()
 		}
 	}
+	for _, w := range u.Filters.Webhooks {
+		if w.Secret != nil {
+			w.Secret.Hide()
+		}
+	}
 }
 
 // GetSubDirPermissions returns permissions for sub directories
@@ -564,8 +678,18 @@ func (u *User) GetFilesystemForPath(virtualPath, connectionID string) (vfs.Fs, e
 					return nil, err
 				}
 				forbiddenSelfUsers = append(forbiddenSelfUsers, forbiddens...)
+				folder.FsConfig.SFTPConfig.SetClientIP(u.clientIP)
+			}
+			if folder.Failover != nil && folder.Failover.FsConfig.Provider == sdk.SFTPFilesystemProvider {
+				failover := *folder.Failover
+				failover.FsConfig.SFTPConfig.SetClientIP(u.clientIP)
+				folder.Failover = &failover
 			}
 			fs, err := folder.GetFilesystem(connectionID, forbiddenSelfUsers)
+			if err != nil {
+				return fs, err
+			}
+			fs, err = u.wrapPGPFs(fs, folder.FsConfig.PGPConfig)
 			if err == nil {
 				u.fsCache[folder.VirtualPath] = fs
 			}
@@ -580,10 +704,25 @@ func (u *User) GetFilesystemForPath(virtualPath, connectionID string) (vfs.Fs, e
 	if err != nil {
 		return fs, err
 	}
+	fs, err = u.wrapPGPFs(fs, u.FsConfig.PGPConfig)
+	if err != nil {
+		return fs, err
+	}
 	u.fsCache["/"] = fs
 	return fs, err
 }
 
+// wrapPGPFs wraps fs to PGP encrypt the files uploaded by this user,
+// if encryption is enabled in the provided configuration
+func (u *User) wrapPGPFs(fs vfs.Fs, config vfs.PGPFsConfig) (vfs.Fs, error) {
+	pgpFs, err := vfs.NewPGPFs(fs, config, u.Username)
+	if err != nil {
+		fs.Close()
+		return nil, fmt.Errorf("unable to initialize PGP encryption: %w", err)
+	}
+	return pgpFs, nil
+}
+
 // GetVirtualFolderForPath returns the virtual folder containing the specified virtual path.
 // If the path is not inside a virtual folder an error is returned
 func (u *User) GetVirtualFolderForPath(virtualPath string) (vfs.VirtualFolder, error) {
@@ -653,6 +792,49 @@ func (u *User) ScanQuota() (int, int64, error) {
 	return numFiles, size, nil
 }
 
+// ScanQuotaIncremental is like ScanQuota but, for local filesystems, it only lists
+// the directories modified since the scans recorded in states, if not nil.
+// The progress function, if not nil, is called with the files and the size
+// found so far
+func (u *User) ScanQuotaIncremental(states *vfs.QuotaScanStates, progress vfs.QuotaScanProgress) (int, int64, error) {
+	fs, err := u.getRootFs(xid.New().String())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fs.Close()
+
+	var scannedFiles int
+	var scannedSize int64
+	getProgress := func() vfs.QuotaScanProgress {
+		if progress == nil {
+			return nil
+		}
+		return func(numFiles int, size int64) {
+			progress(scannedFiles+numFiles, scannedSize+size)
+		}
+	}
+
+	numFiles, size, err := vfs.ScanRootDirContentsIncremental(fs, states, getProgress())
+	if err != nil {
+		return numFiles, size, err
+	}
+	scannedFiles, scannedSize = numFiles, size
+	for idx := range u.VirtualFolders {
+		v := &u.VirtualFolders[idx]
+		if !v.IsIncludedInUserQuota() {
+			continue
+		}
+		num, s, err := v.ScanQuotaIncremental(states, getProgress())
+		if err != nil {
+			return scannedFiles, scannedSize, err
+		}
+		scannedFiles += num
+		scannedSize += s
+	}
+
+	return scannedFiles, scannedSize, nil
+}
+
 // GetVirtualFoldersInPath returns the virtual folders inside virtualPath including
 // any parents
 func (u *User) GetVirtualFoldersInPath(virtualPath string) map[string]bool {
@@ -701,53 +883,83 @@ func (u *User) hasVirtualDirs() bool {
 
 // FilterListDir adds virtual folders and remove hidden items from the given files list
 func (u *User) FilterListDir(dirContents []os.FileInfo, virtualPath string) []os.FileInfo {
-	filter := u.getPatternsFilterForPath(virtualPath)
-	if !u.hasVirtualDirs() && filter.DenyPolicy != sdk.DenyPolicyHide {
-		return dirContents
-	}
+	filter := u.NewDirListFilter(virtualPath)
+	dirContents = filter.Filter(dirContents)
+	return append(dirContents, filter.RemainingVirtualFolders()...)
+}
 
-	vdirs := make(map[string]bool)
+// NewDirListFilter returns a filter for the listing of the specified virtual path.
+// The filter allows to process the directory entries in chunks
+func (u *User) NewDirListFilter(virtualPath string) *DirListFilter {
+	filter := &DirListFilter{
+		patterns: u.getPatternsFilterForPath(virtualPath),
+		vdirs:    make(map[string]bool),
+	}
+	if !u.hasVirtualDirs() && filter.patterns.DenyPolicy != sdk.DenyPolicyHide {
+		return filter
+	}
 	for dir := range u.GetVirtualFoldersInPath(virtualPath) {
 		dirName := path.Base(dir)
-		if filter.DenyPolicy == sdk.DenyPolicyHide {
-			if !filter.CheckAllowed(dirName) {
+		if filter.patterns.DenyPolicy == sdk.DenyPolicyHide {
+			if !filter.patterns.CheckAllowed(dirName) {
 				continue
 			}
 		}
-		vdirs[dirName] = true
+		filter.vdirs[dirName] = true
+	}
+	return filter
+}
+
+// DirListFilter adds virtual folders and remove hidden items from a directory
+// listing processed in chunks
+type DirListFilter struct {
+	patterns sdk.PatternsFilter
+	vdirs    map[string]bool
+}
+
+// Filter removes the hidden items from the given chunk of the listing and
+// replaces the entries matching a virtual folder name. The slice is modified in place
+func (f *DirListFilter) Filter(dirContents []os.FileInfo) []os.FileInfo {
+	dirContents = filterStagingDirs(dirContents)
+	if len(f.vdirs) == 0 && f.patterns.DenyPolicy != sdk.DenyPolicyHide {
+		return dirContents
 	}
 
 	validIdx := 0
 	for index, fi := range dirContents {
-		for dir := range vdirs {
-			if fi.Name() == dir {
-				if !fi.IsDir() {
-					fi = vfs.NewFileInfo(dir, true, 0, time.Unix(0, 0), false)
-					dirContents[index] = fi
-				}
-				delete(vdirs, dir)
+		if _, ok := f.vdirs[fi.Name()]; ok {
+			if !fi.IsDir() {
+				fi = vfs.NewFileInfo(fi.Name(), true, 0, time.Unix(0, 0), false)
+				dirContents[index] = fi
 			}
+			delete(f.vdirs, fi.Name())
 		}
-		if filter.DenyPolicy == sdk.DenyPolicyHide {
-			if filter.CheckAllowed(fi.Name()) {
+		if f.patterns.DenyPolicy == sdk.DenyPolicyHide {
+			if f.patterns.CheckAllowed(fi.Name()) {
 				dirContents[validIdx] = fi
 				validIdx++
 			}
 		}
 	}
 
-	if filter.DenyPolicy == sdk.DenyPolicyHide {
+	if f.patterns.DenyPolicy == sdk.DenyPolicyHide {
 		for idx := validIdx; idx < len(dirContents); idx++ {
 			dirContents[idx] = nil
 		}
 		dirContents = dirContents[:validIdx]
 	}
+	return dirContents
+}
 
-	for dir := range vdirs {
-		fi := vfs.NewFileInfo(dir, true, 0, time.Unix(0, 0), false)
-		dirContents = append(dirContents, fi)
+// RemainingVirtualFolders returns the virtual folders not found in the
+// processed chunks, they must be added at the end of the listing
+func (f *DirListFilter) RemainingVirtualFolders() []os.FileInfo {
+	result := make([]os.FileInfo, 0, len(f.vdirs))
+	for dir := range f.vdirs {
+		result = append(result, vfs.NewFileInfo(dir, true, 0, time.Unix(0, 0), false))
 	}
-	return dirContents
+	f.vdirs = make(map[string]bool)
+	return result
 }
 
 // IsMappedPath returns true if the specified filesystem path has a virtual folder mapping.
@@ -1026,8 +1238,12 @@ func (u *User) getMinPasswordEntropy() float64 {
 }
 
 // IsFileAllowed returns true if the specified file is allowed by the file restrictions filters.
+// Staging directories are always hidden.
 // The second parameter returned is the deny policy
 func (u *User) IsFileAllowed(virtualPath string) (bool, int) {
+	if IsStagingPath(virtualPath) {
+		return false, sdk.DenyPolicyHide
+	}
 	dirPath := path.Dir(virtualPath)
 	if u.isDirHidden(dirPath) {
 		return false, sdk.DenyPolicyHide
@@ -1137,6 +1353,42 @@ func (u *User) PasswordExpiresIn() int {
 	return res
 }
 
+// GetPublicKeyExpiration returns the expiration date, as unix timestamp in milliseconds,
+// for the public key with the specified fingerprint. 0 means no expiration
+func (u *User) GetPublicKeyExpiration(fingerprint string) int64 {
+	for _, exp := range u.Filters.PublicKeysExpiration {
+		if exp.Fingerprint == fingerprint {
+			return exp.ExpiresAt
+		}
+	}
+	return 0
+}
+
+// IsPublicKeyExpired returns true if the public key with the specified fingerprint is expired
+func (u *User) IsPublicKeyExpired(fingerprint string) bool {
+	expiresAt := u.GetPublicKeyExpiration(fingerprint)
+	if expiresAt == 0 {
+		return false
+	}
+	return util.GetTimeFromMsecSinceEpoch(expiresAt).Before(time.Now())
+}
+
+// GetValidPublicKeys returns the public keys that are not expired
+func (u *User) GetValidPublicKeys() []string {
+	result := make([]string, 0, len(u.PublicKeys))
+	for _, k := range u.PublicKeys {
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
+		if err != nil {
+			continue
+		}
+		if u.IsPublicKeyExpired(ssh.FingerprintSHA256(pubKey)) {
+			continue
+		}
+		result = append(result, k)
+	}
+	return result
+}
+
 // MustChangePassword returns true if the user must change the password
 func (u *User) MustChangePassword() bool {
 	if u.Filters.RequirePasswordChange {
@@ -1207,8 +1459,8 @@ func (u *User) GetBandwidthForIP(clientIP, connectionID string) (int64, int64) {
 }
 
 // IsLoginFromAddrAllowed returns true if the login is allowed from the specified remoteAddr.
-// If AllowedIP is defined only the specified IP/Mask can login.
-// If DeniedIP is defined the specified IP/Mask cannot login.
+// If AllowedIP is defined only the specified IP/Mask or countries can login.
+// If DeniedIP is defined the specified IP/Mask or countries cannot login.
 // If an IP is both allowed and denied then login will be allowed
 func (u *User) IsLoginFromAddrAllowed(remoteAddr string) bool {
 	if len(u.Filters.AllowedIP) == 0 && len(u.Filters.DeniedIP) == 0 {
@@ -1221,26 +1473,39 @@ func (u *User) IsLoginFromAddrAllowed(remoteAddr string) bool {
 		return true
 	}
 	for _, IPMask := range u.Filters.AllowedIP {
-		_, IPNet, err := net.ParseCIDR(IPMask)
+		matched, err := isIPMatchedByFilter(remoteIP, IPMask)
 		if err != nil {
 			return false
 		}
-		if IPNet.Contains(remoteIP) {
+		if matched {
 			return true
 		}
 	}
 	for _, IPMask := range u.Filters.DeniedIP {
-		_, IPNet, err := net.ParseCIDR(IPMask)
+		matched, err := isIPMatchedByFilter(remoteIP, IPMask)
 		if err != nil {
 			return false
 		}
-		if IPNet.Contains(remoteIP) {
+		if matched {
 			return false
 		}
 	}
 	return len(u.Filters.AllowedIP) == 0
 }
 
+// isIPMatchedByFilter returns true if the specified IP is matched by the given
+// IP/Mask or country filter
+func isIPMatchedByFilter(ip net.IP, filter string) (bool, error) {
+	if country, ok := geoip.ParseCountryEntry(filter); ok {
+		return geoip.IsCountryMatched(ip.String(), []string{country}), nil
+	}
+	_, IPNet, err := net.ParseCIDR(filter)
+	if err != nil {
+		return false, err
+	}
+	return IPNet.Contains(ip), nil
+}
+
 // GetPermissionsAsJSON returns the permissions as json byte array
 func (u *User) GetPermissionsAsJSON() ([]byte, error) {
 	return json.Marshal(u.Permissions)
@@ -1435,6 +1700,8 @@ func (u *User) GetStorageDescrition() string {
 		return fmt.Sprintf("SFTP: %v", u.FsConfig.SFTPConfig.Endpoint)
 	case sdk.HTTPFilesystemProvider:
 		return fmt.Sprintf("HTTP: %v", u.FsConfig.HTTPConfig.Endpoint)
+	case vfs.WebDAVFilesystemProvider:
+		return fmt.Sprintf("WebDAV: %v", u.FsConfig.WebDAVConfig.Endpoint)
 	default:
 		return ""
 	}
@@ -1551,6 +1818,9 @@ func (u *User) SetEmptySecretsIfNil() {
 	for idx := range u.VirtualFolders {
 		vfolder := &u.VirtualFolders[idx]
 		vfolder.FsConfig.SetEmptySecretsIfNil()
+		if vfolder.Failover != nil {
+			vfolder.Failover.FsConfig.SetEmptySecretsIfNil()
+		}
 	}
 	if u.Filters.TOTPConfig.Secret == nil {
 		u.Filters.TOTPConfig.Secret = kms.NewEmptySecret()
@@ -1696,6 +1966,8 @@ func (u *User) replaceFsConfigPlaceholders(fsConfig vfs.Filesystem, replacer *st
 		fsConfig.SFTPConfig.Prefix = u.replacePlaceholder(fsConfig.SFTPConfig.Prefix, replacer)
 	case sdk.HTTPFilesystemProvider:
 		fsConfig.HTTPConfig.Username = u.replacePlaceholder(fsConfig.HTTPConfig.Username, replacer)
+	case vfs.WebDAVFilesystemProvider:
+		fsConfig.WebDAVConfig.Username = u.replacePlaceholder(fsConfig.WebDAVConfig.Username, replacer)
 	}
 	return fsConfig
 }
@@ -1712,6 +1984,7 @@ func (u *User) mergeCryptFsConfig(group *Group) {
 }
 
 func (u *User) mergeWithPrimaryGroup(group *Group, replacer *strings.Replacer) {
+	u.mergeGroupOverrides(group, replacer)
 	if group.UserSettings.HomeDir != "" {
 		u.HomeDir = u.replacePlaceholder(group.UserSettings.HomeDir, replacer)
 	}
@@ -1725,6 +1998,18 @@ func (u *User) mergeWithPrimaryGroup(group *Group, replacer *strings.Replacer) {
 		if u.FsConfig.OSConfig.WriteBufferSize == 0 {
 			u.FsConfig.OSConfig.WriteBufferSize = group.UserSettings.FsConfig.OSConfig.WriteBufferSize
 		}
+		if u.FsConfig.Provider == sdk.LocalFilesystemProvider && !u.FsConfig.DedupConfig.Enabled {
+			u.FsConfig.DedupConfig.Enabled = group.UserSettings.FsConfig.DedupConfig.Enabled
+		}
+		if !u.FsConfig.PGPConfig.IsEnabled() {
+			u.FsConfig.PGPConfig = group.UserSettings.FsConfig.PGPConfig.GetACopy()
+		}
+		if !u.FsConfig.WORMConfig.Enabled {
+			u.FsConfig.WORMConfig = group.UserSettings.FsConfig.WORMConfig
+		}
+		if !u.FsConfig.MIMEPolicy.IsEnabled() {
+			u.FsConfig.MIMEPolicy = group.UserSettings.FsConfig.MIMEPolicy.GetACopy()
+		}
 	}
 	if u.MaxSessions == 0 {
 		u.MaxSessions = group.UserSettings.MaxSessions
@@ -1749,6 +2034,30 @@ func (u *User) mergeWithPrimaryGroup(group *Group, replacer *strings.Replacer) {
 	if u.ExpirationDate == 0 && group.UserSettings.ExpiresIn > 0 {
 		u.ExpirationDate = u.CreatedAt + int64(group.UserSettings.ExpiresIn)*86400000
 	}
+	if len(u.Filters.SessionPolicies) == 0 {
+		u.Filters.SessionPolicies = copySessionPolicies(group.UserSettings.SessionPolicies)
+	}
+	if len(u.Filters.AccessWindows) == 0 {
+		u.Filters.AccessWindows = copyAccessWindows(group.UserSettings.AccessWindows)
+		u.Filters.AccessTimezone = group.UserSettings.AccessTimezone
+	}
+	if len(u.Filters.AllowedSSHCommands) == 0 {
+		u.Filters.AllowedSSHCommands = append(u.Filters.AllowedSSHCommands, group.UserSettings.AllowedSSHCommands...)
+	}
+	if len(u.Filters.CertPrincipals) == 0 {
+		for _, principal := range group.UserSettings.CertPrincipals {
+			u.Filters.CertPrincipals = append(u.Filters.CertPrincipals, u.replacePlaceholder(principal, replacer))
+		}
+	}
+	if u.Filters.PriorityClass == "" {
+		u.Filters.PriorityClass = group.UserSettings.PriorityClass
+	}
+	if u.Filters.FTPMaxTransfers == 0 {
+		u.Filters.FTPMaxTransfers = group.UserSettings.FTPMaxTransfers
+	}
+	if !u.Filters.PassivePortRange.IsDefined() {
+		u.Filters.PassivePortRange = group.UserSettings.PassivePortRange
+	}
 	u.mergePrimaryGroupFilters(&group.UserSettings.Filters, replacer)
 	u.mergeAdditiveProperties(group, sdk.GroupTypePrimary, replacer)
 }
@@ -1809,6 +2118,11 @@ func (u *User) mergeAdditiveProperties(group *Group, groupType int, replacer *st
 	u.Filters.DeniedProtocols = append(u.Filters.DeniedProtocols, group.UserSettings.Filters.DeniedProtocols...)
 	u.Filters.WebClient = append(u.Filters.WebClient, group.UserSettings.Filters.WebClient...)
 	u.Filters.TwoFactorAuthProtocols = append(u.Filters.TwoFactorAuthProtocols, group.UserSettings.Filters.TwoFactorAuthProtocols...)
+	u.Filters.TrustedCAKeys = append(u.Filters.TrustedCAKeys, group.UserSettings.TrustedCAKeys...)
+	u.Filters.DeniedSSHCommands = append(u.Filters.DeniedSSHCommands, group.UserSettings.DeniedSSHCommands...)
+	if group.UserSettings.SFTPOnly {
+		u.Filters.SFTPOnly = true
+	}
 }
 
 func (u *User) mergeVirtualFolders(group *Group, groupType int, replacer *strings.Replacer) {
@@ -1917,6 +2231,33 @@ func (u *User) getACopy() User {
 	filters.TOTPConfig.Secret = u.Filters.TOTPConfig.Secret.Clone()
 	filters.TOTPConfig.Protocols = make([]string, len(u.Filters.TOTPConfig.Protocols))
 	copy(filters.TOTPConfig.Protocols, u.Filters.TOTPConfig.Protocols)
+	filters.SessionPolicies = copySessionPolicies(u.Filters.SessionPolicies)
+	filters.PublicKeysExpiration = make([]PublicKeyExpiration, len(u.Filters.PublicKeysExpiration))
+	copy(filters.PublicKeysExpiration, u.Filters.PublicKeysExpiration)
+	filters.Webhooks = copyUserWebhooks(u.Filters.Webhooks)
+	filters.ClientEncryptedFolders = make([]string, len(u.Filters.ClientEncryptedFolders))
+	copy(filters.ClientEncryptedFolders, u.Filters.ClientEncryptedFolders)
+	filters.StagingFolders = make([]string, len(u.Filters.StagingFolders))
+	copy(filters.StagingFolders, u.Filters.StagingFolders)
+	filters.StoreChecksums = u.Filters.StoreChecksums
+	filters.BandwidthSchedules = copyBandwidthSchedules(u.Filters.BandwidthSchedules)
+	filters.PriorityClass = u.Filters.PriorityClass
+	filters.FTPMaxTransfers = u.Filters.FTPMaxTransfers
+	filters.PassivePortRange = u.Filters.PassivePortRange
+	filters.Consents = copyUserConsents(u.Filters.Consents)
+	filters.AccessWindows = copyAccessWindows(u.Filters.AccessWindows)
+	filters.AccessTimezone = u.Filters.AccessTimezone
+	filters.ActivationDate = u.Filters.ActivationDate
+	filters.PendingRegistration = u.Filters.PendingRegistration
+	filters.TrustedCAKeys = make([]string, len(u.Filters.TrustedCAKeys))
+	copy(filters.TrustedCAKeys, u.Filters.TrustedCAKeys)
+	filters.CertPrincipals = make([]string, len(u.Filters.CertPrincipals))
+	copy(filters.CertPrincipals, u.Filters.CertPrincipals)
+	filters.SFTPOnly = u.Filters.SFTPOnly
+	filters.AllowedSSHCommands = make([]string, len(u.Filters.AllowedSSHCommands))
+	copy(filters.AllowedSSHCommands, u.Filters.AllowedSSHCommands)
+	filters.DeniedSSHCommands = make([]string, len(u.Filters.DeniedSSHCommands))
+	copy(filters.DeniedSSHCommands, u.Filters.DeniedSSHCommands)
 	filters.RecoveryCodes = make([]RecoveryCode, 0, len(u.Filters.RecoveryCodes))
 	for _, code := range u.Filters.RecoveryCodes {
 		if code.Secret == nil {
@@ -1970,6 +2311,7 @@ func (u *User) getACopy() User {
 		Groups:               groups,
 		FsConfig:             u.FsConfig.GetACopy(),
 		groupSettingsApplied: u.groupSettingsApplied,
+		groupOverrides:       copyGroupOverrides(u.groupOverrides),
 	}
 }
 
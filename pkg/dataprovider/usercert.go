@@ -0,0 +1,124 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// validateTrustedCAKeys validates the specified certificate authorities
+// public keys, in authorized_keys format, and removes duplicates
+func validateTrustedCAKeys(keys []string) ([]string, error) {
+	var result []string
+	fingerprints := make(map[string]bool)
+	for idx, key := range keys {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		parsedKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+		if err != nil {
+			return nil, util.NewValidationError(fmt.Sprintf("could not parse trusted CA key %d: %v", idx+1, err))
+		}
+		if _, ok := parsedKey.(*ssh.Certificate); ok {
+			return nil, util.NewValidationError(fmt.Sprintf("trusted CA key %d is a certificate, a public key is required", idx+1))
+		}
+		fp := ssh.FingerprintSHA256(parsedKey)
+		if fingerprints[fp] {
+			continue
+		}
+		fingerprints[fp] = true
+		result = append(result, key)
+	}
+	return result, nil
+}
+
+func validateCertPrincipals(principals []string) []string {
+	var result []string
+	for _, principal := range principals {
+		principal = strings.TrimSpace(principal)
+		if principal != "" && !util.Contains(result, principal) {
+			result = append(result, principal)
+		}
+	}
+	return result
+}
+
+func validateUserCertSettings(user *User) error {
+	keys, err := validateTrustedCAKeys(user.Filters.TrustedCAKeys)
+	if err != nil {
+		return err
+	}
+	user.Filters.TrustedCAKeys = keys
+	user.Filters.CertPrincipals = validateCertPrincipals(user.Filters.CertPrincipals)
+	return nil
+}
+
+// IsTrustedUserCA returns true if the specified key is a certificate authority
+// trusted to sign certificates for this user
+func (u *User) IsTrustedUserCA(key ssh.PublicKey) bool {
+	marshaledKey := key.Marshal()
+	for idx, k := range u.Filters.TrustedCAKeys {
+		parsedKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
+		if err != nil {
+			providerLog(logger.LevelError, "error parsing trusted CA key %d for user %q: %v", idx, u.Username, err)
+			continue
+		}
+		if bytes.Equal(parsedKey.Marshal(), marshaledKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCertPrincipals returns the SSH certificate principals mapped to this user.
+// The username is the only allowed principal if no mapping is configured
+func (u *User) GetCertPrincipals() []string {
+	if len(u.Filters.CertPrincipals) == 0 {
+		return []string{u.Username}
+	}
+	result := make([]string, 0, len(u.Filters.CertPrincipals))
+	for _, principal := range u.Filters.CertPrincipals {
+		result = append(result, strings.ReplaceAll(principal, "%username%", u.Username))
+	}
+	return result
+}
+
+// GetTrustedCAKeysAsString returns the trusted CA keys, one per line
+func (u *User) GetTrustedCAKeysAsString() string {
+	return strings.Join(u.Filters.TrustedCAKeys, "\n")
+}
+
+// GetCertPrincipalsAsString returns the certificate principals as comma separated string
+func (u *User) GetCertPrincipalsAsString() string {
+	return strings.Join(u.Filters.CertPrincipals, ",")
+}
+
+// GetTrustedCAKeysAsString returns the trusted CA keys, one per line
+func (g *Group) GetTrustedCAKeysAsString() string {
+	return strings.Join(g.UserSettings.TrustedCAKeys, "\n")
+}
+
+// GetCertPrincipalsAsString returns the certificate principals as comma separated string
+func (g *Group) GetCertPrincipalsAsString() string {
+	return strings.Join(g.UserSettings.CertPrincipals, ",")
+}
@@ -0,0 +1,94 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// Supported methods to accept consent documents
+const (
+	ConsentMethodWebClient = "WebClient"
+	ConsentMethodLink      = "Link"
+)
+
+// UserConsent records the acceptance of a consent document, for example the
+// terms of service, by a user
+type UserConsent struct {
+	// Name of the accepted document
+	Document string `json:"document"`
+	// Version of the accepted document
+	Version string `json:"version"`
+	// Acceptance time as unix timestamp in milliseconds
+	AcceptedAt int64 `json:"accepted_at"`
+	// IP address the document was accepted from
+	IP string `json:"ip,omitempty"`
+	// How the document was accepted: from the WebClient or using a consent link
+	Method string `json:"method,omitempty"`
+}
+
+func validateUserConsents(user *User) error {
+	for idx := range user.Filters.Consents {
+		consent := &user.Filters.Consents[idx]
+		if consent.Document == "" || consent.Version == "" {
+			return util.NewValidationError(fmt.Sprintf("consent %d: document and version are mandatory", idx))
+		}
+		if consent.AcceptedAt <= 0 {
+			return util.NewValidationError(fmt.Sprintf("consent %d: invalid acceptance time", idx))
+		}
+	}
+	return nil
+}
+
+func copyUserConsents(consents []UserConsent) []UserConsent {
+	if len(consents) == 0 {
+		return nil
+	}
+	result := make([]UserConsent, len(consents))
+	copy(result, consents)
+	return result
+}
+
+// HasAcceptedConsent returns true if the user accepted the specified document.
+// If version is not empty the accepted version must match
+func (u *User) HasAcceptedConsent(document, version string) bool {
+	for _, consent := range u.Filters.Consents {
+		if consent.Document == document && (version == "" || consent.Version == version) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddUserConsents records the acceptance of the specified consent documents.
+// The previous acceptances are preserved for auditing purposes. The provider
+// actions and the event rules get the correlation ID carried by ctx, if any
+func AddUserConsents(ctx context.Context, username string, consents []UserConsent, executor, ipAddress, role string) error {
+	user, err := provider.userExists(username, role)
+	if err != nil {
+		return err
+	}
+	before := getAuditLogSnapshot(executor, actionObjectUser, &user)
+	user.Filters.Consents = append(user.Filters.Consents, consents...)
+	if err := provider.updateUser(&user); err != nil {
+		return err
+	}
+	webDAVUsersCache.swap(&user, "")
+	executeAuditedAction(ctx, operationUpdate, executor, ipAddress, actionObjectUser, username, role, before, &user)
+	return nil
+}
@@ -0,0 +1,571 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sftpgo/sdk"
+
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// Supported user import formats
+const (
+	// CSV with a header row, the columns are mapped to the user fields
+	UserImportFormatCSV = "csv"
+	// passwd style files, "username:password[:uid:gid:gecos:home_dir:shell]",
+	// for example ProFTPD AuthUserFile or vsftpd virtual users password files
+	UserImportFormatPasswd = "passwd"
+	// Pure-FTPd virtual users file, as managed by pure-pw
+	UserImportFormatPureFTPd = "pureftpd"
+)
+
+// Supported user import actions
+const (
+	UserImportActionAdd    = "add"
+	UserImportActionUpdate = "update"
+	UserImportActionSkip   = "skip"
+	UserImportActionError  = "error"
+)
+
+const (
+	// UserImportMaxRows defines the maximum number of users that can be imported at once
+	UserImportMaxRows = 10000
+	// placeholder replaced with the username in the template home dir
+	userImportUsernamePlaceholder = "%username%"
+	// separator for the fields with multiple values, for example groups, in a single CSV column
+	userImportListSeparator = ";"
+)
+
+var (
+	// UserImportFormats defines the supported user import formats
+	UserImportFormats = []string{UserImportFormatCSV, UserImportFormatPasswd, UserImportFormatPureFTPd}
+	// UserImportFields defines the user fields that can be mapped to CSV columns
+	UserImportFields = []string{"username", "password", "home_dir", "email", "description", "status",
+		"expiration_date", "quota_size", "quota_files", "max_sessions", "upload_bandwidth", "download_bandwidth",
+		"groups", "public_keys", "allowed_ip", "denied_ip"}
+	userImportCryptPrefixes = []string{"$2y$", "$2b$"}
+)
+
+// UserImportRequest defines the users to import
+type UserImportRequest struct {
+	// Format of the data to import, see UserImportFormats
+	Format string `json:"format"`
+	// Data to import
+	Data string `json:"data"`
+	// Mapping between the user fields and the CSV columns, ignored for the other formats.
+	// Unmapped fields are read from the column with the same name, if any
+	Mapping map[string]string `json:"mapping,omitempty"`
+	// Template defines the settings for the imported users, for example the permissions,
+	// the groups and the filesystem. Values read from the imported data have precedence.
+	// The "%username%" placeholder is replaced with the username in home_dir
+	Template User `json:"template"`
+	// If true the users are validated but not saved
+	DryRun bool `json:"dry_run"`
+	// If true existing users are updated with the imported values, otherwise they are skipped
+	UpdateExisting bool `json:"update_existing"`
+}
+
+// UserImportResult defines the result for a single imported user
+type UserImportResult struct {
+	// Line number within the imported data
+	Line     int    `json:"line"`
+	Username string `json:"username,omitempty"`
+	// add, update, skip, error
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+// UserImportReport defines the result of a users import
+type UserImportReport struct {
+	DryRun  bool               `json:"dry_run"`
+	Added   int                `json:"added"`
+	Updated int                `json:"updated"`
+	Skipped int                `json:"skipped"`
+	Errors  int                `json:"errors"`
+	Results []UserImportResult `json:"results"`
+}
+
+func (r *UserImportReport) addResult(result UserImportResult) {
+	switch result.Action {
+	case UserImportActionAdd:
+		r.Added++
+	case UserImportActionUpdate:
+		r.Updated++
+	case UserImportActionSkip:
+		r.Skipped++
+	default:
+		r.Errors++
+	}
+	r.Results = append(r.Results, result)
+}
+
+// userImportRow defines the values read from a single row, only the
+// fields set in values are applied to the user
+type userImportRow struct {
+	line   int
+	values map[string]string
+	err    error
+}
+
+func (r *UserImportRequest) validate() error {
+	if !util.Contains(UserImportFormats, r.Format) {
+		return util.NewValidationError(fmt.Sprintf("invalid import format %q", r.Format))
+	}
+	if strings.TrimSpace(r.Data) == "" {
+		return util.NewValidationError("no data to import")
+	}
+	for field, column := range r.Mapping {
+		if !util.Contains(UserImportFields, field) {
+			return util.NewValidationError(fmt.Sprintf("invalid mapping, unsupported field %q", field))
+		}
+		if strings.TrimSpace(column) == "" {
+			return util.NewValidationError(fmt.Sprintf("invalid mapping, empty column for field %q", field))
+		}
+	}
+	return nil
+}
+
+func (r *UserImportRequest) getRows() ([]userImportRow, error) {
+	var rows []userImportRow
+	var err error
+	switch r.Format {
+	case UserImportFormatCSV:
+		rows, err = r.getCSVRows()
+	default:
+		rows, err = r.getPasswdRows()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) > UserImportMaxRows {
+		return nil, util.NewValidationError(fmt.Sprintf("too many users to import: %d, max allowed: %d",
+			len(rows), UserImportMaxRows))
+	}
+	return rows, nil
+}
+
+func (r *UserImportRequest) getCSVRows() ([]userImportRow, error) {
+	reader := csv.NewReader(strings.NewReader(r.Data))
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, util.NewValidationError(fmt.Sprintf("unable to read the CSV header: %v", err))
+	}
+	columns := make(map[string]int)
+	for idx, name := range header {
+		columns[strings.TrimSpace(name)] = idx
+	}
+	fields := make(map[string]int)
+	for _, field := range UserImportFields {
+		column, ok := r.Mapping[field]
+		if !ok {
+			column = field
+		}
+		idx, ok := columns[column]
+		if !ok {
+			if _, mapped := r.Mapping[field]; mapped {
+				return nil, util.NewValidationError(fmt.Sprintf("column %q mapped to field %q not found", column, field))
+			}
+			continue
+		}
+		fields[field] = idx
+	}
+	if _, ok := fields["username"]; !ok {
+		return nil, util.NewValidationError("the username column is required")
+	}
+	var rows []userImportRow
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return nil, util.NewValidationError(fmt.Sprintf("unable to read the CSV data: %v", err))
+			}
+			rows = append(rows, userImportRow{line: parseErr.StartLine, err: err})
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+		values := make(map[string]string)
+		for field, idx := range fields {
+			values[field] = strings.TrimSpace(record[idx])
+		}
+		rows = append(rows, userImportRow{line: line, values: values})
+	}
+	return rows, nil
+}
+
+func (r *UserImportRequest) getPasswdRows() ([]userImportRow, error) {
+	var rows []userImportRow
+	scanner := bufio.NewScanner(strings.NewReader(r.Data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if r.Format == UserImportFormatPureFTPd {
+			rows = append(rows, getPureFTPdImportRow(line, text))
+		} else {
+			rows = append(rows, getPasswdImportRow(line, text))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, util.NewValidationError(fmt.Sprintf("unable to read the data to import: %v", err))
+	}
+	return rows, nil
+}
+
+func getPasswdImportRow(line int, text string) userImportRow {
+	fields := strings.Split(text, ":")
+	if len(fields) < 2 {
+		return userImportRow{line: line, err: errors.New("invalid line, expected at least username and password")}
+	}
+	values := map[string]string{
+		"username": fields[0],
+		"password": fields[1],
+	}
+	if len(fields) > 4 {
+		values["description"] = fields[4]
+	}
+	if len(fields) > 5 {
+		values["home_dir"] = fields[5]
+	}
+	return userImportRow{line: line, values: values}
+}
+
+// getPureFTPdImportRow parses a line from a Pure-FTPd virtual users file:
+// account:password:uid:gid:gecos:home_directory:upload_bandwidth:download_bandwidth:
+// upload_ratio:download_ratio:max_number_of_connections:files_quota:size_quota:
+// authorized_local_IPs:refused_local_IPs:authorized_client_IPs:refused_client_IPs:time_restrictions
+func getPureFTPdImportRow(line int, text string) userImportRow {
+	fields := strings.Split(text, ":")
+	if len(fields) < 6 {
+		return userImportRow{line: line, err: errors.New("invalid line, expected at least 6 fields")}
+	}
+	// "/./" marks the chroot, the user is always chrooted to the home dir
+	homeDir := path.Clean(strings.Replace(fields[5], "/./", "/", 1))
+	values := map[string]string{
+		"username":    fields[0],
+		"password":    fields[1],
+		"description": fields[4],
+		"home_dir":    homeDir,
+	}
+	// Pure-FTPd bandwidth limits are saved in bytes/s, SFTPGo uses KB/s
+	for idx, field := range map[int]string{6: "upload_bandwidth", 7: "download_bandwidth"} {
+		if len(fields) > idx && fields[idx] != "" {
+			bw, err := strconv.ParseInt(fields[idx], 10, 64)
+			if err != nil {
+				return userImportRow{line: line, err: fmt.Errorf("invalid %s: %w", field, err)}
+			}
+			values[field] = strconv.FormatInt(bw/1024, 10)
+		}
+	}
+	for idx, field := range map[int]string{10: "max_sessions", 11: "quota_files", 12: "quota_size"} {
+		if len(fields) > idx {
+			values[field] = fields[idx]
+		}
+	}
+	for idx, field := range map[int]string{15: "allowed_ip", 16: "denied_ip"} {
+		if len(fields) > idx && fields[idx] != "" {
+			values[field] = strings.ReplaceAll(fields[idx], ",", userImportListSeparator)
+		}
+	}
+	return userImportRow{line: line, values: values}
+}
+
+func getImportListValue(value string) []string {
+	var result []string
+	for _, v := range strings.Split(value, userImportListSeparator) {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// getImportIPValue returns the specified IP addresses and networks as CIDR networks
+func getImportIPValue(value string) []string {
+	result := getImportListValue(value)
+	for idx, ip := range result {
+		if !strings.Contains(ip, "/") {
+			if parsed := net.ParseIP(ip); parsed != nil {
+				if parsed.To4() != nil {
+					result[idx] = ip + "/32"
+				} else {
+					result[idx] = ip + "/128"
+				}
+			}
+		}
+	}
+	return result
+}
+
+func getImportExpirationDate(value string) (int64, error) {
+	if value == "" || value == "0" {
+		return 0, nil
+	}
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ts, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return util.GetTimeAsMsSinceEpoch(t), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid expiration_date %q", value)
+}
+
+// getImportPassword returns the password to save. For passwd style files the
+// password must be hashed using a supported algorithm
+func getImportPassword(value, format string) (string, error) {
+	if value == "" || format == UserImportFormatCSV {
+		return value, nil
+	}
+	for _, prefix := range userImportCryptPrefixes {
+		if strings.HasPrefix(value, prefix) {
+			value = bcryptPwdPrefix + strings.TrimPrefix(value, prefix)
+		}
+	}
+	if !util.IsStringPrefixInSlice(value, hashPwdPrefixes) {
+		return "", errors.New("unsupported or disabled password hash")
+	}
+	return value, nil
+}
+
+func applyImportInt(values map[string]string, field string, setter func(int64)) error {
+	value, ok := values[field]
+	if !ok || value == "" {
+		return nil
+	}
+	var n int64
+	var err error
+	if field == "quota_size" {
+		n, err = util.ParseBytes(value)
+	} else {
+		n, err = strconv.ParseInt(value, 10, 64)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", field, value)
+	}
+	setter(n)
+	return nil
+}
+
+// applyImportValues sets the imported values to the specified user
+func applyImportValues(user *User, values map[string]string, format string) error {
+	var err error
+	if v, ok := values["password"]; ok && v != "" {
+		if user.Password, err = getImportPassword(v, format); err != nil {
+			return err
+		}
+	}
+	if v, ok := values["home_dir"]; ok && v != "" {
+		user.HomeDir = v
+	}
+	if v, ok := values["email"]; ok && v != "" {
+		user.Email = v
+	}
+	if v, ok := values["description"]; ok && v != "" {
+		user.Description = v
+	}
+	if v, ok := values["status"]; ok && v != "" {
+		if user.Status, err = strconv.Atoi(v); err != nil {
+			return fmt.Errorf("invalid status %q", v)
+		}
+	}
+	if v, ok := values["expiration_date"]; ok {
+		if user.ExpirationDate, err = getImportExpirationDate(v); err != nil {
+			return err
+		}
+	}
+	if err := applyImportInt(values, "quota_size", func(n int64) { user.QuotaSize = n }); err != nil {
+		return err
+	}
+	if err := applyImportInt(values, "quota_files", func(n int64) { user.QuotaFiles = int(n) }); err != nil {
+		return err
+	}
+	if err := applyImportInt(values, "max_sessions", func(n int64) { user.MaxSessions = int(n) }); err != nil {
+		return err
+	}
+	if err := applyImportInt(values, "upload_bandwidth", func(n int64) { user.UploadBandwidth = n }); err != nil {
+		return err
+	}
+	if err := applyImportInt(values, "download_bandwidth", func(n int64) { user.DownloadBandwidth = n }); err != nil {
+		return err
+	}
+	if v, ok := values["groups"]; ok && v != "" {
+		user.Groups = nil
+		for idx, name := range getImportListValue(v) {
+			groupType := sdk.GroupTypeSecondary
+			if idx == 0 {
+				groupType = sdk.GroupTypePrimary
+			}
+			user.Groups = append(user.Groups, sdk.GroupMapping{Name: name, Type: groupType})
+		}
+	}
+	if v, ok := values["public_keys"]; ok && v != "" {
+		user.PublicKeys = getImportListValue(v)
+	}
+	if v, ok := values["allowed_ip"]; ok && v != "" {
+		user.Filters.AllowedIP = getImportIPValue(v)
+	}
+	if v, ok := values["denied_ip"]; ok && v != "" {
+		user.Filters.DeniedIP = getImportIPValue(v)
+	}
+	return nil
+}
+
+func getUserImportTemplate(template *User, role string) User {
+	user := template.getACopy()
+	user.ID = 0
+	user.Username = ""
+	user.Password = ""
+	user.Role = role
+	user.LastPasswordChange = 0
+	user.Filters.RecoveryCodes = nil
+	user.Filters.Consents = nil
+	user.Filters.PendingRegistration = 0
+	user.Filters.TOTPConfig = UserTOTPConfig{
+		Enabled: false,
+	}
+	// imported users are enabled unless a status is imported
+	user.Status = 1
+	if len(user.Permissions) == 0 {
+		user.Permissions = map[string][]string{
+			"/": {PermAny},
+		}
+	}
+	return user
+}
+
+func importUser(req *UserImportRequest, template *User, row *userImportRow, executor, ipAddress, role string,
+	checkUser func(*User) error,
+) UserImportResult {
+	result := UserImportResult{
+		Line:     row.line,
+		Username: config.convertName(row.values["username"]),
+		Action:   UserImportActionError,
+	}
+	if result.Username == "" {
+		result.Error = "the username is required"
+		return result
+	}
+	existing, err := UserExists(result.Username, role)
+	isNew := err != nil
+	if !isNew && !req.UpdateExisting {
+		result.Action = UserImportActionSkip
+		return result
+	}
+	var user User
+	if isNew {
+		if _, errAny := UserExists(result.Username, ""); errAny == nil {
+			result.Error = "the user already exists and it is not managed by the executor role"
+			return result
+		}
+		user = template.getACopy()
+		user.Username = result.Username
+		user.HomeDir = strings.ReplaceAll(user.HomeDir, userImportUsernamePlaceholder, user.Username)
+	} else {
+		user = existing
+	}
+	if err := applyImportValues(&user, row.values, req.Format); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if checkUser != nil {
+		if err := checkUser(&user); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+	}
+	if req.DryRun {
+		userCopy := user.getACopy()
+		err = ValidateUser(&userCopy)
+	} else if isNew {
+		err = AddUser(&user, executor, ipAddress, role)
+	} else {
+		err = UpdateUser(&user, executor, ipAddress, role)
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if isNew {
+		result.Action = UserImportActionAdd
+	} else {
+		result.Action = UserImportActionUpdate
+	}
+	return result
+}
+
+// ImportUsers imports the users from the specified data. The import is not
+// stopped if a user cannot be saved, the report contains the result for each
+// user. If set, checkUser is called for each user before saving it
+func ImportUsers(req *UserImportRequest, executor, ipAddress, role string, checkUser func(*User) error,
+) (UserImportReport, error) {
+	report := UserImportReport{
+		DryRun:  req.DryRun,
+		Results: []UserImportResult{},
+	}
+	if err := req.validate(); err != nil {
+		return report, err
+	}
+	rows, err := req.getRows()
+	if err != nil {
+		return report, err
+	}
+	template := getUserImportTemplate(&req.Template, role)
+	seen := make(map[string]bool)
+	for idx := range rows {
+		row := &rows[idx]
+		if row.err != nil {
+			report.addResult(UserImportResult{
+				Line:   row.line,
+				Action: UserImportActionError,
+				Error:  row.err.Error(),
+			})
+			continue
+		}
+		username := config.convertName(row.values["username"])
+		if username != "" && seen[username] {
+			report.addResult(UserImportResult{
+				Line:     row.line,
+				Username: username,
+				Action:   UserImportActionError,
+				Error:    "duplicate username",
+			})
+			continue
+		}
+		seen[username] = true
+		report.addResult(importUser(req, &template, row, executor, ipAddress, role, checkUser))
+	}
+	return report, nil
+}
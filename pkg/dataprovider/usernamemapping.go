@@ -0,0 +1,178 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	maxUsernameAliases = 10000
+)
+
+var (
+	// cached aliases, the key is the lowercase alias and the value the target username
+	usernameAliases atomic.Pointer[map[string]string]
+	// UpdatedAt for the cached aliases, used to detect updates from other instances
+	usernameAliasesUpdatedAt atomic.Int64
+)
+
+// UsernameMappingConfig defines the rules used to canonicalize the login names
+// before looking up users. The rules are applied for all protocols and login
+// methods, in the following order: domain stripping, case folding, aliases resolution.
+// Aliases are stored in the data provider configs
+type UsernameMappingConfig struct {
+	// Domains to strip from login names, both in the "user@domain" and in the
+	// "DOMAIN\user" form. Domains are matched case insensitively, "*" means any domain.
+	// For example setting "corp.com" and "CORP" allows to login as "user", "user@corp.com"
+	// and "CORP\user"
+	StripDomains []string `json:"strip_domains" mapstructure:"strip_domains"`
+	// Convert the login names to lowercase before looking up users.
+	// Stored usernames are not modified, you have to use lowercase usernames or
+	// enable the naming rules to convert them to lowercase
+	CaseFolding bool `json:"case_folding" mapstructure:"case_folding"`
+}
+
+func (c *UsernameMappingConfig) stripDomain(name string) string {
+	if len(c.StripDomains) == 0 {
+		return name
+	}
+	var domain, username string
+	if idx := strings.Index(name, "\\"); idx > 0 {
+		domain = name[:idx]
+		username = name[idx+1:]
+	} else if idx := strings.LastIndex(name, "@"); idx > 0 {
+		username = name[:idx]
+		domain = name[idx+1:]
+	} else {
+		return name
+	}
+	if username == "" {
+		return name
+	}
+	for _, d := range c.StripDomains {
+		if d == "*" || strings.EqualFold(d, domain) {
+			return username
+		}
+	}
+	return name
+}
+
+func (c *UsernameMappingConfig) canonicalize(name string) string {
+	name = c.stripDomain(name)
+	if c.CaseFolding {
+		name = strings.ToLower(name)
+	}
+	return name
+}
+
+func validateUsernameAliases(aliases map[string]string) (map[string]string, error) {
+	if len(aliases) == 0 {
+		return nil, nil
+	}
+	if len(aliases) > maxUsernameAliases {
+		return nil, util.NewValidationError(fmt.Sprintf("too many username aliases: %d, max allowed: %d",
+			len(aliases), maxUsernameAliases))
+	}
+	result := make(map[string]string)
+	for alias, username := range aliases {
+		alias = strings.ToLower(strings.TrimSpace(alias))
+		username = config.convertName(strings.TrimSpace(username))
+		if alias == "" || username == "" {
+			return nil, util.NewValidationError("username aliases and usernames cannot be empty")
+		}
+		if strings.EqualFold(alias, username) {
+			return nil, util.NewValidationError(fmt.Sprintf("alias %q cannot point to itself", alias))
+		}
+		if val, ok := result[alias]; ok && val != username {
+			return nil, util.NewValidationError(fmt.Sprintf("alias %q is duplicated", alias))
+		}
+		result[alias] = username
+	}
+	for alias, username := range result {
+		if _, ok := result[strings.ToLower(username)]; ok {
+			return nil, util.NewValidationError(fmt.Sprintf("alias %q points to %q that is an alias too", alias, username))
+		}
+	}
+	return result, nil
+}
+
+// GetUsernameAliasesAsString returns the username aliases formatted as
+// "alias:username" lines, sorted by alias
+func (c *Configs) GetUsernameAliasesAsString() string {
+	aliases := make([]string, 0, len(c.UsernameAliases))
+	for alias, username := range c.UsernameAliases {
+		aliases = append(aliases, fmt.Sprintf("%s:%s", alias, username))
+	}
+	sort.Strings(aliases)
+	return strings.Join(aliases, "\n")
+}
+
+func setUsernameAliases(configs *Configs) {
+	var aliases map[string]string
+	if len(configs.UsernameAliases) > 0 {
+		aliases = make(map[string]string)
+		for k, v := range configs.UsernameAliases {
+			aliases[k] = v
+		}
+	}
+	usernameAliases.Store(&aliases)
+	usernameAliasesUpdatedAt.Store(configs.UpdatedAt)
+}
+
+func loadUsernameAliases() {
+	configs, err := provider.getConfigs()
+	if err != nil {
+		providerLog(logger.LevelError, "unable to load username aliases: %v", err)
+		return
+	}
+	if configs.UpdatedAt == usernameAliasesUpdatedAt.Load() && usernameAliases.Load() != nil {
+		return
+	}
+	providerLog(logger.LevelDebug, "loading %d username aliases", len(configs.UsernameAliases))
+	setUsernameAliases(&configs)
+}
+
+func resolveUsernameAlias(name string) string {
+	aliases := usernameAliases.Load()
+	if aliases == nil || len(*aliases) == 0 {
+		return name
+	}
+	if username, ok := (*aliases)[strings.ToLower(name)]; ok {
+		providerLog(logger.LevelDebug, "login name %q resolved to username %q", name, username)
+		return username
+	}
+	return name
+}
+
+// canonicalizeLoginName returns the username to use for the provider lookups
+// applying the configured mapping rules, the aliases and the naming rules
+func canonicalizeLoginName(name string) string {
+	name = config.UsernameMapping.canonicalize(name)
+	name = resolveUsernameAlias(name)
+	return config.convertName(name)
+}
+
+// CanonicalizeLoginName returns the username for the given login name
+// applying the configured username mapping rules and aliases
+func CanonicalizeLoginName(name string) string {
+	return canonicalizeLoginName(name)
+}
@@ -0,0 +1,164 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+var (
+	userTemplateVariableRegex = regexp.MustCompile("^[a-zA-Z0-9_]+$")
+	// placeholders always replaced using the provisioning request
+	userTemplateReservedVariables = []string{"username", "password", "email"}
+)
+
+// UserTemplate defines a named template to provision users.
+// The string fields of the template user, for example the home directory,
+// the description, the groups names and the filesystem configuration, can
+// contain the %username% placeholder and the %<variable>% placeholders for
+// the template variables
+type UserTemplate struct {
+	// Unique name
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Template variables and their default values, a variable without a
+	// default value must be set in each provisioning request
+	Variables map[string]string `json:"variables,omitempty"`
+	// Template user, the username, the password and the public keys are
+	// defined in each provisioning request
+	User      User  `json:"user"`
+	CreatedAt int64 `json:"created_at"`
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+// GetReplacements returns the placeholders to replace for the specified
+// username and variables. The variables must be defined in the template
+func (t *UserTemplate) GetReplacements(username string, variables map[string]string) (map[string]string, error) {
+	replacements := make(map[string]string)
+	for k, v := range variables {
+		if _, ok := t.Variables[k]; !ok {
+			return nil, util.NewValidationError(fmt.Sprintf("variable %q is not defined in template %q", k, t.Name))
+		}
+		replacements["%"+k+"%"] = v
+	}
+	for k, v := range t.Variables {
+		if _, ok := replacements["%"+k+"%"]; ok {
+			continue
+		}
+		if v == "" {
+			return nil, util.NewValidationError(fmt.Sprintf("variable %q is required by template %q", k, t.Name))
+		}
+		replacements["%"+k+"%"] = v
+	}
+	replacements["%username%"] = username
+	return replacements, nil
+}
+
+// PrepareForRendering hides confidential data
+func (t *UserTemplate) PrepareForRendering() {
+	t.User.PrepareForRendering()
+}
+
+func (t *UserTemplate) validate() error {
+	if t.Name == "" {
+		return util.NewValidationError("user template: a name is required")
+	}
+	if len(t.Name) > 255 {
+		return util.NewValidationError("user template: name is too long, 255 is the maximum length allowed")
+	}
+	if config.NamingRules&1 == 0 && !usernameRegex.MatchString(t.Name) {
+		return util.NewValidationError(fmt.Sprintf("user template name %q is not valid, the following characters are allowed: a-zA-Z0-9-_.~", t.Name))
+	}
+	for k := range t.Variables {
+		if !userTemplateVariableRegex.MatchString(k) {
+			return util.NewValidationError(fmt.Sprintf("user template %q: variable name %q is not valid, the following characters are allowed: a-zA-Z0-9_", t.Name, k))
+		}
+		if util.Contains(userTemplateReservedVariables, k) {
+			return util.NewValidationError(fmt.Sprintf("user template %q: variable name %q is reserved", t.Name, k))
+		}
+	}
+	if t.User.Status < 0 || t.User.Status > 1 {
+		return util.NewValidationError(fmt.Sprintf("user template %q: invalid status %d", t.Name, t.User.Status))
+	}
+	t.User.ID = 0
+	t.User.Username = ""
+	t.User.Password = ""
+	t.User.PublicKeys = nil
+	t.User.SetEmptySecretsIfNil()
+	if t.User.FsConfig.HasRedactedSecret() {
+		return util.NewValidationError(fmt.Sprintf("user template %q: cannot save a filesystem configuration with redacted secrets", t.Name))
+	}
+	if err := t.User.FsConfig.Validate(t.Name); err != nil {
+		return util.NewValidationError(fmt.Sprintf("user template %q: %v", t.Name, err))
+	}
+	if t.CreatedAt == 0 {
+		t.CreatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+	}
+	if t.UpdatedAt == 0 {
+		t.UpdatedAt = t.CreatedAt
+	}
+	return nil
+}
+
+func (t *UserTemplate) getACopy() UserTemplate {
+	var variables map[string]string
+	if t.Variables != nil {
+		variables = make(map[string]string)
+		for k, v := range t.Variables {
+			variables[k] = v
+		}
+	}
+	return UserTemplate{
+		Name:        t.Name,
+		Description: t.Description,
+		Variables:   variables,
+		User:        t.User.getACopy(),
+		CreatedAt:   t.CreatedAt,
+		UpdatedAt:   t.UpdatedAt,
+	}
+}
+
+func validateUserTemplates(templates []UserTemplate) error {
+	names := make(map[string]bool)
+	for idx := range templates {
+		t := &templates[idx]
+		if err := t.validate(); err != nil {
+			return err
+		}
+		if names[t.Name] {
+			return util.NewValidationError(fmt.Sprintf("duplicated user template %q", t.Name))
+		}
+		names[t.Name] = true
+	}
+	return nil
+}
+
+// GetUserTemplate returns the user template with the specified name
+func GetUserTemplate(name string) (UserTemplate, error) {
+	configs, err := provider.getConfigs()
+	if err != nil {
+		return UserTemplate{}, err
+	}
+	for idx := range configs.UserTemplates {
+		if configs.UserTemplates[idx].Name == name {
+			return configs.UserTemplates[idx].getACopy(), nil
+		}
+	}
+	return UserTemplate{}, util.NewRecordNotFoundError(fmt.Sprintf("user template %q does not exist", name))
+}
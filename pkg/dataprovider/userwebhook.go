@@ -0,0 +1,163 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dataprovider
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/drakkan/sftpgo/v2/pkg/kms"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	// MaxUserWebhooks defines the maximum number of webhooks a user can register
+	MaxUserWebhooks = 10
+)
+
+var (
+	// UserWebhookEvents defines the filesystem events users can register webhooks for
+	UserWebhookEvents = []string{"upload", "download", "delete", "rename", "mkdir", "rmdir", "copy"}
+)
+
+// UserWebhook defines a webhook registered by a user to be notified about
+// filesystem events inside one of their folders
+type UserWebhook struct {
+	// Unique name
+	Name string `json:"name"`
+	// Virtual path of the folder, events for files and directories inside
+	// this folder are notified
+	Path string `json:"path"`
+	// Endpoint URL
+	URL string `json:"url"`
+	// Secret used to sign the payloads, it is mandatory
+	Secret *kms.Secret `json:"secret,omitempty"`
+	// Filesystem events to notify
+	Events []string `json:"events"`
+}
+
+// IsMatch returns true if the webhook must be notified for the specified
+// event and virtual path
+func (w *UserWebhook) IsMatch(event, virtualPath string) bool {
+	if !util.Contains(w.Events, event) {
+		return false
+	}
+	if w.Path == "/" || virtualPath == w.Path {
+		return true
+	}
+	return strings.HasPrefix(virtualPath, w.Path+"/")
+}
+
+func (w *UserWebhook) getACopy() UserWebhook {
+	events := make([]string, len(w.Events))
+	copy(events, w.Events)
+	secret := w.Secret
+	if secret == nil {
+		secret = kms.NewEmptySecret()
+	}
+
+	return UserWebhook{
+		Name:   w.Name,
+		Path:   w.Path,
+		URL:    w.URL,
+		Secret: secret.Clone(),
+		Events: events,
+	}
+}
+
+func (w *UserWebhook) validate(username string) error {
+	w.Name = strings.TrimSpace(w.Name)
+	if w.Name == "" {
+		return util.NewValidationError("webhook: name is mandatory")
+	}
+	if w.Path == "" {
+		return util.NewValidationError(fmt.Sprintf("webhook %q: path is mandatory", w.Name))
+	}
+	w.Path = util.CleanPath(w.Path)
+	u, err := url.Parse(w.URL)
+	if w.URL == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return util.NewValidationError(fmt.Sprintf("webhook %q: invalid URL %q", w.Name, w.URL))
+	}
+	w.Events = util.RemoveDuplicates(w.Events, false)
+	if len(w.Events) == 0 {
+		return util.NewValidationError(fmt.Sprintf("webhook %q: specify at least one event", w.Name))
+	}
+	for _, ev := range w.Events {
+		if !util.Contains(UserWebhookEvents, ev) {
+			return util.NewValidationError(fmt.Sprintf("webhook %q: unsupported event %q", w.Name, ev))
+		}
+	}
+	if w.Secret == nil || w.Secret.IsEmpty() {
+		return util.NewValidationError(fmt.Sprintf("webhook %q: secret is mandatory", w.Name))
+	}
+	if w.Secret.IsRedacted() {
+		return util.NewValidationError(fmt.Sprintf("webhook %q: cannot save a redacted secret", w.Name))
+	}
+	if w.Secret.IsPlain() {
+		w.Secret.SetAdditionalData(username)
+		if err := w.Secret.Encrypt(); err != nil {
+			return util.NewValidationError(fmt.Sprintf("webhook %q: unable to encrypt secret: %v", w.Name, err))
+		}
+	}
+	return nil
+}
+
+func copyUserWebhooks(webhooks []UserWebhook) []UserWebhook {
+	if len(webhooks) == 0 {
+		return nil
+	}
+	result := make([]UserWebhook, 0, len(webhooks))
+	for idx := range webhooks {
+		result = append(result, webhooks[idx].getACopy())
+	}
+	return result
+}
+
+func validateUserWebhooks(user *User) error {
+	if len(user.Filters.Webhooks) > MaxUserWebhooks {
+		return util.NewValidationError(fmt.Sprintf("too many webhooks, the maximum allowed is %d", MaxUserWebhooks))
+	}
+	var names []string
+	for idx := range user.Filters.Webhooks {
+		w := &user.Filters.Webhooks[idx]
+		if err := w.validate(user.Username); err != nil {
+			return err
+		}
+		if util.Contains(names, w.Name) {
+			return util.NewValidationError(fmt.Sprintf("webhook %q is duplicated", w.Name))
+		}
+		names = append(names, w.Name)
+	}
+	return nil
+}
+
+// SetWebhookSecretsFrom sets the secrets for the webhooks without a plain text
+// secret using the secrets of the given webhooks with the same name.
+// This way clients don't need to resend the secrets when updating webhooks
+func (u *User) SetWebhookSecretsFrom(webhooks []UserWebhook) {
+	for idx := range u.Filters.Webhooks {
+		w := &u.Filters.Webhooks[idx]
+		if w.Secret != nil && w.Secret.IsPlain() {
+			continue
+		}
+		for _, current := range webhooks {
+			if current.Name == w.Name && current.Secret != nil {
+				w.Secret = current.Secret.Clone()
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package ftpd
+
+import (
+	"fmt"
+	"strings"
+
+	ftpserverlog "github.com/fclairamb/go-log"
+
+	"github.com/drakkan/sftpgo/v2/pkg/common"
+)
+
+const (
+	ftpLogReceivedLine  = "Received line"
+	ftpLogSendingAnswer = "Sending answer"
+)
+
+// captureLogger wraps the ftpserverlib logger to add the exchanged commands
+// and replies to the matching debug captures. ftpserverlib logs commands and
+// replies if the debug mode is enabled for the client, the debug mode is
+// enabled if the binding has debug enabled or if a debug capture is running
+type captureLogger struct {
+	ftpserverlog.Logger
+	serverID int
+	clientID string
+	debug    bool
+}
+
+func newCaptureLogger(logger ftpserverlog.Logger, serverID int, debug bool) *captureLogger {
+	return &captureLogger{
+		Logger:   logger,
+		serverID: serverID,
+		debug:    debug,
+	}
+}
+
+func (l *captureLogger) Debug(event string, keyvals ...any) {
+	if l.clientID != "" && (event == ftpLogReceivedLine || event == ftpLogSendingAnswer) {
+		direction := common.DebugCaptureDirectionOut
+		if event == ftpLogReceivedLine {
+			direction = common.DebugCaptureDirectionIn
+		}
+		connID := fmt.Sprintf("%v_%v_%v", common.ProtocolFTP, l.serverID, l.clientID)
+		common.DebugCaptures.CaptureConnection(connID, direction, func() string {
+			return redactFTPLine(getLogValue("line", keyvals...))
+		})
+		if !l.debug {
+			return
+		}
+	}
+	l.Logger.Debug(event, keyvals...)
+}
+
+func (l *captureLogger) With(keyvals ...any) ftpserverlog.Logger {
+	clientID := l.clientID
+	if val := getLogValue("clientId", keyvals...); val != "" {
+		clientID = val
+	}
+	return &captureLogger{
+		Logger:   l.Logger.With(keyvals...),
+		serverID: l.serverID,
+		clientID: clientID,
+		debug:    l.debug,
+	}
+}
+
+func getLogValue(key string, keyvals ...any) string {
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if k, ok := keyvals[i].(string); ok && k == key {
+			return fmt.Sprintf("%v", keyvals[i+1])
+		}
+	}
+	return ""
+}
+
+func redactFTPLine(line string) string {
+	command, _, _ := strings.Cut(line, " ")
+	if strings.EqualFold(command, "PASS") {
+		return command + " REDACTED"
+	}
+	return line
+}
@@ -0,0 +1,236 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package ftpd
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	ftpserver "github.com/fclairamb/ftpserverlib"
+
+	"github.com/drakkan/sftpgo/v2/pkg/common"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	maxDataConnectionErrors = 100
+	dataConnectionActive    = "active"
+	dataConnectionPassive   = "passive"
+)
+
+var dataConnErrors = dataConnectionErrors{}
+
+// DataConnectionError defines a data connection that could not be established
+type DataConnectionError struct {
+	// Unix timestamp in milliseconds
+	Timestamp    int64  `json:"timestamp"`
+	ConnectionID string `json:"connection_id"`
+	Username     string `json:"username,omitempty"`
+	ClientIP     string `json:"client_ip"`
+	Binding      string `json:"binding"`
+	// active or passive
+	Mode    string `json:"mode"`
+	Command string `json:"command,omitempty"`
+	Error   string `json:"error"`
+	// Hint describes the most likely cause
+	Hint string `json:"hint"`
+}
+
+// BindingDataConnections describes the data connections configuration for a binding
+type BindingDataConnections struct {
+	Binding                    string    `json:"binding"`
+	PassiveIP                  string    `json:"passive_ip,omitempty"`
+	PassiveHost                string    `json:"passive_host,omitempty"`
+	PassiveIPOverrides         int       `json:"passive_ip_overrides,omitempty"`
+	PassivePortRange           PortRange `json:"passive_port_range"`
+	PassiveConnectionsSecurity int       `json:"passive_connections_security"`
+	ActiveModeDisabled         bool      `json:"active_mode_disabled"`
+	ActiveSourceAddress        string    `json:"active_source_address,omitempty"`
+	ActiveConnectionsSecurity  int       `json:"active_connections_security"`
+	DisabledCommands           []string  `json:"disabled_commands,omitempty"`
+	ProxyProtocol              bool      `json:"proxy_protocol"`
+	// Warnings about settings that often break data connections behind NAT
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Diagnostics defines the data connections diagnostics
+type Diagnostics struct {
+	Bindings []BindingDataConnections `json:"bindings"`
+	// Most recent data connection errors, newest first
+	Errors []DataConnectionError `json:"errors"`
+}
+
+type dataConnectionErrors struct {
+	sync.RWMutex
+	errors []DataConnectionError
+}
+
+func (e *dataConnectionErrors) add(connErr DataConnectionError) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.errors = append(e.errors, connErr)
+	if len(e.errors) > maxDataConnectionErrors {
+		e.errors = e.errors[len(e.errors)-maxDataConnectionErrors:]
+	}
+}
+
+func (e *dataConnectionErrors) get() []DataConnectionError {
+	e.RLock()
+	defer e.RUnlock()
+
+	result := make([]DataConnectionError, 0, len(e.errors))
+	for idx := len(e.errors) - 1; idx >= 0; idx-- {
+		result = append(result, e.errors[idx])
+	}
+	return result
+}
+
+func (e *dataConnectionErrors) clear() {
+	e.Lock()
+	defer e.Unlock()
+
+	e.errors = nil
+}
+
+func newDataConnectionError(binding Binding, connectionID string, cc ftpserver.ClientContext,
+	channelType ftpserver.DataChannel, err error,
+) DataConnectionError {
+	mode := dataConnectionPassive
+	if channelType == ftpserver.DataChannelActive {
+		mode = dataConnectionActive
+	}
+	connErr := DataConnectionError{
+		Timestamp:    util.GetTimeAsMsSinceEpoch(time.Now()),
+		ConnectionID: connectionID,
+		ClientIP:     util.GetIPFromRemoteAddress(cc.RemoteAddr().String()),
+		Binding:      binding.GetAddress(),
+		Mode:         mode,
+		Command:      cc.GetLastCommand(),
+		Error:        err.Error(),
+		Hint:         getDataConnectionHint(mode, err),
+	}
+	for _, stat := range common.Connections.GetStats("") {
+		if stat.ConnectionID == connectionID {
+			connErr.Username = stat.Username
+			break
+		}
+	}
+	logger.Warn(logSender, connectionID, "%s data connection failed: %v, hint: %s", mode, err, connErr.Hint)
+	return connErr
+}
+
+func getDataConnectionHint(mode string, err error) string {
+	var netErr net.Error
+	isTimeout := errors.As(err, &netErr) && netErr.Timeout()
+	errMsg := err.Error()
+
+	if mode == dataConnectionPassive {
+		switch {
+		case errors.Is(err, ftpserver.ErrNoAvailableListeningPort):
+			return "all the ports in the passive port range are in use, increase the range"
+		case strings.Contains(errMsg, "invalid passive IP"), strings.Contains(errMsg, "couldn't fetch public IP"):
+			return "unable to determine a valid IPv4 address for passive connections, check force_passive_ip, " +
+				"passive_host and passive_ip_overrides"
+		case strings.Contains(errMsg, "security requirements not met"):
+			return "the data connection comes from an IP address different from the control connection one, " +
+				"check the NAT/proxy configuration or set passive_connections_security to 1 on trusted networks"
+		case isTimeout:
+			return "the client did not connect to the advertised passive address: check that the passive IP is " +
+				"reachable from the client, this is usually the public IP when the server is behind NAT, " +
+				"and that the passive port range is allowed in the firewall and forwarded by the NAT"
+		}
+		return "unable to establish the passive data connection, check the passive IP and port range settings"
+	}
+
+	switch {
+	case strings.Contains(errMsg, "problem parsing"):
+		return "the client sent an invalid address for the active data connection"
+	case strings.Contains(errMsg, "does not match control connection"):
+		return "the client requested a data connection to an IP address different from the control connection one, " +
+			"this usually happens if the client is behind NAT and sends its private IP, use passive mode"
+	case errors.Is(err, syscall.EADDRINUSE), errors.Is(err, syscall.EACCES), strings.Contains(errMsg, "source address"):
+		return "unable to bind the source address for the active data connection, check active_source_port, " +
+			"binding port 20 requires additional privileges"
+	case isTimeout, errors.Is(err, syscall.ECONNREFUSED):
+		return "the server cannot connect to the client, the client is probably behind NAT or a firewall " +
+			"blocking incoming connections, use passive mode"
+	}
+	return "unable to establish the active data connection, try passive mode"
+}
+
+func getBindingDataConnections(c *Configuration, binding Binding) BindingDataConnections {
+	result := BindingDataConnections{
+		Binding:                    binding.GetAddress(),
+		PassiveIP:                  binding.ForcePassiveIP,
+		PassiveHost:                binding.PassiveHost,
+		PassiveIPOverrides:         len(binding.PassiveIPOverrides),
+		PassivePortRange:           c.PassivePortRange,
+		PassiveConnectionsSecurity: binding.PassiveConnectionsSecurity,
+		ActiveModeDisabled:         c.DisableActiveMode,
+		ActiveSourceAddress:        binding.getActiveSourceAddress(),
+		ActiveConnectionsSecurity:  binding.ActiveConnectionsSecurity,
+		DisabledCommands:           binding.GetDisabledDataCommands(),
+		ProxyProtocol:              binding.HasProxy(),
+	}
+	if binding.HasPassivePortRange() {
+		result.PassivePortRange = binding.PassivePortRange
+	}
+	if result.ActiveSourceAddress == "" && !c.DisableActiveMode {
+		if c.ActiveTransfersPortNon20 {
+			result.ActiveSourceAddress = net.JoinHostPort(binding.Address, "0")
+		} else {
+			result.ActiveSourceAddress = net.JoinHostPort(binding.Address, "20")
+		}
+	}
+	if result.PassiveIP == "" && result.PassiveHost == "" {
+		result.Warnings = append(result.Warnings, "no passive IP or host configured, the local address of the "+
+			"control connection is advertised, clients outside a NAT cannot connect to it")
+	}
+	if result.PassivePortRange.Start == 0 || result.PassivePortRange.End <= result.PassivePortRange.Start {
+		result.Warnings = append(result.Warnings, "no passive port range configured, random ports are used "+
+			"and they cannot be allowed in the firewall")
+	}
+	if binding.ExtendedCommandsPolicy == 2 {
+		result.Warnings = append(result.Warnings, "PORT and PASV are disabled, clients without EPRT and EPSV "+
+			"support cannot transfer files")
+	}
+	return result
+}
+
+// GetDiagnostics returns the data connections configuration for the active
+// bindings and the most recent data connection errors
+func GetDiagnostics() Diagnostics {
+	diagnostics := Diagnostics{
+		Bindings: make([]BindingDataConnections, 0, len(serviceStatus.Bindings)),
+		Errors:   dataConnErrors.get(),
+	}
+	if serviceConfig != nil {
+		for _, binding := range serviceStatus.Bindings {
+			diagnostics.Bindings = append(diagnostics.Bindings, getBindingDataConnections(serviceConfig, binding))
+		}
+	}
+	return diagnostics
+}
+
+// ClearDataConnectionErrors removes the recorded data connection errors
+func ClearDataConnectionErrors() {
+	dataConnErrors.clear()
+}
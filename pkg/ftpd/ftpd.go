@@ -22,6 +22,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -40,6 +41,7 @@ const (
 var (
 	certMgr       *common.CertManager
 	serviceStatus ServiceStatus
+	serviceConfig *Configuration
 )
 
 // PassiveIPOverride defines an exception for the configured passive IP
@@ -70,6 +72,14 @@ type Binding struct {
 	// ones will be used, if any
 	CertificateFile    string `json:"certificate_file" mapstructure:"certificate_file"`
 	CertificateKeyFile string `json:"certificate_key_file" mapstructure:"certificate_key_file"`
+	// Additional certificates for this binding, selected based on the server name
+	// requested by the client (SNI). If no additional certificate matches, the
+	// binding specific or the global certificate is used
+	SNICertificates []common.SNICertificate `json:"sni_certificates" mapstructure:"sni_certificates"`
+	// Obtain, using ACME, a certificate for the server name requested by the
+	// client, if no configured certificate matches and the server name is allowed
+	// in the ACME on-demand configuration
+	ACMEOnDemand bool `json:"acme_on_demand" mapstructure:"acme_on_demand"`
 	// Defines the minimum TLS version. 13 means TLS 1.3, default is TLS 1.2
 	MinTLSVersion int `json:"min_tls_version" mapstructure:"min_tls_version"`
 	// External IP address for passive connections.
@@ -81,6 +91,10 @@ type Binding struct {
 	// connection is requested and this can, depending on the DNS configuration, take a noticeable
 	// amount of time. Enable this setting only if you have a dynamic IP address
 	PassiveHost string `json:"passive_host" mapstructure:"passive_host"`
+	// Port range for passive data connections accepted on this binding. If set, it overrides
+	// the global passive port range, this way you can apply different firewall rules to the
+	// users connecting to different bindings
+	PassivePortRange PortRange `json:"passive_port_range" mapstructure:"passive_port_range"`
 	// Set to 1 to require client certificate authentication.
 	// Set to 2 to require a client certificate and verfify it if given. In this mode
 	// the client is allowed not to send a certificate.
@@ -107,6 +121,16 @@ type Binding struct {
 	// Please note that disabling the security checks you will make the FTP service vulnerable to bounce attacks
 	// on active data connections, so change the default value only if you are on a trusted/internal network
 	ActiveConnectionsSecurity int `json:"active_connections_security" mapstructure:"active_connections_security"`
+	// ActiveSourcePort defines the source port for active data connections. If set, active
+	// data connections originate from the binding address and this port, this way you can
+	// define stateful firewall rules for them. It overrides active_transfers_port_non_20
+	ActiveSourcePort int `json:"active_source_port" mapstructure:"active_source_port"`
+	// ExtendedCommandsPolicy defines the commands allowed to set up data connections.
+	// Supported values:
+	// - 0 PORT, PASV, EPRT and EPSV are allowed. This is the default
+	// - 1 EPRT and EPSV are disabled. Useful if a NAT or firewall helper only rewrites PORT and PASV
+	// - 2 PORT and PASV are disabled, only EPRT and EPSV are allowed
+	ExtendedCommandsPolicy int `json:"extended_commands_policy" mapstructure:"extended_commands_policy"`
 	// Debug enables the FTP debug mode. In debug mode, every FTP command will be logged
 	Debug   bool `json:"debug" mapstructure:"debug"`
 	ciphers []uint16
@@ -133,6 +157,21 @@ func (b *Binding) IsValid() bool {
 	return b.Port > 0
 }
 
+// HasPassivePortRange returns true if a binding specific passive port range is defined
+func (b *Binding) HasPassivePortRange() bool {
+	return b.PassivePortRange.Start > 0 && b.PassivePortRange.End > b.PassivePortRange.Start
+}
+
+func (b *Binding) checkPassivePortRange() error {
+	if b.PassivePortRange.Start == 0 && b.PassivePortRange.End == 0 {
+		return nil
+	}
+	if !b.HasPassivePortRange() || b.PassivePortRange.End > 65535 {
+		return fmt.Errorf("invalid passive_port_range: %d-%d", b.PassivePortRange.Start, b.PassivePortRange.End)
+	}
+	return nil
+}
+
 func (b *Binding) checkSecuritySettings() error {
 	if b.PassiveConnectionsSecurity < 0 || b.PassiveConnectionsSecurity > 1 {
 		return fmt.Errorf("invalid passive_connections_security: %v", b.PassiveConnectionsSecurity)
@@ -143,6 +182,35 @@ func (b *Binding) checkSecuritySettings() error {
 	return nil
 }
 
+func (b *Binding) checkDataConnectionsSettings() error {
+	if b.ActiveSourcePort < 0 || b.ActiveSourcePort > 65535 {
+		return fmt.Errorf("invalid active_source_port: %d", b.ActiveSourcePort)
+	}
+	if b.ExtendedCommandsPolicy < 0 || b.ExtendedCommandsPolicy > 2 {
+		return fmt.Errorf("invalid extended_commands_policy: %d", b.ExtendedCommandsPolicy)
+	}
+	return nil
+}
+
+func (b *Binding) getActiveSourceAddress() string {
+	if b.ActiveSourcePort > 0 {
+		return net.JoinHostPort(b.Address, strconv.Itoa(b.ActiveSourcePort))
+	}
+	return ""
+}
+
+// GetDisabledDataCommands returns the commands disabled by the extended commands policy
+func (b *Binding) GetDisabledDataCommands() []string {
+	switch b.ExtendedCommandsPolicy {
+	case 1:
+		return []string{"EPRT", "EPSV"}
+	case 2:
+		return []string{"PORT", "PASV"}
+	default:
+		return nil
+	}
+}
+
 func (b *Binding) checkPassiveIP() error {
 	if b.ForcePassiveIP != "" {
 		ip, err := parsePassiveIP(b.ForcePassiveIP)
@@ -315,6 +383,18 @@ func (c *Configuration) getKeyPairs(configDir string) []common.TLSKeyPair {
 				ID:   binding.GetAddress(),
 			})
 		}
+		for _, sniCert := range binding.SNICertificates {
+			certificateFile := getConfigPath(sniCert.CertificateFile, configDir)
+			certificateKeyFile := getConfigPath(sniCert.CertificateKeyFile, configDir)
+			if certificateFile != "" && certificateKeyFile != "" {
+				keyPairs = append(keyPairs, common.TLSKeyPair{
+					Cert: certificateFile,
+					Key:  certificateKeyFile,
+					ID:   binding.GetAddress(),
+					SNI:  true,
+				})
+			}
+		}
 	}
 	var certificateFile, certificateKeyFile string
 	if c.acmeDomain != "" {
@@ -389,6 +469,7 @@ func (c *Configuration) Initialize(configDir string) error {
 		Bindings:         nil,
 		PassivePortRange: c.PassivePortRange,
 	}
+	serviceConfig = c
 
 	exitChannel := make(chan error, 1)
 
@@ -402,7 +483,8 @@ func (c *Configuration) Initialize(configDir string) error {
 		go func(s *Server) {
 			ftpLogger := logger.LeveledLogger{Sender: "ftpserverlib"}
 			ftpServer := ftpserver.NewFtpServer(s)
-			ftpServer.Logger = ftpLogger.With("server_id", fmt.Sprintf("FTP_%v", s.ID))
+			ftpServer.Logger = newCaptureLogger(ftpLogger.With("server_id", fmt.Sprintf("FTP_%v", s.ID)), s.ID,
+				s.binding.Debug)
 			logger.Info(logSender, "", "starting FTP serving, binding: %v", s.binding.GetAddress())
 			util.CheckTCP4Port(s.binding.Port)
 			exitChannel <- ftpServer.ListenAndServe()
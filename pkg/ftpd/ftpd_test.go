@@ -15,6 +15,8 @@
 package ftpd_test
 
 import (
+	"archive/zip"
+	"bytes"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
@@ -26,12 +28,14 @@ import (
 	"io/fs"
 	"net"
 	"net/http"
+	"net/textproto"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -517,6 +521,146 @@ func TestInitializationFailure(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestDebugCapture(t *testing.T) {
+	user, _, err := httpdtest.AddUser(getTestUser(), http.StatusCreated)
+	assert.NoError(t, err)
+	capture, err := common.DebugCaptures.Start(common.DebugCaptureRequest{
+		Protocol: common.ProtocolFTP,
+		Port:     2121,
+	}, "admin")
+	require.NoError(t, err)
+	client, err := getFTPClient(user, false, nil)
+	if assert.NoError(t, err) {
+		_, err = client.CurrentDir()
+		assert.NoError(t, err)
+		err = client.Quit()
+		assert.NoError(t, err)
+	}
+	err = common.DebugCaptures.Stop(capture.ID)
+	assert.NoError(t, err)
+	bundle, err := common.DebugCaptures.GetBundle(capture.ID)
+	require.NoError(t, err)
+	zr, err := zip.NewReader(bytes.NewReader(bundle), int64(len(bundle)))
+	require.NoError(t, err)
+	rc, err := zr.Open("events.jsonl")
+	require.NoError(t, err)
+	data, err := io.ReadAll(rc)
+	assert.NoError(t, err)
+	rc.Close()
+	assert.NotContains(t, string(data), defaultPassword)
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var ev common.DebugCaptureEvent
+		err = json.Unmarshal([]byte(line), &ev)
+		require.NoError(t, err)
+		assert.Equal(t, common.ProtocolFTP, ev.Protocol)
+		lines = append(lines, ev.Direction+" "+ev.Message)
+	}
+	assert.Contains(t, lines, "in USER "+defaultUsername)
+	assert.Contains(t, lines, "in PASS REDACTED")
+	assert.Contains(t, lines, "in PWD")
+	assert.Contains(t, lines, "out 230 Password ok, continue")
+	err = common.DebugCaptures.Delete(capture.ID)
+	assert.NoError(t, err)
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestMaxTransfers(t *testing.T) {
+	u := getTestUser()
+	u.Filters.FTPMaxTransfers = 1
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(131072)
+	err = createTestFile(testFilePath, testFileSize)
+	assert.NoError(t, err)
+	client1, err := getFTPClient(user, false, nil)
+	if assert.NoError(t, err) {
+		client2, err := getFTPClient(user, false, nil)
+		if assert.NoError(t, err) {
+			err = ftpUploadFile(testFilePath, testFileName, testFileSize, client1, 0)
+			assert.NoError(t, err)
+			// keep an upload in progress until the pipe writer is closed
+			pr, pw := io.Pipe()
+			uploadErr := make(chan error, 1)
+			go func() {
+				uploadErr <- client1.Stor(testFileName+"1", pr)
+			}()
+			_, err = pw.Write([]byte("data"))
+			assert.NoError(t, err)
+			_, err = client2.Retr(testFileName)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), "too many simultaneous transfers")
+			}
+			err = pw.Close()
+			assert.NoError(t, err)
+			assert.NoError(t, <-uploadErr)
+			// directory listings are not limited
+			_, err = client2.List("/")
+			assert.NoError(t, err)
+			localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+			err = ftpDownloadFile(testFileName, localDownloadPath, testFileSize, client2, 0)
+			assert.NoError(t, err)
+			err = os.Remove(localDownloadPath)
+			assert.NoError(t, err)
+			err = client2.Quit()
+			assert.NoError(t, err)
+		}
+		err = client1.Quit()
+		assert.NoError(t, err)
+	}
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestUserPassivePortRange(t *testing.T) {
+	g := getTestGroup()
+	g.UserSettings.PassivePortRange = dataprovider.PortRange{Start: 51020, End: 51030}
+	group, _, err := httpdtest.AddGroup(g, http.StatusCreated)
+	assert.NoError(t, err)
+	u := getTestUser()
+	u.Filters.PassivePortRange = dataprovider.PortRange{Start: 51000, End: 51010}
+	u.Groups = []sdk.GroupMapping{
+		{
+			Name: group.Name,
+			Type: sdk.GroupTypePrimary,
+		},
+	}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		port, err := getFTPPassivePort(user)
+		if assert.NoError(t, err) {
+			assert.GreaterOrEqual(t, port, 51000)
+			assert.LessOrEqual(t, port, 51010)
+		}
+	}
+	// the group range applies to the users without one
+	user.Filters.PassivePortRange = dataprovider.PortRange{}
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	port, err := getFTPPassivePort(user)
+	if assert.NoError(t, err) {
+		assert.GreaterOrEqual(t, port, 51020)
+		assert.LessOrEqual(t, port, 51030)
+	}
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveGroup(group, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestBasicFTPHandling(t *testing.T) {
 	u := getTestUser()
 	u.QuotaSize = 6553600
@@ -2077,6 +2221,53 @@ func TestSFTPBuffered(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestZeroCopyDownload(t *testing.T) {
+	common.Config.ZeroCopyDownloads = true
+	defer func() {
+		common.Config.ZeroCopyDownloads = false
+	}()
+
+	u := getTestUser()
+	u.DownloadBandwidth = 4096
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(1048576 + 65535)
+	err = createTestFile(testFilePath, testFileSize)
+	assert.NoError(t, err)
+	expected, err := os.ReadFile(testFilePath)
+	assert.NoError(t, err)
+	for _, useTLS := range []bool{false, true} {
+		client, err := getFTPClient(user, useTLS, nil)
+		if assert.NoError(t, err) {
+			err = ftpUploadFile(testFilePath, testFileName, testFileSize, client, 0)
+			assert.NoError(t, err)
+			localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+			err = ftpDownloadFile(testFileName, localDownloadPath, testFileSize, client, 0)
+			assert.NoError(t, err)
+			readed, err := os.ReadFile(localDownloadPath)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, readed)
+			// resume the download
+			err = ftpDownloadFile(testFileName, localDownloadPath, testFileSize-1000, client, 1000)
+			assert.NoError(t, err)
+			readed, err = os.ReadFile(localDownloadPath)
+			assert.NoError(t, err)
+			assert.Equal(t, expected[1000:], readed)
+			err = client.Quit()
+			assert.NoError(t, err)
+			err = os.Remove(localDownloadPath)
+			assert.NoError(t, err)
+		}
+	}
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestResume(t *testing.T) {
 	u := getTestUser()
 	localUser, _, err := httpdtest.AddUser(u, http.StatusCreated)
@@ -3187,6 +3378,16 @@ func TestActiveModeDisabled(t *testing.T) {
 		assert.Equal(t, ftp.StatusBadArguments, code)
 		assert.Equal(t, "Your request does not meet the configured security requirements", response)
 
+		diagnostics := ftpd.GetDiagnostics()
+		assert.NotEmpty(t, diagnostics.Bindings)
+		if assert.NotEmpty(t, diagnostics.Errors) {
+			assert.Equal(t, "active", diagnostics.Errors[0].Mode)
+			assert.Equal(t, "EPRT", diagnostics.Errors[0].Command)
+			assert.Equal(t, user.Username, diagnostics.Errors[0].Username)
+			assert.Contains(t, diagnostics.Errors[0].Error, "132.235.1.2")
+		}
+		ftpd.ClearDataConnectionErrors()
+
 		err = client.Quit()
 		assert.NoError(t, err)
 	}
@@ -3876,6 +4077,58 @@ func getFTPClient(user dataprovider.User, useTLS bool, tlsConfig *tls.Config, di
 	return client, err
 }
 
+// getFTPPassivePort logs in using the specified user, sends a PASV command
+// and returns the port included in the reply
+func getFTPPassivePort(user dataprovider.User) (int, error) {
+	conn, err := textproto.Dial("tcp", ftpServerAddr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if _, _, err := conn.ReadResponse(ftp.StatusReady); err != nil {
+		return 0, err
+	}
+	if err := conn.PrintfLine("USER %s", user.Username); err != nil {
+		return 0, err
+	}
+	if _, _, err := conn.ReadResponse(ftp.StatusUserOK); err != nil {
+		return 0, err
+	}
+	if err := conn.PrintfLine("PASS %s", defaultPassword); err != nil {
+		return 0, err
+	}
+	if _, _, err := conn.ReadResponse(ftp.StatusLoggedIn); err != nil {
+		return 0, err
+	}
+	if err := conn.PrintfLine("PASV"); err != nil {
+		return 0, err
+	}
+	_, msg, err := conn.ReadResponse(ftp.StatusPassiveMode)
+	if err != nil {
+		return 0, err
+	}
+	// the reply is in the format "Entering Passive Mode (h1,h2,h3,h4,p1,p2)"
+	start := strings.Index(msg, "(")
+	end := strings.LastIndex(msg, ")")
+	if start < 0 || end < start {
+		return 0, fmt.Errorf("invalid PASV reply: %q", msg)
+	}
+	fields := strings.Split(msg[start+1:end], ",")
+	if len(fields) != 6 {
+		return 0, fmt.Errorf("invalid PASV reply: %q", msg)
+	}
+	p1, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return 0, err
+	}
+	p2, err := strconv.Atoi(fields[5])
+	if err != nil {
+		return 0, err
+	}
+	return p1*256 + p2, nil
+}
+
 func waitTCPListening(address string) {
 	for {
 		conn, err := net.Dial("tcp", address)
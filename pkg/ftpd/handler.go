@@ -35,6 +35,7 @@ import (
 var (
 	errNotImplemented   = errors.New("not implemented")
 	errCOMBNotSupported = errors.New("COMB is not supported for this filesystem")
+	errTooManyTransfers = errors.New("too many simultaneous transfers")
 )
 
 // Connection details for an FTP connection.
@@ -292,6 +293,15 @@ func (c *Connection) Symlink(oldname, newname string) error {
 
 // ReadDir implements ClientDriverExtensionFilelist
 func (c *Connection) ReadDir(name string) ([]os.FileInfo, error) {
+	lister, err := c.ReadDirLister(name)
+	if err != nil {
+		return nil, err
+	}
+	return vfs.ReadAllFromDirLister(lister)
+}
+
+// ReadDirLister implements ClientDriverExtensionFileLister
+func (c *Connection) ReadDirLister(name string) (ftpserver.DirLister, error) {
 	c.UpdateLastActivity()
 
 	if c.doWildcardListDir {
@@ -305,7 +315,18 @@ func (c *Connection) ReadDir(name string) ([]os.FileInfo, error) {
 		return c.getListDirWithWildcards(name, baseName)
 	}
 
-	return c.ListDir(name)
+	return c.GetDirLister(name)
+}
+
+// GetPassivePortRange implements ClientDriverExtensionPassivePortRange
+func (c *Connection) GetPassivePortRange() *ftpserver.PortRange {
+	if !c.User.Filters.PassivePortRange.IsDefined() {
+		return nil
+	}
+	return &ftpserver.PortRange{
+		Start: c.User.Filters.PassivePortRange.Start,
+		End:   c.User.Filters.PassivePortRange.End,
+	}
 }
 
 // GetHandle implements ClientDriverExtentionFileTransfer
@@ -321,10 +342,23 @@ func (c *Connection) GetHandle(name string, flags int, offset int64) (ftpserver.
 		return nil, errCOMBNotSupported
 	}
 
+	maxTransfers := c.User.Filters.FTPMaxTransfers
+	if maxTransfers > 0 && !userTransfers.add(c.User.Username, maxTransfers) {
+		c.Log(logger.LevelInfo, "denying transfer for %q, the limit of %d simultaneous transfers is reached",
+			name, maxTransfers)
+		return nil, errTooManyTransfers
+	}
+
+	var t ftpserver.FileTransfer
 	if flags&os.O_WRONLY != 0 {
-		return c.uploadFile(fs, p, name, flags)
+		t, err = c.uploadFile(fs, p, name, flags)
+	} else {
+		t, err = c.downloadFile(fs, p, name, offset)
+	}
+	if err != nil && maxTransfers > 0 {
+		userTransfers.remove(c.User.Username)
 	}
-	return c.downloadFile(fs, p, name, offset)
+	return t, err
 }
 
 func (c *Connection) downloadFile(fs vfs.Fs, fsPath, ftpPath string, offset int64) (ftpserver.FileTransfer, error) {
@@ -367,9 +401,9 @@ func (c *Connection) uploadFile(fs vfs.Fs, fsPath, ftpPath string, flags int) (f
 		return nil, ftpserver.ErrFileNameNotAllowed
 	}
 
-	filePath := fsPath
-	if common.Config.IsAtomicUploadEnabled() && fs.IsAtomicUploadSupported() {
-		filePath = fs.GetAtomicUploadPath(fsPath)
+	filePath, err := c.GetUploadFsPath(fs, fsPath, ftpPath)
+	if err != nil {
+		return nil, err
 	}
 
 	stat, statErr := fs.Lstat(fsPath)
@@ -395,6 +429,15 @@ func (c *Connection) uploadFile(fs vfs.Fs, fsPath, ftpPath string, flags int) (f
 		return nil, fmt.Errorf("%w, no overwrite permission", ftpserver.ErrFileNameNotAllowed)
 	}
 
+	if err := c.CheckWORMProtection(ftpPath, stat); err != nil {
+		return nil, err
+	}
+
+	if c.IsStagedUpload(ftpPath) {
+		// the existing file is replaced when the staged upload is published
+		return c.handleFTPUploadToNewFile(fs, flags, fsPath, filePath, ftpPath)
+	}
+
 	return c.handleFTPUploadToExistingFile(fs, flags, fsPath, filePath, stat.Size(), ftpPath)
 }
 
@@ -506,29 +549,23 @@ func (c *Connection) handleFTPUploadToExistingFile(fs vfs.Fs, flags int, resolve
 	return t, nil
 }
 
-func (c *Connection) getListDirWithWildcards(dirName, pattern string) ([]os.FileInfo, error) {
-	files, err := c.ListDir(dirName)
+func (c *Connection) getListDirWithWildcards(dirName, pattern string) (ftpserver.DirLister, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	lister, err := c.GetDirLister(dirName)
 	if err != nil {
-		return files, err
+		return nil, err
 	}
-	validIdx := 0
 	var relativeBase string
 	if c.clientContext.GetLastCommand() != "NLST" {
 		relativeBase = getPathRelativeTo(c.clientContext.Path(), dirName)
 	}
-	for _, fi := range files {
-		match, err := path.Match(pattern, fi.Name())
-		if err != nil {
-			return files, err
-		}
-		if match {
-			files[validIdx] = vfs.NewFileInfo(path.Join(relativeBase, fi.Name()), fi.IsDir(), fi.Size(),
-				fi.ModTime(), true)
-			validIdx++
-		}
-	}
-
-	return files[:validIdx], nil
+	return &patternDirLister{
+		DirListerAt:  lister,
+		pattern:      pattern,
+		relativeBase: relativeBase,
+	}, nil
 }
 
 func (c *Connection) isListDirWithWildcards(name string) bool {
@@ -559,3 +596,36 @@ func getPathRelativeTo(base, target string) string {
 		base = path.Dir(path.Clean(base))
 	}
 }
+
+// patternDirLister returns the entries matching a pattern, the names are
+// relative to the base path, if any
+type patternDirLister struct {
+	*common.DirListerAt
+	pattern      string
+	relativeBase string
+}
+
+// Next implements the ftpserver.DirLister interface
+func (l *patternDirLister) Next(limit int) ([]os.FileInfo, error) {
+	for {
+		files, err := l.DirListerAt.Next(limit)
+		if len(files) == 0 {
+			return files, err
+		}
+		validIdx := 0
+		for _, fi := range files {
+			match, errMatch := path.Match(l.pattern, fi.Name())
+			if errMatch != nil {
+				return nil, errMatch
+			}
+			if match {
+				files[validIdx] = vfs.NewFileInfo(path.Join(l.relativeBase, fi.Name()), fi.IsDir(), fi.Size(),
+					fi.ModTime(), true)
+				validIdx++
+			}
+		}
+		if validIdx > 0 || err != nil {
+			return files[:validIdx], err
+		}
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"syscall"
 	"testing"
 	"time"
 
@@ -504,6 +505,27 @@ func TestServerGetSettings(t *testing.T) {
 	assert.Equal(t, 10000, settings.PassiveTransferPortRange.Start)
 	assert.Equal(t, 11000, settings.PassiveTransferPortRange.End)
 
+	server.binding.PassivePortRange = PortRange{
+		Start: 12000,
+		End:   12100,
+	}
+	settings, err = server.GetSettings()
+	assert.NoError(t, err)
+	assert.Equal(t, 12000, settings.PassiveTransferPortRange.Start)
+	assert.Equal(t, 12100, settings.PassiveTransferPortRange.End)
+	server.binding.PassivePortRange.End = 11000
+	_, err = server.GetSettings()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "invalid passive_port_range")
+	}
+	server.binding.PassivePortRange = PortRange{
+		Start: 65000,
+		End:   65600,
+	}
+	_, err = server.GetSettings()
+	assert.Error(t, err)
+	server.binding.PassivePortRange = PortRange{}
+
 	common.Config.ProxyProtocol = 1
 	_, err = server.GetSettings()
 	assert.Error(t, err)
@@ -549,6 +571,27 @@ func TestServerGetSettings(t *testing.T) {
 	common.Config = oldConfig
 }
 
+func TestTransfersTracker(t *testing.T) {
+	tracker := transfersTracker{
+		users: make(map[string]int),
+	}
+	assert.True(t, tracker.add("user1", 2))
+	assert.True(t, tracker.add("user1", 2))
+	assert.False(t, tracker.add("user1", 2))
+	assert.True(t, tracker.add("user2", 1))
+	assert.False(t, tracker.add("user2", 1))
+	tracker.remove("user1")
+	assert.Equal(t, 1, tracker.users["user1"])
+	assert.True(t, tracker.add("user1", 2))
+	tracker.remove("user1")
+	tracker.remove("user1")
+	tracker.remove("user2")
+	assert.Len(t, tracker.users, 0)
+	// removing an untracked user must not create a negative counter
+	tracker.remove("user3")
+	assert.Len(t, tracker.users, 0)
+}
+
 func TestUserInvalidParams(t *testing.T) {
 	u := dataprovider.User{
 		BaseUser: sdk.BaseUser{
@@ -1124,6 +1167,110 @@ func TestConfigsFromProvider(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestDataConnectionsSettings(t *testing.T) {
+	b := Binding{
+		Address:          "127.0.0.1",
+		Port:             2121,
+		ActiveSourcePort: -1,
+	}
+	assert.Error(t, b.checkDataConnectionsSettings())
+	b.ActiveSourcePort = 70000
+	assert.Error(t, b.checkDataConnectionsSettings())
+	b.ActiveSourcePort = 2020
+	b.ExtendedCommandsPolicy = 3
+	assert.Error(t, b.checkDataConnectionsSettings())
+	b.ExtendedCommandsPolicy = 1
+	assert.NoError(t, b.checkDataConnectionsSettings())
+	assert.Equal(t, "127.0.0.1:2020", b.getActiveSourceAddress())
+	assert.Equal(t, []string{"EPRT", "EPSV"}, b.GetDisabledDataCommands())
+	b.ExtendedCommandsPolicy = 2
+	assert.Equal(t, []string{"PORT", "PASV"}, b.GetDisabledDataCommands())
+	b.ExtendedCommandsPolicy = 0
+	assert.Nil(t, b.GetDisabledDataCommands())
+
+	c := &Configuration{
+		PassivePortRange: PortRange{Start: 50000, End: 50100},
+	}
+	server := NewServer(c, configDir, b, 0)
+	settings, err := server.GetSettings()
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:2020", settings.ActiveTransferSourceAddr)
+	assert.Nil(t, settings.DisabledCommands)
+	server.binding.ExtendedCommandsPolicy = 5
+	_, err = server.GetSettings()
+	assert.Error(t, err)
+
+	diagnostics := getBindingDataConnections(c, b)
+	assert.Equal(t, "127.0.0.1:2020", diagnostics.ActiveSourceAddress)
+	assert.Equal(t, c.PassivePortRange, diagnostics.PassivePortRange)
+	assert.Len(t, diagnostics.Warnings, 1)
+	b.ActiveSourcePort = 0
+	b.ForcePassiveIP = "192.168.1.1"
+	b.PassivePortRange = PortRange{Start: 51000, End: 51100}
+	b.ExtendedCommandsPolicy = 2
+	diagnostics = getBindingDataConnections(c, b)
+	assert.Equal(t, "127.0.0.1:20", diagnostics.ActiveSourceAddress)
+	assert.Equal(t, b.PassivePortRange, diagnostics.PassivePortRange)
+	assert.Len(t, diagnostics.Warnings, 1)
+	c.PassivePortRange = PortRange{}
+	c.ActiveTransfersPortNon20 = true
+	b.PassivePortRange = PortRange{}
+	b.ExtendedCommandsPolicy = 0
+	diagnostics = getBindingDataConnections(c, b)
+	assert.Equal(t, "127.0.0.1:0", diagnostics.ActiveSourceAddress)
+	assert.Len(t, diagnostics.Warnings, 1)
+}
+
+func TestDataConnectionErrors(t *testing.T) {
+	ClearDataConnectionErrors()
+	b := Binding{
+		Address: "127.0.0.1",
+		Port:    2121,
+	}
+	server := NewServer(&Configuration{}, configDir, b, 0)
+	cc := mockFTPClientContext{remoteIP: "172.16.1.1"}
+	timeoutErr := &net.OpError{Op: "accept", Err: os.ErrDeadlineExceeded}
+	server.DataConnectionFailed(cc, ftpserver.DataChannelPassive, timeoutErr)
+	server.DataConnectionFailed(cc, ftpserver.DataChannelActive, errors.New("data connection ip address 10.0.0.1 "+
+		"does not match control connection ip address 172.16.1.1"))
+	connErrors := dataConnErrors.get()
+	require.Len(t, connErrors, 2)
+	assert.Equal(t, dataConnectionActive, connErrors[0].Mode)
+	assert.Contains(t, connErrors[0].Hint, "private IP")
+	assert.Equal(t, "172.16.1.1", connErrors[0].ClientIP)
+	assert.Equal(t, "127.0.0.1:2121", connErrors[0].Binding)
+	assert.Equal(t, dataConnectionPassive, connErrors[1].Mode)
+	assert.Contains(t, connErrors[1].Hint, "did not connect")
+
+	hints := map[string]error{
+		"passive port range":           ftpserver.ErrNoAvailableListeningPort,
+		"force_passive_ip":             errors.New("invalid passive IP \"a\""),
+		"passive_connections_security": errors.New("data connection security requirements not met"),
+		"passive IP and port range":    errors.New("unexpected"),
+	}
+	for hint, err := range hints {
+		assert.Contains(t, getDataConnectionHint(dataConnectionPassive, err), hint)
+	}
+	hints = map[string]error{
+		"invalid address":    errors.New("problem parsing 1,2: invalid"),
+		"active_source_port": &net.OpError{Op: "dial", Err: syscall.EADDRINUSE},
+		"behind NAT":         &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED},
+		"try passive mode":   errors.New("unexpected"),
+	}
+	for hint, err := range hints {
+		assert.Contains(t, getDataConnectionHint(dataConnectionActive, err), hint)
+	}
+
+	for i := 0; i < maxDataConnectionErrors+10; i++ {
+		dataConnErrors.add(DataConnectionError{ConnectionID: fmt.Sprintf("%d", i)})
+	}
+	connErrors = dataConnErrors.get()
+	require.Len(t, connErrors, maxDataConnectionErrors)
+	assert.Equal(t, fmt.Sprintf("%d", maxDataConnectionErrors+9), connErrors[0].ConnectionID)
+	ClearDataConnectionErrors()
+	assert.Len(t, GetDiagnostics().Errors, 0)
+}
+
 func TestPassiveHost(t *testing.T) {
 	b := Binding{
 		PassiveHost: "invalid hostname",
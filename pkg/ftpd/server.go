@@ -15,6 +15,7 @@
 package ftpd
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -105,8 +106,19 @@ func (s *Server) GetSettings() (*ftpserver.Settings, error) {
 	if err := s.binding.checkSecuritySettings(); err != nil {
 		return nil, err
 	}
+	if err := s.binding.checkPassivePortRange(); err != nil {
+		return nil, err
+	}
+	if err := s.binding.checkDataConnectionsSettings(); err != nil {
+		return nil, err
+	}
 	var portRange *ftpserver.PortRange
-	if s.config.PassivePortRange.Start > 0 && s.config.PassivePortRange.End > s.config.PassivePortRange.Start {
+	if s.binding.HasPassivePortRange() {
+		portRange = &ftpserver.PortRange{
+			Start: s.binding.PassivePortRange.Start,
+			End:   s.binding.PassivePortRange.End,
+		}
+	} else if s.config.PassivePortRange.Start > 0 && s.config.PassivePortRange.End > s.config.PassivePortRange.Start {
 		portRange = &ftpserver.PortRange{
 			Start: s.config.PassivePortRange.Start,
 			End:   s.config.PassivePortRange.End,
@@ -143,12 +155,14 @@ func (s *Server) GetSettings() (*ftpserver.Settings, error) {
 		PublicIPResolver:         s.binding.passiveIPResolver,
 		PassiveTransferPortRange: portRange,
 		ActiveTransferPortNon20:  s.config.ActiveTransfersPortNon20,
+		ActiveTransferSourceAddr: s.binding.getActiveSourceAddress(),
 		IdleTimeout:              -1,
 		ConnectionTimeout:        20,
 		Banner:                   s.statusBanner,
 		TLSRequired:              ftpserver.TLSRequirement(s.binding.TLSMode),
 		DisableSite:              !s.config.EnableSite,
 		DisableActiveMode:        s.config.DisableActiveMode,
+		DisabledCommands:         s.binding.GetDisabledDataCommands(),
 		EnableHASH:               s.config.HASHSupport > 0,
 		EnableCOMB:               s.config.CombineSupport > 0,
 		DefaultTransferType:      ftpserver.TransferTypeBinary,
@@ -159,7 +173,7 @@ func (s *Server) GetSettings() (*ftpserver.Settings, error) {
 
 // ClientConnected is called to send the very first welcome message
 func (s *Server) ClientConnected(cc ftpserver.ClientContext) (string, error) {
-	cc.SetDebug(s.binding.Debug)
+	cc.SetDebug(s.binding.Debug || common.DebugCaptures.IsActive())
 	ipAddr := util.GetIPFromRemoteAddress(cc.RemoteAddr().String())
 	common.Connections.AddClientConnection(ipAddr)
 	if common.IsBanned(ipAddr, common.ProtocolFTP) {
@@ -203,16 +217,17 @@ func (s *Server) AuthUser(cc ftpserver.ClientContext, username, password string)
 		loginMethod = dataprovider.LoginMethodTLSCertificateAndPwd
 	}
 	ipAddr := util.GetIPFromRemoteAddress(cc.RemoteAddr().String())
-	user, err := dataprovider.CheckUserAndPass(username, password, ipAddr, common.ProtocolFTP)
+	ctx := s.getLoginContext(cc)
+	user, err := dataprovider.CheckUserAndPassContext(ctx, username, password, ipAddr, common.ProtocolFTP)
 	if err != nil {
 		user.Username = username
-		updateLoginMetrics(&user, ipAddr, loginMethod, err)
+		updateLoginMetrics(ctx, &user, ipAddr, loginMethod, err)
 		return nil, dataprovider.ErrInvalidCredentials
 	}
 
 	connection, err := s.validateUser(user, cc, loginMethod)
 
-	defer updateLoginMetrics(&user, ipAddr, loginMethod, err)
+	defer updateLoginMetrics(ctx, &user, ipAddr, loginMethod, err)
 
 	if err != nil {
 		return nil, err
@@ -226,7 +241,8 @@ func (s *Server) AuthUser(cc ftpserver.ClientContext, username, password string)
 // PreAuthUser implements the MainDriverExtensionUserVerifier interface
 func (s *Server) PreAuthUser(cc ftpserver.ClientContext, username string) error {
 	if s.binding.TLSMode == 0 && s.tlsConfig != nil {
-		user, err := dataprovider.GetFTPPreAuthUser(username, util.GetIPFromRemoteAddress(cc.RemoteAddr().String()))
+		user, err := dataprovider.GetFTPPreAuthUser(s.getLoginContext(cc), username,
+			util.GetIPFromRemoteAddress(cc.RemoteAddr().String()))
 		if err == nil {
 			if user.Filters.FTPSecurity == 1 {
 				return cc.SetTLSRequirement(ftpserver.MandatoryEncryption)
@@ -250,6 +266,12 @@ func (s *Server) WrapPassiveListener(listener net.Listener) (net.Listener, error
 	return listener, nil
 }
 
+// DataConnectionFailed implements the MainDriverExtensionDataConnectionNotifier interface
+func (s *Server) DataConnectionFailed(cc ftpserver.ClientContext, channelType ftpserver.DataChannel, err error) {
+	connectionID := fmt.Sprintf("%v_%v_%v", common.ProtocolFTP, s.ID, cc.ID())
+	dataConnErrors.add(newDataConnectionError(s.binding, connectionID, cc, channelType, err))
+}
+
 // VerifyConnection checks whether a user should be authenticated using a client certificate without prompting for a password
 func (s *Server) VerifyConnection(cc ftpserver.ClientContext, user string, tlsConn *tls.Conn) (ftpserver.ClientDriver, error) {
 	if !s.binding.isMutualTLSEnabled() {
@@ -260,14 +282,16 @@ func (s *Server) VerifyConnection(cc ftpserver.ClientContext, user string, tlsCo
 		state := tlsConn.ConnectionState()
 		if len(state.PeerCertificates) > 0 {
 			ipAddr := util.GetIPFromRemoteAddress(cc.RemoteAddr().String())
-			dbUser, err := dataprovider.CheckUserBeforeTLSAuth(user, ipAddr, common.ProtocolFTP, state.PeerCertificates[0])
+			ctx := s.getLoginContext(cc)
+			dbUser, err := dataprovider.CheckUserBeforeTLSAuth(ctx, user, ipAddr, common.ProtocolFTP, state.PeerCertificates[0])
 			if err != nil {
 				dbUser.Username = user
-				updateLoginMetrics(&dbUser, ipAddr, dataprovider.LoginMethodTLSCertificate, err)
+				updateLoginMetrics(ctx, &dbUser, ipAddr, dataprovider.LoginMethodTLSCertificate, err)
 				return nil, dataprovider.ErrInvalidCredentials
 			}
 			if dbUser.IsTLSUsernameVerificationEnabled() {
-				dbUser, err = dataprovider.CheckUserAndTLSCert(user, ipAddr, common.ProtocolFTP, state.PeerCertificates[0])
+				dbUser, err = dataprovider.CheckUserAndTLSCertContext(ctx, user, ipAddr, common.ProtocolFTP,
+					state.PeerCertificates[0])
 				if err != nil {
 					return nil, err
 				}
@@ -277,7 +301,7 @@ func (s *Server) VerifyConnection(cc ftpserver.ClientContext, user string, tlsCo
 				if dbUser.IsLoginMethodAllowed(dataprovider.LoginMethodTLSCertificate, common.ProtocolFTP, nil) {
 					connection, err := s.validateUser(dbUser, cc, dataprovider.LoginMethodTLSCertificate)
 
-					defer updateLoginMetrics(&dbUser, ipAddr, dataprovider.LoginMethodTLSCertificate, err)
+					defer updateLoginMetrics(ctx, &dbUser, ipAddr, dataprovider.LoginMethodTLSCertificate, err)
 
 					if err != nil {
 						return nil, err
@@ -301,8 +325,12 @@ func (s *Server) buildTLSConfig() {
 		if getConfigPath(s.binding.CertificateFile, "") != "" && getConfigPath(s.binding.CertificateKeyFile, "") != "" {
 			certID = s.binding.GetAddress()
 		}
+		getCertificate := certMgr.GetCertificateFunc(certID)
+		if len(s.binding.SNICertificates) > 0 || s.binding.ACMEOnDemand {
+			getCertificate = certMgr.GetCertificateFuncWithSNI(certID, s.binding.GetAddress(), s.binding.ACMEOnDemand)
+		}
 		s.tlsConfig = &tls.Config{
-			GetCertificate:           certMgr.GetCertificateFunc(certID),
+			GetCertificate:           getCertificate,
 			MinVersion:               util.GetTLSVersion(s.binding.MinTLSVersion),
 			CipherSuites:             s.binding.ciphers,
 			PreferServerCipherSuites: true,
@@ -360,6 +388,12 @@ func (s *Server) verifyTLSConnection(state tls.ConnectionState) error {
 	return nil
 }
 
+// getLoginContext returns a context carrying the connection ID, it is used as
+// correlation ID for the hooks executed while authenticating the client
+func (s *Server) getLoginContext(cc ftpserver.ClientContext) context.Context {
+	return logger.WithCorrelationID(context.Background(), fmt.Sprintf("%v_%v_%v", common.ProtocolFTP, s.ID, cc.ID()))
+}
+
 func (s *Server) validateUser(user dataprovider.User, cc ftpserver.ClientContext, loginMethod string) (*Connection, error) {
 	connectionID := fmt.Sprintf("%v_%v_%v", common.ProtocolFTP, s.ID, cc.ID())
 	if !filepath.IsAbs(user.HomeDir) {
@@ -381,6 +415,10 @@ func (s *Server) validateUser(user dataprovider.User, cc ftpserver.ClientContext
 			user.Username)
 		return nil, fmt.Errorf("second factor authentication is not set for user %q", user.Username)
 	}
+	if err := common.CheckConsentsForProtocol(&user, common.ProtocolFTP); err != nil {
+		logger.Info(logSender, connectionID, "cannot login user %q, consent documents not accepted", user.Username)
+		return nil, err
+	}
 	if user.MaxSessions > 0 {
 		activeSessions := common.Connections.GetActiveSessions(user.Username)
 		if activeSessions >= user.MaxSessions {
@@ -412,6 +450,9 @@ func (s *Server) validateUser(user dataprovider.User, cc ftpserver.ClientContext
 		logger.Warn(logSender, connectionID, "unable to swap connection: %v, close fs error: %v", err, errClose)
 		return nil, err
 	}
+	if common.DebugCaptures.IsActive() {
+		cc.SetDebug(true)
+	}
 	return connection, nil
 }
 
@@ -422,7 +463,7 @@ func setStartDirectory(startDirectory string, cc ftpserver.ClientContext) {
 	cc.SetPath(startDirectory)
 }
 
-func updateLoginMetrics(user *dataprovider.User, ip, loginMethod string, err error) {
+func updateLoginMetrics(ctx context.Context, user *dataprovider.User, ip, loginMethod string, err error) {
 	metric.AddLoginAttempt(loginMethod)
 	if err != nil && err != common.ErrInternalFailure {
 		logger.ConnectionFailedLog(user.Username, ip, loginMethod,
@@ -437,5 +478,5 @@ func updateLoginMetrics(user *dataprovider.User, ip, loginMethod string, err err
 		plugin.Handler.NotifyLogEvent(logEv, common.ProtocolFTP, user.Username, ip, "", err)
 	}
 	metric.AddLoginResult(loginMethod, err)
-	dataprovider.ExecutePostLoginHook(user, loginMethod, ip, common.ProtocolFTP, err)
+	dataprovider.ExecutePostLoginHook(ctx, user, loginMethod, ip, common.ProtocolFTP, err)
 }
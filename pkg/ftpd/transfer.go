@@ -17,6 +17,7 @@ package ftpd
 import (
 	"errors"
 	"io"
+	"sync"
 
 	"github.com/eikenb/pipeat"
 
@@ -24,6 +25,40 @@ import (
 	"github.com/drakkan/sftpgo/v2/pkg/vfs"
 )
 
+// userTransfers tracks the simultaneous file transfers for the users with
+// a transfers limit, the transfers from all the users sessions count
+var userTransfers = transfersTracker{
+	users: make(map[string]int),
+}
+
+type transfersTracker struct {
+	sync.Mutex
+	users map[string]int
+}
+
+// add returns false if the user already has maxTransfers active transfers
+func (d *transfersTracker) add(username string, maxTransfers int) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.users[username] >= maxTransfers {
+		return false
+	}
+	d.users[username]++
+	return true
+}
+
+func (d *transfersTracker) remove(username string) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.users[username] <= 1 {
+		delete(d.users, username)
+		return
+	}
+	d.users[username]--
+}
+
 // transfer contains the transfer details for an upload or a download.
 // It implements the ftpserver.FileTransfer interface to handle files downloads and uploads
 type transfer struct {
@@ -74,12 +109,37 @@ func (t *transfer) Read(p []byte) (n int, err error) {
 	return
 }
 
+// WriteTo implements io.WriterTo. It is used by io.Copy to send the downloads
+// to the data connection, the local files are sent without copying them in
+// user space, if enabled and supported by the data connection, otherwise a
+// buffer from the transfer buffers pool is used
+func (t *transfer) WriteTo(w io.Writer) (int64, error) {
+	if t.CanZeroCopy(w) {
+		return t.ZeroCopyWriteTo(w, -1)
+	}
+	n, err := t.Connection.CopyBuffer(w, t)
+	if errors.Is(err, common.ErrMemoryBudgetExhausted) {
+		t.TransferError(err)
+	}
+	return n, err
+}
+
+// ReadFrom implements io.ReaderFrom. It is used by io.Copy to receive the
+// uploads from the data connection using a buffer from the transfer buffers pool
+func (t *transfer) ReadFrom(r io.Reader) (int64, error) {
+	n, err := t.Connection.CopyBuffer(t, r)
+	if errors.Is(err, common.ErrMemoryBudgetExhausted) {
+		t.TransferError(err)
+	}
+	return n, err
+}
+
 // Write writes the uploaded contents.
 func (t *transfer) Write(p []byte) (n int, err error) {
 	t.Connection.UpdateLastActivity()
-
-	n, err = t.writer.Write(p)
+	n, err = t.WriteUploadContent(t.writer, p)
 	t.BytesReceived.Add(int64(n))
+	t.UpdateChecksum(p[:n], -1)
 
 	if err == nil {
 		err = t.CheckWrite()
@@ -115,6 +175,15 @@ func (t *transfer) Close() error {
 	if err := t.setFinished(); err != nil {
 		return err
 	}
+	if t.Connection.User.Filters.FTPMaxTransfers > 0 {
+		userTransfers.remove(t.Connection.User.Username)
+	}
+	if t.writer != nil {
+		// the data buffered to detect the content type must be written before closing
+		if err := t.FlushUploadContent(t.writer); err != nil {
+			t.TransferError(err)
+		}
+	}
 	err := t.closeIO()
 	errBaseClose := t.BaseTransfer.Close()
 	if errBaseClose != nil {
@@ -0,0 +1,522 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Package geoip provides a reader for MaxMind DB files, such as GeoLite2
+// Country and City databases, to find the country of IP addresses
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// CountryPrefix is the prefix for the allow and deny list entries that
+// match a country instead of an IP/Mask, for example "country:IT"
+const CountryPrefix = "country:"
+
+const (
+	dataSectionSeparatorSize = 16
+	maxMetadataSize          = 128 * 1024
+	maxLookupCacheSize       = 10000
+)
+
+var (
+	metadataStartMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+	errInvalidDatabase  = errors.New("invalid MaxMind DB file")
+	current             atomic.Pointer[Reader]
+	currentPath         atomic.Pointer[string]
+)
+
+// data types as defined in the MaxMind DB file format specification
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// Reader allows to lookup IP addresses in a MaxMind DB file
+type Reader struct {
+	buf          []byte
+	databaseType string
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	treeSize     uint
+	ipv4Start    uint
+	mu           sync.RWMutex
+	cache        map[string]string
+}
+
+// Open reads the MaxMind DB file at the specified path
+func Open(path string) (*Reader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newReader(buf)
+}
+
+func newReader(buf []byte) (*Reader, error) {
+	start := 0
+	if len(buf) > maxMetadataSize {
+		start = len(buf) - maxMetadataSize
+	}
+	idx := bytes.LastIndex(buf[start:], metadataStartMarker)
+	if idx < 0 {
+		return nil, fmt.Errorf("%w: metadata not found", errInvalidDatabase)
+	}
+	metadataStart := uint(start + idx + len(metadataStartMarker))
+	d := decoder{buf: buf[metadataStart:]}
+	value, _, err := d.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unable to decode metadata: %v", errInvalidDatabase, err)
+	}
+	metadata, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: unexpected metadata", errInvalidDatabase)
+	}
+	r := &Reader{
+		buf:        buf,
+		nodeCount:  getUintValue(metadata["node_count"]),
+		recordSize: getUintValue(metadata["record_size"]),
+		ipVersion:  getUintValue(metadata["ip_version"]),
+		cache:      make(map[string]string),
+	}
+	r.databaseType, _ = metadata["database_type"].(string)
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("%w: unsupported record size %d", errInvalidDatabase, r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("%w: unsupported IP version %d", errInvalidDatabase, r.ipVersion)
+	}
+	r.treeSize = r.nodeCount * r.recordSize / 4
+	if r.treeSize+dataSectionSeparatorSize > metadataStart-uint(len(metadataStartMarker)) {
+		return nil, fmt.Errorf("%w: the search tree exceeds the file size", errInvalidDatabase)
+	}
+	if r.ipVersion == 6 {
+		// IPv4 addresses are stored in the ::/96 subtree
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node, err = r.readNode(node, 0)
+			if err != nil {
+				return nil, err
+			}
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// DatabaseType returns the database type, for example "GeoLite2-Country"
+func (r *Reader) DatabaseType() string {
+	return r.databaseType
+}
+
+func (r *Reader) readNode(node, bit uint) (uint, error) {
+	offset := node * r.recordSize / 4
+	if offset+r.recordSize/4 > r.treeSize {
+		return 0, fmt.Errorf("%w: invalid node %d", errInvalidDatabase, node)
+	}
+	b := r.buf[offset:]
+	switch r.recordSize {
+	case 24:
+		if bit == 0 {
+			return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return uint(b[3])<<16 | uint(b[4])<<8 | uint(b[5]), nil
+	case 28:
+		if bit == 0 {
+			return (uint(b[3])&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return (uint(b[3])&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6]), nil
+	default:
+		if bit == 0 {
+			return uint(binary.BigEndian.Uint32(b[0:4])), nil
+		}
+		return uint(binary.BigEndian.Uint32(b[4:8])), nil
+	}
+}
+
+// Lookup returns the data stored for the specified IP address or nil if the
+// address is not in the database
+func (r *Reader) Lookup(ip net.IP) (any, error) {
+	ipBytes := ip.To4()
+	node := uint(0)
+	if ipBytes != nil {
+		node = r.ipv4Start
+	} else {
+		if r.ipVersion == 4 {
+			return nil, nil
+		}
+		ipBytes = ip.To16()
+		if ipBytes == nil {
+			return nil, fmt.Errorf("invalid IP address %q", ip)
+		}
+	}
+	bitCount := uint(len(ipBytes) * 8)
+	var err error
+	for i := uint(0); i < bitCount && node < r.nodeCount; i++ {
+		bit := uint(ipBytes[i>>3]>>(7-(i%8))) & 1
+		node, err = r.readNode(node, bit)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if node == r.nodeCount {
+		return nil, nil
+	}
+	if node < r.nodeCount {
+		return nil, fmt.Errorf("%w: the search tree is too deep", errInvalidDatabase)
+	}
+	offset := node - r.nodeCount - dataSectionSeparatorSize
+	d := decoder{buf: r.buf[r.treeSize+dataSectionSeparatorSize:]}
+	value, _, err := d.decode(offset)
+	return value, err
+}
+
+// Country returns the ISO 3166-1 alpha-2 code of the country for the
+// specified IP address, the registered country is returned if the country is
+// unknown. An empty string is returned if the address is not in the database
+func (r *Reader) Country(ip net.IP) (string, error) {
+	key := ip.String()
+	r.mu.RLock()
+	code, ok := r.cache[key]
+	r.mu.RUnlock()
+	if ok {
+		return code, nil
+	}
+	value, err := r.Lookup(ip)
+	if err != nil {
+		return "", err
+	}
+	if record, ok := value.(map[string]any); ok {
+		for _, field := range []string{"country", "registered_country"} {
+			if country, ok := record[field].(map[string]any); ok {
+				if isoCode, ok := country["iso_code"].(string); ok && isoCode != "" {
+					code = strings.ToUpper(isoCode)
+					break
+				}
+			}
+		}
+	}
+	r.mu.Lock()
+	if len(r.cache) >= maxLookupCacheSize {
+		r.cache = make(map[string]string)
+	}
+	r.cache[key] = code
+	r.mu.Unlock()
+	return code, nil
+}
+
+type decoder struct {
+	buf []byte
+}
+
+func (d *decoder) readBytes(offset, size uint) ([]byte, error) {
+	if offset+size > uint(len(d.buf)) || offset+size < offset {
+		return nil, fmt.Errorf("%w: unexpected end of data", errInvalidDatabase)
+	}
+	return d.buf[offset : offset+size], nil
+}
+
+func (d *decoder) readUint(offset, size uint) (uint64, error) {
+	b, err := d.readBytes(offset, size)
+	if err != nil {
+		return 0, err
+	}
+	var val uint64
+	for _, c := range b {
+		val = val<<8 | uint64(c)
+	}
+	return val, nil
+}
+
+func (d *decoder) decodeControl(offset uint) (int, uint, uint, error) {
+	ctrl, err := d.readBytes(offset, 1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	offset++
+	dataType := int(ctrl[0] >> 5)
+	if dataType == typeExtended {
+		ext, err := d.readBytes(offset, 1)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		offset++
+		dataType = 7 + int(ext[0])
+	}
+	size := uint(ctrl[0] & 0x1f)
+	if dataType == typePointer {
+		// the size bits encode the pointer size and value
+		return dataType, size, offset, nil
+	}
+	switch size {
+	case 29:
+		val, err := d.readUint(offset, 1)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		size = 29 + uint(val)
+		offset++
+	case 30:
+		val, err := d.readUint(offset, 2)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		size = 285 + uint(val)
+		offset += 2
+	case 31:
+		val, err := d.readUint(offset, 3)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		size = 65821 + uint(val)
+		offset += 3
+	}
+	return dataType, size, offset, nil
+}
+
+func (d *decoder) decodePointer(ctrl, offset uint) (uint, uint, error) {
+	pointerSize := ((ctrl >> 3) & 0x3) + 1
+	val, err := d.readUint(offset, pointerSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	prefix := uint64(ctrl & 0x7)
+	var pointer uint64
+	switch pointerSize {
+	case 1:
+		pointer = prefix<<8 | val
+	case 2:
+		pointer = (prefix<<16 | val) + 2048
+	case 3:
+		pointer = (prefix<<24 | val) + 526336
+	default:
+		pointer = val
+	}
+	return uint(pointer), offset + pointerSize, nil
+}
+
+// decode decodes the value at the specified offset and returns it with the
+// offset of the next value
+func (d *decoder) decode(offset uint) (any, uint, error) {
+	return d.decodeValue(offset, 0)
+}
+
+func (d *decoder) decodeValue(offset uint, depth int) (any, uint, error) {
+	if depth > 32 {
+		return nil, 0, fmt.Errorf("%w: maximum data structure depth exceeded", errInvalidDatabase)
+	}
+	dataType, size, offset, err := d.decodeControl(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch dataType {
+	case typePointer:
+		pointer, next, err := d.decodePointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decodeValue(pointer, depth+1)
+		return value, next, err
+	case typeString:
+		b, err := d.readBytes(offset, size)
+		return string(b), offset + size, err
+	case typeBytes:
+		b, err := d.readBytes(offset, size)
+		return b, offset + size, err
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("%w: invalid double size %d", errInvalidDatabase, size)
+		}
+		val, err := d.readUint(offset, size)
+		return math.Float64frombits(val), offset + size, err
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("%w: invalid float size %d", errInvalidDatabase, size)
+		}
+		val, err := d.readUint(offset, size)
+		return float64(math.Float32frombits(uint32(val))), offset + size, err
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("%w: invalid integer size %d", errInvalidDatabase, size)
+		}
+		val, err := d.readUint(offset, size)
+		return val, offset + size, err
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("%w: invalid integer size %d", errInvalidDatabase, size)
+		}
+		val, err := d.readUint(offset, size)
+		return int64(int32(uint32(val))), offset + size, err
+	case typeUint128:
+		// not used for country lookups, the raw bytes are returned
+		b, err := d.readBytes(offset, size)
+		return b, offset + size, err
+	case typeBool:
+		return size != 0, offset, nil
+	case typeMap:
+		result := make(map[string]any, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decodeValue(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			keyString, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("%w: map keys must be strings", errInvalidDatabase)
+			}
+			value, next, err := d.decodeValue(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			result[keyString] = value
+			offset = next
+		}
+		return result, offset, nil
+	case typeArray:
+		result := make([]any, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := d.decodeValue(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			result = append(result, value)
+			offset = next
+		}
+		return result, offset, nil
+	default:
+		return nil, 0, fmt.Errorf("%w: unsupported data type %d", errInvalidDatabase, dataType)
+	}
+}
+
+func getUintValue(value any) uint {
+	if val, ok := value.(uint64); ok {
+		return uint(val)
+	}
+	return 0
+}
+
+// Load loads the MaxMind DB file at the specified path and uses it for the
+// lookups. An empty path disables the lookups
+func Load(path string) error {
+	if path == "" {
+		current.Store(nil)
+		currentPath.Store(nil)
+		return nil
+	}
+	reader, err := Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to load the geoip database %q: %w", path, err)
+	}
+	current.Store(reader)
+	currentPath.Store(&path)
+	return nil
+}
+
+// Reload loads again the configured MaxMind DB file, if any, for example
+// after updating it using geoipupdate
+func Reload() error {
+	path := currentPath.Load()
+	if path == nil {
+		return nil
+	}
+	return Load(*path)
+}
+
+// IsEnabled returns true if a MaxMind DB file is loaded
+func IsEnabled() bool {
+	return current.Load() != nil
+}
+
+// GetCountry returns the country code for the specified IP address. An empty
+// string is returned if no database is loaded or the country is unknown
+func GetCountry(ip string) string {
+	reader := current.Load()
+	if reader == nil {
+		return ""
+	}
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return ""
+	}
+	code, err := reader.Country(parsedIP)
+	if err != nil {
+		return ""
+	}
+	return code
+}
+
+// IsValidCountryCode returns true if the specified code is an ISO 3166-1
+// alpha-2 country code
+func IsValidCountryCode(code string) bool {
+	if len(code) != 2 {
+		return false
+	}
+	for _, c := range code {
+		if (c < 'A' || c > 'Z') && (c < 'a' || c > 'z') {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseCountryEntry returns the upper case country code and true if the
+// specified allow/deny list entry matches a country
+func ParseCountryEntry(entry string) (string, bool) {
+	if len(entry) < len(CountryPrefix) || !strings.EqualFold(entry[:len(CountryPrefix)], CountryPrefix) {
+		return "", false
+	}
+	return strings.ToUpper(strings.TrimSpace(entry[len(CountryPrefix):])), true
+}
+
+// IsCountryMatched returns true if the country of the specified IP is in the
+// given list of country codes. Hosts whose country is unknown never match
+func IsCountryMatched(ip string, countries []string) bool {
+	if len(countries) == 0 {
+		return false
+	}
+	country := GetCountry(ip)
+	if country == "" {
+		return false
+	}
+	for _, c := range countries {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+	return false
+}
@@ -16,14 +16,17 @@
 package httpclient
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
@@ -72,7 +75,11 @@ type Config struct {
 	// This should be used only for testing.
 	SkipTLSVerify bool `json:"skip_tls_verify" mapstructure:"skip_tls_verify"`
 	// Headers defines a list of http headers to add to each request
-	Headers         []Header `json:"headers" mapstructure:"headers"`
+	Headers []Header `json:"headers" mapstructure:"headers"`
+	// ClientIPHeader defines the HTTP header used to propagate the IP address
+	// of the SFTPGo client to the hooks related to a client connection, for
+	// example "X-Forwarded-For". Empty means disabled
+	ClientIPHeader  string `json:"client_ip_header" mapstructure:"client_ip_header"`
 	customTransport *http.Transport
 }
 
@@ -112,6 +119,13 @@ func (c *Config) Initialize(configDir string) error {
 		}
 	}
 	c.Headers = headers
+	c.ClientIPHeader = strings.TrimSpace(c.ClientIPHeader)
+	if c.ClientIPHeader != "" {
+		if strings.ContainsAny(c.ClientIPHeader, " \t:\r\n") {
+			return fmt.Errorf("invalid client IP header: %q", c.ClientIPHeader)
+		}
+		c.ClientIPHeader = http.CanonicalHeaderKey(c.ClientIPHeader)
+	}
 	httpConfig = *c
 	return nil
 }
@@ -190,6 +204,30 @@ func GetHTTPClient() *http.Client {
 	}
 }
 
+// GetDownloadHTTPClient returns a new HTTP client suitable for long running
+// downloads: the configured timeout applies to the response headers and not
+// to the whole request. If control is not nil, it is called before connecting
+// to each resolved address and the connection is aborted if it returns an error
+func GetDownloadHTTPClient(control func(network, address string, c syscall.RawConn) error) *http.Client {
+	var transport *http.Transport
+	if httpConfig.customTransport != nil {
+		transport = httpConfig.customTransport.Clone()
+	} else {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   control,
+	}
+	transport.DialContext = dialer.DialContext
+	transport.ResponseHeaderTimeout = time.Duration(httpConfig.Timeout * float64(time.Second))
+
+	return &http.Client{
+		Transport: transport,
+	}
+}
+
 // GetRetraybleHTTPClient returns an HTTP client that retry a request on error.
 // It uses the configured retry parameters
 func GetRetraybleHTTPClient() *retryablehttp.Client {
@@ -219,12 +257,21 @@ func Get(url string) (*http.Response, error) {
 
 // Post issues a POST to the specified URL
 func Post(url string, contentType string, body io.Reader) (*http.Response, error) {
+	return PostWithClientIP(context.Background(), url, contentType, body, "")
+}
+
+// PostWithClientIP issues a POST to the specified URL and sends the specified
+// client IP, if not empty, using the configured client IP header.
+// The correlation ID carried by ctx, if any, is sent too
+func PostWithClientIP(ctx context.Context, url string, contentType string, body io.Reader, clientIP string) (*http.Response, error) {
 	req, err := http.NewRequest(http.MethodPost, url, body)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", contentType)
 	addHeaders(req, url)
+	setClientIP(req.Header, clientIP)
+	setCorrelationID(req.Header, logger.GetCorrelationID(ctx))
 	client := GetHTTPClient()
 	defer client.CloseIdleConnections()
 
@@ -244,14 +291,56 @@ func RetryableGet(url string) (*http.Response, error) {
 	return client.Do(req)
 }
 
+// RetryableGetWithCorrelationID issues a GET to the specified URL using the retryable client
+// and sends the specified correlation ID, if not empty
+func RetryableGetWithCorrelationID(url, correlationID string) (*http.Response, error) {
+	req, err := retryablehttp.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	addHeadersToRetryableReq(req, url)
+	setCorrelationID(req.Header, correlationID)
+	client := GetRetraybleHTTPClient()
+	defer client.HTTPClient.CloseIdleConnections()
+
+	return client.Do(req)
+}
+
 // RetryablePost issues a POST to the specified URL using the retryable client
 func RetryablePost(url string, contentType string, body io.Reader) (*http.Response, error) {
+	return RetryablePostWithCorrelationID(url, contentType, body, "")
+}
+
+// RetryablePostWithClientIP issues a POST to the specified URL using the retryable client
+// and sends the specified client IP, if not empty, using the configured client IP header.
+// The correlation ID carried by ctx, if any, is sent too
+func RetryablePostWithClientIP(ctx context.Context, url string, contentType string, body io.Reader,
+	clientIP string,
+) (*http.Response, error) {
 	req, err := retryablehttp.NewRequest(http.MethodPost, url, body)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", contentType)
 	addHeadersToRetryableReq(req, url)
+	setClientIP(req.Header, clientIP)
+	setCorrelationID(req.Header, logger.GetCorrelationID(ctx))
+	client := GetRetraybleHTTPClient()
+	defer client.HTTPClient.CloseIdleConnections()
+
+	return client.Do(req)
+}
+
+// RetryablePostWithCorrelationID issues a POST to the specified URL using the retryable client
+// and sends the specified correlation ID, if not empty
+func RetryablePostWithCorrelationID(url string, contentType string, body io.Reader, correlationID string) (*http.Response, error) {
+	req, err := retryablehttp.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	addHeadersToRetryableReq(req, url)
+	setCorrelationID(req.Header, correlationID)
 	client := GetRetraybleHTTPClient()
 	defer client.HTTPClient.CloseIdleConnections()
 
@@ -275,3 +364,15 @@ func addHeadersToRetryableReq(req *retryablehttp.Request, url string) {
 		}
 	}
 }
+
+func setCorrelationID(header http.Header, correlationID string) {
+	if correlationID != "" {
+		header.Set(logger.CorrelationIDHeader, correlationID)
+	}
+}
+
+func setClientIP(header http.Header, clientIP string) {
+	if httpConfig.ClientIPHeader != "" && clientIP != "" {
+		header.Set(httpConfig.ClientIPHeader, clientIP)
+	}
+}
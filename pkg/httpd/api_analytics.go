@@ -0,0 +1,115 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/render"
+
+	"github.com/drakkan/sftpgo/v2/pkg/common"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	heatmapGroupFile = "file"
+	heatmapGroupDir  = "dir"
+)
+
+func getHeatmapQueryFromRequest(r *http.Request, role string) (common.HeatmapQuery, error) {
+	query := common.HeatmapQuery{
+		Username: r.URL.Query().Get("username"),
+		Role:     role,
+		Order:    r.URL.Query().Get("order"),
+		Limit:    100,
+	}
+	switch group := r.URL.Query().Get("group"); group {
+	case "", heatmapGroupFile:
+	case heatmapGroupDir:
+		query.GroupByDir = true
+	default:
+		return query, util.NewValidationError(fmt.Sprintf("invalid group %q", group))
+	}
+	if _, ok := r.URL.Query()["limit"]; ok {
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil {
+			return query, util.NewValidationError(fmt.Sprintf("invalid limit: %v", err))
+		}
+		if limit < 1 || limit > 1000 {
+			return query, util.NewValidationError(fmt.Sprintf("limit is out of the 1-1000 range: %v", limit))
+		}
+		query.Limit = limit
+	}
+	return query, nil
+}
+
+func getStorageReportRespStatus(err error) int {
+	if errors.Is(err, common.ErrStorageReportInProgress) {
+		return http.StatusConflict
+	}
+	return getRespStatus(err)
+}
+
+func getAccessHeatmap(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	query, err := getHeatmapQueryFromRequest(r, claims.Role)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	heatmap, err := common.GetAccessHeatmap(query)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, heatmap)
+}
+
+func getStorageReport(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	var limit int
+	if _, ok := r.URL.Query()["limit"]; ok {
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil {
+			err = fmt.Errorf("invalid limit: %w", err)
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	user, err := claims.getUserWithGroupSettings(getURLParam(r, "username"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	report, err := common.GetStorageReport(user, limit)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getStorageReportRespStatus(err))
+		return
+	}
+	render.JSON(w, r, report)
+}
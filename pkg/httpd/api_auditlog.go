@@ -0,0 +1,167 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/render"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+func getAuditLogSearchParamsFromRequest(r *http.Request) (dataprovider.AuditLogSearch, error) {
+	s := dataprovider.AuditLogSearch{
+		Limit: 100,
+		Order: dataprovider.OrderDESC,
+	}
+	if _, ok := r.URL.Query()["limit"]; ok {
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil {
+			return s, util.NewValidationError(fmt.Sprintf("invalid limit: %v", err))
+		}
+		if limit < 1 || limit > dataprovider.AuditLogMaxLimit {
+			return s, util.NewValidationError(fmt.Sprintf("limit is out of the 1-%d range: %v",
+				dataprovider.AuditLogMaxLimit, limit))
+		}
+		s.Limit = limit
+	}
+	if _, ok := r.URL.Query()["order"]; ok {
+		order := r.URL.Query().Get("order")
+		if order != dataprovider.OrderASC && order != dataprovider.OrderDESC {
+			return s, util.NewValidationError(fmt.Sprintf("invalid order %q", order))
+		}
+		s.Order = order
+	}
+	if _, ok := r.URL.Query()["start_timestamp"]; ok {
+		ts, err := strconv.ParseInt(r.URL.Query().Get("start_timestamp"), 10, 64)
+		if err != nil {
+			return s, util.NewValidationError(fmt.Sprintf("invalid start_timestamp: %v", err))
+		}
+		s.StartTimestamp = ts
+	}
+	if _, ok := r.URL.Query()["end_timestamp"]; ok {
+		ts, err := strconv.ParseInt(r.URL.Query().Get("end_timestamp"), 10, 64)
+		if err != nil {
+			return s, util.NewValidationError(fmt.Sprintf("invalid end_timestamp: %v", err))
+		}
+		s.EndTimestamp = ts
+	}
+	if _, ok := r.URL.Query()["from_id"]; ok {
+		id, err := strconv.ParseInt(r.URL.Query().Get("from_id"), 10, 64)
+		if err != nil {
+			return s, util.NewValidationError(fmt.Sprintf("invalid from_id: %v", err))
+		}
+		s.FromID = id
+	}
+	s.Executor = r.URL.Query().Get("username")
+	s.IP = r.URL.Query().Get("ip")
+	s.Actions = getCommaSeparatedQueryParam(r, "actions")
+	for _, action := range s.Actions {
+		if !util.Contains(dataprovider.AuditLogActions, action) {
+			return s, util.NewValidationError(fmt.Sprintf("invalid action %q", action))
+		}
+	}
+	s.ObjectTypes = getCommaSeparatedQueryParam(r, "object_types")
+	for _, objectType := range s.ObjectTypes {
+		if !util.Contains(dataprovider.AuditLogObjectTypes, objectType) {
+			return s, util.NewValidationError(fmt.Sprintf("invalid object type %q", objectType))
+		}
+	}
+	s.ObjectName = r.URL.Query().Get("object_name")
+	s.OmitObjectData = getBoolQueryParam(r, "omit_object_data")
+
+	return s, nil
+}
+
+func searchAuditLog(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+
+	filters, err := getAuditLogSearchParamsFromRequest(r)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	filters.Role = getRoleFilterForEventSearch(r, claims.Role)
+
+	if getBoolQueryParam(r, "csv_export") {
+		filters.Limit = 100
+		filters.OmitObjectData = true
+		if err := exportAuditLog(w, &filters); err != nil {
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+
+	entries, err := dataprovider.SearchAuditLog(&filters)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, entries)
+}
+
+func exportAuditLog(w http.ResponseWriter, filters *dataprovider.AuditLogSearch) error {
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=auditlog-%s.csv", time.Now().Format("2006-01-02T15-04-05")))
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Accept-Ranges", "none")
+	w.WriteHeader(http.StatusOK)
+
+	csvWriter := csv.NewWriter(w)
+	err := csvWriter.Write([]string{"ID", "Time", "Action", "Username", "IP", "Role", "Object Type",
+		"Object Name", "Changes"})
+	if err != nil {
+		return err
+	}
+	for {
+		entries, err := dataprovider.SearchAuditLog(filters)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			var changes string
+			if len(entry.Changes) > 0 {
+				data, err := json.Marshal(entry.Changes)
+				if err != nil {
+					return err
+				}
+				changes = string(data)
+			}
+			if err := csvWriter.Write([]string{strconv.FormatInt(entry.ID, 10),
+				util.GetTimeFromMsecSinceEpoch(entry.Timestamp).UTC().Format(time.RFC3339Nano),
+				entry.Action, entry.Executor, entry.IP, entry.Role, entry.ObjectType, entry.ObjectName,
+				changes}); err != nil {
+				return err
+			}
+		}
+		if len(entries) < filters.Limit || len(entries) == 0 {
+			break
+		}
+		filters.FromID = entries[len(entries)-1].ID
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
@@ -0,0 +1,105 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/go-chi/render"
+
+	"github.com/drakkan/sftpgo/v2/pkg/common"
+)
+
+func getDebugCaptures(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+
+	render.JSON(w, r, common.DebugCaptures.GetAll())
+}
+
+func getDebugCapture(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+
+	capture, err := common.DebugCaptures.Get(getURLParam(r, "id"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, capture)
+}
+
+func startDebugCapture(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	var req common.DebugCaptureRequest
+	if err := render.DecodeJSON(r.Body, &req); err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	capture, err := common.DebugCaptures.Start(req, claims.Username)
+	if err != nil {
+		status := getRespStatus(err)
+		if errors.Is(err, common.ErrTooManyDebugCaptures) {
+			status = http.StatusConflict
+		}
+		sendAPIResponse(w, r, err, "", status)
+		return
+	}
+	w.Header().Set("Location", path.Join(debugCapturesPath, capture.ID))
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, capture)
+}
+
+func stopDebugCapture(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+
+	if err := common.DebugCaptures.Stop(getURLParam(r, "id")); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, nil, "Debug capture stopped", http.StatusOK)
+}
+
+func deleteDebugCapture(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+
+	if err := common.DebugCaptures.Delete(getURLParam(r, "id")); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, nil, "Debug capture deleted", http.StatusOK)
+}
+
+func getDebugCaptureBundle(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+
+	id := getURLParam(r, "id")
+	bundle, err := common.DebugCaptures.GetBundle(id)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"sftpgo-debug-capture-%s.zip\"", id))
+	w.Header().Set("Content-Length", strconv.Itoa(len(bundle)))
+	w.Write(bundle) //nolint:errcheck
+}
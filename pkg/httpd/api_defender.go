@@ -56,6 +56,21 @@ func getDefenderHostByID(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, host)
 }
 
+func getDefenderHostStatusByID(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	ip, err := getIPFromID(r)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	status, err := common.GetDefenderHostStatus(ip)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, &status)
+}
+
 func deleteDefenderHostByID(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 	ip, err := getIPFromID(r)
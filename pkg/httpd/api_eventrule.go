@@ -78,6 +78,10 @@ func addEventAction(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
 		return
 	}
+	if claims.Role != "" {
+		sendAPIResponse(w, r, nil, "Role admins cannot manage event actions", http.StatusForbidden)
+		return
+	}
 	var action dataprovider.BaseEventAction
 	err = render.DecodeJSON(r.Body, &action)
 	if err != nil {
@@ -85,7 +89,7 @@ func addEventAction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	ipAddr := util.GetIPFromRemoteAddress(r.RemoteAddr)
-	err = dataprovider.AddEventAction(&action, claims.Username, ipAddr, claims.Role)
+	err = dataprovider.AddEventActionContext(r.Context(), &action, claims.Username, ipAddr, claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -101,6 +105,10 @@ func updateEventAction(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
 		return
 	}
+	if claims.Role != "" {
+		sendAPIResponse(w, r, nil, "Role admins cannot manage event actions", http.StatusForbidden)
+		return
+	}
 
 	name := getURLParam(r, "name")
 	action, err := dataprovider.EventActionExists(name)
@@ -126,7 +134,8 @@ func updateEventAction(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	err = dataprovider.UpdateEventAction(&updatedAction, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
+	err = dataprovider.UpdateEventActionContext(r.Context(), &updatedAction, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -141,8 +150,13 @@ func deleteEventAction(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
 		return
 	}
+	if claims.Role != "" {
+		sendAPIResponse(w, r, nil, "Role admins cannot manage event actions", http.StatusForbidden)
+		return
+	}
 	name := getURLParam(r, "name")
-	err = dataprovider.DeleteEventAction(name, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
+	err = dataprovider.DeleteEventActionContext(r.Context(), name, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -152,12 +166,17 @@ func deleteEventAction(w http.ResponseWriter, r *http.Request) {
 
 func getEventRules(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
 	limit, offset, order, err := getSearchFilters(w, r)
 	if err != nil {
 		return
 	}
 
-	rules, err := dataprovider.GetEventRules(limit, offset, order)
+	rules, err := dataprovider.GetEventRules(limit, offset, order, claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
 		return
@@ -166,7 +185,7 @@ func getEventRules(w http.ResponseWriter, r *http.Request) {
 }
 
 func renderEventRule(w http.ResponseWriter, r *http.Request, name string, claims *jwtTokenClaims, status int) {
-	rule, err := dataprovider.EventRuleExists(name)
+	rule, err := claims.getEventRule(name)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -207,8 +226,11 @@ func addEventRule(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
 		return
 	}
+	if claims.Role != "" {
+		rule.Role = claims.Role
+	}
 	ipAddr := util.GetIPFromRemoteAddress(r.RemoteAddr)
-	if err := dataprovider.AddEventRule(&rule, claims.Username, ipAddr, claims.Role); err != nil {
+	if err := dataprovider.AddEventRuleContext(r.Context(), &rule, claims.Username, ipAddr, claims.Role); err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
 	}
@@ -224,7 +246,7 @@ func updateEventRule(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rule, err := dataprovider.EventRuleExists(getURLParam(r, "name"))
+	rule, err := claims.getEventRule(getURLParam(r, "name"))
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -238,8 +260,12 @@ func updateEventRule(w http.ResponseWriter, r *http.Request) {
 	}
 	updatedRule.ID = rule.ID
 	updatedRule.Name = rule.Name
+	if claims.Role != "" {
+		updatedRule.Role = claims.Role
+	}
 
-	err = dataprovider.UpdateEventRule(&updatedRule, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
+	err = dataprovider.UpdateEventRuleContext(r.Context(), &updatedRule, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -255,7 +281,12 @@ func deleteEventRule(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	name := getURLParam(r, "name")
-	err = dataprovider.DeleteEventRule(name, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
+	if _, err := claims.getEventRule(name); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	err = dataprovider.DeleteEventRuleContext(r.Context(), name, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -265,9 +296,18 @@ func deleteEventRule(w http.ResponseWriter, r *http.Request) {
 
 func runOnDemandRule(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
 
 	name := getURLParam(r, "name")
-	if err := common.RunOnDemandRule(name); err != nil {
+	if _, err := claims.getEventRule(name); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	if err := common.RunOnDemandRule(r.Context(), name); err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
 	}
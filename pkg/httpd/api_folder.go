@@ -29,12 +29,17 @@ import (
 
 func getFolders(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
 	limit, offset, order, err := getSearchFilters(w, r)
 	if err != nil {
 		return
 	}
 
-	folders, err := dataprovider.GetFolders(limit, offset, order, false)
+	folders, err := dataprovider.GetFolders(limit, offset, order, false, claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
 		return
@@ -57,7 +62,11 @@ func addFolder(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
 		return
 	}
-	if err := dataprovider.AddFolder(&folder, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role); err != nil {
+	if claims.Role != "" {
+		folder.Role = claims.Role
+	}
+	if err := dataprovider.AddFolderContext(r.Context(), &folder, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role); err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
 	}
@@ -65,6 +74,28 @@ func addFolder(w http.ResponseWriter, r *http.Request) {
 	renderFolder(w, r, folder.Name, &claims, http.StatusCreated)
 }
 
+func bulkUpdateFolders(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	var req dataprovider.FolderBulkRequest
+	err = render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	report, err := dataprovider.BulkUpdateFolders(&req, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, report)
+}
+
 func updateFolder(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 	claims, err := getTokenClaims(r)
@@ -74,7 +105,7 @@ func updateFolder(w http.ResponseWriter, r *http.Request) {
 	}
 
 	name := getURLParam(r, "name")
-	folder, err := dataprovider.GetFolderByName(name)
+	folder, err := claims.getFolder(name)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -88,13 +119,33 @@ func updateFolder(w http.ResponseWriter, r *http.Request) {
 	}
 	updatedFolder.ID = folder.ID
 	updatedFolder.Name = folder.Name
+	if claims.Role != "" {
+		updatedFolder.Role = claims.Role
+	}
 	updatedFolder.FsConfig.SetEmptySecretsIfNil()
 	updateEncryptedSecrets(&updatedFolder.FsConfig, folder.FsConfig.S3Config.AccessSecret, folder.FsConfig.AzBlobConfig.AccountKey,
 		folder.FsConfig.AzBlobConfig.SASURL, folder.FsConfig.GCSConfig.Credentials, folder.FsConfig.CryptConfig.Passphrase,
 		folder.FsConfig.SFTPConfig.Password, folder.FsConfig.SFTPConfig.PrivateKey, folder.FsConfig.SFTPConfig.KeyPassphrase,
-		folder.FsConfig.HTTPConfig.Password, folder.FsConfig.HTTPConfig.APIKey)
+		folder.FsConfig.HTTPConfig.Password, folder.FsConfig.HTTPConfig.APIKey, folder.FsConfig.WebDAVConfig.Password,
+		folder.FsConfig.WebDAVConfig.ClientKey)
+	updatePGPEncryptedSecrets(&updatedFolder.FsConfig, folder.FsConfig.PGPConfig)
+	updateCryptFsEncryptedSecrets(&updatedFolder.FsConfig, folder.FsConfig.CryptConfig)
+	if updatedFolder.Failover != nil {
+		updatedFolder.Failover.FsConfig.SetEmptySecretsIfNil()
+		if folder.Failover != nil {
+			current := &folder.Failover.FsConfig
+			current.SetEmptySecretsIfNil()
+			updateEncryptedSecrets(&updatedFolder.Failover.FsConfig, current.S3Config.AccessSecret, current.AzBlobConfig.AccountKey,
+				current.AzBlobConfig.SASURL, current.GCSConfig.Credentials, current.CryptConfig.Passphrase,
+				current.SFTPConfig.Password, current.SFTPConfig.PrivateKey, current.SFTPConfig.KeyPassphrase,
+				current.HTTPConfig.Password, current.HTTPConfig.APIKey, current.WebDAVConfig.Password,
+				current.WebDAVConfig.ClientKey)
+			updatePGPEncryptedSecrets(&updatedFolder.Failover.FsConfig, current.PGPConfig)
+			updateCryptFsEncryptedSecrets(&updatedFolder.Failover.FsConfig, current.CryptConfig)
+		}
+	}
 
-	err = dataprovider.UpdateFolder(&updatedFolder, folder.Users, folder.Groups, claims.Username,
+	err = dataprovider.UpdateFolderContext(r.Context(), &updatedFolder, folder.Users, folder.Groups, claims.Username,
 		util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
@@ -104,7 +155,7 @@ func updateFolder(w http.ResponseWriter, r *http.Request) {
 }
 
 func renderFolder(w http.ResponseWriter, r *http.Request, name string, claims *jwtTokenClaims, status int) {
-	folder, err := dataprovider.GetFolderByName(name)
+	folder, err := claims.getFolder(name)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -139,10 +190,65 @@ func deleteFolder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	name := getURLParam(r, "name")
-	err = dataprovider.DeleteFolder(name, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
+	if _, err := claims.getFolder(name); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	err = dataprovider.DeleteFolderContext(r.Context(), name, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
 	}
 	sendAPIResponse(w, r, err, "Folder deleted", http.StatusOK)
 }
+
+func getFolderFailoverStatus(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	name := getURLParam(r, "name")
+	folder, err := claims.getFolder(name)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	if !folder.HasFailover() {
+		sendAPIResponse(w, r, nil, "No secondary storage backend configured for this folder", http.StatusNotFound)
+		return
+	}
+	render.JSON(w, r, vfs.GetFolderFailoverStatus(folder.Name))
+}
+
+func reconcileFolderFailover(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	name := getURLParam(r, "name")
+	folder, err := claims.getFolder(name)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	if !folder.HasFailover() {
+		sendAPIResponse(w, r, nil, "No secondary storage backend configured for this folder", http.StatusNotFound)
+		return
+	}
+	folder.FsConfig.SetEmptySecretsIfNil()
+	folder.Failover.FsConfig.SetEmptySecretsIfNil()
+	vfolder := vfs.VirtualFolder{
+		BaseVirtualFolder: folder,
+		VirtualPath:       "/",
+	}
+	if _, err := vfolder.ReconcileFailover(); err != nil {
+		sendAPIResponse(w, r, err, "Unable to reconcile the journaled operations", http.StatusInternalServerError)
+		return
+	}
+	render.JSON(w, r, vfs.GetFolderFailoverStatus(folder.Name))
+}
@@ -28,12 +28,17 @@ import (
 
 func getGroups(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
 	limit, offset, order, err := getSearchFilters(w, r)
 	if err != nil {
 		return
 	}
 
-	groups, err := dataprovider.GetGroups(limit, offset, order, false)
+	groups, err := dataprovider.GetGroups(limit, offset, order, false, claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
 		return
@@ -55,7 +60,11 @@ func addGroup(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
 		return
 	}
-	err = dataprovider.AddGroup(&group, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
+	if claims.Role != "" {
+		group.Role = claims.Role
+	}
+	err = dataprovider.AddGroupContext(r.Context(), &group, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -73,7 +82,7 @@ func updateGroup(w http.ResponseWriter, r *http.Request) {
 	}
 
 	name := getURLParam(r, "name")
-	group, err := dataprovider.GroupExists(name)
+	group, err := claims.getGroup(name)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -89,6 +98,10 @@ func updateGroup(w http.ResponseWriter, r *http.Request) {
 	currentSFTPKeyPassphrase := group.UserSettings.FsConfig.SFTPConfig.KeyPassphrase
 	currentHTTPPassword := group.UserSettings.FsConfig.HTTPConfig.Password
 	currentHTTPAPIKey := group.UserSettings.FsConfig.HTTPConfig.APIKey
+	currentWebDAVPassword := group.UserSettings.FsConfig.WebDAVConfig.Password
+	currentWebDAVClientKey := group.UserSettings.FsConfig.WebDAVConfig.ClientKey
+	currentPGPConfig := group.UserSettings.FsConfig.PGPConfig
+	currentCryptConfig := group.UserSettings.FsConfig.CryptConfig
 
 	var updatedGroup dataprovider.Group
 	err = render.DecodeJSON(r.Body, &updatedGroup)
@@ -98,11 +111,16 @@ func updateGroup(w http.ResponseWriter, r *http.Request) {
 	}
 	updatedGroup.ID = group.ID
 	updatedGroup.Name = group.Name
+	if claims.Role != "" {
+		updatedGroup.Role = claims.Role
+	}
 	updatedGroup.UserSettings.FsConfig.SetEmptySecretsIfNil()
 	updateEncryptedSecrets(&updatedGroup.UserSettings.FsConfig, currentS3AccessSecret, currentAzAccountKey, currentAzSASUrl,
 		currentGCSCredentials, currentCryptoPassphrase, currentSFTPPassword, currentSFTPKey, currentSFTPKeyPassphrase,
-		currentHTTPPassword, currentHTTPAPIKey)
-	err = dataprovider.UpdateGroup(&updatedGroup, group.Users, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		currentHTTPPassword, currentHTTPAPIKey, currentWebDAVPassword, currentWebDAVClientKey)
+	updatePGPEncryptedSecrets(&updatedGroup.UserSettings.FsConfig, currentPGPConfig)
+	updateCryptFsEncryptedSecrets(&updatedGroup.UserSettings.FsConfig, currentCryptConfig)
+	err = dataprovider.UpdateGroupContext(r.Context(), &updatedGroup, group.Users, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
 		claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
@@ -112,7 +130,7 @@ func updateGroup(w http.ResponseWriter, r *http.Request) {
 }
 
 func renderGroup(w http.ResponseWriter, r *http.Request, name string, claims *jwtTokenClaims, status int) {
-	group, err := dataprovider.GroupExists(name)
+	group, err := claims.getGroup(name)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -147,7 +165,12 @@ func deleteGroup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	name := getURLParam(r, "name")
-	err = dataprovider.DeleteGroup(name, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
+	if _, err := claims.getGroup(name); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	err = dataprovider.DeleteGroupContext(r.Context(), name, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
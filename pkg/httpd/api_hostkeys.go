@@ -0,0 +1,281 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/kms"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/sftpd"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// sshHostKeyRequest defines the request to generate or import an SSH host key
+type sshHostKeyRequest struct {
+	// Type of the key to generate: rsa, ecdsa or ed25519. Ignored if a
+	// private key is provided
+	Type        string `json:"type,omitempty"`
+	PrivateKey  string `json:"private_key,omitempty"`
+	Certificate string `json:"certificate,omitempty"`
+	ActivateAt  int64  `json:"activate_at,omitempty"`
+	RetireAt    int64  `json:"retire_at,omitempty"`
+}
+
+// sshHostKeyRotateRequest defines the request to rotate an SSH host key
+type sshHostKeyRotateRequest struct {
+	// Number of hours both keys are advertised. The current key is used for
+	// the SSH handshake until the end of the overlap period
+	Overlap int `json:"overlap"`
+}
+
+type sshHostKeyResponse struct {
+	dataprovider.SSHHostKey
+	Type        string `json:"type"`
+	Fingerprint string `json:"fingerprint"`
+	Status      string `json:"status"`
+}
+
+func getSSHHostKeyResponse(key dataprovider.SSHHostKey) sshHostKeyResponse {
+	key.PrivateKey = nil
+	return sshHostKeyResponse{
+		SSHHostKey:  key,
+		Type:        key.GetKeyType(),
+		Fingerprint: key.GetFingerprint(),
+		Status:      key.GetStatus(time.Now()),
+	}
+}
+
+func getSSHHostKeysConfigs() (dataprovider.Configs, error) {
+	configs, err := dataprovider.GetConfigs()
+	if err != nil {
+		return configs, err
+	}
+	configs.SetNilsToEmpty()
+	return configs, nil
+}
+
+func findSSHHostKey(configs *dataprovider.Configs, id string) (int, error) {
+	for idx := range configs.SFTPD.HostKeys {
+		if configs.SFTPD.HostKeys[idx].ID == id {
+			return idx, nil
+		}
+	}
+	return -1, util.NewRecordNotFoundError(fmt.Sprintf("host key %q does not exist", id))
+}
+
+func saveSSHHostKeys(configs *dataprovider.Configs, r *http.Request) error {
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		return util.NewValidationError("invalid token claims")
+	}
+	err = dataprovider.UpdateConfigsContext(r.Context(), configs, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role)
+	if err != nil {
+		return err
+	}
+	if err := sftpd.ReloadHostKeys(); err != nil {
+		logger.Warn(logSender, "", "unable to reload the SSH host keys: %v", err)
+	}
+	return nil
+}
+
+func newSSHHostKey(req sshHostKeyRequest) (dataprovider.SSHHostKey, error) {
+	privateKey := req.PrivateKey
+	if privateKey == "" {
+		keyBytes, err := util.GeneratePrivateKey(req.Type)
+		if err != nil {
+			return dataprovider.SSHHostKey{}, util.NewValidationError(err.Error())
+		}
+		privateKey = string(keyBytes)
+	}
+	return dataprovider.SSHHostKey{
+		ID:          xid.New().String(),
+		PrivateKey:  kms.NewPlainSecret(privateKey),
+		Certificate: req.Certificate,
+		ActivateAt:  req.ActivateAt,
+		RetireAt:    req.RetireAt,
+		CreatedAt:   util.GetTimeAsMsSinceEpoch(time.Now()),
+	}, nil
+}
+
+func getSSHHostKeys(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+
+	configs, err := getSSHHostKeysConfigs()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	keys := make([]sshHostKeyResponse, 0, len(configs.SFTPD.HostKeys))
+	for _, k := range configs.SFTPD.HostKeys {
+		keys = append(keys, getSSHHostKeyResponse(k))
+	}
+	render.JSON(w, r, keys)
+}
+
+func getSSHHostKeyByID(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+
+	configs, err := getSSHHostKeysConfigs()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	idx, err := findSSHHostKey(&configs, getURLParam(r, "id"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, getSSHHostKeyResponse(configs.SFTPD.HostKeys[idx]))
+}
+
+func addSSHHostKey(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+
+	var req sshHostKeyRequest
+	if err := render.DecodeJSON(r.Body, &req); err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	key, err := newSSHHostKey(req)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	configs, err := getSSHHostKeysConfigs()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	configs.SFTPD.HostKeys = append(configs.SFTPD.HostKeys, key)
+	if err := saveSSHHostKeys(&configs, r); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	w.Header().Set("Location", path.Join(hostKeysPath, key.ID))
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, getSSHHostKeyResponse(configs.SFTPD.HostKeys[len(configs.SFTPD.HostKeys)-1]))
+}
+
+func updateSSHHostKey(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+
+	var req sshHostKeyRequest
+	if err := render.DecodeJSON(r.Body, &req); err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	configs, err := getSSHHostKeysConfigs()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	idx, err := findSSHHostKey(&configs, getURLParam(r, "id"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	// the private key cannot be changed, import a new key instead
+	key := &configs.SFTPD.HostKeys[idx]
+	key.Certificate = req.Certificate
+	key.ActivateAt = req.ActivateAt
+	key.RetireAt = req.RetireAt
+	if err := saveSSHHostKeys(&configs, r); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, nil, "Host key updated", http.StatusOK)
+}
+
+func rotateSSHHostKey(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+
+	var req sshHostKeyRotateRequest
+	if err := render.DecodeJSON(r.Body, &req); err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	if req.Overlap < 0 {
+		sendAPIResponse(w, r, nil, "the overlap period cannot be negative", http.StatusBadRequest)
+		return
+	}
+	configs, err := getSSHHostKeysConfigs()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	idx, err := findSSHHostKey(&configs, getURLParam(r, "id"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	current := &configs.SFTPD.HostKeys[idx]
+	if status := current.GetStatus(time.Now()); status != dataprovider.SSHHostKeyStatusActive {
+		sendAPIResponse(w, r, nil, fmt.Sprintf("cannot rotate a %s key", status), http.StatusBadRequest)
+		return
+	}
+	keyType, err := current.GetRotationKeyType()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	switchAt := util.GetTimeAsMsSinceEpoch(time.Now().Add(time.Duration(req.Overlap) * time.Hour))
+	key, err := newSSHHostKey(sshHostKeyRequest{
+		Type:       keyType,
+		ActivateAt: switchAt,
+	})
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	current.RetireAt = switchAt
+	configs.SFTPD.HostKeys = append(configs.SFTPD.HostKeys, key)
+	if err := saveSSHHostKeys(&configs, r); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	w.Header().Set("Location", path.Join(hostKeysPath, key.ID))
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, getSSHHostKeyResponse(configs.SFTPD.HostKeys[len(configs.SFTPD.HostKeys)-1]))
+}
+
+func deleteSSHHostKey(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+
+	configs, err := getSSHHostKeysConfigs()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	idx, err := findSSHHostKey(&configs, getURLParam(r, "id"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	configs.SFTPD.HostKeys = append(configs.SFTPD.HostKeys[:idx], configs.SFTPD.HostKeys[idx+1:]...)
+	if err := saveSSHHostKeys(&configs, r); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, nil, "Host key deleted", http.StatusOK)
+}
@@ -16,18 +16,20 @@ package httpd
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"strconv"
 	"strings"
 
 	"github.com/go-chi/render"
-	"github.com/rs/xid"
 
 	"github.com/drakkan/sftpgo/v2/pkg/common"
 	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
@@ -46,7 +48,7 @@ func getUserConnection(w http.ResponseWriter, r *http.Request) (*Connection, err
 		sendAPIResponse(w, r, nil, "Unable to retrieve your user", getRespStatus(err))
 		return nil, err
 	}
-	connID := xid.New().String()
+	connID := getRequestID(r)
 	protocol := getProtocolFromRequest(r)
 	connectionID := fmt.Sprintf("%v_%v", protocol, connID)
 	if err := checkHTTPClientUser(&user, r, connectionID, false); err != nil {
@@ -74,14 +76,101 @@ func readUserFolder(w http.ResponseWriter, r *http.Request) {
 	defer common.Connections.Remove(connection.GetID())
 
 	name := connection.User.GetCleanedPath(r.URL.Query().Get("path"))
-	contents, err := connection.ReadDir(name)
+	limit, offset, err := getDirListPagination(r, name)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	lister, err := connection.GetDirLister(name)
+	if err != nil {
+		sendAPIResponse(w, r, err, "Unable to get directory contents", getMappedStatusCode(err))
+		return
+	}
+	defer lister.Close()
+
+	if limit == 0 {
+		renderAPIDirLister(w, r, connection, lister)
+		return
+	}
+	contents, hasMore, err := readDirListPage(lister, offset, limit)
 	if err != nil {
 		sendAPIResponse(w, r, err, "Unable to get directory contents", getMappedStatusCode(err))
 		return
 	}
+	if hasMore {
+		w.Header().Set(nextCursorHeader, encodeDirListCursor(name, offset+len(contents)))
+	}
 	renderAPIDirContents(w, r, contents, false)
 }
 
+func getUserSearchQuery(r *http.Request) (common.SearchQuery, error) {
+	query := common.SearchQuery{
+		Text:       strings.TrimSpace(r.URL.Query().Get("q")),
+		Path:       r.URL.Query().Get("path"),
+		Extensions: getCommaSeparatedQueryParam(r, "extensions"),
+	}
+	switch r.URL.Query().Get("type") {
+	case "", "all":
+	case "file":
+		query.Type = common.SearchTypeFiles
+	case "dir":
+		query.Type = common.SearchTypeDirs
+	default:
+		return query, util.NewValidationError("invalid type")
+	}
+	int64Params := map[string]*int64{
+		"min_size":        &query.MinSize,
+		"max_size":        &query.MaxSize,
+		"modified_after":  &query.ModifiedAfter,
+		"modified_before": &query.ModifiedBefore,
+	}
+	for name, val := range int64Params {
+		if _, ok := r.URL.Query()[name]; ok {
+			v, err := strconv.ParseInt(r.URL.Query().Get(name), 10, 64)
+			if err != nil {
+				return query, util.NewValidationError(fmt.Sprintf("invalid %s", name))
+			}
+			*val = v
+		}
+	}
+	return query, nil
+}
+
+func searchUserFiles(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	if !common.IsSearchEnabled() {
+		sendAPIResponse(w, r, nil, "Search is disabled", http.StatusNotFound)
+		return
+	}
+	limit, offset, _, err := getSearchFilters(w, r)
+	if err != nil {
+		return
+	}
+	query, err := getUserSearchQuery(r)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	query.Limit = limit
+	query.Offset = offset
+
+	connection, err := getUserConnection(w, r)
+	if err != nil {
+		return
+	}
+	defer common.Connections.Remove(connection.GetID())
+
+	if query.Path != "" {
+		query.Path = connection.User.GetCleanedPath(query.Path)
+	}
+	results, err := common.SearchFiles(&connection.User, query)
+	if err != nil {
+		sendAPIResponse(w, r, err, "Unable to search files", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, results)
+}
+
 func createUserDir(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 	connection, err := getUserConnection(w, r)
@@ -185,6 +274,481 @@ func copyUserFsEntry(w http.ResponseWriter, r *http.Request) {
 	sendAPIResponse(w, r, nil, fmt.Sprintf("%q copied to %q", source, target), http.StatusOK)
 }
 
+func extractUserArchive(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+
+	connection, err := getUserConnection(w, r)
+	if err != nil {
+		return
+	}
+	defer common.Connections.Remove(connection.GetID())
+
+	source := connection.User.GetCleanedPath(r.URL.Query().Get("path"))
+	target := connection.User.GetCleanedPath(r.URL.Query().Get("target"))
+	err = connection.Extract(source, target)
+	if err != nil {
+		sendAPIResponse(w, r, err, fmt.Sprintf("Unable to extract %q -> %q", source, target),
+			getMappedStatusCode(err))
+		return
+	}
+	sendAPIResponse(w, r, nil, fmt.Sprintf("%q extracted to %q", source, target), http.StatusOK)
+}
+
+type fileOperationRequest struct {
+	Type   string `json:"type"`
+	Path   string `json:"path"`
+	Target string `json:"target"`
+}
+
+func startUserFileOperation(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+
+	var req fileOperationRequest
+	err := render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	connection, err := getUserConnection(w, r)
+	if err != nil {
+		return
+	}
+	defer common.Connections.Remove(connection.GetID())
+
+	source := connection.User.GetCleanedPath(req.Path)
+	target := ""
+	if req.Target != "" {
+		target = connection.User.GetCleanedPath(req.Target)
+	}
+	if req.Type == common.FileOperationCopy {
+		// preserve the same semantic of the synchronous copy
+		if strings.HasSuffix(req.Path, "/") && source != "/" {
+			source += "/"
+		}
+		if strings.HasSuffix(req.Target, "/") && target != "/" {
+			target += "/"
+		}
+	}
+	startFileOperation(w, r, connection, req.Type, source, target)
+}
+
+// startUserCopy starts a server side copy in background, the progress can
+// be polled using the file operations API
+func startUserCopy(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+
+	connection, err := getUserConnection(w, r)
+	if err != nil {
+		return
+	}
+	defer common.Connections.Remove(connection.GetID())
+
+	source := r.URL.Query().Get("path")
+	target := r.URL.Query().Get("target")
+	if source == "" || target == "" {
+		sendAPIResponse(w, r, nil, "Please set the source and target paths", http.StatusBadRequest)
+		return
+	}
+	copyFromSource := strings.HasSuffix(source, "/")
+	copyInTarget := strings.HasSuffix(target, "/")
+	source = connection.User.GetCleanedPath(source)
+	target = connection.User.GetCleanedPath(target)
+	if copyFromSource && source != "/" {
+		source += "/"
+	}
+	if copyInTarget && target != "/" {
+		target += "/"
+	}
+	startFileOperation(w, r, connection, common.FileOperationCopy, source, target)
+}
+
+func startFileOperation(w http.ResponseWriter, r *http.Request, connection *Connection, opType, source, target string) {
+	op, err := common.FileOperations.Start(connection.BaseConnection, opType, source, target)
+	if err != nil {
+		status := getRespStatus(err)
+		if errors.Is(err, common.ErrTooManyFileOperations) {
+			status = http.StatusTooManyRequests
+		}
+		sendAPIResponse(w, r, err, "Unable to start the file operation", status)
+		return
+	}
+	w.Header().Add("Location", fmt.Sprintf("%s/%s", userFileOperationsPath, url.PathEscape(op.ID)))
+	ctx := context.WithValue(r.Context(), render.StatusCtxKey, http.StatusAccepted)
+	render.JSON(w, r.WithContext(ctx), op)
+}
+
+func getUserFileOperations(w http.ResponseWriter, r *http.Request) {
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	render.JSON(w, r, common.FileOperations.GetAll(claims.Username))
+}
+
+func getUserFileOperation(w http.ResponseWriter, r *http.Request) {
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	op, err := common.FileOperations.Get(claims.Username, getURLParam(r, "id"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, op)
+}
+
+type pullJobRequest struct {
+	URL    string `json:"url"`
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+func startUserPullJob(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+
+	var req pullJobRequest
+	err := render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	connection, err := getUserConnection(w, r)
+	if err != nil {
+		return
+	}
+	defer common.Connections.Remove(connection.GetID())
+
+	job, err := common.PullJobs.Start(connection.BaseConnection, req.URL, connection.User.GetCleanedPath(req.Path), req.SHA256)
+	if err != nil {
+		status := getRespStatus(err)
+		if errors.Is(err, common.ErrTooManyPullJobs) {
+			status = http.StatusTooManyRequests
+		}
+		sendAPIResponse(w, r, err, "Unable to start the pull job", status)
+		return
+	}
+	w.Header().Add("Location", fmt.Sprintf("%s/%s", userPullJobsPath, url.PathEscape(job.ID)))
+	ctx := context.WithValue(r.Context(), render.StatusCtxKey, http.StatusAccepted)
+	render.JSON(w, r.WithContext(ctx), job)
+}
+
+func getUserPullJobs(w http.ResponseWriter, r *http.Request) {
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	render.JSON(w, r, common.PullJobs.GetAll(claims.Username))
+}
+
+func getUserPullJob(w http.ResponseWriter, r *http.Request) {
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	job, err := common.PullJobs.Get(claims.Username, getURLParam(r, "id"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, job)
+}
+
+func cancelUserPullJob(w http.ResponseWriter, r *http.Request) {
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	if err := common.PullJobs.Cancel(claims.Username, getURLParam(r, "id")); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, nil, "Pull job canceled", http.StatusOK)
+}
+
+type archiveJobRequest struct {
+	Paths  []string `json:"paths"`
+	Format string   `json:"format"`
+}
+
+func startUserArchiveJob(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+
+	var req archiveJobRequest
+	err := render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	connection, err := getUserConnection(w, r)
+	if err != nil {
+		return
+	}
+	defer common.Connections.Remove(connection.GetID())
+
+	job, err := archiveJobs.start(connection, req.Paths, req.Format)
+	if err != nil {
+		status := getRespStatus(err)
+		if errors.Is(err, errTooManyArchiveJobs) {
+			status = http.StatusTooManyRequests
+		}
+		sendAPIResponse(w, r, err, "Unable to start the archive job", status)
+		return
+	}
+	w.Header().Add("Location", fmt.Sprintf("%s/%s", userArchiveJobsPath, url.PathEscape(job.ID)))
+	ctx := context.WithValue(r.Context(), render.StatusCtxKey, http.StatusAccepted)
+	render.JSON(w, r.WithContext(ctx), job)
+}
+
+func getUserArchiveJobs(w http.ResponseWriter, r *http.Request) {
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	render.JSON(w, r, archiveJobs.getAll(claims.Username))
+}
+
+func getUserArchiveJob(w http.ResponseWriter, r *http.Request) {
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	job, err := archiveJobs.get(claims.Username, getURLParam(r, "id"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, job)
+}
+
+func downloadUserArchive(w http.ResponseWriter, r *http.Request) {
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	job, filePath, err := archiveJobs.getFile(claims.Username, getURLParam(r, "id"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		sendAPIResponse(w, r, err, "Unable to open the archive", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	// ServeContent handles range requests, so interrupted downloads can be resumed
+	w.Header().Set("Content-Type", getArchiveContentType(job.Format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", job.Name))
+	http.ServeContent(w, r, job.Name, util.GetTimeFromMsecSinceEpoch(job.EndTime), f)
+}
+
+func deleteUserArchiveJob(w http.ResponseWriter, r *http.Request) {
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	if err := archiveJobs.remove(claims.Username, getURLParam(r, "id")); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, nil, "Archive job removed", http.StatusOK)
+}
+
+func getThumbnailRespStatus(err error) int {
+	if errors.Is(err, util.ErrValidation) || errors.Is(err, util.ErrMethodDisabled) {
+		return getRespStatus(err)
+	}
+	return getMappedStatusCode(err)
+}
+
+func getUserThumbnail(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	config := thumbnails.getConfig()
+	if !config.Enabled {
+		sendAPIResponse(w, r, errThumbnailsDisabled, "", http.StatusForbidden)
+		return
+	}
+	size, err := config.getSize(r.URL.Query().Get("size"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	connection, err := getUserConnection(w, r)
+	if err != nil {
+		return
+	}
+	defer common.Connections.Remove(connection.GetID())
+
+	name := connection.User.GetCleanedPath(r.URL.Query().Get("path"))
+	info, err := connection.Stat(name, 0)
+	if err != nil {
+		sendAPIResponse(w, r, err, "Unable to stat the requested file", getMappedStatusCode(err))
+		return
+	}
+	if !info.Mode().IsRegular() {
+		sendAPIResponse(w, r, nil, fmt.Sprintf("Please set the path to a valid file, %q is not a regular file", name),
+			http.StatusBadRequest)
+		return
+	}
+	thumbPath, err := thumbnails.getThumbnail(connection, name, info, size)
+	if err != nil {
+		sendAPIResponse(w, r, err, "Unable to get the thumbnail", getThumbnailRespStatus(err))
+		return
+	}
+	f, err := os.Open(thumbPath)
+	if err != nil {
+		sendAPIResponse(w, r, err, "Unable to open the thumbnail", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=60")
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+func getUserMediaStream(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	connection, err := getUserConnection(w, r)
+	if err != nil {
+		return
+	}
+	defer common.Connections.Remove(connection.GetID())
+
+	name := connection.User.GetCleanedPath(r.URL.Query().Get("path"))
+	config := mediaStreamer.getConfig()
+	if config.getPlayerType(name) == "" {
+		sendAPIResponse(w, r, nil, fmt.Sprintf("Unsupported media file %q", name), http.StatusBadRequest)
+		return
+	}
+	info, err := connection.Stat(name, 0)
+	if err != nil {
+		sendAPIResponse(w, r, err, "Unable to stat the requested file", getMappedStatusCode(err))
+		return
+	}
+	if !info.Mode().IsRegular() {
+		sendAPIResponse(w, r, nil, fmt.Sprintf("Please set the path to a valid file, %q is not a regular file", name),
+			http.StatusBadRequest)
+		return
+	}
+	if status, err := streamMedia(w, r, connection, name, info, nil); err != nil {
+		resp := apiResponse{
+			Error:   err.Error(),
+			Message: http.StatusText(status),
+		}
+		ctx := r.Context()
+		if status != 0 {
+			ctx = context.WithValue(ctx, render.StatusCtxKey, status)
+		}
+		render.JSON(w, r.WithContext(ctx), resp)
+	}
+}
+
+// getFileMetadataRespStatus maps both data provider and filesystem errors
+func getFileMetadataRespStatus(err error) int {
+	if errors.Is(err, util.ErrValidation) || errors.Is(err, util.ErrNotFound) {
+		return getRespStatus(err)
+	}
+	return getMappedStatusCode(err)
+}
+
+func getUserFileMetadata(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	connection, err := getUserConnection(w, r)
+	if err != nil {
+		return
+	}
+	defer common.Connections.Remove(connection.GetID())
+
+	name := connection.User.GetCleanedPath(r.URL.Query().Get("path"))
+	metadata, err := connection.GetFileMetadata(name)
+	if err != nil {
+		sendAPIResponse(w, r, err, fmt.Sprintf("Unable to get metadata for %q", name), getFileMetadataRespStatus(err))
+		return
+	}
+	render.JSON(w, r, metadata)
+}
+
+func setUserFileMetadata(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+
+	var metadata dataprovider.FileMetadata
+	err := render.DecodeJSON(r.Body, &metadata)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	connection, err := getUserConnection(w, r)
+	if err != nil {
+		return
+	}
+	defer common.Connections.Remove(connection.GetID())
+
+	metadata.Path = connection.User.GetCleanedPath(r.URL.Query().Get("path"))
+	if err := connection.SetFileMetadata(&metadata); err != nil {
+		sendAPIResponse(w, r, err, fmt.Sprintf("Unable to set metadata for %q", metadata.Path),
+			getFileMetadataRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, nil, "Metadata updated", http.StatusOK)
+}
+
+func deleteUserFileMetadata(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	connection, err := getUserConnection(w, r)
+	if err != nil {
+		return
+	}
+	defer common.Connections.Remove(connection.GetID())
+
+	metadata := dataprovider.FileMetadata{
+		Path: connection.User.GetCleanedPath(r.URL.Query().Get("path")),
+	}
+	if err := connection.SetFileMetadata(&metadata); err != nil {
+		sendAPIResponse(w, r, err, fmt.Sprintf("Unable to delete metadata for %q", metadata.Path),
+			getFileMetadataRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, nil, "Metadata deleted", http.StatusOK)
+}
+
+func searchUserFilesMetadata(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	metadata := make(map[string]string)
+	for _, val := range r.URL.Query()["metadata"] {
+		key, value, _ := strings.Cut(val, ":")
+		if key == "" {
+			sendAPIResponse(w, r, nil, fmt.Sprintf("Invalid metadata filter %q", val), http.StatusBadRequest)
+			return
+		}
+		metadata[key] = value
+	}
+	connection, err := getUserConnection(w, r)
+	if err != nil {
+		return
+	}
+	defer common.Connections.Remove(connection.GetID())
+
+	name := connection.User.GetCleanedPath(r.URL.Query().Get("path"))
+	results, err := connection.SearchFilesMetadata(name, r.URL.Query()["tag"], metadata)
+	if err != nil {
+		sendAPIResponse(w, r, err, "Unable to search metadata", getFileMetadataRespStatus(err))
+		return
+	}
+	render.JSON(w, r, results)
+}
+
 func getUserFile(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 	connection, err := getUserConnection(w, r)
@@ -208,6 +772,15 @@ func getUserFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Query().Get("verify_checksum") == "true" {
+		checksum, err := connection.VerifyFileChecksum(name)
+		if err != nil {
+			sendAPIResponse(w, r, err, "Unable to verify the file checksum", getChecksumRespStatus(err))
+			return
+		}
+		setReprDigestHeader(w, checksum)
+	}
+
 	inline := r.URL.Query().Get("inline") != ""
 	if status, err := downloadFile(w, r, connection, name, info, inline, nil); err != nil {
 		resp := apiResponse{
@@ -222,6 +795,43 @@ func getUserFile(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func getUserFileChecksum(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	connection, err := getUserConnection(w, r)
+	if err != nil {
+		return
+	}
+	defer common.Connections.Remove(connection.GetID())
+
+	name := connection.User.GetCleanedPath(r.URL.Query().Get("path"))
+	checksum, err := connection.GetFileChecksum(name)
+	if err != nil {
+		sendAPIResponse(w, r, err, fmt.Sprintf("Unable to get the checksum for %q", name), getChecksumRespStatus(err))
+		return
+	}
+	render.JSON(w, r, map[string]string{
+		"path":   name,
+		"sha256": checksum,
+	})
+}
+
+func getChecksumRespStatus(err error) int {
+	if errors.Is(err, common.ErrChecksumMismatch) {
+		return http.StatusConflict
+	}
+	return getFileMetadataRespStatus(err)
+}
+
+// setReprDigestHeader sets the representation digest, as defined in RFC 9530,
+// for a SHA-256 checksum in hex format
+func setReprDigestHeader(w http.ResponseWriter, checksum string) {
+	digest, err := hex.DecodeString(checksum)
+	if err != nil {
+		return
+	}
+	w.Header().Set("Repr-Digest", fmt.Sprintf("sha-256=:%s:", base64.StdEncoding.EncodeToString(digest)))
+}
+
 func setFileDirMetadata(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 
@@ -285,12 +895,17 @@ func uploadUserFile(w http.ResponseWriter, r *http.Request) {
 
 func doUploadFile(w http.ResponseWriter, r *http.Request, connection *Connection, filePath string) error {
 	connection.User.CheckFsRoot(connection.ID) //nolint:errcheck
+	reader, err := getClientEncryptedReader(&connection.User, filePath, r.Body)
+	if err != nil {
+		sendAPIResponse(w, r, err, fmt.Sprintf("Unable to write file %q", filePath), getClientEncryptionErrorStatus(err))
+		return err
+	}
 	writer, err := connection.getFileWriter(filePath)
 	if err != nil {
 		sendAPIResponse(w, r, err, fmt.Sprintf("Unable to write file %q", filePath), getMappedStatusCode(err))
 		return err
 	}
-	_, err = io.Copy(writer, r.Body)
+	_, err = io.Copy(writer, reader)
 	if err != nil {
 		writer.Close() //nolint:errcheck
 		sendAPIResponse(w, r, err, fmt.Sprintf("Error saving file %q", filePath), getMappedStatusCode(err))
@@ -306,6 +921,93 @@ func doUploadFile(w http.ResponseWriter, r *http.Request, connection *Connection
 	return nil
 }
 
+func getUserUploadOffset(w http.ResponseWriter, r *http.Request) {
+	if !r.URL.Query().Has("path") {
+		sendAPIResponse(w, r, errors.New("please set a file path"), "", http.StatusBadRequest)
+		return
+	}
+
+	connection, err := getUserConnection(w, r)
+	if err != nil {
+		return
+	}
+	defer common.Connections.Remove(connection.GetID())
+
+	name := connection.User.GetCleanedPath(r.URL.Query().Get("path"))
+	offset, err := connection.getUploadOffset(name)
+	if err != nil {
+		sendAPIResponse(w, r, err, fmt.Sprintf("Unable to get the upload offset for %q", name), getMappedStatusCode(err))
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func resumeUserFileUpload(w http.ResponseWriter, r *http.Request) {
+	if maxUploadFileSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadFileSize)
+	}
+
+	if !r.URL.Query().Has("path") {
+		sendAPIResponse(w, r, errors.New("please set a file path"), "", http.StatusBadRequest)
+		return
+	}
+	cr, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength >= 0 && r.ContentLength != cr.length() {
+		sendAPIResponse(w, r, errors.New("the body size does not match the Content-Range header"), "",
+			http.StatusBadRequest)
+		return
+	}
+
+	connection, err := getUserConnection(w, r)
+	if err != nil {
+		return
+	}
+	defer common.Connections.Remove(connection.GetID())
+
+	filePath := connection.User.GetCleanedPath(r.URL.Query().Get("path"))
+	if cr.start == 0 && getBoolQueryParam(r, "mkdir_parents") {
+		if err = connection.CheckParentDirs(path.Dir(filePath)); err != nil {
+			sendAPIResponse(w, r, err, "Error checking parent directories", getMappedStatusCode(err))
+			return
+		}
+	}
+	connection.User.CheckFsRoot(connection.ID) //nolint:errcheck
+	writer, offset, err := connection.getResumeFileWriter(filePath, cr.start)
+	if err != nil {
+		if errors.Is(err, errUploadOffsetMismatch) {
+			w.Header().Set(uploadOffsetHeader, strconv.FormatInt(offset, 10))
+			sendAPIResponse(w, r, err, "", http.StatusConflict)
+			return
+		}
+		sendAPIResponse(w, r, err, fmt.Sprintf("Unable to write file %q", filePath), getMappedStatusCode(err))
+		return
+	}
+	_, err = io.CopyN(writer, r.Body, cr.length())
+	if err != nil {
+		writer.Close() //nolint:errcheck
+		sendAPIResponse(w, r, err, fmt.Sprintf("Error saving file %q", filePath), getMappedStatusCode(err))
+		return
+	}
+	err = writer.Close()
+	if err != nil {
+		sendAPIResponse(w, r, err, fmt.Sprintf("Error closing file %q", filePath), getMappedStatusCode(err))
+		return
+	}
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(cr.end+1, 10))
+	if cr.isLast() {
+		setModificationTimeFromHeader(r, connection, filePath)
+		sendAPIResponse(w, r, nil, "Upload completed", http.StatusCreated)
+		return
+	}
+	sendAPIResponse(w, r, nil, "Upload chunk saved", http.StatusOK)
+}
+
 func uploadUserFiles(w http.ResponseWriter, r *http.Request) {
 	if maxUploadFileSize > 0 {
 		r.Body = http.MaxBytesReader(w, r.Body, maxUploadFileSize)
@@ -366,12 +1068,17 @@ func doUploadFiles(w http.ResponseWriter, r *http.Request, connection *Connectio
 		defer file.Close()
 
 		filePath := path.Join(parentDir, path.Base(util.CleanPath(f.Filename)))
+		reader, err := getClientEncryptedReader(&connection.User, filePath, file)
+		if err != nil {
+			sendAPIResponse(w, r, err, fmt.Sprintf("Unable to write file %q", f.Filename), getClientEncryptionErrorStatus(err))
+			return uploaded
+		}
 		writer, err := connection.getFileWriter(filePath)
 		if err != nil {
 			sendAPIResponse(w, r, err, fmt.Sprintf("Unable to write file %q", f.Filename), getMappedStatusCode(err))
 			return uploaded
 		}
-		_, err = io.Copy(writer, file)
+		_, err = io.Copy(writer, reader)
 		if err != nil {
 			writer.Close() //nolint:errcheck
 			sendAPIResponse(w, r, err, fmt.Sprintf("Error saving file %q", f.Filename), getMappedStatusCode(err))
@@ -438,6 +1145,11 @@ func getUserFilesAsZipStream(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
 		return
 	}
+	format, err := getArchiveFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
 
 	baseDir := "/"
 	for idx := range filesList {
@@ -447,8 +1159,8 @@ func getUserFilesAsZipStream(w http.ResponseWriter, r *http.Request) {
 	filesList = util.RemoveDuplicates(filesList, false)
 
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"",
-		getCompressedFileName(connection.GetUsername(), filesList)))
-	renderCompressedFiles(w, connection, baseDir, filesList, nil)
+		getCompressedFileName(connection.GetUsername(), filesList, format)))
+	renderCompressedFiles(w, connection, baseDir, filesList, nil, format)
 }
 
 func getUserProfile(w http.ResponseWriter, r *http.Request) {
@@ -469,7 +1181,9 @@ func getUserProfile(w http.ResponseWriter, r *http.Request) {
 			Description:     user.Description,
 			AllowAPIKeyAuth: user.Filters.AllowAPIKeyAuth,
 		},
-		PublicKeys: user.PublicKeys,
+		PublicKeys:           user.PublicKeys,
+		PublicKeysExpiration: user.Filters.PublicKeysExpiration,
+		PublicKeysURL:        getPublicKeysURL(user.Username),
 	}
 	render.JSON(w, r, resp)
 }
@@ -498,6 +1212,7 @@ func updateUserProfile(w http.ResponseWriter, r *http.Request) {
 	}
 	if userMerged.CanManagePublicKeys() {
 		user.PublicKeys = req.PublicKeys
+		user.Filters.PublicKeysExpiration = req.PublicKeysExpiration
 	}
 	if userMerged.CanChangeAPIKeyAuth() {
 		user.Filters.AllowAPIKeyAuth = req.AllowAPIKeyAuth
@@ -506,7 +1221,8 @@ func updateUserProfile(w http.ResponseWriter, r *http.Request) {
 		user.Email = req.Email
 		user.Description = req.Description
 	}
-	if err := dataprovider.UpdateUser(&user, dataprovider.ActionExecutorSelf, util.GetIPFromRemoteAddress(r.RemoteAddr), user.Role); err != nil {
+	if err := dataprovider.UpdateUserContext(r.Context(), &user, dataprovider.ActionExecutorSelf, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		user.Role); err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
 	}
@@ -544,7 +1260,7 @@ func doChangeUserPassword(r *http.Request, currentPassword, newPassword, confirm
 	if err != nil || claims.Username == "" {
 		return errors.New("invalid token claims")
 	}
-	_, err = dataprovider.CheckUserAndPass(claims.Username, currentPassword, util.GetIPFromRemoteAddress(r.RemoteAddr),
+	_, err = dataprovider.CheckUserAndPassContext(r.Context(), claims.Username, currentPassword, util.GetIPFromRemoteAddress(r.RemoteAddr),
 		getProtocolFromRequest(r))
 	if err != nil {
 		return util.NewValidationError("current password does not match")
@@ -556,7 +1272,8 @@ func doChangeUserPassword(r *http.Request, currentPassword, newPassword, confirm
 
 func setModificationTimeFromHeader(r *http.Request, c *Connection, filePath string) {
 	mTimeString := r.Header.Get(mTimeHeader)
-	if mTimeString != "" {
+	// staged uploads are not yet visible at their final path
+	if mTimeString != "" && !c.IsStagedUpload(filePath) {
 		// we don't return an error here if we fail to set the modification time
 		mTime, err := strconv.ParseInt(mTimeString, 10, 64)
 		if err == nil {
@@ -573,3 +1290,71 @@ func setModificationTimeFromHeader(r *http.Request, c *Connection, filePath stri
 		}
 	}
 }
+
+func getUserWebhooks(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	user, err := dataprovider.UserExists(claims.Username, "")
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	user.PrepareForRendering()
+	webhooks := user.Filters.Webhooks
+	if webhooks == nil {
+		webhooks = []dataprovider.UserWebhook{}
+	}
+	render.JSON(w, r, webhooks)
+}
+
+func updateUserWebhooks(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	var webhooks []dataprovider.UserWebhook
+	err = render.DecodeJSON(r.Body, &webhooks)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	user, userMerged, err := dataprovider.GetUserVariants(claims.Username, "")
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	if err := checkUserWebhooksPaths(&userMerged, webhooks); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	currentWebhooks := user.Filters.Webhooks
+	user.Filters.Webhooks = webhooks
+	user.SetWebhookSecretsFrom(currentWebhooks)
+	if err := dataprovider.UpdateUserContext(r.Context(), &user, dataprovider.ActionExecutorSelf, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		user.Role); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, nil, "Webhooks updated", http.StatusOK)
+}
+
+// checkUserWebhooksPaths returns an error if the user cannot list the
+// contents of the folders associated to the given webhooks
+func checkUserWebhooksPaths(user *dataprovider.User, webhooks []dataprovider.UserWebhook) error {
+	for _, webhook := range webhooks {
+		if webhook.Path == "" {
+			continue
+		}
+		if !user.HasPerm(dataprovider.PermListItems, util.CleanPath(webhook.Path)) {
+			return util.NewValidationError(fmt.Sprintf("webhook %q: permission denied for folder %q",
+				webhook.Name, webhook.Path))
+		}
+	}
+	return nil
+}
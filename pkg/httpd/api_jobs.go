@@ -0,0 +1,162 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/render"
+
+	"github.com/drakkan/sftpgo/v2/pkg/common"
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+// getJobPermission returns the admin permission required to manage the jobs
+// with the specified type
+func getJobPermission(jobType string) string {
+	switch jobType {
+	case common.JobTypeUserQuotaScan, common.JobTypeFolderQuotaScan:
+		return dataprovider.PermAdminQuotaScans
+	case common.JobTypeRetentionCheck:
+		return dataprovider.PermAdminRetentionChecks
+	default:
+		return dataprovider.PermAdminChangeUsers
+	}
+}
+
+func getJobs(w http.ResponseWriter, r *http.Request) {
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	jobs, err := common.Jobs.GetAll(claims.Role)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	result := make([]common.Job, 0, len(jobs))
+	for _, job := range jobs {
+		if claims.hasPerm(getJobPermission(job.Type)) {
+			result = append(result, job)
+		}
+	}
+	render.JSON(w, r, result)
+}
+
+// getJobForClaims returns the job with the specified id if the admin can manage it
+func getJobForClaims(claims *jwtTokenClaims, id string) (common.Job, error) {
+	job, err := common.Jobs.Get(id, claims.Role)
+	if err != nil {
+		return job, err
+	}
+	if !claims.hasPerm(getJobPermission(job.Type)) {
+		return common.Job{}, util.NewRecordNotFoundError(fmt.Sprintf("background job %q not found", id))
+	}
+	return job, nil
+}
+
+func getJob(w http.ResponseWriter, r *http.Request) {
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	job, err := getJobForClaims(&claims, getURLParam(r, "id"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, job)
+}
+
+func startJob(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	var req common.JobRequest
+	err = render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	if !claims.hasPerm(getJobPermission(req.Type)) {
+		sendAPIResponse(w, r, nil, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	var job common.Job
+	if req.Type == common.JobTypeFolderQuotaScan || (req.Type == common.JobTypeCryptKeyRotation && req.Folder != "") {
+		var folder vfs.BaseVirtualFolder
+		folder, err = claims.getFolder(req.Folder)
+		if err != nil {
+			sendAPIResponse(w, r, err, "", getRespStatus(err))
+			return
+		}
+		job, err = common.Jobs.StartFolderJob(req, folder, claims.Username)
+	} else {
+		var user dataprovider.User
+		user, err = claims.getUserWithGroupSettings(req.Username)
+		if err != nil {
+			sendAPIResponse(w, r, err, "", getRespStatus(err))
+			return
+		}
+		job, err = common.Jobs.StartUserJob(req, user, claims.Username)
+	}
+	if err != nil {
+		status := getRespStatus(err)
+		if errors.Is(err, common.ErrTooManyJobs) {
+			status = http.StatusTooManyRequests
+		} else if errors.Is(err, common.ErrJobConflict) {
+			status = http.StatusConflict
+		}
+		sendAPIResponse(w, r, err, "Unable to start the background job", status)
+		return
+	}
+	w.Header().Add("Location", fmt.Sprintf("%s/%s", jobsPath, url.PathEscape(job.ID)))
+	ctx := context.WithValue(r.Context(), render.StatusCtxKey, http.StatusAccepted)
+	render.JSON(w, r.WithContext(ctx), job)
+}
+
+func deleteJob(w http.ResponseWriter, r *http.Request) {
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	id := getURLParam(r, "id")
+	if _, err := getJobForClaims(&claims, id); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	job, err := common.Jobs.Cancel(id, claims.Role)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	if job.Status == common.JobStatusRunning {
+		sendAPIResponse(w, r, nil, "Cancel requested", http.StatusAccepted)
+		return
+	}
+	sendAPIResponse(w, r, nil, "Job deleted", http.StatusOK)
+}
@@ -19,6 +19,8 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/go-chi/render"
 
@@ -71,7 +73,8 @@ func addAPIKey(w http.ResponseWriter, r *http.Request) {
 	apiKey.KeyID = ""
 	apiKey.Key = ""
 	apiKey.LastUseAt = 0
-	err = dataprovider.AddAPIKey(&apiKey, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
+	err = dataprovider.AddAPIKeyContext(r.Context(), &apiKey, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -108,7 +111,10 @@ func updateAPIKey(w http.ResponseWriter, r *http.Request) {
 
 	updatedAPIKey.KeyID = keyID
 	updatedAPIKey.Key = apiKey.Key
-	err = dataprovider.UpdateAPIKey(&updatedAPIKey, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
+	updatedAPIKey.Filters.PreviousKey = apiKey.Filters.PreviousKey
+	updatedAPIKey.Filters.PreviousKeyExpiresAt = apiKey.Filters.PreviousKeyExpiresAt
+	err = dataprovider.UpdateAPIKeyContext(r.Context(), &updatedAPIKey, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -116,6 +122,39 @@ func updateAPIKey(w http.ResponseWriter, r *http.Request) {
 	sendAPIResponse(w, r, nil, "API key updated", http.StatusOK)
 }
 
+func rotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	gracePeriod := defaultAPIKeyRotationGracePeriod
+	if _, ok := r.URL.Query()["grace_period"]; ok {
+		minutes, err := strconv.Atoi(r.URL.Query().Get("grace_period"))
+		if err != nil || minutes < 0 || minutes > maxAPIKeyRotationGracePeriod {
+			sendAPIResponse(w, r, err, fmt.Sprintf("Invalid grace period, it must be between 0 and %d minutes",
+				maxAPIKeyRotationGracePeriod), http.StatusBadRequest)
+			return
+		}
+		gracePeriod = minutes
+	}
+
+	apiKey, err := dataprovider.RotateAPIKey(getURLParam(r, "id"), time.Duration(gracePeriod)*time.Minute,
+		claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	response := make(map[string]any)
+	response["message"] = "API key rotated. This is the only time the new API key is visible, please save it."
+	response["key"] = apiKey.DisplayKey()
+	if apiKey.Filters.PreviousKeyExpiresAt > 0 {
+		response["previous_key_expires_at"] = apiKey.Filters.PreviousKeyExpiresAt
+	}
+	render.JSON(w, r, response)
+}
+
 func deleteAPIKey(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 	keyID := getURLParam(r, "id")
@@ -125,7 +164,8 @@ func deleteAPIKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = dataprovider.DeleteAPIKey(keyID, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
+	err = dataprovider.DeleteAPIKeyContext(r.Context(), keyID, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -0,0 +1,209 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/gorilla/websocket"
+
+	"github.com/drakkan/sftpgo/v2/pkg/common"
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+)
+
+const (
+	liveStatsInterval = 2 * time.Second
+	// the client is not expected to send messages other than control frames
+	liveStatsMaxMessageSize = 512
+)
+
+type transferBandwidthLimit struct {
+	// Bandwidth limit as KB/s, 0 means no limit
+	Bandwidth int64 `json:"bandwidth"`
+}
+
+// handleLiveStats sends a snapshot of the active transfers every
+// liveStatsInterval over a WebSocket connection. Only the transfers for
+// the current node are included
+func handleLiveStats(w http.ResponseWriter, r *http.Request) {
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already replied with an HTTP error
+		logger.Debug(logSender, "", "unable to upgrade to WebSocket: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	serveLiveStats(conn, claims.Role)
+}
+
+func serveLiveStats(conn *websocket.Conn, role string) {
+	conn.SetReadLimit(liveStatsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait)) //nolint:errcheck
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	// reading is required to process the pong and close frames
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	statsTicker := time.NewTicker(liveStatsInterval)
+	defer statsTicker.Stop()
+	pingTicker := time.NewTicker(wsPingInterval)
+	defer pingTicker.Stop()
+
+	var previous *common.LiveStats
+	for {
+		if common.CheckClosing() != nil {
+			return
+		}
+		stats := common.Connections.GetLiveStats(role, previous)
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait)) //nolint:errcheck
+		if err := conn.WriteJSON(&stats); err != nil {
+			logger.Debug(logSender, "", "live stats WebSocket ended: %v", err)
+			return
+		}
+		previous = &stats
+
+	waitLoop:
+		for {
+			select {
+			case <-done:
+				return
+			case <-pingTicker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+					return
+				}
+			case <-statsTicker.C:
+				break waitLoop
+			}
+		}
+	}
+}
+
+func getTransferFromRequest(w http.ResponseWriter, r *http.Request) (string, int64, bool) {
+	connectionID := getURLParam(r, "connectionID")
+	if connectionID == "" {
+		sendAPIResponse(w, r, nil, "connectionID is mandatory", http.StatusBadRequest)
+		return "", 0, false
+	}
+	transferID, err := strconv.ParseInt(getURLParam(r, "transferID"), 10, 64)
+	if err != nil {
+		sendAPIResponse(w, r, err, "Invalid transferID", http.StatusBadRequest)
+		return "", 0, false
+	}
+	return connectionID, transferID, true
+}
+
+func handleCloseTransfer(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	connectionID, transferID, ok := getTransferFromRequest(w, r)
+	if !ok {
+		return
+	}
+	node := r.URL.Query().Get("node")
+	if node == "" || node == dataprovider.GetNodeName() {
+		if common.Connections.CloseTransfer(connectionID, transferID, claims.Role) {
+			sendAPIResponse(w, r, nil, "Transfer closed", http.StatusOK)
+		} else {
+			sendAPIResponse(w, r, nil, "Not Found", http.StatusNotFound)
+		}
+		return
+	}
+	n, err := dataprovider.GetNodeByName(node)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to get node with name %q: %v", node, err)
+		status := getRespStatus(err)
+		sendAPIResponse(w, r, nil, http.StatusText(status), status)
+		return
+	}
+	relativeURL := fmt.Sprintf("%s/%s/transfers/%d", activeConnectionsPath, connectionID, transferID)
+	if err := n.SendDeleteRequest(claims.Username, claims.Role, relativeURL); err != nil {
+		logger.Warn(logSender, "", "unable to close transfer id %d, connection id %q from node %q: %v",
+			transferID, connectionID, n.Name, err)
+		sendAPIResponse(w, r, nil, "Not Found", http.StatusNotFound)
+		return
+	}
+	sendAPIResponse(w, r, nil, "Transfer closed", http.StatusOK)
+}
+
+func handleThrottleTransfer(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	connectionID, transferID, ok := getTransferFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var limit transferBandwidthLimit
+	if err := render.DecodeJSON(r.Body, &limit); err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	if limit.Bandwidth < 0 {
+		sendAPIResponse(w, r, nil, "The bandwidth limit cannot be negative", http.StatusBadRequest)
+		return
+	}
+	node := r.URL.Query().Get("node")
+	if node == "" || node == dataprovider.GetNodeName() {
+		if common.Connections.ThrottleTransfer(connectionID, transferID, limit.Bandwidth, claims.Role) {
+			sendAPIResponse(w, r, nil, "Bandwidth limit updated", http.StatusOK)
+		} else {
+			sendAPIResponse(w, r, nil, "Not Found", http.StatusNotFound)
+		}
+		return
+	}
+	n, err := dataprovider.GetNodeByName(node)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to get node with name %q: %v", node, err)
+		status := getRespStatus(err)
+		sendAPIResponse(w, r, nil, http.StatusText(status), status)
+		return
+	}
+	relativeURL := fmt.Sprintf("%s/%s/transfers/%d/bandwidth", activeConnectionsPath, connectionID, transferID)
+	if err := n.SendPutRequest(claims.Username, claims.Role, relativeURL, limit); err != nil {
+		logger.Warn(logSender, "", "unable to throttle transfer id %d, connection id %q from node %q: %v",
+			transferID, connectionID, n.Name, err)
+		sendAPIResponse(w, r, nil, "Not Found", http.StatusNotFound)
+		return
+	}
+	sendAPIResponse(w, r, nil, "Bandwidth limit updated", http.StatusOK)
+}
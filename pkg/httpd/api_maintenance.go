@@ -15,6 +15,7 @@
 package httpd
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -29,6 +30,7 @@ import (
 
 	"github.com/drakkan/sftpgo/v2/pkg/common"
 	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/ftpd"
 	"github.com/drakkan/sftpgo/v2/pkg/logger"
 	"github.com/drakkan/sftpgo/v2/pkg/util"
 	"github.com/drakkan/sftpgo/v2/pkg/vfs"
@@ -48,6 +50,32 @@ func validateBackupFile(outputFile string) (string, error) {
 	return outputFile, nil
 }
 
+func getRuntimeConfig(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	if fnConfigReport == nil {
+		sendAPIResponse(w, r, nil, "The runtime configuration is not available", http.StatusNotFound)
+		return
+	}
+	report, err := fnConfigReport()
+	if err != nil {
+		logger.Warn(logSender, "", "unable to get the runtime configuration: %v", err)
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	render.JSON(w, r, report)
+}
+
+func getFTPDiagnostics(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	render.JSON(w, r, ftpd.GetDiagnostics())
+}
+
+func clearFTPDiagnostics(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	ftpd.ClearDataConnectionErrors()
+	sendAPIResponse(w, r, nil, "FTP data connection errors cleared", http.StatusOK)
+}
+
 func dumpData(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 	var outputFile, outputData, indent string
@@ -134,7 +162,7 @@ func loadDataFromRequest(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
 	}
-	if err := restoreBackup(content, "", scanQuota, mode, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role); err != nil {
+	if err := restoreBackup(r.Context(), content, "", scanQuota, mode, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role); err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
 	}
@@ -174,60 +202,68 @@ func loadData(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
 	}
-	if err := restoreBackup(content, inputFile, scanQuota, mode, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role); err != nil {
+	if err := restoreBackup(r.Context(), content, inputFile, scanQuota, mode, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role); err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
 	}
 	sendAPIResponse(w, r, err, "Data restored", http.StatusOK)
 }
 
-func restoreBackup(content []byte, inputFile string, scanQuota, mode int, executor, ipAddress, role string) error {
+func restoreBackup(ctx context.Context, content []byte, inputFile string, scanQuota, mode int, executor, ipAddress, role string) error {
+	content, err := common.DecodeProviderBackup(content)
+	if err != nil {
+		return util.NewValidationError(fmt.Sprintf("unable to decode backup content: %v", err))
+	}
 	dump, err := dataprovider.ParseDumpData(content)
 	if err != nil {
 		return util.NewValidationError(fmt.Sprintf("unable to parse backup content: %v", err))
 	}
 
-	if err = RestoreConfigs(dump.Configs, mode, executor, ipAddress, role); err != nil {
+	if err = restoreConfigs(ctx, dump.Configs, mode, executor, ipAddress, role); err != nil {
 		return err
 	}
 
-	if err = RestoreIPListEntries(dump.IPLists, inputFile, mode, executor, ipAddress, role); err != nil {
+	if err = restoreIPListEntries(ctx, dump.IPLists, inputFile, mode, executor, ipAddress, role); err != nil {
 		return err
 	}
 
-	if err = RestoreRoles(dump.Roles, inputFile, mode, executor, ipAddress, role); err != nil {
+	if err = restoreRoles(ctx, dump.Roles, inputFile, mode, executor, ipAddress, role); err != nil {
 		return err
 	}
 
-	if err = RestoreFolders(dump.Folders, inputFile, mode, scanQuota, executor, ipAddress, role); err != nil {
+	if err = restoreAdminRoles(ctx, dump.AdminRoles, inputFile, mode, executor, ipAddress, role); err != nil {
 		return err
 	}
 
-	if err = RestoreGroups(dump.Groups, inputFile, mode, executor, ipAddress, role); err != nil {
+	if err = restoreFolders(ctx, dump.Folders, inputFile, mode, scanQuota, executor, ipAddress, role); err != nil {
 		return err
 	}
 
-	if err = RestoreUsers(dump.Users, inputFile, mode, scanQuota, executor, ipAddress, role); err != nil {
+	if err = restoreGroups(ctx, dump.Groups, inputFile, mode, executor, ipAddress, role); err != nil {
 		return err
 	}
 
-	if err = RestoreAdmins(dump.Admins, inputFile, mode, executor, ipAddress, role); err != nil {
+	if err = restoreUsers(ctx, dump.Users, inputFile, mode, scanQuota, executor, ipAddress, role); err != nil {
 		return err
 	}
 
-	if err = RestoreAPIKeys(dump.APIKeys, inputFile, mode, executor, ipAddress, role); err != nil {
+	if err = restoreAdmins(ctx, dump.Admins, inputFile, mode, executor, ipAddress, role); err != nil {
 		return err
 	}
 
-	if err = RestoreShares(dump.Shares, inputFile, mode, executor, ipAddress, role); err != nil {
+	if err = restoreAPIKeys(ctx, dump.APIKeys, inputFile, mode, executor, ipAddress, role); err != nil {
 		return err
 	}
 
-	if err = RestoreEventActions(dump.EventActions, inputFile, mode, executor, ipAddress, role); err != nil {
+	if err = restoreShares(ctx, dump.Shares, inputFile, mode, executor, ipAddress, role); err != nil {
 		return err
 	}
 
-	if err = RestoreEventRules(dump.EventRules, inputFile, mode, executor, ipAddress, role, dump.Version); err != nil {
+	if err = restoreEventActions(ctx, dump.EventActions, inputFile, mode, executor, ipAddress, role); err != nil {
+		return err
+	}
+
+	if err = restoreEventRules(ctx, dump.EventRules, inputFile, mode, executor, ipAddress, role, dump.Version); err != nil {
 		return err
 	}
 	logger.Debug(logSender, "", "backup restored")
@@ -262,6 +298,10 @@ func getLoaddataOptions(r *http.Request) (string, int, int, error) {
 
 // RestoreFolders restores the specified folders
 func RestoreFolders(folders []vfs.BaseVirtualFolder, inputFile string, mode, scanQuota int, executor, ipAddress, role string) error {
+	return restoreFolders(context.Background(), folders, inputFile, mode, scanQuota, executor, ipAddress, role)
+}
+
+func restoreFolders(ctx context.Context, folders []vfs.BaseVirtualFolder, inputFile string, mode, scanQuota int, executor, ipAddress, role string) error {
 	for idx := range folders {
 		folder := folders[idx]
 		f, err := dataprovider.GetFolderByName(folder.Name)
@@ -272,11 +312,11 @@ func RestoreFolders(folders []vfs.BaseVirtualFolder, inputFile string, mode, sca
 			}
 			folder.ID = f.ID
 			folder.Name = f.Name
-			err = dataprovider.UpdateFolder(&folder, f.Users, f.Groups, executor, ipAddress, role)
+			err = dataprovider.UpdateFolderContext(ctx, &folder, f.Users, f.Groups, executor, ipAddress, role)
 			logger.Debug(logSender, "", "restoring existing folder %q, dump file: %q, error: %v", folder.Name, inputFile, err)
 		} else {
 			folder.Users = nil
-			err = dataprovider.AddFolder(&folder, executor, ipAddress, role)
+			err = dataprovider.AddFolderContext(ctx, &folder, executor, ipAddress, role)
 			logger.Debug(logSender, "", "adding new folder %q, dump file: %q, error: %v", folder.Name, inputFile, err)
 		}
 		if err != nil {
@@ -295,6 +335,12 @@ func RestoreFolders(folders []vfs.BaseVirtualFolder, inputFile string, mode, sca
 // RestoreShares restores the specified shares
 func RestoreShares(shares []dataprovider.Share, inputFile string, mode int, executor,
 	ipAddress, role string,
+) error {
+	return restoreShares(context.Background(), shares, inputFile, mode, executor, ipAddress, role)
+}
+
+func restoreShares(ctx context.Context, shares []dataprovider.Share, inputFile string, mode int, executor,
+	ipAddress, role string,
 ) error {
 	for idx := range shares {
 		share := shares[idx]
@@ -306,10 +352,10 @@ func RestoreShares(shares []dataprovider.Share, inputFile string, mode int, exec
 				continue
 			}
 			share.ID = s.ID
-			err = dataprovider.UpdateShare(&share, executor, ipAddress, role)
+			err = dataprovider.UpdateShareContext(ctx, &share, executor, ipAddress, role)
 			logger.Debug(logSender, "", "restoring existing share %q, dump file: %q, error: %v", share.ShareID, inputFile, err)
 		} else {
-			err = dataprovider.AddShare(&share, executor, ipAddress, role)
+			err = dataprovider.AddShareContext(ctx, &share, executor, ipAddress, role)
 			logger.Debug(logSender, "", "adding new share %q, dump file: %q, error: %v", share.ShareID, inputFile, err)
 		}
 		if err != nil {
@@ -321,6 +367,10 @@ func RestoreShares(shares []dataprovider.Share, inputFile string, mode int, exec
 
 // RestoreEventActions restores the specified event actions
 func RestoreEventActions(actions []dataprovider.BaseEventAction, inputFile string, mode int, executor, ipAddress, role string) error {
+	return restoreEventActions(context.Background(), actions, inputFile, mode, executor, ipAddress, role)
+}
+
+func restoreEventActions(ctx context.Context, actions []dataprovider.BaseEventAction, inputFile string, mode int, executor, ipAddress, role string) error {
 	for idx := range actions {
 		action := actions[idx]
 		a, err := dataprovider.EventActionExists(action.Name)
@@ -330,10 +380,10 @@ func RestoreEventActions(actions []dataprovider.BaseEventAction, inputFile strin
 				continue
 			}
 			action.ID = a.ID
-			err = dataprovider.UpdateEventAction(&action, executor, ipAddress, role)
+			err = dataprovider.UpdateEventActionContext(ctx, &action, executor, ipAddress, role)
 			logger.Debug(logSender, "", "restoring event action %q, dump file: %q, error: %v", action.Name, inputFile, err)
 		} else {
-			err = dataprovider.AddEventAction(&action, executor, ipAddress, role)
+			err = dataprovider.AddEventActionContext(ctx, &action, executor, ipAddress, role)
 			logger.Debug(logSender, "", "adding new event action %q, dump file: %q, error: %v", action.Name, inputFile, err)
 		}
 		if err != nil {
@@ -346,6 +396,12 @@ func RestoreEventActions(actions []dataprovider.BaseEventAction, inputFile strin
 // RestoreEventRules restores the specified event rules
 func RestoreEventRules(rules []dataprovider.EventRule, inputFile string, mode int, executor, ipAddress,
 	role string, dumpVersion int,
+) error {
+	return restoreEventRules(context.Background(), rules, inputFile, mode, executor, ipAddress, role, dumpVersion)
+}
+
+func restoreEventRules(ctx context.Context, rules []dataprovider.EventRule, inputFile string, mode int, executor, ipAddress,
+	role string, dumpVersion int,
 ) error {
 	for idx := range rules {
 		rule := rules[idx]
@@ -359,10 +415,10 @@ func RestoreEventRules(rules []dataprovider.EventRule, inputFile string, mode in
 				continue
 			}
 			rule.ID = r.ID
-			err = dataprovider.UpdateEventRule(&rule, executor, ipAddress, role)
+			err = dataprovider.UpdateEventRuleContext(ctx, &rule, executor, ipAddress, role)
 			logger.Debug(logSender, "", "restoring event rule %q, dump file: %q, error: %v", rule.Name, inputFile, err)
 		} else {
-			err = dataprovider.AddEventRule(&rule, executor, ipAddress, role)
+			err = dataprovider.AddEventRuleContext(ctx, &rule, executor, ipAddress, role)
 			logger.Debug(logSender, "", "adding new event rule %q, dump file: %q, error: %v", rule.Name, inputFile, err)
 		}
 		if err != nil {
@@ -374,6 +430,10 @@ func RestoreEventRules(rules []dataprovider.EventRule, inputFile string, mode in
 
 // RestoreAPIKeys restores the specified API keys
 func RestoreAPIKeys(apiKeys []dataprovider.APIKey, inputFile string, mode int, executor, ipAddress, role string) error {
+	return restoreAPIKeys(context.Background(), apiKeys, inputFile, mode, executor, ipAddress, role)
+}
+
+func restoreAPIKeys(ctx context.Context, apiKeys []dataprovider.APIKey, inputFile string, mode int, executor, ipAddress, role string) error {
 	for idx := range apiKeys {
 		apiKey := apiKeys[idx]
 		if apiKey.Key == "" {
@@ -387,10 +447,10 @@ func RestoreAPIKeys(apiKeys []dataprovider.APIKey, inputFile string, mode int, e
 				continue
 			}
 			apiKey.ID = k.ID
-			err = dataprovider.UpdateAPIKey(&apiKey, executor, ipAddress, role)
+			err = dataprovider.UpdateAPIKeyContext(ctx, &apiKey, executor, ipAddress, role)
 			logger.Debug(logSender, "", "restoring existing API key %q, dump file: %q, error: %v", apiKey.KeyID, inputFile, err)
 		} else {
-			err = dataprovider.AddAPIKey(&apiKey, executor, ipAddress, role)
+			err = dataprovider.AddAPIKeyContext(ctx, &apiKey, executor, ipAddress, role)
 			logger.Debug(logSender, "", "adding new API key %q, dump file: %q, error: %v", apiKey.KeyID, inputFile, err)
 		}
 		if err != nil {
@@ -402,6 +462,10 @@ func RestoreAPIKeys(apiKeys []dataprovider.APIKey, inputFile string, mode int, e
 
 // RestoreAdmins restores the specified admins
 func RestoreAdmins(admins []dataprovider.Admin, inputFile string, mode int, executor, ipAddress, role string) error {
+	return restoreAdmins(context.Background(), admins, inputFile, mode, executor, ipAddress, role)
+}
+
+func restoreAdmins(ctx context.Context, admins []dataprovider.Admin, inputFile string, mode int, executor, ipAddress, role string) error {
 	for idx := range admins {
 		admin := admins[idx]
 		a, err := dataprovider.AdminExists(admin.Username)
@@ -412,10 +476,10 @@ func RestoreAdmins(admins []dataprovider.Admin, inputFile string, mode int, exec
 			}
 			admin.ID = a.ID
 			admin.Username = a.Username
-			err = dataprovider.UpdateAdmin(&admin, executor, ipAddress, role)
+			err = dataprovider.UpdateAdminContext(ctx, &admin, executor, ipAddress, role)
 			logger.Debug(logSender, "", "restoring existing admin %q, dump file: %q, error: %v", admin.Username, inputFile, err)
 		} else {
-			err = dataprovider.AddAdmin(&admin, executor, ipAddress, role)
+			err = dataprovider.AddAdminContext(ctx, &admin, executor, ipAddress, role)
 			logger.Debug(logSender, "", "adding new admin %q, dump file: %q, error: %v", admin.Username, inputFile, err)
 		}
 		if err != nil {
@@ -429,6 +493,12 @@ func RestoreAdmins(admins []dataprovider.Admin, inputFile string, mode int, exec
 // RestoreConfigs restores the specified provider configs
 func RestoreConfigs(configs *dataprovider.Configs, mode int, executor, ipAddress,
 	executorRole string,
+) error {
+	return restoreConfigs(context.Background(), configs, mode, executor, ipAddress, executorRole)
+}
+
+func restoreConfigs(ctx context.Context, configs *dataprovider.Configs, mode int, executor, ipAddress,
+	executorRole string,
 ) error {
 	if configs == nil {
 		return nil
@@ -443,12 +513,18 @@ func RestoreConfigs(configs *dataprovider.Configs, mode int, executor, ipAddress
 			return nil
 		}
 	}
-	return dataprovider.UpdateConfigs(configs, executor, ipAddress, executorRole)
+	return dataprovider.UpdateConfigsContext(ctx, configs, executor, ipAddress, executorRole)
 }
 
 // RestoreIPListEntries restores the specified IP list entries
 func RestoreIPListEntries(entries []dataprovider.IPListEntry, inputFile string, mode int, executor, ipAddress,
 	executorRole string,
+) error {
+	return restoreIPListEntries(context.Background(), entries, inputFile, mode, executor, ipAddress, executorRole)
+}
+
+func restoreIPListEntries(ctx context.Context, entries []dataprovider.IPListEntry, inputFile string, mode int, executor, ipAddress,
+	executorRole string,
 ) error {
 	for idx := range entries {
 		entry := entries[idx]
@@ -459,11 +535,11 @@ func RestoreIPListEntries(entries []dataprovider.IPListEntry, inputFile string,
 					e.Type.AsString(), e.IPOrNet)
 				continue
 			}
-			err = dataprovider.UpdateIPListEntry(&entry, executor, ipAddress, executorRole)
+			err = dataprovider.UpdateIPListEntryContext(ctx, &entry, executor, ipAddress, executorRole)
 			logger.Debug(logSender, "", "restoring existing IP list entry: %s-%s, dump file: %q, error: %v",
 				entry.Type.AsString(), entry.IPOrNet, inputFile, err)
 		} else {
-			err = dataprovider.AddIPListEntry(&entry, executor, ipAddress, executorRole)
+			err = dataprovider.AddIPListEntryContext(ctx, &entry, executor, ipAddress, executorRole)
 			logger.Debug(logSender, "", "adding new IP list entry %s-%s, dump file: %q, error: %v",
 				entry.Type.AsString(), entry.IPOrNet, inputFile, err)
 		}
@@ -476,6 +552,10 @@ func RestoreIPListEntries(entries []dataprovider.IPListEntry, inputFile string,
 
 // RestoreRoles restores the specified roles
 func RestoreRoles(roles []dataprovider.Role, inputFile string, mode int, executor, ipAddress, executorRole string) error {
+	return restoreRoles(context.Background(), roles, inputFile, mode, executor, ipAddress, executorRole)
+}
+
+func restoreRoles(ctx context.Context, roles []dataprovider.Role, inputFile string, mode int, executor, ipAddress, executorRole string) error {
 	for idx := range roles {
 		role := roles[idx]
 		r, err := dataprovider.RoleExists(role.Name)
@@ -485,10 +565,10 @@ func RestoreRoles(roles []dataprovider.Role, inputFile string, mode int, executo
 				continue
 			}
 			role.ID = r.ID
-			err = dataprovider.UpdateRole(&role, executor, ipAddress, executorRole)
+			err = dataprovider.UpdateRoleContext(ctx, &role, executor, ipAddress, executorRole)
 			logger.Debug(logSender, "", "restoring existing role: %q, dump file: %q, error: %v", role.Name, inputFile, err)
 		} else {
-			err = dataprovider.AddRole(&role, executor, ipAddress, executorRole)
+			err = dataprovider.AddRoleContext(ctx, &role, executor, ipAddress, executorRole)
 			logger.Debug(logSender, "", "adding new role: %q, dump file: %q, error: %v", role.Name, inputFile, err)
 		}
 		if err != nil {
@@ -498,8 +578,40 @@ func RestoreRoles(roles []dataprovider.Role, inputFile string, mode int, executo
 	return nil
 }
 
+// RestoreAdminRoles restores the specified admin roles
+func RestoreAdminRoles(roles []dataprovider.AdminRole, inputFile string, mode int, executor, ipAddress, executorRole string) error {
+	return restoreAdminRoles(context.Background(), roles, inputFile, mode, executor, ipAddress, executorRole)
+}
+
+func restoreAdminRoles(ctx context.Context, roles []dataprovider.AdminRole, inputFile string, mode int, executor, ipAddress, executorRole string) error {
+	for idx := range roles {
+		role := roles[idx]
+		r, err := dataprovider.AdminRoleExists(role.Name)
+		if err == nil {
+			if mode == 1 {
+				logger.Debug(logSender, "", "loaddata mode 1, existing admin role %q not updated", r.Name)
+				continue
+			}
+			role.ID = r.ID
+			err = dataprovider.UpdateAdminRoleContext(ctx, &role, executor, ipAddress, executorRole)
+			logger.Debug(logSender, "", "restoring existing admin role: %q, dump file: %q, error: %v", role.Name, inputFile, err)
+		} else {
+			err = dataprovider.AddAdminRoleContext(ctx, &role, executor, ipAddress, executorRole)
+			logger.Debug(logSender, "", "adding new admin role: %q, dump file: %q, error: %v", role.Name, inputFile, err)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to restore admin role %q: %w", role.Name, err)
+		}
+	}
+	return nil
+}
+
 // RestoreGroups restores the specified groups
 func RestoreGroups(groups []dataprovider.Group, inputFile string, mode int, executor, ipAddress, role string) error {
+	return restoreGroups(context.Background(), groups, inputFile, mode, executor, ipAddress, role)
+}
+
+func restoreGroups(ctx context.Context, groups []dataprovider.Group, inputFile string, mode int, executor, ipAddress, role string) error {
 	for idx := range groups {
 		group := groups[idx]
 		g, err := dataprovider.GroupExists(group.Name)
@@ -510,10 +622,10 @@ func RestoreGroups(groups []dataprovider.Group, inputFile string, mode int, exec
 			}
 			group.ID = g.ID
 			group.Name = g.Name
-			err = dataprovider.UpdateGroup(&group, g.Users, executor, ipAddress, role)
+			err = dataprovider.UpdateGroupContext(ctx, &group, g.Users, executor, ipAddress, role)
 			logger.Debug(logSender, "", "restoring existing group: %q, dump file: %q, error: %v", group.Name, inputFile, err)
 		} else {
-			err = dataprovider.AddGroup(&group, executor, ipAddress, role)
+			err = dataprovider.AddGroupContext(ctx, &group, executor, ipAddress, role)
 			logger.Debug(logSender, "", "adding new group: %q, dump file: %q, error: %v", group.Name, inputFile, err)
 		}
 		if err != nil {
@@ -525,6 +637,10 @@ func RestoreGroups(groups []dataprovider.Group, inputFile string, mode int, exec
 
 // RestoreUsers restores the specified users
 func RestoreUsers(users []dataprovider.User, inputFile string, mode, scanQuota int, executor, ipAddress, role string) error {
+	return restoreUsers(context.Background(), users, inputFile, mode, scanQuota, executor, ipAddress, role)
+}
+
+func restoreUsers(ctx context.Context, users []dataprovider.User, inputFile string, mode, scanQuota int, executor, ipAddress, role string) error {
 	for idx := range users {
 		user := users[idx]
 		u, err := dataprovider.UserExists(user.Username, "")
@@ -535,13 +651,13 @@ func RestoreUsers(users []dataprovider.User, inputFile string, mode, scanQuota i
 			}
 			user.ID = u.ID
 			user.Username = u.Username
-			err = dataprovider.UpdateUser(&user, executor, ipAddress, role)
+			err = dataprovider.UpdateUserContext(ctx, &user, executor, ipAddress, role)
 			logger.Debug(logSender, "", "restoring existing user: %q, dump file: %q, error: %v", user.Username, inputFile, err)
 			if mode == 2 && err == nil {
 				disconnectUser(user.Username, executor, role)
 			}
 		} else {
-			err = dataprovider.AddUser(&user, executor, ipAddress, role)
+			err = dataprovider.AddUserContext(ctx, &user, executor, ipAddress, role)
 			logger.Debug(logSender, "", "adding new user: %q, dump file: %q, error: %v", user.Username, inputFile, err)
 		}
 		if err != nil {
@@ -43,7 +43,7 @@ func startMetadataCheck(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := dataprovider.GetUserWithGroupSettings(getURLParam(r, "username"), claims.Role)
+	user, err := claims.getUserWithGroupSettings(getURLParam(r, "username"))
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -213,7 +213,8 @@ func generateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		user.Filters.RecoveryCodes = accountRecoveryCodes
-		if err := dataprovider.UpdateUser(&user, dataprovider.ActionExecutorSelf, util.GetIPFromRemoteAddress(r.RemoteAddr), user.Role); err != nil {
+		if err := dataprovider.UpdateUserContext(r.Context(), &user, dataprovider.ActionExecutorSelf, util.GetIPFromRemoteAddress(r.RemoteAddr),
+			user.Role); err != nil {
 			sendAPIResponse(w, r, err, "", getRespStatus(err))
 			return
 		}
@@ -228,7 +229,8 @@ func generateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		admin.Filters.RecoveryCodes = accountRecoveryCodes
-		if err := dataprovider.UpdateAdmin(&admin, dataprovider.ActionExecutorSelf, util.GetIPFromRemoteAddress(r.RemoteAddr), admin.Role); err != nil {
+		if err := dataprovider.UpdateAdminContext(r.Context(), &admin, dataprovider.ActionExecutorSelf, util.GetIPFromRemoteAddress(r.RemoteAddr),
+			admin.Role); err != nil {
 			sendAPIResponse(w, r, err, "", getRespStatus(err))
 			return
 		}
@@ -271,7 +273,8 @@ func saveUserTOTPConfig(username string, r *http.Request, recoveryCodes []datapr
 	} else {
 		user.Filters.RecoveryCodes = nil
 	}
-	return dataprovider.UpdateUser(&user, dataprovider.ActionExecutorSelf, util.GetIPFromRemoteAddress(r.RemoteAddr), user.Role)
+	return dataprovider.UpdateUserContext(r.Context(), &user, dataprovider.ActionExecutorSelf, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		user.Role)
 }
 
 func saveAdminTOTPConfig(username string, r *http.Request, recoveryCodes []dataprovider.RecoveryCode) error {
@@ -295,5 +298,6 @@ func saveAdminTOTPConfig(username string, r *http.Request, recoveryCodes []datap
 	if admin.Filters.TOTPConfig.Secret == nil || !admin.Filters.TOTPConfig.Secret.IsPlain() {
 		admin.Filters.TOTPConfig.Secret = currentTOTPSecret
 	}
-	return dataprovider.UpdateAdmin(&admin, dataprovider.ActionExecutorSelf, util.GetIPFromRemoteAddress(r.RemoteAddr), admin.Role)
+	return dataprovider.UpdateAdminContext(r.Context(), &admin, dataprovider.ActionExecutorSelf, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		admin.Role)
 }
@@ -0,0 +1,92 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const publicKeysCacheMaxAge = 300
+
+var (
+	publicKeysSigningKey = util.GenerateRandomBytes(32)
+)
+
+func getPublicKeysSignature(username string) string {
+	h := hmac.New(sha256.New, publicKeysSigningKey)
+	h.Write([]byte("publickeys:" + username))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// getPublicKeysURL returns the signed URL, relative to the server root,
+// to get the authorized public keys for the specified user
+func getPublicKeysURL(username string) string {
+	return fmt.Sprintf("%s/%s?signature=%s", publicKeysPath, url.PathEscape(username),
+		getPublicKeysSignature(username))
+}
+
+// getAuthorizedPublicKeys returns the not expired public keys for the specified
+// user in authorized_keys format. Disabled and expired users have no authorized keys
+func getAuthorizedPublicKeys(user *dataprovider.User) []byte {
+	var buf bytes.Buffer
+	if user.Status != 1 {
+		return buf.Bytes()
+	}
+	if user.ExpirationDate > 0 && util.GetTimeFromMsecSinceEpoch(user.ExpirationDate).Before(time.Now()) {
+		return buf.Bytes()
+	}
+	for _, k := range user.GetValidPublicKeys() {
+		buf.WriteString(strings.TrimSpace(k))
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
+
+func getUserPublicKeys(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	username := getURLParam(r, "username")
+	signature := r.URL.Query().Get("signature")
+	if !hmac.Equal([]byte(signature), []byte(getPublicKeysSignature(username))) {
+		sendAPIResponse(w, r, nil, "Invalid signature", http.StatusForbidden)
+		return
+	}
+	user, err := dataprovider.UserExists(username, "")
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	keys := getAuthorizedPublicKeys(&user)
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(keys))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", publicKeysCacheMaxAge))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(keys) //nolint:errcheck
+}
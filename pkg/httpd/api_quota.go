@@ -57,6 +57,42 @@ func getFoldersQuotaScans(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, common.QuotaScans.GetVFoldersQuotaScans())
 }
 
+func getScheduledQuotaScans(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	if claims.Role != "" {
+		sendAPIResponse(w, r, nil, "Role admins cannot manage the scheduled quota scans", http.StatusForbidden)
+		return
+	}
+	render.JSON(w, r, common.ScheduledQuotaScans.GetStatus())
+}
+
+func startScheduledQuotaScans(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	if claims.Role != "" {
+		sendAPIResponse(w, r, nil, "Role admins cannot manage the scheduled quota scans", http.StatusForbidden)
+		return
+	}
+	if err := common.ScheduledQuotaScans.Start(); err != nil {
+		if errors.Is(err, common.ErrQuotaScansRunning) {
+			sendAPIResponse(w, r, err, "", http.StatusConflict)
+			return
+		}
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, nil, "Scan started", http.StatusAccepted)
+}
+
 func updateUserQuotaUsage(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 	var usage quotaUsage
@@ -112,7 +148,7 @@ func updateUserTransferQuotaUsage(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
 		return
 	}
-	user, err := dataprovider.GetUserWithGroupSettings(getURLParam(r, "username"), claims.Role)
+	user, err := claims.getUserWithGroupSettings(getURLParam(r, "username"))
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -147,7 +183,7 @@ func doUpdateUserQuotaUsage(w http.ResponseWriter, r *http.Request, username str
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
 		return
 	}
-	user, err := dataprovider.GetUserWithGroupSettings(username, claims.Role)
+	user, err := claims.getUserWithGroupSettings(username)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -176,12 +212,17 @@ func doUpdateFolderQuotaUsage(w http.ResponseWriter, r *http.Request, name strin
 			"", http.StatusBadRequest)
 		return
 	}
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
 	mode, err := getQuotaUpdateMode(r)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
 		return
 	}
-	folder, err := dataprovider.GetFolderByName(name)
+	folder, err := claims.getFolder(name)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -209,7 +250,7 @@ func doStartUserQuotaScan(w http.ResponseWriter, r *http.Request, username strin
 		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
 		return
 	}
-	user, err := dataprovider.GetUserWithGroupSettings(username, claims.Role)
+	user, err := claims.getUserWithGroupSettings(username)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -228,7 +269,12 @@ func doStartFolderQuotaScan(w http.ResponseWriter, r *http.Request, name string)
 		sendAPIResponse(w, r, nil, "Quota tracking is disabled!", http.StatusForbidden)
 		return
 	}
-	folder, err := dataprovider.GetFolderByName(name)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	folder, err := claims.getFolder(name)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -244,7 +290,9 @@ func doStartFolderQuotaScan(w http.ResponseWriter, r *http.Request, name string)
 
 func doUserQuotaScan(user dataprovider.User) error {
 	defer common.QuotaScans.RemoveUserQuotaScan(user.Username)
-	numFiles, size, err := user.ScanQuota()
+	numFiles, size, err := user.ScanQuotaIncremental(nil, func(numFiles int, size int64) {
+		common.QuotaScans.UpdateUserQuotaScanProgress(user.Username, numFiles, size)
+	})
 	if err != nil {
 		logger.Warn(logSender, "", "error scanning user quota %q: %v", user.Username, err)
 		return err
@@ -260,7 +308,9 @@ func doFolderQuotaScan(folder vfs.BaseVirtualFolder) error {
 		BaseVirtualFolder: folder,
 		VirtualPath:       "/",
 	}
-	numFiles, size, err := f.ScanQuota()
+	numFiles, size, err := f.ScanQuotaIncremental(nil, func(numFiles int, size int64) {
+		common.QuotaScans.UpdateVFolderQuotaScanProgress(folder.Name, numFiles, size)
+	})
 	if err != nil {
 		logger.Warn(logSender, "", "error scanning folder %q: %v", folder.Name, err)
 		return err
@@ -15,13 +15,19 @@
 package httpd
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"path"
+	"time"
 
 	"github.com/go-chi/render"
 
 	"github.com/drakkan/sftpgo/v2/pkg/common"
 	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
 )
 
 func getRetentionChecks(w http.ResponseWriter, r *http.Request) {
@@ -42,7 +48,7 @@ func startRetentionCheck(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	username := getURLParam(r, "username")
-	user, err := dataprovider.GetUserWithGroupSettings(username, claims.Role)
+	user, err := claims.getUserWithGroupSettings(username)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -79,3 +85,189 @@ func startRetentionCheck(w http.ResponseWriter, r *http.Request) {
 	go c.Start() //nolint:errcheck
 	sendAPIResponse(w, r, err, "Check started", http.StatusAccepted)
 }
+
+func checkRetentionPoliciesClaims(w http.ResponseWriter, r *http.Request) bool {
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return false
+	}
+	if claims.Role != "" {
+		sendAPIResponse(w, r, nil, "Role admins cannot manage retention policies", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func findRetentionPolicy(configs *dataprovider.Configs, name string) (int, error) {
+	for idx := range configs.RetentionPolicies {
+		if configs.RetentionPolicies[idx].Name == name {
+			return idx, nil
+		}
+	}
+	return -1, util.NewRecordNotFoundError(fmt.Sprintf("retention policy %q does not exist", name))
+}
+
+func saveRetentionPolicies(configs *dataprovider.Configs, r *http.Request) error {
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		return util.NewValidationError("invalid token claims")
+	}
+	return dataprovider.UpdateConfigsContext(r.Context(), configs, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role)
+}
+
+func getRetentionPolicies(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	if !checkRetentionPoliciesClaims(w, r) {
+		return
+	}
+	configs, err := dataprovider.GetConfigs()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	policies := configs.RetentionPolicies
+	if policies == nil {
+		policies = []dataprovider.RetentionPolicy{}
+	}
+	render.JSON(w, r, policies)
+}
+
+func getRetentionPolicyByName(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	if !checkRetentionPoliciesClaims(w, r) {
+		return
+	}
+	configs, err := dataprovider.GetConfigs()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	idx, err := findRetentionPolicy(&configs, getURLParam(r, "name"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, configs.RetentionPolicies[idx])
+}
+
+func addRetentionPolicy(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	if !checkRetentionPoliciesClaims(w, r) {
+		return
+	}
+	var policy dataprovider.RetentionPolicy
+	if err := render.DecodeJSON(r.Body, &policy); err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	configs, err := dataprovider.GetConfigs()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	if _, err := findRetentionPolicy(&configs, policy.Name); err == nil {
+		sendAPIResponse(w, r, nil, fmt.Sprintf("Retention policy %q already exists", policy.Name), http.StatusConflict)
+		return
+	}
+	policy.CreatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+	policy.UpdatedAt = policy.CreatedAt
+	configs.RetentionPolicies = append(configs.RetentionPolicies, policy)
+	if err := saveRetentionPolicies(&configs, r); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	w.Header().Set("Location", path.Join(retentionPoliciesPath, url.PathEscape(policy.Name)))
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, configs.RetentionPolicies[len(configs.RetentionPolicies)-1])
+}
+
+func updateRetentionPolicy(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	if !checkRetentionPoliciesClaims(w, r) {
+		return
+	}
+	var policy dataprovider.RetentionPolicy
+	if err := render.DecodeJSON(r.Body, &policy); err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	configs, err := dataprovider.GetConfigs()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	idx, err := findRetentionPolicy(&configs, getURLParam(r, "name"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	// the name cannot be changed
+	policy.Name = configs.RetentionPolicies[idx].Name
+	policy.CreatedAt = configs.RetentionPolicies[idx].CreatedAt
+	policy.UpdatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+	configs.RetentionPolicies[idx] = policy
+	if err := saveRetentionPolicies(&configs, r); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, nil, "Retention policy updated", http.StatusOK)
+}
+
+func deleteRetentionPolicy(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	if !checkRetentionPoliciesClaims(w, r) {
+		return
+	}
+	configs, err := dataprovider.GetConfigs()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	idx, err := findRetentionPolicy(&configs, getURLParam(r, "name"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	name := configs.RetentionPolicies[idx].Name
+	configs.RetentionPolicies = append(configs.RetentionPolicies[:idx], configs.RetentionPolicies[idx+1:]...)
+	if err := saveRetentionPolicies(&configs, r); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	if err := common.DeleteRetentionPolicyReport(name); err != nil {
+		logger.Warn(logSender, "", "unable to delete the report for retention policy %q: %v", name, err)
+	}
+	sendAPIResponse(w, r, nil, "Retention policy deleted", http.StatusOK)
+}
+
+func runRetentionPolicy(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	if !checkRetentionPoliciesClaims(w, r) {
+		return
+	}
+	err := common.RunRetentionPolicy(getURLParam(r, "name"))
+	if err != nil {
+		status := getRespStatus(err)
+		if errors.Is(err, common.ErrRetentionPolicyRunning) {
+			status = http.StatusConflict
+		}
+		sendAPIResponse(w, r, err, "", status)
+		return
+	}
+	sendAPIResponse(w, r, nil, "Retention policy started", http.StatusAccepted)
+}
+
+func getRetentionPolicyReport(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	if !checkRetentionPoliciesClaims(w, r) {
+		return
+	}
+	report, err := common.GetRetentionPolicyReport(getURLParam(r, "name"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, report)
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/go-chi/render"
 
 	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/kms"
 	"github.com/drakkan/sftpgo/v2/pkg/util"
 )
 
@@ -38,6 +39,9 @@ func getRoles(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
 		return
 	}
+	for idx := range roles {
+		roles[idx].PrepareForRendering()
+	}
 	render.JSON(w, r, roles)
 }
 
@@ -56,7 +60,7 @@ func addRole(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
 		return
 	}
-	err = dataprovider.AddRole(&role, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
+	err = dataprovider.AddRoleContext(r.Context(), &role, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 	} else {
@@ -89,7 +93,9 @@ func updateRole(w http.ResponseWriter, r *http.Request) {
 
 	updatedRole.ID = role.ID
 	updatedRole.Name = role.Name
-	err = dataprovider.UpdateRole(&updatedRole, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
+	updateRoleTenantSecrets(&updatedRole, &role)
+	err = dataprovider.UpdateRoleContext(r.Context(), &updatedRole, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -103,6 +109,7 @@ func renderRole(w http.ResponseWriter, r *http.Request, name string, status int)
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
 	}
+	role.PrepareForRendering()
 	if status != http.StatusOK {
 		ctx := context.WithValue(r.Context(), render.StatusCtxKey, status)
 		render.JSON(w, r.WithContext(ctx), role)
@@ -125,10 +132,39 @@ func deleteRole(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	name := getURLParam(r, "name")
-	err = dataprovider.DeleteRole(name, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
+	err = dataprovider.DeleteRoleContext(r.Context(), name, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
 	}
 	sendAPIResponse(w, r, err, "Role deleted", http.StatusOK)
 }
+
+// updateRoleTenantSecrets preserves the current tenant secrets if the updated role
+// contains redacted or empty secrets
+func updateRoleTenantSecrets(updatedRole, currentRole *dataprovider.Role) {
+	if updatedRole.Tenant == nil || currentRole.Tenant == nil {
+		return
+	}
+	if updatedRole.Tenant.OIDC != nil && currentRole.Tenant.OIDC != nil {
+		secret := updatedRole.Tenant.OIDC.ClientSecret
+		if secret != nil && secret.IsNotPlainAndNotEmpty() {
+			updatedRole.Tenant.OIDC.ClientSecret = currentRole.Tenant.OIDC.ClientSecret
+		}
+	}
+	if updatedRole.Tenant.SMTP != nil && currentRole.Tenant.SMTP != nil {
+		for _, smtpConfigs := range []*dataprovider.SMTPConfigs{updatedRole.Tenant.SMTP, currentRole.Tenant.SMTP} {
+			if smtpConfigs.Password == nil {
+				smtpConfigs.Password = kms.NewEmptySecret()
+			}
+			if smtpConfigs.OAuth2.ClientSecret == nil {
+				smtpConfigs.OAuth2.ClientSecret = kms.NewEmptySecret()
+			}
+			if smtpConfigs.OAuth2.RefreshToken == nil {
+				smtpConfigs.OAuth2.RefreshToken = kms.NewEmptySecret()
+			}
+		}
+		updateSMTPSecrets(updatedRole.Tenant.SMTP, currentRole.Tenant.SMTP)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"net/http"
+
+	"github.com/go-chi/render"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/sftpd"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// sshSecurityProfile defines the SSH security profile stored in the data
+// provider and the profile currently used by the SFTP service
+type sshSecurityProfile struct {
+	// Profile stored in the data provider, it overrides the one defined in
+	// the configuration file after a service restart
+	SecurityProfile string `json:"security_profile"`
+	// Profile in use, empty means the algorithms are explicitly configured
+	// or the defaults are used
+	ActiveProfile     string   `json:"active_profile,omitempty"`
+	SupportedProfiles []string `json:"supported_profiles,omitempty"`
+}
+
+func getSSHSecurityProfile(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+
+	configs, err := getSSHHostKeysConfigs()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, sshSecurityProfile{
+		SecurityProfile:   configs.SFTPD.SecurityProfile,
+		ActiveProfile:     sftpd.GetStatus().SecurityProfile,
+		SupportedProfiles: configs.SFTPD.GetSupportedSecurityProfiles(),
+	})
+}
+
+func updateSSHSecurityProfile(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	var req sshSecurityProfile
+	if err := render.DecodeJSON(r.Body, &req); err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	configs, err := getSSHHostKeysConfigs()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	configs.SFTPD.SecurityProfile = req.SecurityProfile
+	err = dataprovider.UpdateConfigsContext(r.Context(), &configs, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, nil, "Security profile updated, a service restart is required to apply it", http.StatusOK)
+}
@@ -22,12 +22,12 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-chi/jwtauth/v5"
 	"github.com/go-chi/render"
-	"github.com/rs/xid"
 	"github.com/sftpgo/sdk"
 
 	"github.com/drakkan/sftpgo/v2/pkg/common"
@@ -109,7 +109,8 @@ func addShare(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	err = dataprovider.AddShare(&share, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
+	err = dataprovider.AddShareContext(r.Context(), &share, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -152,7 +153,8 @@ func updateShare(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	err = dataprovider.UpdateShare(&updatedShare, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
+	err = dataprovider.UpdateShareContext(r.Context(), &updatedShare, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -169,7 +171,8 @@ func deleteShare(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = dataprovider.DeleteShare(shareID, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
+	err = dataprovider.DeleteShareContext(r.Context(), shareID, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -177,6 +180,53 @@ func deleteShare(w http.ResponseWriter, r *http.Request) {
 	sendAPIResponse(w, r, err, "Share deleted", http.StatusOK)
 }
 
+func getShareStats(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	filters, err := getShareStatsSearchFromRequest(r)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	stats, err := dataprovider.GetShareStats(getURLParam(r, "id"), claims.Username, &filters)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, stats)
+}
+
+func getShareStatsSearchFromRequest(r *http.Request) (dataprovider.ShareStatsSearch, error) {
+	var s dataprovider.ShareStatsSearch
+	if _, ok := r.URL.Query()["from"]; ok {
+		ts, err := strconv.ParseInt(r.URL.Query().Get("from"), 10, 64)
+		if err != nil {
+			return s, util.NewValidationError(fmt.Sprintf("invalid from: %v", err))
+		}
+		s.From = ts
+	}
+	if _, ok := r.URL.Query()["to"]; ok {
+		ts, err := strconv.ParseInt(r.URL.Query().Get("to"), 10, 64)
+		if err != nil {
+			return s, util.NewValidationError(fmt.Sprintf("invalid to: %v", err))
+		}
+		s.To = ts
+	}
+	if _, ok := r.URL.Query()["top_files"]; ok {
+		topFiles, err := strconv.Atoi(r.URL.Query().Get("top_files"))
+		if err != nil {
+			return s, util.NewValidationError(fmt.Sprintf("invalid top_files: %v", err))
+		}
+		s.TopFiles = topFiles
+	}
+	s.Granularity = r.URL.Query().Get("granularity")
+	return s, nil
+}
+
 func (s *httpdServer) readBrowsableShareContents(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 	validScopes := []dataprovider.ShareScope{dataprovider.ShareScopeRead, dataprovider.ShareScopeReadWrite}
@@ -243,9 +293,69 @@ func (s *httpdServer) downloadBrowsableSharedFile(w http.ResponseWriter, r *http
 	}
 
 	inline := r.URL.Query().Get("inline") != ""
-	dataprovider.UpdateShareLastUse(&share, 1) //nolint:errcheck
+	updateShareUsage(&share, connection.GetRemoteIP(), 1)
 	if status, err := downloadFile(w, r, connection, name, info, inline, &share); err != nil {
-		dataprovider.UpdateShareLastUse(&share, -1) //nolint:errcheck
+		updateShareUsage(&share, connection.GetRemoteIP(), -1)
+		resp := apiResponse{
+			Error:   err.Error(),
+			Message: http.StatusText(status),
+		}
+		ctx := r.Context()
+		if status != 0 {
+			ctx = context.WithValue(ctx, render.StatusCtxKey, status)
+		}
+		render.JSON(w, r.WithContext(ctx), resp)
+	}
+}
+
+func (s *httpdServer) streamBrowsableSharedFile(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	validScopes := []dataprovider.ShareScope{dataprovider.ShareScopeRead, dataprovider.ShareScopeReadWrite}
+	share, connection, err := s.checkPublicShare(w, r, validScopes)
+	if err != nil {
+		return
+	}
+	if err := validateBrowsableShare(share, connection); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	name, err := getBrowsableSharedPath(share, r)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	config := mediaStreamer.getConfig()
+	if config.getPlayerType(name) == "" {
+		sendAPIResponse(w, r, nil, "Unsupported media file", http.StatusBadRequest)
+		return
+	}
+
+	if err = common.Connections.Add(connection); err != nil {
+		sendAPIResponse(w, r, err, "Unable to add connection", http.StatusTooManyRequests)
+		return
+	}
+	defer common.Connections.Remove(connection.GetID())
+
+	info, err := connection.Stat(name, 1)
+	if err != nil {
+		sendAPIResponse(w, r, err, "Unable to stat the requested file", getMappedStatusCode(err))
+		return
+	}
+	if !info.Mode().IsRegular() {
+		sendAPIResponse(w, r, nil, "Please set the path to a valid file", http.StatusBadRequest)
+		return
+	}
+	// players send several range requests for a single playback, the share
+	// usage is updated only for the first one
+	var usageShare *dataprovider.Share
+	if isFirstMediaRequest(r) {
+		usageShare = &share
+		updateShareUsage(usageShare, connection.GetRemoteIP(), 1)
+	}
+	if status, err := streamMedia(w, r, connection, name, info, usageShare); err != nil {
+		if usageShare != nil {
+			updateShareUsage(usageShare, connection.GetRemoteIP(), -1)
+		}
 		resp := apiResponse{
 			Error:   err.Error(),
 			Message: http.StatusText(status),
@@ -285,14 +395,19 @@ func (s *httpdServer) downloadFromShare(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	dataprovider.UpdateShareLastUse(&share, 1) //nolint:errcheck
+	format, err := getArchiveFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	updateShareUsage(&share, connection.GetRemoteIP(), 1)
 	if compress {
 		transferQuota := connection.GetTransferQuota()
 		if !transferQuota.HasDownloadSpace() {
 			err = connection.GetReadQuotaExceededError()
 			connection.Log(logger.LevelInfo, "denying share read due to quota limits")
 			sendAPIResponse(w, r, err, "", getMappedStatusCode(err))
-			dataprovider.UpdateShareLastUse(&share, -1) //nolint:errcheck
+			updateShareUsage(&share, connection.GetRemoteIP(), -1)
 			return
 		}
 		baseDir := "/"
@@ -300,12 +415,12 @@ func (s *httpdServer) downloadFromShare(w http.ResponseWriter, r *http.Request)
 			baseDir = share.Paths[0]
 			share.Paths[0] = "/"
 		}
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"share-%v.zip\"", share.Name))
-		renderCompressedFiles(w, connection, baseDir, share.Paths, &share)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"share-%v.%s\"", share.Name, format))
+		renderCompressedFiles(w, connection, baseDir, share.Paths, &share, format)
 		return
 	}
 	if status, err := downloadFile(w, r, connection, share.Paths[0], info, false, &share); err != nil {
-		dataprovider.UpdateShareLastUse(&share, -1) //nolint:errcheck
+		updateShareUsage(&share, connection.GetRemoteIP(), -1)
 		resp := apiResponse{
 			Error:   err.Error(),
 			Message: http.StatusText(status),
@@ -323,11 +438,17 @@ func (s *httpdServer) uploadFileToShare(w http.ResponseWriter, r *http.Request)
 		r.Body = http.MaxBytesReader(w, r.Body, maxUploadFileSize)
 	}
 	name := getURLParam(r, "name")
-	validScopes := []dataprovider.ShareScope{dataprovider.ShareScopeWrite, dataprovider.ShareScopeReadWrite}
+	validScopes := []dataprovider.ShareScope{dataprovider.ShareScopeWrite, dataprovider.ShareScopeReadWrite,
+		dataprovider.ShareScopeUploadPortal, dataprovider.ShareScopeFileRequest}
 	share, connection, err := s.checkPublicShare(w, r, validScopes)
 	if err != nil {
 		return
 	}
+	uploader, err := setSharePortalFields(connection, &share, r.URL.Query())
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
 	filePath := util.CleanPath(path.Join(share.Paths[0], name))
 	expectedPrefix := share.Paths[0]
 	if !strings.HasSuffix(expectedPrefix, "/") {
@@ -337,7 +458,14 @@ func (s *httpdServer) uploadFileToShare(w http.ResponseWriter, r *http.Request)
 		sendAPIResponse(w, r, err, "Uploading outside the share is not allowed", http.StatusForbidden)
 		return
 	}
-	dataprovider.UpdateShareLastUse(&share, 1) //nolint:errcheck
+	if share.Scope == dataprovider.ShareScopeFileRequest {
+		filePath, err = getFileRequestPath(connection, &share, name, uploader, make(map[string]bool))
+		if err != nil {
+			sendAPIResponse(w, r, err, "Unable to generate the file name", getMappedStatusCode(err))
+			return
+		}
+	}
+	updateShareUsage(&share, connection.GetRemoteIP(), 1)
 
 	if err = common.Connections.Add(connection); err != nil {
 		sendAPIResponse(w, r, err, "Unable to add connection", http.StatusTooManyRequests)
@@ -345,15 +473,18 @@ func (s *httpdServer) uploadFileToShare(w http.ResponseWriter, r *http.Request)
 	}
 	defer common.Connections.Remove(connection.GetID())
 	if err := doUploadFile(w, r, connection, filePath); err != nil {
-		dataprovider.UpdateShareLastUse(&share, -1) //nolint:errcheck
+		updateShareUsage(&share, connection.GetRemoteIP(), -1)
+		return
 	}
+	notifyFileRequestUploads(connection, &share, uploader, []string{filePath})
 }
 
 func (s *httpdServer) uploadFilesToShare(w http.ResponseWriter, r *http.Request) {
 	if maxUploadFileSize > 0 {
 		r.Body = http.MaxBytesReader(w, r.Body, maxUploadFileSize)
 	}
-	validScopes := []dataprovider.ShareScope{dataprovider.ShareScopeWrite, dataprovider.ShareScopeReadWrite}
+	validScopes := []dataprovider.ShareScope{dataprovider.ShareScopeWrite, dataprovider.ShareScopeReadWrite,
+		dataprovider.ShareScopeUploadPortal, dataprovider.ShareScopeFileRequest}
 	share, connection, err := s.checkPublicShare(w, r, validScopes)
 	if err != nil {
 		return
@@ -389,17 +520,38 @@ func (s *httpdServer) uploadFilesToShare(w http.ResponseWriter, r *http.Request)
 		sendAPIResponse(w, r, nil, "No files uploaded!", http.StatusBadRequest)
 		return
 	}
+	uploader, err := setSharePortalFields(connection, &share, r.MultipartForm.Value)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
 	if share.MaxTokens > 0 {
 		if len(files) > (share.MaxTokens - share.UsedTokens) {
 			sendAPIResponse(w, r, nil, "Allowed usage exceeded", http.StatusBadRequest)
 			return
 		}
 	}
-	dataprovider.UpdateShareLastUse(&share, len(files)) //nolint:errcheck
+	var filePaths []string
+	if share.Scope == dataprovider.ShareScopeFileRequest {
+		usedPaths := make(map[string]bool)
+		for _, f := range files {
+			filePath, err := getFileRequestPath(connection, &share, f.Filename, uploader, usedPaths)
+			if err != nil {
+				sendAPIResponse(w, r, err, "Unable to generate the file name", getMappedStatusCode(err))
+				return
+			}
+			f.Filename = path.Base(filePath)
+			filePaths = append(filePaths, filePath)
+		}
+	}
+	updateShareUsage(&share, connection.GetRemoteIP(), len(files))
 
 	numUploads := doUploadFiles(w, r, connection, share.Paths[0], files)
 	if numUploads != len(files) {
-		dataprovider.UpdateShareLastUse(&share, numUploads-len(files)) //nolint:errcheck
+		updateShareUsage(&share, connection.GetRemoteIP(), numUploads-len(files))
+	}
+	if numUploads > 0 && len(filePaths) >= numUploads {
+		notifyFileRequestUploads(connection, &share, uploader, filePaths[:numUploads])
 	}
 }
 
@@ -499,7 +651,7 @@ func (s *httpdServer) checkPublicShare(w http.ResponseWriter, r *http.Request, v
 		renderError(err, "", getRespStatus(err))
 		return share, nil, err
 	}
-	connID := xid.New().String()
+	connID := getRequestID(r)
 	connection := &Connection{
 		BaseConnection: common.NewBaseConnection(connID, common.ProtocolHTTPShare, util.GetHTTPLocalAddress(r),
 			r.RemoteAddr, user),
@@ -551,3 +703,102 @@ func getBrowsableSharedPath(share dataprovider.Share, r *http.Request) (string,
 	}
 	return name, nil
 }
+
+// setSharePortalFields validates the fields submitted to an upload portal or
+// a file request and sets them on the connection, so they are stored as
+// metadata for the uploaded files and forwarded to the event manager.
+// The uploader name is returned for file requests
+func setSharePortalFields(connection *Connection, share *dataprovider.Share, values url.Values) (string, error) {
+	if !share.HasPortal() {
+		return "", nil
+	}
+	fields := make(map[string]string)
+	if share.Portal != nil {
+		var err error
+		fields, err = share.Portal.GetMetadata(values)
+		if err != nil {
+			return "", err
+		}
+	}
+	var uploader string
+	if share.Scope == dataprovider.ShareScopeFileRequest && share.FileRequest != nil {
+		var err error
+		uploader, err = share.FileRequest.GetUploader(values)
+		if err != nil {
+			return "", err
+		}
+		if uploader != "" {
+			fields[dataprovider.ShareFileRequestUploaderField] = uploader
+		}
+	}
+	connection.SetUploadFields(fields)
+	return uploader, nil
+}
+
+// getFileRequestPath returns the virtual path for a file uploaded to a file
+// request. The name is generated using the share template, a numeric suffix
+// is added if the name is already used by an existing file or by another file
+// within the same request
+func getFileRequestPath(connection *Connection, share *dataprovider.Share, name, uploader string,
+	usedPaths map[string]bool,
+) (string, error) {
+	if share.FileRequest == nil {
+		share.FileRequest = &dataprovider.ShareFileRequest{NameTemplate: dataprovider.ShareFileRequestDefaultTemplate}
+	}
+	fileName := share.FileRequest.GetFileName(name, uploader, time.Now())
+	for n := 0; n < maxFileRequestNameAttempts; n++ {
+		filePath := path.Join(share.Paths[0], dataprovider.GetShareFileNameVariant(fileName, n))
+		if usedPaths[filePath] {
+			continue
+		}
+		_, err := connection.DoStat(filePath, 0, false)
+		if err == nil {
+			continue
+		}
+		if !connection.IsNotExistError(err) {
+			return "", err
+		}
+		usedPaths[filePath] = true
+		return filePath, nil
+	}
+	return "", util.NewGenericError(fmt.Sprintf("unable to find an available name for %q", fileName))
+}
+
+func notifyFileRequestUploads(connection *Connection, share *dataprovider.Share, uploader string, filePaths []string) {
+	if share.Scope != dataprovider.ShareScopeFileRequest {
+		return
+	}
+	uploads := make([]common.FileRequestUpload, 0, len(filePaths))
+	for _, p := range filePaths {
+		uploads = append(uploads, common.FileRequestUpload{
+			Name:     share.GetRelativePath(p),
+			Uploader: uploader,
+			IP:       connection.GetRemoteIP(),
+		})
+	}
+	common.NotifyFileRequestUploads(share, uploads)
+}
+
+// addShareEvent records a completed download from the specified share
+func addShareEvent(connection *Connection, share *dataprovider.Share, name string, size int64) {
+	event := &dataprovider.ShareEvent{
+		ShareID: share.ShareID,
+		IP:      connection.GetRemoteIP(),
+		Path:    name,
+		Size:    size,
+	}
+	if connection.request != nil {
+		event.UserAgent = connection.request.UserAgent()
+	}
+	dataprovider.AddShareEvent(event)
+}
+
+// updateShareUsage updates the share usage and notifies the share owner,
+// if requested, when the share is used
+func updateShareUsage(share *dataprovider.Share, ipAddr string, numTokens int) {
+	dataprovider.UpdateShareUsage(share, ipAddr, numTokens) //nolint:errcheck
+	// file requests notify the owner about the uploaded files
+	if numTokens > 0 && share.NotifyOnUse && share.Scope != dataprovider.ShareScopeFileRequest {
+		common.NotifyShareUse(share, ipAddr, numTokens)
+	}
+}
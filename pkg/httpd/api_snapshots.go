@@ -0,0 +1,149 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/render"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+func getConfigSnapshots(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	snapshots, err := dataprovider.GetConfigSnapshots(getURLParam(r, "type"), getURLParam(r, "name"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	// the objects are only returned when a single snapshot is requested
+	for idx := range snapshots {
+		snapshots[idx].Object = nil
+	}
+	if snapshots == nil {
+		snapshots = []dataprovider.ConfigSnapshot{}
+	}
+	render.JSON(w, r, snapshots)
+}
+
+func getConfigSnapshotByID(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	snapshot, err := getObjectConfigSnapshot(getURLParam(r, "type"), getURLParam(r, "name"), getURLParam(r, "id"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, snapshot)
+}
+
+func rollbackConfigSnapshot(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	snapshot, err := getSnapshotForRollback(r)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	if snapshot.IsDelete() {
+		err = util.NewValidationError(fmt.Sprintf("%s %q was deleted, snapshot %q cannot be restored",
+			snapshot.ObjectType, snapshot.ObjectName, snapshot.ID))
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	err = restoreConfigSnapshot(r.Context(), &snapshot, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	snapshot.Object = nil
+	render.JSON(w, r, snapshot)
+}
+
+func getObjectConfigSnapshot(objectType, objectName, id string) (dataprovider.ConfigSnapshot, error) {
+	snapshot, err := dataprovider.GetConfigSnapshot(id)
+	if err != nil {
+		return snapshot, err
+	}
+	if snapshot.ObjectType != objectType || snapshot.ObjectName != objectName {
+		return dataprovider.ConfigSnapshot{}, util.NewRecordNotFoundError(
+			fmt.Sprintf("snapshot %q does not exist for %s %q", id, objectType, objectName))
+	}
+	return snapshot, nil
+}
+
+// getSnapshotForRollback returns the snapshot identified by the "id" query
+// parameter or the most recent snapshot at the time defined by the "as_of"
+// query parameter
+func getSnapshotForRollback(r *http.Request) (dataprovider.ConfigSnapshot, error) {
+	objectType := getURLParam(r, "type")
+	objectName := getURLParam(r, "name")
+	if id := r.URL.Query().Get("id"); id != "" {
+		return getObjectConfigSnapshot(objectType, objectName, id)
+	}
+	if _, ok := r.URL.Query()["as_of"]; !ok {
+		return dataprovider.ConfigSnapshot{}, util.NewValidationError("as_of or id is required")
+	}
+	ts, err := strconv.ParseInt(r.URL.Query().Get("as_of"), 10, 64)
+	if err != nil {
+		return dataprovider.ConfigSnapshot{}, util.NewValidationError(fmt.Sprintf("invalid as_of: %v", err))
+	}
+	return dataprovider.GetConfigSnapshotAt(objectType, objectName, util.GetTimeFromMsecSinceEpoch(ts))
+}
+
+func restoreConfigSnapshot(ctx context.Context, snapshot *dataprovider.ConfigSnapshot, executor, ipAddress, role string) error {
+	inputFile := fmt.Sprintf("snapshot %s at %s", snapshot.ID,
+		util.GetTimeFromMsecSinceEpoch(snapshot.Timestamp).UTC().Format(time.RFC3339))
+	switch snapshot.ObjectType {
+	case "user":
+		var user dataprovider.User
+		if err := json.Unmarshal(snapshot.Object, &user); err != nil {
+			return fmt.Errorf("unable to decode snapshot %q: %w", snapshot.ID, err)
+		}
+		return restoreUsers(ctx, []dataprovider.User{user}, inputFile, 0, 0, executor, ipAddress, role)
+	case "folder":
+		var folder vfs.BaseVirtualFolder
+		if err := json.Unmarshal(snapshot.Object, &folder); err != nil {
+			return fmt.Errorf("unable to decode snapshot %q: %w", snapshot.ID, err)
+		}
+		return restoreFolders(ctx, []vfs.BaseVirtualFolder{folder}, inputFile, 0, 0, executor, ipAddress, role)
+	case "group":
+		var group dataprovider.Group
+		if err := json.Unmarshal(snapshot.Object, &group); err != nil {
+			return fmt.Errorf("unable to decode snapshot %q: %w", snapshot.ID, err)
+		}
+		return restoreGroups(ctx, []dataprovider.Group{group}, inputFile, 0, executor, ipAddress, role)
+	case "event_rule":
+		var rule dataprovider.EventRule
+		if err := json.Unmarshal(snapshot.Object, &rule); err != nil {
+			return fmt.Errorf("unable to decode snapshot %q: %w", snapshot.ID, err)
+		}
+		return restoreEventRules(ctx, []dataprovider.EventRule{rule}, inputFile, 0, executor, ipAddress, role,
+			dataprovider.DumpVersion)
+	default:
+		return util.NewValidationError(fmt.Sprintf("unsupported snapshot object type %q", snapshot.ObjectType))
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"path"
 	"strconv"
 	"time"
 
@@ -46,7 +47,7 @@ func getUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	users, err := dataprovider.GetUsers(limit, offset, order, claims.Role)
+	users, err := claims.getUsers(limit, offset, order)
 	if err == nil {
 		render.JSON(w, r, users)
 	} else {
@@ -66,7 +67,7 @@ func getUserByUsername(w http.ResponseWriter, r *http.Request) {
 }
 
 func renderUser(w http.ResponseWriter, r *http.Request, username string, claims *jwtTokenClaims, status int) {
-	user, err := dataprovider.UserExists(username, claims.Role)
+	user, err := claims.getUser(username)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -107,12 +108,18 @@ func addUser(w http.ResponseWriter, r *http.Request) {
 	if claims.Role != "" {
 		user.Role = claims.Role
 	}
+	if err := claims.checkUserScope(&user); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
 	user.LastPasswordChange = 0
 	user.Filters.RecoveryCodes = nil
+	user.Filters.Consents = nil
+	user.Filters.PendingRegistration = 0
 	user.Filters.TOTPConfig = dataprovider.UserTOTPConfig{
 		Enabled: false,
 	}
-	err = dataprovider.AddUser(&user, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
+	err = dataprovider.AddUserContext(r.Context(), &user, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -121,6 +128,72 @@ func addUser(w http.ResponseWriter, r *http.Request) {
 	renderUser(w, r, user.Username, &claims, http.StatusCreated)
 }
 
+func importUsers(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxRestoreSize)
+
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	var req dataprovider.UserImportRequest
+	err = render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	if req.UpdateExisting && !claims.hasPerm(dataprovider.PermAdminChangeUsers) {
+		sendAPIResponse(w, r, nil, "Updating existing users is not allowed", http.StatusForbidden)
+		return
+	}
+	report, err := dataprovider.ImportUsers(&req, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role, claims.checkUserScope)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, report)
+}
+
+func bulkUpdateUsers(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	disconnect := 0
+	if _, ok := r.URL.Query()["disconnect"]; ok {
+		disconnect, err = strconv.Atoi(r.URL.Query().Get("disconnect"))
+		if err != nil {
+			err = fmt.Errorf("invalid disconnect parameter: %v", err)
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	var req dataprovider.UserBulkRequest
+	err = render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	report, err := dataprovider.BulkUpdateUsers(&req, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role, claims.UserGroups)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, report)
+	if disconnect == 1 && !report.DryRun {
+		for _, result := range report.Results {
+			if result.Action == dataprovider.BulkActionUpdate {
+				disconnectUser(result.Name, claims.Username, claims.Role)
+			}
+		}
+	}
+}
+
 func disableUser2FA(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 	claims, err := getTokenClaims(r)
@@ -129,7 +202,7 @@ func disableUser2FA(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	username := getURLParam(r, "username")
-	user, err := dataprovider.UserExists(username, claims.Role)
+	user, err := claims.getUser(username)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -138,13 +211,72 @@ func disableUser2FA(w http.ResponseWriter, r *http.Request) {
 	user.Filters.TOTPConfig = dataprovider.UserTOTPConfig{
 		Enabled: false,
 	}
-	if err := dataprovider.UpdateUser(&user, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role); err != nil {
+	if err := dataprovider.UpdateUserContext(r.Context(), &user, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role); err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
 	}
 	sendAPIResponse(w, r, nil, "2FA disabled", http.StatusOK)
 }
 
+func getUserConsents(w http.ResponseWriter, r *http.Request) {
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	user, err := claims.getUser(getURLParam(r, "username"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	status := userConsentsStatus{
+		Accepted: user.Filters.Consents,
+		Pending:  []consentDocumentInfo{},
+	}
+	if status.Accepted == nil {
+		status.Accepted = []dataprovider.UserConsent{}
+	}
+	for _, doc := range common.GetPendingConsents(&user) {
+		status.Pending = append(status.Pending, consentDocumentInfo{
+			Name:    doc.Name,
+			Title:   doc.Title,
+			Version: doc.Version,
+		})
+	}
+	render.JSON(w, r, status)
+}
+
+func generateUserConsentLink(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	user, err := claims.getUser(getURLParam(r, "username"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	if !common.MustAcceptConsents(&user) {
+		sendAPIResponse(w, r, nil, "The user has no consent documents to accept", http.StatusBadRequest)
+		return
+	}
+	code := newResetCode(user.Username, false)
+	code.ExpiresAt = time.Now().Add(common.GetConsentLinkValidity()).UTC()
+	if err := consentLinksMgr.Add(code); err != nil {
+		sendAPIResponse(w, r, err, "Unable to save the consent link", getRespStatus(err))
+		return
+	}
+	logger.Debug(logSender, getRequestID(r), "consent link generated for user %q by admin %q, expires at %v",
+		user.Username, claims.Username, code.ExpiresAt)
+	render.JSON(w, r, consentLink{
+		Path:      path.Join(webClientConsentLinkPath, code.Code),
+		ExpiresAt: util.GetTimeAsMsSinceEpoch(code.ExpiresAt),
+	})
+}
+
 func updateUser(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 	claims, err := getTokenClaims(r)
@@ -163,7 +295,7 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	user, err := dataprovider.UserExists(username, claims.Role)
+	user, err := claims.getUser(username)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -180,16 +312,28 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	updatedUser.Username = user.Username
 	updatedUser.Filters.RecoveryCodes = user.Filters.RecoveryCodes
 	updatedUser.Filters.TOTPConfig = user.Filters.TOTPConfig
+	// consents can only be accepted by the users themselves
+	updatedUser.Filters.Consents = user.Filters.Consents
+	updatedUser.Filters.PendingRegistration = user.Filters.PendingRegistration
 	updatedUser.LastPasswordChange = user.LastPasswordChange
 	updatedUser.SetEmptySecretsIfNil()
+	updatedUser.SetWebhookSecretsFrom(user.Filters.Webhooks)
 	updateEncryptedSecrets(&updatedUser.FsConfig, user.FsConfig.S3Config.AccessSecret, user.FsConfig.AzBlobConfig.AccountKey,
 		user.FsConfig.AzBlobConfig.SASURL, user.FsConfig.GCSConfig.Credentials, user.FsConfig.CryptConfig.Passphrase,
 		user.FsConfig.SFTPConfig.Password, user.FsConfig.SFTPConfig.PrivateKey, user.FsConfig.SFTPConfig.KeyPassphrase,
-		user.FsConfig.HTTPConfig.Password, user.FsConfig.HTTPConfig.APIKey)
+		user.FsConfig.HTTPConfig.Password, user.FsConfig.HTTPConfig.APIKey, user.FsConfig.WebDAVConfig.Password,
+		user.FsConfig.WebDAVConfig.ClientKey)
+	updatePGPEncryptedSecrets(&updatedUser.FsConfig, user.FsConfig.PGPConfig)
+	updateCryptFsEncryptedSecrets(&updatedUser.FsConfig, user.FsConfig.CryptConfig)
 	if claims.Role != "" {
 		updatedUser.Role = claims.Role
 	}
-	err = dataprovider.UpdateUser(&updatedUser, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
+	if err := claims.checkUserScope(&updatedUser); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	err = dataprovider.UpdateUserContext(r.Context(), &updatedUser, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -208,7 +352,14 @@ func deleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	username := getURLParam(r, "username")
-	err = dataprovider.DeleteUser(username, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
+	if len(claims.UserGroups) > 0 {
+		if _, err := claims.getUser(username); err != nil {
+			sendAPIResponse(w, r, err, "", getRespStatus(err))
+			return
+		}
+	}
+	err = dataprovider.DeleteUserContext(r.Context(), username, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -220,7 +371,7 @@ func deleteUser(w http.ResponseWriter, r *http.Request) {
 func forgotUserPassword(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 
-	if !smtp.IsEnabled() {
+	if !smtp.IsEnabled() && !hasTenantSMTP(getURLParam(r, "username")) {
 		sendAPIResponse(w, r, nil, "No SMTP configuration", http.StatusBadRequest)
 		return
 	}
@@ -273,7 +424,7 @@ func disconnectUser(username, admin, role string) {
 
 func updateEncryptedSecrets(fsConfig *vfs.Filesystem, currentS3AccessSecret, currentAzAccountKey, currentAzSASUrl,
 	currentGCSCredentials, currentCryptoPassphrase, currentSFTPPassword, currentSFTPKey, currentSFTPKeyPassphrase,
-	currentHTTPPassword, currentHTTPAPIKey *kms.Secret) {
+	currentHTTPPassword, currentHTTPAPIKey, currentWebDAVPassword, currentWebDAVClientKey *kms.Secret) {
 	// we use the new access secret if plain or empty, otherwise the old value
 	switch fsConfig.Provider {
 	case sdk.S3FilesystemProvider:
@@ -301,6 +452,42 @@ func updateEncryptedSecrets(fsConfig *vfs.Filesystem, currentS3AccessSecret, cur
 		updateSFTPFsEncryptedSecrets(fsConfig, currentSFTPPassword, currentSFTPKey, currentSFTPKeyPassphrase)
 	case sdk.HTTPFilesystemProvider:
 		updateHTTPFsEncryptedSecrets(fsConfig, currentHTTPPassword, currentHTTPAPIKey)
+	case vfs.WebDAVFilesystemProvider:
+		updateWebDAVFsEncryptedSecrets(fsConfig, currentWebDAVPassword, currentWebDAVClientKey)
+	}
+}
+
+// updateCryptFsEncryptedSecrets preserves the names encryption key and the
+// previous passphrases, they are not editable. If the passphrase changes, the
+// current one is added to the previous passphrases so the files not yet
+// re-encrypted can still be read
+func updateCryptFsEncryptedSecrets(fsConfig *vfs.Filesystem, current vfs.CryptFsConfig) {
+	if fsConfig.Provider != sdk.CryptedFilesystemProvider {
+		return
+	}
+	config := &fsConfig.CryptConfig
+	config.PreviousPassphrases = current.PreviousPassphrases
+	if config.NamesKey == nil || !config.NamesKey.IsPlain() {
+		config.NamesKey = current.NamesKey
+	}
+	if config.Passphrase == nil || !config.Passphrase.IsPlain() || current.Passphrase == nil ||
+		!current.Passphrase.IsEncrypted() {
+		return
+	}
+	currentPassphrase := current.Passphrase.Clone()
+	if err := currentPassphrase.TryDecrypt(); err == nil && currentPassphrase.GetPayload() == config.Passphrase.GetPayload() {
+		return
+	}
+	config.PreviousPassphrases = append([]*kms.Secret{current.Passphrase}, current.PreviousPassphrases...)
+}
+
+func updatePGPEncryptedSecrets(fsConfig *vfs.Filesystem, current vfs.PGPFsConfig) {
+	// the PGP settings are supported for all the providers
+	if fsConfig.PGPConfig.PrivateKey.IsNotPlainAndNotEmpty() {
+		fsConfig.PGPConfig.PrivateKey = current.PrivateKey
+	}
+	if fsConfig.PGPConfig.Passphrase.IsNotPlainAndNotEmpty() {
+		fsConfig.PGPConfig.Passphrase = current.Passphrase
 	}
 }
 
@@ -326,3 +513,12 @@ func updateHTTPFsEncryptedSecrets(fsConfig *vfs.Filesystem, currentHTTPPassword,
 		fsConfig.HTTPConfig.APIKey = currentHTTPAPIKey
 	}
 }
+
+func updateWebDAVFsEncryptedSecrets(fsConfig *vfs.Filesystem, currentWebDAVPassword, currentWebDAVClientKey *kms.Secret) {
+	if fsConfig.WebDAVConfig.Password.IsNotPlainAndNotEmpty() {
+		fsConfig.WebDAVConfig.Password = currentWebDAVPassword
+	}
+	if fsConfig.WebDAVConfig.ClientKey.IsNotPlainAndNotEmpty() {
+		fsConfig.WebDAVConfig.ClientKey = currentWebDAVClientKey
+	}
+}
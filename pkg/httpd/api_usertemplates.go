@@ -0,0 +1,251 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/go-chi/render"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// userProvisionRequest defines the user specific fields used to instantiate
+// a user from a template
+type userProvisionRequest struct {
+	Username   string            `json:"username"`
+	Password   string            `json:"password,omitempty"`
+	PublicKeys []string          `json:"public_keys,omitempty"`
+	Email      string            `json:"email,omitempty"`
+	Variables  map[string]string `json:"variables,omitempty"`
+}
+
+func findUserTemplate(configs *dataprovider.Configs, name string) (int, error) {
+	for idx := range configs.UserTemplates {
+		if configs.UserTemplates[idx].Name == name {
+			return idx, nil
+		}
+	}
+	return -1, util.NewRecordNotFoundError(fmt.Sprintf("user template %q does not exist", name))
+}
+
+func saveUserTemplates(configs *dataprovider.Configs, r *http.Request) error {
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		return util.NewValidationError("invalid token claims")
+	}
+	return dataprovider.UpdateConfigsContext(r.Context(), configs, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr),
+		claims.Role)
+}
+
+func getUserTemplates(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	configs, err := dataprovider.GetConfigs()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	templates := configs.UserTemplates
+	if templates == nil {
+		templates = []dataprovider.UserTemplate{}
+	}
+	for idx := range templates {
+		templates[idx].PrepareForRendering()
+	}
+	render.JSON(w, r, templates)
+}
+
+func getUserTemplateByName(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	template, err := dataprovider.GetUserTemplate(getURLParam(r, "name"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	template.PrepareForRendering()
+	render.JSON(w, r, template)
+}
+
+func addUserTemplate(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	var template dataprovider.UserTemplate
+	if err := render.DecodeJSON(r.Body, &template); err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	configs, err := dataprovider.GetConfigs()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	if _, err := findUserTemplate(&configs, template.Name); err == nil {
+		sendAPIResponse(w, r, nil, fmt.Sprintf("User template %q already exists", template.Name), http.StatusConflict)
+		return
+	}
+	template.CreatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+	template.UpdatedAt = template.CreatedAt
+	configs.UserTemplates = append(configs.UserTemplates, template)
+	if err := saveUserTemplates(&configs, r); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	template = configs.UserTemplates[len(configs.UserTemplates)-1]
+	template.PrepareForRendering()
+	w.Header().Set("Location", path.Join(userTemplatesPath, url.PathEscape(template.Name)))
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, template)
+}
+
+func updateUserTemplate(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	var template dataprovider.UserTemplate
+	if err := render.DecodeJSON(r.Body, &template); err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	configs, err := dataprovider.GetConfigs()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	idx, err := findUserTemplate(&configs, getURLParam(r, "name"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	current := &configs.UserTemplates[idx]
+	// the name cannot be changed
+	template.Name = current.Name
+	template.CreatedAt = current.CreatedAt
+	template.UpdatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+	fsConfig := &current.User.FsConfig
+	fsConfig.SetEmptySecretsIfNil()
+	template.User.SetEmptySecretsIfNil()
+	updateEncryptedSecrets(&template.User.FsConfig, fsConfig.S3Config.AccessSecret, fsConfig.AzBlobConfig.AccountKey,
+		fsConfig.AzBlobConfig.SASURL, fsConfig.GCSConfig.Credentials, fsConfig.CryptConfig.Passphrase,
+		fsConfig.SFTPConfig.Password, fsConfig.SFTPConfig.PrivateKey, fsConfig.SFTPConfig.KeyPassphrase,
+		fsConfig.HTTPConfig.Password, fsConfig.HTTPConfig.APIKey, fsConfig.WebDAVConfig.Password,
+		fsConfig.WebDAVConfig.ClientKey)
+	updatePGPEncryptedSecrets(&template.User.FsConfig, fsConfig.PGPConfig)
+	configs.UserTemplates[idx] = template
+	if err := saveUserTemplates(&configs, r); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, nil, "User template updated", http.StatusOK)
+}
+
+func deleteUserTemplate(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	configs, err := dataprovider.GetConfigs()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	idx, err := findUserTemplate(&configs, getURLParam(r, "name"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	configs.UserTemplates = append(configs.UserTemplates[:idx], configs.UserTemplates[idx+1:]...)
+	if err := saveUserTemplates(&configs, r); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, nil, "User template deleted", http.StatusOK)
+}
+
+func provisionUser(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	var req userProvisionRequest
+	if err := render.DecodeJSON(r.Body, &req); err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	template, err := dataprovider.GetUserTemplate(getURLParam(r, "name"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	user, err := getUserFromUserTemplate(&template, &req)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	if claims.Role != "" {
+		user.Role = claims.Role
+	}
+	if err := claims.checkUserScope(&user); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	err = dataprovider.AddUserContext(r.Context(), &user, claims.Username, util.GetIPFromRemoteAddress(r.RemoteAddr), claims.Role)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	w.Header().Add("Location", fmt.Sprintf("%s/%s", userPath, url.PathEscape(user.Username)))
+	renderUser(w, r, user.Username, &claims, http.StatusCreated)
+}
+
+// getUserFromUserTemplate instantiates a user from the specified template.
+// The template secrets are decrypted so the placeholders can be replaced,
+// they will be encrypted again using the new username as additional data
+func getUserFromUserTemplate(template *dataprovider.UserTemplate, req *userProvisionRequest) (dataprovider.User, error) {
+	if req.Username == "" {
+		return dataprovider.User{}, util.NewValidationError("username is required")
+	}
+	replacements, err := template.GetReplacements(req.Username, req.Variables)
+	if err != nil {
+		return dataprovider.User{}, err
+	}
+	user := template.User
+	if err := user.FsConfig.TryDecryptSecrets(); err != nil {
+		return user, fmt.Errorf("unable to decrypt the secrets for template %q: %w", template.Name, err)
+	}
+	user.Username = req.Username
+	user.Password = req.Password
+	user.PublicKeys = req.PublicKeys
+	if req.Email != "" {
+		user.Email = req.Email
+	}
+	replacements["%email%"] = user.Email
+	if user.Password != "" {
+		replacements["%password%"] = user.Password
+	}
+	user = applyUserTemplateReplacements(user, replacements)
+	user.Email = replacePlaceholders(user.Email, replacements)
+	for idx := range user.Groups {
+		user.Groups[idx].Name = replacePlaceholders(user.Groups[idx].Name, replacements)
+	}
+	user.LastPasswordChange = 0
+	user.Filters.RecoveryCodes = nil
+	user.Filters.Consents = nil
+	user.Filters.PendingRegistration = 0
+	user.Filters.TOTPConfig = dataprovider.UserTOTPConfig{
+		Enabled: false,
+	}
+	return user, nil
+}
@@ -17,6 +17,8 @@ package httpd
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -34,7 +36,6 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
-	"github.com/klauspost/compress/zip"
 	"github.com/sftpgo/sdk/plugin/notifier"
 
 	"github.com/drakkan/sftpgo/v2/pkg/common"
@@ -44,6 +45,7 @@ import (
 	"github.com/drakkan/sftpgo/v2/pkg/plugin"
 	"github.com/drakkan/sftpgo/v2/pkg/smtp"
 	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
 )
 
 type pwdChange struct {
@@ -68,7 +70,29 @@ type adminProfile struct {
 
 type userProfile struct {
 	baseProfile
-	PublicKeys []string `json:"public_keys,omitempty"`
+	PublicKeys           []string                           `json:"public_keys,omitempty"`
+	PublicKeysExpiration []dataprovider.PublicKeyExpiration `json:"public_keys_expiration,omitempty"`
+	// signed URL to get the authorized public keys, read only
+	PublicKeysURL string `json:"public_keys_url,omitempty"`
+}
+
+type consentDocumentInfo struct {
+	Name    string `json:"name"`
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type userConsentsStatus struct {
+	Accepted []dataprovider.UserConsent `json:"accepted"`
+	Pending  []consentDocumentInfo      `json:"pending"`
+}
+
+type consentLink struct {
+	// path to the WebClient consent page, it must be prefixed with the public
+	// base URL before sending it to the user
+	Path string `json:"path"`
+	// expiration as unix timestamp in milliseconds
+	ExpiresAt int64 `json:"expires_at"`
 }
 
 func sendAPIResponse(w http.ResponseWriter, r *http.Request, err error, message string, code int) {
@@ -120,6 +144,10 @@ func getMappedStatusCode(err error) int {
 		statusCode = http.StatusNotFound
 	case errors.Is(err, common.ErrQuotaExceeded):
 		statusCode = http.StatusRequestEntityTooLarge
+	case errors.Is(err, common.ErrContentTypeDenied):
+		statusCode = http.StatusUnsupportedMediaType
+	case errors.Is(err, common.ErrWORMProtected):
+		statusCode = http.StatusLocked
 	case errors.Is(err, common.ErrOpUnsupported):
 		statusCode = http.StatusBadRequest
 	default:
@@ -277,119 +305,215 @@ func getSearchFilters(w http.ResponseWriter, r *http.Request) (int, int, string,
 	return limit, offset, order, err
 }
 
+func getAPIDirEntry(info os.FileInfo) map[string]any {
+	res := make(map[string]any)
+	res["name"] = info.Name()
+	if info.Mode().IsRegular() {
+		res["size"] = info.Size()
+	}
+	res["mode"] = info.Mode()
+	res["last_modified"] = info.ModTime().UTC().Format(time.RFC3339)
+	return res
+}
+
 func renderAPIDirContents(w http.ResponseWriter, r *http.Request, contents []os.FileInfo, omitNonRegularFiles bool) {
 	results := make([]map[string]any, 0, len(contents))
 	for _, info := range contents {
 		if omitNonRegularFiles && !info.Mode().IsDir() && !info.Mode().IsRegular() {
 			continue
 		}
-		res := make(map[string]any)
-		res["name"] = info.Name()
-		if info.Mode().IsRegular() {
-			res["size"] = info.Size()
-		}
-		res["mode"] = info.Mode()
-		res["last_modified"] = info.ModTime().UTC().Format(time.RFC3339)
-		results = append(results, res)
+		results = append(results, getAPIDirEntry(info))
 	}
 
 	render.JSON(w, r, results)
 }
 
-func getCompressedFileName(username string, files []string) string {
+// renderAPIDirLister writes the directory entries as a JSON array while they
+// are read from the lister, so the whole listing is never loaded in memory.
+// If an error happens after the response is started the array is not
+// terminated, so the client can detect the truncated listing
+func renderAPIDirLister(w http.ResponseWriter, r *http.Request, conn *Connection, lister *common.DirListerAt) {
+	files, err := lister.Next(vfs.ListerBatchSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		sendAPIResponse(w, r, err, "Unable to get directory contents", getMappedStatusCode(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if _, errWrite := w.Write([]byte("[")); errWrite != nil {
+		return
+	}
+	numEntries := 0
+	for {
+		for _, info := range files {
+			data, errMarshal := json.Marshal(getAPIDirEntry(info))
+			if errMarshal != nil {
+				conn.Log(logger.LevelError, "unable to marshal directory entry %q: %v", info.Name(), errMarshal)
+				return
+			}
+			if numEntries > 0 {
+				data = append([]byte(","), data...)
+			}
+			if _, errWrite := w.Write(data); errWrite != nil {
+				return
+			}
+			numEntries++
+		}
+		if err != nil {
+			break
+		}
+		files, err = lister.Next(vfs.ListerBatchSize)
+		if err != nil && !errors.Is(err, io.EOF) {
+			conn.Log(logger.LevelError, "unable to list directory, listing truncated after %d entries: %v",
+				numEntries, err)
+			return
+		}
+	}
+	w.Write([]byte("]\n")) //nolint:errcheck
+}
+
+type dirListCursor struct {
+	Path   string `json:"path"`
+	Offset int    `json:"offset"`
+}
+
+func encodeDirListCursor(name string, offset int) string {
+	data, err := json.Marshal(dirListCursor{Path: name, Offset: offset})
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeDirListCursor(cursor, name string) (int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, util.NewValidationError("invalid cursor")
+	}
+	var c dirListCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return 0, util.NewValidationError("invalid cursor")
+	}
+	if c.Path != name || c.Offset < 0 {
+		return 0, util.NewValidationError("the cursor does not match the requested path")
+	}
+	return c.Offset, nil
+}
+
+// getDirListPagination returns the requested page size and the number of
+// entries to skip. A zero limit means the whole listing is requested
+func getDirListPagination(r *http.Request, name string) (int, int, error) {
+	var err error
+	limit := 0
+	offset := 0
+	if _, ok := r.URL.Query()["limit"]; ok {
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 {
+			return 0, 0, util.NewValidationError("invalid limit")
+		}
+		if limit > maxDirListLimit {
+			limit = maxDirListLimit
+		}
+	}
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		offset, err = decodeDirListCursor(cursor, name)
+		if err != nil {
+			return 0, 0, err
+		}
+		if limit == 0 {
+			limit = vfs.ListerBatchSize
+		}
+	}
+	return limit, offset, nil
+}
+
+// readDirListPage skips offset entries and returns up to limit entries from
+// the lister. The returned boolean is true if there are more entries
+func readDirListPage(lister *common.DirListerAt, offset, limit int) ([]os.FileInfo, bool, error) {
+	for offset > 0 {
+		files, err := lister.Next(min(offset, vfs.ListerBatchSize))
+		offset -= len(files)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, false, nil
+			}
+			return nil, false, err
+		}
+	}
+	var result []os.FileInfo
+	for len(result) < limit {
+		files, err := lister.Next(limit - len(result))
+		result = append(result, files...)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return result, false, nil
+			}
+			return nil, false, err
+		}
+	}
+	files, err := lister.Next(1)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, false, err
+	}
+	return result, len(files) > 0, nil
+}
+
+func getCompressedFileName(username string, files []string, format string) string {
 	if len(files) == 1 {
 		name := path.Base(files[0])
-		return fmt.Sprintf("%s-%s.zip", username, strings.TrimSuffix(name, path.Ext(name)))
+		return fmt.Sprintf("%s-%s.%s", username, strings.TrimSuffix(name, path.Ext(name)), format)
 	}
-	return fmt.Sprintf("%s-download.zip", username)
+	return fmt.Sprintf("%s-download.%s", username, format)
 }
 
 func renderCompressedFiles(w http.ResponseWriter, conn *Connection, baseDir string, files []string,
-	share *dataprovider.Share,
+	share *dataprovider.Share, format string,
 ) {
 	conn.User.CheckFsRoot(conn.ID) //nolint:errcheck
-	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Type", getArchiveContentType(format))
 	w.Header().Set("Accept-Ranges", "none")
 	w.Header().Set("Content-Transfer-Encoding", "binary")
 	w.WriteHeader(http.StatusOK)
 
-	wr := zip.NewWriter(w)
+	counter := &bytesCounterWriter{w: w}
+	wr := newArchiveWriter(counter, format)
+	builder := newArchiveBuilder(wr, conn, baseDir)
 
 	for _, file := range files {
 		fullPath := util.CleanPath(path.Join(baseDir, file))
-		if err := addZipEntry(wr, conn, fullPath, baseDir); err != nil {
+		if err := builder.addEntry(fullPath); err != nil {
 			if share != nil {
-				dataprovider.UpdateShareLastUse(share, -1) //nolint:errcheck
+				updateShareUsage(share, conn.GetRemoteIP(), -1)
 			}
 			panic(http.ErrAbortHandler)
 		}
 	}
 	if err := wr.Close(); err != nil {
-		conn.Log(logger.LevelError, "unable to close zip file: %v", err)
+		conn.Log(logger.LevelError, "unable to close %s archive: %v", format, err)
 		if share != nil {
-			dataprovider.UpdateShareLastUse(share, -1) //nolint:errcheck
+			updateShareUsage(share, conn.GetRemoteIP(), -1)
 		}
 		panic(http.ErrAbortHandler)
 	}
-}
-
-func addZipEntry(wr *zip.Writer, conn *Connection, entryPath, baseDir string) error {
-	info, err := conn.Stat(entryPath, 1)
-	if err != nil {
-		conn.Log(logger.LevelDebug, "unable to add zip entry %q, stat error: %v", entryPath, err)
-		return err
-	}
-	entryName, err := getZipEntryName(entryPath, baseDir)
-	if err != nil {
-		conn.Log(logger.LevelError, "unable to get zip entry name: %v", err)
-		return err
-	}
-	if info.IsDir() {
-		_, err = wr.CreateHeader(&zip.FileHeader{
-			Name:     entryName + "/",
-			Method:   zip.Deflate,
-			Modified: info.ModTime(),
-		})
-		if err != nil {
-			conn.Log(logger.LevelError, "unable to create zip entry %q: %v", entryPath, err)
-			return err
+	if share != nil {
+		sharedPath := baseDir
+		if len(files) == 1 {
+			sharedPath = util.CleanPath(path.Join(baseDir, files[0]))
 		}
-		contents, err := conn.ReadDir(entryPath)
-		if err != nil {
-			conn.Log(logger.LevelDebug, "unable to add zip entry %q, read dir error: %v", entryPath, err)
-			return err
-		}
-		for _, info := range contents {
-			fullPath := util.CleanPath(path.Join(entryPath, info.Name()))
-			if err := addZipEntry(wr, conn, fullPath, baseDir); err != nil {
-				return err
-			}
-		}
-		return nil
-	}
-	if !info.Mode().IsRegular() {
-		// we only allow regular files
-		conn.Log(logger.LevelInfo, "skipping zip entry for non regular file %q", entryPath)
-		return nil
-	}
-	reader, err := conn.getFileReader(entryPath, 0, http.MethodGet)
-	if err != nil {
-		conn.Log(logger.LevelDebug, "unable to add zip entry %q, cannot open file: %v", entryPath, err)
-		return err
+		addShareEvent(conn, share, sharedPath, counter.written)
 	}
-	defer reader.Close()
+}
 
-	f, err := wr.CreateHeader(&zip.FileHeader{
-		Name:     entryName,
-		Method:   zip.Deflate,
-		Modified: info.ModTime(),
-	})
-	if err != nil {
-		conn.Log(logger.LevelError, "unable to create zip entry %q: %v", entryPath, err)
-		return err
-	}
-	_, err = io.Copy(f, reader)
-	return err
+// bytesCounterWriter counts the bytes written to the wrapped writer
+type bytesCounterWriter struct {
+	w       io.Writer
+	written int64
+}
+
+func (c *bytesCounterWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.written += int64(n)
+	return n, err
 }
 
 func getZipEntryName(entryPath, baseDir string) (string, error) {
@@ -457,18 +581,35 @@ func downloadFile(w http.ResponseWriter, r *http.Request, connection *Connection
 	w.Header().Set("Accept-Ranges", "bytes")
 	w.WriteHeader(responseStatus)
 	if r.Method != http.MethodHead {
-		_, err = io.CopyN(w, reader, size)
+		err = sendFileContents(w, reader, size)
 		if err != nil {
 			if share != nil {
-				dataprovider.UpdateShareLastUse(share, -1) //nolint:errcheck
+				updateShareUsage(share, connection.GetRemoteIP(), -1)
 			}
 			connection.Log(logger.LevelDebug, "error reading file to download: %v", err)
 			panic(http.ErrAbortHandler)
 		}
+		if share != nil {
+			addShareEvent(connection, share, name, size)
+		}
 	}
 	return http.StatusOK, nil
 }
 
+// sendFileContents writes size bytes from the downloaded file to w. Local files
+// are sent without copying them in user space, if enabled and supported
+func sendFileContents(w io.Writer, reader io.Reader, size int64) error {
+	if f, ok := reader.(*httpdFile); ok && f.CanZeroCopy(w) {
+		written, err := f.ZeroCopyWriteTo(w, size)
+		if err == nil && written < size {
+			err = io.EOF
+		}
+		return err
+	}
+	_, err := io.CopyN(w, reader, size)
+	return err
+}
+
 func checkPreconditions(w http.ResponseWriter, r *http.Request, modtime time.Time) bool {
 	if checkIfUnmodifiedSince(r, modtime) == condFalse {
 		w.WriteHeader(http.StatusPreconditionFailed)
@@ -603,8 +744,7 @@ func handleDefenderEventLoginFailed(ipAddr string, err error) error {
 	return err
 }
 
-func updateLoginMetrics(user *dataprovider.User, loginMethod, ip string, err error) {
-	metric.AddLoginAttempt(loginMethod)
+func updateLoginMetrics(ctx context.Context, user *dataprovider.User, loginMethod, ip string, err error) {
 	var protocol string
 	switch loginMethod {
 	case dataprovider.LoginMethodIDP:
@@ -612,6 +752,11 @@ func updateLoginMetrics(user *dataprovider.User, loginMethod, ip string, err err
 	default:
 		protocol = common.ProtocolHTTP
 	}
+	updateLoginMetricsForProtocol(ctx, user, loginMethod, protocol, ip, err)
+}
+
+func updateLoginMetricsForProtocol(ctx context.Context, user *dataprovider.User, loginMethod, protocol, ip string, err error) {
+	metric.AddLoginAttempt(loginMethod)
 	if err != nil && err != common.ErrInternalFailure && err != common.ErrNoCredentials {
 		logger.ConnectionFailedLog(user.Username, ip, loginMethod, protocol, err.Error())
 		err = handleDefenderEventLoginFailed(ip, err)
@@ -622,17 +767,24 @@ func updateLoginMetrics(user *dataprovider.User, loginMethod, ip string, err err
 		plugin.Handler.NotifyLogEvent(logEv, protocol, user.Username, ip, "", err)
 	}
 	metric.AddLoginResult(loginMethod, err)
-	dataprovider.ExecutePostLoginHook(user, loginMethod, ip, protocol, err)
+	dataprovider.ExecutePostLoginHook(ctx, user, loginMethod, ip, protocol, err)
 }
 
 func checkHTTPClientUser(user *dataprovider.User, r *http.Request, connectionID string, checkSessions bool) error {
+	return checkHTTPClientUserWithLoginMethod(user, r, connectionID, dataprovider.LoginMethodPassword, checkSessions)
+}
+
+func checkHTTPClientUserWithLoginMethod(user *dataprovider.User, r *http.Request, connectionID, loginMethod string,
+	checkSessions bool,
+) error {
 	if util.Contains(user.Filters.DeniedProtocols, common.ProtocolHTTP) {
 		logger.Info(logSender, connectionID, "cannot login user %q, protocol HTTP is not allowed", user.Username)
 		return fmt.Errorf("protocol HTTP is not allowed for user %q", user.Username)
 	}
-	if !isLoggedInWithOIDC(r) && !user.IsLoginMethodAllowed(dataprovider.LoginMethodPassword, common.ProtocolHTTP, nil) {
-		logger.Info(logSender, connectionID, "cannot login user %q, password login method is not allowed", user.Username)
-		return fmt.Errorf("login method password is not allowed for user %q", user.Username)
+	if !isLoggedInWithIDP(r) && !user.IsLoginMethodAllowed(loginMethod, common.ProtocolHTTP, nil) {
+		logger.Info(logSender, connectionID, "cannot login user %q, login method %q is not allowed",
+			user.Username, loginMethod)
+		return fmt.Errorf("login method %s is not allowed for user %q", loginMethod, user.Username)
 	}
 	if checkSessions && user.MaxSessions > 0 {
 		activeSessions := common.Connections.GetActiveSessions(user.Username)
@@ -684,16 +836,20 @@ func handleForgotPassword(r *http.Request, username string, isAdmin bool) error
 	if email == "" {
 		return util.NewValidationError("Your account does not have an email address, it is not possible to reset your password by sending an email verification code")
 	}
+	var role string
+	if !isAdmin {
+		role = user.Role
+	}
 	c := newResetCode(username, isAdmin)
 	body := new(bytes.Buffer)
 	data := make(map[string]string)
 	data["Code"] = c.Code
-	if err := smtp.RenderPasswordResetTemplate(body, data); err != nil {
+	if err := smtp.RenderPasswordResetTemplate(role, body, data); err != nil {
 		logger.Warn(logSender, middleware.GetReqID(r.Context()), "unable to render password reset template: %v", err)
 		return util.NewGenericError("Unable to render password reset template")
 	}
 	startTime := time.Now()
-	if err := smtp.SendEmail([]string{email}, nil, subject, body.String(), smtp.EmailContentTypeTextHTML); err != nil {
+	if err := smtp.SendEmailForRole(role, []string{email}, nil, subject, body.String(), smtp.EmailContentTypeTextHTML); err != nil {
 		logger.Warn(logSender, middleware.GetReqID(r.Context()), "unable to send password reset code via email: %v, elapsed: %v",
 			err, time.Since(startTime))
 		return util.NewGenericError(fmt.Sprintf("Unable to send confirmation code via email: %v", err))
@@ -731,7 +887,7 @@ func handleResetPassword(r *http.Request, code, newPassword string, isAdmin bool
 			return &admin, &user, util.NewValidationError("unable to associate the confirmation code with an existing admin")
 		}
 		admin.Password = newPassword
-		err = dataprovider.UpdateAdmin(&admin, dataprovider.ActionExecutorSelf, ipAddr, admin.Role)
+		err = dataprovider.UpdateAdminContext(r.Context(), &admin, dataprovider.ActionExecutorSelf, ipAddr, admin.Role)
 		if err != nil {
 			return &admin, &user, util.NewGenericError(fmt.Sprintf("unable to set the new password: %v", err))
 		}
@@ -777,9 +933,16 @@ func getProtocolFromRequest(r *http.Request) string {
 	if isLoggedInWithOIDC(r) {
 		return common.ProtocolOIDC
 	}
+	if claims, err := getTokenClaims(r); err == nil && claims.IDPProtocol != "" {
+		return claims.IDPProtocol
+	}
 	return common.ProtocolHTTP
 }
 
+func isLoggedInWithIDP(r *http.Request) bool {
+	return getProtocolFromRequest(r) != common.ProtocolHTTP
+}
+
 func hideConfidentialData(claims *jwtTokenClaims, r *http.Request) bool {
 	if !claims.hasPerm(dataprovider.PermAdminManageSystem) {
 		return true
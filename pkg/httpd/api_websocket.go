@@ -0,0 +1,507 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sftpgo/sdk"
+
+	"github.com/drakkan/sftpgo/v2/pkg/common"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+)
+
+const (
+	// max size for a single message sent by the client, upload chunks included
+	wsMaxMessageSize = 1048576
+	// size of the binary messages sent for downloads
+	wsChunkSize    = 65536
+	wsPingInterval = 30 * time.Second
+	wsPongWait     = 60 * time.Second
+	wsWriteWait    = 30 * time.Second
+)
+
+// WebSocket message types
+const (
+	wsTypeSubscribe   = "subscribe"
+	wsTypeUnsubscribe = "unsubscribe"
+	wsTypeDownload    = "download"
+	wsTypeUpload      = "upload"
+	wsTypeUploadEnd   = "upload_end"
+	wsTypeCancel      = "cancel"
+	wsTypeAck         = "ack"
+	wsTypeComplete    = "complete"
+	wsTypeError       = "error"
+	wsTypeEvent       = "event"
+)
+
+var (
+	errWSTransferCancelled = errors.New("transfer cancelled")
+	errWSClosed            = errors.New("WebSocket connection closed")
+	wsUpgrader             = websocket.Upgrader{
+		ReadBufferSize:  32768,
+		WriteBufferSize: 32768,
+	}
+)
+
+type wsRequest struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Path   string `json:"path,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+}
+
+type wsResponse struct {
+	ID     string              `json:"id,omitempty"`
+	Type   string              `json:"type"`
+	Size   int64               `json:"size,omitempty"`
+	Status int                 `json:"status,omitempty"`
+	Error  string              `json:"error,omitempty"`
+	Event  *common.UserFsEvent `json:"event,omitempty"`
+}
+
+// wsTransfer is the upload or download in progress for a WebSocket session.
+// Upload chunks are written to a pipe, this way the client is slowed down
+// if the storage backend is slower than the network
+type wsTransfer struct {
+	id         string
+	isUpload   bool
+	pipeReader *io.PipeReader
+	pipeWriter *io.PipeWriter
+	received   int64
+	cancelled  atomic.Bool
+	done       chan struct{}
+	// set before closing the done channel
+	size int64
+	err  error
+}
+
+type wsSession struct {
+	conn       *websocket.Conn
+	connection *Connection
+	canWrite   bool
+	writeMu    sync.Mutex
+	mu         sync.Mutex
+	sub        *common.FsEventSubscription
+	transfer   *wsTransfer
+	wg         sync.WaitGroup
+}
+
+func handleUserWebSocket(w http.ResponseWriter, r *http.Request) {
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	connection, err := getUserConnection(w, r)
+	if err != nil {
+		return
+	}
+	defer common.Connections.Remove(connection.GetID())
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already replied with an HTTP error
+		connection.Log(logger.LevelDebug, "unable to upgrade to WebSocket: %v", err)
+		return
+	}
+	s := &wsSession{
+		conn:       conn,
+		connection: connection,
+		// for web client perms are negated and not granted
+		canWrite: !claims.hasPerm(sdk.WebClientWriteDisabled),
+	}
+	s.serve()
+}
+
+func (s *wsSession) serve() {
+	defer s.close()
+
+	s.conn.SetReadLimit(wsMaxMessageSize)
+	s.conn.SetReadDeadline(time.Now().Add(wsPongWait)) //nolint:errcheck
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	stopPing := make(chan struct{})
+	defer close(stopPing)
+
+	go s.ping(stopPing)
+
+	for {
+		msgType, data, err := s.conn.ReadMessage()
+		if err != nil {
+			s.connection.Log(logger.LevelDebug, "WebSocket session ended: %v", err)
+			return
+		}
+		s.conn.SetReadDeadline(time.Now().Add(wsPongWait)) //nolint:errcheck
+		s.connection.UpdateLastActivity()
+
+		if msgType == websocket.BinaryMessage {
+			s.handleUploadData(data)
+			continue
+		}
+		var req wsRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			s.sendError("", nil, "Invalid request", http.StatusBadRequest)
+			continue
+		}
+		s.handleRequest(&req)
+	}
+}
+
+func (s *wsSession) handleRequest(req *wsRequest) {
+	switch req.Type {
+	case wsTypeSubscribe:
+		s.subscribe()
+		s.writeJSON(wsResponse{ID: req.ID, Type: wsTypeAck}) //nolint:errcheck
+	case wsTypeUnsubscribe:
+		s.unsubscribe()
+		s.writeJSON(wsResponse{ID: req.ID, Type: wsTypeAck}) //nolint:errcheck
+	case wsTypeDownload:
+		s.startDownload(req)
+	case wsTypeUpload:
+		s.startUpload(req)
+	case wsTypeUploadEnd:
+		t := s.getTransfer()
+		if t == nil || !t.isUpload || t.id != req.ID {
+			s.sendError(req.ID, nil, "No such upload", http.StatusNotFound)
+			return
+		}
+		s.finishUpload(t, nil)
+	case wsTypeCancel:
+		s.cancelTransfer(req.ID)
+	default:
+		s.sendError(req.ID, nil, fmt.Sprintf("Unsupported request type %q", req.Type), http.StatusBadRequest)
+	}
+}
+
+func (s *wsSession) ping(stop chan struct{}) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *wsSession) writeJSON(resp wsResponse) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait)) //nolint:errcheck
+	return s.conn.WriteJSON(resp)
+}
+
+func (s *wsSession) writeBinary(data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait)) //nolint:errcheck
+	return s.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (s *wsSession) sendError(id string, err error, message string, status int) {
+	resp := wsResponse{
+		ID:     id,
+		Type:   wsTypeError,
+		Status: status,
+		Error:  message,
+	}
+	if err != nil {
+		resp.Error = fmt.Sprintf("%s: %v", message, err)
+		resp.Status = getMappedStatusCode(err)
+	}
+	s.writeJSON(resp) //nolint:errcheck
+}
+
+func (s *wsSession) subscribe() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sub != nil {
+		return
+	}
+	s.sub = common.FsEventSubscriptions.Subscribe(s.connection.User.Username)
+	s.wg.Add(1)
+	go s.pushEvents(s.sub)
+}
+
+func (s *wsSession) unsubscribe() {
+	s.mu.Lock()
+	sub := s.sub
+	s.sub = nil
+	s.mu.Unlock()
+
+	if sub != nil {
+		common.FsEventSubscriptions.Unsubscribe(sub)
+	}
+}
+
+func (s *wsSession) pushEvents(sub *common.FsEventSubscription) {
+	defer s.wg.Done()
+
+	for event := range sub.Events() {
+		ev := event
+		if err := s.writeJSON(wsResponse{Type: wsTypeEvent, Event: &ev}); err != nil {
+			s.connection.Log(logger.LevelDebug, "unable to push fs event: %v", err)
+			return
+		}
+	}
+	if dropped := sub.Dropped(); dropped > 0 {
+		s.connection.Log(logger.LevelDebug, "%d fs events dropped, the client is too slow", dropped)
+	}
+}
+
+func (s *wsSession) getTransfer() *wsTransfer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.transfer
+}
+
+// setTransfer sets the transfer in progress. Transfers are started only from
+// the reading loop after checking that there is no other transfer in progress
+func (s *wsSession) setTransfer(t *wsTransfer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.transfer = t
+}
+
+func (s *wsSession) clearTransfer(t *wsTransfer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.transfer == t {
+		s.transfer = nil
+	}
+}
+
+func (s *wsSession) startDownload(req *wsRequest) {
+	if s.getTransfer() != nil {
+		s.sendError(req.ID, nil, "Another transfer is in progress", http.StatusConflict)
+		return
+	}
+	name := s.connection.User.GetCleanedPath(req.Path)
+	if name == "/" {
+		s.sendError(req.ID, nil, "Please set the path to a valid file", http.StatusBadRequest)
+		return
+	}
+	info, err := s.connection.Stat(name, 0)
+	if err != nil {
+		s.sendError(req.ID, err, "Unable to stat the requested file", 0)
+		return
+	}
+	if info.IsDir() {
+		s.sendError(req.ID, nil, fmt.Sprintf("Please set the path to a valid file, %q is a directory", name),
+			http.StatusBadRequest)
+		return
+	}
+	if req.Offset < 0 || req.Offset > info.Size() {
+		s.sendError(req.ID, nil, fmt.Sprintf("Invalid offset %d", req.Offset), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	s.connection.User.CheckFsRoot(s.connection.ID) //nolint:errcheck
+	reader, err := s.connection.getFileReader(name, req.Offset, http.MethodGet)
+	if err != nil {
+		s.sendError(req.ID, err, fmt.Sprintf("Unable to read file %q", name), 0)
+		return
+	}
+	t := &wsTransfer{
+		id:   req.ID,
+		done: make(chan struct{}),
+	}
+	s.setTransfer(t)
+	if err := s.writeJSON(wsResponse{ID: req.ID, Type: wsTypeAck, Size: info.Size() - req.Offset}); err != nil {
+		s.clearTransfer(t)
+		reader.Close()
+		return
+	}
+	s.wg.Add(1)
+	go s.download(t, reader)
+}
+
+func (s *wsSession) download(t *wsTransfer, reader io.ReadCloser) {
+	defer s.wg.Done()
+	defer close(t.done)
+
+	buf := make([]byte, wsChunkSize)
+	var err error
+	for {
+		if t.cancelled.Load() {
+			err = errWSTransferCancelled
+			break
+		}
+		n, readErr := reader.Read(buf)
+		if n > 0 {
+			// the write blocks until the client reads the data
+			if err = s.writeBinary(buf[:n]); err != nil {
+				break
+			}
+			t.size += int64(n)
+		}
+		if readErr != nil {
+			if readErr != io.EOF {
+				err = readErr
+			}
+			break
+		}
+	}
+	closeErr := reader.Close()
+	if err == nil {
+		err = closeErr
+	}
+	t.err = err
+	s.clearTransfer(t)
+	if err != nil {
+		s.connection.Log(logger.LevelDebug, "WebSocket download failed: %v", err)
+		s.sendError(t.id, err, "Download failed", 0)
+		return
+	}
+	s.writeJSON(wsResponse{ID: t.id, Type: wsTypeComplete, Size: t.size}) //nolint:errcheck
+}
+
+func (s *wsSession) startUpload(req *wsRequest) {
+	if !s.canWrite {
+		s.sendError(req.ID, nil, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if s.getTransfer() != nil {
+		s.sendError(req.ID, nil, "Another transfer is in progress", http.StatusConflict)
+		return
+	}
+	name := s.connection.User.GetCleanedPath(req.Path)
+	if name == "/" {
+		s.sendError(req.ID, nil, "Please set the path to a valid file", http.StatusBadRequest)
+		return
+	}
+	s.connection.User.CheckFsRoot(s.connection.ID) //nolint:errcheck
+	pipeReader, pipeWriter := io.Pipe()
+	reader, err := getClientEncryptedReader(&s.connection.User, name, pipeReader)
+	if err != nil {
+		s.sendError(req.ID, nil, fmt.Sprintf("Unable to write file %q: %v", name, err),
+			getClientEncryptionErrorStatus(err))
+		return
+	}
+	writer, err := s.connection.getFileWriter(name)
+	if err != nil {
+		s.sendError(req.ID, err, fmt.Sprintf("Unable to write file %q", name), 0)
+		return
+	}
+	t := &wsTransfer{
+		id:         req.ID,
+		isUpload:   true,
+		pipeReader: pipeReader,
+		pipeWriter: pipeWriter,
+		done:       make(chan struct{}),
+	}
+	s.setTransfer(t)
+	s.wg.Add(1)
+	go s.upload(t, reader, writer)
+	s.writeJSON(wsResponse{ID: req.ID, Type: wsTypeAck}) //nolint:errcheck
+}
+
+func (s *wsSession) upload(t *wsTransfer, reader io.Reader, writer io.WriteCloser) {
+	defer s.wg.Done()
+	defer close(t.done)
+
+	written, err := io.Copy(writer, reader)
+	if err != nil {
+		writer.Close() //nolint:errcheck
+		// unblock the pending and future writes
+		t.pipeReader.CloseWithError(err)
+		t.err = err
+		return
+	}
+	t.size = written
+	t.err = writer.Close()
+}
+
+func (s *wsSession) handleUploadData(data []byte) {
+	t := s.getTransfer()
+	if t == nil || !t.isUpload {
+		s.connection.Log(logger.LevelDebug, "ignoring binary message, no upload in progress")
+		return
+	}
+	t.received += int64(len(data))
+	if maxUploadFileSize > 0 && t.received > maxUploadFileSize {
+		s.finishUpload(t, fmt.Errorf("the upload exceeds the maximum allowed size: %d", maxUploadFileSize))
+		return
+	}
+	// the write blocks until the data is written to the storage backend
+	if _, err := t.pipeWriter.Write(data); err != nil {
+		s.finishUpload(t, nil)
+	}
+}
+
+// finishUpload closes the pipe and waits for the upload to complete.
+// If abortErr is not nil the upload fails
+func (s *wsSession) finishUpload(t *wsTransfer, abortErr error) {
+	if abortErr != nil {
+		t.pipeWriter.CloseWithError(abortErr)
+	} else {
+		t.pipeWriter.Close()
+	}
+	<-t.done
+	s.clearTransfer(t)
+	if t.err != nil {
+		s.connection.Log(logger.LevelDebug, "WebSocket upload failed: %v", t.err)
+		s.sendError(t.id, t.err, "Upload failed", 0)
+		return
+	}
+	s.writeJSON(wsResponse{ID: t.id, Type: wsTypeComplete, Size: t.size}) //nolint:errcheck
+}
+
+func (s *wsSession) cancelTransfer(id string) {
+	t := s.getTransfer()
+	if t == nil || t.id != id {
+		s.sendError(id, nil, "No such transfer", http.StatusNotFound)
+		return
+	}
+	if t.isUpload {
+		s.finishUpload(t, errWSTransferCancelled)
+		return
+	}
+	// the download goroutine sends the error response
+	t.cancelled.Store(true)
+}
+
+func (s *wsSession) close() {
+	s.unsubscribe()
+	if t := s.getTransfer(); t != nil {
+		if t.isUpload {
+			t.pipeWriter.CloseWithError(errWSClosed)
+		} else {
+			t.cancelled.Store(true)
+		}
+	}
+	s.conn.Close()
+	s.wg.Wait()
+}
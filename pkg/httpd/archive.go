@@ -0,0 +1,239 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zip"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// Supported archive formats
+const (
+	archiveFormatZip   = "zip"
+	archiveFormatTar   = "tar"
+	archiveFormatTarGz = "tar.gz"
+)
+
+// getArchiveFormat returns the archive format for the specified value,
+// zip is the default
+func getArchiveFormat(val string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(val)) {
+	case "", archiveFormatZip:
+		return archiveFormatZip, nil
+	case archiveFormatTar:
+		return archiveFormatTar, nil
+	case archiveFormatTarGz, "tgz":
+		return archiveFormatTarGz, nil
+	default:
+		return "", util.NewValidationError(fmt.Sprintf("unsupported archive format %q", val))
+	}
+}
+
+func getArchiveContentType(format string) string {
+	switch format {
+	case archiveFormatTar:
+		return "application/x-tar"
+	case archiveFormatTarGz:
+		return "application/gzip"
+	default:
+		return "application/zip"
+	}
+}
+
+// archiveWriter writes the entries of zip and tar archives
+type archiveWriter interface {
+	addDir(name string, modTime time.Time) error
+	// addFile adds a regular file entry and returns the writer for its contents
+	addFile(name string, info os.FileInfo) (io.Writer, error)
+	Close() error
+}
+
+func newArchiveWriter(w io.Writer, format string) archiveWriter {
+	switch format {
+	case archiveFormatTar:
+		return &tarArchiveWriter{
+			wr: tar.NewWriter(w),
+		}
+	case archiveFormatTarGz:
+		gz := gzip.NewWriter(w)
+		return &tarArchiveWriter{
+			wr: tar.NewWriter(gz),
+			gz: gz,
+		}
+	default:
+		return &zipArchiveWriter{
+			wr: zip.NewWriter(w),
+		}
+	}
+}
+
+type zipArchiveWriter struct {
+	wr *zip.Writer
+}
+
+func (w *zipArchiveWriter) addDir(name string, modTime time.Time) error {
+	_, err := w.wr.CreateHeader(&zip.FileHeader{
+		Name:     name + "/",
+		Method:   zip.Deflate,
+		Modified: modTime,
+	})
+	return err
+}
+
+func (w *zipArchiveWriter) addFile(name string, info os.FileInfo) (io.Writer, error) {
+	return w.wr.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: info.ModTime(),
+	})
+}
+
+func (w *zipArchiveWriter) Close() error {
+	return w.wr.Close()
+}
+
+type tarArchiveWriter struct {
+	wr *tar.Writer
+	gz *gzip.Writer
+}
+
+func (w *tarArchiveWriter) addDir(name string, modTime time.Time) error {
+	return w.wr.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     0755,
+		ModTime:  modTime,
+	})
+}
+
+func (w *tarArchiveWriter) addFile(name string, info os.FileInfo) (io.Writer, error) {
+	err := w.wr.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     info.Size(),
+		Mode:     0644,
+		ModTime:  info.ModTime(),
+	})
+	return w.wr, err
+}
+
+func (w *tarArchiveWriter) Close() error {
+	err := w.wr.Close()
+	if w.gz != nil {
+		if errGz := w.gz.Close(); err == nil {
+			err = errGz
+		}
+	}
+	return err
+}
+
+// archiveBuilder adds the selected paths, relative to baseDir, to an archive
+type archiveBuilder struct {
+	writer  archiveWriter
+	conn    *Connection
+	baseDir string
+	// entries already added, overlapping selections are added once
+	entries map[string]bool
+	// optional writer to track the contents read
+	progress io.Writer
+	// optional callback executed after adding a file
+	onFileAdded func()
+}
+
+func newArchiveBuilder(writer archiveWriter, conn *Connection, baseDir string) *archiveBuilder {
+	return &archiveBuilder{
+		writer:  writer,
+		conn:    conn,
+		baseDir: baseDir,
+		entries: make(map[string]bool),
+	}
+}
+
+func (b *archiveBuilder) addEntry(entryPath string) error {
+	info, err := b.conn.Stat(entryPath, 1)
+	if err != nil {
+		b.conn.Log(logger.LevelDebug, "unable to add archive entry %q, stat error: %v", entryPath, err)
+		return err
+	}
+	entryName, err := getZipEntryName(entryPath, b.baseDir)
+	if err != nil {
+		b.conn.Log(logger.LevelError, "unable to get archive entry name: %v", err)
+		return err
+	}
+	if b.entries[entryName] {
+		b.conn.Log(logger.LevelDebug, "skipping duplicate archive entry %q", entryPath)
+		return nil
+	}
+	b.entries[entryName] = true
+	if info.IsDir() {
+		if entryName != "" {
+			if err := b.writer.addDir(entryName, info.ModTime()); err != nil {
+				b.conn.Log(logger.LevelError, "unable to create archive entry %q: %v", entryPath, err)
+				return err
+			}
+		}
+		contents, err := b.conn.ReadDir(entryPath)
+		if err != nil {
+			b.conn.Log(logger.LevelDebug, "unable to add archive entry %q, read dir error: %v", entryPath, err)
+			return err
+		}
+		for _, info := range contents {
+			fullPath := util.CleanPath(path.Join(entryPath, info.Name()))
+			if err := b.addEntry(fullPath); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if !info.Mode().IsRegular() {
+		// we only allow regular files
+		b.conn.Log(logger.LevelInfo, "skipping archive entry for non regular file %q", entryPath)
+		return nil
+	}
+	reader, err := b.conn.getFileReader(entryPath, 0, http.MethodGet)
+	if err != nil {
+		b.conn.Log(logger.LevelDebug, "unable to add archive entry %q, cannot open file: %v", entryPath, err)
+		return err
+	}
+	defer reader.Close()
+
+	f, err := b.writer.addFile(entryName, info)
+	if err != nil {
+		b.conn.Log(logger.LevelError, "unable to create archive entry %q: %v", entryPath, err)
+		return err
+	}
+	if b.progress != nil {
+		f = io.MultiWriter(f, b.progress)
+	}
+	if _, err = io.Copy(f, reader); err != nil {
+		return err
+	}
+	if b.onFileAdded != nil {
+		b.onFileAdded()
+	}
+	return nil
+}
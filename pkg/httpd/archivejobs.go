@@ -0,0 +1,543 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/xid"
+	"golang.org/x/time/rate"
+
+	"github.com/drakkan/sftpgo/v2/pkg/common"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+// Archive job statuses
+const (
+	archiveJobStatusRunning   = "running"
+	archiveJobStatusCompleted = "completed"
+	archiveJobStatusFailed    = "failed"
+	archiveJobStatusCanceled  = "canceled"
+)
+
+const (
+	archiveJobsFilePrefix = "sftpgo-archive-"
+	archiveJobsMaxPaths   = 1000
+)
+
+var (
+	errTooManyArchiveJobs  = errors.New("too many archive jobs in progress")
+	errArchiveJobsDisabled = util.NewMethodDisabledError("archive jobs are disabled")
+	archiveJobs            = &archiveJobsManager{
+		jobs: make(map[string]*archiveJob),
+	}
+)
+
+// ArchiveJobsConfig defines the configuration for archive jobs. Archive jobs
+// build, in background, the archives for large selections of files and
+// directories so they can be downloaded, and resumed, once ready
+type ArchiveJobsConfig struct {
+	// Set to true to allow users to start archive jobs
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// Maximum number of concurrent archive jobs for each user
+	MaxConcurrentJobs int `json:"max_concurrent_jobs" mapstructure:"max_concurrent_jobs"`
+	// Maximum size, as bytes, of the files to add to each archive. 0 means no limit
+	MaxSize int64 `json:"max_size" mapstructure:"max_size"`
+	// Maximum rate, as KB/s, for writing each archive. 0 means no limit.
+	// The bandwidth limits for the users apply too
+	Bandwidth int64 `json:"bandwidth" mapstructure:"bandwidth"`
+	// Completed archives can be downloaded for this number of hours
+	Retention int `json:"retention" mapstructure:"retention"`
+}
+
+func (c *ArchiveJobsConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.MaxConcurrentJobs < 1 {
+		return fmt.Errorf("invalid archive jobs max concurrent jobs: %d", c.MaxConcurrentJobs)
+	}
+	if c.MaxSize < 0 {
+		return fmt.Errorf("invalid archive jobs max size: %d", c.MaxSize)
+	}
+	if c.Bandwidth < 0 {
+		return fmt.Errorf("invalid archive jobs bandwidth: %d", c.Bandwidth)
+	}
+	if c.Retention < 1 {
+		return fmt.Errorf("invalid archive jobs retention: %d", c.Retention)
+	}
+	return nil
+}
+
+func getArchiveJobsDir() string {
+	if tempPath := vfs.GetTempPath(); tempPath != "" {
+		return tempPath
+	}
+	return os.TempDir()
+}
+
+// archiveJobInfo defines the status and the progress of an archive job
+type archiveJobInfo struct {
+	ID string `json:"id"`
+	// File name for the download
+	Name   string   `json:"name"`
+	Format string   `json:"format"`
+	Paths  []string `json:"paths"`
+	// Job status: running, completed, failed, canceled
+	Status string `json:"status"`
+	// Number and size of the files to add, available after scanning the paths
+	Files int   `json:"files"`
+	Size  int64 `json:"size"`
+	// Number and size of the files added so far
+	ProcessedFiles int   `json:"processed_files"`
+	ProcessedSize  int64 `json:"processed_size"`
+	// Archive size, available once completed
+	ArchiveSize int64 `json:"archive_size,omitempty"`
+	// Error details if the job failed
+	Error string `json:"error,omitempty"`
+	// Start and end time as unix timestamp in milliseconds
+	StartTime int64 `json:"start_time"`
+	EndTime   int64 `json:"end_time,omitempty"`
+}
+
+type archiveJob struct {
+	sync.RWMutex
+	username       string
+	filePath       string
+	info           archiveJobInfo
+	processedFiles atomic.Int64
+	processedSize  atomic.Int64
+	cancel         context.CancelFunc
+}
+
+func (j *archiveJob) getInfo() archiveJobInfo {
+	j.RLock()
+	defer j.RUnlock()
+
+	info := j.info
+	info.Paths = make([]string, len(j.info.Paths))
+	copy(info.Paths, j.info.Paths)
+	info.ProcessedFiles = int(j.processedFiles.Load())
+	info.ProcessedSize = j.processedSize.Load()
+	return info
+}
+
+func (j *archiveJob) isRunning() bool {
+	j.RLock()
+	defer j.RUnlock()
+
+	return j.info.Status == archiveJobStatusRunning
+}
+
+func (j *archiveJob) isExpired(retention time.Duration) bool {
+	j.RLock()
+	defer j.RUnlock()
+
+	return j.info.Status != archiveJobStatusRunning &&
+		j.info.EndTime < util.GetTimeAsMsSinceEpoch(time.Now().Add(-retention))
+}
+
+func (j *archiveJob) setTotals(files int, size int64) {
+	j.Lock()
+	defer j.Unlock()
+
+	j.info.Files = files
+	j.info.Size = size
+}
+
+func (j *archiveJob) setDone(archiveSize int64, err error, canceled bool) {
+	j.Lock()
+	defer j.Unlock()
+
+	j.info.EndTime = util.GetTimeAsMsSinceEpoch(time.Now())
+	switch {
+	case canceled:
+		j.info.Status = archiveJobStatusCanceled
+	case err != nil:
+		j.info.Status = archiveJobStatusFailed
+		j.info.Error = err.Error()
+	default:
+		j.info.Status = archiveJobStatusCompleted
+		j.info.ArchiveSize = archiveSize
+	}
+}
+
+func (j *archiveJob) removeFile() {
+	if err := os.Remove(j.filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Warn(logSender, "", "unable to remove the file %q for archive job %q: %v", j.filePath, j.info.ID, err)
+	}
+}
+
+// Write implements io.Writer to track the contents added to the archive
+func (j *archiveJob) Write(p []byte) (int, error) {
+	j.processedSize.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// scan returns the number and the size of the files to add to the archive
+func (j *archiveJob) scan(ctx context.Context, conn *Connection) (int, int64, error) {
+	var files int
+	var size int64
+	visited := make(map[string]bool)
+
+	var walk func(virtualPath string) error
+	walk = func(virtualPath string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if visited[virtualPath] {
+			return nil
+		}
+		visited[virtualPath] = true
+		info, err := conn.Stat(virtualPath, 1)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			contents, err := conn.ReadDir(virtualPath)
+			if err != nil {
+				return err
+			}
+			for _, fi := range contents {
+				if err := walk(util.CleanPath(path.Join(virtualPath, fi.Name()))); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			files++
+			size += info.Size()
+		}
+		return nil
+	}
+	for _, p := range j.info.Paths {
+		if err := walk(p); err != nil {
+			return files, size, err
+		}
+	}
+	return files, size, nil
+}
+
+func (j *archiveJob) build(ctx context.Context, conn *Connection, config ArchiveJobsConfig) (int64, error) {
+	files, size, err := j.scan(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+	j.setTotals(files, size)
+	if config.MaxSize > 0 && size > config.MaxSize {
+		return 0, util.NewValidationError(fmt.Sprintf("the selected files size %d exceeds the maximum allowed size %d",
+			size, config.MaxSize))
+	}
+	f, err := os.OpenFile(j.filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	w := &archiveJobWriter{
+		ctx: ctx,
+		f:   f,
+	}
+	if config.Bandwidth > 0 {
+		w.limiter = rate.NewLimiter(rate.Limit(config.Bandwidth*1024), int(config.Bandwidth*1024))
+	}
+	wr := newArchiveWriter(w, j.info.Format)
+	builder := newArchiveBuilder(wr, conn, "/")
+	builder.progress = j
+	builder.onFileAdded = func() {
+		j.processedFiles.Add(1)
+	}
+	for _, p := range j.info.Paths {
+		if err = builder.addEntry(p); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = wr.Close()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		err = ctxErr
+	}
+	return w.written, err
+}
+
+// archiveJobWriter writes the archive to the job file, it enforces the
+// configured bandwidth and stops as soon as the job is canceled
+type archiveJobWriter struct {
+	ctx     context.Context
+	f       *os.File
+	limiter *rate.Limiter
+	written int64
+}
+
+func (w *archiveJobWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if w.limiter != nil {
+		for remaining := len(p); remaining > 0; {
+			n := min(remaining, w.limiter.Burst())
+			if err := w.limiter.WaitN(w.ctx, n); err != nil {
+				return 0, err
+			}
+			remaining -= n
+		}
+	}
+	n, err := w.f.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+type archiveJobsManager struct {
+	sync.RWMutex
+	config ArchiveJobsConfig
+	jobs   map[string]*archiveJob
+}
+
+func (m *archiveJobsManager) setConfig(config ArchiveJobsConfig) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.config = config
+}
+
+func (m *archiveJobsManager) getConfig() ArchiveJobsConfig {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.config
+}
+
+// removeStaleFiles removes the archives left by a previous run, the jobs
+// are tracked in memory so they cannot be downloaded anymore
+func (m *archiveJobsManager) removeStaleFiles() {
+	m.RLock()
+	defer m.RUnlock()
+
+	matches, err := filepath.Glob(filepath.Join(getArchiveJobsDir(), archiveJobsFilePrefix+"*"))
+	if err != nil {
+		return
+	}
+	for _, match := range matches {
+		id := strings.TrimPrefix(filepath.Base(match), archiveJobsFilePrefix)
+		id = strings.SplitN(id, ".", 2)[0]
+		if _, ok := m.jobs[id]; ok {
+			continue
+		}
+		if err := os.Remove(match); err == nil {
+			logger.Debug(logSender, "", "stale archive %q removed", match)
+		}
+	}
+}
+
+// start validates and starts an archive job for the specified virtual
+// paths. conn is the connection requesting the job, it is not used after
+// this method returns
+func (m *archiveJobsManager) start(conn *Connection, paths []string, format string) (archiveJobInfo, error) {
+	config := m.getConfig()
+	if !config.Enabled {
+		return archiveJobInfo{}, errArchiveJobsDisabled
+	}
+	format, err := getArchiveFormat(format)
+	if err != nil {
+		return archiveJobInfo{}, err
+	}
+	if len(paths) == 0 {
+		return archiveJobInfo{}, util.NewValidationError("at least a path is required")
+	}
+	if len(paths) > archiveJobsMaxPaths {
+		return archiveJobInfo{}, util.NewValidationError(fmt.Sprintf("too many paths, the maximum allowed is %d",
+			archiveJobsMaxPaths))
+	}
+	for idx := range paths {
+		paths[idx] = conn.User.GetCleanedPath(paths[idx])
+	}
+	paths = util.RemoveDuplicates(paths, false)
+	for _, p := range paths {
+		if _, err := conn.Stat(p, 1); err != nil {
+			return archiveJobInfo{}, err
+		}
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.removeExpired(time.Duration(config.Retention) * time.Hour)
+	running := 0
+	for _, job := range m.jobs {
+		if job.username == conn.User.Username && job.isRunning() {
+			running++
+		}
+	}
+	if running >= config.MaxConcurrentJobs {
+		return archiveJobInfo{}, errTooManyArchiveJobs
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	id := xid.New().String()
+	job := &archiveJob{
+		username: conn.User.Username,
+		filePath: filepath.Join(getArchiveJobsDir(), fmt.Sprintf("%s%s.%s", archiveJobsFilePrefix, id, format)),
+		info: archiveJobInfo{
+			ID:        id,
+			Name:      getCompressedFileName(conn.User.Username, paths, format),
+			Format:    format,
+			Paths:     paths,
+			Status:    archiveJobStatusRunning,
+			StartTime: util.GetTimeAsMsSinceEpoch(time.Now()),
+		},
+		cancel: cancel,
+	}
+	m.jobs[id] = job
+	// the requesting connection could be closed before the job ends
+	// so we use a dedicated connection
+	jobConn := &Connection{
+		BaseConnection: common.NewBaseConnection(id, conn.GetProtocol(), conn.GetLocalAddress(),
+			conn.GetRemoteAddress(), conn.User),
+	}
+	go m.run(ctx, jobConn, job, config)
+
+	return job.getInfo(), nil
+}
+
+func (m *archiveJobsManager) run(ctx context.Context, conn *Connection, job *archiveJob, config ArchiveJobsConfig) {
+	defer conn.CloseFS() //nolint:errcheck
+	defer job.cancel()
+
+	conn.User.CheckFsRoot(conn.ID) //nolint:errcheck
+	info := job.getInfo()
+	conn.Log(logger.LevelInfo, "starting archive job %q, format %q, paths %v", info.ID, info.Format, info.Paths)
+
+	archiveSize, err := job.build(ctx, conn, config)
+	canceled := ctx.Err() != nil
+	if err != nil || canceled {
+		job.removeFile()
+	}
+	job.setDone(archiveSize, err, canceled)
+
+	info = job.getInfo()
+	conn.Log(logger.LevelInfo, "archive job %q finished, status: %s, files: %d, size: %d, archive size: %d, "+
+		"elapsed: %d ms, err: %v", info.ID, info.Status, info.ProcessedFiles, info.ProcessedSize, info.ArchiveSize,
+		info.EndTime-info.StartTime, err)
+}
+
+// removeExpired must be called with the lock held
+func (m *archiveJobsManager) removeExpired(retention time.Duration) {
+	for id, job := range m.jobs {
+		if job.isExpired(retention) {
+			job.removeFile()
+			delete(m.jobs, id)
+		}
+	}
+}
+
+func (m *archiveJobsManager) cleanup() {
+	retention := time.Duration(m.getConfig().Retention) * time.Hour
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.removeExpired(retention)
+}
+
+func (m *archiveJobsManager) getJob(username, id string) (*archiveJob, error) {
+	job, ok := m.jobs[id]
+	if !ok || job.username != username {
+		return nil, util.NewRecordNotFoundError(fmt.Sprintf("archive job %q not found", id))
+	}
+	return job, nil
+}
+
+// get returns the archive job with the specified id for the given user
+func (m *archiveJobsManager) get(username, id string) (archiveJobInfo, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	job, err := m.getJob(username, id)
+	if err != nil {
+		return archiveJobInfo{}, err
+	}
+	return job.getInfo(), nil
+}
+
+// getAll returns the archive jobs for the given user, sorted by start time
+func (m *archiveJobsManager) getAll(username string) []archiveJobInfo {
+	m.RLock()
+	defer m.RUnlock()
+
+	result := make([]archiveJobInfo, 0)
+	for _, job := range m.jobs {
+		if job.username == username {
+			result = append(result, job.getInfo())
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].StartTime == result[j].StartTime {
+			return result[i].ID < result[j].ID
+		}
+		return result[i].StartTime < result[j].StartTime
+	})
+	return result
+}
+
+// getFile returns the archive job and the path to the archive, the job
+// must be completed
+func (m *archiveJobsManager) getFile(username, id string) (archiveJobInfo, string, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	job, err := m.getJob(username, id)
+	if err != nil {
+		return archiveJobInfo{}, "", err
+	}
+	info := job.getInfo()
+	if info.Status != archiveJobStatusCompleted {
+		return info, "", util.NewValidationError(fmt.Sprintf("archive job %q is not completed, status: %s",
+			id, info.Status))
+	}
+	return info, job.filePath, nil
+}
+
+// remove cancels the running archive job with the specified id for the
+// given user or removes the job and its archive if it is not running
+func (m *archiveJobsManager) remove(username, id string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	job, err := m.getJob(username, id)
+	if err != nil {
+		return err
+	}
+	if job.isRunning() {
+		job.cancel()
+		return nil
+	}
+	job.removeFile()
+	delete(m.jobs, id)
+	return nil
+}
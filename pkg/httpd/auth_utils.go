@@ -18,6 +18,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/go-chi/jwtauth/v5"
@@ -27,6 +28,7 @@ import (
 	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
 	"github.com/drakkan/sftpgo/v2/pkg/logger"
 	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
 )
 
 type tokenAudience = string
@@ -54,12 +56,17 @@ const (
 	claimUsernameKey                = "username"
 	claimPermissionsKey             = "permissions"
 	claimRole                       = "role"
+	claimUserGroups                 = "user_groups"
 	claimAPIKey                     = "api_key"
 	claimNodeID                     = "node_id"
 	claimMustChangePasswordKey      = "chpwd"
 	claimMustSetSecondFactorKey     = "2fa_required"
 	claimRequiredTwoFactorProtocols = "2fa_protos"
 	claimHideUserPageSection        = "hus"
+	claimSessionExpiresAt           = "sexp"
+	claimIDPProtocol                = "idp"
+	claimMustAcceptConsents         = "consents"
+	claimSessionID                  = "sid"
 	basicRealm                      = "Basic realm=\"SFTPGo\""
 	jwtCookieKey                    = "jwt"
 )
@@ -75,9 +82,12 @@ var (
 )
 
 type jwtTokenClaims struct {
-	Username                   string
-	Permissions                []string
-	Role                       string
+	Username    string
+	Permissions []string
+	Role        string
+	// UserGroups restricts the users an admin can manage to the members
+	// of these groups, it is set from the admin role, if any
+	UserGroups                 []string
 	Signature                  string
 	Audience                   []string
 	APIKeyID                   string
@@ -86,6 +96,18 @@ type jwtTokenClaims struct {
 	MustChangePassword         bool
 	RequiredTwoFactorProtocols []string
 	HideUserPageSections       int
+	// SessionExpiresAt is the max session duration expiration, as unix timestamp
+	// in milliseconds. Tokens cannot be refreshed after this time
+	SessionExpiresAt int64
+	// IDPProtocol is set if the user logged in using an identity provider
+	// that does not require a server side session, for example SAML
+	IDPProtocol string
+	// MustAcceptConsents is set if the user must accept the configured consent
+	// documents before using the WebClient or the REST API
+	MustAcceptConsents bool
+	// SessionID identifies the login session, it is preserved when the token
+	// is refreshed and it allows to revoke all the tokens issued for a session
+	SessionID string
 }
 
 func (c *jwtTokenClaims) hasUserAudience() bool {
@@ -106,6 +128,9 @@ func (c *jwtTokenClaims) asMap() map[string]any {
 	if c.Role != "" {
 		claims[claimRole] = c.Role
 	}
+	if len(c.UserGroups) > 0 {
+		claims[claimUserGroups] = c.UserGroups
+	}
 	if c.APIKeyID != "" {
 		claims[claimAPIKey] = c.APIKeyID
 	}
@@ -125,6 +150,18 @@ func (c *jwtTokenClaims) asMap() map[string]any {
 	if c.HideUserPageSections > 0 {
 		claims[claimHideUserPageSection] = c.HideUserPageSections
 	}
+	if c.SessionExpiresAt > 0 {
+		claims[claimSessionExpiresAt] = c.SessionExpiresAt
+	}
+	if c.IDPProtocol != "" {
+		claims[claimIDPProtocol] = c.IDPProtocol
+	}
+	if c.MustAcceptConsents {
+		claims[claimMustAcceptConsents] = c.MustAcceptConsents
+	}
+	if c.SessionID != "" {
+		claims[claimSessionID] = c.SessionID
+	}
 
 	return claims
 }
@@ -188,6 +225,10 @@ func (c *jwtTokenClaims) Decode(token map[string]any) {
 		c.Role = c.decodeString(val)
 	}
 
+	if val, ok := token[claimUserGroups]; ok {
+		c.UserGroups = c.decodeSliceString(val)
+	}
+
 	permissions := token[claimPermissionsKey]
 	c.Permissions = c.decodeSliceString(permissions)
 
@@ -209,36 +250,209 @@ func (c *jwtTokenClaims) Decode(token map[string]any) {
 			c.HideUserPageSections = int(v)
 		}
 	}
+
+	if val, ok := token[claimSessionExpiresAt]; ok {
+		switch v := val.(type) {
+		case float64:
+			c.SessionExpiresAt = int64(v)
+		}
+	}
+
+	if val, ok := token[claimIDPProtocol]; ok {
+		c.IDPProtocol = c.decodeString(val)
+	}
+
+	if val, ok := token[claimMustAcceptConsents]; ok {
+		c.MustAcceptConsents = c.decodeBoolean(val)
+	}
+
+	if val, ok := token[claimSessionID]; ok {
+		c.SessionID = c.decodeString(val)
+	}
 }
 
-func (c *jwtTokenClaims) isCriticalPermRemoved(permissions []string) bool {
-	if util.Contains(permissions, dataprovider.PermAdminAny) {
+// getTokenExpiration returns the expiration for a new token, limited
+// by the session expiration if any
+func (c *jwtTokenClaims) getTokenExpiration(now time.Time, duration time.Duration) time.Time {
+	expiration := now.Add(duration)
+	if c.SessionExpiresAt > 0 {
+		sessionExpiration := util.GetTimeFromMsecSinceEpoch(c.SessionExpiresAt)
+		if sessionExpiration.Before(expiration) {
+			return sessionExpiration
+		}
+	}
+	return expiration
+}
+
+// isCriticalPermRemoved returns true if the permissions to manage admins are
+// removed. The effective permissions, including the admin role ones, are checked
+func (c *jwtTokenClaims) isCriticalPermRemoved(admin *dataprovider.Admin) bool {
+	permissions, _, err := admin.GetAccessSettings()
+	if err != nil {
+		// the update will fail anyway, the admin role does not exist
 		return false
 	}
-	if (util.Contains(c.Permissions, dataprovider.PermAdminManageAdmins) ||
-		util.Contains(c.Permissions, dataprovider.PermAdminAny)) &&
-		!util.Contains(permissions, dataprovider.PermAdminManageAdmins) &&
-		!util.Contains(permissions, dataprovider.PermAdminAny) {
-		return true
+	if util.Contains(permissions, dataprovider.PermAdminAny) {
+		return false
 	}
-	return false
+	return dataprovider.HasAdminPermission(c.Permissions, dataprovider.PermAdminAdminsUpdate) &&
+		!dataprovider.HasAdminPermission(permissions, dataprovider.PermAdminAdminsUpdate)
 }
 
 func (c *jwtTokenClaims) hasPerm(perm string) bool {
-	if util.Contains(c.Permissions, dataprovider.PermAdminAny) {
-		return true
+	return dataprovider.HasAdminPermission(c.Permissions, perm)
+}
+
+// isUserInScope returns true if the admin can manage the specified user
+func (c *jwtTokenClaims) isUserInScope(user *dataprovider.User) bool {
+	return dataprovider.IsUserInAdminScope(user, c.UserGroups)
+}
+
+// checkUserScope returns a validation error if the admin cannot assign the
+// groups set for the specified user
+func (c *jwtTokenClaims) checkUserScope(user *dataprovider.User) error {
+	if !c.isUserInScope(user) {
+		return util.NewValidationError(fmt.Sprintf("the user must be a member of at least one of the following groups: %q",
+			strings.Join(c.UserGroups, ",")))
 	}
+	return nil
+}
 
-	return util.Contains(c.Permissions, perm)
+// getUser returns the user with the specified username if the admin can manage it
+func (c *jwtTokenClaims) getUser(username string) (dataprovider.User, error) {
+	user, err := dataprovider.UserExists(username, c.Role)
+	if err != nil {
+		return user, err
+	}
+	if !c.isUserInScope(&user) {
+		return dataprovider.User{}, util.NewRecordNotFoundError(fmt.Sprintf("username %q does not exist", username))
+	}
+	return user, nil
+}
+
+// getUserWithGroupSettings is like getUser but the group settings are applied
+func (c *jwtTokenClaims) getUserWithGroupSettings(username string) (dataprovider.User, error) {
+	user, err := dataprovider.GetUserWithGroupSettings(username, c.Role)
+	if err != nil {
+		return user, err
+	}
+	if !c.isUserInScope(&user) {
+		return dataprovider.User{}, util.NewRecordNotFoundError(fmt.Sprintf("username %q does not exist", username))
+	}
+	return user, nil
+}
+
+// filterUsersInScope removes the users the admin cannot manage
+func (c *jwtTokenClaims) filterUsersInScope(users []dataprovider.User) []dataprovider.User {
+	if len(c.UserGroups) == 0 {
+		return users
+	}
+	result := make([]dataprovider.User, 0, len(users))
+	for idx := range users {
+		if c.isUserInScope(&users[idx]) {
+			result = append(result, users[idx])
+		}
+	}
+	return result
+}
+
+// getUsers returns the users the admin can manage. If the admin is restricted
+// to some user groups, the provider is queried in batches and the pagination
+// is applied after filtering, so the returned pages are always complete
+func (c *jwtTokenClaims) getUsers(limit, offset int, order string) ([]dataprovider.User, error) {
+	if len(c.UserGroups) == 0 {
+		return dataprovider.GetUsers(limit, offset, order, c.Role)
+	}
+	batchSize := limit
+	if batchSize < defaultQueryLimit {
+		batchSize = defaultQueryLimit
+	}
+	result := make([]dataprovider.User, 0, limit)
+	skipped := 0
+	for providerOffset := 0; ; providerOffset += batchSize {
+		users, err := dataprovider.GetUsers(batchSize, providerOffset, order, c.Role)
+		if err != nil {
+			return nil, err
+		}
+		for idx := range users {
+			if !c.isUserInScope(&users[idx]) {
+				continue
+			}
+			if skipped < offset {
+				skipped++
+				continue
+			}
+			result = append(result, users[idx])
+			if len(result) == limit {
+				return result, nil
+			}
+		}
+		if len(users) < batchSize {
+			return result, nil
+		}
+	}
+}
+
+// getGroup returns the group with the specified name if the admin can manage it,
+// role admins can only manage the groups owned by their role
+func (c *jwtTokenClaims) getGroup(name string) (dataprovider.Group, error) {
+	group, err := dataprovider.GroupExists(name)
+	if err != nil {
+		return group, err
+	}
+	if c.Role != "" && group.Role != c.Role {
+		return dataprovider.Group{}, util.NewRecordNotFoundError(fmt.Sprintf("group %q does not exist", name))
+	}
+	return group, nil
+}
+
+// getFolder returns the folder with the specified name if the admin can manage it,
+// role admins can only manage the folders owned by their role
+func (c *jwtTokenClaims) getFolder(name string) (vfs.BaseVirtualFolder, error) {
+	folder, err := dataprovider.GetFolderByName(name)
+	if err != nil {
+		return folder, err
+	}
+	if c.Role != "" && folder.Role != c.Role {
+		return vfs.BaseVirtualFolder{}, util.NewRecordNotFoundError(fmt.Sprintf("folder %q does not exist", name))
+	}
+	return folder, nil
+}
+
+// getEventRule returns the event rule with the specified name if the admin can
+// manage it, role admins can only manage the rules owned by their role
+func (c *jwtTokenClaims) getEventRule(name string) (dataprovider.EventRule, error) {
+	rule, err := dataprovider.EventRuleExists(name)
+	if err != nil {
+		return rule, err
+	}
+	if c.Role != "" && rule.Role != c.Role {
+		return dataprovider.EventRule{}, util.NewRecordNotFoundError(fmt.Sprintf("event rule %q does not exist", name))
+	}
+	return rule, nil
+}
+
+// setAdminAccessSettings sets the effective permissions and the managed
+// users restrictions for the specified admin
+func (c *jwtTokenClaims) setAdminAccessSettings(admin *dataprovider.Admin) error {
+	permissions, userGroups, err := admin.GetAccessSettings()
+	if err != nil {
+		return err
+	}
+	c.Permissions = permissions
+	c.UserGroups = userGroups
+	return nil
 }
 
 func (c *jwtTokenClaims) createToken(tokenAuth *jwtauth.JWTAuth, audience tokenAudience, ip string) (jwt.Token, string, error) {
-	claims := c.asMap()
 	now := time.Now().UTC()
+	expiration := c.getTokenExpiration(now, tokenDuration)
+	c.trackWebSession(audience, ip, expiration)
+	claims := c.asMap()
 
 	claims[jwt.JwtIDKey] = xid.New().String()
 	claims[jwt.NotBeforeKey] = now.Add(-30 * time.Second)
-	claims[jwt.ExpirationKey] = now.Add(tokenDuration)
+	claims[jwt.ExpirationKey] = expiration
 	claims[jwt.AudienceKey] = []string{audience, ip, tokenAudienceAPIUser}
 
 	return tokenAuth.Encode(claims)
@@ -274,11 +488,13 @@ func (c *jwtTokenClaims) createAndSetCookie(w http.ResponseWriter, r *http.Reque
 	if audience == tokenAudienceWebShare {
 		duration = shareTokenDuration
 	}
+	expiration := c.getTokenExpiration(time.Now(), duration)
+	duration = time.Until(expiration)
 	http.SetCookie(w, &http.Cookie{
 		Name:     jwtCookieKey,
 		Value:    resp["access_token"].(string),
 		Path:     basePath,
-		Expires:  time.Now().Add(duration),
+		Expires:  expiration,
 		MaxAge:   int(duration / time.Second),
 		HttpOnly: true,
 		Secure:   isTLS(r),
@@ -342,6 +558,13 @@ func isTokenInvalidated(r *http.Request) bool {
 }
 
 func invalidateToken(r *http.Request) {
+	if _, claims, err := jwtauth.FromContext(r.Context()); err == nil {
+		if sessionID, ok := claims[claimSessionID].(string); ok && sessionID != "" {
+			if err := revokeWebSession(sessionID); err != nil {
+				logger.Warn(logSender, "", "unable to revoke session %q: %v", sessionID, err)
+			}
+		}
+	}
 	tokenString := jwtauth.TokenFromHeader(r)
 	if tokenString != "" {
 		invalidatedJWTTokens.Store(tokenString, time.Now().Add(tokenDuration).UTC())
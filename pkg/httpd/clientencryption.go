@@ -0,0 +1,77 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	clientEncryptionVersion = 1
+)
+
+var (
+	// clientEncryptionMarker is the prefix of the files encrypted by the WebClient
+	clientEncryptionMarker = []byte("SFTPGOE2")
+)
+
+// getClientEncryptedReader returns the reader to use to store the specified upload.
+// If the upload path is inside a client side encrypted folder the content must start
+// with the encryption marker, this way the server never stores plain text data
+// uploaded using the HTTP interfaces inside these folders
+func getClientEncryptedReader(user *dataprovider.User, filePath string, reader io.Reader) (io.Reader, error) {
+	if user.GetClientEncryptedFolder(filePath) == "" {
+		return reader, nil
+	}
+	header := make([]byte, len(clientEncryptionMarker)+1)
+	n, err := io.ReadFull(reader, header)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	if n < len(header) || !bytes.Equal(header[:len(clientEncryptionMarker)], clientEncryptionMarker) ||
+		header[len(clientEncryptionMarker)] != clientEncryptionVersion {
+		return nil, util.NewValidationError(fmt.Sprintf("%q is inside a client encrypted folder, only files encrypted by the WebClient are allowed",
+			filePath))
+	}
+	return io.MultiReader(bytes.NewReader(header), reader), nil
+}
+
+func getClientEncryptionErrorStatus(err error) int {
+	if errors.Is(err, util.ErrValidation) {
+		return http.StatusBadRequest
+	}
+	return getMappedStatusCode(err)
+}
+
+// getShareClientEncryptedFolder returns the client side encrypted folder that
+// includes all the shared paths, if any
+func getShareClientEncryptedFolder(user *dataprovider.User, share *dataprovider.Share) string {
+	var result string
+	for idx, p := range share.Paths {
+		folder := user.GetClientEncryptedFolder(p)
+		if folder == "" || (idx > 0 && folder != result) {
+			return ""
+		}
+		result = folder
+	}
+	return result
+}
@@ -83,9 +83,9 @@ func (f *httpdFile) Write(p []byte) (n int, err error) {
 	}
 
 	f.Connection.UpdateLastActivity()
-
-	n, err = f.writer.Write(p)
+	n, err = f.WriteUploadContent(f.writer, p)
 	f.BytesReceived.Add(int64(n))
+	f.UpdateChecksum(p[:n], -1)
 
 	if err == nil {
 		err = f.CheckWrite()
@@ -104,6 +104,12 @@ func (f *httpdFile) Close() error {
 	if err := f.setFinished(); err != nil {
 		return err
 	}
+	if f.writer != nil {
+		// the data buffered to detect the content type must be written before closing
+		if err := f.FlushUploadContent(f.writer); err != nil {
+			f.TransferError(err)
+		}
+	}
 	err := f.closeIO()
 	errBaseClose := f.BaseTransfer.Close()
 	if errBaseClose != nil {
@@ -0,0 +1,947 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/go-chi/render"
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/sftpgo/sdk/plugin/eventsearcher"
+
+	"github.com/drakkan/sftpgo/v2/pkg/common"
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/plugin"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+const (
+	graphQLMaxDepth       = 10
+	graphQLMaxParallelism = 10
+	graphQLMaxLimit       = 500
+)
+
+const graphQLSchemaString = `
+schema {
+	query: Query
+}
+
+"64-bit signed integer, used for sizes and unix timestamps in milliseconds"
+scalar Int64
+
+enum Order {
+	ASC
+	DESC
+}
+
+type Query {
+	"Requires the view_users permission"
+	users(limit: Int = 100, offset: Int = 0, order: Order = ASC): [User!]!
+	"Requires the view_users permission"
+	user(username: String!): User
+	"Requires the manage_groups permission"
+	groups(limit: Int = 100, offset: Int = 0, order: Order = ASC): [Group!]!
+	"Requires the manage_groups permission"
+	group(name: String!): Group
+	"Requires the view_users permission"
+	folders(limit: Int = 100, offset: Int = 0, order: Order = ASC): [Folder!]!
+	"Requires the view_users permission"
+	folder(name: String!): Folder
+	"Requires the view_conns permission"
+	connections: [Connection!]!
+	"Requires the view_events permission and an event searcher plugin"
+	fsEvents(filter: FsEventFilter): [FsEvent!]!
+	"Requires the view_events permission and an event searcher plugin"
+	providerEvents(filter: ProviderEventFilter): [ProviderEvent!]!
+}
+
+type User {
+	id: Int64!
+	username: String!
+	status: Int!
+	email: String!
+	description: String!
+	role: String!
+	homeDir: String!
+	maxSessions: Int!
+	expirationDate: Int64!
+	lastLogin: Int64!
+	createdAt: Int64!
+	updatedAt: Int64!
+	permissions: [DirectoryPermissions!]!
+	quota: Quota!
+	folders: [VirtualFolder!]!
+	groups: [GroupMapping!]!
+	"Requires the view_users permission"
+	shares(limit: Int = 100, offset: Int = 0, order: Order = ASC): [Share!]!
+	"Requires the view_conns permission"
+	connections: [Connection!]!
+}
+
+type DirectoryPermissions {
+	path: String!
+	permissions: [String!]!
+}
+
+type Quota {
+	size: Int64!
+	files: Int!
+	usedSize: Int64!
+	usedFiles: Int!
+	lastUpdate: Int64!
+	"Data transfer limits as MB, 0 means unlimited"
+	uploadDataTransfer: Int64!
+	downloadDataTransfer: Int64!
+	totalDataTransfer: Int64!
+	"Used data transfer as bytes"
+	usedUploadDataTransfer: Int64!
+	usedDownloadDataTransfer: Int64!
+}
+
+type GroupMapping {
+	name: String!
+	type: Int!
+	"Requires the manage_groups permission"
+	group: Group
+}
+
+type Group {
+	id: Int64!
+	name: String!
+	description: String!
+	createdAt: Int64!
+	updatedAt: Int64!
+	users: [String!]!
+	folders: [VirtualFolder!]!
+}
+
+type VirtualFolder {
+	virtualPath: String!
+	quotaSize: Int64!
+	quotaFiles: Int!
+	folder: Folder!
+}
+
+type Folder {
+	id: Int64!
+	name: String!
+	description: String!
+	mappedPath: String!
+	usedQuotaSize: Int64!
+	usedQuotaFiles: Int!
+	lastQuotaUpdate: Int64!
+	users: [String!]!
+	groups: [String!]!
+}
+
+type Share {
+	id: String!
+	name: String!
+	description: String!
+	scope: Int!
+	paths: [String!]!
+	username: String!
+	createdAt: Int64!
+	updatedAt: Int64!
+	lastUseAt: Int64!
+	expiresAt: Int64!
+	maxTokens: Int!
+	usedTokens: Int!
+	allowFrom: [String!]!
+}
+
+type Connection {
+	connectionId: String!
+	username: String!
+	clientVersion: String!
+	remoteAddress: String!
+	connectionTime: Int64!
+	lastActivity: Int64!
+	protocol: String!
+	command: String!
+	node: String!
+	transfers: [Transfer!]!
+}
+
+type Transfer {
+	operationType: String!
+	startTime: Int64!
+	size: Int64!
+	path: String!
+}
+
+input FsEventFilter {
+	"Unix timestamp in nanoseconds"
+	startTimestamp: Int64
+	"Unix timestamp in nanoseconds"
+	endTimestamp: Int64
+	actions: [String!]
+	username: String
+	ip: String
+	sshCmd: String
+	protocols: [String!]
+	statuses: [Int!]
+	limit: Int = 100
+	order: Order = DESC
+}
+
+type FsEvent {
+	id: String!
+	"Unix timestamp in nanoseconds"
+	timestamp: Int64!
+	action: String!
+	username: String!
+	virtualPath: String!
+	virtualTargetPath: String!
+	sshCmd: String!
+	fileSize: Int64!
+	elapsed: Int64!
+	status: Int!
+	protocol: String!
+	ip: String!
+	sessionId: String!
+	role: String!
+	instanceId: String!
+}
+
+input ProviderEventFilter {
+	"Unix timestamp in nanoseconds"
+	startTimestamp: Int64
+	"Unix timestamp in nanoseconds"
+	endTimestamp: Int64
+	actions: [String!]
+	username: String
+	ip: String
+	objectName: String
+	objectTypes: [String!]
+	limit: Int = 100
+	order: Order = DESC
+}
+
+type ProviderEvent {
+	id: String!
+	"Unix timestamp in nanoseconds"
+	timestamp: Int64!
+	action: String!
+	username: String!
+	ip: String!
+	objectType: String!
+	objectName: String!
+	role: String!
+	instanceId: String!
+}
+`
+
+type graphQLContextKey struct{}
+
+var (
+	graphQLClaimsKey = &graphQLContextKey{}
+	graphQLSchema    = graphql.MustParseSchema(graphQLSchemaString, &graphQLResolver{},
+		graphql.MaxDepth(graphQLMaxDepth), graphql.MaxParallelism(graphQLMaxParallelism),
+		graphql.Logger(&graphQLLogger{}))
+)
+
+type graphQLLogger struct{}
+
+func (l *graphQLLogger) LogPanic(_ context.Context, value any) {
+	logger.Error(logSender, "", "panic while executing GraphQL query: %v", value)
+}
+
+type graphQLRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+func handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	var req graphQLRequest
+	if r.Method == http.MethodGet {
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if variables := r.URL.Query().Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+				sendAPIResponse(w, r, err, "Invalid variables", http.StatusBadRequest)
+				return
+			}
+		}
+	} else {
+		if err := render.DecodeJSON(r.Body, &req); err != nil {
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Query == "" {
+		sendAPIResponse(w, r, nil, "Query is mandatory", http.StatusBadRequest)
+		return
+	}
+	ctx := context.WithValue(r.Context(), graphQLClaimsKey, &claims)
+	render.JSON(w, r, graphQLSchema.Exec(ctx, req.Query, req.OperationName, req.Variables))
+}
+
+func checkGraphQLPerm(ctx context.Context, perm string) (*jwtTokenClaims, error) {
+	claims, ok := ctx.Value(graphQLClaimsKey).(*jwtTokenClaims)
+	if !ok || claims == nil {
+		return nil, errors.New("invalid token claims")
+	}
+	if !claims.hasPerm(perm) {
+		return nil, fmt.Errorf("permission denied, %q is required", perm)
+	}
+	return claims, nil
+}
+
+// graphQLInt64 implements the Int64 custom scalar, GraphQL Int is 32-bit only
+type graphQLInt64 int64
+
+func (graphQLInt64) ImplementsGraphQLType(name string) bool {
+	return name == "Int64"
+}
+
+func (v *graphQLInt64) UnmarshalGraphQL(input any) error {
+	switch val := input.(type) {
+	case int32:
+		*v = graphQLInt64(val)
+	case int64:
+		*v = graphQLInt64(val)
+	case float64:
+		*v = graphQLInt64(val)
+	case string:
+		parsed, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid Int64 value %q: %w", val, err)
+		}
+		*v = graphQLInt64(parsed)
+	default:
+		return fmt.Errorf("invalid Int64 value %v", input)
+	}
+	return nil
+}
+
+func (v graphQLInt64) MarshalJSON() ([]byte, error) {
+	return strconv.AppendInt(nil, int64(v), 10), nil
+}
+
+type graphQLListArgs struct {
+	Limit  int32
+	Offset int32
+	Order  string
+}
+
+func (a *graphQLListArgs) validate() error {
+	if a.Limit < 1 || a.Limit > graphQLMaxLimit {
+		return util.NewValidationError(fmt.Sprintf("limit is out of the 1-%d range: %d", graphQLMaxLimit, a.Limit))
+	}
+	if a.Offset < 0 {
+		return util.NewValidationError(fmt.Sprintf("invalid offset: %d", a.Offset))
+	}
+	return nil
+}
+
+type graphQLResolver struct{}
+
+func (r *graphQLResolver) Users(ctx context.Context, args graphQLListArgs) ([]*graphQLUserResolver, error) {
+	claims, err := checkGraphQLPerm(ctx, dataprovider.PermAdminViewUsers)
+	if err != nil {
+		return nil, err
+	}
+	if err := args.validate(); err != nil {
+		return nil, err
+	}
+	users, err := claims.getUsers(int(args.Limit), int(args.Offset), args.Order)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*graphQLUserResolver, 0, len(users))
+	for _, user := range users {
+		result = append(result, &graphQLUserResolver{user: user})
+	}
+	return result, nil
+}
+
+func (r *graphQLResolver) User(ctx context.Context, args struct{ Username string }) (*graphQLUserResolver, error) {
+	claims, err := checkGraphQLPerm(ctx, dataprovider.PermAdminViewUsers)
+	if err != nil {
+		return nil, err
+	}
+	user, err := claims.getUser(args.Username)
+	if err != nil {
+		if errors.Is(err, util.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &graphQLUserResolver{user: user}, nil
+}
+
+func (r *graphQLResolver) Groups(ctx context.Context, args graphQLListArgs) ([]*graphQLGroupResolver, error) {
+	claims, err := checkGraphQLPerm(ctx, dataprovider.PermAdminGroupsRead)
+	if err != nil {
+		return nil, err
+	}
+	if err := args.validate(); err != nil {
+		return nil, err
+	}
+	groups, err := dataprovider.GetGroups(int(args.Limit), int(args.Offset), args.Order, false, claims.Role)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*graphQLGroupResolver, 0, len(groups))
+	for _, group := range groups {
+		result = append(result, &graphQLGroupResolver{group: group})
+	}
+	return result, nil
+}
+
+func (r *graphQLResolver) Group(ctx context.Context, args struct{ Name string }) (*graphQLGroupResolver, error) {
+	return getGraphQLGroup(ctx, args.Name)
+}
+
+func (r *graphQLResolver) Folders(ctx context.Context, args graphQLListArgs) ([]*graphQLFolderResolver, error) {
+	claims, err := checkGraphQLPerm(ctx, dataprovider.PermAdminFoldersRead)
+	if err != nil {
+		return nil, err
+	}
+	if err := args.validate(); err != nil {
+		return nil, err
+	}
+	folders, err := dataprovider.GetFolders(int(args.Limit), int(args.Offset), args.Order, false, claims.Role)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*graphQLFolderResolver, 0, len(folders))
+	for _, folder := range folders {
+		result = append(result, &graphQLFolderResolver{folder: folder, isComplete: true})
+	}
+	return result, nil
+}
+
+func (r *graphQLResolver) Folder(ctx context.Context, args struct{ Name string }) (*graphQLFolderResolver, error) {
+	claims, err := checkGraphQLPerm(ctx, dataprovider.PermAdminFoldersRead)
+	if err != nil {
+		return nil, err
+	}
+	folder, err := claims.getFolder(args.Name)
+	if err != nil {
+		if errors.Is(err, util.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &graphQLFolderResolver{folder: folder, isComplete: true}, nil
+}
+
+func (r *graphQLResolver) Connections(ctx context.Context) ([]*graphQLConnectionResolver, error) {
+	return getGraphQLConnections(ctx, "")
+}
+
+func (r *graphQLResolver) FsEvents(ctx context.Context, args struct{ Filter *graphQLFsEventFilter }) ([]*graphQLFsEventResolver, error) {
+	claims, err := checkGraphQLPerm(ctx, dataprovider.PermAdminViewEvents)
+	if err != nil {
+		return nil, err
+	}
+	filter := args.Filter
+	if filter == nil {
+		filter = &graphQLFsEventFilter{Limit: 100, Order: dataprovider.OrderDESC}
+	}
+	search, err := filter.toSearch(claims.Role)
+	if err != nil {
+		return nil, err
+	}
+	data, err := plugin.Handler.SearchFsEvents(&search)
+	if err != nil {
+		return nil, err
+	}
+	var events []fsEvent
+	if err := json.Unmarshal(data, &events); err != nil {
+		return nil, err
+	}
+	result := make([]*graphQLFsEventResolver, 0, len(events))
+	for idx := range events {
+		result = append(result, &graphQLFsEventResolver{event: &events[idx]})
+	}
+	return result, nil
+}
+
+func (r *graphQLResolver) ProviderEvents(ctx context.Context, args struct{ Filter *graphQLProviderEventFilter },
+) ([]*graphQLProviderEventResolver, error) {
+	claims, err := checkGraphQLPerm(ctx, dataprovider.PermAdminViewEvents)
+	if err != nil {
+		return nil, err
+	}
+	filter := args.Filter
+	if filter == nil {
+		filter = &graphQLProviderEventFilter{Limit: 100, Order: dataprovider.OrderDESC}
+	}
+	search, err := filter.toSearch(claims.Role)
+	if err != nil {
+		return nil, err
+	}
+	data, err := plugin.Handler.SearchProviderEvents(&search)
+	if err != nil {
+		return nil, err
+	}
+	var events []providerEvent
+	if err := json.Unmarshal(data, &events); err != nil {
+		return nil, err
+	}
+	result := make([]*graphQLProviderEventResolver, 0, len(events))
+	for idx := range events {
+		result = append(result, &graphQLProviderEventResolver{event: &events[idx]})
+	}
+	return result, nil
+}
+
+func getGraphQLGroup(ctx context.Context, name string) (*graphQLGroupResolver, error) {
+	claims, err := checkGraphQLPerm(ctx, dataprovider.PermAdminGroupsRead)
+	if err != nil {
+		return nil, err
+	}
+	group, err := claims.getGroup(name)
+	if err != nil {
+		if errors.Is(err, util.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &graphQLGroupResolver{group: group}, nil
+}
+
+func getGraphQLConnections(ctx context.Context, username string) ([]*graphQLConnectionResolver, error) {
+	claims, err := checkGraphQLPerm(ctx, dataprovider.PermAdminViewConnections)
+	if err != nil {
+		return nil, err
+	}
+	stats := common.Connections.GetStats(claims.Role)
+	stats = append(stats, getNodesConnections(claims.Username, claims.Role)...)
+	result := make([]*graphQLConnectionResolver, 0, len(stats))
+	for idx := range stats {
+		if username != "" && stats[idx].Username != username {
+			continue
+		}
+		result = append(result, &graphQLConnectionResolver{conn: &stats[idx]})
+	}
+	return result, nil
+}
+
+func getGraphQLVirtualFolders(folders []vfs.VirtualFolder) []*graphQLVirtualFolderResolver {
+	result := make([]*graphQLVirtualFolderResolver, 0, len(folders))
+	for idx := range folders {
+		result = append(result, &graphQLVirtualFolderResolver{folder: &folders[idx]})
+	}
+	return result
+}
+
+func getGraphQLStrings(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+func getGraphQLNullableString(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+func getGraphQLStatuses(statuses *[]int32) []int32 {
+	if statuses == nil {
+		return nil
+	}
+	return *statuses
+}
+
+func getGraphQLStringsFilter(values *[]string) []string {
+	if values == nil {
+		return nil
+	}
+	return *values
+}
+
+type graphQLUserResolver struct {
+	user dataprovider.User
+}
+
+func (u *graphQLUserResolver) ID() graphQLInt64            { return graphQLInt64(u.user.ID) }
+func (u *graphQLUserResolver) Username() string            { return u.user.Username }
+func (u *graphQLUserResolver) Status() int32               { return int32(u.user.Status) }
+func (u *graphQLUserResolver) Email() string               { return u.user.Email }
+func (u *graphQLUserResolver) Description() string         { return u.user.Description }
+func (u *graphQLUserResolver) Role() string                { return u.user.Role }
+func (u *graphQLUserResolver) HomeDir() string             { return u.user.HomeDir }
+func (u *graphQLUserResolver) MaxSessions() int32          { return int32(u.user.MaxSessions) }
+func (u *graphQLUserResolver) LastLogin() graphQLInt64     { return graphQLInt64(u.user.LastLogin) }
+func (u *graphQLUserResolver) CreatedAt() graphQLInt64     { return graphQLInt64(u.user.CreatedAt) }
+func (u *graphQLUserResolver) UpdatedAt() graphQLInt64     { return graphQLInt64(u.user.UpdatedAt) }
+func (u *graphQLUserResolver) Quota() *graphQLUserResolver { return u }
+
+func (u *graphQLUserResolver) ExpirationDate() graphQLInt64 {
+	return graphQLInt64(u.user.ExpirationDate)
+}
+
+func (u *graphQLUserResolver) Permissions() []*graphQLPermissionsResolver {
+	result := make([]*graphQLPermissionsResolver, 0, len(u.user.Permissions))
+	for dir, perms := range u.user.Permissions {
+		result = append(result, &graphQLPermissionsResolver{path: dir, permissions: perms})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].path < result[j].path
+	})
+	return result
+}
+
+func (u *graphQLUserResolver) Folders() []*graphQLVirtualFolderResolver {
+	return getGraphQLVirtualFolders(u.user.VirtualFolders)
+}
+
+func (u *graphQLUserResolver) Groups() []*graphQLGroupMappingResolver {
+	result := make([]*graphQLGroupMappingResolver, 0, len(u.user.Groups))
+	for _, g := range u.user.Groups {
+		result = append(result, &graphQLGroupMappingResolver{name: g.Name, groupType: g.Type})
+	}
+	return result
+}
+
+func (u *graphQLUserResolver) Shares(ctx context.Context, args graphQLListArgs) ([]*graphQLShareResolver, error) {
+	if _, err := checkGraphQLPerm(ctx, dataprovider.PermAdminViewUsers); err != nil {
+		return nil, err
+	}
+	if err := args.validate(); err != nil {
+		return nil, err
+	}
+	shares, err := dataprovider.GetShares(int(args.Limit), int(args.Offset), args.Order, u.user.Username)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*graphQLShareResolver, 0, len(shares))
+	for idx := range shares {
+		result = append(result, &graphQLShareResolver{share: &shares[idx]})
+	}
+	return result, nil
+}
+
+func (u *graphQLUserResolver) Connections(ctx context.Context) ([]*graphQLConnectionResolver, error) {
+	return getGraphQLConnections(ctx, u.user.Username)
+}
+
+// quota fields, the Quota type is resolved by the user resolver itself
+
+func (u *graphQLUserResolver) Size() graphQLInt64       { return graphQLInt64(u.user.QuotaSize) }
+func (u *graphQLUserResolver) Files() int32             { return int32(u.user.QuotaFiles) }
+func (u *graphQLUserResolver) UsedSize() graphQLInt64   { return graphQLInt64(u.user.UsedQuotaSize) }
+func (u *graphQLUserResolver) UsedFiles() int32         { return int32(u.user.UsedQuotaFiles) }
+func (u *graphQLUserResolver) LastUpdate() graphQLInt64 { return graphQLInt64(u.user.LastQuotaUpdate) }
+
+func (u *graphQLUserResolver) UploadDataTransfer() graphQLInt64 {
+	return graphQLInt64(u.user.UploadDataTransfer)
+}
+
+func (u *graphQLUserResolver) DownloadDataTransfer() graphQLInt64 {
+	return graphQLInt64(u.user.DownloadDataTransfer)
+}
+
+func (u *graphQLUserResolver) TotalDataTransfer() graphQLInt64 {
+	return graphQLInt64(u.user.TotalDataTransfer)
+}
+
+func (u *graphQLUserResolver) UsedUploadDataTransfer() graphQLInt64 {
+	return graphQLInt64(u.user.UsedUploadDataTransfer)
+}
+
+func (u *graphQLUserResolver) UsedDownloadDataTransfer() graphQLInt64 {
+	return graphQLInt64(u.user.UsedDownloadDataTransfer)
+}
+
+type graphQLPermissionsResolver struct {
+	path        string
+	permissions []string
+}
+
+func (p *graphQLPermissionsResolver) Path() string          { return p.path }
+func (p *graphQLPermissionsResolver) Permissions() []string { return getGraphQLStrings(p.permissions) }
+
+type graphQLGroupMappingResolver struct {
+	name      string
+	groupType int
+}
+
+func (g *graphQLGroupMappingResolver) Name() string { return g.name }
+func (g *graphQLGroupMappingResolver) Type() int32  { return int32(g.groupType) }
+
+func (g *graphQLGroupMappingResolver) Group(ctx context.Context) (*graphQLGroupResolver, error) {
+	return getGraphQLGroup(ctx, g.name)
+}
+
+type graphQLGroupResolver struct {
+	group dataprovider.Group
+}
+
+func (g *graphQLGroupResolver) ID() graphQLInt64        { return graphQLInt64(g.group.ID) }
+func (g *graphQLGroupResolver) Name() string            { return g.group.Name }
+func (g *graphQLGroupResolver) Description() string     { return g.group.Description }
+func (g *graphQLGroupResolver) CreatedAt() graphQLInt64 { return graphQLInt64(g.group.CreatedAt) }
+func (g *graphQLGroupResolver) UpdatedAt() graphQLInt64 { return graphQLInt64(g.group.UpdatedAt) }
+func (g *graphQLGroupResolver) Users() []string         { return getGraphQLStrings(g.group.Users) }
+
+func (g *graphQLGroupResolver) Folders() []*graphQLVirtualFolderResolver {
+	return getGraphQLVirtualFolders(g.group.VirtualFolders)
+}
+
+type graphQLVirtualFolderResolver struct {
+	folder *vfs.VirtualFolder
+}
+
+func (f *graphQLVirtualFolderResolver) VirtualPath() string { return f.folder.VirtualPath }
+func (f *graphQLVirtualFolderResolver) QuotaSize() graphQLInt64 {
+	return graphQLInt64(f.folder.QuotaSize)
+}
+func (f *graphQLVirtualFolderResolver) QuotaFiles() int32 { return int32(f.folder.QuotaFiles) }
+
+func (f *graphQLVirtualFolderResolver) Folder() *graphQLFolderResolver {
+	return &graphQLFolderResolver{folder: f.folder.BaseVirtualFolder}
+}
+
+type graphQLFolderResolver struct {
+	folder vfs.BaseVirtualFolder
+	// folders nested inside users and groups don't include the associated
+	// users and groups, they are loaded on demand
+	isComplete bool
+}
+
+func (f *graphQLFolderResolver) ID() graphQLInt64      { return graphQLInt64(f.folder.ID) }
+func (f *graphQLFolderResolver) Name() string          { return f.folder.Name }
+func (f *graphQLFolderResolver) Description() string   { return f.folder.Description }
+func (f *graphQLFolderResolver) MappedPath() string    { return f.folder.MappedPath }
+func (f *graphQLFolderResolver) UsedQuotaFiles() int32 { return int32(f.folder.UsedQuotaFiles) }
+
+func (f *graphQLFolderResolver) UsedQuotaSize() graphQLInt64 {
+	return graphQLInt64(f.folder.UsedQuotaSize)
+}
+
+func (f *graphQLFolderResolver) LastQuotaUpdate() graphQLInt64 {
+	return graphQLInt64(f.folder.LastQuotaUpdate)
+}
+
+func (f *graphQLFolderResolver) load() error {
+	if f.isComplete {
+		return nil
+	}
+	folder, err := dataprovider.GetFolderByName(f.folder.Name)
+	if err != nil {
+		return err
+	}
+	f.folder = folder
+	f.isComplete = true
+	return nil
+}
+
+func (f *graphQLFolderResolver) Users() ([]string, error) {
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return getGraphQLStrings(f.folder.Users), nil
+}
+
+func (f *graphQLFolderResolver) Groups() ([]string, error) {
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return getGraphQLStrings(f.folder.Groups), nil
+}
+
+type graphQLShareResolver struct {
+	share *dataprovider.Share
+}
+
+func (s *graphQLShareResolver) ID() string              { return s.share.ShareID }
+func (s *graphQLShareResolver) Name() string            { return s.share.Name }
+func (s *graphQLShareResolver) Description() string     { return s.share.Description }
+func (s *graphQLShareResolver) Scope() int32            { return int32(s.share.Scope) }
+func (s *graphQLShareResolver) Paths() []string         { return getGraphQLStrings(s.share.Paths) }
+func (s *graphQLShareResolver) Username() string        { return s.share.Username }
+func (s *graphQLShareResolver) CreatedAt() graphQLInt64 { return graphQLInt64(s.share.CreatedAt) }
+func (s *graphQLShareResolver) UpdatedAt() graphQLInt64 { return graphQLInt64(s.share.UpdatedAt) }
+func (s *graphQLShareResolver) LastUseAt() graphQLInt64 { return graphQLInt64(s.share.LastUseAt) }
+func (s *graphQLShareResolver) ExpiresAt() graphQLInt64 { return graphQLInt64(s.share.ExpiresAt) }
+func (s *graphQLShareResolver) MaxTokens() int32        { return int32(s.share.MaxTokens) }
+func (s *graphQLShareResolver) UsedTokens() int32       { return int32(s.share.UsedTokens) }
+func (s *graphQLShareResolver) AllowFrom() []string     { return getGraphQLStrings(s.share.AllowFrom) }
+
+type graphQLConnectionResolver struct {
+	conn *common.ConnectionStatus
+}
+
+func (c *graphQLConnectionResolver) ConnectionID() string  { return c.conn.ConnectionID }
+func (c *graphQLConnectionResolver) Username() string      { return c.conn.Username }
+func (c *graphQLConnectionResolver) ClientVersion() string { return c.conn.ClientVersion }
+func (c *graphQLConnectionResolver) RemoteAddress() string { return c.conn.RemoteAddress }
+func (c *graphQLConnectionResolver) Protocol() string      { return c.conn.Protocol }
+func (c *graphQLConnectionResolver) Command() string       { return c.conn.Command }
+func (c *graphQLConnectionResolver) Node() string          { return c.conn.Node }
+
+func (c *graphQLConnectionResolver) ConnectionTime() graphQLInt64 {
+	return graphQLInt64(c.conn.ConnectionTime)
+}
+
+func (c *graphQLConnectionResolver) LastActivity() graphQLInt64 {
+	return graphQLInt64(c.conn.LastActivity)
+}
+
+func (c *graphQLConnectionResolver) Transfers() []*graphQLTransferResolver {
+	result := make([]*graphQLTransferResolver, 0, len(c.conn.Transfers))
+	for idx := range c.conn.Transfers {
+		result = append(result, &graphQLTransferResolver{transfer: &c.conn.Transfers[idx]})
+	}
+	return result
+}
+
+type graphQLTransferResolver struct {
+	transfer *common.ConnectionTransfer
+}
+
+func (t *graphQLTransferResolver) OperationType() string   { return t.transfer.OperationType }
+func (t *graphQLTransferResolver) StartTime() graphQLInt64 { return graphQLInt64(t.transfer.StartTime) }
+func (t *graphQLTransferResolver) Size() graphQLInt64      { return graphQLInt64(t.transfer.Size) }
+func (t *graphQLTransferResolver) Path() string            { return t.transfer.VirtualPath }
+
+type graphQLFsEventFilter struct {
+	StartTimestamp *graphQLInt64
+	EndTimestamp   *graphQLInt64
+	Actions        *[]string
+	Username       *string
+	IP             *string
+	SSHCmd         *string
+	Protocols      *[]string
+	Statuses       *[]int32
+	Limit          int32
+	Order          string
+}
+
+func (f *graphQLFsEventFilter) toSearch(role string) (eventsearcher.FsEventSearch, error) {
+	params, err := getGraphQLCommonSearchParams(f.StartTimestamp, f.EndTimestamp, f.Username, f.IP, f.Limit,
+		f.Order, role)
+	if err != nil {
+		return eventsearcher.FsEventSearch{}, err
+	}
+	return eventsearcher.FsEventSearch{
+		CommonSearchParams: params,
+		Actions:            getGraphQLStringsFilter(f.Actions),
+		SSHCmd:             getGraphQLNullableString(f.SSHCmd),
+		Protocols:          getGraphQLStringsFilter(f.Protocols),
+		Statuses:           getGraphQLStatuses(f.Statuses),
+		FsProvider:         -1,
+	}, nil
+}
+
+type graphQLProviderEventFilter struct {
+	StartTimestamp *graphQLInt64
+	EndTimestamp   *graphQLInt64
+	Actions        *[]string
+	Username       *string
+	IP             *string
+	ObjectName     *string
+	ObjectTypes    *[]string
+	Limit          int32
+	Order          string
+}
+
+func (f *graphQLProviderEventFilter) toSearch(role string) (eventsearcher.ProviderEventSearch, error) {
+	params, err := getGraphQLCommonSearchParams(f.StartTimestamp, f.EndTimestamp, f.Username, f.IP, f.Limit,
+		f.Order, role)
+	if err != nil {
+		return eventsearcher.ProviderEventSearch{}, err
+	}
+	return eventsearcher.ProviderEventSearch{
+		CommonSearchParams: params,
+		Actions:            getGraphQLStringsFilter(f.Actions),
+		ObjectName:         getGraphQLNullableString(f.ObjectName),
+		ObjectTypes:        getGraphQLStringsFilter(f.ObjectTypes),
+		OmitObjectData:     true,
+	}, nil
+}
+
+func getGraphQLCommonSearchParams(startTimestamp, endTimestamp *graphQLInt64, username, ip *string, limit int32,
+	order, role string,
+) (eventsearcher.CommonSearchParams, error) {
+	c := eventsearcher.CommonSearchParams{
+		Limit:    int(limit),
+		Username: getGraphQLNullableString(username),
+		IP:       getGraphQLNullableString(ip),
+		Role:     role,
+	}
+	if limit < 1 || limit > 1000 {
+		return c, util.NewValidationError(fmt.Sprintf("limit is out of the 1-1000 range: %d", limit))
+	}
+	if order == dataprovider.OrderASC {
+		c.Order = 1
+	}
+	if startTimestamp != nil {
+		c.StartTimestamp = int64(*startTimestamp)
+	}
+	if endTimestamp != nil {
+		c.EndTimestamp = int64(*endTimestamp)
+	}
+	return c, nil
+}
+
+type graphQLFsEventResolver struct {
+	event *fsEvent
+}
+
+func (e *graphQLFsEventResolver) ID() string                { return e.event.ID }
+func (e *graphQLFsEventResolver) Timestamp() graphQLInt64   { return graphQLInt64(e.event.Timestamp) }
+func (e *graphQLFsEventResolver) Action() string            { return e.event.Action }
+func (e *graphQLFsEventResolver) Username() string          { return e.event.Username }
+func (e *graphQLFsEventResolver) VirtualPath() string       { return e.event.VirtualPath }
+func (e *graphQLFsEventResolver) VirtualTargetPath() string { return e.event.VirtualTargetPath }
+func (e *graphQLFsEventResolver) SSHCmd() string            { return e.event.SSHCmd }
+func (e *graphQLFsEventResolver) FileSize() graphQLInt64    { return graphQLInt64(e.event.FileSize) }
+func (e *graphQLFsEventResolver) Elapsed() graphQLInt64     { return graphQLInt64(e.event.Elapsed) }
+func (e *graphQLFsEventResolver) Status() int32             { return int32(e.event.Status) }
+func (e *graphQLFsEventResolver) Protocol() string          { return e.event.Protocol }
+func (e *graphQLFsEventResolver) IP() string                { return e.event.IP }
+func (e *graphQLFsEventResolver) SessionID() string         { return e.event.SessionID }
+func (e *graphQLFsEventResolver) Role() string              { return e.event.Role }
+func (e *graphQLFsEventResolver) InstanceID() string        { return e.event.InstanceID }
+
+type graphQLProviderEventResolver struct {
+	event *providerEvent
+}
+
+func (e *graphQLProviderEventResolver) ID() string { return e.event.ID }
+func (e *graphQLProviderEventResolver) Timestamp() graphQLInt64 {
+	return graphQLInt64(e.event.Timestamp)
+}
+func (e *graphQLProviderEventResolver) Action() string     { return e.event.Action }
+func (e *graphQLProviderEventResolver) Username() string   { return e.event.Username }
+func (e *graphQLProviderEventResolver) IP() string         { return e.event.IP }
+func (e *graphQLProviderEventResolver) ObjectType() string { return e.event.ObjectType }
+func (e *graphQLProviderEventResolver) ObjectName() string { return e.event.ObjectName }
+func (e *graphQLProviderEventResolver) Role() string       { return e.event.Role }
+func (e *graphQLProviderEventResolver) InstanceID() string { return e.event.InstanceID }
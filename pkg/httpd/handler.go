@@ -94,6 +94,14 @@ func (c *Connection) ReadDir(name string) ([]os.FileInfo, error) {
 	return c.ListDir(name)
 }
 
+// GetDirLister returns a lister for the directory entries, the entries are
+// read in chunks. The lister must be closed
+func (c *Connection) GetDirLister(name string) (*common.DirListerAt, error) {
+	c.UpdateLastActivity()
+
+	return c.BaseConnection.GetDirLister(name)
+}
+
 func (c *Connection) getFileReader(name string, offset int64, method string) (io.ReadCloser, error) {
 	c.UpdateLastActivity()
 
@@ -147,9 +155,9 @@ func (c *Connection) getFileWriter(name string) (io.WriteCloser, error) {
 	if err != nil {
 		return nil, err
 	}
-	filePath := p
-	if common.Config.IsAtomicUploadEnabled() && fs.IsAtomicUploadSupported() {
-		filePath = fs.GetAtomicUploadPath(p)
+	filePath, err := c.GetUploadFsPath(fs, p, name)
+	if err != nil {
+		return nil, err
 	}
 
 	stat, statErr := fs.Lstat(p)
@@ -175,6 +183,15 @@ func (c *Connection) getFileWriter(name string) (io.WriteCloser, error) {
 		return nil, c.GetPermissionDeniedError()
 	}
 
+	if err := c.CheckWORMProtection(name, stat); err != nil {
+		return nil, err
+	}
+
+	if c.IsStagedUpload(name) {
+		// the existing file is replaced when the staged upload is published
+		return c.handleUploadFile(fs, p, filePath, name, true, 0)
+	}
+
 	if common.Config.IsAtomicUploadEnabled() && fs.IsAtomicUploadSupported() {
 		_, _, err = fs.Rename(p, filePath)
 		if err != nil {
@@ -187,6 +204,117 @@ func (c *Connection) getFileWriter(name string) (io.WriteCloser, error) {
 	return c.handleUploadFile(fs, p, filePath, name, false, stat.Size())
 }
 
+// getUploadOffset returns the size of the specified file, this is the offset
+// to use to resume its upload. Users allowed to upload can resume their uploads
+// even if they cannot list the directory contents
+func (c *Connection) getUploadOffset(name string) (int64, error) {
+	c.UpdateLastActivity()
+
+	if !c.User.HasAnyPerm([]string{dataprovider.PermListItems, dataprovider.PermUpload}, path.Dir(name)) {
+		return 0, c.GetPermissionDeniedError()
+	}
+	fi, err := c.DoStat(name, 0, true)
+	if err != nil {
+		return 0, err
+	}
+	if !fi.Mode().IsRegular() {
+		return 0, c.GetOpUnsupportedError()
+	}
+	return fi.Size(), nil
+}
+
+// getResumeFileWriter returns a writer to continue the upload of the specified file
+// from the given offset. An offset of 0 starts a new upload. If the offset does not
+// match the size of the existing file errUploadOffsetMismatch is returned together
+// with the current size
+func (c *Connection) getResumeFileWriter(name string, offset int64) (io.WriteCloser, int64, error) {
+	c.UpdateLastActivity()
+
+	if offset == 0 {
+		w, err := c.getFileWriter(name)
+		return w, 0, err
+	}
+	if ok, _ := c.User.IsFileAllowed(name); !ok {
+		c.Log(logger.LevelWarn, "writing file %q is not allowed", name)
+		return nil, 0, c.GetPermissionDeniedError()
+	}
+	if c.User.GetClientEncryptedFolder(name) != "" || c.IsStagedUpload(name) {
+		c.Log(logger.LevelInfo, "upload resume is not supported for file %q", name)
+		return nil, 0, c.GetOpUnsupportedError()
+	}
+
+	fs, p, err := c.GetFsAndResolvedPath(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	filePath, err := c.GetUploadFsPath(fs, p, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := fs.Lstat(p)
+	if err != nil {
+		if fs.IsNotExist(err) {
+			return nil, 0, errUploadOffsetMismatch
+		}
+		c.Log(logger.LevelError, "error performing file stat %q: %+v", p, err)
+		return nil, 0, c.GetFsError(fs, err)
+	}
+	if !stat.Mode().IsRegular() {
+		c.Log(logger.LevelError, "attempted to resume the upload to a non regular file: %q", p)
+		return nil, 0, c.GetOpUnsupportedError()
+	}
+	if stat.Size() != offset {
+		return nil, stat.Size(), errUploadOffsetMismatch
+	}
+	if !c.User.HasPerm(dataprovider.PermOverwrite, path.Dir(name)) {
+		return nil, 0, c.GetPermissionDeniedError()
+	}
+	if err := c.CheckWORMProtection(name, stat); err != nil {
+		return nil, 0, err
+	}
+	w, err := c.handleResumeUploadFile(fs, p, filePath, name, stat.Size())
+	return w, stat.Size(), err
+}
+
+func (c *Connection) handleResumeUploadFile(fs vfs.Fs, resolvedPath, filePath, requestPath string, fileSize int64) (io.WriteCloser, error) {
+	diskQuota, transferQuota := c.HasSpace(false, false, requestPath)
+	if !diskQuota.HasSpace || !transferQuota.HasUploadSpace() {
+		c.Log(logger.LevelInfo, "denying file write due to quota limits")
+		return nil, common.ErrQuotaExceeded
+	}
+	maxWriteSize, err := c.GetMaxWriteSize(diskQuota, true, fileSize, fs.IsUploadResumeSupported())
+	if err != nil {
+		c.Log(logger.LevelDebug, "unable to get max write size: %v", err)
+		return nil, err
+	}
+	osFlags := os.O_WRONLY | os.O_APPEND
+	_, err = common.ExecutePreAction(c.BaseConnection, common.OperationPreUpload, resolvedPath, requestPath, fileSize, osFlags)
+	if err != nil {
+		c.Log(logger.LevelDebug, "upload for file %q denied by pre action: %v", requestPath, err)
+		return nil, c.GetPermissionDeniedError()
+	}
+
+	if common.Config.IsAtomicUploadEnabled() && fs.IsAtomicUploadSupported() {
+		_, _, err = fs.Rename(resolvedPath, filePath)
+		if err != nil {
+			c.Log(logger.LevelError, "error renaming existing file for atomic upload, source: %q, dest: %q, err: %+v",
+				resolvedPath, filePath, err)
+			return nil, c.GetFsError(fs, err)
+		}
+	}
+
+	file, w, cancelFn, err := fs.Create(filePath, osFlags, c.GetCreateChecks(requestPath, false))
+	if err != nil {
+		c.Log(logger.LevelError, "error opening existing file, source: %q, err: %+v", filePath, err)
+		return nil, c.GetFsError(fs, err)
+	}
+	c.Log(logger.LevelDebug, "resuming upload requested, file path %q initial size: %d", filePath, fileSize)
+
+	baseTransfer := common.NewBaseTransfer(file, c.BaseConnection, cancelFn, resolvedPath, filePath, requestPath,
+		common.TransferUpload, fileSize, fileSize, maxWriteSize, 0, false, fs, transferQuota)
+	return newHTTPDFile(baseTransfer, w, nil), nil
+}
+
 func (c *Connection) handleUploadFile(fs vfs.Fs, resolvedPath, filePath, requestPath string, isNewFile bool, fileSize int64) (io.WriteCloser, error) {
 	diskQuota, transferQuota := c.HasSpace(isNewFile, false, requestPath)
 	if !diskQuota.HasSpace || !transferQuota.HasUploadSpace() {
@@ -260,6 +388,10 @@ type throttledReader struct {
 	conn          *Connection
 	mu            sync.Mutex
 	errAbort      error
+	// bandwidth limit set by an administrator and the bytes read before it
+	adminLimit  int64
+	adminStart  time.Time
+	adminOffset int64
 }
 
 func (t *throttledReader) GetID() int64 {
@@ -315,6 +447,34 @@ func (t *throttledReader) HasSizeLimit() bool {
 	return false
 }
 
+func (t *throttledReader) SetBandwidthLimit(bandwidth int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.adminLimit = bandwidth
+	t.adminStart = time.Now()
+	t.adminOffset = t.bytesRead.Load()
+}
+
+func (t *throttledReader) GetBandwidthLimit() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.adminLimit
+}
+
+// getThrottleParams returns the wanted bandwidth, the throttling start time
+// and the bytes read before it
+func (t *throttledReader) getThrottleParams() (int64, time.Time, int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.adminLimit > 0 && t.adminLimit < t.limit {
+		return t.adminLimit, t.adminStart, t.adminOffset
+	}
+	return t.limit, t.start, 0
+}
+
 func (t *throttledReader) Truncate(_ string, _ int64) (int64, error) {
 	return 0, vfs.ErrVfsUnsupported
 }
@@ -336,9 +496,10 @@ func (t *throttledReader) Read(p []byte) (n int, err error) {
 	n, err = t.r.Read(p)
 	if t.limit > 0 {
 		t.bytesRead.Add(int64(n))
-		trasferredBytes := t.bytesRead.Load()
-		elapsed := time.Since(t.start).Nanoseconds() / 1000000
-		wantedElapsed := 1000 * (trasferredBytes / 1024) / t.limit
+		limit, start, offset := t.getThrottleParams()
+		trasferredBytes := t.bytesRead.Load() - offset
+		elapsed := time.Since(start).Nanoseconds() / 1000000
+		wantedElapsed := 1000 * (trasferredBytes / 1024) / limit
 		if wantedElapsed > elapsed {
 			toSleep := time.Duration(wantedElapsed - elapsed)
 			time.Sleep(toSleep * time.Millisecond)
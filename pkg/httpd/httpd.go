@@ -43,6 +43,7 @@ import (
 	"github.com/drakkan/sftpgo/v2/pkg/mfa"
 	"github.com/drakkan/sftpgo/v2/pkg/sftpd"
 	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
 	"github.com/drakkan/sftpgo/v2/pkg/webdavd"
 )
 
@@ -53,6 +54,8 @@ const (
 	userTokenPath                         = "/api/v2/user/token"
 	userLogoutPath                        = "/api/v2/user/logout"
 	activeConnectionsPath                 = "/api/v2/connections"
+	sessionsPath                          = "/api/v2/sessions"
+	registrationsPath                     = "/api/v2/registrations"
 	quotasBasePath                        = "/api/v2/quotas"
 	userPath                              = "/api/v2/users"
 	versionPath                           = "/api/v2/version"
@@ -72,6 +75,17 @@ const (
 	userStreamZipPath                     = "/api/v2/user/streamzip"
 	userUploadFilePath                    = "/api/v2/user/files/upload"
 	userFilesDirsMetadataPath             = "/api/v2/user/files/metadata"
+	userFilesChecksumPath                 = "/api/v2/user/files/checksum"
+	userSearchPath                        = "/api/v2/user/search"
+	userFileOperationsPath                = "/api/v2/user/file-operations"
+	userCopyPath                          = "/api/v2/user/copy"
+	userPullJobsPath                      = "/api/v2/user/pulls"
+	userArchiveJobsPath                   = "/api/v2/user/archives"
+	userStagingTxPath                     = "/api/v2/user/transactions"
+	userThumbnailsPath                    = "/api/v2/user/thumbs"
+	userStreamPath                        = "/api/v2/user/stream"
+	userWebSocketPath                     = "/api/v2/user/ws"
+	userFilesMetadataPath                 = "/api/v2/user/metadata"
 	apiKeysPath                           = "/api/v2/apikeys"
 	adminTOTPConfigsPath                  = "/api/v2/admin/totp/configs"
 	adminTOTPGeneratePath                 = "/api/v2/admin/totp/generate"
@@ -85,18 +99,34 @@ const (
 	user2FARecoveryCodesPath              = "/api/v2/user/2fa/recoverycodes"
 	userProfilePath                       = "/api/v2/user/profile"
 	userSharesPath                        = "/api/v2/user/shares"
+	userWebhooksPath                      = "/api/v2/user/webhooks"
 	retentionBasePath                     = "/api/v2/retention/users"
 	retentionChecksPath                   = "/api/v2/retention/users/checks"
+	retentionPoliciesPath                 = "/api/v2/retention/policies"
+	jobsPath                              = "/api/v2/jobs"
+	snapshotsPath                         = "/api/v2/snapshots"
+	userTemplatesPath                     = "/api/v2/usertemplates"
 	metadataBasePath                      = "/api/v2/metadata/users"
 	metadataChecksPath                    = "/api/v2/metadata/users/checks"
 	fsEventsPath                          = "/api/v2/events/fs"
 	providerEventsPath                    = "/api/v2/events/provider"
 	logEventsPath                         = "/api/v2/events/logs"
+	auditLogPath                          = "/api/v2/auditlog"
 	sharesPath                            = "/api/v2/shares"
 	eventActionsPath                      = "/api/v2/eventactions"
 	eventRulesPath                        = "/api/v2/eventrules"
 	rolesPath                             = "/api/v2/roles"
+	adminRolesPath                        = "/api/v2/adminroles"
 	ipListsPath                           = "/api/v2/iplists"
+	analyticsHeatmapPath                  = "/api/v2/analytics/heatmap"
+	analyticsStoragePath                  = "/api/v2/analytics/storage"
+	runtimeConfigPath                     = "/api/v2/runtimeconfig"
+	ftpDiagnosticsPath                    = "/api/v2/ftpdiagnostics"
+	debugCapturesPath                     = "/api/v2/debug-captures"
+	hostKeysPath                          = "/api/v2/hostkeys"
+	sshSecurityProfilePath                = "/api/v2/sshsecurityprofile"
+	publicKeysPath                        = "/api/v2/publickeys"
+	graphQLPath                           = "/api/v2/graphql"
 	healthzPath                           = "/healthz"
 	robotsTxtPath                         = "/robots.txt"
 	webRootPathDefault                    = "/"
@@ -106,7 +136,10 @@ const (
 	webAdminSetupPathDefault              = "/web/admin/setup"
 	webAdminLoginPathDefault              = "/web/admin/login"
 	webAdminOIDCLoginPathDefault          = "/web/admin/oidclogin"
+	webAdminSAMLLoginPathDefault          = "/web/admin/samllogin"
 	webOIDCRedirectPathDefault            = "/web/oidc/redirect"
+	webSAMLMetadataPathDefault            = "/web/saml/metadata"
+	webSAMLACSPathDefault                 = "/web/saml/acs"
 	webOAuth2RedirectPathDefault          = "/web/oauth2/redirect"
 	webOAuth2TokenPathDefault             = "/web/admin/oauth2/token"
 	webAdminTwoFactorPathDefault          = "/web/admin/twofactor"
@@ -115,6 +148,8 @@ const (
 	webUsersPathDefault                   = "/web/admin/users"
 	webUserPathDefault                    = "/web/admin/user"
 	webConnectionsPathDefault             = "/web/admin/connections"
+	webSessionsPathDefault                = "/web/admin/sessions"
+	webRegistrationsPathDefault           = "/web/admin/registrations"
 	webFoldersPathDefault                 = "/web/admin/folders"
 	webFolderPathDefault                  = "/web/admin/folder"
 	webGroupsPathDefault                  = "/web/admin/groups"
@@ -138,6 +173,8 @@ const (
 	webAdminEventActionPathDefault        = "/web/admin/eventaction"
 	webAdminRolesPathDefault              = "/web/admin/roles"
 	webAdminRolePathDefault               = "/web/admin/role"
+	webAdminAdminRolesPathDefault         = "/web/admin/adminroles"
+	webAdminAdminRolePathDefault          = "/web/admin/adminrole"
 	webAdminTOTPGeneratePathDefault       = "/web/admin/totp/generate"
 	webAdminTOTPValidatePathDefault       = "/web/admin/totp/validate"
 	webAdminTOTPSavePathDefault           = "/web/admin/totp/save"
@@ -153,8 +190,12 @@ const (
 	webEventsProviderSearchPathDefault    = "/web/admin/events/provider"
 	webEventsLogSearchPathDefault         = "/web/admin/events/logs"
 	webConfigsPathDefault                 = "/web/admin/configs"
+	webHostKeysPathDefault                = "/web/admin/hostkeys"
+	webAnalyticsPathDefault               = "/web/admin/analytics"
+	webDashboardPathDefault               = "/web/admin/dashboard"
 	webClientLoginPathDefault             = "/web/client/login"
 	webClientOIDCLoginPathDefault         = "/web/client/oidclogin"
+	webClientSAMLLoginPathDefault         = "/web/client/samllogin"
 	webClientTwoFactorPathDefault         = "/web/client/twofactor"
 	webClientTwoFactorRecoveryPathDefault = "/web/client/twofactor-recovery"
 	webClientFilesPathDefault             = "/web/client/files"
@@ -165,7 +206,13 @@ const (
 	webClientEditFilePathDefault          = "/web/client/editfile"
 	webClientDirsPathDefault              = "/web/client/dirs"
 	webClientDownloadZipPathDefault       = "/web/client/downloadzip"
+	webClientArchiveJobsPathDefault       = "/web/client/archives"
+	webClientThumbnailsPathDefault        = "/web/client/thumbs"
+	webClientStreamPathDefault            = "/web/client/stream"
 	webClientProfilePathDefault           = "/web/client/profile"
+	webClientWebhooksPathDefault          = "/web/client/webhooks"
+	webClientConsentsPathDefault          = "/web/client/consents"
+	webClientConsentLinkPathDefault       = "/web/client/consentlink"
 	webClientMFAPathDefault               = "/web/client/mfa"
 	webClientTOTPGeneratePathDefault      = "/web/client/totp/generate"
 	webClientTOTPValidatePathDefault      = "/web/client/totp/validate"
@@ -176,21 +223,31 @@ const (
 	webClientPubSharesPathDefault         = "/web/client/pubshares"
 	webClientForgotPwdPathDefault         = "/web/client/forgot-password"
 	webClientResetPwdPathDefault          = "/web/client/reset-password"
+	webClientSignUpPathDefault            = "/web/client/signup"
 	webClientViewPDFPathDefault           = "/web/client/viewpdf"
 	webClientGetPDFPathDefault            = "/web/client/getpdf"
+	webClientSearchPathDefault            = "/web/client/search"
 	webStaticFilesPathDefault             = "/static"
 	webOpenAPIPathDefault                 = "/openapi"
 	// MaxRestoreSize defines the max size for the loaddata input file
-	MaxRestoreSize         = 10485760     // 10 MB
-	maxRequestSize         = 1048576      // 1MB
-	maxLoginBodySize       = 262144       // 256 KB
-	httpdMaxEditFileSize   = 1048576 * 50 // 50 MB
-	maxMultipartMem        = 10485760     // 10 MB
-	osWindows              = "windows"
-	otpHeaderCode          = "X-SFTPGO-OTP"
-	mTimeHeader            = "X-SFTPGO-MTIME"
-	acmeChallengeURI       = "/.well-known/acme-challenge/"
-	onlyOfficeCallbackPath = "/api/v2/user/onlyoffice"
+	MaxRestoreSize       = 10485760     // 10 MB
+	maxRequestSize       = 1048576      // 1MB
+	maxLoginBodySize     = 262144       // 256 KB
+	httpdMaxEditFileSize = 1048576 * 50 // 50 MB
+	maxMultipartMem      = 10485760     // 10 MB
+	// max numeric suffixes to try for the files uploaded to a file request
+	maxFileRequestNameAttempts = 1000
+	osWindows                  = "windows"
+	otpHeaderCode              = "X-SFTPGO-OTP"
+	mTimeHeader                = "X-SFTPGO-MTIME"
+	nextCursorHeader           = "X-SFTPGO-NEXT-CURSOR"
+	uploadOffsetHeader         = "Upload-Offset"
+	maxDirListLimit            = 10000
+	acmeChallengeURI           = "/.well-known/acme-challenge/"
+	onlyOfficeCallbackPath     = "/api/v2/user/onlyoffice"
+	// grace periods, in minutes, for the previous key after an API key rotation
+	defaultAPIKeyRotationGracePeriod = 60
+	maxAPIKeyRotationGracePeriod     = 10080
 )
 
 var (
@@ -204,10 +261,13 @@ var (
 	webBaseAdminPath               string
 	webBaseClientPath              string
 	webOIDCRedirectPath            string
+	webSAMLMetadataPath            string
+	webSAMLACSPath                 string
 	webOAuth2RedirectPath          string
 	webOAuth2TokenPath             string
 	webAdminSetupPath              string
 	webAdminOIDCLoginPath          string
+	webAdminSAMLLoginPath          string
 	webAdminLoginPath              string
 	webAdminTwoFactorPath          string
 	webAdminTwoFactorRecoveryPath  string
@@ -215,6 +275,8 @@ var (
 	webUsersPath                   string
 	webUserPath                    string
 	webConnectionsPath             string
+	webSessionsPath                string
+	webRegistrationsPath           string
 	webFoldersPath                 string
 	webFolderPath                  string
 	webGroupsPath                  string
@@ -235,6 +297,8 @@ var (
 	webAdminEventActionPath        string
 	webAdminRolesPath              string
 	webAdminRolePath               string
+	webAdminAdminRolesPath         string
+	webAdminAdminRolePath          string
 	webAdminTOTPGeneratePath       string
 	webAdminTOTPValidatePath       string
 	webAdminTOTPSavePath           string
@@ -252,9 +316,13 @@ var (
 	webEventsProviderSearchPath    string
 	webEventsLogSearchPath         string
 	webConfigsPath                 string
+	webHostKeysPath                string
+	webAnalyticsPath               string
+	webDashboardPath               string
 	webDefenderHostsPath           string
 	webClientLoginPath             string
 	webClientOIDCLoginPath         string
+	webClientSAMLLoginPath         string
 	webClientTwoFactorPath         string
 	webClientTwoFactorRecoveryPath string
 	webClientFilesPath             string
@@ -265,7 +333,13 @@ var (
 	webClientEditFilePath          string
 	webClientDirsPath              string
 	webClientDownloadZipPath       string
+	webClientArchiveJobsPath       string
+	webClientThumbnailsPath        string
+	webClientStreamPath            string
 	webClientProfilePath           string
+	webClientWebhooksPath          string
+	webClientConsentsPath          string
+	webClientConsentLinkPath       string
 	webChangeClientPwdPath         string
 	webClientMFAPath               string
 	webClientTOTPGeneratePath      string
@@ -276,8 +350,10 @@ var (
 	webClientLogoutPath            string
 	webClientForgotPwdPath         string
 	webClientResetPwdPath          string
+	webClientSignUpPath            string
 	webClientViewPDFPath           string
 	webClientGetPDFPath            string
+	webClientSearchPath            string
 	webStaticFilesPath             string
 	webOpenAPIPath                 string
 	// max upload size for http clients, 1GB by default
@@ -286,6 +362,7 @@ var (
 	installationCode           string
 	installationCodeHint       string
 	fnInstallationCodeResolver FnInstallationCodeResolver
+	fnConfigReport             FnConfigReport
 	configurationDir           string
 )
 
@@ -299,6 +376,9 @@ func init() {
 // If the installation code cannot be resolved the provided default must be returned
 type FnInstallationCodeResolver func(defaultInstallationCode string) string
 
+// FnConfigReport defines a method to get the runtime configuration report
+type FnConfigReport func() (ConfigReport, error)
+
 // HTTPSProxyHeader defines an HTTPS proxy header as key/value.
 // For example Key could be "X-Forwarded-Proto" and Value "https"
 type HTTPSProxyHeader struct {
@@ -472,15 +552,18 @@ type Binding struct {
 	EnableWebClient bool `json:"enable_web_client" mapstructure:"enable_web_client"`
 	// Enable REST API
 	EnableRESTAPI bool `json:"enable_rest_api" mapstructure:"enable_rest_api"`
+	// Enable the read-only GraphQL admin API. It requires the REST API and uses
+	// the same authentication
+	EnableGraphQL bool `json:"enable_graphql" mapstructure:"enable_graphql"`
 	// Defines the login methods available for the WebAdmin and WebClient UIs:
 	//
-	// - 0 means any configured method: username/password login form and OIDC, if enabled
-	// - 1 means OIDC for the WebAdmin UI
-	// - 2 means OIDC for the WebClient UI
+	// - 0 means any configured method: username/password login form, OIDC and SAML, if enabled
+	// - 1 means OIDC and SAML for the WebAdmin UI
+	// - 2 means OIDC and SAML for the WebClient UI
 	// - 4 means login form for the WebAdmin UI
 	// - 8 means login form for the WebClient UI
 	//
-	// You can combine the values. For example 3 means that you can only login using OIDC on
+	// You can combine the values. For example 3 means that you can only login using OIDC or SAML on
 	// both WebClient and WebAdmin UI.
 	EnabledLoginMethods int `json:"enabled_login_methods" mapstructure:"enabled_login_methods"`
 	// you also need to provide a certificate for enabling HTTPS
@@ -489,10 +572,21 @@ type Binding struct {
 	// ones will be used, if any
 	CertificateFile    string `json:"certificate_file" mapstructure:"certificate_file"`
 	CertificateKeyFile string `json:"certificate_key_file" mapstructure:"certificate_key_file"`
+	// Additional certificates for this binding, selected based on the server name
+	// requested by the client (SNI). If no additional certificate matches, the
+	// binding specific or the global certificate is used
+	SNICertificates []common.SNICertificate `json:"sni_certificates" mapstructure:"sni_certificates"`
+	// Obtain, using ACME, a certificate for the server name requested by the
+	// client, if no configured certificate matches and the server name is allowed
+	// in the ACME on-demand configuration
+	ACMEOnDemand bool `json:"acme_on_demand" mapstructure:"acme_on_demand"`
 	// Defines the minimum TLS version. 13 means TLS 1.3, default is TLS 1.2
 	MinTLSVersion int `json:"min_tls_version" mapstructure:"min_tls_version"`
-	// set to 1 to require client certificate authentication in addition to basic auth.
-	// You need to define at least a certificate authority for this to work
+	// Set to 1 to require a client certificate and verify it. Set to 2 to request
+	// a client certificate and verify it if given. WebClient users and REST API
+	// users can authenticate using the provided certificate if the TLS username
+	// is configured for them. You need to define at least a certificate authority
+	// for this to work
 	ClientAuthType int `json:"client_auth_type" mapstructure:"client_auth_type"`
 	// TLSCipherSuites is a list of supported cipher suites for TLS version 1.2.
 	// If CipherSuites is nil/empty, a default list of secure cipher suites
@@ -529,8 +623,12 @@ type Binding struct {
 	WebClientIntegrations []WebClientIntegration `json:"web_client_integrations" mapstructure:"web_client_integrations"`
 	// Defining an OIDC configuration the web admin and web client UI will use OpenID to authenticate users.
 	OIDC OIDC `json:"oidc" mapstructure:"oidc"`
+	// Defining a SAML configuration the web admin and web client UI will allow SAML 2.0 single sign-on
+	SAML SAML `json:"saml" mapstructure:"saml"`
 	// Security defines security headers to add to HTTP responses and allows to restrict allowed hosts
 	Security SecurityConf `json:"security" mapstructure:"security"`
+	// RequestFilter defines the filters to apply to the requests before processing them
+	RequestFilter RequestFilter `json:"request_filter" mapstructure:"request_filter"`
 	// Branding defines customizations to suit your brand
 	Branding         Branding `json:"branding" mapstructure:"branding"`
 	allowHeadersFrom []func(net.IP) bool
@@ -577,6 +675,10 @@ func (b *Binding) parseAllowedProxy() error {
 	return nil
 }
 
+func (b *Binding) isMutualTLSEnabled() bool {
+	return b.ClientAuthType == 1 || b.ClientAuthType == 2
+}
+
 // GetAddress returns the binding address
 func (b *Binding) GetAddress() string {
 	return fmt.Sprintf("%s:%d", b.Address, b.Port)
@@ -641,7 +743,7 @@ func (b *Binding) checkLoginMethods() error {
 		return errors.New("no login method available for WebAdmin UI")
 	}
 	if !b.isWebAdminOIDCLoginDisabled() {
-		if b.isWebAdminLoginFormDisabled() && !b.OIDC.hasRoles() {
+		if b.isWebAdminLoginFormDisabled() && !b.OIDC.hasRoles() && !b.SAML.hasRoles() {
 			return errors.New("no login method available for WebAdmin UI")
 		}
 	}
@@ -649,7 +751,7 @@ func (b *Binding) checkLoginMethods() error {
 		return errors.New("no login method available for WebClient UI")
 	}
 	if !b.isWebClientOIDCLoginDisabled() {
-		if b.isWebClientLoginFormDisabled() && !b.OIDC.isEnabled() {
+		if b.isWebClientLoginFormDisabled() && !b.OIDC.isEnabled() && !b.SAML.isEnabled() {
 			return errors.New("no login method available for WebClient UI")
 		}
 	}
@@ -704,6 +806,34 @@ type ServicesStatus struct {
 	MFA          mfa.ServiceStatus           `json:"mfa"`
 	AllowList    allowListStatus             `json:"allow_list"`
 	RateLimiters rateLimiters                `json:"rate_limiters"`
+	SFTPFsPool   vfs.SFTPPoolStatus          `json:"sftpfs_pool"`
+}
+
+// ConfigDifference defines a configuration key whose runtime value differs from
+// the configuration file or from the value that would be loaded after a restart
+type ConfigDifference struct {
+	// Configuration key, for example "sftpd.bindings.0.port"
+	Key string `json:"key"`
+	// Value currently in use
+	RuntimeValue any `json:"runtime_value"`
+	// Value defined in the configuration file or the default one,
+	// environment variables are not applied
+	FileValue any `json:"file_value"`
+	// Value that would be loaded after a restart: configuration file
+	// and environment variables
+	RestartValue any `json:"restart_value"`
+	// True if an environment variable overrides the configuration file value
+	EnvOverride bool `json:"env_override"`
+	// True if a restart is required to apply the new value
+	RestartRequired bool `json:"restart_required"`
+}
+
+// ConfigReport defines the effective runtime configuration and the differences
+// against the configuration on disk. Secrets are redacted
+type ConfigReport struct {
+	ConfigFile  string             `json:"config_file"`
+	Config      map[string]any     `json:"config"`
+	Differences []ConfigDifference `json:"differences"`
 }
 
 // SetupConfig defines the configuration parameters for the initial web admin setup
@@ -777,7 +907,15 @@ type Conf struct {
 	Setup SetupConfig `json:"setup" mapstructure:"setup"`
 	// If enabled, the link to the sponsors section will not appear on the setup screen page
 	HideSupportLink bool `json:"hide_support_link" mapstructure:"hide_support_link"`
-	acmeDomain      string
+	// Archives built in background for large selections
+	ArchiveJobs ArchiveJobsConfig `json:"archive_jobs" mapstructure:"archive_jobs"`
+	// Cached image and PDF previews
+	Thumbnails ThumbnailsConfig `json:"thumbnails" mapstructure:"thumbnails"`
+	// Media streaming and transcoding
+	Media MediaConfig `json:"media" mapstructure:"media"`
+	// Self-service user registration
+	Registration RegistrationConfig `json:"registration" mapstructure:"registration"`
+	acmeDomain   string
 }
 
 type apiResponse struct {
@@ -857,6 +995,18 @@ func (c *Conf) getKeyPairs(configDir string) []common.TLSKeyPair {
 				ID:   binding.GetAddress(),
 			})
 		}
+		for _, sniCert := range binding.SNICertificates {
+			certificateFile := getConfigPath(sniCert.CertificateFile, configDir)
+			certificateKeyFile := getConfigPath(sniCert.CertificateKeyFile, configDir)
+			if certificateFile != "" && certificateKeyFile != "" {
+				keyPairs = append(keyPairs, common.TLSKeyPair{
+					Cert: certificateFile,
+					Key:  certificateKeyFile,
+					ID:   binding.GetAddress(),
+					SNI:  true,
+				})
+			}
+		}
 	}
 	var certificateFile, certificateKeyFile string
 	if c.acmeDomain != "" {
@@ -923,6 +1073,8 @@ func (c *Conf) Initialize(configDir string, isShared int) error {
 	logger.Info(logSender, "", "initializing HTTP server with config %+v", c.getRedacted())
 	configurationDir = configDir
 	resetCodesMgr = newResetCodeManager(isShared)
+	consentLinksMgr = newConsentLinkManager(isShared)
+	webSessionsMgr = newWebSessionManager(isShared)
 	oidcMgr = newOIDCManager(isShared)
 	oauth2Mgr = newOAuth2Manager(isShared)
 	staticFilesPath := util.FindSharedDataPath(c.StaticFilesPath, configDir)
@@ -931,6 +1083,23 @@ func (c *Conf) Initialize(configDir string, isShared int) error {
 	if err := c.checkRequiredDirs(staticFilesPath, templatesPath); err != nil {
 		return err
 	}
+	if err := c.ArchiveJobs.validate(); err != nil {
+		return err
+	}
+	archiveJobs.setConfig(c.ArchiveJobs)
+	archiveJobs.removeStaleFiles()
+	if err := c.Thumbnails.validate(configDir); err != nil {
+		return err
+	}
+	thumbnails.setConfig(c.Thumbnails)
+	if err := c.Media.validate(); err != nil {
+		return err
+	}
+	mediaStreamer.setConfig(c.Media)
+	if err := c.Registration.validate(); err != nil {
+		return err
+	}
+	registrationConfig = c.Registration
 	if c.isWebAdminEnabled() {
 		updateWebAdminURLs(c.WebRoot)
 		loadAdminTemplates(templatesPath)
@@ -961,6 +1130,7 @@ func (c *Conf) Initialize(configDir string, isShared int) error {
 	}
 
 	csrfTokenAuth = jwtauth.New(jwa.HS256.String(), getSigningKey(c.SigningPassphrase), nil)
+	publicKeysSigningKey = getSigningKey(c.SigningPassphrase)
 	hideSupportLink = c.HideSupportLink
 
 	exitChannel := make(chan error, 1)
@@ -972,6 +1142,9 @@ func (c *Conf) Initialize(configDir string, isShared int) error {
 		if err := binding.parseAllowedProxy(); err != nil {
 			return err
 		}
+		if err := binding.RequestFilter.initialize(); err != nil {
+			return err
+		}
 		binding.checkWebClientIntegrations()
 		binding.checkBranding()
 		binding.Security.updateProxyHeaders()
@@ -981,6 +1154,10 @@ func (c *Conf) Initialize(configDir string, isShared int) error {
 				exitChannel <- err
 				return
 			}
+			if err := b.SAML.initialize(configDir); err != nil {
+				exitChannel <- err
+				return
+			}
 			if err := b.checkLoginMethods(); err != nil {
 				exitChannel <- err
 				return
@@ -1044,6 +1221,7 @@ func getServicesStatus() *ServicesStatus {
 			IsActive:  rtlEnabled,
 			Protocols: rtlProtocols,
 		},
+		SFTPFsPool: vfs.GetSFTPPoolStatus(),
 	}
 	return status
 }
@@ -1075,8 +1253,11 @@ func updateWebClientURLs(baseURL string) {
 	webBasePath = path.Join(baseURL, webBasePathDefault)
 	webBaseClientPath = path.Join(baseURL, webBasePathClientDefault)
 	webOIDCRedirectPath = path.Join(baseURL, webOIDCRedirectPathDefault)
+	webSAMLMetadataPath = path.Join(baseURL, webSAMLMetadataPathDefault)
+	webSAMLACSPath = path.Join(baseURL, webSAMLACSPathDefault)
 	webClientLoginPath = path.Join(baseURL, webClientLoginPathDefault)
 	webClientOIDCLoginPath = path.Join(baseURL, webClientOIDCLoginPathDefault)
+	webClientSAMLLoginPath = path.Join(baseURL, webClientSAMLLoginPathDefault)
 	webClientTwoFactorPath = path.Join(baseURL, webClientTwoFactorPathDefault)
 	webClientTwoFactorRecoveryPath = path.Join(baseURL, webClientTwoFactorRecoveryPathDefault)
 	webClientFilesPath = path.Join(baseURL, webClientFilesPathDefault)
@@ -1088,7 +1269,13 @@ func updateWebClientURLs(baseURL string) {
 	webClientEditFilePath = path.Join(baseURL, webClientEditFilePathDefault)
 	webClientDirsPath = path.Join(baseURL, webClientDirsPathDefault)
 	webClientDownloadZipPath = path.Join(baseURL, webClientDownloadZipPathDefault)
+	webClientArchiveJobsPath = path.Join(baseURL, webClientArchiveJobsPathDefault)
+	webClientThumbnailsPath = path.Join(baseURL, webClientThumbnailsPathDefault)
+	webClientStreamPath = path.Join(baseURL, webClientStreamPathDefault)
 	webClientProfilePath = path.Join(baseURL, webClientProfilePathDefault)
+	webClientWebhooksPath = path.Join(baseURL, webClientWebhooksPathDefault)
+	webClientConsentsPath = path.Join(baseURL, webClientConsentsPathDefault)
+	webClientConsentLinkPath = path.Join(baseURL, webClientConsentLinkPathDefault)
 	webChangeClientPwdPath = path.Join(baseURL, webChangeClientPwdPathDefault)
 	webClientLogoutPath = path.Join(baseURL, webClientLogoutPathDefault)
 	webClientMFAPath = path.Join(baseURL, webClientMFAPathDefault)
@@ -1098,8 +1285,10 @@ func updateWebClientURLs(baseURL string) {
 	webClientRecoveryCodesPath = path.Join(baseURL, webClientRecoveryCodesPathDefault)
 	webClientForgotPwdPath = path.Join(baseURL, webClientForgotPwdPathDefault)
 	webClientResetPwdPath = path.Join(baseURL, webClientResetPwdPathDefault)
+	webClientSignUpPath = path.Join(baseURL, webClientSignUpPathDefault)
 	webClientViewPDFPath = path.Join(baseURL, webClientViewPDFPathDefault)
 	webClientGetPDFPath = path.Join(baseURL, webClientGetPDFPathDefault)
+	webClientSearchPath = path.Join(baseURL, webClientSearchPathDefault)
 }
 
 func updateWebAdminURLs(baseURL string) {
@@ -1110,17 +1299,22 @@ func updateWebAdminURLs(baseURL string) {
 	webBasePath = path.Join(baseURL, webBasePathDefault)
 	webBaseAdminPath = path.Join(baseURL, webBasePathAdminDefault)
 	webOIDCRedirectPath = path.Join(baseURL, webOIDCRedirectPathDefault)
+	webSAMLMetadataPath = path.Join(baseURL, webSAMLMetadataPathDefault)
+	webSAMLACSPath = path.Join(baseURL, webSAMLACSPathDefault)
 	webOAuth2RedirectPath = path.Join(baseURL, webOAuth2RedirectPathDefault)
 	webOAuth2TokenPath = path.Join(baseURL, webOAuth2TokenPathDefault)
 	webAdminSetupPath = path.Join(baseURL, webAdminSetupPathDefault)
 	webAdminLoginPath = path.Join(baseURL, webAdminLoginPathDefault)
 	webAdminOIDCLoginPath = path.Join(baseURL, webAdminOIDCLoginPathDefault)
+	webAdminSAMLLoginPath = path.Join(baseURL, webAdminSAMLLoginPathDefault)
 	webAdminTwoFactorPath = path.Join(baseURL, webAdminTwoFactorPathDefault)
 	webAdminTwoFactorRecoveryPath = path.Join(baseURL, webAdminTwoFactorRecoveryPathDefault)
 	webLogoutPath = path.Join(baseURL, webLogoutPathDefault)
 	webUsersPath = path.Join(baseURL, webUsersPathDefault)
 	webUserPath = path.Join(baseURL, webUserPathDefault)
 	webConnectionsPath = path.Join(baseURL, webConnectionsPathDefault)
+	webSessionsPath = path.Join(baseURL, webSessionsPathDefault)
+	webRegistrationsPath = path.Join(baseURL, webRegistrationsPathDefault)
 	webFoldersPath = path.Join(baseURL, webFoldersPathDefault)
 	webFolderPath = path.Join(baseURL, webFolderPathDefault)
 	webGroupsPath = path.Join(baseURL, webGroupsPathDefault)
@@ -1144,6 +1338,8 @@ func updateWebAdminURLs(baseURL string) {
 	webAdminEventActionPath = path.Join(baseURL, webAdminEventActionPathDefault)
 	webAdminRolesPath = path.Join(baseURL, webAdminRolesPathDefault)
 	webAdminRolePath = path.Join(baseURL, webAdminRolePathDefault)
+	webAdminAdminRolesPath = path.Join(baseURL, webAdminAdminRolesPathDefault)
+	webAdminAdminRolePath = path.Join(baseURL, webAdminAdminRolePathDefault)
 	webAdminTOTPGeneratePath = path.Join(baseURL, webAdminTOTPGeneratePathDefault)
 	webAdminTOTPValidatePath = path.Join(baseURL, webAdminTOTPValidatePathDefault)
 	webAdminTOTPSavePath = path.Join(baseURL, webAdminTOTPSavePathDefault)
@@ -1159,6 +1355,9 @@ func updateWebAdminURLs(baseURL string) {
 	webEventsProviderSearchPath = path.Join(baseURL, webEventsProviderSearchPathDefault)
 	webEventsLogSearchPath = path.Join(baseURL, webEventsLogSearchPathDefault)
 	webConfigsPath = path.Join(baseURL, webConfigsPathDefault)
+	webHostKeysPath = path.Join(baseURL, webHostKeysPathDefault)
+	webAnalyticsPath = path.Join(baseURL, webAnalyticsPathDefault)
+	webDashboardPath = path.Join(baseURL, webDashboardPathDefault)
 	webStaticFilesPath = path.Join(baseURL, webStaticFilesPathDefault)
 	webOpenAPIPath = path.Join(baseURL, webOpenAPIPathDefault)
 }
@@ -1186,10 +1385,16 @@ func startCleanupTicker(duration time.Duration) {
 				counter++
 				cleanupExpiredJWTTokens()
 				resetCodesMgr.Cleanup()
+				consentLinksMgr.Cleanup()
+				webSessionsMgr.cleanup()
+				archiveJobs.cleanup()
 				if counter%2 == 0 {
 					oidcMgr.cleanup()
 					oauth2Mgr.cleanup()
 				}
+				if counter%6 == 0 {
+					thumbnails.cleanup()
+				}
 			}
 		}
 	}()
@@ -1226,6 +1431,11 @@ func SetInstallationCodeResolver(fn FnInstallationCodeResolver) {
 	fnInstallationCodeResolver = fn
 }
 
+// SetConfigReportResolver sets a function to call to get the runtime configuration report
+func SetConfigReportResolver(fn FnConfigReport) {
+	fnConfigReport = fn
+}
+
 func resolveInstallationCode() string {
 	if fnInstallationCodeResolver != nil {
 		return fnInstallationCodeResolver(installationCode)
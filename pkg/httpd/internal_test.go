@@ -15,6 +15,7 @@
 package httpd
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
 	"crypto/tls"
@@ -24,6 +25,10 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -34,12 +39,13 @@ import (
 	"runtime"
 	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/jwtauth/v5"
-	"github.com/klauspost/compress/zip"
+	"github.com/klauspost/compress/gzip"
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwt"
 	"github.com/rs/xid"
@@ -1244,7 +1250,7 @@ func TestCreateTokenError(t *testing.T) {
 	}
 	req, _ = http.NewRequest(http.MethodGet, userTokenPath, nil)
 
-	server.generateAndSendUserToken(rr, req, "", user)
+	server.generateAndSendUserToken(rr, req, "", dataprovider.LoginMethodPassword, user)
 	assert.Equal(t, http.StatusInternalServerError, rr.Code)
 
 	rr = httptest.NewRecorder()
@@ -2167,7 +2173,7 @@ func TestCompressorAbortHandler(t *testing.T) {
 		request:        nil,
 	}
 	share := &dataprovider.Share{}
-	renderCompressedFiles(&failingWriter{}, connection, "", nil, share)
+	renderCompressedFiles(&failingWriter{}, connection, "", nil, share, archiveFormatZip)
 }
 
 func TestZipErrors(t *testing.T) {
@@ -2187,18 +2193,18 @@ func TestZipErrors(t *testing.T) {
 	err := os.MkdirAll(testDir, os.ModePerm)
 	assert.NoError(t, err)
 
-	wr := zip.NewWriter(&failingWriter{})
+	wr := newArchiveWriter(&failingWriter{}, archiveFormatZip)
 	err = wr.Close()
 	if assert.Error(t, err) {
 		assert.Contains(t, err.Error(), "write error")
 	}
 
-	err = addZipEntry(wr, connection, "/"+filepath.Base(testDir), "/")
+	err = newArchiveBuilder(wr, connection, "/").addEntry("/" + filepath.Base(testDir))
 	if assert.Error(t, err) {
 		assert.Contains(t, err.Error(), "write error")
 	}
 
-	err = addZipEntry(wr, connection, "/"+filepath.Base(testDir), path.Join("/", filepath.Base(testDir), "dir"))
+	err = newArchiveBuilder(wr, connection, path.Join("/", filepath.Base(testDir), "dir")).addEntry("/" + filepath.Base(testDir))
 	if assert.Error(t, err) {
 		assert.Contains(t, err.Error(), "is outside base dir")
 	}
@@ -2206,15 +2212,15 @@ func TestZipErrors(t *testing.T) {
 	testFilePath := filepath.Join(testDir, "ziptest.zip")
 	err = os.WriteFile(testFilePath, util.GenerateRandomBytes(65535), os.ModePerm)
 	assert.NoError(t, err)
-	err = addZipEntry(wr, connection, path.Join("/", filepath.Base(testDir), filepath.Base(testFilePath)),
-		"/"+filepath.Base(testDir))
+	err = newArchiveBuilder(wr, connection, "/"+filepath.Base(testDir)).
+		addEntry(path.Join("/", filepath.Base(testDir), filepath.Base(testFilePath)))
 	if assert.Error(t, err) {
 		assert.Contains(t, err.Error(), "write error")
 	}
 
 	connection.User.Permissions["/"] = []string{dataprovider.PermListItems}
-	err = addZipEntry(wr, connection, path.Join("/", filepath.Base(testDir), filepath.Base(testFilePath)),
-		"/"+filepath.Base(testDir))
+	err = newArchiveBuilder(wr, connection, "/"+filepath.Base(testDir)).
+		addEntry(path.Join("/", filepath.Base(testDir), filepath.Base(testFilePath)))
 	assert.ErrorIs(t, err, os.ErrPermission)
 
 	// creating a virtual folder to a missing path stat is ok but readdir fails
@@ -2225,15 +2231,15 @@ func TestZipErrors(t *testing.T) {
 		VirtualPath: "/vpath",
 	})
 	connection.User = user
-	wr = zip.NewWriter(bytes.NewBuffer(make([]byte, 0)))
-	err = addZipEntry(wr, connection, user.VirtualFolders[0].VirtualPath, "/")
+	wr = newArchiveWriter(bytes.NewBuffer(make([]byte, 0)), archiveFormatZip)
+	err = newArchiveBuilder(wr, connection, "/").addEntry(user.VirtualFolders[0].VirtualPath)
 	assert.Error(t, err)
 
 	user.Filters.FilePatterns = append(user.Filters.FilePatterns, sdk.PatternsFilter{
 		Path:           "/",
 		DeniedPatterns: []string{"*.zip"},
 	})
-	err = addZipEntry(wr, connection, "/"+filepath.Base(testDir), "/")
+	err = newArchiveBuilder(wr, connection, "/").addEntry("/" + filepath.Base(testDir))
 	assert.ErrorIs(t, err, os.ErrPermission)
 
 	err = os.RemoveAll(testDir)
@@ -2950,19 +2956,333 @@ func TestSecureMiddlewareIntegration(t *testing.T) {
 
 func TestGetCompressedFileName(t *testing.T) {
 	username := "test"
-	res := getCompressedFileName(username, []string{"single dir"})
+	res := getCompressedFileName(username, []string{"single dir"}, archiveFormatZip)
 	require.Equal(t, fmt.Sprintf("%s-single dir.zip", username), res)
-	res = getCompressedFileName(username, []string{"file1", "file2"})
+	res = getCompressedFileName(username, []string{"file1", "file2"}, archiveFormatZip)
 	require.Equal(t, fmt.Sprintf("%s-download.zip", username), res)
-	res = getCompressedFileName(username, []string{"file1.txt"})
+	res = getCompressedFileName(username, []string{"file1.txt"}, archiveFormatZip)
 	require.Equal(t, fmt.Sprintf("%s-file1.zip", username), res)
 	// now files with full paths
-	res = getCompressedFileName(username, []string{"/dir/single dir"})
+	res = getCompressedFileName(username, []string{"/dir/single dir"}, archiveFormatZip)
 	require.Equal(t, fmt.Sprintf("%s-single dir.zip", username), res)
-	res = getCompressedFileName(username, []string{"/adir/file1", "/adir/file2"})
+	res = getCompressedFileName(username, []string{"/adir/file1", "/adir/file2"}, archiveFormatZip)
 	require.Equal(t, fmt.Sprintf("%s-download.zip", username), res)
-	res = getCompressedFileName(username, []string{"/sub/dir/file1.txt"})
+	res = getCompressedFileName(username, []string{"/sub/dir/file1.txt"}, archiveFormatZip)
 	require.Equal(t, fmt.Sprintf("%s-file1.zip", username), res)
+	res = getCompressedFileName(username, []string{"/sub/dir/file1.txt"}, archiveFormatTarGz)
+	require.Equal(t, fmt.Sprintf("%s-file1.tar.gz", username), res)
+	res = getCompressedFileName(username, []string{"/adir/file1", "/adir/file2"}, archiveFormatTar)
+	require.Equal(t, fmt.Sprintf("%s-download.tar", username), res)
+}
+
+func TestArchiveFormats(t *testing.T) {
+	for _, val := range []string{"", "zip", " ZIP "} {
+		format, err := getArchiveFormat(val)
+		assert.NoError(t, err)
+		assert.Equal(t, archiveFormatZip, format)
+	}
+	format, err := getArchiveFormat("tar")
+	assert.NoError(t, err)
+	assert.Equal(t, archiveFormatTar, format)
+	for _, val := range []string{"tar.gz", "tgz"} {
+		format, err = getArchiveFormat(val)
+		assert.NoError(t, err)
+		assert.Equal(t, archiveFormatTarGz, format)
+	}
+	_, err = getArchiveFormat("rar")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	assert.Equal(t, "application/zip", getArchiveContentType(archiveFormatZip))
+	assert.Equal(t, "application/x-tar", getArchiveContentType(archiveFormatTar))
+	assert.Equal(t, "application/gzip", getArchiveContentType(archiveFormatTarGz))
+
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, format := range []string{archiveFormatTar, archiveFormatTarGz} {
+		buf := bytes.NewBuffer(nil)
+		wr := newArchiveWriter(buf, format)
+		err = wr.addDir("dir", modTime)
+		assert.NoError(t, err)
+		w, err := wr.addFile("dir/file.txt", vfs.NewFileInfo("file.txt", false, 4, modTime, false))
+		assert.NoError(t, err)
+		_, err = w.Write([]byte("test"))
+		assert.NoError(t, err)
+		// the file is bigger than expected
+		_, err = w.Write([]byte("test"))
+		assert.Error(t, err)
+		err = wr.Close()
+		assert.NoError(t, err)
+
+		var r io.Reader = buf
+		if format == archiveFormatTarGz {
+			r, err = gzip.NewReader(buf)
+			require.NoError(t, err)
+		}
+		tr := tar.NewReader(r)
+		hdr, err := tr.Next()
+		require.NoError(t, err)
+		assert.Equal(t, "dir/", hdr.Name)
+		assert.Equal(t, byte(tar.TypeDir), hdr.Typeflag)
+		assert.True(t, hdr.ModTime.Equal(modTime))
+		hdr, err = tr.Next()
+		require.NoError(t, err)
+		assert.Equal(t, "dir/file.txt", hdr.Name)
+		assert.Equal(t, int64(4), hdr.Size)
+		contents, err := io.ReadAll(tr)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("test"), contents)
+		_, err = tr.Next()
+		assert.ErrorIs(t, err, io.EOF)
+
+		wr = newArchiveWriter(&failingWriter{}, format)
+		err = wr.addDir("dir", modTime)
+		if format == archiveFormatTar {
+			assert.Error(t, err)
+		}
+		err = wr.Close()
+		assert.Error(t, err)
+	}
+}
+
+func TestArchiveJobsConfig(t *testing.T) {
+	c := ArchiveJobsConfig{}
+	assert.NoError(t, c.validate())
+	c.Enabled = true
+	assert.Error(t, c.validate())
+	c.MaxConcurrentJobs = 1
+	c.MaxSize = -1
+	assert.Error(t, c.validate())
+	c.MaxSize = 0
+	c.Bandwidth = -1
+	assert.Error(t, c.validate())
+	c.Bandwidth = 0
+	assert.Error(t, c.validate())
+	c.Retention = 1
+	assert.NoError(t, c.validate())
+
+	config := archiveJobs.getConfig()
+	defer archiveJobs.setConfig(config)
+
+	archiveJobs.setConfig(ArchiveJobsConfig{})
+	connection := &Connection{
+		BaseConnection: common.NewBaseConnection(xid.New().String(), common.ProtocolHTTP, "", "", dataprovider.User{}),
+	}
+	_, err := archiveJobs.start(connection, []string{"/"}, "")
+	assert.ErrorIs(t, err, util.ErrMethodDisabled)
+	archiveJobs.setConfig(c)
+	_, err = archiveJobs.start(connection, []string{"/"}, "7z")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	_, err = archiveJobs.start(connection, nil, "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	_, err = archiveJobs.start(connection, make([]string, archiveJobsMaxPaths+1), "")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	// stale archives are removed
+	staleFile := filepath.Join(getArchiveJobsDir(), archiveJobsFilePrefix+xid.New().String()+".zip")
+	err = os.WriteFile(staleFile, []byte("stale"), 0600)
+	assert.NoError(t, err)
+	archiveJobs.removeStaleFiles()
+	assert.NoFileExists(t, staleFile)
+	// expired jobs are removed with their archives
+	jobFile := filepath.Join(getArchiveJobsDir(), archiveJobsFilePrefix+"expired.zip")
+	err = os.WriteFile(jobFile, []byte("archive"), 0600)
+	assert.NoError(t, err)
+	archiveJobs.Lock()
+	archiveJobs.jobs["expired"] = &archiveJob{
+		username: "user",
+		filePath: jobFile,
+		info: archiveJobInfo{
+			ID:      "expired",
+			Status:  archiveJobStatusCompleted,
+			EndTime: util.GetTimeAsMsSinceEpoch(time.Now().Add(-2 * time.Hour)),
+		},
+	}
+	archiveJobs.Unlock()
+	_, err = archiveJobs.get("user", "expired")
+	assert.NoError(t, err)
+	_, err = archiveJobs.get("other user", "expired")
+	assert.ErrorIs(t, err, util.ErrNotFound)
+	archiveJobs.cleanup()
+	_, err = archiveJobs.get("user", "expired")
+	assert.ErrorIs(t, err, util.ErrNotFound)
+	assert.NoFileExists(t, jobFile)
+}
+
+func TestThumbnailsConfig(t *testing.T) {
+	configDir := filepath.Join(os.TempDir(), "config")
+	c := ThumbnailsConfig{}
+	assert.NoError(t, c.validate(configDir))
+	c.Enabled = true
+	assert.Error(t, c.validate(configDir))
+	c.Sizes = []int{64, thumbnailsMaxSize + 1}
+	assert.Error(t, c.validate(configDir))
+	c.Sizes = []int{64, 256}
+	c.MaxFileSize = -1
+	assert.Error(t, c.validate(configDir))
+	c.MaxFileSize = 0
+	c.Retention = -1
+	assert.Error(t, c.validate(configDir))
+	c.Retention = 1
+	c.BackendCacheDirs = map[string]string{"unknownfs": "cache"}
+	assert.Error(t, c.validate(configDir))
+	c.BackendCacheDirs = map[string]string{"s3fs": ""}
+	assert.Error(t, c.validate(configDir))
+	c.BackendCacheDirs = map[string]string{"s3fs": "s3cache", "osfs": "/cache/local"}
+	c.PDFRenderer = "pdftoppm"
+	assert.Error(t, c.validate(configDir))
+	c.PDFRenderer = "/usr/bin/pdftoppm"
+	assert.Error(t, c.validate(configDir))
+	c.PDFRendererTimeout = 10
+	c.CacheDir = "thumbs"
+	assert.NoError(t, c.validate(configDir))
+	assert.Equal(t, filepath.Join(configDir, "thumbs"), c.CacheDir)
+	assert.Equal(t, filepath.Join(configDir, "s3cache"), c.getCacheDir(sdk.S3FilesystemProvider))
+	assert.Equal(t, filepath.Clean("/cache/local"), c.getCacheDir(sdk.LocalFilesystemProvider))
+	assert.Equal(t, filepath.Join(configDir, "thumbs", "webdavfs"), c.getCacheDir(vfs.WebDAVFilesystemProvider))
+	assert.True(t, c.isSupported("/a/file.PDF"))
+	assert.True(t, c.isSupported("/a/file.jpeg"))
+	assert.False(t, c.isSupported("/a/file.txt"))
+	c.PDFRenderer = ""
+	assert.False(t, c.isSupported("/a/file.pdf"))
+	size, err := c.getSize("")
+	assert.NoError(t, err)
+	assert.Equal(t, 64, size)
+	size, err = c.getSize("256")
+	assert.NoError(t, err)
+	assert.Equal(t, 256, size)
+	_, err = c.getSize("128")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	_, err = c.getSize("a")
+	assert.ErrorIs(t, err, util.ErrValidation)
+	c.CacheDir = ""
+	assert.NoError(t, c.validate(configDir))
+	assert.Equal(t, filepath.Join(getArchiveJobsDir(), "thumbnails"), c.CacheDir)
+}
+
+func TestResizeImage(t *testing.T) {
+	w, h := getThumbnailDimensions(100, 50, 200)
+	assert.Equal(t, 100, w)
+	assert.Equal(t, 50, h)
+	w, h = getThumbnailDimensions(1000, 500, 200)
+	assert.Equal(t, 200, w)
+	assert.Equal(t, 100, h)
+	w, h = getThumbnailDimensions(500, 1000, 200)
+	assert.Equal(t, 100, w)
+	assert.Equal(t, 200, h)
+	w, h = getThumbnailDimensions(10000, 1, 200)
+	assert.Equal(t, 200, w)
+	assert.Equal(t, 1, h)
+	// left half red, right half transparent
+	src := image.NewNRGBA(image.Rect(10, 10, 410, 210))
+	for y := 10; y < 210; y++ {
+		for x := 10; x < 210; x++ {
+			src.Set(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	dst := resizeImage(src, 100)
+	assert.Equal(t, 100, dst.Bounds().Dx())
+	assert.Equal(t, 50, dst.Bounds().Dy())
+	assert.Equal(t, color.RGBA{R: 255, A: 255}, dst.RGBAAt(10, 10))
+	// transparent areas are rendered on a white background
+	assert.Equal(t, color.RGBA{R: 255, G: 255, B: 255, A: 255}, dst.RGBAAt(90, 40))
+	for y := 0; y < dst.Bounds().Dy(); y++ {
+		for x := 0; x < dst.Bounds().Dx(); x++ {
+			assert.Equal(t, uint8(255), dst.RGBAAt(x, y).A)
+		}
+	}
+	// small images are not enlarged
+	dst = resizeImage(image.NewGray(image.Rect(0, 0, 20, 10)), 100)
+	assert.Equal(t, 20, dst.Bounds().Dx())
+	assert.Equal(t, 10, dst.Bounds().Dy())
+
+	_, err := decodeImage(bytes.NewBuffer([]byte("not an image")))
+	assert.ErrorIs(t, err, util.ErrValidation)
+	_, err = decodeImage(iotest.ErrReader(errors.New("read error")))
+	assert.Error(t, err)
+}
+
+func TestThumbnails(t *testing.T) {
+	if runtime.GOOS == osWindows {
+		t.Skip("this test is not available on Windows")
+	}
+	homeDir := filepath.Join(os.TempDir(), util.GenerateUniqueID())
+	cacheDir := filepath.Join(os.TempDir(), util.GenerateUniqueID())
+	err := os.MkdirAll(homeDir, os.ModePerm)
+	require.NoError(t, err)
+	defer os.RemoveAll(homeDir)
+	defer os.RemoveAll(cacheDir)
+
+	buf := bytes.NewBuffer(nil)
+	err = png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 300, 150)))
+	require.NoError(t, err)
+	pngPath := filepath.Join(homeDir, "page.png")
+	err = os.WriteFile(pngPath, buf.Bytes(), 0644)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(homeDir, "doc.pdf"), []byte("%PDF-1.4"), 0644)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(homeDir, "image.png"), []byte("invalid image"), 0644)
+	require.NoError(t, err)
+	// the renderer receives a local copy of the PDF file and the requested size
+	renderer := filepath.Join(homeDir, "renderer.sh")
+	err = os.WriteFile(renderer, []byte(fmt.Sprintf("#!/bin/sh\ngrep -q PDF \"$1\" && [ \"$2\" = \"32\" ] && cat %q\n", pngPath)),
+		0755)
+	require.NoError(t, err)
+
+	config := thumbnails.getConfig()
+	defer thumbnails.setConfig(config)
+
+	c := ThumbnailsConfig{
+		Enabled:            true,
+		Sizes:              []int{32, 64},
+		CacheDir:           cacheDir,
+		Retention:          1,
+		PDFRenderer:        renderer,
+		PDFRendererTimeout: 10,
+	}
+	require.NoError(t, c.validate(os.TempDir()))
+	thumbnails.setConfig(c)
+
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "thumb_user",
+			HomeDir:  homeDir,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+	}
+	connection := &Connection{
+		BaseConnection: common.NewBaseConnection(xid.New().String(), common.ProtocolHTTP, "", "", user),
+	}
+	info, err := os.Stat(filepath.Join(homeDir, "doc.pdf"))
+	require.NoError(t, err)
+	thumbPath, err := thumbnails.getThumbnail(connection, "/doc.pdf", info, 32)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(thumbPath, filepath.Join(cacheDir, "osfs")))
+	f, err := os.Open(thumbPath)
+	require.NoError(t, err)
+	img, err := jpeg.Decode(f)
+	f.Close()
+	require.NoError(t, err)
+	assert.Equal(t, 32, img.Bounds().Dx())
+	assert.Equal(t, 16, img.Bounds().Dy())
+	// the renderer fails for different sizes
+	_, err = thumbnails.getThumbnail(connection, "/doc.pdf", info, 64)
+	assert.Error(t, err)
+	info, err = os.Stat(filepath.Join(homeDir, "image.png"))
+	require.NoError(t, err)
+	_, err = thumbnails.getThumbnail(connection, "/image.png", info, 32)
+	assert.ErrorIs(t, err, util.ErrValidation)
+	_, err = thumbnails.getThumbnail(connection, "/renderer.sh", info, 32)
+	assert.ErrorIs(t, err, util.ErrValidation)
+	// expired thumbnails are removed
+	past := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(thumbPath, past, past)
+	assert.NoError(t, err)
+	thumbnails.cleanup()
+	assert.NoFileExists(t, thumbPath)
+
+	c.Enabled = false
+	thumbnails.setConfig(c)
+	_, err = thumbnails.getThumbnail(connection, "/doc.pdf", info, 32)
+	assert.ErrorIs(t, err, util.ErrMethodDisabled)
 }
 
 func TestRESTAPIDisabled(t *testing.T) {
@@ -3136,7 +3456,7 @@ func TestDbResetCodeManager(t *testing.T) {
 		assert.ErrorIs(t, err, util.ErrNotFound)
 	}
 	_, err = mgr.Get(resetCode.Code)
-	assert.ErrorIs(t, err, sql.ErrNoRows)
+	assertSharedSessionNotFound(t, err)
 	// add an expired reset code
 	resetCode = newResetCode("user", false)
 	resetCode.ExpiresAt = time.Now().Add(-24 * time.Hour)
@@ -3148,7 +3468,7 @@ func TestDbResetCodeManager(t *testing.T) {
 	}
 	mgr.Cleanup()
 	_, err = mgr.Get(resetCode.Code)
-	assert.ErrorIs(t, err, sql.ErrNoRows)
+	assertSharedSessionNotFound(t, err)
 
 	dbMgr, ok := mgr.(*dbResetCodeManager)
 	if assert.True(t, ok) {
@@ -3157,6 +3477,93 @@ func TestDbResetCodeManager(t *testing.T) {
 	}
 }
 
+func TestDbWebSessionManager(t *testing.T) {
+	if !isSharedProviderSupported() {
+		t.Skip("this test it is not available with this provider")
+	}
+	mgr := newWebSessionManager(1)
+	now := time.Now()
+	session := &webSession{
+		ID:        util.GenerateUniqueID(),
+		Username:  defaultAdminUsername,
+		Type:      webSessionTypeAdmin,
+		Source:    webSessionSourceWeb,
+		IP:        "127.0.0.1",
+		CreatedAt: util.GetTimeAsMsSinceEpoch(now),
+		ExpiresAt: util.GetTimeAsMsSinceEpoch(now.Add(tokenDuration)),
+	}
+	err := mgr.add(session)
+	assert.NoError(t, err)
+	sessionGet, err := mgr.get(session.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, session, sessionGet)
+	sessions, err := mgr.getAll()
+	assert.NoError(t, err)
+	assert.Contains(t, sessions, *session)
+	assert.False(t, mgr.isRevoked(session.ID))
+	err = mgr.revoke(session)
+	assert.NoError(t, err)
+	assert.True(t, mgr.isRevoked(session.ID))
+	_, err = mgr.get(session.ID)
+	assertSharedSessionNotFound(t, err)
+	sessions, err = mgr.getAll()
+	assert.NoError(t, err)
+	assert.NotContains(t, sessions, *session)
+	// revocation entries cannot be returned as sessions
+	_, err = mgr.get(revokedWebSessionKey + session.ID)
+	assert.Error(t, err)
+	// add an expired session
+	session.ID = util.GenerateUniqueID()
+	session.ExpiresAt = util.GetTimeAsMsSinceEpoch(now.Add(-1 * time.Minute))
+	err = mgr.add(session)
+	assert.NoError(t, err)
+	_, err = mgr.get(session.ID)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "session expired")
+	}
+	mgr.cleanup()
+	_, err = mgr.get(session.ID)
+	assertSharedSessionNotFound(t, err)
+
+	dbMgr, ok := mgr.(*dbWebSessionManager)
+	if assert.True(t, ok) {
+		_, err = dbMgr.decodeData("astring")
+		assert.Error(t, err)
+	}
+}
+
+func TestMemoryWebSessionManagerRevocations(t *testing.T) {
+	mgr := newWebSessionManager(0)
+	now := time.Now()
+	session := &webSession{
+		ID:        util.GenerateUniqueID(),
+		Username:  defaultAdminUsername,
+		Type:      webSessionTypeAdmin,
+		Source:    webSessionSourceAPI,
+		IP:        "127.0.0.1",
+		CreatedAt: util.GetTimeAsMsSinceEpoch(now),
+		ExpiresAt: util.GetTimeAsMsSinceEpoch(now.Add(tokenDuration)),
+	}
+	err := mgr.add(session)
+	assert.NoError(t, err)
+	err = mgr.revoke(session)
+	assert.NoError(t, err)
+	assert.True(t, mgr.isRevoked(session.ID))
+	_, err = mgr.get(session.ID)
+	assert.ErrorIs(t, err, util.ErrNotFound)
+	// the revocation is stored in the data provider and survives restarts
+	_, err = dataprovider.GetSharedSession(revokedWebSessionKey + session.ID)
+	assert.NoError(t, err)
+	mgr = newWebSessionManager(0)
+	assert.True(t, mgr.isRevoked(session.ID))
+	assert.False(t, mgr.isRevoked(util.GenerateUniqueID()))
+	mgr.cleanup()
+	assert.True(t, mgr.isRevoked(session.ID))
+
+	err = dataprovider.DeleteSharedSession(revokedWebSessionKey + session.ID)
+	assert.NoError(t, err)
+}
+
 func TestDecodeToken(t *testing.T) {
 	nodeID := "nodeID"
 	token := map[string]any{
@@ -3451,14 +3858,450 @@ func TestUserQuotaUsage(t *testing.T) {
 	assert.True(t, usage.IsTransferQuotaLow())
 }
 
+func assertSharedSessionNotFound(t *testing.T, err error) {
+	if dataprovider.GetProviderStatus().Driver == dataprovider.EtcdDataProviderName {
+		assert.ErrorIs(t, err, util.ErrNotFound)
+		return
+	}
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
 func isSharedProviderSupported() bool {
 	// SQLite shares the implementation with other SQL-based provider but it makes no sense
 	// to use it outside test cases
 	switch dataprovider.GetProviderStatus().Driver {
 	case dataprovider.MySQLDataProviderName, dataprovider.PGSQLDataProviderName,
-		dataprovider.CockroachDataProviderName, dataprovider.SQLiteDataProviderName:
+		dataprovider.CockroachDataProviderName, dataprovider.SQLiteDataProviderName,
+		dataprovider.EtcdDataProviderName:
 		return true
 	default:
 		return false
 	}
 }
+
+func TestUserPublicKeysSignature(t *testing.T) {
+	username := "missing user"
+	keysURL := getPublicKeysURL(username)
+	assert.Contains(t, keysURL, url.PathEscape(username))
+	assert.Contains(t, keysURL, getPublicKeysSignature(username))
+	assert.NotEqual(t, getPublicKeysSignature(username), getPublicKeysSignature(username+"1"))
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, keysURL, nil)
+	assert.NoError(t, err)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("username", username)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	getUserPublicKeys(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username:       username,
+			Status:         1,
+			ExpirationDate: util.GetTimeAsMsSinceEpoch(time.Now().Add(-1 * time.Hour)),
+			PublicKeys:     []string{"ssh-ed25519 AAAA"},
+		},
+	}
+	assert.Empty(t, getAuthorizedPublicKeys(&user))
+}
+
+func TestPublicKeysExpirationFromPostFields(t *testing.T) {
+	pubKey := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIElL26d02wTylLuNYR0UTsQLJXMsiAksWHl9JL959pBo"
+	form := make(url.Values)
+	form.Add("public_keys", pubKey)
+	form.Add("public_keys", "invalid key")
+	form.Add("public_keys", pubKey)
+	form.Add("public_keys_expiration", "2030-01-02")
+	form.Add("public_keys_expiration", "2030-01-02")
+	form.Add("public_keys_expiration", "")
+	req, err := http.NewRequest(http.MethodPost, webClientProfilePath, bytes.NewBuffer([]byte(form.Encode())))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	err = req.ParseForm()
+	assert.NoError(t, err)
+	expirations, err := getPublicKeysExpirationFromPostFields(req)
+	assert.NoError(t, err)
+	if assert.Len(t, expirations, 1) {
+		user := dataprovider.User{}
+		user.Filters.PublicKeysExpiration = expirations
+		assert.Equal(t, "2030-01-02", getPublicKeyExpirationAsString(&user, pubKey))
+		assert.Empty(t, getPublicKeyExpirationAsString(&user, "invalid key"))
+	}
+
+	form.Set("public_keys_expiration", "02/01/2030")
+	req, err = http.NewRequest(http.MethodPost, webClientProfilePath, bytes.NewBuffer([]byte(form.Encode())))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	err = req.ParseForm()
+	assert.NoError(t, err)
+	_, err = getPublicKeysExpirationFromPostFields(req)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "invalid expiration date for public key nr. 1")
+	}
+}
+
+func TestClientEncryptionHelpers(t *testing.T) {
+	user := dataprovider.User{}
+	user.Filters.ClientEncryptedFolders = []string{"/enc1", "/enc2"}
+	share := dataprovider.Share{
+		Paths: []string{"/enc1/file1", "/enc1/dir"},
+	}
+	assert.Equal(t, "/enc1", getShareClientEncryptedFolder(&user, &share))
+	share.Paths = []string{"/enc1/file1", "/enc2/file2"}
+	assert.Empty(t, getShareClientEncryptedFolder(&user, &share))
+	share.Paths = []string{"/enc1/file1", "/file2"}
+	assert.Empty(t, getShareClientEncryptedFolder(&user, &share))
+
+	reader, err := getClientEncryptedReader(&user, "/file", strings.NewReader("plain"))
+	assert.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "plain", string(data))
+
+	_, err = getClientEncryptedReader(&user, "/enc2/file", strings.NewReader(""))
+	assert.ErrorIs(t, err, util.ErrValidation)
+	assert.Equal(t, http.StatusBadRequest, getClientEncryptionErrorStatus(err))
+	_, err = getClientEncryptedReader(&user, "/enc2/file", strings.NewReader("SFTPGOE2\x02data"))
+	assert.ErrorIs(t, err, util.ErrValidation)
+	_, err = getClientEncryptedReader(&user, "/enc2/file", iotest.ErrReader(os.ErrClosed))
+	assert.ErrorIs(t, err, os.ErrClosed)
+	assert.NotEqual(t, http.StatusBadRequest, getClientEncryptionErrorStatus(err))
+
+	reader, err = getClientEncryptedReader(&user, "/enc2/file", strings.NewReader("SFTPGOE2\x01data"))
+	assert.NoError(t, err)
+	data, err = io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "SFTPGOE2\x01data", string(data))
+}
+
+func TestMediaConfig(t *testing.T) {
+	c := MediaConfig{}
+	assert.NoError(t, c.validate())
+	assert.Empty(t, c.getTranscodingType("file.mkv"))
+	assert.Equal(t, "video/mp4", c.getPlayerType("/dir/file.MP4"))
+	assert.Equal(t, "audio/ogg", c.getPlayerType("file.ogg"))
+	assert.Empty(t, c.getPlayerType("file.mkv"))
+	assert.Empty(t, c.getPlayerType("file.txt"))
+
+	c.TranscodingHook = "relative/path"
+	assert.Error(t, c.validate())
+	c.TranscodingHook = "http://127.0.0.1:8080/transcode"
+	assert.Error(t, c.validate())
+	c.MaxTranscodings = 1
+	c.VideoExtensions = []string{"MKV", ".avi", " ", ".mkv"}
+	c.AudioExtensions = []string{".WMA"}
+	assert.NoError(t, c.validate())
+	assert.Equal(t, []string{".mkv", ".avi"}, c.VideoExtensions)
+	assert.Equal(t, []string{".wma"}, c.AudioExtensions)
+	assert.Equal(t, mediaTypeVideo, c.getTranscodingType("/a/file.MKV"))
+	assert.Equal(t, mediaTypeAudio, c.getTranscodingType("file.wma"))
+	assert.Equal(t, "video/mp4", c.getPlayerType("file.avi"))
+	assert.Equal(t, "audio/mpeg", c.getPlayerType("file.wma"))
+	assert.Equal(t, "video/webm", c.getPlayerType("file.webm"))
+
+	r := httptest.NewRequest(http.MethodGet, "/stream?start=12.5", nil)
+	start, err := getMediaStart(r)
+	assert.NoError(t, err)
+	assert.Equal(t, 12.5, start)
+	r = httptest.NewRequest(http.MethodGet, "/stream?start=-1", nil)
+	_, err = getMediaStart(r)
+	assert.ErrorIs(t, err, util.ErrValidation)
+	assert.True(t, isFirstMediaRequest(r))
+	r.Header.Set("Range", "bytes=0-")
+	assert.True(t, isFirstMediaRequest(r))
+	r.Header.Set("Range", "bytes=100-")
+	assert.False(t, isFirstMediaRequest(r))
+}
+
+func TestStreamMedia(t *testing.T) {
+	if runtime.GOOS == osWindows {
+		t.Skip("this test is not available on Windows")
+	}
+	homeDir := filepath.Join(os.TempDir(), util.GenerateUniqueID())
+	err := os.MkdirAll(homeDir, os.ModePerm)
+	require.NoError(t, err)
+	defer os.RemoveAll(homeDir)
+
+	for _, name := range []string{"video.mkv", "video.mp4", "audio.wma"} {
+		err = os.WriteFile(filepath.Join(homeDir, name), []byte("media content"), 0644)
+		require.NoError(t, err)
+	}
+	hook := filepath.Join(homeDir, "transcode.sh")
+	err = os.WriteFile(hook, []byte("#!/bin/sh\necho \"$SFTPGO_MEDIA_NAME $SFTPGO_MEDIA_TYPE $SFTPGO_MEDIA_START\"\ncat\n"), 0755)
+	require.NoError(t, err)
+
+	config := mediaStreamer.getConfig()
+	defer mediaStreamer.setConfig(config)
+
+	c := MediaConfig{
+		TranscodingHook: hook,
+		MaxTranscodings: 1,
+		VideoExtensions: []string{".mkv"},
+		AudioExtensions: []string{".wma"},
+	}
+	require.NoError(t, c.validate())
+	mediaStreamer.setConfig(c)
+
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "media_user",
+			HomeDir:  homeDir,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+	}
+	connection := &Connection{
+		BaseConnection: common.NewBaseConnection(xid.New().String(), common.ProtocolHTTP, "", "", user),
+	}
+	stream := func(name string, r *http.Request) (*httptest.ResponseRecorder, int, error) {
+		info, err := os.Stat(filepath.Join(homeDir, name))
+		require.NoError(t, err)
+		rr := httptest.NewRecorder()
+		status, err := streamMedia(rr, r, connection, "/"+name, info, nil)
+		return rr, status, err
+	}
+	// native formats support range requests
+	r := httptest.NewRequest(http.MethodGet, "/stream", nil)
+	r.Header.Set("Range", "bytes=6-")
+	rr, status, err := stream("video.mp4", r)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, http.StatusPartialContent, rr.Code)
+	assert.Equal(t, "content", rr.Body.String())
+
+	r = httptest.NewRequest(http.MethodGet, "/stream?start=30", nil)
+	rr, status, err = stream("video.mkv", r)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "video/mp4", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "none", rr.Header().Get("Accept-Ranges"))
+	assert.Equal(t, "video.mkv video 30\nmedia content", rr.Body.String())
+
+	r = httptest.NewRequest(http.MethodHead, "/stream", nil)
+	rr, status, err = stream("audio.wma", r)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "audio/mpeg", rr.Header().Get("Content-Type"))
+	assert.Equal(t, 0, rr.Body.Len())
+
+	r = httptest.NewRequest(http.MethodGet, "/stream?start=a", nil)
+	_, status, err = stream("audio.wma", r)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	mediaStreamer.acquire()
+	r = httptest.NewRequest(http.MethodGet, "/stream", nil)
+	_, status, err = stream("video.mkv", r)
+	assert.ErrorIs(t, err, errTooManyTranscodings)
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	mediaStreamer.release()
+	// the hook fails before writing any output
+	err = os.WriteFile(hook, []byte("#!/bin/sh\necho failure >&2\nexit 1\n"), 0755)
+	require.NoError(t, err)
+	_, status, err = stream("video.mkv", r)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failure")
+	}
+	assert.Equal(t, http.StatusInternalServerError, status)
+	// the hook fails after writing some output
+	err = os.WriteFile(hook, []byte("#!/bin/sh\necho partial\nexit 1\n"), 0755)
+	require.NoError(t, err)
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		stream("video.mkv", r) //nolint:errcheck
+	})
+	// HTTP hook
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("type") != mediaTypeAudio {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "audio/aac")
+		data, _ := io.ReadAll(r.Body)
+		w.Write([]byte(r.URL.Query().Get("name") + " " + string(data))) //nolint:errcheck
+	}))
+	defer srv.Close()
+
+	c.TranscodingHook = srv.URL
+	mediaStreamer.setConfig(c)
+	rr, status, err = stream("audio.wma", r)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "audio/aac", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "audio.wma media content", rr.Body.String())
+	_, status, err = stream("video.mkv", r)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Equal(t, 0, mediaStreamer.running)
+}
+
+func TestRequestFilter(t *testing.T) {
+	b := Binding{
+		Address:         "",
+		Port:            8080,
+		EnableWebAdmin:  true,
+		EnableWebClient: true,
+		EnableRESTAPI:   true,
+		RequestFilter: RequestFilter{
+			Enabled:        true,
+			MaxHeadersSize: -1,
+		},
+	}
+	err := b.RequestFilter.initialize()
+	assert.Error(t, err)
+	b.RequestFilter.MaxHeadersSize = 1024
+	b.RequestFilter.DeniedPatterns = []string{"["}
+	err = b.RequestFilter.initialize()
+	assert.Error(t, err)
+	b.RequestFilter.DeniedPatterns = []string{`\.php$`, `(?i)select\s.+\sfrom`}
+	b.RequestFilter.Routes = []RequestFilterRoute{
+		{
+			Path: "relative",
+		},
+	}
+	err = b.RequestFilter.initialize()
+	assert.Error(t, err)
+	b.RequestFilter.Routes = []RequestFilterRoute{
+		{
+			Path: "/api/v2",
+			RateLimit: RequestFilterRateLimit{
+				Average: 1,
+				Period:  10,
+			},
+		},
+	}
+	err = b.RequestFilter.initialize()
+	assert.Error(t, err)
+	b.RequestFilter.DenyPathTraversal = true
+	b.RequestFilter.GenerateDefenderEvents = true
+	b.RequestFilter.Routes = []RequestFilterRoute{
+		{
+			Path:    "/api/v2/",
+			Methods: []string{"get", "post", "GET", "put", "delete"},
+		},
+		{
+			Path:    tokenPath,
+			Methods: []string{http.MethodGet},
+			RateLimit: RequestFilterRateLimit{
+				Average: 1,
+				Period:  60000,
+				Burst:   1,
+			},
+		},
+	}
+	err = b.RequestFilter.initialize()
+	require.NoError(t, err)
+	assert.Equal(t, "/api/v2", b.RequestFilter.Routes[0].Path)
+	assert.Equal(t, []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+		b.RequestFilter.Routes[0].Methods)
+	assert.Nil(t, b.RequestFilter.Routes[0].limiter)
+	assert.NotNil(t, b.RequestFilter.Routes[1].limiter)
+	assert.Equal(t, tokenPath, b.RequestFilter.getRoute(tokenPath+"/sub").Path)
+	assert.Equal(t, "/api/v2", b.RequestFilter.getRoute(userPath).Path)
+	assert.Nil(t, b.RequestFilter.getRoute("/api/v20"))
+
+	server := newHttpdServer(b, "", "", CorsConfig{}, "")
+	server.initializeRouter()
+	testServer := httptest.NewServer(server.router)
+	defer testServer.Close()
+
+	for _, p := range []string{
+		"/api/v2/../v2/users",
+		"/api/v2/%2e%2e/users",
+		"/api/v2/users?path=..%5C..%5Cetc",
+		"/api/v2/users?path=%252e%252e%252fetc",
+		"/api/v2/users?path=a%00b",
+	} {
+		req, err := http.NewRequest(http.MethodGet, p, nil)
+		require.NoError(t, err)
+		req.RemoteAddr = "127.0.0.1:1234"
+		rr := httptest.NewRecorder()
+		testServer.Config.Handler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, p)
+		assert.Contains(t, rr.Body.String(), errRequestPathTraversal.Error(), p)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "/index.php", nil)
+	require.NoError(t, err)
+	req.RemoteAddr = "127.0.0.1:1234"
+	rr := httptest.NewRecorder()
+	testServer.Config.Handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	req, err = http.NewRequest(http.MethodGet, userPath+"?filter=SELECT%20name%20FROM%20users", nil)
+	require.NoError(t, err)
+	req.RemoteAddr = "127.0.0.1:1234"
+	rr = httptest.NewRecorder()
+	testServer.Config.Handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), errRequestDenied.Error())
+
+	req, err = http.NewRequest(http.MethodGet, webClientLoginPath, nil)
+	require.NoError(t, err)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("X-Large-Header", strings.Repeat("a", 1024))
+	rr = httptest.NewRecorder()
+	testServer.Config.Handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, rr.Code)
+
+	req, err = http.NewRequest(http.MethodPatch, userPath, nil)
+	require.NoError(t, err)
+	req.RemoteAddr = "127.0.0.1:1234"
+	rr = httptest.NewRecorder()
+	testServer.Config.Handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	assert.Equal(t, "GET, POST, PUT, DELETE", rr.Header().Get("Allow"))
+
+	req, err = http.NewRequest(http.MethodPost, tokenPath, nil)
+	require.NoError(t, err)
+	req.RemoteAddr = "127.0.0.1:1234"
+	rr = httptest.NewRecorder()
+	testServer.Config.Handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	assert.Equal(t, http.MethodGet, rr.Header().Get("Allow"))
+
+	req, err = http.NewRequest(http.MethodGet, tokenPath, nil)
+	require.NoError(t, err)
+	req.RemoteAddr = "127.0.0.1:1234"
+	rr = httptest.NewRecorder()
+	testServer.Config.Handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	rr = httptest.NewRecorder()
+	testServer.Config.Handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+	// the rate limit is per source IP
+	req.RemoteAddr = "127.0.0.2:1234"
+	rr = httptest.NewRecorder()
+	testServer.Config.Handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	req, err = http.NewRequest(http.MethodGet, webClientLoginPath, nil)
+	require.NoError(t, err)
+	req.RemoteAddr = "127.0.0.1:1234"
+	rr = httptest.NewRecorder()
+	testServer.Config.Handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestParseContentRange(t *testing.T) {
+	for _, header := range []string{"", "bytes", "bytes 0-9", "items 0-9/10", "bytes a-9/10", "bytes 0-b/10",
+		"bytes 10-9/20", "bytes -1-9/10", "bytes 0-9/9", "bytes 0-9/c", "bytes */10"} {
+		_, err := parseContentRange(header)
+		assert.ErrorIs(t, err, util.ErrValidation, header)
+	}
+	cr, err := parseContentRange("bytes 0-9/10")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), cr.length())
+	assert.True(t, cr.isLast())
+	cr, err = parseContentRange("bytes 10-19/100")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), cr.start)
+	assert.Equal(t, int64(10), cr.length())
+	assert.False(t, cr.isLast())
+	cr, err = parseContentRange("bytes 10-19/*")
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), cr.total)
+	assert.False(t, cr.isLast())
+}
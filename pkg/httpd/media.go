@@ -0,0 +1,343 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/command"
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/httpclient"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// Media types for transcoding hooks
+const (
+	mediaTypeVideo = "video"
+	mediaTypeAudio = "audio"
+)
+
+var (
+	errTooManyTranscodings = errors.New("too many concurrent transcodings")
+	mediaStreamer          = &mediaTranscoder{}
+	// content types for the formats that browsers can play natively
+	nativeMediaTypes = map[string]string{
+		".mp4":  "video/mp4",
+		".m4v":  "video/mp4",
+		".mov":  "video/mp4",
+		".webm": "video/webm",
+		".ogv":  "video/ogg",
+		".ogg":  "audio/ogg",
+		".oga":  "audio/ogg",
+		".opus": "audio/ogg",
+		".mp3":  "audio/mpeg",
+		".m4a":  "audio/mp4",
+		".aac":  "audio/aac",
+		".wav":  "audio/wav",
+		".flac": "audio/flac",
+	}
+	// content types for the transcoded streams
+	transcodedMediaTypes = map[string]string{
+		mediaTypeVideo: "video/mp4",
+		mediaTypeAudio: "audio/mpeg",
+	}
+)
+
+// MediaConfig defines the configuration for media streaming
+type MediaConfig struct {
+	// Hook to transcode the media formats that browsers cannot play.
+	// It can be an HTTP URL or an absolute path to a program. The media
+	// contents are sent as request body, or as program standard input,
+	// and the transcoded stream is read from the response body, or from
+	// the program standard output
+	TranscodingHook string `json:"transcoding_hook" mapstructure:"transcoding_hook"`
+	// Maximum number of concurrent transcodings
+	MaxTranscodings int `json:"max_transcodings" mapstructure:"max_transcodings"`
+	// Video file extensions, for example ".mkv", to transcode
+	VideoExtensions []string `json:"video_extensions" mapstructure:"video_extensions"`
+	// Audio file extensions, for example ".wma", to transcode
+	AudioExtensions []string `json:"audio_extensions" mapstructure:"audio_extensions"`
+}
+
+func (c *MediaConfig) validate() error {
+	if c.TranscodingHook == "" {
+		return nil
+	}
+	if !strings.HasPrefix(c.TranscodingHook, "http") {
+		if !filepath.IsAbs(c.TranscodingHook) {
+			return fmt.Errorf("invalid transcoding hook %q, the program path must be absolute", c.TranscodingHook)
+		}
+	} else if _, err := url.Parse(c.TranscodingHook); err != nil {
+		return fmt.Errorf("invalid transcoding hook %q: %w", c.TranscodingHook, err)
+	}
+	if c.MaxTranscodings < 1 {
+		return fmt.Errorf("invalid max transcodings: %d", c.MaxTranscodings)
+	}
+	c.VideoExtensions = normalizeMediaExtensions(c.VideoExtensions)
+	c.AudioExtensions = normalizeMediaExtensions(c.AudioExtensions)
+	return nil
+}
+
+func normalizeMediaExtensions(extensions []string) []string {
+	var result []string
+	for _, ext := range extensions {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if !util.Contains(result, ext) {
+			result = append(result, ext)
+		}
+	}
+	return result
+}
+
+// getTranscodingType returns the media type if the specified file must be
+// transcoded, an empty string otherwise
+func (c *MediaConfig) getTranscodingType(name string) string {
+	if c.TranscodingHook == "" {
+		return ""
+	}
+	ext := strings.ToLower(path.Ext(name))
+	if util.Contains(c.VideoExtensions, ext) {
+		return mediaTypeVideo
+	}
+	if util.Contains(c.AudioExtensions, ext) {
+		return mediaTypeAudio
+	}
+	return ""
+}
+
+// getPlayerType returns the content type to use in media players for the
+// specified file, an empty string means that the file cannot be played
+func (c *MediaConfig) getPlayerType(name string) string {
+	if mediaType := c.getTranscodingType(name); mediaType != "" {
+		return transcodedMediaTypes[mediaType]
+	}
+	return nativeMediaTypes[strings.ToLower(path.Ext(name))]
+}
+
+type mediaTranscoder struct {
+	sync.RWMutex
+	config  MediaConfig
+	running int
+}
+
+func (t *mediaTranscoder) setConfig(config MediaConfig) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.config = config
+}
+
+func (t *mediaTranscoder) getConfig() MediaConfig {
+	t.RLock()
+	defer t.RUnlock()
+
+	return t.config
+}
+
+func (t *mediaTranscoder) acquire() bool {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.running >= t.config.MaxTranscodings {
+		return false
+	}
+	t.running++
+	return true
+}
+
+func (t *mediaTranscoder) release() {
+	t.Lock()
+	defer t.Unlock()
+
+	t.running--
+}
+
+// mediaResponseWriter sends the response headers on the first write, so an
+// error can be returned if the hook fails before producing any output
+type mediaResponseWriter struct {
+	w           http.ResponseWriter
+	contentType string
+	written     int64
+}
+
+func (w *mediaResponseWriter) Write(p []byte) (int, error) {
+	if w.written == 0 && len(p) > 0 {
+		w.w.Header().Set("Content-Type", w.contentType)
+		w.w.Header().Set("Cache-Control", "no-store")
+		w.w.Header().Set("Accept-Ranges", "none")
+		w.w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.w.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// transcode sends the media contents read from reader to the configured hook
+// and writes the transcoded stream to w
+func (t *mediaTranscoder) transcode(ctx context.Context, w *mediaResponseWriter, reader io.Reader,
+	conn *Connection, name, mediaType string, start float64, hook string,
+) error {
+	startValue := strconv.FormatFloat(start, 'f', -1, 64)
+	if strings.HasPrefix(hook, "http") {
+		u, err := url.Parse(hook)
+		if err != nil {
+			return err
+		}
+		q := u.Query()
+		q.Set("name", path.Base(name))
+		q.Set("type", mediaType)
+		q.Set("start", startValue)
+		u.RawQuery = q.Encode()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), reader)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		client := httpclient.GetDownloadHTTPClient(nil)
+		defer client.CloseIdleConnections()
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status code from transcoding hook: %d", resp.StatusCode)
+		}
+		if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+			w.contentType = contentType
+		}
+		_, err = io.Copy(w, resp.Body)
+		return err
+	}
+	// the command timeout is ignored, the program runs until the whole
+	// stream is sent or the client disconnects
+	_, env, args := command.GetConfig(hook, command.HookTranscoding)
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, hook, args...)
+	cmd.Env = append(env,
+		fmt.Sprintf("SFTPGO_MEDIA_NAME=%s", path.Base(name)),
+		fmt.Sprintf("SFTPGO_MEDIA_TYPE=%s", mediaType),
+		fmt.Sprintf("SFTPGO_MEDIA_START=%s", startValue),
+		fmt.Sprintf("SFTPGO_MEDIA_USERNAME=%s", conn.User.Username))
+	cmd.Stdin = reader
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("transcoding program error: %w, stderr: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func getMediaStart(r *http.Request) (float64, error) {
+	val := r.URL.Query().Get("start")
+	if val == "" {
+		return 0, nil
+	}
+	start, err := strconv.ParseFloat(val, 64)
+	if err != nil || start < 0 {
+		return 0, util.NewValidationError(fmt.Sprintf("invalid start position %q", val))
+	}
+	return start, nil
+}
+
+// isFirstMediaRequest returns false for range requests that do not start from
+// the beginning of the file, media players send several range requests while
+// playing a single file
+func isFirstMediaRequest(r *http.Request) bool {
+	rangeHeader := r.Header.Get("Range")
+	return rangeHeader == "" || strings.HasPrefix(rangeHeader, "bytes=0-")
+}
+
+// streamMedia streams the specified file for inline playback. The formats that
+// browsers cannot play are transcoded using the configured hook, range requests
+// are supported for the other formats. The same contract of downloadFile applies
+// for the returned values, share must be nil if the share usage was not updated
+func streamMedia(w http.ResponseWriter, r *http.Request, connection *Connection, name string,
+	info os.FileInfo, share *dataprovider.Share,
+) (int, error) {
+	config := mediaStreamer.getConfig()
+	mediaType := config.getTranscodingType(name)
+	if mediaType == "" {
+		return downloadFile(w, r, connection, name, info, true, share)
+	}
+	if err := checkDownloadFileFromShare(share, info); err != nil {
+		return http.StatusBadRequest, err
+	}
+	start, err := getMediaStart(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Type", transcodedMediaTypes[mediaType])
+		w.Header().Set("Accept-Ranges", "none")
+		w.WriteHeader(http.StatusOK)
+		return http.StatusOK, nil
+	}
+	if !mediaStreamer.acquire() {
+		return http.StatusTooManyRequests, errTooManyTranscodings
+	}
+	defer mediaStreamer.release()
+
+	reader, err := connection.getFileReader(name, 0, r.Method)
+	if err != nil {
+		return getMappedStatusCode(err), fmt.Errorf("unable to read file %q: %v", name, err)
+	}
+	defer reader.Close()
+
+	startTime := time.Now()
+	mw := &mediaResponseWriter{
+		w:           w,
+		contentType: transcodedMediaTypes[mediaType],
+	}
+	err = mediaStreamer.transcode(r.Context(), mw, reader, connection, name, mediaType, start, config.TranscodingHook)
+	connection.Log(logger.LevelDebug, "transcoding completed for %q, type: %s, start: %v, written: %d, elapsed: %s, err: %v",
+		name, mediaType, start, mw.written, time.Since(startTime), err)
+	if err != nil {
+		if mw.written == 0 {
+			return http.StatusInternalServerError, fmt.Errorf("unable to transcode %q: %w", name, err)
+		}
+		if share != nil {
+			updateShareUsage(share, connection.GetRemoteIP(), -1)
+		}
+		panic(http.ErrAbortHandler)
+	}
+	if share != nil {
+		addShareEvent(connection, share, name, mw.written)
+	}
+	return http.StatusOK, nil
+}
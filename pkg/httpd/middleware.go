@@ -15,25 +15,31 @@
 package httpd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/jwtauth/v5"
 	"github.com/lestrrat-go/jwx/v2/jwt"
 	"github.com/rs/xid"
 	"github.com/sftpgo/sdk"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/drakkan/sftpgo/v2/pkg/common"
 	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
 	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/tracing"
 	"github.com/drakkan/sftpgo/v2/pkg/util"
 )
 
 var (
 	forwardedProtoKey = &contextKey{"forwarded proto"}
+	debugCaptureKey   = &contextKey{"debug capture"}
 	errInvalidToken   = errors.New("invalid JWT token")
 )
 
@@ -45,6 +51,117 @@ func (k *contextKey) String() string {
 	return "context value " + k.name
 }
 
+// setRequestID generates a unique ID for each request and returns it to the client.
+// The request ID is the correlation ID for the request, it is included in the
+// access log and in the IDs of the connections created for the request.
+// Request IDs sent by the clients are ignored, they are not guaranteed to be unique
+func setRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqID := xid.New().String()
+		w.Header().Set(logger.CorrelationIDHeader, reqID)
+		ctx := context.WithValue(r.Context(), middleware.RequestIDKey, reqID)
+		ctx = logger.WithCorrelationID(ctx, reqID)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func traceRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tracing.IsEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		reqID := getRequestID(r)
+		ctx, span := tracing.Start(r.Context(), "HTTP "+r.Method,
+			attribute.String("http.method", r.Method),
+			attribute.String("http.target", r.URL.Path),
+			attribute.String("net.sock.peer.addr", util.GetIPFromRemoteAddress(r.RemoteAddr)),
+			attribute.String("sftpgo.request_id", reqID))
+		// the connections and transfers started while serving this request
+		// will be children of the request span
+		tracing.SetConnectionContext(ctx, reqID)
+		defer tracing.RemoveConnectionContext(reqID)
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		tracing.EndSpan(span, tracing.ErrorFromStatus(status))
+	})
+}
+
+// httpCaptureSource identifies an HTTP request for debug captures. The username
+// is set, after the authentication, for WebClient and user API requests
+type httpCaptureSource struct {
+	id         string
+	username   string
+	localAddr  string
+	remoteAddr string
+}
+
+func (s *httpCaptureSource) GetID() string {
+	return s.id
+}
+
+func (s *httpCaptureSource) GetProtocol() string {
+	return common.ProtocolHTTP
+}
+
+func (s *httpCaptureSource) GetUsername() string {
+	return s.username
+}
+
+func (s *httpCaptureSource) GetLocalAddress() string {
+	return s.localAddr
+}
+
+func (s *httpCaptureSource) GetRemoteAddress() string {
+	return s.remoteAddr
+}
+
+// captureDebugEvents adds the requests to the matching debug captures
+func captureDebugEvents(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !common.DebugCaptures.IsActive() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		src := &httpCaptureSource{
+			id:         fmt.Sprintf("%s_%s", common.ProtocolHTTP, getRequestID(r)),
+			localAddr:  util.GetHTTPLocalAddress(r),
+			remoteAddr: r.RemoteAddr,
+		}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), debugCaptureKey, src)))
+		common.DebugCaptures.CaptureHTTPRequest(src, r, ww.Status(), int64(ww.BytesWritten()), time.Since(start))
+	})
+}
+
+func setDebugCaptureUsername(r *http.Request) {
+	src, ok := r.Context().Value(debugCaptureKey).(*httpCaptureSource)
+	if !ok {
+		return
+	}
+	if claims, err := getTokenClaims(r); err == nil {
+		src.username = claims.Username
+	}
+}
+
+// getRequestID returns the ID for the specified request
+func getRequestID(r *http.Request) string {
+	if reqID := middleware.GetReqID(r.Context()); reqID != "" {
+		return reqID
+	}
+	return xid.New().String()
+}
+
 func validateJWTToken(w http.ResponseWriter, r *http.Request, audience tokenAudience) error {
 	token, _, err := jwtauth.FromContext(r.Context())
 
@@ -85,6 +202,11 @@ func validateJWTToken(w http.ResponseWriter, r *http.Request, audience tokenAudi
 		doRedirect("Your token is no longer valid", nil)
 		return errInvalidToken
 	}
+	if isWebSessionRevoked(token) {
+		logger.Debug(logSender, "", "the session for the token with id %q has been revoked", token.JwtID())
+		doRedirect("Your session has been revoked", nil)
+		return errInvalidToken
+	}
 	// a user with a partial token will be always redirected to the appropriate two factor auth page
 	if err := checkPartialAuth(w, r, audience, token.Audience()); err != nil {
 		return err
@@ -159,6 +281,7 @@ func jwtAuthenticatorAPIUser(next http.Handler) http.Handler {
 		if err := validateJWTToken(w, r, tokenAudienceAPIUser); err != nil {
 			return
 		}
+		setDebugCaptureUsername(r)
 
 		// Token is authenticated, pass it through
 		next.ServeHTTP(w, r)
@@ -181,12 +304,40 @@ func jwtAuthenticatorWebClient(next http.Handler) http.Handler {
 		if err := validateJWTToken(w, r, tokenAudienceWebClient); err != nil {
 			return
 		}
+		setDebugCaptureUsername(r)
 
 		// Token is authenticated, pass it through
 		next.ServeHTTP(w, r)
 	})
 }
 
+// limitAuthenticatedRate applies the per-user rate limiters, API keys have
+// their own limits
+func (s *httpdServer) limitAuthenticatedRate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := getTokenClaims(r)
+		if err == nil && claims.Username != "" {
+			key := "admin_" + claims.Username
+			if claims.hasUserAudience() {
+				key = "user_" + claims.Username
+			}
+			if claims.APIKeyID != "" {
+				key = "apikey_" + claims.APIKeyID
+			}
+			ipAddr := util.GetIPFromRemoteAddress(r.RemoteAddr)
+			if delay, err := common.LimitHTTPUserRate(ipAddr, key, r.URL.Path); err != nil {
+				delay += 499999999 * time.Nanosecond
+				w.Header().Set("Retry-After", fmt.Sprintf("%.0f", delay.Seconds()))
+				w.Header().Set("X-Retry-In", delay.String())
+				s.sendTooManyRequestResponse(w, r, err)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (s *httpdServer) checkHTTPUserPerm(perm string) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -216,6 +367,23 @@ func (s *httpdServer) checkHTTPUserPerm(perm string) func(next http.Handler) htt
 	}
 }
 
+// checkUserWebhooksEnabled returns a not found error if user webhooks are disabled
+func (s *httpdServer) checkUserWebhooksEnabled(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !common.IsUserWebhooksEnabled() {
+			err := util.NewRecordNotFoundError("user webhooks are disabled")
+			if isWebRequest(r) {
+				s.renderClientNotFoundPage(w, r, err)
+			} else {
+				sendAPIResponse(w, r, err, "", http.StatusNotFound)
+			}
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 // checkAuthRequirements checks if the user must set a second factor auth or change the password
 func (s *httpdServer) checkAuthRequirements(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -230,6 +398,15 @@ func (s *httpdServer) checkAuthRequirements(next http.Handler) http.Handler {
 		}
 		tokenClaims := jwtTokenClaims{}
 		tokenClaims.Decode(claims)
+		if tokenClaims.MustAcceptConsents {
+			if isWebRequest(r) {
+				http.Redirect(w, r, webClientConsentsPath, http.StatusFound)
+			} else {
+				sendAPIResponse(w, r, nil, "Consent documents acceptance required. Please accept them using the WebClient",
+					http.StatusForbidden)
+			}
+			return
+		}
 		if tokenClaims.MustSetTwoFactorAuth || tokenClaims.MustChangePassword {
 			var message string
 			if tokenClaims.MustSetTwoFactorAuth {
@@ -397,6 +574,18 @@ func checkAPIKeyAuth(tokenAuth *jwtauth.JWTAuth, scope dataprovider.APIKeyScope)
 				sendAPIResponse(w, r, fmt.Errorf("the provided api key cannot be authenticated"), "", http.StatusUnauthorized)
 				return
 			}
+			if !k.IsAllowedFromIP(util.GetIPFromRemoteAddress(r.RemoteAddr)) {
+				logger.Debug(logSender, "", "api key %q cannot be used from IP %q", keyID, r.RemoteAddr)
+				sendAPIResponse(w, r, fmt.Errorf("the provided api key cannot be used from this IP address"), "",
+					http.StatusForbidden)
+				return
+			}
+			if !k.IsEndpointAllowed(r.Method, r.URL.Path) {
+				logger.Debug(logSender, "", "api key %q is not allowed for %s %q", keyID, r.Method, r.URL.Path)
+				sendAPIResponse(w, r, fmt.Errorf("the provided api key is not allowed for this endpoint"), "",
+					http.StatusForbidden)
+				return
+			}
 			if scope == dataprovider.APIKeyScopeAdmin {
 				if k.Admin != "" {
 					apiUser = k.Admin
@@ -416,7 +605,7 @@ func checkAPIKeyAuth(tokenAuth *jwtauth.JWTAuth, scope dataprovider.APIKeyScope)
 				if err := authenticateUserWithAPIKey(apiUser, keyID, tokenAuth, r); err != nil {
 					logger.Debug(logSender, "", "unable to authenticate user %q associated with api key %q: %v",
 						apiUser, apiKey, err)
-					updateLoginMetrics(&dataprovider.User{BaseUser: sdk.BaseUser{Username: apiUser}},
+					updateLoginMetrics(r.Context(), &dataprovider.User{BaseUser: sdk.BaseUser{Username: apiUser}},
 						dataprovider.LoginMethodPassword, util.GetIPFromRemoteAddress(r.RemoteAddr), err)
 					code := http.StatusUnauthorized
 					if errors.Is(err, common.ErrInternalFailure) {
@@ -426,7 +615,7 @@ func checkAPIKeyAuth(tokenAuth *jwtauth.JWTAuth, scope dataprovider.APIKeyScope)
 						"", code)
 					return
 				}
-				updateLoginMetrics(&dataprovider.User{BaseUser: sdk.BaseUser{Username: apiUser}},
+				updateLoginMetrics(r.Context(), &dataprovider.User{BaseUser: sdk.BaseUser{Username: apiUser}},
 					dataprovider.LoginMethodPassword, util.GetIPFromRemoteAddress(r.RemoteAddr), nil)
 			}
 			dataprovider.UpdateAPIKeyLastUse(&k) //nolint:errcheck
@@ -468,11 +657,13 @@ func authenticateAdminWithAPIKey(username, keyID string, tokenAuth *jwtauth.JWTA
 		return err
 	}
 	c := jwtTokenClaims{
-		Username:    admin.Username,
-		Permissions: admin.Permissions,
-		Signature:   admin.GetSignature(),
-		Role:        admin.Role,
-		APIKeyID:    keyID,
+		Username:  admin.Username,
+		Signature: admin.GetSignature(),
+		Role:      admin.Role,
+		APIKeyID:  keyID,
+	}
+	if err := c.setAdminAccessSettings(&admin); err != nil {
+		return err
 	}
 
 	resp, err := c.createTokenResponse(tokenAuth, tokenAudienceAPI, ipAddr)
@@ -489,7 +680,7 @@ func authenticateUserWithAPIKey(username, keyID string, tokenAuth *jwtauth.JWTAu
 	protocol := common.ProtocolHTTP
 	if username == "" {
 		err := errors.New("the provided key is not associated with any user and no username was provided")
-		updateLoginMetrics(&dataprovider.User{BaseUser: sdk.BaseUser{Username: username}},
+		updateLoginMetrics(r.Context(), &dataprovider.User{BaseUser: sdk.BaseUser{Username: username}},
 			dataprovider.LoginMethodPassword, ipAddr, err)
 		return err
 	}
@@ -498,46 +689,47 @@ func authenticateUserWithAPIKey(username, keyID string, tokenAuth *jwtauth.JWTAu
 	}
 	user, err := dataprovider.GetUserWithGroupSettings(username, "")
 	if err != nil {
-		updateLoginMetrics(&dataprovider.User{BaseUser: sdk.BaseUser{Username: username}},
+		updateLoginMetrics(r.Context(), &dataprovider.User{BaseUser: sdk.BaseUser{Username: username}},
 			dataprovider.LoginMethodPassword, ipAddr, err)
 		return err
 	}
 	if !user.Filters.AllowAPIKeyAuth {
 		err := fmt.Errorf("API key authentication disabled for user %q", user.Username)
-		updateLoginMetrics(&user, dataprovider.LoginMethodPassword, ipAddr, err)
+		updateLoginMetrics(r.Context(), &user, dataprovider.LoginMethodPassword, ipAddr, err)
 		return err
 	}
 	if err := user.CheckLoginConditions(); err != nil {
-		updateLoginMetrics(&user, dataprovider.LoginMethodPassword, ipAddr, err)
+		updateLoginMetrics(r.Context(), &user, dataprovider.LoginMethodPassword, ipAddr, err)
 		return err
 	}
-	connectionID := fmt.Sprintf("%v_%v", protocol, xid.New().String())
+	connectionID := fmt.Sprintf("%v_%v", protocol, getRequestID(r))
 	if err := checkHTTPClientUser(&user, r, connectionID, true); err != nil {
-		updateLoginMetrics(&user, dataprovider.LoginMethodPassword, ipAddr, err)
+		updateLoginMetrics(r.Context(), &user, dataprovider.LoginMethodPassword, ipAddr, err)
 		return err
 	}
 	defer user.CloseFs() //nolint:errcheck
 	err = user.CheckFsRoot(connectionID)
 	if err != nil {
-		updateLoginMetrics(&user, dataprovider.LoginMethodPassword, ipAddr, common.ErrInternalFailure)
+		updateLoginMetrics(r.Context(), &user, dataprovider.LoginMethodPassword, ipAddr, common.ErrInternalFailure)
 		return common.ErrInternalFailure
 	}
 	c := jwtTokenClaims{
-		Username:    user.Username,
-		Permissions: user.Filters.WebClient,
-		Signature:   user.GetSignature(),
-		Role:        user.Role,
-		APIKeyID:    keyID,
+		Username:           user.Username,
+		Permissions:        user.Filters.WebClient,
+		Signature:          user.GetSignature(),
+		Role:               user.Role,
+		APIKeyID:           keyID,
+		MustAcceptConsents: common.MustAcceptConsentsForProtocol(&user, common.ProtocolHTTP),
 	}
 
 	resp, err := c.createTokenResponse(tokenAuth, tokenAudienceAPIUser, ipAddr)
 	if err != nil {
-		updateLoginMetrics(&user, dataprovider.LoginMethodPassword, ipAddr, common.ErrInternalFailure)
+		updateLoginMetrics(r.Context(), &user, dataprovider.LoginMethodPassword, ipAddr, common.ErrInternalFailure)
 		return err
 	}
 	r.Header.Set("Authorization", fmt.Sprintf("Bearer %v", resp["access_token"]))
 	dataprovider.UpdateLastLogin(&user)
-	updateLoginMetrics(&user, dataprovider.LoginMethodPassword, ipAddr, nil)
+	updateLoginMetrics(r.Context(), &user, dataprovider.LoginMethodPassword, ipAddr, nil)
 
 	return nil
 }
@@ -190,6 +190,7 @@ type oidcPendingAuth struct {
 	Nonce    string        `json:"nonce"`
 	Audience tokenAudience `json:"audience"`
 	IssuedAt int64         `json:"issued_at"`
+	Tenant   string        `json:"tenant,omitempty"`
 }
 
 func newOIDCPendingAuth(audience tokenAudience) oidcPendingAuth {
@@ -211,12 +212,15 @@ type oidcToken struct {
 	Nonce                string          `json:"nonce"`
 	Username             string          `json:"username"`
 	Permissions          []string        `json:"permissions"`
+	UserGroups           []string        `json:"user_groups,omitempty"`
 	HideUserPageSections int             `json:"hide_user_page_sections,omitempty"`
 	TokenRole            string          `json:"token_role,omitempty"` // SFTPGo role name
 	Role                 any             `json:"role"`                 // oidc user role: SFTPGo user or admin
 	CustomFields         *map[string]any `json:"custom_fields,omitempty"`
 	Cookie               string          `json:"cookie"`
 	UsedAt               int64           `json:"used_at"`
+	Tenant               string          `json:"tenant,omitempty"` // role name for tenant logins
+	MustAcceptConsents   bool            `json:"must_accept_consents,omitempty"`
 }
 
 func (t *oidcToken) parseClaims(claims map[string]any, usernameField, roleField string, customFields []string,
@@ -371,7 +375,12 @@ func (t *oidcToken) refreshUser(r *http.Request) error {
 		if err := admin.CanLogin(util.GetIPFromRemoteAddress(r.RemoteAddr)); err != nil {
 			return err
 		}
-		t.Permissions = admin.Permissions
+		permissions, userGroups, err := admin.GetAccessSettings()
+		if err != nil {
+			return err
+		}
+		t.Permissions = permissions
+		t.UserGroups = userGroups
 		t.TokenRole = admin.Role
 		t.HideUserPageSections = admin.Filters.Preferences.HideUserPageSections
 		return nil
@@ -386,8 +395,21 @@ func (t *oidcToken) refreshUser(r *http.Request) error {
 	if err := checkHTTPClientUser(&user, r, xid.New().String(), true); err != nil {
 		return err
 	}
+	if err := t.checkTenant(&user); err != nil {
+		return err
+	}
 	t.Permissions = user.Filters.WebClient
 	t.TokenRole = user.Role
+	t.MustAcceptConsents = common.MustAcceptConsents(&user)
+	return nil
+}
+
+// checkTenant checks that the specified user is associated with the tenant
+// the token was issued for
+func (t *oidcToken) checkTenant(user *dataprovider.User) error {
+	if t.Tenant != "" && user.Role != t.Tenant {
+		return fmt.Errorf("user %q is not associated with tenant %q", user.Username, t.Tenant)
+	}
 	return nil
 }
 
@@ -416,7 +438,12 @@ func (t *oidcToken) getUser(r *http.Request) error {
 		if err := admin.CanLogin(ipAddr); err != nil {
 			return err
 		}
-		t.Permissions = admin.Permissions
+		permissions, userGroups, err := admin.GetAccessSettings()
+		if err != nil {
+			return err
+		}
+		t.Permissions = permissions
+		t.UserGroups = userGroups
 		t.TokenRole = admin.Role
 		t.HideUserPageSections = admin.Filters.Preferences.HideUserPageSections
 		dataprovider.UpdateAdminLastLogin(admin)
@@ -428,36 +455,41 @@ func (t *oidcToken) getUser(r *http.Request) error {
 		return err
 	}
 	if user == nil {
-		u, err := dataprovider.GetUserAfterIDPAuth(t.Username, ipAddr, common.ProtocolOIDC, t.CustomFields)
+		u, err := dataprovider.GetUserAfterIDPAuthContext(r.Context(), t.Username, ipAddr, common.ProtocolOIDC, t.CustomFields)
 		if err != nil {
 			return err
 		}
 		user = &u
 	}
+	if err := t.checkTenant(user); err != nil {
+		updateLoginMetrics(r.Context(), user, dataprovider.LoginMethodIDP, ipAddr, err)
+		return err
+	}
 	if err := common.Config.ExecutePostConnectHook(ipAddr, common.ProtocolOIDC); err != nil {
-		updateLoginMetrics(user, dataprovider.LoginMethodIDP, ipAddr, err)
+		updateLoginMetrics(r.Context(), user, dataprovider.LoginMethodIDP, ipAddr, err)
 		return fmt.Errorf("access denied: %w", err)
 	}
 	if err := user.CheckLoginConditions(); err != nil {
-		updateLoginMetrics(user, dataprovider.LoginMethodIDP, ipAddr, err)
+		updateLoginMetrics(r.Context(), user, dataprovider.LoginMethodIDP, ipAddr, err)
 		return err
 	}
-	connectionID := fmt.Sprintf("%s_%s", common.ProtocolOIDC, xid.New().String())
+	connectionID := fmt.Sprintf("%s_%s", common.ProtocolOIDC, getRequestID(r))
 	if err := checkHTTPClientUser(user, r, connectionID, true); err != nil {
-		updateLoginMetrics(user, dataprovider.LoginMethodIDP, ipAddr, err)
+		updateLoginMetrics(r.Context(), user, dataprovider.LoginMethodIDP, ipAddr, err)
 		return err
 	}
 	defer user.CloseFs() //nolint:errcheck
 	err = user.CheckFsRoot(connectionID)
 	if err != nil {
 		logger.Warn(logSender, connectionID, "unable to check fs root: %v", err)
-		updateLoginMetrics(user, dataprovider.LoginMethodIDP, ipAddr, common.ErrInternalFailure)
+		updateLoginMetrics(r.Context(), user, dataprovider.LoginMethodIDP, ipAddr, common.ErrInternalFailure)
 		return err
 	}
-	updateLoginMetrics(user, dataprovider.LoginMethodIDP, ipAddr, nil)
+	updateLoginMetrics(r.Context(), user, dataprovider.LoginMethodIDP, ipAddr, nil)
 	dataprovider.UpdateLastLogin(user)
 	t.Permissions = user.Filters.WebClient
 	t.TokenRole = user.Role
+	t.MustAcceptConsents = common.MustAcceptConsents(user)
 	return nil
 }
 
@@ -488,7 +520,11 @@ func (s *httpdServer) validateOIDCToken(w http.ResponseWriter, r *http.Request,
 		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 		defer cancel()
 
-		if err = token.refresh(ctx, s.binding.OIDC.oauth2Config, s.binding.OIDC.getVerifier(ctx), r); err != nil {
+		config, err := s.getOIDC(token.Tenant)
+		if err == nil {
+			err = token.refresh(ctx, config.oauth2Config, config.getVerifier(ctx), r)
+		}
+		if err != nil {
 			setFlashMessage(w, r, "Your OpenID token is expired, please log-in again")
 			doRedirect()
 			return oidcToken{}, errInvalidToken
@@ -517,7 +553,7 @@ func (s *httpdServer) validateOIDCToken(w http.ResponseWriter, r *http.Request,
 func (s *httpdServer) oidcTokenAuthenticator(audience tokenAudience) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if canSkipOIDCValidation(r) {
+			if canSkipOIDCValidation(r) || (!s.binding.OIDC.isEnabled() && !hasOIDCCookie(r)) {
 				next.ServeHTTP(w, r)
 				return
 			}
@@ -528,8 +564,10 @@ func (s *httpdServer) oidcTokenAuthenticator(audience tokenAudience) func(next h
 			jwtTokenClaims := jwtTokenClaims{
 				Username:             token.Username,
 				Permissions:          token.Permissions,
+				UserGroups:           token.UserGroups,
 				Role:                 token.TokenRole,
 				HideUserPageSections: token.HideUserPageSections,
+				MustAcceptConsents:   token.MustAcceptConsents,
 			}
 			_, tokenString, err := jwtTokenClaims.createToken(s.tokenAuth, audience, util.GetIPFromRemoteAddress(r.RemoteAddr))
 			if err != nil {
@@ -559,8 +597,22 @@ func (s *httpdServer) handleWebClientOIDCLogin(w http.ResponseWriter, r *http.Re
 
 func (s *httpdServer) oidcLoginRedirect(w http.ResponseWriter, r *http.Request, audience tokenAudience) {
 	pendingAuth := newOIDCPendingAuth(audience)
+	config := &s.binding.OIDC
+	if audience == tokenAudienceWebClient {
+		tenant, tenantConfig, err := s.getTenantOIDC(r)
+		if err == nil {
+			pendingAuth.Tenant = tenant
+			config = tenantConfig
+		} else if !errors.Is(err, util.ErrNotFound) {
+			logger.Warn(logSender, "", "unable to get the tenant OpenID configuration: %v", err)
+		}
+	}
+	if !config.isEnabled() {
+		s.renderClientNotFoundPage(w, r, errors.New("OpenID Connect is not configured"))
+		return
+	}
 	oidcMgr.addPendingAuth(pendingAuth)
-	http.Redirect(w, r, s.binding.OIDC.oauth2Config.AuthCodeURL(pendingAuth.State,
+	http.Redirect(w, r, config.oauth2Config.AuthCodeURL(pendingAuth.State,
 		oidc.Nonce(pendingAuth.Nonce)), http.StatusFound)
 }
 
@@ -592,14 +644,21 @@ func (s *httpdServer) handleOIDCRedirect(w http.ResponseWriter, r *http.Request)
 		}
 		http.Redirect(w, r, webClientLoginPath, http.StatusFound)
 	}
+	config, err := s.getOIDC(authReq.Tenant)
+	if err != nil {
+		logger.Debug(logSender, "", "unable to get the oidc configuration, tenant %q: %v", authReq.Tenant, err)
+		setFlashMessage(w, r, "OpenID Connect is not configured")
+		doRedirect()
+		return
+	}
 	doLogout := func(rawIDToken string) {
-		s.logoutFromOIDCOP(rawIDToken)
+		s.logoutFromOIDCOP(config, rawIDToken)
 	}
 
 	ctx, cancel := context.WithTimeout(r.Context(), 20*time.Second)
 	defer cancel()
 
-	oauth2Token, err := s.binding.OIDC.oauth2Config.Exchange(ctx, r.URL.Query().Get("code"))
+	oauth2Token, err := config.oauth2Config.Exchange(ctx, r.URL.Query().Get("code"))
 	if err != nil {
 		logger.Debug(logSender, "", "failed to exchange oidc token: %v", err)
 		setFlashMessage(w, r, "Failed to exchange OpenID token")
@@ -614,7 +673,7 @@ func (s *httpdServer) handleOIDCRedirect(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	s.debugTokenClaims(nil, rawIDToken)
-	idToken, err := s.binding.OIDC.getVerifier(ctx).Verify(ctx, rawIDToken)
+	idToken, err := config.getVerifier(ctx).Verify(ctx, rawIDToken)
 	if err != nil {
 		logger.Debug(logSender, "", "failed to verify oidc token: %v", err)
 		setFlashMessage(w, r, "Failed to verify OpenID token")
@@ -647,12 +706,13 @@ func (s *httpdServer) handleOIDCRedirect(w http.ResponseWriter, r *http.Request)
 		IDToken:      rawIDToken,
 		Nonce:        idToken.Nonce,
 		Cookie:       xid.New().String(),
+		Tenant:       authReq.Tenant,
 	}
 	if !oauth2Token.Expiry.IsZero() {
 		token.ExpiresAt = util.GetTimeAsMsSinceEpoch(oauth2Token.Expiry)
 	}
-	err = token.parseClaims(claims, s.binding.OIDC.UsernameField, s.binding.OIDC.RoleField,
-		s.binding.OIDC.CustomFields, s.binding.OIDC.getForcedRole(authReq.Audience))
+	err = token.parseClaims(claims, config.UsernameField, config.RoleField,
+		config.CustomFields, config.getForcedRole(authReq.Audience))
 	if err != nil {
 		logger.Debug(logSender, "", "unable to parse oidc token claims: %v", err)
 		setFlashMessage(w, r, fmt.Sprintf("Unable to parse OpenID token claims: %v", err))
@@ -717,22 +777,24 @@ func (s *httpdServer) logoutOIDCUser(w http.ResponseWriter, r *http.Request) {
 		removeOIDCCookie(w, r)
 		token, err := oidcMgr.getToken(oidcKey)
 		if err == nil {
-			s.logoutFromOIDCOP(token.IDToken)
+			if config, err := s.getOIDC(token.Tenant); err == nil {
+				s.logoutFromOIDCOP(config, token.IDToken)
+			}
 		}
 		oidcMgr.removeToken(oidcKey)
 	}
 }
 
-func (s *httpdServer) logoutFromOIDCOP(idToken string) {
-	if s.binding.OIDC.providerLogoutURL == "" {
+func (s *httpdServer) logoutFromOIDCOP(config *OIDC, idToken string) {
+	if config.providerLogoutURL == "" {
 		logger.Debug(logSender, "", "oidc: provider logout URL not set, unable to logout from the OP")
 		return
 	}
-	go s.doOIDCFromLogout(idToken)
+	go s.doOIDCFromLogout(config, idToken)
 }
 
-func (s *httpdServer) doOIDCFromLogout(idToken string) {
-	logoutURL, err := url.Parse(s.binding.OIDC.providerLogoutURL)
+func (s *httpdServer) doOIDCFromLogout(config *OIDC, idToken string) {
+	logoutURL, err := url.Parse(config.providerLogoutURL)
 	if err != nil {
 		logger.Warn(logSender, "", "oidc: unable to parse logout URL: %v", err)
 		return
@@ -775,6 +837,11 @@ func canSkipOIDCValidation(r *http.Request) bool {
 	return false
 }
 
+func hasOIDCCookie(r *http.Request) bool {
+	_, err := r.Cookie(oidcCookieKey)
+	return err == nil
+}
+
 func isLoggedInWithOIDC(r *http.Request) bool {
 	_, ok := r.Context().Value(oidcTokenKey).(string)
 	return ok
@@ -835,11 +835,11 @@ func TestSkipOIDCAuth(t *testing.T) {
 func TestOIDCLogoutErrors(t *testing.T) {
 	server := getTestOIDCServer()
 	assert.Empty(t, server.binding.OIDC.providerLogoutURL)
-	server.logoutFromOIDCOP("")
+	server.logoutFromOIDCOP(&server.binding.OIDC, "")
 	server.binding.OIDC.providerLogoutURL = "http://foo\x7f.com/"
-	server.doOIDCFromLogout("")
+	server.doOIDCFromLogout(&server.binding.OIDC, "")
 	server.binding.OIDC.providerLogoutURL = "http://127.0.0.1:11234"
-	server.doOIDCFromLogout("")
+	server.doOIDCFromLogout(&server.binding.OIDC, "")
 }
 
 func TestOIDCToken(t *testing.T) {
@@ -1728,6 +1728,214 @@ func TestDbOIDCManager(t *testing.T) {
 	}
 }
 
+func TestOIDCTenant(t *testing.T) {
+	oidcMgr, ok := oidcMgr.(*memoryOIDCManager)
+	require.True(t, ok)
+
+	role := dataprovider.Role{
+		Name: "tenant_oidc_role",
+		Tenant: &dataprovider.RoleTenant{
+			Slug:    "acme",
+			Domains: []string{"sftp.acme.example"},
+			OIDC: &dataprovider.RoleTenantOIDC{
+				ClientID:     "tenant-client",
+				ClientSecret: kms.NewPlainSecret("tenant-secret"),
+				ConfigURL:    fmt.Sprintf("http://%v/auth/realms/sftpgo", oidcMockAddr),
+			},
+		},
+	}
+	err := dataprovider.AddRole(&role, "", "", "")
+	require.NoError(t, err)
+	numTokens := len(oidcMgr.tokens)
+	numPendingAuths := len(oidcMgr.pendingAuths)
+	role, err = dataprovider.RoleExists(role.Name)
+	require.NoError(t, err)
+	// the global configuration is not initialized, only the tenant one is available
+	server := getTestOIDCServer()
+	server.initializeRouter()
+
+	rr := httptest.NewRecorder()
+	r, err := http.NewRequest(http.MethodGet, webClientOIDCLoginPath, nil)
+	assert.NoError(t, err)
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	require.Len(t, oidcMgr.pendingAuths, numPendingAuths)
+
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodGet, webClientOIDCLoginPath+"?tenant=acme", nil)
+	assert.NoError(t, err)
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Contains(t, rr.Header().Get("Location"), oidcMockAddr)
+	assert.Contains(t, rr.Header().Get("Location"), "tenant-client")
+	require.Len(t, oidcMgr.pendingAuths, numPendingAuths+1)
+	for _, authReq := range oidcMgr.pendingAuths {
+		if authReq.Tenant == role.Name {
+			oidcMgr.removePendingAuth(authReq.State)
+		}
+	}
+	require.Len(t, oidcMgr.pendingAuths, numPendingAuths)
+	// the tenant can be selected using the domain too
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodGet, webClientOIDCLoginPath, nil)
+	assert.NoError(t, err)
+	r.Host = "sftp.acme.example:8080"
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	require.Len(t, oidcMgr.pendingAuths, numPendingAuths+1)
+	for _, authReq := range oidcMgr.pendingAuths {
+		if authReq.Tenant == role.Name {
+			oidcMgr.removePendingAuth(authReq.State)
+		}
+	}
+	require.Len(t, oidcMgr.pendingAuths, numPendingAuths)
+	// WebAdmin cannot use the tenant configuration
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodGet, webAdminOIDCLoginPath+"?tenant=acme", nil)
+	assert.NoError(t, err)
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	config, err := tenantOIDCs.get(&role, &server.binding)
+	require.NoError(t, err)
+	assert.Equal(t, "tenant-secret", config.ClientSecret)
+	assert.Equal(t, server.binding.OIDC.RedirectBaseURL, config.RedirectBaseURL)
+	assert.Equal(t, defaultTenantOIDCUsername, config.UsernameField)
+	cachedConfig, err := server.getOIDC(role.Name)
+	require.NoError(t, err)
+	assert.Equal(t, config, cachedConfig)
+	_, err = server.getOIDC("")
+	assert.Error(t, err)
+	_, err = server.getOIDC("missing role")
+	assert.Error(t, err)
+
+	token := &oauth2.Token{
+		AccessToken: "1234",
+		Expiry:      time.Now().Add(5 * time.Minute),
+	}
+	token = token.WithExtra(map[string]any{
+		"id_token": "id_token_val",
+	})
+	config.oauth2Config = &mockOAuth2Config{
+		tokenSource: &mockTokenSource{},
+		authCodeURL: webOIDCRedirectPath,
+		token:       token,
+	}
+	username := "test_oidc_tenant_user"
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: username,
+			Password: "pwd",
+			HomeDir:  filepath.Join(os.TempDir(), username),
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+	}
+	err = dataprovider.AddUser(&user, "", "", "")
+	assert.NoError(t, err)
+	// the user is not associated with the tenant role
+	authReq := newOIDCPendingAuth(tokenAudienceWebClient)
+	authReq.Tenant = role.Name
+	oidcMgr.addPendingAuth(authReq)
+	idToken := &oidc.IDToken{
+		Nonce:  authReq.Nonce,
+		Expiry: time.Now().Add(5 * time.Minute),
+	}
+	setIDTokenClaims(idToken, []byte(fmt.Sprintf(`{"preferred_username":"%s"}`, username)))
+	config.verifier = &mockOIDCVerifier{
+		err:   nil,
+		token: idToken,
+	}
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodGet, webOIDCRedirectPath+"?state="+authReq.State, nil)
+	assert.NoError(t, err)
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, webClientLoginPath, rr.Header().Get("Location"))
+	require.Len(t, oidcMgr.pendingAuths, numPendingAuths)
+	require.Len(t, oidcMgr.tokens, numTokens)
+
+	user.Role = role.Name
+	err = dataprovider.UpdateUser(&user, "", "", "")
+	assert.NoError(t, err)
+	authReq = newOIDCPendingAuth(tokenAudienceWebClient)
+	authReq.Tenant = role.Name
+	oidcMgr.addPendingAuth(authReq)
+	idToken.Nonce = authReq.Nonce
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodGet, webOIDCRedirectPath+"?state="+authReq.State, nil)
+	assert.NoError(t, err)
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, webClientFilesPath, rr.Header().Get("Location"))
+	require.Len(t, oidcMgr.tokens, numTokens+1)
+	var tokenCookie string
+	for k, v := range oidcMgr.tokens {
+		if v.Tenant == role.Name {
+			tokenCookie = k
+		}
+	}
+	require.NotEmpty(t, tokenCookie)
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodGet, webClientFilesPath, nil)
+	assert.NoError(t, err)
+	r.Header.Set("Cookie", fmt.Sprintf("%v=%v", oidcCookieKey, tokenCookie))
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	// updating the role invalidates the cached configuration
+	role.Description = "updated tenant role"
+	role.Tenant.OIDC.ClientSecret = kms.NewPlainSecret("tenant-secret")
+	err = dataprovider.UpdateRole(&role, "", "", "")
+	assert.NoError(t, err)
+	role, err = dataprovider.RoleExists(role.Name)
+	require.NoError(t, err)
+	newConfig, err := tenantOIDCs.get(&role, &server.binding)
+	require.NoError(t, err)
+	assert.NotEqual(t, fmt.Sprintf("%p", config), fmt.Sprintf("%p", newConfig))
+
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodGet, webClientLogoutPath, nil)
+	assert.NoError(t, err)
+	r.Header.Set("Cookie", fmt.Sprintf("%v=%v", oidcCookieKey, tokenCookie))
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, webClientLoginPath, rr.Header().Get("Location"))
+	require.Len(t, oidcMgr.tokens, numTokens)
+
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	err = dataprovider.DeleteUser(username, "", "", "")
+	assert.NoError(t, err)
+	err = dataprovider.DeleteRole(role.Name, "", "", "")
+	assert.NoError(t, err)
+}
+
+func TestTenantRequestHelpers(t *testing.T) {
+	r, err := http.NewRequest(http.MethodGet, webClientLoginPath+"?tenant=acme", nil)
+	require.NoError(t, err)
+	r.Host = "[::1]:8080"
+	assert.Equal(t, "?tenant=acme", getTenantQuery(r))
+	assert.Equal(t, "::1", getRequestHostname(r))
+	r, err = http.NewRequest(http.MethodGet, webClientLoginPath, nil)
+	require.NoError(t, err)
+	r.Host = "sftp.example.com"
+	assert.Empty(t, getTenantQuery(r))
+	assert.Equal(t, "sftp.example.com", getRequestHostname(r))
+	_, err = getTenantRole(r)
+	assert.ErrorIs(t, err, util.ErrNotFound)
+	assert.False(t, isWebClientPasswordResetEnabled(r))
+
+	token := oidcToken{
+		Tenant: "role1",
+	}
+	assert.Error(t, token.checkTenant(&dataprovider.User{}))
+	assert.NoError(t, token.checkTenant(&dataprovider.User{BaseUser: sdk.BaseUser{Role: "role1"}}))
+	token.Tenant = ""
+	assert.NoError(t, token.checkTenant(&dataprovider.User{}))
+}
+
 func getTestOIDCServer() *httpdServer {
 	return &httpdServer{
 		binding: Binding{
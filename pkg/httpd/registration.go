@@ -0,0 +1,224 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/smtp"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+var (
+	registrationConfig RegistrationConfig
+)
+
+// RegistrationConfig defines the configuration for the self-service user
+// registration. Registered users are disabled until an admin approves them
+type RegistrationConfig struct {
+	// Set to true to show a sign up page in the WebClient login form
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// Username of an existing user to use as template for the registered users.
+	// The %username% placeholder is replaced as for the WebAdmin user templates
+	TemplateUser string `json:"template_user" mapstructure:"template_user"`
+	// Email addresses to notify about new registrations. An SMTP server must
+	// be configured
+	NotifyEmails []string `json:"notify_emails" mapstructure:"notify_emails"`
+}
+
+func (c *RegistrationConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	c.TemplateUser = strings.TrimSpace(c.TemplateUser)
+	if c.TemplateUser == "" {
+		return errors.New("registration: a template user is required")
+	}
+	var emails []string
+	for _, email := range c.NotifyEmails {
+		email = strings.TrimSpace(email)
+		if email == "" {
+			continue
+		}
+		if !util.IsEmailValid(email) {
+			return fmt.Errorf("registration: invalid notification email %q", email)
+		}
+		emails = append(emails, email)
+	}
+	c.NotifyEmails = util.RemoveDuplicates(emails, false)
+	return nil
+}
+
+// pendingRegistration defines a registered user awaiting approval
+type pendingRegistration struct {
+	Username     string `json:"username"`
+	Email        string `json:"email,omitempty"`
+	Role         string `json:"role,omitempty"`
+	RegisteredAt int64  `json:"registered_at"`
+}
+
+// GetRegisteredAsString returns the registration time as string
+func (r *pendingRegistration) GetRegisteredAsString() string {
+	return util.GetTimeFromMsecSinceEpoch(r.RegisteredAt).Format(webSessionTimeDisplay)
+}
+
+func registerUser(ctx context.Context, username, email, password, ipAddr string) (dataprovider.User, error) {
+	if username == "" || email == "" || password == "" {
+		return dataprovider.User{}, util.NewValidationError("username, email and password are mandatory")
+	}
+	if !util.IsEmailValid(email) {
+		return dataprovider.User{}, util.NewValidationError(fmt.Sprintf("email %q is not valid", email))
+	}
+	if _, err := dataprovider.UserExists(username, ""); err == nil {
+		return dataprovider.User{}, util.NewValidationError(fmt.Sprintf("username %q is not available", username))
+	}
+	template, err := dataprovider.UserExists(registrationConfig.TemplateUser, "")
+	if err != nil {
+		logger.Error(logSender, "", "unable to load registration template user %q: %v",
+			registrationConfig.TemplateUser, err)
+		return dataprovider.User{}, errors.New("registration is not available")
+	}
+	if err := template.FsConfig.TryDecryptSecrets(); err != nil {
+		logger.Error(logSender, "", "unable to decrypt the secrets for registration template user %q: %v",
+			registrationConfig.TemplateUser, err)
+		return dataprovider.User{}, errors.New("registration is not available")
+	}
+	user := getUserFromTemplate(template, userTemplateFields{
+		Username: username,
+		Password: password,
+	})
+	user.ID = 0
+	user.Email = email
+	user.Status = 0
+	user.LastLogin = 0
+	user.FirstDownload = 0
+	user.FirstUpload = 0
+	user.LastPasswordChange = 0
+	user.UsedQuotaSize = 0
+	user.UsedQuotaFiles = 0
+	user.UsedUploadDataTransfer = 0
+	user.UsedDownloadDataTransfer = 0
+	user.CreatedAt = 0
+	user.UpdatedAt = 0
+	user.Filters.RecoveryCodes = nil
+	user.Filters.TOTPConfig = dataprovider.UserTOTPConfig{}
+	user.Filters.Consents = nil
+	user.Filters.Webhooks = nil
+	user.Filters.PendingRegistration = util.GetTimeAsMsSinceEpoch(time.Now())
+	if err := dataprovider.AddUserContext(ctx, &user, dataprovider.ActionExecutorSelf, ipAddr, user.Role); err != nil {
+		return user, err
+	}
+	go notifyNewRegistration(user, ipAddr)
+	return user, nil
+}
+
+func notifyNewRegistration(user dataprovider.User, ipAddr string) {
+	if len(registrationConfig.NotifyEmails) == 0 {
+		return
+	}
+	data := map[string]any{
+		"Username": user.Username,
+		"Email":    user.Email,
+		"IP":       ipAddr,
+	}
+	body := new(bytes.Buffer)
+	if err := smtp.RenderRegistrationReviewTemplate(user.Role, body, data); err != nil {
+		logger.Warn(logSender, "", "unable to render the registration notification for user %q: %v", user.Username, err)
+		return
+	}
+	subject := fmt.Sprintf("New registration for user %q", user.Username)
+	err := smtp.SendEmailForRole(user.Role, registrationConfig.NotifyEmails, nil, subject, body.String(),
+		smtp.EmailContentTypeTextHTML)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to send the registration notification for user %q: %v", user.Username, err)
+	}
+}
+
+func notifyRegistrationResult(user dataprovider.User, approved bool) {
+	if user.Email == "" {
+		return
+	}
+	data := map[string]any{
+		"Username": user.Username,
+		"Approved": approved,
+	}
+	body := new(bytes.Buffer)
+	if err := smtp.RenderRegistrationResultTemplate(user.Role, body, data); err != nil {
+		logger.Debug(logSender, "", "unable to render the registration result for user %q: %v", user.Username, err)
+		return
+	}
+	subject := "Your registration has been rejected"
+	if approved {
+		subject = "Your registration has been approved"
+	}
+	err := smtp.SendEmailForRole(user.Role, []string{user.Email}, nil, subject, body.String(),
+		smtp.EmailContentTypeTextHTML)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to send the registration result to user %q: %v", user.Username, err)
+	}
+}
+
+// getPendingRegistrations returns the registrations awaiting approval the
+// admin can manage
+func (c *jwtTokenClaims) getPendingRegistrations() ([]pendingRegistration, error) {
+	var result []pendingRegistration
+	limit := 500
+	offset := 0
+	for {
+		users, err := dataprovider.GetUsers(limit, offset, dataprovider.OrderASC, c.Role)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range c.filterUsersInScope(users) {
+			if user.Filters.PendingRegistration > 0 {
+				result = append(result, pendingRegistration{
+					Username:     user.Username,
+					Email:        user.Email,
+					Role:         user.Role,
+					RegisteredAt: user.Filters.PendingRegistration,
+				})
+			}
+		}
+		if len(users) < limit {
+			break
+		}
+		offset += limit
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].RegisteredAt < result[j].RegisteredAt
+	})
+	return result, nil
+}
+
+// getPendingRegistration returns the user with the specified username if it
+// is awaiting approval and the admin can manage it
+func (c *jwtTokenClaims) getPendingRegistration(username string) (dataprovider.User, error) {
+	user, err := c.getUser(username)
+	if err != nil {
+		return user, err
+	}
+	if user.Filters.PendingRegistration == 0 {
+		return dataprovider.User{}, util.NewRecordNotFoundError(fmt.Sprintf("no pending registration for user %q", username))
+	}
+	return user, nil
+}
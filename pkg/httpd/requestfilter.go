@@ -0,0 +1,253 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/common"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+var (
+	errRequestPathTraversal = errors.New("path traversal attempt detected")
+	errRequestDenied        = errors.New("request denied by the configured patterns")
+	errRequestHeadersSize   = errors.New("request headers too large")
+	errRequestMethod        = errors.New("method not allowed for this route")
+)
+
+// RequestFilterRateLimit defines a per-source rate limit for a route
+type RequestFilterRateLimit struct {
+	// Average defines the maximum rate allowed. 0 means disabled
+	Average int64 `json:"average" mapstructure:"average"`
+	// Period defines the period as milliseconds. Default: 1000 (1 second)
+	Period int64 `json:"period" mapstructure:"period"`
+	// Burst is the maximum number of requests allowed to go through in the
+	// same arbitrarily small period of time. Default: 1
+	Burst int `json:"burst" mapstructure:"burst"`
+}
+
+// RequestFilterRoute defines the restrictions for the requests to a route
+type RequestFilterRoute struct {
+	// Path of the route, for example "/api/v2/token". The restrictions apply
+	// to the path and to its sub paths
+	Path string `json:"path" mapstructure:"path"`
+	// Allowed HTTP methods, empty means any method
+	Methods []string `json:"methods" mapstructure:"methods"`
+	// Per client IP rate limit for this route
+	RateLimit RequestFilterRateLimit `json:"rate_limit" mapstructure:"rate_limit"`
+	limiter   *common.SourceRateLimiter
+}
+
+func (r *RequestFilterRoute) matches(urlPath string) bool {
+	if r.Path == "/" {
+		return true
+	}
+	return urlPath == r.Path || strings.HasPrefix(urlPath, r.Path+"/")
+}
+
+// RequestFilter defines the filters to apply to the HTTP requests before
+// processing them. Denied requests can generate defender events
+type RequestFilter struct {
+	// Set to true to enable the request filters
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// Deny the requests containing path traversal patterns, such as "../",
+	// in the URL path or query parameters
+	DenyPathTraversal bool `json:"deny_path_traversal" mapstructure:"deny_path_traversal"`
+	// Maximum size, as bytes, of the request headers, names and values. 0
+	// means no limit other than the server one
+	MaxHeadersSize int `json:"max_headers_size" mapstructure:"max_headers_size"`
+	// Regular expressions, matched against the decoded URL path and query, to
+	// deny requests
+	DeniedPatterns []string `json:"denied_patterns" mapstructure:"denied_patterns"`
+	// Restrictions for specific routes. If a request matches multiple routes
+	// the longest path is used
+	Routes []RequestFilterRoute `json:"routes" mapstructure:"routes"`
+	// If enabled, each denied request generates a limit exceeded defender event
+	GenerateDefenderEvents bool `json:"generate_defender_events" mapstructure:"generate_defender_events"`
+	deniedPatterns         []*regexp.Regexp
+}
+
+func (f *RequestFilter) initialize() error {
+	if !f.Enabled {
+		return nil
+	}
+	if f.MaxHeadersSize < 0 {
+		return fmt.Errorf("request filter: invalid max headers size %d", f.MaxHeadersSize)
+	}
+	f.deniedPatterns = nil
+	for _, pattern := range f.DeniedPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("request filter: invalid denied pattern %q: %w", pattern, err)
+		}
+		f.deniedPatterns = append(f.deniedPatterns, re)
+	}
+	routes := make([]RequestFilterRoute, 0, len(f.Routes))
+	for _, route := range f.Routes {
+		route.Path = strings.TrimSpace(route.Path)
+		if !path.IsAbs(route.Path) {
+			return fmt.Errorf("request filter: invalid route path %q, it must be absolute", route.Path)
+		}
+		route.Path = path.Clean(route.Path)
+		for idx := range route.Methods {
+			route.Methods[idx] = strings.ToUpper(strings.TrimSpace(route.Methods[idx]))
+		}
+		route.Methods = util.RemoveDuplicates(route.Methods, false)
+		if route.RateLimit.Average > 0 {
+			limiter, err := common.NewSourceRateLimiter(route.RateLimit.Average, route.RateLimit.Period,
+				route.RateLimit.Burst)
+			if err != nil {
+				return fmt.Errorf("request filter: invalid rate limit for route %q: %w", route.Path, err)
+			}
+			route.limiter = limiter
+		}
+		routes = append(routes, route)
+	}
+	f.Routes = routes
+	return nil
+}
+
+func (f *RequestFilter) getRoute(urlPath string) *RequestFilterRoute {
+	var result *RequestFilterRoute
+	for idx := range f.Routes {
+		route := &f.Routes[idx]
+		if route.matches(urlPath) && (result == nil || len(route.Path) > len(result.Path)) {
+			result = route
+		}
+	}
+	return result
+}
+
+func (f *RequestFilter) getHeadersSize(r *http.Request) int {
+	size := 0
+	for name, values := range r.Header {
+		for _, value := range values {
+			size += len(name) + len(value)
+		}
+	}
+	return size
+}
+
+// hasPathTraversal returns true if the URL path or the query values contain
+// a ".." path element, also if encoded twice or using backslashes
+func (f *RequestFilter) hasPathTraversal(r *http.Request) bool {
+	candidates := []string{r.URL.Path}
+	if r.URL.RawPath != "" {
+		candidates = append(candidates, r.URL.RawPath)
+	}
+	for _, values := range r.URL.Query() {
+		candidates = append(candidates, values...)
+	}
+	for _, candidate := range candidates {
+		if unescaped, err := url.PathUnescape(candidate); err == nil {
+			candidate = unescaped
+		}
+		if strings.ContainsRune(candidate, 0) {
+			return true
+		}
+		candidate = strings.ReplaceAll(candidate, `\`, "/")
+		for _, elem := range strings.Split(candidate, "/") {
+			if elem == ".." {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *RequestFilter) isDeniedByPatterns(r *http.Request) bool {
+	if len(f.deniedPatterns) == 0 {
+		return false
+	}
+	target := r.URL.Path
+	if query, err := url.QueryUnescape(r.URL.RawQuery); err == nil && query != "" {
+		target += "?" + query
+	}
+	for _, re := range f.deniedPatterns {
+		if re.MatchString(target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *httpdServer) sendRequestFilterResponse(w http.ResponseWriter, r *http.Request, err error, statusCode int) {
+	if (s.enableWebAdmin || s.enableWebClient) && isWebRequest(r) {
+		r = s.updateContextFromCookie(r)
+		if s.enableWebClient && (isWebClientRequest(r) || !s.enableWebAdmin) {
+			s.renderClientMessagePage(w, r, http.StatusText(statusCode), "", statusCode, err, "")
+			return
+		}
+		s.renderMessagePage(w, r, http.StatusText(statusCode), "", statusCode, err, "")
+		return
+	}
+	sendAPIResponse(w, r, err, http.StatusText(statusCode), statusCode)
+}
+
+// filterRequests applies the configured request filters
+func (s *httpdServer) filterRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f := &s.binding.RequestFilter
+		ipAddr := util.GetIPFromRemoteAddress(r.RemoteAddr)
+
+		deny := func(err error, statusCode int) {
+			logger.Debug(logSender, "", "request %s %q from ip %q denied: %v", r.Method, r.URL.Path, ipAddr, err)
+			if f.GenerateDefenderEvents {
+				common.AddDefenderEvent(ipAddr, common.ProtocolHTTP, common.HostEventLimitExceeded)
+			}
+			s.sendRequestFilterResponse(w, r, err, statusCode)
+		}
+
+		if f.MaxHeadersSize > 0 && f.getHeadersSize(r) > f.MaxHeadersSize {
+			deny(errRequestHeadersSize, http.StatusRequestHeaderFieldsTooLarge)
+			return
+		}
+		if f.DenyPathTraversal && f.hasPathTraversal(r) {
+			deny(errRequestPathTraversal, http.StatusBadRequest)
+			return
+		}
+		if f.isDeniedByPatterns(r) {
+			deny(errRequestDenied, http.StatusForbidden)
+			return
+		}
+		if route := f.getRoute(r.URL.Path); route != nil {
+			if len(route.Methods) > 0 && !util.Contains(route.Methods, r.Method) {
+				w.Header().Set("Allow", strings.Join(route.Methods, ", "))
+				deny(errRequestMethod, http.StatusMethodNotAllowed)
+				return
+			}
+			if route.limiter != nil {
+				if delay, err := route.limiter.Wait(ipAddr); err != nil {
+					delay += 499999999 * time.Nanosecond
+					w.Header().Set("Retry-After", fmt.Sprintf("%.0f", delay.Seconds()))
+					w.Header().Set("X-Retry-In", delay.String())
+					deny(err, http.StatusTooManyRequests)
+					return
+				}
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -27,6 +27,8 @@ import (
 var (
 	resetCodeLifespan = 10 * time.Minute
 	resetCodesMgr     resetCodeManager
+	// consent links reuse the reset code managers with a different session type
+	consentLinksMgr resetCodeManager
 )
 
 type resetCodeManager interface {
@@ -39,12 +41,19 @@ type resetCodeManager interface {
 func newResetCodeManager(isShared int) resetCodeManager {
 	if isShared == 1 {
 		logger.Info(logSender, "", "using provider reset code manager")
-		return &dbResetCodeManager{}
+		return &dbResetCodeManager{sessionType: dataprovider.SessionTypeResetCode}
 	}
 	logger.Info(logSender, "", "using memory reset code manager")
 	return &memoryResetCodeManager{}
 }
 
+func newConsentLinkManager(isShared int) resetCodeManager {
+	if isShared == 1 {
+		return &dbResetCodeManager{sessionType: dataprovider.SessionTypeConsentLink}
+	}
+	return &memoryResetCodeManager{}
+}
+
 type resetCode struct {
 	Code      string    `json:"code"`
 	Username  string    `json:"username"`
@@ -97,13 +106,15 @@ func (m *memoryResetCodeManager) Cleanup() {
 	})
 }
 
-type dbResetCodeManager struct{}
+type dbResetCodeManager struct {
+	sessionType dataprovider.SessionType
+}
 
 func (m *dbResetCodeManager) Add(code *resetCode) error {
 	session := dataprovider.Session{
 		Key:       code.Code,
 		Data:      code,
-		Type:      dataprovider.SessionTypeResetCode,
+		Type:      m.sessionType,
 		Timestamp: util.GetTimeAsMsSinceEpoch(code.ExpiresAt),
 	}
 	return dataprovider.AddSharedSession(session)
@@ -136,5 +147,5 @@ func (m *dbResetCodeManager) Delete(code string) error {
 }
 
 func (m *dbResetCodeManager) Cleanup() {
-	dataprovider.CleanupSharedSessions(dataprovider.SessionTypeResetCode, time.Now()) //nolint:errcheck
+	dataprovider.CleanupSharedSessions(m.sessionType, time.Now()) //nolint:errcheck
 }
@@ -0,0 +1,584 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"github.com/rs/xid"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/sftpgo/sdk"
+
+	"github.com/drakkan/sftpgo/v2/pkg/common"
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/httpclient"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// SAML defines the configuration for SAML 2.0 single sign-on.
+// SFTPGo acts as a service provider, the identity provider is configured
+// using its metadata
+type SAML struct {
+	// URL to fetch the identity provider metadata from. SFTPGo will try to retrieve
+	// the metadata on startup and will refuse to start if it fails
+	IDPMetadataURL string `json:"idp_metadata_url" mapstructure:"idp_metadata_url"`
+	// Path to a file with the identity provider metadata, it is used if
+	// IDPMetadataURL is empty
+	IDPMetadataFile string `json:"idp_metadata_file" mapstructure:"idp_metadata_file"`
+	// Service provider entity ID, if empty the metadata URL is used
+	EntityID string `json:"entity_id" mapstructure:"entity_id"`
+	// BaseURL is the public base URL for the service provider endpoints.
+	// The suffixes "/web/saml/metadata" and "/web/saml/acs" will be added to this base URL,
+	// adding also the "web_root" if configured
+	BaseURL string `json:"base_url" mapstructure:"base_url"`
+	// Service provider certificate and RSA private key. They are optional, if set
+	// they are published in the metadata and used to decrypt the assertions and to sign
+	// the authentication requests
+	CertificateFile    string `json:"certificate_file" mapstructure:"certificate_file"`
+	CertificateKeyFile string `json:"certificate_key_file" mapstructure:"certificate_key_file"`
+	// Sign the authentication requests, a certificate and a private key are required
+	SignRequests bool `json:"sign_requests" mapstructure:"sign_requests"`
+	// Assertion attribute to map to the SFTPGo username, if empty the NameID is used
+	UsernameAttribute string `json:"username_attribute" mapstructure:"username_attribute"`
+	// Optional assertion attribute to map to the SFTPGo role. If one of the attribute
+	// values matches one of the AdminRoleValues the authenticated user is mapped to
+	// an SFTPGo admin, otherwise to an SFTPGo user.
+	// You don't need to specify this attribute if you want to use SAML only for the
+	// Web Client UI
+	RoleAttribute string `json:"role_attribute" mapstructure:"role_attribute"`
+	// Role attribute values that identify SFTPGo admins. Default: "admin"
+	AdminRoleValues []string `json:"admin_role_values" mapstructure:"admin_role_values"`
+	// If set, the RoleAttribute is ignored and the SFTPGo role is assumed based on
+	// the login link used
+	ImplicitRoles bool `json:"implicit_roles" mapstructure:"implicit_roles"`
+	// Custom assertion attributes to pass to the pre-login hook and to the
+	// identity provider login event rules
+	CustomAttributes []string `json:"custom_attributes" mapstructure:"custom_attributes"`
+	// Automatically create SFTPGo users on their first login if they don't exist.
+	// Admins are never created
+	AutoProvisioning bool `json:"auto_provisioning" mapstructure:"auto_provisioning"`
+	// Primary group for the automatically created users. The group should define at
+	// least the home directory, or "users_base_dir" must be set, and the permissions
+	// for the "/" directory. It is required if AutoProvisioning is enabled
+	ProvisioningGroup string `json:"provisioning_group" mapstructure:"provisioning_group"`
+	// Debug enables the SAML debug mode. In debug mode, the received assertions will be
+	// logged at the debug level
+	Debug bool `json:"debug" mapstructure:"debug"`
+	sp    *saml.ServiceProvider
+}
+
+func (s *SAML) isEnabled() bool {
+	return s.sp != nil
+}
+
+func (s *SAML) hasRoles() bool {
+	return s.isEnabled() && (s.RoleAttribute != "" || s.ImplicitRoles)
+}
+
+func (s *SAML) getMetadataURL() string {
+	return strings.TrimSuffix(s.BaseURL, "/") + webSAMLMetadataPath
+}
+
+func (s *SAML) getACSURL() string {
+	return strings.TrimSuffix(s.BaseURL, "/") + webSAMLACSPath
+}
+
+func (s *SAML) initialize(configDir string) error {
+	if s.IDPMetadataURL == "" && s.IDPMetadataFile == "" {
+		return nil
+	}
+	if s.BaseURL == "" {
+		return errors.New("saml: base URL cannot be empty")
+	}
+	if s.AutoProvisioning && s.ProvisioningGroup == "" {
+		return errors.New("saml: a provisioning group is required to enable auto provisioning")
+	}
+	metadataURL, err := url.Parse(s.getMetadataURL())
+	if err != nil {
+		return fmt.Errorf("saml: invalid base URL %q: %w", s.BaseURL, err)
+	}
+	acsURL, err := url.Parse(s.getACSURL())
+	if err != nil {
+		return fmt.Errorf("saml: invalid base URL %q: %w", s.BaseURL, err)
+	}
+	idpMetadata, err := s.loadIDPMetadata(configDir)
+	if err != nil {
+		return err
+	}
+	sp := &saml.ServiceProvider{
+		EntityID:    s.EntityID,
+		MetadataURL: *metadataURL,
+		AcsURL:      *acsURL,
+		IDPMetadata: idpMetadata,
+		HTTPClient:  httpclient.GetHTTPClient(),
+	}
+	if sp.GetSSOBindingLocation(saml.HTTPRedirectBinding) == "" {
+		return errors.New("saml: the identity provider does not support the HTTP-Redirect binding")
+	}
+	if s.CertificateFile != "" || s.CertificateKeyFile != "" {
+		keyPair, err := tls.LoadX509KeyPair(getConfigPath(s.CertificateFile, configDir),
+			getConfigPath(s.CertificateKeyFile, configDir))
+		if err != nil {
+			return fmt.Errorf("saml: unable to load the service provider key pair: %w", err)
+		}
+		key, ok := keyPair.PrivateKey.(*rsa.PrivateKey)
+		if !ok {
+			return errors.New("saml: the service provider private key must be an RSA key")
+		}
+		cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("saml: unable to parse the service provider certificate: %w", err)
+		}
+		sp.Key = key
+		sp.Certificate = cert
+	}
+	if s.SignRequests {
+		if sp.Key == nil {
+			return errors.New("saml: a certificate and a private key are required to sign requests")
+		}
+		sp.SignatureMethod = dsig.RSASHA256SignatureMethod
+	}
+	s.sp = sp
+	logger.Debug(logSender, "", "saml service provider initialized, metadata URL %q, ACS URL %q",
+		metadataURL.String(), acsURL.String())
+	return nil
+}
+
+func (s *SAML) loadIDPMetadata(configDir string) (*saml.EntityDescriptor, error) {
+	if s.IDPMetadataURL != "" {
+		metadataURL, err := url.Parse(s.IDPMetadataURL)
+		if err != nil {
+			return nil, fmt.Errorf("saml: invalid identity provider metadata URL %q: %w", s.IDPMetadataURL, err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		metadata, err := samlsp.FetchMetadata(ctx, httpclient.GetHTTPClient(), *metadataURL)
+		if err != nil {
+			return nil, fmt.Errorf("saml: unable to fetch the identity provider metadata from %q: %w",
+				s.IDPMetadataURL, err)
+		}
+		return metadata, nil
+	}
+	metadataFile := getConfigPath(s.IDPMetadataFile, configDir)
+	data, err := os.ReadFile(metadataFile)
+	if err != nil {
+		return nil, fmt.Errorf("saml: unable to read the identity provider metadata file %q: %w", metadataFile, err)
+	}
+	metadata, err := samlsp.ParseMetadata(data)
+	if err != nil {
+		return nil, fmt.Errorf("saml: unable to parse the identity provider metadata file %q: %w", metadataFile, err)
+	}
+	return metadata, nil
+}
+
+func (s *SAML) getAdminRoleValues() []string {
+	if len(s.AdminRoleValues) == 0 {
+		return []string{adminRoleFieldValue}
+	}
+	return s.AdminRoleValues
+}
+
+// provisionUser creates a new user, member of the provisioning group
+func (s *SAML) provisionUser(ctx context.Context, username, ipAddr string) error {
+	group, err := dataprovider.GroupExists(s.ProvisioningGroup)
+	if err != nil {
+		return fmt.Errorf("unable to get the provisioning group %q: %w", s.ProvisioningGroup, err)
+	}
+	rootPerms := group.UserSettings.Permissions["/"]
+	if len(rootPerms) == 0 {
+		rootPerms = []string{dataprovider.PermAny}
+	}
+	// the group home dir has precedence at runtime, we set it here to pass the
+	// validation. If empty, the users base dir will be used, if configured
+	homeDir := strings.ReplaceAll(group.UserSettings.HomeDir, "%username%", username)
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: username,
+			HomeDir:  homeDir,
+			Status:   1,
+			// the password is never used, users can login using SAML and
+			// an admin can set a password later if needed
+			Password: util.GenerateUniqueID(),
+			Permissions: map[string][]string{
+				"/": rootPerms,
+			},
+		},
+		Groups: []sdk.GroupMapping{
+			{
+				Name: group.Name,
+				Type: sdk.GroupTypePrimary,
+			},
+		},
+	}
+	if err := dataprovider.AddUserContext(ctx, &user, dataprovider.ActionExecutorSystem, ipAddr, ""); err != nil {
+		return fmt.Errorf("unable to provision user %q: %w", username, err)
+	}
+	logger.Info(logSender, "", "saml: user %q provisioned, group %q", username, group.Name)
+	return nil
+}
+
+// samlIdentity defines the identity mapped from a SAML assertion
+type samlIdentity struct {
+	Username     string
+	IsAdmin      bool
+	CustomFields *map[string]any
+}
+
+func getSAMLAttributeValues(assertion *saml.Assertion, name string) []string {
+	var values []string
+	for _, statement := range assertion.AttributeStatements {
+		for _, attr := range statement.Attributes {
+			if attr.Name != name && attr.FriendlyName != name {
+				continue
+			}
+			for _, val := range attr.Values {
+				values = append(values, val.Value)
+			}
+		}
+	}
+	return values
+}
+
+func (s *SAML) getIdentity(assertion *saml.Assertion, audience tokenAudience) (samlIdentity, error) {
+	var identity samlIdentity
+
+	if s.UsernameAttribute == "" {
+		if assertion.Subject != nil && assertion.Subject.NameID != nil {
+			identity.Username = assertion.Subject.NameID.Value
+		}
+	} else {
+		values := getSAMLAttributeValues(assertion, s.UsernameAttribute)
+		if len(values) > 0 {
+			identity.Username = values[0]
+		}
+	}
+	if identity.Username == "" {
+		return identity, errors.New("no username attribute")
+	}
+	if s.ImplicitRoles {
+		identity.IsAdmin = audience == tokenAudienceWebAdmin
+	} else if s.RoleAttribute != "" {
+		adminValues := s.getAdminRoleValues()
+		for _, val := range getSAMLAttributeValues(assertion, s.RoleAttribute) {
+			if util.Contains(adminValues, val) {
+				identity.IsAdmin = true
+				break
+			}
+		}
+	}
+	for _, attr := range s.CustomAttributes {
+		values := getSAMLAttributeValues(assertion, attr)
+		if len(values) == 0 {
+			logger.Info(logSender, "", "custom attribute %q not found in saml assertion", attr)
+			continue
+		}
+		if identity.CustomFields == nil {
+			customFields := make(map[string]any)
+			identity.CustomFields = &customFields
+		}
+		if len(values) == 1 {
+			(*identity.CustomFields)[attr] = values[0]
+		} else {
+			(*identity.CustomFields)[attr] = values
+		}
+	}
+	return identity, nil
+}
+
+func (s *httpdServer) handleWebAdminSAMLLogin(w http.ResponseWriter, r *http.Request) {
+	s.samlLoginRedirect(w, r, tokenAudienceWebAdmin)
+}
+
+func (s *httpdServer) handleWebClientSAMLLogin(w http.ResponseWriter, r *http.Request) {
+	s.samlLoginRedirect(w, r, tokenAudienceWebClient)
+}
+
+func (s *httpdServer) samlLoginRedirect(w http.ResponseWriter, r *http.Request, audience tokenAudience) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxLoginBodySize)
+	sp := s.binding.SAML.sp
+	req, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(saml.HTTPRedirectBinding),
+		saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err == nil {
+		var redirectURL *url.URL
+		redirectURL, err = req.Redirect(req.ID, sp)
+		if err == nil {
+			// the request ID is also used as relay state
+			oidcMgr.addPendingAuth(oidcPendingAuth{
+				State:    req.ID,
+				Nonce:    xid.New().String(),
+				Audience: audience,
+				IssuedAt: util.GetTimeAsMsSinceEpoch(time.Now()),
+			})
+			http.Redirect(w, r, redirectURL.String(), http.StatusFound)
+			return
+		}
+	}
+	logger.Warn(logSender, "", "unable to create saml authentication request: %v", err)
+	setFlashMessage(w, r, "Unable to create the SAML authentication request")
+	if audience == tokenAudienceWebAdmin {
+		http.Redirect(w, r, webAdminLoginPath, http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, webClientLoginPath, http.StatusFound)
+}
+
+func (s *httpdServer) handleSAMLMetadata(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxLoginBodySize)
+	data, err := xml.MarshalIndent(s.binding.SAML.sp.Metadata(), "", "  ")
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write(data) //nolint:errcheck
+}
+
+func (s *httpdServer) debugSAMLAssertion(assertion *saml.Assertion) {
+	if s.binding.SAML.Debug {
+		data, err := xml.Marshal(assertion)
+		logger.Debug(logSender, "", "saml assertion %s, marshal err: %v", data, err)
+	}
+}
+
+func (s *httpdServer) handleSAMLACS(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	if err := r.ParseForm(); err != nil {
+		s.renderClientMessagePage(w, r, "Invalid authentication request", "Unable to parse the SAML response",
+			http.StatusBadRequest, err, "")
+		return
+	}
+	relayState := r.PostForm.Get("RelayState")
+	authReq, err := oidcMgr.getPendingAuth(relayState)
+	if err != nil {
+		logger.Debug(logSender, "", "saml relay state did not match")
+		s.renderClientMessagePage(w, r, "Invalid authentication request", "Authentication state did not match",
+			http.StatusBadRequest, nil, "")
+		return
+	}
+	oidcMgr.removePendingAuth(relayState)
+
+	doRedirect := func() {
+		if authReq.Audience == tokenAudienceWebAdmin {
+			http.Redirect(w, r, webAdminLoginPath, http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, webClientLoginPath, http.StatusFound)
+	}
+
+	assertion, err := s.binding.SAML.sp.ParseResponse(r, []string{authReq.State})
+	if err != nil {
+		var invalidResponseErr *saml.InvalidResponseError
+		if errors.As(err, &invalidResponseErr) {
+			err = invalidResponseErr.PrivateErr
+		}
+		logger.Debug(logSender, "", "failed to validate saml response: %v", err)
+		setFlashMessage(w, r, "Failed to validate the SAML response")
+		doRedirect()
+		return
+	}
+	s.debugSAMLAssertion(assertion)
+	identity, err := s.binding.SAML.getIdentity(assertion, authReq.Audience)
+	if err != nil {
+		logger.Debug(logSender, "", "unable to get the identity from the saml assertion: %v", err)
+		setFlashMessage(w, r, fmt.Sprintf("Unable to parse the SAML assertion: %v", err))
+		doRedirect()
+		return
+	}
+	switch authReq.Audience {
+	case tokenAudienceWebAdmin:
+		if !identity.IsAdmin {
+			logger.Debug(logSender, "", "wrong saml role, the mapped user is not an SFTPGo admin")
+			setFlashMessage(w, r, "Wrong SAML role, the logged in user is not an SFTPGo admin")
+			doRedirect()
+			return
+		}
+		s.loginSAMLAdmin(w, r, &identity, doRedirect)
+	case tokenAudienceWebClient:
+		if identity.IsAdmin {
+			logger.Debug(logSender, "", "wrong saml role, the mapped user is an SFTPGo admin")
+			setFlashMessage(w, r, "Wrong SAML role, the logged in user is an SFTPGo admin")
+			doRedirect()
+			return
+		}
+		s.loginSAMLUser(w, r, &identity, doRedirect)
+	}
+}
+
+func (s *httpdServer) loginSAMLAdmin(w http.ResponseWriter, r *http.Request, identity *samlIdentity, doRedirect func()) {
+	ipAddr := util.GetIPFromRemoteAddress(r.RemoteAddr)
+	params := common.EventParams{
+		Name:      identity.Username,
+		IP:        ipAddr,
+		Protocol:  common.ProtocolSAML,
+		Timestamp: time.Now().UnixNano(),
+		Status:    1,
+		Event:     common.IDPLoginAdmin,
+	}
+	_, admin, err := common.HandleIDPLoginEvent(params, identity.CustomFields)
+	if err == nil && admin == nil {
+		var a dataprovider.Admin
+		a, err = dataprovider.AdminExists(identity.Username)
+		admin = &a
+	}
+	if err == nil {
+		err = admin.CanLogin(ipAddr)
+	}
+	c := jwtTokenClaims{
+		Username:             admin.Username,
+		Role:                 admin.Role,
+		Signature:            admin.GetSignature(),
+		HideUserPageSections: admin.Filters.Preferences.HideUserPageSections,
+		IDPProtocol:          common.ProtocolSAML,
+	}
+	if err == nil {
+		err = c.setAdminAccessSettings(admin)
+	}
+	if err != nil {
+		logger.Debug(logSender, "", "unable to get the sftpgo admin associated with the saml assertion: %v", err)
+		setFlashMessage(w, r, "Unable to get the admin associated with the SAML assertion")
+		doRedirect()
+		return
+	}
+	if err := c.createAndSetCookie(w, r, s.tokenAuth, tokenAudienceWebAdmin, ipAddr); err != nil {
+		logger.Warn(logSender, "", "unable to set admin login cookie %v", err)
+		setFlashMessage(w, r, "Unable to create cookie")
+		doRedirect()
+		return
+	}
+	dataprovider.UpdateAdminLastLogin(admin)
+	renderSAMLLoginRedirect(w, webUsersPath)
+}
+
+func (s *httpdServer) getSAMLUser(ctx context.Context, identity *samlIdentity, ipAddr string) (*dataprovider.User, error) {
+	params := common.EventParams{
+		Name:      identity.Username,
+		IP:        ipAddr,
+		Protocol:  common.ProtocolSAML,
+		Timestamp: time.Now().UnixNano(),
+		Status:    1,
+		Event:     common.IDPLoginUser,
+	}
+	user, _, err := common.HandleIDPLoginEvent(params, identity.CustomFields)
+	if err != nil {
+		return nil, err
+	}
+	if user != nil {
+		return user, nil
+	}
+	u, err := dataprovider.GetUserAfterIDPAuthContext(ctx, identity.Username, ipAddr, common.ProtocolSAML, identity.CustomFields)
+	if err != nil {
+		if !s.binding.SAML.AutoProvisioning || !errors.Is(err, util.ErrNotFound) {
+			return nil, err
+		}
+		if err := s.binding.SAML.provisionUser(ctx, identity.Username, ipAddr); err != nil {
+			logger.Warn(logSender, "", "saml: %v", err)
+			return nil, err
+		}
+		u, err = dataprovider.GetUserAfterIDPAuthContext(ctx, identity.Username, ipAddr, common.ProtocolSAML, identity.CustomFields)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &u, nil
+}
+
+func (s *httpdServer) loginSAMLUser(w http.ResponseWriter, r *http.Request, identity *samlIdentity, doRedirect func()) {
+	ipAddr := util.GetIPFromRemoteAddress(r.RemoteAddr)
+	user, err := s.getSAMLUser(r.Context(), identity, ipAddr)
+	if err != nil {
+		logger.Debug(logSender, "", "unable to get the sftpgo user associated with the saml assertion: %v", err)
+		setFlashMessage(w, r, "Unable to get the user associated with the SAML assertion")
+		doRedirect()
+		return
+	}
+	connectionID := fmt.Sprintf("%s_%s", common.ProtocolSAML, getRequestID(r))
+	err = common.Config.ExecutePostConnectHook(ipAddr, common.ProtocolSAML)
+	if err != nil {
+		err = fmt.Errorf("access denied: %w", err)
+	}
+	if err == nil {
+		err = user.CheckLoginConditions()
+	}
+	if err == nil {
+		err = checkHTTPClientUser(user, r, connectionID, true)
+	}
+	if err == nil {
+		err = user.CheckFsRoot(connectionID)
+		user.CloseFs() //nolint:errcheck
+		if err != nil {
+			logger.Warn(logSender, connectionID, "unable to check fs root: %v", err)
+			err = common.ErrInternalFailure
+		}
+	}
+	if err != nil {
+		updateLoginMetricsForProtocol(r.Context(), user, dataprovider.LoginMethodIDP, common.ProtocolSAML, ipAddr, err)
+		logger.Debug(logSender, connectionID, "saml login denied for user %q: %v", user.Username, err)
+		setFlashMessage(w, r, "Unable to login the user associated with the SAML assertion")
+		doRedirect()
+		return
+	}
+	c := jwtTokenClaims{
+		Username:           user.Username,
+		Permissions:        user.Filters.WebClient,
+		Signature:          user.GetSignature(),
+		Role:               user.Role,
+		IDPProtocol:        common.ProtocolSAML,
+		MustAcceptConsents: common.MustAcceptConsents(user),
+	}
+	policy := user.GetSessionPolicy(common.ProtocolSAML)
+	if policy.MaxSessionDuration > 0 {
+		c.SessionExpiresAt = util.GetTimeAsMsSinceEpoch(time.Now().Add(policy.GetMaxSessionDuration()))
+	}
+	if err := c.createAndSetCookie(w, r, s.tokenAuth, tokenAudienceWebClient, ipAddr); err != nil {
+		logger.Warn(logSender, connectionID, "unable to set user login cookie %v", err)
+		updateLoginMetricsForProtocol(r.Context(), user, dataprovider.LoginMethodIDP, common.ProtocolSAML, ipAddr,
+			common.ErrInternalFailure)
+		setFlashMessage(w, r, "Unable to create cookie")
+		doRedirect()
+		return
+	}
+	updateLoginMetricsForProtocol(r.Context(), user, dataprovider.LoginMethodIDP, common.ProtocolSAML, ipAddr, nil)
+	dataprovider.UpdateLastLogin(user)
+	renderSAMLLoginRedirect(w, webClientFilesPath)
+}
+
+// renderSAMLLoginRedirect redirects to the specified location after a successful login.
+// The ACS endpoint is reached with a cross site POST request, the login cookie
+// uses the strict same site mode and so it will not be sent following an HTTP redirect.
+// We use a same site navigation instead
+func renderSAMLLoginRedirect(w http.ResponseWriter, location string) {
+	location = html.EscapeString(location)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Add("Cache-Control", `no-cache="Set-Cookie"`)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `<!DOCTYPE html><html><head><meta http-equiv="refresh" content="0;url=%s"></head>`+ //nolint:errcheck
+		`<body><a href="%s">Continue</a></body></html>`, location, location)
+}
@@ -0,0 +1,614 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/rs/xid"
+	"github.com/sftpgo/sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/v2/pkg/common"
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	samlIDPBaseURL = "https://idp.example.com"
+	samlSPBaseURL  = "https://sftpgo.example.com"
+)
+
+func getTestSAMLIDP(t *testing.T) *saml.IdentityProvider {
+	keyPair, err := tls.X509KeyPair([]byte(client1Crt), []byte(client1Key))
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	require.NoError(t, err)
+	metadataURL, err := url.Parse(samlIDPBaseURL + "/metadata")
+	require.NoError(t, err)
+	ssoURL, err := url.Parse(samlIDPBaseURL + "/sso")
+	require.NoError(t, err)
+	return &saml.IdentityProvider{
+		Key:         keyPair.PrivateKey,
+		Certificate: cert,
+		MetadataURL: *metadataURL,
+		SSOURL:      *ssoURL,
+	}
+}
+
+func writeTestSAMLIDPMetadata(t *testing.T, idp *saml.IdentityProvider) string {
+	data, err := xml.Marshal(idp.Metadata())
+	require.NoError(t, err)
+	metadataFile := filepath.Join(os.TempDir(), "idp_metadata.xml")
+	err = os.WriteFile(metadataFile, data, 0600)
+	require.NoError(t, err)
+	return metadataFile
+}
+
+func getTestSAMLServer(t *testing.T, idpMetadataFile string) *httpdServer {
+	server := &httpdServer{
+		binding: Binding{
+			SAML: SAML{
+				IDPMetadataFile: idpMetadataFile,
+				BaseURL:         samlSPBaseURL,
+				RoleAttribute:   "sftpgo_role",
+				Debug:           true,
+			},
+		},
+		enableWebAdmin:  true,
+		enableWebClient: true,
+	}
+	err := server.binding.SAML.initialize(configDir)
+	require.NoError(t, err)
+	server.initializeRouter()
+	return server
+}
+
+// getTestSAMLResponse returns a signed SAML response form for the specified request ID
+func getTestSAMLResponse(t *testing.T, idp *saml.IdentityProvider, sp *saml.ServiceProvider, requestID string,
+	session *saml.Session,
+) url.Values {
+	spMetadata := sp.Metadata()
+	req := &saml.IdpAuthnRequest{
+		IDP:         idp,
+		HTTPRequest: httptest.NewRequest(http.MethodGet, samlIDPBaseURL+"/sso", nil),
+		Request: saml.AuthnRequest{
+			ID:           requestID,
+			IssueInstant: time.Now(),
+		},
+		ServiceProviderMetadata: spMetadata,
+		SPSSODescriptor:         &spMetadata.SPSSODescriptors[0],
+		ACSEndpoint:             &spMetadata.SPSSODescriptors[0].AssertionConsumerServices[0],
+		RelayState:              requestID,
+		Now:                     time.Now(),
+	}
+	err := saml.DefaultAssertionMaker{}.MakeAssertion(req, session)
+	require.NoError(t, err)
+	form, err := req.PostBinding()
+	require.NoError(t, err)
+	values := url.Values{}
+	values.Set("SAMLResponse", form.SAMLResponse)
+	values.Set("RelayState", form.RelayState)
+	return values
+}
+
+func getTestSAMLSession(username string, role string) *saml.Session {
+	session := &saml.Session{
+		ID:         xid.New().String(),
+		CreateTime: time.Now(),
+		ExpireTime: time.Now().Add(5 * time.Minute),
+		Index:      xid.New().String(),
+		NameID:     username,
+	}
+	if role != "" {
+		session.CustomAttributes = []saml.Attribute{
+			{
+				Name: "sftpgo_role",
+				Values: []saml.AttributeValue{
+					{
+						Type:  "xs:string",
+						Value: role,
+					},
+				},
+			},
+		}
+	}
+	return session
+}
+
+func getSAMLRequestID(t *testing.T, oidcMgr *memoryOIDCManager) string {
+	require.Len(t, oidcMgr.pendingAuths, 1)
+	var requestID string
+	for k := range oidcMgr.pendingAuths {
+		requestID = k
+	}
+	return requestID
+}
+
+func TestSAMLInitialization(t *testing.T) {
+	config := SAML{}
+	err := config.initialize(configDir)
+	assert.NoError(t, err)
+	assert.False(t, config.isEnabled())
+	assert.False(t, config.hasRoles())
+
+	config.IDPMetadataFile = "missing_metadata.xml"
+	err = config.initialize(configDir)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "base URL cannot be empty")
+	}
+	config.BaseURL = samlSPBaseURL
+	config.AutoProvisioning = true
+	err = config.initialize(configDir)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "a provisioning group is required")
+	}
+	config.AutoProvisioning = false
+	err = config.initialize(configDir)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unable to read the identity provider metadata file")
+	}
+	invalidMetadataFile := filepath.Join(os.TempDir(), "invalid_idp_metadata.xml")
+	err = os.WriteFile(invalidMetadataFile, []byte("invalid metadata"), 0600)
+	assert.NoError(t, err)
+	config.IDPMetadataFile = invalidMetadataFile
+	err = config.initialize(configDir)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unable to parse the identity provider metadata file")
+	}
+	err = os.Remove(invalidMetadataFile)
+	assert.NoError(t, err)
+	config.IDPMetadataFile = ""
+	config.IDPMetadataURL = "http://127.0.0.1:11112/metadata"
+	err = config.initialize(configDir)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unable to fetch the identity provider metadata")
+	}
+	config.IDPMetadataURL = ""
+
+	idp := getTestSAMLIDP(t)
+	metadataFile := writeTestSAMLIDPMetadata(t, idp)
+	config.IDPMetadataFile = metadataFile
+	config.SignRequests = true
+	err = config.initialize(configDir)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "are required to sign requests")
+	}
+	certPath := filepath.Join(os.TempDir(), "saml.crt")
+	keyPath := filepath.Join(os.TempDir(), "saml.key")
+	err = os.WriteFile(certPath, []byte(httpdCert), 0600)
+	assert.NoError(t, err)
+	err = os.WriteFile(keyPath, []byte(httpdKey), 0600)
+	assert.NoError(t, err)
+	config.CertificateFile = certPath
+	config.CertificateKeyFile = "missing.key"
+	err = config.initialize(configDir)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unable to load the service provider key pair")
+	}
+	config.CertificateKeyFile = keyPath
+	err = config.initialize(configDir)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "must be an RSA key")
+	}
+	err = os.WriteFile(certPath, []byte(client2Crt), 0600)
+	assert.NoError(t, err)
+	err = os.WriteFile(keyPath, []byte(client2Key), 0600)
+	assert.NoError(t, err)
+	err = config.initialize(configDir)
+	assert.NoError(t, err)
+	assert.True(t, config.isEnabled())
+	assert.False(t, config.hasRoles())
+	assert.Equal(t, samlSPBaseURL+webSAMLACSPath, config.sp.AcsURL.String())
+	assert.Equal(t, []string{adminRoleFieldValue}, config.getAdminRoleValues())
+	config.ImplicitRoles = true
+	assert.True(t, config.hasRoles())
+
+	err = os.Remove(certPath)
+	assert.NoError(t, err)
+	err = os.Remove(keyPath)
+	assert.NoError(t, err)
+	err = os.Remove(metadataFile)
+	assert.NoError(t, err)
+}
+
+func TestSAMLIdentity(t *testing.T) {
+	config := SAML{
+		UsernameAttribute: "email",
+		RoleAttribute:     "role",
+		AdminRoleValues:   []string{"superuser"},
+		CustomAttributes:  []string{"department", "groups", "missing"},
+	}
+	assertion := &saml.Assertion{
+		Subject: &saml.Subject{
+			NameID: &saml.NameID{
+				Value: "nameid",
+			},
+		},
+	}
+	_, err := config.getIdentity(assertion, tokenAudienceWebClient)
+	assert.Error(t, err)
+	assertion.AttributeStatements = []saml.AttributeStatement{
+		{
+			Attributes: []saml.Attribute{
+				{
+					FriendlyName: "email",
+					Values:       []saml.AttributeValue{{Value: "user@example.com"}},
+				},
+				{
+					Name:   "role",
+					Values: []saml.AttributeValue{{Value: "admin"}},
+				},
+				{
+					Name:   "department",
+					Values: []saml.AttributeValue{{Value: "sales"}},
+				},
+				{
+					Name:   "groups",
+					Values: []saml.AttributeValue{{Value: "g1"}, {Value: "g2"}},
+				},
+			},
+		},
+	}
+	identity, err := config.getIdentity(assertion, tokenAudienceWebAdmin)
+	assert.NoError(t, err)
+	assert.Equal(t, "user@example.com", identity.Username)
+	assert.False(t, identity.IsAdmin)
+	require.NotNil(t, identity.CustomFields)
+	assert.Len(t, *identity.CustomFields, 2)
+	assert.Equal(t, "sales", (*identity.CustomFields)["department"])
+	assert.Equal(t, []string{"g1", "g2"}, (*identity.CustomFields)["groups"])
+
+	assertion.AttributeStatements[0].Attributes[1].Values = append(assertion.AttributeStatements[0].Attributes[1].Values,
+		saml.AttributeValue{Value: "superuser"})
+	identity, err = config.getIdentity(assertion, tokenAudienceWebClient)
+	assert.NoError(t, err)
+	assert.True(t, identity.IsAdmin)
+
+	config.UsernameAttribute = ""
+	config.ImplicitRoles = true
+	config.CustomAttributes = nil
+	identity, err = config.getIdentity(assertion, tokenAudienceWebClient)
+	assert.NoError(t, err)
+	assert.Equal(t, "nameid", identity.Username)
+	assert.False(t, identity.IsAdmin)
+	assert.Nil(t, identity.CustomFields)
+	identity, err = config.getIdentity(assertion, tokenAudienceWebAdmin)
+	assert.NoError(t, err)
+	assert.True(t, identity.IsAdmin)
+}
+
+func TestSAMLLoginLogout(t *testing.T) {
+	oidcMgr, ok := oidcMgr.(*memoryOIDCManager)
+	require.True(t, ok)
+
+	idp := getTestSAMLIDP(t)
+	metadataFile := writeTestSAMLIDPMetadata(t, idp)
+	server := getTestSAMLServer(t, metadataFile)
+	assert.True(t, server.binding.SAML.hasRoles())
+
+	rr := httptest.NewRecorder()
+	r, err := http.NewRequest(http.MethodGet, webSAMLMetadataPath, nil)
+	assert.NoError(t, err)
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/samlmetadata+xml", rr.Header().Get("Content-Type"))
+	assert.Contains(t, rr.Body.String(), samlSPBaseURL+webSAMLACSPath)
+	// the login pages must show the SAML login links
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodGet, webClientLoginPath, nil)
+	assert.NoError(t, err)
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), webClientSAMLLoginPath)
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodGet, webAdminLoginPath, nil)
+	assert.NoError(t, err)
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), webAdminSAMLLoginPath)
+	// invalid relay state
+	form := url.Values{}
+	form.Set("RelayState", xid.New().String())
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodPost, webSAMLACSPath, strings.NewReader(form.Encode()))
+	assert.NoError(t, err)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Authentication state did not match")
+	// login as admin
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodGet, webAdminSAMLLoginPath, nil)
+	assert.NoError(t, err)
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.True(t, strings.HasPrefix(rr.Header().Get("Location"), samlIDPBaseURL+"/sso?SAMLRequest="))
+	requestID := getSAMLRequestID(t, oidcMgr)
+	// invalid SAML response
+	form = url.Values{}
+	form.Set("RelayState", requestID)
+	form.Set("SAMLResponse", "invalid")
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodPost, webSAMLACSPath, strings.NewReader(form.Encode()))
+	assert.NoError(t, err)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, webAdminLoginPath, rr.Header().Get("Location"))
+	require.Len(t, oidcMgr.pendingAuths, 0)
+	// the user is not an admin
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodGet, webAdminSAMLLoginPath, nil)
+	assert.NoError(t, err)
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	requestID = getSAMLRequestID(t, oidcMgr)
+	form = getTestSAMLResponse(t, idp, server.binding.SAML.sp, requestID, getTestSAMLSession(defaultAdminUsername, ""))
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodPost, webSAMLACSPath, strings.NewReader(form.Encode()))
+	assert.NoError(t, err)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, webAdminLoginPath, rr.Header().Get("Location"))
+	// successful admin login
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodGet, webAdminSAMLLoginPath, nil)
+	assert.NoError(t, err)
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	requestID = getSAMLRequestID(t, oidcMgr)
+	form = getTestSAMLResponse(t, idp, server.binding.SAML.sp, requestID,
+		getTestSAMLSession(defaultAdminUsername, adminRoleFieldValue))
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodPost, webSAMLACSPath, strings.NewReader(form.Encode()))
+	assert.NoError(t, err)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), webUsersPath)
+	cookie := rr.Header().Get("Set-Cookie")
+	assert.Contains(t, cookie, jwtCookieKey)
+	// the replayed response is rejected
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodPost, webSAMLACSPath, strings.NewReader(form.Encode()))
+	assert.NoError(t, err)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	// the admin cookie works
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodGet, webUsersPath, nil)
+	assert.NoError(t, err)
+	r.Header.Set("Cookie", strings.Split(cookie, ";")[0])
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	// missing user
+	username := "saml_user"
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodGet, webClientSAMLLoginPath, nil)
+	assert.NoError(t, err)
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	requestID = getSAMLRequestID(t, oidcMgr)
+	form = getTestSAMLResponse(t, idp, server.binding.SAML.sp, requestID, getTestSAMLSession(username, ""))
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodPost, webSAMLACSPath, strings.NewReader(form.Encode()))
+	assert.NoError(t, err)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, webClientLoginPath, rr.Header().Get("Location"))
+	// an admin cannot login to the WebClient
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodGet, webClientSAMLLoginPath, nil)
+	assert.NoError(t, err)
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	requestID = getSAMLRequestID(t, oidcMgr)
+	form = getTestSAMLResponse(t, idp, server.binding.SAML.sp, requestID,
+		getTestSAMLSession(defaultAdminUsername, adminRoleFieldValue))
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodPost, webSAMLACSPath, strings.NewReader(form.Encode()))
+	assert.NoError(t, err)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, webClientLoginPath, rr.Header().Get("Location"))
+	// create the user
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: username,
+			Password: "pwd",
+			HomeDir:  filepath.Join(os.TempDir(), username),
+			Status:   1,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+	}
+	err = dataprovider.AddUser(&user, "", "", "")
+	assert.NoError(t, err)
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodGet, webClientSAMLLoginPath, nil)
+	assert.NoError(t, err)
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	requestID = getSAMLRequestID(t, oidcMgr)
+	form = getTestSAMLResponse(t, idp, server.binding.SAML.sp, requestID, getTestSAMLSession(username, ""))
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodPost, webSAMLACSPath, strings.NewReader(form.Encode()))
+	assert.NoError(t, err)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), webClientFilesPath)
+	cookie = rr.Header().Get("Set-Cookie")
+	assert.Contains(t, cookie, jwtCookieKey)
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodGet, webClientFilesPath, nil)
+	assert.NoError(t, err)
+	r.Header.Set("Cookie", strings.Split(cookie, ";")[0])
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	// the WebClient cookie cannot be used for the WebAdmin
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodGet, webUsersPath, nil)
+	assert.NoError(t, err)
+	r.Header.Set("Cookie", strings.Split(cookie, ";")[0])
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, webAdminLoginPath, rr.Header().Get("Location"))
+
+	err = dataprovider.DeleteUser(username, "", "", "")
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	err = os.Remove(metadataFile)
+	assert.NoError(t, err)
+}
+
+func TestSAMLAutoProvisioning(t *testing.T) {
+	oidcMgr, ok := oidcMgr.(*memoryOIDCManager)
+	require.True(t, ok)
+
+	group := dataprovider.Group{
+		BaseGroup: sdk.BaseGroup{
+			Name: "saml_group",
+		},
+		UserSettings: dataprovider.GroupUserSettings{
+			BaseGroupUserSettings: sdk.BaseGroupUserSettings{
+				HomeDir: filepath.Join(os.TempDir(), "saml_home", "%username%"),
+				Permissions: map[string][]string{
+					"/": {dataprovider.PermListItems, dataprovider.PermDownload},
+				},
+			},
+		},
+	}
+	idp := getTestSAMLIDP(t)
+	metadataFile := writeTestSAMLIDPMetadata(t, idp)
+	server := getTestSAMLServer(t, metadataFile)
+	server.binding.SAML.AutoProvisioning = true
+	server.binding.SAML.ProvisioningGroup = group.Name
+	username := "saml_provisioned_user"
+	// the provisioning group does not exist
+	rr := httptest.NewRecorder()
+	r, err := http.NewRequest(http.MethodGet, webClientSAMLLoginPath, nil)
+	assert.NoError(t, err)
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	requestID := getSAMLRequestID(t, oidcMgr)
+	form := getTestSAMLResponse(t, idp, server.binding.SAML.sp, requestID, getTestSAMLSession(username, ""))
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodPost, webSAMLACSPath, strings.NewReader(form.Encode()))
+	assert.NoError(t, err)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, webClientLoginPath, rr.Header().Get("Location"))
+	_, err = dataprovider.UserExists(username, "")
+	assert.ErrorIs(t, err, util.ErrNotFound)
+
+	err = dataprovider.AddGroup(&group, "", "", "")
+	assert.NoError(t, err)
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodGet, webClientSAMLLoginPath, nil)
+	assert.NoError(t, err)
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	requestID = getSAMLRequestID(t, oidcMgr)
+	form = getTestSAMLResponse(t, idp, server.binding.SAML.sp, requestID, getTestSAMLSession(username, ""))
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodPost, webSAMLACSPath, strings.NewReader(form.Encode()))
+	assert.NoError(t, err)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), webClientFilesPath)
+
+	user, err := dataprovider.UserExists(username, "")
+	assert.NoError(t, err)
+	require.Len(t, user.Groups, 1)
+	assert.Equal(t, group.Name, user.Groups[0].Name)
+	assert.Equal(t, sdk.GroupTypePrimary, user.Groups[0].Type)
+	assert.Equal(t, []string{dataprovider.PermListItems, dataprovider.PermDownload}, user.Permissions["/"])
+	user, err = dataprovider.GetUserWithGroupSettings(username, "")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(os.TempDir(), "saml_home", username), user.GetHomeDir())
+	// admins are never provisioned
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodGet, webAdminSAMLLoginPath, nil)
+	assert.NoError(t, err)
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	requestID = getSAMLRequestID(t, oidcMgr)
+	form = getTestSAMLResponse(t, idp, server.binding.SAML.sp, requestID,
+		getTestSAMLSession("saml_missing_admin", adminRoleFieldValue))
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodPost, webSAMLACSPath, strings.NewReader(form.Encode()))
+	assert.NoError(t, err)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	server.router.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, webAdminLoginPath, rr.Header().Get("Location"))
+	_, err = dataprovider.AdminExists("saml_missing_admin")
+	assert.ErrorIs(t, err, util.ErrNotFound)
+
+	err = dataprovider.DeleteUser(username, "", "", "")
+	assert.NoError(t, err)
+	err = dataprovider.DeleteGroup(group.Name, "", "", "")
+	assert.NoError(t, err)
+	err = os.RemoveAll(filepath.Join(os.TempDir(), "saml_home"))
+	assert.NoError(t, err)
+	err = os.Remove(metadataFile)
+	assert.NoError(t, err)
+}
+
+func TestSAMLProtocol(t *testing.T) {
+	assert.True(t, util.Contains(dataprovider.SupportedRuleConditionProtocols, common.ProtocolSAML))
+	user := dataprovider.User{
+		Filters: dataprovider.UserFilters{
+			SessionPolicies: []dataprovider.SessionPolicy{
+				{
+					Protocols:          []string{common.ProtocolHTTP},
+					MaxSessionDuration: 10,
+				},
+			},
+		},
+	}
+	assert.Equal(t, 10, user.GetSessionPolicy(common.ProtocolSAML).MaxSessionDuration)
+	c := jwtTokenClaims{
+		Username:    "user",
+		IDPProtocol: common.ProtocolSAML,
+	}
+	token := c.asMap()
+	assert.Equal(t, common.ProtocolSAML, token[claimIDPProtocol])
+	decoded := jwtTokenClaims{}
+	decoded.Decode(token)
+	assert.Equal(t, common.ProtocolSAML, decoded.IDPProtocol)
+}
@@ -107,8 +107,12 @@ func (s *httpdServer) listenAndServe() error {
 		if getConfigPath(s.binding.CertificateFile, "") != "" && getConfigPath(s.binding.CertificateKeyFile, "") != "" {
 			certID = s.binding.GetAddress()
 		}
+		getCertificate := certMgr.GetCertificateFunc(certID)
+		if len(s.binding.SNICertificates) > 0 || s.binding.ACMEOnDemand {
+			getCertificate = certMgr.GetCertificateFuncWithSNI(certID, s.binding.GetAddress(), s.binding.ACMEOnDemand)
+		}
 		config := &tls.Config{
-			GetCertificate:           certMgr.GetCertificateFunc(certID),
+			GetCertificate:           getCertificate,
 			MinVersion:               util.GetTLSVersion(s.binding.MinTLSVersion),
 			NextProtos:               []string{"http/1.1", "h2"},
 			CipherSuites:             util.GetTLSCiphersFromNames(s.binding.TLSCipherSuites),
@@ -117,10 +121,15 @@ func (s *httpdServer) listenAndServe() error {
 		httpServer.TLSConfig = config
 		logger.Debug(logSender, "", "configured TLS cipher suites for binding %q: %v, certID: %v",
 			s.binding.GetAddress(), httpServer.TLSConfig.CipherSuites, certID)
-		if s.binding.ClientAuthType == 1 {
+		if s.binding.isMutualTLSEnabled() {
 			httpServer.TLSConfig.ClientCAs = certMgr.GetRootCAs()
-			httpServer.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
 			httpServer.TLSConfig.VerifyConnection = s.verifyTLSConnection
+			switch s.binding.ClientAuthType {
+			case 1:
+				httpServer.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			case 2:
+				httpServer.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			}
 		}
 		return util.HTTPListenAndServe(httpServer, s.binding.Address, s.binding.Port, true, logSender)
 	}
@@ -136,6 +145,9 @@ func (s *httpdServer) verifyTLSConnection(state tls.ConnectionState) error {
 			clientCrtName = clientCrt.Subject.String()
 		}
 		if len(state.VerifiedChains) == 0 {
+			if s.binding.ClientAuthType == 2 {
+				return nil
+			}
 			logger.Warn(logSender, "", "TLS connection cannot be verified: unable to get verification chain")
 			return errors.New("TLS connection cannot be verified: unable to get verification chain")
 		}
@@ -154,6 +166,23 @@ func (s *httpdServer) verifyTLSConnection(state tls.ConnectionState) error {
 	return nil
 }
 
+// getTLSCertificateLogin returns the username, the login method and the verified
+// TLS client certificate, if any. If a certificate is provided without a password,
+// the certificate CN is used if no username is provided
+func (s *httpdServer) getTLSCertificateLogin(r *http.Request, username, password string) (string, string, *x509.Certificate) {
+	if !s.binding.isMutualTLSEnabled() || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return username, dataprovider.LoginMethodPassword, nil
+	}
+	tlsCert := r.TLS.PeerCertificates[0]
+	if password != "" {
+		return username, dataprovider.LoginMethodTLSCertificateAndPwd, tlsCert
+	}
+	if username == "" {
+		username = tlsCert.Subject.CommonName
+	}
+	return username, dataprovider.LoginMethodTLSCertificate, tlsCert
+}
+
 func (s *httpdServer) refreshCookie(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		s.checkCookieExpiration(w, r)
@@ -171,6 +200,9 @@ func (s *httpdServer) renderClientLoginPage(w http.ResponseWriter, r *http.Reque
 		Branding:     s.binding.Branding.WebClient,
 		FormDisabled: s.binding.isWebClientLoginFormDisabled(),
 	}
+	if s.binding.isMutualTLSEnabled() && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		data.TLSCertificate = true
+	}
 	if next := r.URL.Query().Get("next"); strings.HasPrefix(next, webClientFilesPath) {
 		data.CurrentURL += "?next=" + url.QueryEscape(next)
 	}
@@ -178,11 +210,22 @@ func (s *httpdServer) renderClientLoginPage(w http.ResponseWriter, r *http.Reque
 		data.AltLoginURL = webAdminLoginPath
 		data.AltLoginName = s.binding.Branding.WebAdmin.ShortName
 	}
-	if smtp.IsEnabled() && !data.FormDisabled {
-		data.ForgotPwdURL = webClientForgotPwdPath
+	if isWebClientPasswordResetEnabled(r) && !data.FormDisabled {
+		data.ForgotPwdURL = webClientForgotPwdPath + getTenantQuery(r)
+	}
+	if registrationConfig.Enabled && !data.FormDisabled {
+		data.SignUpURL = webClientSignUpPath
+	}
+	if !s.binding.isWebClientOIDCLoginDisabled() {
+		if s.binding.OIDC.isEnabled() {
+			data.OpenIDLoginURL = webClientOIDCLoginPath
+		}
+		if role, err := getTenantRole(r); err == nil && role.HasTenantOIDC() {
+			data.OpenIDLoginURL = webClientOIDCLoginPath + getTenantQuery(r)
+		}
 	}
-	if s.binding.OIDC.isEnabled() && !s.binding.isWebClientOIDCLoginDisabled() {
-		data.OpenIDLoginURL = webClientOIDCLoginPath
+	if s.binding.SAML.isEnabled() && !s.binding.isWebClientOIDCLoginDisabled() {
+		data.SAMLLoginURL = webClientSAMLLoginPath
 	}
 	renderClientTemplate(w, templateClientLogin, data)
 }
@@ -235,35 +278,38 @@ func (s *httpdServer) handleWebClientLoginPost(w http.ResponseWriter, r *http.Re
 	protocol := common.ProtocolHTTP
 	username := strings.TrimSpace(r.Form.Get("username"))
 	password := strings.TrimSpace(r.Form.Get("password"))
-	if username == "" || password == "" {
-		updateLoginMetrics(&dataprovider.User{BaseUser: sdk.BaseUser{Username: username}},
-			dataprovider.LoginMethodPassword, ipAddr, common.ErrNoCredentials)
+	username, loginMethod, tlsCert := s.getTLSCertificateLogin(r, username, password)
+	if username == "" || (password == "" && tlsCert == nil) {
+		updateLoginMetrics(r.Context(), &dataprovider.User{BaseUser: sdk.BaseUser{Username: username}},
+			loginMethod, ipAddr, common.ErrNoCredentials)
 		s.renderClientLoginPage(w, r, "Invalid credentials", ipAddr)
 		return
 	}
 	if err := verifyCSRFToken(r.Form.Get(csrfFormToken), ipAddr); err != nil {
-		updateLoginMetrics(&dataprovider.User{BaseUser: sdk.BaseUser{Username: username}},
-			dataprovider.LoginMethodPassword, ipAddr, err)
+		updateLoginMetrics(r.Context(), &dataprovider.User{BaseUser: sdk.BaseUser{Username: username}},
+			loginMethod, ipAddr, err)
 		s.renderClientLoginPage(w, r, err.Error(), ipAddr)
 		return
 	}
 
 	if err := common.Config.ExecutePostConnectHook(ipAddr, protocol); err != nil {
-		updateLoginMetrics(&dataprovider.User{BaseUser: sdk.BaseUser{Username: username}},
-			dataprovider.LoginMethodPassword, ipAddr, err)
+		updateLoginMetrics(r.Context(), &dataprovider.User{BaseUser: sdk.BaseUser{Username: username}},
+			loginMethod, ipAddr, err)
 		s.renderClientLoginPage(w, r, fmt.Sprintf("access denied: %v", err), ipAddr)
 		return
 	}
 
-	user, err := dataprovider.CheckUserAndPass(username, password, ipAddr, protocol)
+	user, loginMethod, err := dataprovider.CheckCompositeCredentialsContext(r.Context(), username, password, ipAddr, loginMethod,
+		protocol, tlsCert)
 	if err != nil {
-		updateLoginMetrics(&user, dataprovider.LoginMethodPassword, ipAddr, err)
+		user.Username = username
+		updateLoginMetrics(r.Context(), &user, loginMethod, ipAddr, err)
 		s.renderClientLoginPage(w, r, dataprovider.ErrInvalidCredentials.Error(), ipAddr)
 		return
 	}
-	connectionID := fmt.Sprintf("%v_%v", protocol, xid.New().String())
-	if err := checkHTTPClientUser(&user, r, connectionID, true); err != nil {
-		updateLoginMetrics(&user, dataprovider.LoginMethodPassword, ipAddr, err)
+	connectionID := fmt.Sprintf("%v_%v", protocol, getRequestID(r))
+	if err := checkHTTPClientUserWithLoginMethod(&user, r, connectionID, loginMethod, true); err != nil {
+		updateLoginMetrics(r.Context(), &user, loginMethod, ipAddr, err)
 		s.renderClientLoginPage(w, r, err.Error(), ipAddr)
 		return
 	}
@@ -272,11 +318,11 @@ func (s *httpdServer) handleWebClientLoginPost(w http.ResponseWriter, r *http.Re
 	err = user.CheckFsRoot(connectionID)
 	if err != nil {
 		logger.Warn(logSender, connectionID, "unable to check fs root: %v", err)
-		updateLoginMetrics(&user, dataprovider.LoginMethodPassword, ipAddr, common.ErrInternalFailure)
+		updateLoginMetrics(r.Context(), &user, loginMethod, ipAddr, common.ErrInternalFailure)
 		s.renderClientLoginPage(w, r, err.Error(), ipAddr)
 		return
 	}
-	s.loginUser(w, r, &user, connectionID, ipAddr, false, s.renderClientLoginPage)
+	s.loginUser(w, r, &user, connectionID, ipAddr, loginMethod, false, s.renderClientLoginPage)
 }
 
 func (s *httpdServer) handleWebClientPasswordResetPost(w http.ResponseWriter, r *http.Request) {
@@ -298,7 +344,7 @@ func (s *httpdServer) handleWebClientPasswordResetPost(w http.ResponseWriter, r
 		s.renderClientResetPwdPage(w, r, err.Error(), ipAddr)
 		return
 	}
-	connectionID := fmt.Sprintf("%v_%v", getProtocolFromRequest(r), xid.New().String())
+	connectionID := fmt.Sprintf("%v_%v", getProtocolFromRequest(r), getRequestID(r))
 	if err := checkHTTPClientUser(user, r, connectionID, true); err != nil {
 		s.renderClientResetPwdPage(w, r, fmt.Sprintf("Password reset successfully but unable to login: %v", err.Error()), ipAddr)
 		return
@@ -311,7 +357,7 @@ func (s *httpdServer) handleWebClientPasswordResetPost(w http.ResponseWriter, r
 		s.renderClientResetPwdPage(w, r, fmt.Sprintf("Password reset successfully but unable to login: %s", err.Error()), ipAddr)
 		return
 	}
-	s.loginUser(w, r, user, connectionID, ipAddr, false, s.renderClientResetPwdPage)
+	s.loginUser(w, r, user, connectionID, ipAddr, dataprovider.LoginMethodPassword, false, s.renderClientResetPwdPage)
 }
 
 func (s *httpdServer) handleWebClientTwoFactorRecoveryPost(w http.ResponseWriter, r *http.Request) {
@@ -359,14 +405,14 @@ func (s *httpdServer) handleWebClientTwoFactorRecoveryPost(w http.ResponseWriter
 				return
 			}
 			user.Filters.RecoveryCodes[idx].Used = true
-			err = dataprovider.UpdateUser(&user, dataprovider.ActionExecutorSelf, ipAddr, user.Role)
+			err = dataprovider.UpdateUserContext(r.Context(), &user, dataprovider.ActionExecutorSelf, ipAddr, user.Role)
 			if err != nil {
 				logger.Warn(logSender, "", "unable to set the recovery code %q as used: %v", recoveryCode, err)
 				s.renderClientInternalServerErrorPage(w, r, errors.New("unable to set the recovery code as used"))
 				return
 			}
-			connectionID := fmt.Sprintf("%v_%v", getProtocolFromRequest(r), xid.New().String())
-			s.loginUser(w, r, &userMerged, connectionID, ipAddr, true,
+			connectionID := fmt.Sprintf("%v_%v", getProtocolFromRequest(r), getRequestID(r))
+			s.loginUser(w, r, &userMerged, connectionID, ipAddr, dataprovider.LoginMethodPassword, true,
 				s.renderClientTwoFactorRecoveryPage)
 			return
 		}
@@ -390,44 +436,45 @@ func (s *httpdServer) handleWebClientTwoFactorPost(w http.ResponseWriter, r *htt
 	username := claims.Username
 	passcode := strings.TrimSpace(r.Form.Get("passcode"))
 	if username == "" || passcode == "" {
-		updateLoginMetrics(&dataprovider.User{BaseUser: sdk.BaseUser{Username: username}},
+		updateLoginMetrics(r.Context(), &dataprovider.User{BaseUser: sdk.BaseUser{Username: username}},
 			dataprovider.LoginMethodPassword, ipAddr, common.ErrNoCredentials)
 		s.renderClientTwoFactorPage(w, r, "Invalid credentials", ipAddr)
 		return
 	}
 	if err := verifyCSRFToken(r.Form.Get(csrfFormToken), ipAddr); err != nil {
-		updateLoginMetrics(&dataprovider.User{BaseUser: sdk.BaseUser{Username: username}},
+		updateLoginMetrics(r.Context(), &dataprovider.User{BaseUser: sdk.BaseUser{Username: username}},
 			dataprovider.LoginMethodPassword, ipAddr, err)
 		s.renderClientTwoFactorPage(w, r, err.Error(), ipAddr)
 		return
 	}
 	user, err := dataprovider.GetUserWithGroupSettings(username, "")
 	if err != nil {
-		updateLoginMetrics(&dataprovider.User{BaseUser: sdk.BaseUser{Username: username}},
+		updateLoginMetrics(r.Context(), &dataprovider.User{BaseUser: sdk.BaseUser{Username: username}},
 			dataprovider.LoginMethodPassword, ipAddr, err)
 		s.renderClientTwoFactorPage(w, r, "Invalid credentials", ipAddr)
 		return
 	}
 	if !user.Filters.TOTPConfig.Enabled || !util.Contains(user.Filters.TOTPConfig.Protocols, common.ProtocolHTTP) {
-		updateLoginMetrics(&user, dataprovider.LoginMethodPassword, ipAddr, common.ErrInternalFailure)
+		updateLoginMetrics(r.Context(), &user, dataprovider.LoginMethodPassword, ipAddr, common.ErrInternalFailure)
 		s.renderClientTwoFactorPage(w, r, "Two factory authentication is not enabled", ipAddr)
 		return
 	}
 	err = user.Filters.TOTPConfig.Secret.Decrypt()
 	if err != nil {
-		updateLoginMetrics(&user, dataprovider.LoginMethodPassword, ipAddr, common.ErrInternalFailure)
+		updateLoginMetrics(r.Context(), &user, dataprovider.LoginMethodPassword, ipAddr, common.ErrInternalFailure)
 		s.renderClientInternalServerErrorPage(w, r, err)
 		return
 	}
 	match, err := mfa.ValidateTOTPPasscode(user.Filters.TOTPConfig.ConfigName, passcode,
 		user.Filters.TOTPConfig.Secret.GetPayload())
 	if !match || err != nil {
-		updateLoginMetrics(&user, dataprovider.LoginMethodPassword, ipAddr, dataprovider.ErrInvalidCredentials)
+		updateLoginMetrics(r.Context(), &user, dataprovider.LoginMethodPassword, ipAddr, dataprovider.ErrInvalidCredentials)
 		s.renderClientTwoFactorPage(w, r, "Invalid authentication code", ipAddr)
 		return
 	}
-	connectionID := fmt.Sprintf("%s_%s", getProtocolFromRequest(r), xid.New().String())
-	s.loginUser(w, r, &user, connectionID, ipAddr, true, s.renderClientTwoFactorPage)
+	connectionID := fmt.Sprintf("%s_%s", getProtocolFromRequest(r), getRequestID(r))
+	s.loginUser(w, r, &user, connectionID, ipAddr, dataprovider.LoginMethodPassword, true,
+		s.renderClientTwoFactorPage)
 }
 
 func (s *httpdServer) handleWebAdminTwoFactorRecoveryPost(w http.ResponseWriter, r *http.Request) {
@@ -476,7 +523,7 @@ func (s *httpdServer) handleWebAdminTwoFactorRecoveryPost(w http.ResponseWriter,
 				return
 			}
 			admin.Filters.RecoveryCodes[idx].Used = true
-			err = dataprovider.UpdateAdmin(&admin, dataprovider.ActionExecutorSelf, ipAddr, admin.Role)
+			err = dataprovider.UpdateAdminContext(r.Context(), &admin, dataprovider.ActionExecutorSelf, ipAddr, admin.Role)
 			if err != nil {
 				logger.Warn(logSender, "", "unable to set the recovery code %q as used: %v", recoveryCode, err)
 				s.renderInternalServerErrorPage(w, r, errors.New("unable to set the recovery code as used"))
@@ -587,6 +634,9 @@ func (s *httpdServer) renderAdminLoginPage(w http.ResponseWriter, error, ip stri
 	if s.binding.OIDC.hasRoles() && !s.binding.isWebAdminOIDCLoginDisabled() {
 		data.OpenIDLoginURL = webAdminOIDCLoginPath
 	}
+	if s.binding.SAML.hasRoles() && !s.binding.isWebAdminOIDCLoginDisabled() {
+		data.SAMLLoginURL = webAdminSAMLLoginPath
+	}
 	renderAdminTemplate(w, templateLogin, data)
 }
 
@@ -697,7 +747,7 @@ func (s *httpdServer) handleWebAdminSetupPost(w http.ResponseWriter, r *http.Req
 		Status:      1,
 		Permissions: []string{dataprovider.PermAdminAny},
 	}
-	err = dataprovider.AddAdmin(&admin, username, ipAddr, "")
+	err = dataprovider.AddAdminContext(r.Context(), &admin, username, ipAddr, "")
 	if err != nil {
 		s.renderAdminSetupPage(w, r, username, err.Error())
 		return
@@ -706,7 +756,7 @@ func (s *httpdServer) handleWebAdminSetupPost(w http.ResponseWriter, r *http.Req
 }
 
 func (s *httpdServer) loginUser(
-	w http.ResponseWriter, r *http.Request, user *dataprovider.User, connectionID, ipAddr string,
+	w http.ResponseWriter, r *http.Request, user *dataprovider.User, connectionID, ipAddr, loginMethod string,
 	isSecondFactorAuth bool, errorFunc func(w http.ResponseWriter, r *http.Request, error, ip string),
 ) {
 	c := jwtTokenClaims{
@@ -717,6 +767,11 @@ func (s *httpdServer) loginUser(
 		MustSetTwoFactorAuth:       user.MustSetSecondFactor(),
 		MustChangePassword:         user.MustChangePassword(),
 		RequiredTwoFactorProtocols: user.Filters.TwoFactorAuthProtocols,
+		MustAcceptConsents:         common.MustAcceptConsents(user),
+	}
+	policy := user.GetSessionPolicy(common.ProtocolHTTP)
+	if policy.MaxSessionDuration > 0 {
+		c.SessionExpiresAt = util.GetTimeAsMsSinceEpoch(time.Now().Add(policy.GetMaxSessionDuration()))
 	}
 
 	audience := tokenAudienceWebClient
@@ -728,7 +783,7 @@ func (s *httpdServer) loginUser(
 	err := c.createAndSetCookie(w, r, s.tokenAuth, audience, ipAddr)
 	if err != nil {
 		logger.Warn(logSender, connectionID, "unable to set user login cookie %v", err)
-		updateLoginMetrics(user, dataprovider.LoginMethodPassword, ipAddr, common.ErrInternalFailure)
+		updateLoginMetrics(r.Context(), user, loginMethod, ipAddr, common.ErrInternalFailure)
 		errorFunc(w, r, err.Error(), ipAddr)
 		return
 	}
@@ -743,7 +798,7 @@ func (s *httpdServer) loginUser(
 		http.Redirect(w, r, redirectPath, http.StatusFound)
 		return
 	}
-	updateLoginMetrics(user, dataprovider.LoginMethodPassword, ipAddr, err)
+	updateLoginMetrics(r.Context(), user, loginMethod, ipAddr, err)
 	dataprovider.UpdateLastLogin(user)
 	if next := r.URL.Query().Get("next"); strings.HasPrefix(next, webClientFilesPath) {
 		http.Redirect(w, r, next, http.StatusFound)
@@ -759,7 +814,6 @@ func (s *httpdServer) loginAdmin(
 ) {
 	c := jwtTokenClaims{
 		Username:             admin.Username,
-		Permissions:          admin.Permissions,
 		Role:                 admin.Role,
 		Signature:            admin.GetSignature(),
 		HideUserPageSections: admin.Filters.Preferences.HideUserPageSections,
@@ -770,7 +824,10 @@ func (s *httpdServer) loginAdmin(
 		audience = tokenAudienceWebAdminPartial
 	}
 
-	err := c.createAndSetCookie(w, r, s.tokenAuth, audience, ipAddr)
+	err := c.setAdminAccessSettings(admin)
+	if err == nil {
+		err = c.createAndSetCookie(w, r, s.tokenAuth, audience, ipAddr)
+	}
 	if err != nil {
 		logger.Warn(logSender, "", "unable to set admin login cookie %v", err)
 		if errorFunc == nil {
@@ -802,37 +859,40 @@ func (s *httpdServer) getUserToken(w http.ResponseWriter, r *http.Request) {
 	ipAddr := util.GetIPFromRemoteAddress(r.RemoteAddr)
 	username, password, ok := r.BasicAuth()
 	protocol := common.ProtocolHTTP
-	if !ok {
-		updateLoginMetrics(&dataprovider.User{BaseUser: sdk.BaseUser{Username: username}},
+	username, loginMethod, tlsCert := s.getTLSCertificateLogin(r, username, password)
+	if !ok && tlsCert == nil {
+		updateLoginMetrics(r.Context(), &dataprovider.User{BaseUser: sdk.BaseUser{Username: username}},
 			dataprovider.LoginMethodPassword, ipAddr, common.ErrNoCredentials)
 		w.Header().Set(common.HTTPAuthenticationHeader, basicRealm)
 		sendAPIResponse(w, r, nil, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
-	if username == "" || password == "" {
-		updateLoginMetrics(&dataprovider.User{BaseUser: sdk.BaseUser{Username: username}},
-			dataprovider.LoginMethodPassword, ipAddr, common.ErrNoCredentials)
+	if username == "" || (password == "" && tlsCert == nil) {
+		updateLoginMetrics(r.Context(), &dataprovider.User{BaseUser: sdk.BaseUser{Username: username}},
+			loginMethod, ipAddr, common.ErrNoCredentials)
 		w.Header().Set(common.HTTPAuthenticationHeader, basicRealm)
 		sendAPIResponse(w, r, nil, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
 	if err := common.Config.ExecutePostConnectHook(ipAddr, protocol); err != nil {
-		updateLoginMetrics(&dataprovider.User{BaseUser: sdk.BaseUser{Username: username}},
-			dataprovider.LoginMethodPassword, ipAddr, err)
+		updateLoginMetrics(r.Context(), &dataprovider.User{BaseUser: sdk.BaseUser{Username: username}},
+			loginMethod, ipAddr, err)
 		sendAPIResponse(w, r, err, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 		return
 	}
-	user, err := dataprovider.CheckUserAndPass(username, password, ipAddr, protocol)
+	user, loginMethod, err := dataprovider.CheckCompositeCredentialsContext(r.Context(), username, password, ipAddr, loginMethod,
+		protocol, tlsCert)
 	if err != nil {
+		user.Username = username
 		w.Header().Set(common.HTTPAuthenticationHeader, basicRealm)
-		updateLoginMetrics(&user, dataprovider.LoginMethodPassword, ipAddr, err)
+		updateLoginMetrics(r.Context(), &user, loginMethod, ipAddr, err)
 		sendAPIResponse(w, r, dataprovider.ErrInvalidCredentials, http.StatusText(http.StatusUnauthorized),
 			http.StatusUnauthorized)
 		return
 	}
-	connectionID := fmt.Sprintf("%v_%v", protocol, xid.New().String())
-	if err := checkHTTPClientUser(&user, r, connectionID, true); err != nil {
-		updateLoginMetrics(&user, dataprovider.LoginMethodPassword, ipAddr, err)
+	connectionID := fmt.Sprintf("%v_%v", protocol, getRequestID(r))
+	if err := checkHTTPClientUserWithLoginMethod(&user, r, connectionID, loginMethod, true); err != nil {
+		updateLoginMetrics(r.Context(), &user, loginMethod, ipAddr, err)
 		sendAPIResponse(w, r, err, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 		return
 	}
@@ -842,14 +902,14 @@ func (s *httpdServer) getUserToken(w http.ResponseWriter, r *http.Request) {
 		if passcode == "" {
 			logger.Debug(logSender, "", "TOTP enabled for user %q and not passcode provided, authentication refused", user.Username)
 			w.Header().Set(common.HTTPAuthenticationHeader, basicRealm)
-			updateLoginMetrics(&user, dataprovider.LoginMethodPassword, ipAddr, dataprovider.ErrInvalidCredentials)
+			updateLoginMetrics(r.Context(), &user, loginMethod, ipAddr, dataprovider.ErrInvalidCredentials)
 			sendAPIResponse(w, r, dataprovider.ErrInvalidCredentials, http.StatusText(http.StatusUnauthorized),
 				http.StatusUnauthorized)
 			return
 		}
 		err = user.Filters.TOTPConfig.Secret.Decrypt()
 		if err != nil {
-			updateLoginMetrics(&user, dataprovider.LoginMethodPassword, ipAddr, common.ErrInternalFailure)
+			updateLoginMetrics(r.Context(), &user, loginMethod, ipAddr, common.ErrInternalFailure)
 			sendAPIResponse(w, r, fmt.Errorf("unable to decrypt TOTP secret: %w", err), http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
@@ -858,7 +918,7 @@ func (s *httpdServer) getUserToken(w http.ResponseWriter, r *http.Request) {
 		if !match || err != nil {
 			logger.Debug(logSender, "invalid passcode for user %q, match? %v, err: %v", user.Username, match, err)
 			w.Header().Set(common.HTTPAuthenticationHeader, basicRealm)
-			updateLoginMetrics(&user, dataprovider.LoginMethodPassword, ipAddr, dataprovider.ErrInvalidCredentials)
+			updateLoginMetrics(r.Context(), &user, loginMethod, ipAddr, dataprovider.ErrInvalidCredentials)
 			sendAPIResponse(w, r, dataprovider.ErrInvalidCredentials, http.StatusText(http.StatusUnauthorized),
 				http.StatusUnauthorized)
 			return
@@ -869,15 +929,17 @@ func (s *httpdServer) getUserToken(w http.ResponseWriter, r *http.Request) {
 	err = user.CheckFsRoot(connectionID)
 	if err != nil {
 		logger.Warn(logSender, connectionID, "unable to check fs root: %v", err)
-		updateLoginMetrics(&user, dataprovider.LoginMethodPassword, ipAddr, common.ErrInternalFailure)
+		updateLoginMetrics(r.Context(), &user, loginMethod, ipAddr, common.ErrInternalFailure)
 		sendAPIResponse(w, r, err, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
-	s.generateAndSendUserToken(w, r, ipAddr, user)
+	s.generateAndSendUserToken(w, r, ipAddr, loginMethod, user)
 }
 
-func (s *httpdServer) generateAndSendUserToken(w http.ResponseWriter, r *http.Request, ipAddr string, user dataprovider.User) {
+func (s *httpdServer) generateAndSendUserToken(w http.ResponseWriter, r *http.Request, ipAddr, loginMethod string,
+	user dataprovider.User,
+) {
 	c := jwtTokenClaims{
 		Username:                   user.Username,
 		Permissions:                user.Filters.WebClient,
@@ -886,15 +948,16 @@ func (s *httpdServer) generateAndSendUserToken(w http.ResponseWriter, r *http.Re
 		MustSetTwoFactorAuth:       user.MustSetSecondFactor(),
 		MustChangePassword:         user.MustChangePassword(),
 		RequiredTwoFactorProtocols: user.Filters.TwoFactorAuthProtocols,
+		MustAcceptConsents:         common.MustAcceptConsentsForProtocol(&user, common.ProtocolHTTP),
 	}
 
 	resp, err := c.createTokenResponse(s.tokenAuth, tokenAudienceAPIUser, ipAddr)
 	if err != nil {
-		updateLoginMetrics(&user, dataprovider.LoginMethodPassword, ipAddr, common.ErrInternalFailure)
+		updateLoginMetrics(r.Context(), &user, loginMethod, ipAddr, common.ErrInternalFailure)
 		sendAPIResponse(w, r, err, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	updateLoginMetrics(&user, dataprovider.LoginMethodPassword, ipAddr, err)
+	updateLoginMetrics(r.Context(), &user, loginMethod, ipAddr, err)
 	dataprovider.UpdateLastLogin(&user)
 
 	render.JSON(w, r, resp)
@@ -947,10 +1010,13 @@ func (s *httpdServer) getToken(w http.ResponseWriter, r *http.Request) {
 
 func (s *httpdServer) generateAndSendToken(w http.ResponseWriter, r *http.Request, admin dataprovider.Admin, ip string) {
 	c := jwtTokenClaims{
-		Username:    admin.Username,
-		Permissions: admin.Permissions,
-		Role:        admin.Role,
-		Signature:   admin.GetSignature(),
+		Username:  admin.Username,
+		Role:      admin.Role,
+		Signature: admin.GetSignature(),
+	}
+	if err := c.setAdminAccessSettings(&admin); err != nil {
+		sendAPIResponse(w, r, err, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
 
 	resp, err := c.createTokenResponse(s.tokenAuth, tokenAudienceAPI, ip)
@@ -1025,7 +1091,11 @@ func (s *httpdServer) refreshAdminToken(w http.ResponseWriter, r *http.Request,
 		logger.Debug(logSender, "", "admin %q cannot login from %v, unable to refresh cookie", admin.Username, r.RemoteAddr)
 		return
 	}
-	tokenClaims.Permissions = admin.Permissions
+	if err := tokenClaims.setAdminAccessSettings(&admin); err != nil {
+		logger.Debug(logSender, "", "unable to get access settings for admin %q, unable to refresh cookie: %v",
+			admin.Username, err)
+		return
+	}
 	tokenClaims.Role = admin.Role
 	tokenClaims.HideUserPageSections = admin.Filters.Preferences.HideUserPageSections
 	logger.Debug(logSender, "", "cookie refreshed for admin %q", admin.Username)
@@ -1090,7 +1160,7 @@ func (s *httpdServer) checkConnection(next http.Handler) http.Handler {
 			s.sendForbiddenResponse(w, r, "your IP address is banned")
 			return
 		}
-		if delay, err := common.LimitRate(common.ProtocolHTTP, ipAddr); err != nil {
+		if delay, err := common.LimitHTTPRate(ipAddr, r.URL.Path); err != nil {
 			delay += 499999999 * time.Nanosecond
 			w.Header().Set("Retry-After", fmt.Sprintf("%.0f", delay.Seconds()))
 			w.Header().Set("X-Retry-In", delay.String())
@@ -1184,10 +1254,15 @@ func (s *httpdServer) initializeRouter() {
 	s.tokenAuth = jwtauth.New(jwa.HS256.String(), getSigningKey(s.signingPassphrase), nil)
 	s.router = chi.NewRouter()
 
-	s.router.Use(middleware.RequestID)
+	s.router.Use(setRequestID)
+	s.router.Use(traceRequest)
 	s.router.Use(s.checkConnection)
+	s.router.Use(captureDebugEvents)
 	s.router.Use(logger.NewStructuredLogger(logger.GetLogger()))
 	s.router.Use(middleware.Recoverer)
+	if s.binding.RequestFilter.Enabled {
+		s.router.Use(s.filterRequests)
+	}
 	if s.binding.Security.Enabled {
 		secureMiddleware := secure.New(secure.Options{
 			AllowedHosts:            s.binding.Security.AllowedHosts,
@@ -1251,7 +1326,9 @@ func (s *httpdServer) initializeRouter() {
 		s.router.Post(sharesPath+"/{id}/{name}", s.uploadFileToShare)
 		s.router.With(compressor.Handler).Get(sharesPath+"/{id}/dirs", s.readBrowsableShareContents)
 		s.router.Get(sharesPath+"/{id}/files", s.downloadBrowsableSharedFile)
+		s.router.Get(sharesPath+"/{id}/stream", s.streamBrowsableSharedFile)
 
+		s.router.Get(publicKeysPath+"/{username}", getUserPublicKeys)
 		s.router.Get(tokenPath, s.getToken)
 		s.router.Post(adminPath+"/{username}/forgot-password", forgotAdminPassword)
 		s.router.Post(adminPath+"/{username}/reset-password", resetAdminPassword)
@@ -1263,6 +1340,7 @@ func (s *httpdServer) initializeRouter() {
 			router.Use(checkAPIKeyAuth(s.tokenAuth, dataprovider.APIKeyScopeAdmin))
 			router.Use(jwtauth.Verify(s.tokenAuth, jwtauth.TokenFromHeader))
 			router.Use(jwtAuthenticatorAPI)
+			router.Use(s.limitAuthenticatedRate)
 
 			router.Get(versionPath, func(w http.ResponseWriter, r *http.Request) {
 				r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
@@ -1290,29 +1368,96 @@ func (s *httpdServer) initializeRouter() {
 			router.With(s.checkPerm(dataprovider.PermAdminViewConnections)).Get(activeConnectionsPath, getActiveConnections)
 			router.With(s.checkPerm(dataprovider.PermAdminCloseConnections)).
 				Delete(activeConnectionsPath+"/{connectionID}", handleCloseConnection)
+			router.With(s.checkPerm(dataprovider.PermAdminViewConnections)).Get(activeConnectionsPath+"/live",
+				handleLiveStats)
+			router.With(s.checkPerm(dataprovider.PermAdminCloseConnections)).
+				Delete(activeConnectionsPath+"/{connectionID}/transfers/{transferID}", handleCloseTransfer)
+			router.With(s.checkPerm(dataprovider.PermAdminCloseConnections)).
+				Put(activeConnectionsPath+"/{connectionID}/transfers/{transferID}/bandwidth", handleThrottleTransfer)
+			router.With(s.checkPerm(dataprovider.PermAdminViewConnections)).Get(sessionsPath, getWebSessions)
+			router.With(s.checkPerm(dataprovider.PermAdminCloseConnections)).
+				Delete(sessionsPath+"/{id}", handleRevokeWebSession)
+			router.With(s.checkPerm(dataprovider.PermAdminCloseConnections)).
+				Delete(userPath+"/{username}/sessions", revokeUserWebSessions)
+			router.With(s.checkPerm(dataprovider.PermAdminAdminsUpdate)).
+				Delete(adminPath+"/{username}/sessions", revokeAdminWebSessions)
+			router.With(s.checkPerm(dataprovider.PermAdminViewUsers)).Get(registrationsPath, getPendingRegistrations)
+			router.With(s.checkPerm(dataprovider.PermAdminChangeUsers)).
+				Post(registrationsPath+"/{username}/approve", approveRegistration)
+			router.With(s.checkPerm(dataprovider.PermAdminDeleteUsers)).
+				Delete(registrationsPath+"/{username}", rejectRegistration)
 			router.With(s.checkPerm(dataprovider.PermAdminQuotaScans)).Get(quotasBasePath+"/users/scans", getUsersQuotaScans)
 			router.With(s.checkPerm(dataprovider.PermAdminQuotaScans)).Post(quotasBasePath+"/users/{username}/scan", startUserQuotaScan)
 			router.With(s.checkPerm(dataprovider.PermAdminQuotaScans)).Get(quotasBasePath+"/folders/scans", getFoldersQuotaScans)
 			router.With(s.checkPerm(dataprovider.PermAdminQuotaScans)).Post(quotasBasePath+"/folders/{name}/scan", startFolderQuotaScan)
+			router.With(s.checkPerm(dataprovider.PermAdminQuotaScans)).Get(quotasBasePath+"/scheduled-scans", getScheduledQuotaScans)
+			router.With(s.checkPerm(dataprovider.PermAdminQuotaScans)).Post(quotasBasePath+"/scheduled-scans/run", startScheduledQuotaScans)
 			router.With(s.checkPerm(dataprovider.PermAdminViewUsers)).Get(userPath, getUsers)
 			router.With(s.checkPerm(dataprovider.PermAdminAddUsers)).Post(userPath, addUser)
+			router.With(s.checkPerm(dataprovider.PermAdminAddUsers)).Post(userPath+"/import", importUsers)
+			router.With(s.checkPerm(dataprovider.PermAdminChangeUsers)).Post(userPath+"/bulk", bulkUpdateUsers)
+			router.With(s.checkPerm(dataprovider.PermAdminViewUsers)).Get(userTemplatesPath, getUserTemplates)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).Post(userTemplatesPath, addUserTemplate)
+			router.With(s.checkPerm(dataprovider.PermAdminViewUsers)).Get(userTemplatesPath+"/{name}", getUserTemplateByName)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).Put(userTemplatesPath+"/{name}", updateUserTemplate)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).Delete(userTemplatesPath+"/{name}", deleteUserTemplate)
+			router.With(s.checkPerm(dataprovider.PermAdminAddUsers)).Post(userTemplatesPath+"/{name}/provision", provisionUser)
 			router.With(s.checkPerm(dataprovider.PermAdminViewUsers)).Get(userPath+"/{username}", getUserByUsername)
 			router.With(s.checkPerm(dataprovider.PermAdminChangeUsers)).Put(userPath+"/{username}", updateUser)
 			router.With(s.checkPerm(dataprovider.PermAdminDeleteUsers)).Delete(userPath+"/{username}", deleteUser)
 			router.With(s.checkPerm(dataprovider.PermAdminChangeUsers)).Put(userPath+"/{username}/2fa/disable", disableUser2FA)
-			router.With(s.checkPerm(dataprovider.PermAdminViewUsers)).Get(folderPath, getFolders)
-			router.With(s.checkPerm(dataprovider.PermAdminViewUsers)).Get(folderPath+"/{name}", getFolderByName)
-			router.With(s.checkPerm(dataprovider.PermAdminAddUsers)).Post(folderPath, addFolder)
-			router.With(s.checkPerm(dataprovider.PermAdminChangeUsers)).Put(folderPath+"/{name}", updateFolder)
-			router.With(s.checkPerm(dataprovider.PermAdminDeleteUsers)).Delete(folderPath+"/{name}", deleteFolder)
-			router.With(s.checkPerm(dataprovider.PermAdminManageGroups)).Get(groupPath, getGroups)
-			router.With(s.checkPerm(dataprovider.PermAdminManageGroups)).Get(groupPath+"/{name}", getGroupByName)
-			router.With(s.checkPerm(dataprovider.PermAdminManageGroups)).Post(groupPath, addGroup)
-			router.With(s.checkPerm(dataprovider.PermAdminManageGroups)).Put(groupPath+"/{name}", updateGroup)
-			router.With(s.checkPerm(dataprovider.PermAdminManageGroups)).Delete(groupPath+"/{name}", deleteGroup)
+			router.With(s.checkPerm(dataprovider.PermAdminViewUsers)).Get(userPath+"/{username}/consents", getUserConsents)
+			router.With(s.checkPerm(dataprovider.PermAdminChangeUsers)).
+				Post(userPath+"/{username}/consents/link", generateUserConsentLink)
+			router.With(s.checkPerm(dataprovider.PermAdminViewUsers)).Get(userPath+"/{username}/staging", getUserStagedItems)
+			router.With(s.checkPerm(dataprovider.PermAdminChangeUsers)).
+				Post(userPath+"/{username}/staging/{id}/approve", approveStagedItem)
+			router.With(s.checkPerm(dataprovider.PermAdminChangeUsers)).
+				Post(userPath+"/{username}/staging/{id}/reject", rejectStagedItem)
+			router.With(s.checkPerm(dataprovider.PermAdminFoldersRead)).Get(folderPath, getFolders)
+			router.With(s.checkPerm(dataprovider.PermAdminFoldersRead)).Get(folderPath+"/{name}", getFolderByName)
+			router.With(s.checkPerm(dataprovider.PermAdminFoldersCreate)).Post(folderPath, addFolder)
+			router.With(s.checkPerm(dataprovider.PermAdminFoldersUpdate)).Post(folderPath+"/bulk", bulkUpdateFolders)
+			router.With(s.checkPerm(dataprovider.PermAdminFoldersUpdate)).Put(folderPath+"/{name}", updateFolder)
+			router.With(s.checkPerm(dataprovider.PermAdminFoldersDelete)).Delete(folderPath+"/{name}", deleteFolder)
+			router.With(s.checkPerm(dataprovider.PermAdminFoldersRead)).Get(folderPath+"/{name}/failover", getFolderFailoverStatus)
+			router.With(s.checkPerm(dataprovider.PermAdminFoldersUpdate)).Post(folderPath+"/{name}/failover/reconcile",
+				reconcileFolderFailover)
+			router.With(s.checkPerm(dataprovider.PermAdminGroupsRead)).Get(groupPath, getGroups)
+			router.With(s.checkPerm(dataprovider.PermAdminGroupsRead)).Get(groupPath+"/{name}", getGroupByName)
+			router.With(s.checkPerm(dataprovider.PermAdminGroupsCreate)).Post(groupPath, addGroup)
+			router.With(s.checkPerm(dataprovider.PermAdminGroupsUpdate)).Put(groupPath+"/{name}", updateGroup)
+			router.With(s.checkPerm(dataprovider.PermAdminGroupsDelete)).Delete(groupPath+"/{name}", deleteGroup)
 			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).Get(dumpDataPath, dumpData)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).Get(runtimeConfigPath, getRuntimeConfig)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).Get(ftpDiagnosticsPath, getFTPDiagnostics)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).Delete(ftpDiagnosticsPath, clearFTPDiagnostics)
 			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).Get(loadDataPath, loadData)
 			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).Post(loadDataPath, loadDataFromRequest)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).Get(snapshotsPath+"/{type}/{name}",
+				getConfigSnapshots)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).Get(snapshotsPath+"/{type}/{name}/{id}",
+				getConfigSnapshotByID)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).Post(snapshotsPath+"/{type}/{name}/rollback",
+				rollbackConfigSnapshot)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).Get(debugCapturesPath, getDebugCaptures)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).Post(debugCapturesPath, startDebugCapture)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).Get(debugCapturesPath+"/{id}", getDebugCapture)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).
+				Delete(debugCapturesPath+"/{id}", deleteDebugCapture)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).
+				Post(debugCapturesPath+"/{id}/stop", stopDebugCapture)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).
+				Get(debugCapturesPath+"/{id}/bundle", getDebugCaptureBundle)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).Get(hostKeysPath, getSSHHostKeys)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).Post(hostKeysPath, addSSHHostKey)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).Get(hostKeysPath+"/{id}", getSSHHostKeyByID)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).Put(hostKeysPath+"/{id}", updateSSHHostKey)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).Delete(hostKeysPath+"/{id}", deleteSSHHostKey)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).
+				Post(hostKeysPath+"/{id}/rotate", rotateSSHHostKey)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).Get(sshSecurityProfilePath, getSSHSecurityProfile)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).Put(sshSecurityProfilePath, updateSSHSecurityProfile)
 			router.With(s.checkPerm(dataprovider.PermAdminChangeUsers)).Put(quotasBasePath+"/users/{username}/usage",
 				updateUserQuotaUsage)
 			router.With(s.checkPerm(dataprovider.PermAdminChangeUsers)).Put(quotasBasePath+"/users/{username}/transfer-usage",
@@ -1321,16 +1466,40 @@ func (s *httpdServer) initializeRouter() {
 				updateFolderQuotaUsage)
 			router.With(s.checkPerm(dataprovider.PermAdminViewDefender)).Get(defenderHosts, getDefenderHosts)
 			router.With(s.checkPerm(dataprovider.PermAdminViewDefender)).Get(defenderHosts+"/{id}", getDefenderHostByID)
+			router.With(s.checkPerm(dataprovider.PermAdminViewDefender)).Get(defenderHosts+"/{id}/status", getDefenderHostStatusByID)
 			router.With(s.checkPerm(dataprovider.PermAdminManageDefender)).Delete(defenderHosts+"/{id}", deleteDefenderHostByID)
-			router.With(s.checkPerm(dataprovider.PermAdminManageAdmins)).Get(adminPath, getAdmins)
-			router.With(s.checkPerm(dataprovider.PermAdminManageAdmins)).Post(adminPath, addAdmin)
-			router.With(s.checkPerm(dataprovider.PermAdminManageAdmins)).Get(adminPath+"/{username}", getAdminByUsername)
-			router.With(s.checkPerm(dataprovider.PermAdminManageAdmins)).Put(adminPath+"/{username}", updateAdmin)
-			router.With(s.checkPerm(dataprovider.PermAdminManageAdmins)).Delete(adminPath+"/{username}", deleteAdmin)
-			router.With(s.checkPerm(dataprovider.PermAdminManageAdmins)).Put(adminPath+"/{username}/2fa/disable", disableAdmin2FA)
+			router.With(s.checkPerm(dataprovider.PermAdminAdminsRead)).Get(adminPath, getAdmins)
+			router.With(s.checkPerm(dataprovider.PermAdminAdminsCreate)).Post(adminPath, addAdmin)
+			router.With(s.checkPerm(dataprovider.PermAdminAdminsRead)).Get(adminPath+"/{username}", getAdminByUsername)
+			router.With(s.checkPerm(dataprovider.PermAdminAdminsUpdate)).Put(adminPath+"/{username}", updateAdmin)
+			router.With(s.checkPerm(dataprovider.PermAdminAdminsDelete)).Delete(adminPath+"/{username}", deleteAdmin)
+			router.With(s.checkPerm(dataprovider.PermAdminAdminsUpdate)).Put(adminPath+"/{username}/2fa/disable", disableAdmin2FA)
 			router.With(s.checkPerm(dataprovider.PermAdminRetentionChecks)).Get(retentionChecksPath, getRetentionChecks)
 			router.With(s.checkPerm(dataprovider.PermAdminRetentionChecks)).Post(retentionBasePath+"/{username}/check",
 				startRetentionCheck)
+			router.With(s.checkPerm(dataprovider.PermAdminRetentionChecks)).Get(retentionPoliciesPath, getRetentionPolicies)
+			router.With(s.checkPerm(dataprovider.PermAdminRetentionChecks)).Post(retentionPoliciesPath, addRetentionPolicy)
+			router.With(s.checkPerm(dataprovider.PermAdminRetentionChecks)).Get(retentionPoliciesPath+"/{name}",
+				getRetentionPolicyByName)
+			router.With(s.checkPerm(dataprovider.PermAdminRetentionChecks)).Put(retentionPoliciesPath+"/{name}",
+				updateRetentionPolicy)
+			router.With(s.checkPerm(dataprovider.PermAdminRetentionChecks)).Delete(retentionPoliciesPath+"/{name}",
+				deleteRetentionPolicy)
+			router.With(s.checkPerm(dataprovider.PermAdminRetentionChecks)).Post(retentionPoliciesPath+"/{name}/run",
+				runRetentionPolicy)
+			router.With(s.checkPerm(dataprovider.PermAdminRetentionChecks)).Get(retentionPoliciesPath+"/{name}/report",
+				getRetentionPolicyReport)
+			router.Get(jobsPath, getJobs)
+			router.Post(jobsPath, startJob)
+			router.Get(jobsPath+"/{id}", getJob)
+			router.Delete(jobsPath+"/{id}", deleteJob)
+			if s.binding.EnableGraphQL {
+				router.Get(graphQLPath, handleGraphQL)
+				router.Post(graphQLPath, handleGraphQL)
+			}
+			router.With(s.checkPerm(dataprovider.PermAdminViewUsers)).Get(analyticsHeatmapPath, getAccessHeatmap)
+			router.With(s.checkPerm(dataprovider.PermAdminViewUsers)).Get(analyticsStoragePath+"/{username}",
+				getStorageReport)
 			router.With(s.checkPerm(dataprovider.PermAdminMetadataChecks)).Get(metadataChecksPath, getMetadataChecks)
 			router.With(s.checkPerm(dataprovider.PermAdminMetadataChecks)).Post(metadataBasePath+"/{username}/check",
 				startMetadataCheck)
@@ -1340,37 +1509,46 @@ func (s *httpdServer) initializeRouter() {
 				Get(providerEventsPath, searchProviderEvents)
 			router.With(s.checkPerm(dataprovider.PermAdminViewEvents), compressor.Handler).
 				Get(logEventsPath, searchLogEvents)
-			router.With(forbidAPIKeyAuthentication, s.checkPerm(dataprovider.PermAdminManageAPIKeys)).
+			router.With(s.checkPerm(dataprovider.PermAdminViewEvents), compressor.Handler).
+				Get(auditLogPath, searchAuditLog)
+			router.With(forbidAPIKeyAuthentication, s.checkPerm(dataprovider.PermAdminAPIKeysRead)).
 				Get(apiKeysPath, getAPIKeys)
-			router.With(forbidAPIKeyAuthentication, s.checkPerm(dataprovider.PermAdminManageAPIKeys)).
+			router.With(forbidAPIKeyAuthentication, s.checkPerm(dataprovider.PermAdminAPIKeysCreate)).
 				Post(apiKeysPath, addAPIKey)
-			router.With(forbidAPIKeyAuthentication, s.checkPerm(dataprovider.PermAdminManageAPIKeys)).
+			router.With(forbidAPIKeyAuthentication, s.checkPerm(dataprovider.PermAdminAPIKeysRead)).
 				Get(apiKeysPath+"/{id}", getAPIKeyByID)
-			router.With(forbidAPIKeyAuthentication, s.checkPerm(dataprovider.PermAdminManageAPIKeys)).
+			router.With(forbidAPIKeyAuthentication, s.checkPerm(dataprovider.PermAdminAPIKeysUpdate)).
 				Put(apiKeysPath+"/{id}", updateAPIKey)
-			router.With(forbidAPIKeyAuthentication, s.checkPerm(dataprovider.PermAdminManageAPIKeys)).
+			router.With(forbidAPIKeyAuthentication, s.checkPerm(dataprovider.PermAdminAPIKeysUpdate)).
+				Post(apiKeysPath+"/{id}/rotate", rotateAPIKey)
+			router.With(forbidAPIKeyAuthentication, s.checkPerm(dataprovider.PermAdminAPIKeysDelete)).
 				Delete(apiKeysPath+"/{id}", deleteAPIKey)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules)).Get(eventActionsPath, getEventActions)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules)).Get(eventActionsPath+"/{name}", getEventActionByName)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules)).Post(eventActionsPath, addEventAction)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules)).Put(eventActionsPath+"/{name}", updateEventAction)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules)).Delete(eventActionsPath+"/{name}", deleteEventAction)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules)).Get(eventRulesPath, getEventRules)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules)).Get(eventRulesPath+"/{name}", getEventRuleByName)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules)).Post(eventRulesPath, addEventRule)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules)).Put(eventRulesPath+"/{name}", updateEventRule)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules)).Delete(eventRulesPath+"/{name}", deleteEventRule)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules)).Post(eventRulesPath+"/run/{name}", runOnDemandRule)
-			router.With(s.checkPerm(dataprovider.PermAdminManageRoles)).Get(rolesPath, getRoles)
-			router.With(s.checkPerm(dataprovider.PermAdminManageRoles)).Post(rolesPath, addRole)
-			router.With(s.checkPerm(dataprovider.PermAdminManageRoles)).Get(rolesPath+"/{name}", getRoleByName)
-			router.With(s.checkPerm(dataprovider.PermAdminManageRoles)).Put(rolesPath+"/{name}", updateRole)
-			router.With(s.checkPerm(dataprovider.PermAdminManageRoles)).Delete(rolesPath+"/{name}", deleteRole)
-			router.With(s.checkPerm(dataprovider.PermAdminManageIPLists), compressor.Handler).Get(ipListsPath+"/{type}", getIPListEntries)
-			router.With(s.checkPerm(dataprovider.PermAdminManageIPLists)).Post(ipListsPath+"/{type}", addIPListEntry)
-			router.With(s.checkPerm(dataprovider.PermAdminManageIPLists)).Get(ipListsPath+"/{type}/{ipornet}", getIPListEntry)
-			router.With(s.checkPerm(dataprovider.PermAdminManageIPLists)).Put(ipListsPath+"/{type}/{ipornet}", updateIPListEntry)
-			router.With(s.checkPerm(dataprovider.PermAdminManageIPLists)).Delete(ipListsPath+"/{type}/{ipornet}", deleteIPListEntry)
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesRead)).Get(eventActionsPath, getEventActions)
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesRead)).Get(eventActionsPath+"/{name}", getEventActionByName)
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesCreate)).Post(eventActionsPath, addEventAction)
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesUpdate)).Put(eventActionsPath+"/{name}", updateEventAction)
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesDelete)).Delete(eventActionsPath+"/{name}", deleteEventAction)
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesRead)).Get(eventRulesPath, getEventRules)
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesRead)).Get(eventRulesPath+"/{name}", getEventRuleByName)
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesCreate)).Post(eventRulesPath, addEventRule)
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesUpdate)).Put(eventRulesPath+"/{name}", updateEventRule)
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesDelete)).Delete(eventRulesPath+"/{name}", deleteEventRule)
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesUpdate)).Post(eventRulesPath+"/run/{name}", runOnDemandRule)
+			router.With(s.checkPerm(dataprovider.PermAdminRolesRead)).Get(rolesPath, getRoles)
+			router.With(s.checkPerm(dataprovider.PermAdminRolesCreate)).Post(rolesPath, addRole)
+			router.With(s.checkPerm(dataprovider.PermAdminRolesRead)).Get(rolesPath+"/{name}", getRoleByName)
+			router.With(s.checkPerm(dataprovider.PermAdminRolesUpdate)).Put(rolesPath+"/{name}", updateRole)
+			router.With(s.checkPerm(dataprovider.PermAdminRolesDelete)).Delete(rolesPath+"/{name}", deleteRole)
+			router.With(s.checkPerm(dataprovider.PermAdminAdminRolesRead)).Get(adminRolesPath, getAdminRoles)
+			router.With(s.checkPerm(dataprovider.PermAdminAdminRolesCreate)).Post(adminRolesPath, addAdminRole)
+			router.With(s.checkPerm(dataprovider.PermAdminAdminRolesRead)).Get(adminRolesPath+"/{name}", getAdminRoleByName)
+			router.With(s.checkPerm(dataprovider.PermAdminAdminRolesUpdate)).Put(adminRolesPath+"/{name}", updateAdminRole)
+			router.With(s.checkPerm(dataprovider.PermAdminAdminRolesDelete)).Delete(adminRolesPath+"/{name}", deleteAdminRole)
+			router.With(s.checkPerm(dataprovider.PermAdminIPListsRead), compressor.Handler).Get(ipListsPath+"/{type}", getIPListEntries)
+			router.With(s.checkPerm(dataprovider.PermAdminIPListsCreate)).Post(ipListsPath+"/{type}", addIPListEntry)
+			router.With(s.checkPerm(dataprovider.PermAdminIPListsRead)).Get(ipListsPath+"/{type}/{ipornet}", getIPListEntry)
+			router.With(s.checkPerm(dataprovider.PermAdminIPListsUpdate)).Put(ipListsPath+"/{type}/{ipornet}", updateIPListEntry)
+			router.With(s.checkPerm(dataprovider.PermAdminIPListsDelete)).Delete(ipListsPath+"/{type}/{ipornet}", deleteIPListEntry)
 		})
 
 		s.router.Get(userTokenPath, s.getUserToken)
@@ -1380,12 +1558,16 @@ func (s *httpdServer) initializeRouter() {
 			// Query is put before header due to only office server sending its token in the header
 			router.Use(jwtauth.Verify(s.tokenAuth, jwtauth.TokenFromQuery, jwtauth.TokenFromHeader))
 			router.Use(jwtAuthenticatorAPIUser)
+			router.Use(s.limitAuthenticatedRate)
 
 			router.With(forbidAPIKeyAuthentication).Get(userLogoutPath, s.logout)
 			router.With(forbidAPIKeyAuthentication, s.checkHTTPUserPerm(sdk.WebClientPasswordChangeDisabled)).
 				Put(userPwdPath, changeUserPassword)
 			router.With(forbidAPIKeyAuthentication).Get(userProfilePath, getUserProfile)
 			router.With(forbidAPIKeyAuthentication, s.checkAuthRequirements).Put(userProfilePath, updateUserProfile)
+			router.With(forbidAPIKeyAuthentication, s.checkUserWebhooksEnabled).Get(userWebhooksPath, getUserWebhooks)
+			router.With(forbidAPIKeyAuthentication, s.checkAuthRequirements, s.checkUserWebhooksEnabled).
+				Put(userWebhooksPath, updateUserWebhooks)
 			// user TOTP APIs
 			router.With(forbidAPIKeyAuthentication, s.checkHTTPUserPerm(sdk.WebClientMFADisabled)).
 				Get(userTOTPConfigsPath, getTOTPConfigs)
@@ -1408,6 +1590,7 @@ func (s *httpdServer) initializeRouter() {
 			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientWriteDisabled)).
 				Delete(userDirsPath, deleteUserDir)
 			router.With(s.checkAuthRequirements).Get(userFilesPath, getUserFile)
+			router.With(s.checkAuthRequirements).Get(userFilesChecksumPath, getUserFileChecksum)
 			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientWriteDisabled)).
 				Post(userFilesPath, uploadUserFiles)
 			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientWriteDisabled)).
@@ -1418,7 +1601,46 @@ func (s *httpdServer) initializeRouter() {
 				Post(userFileActionsPath+"/move", renameUserFsEntry)
 			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientWriteDisabled)).
 				Post(userFileActionsPath+"/copy", copyUserFsEntry)
+			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientWriteDisabled)).
+				Post(userFileActionsPath+"/extract", extractUserArchive)
+			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientWriteDisabled)).
+				Post(userFileOperationsPath, startUserFileOperation)
+			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientWriteDisabled)).
+				Post(userCopyPath, startUserCopy)
+			router.With(s.checkAuthRequirements).Get(userFileOperationsPath, getUserFileOperations)
+			router.With(s.checkAuthRequirements).Get(userFileOperationsPath+"/{id}", getUserFileOperation)
+			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientWriteDisabled)).
+				Post(userPullJobsPath, startUserPullJob)
+			router.With(s.checkAuthRequirements).Get(userPullJobsPath, getUserPullJobs)
+			router.With(s.checkAuthRequirements).Get(userPullJobsPath+"/{id}", getUserPullJob)
+			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientWriteDisabled)).
+				Delete(userPullJobsPath+"/{id}", cancelUserPullJob)
+			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientWriteDisabled)).
+				Post(userStagingTxPath, startUserStagingTx)
+			router.With(s.checkAuthRequirements).Get(userStagingTxPath, getUserStagingTxs)
+			router.With(s.checkAuthRequirements).Get(userStagingTxPath+"/{id}", getUserStagingTx)
+			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientWriteDisabled)).
+				Post(userStagingTxPath+"/{id}/upload", uploadUserStagingTxFile)
+			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientWriteDisabled)).
+				Post(userStagingTxPath+"/{id}/commit", commitUserStagingTx)
+			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientWriteDisabled)).
+				Delete(userStagingTxPath+"/{id}", abortUserStagingTx)
+			router.With(s.checkAuthRequirements).Post(userArchiveJobsPath, startUserArchiveJob)
+			router.With(s.checkAuthRequirements).Get(userArchiveJobsPath, getUserArchiveJobs)
+			router.With(s.checkAuthRequirements).Get(userArchiveJobsPath+"/{id}", getUserArchiveJob)
+			router.With(s.checkAuthRequirements).Get(userArchiveJobsPath+"/{id}/download", downloadUserArchive)
+			router.With(s.checkAuthRequirements).Delete(userArchiveJobsPath+"/{id}", deleteUserArchiveJob)
+			router.With(s.checkAuthRequirements).Get(userThumbnailsPath, getUserThumbnail)
+			router.With(s.checkAuthRequirements).Get(userStreamPath, getUserMediaStream)
+			router.With(s.checkAuthRequirements).Get(userFilesMetadataPath, getUserFileMetadata)
+			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientWriteDisabled)).
+				Put(userFilesMetadataPath, setUserFileMetadata)
+			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientWriteDisabled)).
+				Delete(userFilesMetadataPath, deleteUserFileMetadata)
+			router.With(s.checkAuthRequirements).Get(userFilesMetadataPath+"/search", searchUserFilesMetadata)
 			router.With(s.checkAuthRequirements).Post(userStreamZipPath, getUserFilesAsZipStream)
+			router.With(s.checkAuthRequirements).Get(userWebSocketPath, handleUserWebSocket)
+			router.With(s.checkAuthRequirements, compressor.Handler).Get(userSearchPath, searchUserFiles)
 			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientSharesDisabled)).
 				Get(userSharesPath, getShares)
 			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientSharesDisabled)).
@@ -1429,8 +1651,14 @@ func (s *httpdServer) initializeRouter() {
 				Put(userSharesPath+"/{id}", updateShare)
 			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientSharesDisabled)).
 				Delete(userSharesPath+"/{id}", deleteShare)
+			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientSharesDisabled)).
+				Get(userSharesPath+"/{id}/stats", getShareStats)
 			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientWriteDisabled)).
 				Post(userUploadFilePath, uploadUserFile)
+			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientWriteDisabled)).
+				Patch(userUploadFilePath, resumeUserFileUpload)
+			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientWriteDisabled)).
+				Head(userUploadFilePath, getUserUploadOffset)
 			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientWriteDisabled)).
 				Patch(userFilesDirsMetadataPath, setFileDirMetadata)
 			router.With(s.checkAuthRequirements).Post(onlyOfficeCallbackPath, s.onlyOfficeWriteCallback)
@@ -1449,9 +1677,13 @@ func (s *httpdServer) initializeRouter() {
 			router.Use(compressor.Handler)
 			serveStaticDir(router, webStaticFilesPath, s.staticFilesPath, true)
 		})
-		if s.binding.OIDC.isEnabled() {
+		if s.binding.OIDC.isEnabled() || s.enableWebClient {
 			s.router.Get(webOIDCRedirectPath, s.handleOIDCRedirect)
 		}
+		if s.binding.SAML.isEnabled() {
+			s.router.Get(webSAMLMetadataPath, s.handleSAMLMetadata)
+			s.router.Post(webSAMLACSPath, s.handleSAMLACS)
+		}
 		if s.enableWebClient {
 			s.router.Get(webRootPath, func(w http.ResponseWriter, r *http.Request) {
 				r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
@@ -1484,15 +1716,22 @@ func (s *httpdServer) setupWebClientRoutes() {
 			http.Redirect(w, r, webClientLoginPath, http.StatusFound)
 		})
 		s.router.Get(webClientLoginPath, s.handleClientWebLogin)
-		if s.binding.OIDC.isEnabled() && !s.binding.isWebClientOIDCLoginDisabled() {
+		if !s.binding.isWebClientOIDCLoginDisabled() {
 			s.router.Get(webClientOIDCLoginPath, s.handleWebClientOIDCLogin)
 		}
+		if s.binding.SAML.isEnabled() && !s.binding.isWebClientOIDCLoginDisabled() {
+			s.router.Get(webClientSAMLLoginPath, s.handleWebClientSAMLLogin)
+		}
 		if !s.binding.isWebClientLoginFormDisabled() {
 			s.router.Post(webClientLoginPath, s.handleWebClientLoginPost)
 			s.router.Get(webClientForgotPwdPath, s.handleWebClientForgotPwd)
 			s.router.Post(webClientForgotPwdPath, s.handleWebClientForgotPwdPost)
 			s.router.Get(webClientResetPwdPath, s.handleWebClientPasswordReset)
 			s.router.Post(webClientResetPwdPath, s.handleWebClientPasswordResetPost)
+			if registrationConfig.Enabled {
+				s.router.Get(webClientSignUpPath, s.handleWebClientSignUp)
+				s.router.Post(webClientSignUpPath, s.handleWebClientSignUpPost)
+			}
 			s.router.With(jwtauth.Verify(s.tokenAuth, jwtauth.TokenFromCookie),
 				s.jwtAuthenticatorPartial(tokenAudienceWebClientPartial)).
 				Get(webClientTwoFactorPath, s.handleWebClientTwoFactor)
@@ -1512,19 +1751,25 @@ func (s *httpdServer) setupWebClientRoutes() {
 		s.router.Get(webClientPubSharesPath+"/{id}", s.downloadFromShare)
 		s.router.Get(webClientPubSharesPath+"/{id}/partial", s.handleClientSharePartialDownload)
 		s.router.Get(webClientPubSharesPath+"/{id}/browse", s.handleShareGetFiles)
+		s.router.Get(webClientPubSharesPath+"/{id}/player", s.handleSharePlayer)
+		s.router.Get(webClientPubSharesPath+"/{id}/stream", s.streamBrowsableSharedFile)
 		s.router.Get(webClientPubSharesPath+"/{id}/upload", s.handleClientUploadToShare)
 		s.router.With(compressor.Handler).Get(webClientPubSharesPath+"/{id}/dirs", s.handleShareGetDirContents)
 		s.router.Post(webClientPubSharesPath+"/{id}", s.uploadFilesToShare)
 		s.router.Post(webClientPubSharesPath+"/{id}/{name}", s.uploadFileToShare)
+		// consent links for users who cannot login to the WebClient
+		s.router.Get(webClientConsentLinkPath+"/{code}", s.handleClientConsentLinkGet)
+		s.router.Post(webClientConsentLinkPath+"/{code}", s.handleClientConsentLinkPost)
 
 		s.router.Group(func(router chi.Router) {
-			if s.binding.OIDC.isEnabled() {
-				router.Use(s.oidcTokenAuthenticator(tokenAudienceWebClient))
-			}
+			router.Use(s.oidcTokenAuthenticator(tokenAudienceWebClient))
 			router.Use(jwtauth.Verify(s.tokenAuth, tokenFromContext, jwtauth.TokenFromCookie))
 			router.Use(jwtAuthenticatorWebClient)
+			router.Use(s.limitAuthenticatedRate)
 
 			router.Get(webClientLogoutPath, s.handleWebClientLogout)
+			router.Get(webClientConsentsPath, s.handleClientGetConsents)
+			router.Post(webClientConsentsPath, s.handleWebClientConsentsPost)
 			router.With(s.checkAuthRequirements, s.refreshCookie).Get(webClientFilesPath, s.handleClientGetFiles)
 			router.With(s.checkAuthRequirements, s.refreshCookie).Get(webClientViewPDFPath, s.handleClientViewPDF)
 			router.With(s.checkAuthRequirements, s.refreshCookie).Get(webClientGetPDFPath, s.handleClientGetPDF)
@@ -1536,6 +1781,8 @@ func (s *httpdServer) setupWebClientRoutes() {
 				Delete(webClientFilesPath, deleteUserFile)
 			router.With(s.checkAuthRequirements, compressor.Handler, s.refreshCookie).
 				Get(webClientDirsPath, s.handleClientGetDirContents)
+			router.With(s.checkAuthRequirements, compressor.Handler, s.refreshCookie).
+				Get(webClientSearchPath, searchUserFiles)
 			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientWriteDisabled), verifyCSRFHeader).
 				Post(webClientDirsPath, createUserDir)
 			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientWriteDisabled), verifyCSRFHeader).
@@ -1546,9 +1793,21 @@ func (s *httpdServer) setupWebClientRoutes() {
 				Post(webClientFileActionsPath+"/copy", copyUserFsEntry)
 			router.With(s.checkAuthRequirements, s.refreshCookie).
 				Get(webClientDownloadZipPath, s.handleWebClientDownloadZip)
+			router.With(s.checkAuthRequirements, verifyCSRFHeader).Post(webClientArchiveJobsPath, startUserArchiveJob)
+			router.With(s.checkAuthRequirements, verifyCSRFHeader).Get(webClientArchiveJobsPath, getUserArchiveJobs)
+			router.With(s.checkAuthRequirements, s.refreshCookie).
+				Get(webClientArchiveJobsPath+"/{id}/download", downloadUserArchive)
+			router.With(s.checkAuthRequirements, verifyCSRFHeader).
+				Delete(webClientArchiveJobsPath+"/{id}", deleteUserArchiveJob)
+			router.With(s.checkAuthRequirements, s.refreshCookie).Get(webClientThumbnailsPath, getUserThumbnail)
+			router.With(s.checkAuthRequirements, s.refreshCookie).Get(webClientStreamPath, getUserMediaStream)
 			router.With(s.checkAuthRequirements, s.refreshCookie).Get(webClientProfilePath,
 				s.handleClientGetProfile)
 			router.With(s.checkAuthRequirements).Post(webClientProfilePath, s.handleWebClientProfilePost)
+			router.With(s.checkAuthRequirements, s.checkUserWebhooksEnabled, s.refreshCookie).
+				Get(webClientWebhooksPath, s.handleClientGetWebhooks)
+			router.With(s.checkAuthRequirements, s.checkUserWebhooksEnabled).
+				Post(webClientWebhooksPath, s.handleWebClientWebhooksPost)
 			router.With(s.checkHTTPUserPerm(sdk.WebClientPasswordChangeDisabled)).
 				Get(webChangeClientPwdPath, s.handleWebClientChangePwd)
 			router.With(s.checkHTTPUserPerm(sdk.WebClientPasswordChangeDisabled)).
@@ -1573,6 +1832,8 @@ func (s *httpdServer) setupWebClientRoutes() {
 				Post(webClientSharePath, s.handleClientAddSharePost)
 			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientSharesDisabled), s.refreshCookie).
 				Get(webClientSharePath+"/{id}", s.handleClientUpdateShareGet)
+			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientSharesDisabled), s.refreshCookie).
+				Get(webClientSharePath+"/{id}/stats", s.handleClientShareStats)
 			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientSharesDisabled)).
 				Post(webClientSharePath+"/{id}", s.handleClientUpdateSharePost)
 			router.With(s.checkAuthRequirements, s.checkHTTPUserPerm(sdk.WebClientSharesDisabled), verifyCSRFHeader).
@@ -1591,6 +1852,9 @@ func (s *httpdServer) setupWebAdminRoutes() {
 		if s.binding.OIDC.hasRoles() && !s.binding.isWebAdminOIDCLoginDisabled() {
 			s.router.Get(webAdminOIDCLoginPath, s.handleWebAdminOIDCLogin)
 		}
+		if s.binding.SAML.hasRoles() && !s.binding.isWebAdminOIDCLoginDisabled() {
+			s.router.Get(webAdminSAMLLoginPath, s.handleWebAdminSAMLLogin)
+		}
 		s.router.Get(webOAuth2RedirectPath, s.handleOAuth2TokenRedirect)
 		s.router.Get(webAdminSetupPath, s.handleWebAdminSetupGet)
 		s.router.Post(webAdminSetupPath, s.handleWebAdminSetupPost)
@@ -1620,6 +1884,7 @@ func (s *httpdServer) setupWebAdminRoutes() {
 			}
 			router.Use(jwtauth.Verify(s.tokenAuth, tokenFromContext, jwtauth.TokenFromCookie))
 			router.Use(jwtAuthenticatorWebAdmin)
+			router.Use(s.limitAuthenticatedRate)
 
 			router.Get(webLogoutPath, s.handleWebAdminLogout)
 			router.With(s.refreshCookie, s.requireBuiltinLogin).Get(webAdminProfilePath, s.handleWebAdminProfile)
@@ -1644,44 +1909,70 @@ func (s *httpdServer) setupWebAdminRoutes() {
 			router.With(s.checkPerm(dataprovider.PermAdminAddUsers)).Post(webUserPath, s.handleWebAddUserPost)
 			router.With(s.checkPerm(dataprovider.PermAdminChangeUsers)).Post(webUserPath+"/{username}",
 				s.handleWebUpdateUserPost)
-			router.With(s.checkPerm(dataprovider.PermAdminManageGroups), s.refreshCookie).
+			router.With(s.checkPerm(dataprovider.PermAdminGroupsRead), s.refreshCookie).
 				Get(webGroupsPath, s.handleWebGetGroups)
-			router.With(s.checkPerm(dataprovider.PermAdminManageGroups), s.refreshCookie).
+			router.With(s.checkPerm(dataprovider.PermAdminGroupsCreate), s.refreshCookie).
 				Get(webGroupPath, s.handleWebAddGroupGet)
-			router.With(s.checkPerm(dataprovider.PermAdminManageGroups)).Post(webGroupPath, s.handleWebAddGroupPost)
-			router.With(s.checkPerm(dataprovider.PermAdminManageGroups), s.refreshCookie).
+			router.With(s.checkPerm(dataprovider.PermAdminGroupsCreate)).Post(webGroupPath, s.handleWebAddGroupPost)
+			router.With(s.checkPerm(dataprovider.PermAdminGroupsUpdate), s.refreshCookie).
 				Get(webGroupPath+"/{name}", s.handleWebUpdateGroupGet)
-			router.With(s.checkPerm(dataprovider.PermAdminManageGroups)).Post(webGroupPath+"/{name}",
+			router.With(s.checkPerm(dataprovider.PermAdminGroupsUpdate)).Post(webGroupPath+"/{name}",
 				s.handleWebUpdateGroupPost)
-			router.With(s.checkPerm(dataprovider.PermAdminManageGroups), verifyCSRFHeader).
+			router.With(s.checkPerm(dataprovider.PermAdminGroupsDelete), verifyCSRFHeader).
 				Delete(webGroupPath+"/{name}", deleteGroup)
 			router.With(s.checkPerm(dataprovider.PermAdminViewConnections), s.refreshCookie).
 				Get(webConnectionsPath, s.handleWebGetConnections)
-			router.With(s.checkPerm(dataprovider.PermAdminViewUsers), s.refreshCookie).
+			router.With(s.checkPerm(dataprovider.PermAdminViewConnections), s.refreshCookie).
+				Get(webDashboardPath, s.handleWebGetDashboard)
+			router.With(s.checkPerm(dataprovider.PermAdminViewConnections)).
+				Get(webDashboardPath+"/stats", handleLiveStats)
+			router.With(s.checkPerm(dataprovider.PermAdminViewConnections), s.refreshCookie).
+				Get(webSessionsPath, s.handleWebGetSessions)
+			if registrationConfig.Enabled {
+				router.With(s.checkPerm(dataprovider.PermAdminViewUsers), s.refreshCookie).
+					Get(webRegistrationsPath, s.handleWebGetRegistrations)
+				router.With(s.checkPerm(dataprovider.PermAdminChangeUsers), verifyCSRFHeader).
+					Post(webRegistrationsPath+"/{username}/approve", approveRegistration)
+				router.With(s.checkPerm(dataprovider.PermAdminDeleteUsers), verifyCSRFHeader).
+					Delete(webRegistrationsPath+"/{username}", rejectRegistration)
+			}
+			router.With(s.checkPerm(dataprovider.PermAdminFoldersRead), s.refreshCookie).
 				Get(webFoldersPath, s.handleWebGetFolders)
-			router.With(s.checkPerm(dataprovider.PermAdminAddUsers), s.refreshCookie).
+			router.With(s.checkPerm(dataprovider.PermAdminFoldersCreate), s.refreshCookie).
 				Get(webFolderPath, s.handleWebAddFolderGet)
-			router.With(s.checkPerm(dataprovider.PermAdminAddUsers)).Post(webFolderPath, s.handleWebAddFolderPost)
+			router.With(s.checkPerm(dataprovider.PermAdminFoldersCreate)).Post(webFolderPath, s.handleWebAddFolderPost)
 			router.With(s.checkPerm(dataprovider.PermAdminViewServerStatus), s.refreshCookie).
 				Get(webStatusPath, s.handleWebGetStatus)
-			router.With(s.checkPerm(dataprovider.PermAdminManageAdmins), s.refreshCookie).
+			router.With(s.checkPerm(dataprovider.PermAdminViewUsers), s.refreshCookie).
+				Get(webAnalyticsPath, s.handleWebGetAnalytics)
+			router.With(s.checkPerm(dataprovider.PermAdminAdminsRead), s.refreshCookie).
 				Get(webAdminsPath, s.handleGetWebAdmins)
-			router.With(s.checkPerm(dataprovider.PermAdminManageAdmins), s.refreshCookie).
+			router.With(s.checkPerm(dataprovider.PermAdminAdminsCreate), s.refreshCookie).
 				Get(webAdminPath, s.handleWebAddAdminGet)
-			router.With(s.checkPerm(dataprovider.PermAdminManageAdmins), s.refreshCookie).
+			router.With(s.checkPerm(dataprovider.PermAdminAdminsUpdate), s.refreshCookie).
 				Get(webAdminPath+"/{username}", s.handleWebUpdateAdminGet)
-			router.With(s.checkPerm(dataprovider.PermAdminManageAdmins)).Post(webAdminPath, s.handleWebAddAdminPost)
-			router.With(s.checkPerm(dataprovider.PermAdminManageAdmins)).Post(webAdminPath+"/{username}",
+			router.With(s.checkPerm(dataprovider.PermAdminAdminsCreate)).Post(webAdminPath, s.handleWebAddAdminPost)
+			router.With(s.checkPerm(dataprovider.PermAdminAdminsUpdate)).Post(webAdminPath+"/{username}",
 				s.handleWebUpdateAdminPost)
-			router.With(s.checkPerm(dataprovider.PermAdminManageAdmins), verifyCSRFHeader).
+			router.With(s.checkPerm(dataprovider.PermAdminAdminsDelete), verifyCSRFHeader).
 				Delete(webAdminPath+"/{username}", deleteAdmin)
 			router.With(s.checkPerm(dataprovider.PermAdminCloseConnections), verifyCSRFHeader).
 				Delete(webConnectionsPath+"/{connectionID}", handleCloseConnection)
-			router.With(s.checkPerm(dataprovider.PermAdminChangeUsers), s.refreshCookie).
+			router.With(s.checkPerm(dataprovider.PermAdminCloseConnections), verifyCSRFHeader).
+				Delete(webConnectionsPath+"/{connectionID}/transfers/{transferID}", handleCloseTransfer)
+			router.With(s.checkPerm(dataprovider.PermAdminCloseConnections), verifyCSRFHeader).
+				Put(webConnectionsPath+"/{connectionID}/transfers/{transferID}/bandwidth", handleThrottleTransfer)
+			router.With(s.checkPerm(dataprovider.PermAdminCloseConnections), verifyCSRFHeader).
+				Delete(webSessionsPath+"/{id}", handleRevokeWebSession)
+			router.With(s.checkPerm(dataprovider.PermAdminCloseConnections), verifyCSRFHeader).
+				Delete(webUserPath+"/{username}/sessions", revokeUserWebSessions)
+			router.With(s.checkPerm(dataprovider.PermAdminAdminsUpdate), verifyCSRFHeader).
+				Delete(webAdminPath+"/{username}/sessions", revokeAdminWebSessions)
+			router.With(s.checkPerm(dataprovider.PermAdminFoldersUpdate), s.refreshCookie).
 				Get(webFolderPath+"/{name}", s.handleWebUpdateFolderGet)
-			router.With(s.checkPerm(dataprovider.PermAdminChangeUsers)).Post(webFolderPath+"/{name}",
+			router.With(s.checkPerm(dataprovider.PermAdminFoldersUpdate)).Post(webFolderPath+"/{name}",
 				s.handleWebUpdateFolderPost)
-			router.With(s.checkPerm(dataprovider.PermAdminDeleteUsers), verifyCSRFHeader).
+			router.With(s.checkPerm(dataprovider.PermAdminFoldersDelete), verifyCSRFHeader).
 				Delete(webFolderPath+"/{name}", deleteFolder)
 			router.With(s.checkPerm(dataprovider.PermAdminQuotaScans), verifyCSRFHeader).
 				Post(webScanVFolderPath+"/{name}", startFolderQuotaScan)
@@ -1702,43 +1993,55 @@ func (s *httpdServer) setupWebAdminRoutes() {
 			router.With(s.checkPerm(dataprovider.PermAdminViewDefender)).Get(webDefenderHostsPath, getDefenderHosts)
 			router.With(s.checkPerm(dataprovider.PermAdminManageDefender)).Delete(webDefenderHostsPath+"/{id}",
 				deleteDefenderHostByID)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules), s.refreshCookie).
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesRead), s.refreshCookie).
 				Get(webAdminEventActionsPath, s.handleWebGetEventActions)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules), s.refreshCookie).
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesCreate), s.refreshCookie).
 				Get(webAdminEventActionPath, s.handleWebAddEventActionGet)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules)).Post(webAdminEventActionPath,
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesCreate)).Post(webAdminEventActionPath,
 				s.handleWebAddEventActionPost)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules), s.refreshCookie).
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesUpdate), s.refreshCookie).
 				Get(webAdminEventActionPath+"/{name}", s.handleWebUpdateEventActionGet)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules)).Post(webAdminEventActionPath+"/{name}",
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesUpdate)).Post(webAdminEventActionPath+"/{name}",
 				s.handleWebUpdateEventActionPost)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules), verifyCSRFHeader).
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesDelete), verifyCSRFHeader).
 				Delete(webAdminEventActionPath+"/{name}", deleteEventAction)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules), s.refreshCookie).
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesRead), s.refreshCookie).
 				Get(webAdminEventRulesPath, s.handleWebGetEventRules)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules), s.refreshCookie).
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesCreate), s.refreshCookie).
 				Get(webAdminEventRulePath, s.handleWebAddEventRuleGet)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules)).Post(webAdminEventRulePath,
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesCreate)).Post(webAdminEventRulePath,
 				s.handleWebAddEventRulePost)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules), s.refreshCookie).
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesUpdate), s.refreshCookie).
 				Get(webAdminEventRulePath+"/{name}", s.handleWebUpdateEventRuleGet)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules)).Post(webAdminEventRulePath+"/{name}",
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesUpdate)).Post(webAdminEventRulePath+"/{name}",
 				s.handleWebUpdateEventRulePost)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules), verifyCSRFHeader).
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesDelete), verifyCSRFHeader).
 				Delete(webAdminEventRulePath+"/{name}", deleteEventRule)
-			router.With(s.checkPerm(dataprovider.PermAdminManageEventRules), verifyCSRFHeader).
+			router.With(s.checkPerm(dataprovider.PermAdminEventRulesUpdate), verifyCSRFHeader).
 				Post(webAdminEventRulePath+"/run/{name}", runOnDemandRule)
-			router.With(s.checkPerm(dataprovider.PermAdminManageRoles), s.refreshCookie).
+			router.With(s.checkPerm(dataprovider.PermAdminRolesRead), s.refreshCookie).
 				Get(webAdminRolesPath, s.handleWebGetRoles)
-			router.With(s.checkPerm(dataprovider.PermAdminManageRoles), s.refreshCookie).
+			router.With(s.checkPerm(dataprovider.PermAdminRolesCreate), s.refreshCookie).
 				Get(webAdminRolePath, s.handleWebAddRoleGet)
-			router.With(s.checkPerm(dataprovider.PermAdminManageRoles)).Post(webAdminRolePath, s.handleWebAddRolePost)
-			router.With(s.checkPerm(dataprovider.PermAdminManageRoles), s.refreshCookie).
+			router.With(s.checkPerm(dataprovider.PermAdminRolesCreate)).Post(webAdminRolePath, s.handleWebAddRolePost)
+			router.With(s.checkPerm(dataprovider.PermAdminRolesUpdate), s.refreshCookie).
 				Get(webAdminRolePath+"/{name}", s.handleWebUpdateRoleGet)
-			router.With(s.checkPerm(dataprovider.PermAdminManageRoles)).Post(webAdminRolePath+"/{name}",
+			router.With(s.checkPerm(dataprovider.PermAdminRolesUpdate)).Post(webAdminRolePath+"/{name}",
 				s.handleWebUpdateRolePost)
-			router.With(s.checkPerm(dataprovider.PermAdminManageRoles), verifyCSRFHeader).
+			router.With(s.checkPerm(dataprovider.PermAdminRolesDelete), verifyCSRFHeader).
 				Delete(webAdminRolePath+"/{name}", deleteRole)
+			router.With(s.checkPerm(dataprovider.PermAdminAdminRolesRead), s.refreshCookie).
+				Get(webAdminAdminRolesPath, s.handleWebGetAdminRoles)
+			router.With(s.checkPerm(dataprovider.PermAdminAdminRolesCreate), s.refreshCookie).
+				Get(webAdminAdminRolePath, s.handleWebAddAdminRoleGet)
+			router.With(s.checkPerm(dataprovider.PermAdminAdminRolesCreate)).Post(webAdminAdminRolePath,
+				s.handleWebAddAdminRolePost)
+			router.With(s.checkPerm(dataprovider.PermAdminAdminRolesUpdate), s.refreshCookie).
+				Get(webAdminAdminRolePath+"/{name}", s.handleWebUpdateAdminRoleGet)
+			router.With(s.checkPerm(dataprovider.PermAdminAdminRolesUpdate)).Post(webAdminAdminRolePath+"/{name}",
+				s.handleWebUpdateAdminRolePost)
+			router.With(s.checkPerm(dataprovider.PermAdminAdminRolesDelete), verifyCSRFHeader).
+				Delete(webAdminAdminRolePath+"/{name}", deleteAdminRole)
 			router.With(s.checkPerm(dataprovider.PermAdminViewEvents), s.refreshCookie).Get(webEventsPath,
 				s.handleWebGetEvents)
 			router.With(s.checkPerm(dataprovider.PermAdminViewEvents), compressor.Handler, s.refreshCookie).
@@ -1747,21 +2050,31 @@ func (s *httpdServer) setupWebAdminRoutes() {
 				Get(webEventsProviderSearchPath, searchProviderEvents)
 			router.With(s.checkPerm(dataprovider.PermAdminViewEvents), compressor.Handler, s.refreshCookie).
 				Get(webEventsLogSearchPath, searchLogEvents)
-			router.With(s.checkPerm(dataprovider.PermAdminManageIPLists)).Get(webIPListsPath, s.handleWebIPListsPage)
-			router.With(s.checkPerm(dataprovider.PermAdminManageIPLists), compressor.Handler, s.refreshCookie).
+			router.With(s.checkPerm(dataprovider.PermAdminIPListsRead)).Get(webIPListsPath, s.handleWebIPListsPage)
+			router.With(s.checkPerm(dataprovider.PermAdminIPListsRead), compressor.Handler, s.refreshCookie).
 				Get(webIPListsPath+"/{type}", getIPListEntries)
-			router.With(s.checkPerm(dataprovider.PermAdminManageIPLists), s.refreshCookie).Get(webIPListPath+"/{type}",
+			router.With(s.checkPerm(dataprovider.PermAdminIPListsCreate), s.refreshCookie).Get(webIPListPath+"/{type}",
 				s.handleWebAddIPListEntryGet)
-			router.With(s.checkPerm(dataprovider.PermAdminManageIPLists)).Post(webIPListPath+"/{type}",
+			router.With(s.checkPerm(dataprovider.PermAdminIPListsCreate)).Post(webIPListPath+"/{type}",
 				s.handleWebAddIPListEntryPost)
-			router.With(s.checkPerm(dataprovider.PermAdminManageIPLists), s.refreshCookie).Get(webIPListPath+"/{type}/{ipornet}",
+			router.With(s.checkPerm(dataprovider.PermAdminIPListsUpdate), s.refreshCookie).Get(webIPListPath+"/{type}/{ipornet}",
 				s.handleWebUpdateIPListEntryGet)
-			router.With(s.checkPerm(dataprovider.PermAdminManageIPLists)).Post(webIPListPath+"/{type}/{ipornet}",
+			router.With(s.checkPerm(dataprovider.PermAdminIPListsUpdate)).Post(webIPListPath+"/{type}/{ipornet}",
 				s.handleWebUpdateIPListEntryPost)
-			router.With(s.checkPerm(dataprovider.PermAdminManageIPLists), verifyCSRFHeader).
+			router.With(s.checkPerm(dataprovider.PermAdminIPListsDelete), verifyCSRFHeader).
 				Delete(webIPListPath+"/{type}/{ipornet}", deleteIPListEntry)
 			router.With(s.checkPerm(dataprovider.PermAdminManageSystem), s.refreshCookie).Get(webConfigsPath, s.handleWebConfigs)
 			router.With(s.checkPerm(dataprovider.PermAdminManageSystem)).Post(webConfigsPath, s.handleWebConfigsPost)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem), s.refreshCookie).
+				Get(webHostKeysPath, s.handleWebGetSSHHostKeys)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem), verifyCSRFHeader).
+				Post(webHostKeysPath, addSSHHostKey)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem), verifyCSRFHeader).
+				Put(webHostKeysPath+"/{id}", updateSSHHostKey)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem), verifyCSRFHeader).
+				Delete(webHostKeysPath+"/{id}", deleteSSHHostKey)
+			router.With(s.checkPerm(dataprovider.PermAdminManageSystem), verifyCSRFHeader).
+				Post(webHostKeysPath+"/{id}/rotate", rotateSSHHostKey)
 			router.With(s.checkPerm(dataprovider.PermAdminManageSystem), verifyCSRFHeader, s.refreshCookie).
 				Post(webConfigsPath+"/smtp/test", testSMTPConfig)
 			router.With(s.checkPerm(dataprovider.PermAdminManageSystem), verifyCSRFHeader, s.refreshCookie).
@@ -0,0 +1,190 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/smtp"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	tenantQueryParam          = "tenant"
+	defaultTenantOIDCUsername = "preferred_username"
+)
+
+var (
+	tenantOIDCs = &tenantOIDCCache{
+		configs: make(map[string]tenantOIDC),
+	}
+	defaultTenantOIDCScopes = []string{oidc.ScopeOpenID, "profile", "email"}
+)
+
+type tenantOIDC struct {
+	updatedAt int64
+	config    *OIDC
+}
+
+// tenantOIDCCache caches the initialized OpenID Connect configurations defined
+// within tenant roles, a cached configuration is replaced if the role is updated
+type tenantOIDCCache struct {
+	sync.RWMutex
+	configs map[string]tenantOIDC
+}
+
+// get returns the initialized OpenID Connect configuration for the specified role.
+// The provider discovery is done the first time a configuration is requested
+func (c *tenantOIDCCache) get(role *dataprovider.Role, binding *Binding) (*OIDC, error) {
+	if !role.HasTenantOIDC() {
+		return nil, fmt.Errorf("oidc: not configured for tenant %q", role.Name)
+	}
+	key := role.Name + "|" + binding.OIDC.RedirectBaseURL
+
+	c.RLock()
+	cached, ok := c.configs[key]
+	c.RUnlock()
+
+	if ok && cached.updatedAt == role.UpdatedAt {
+		return cached.config, nil
+	}
+	cfg := role.Tenant.OIDC
+	if err := cfg.ClientSecret.TryDecrypt(); err != nil {
+		return nil, fmt.Errorf("oidc: unable to decrypt the client secret for tenant %q: %w", role.Name, err)
+	}
+	config := &OIDC{
+		ClientID:        cfg.ClientID,
+		ClientSecret:    cfg.ClientSecret.GetPayload(),
+		ConfigURL:       cfg.ConfigURL,
+		RedirectBaseURL: cfg.RedirectBaseURL,
+		UsernameField:   cfg.UsernameField,
+		Scopes:          cfg.Scopes,
+		Debug:           binding.OIDC.Debug,
+	}
+	if config.RedirectBaseURL == "" {
+		config.RedirectBaseURL = binding.OIDC.RedirectBaseURL
+	}
+	if config.UsernameField == "" {
+		config.UsernameField = defaultTenantOIDCUsername
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = defaultTenantOIDCScopes
+	}
+	if err := config.initialize(); err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	c.configs[key] = tenantOIDC{
+		updatedAt: role.UpdatedAt,
+		config:    config,
+	}
+	c.Unlock()
+
+	logger.Debug(logSender, "", "oidc initialized for tenant %q, config URL %q", role.Name, config.ConfigURL)
+	return config, nil
+}
+
+// getTenantRole returns the tenant role selected by the "tenant" query parameter
+// or, if not set, by the host the request was sent to
+func getTenantRole(r *http.Request) (dataprovider.Role, error) {
+	slug := strings.TrimSpace(r.URL.Query().Get(tenantQueryParam))
+	var domain string
+	if slug == "" {
+		domain = getRequestHostname(r)
+	}
+	return dataprovider.GetTenantRole(slug, domain)
+}
+
+// getTenantQuery returns the query string to append to the WebClient URLs to
+// preserve the tenant selected using the "tenant" query parameter
+func getTenantQuery(r *http.Request) string {
+	slug := strings.TrimSpace(r.URL.Query().Get(tenantQueryParam))
+	if slug == "" {
+		return ""
+	}
+	return fmt.Sprintf("?%s=%s", tenantQueryParam, url.QueryEscape(slug))
+}
+
+func getRequestHostname(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.Trim(host, "[]")
+}
+
+// getTenantOIDC returns the OpenID Connect configuration defined for the tenant
+// selected by the specified request, if any
+func (s *httpdServer) getTenantOIDC(r *http.Request) (string, *OIDC, error) {
+	role, err := getTenantRole(r)
+	if err != nil {
+		return "", nil, err
+	}
+	if !role.HasTenantOIDC() {
+		return "", nil, util.NewRecordNotFoundError(fmt.Sprintf("oidc: not configured for tenant %q", role.Name))
+	}
+	config, err := tenantOIDCs.get(&role, &s.binding)
+	return role.Name, config, err
+}
+
+// getOIDC returns the OpenID Connect configuration for the specified tenant,
+// an empty tenant means the configuration defined for the binding
+func (s *httpdServer) getOIDC(tenant string) (*OIDC, error) {
+	if tenant == "" {
+		if !s.binding.OIDC.isEnabled() {
+			return nil, errors.New("oidc: not configured")
+		}
+		return &s.binding.OIDC, nil
+	}
+	role, err := dataprovider.RoleExists(tenant)
+	if err != nil {
+		return nil, err
+	}
+	return tenantOIDCs.get(&role, &s.binding)
+}
+
+// hasTenantSMTP returns true if the specified user is associated with a tenant
+// role defining its own SMTP configuration
+func hasTenantSMTP(username string) bool {
+	user, err := dataprovider.UserExists(username, "")
+	if err != nil || user.Role == "" {
+		return false
+	}
+	return smtp.IsEnabledForRole(user.Role)
+}
+
+// isWebClientPasswordResetEnabled returns true if an SMTP server is configured
+// globally or for the tenant selected by the specified request
+func isWebClientPasswordResetEnabled(r *http.Request) bool {
+	if smtp.IsEnabled() {
+		return true
+	}
+	role, err := getTenantRole(r)
+	if err != nil {
+		return false
+	}
+	return role.HasTenantSMTP()
+}
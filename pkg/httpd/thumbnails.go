@@ -0,0 +1,487 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// register the supported source image formats
+	_ "image/gif"
+	_ "image/png"
+
+	"github.com/sftpgo/sdk"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+const (
+	thumbnailsMinSize   = 16
+	thumbnailsMaxSize   = 2048
+	thumbnailsMaxPixels = 50000000
+	thumbnailsQuality   = 80
+	thumbnailsFileExt   = ".jpg"
+)
+
+var (
+	errThumbnailsDisabled   = util.NewMethodDisabledError("thumbnails are disabled")
+	errThumbnailUnsupported = util.NewValidationError("thumbnails are not supported for this file type")
+	thumbnails              = &thumbnailer{}
+)
+
+// ThumbnailsConfig defines the configuration for image and PDF previews.
+// Thumbnails are generated on first request and cached on the local disk
+type ThumbnailsConfig struct {
+	// Set to true to enable thumbnails
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// Allowed thumbnail sizes, as pixels, for the longest side.
+	// The first size is the default one
+	Sizes []int `json:"sizes" mapstructure:"sizes"`
+	// Thumbnails are not generated for files larger than this size, as bytes.
+	// 0 means no limit
+	MaxFileSize int64 `json:"max_file_size" mapstructure:"max_file_size"`
+	// Directory for cached thumbnails. Thumbnails are stored in a sub directory
+	// for each storage backend, for example "osfs" or "s3fs".
+	// Leave empty to use a "thumbnails" directory inside the temporary path.
+	// Relative paths are resolved against the configuration directory
+	CacheDir string `json:"cache_dir" mapstructure:"cache_dir"`
+	// Override the cache directory for specific storage backends.
+	// The keys are the backend names, for example "s3fs", the values the
+	// directories to use
+	BackendCacheDirs map[string]string `json:"backend_cache_dirs" mapstructure:"backend_cache_dirs"`
+	// Cached thumbnails not requested for this number of hours are removed.
+	// 0 means no automatic removal
+	Retention int `json:"retention" mapstructure:"retention"`
+	// Optional program to render the first page of PDF files. It is invoked
+	// with the PDF file path and the requested size as arguments and must
+	// write a PNG, JPEG or GIF image to its standard output.
+	// Leave empty to disable PDF previews
+	PDFRenderer string `json:"pdf_renderer" mapstructure:"pdf_renderer"`
+	// Timeout, as seconds, for the PDF renderer
+	PDFRendererTimeout int `json:"pdf_renderer_timeout" mapstructure:"pdf_renderer_timeout"`
+}
+
+func (c *ThumbnailsConfig) validate(configDir string) error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.Sizes) == 0 {
+		return errors.New("at least a thumbnail size is required")
+	}
+	for _, size := range c.Sizes {
+		if size < thumbnailsMinSize || size > thumbnailsMaxSize {
+			return fmt.Errorf("invalid thumbnail size %d, allowed range: %d-%d", size, thumbnailsMinSize,
+				thumbnailsMaxSize)
+		}
+	}
+	if c.MaxFileSize < 0 {
+		return fmt.Errorf("invalid thumbnails max file size: %d", c.MaxFileSize)
+	}
+	if c.Retention < 0 {
+		return fmt.Errorf("invalid thumbnails retention: %d", c.Retention)
+	}
+	if c.CacheDir == "" {
+		c.CacheDir = filepath.Join(getArchiveJobsDir(), "thumbnails")
+	} else if c.CacheDir = getConfigPath(c.CacheDir, configDir); c.CacheDir == "" {
+		return errors.New("invalid thumbnails cache dir")
+	}
+	for name, dir := range c.BackendCacheDirs {
+		if vfs.GetProviderByName(name) == sdk.LocalFilesystemProvider && name != "osfs" && name != "0" {
+			return fmt.Errorf("invalid thumbnails backend %q", name)
+		}
+		if dir = getConfigPath(dir, configDir); dir == "" {
+			return fmt.Errorf("invalid cache dir for thumbnails backend %q", name)
+		}
+		c.BackendCacheDirs[name] = dir
+	}
+	if c.PDFRenderer != "" {
+		if !filepath.IsAbs(c.PDFRenderer) {
+			return fmt.Errorf("invalid PDF renderer %q, the path must be absolute", c.PDFRenderer)
+		}
+		if c.PDFRendererTimeout < 1 {
+			return fmt.Errorf("invalid PDF renderer timeout: %d", c.PDFRendererTimeout)
+		}
+	}
+	return nil
+}
+
+// getCacheDir returns the cache directory for the specified storage backend
+func (c *ThumbnailsConfig) getCacheDir(provider sdk.FilesystemProvider) string {
+	name := vfs.GetProviderName(provider)
+	for key, dir := range c.BackendCacheDirs {
+		if vfs.GetProviderByName(key) == provider {
+			return dir
+		}
+	}
+	return filepath.Join(c.CacheDir, name)
+}
+
+// getSize returns the thumbnail size matching the requested one,
+// an empty value means the default size
+func (c *ThumbnailsConfig) getSize(val string) (int, error) {
+	if val == "" {
+		return c.Sizes[0], nil
+	}
+	size, err := strconv.Atoi(val)
+	if err == nil && util.Contains(c.Sizes, size) {
+		return size, nil
+	}
+	return 0, util.NewValidationError(fmt.Sprintf("invalid thumbnail size %q, allowed sizes: %v", val, c.Sizes))
+}
+
+func (c *ThumbnailsConfig) isPDFSupported() bool {
+	return c.PDFRenderer != ""
+}
+
+// isSupported returns true if a thumbnail can be generated for the
+// specified file name
+func (c *ThumbnailsConfig) isSupported(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif":
+		return true
+	case ".pdf":
+		return c.isPDFSupported()
+	default:
+		return false
+	}
+}
+
+type thumbnailer struct {
+	sync.RWMutex
+	config ThumbnailsConfig
+	// keys for thumbnails being generated, concurrent requests
+	// for the same thumbnail wait for the first one
+	pending map[string]chan struct{}
+}
+
+func (t *thumbnailer) setConfig(config ThumbnailsConfig) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.config = config
+	t.pending = make(map[string]chan struct{})
+}
+
+func (t *thumbnailer) getConfig() ThumbnailsConfig {
+	t.RLock()
+	defer t.RUnlock()
+
+	return t.config
+}
+
+// acquire returns true if the caller must generate the thumbnail for the
+// specified key, false if another request generated it in the meantime
+func (t *thumbnailer) acquire(key string) bool {
+	t.Lock()
+	ch, ok := t.pending[key]
+	if !ok {
+		t.pending[key] = make(chan struct{})
+		t.Unlock()
+		return true
+	}
+	t.Unlock()
+	<-ch
+	return false
+}
+
+func (t *thumbnailer) release(key string) {
+	t.Lock()
+	defer t.Unlock()
+
+	if ch, ok := t.pending[key]; ok {
+		close(ch)
+		delete(t.pending, key)
+	}
+}
+
+// cleanup removes the cached thumbnails not used within the configured retention
+func (t *thumbnailer) cleanup() {
+	config := t.getConfig()
+	if !config.Enabled || config.Retention == 0 {
+		return
+	}
+	limit := time.Now().Add(-time.Duration(config.Retention) * time.Hour)
+	dirs := []string{config.CacheDir}
+	for _, dir := range config.BackendCacheDirs {
+		dirs = append(dirs, dir)
+	}
+	removed := 0
+	for _, dir := range dirs {
+		filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error { //nolint:errcheck
+			if err != nil || d.IsDir() || !strings.HasSuffix(d.Name(), thumbnailsFileExt) {
+				return nil
+			}
+			info, err := d.Info()
+			if err == nil && info.ModTime().Before(limit) {
+				if err := os.Remove(p); err == nil {
+					removed++
+				}
+			}
+			return nil
+		})
+	}
+	if removed > 0 {
+		logger.Debug(logSender, "", "expired thumbnails removed: %d", removed)
+	}
+}
+
+func getThumbnailProvider(user *dataprovider.User, virtualPath string) sdk.FilesystemProvider {
+	if folder, err := user.GetVirtualFolderForPath(virtualPath); err == nil {
+		return folder.FsConfig.Provider
+	}
+	return user.FsConfig.Provider
+}
+
+// getThumbnailKey returns the cache key for a thumbnail, any change to
+// the source file results in a different key
+func getThumbnailKey(username, fsName, fsPath string, info os.FileInfo, size int) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%d\x00%d\x00%d", username, fsName, fsPath, info.Size(),
+		info.ModTime().UnixNano(), size)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// getThumbnail returns the path to the cached thumbnail for the specified
+// file, the thumbnail is generated if missing
+func (t *thumbnailer) getThumbnail(conn *Connection, name string, info os.FileInfo, size int) (string, error) {
+	config := t.getConfig()
+	if !config.Enabled {
+		return "", errThumbnailsDisabled
+	}
+	if !config.isSupported(name) {
+		return "", errThumbnailUnsupported
+	}
+	if config.MaxFileSize > 0 && info.Size() > config.MaxFileSize {
+		return "", util.NewValidationError(fmt.Sprintf("thumbnails are not available for files larger than %s",
+			util.ByteCountIEC(config.MaxFileSize)))
+	}
+	// the permissions are checked for cached thumbnails too
+	if !conn.User.HasPerm(dataprovider.PermDownload, path.Dir(name)) {
+		return "", conn.GetPermissionDeniedError()
+	}
+	if ok, policy := conn.User.IsFileAllowed(name); !ok {
+		return "", conn.GetErrorForDeniedFile(policy)
+	}
+	fs, fsPath, err := conn.GetFsAndResolvedPath(name)
+	if err != nil {
+		return "", err
+	}
+	key := getThumbnailKey(conn.User.Username, fs.Name(), fsPath, info, size)
+	thumbPath := filepath.Join(config.getCacheDir(getThumbnailProvider(&conn.User, name)), key[:2],
+		key+thumbnailsFileExt)
+	if t.isCached(thumbPath) {
+		return thumbPath, nil
+	}
+	if !t.acquire(key) {
+		if t.isCached(thumbPath) {
+			return thumbPath, nil
+		}
+		// the concurrent request failed, try again
+		if !t.acquire(key) {
+			return "", fmt.Errorf("unable to generate thumbnail for %q", name)
+		}
+	}
+	defer t.release(key)
+
+	startTime := time.Now()
+	img, err := t.decode(conn, name, size, config)
+	if err != nil {
+		conn.Log(logger.LevelDebug, "unable to generate thumbnail for %q: %v", name, err)
+		return "", err
+	}
+	if err := writeThumbnail(thumbPath, resizeImage(img, size)); err != nil {
+		conn.Log(logger.LevelError, "unable to save thumbnail for %q: %v", name, err)
+		return "", err
+	}
+	conn.Log(logger.LevelDebug, "thumbnail for %q generated, size %d, elapsed: %s", name, size,
+		time.Since(startTime))
+	return thumbPath, nil
+}
+
+// isCached returns true if the thumbnail exists, the modification time is
+// updated so that thumbnails in use are not removed
+func (t *thumbnailer) isCached(thumbPath string) bool {
+	if _, err := os.Stat(thumbPath); err != nil {
+		return false
+	}
+	now := time.Now()
+	os.Chtimes(thumbPath, now, now) //nolint:errcheck
+	return true
+}
+
+func (t *thumbnailer) decode(conn *Connection, name string, size int, config ThumbnailsConfig) (image.Image, error) {
+	reader, err := conn.getFileReader(name, 0, http.MethodGet)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	if strings.ToLower(path.Ext(name)) == ".pdf" {
+		return renderPDF(reader, size, config)
+	}
+	return decodeImage(reader)
+}
+
+func decodeImage(reader io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	// avoid decompression bombs
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, util.NewValidationError(fmt.Sprintf("unable to decode image: %v", err))
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > thumbnailsMaxPixels {
+		return nil, util.NewValidationError(fmt.Sprintf("image size %dx%d not supported", cfg.Width, cfg.Height))
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, util.NewValidationError(fmt.Sprintf("unable to decode image: %v", err))
+	}
+	return img, nil
+}
+
+// renderPDF renders the first page of the PDF file using the configured
+// external program. The PDF file is copied to a local temporary file
+// since the storage backend may not be local
+func renderPDF(reader io.Reader, size int, config ThumbnailsConfig) (image.Image, error) {
+	f, err := os.CreateTemp(getArchiveJobsDir(), "sftpgo-thumb-*.pdf")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create temporary file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, reader)
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.PDFRendererTimeout)*time.Second)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, config.PDFRenderer, f.Name(), strconv.Itoa(size))
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("unable to render PDF: %w, stderr: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return decodeImage(&stdout)
+}
+
+func writeThumbnail(thumbPath string, img image.Image) error {
+	if err := os.MkdirAll(filepath.Dir(thumbPath), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(thumbPath), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	err = jpeg.Encode(f, img, &jpeg.Options{Quality: thumbnailsQuality})
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), thumbPath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// getThumbnailDimensions returns the thumbnail dimensions preserving the
+// aspect ratio, images are never enlarged
+func getThumbnailDimensions(width, height, size int) (int, int) {
+	if width <= size && height <= size {
+		return width, height
+	}
+	if width >= height {
+		h := max(1, int(int64(height)*int64(size)/int64(width)))
+		return size, h
+	}
+	w := max(1, int(int64(width)*int64(size)/int64(height)))
+	return w, size
+}
+
+// resizeImage scales the image, so that the longest side is at most size
+// pixels, averaging the source pixels mapped to each destination pixel.
+// Transparent areas are rendered on a white background
+func resizeImage(src image.Image, size int) *image.RGBA {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	dstW, dstH := getThumbnailDimensions(srcW, srcH, size)
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+
+	// accumulators for the destination row being computed
+	sums := make([]uint64, dstW*3)
+	counts := make([]uint64, dstW)
+	// a single source row is converted to RGBA at a time
+	row := image.NewRGBA(image.Rect(0, 0, srcW, 1))
+	white := image.NewUniform(color.White)
+	dstY := 0
+	for y := 0; y < srcH; y++ {
+		draw.Draw(row, row.Bounds(), white, image.Point{}, draw.Src)
+		draw.Draw(row, row.Bounds(), src, image.Pt(bounds.Min.X, bounds.Min.Y+y), draw.Over)
+		for x := 0; x < srcW; x++ {
+			dx := x * dstW / srcW
+			i := x * 4
+			sums[dx*3] += uint64(row.Pix[i])
+			sums[dx*3+1] += uint64(row.Pix[i+1])
+			sums[dx*3+2] += uint64(row.Pix[i+2])
+			counts[dx]++
+		}
+		if y == srcH-1 || (y+1)*dstH/srcH != dstY {
+			for dx := 0; dx < dstW; dx++ {
+				if counts[dx] == 0 {
+					continue
+				}
+				i := dst.PixOffset(dx, dstY)
+				dst.Pix[i] = uint8(sums[dx*3] / counts[dx])
+				dst.Pix[i+1] = uint8(sums[dx*3+1] / counts[dx])
+				dst.Pix[i+2] = uint8(sums[dx*3+2] / counts[dx])
+				dst.Pix[i+3] = 0xff
+				sums[dx*3], sums[dx*3+1], sums[dx*3+2], counts[dx] = 0, 0, 0, 0
+			}
+			dstY = (y + 1) * dstH / srcH
+		}
+	}
+	return dst
+}
@@ -0,0 +1,80 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+var errUploadOffsetMismatch = errors.New("the upload offset does not match the current file size")
+
+// contentRange is a parsed Content-Range header for resumable uploads.
+// A negative total means the final file size is unknown
+type contentRange struct {
+	start int64
+	end   int64
+	total int64
+}
+
+func (r *contentRange) length() int64 {
+	return r.end - r.start + 1
+}
+
+// isLast returns true if this is the last chunk of the upload
+func (r *contentRange) isLast() bool {
+	return r.total >= 0 && r.end+1 == r.total
+}
+
+// parseContentRange parses a Content-Range header in the format
+// "bytes <start>-<end>/<total>", total can be "*" if unknown
+func parseContentRange(header string) (contentRange, error) {
+	var result contentRange
+	errInvalid := util.NewValidationError("invalid Content-Range header")
+
+	unit, value, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok || unit != "bytes" {
+		return result, errInvalid
+	}
+	rng, total, ok := strings.Cut(value, "/")
+	if !ok {
+		return result, errInvalid
+	}
+	start, end, ok := strings.Cut(rng, "-")
+	if !ok {
+		return result, errInvalid
+	}
+	var err error
+	result.start, err = strconv.ParseInt(start, 10, 64)
+	if err != nil || result.start < 0 {
+		return result, errInvalid
+	}
+	result.end, err = strconv.ParseInt(end, 10, 64)
+	if err != nil || result.end < result.start {
+		return result, errInvalid
+	}
+	if total == "*" {
+		result.total = -1
+		return result, nil
+	}
+	result.total, err = strconv.ParseInt(total, 10, 64)
+	if err != nil || result.total <= result.end {
+		return result, errInvalid
+	}
+	return result, nil
+}
@@ -27,6 +27,7 @@ const (
 	page500Title              = "Internal Server Error"
 	page500Body               = "The server is unable to fulfill your request."
 	webDateTimeFormat         = "2006-01-02 15:04:05" // YYYY-MM-DD HH:MM:SS
+	webDateFormat             = "2006-01-02"          // YYYY-MM-DD
 	redactedSecret            = "[**redacted**]"
 	csrfFormToken             = "_form_token"
 	csrfHeaderToken           = "X-CSRF-TOKEN"
@@ -47,9 +48,12 @@ type loginPage struct {
 	AltLoginURL    string
 	AltLoginName   string
 	ForgotPwdURL   string
+	SignUpURL      string
 	OpenIDLoginURL string
+	SAMLLoginURL   string
 	Branding       UIBranding
 	FormDisabled   bool
+	TLSCertificate bool
 }
 
 type twoFactorPage struct {
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"html/template"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
@@ -80,6 +81,9 @@ const (
 	templateAdmins           = "admins.html"
 	templateAdmin            = "admin.html"
 	templateConnections      = "connections.html"
+	templateSessions         = "sessions.html"
+	templateRegistrations    = "registrations.html"
+	templateHostKeys         = "hostkeys.html"
 	templateGroups           = "groups.html"
 	templateGroup            = "group.html"
 	templateFolders          = "folders.html"
@@ -90,6 +94,8 @@ const (
 	templateEventAction      = "eventaction.html"
 	templateRoles            = "roles.html"
 	templateRole             = "role.html"
+	templateAdminRoles       = "adminroles.html"
+	templateAdminRole        = "adminrole.html"
 	templateEvents           = "events.html"
 	templateMessage          = "message.html"
 	templateStatus           = "status.html"
@@ -98,6 +104,8 @@ const (
 	templateIPLists          = "iplists.html"
 	templateIPList           = "iplist.html"
 	templateConfigs          = "configs.html"
+	templateAnalytics        = "analytics.html"
+	templateDashboard        = "dashboard.html"
 	templateProfile          = "profile.html"
 	templateChangePwd        = "changepassword.html"
 	templateMaintenance      = "maintenance.html"
@@ -106,12 +114,15 @@ const (
 	pageUsersTitle           = "Users"
 	pageAdminsTitle          = "Admins"
 	pageConnectionsTitle     = "Connections"
+	pageSessionsTitle        = "Sessions"
+	pageRegistrationsTitle   = "Registrations"
 	pageStatusTitle          = "Status"
 	pageFoldersTitle         = "Folders"
 	pageGroupsTitle          = "Groups"
 	pageEventRulesTitle      = "Event rules"
 	pageEventActionsTitle    = "Event actions"
 	pageRolesTitle           = "Roles"
+	pageAdminRolesTitle      = "Admin roles"
 	pageProfileTitle         = "My profile"
 	pageChangePwdTitle       = "Change password"
 	pageMaintenanceTitle     = "Maintenance"
@@ -119,6 +130,9 @@ const (
 	pageIPListsTitle         = "IP Lists"
 	pageEventsTitle          = "Logs"
 	pageConfigsTitle         = "Configurations"
+	pageHostKeysTitle        = "SSH host keys"
+	pageAnalyticsTitle       = "Analytics"
+	pageDashboardTitle       = "Dashboard"
 	pageForgotPwdTitle       = "SFTPGo Admin - Forgot password"
 	pageResetPwdTitle        = "SFTPGo Admin - Reset password"
 	pageSetupTitle           = "Create first admin user"
@@ -140,6 +154,8 @@ type basePage struct {
 	AdminURL            string
 	QuotaScanURL        string
 	ConnectionsURL      string
+	SessionsURL         string
+	RegistrationsURL    string
 	GroupsURL           string
 	GroupURL            string
 	FoldersURL          string
@@ -150,6 +166,9 @@ type basePage struct {
 	IPListURL           string
 	EventsURL           string
 	ConfigsURL          string
+	HostKeysURL         string
+	AnalyticsURL        string
+	DashboardURL        string
 	LogoutURL           string
 	ProfileURL          string
 	ChangePwdURL        string
@@ -160,6 +179,8 @@ type basePage struct {
 	EventActionURL      string
 	RolesURL            string
 	RoleURL             string
+	AdminRolesURL       string
+	AdminRoleURL        string
 	FolderQuotaScanURL  string
 	StatusURL           string
 	MaintenanceURL      string
@@ -167,17 +188,23 @@ type basePage struct {
 	UsersTitle          string
 	AdminsTitle         string
 	ConnectionsTitle    string
+	SessionsTitle       string
+	RegistrationsTitle  string
 	FoldersTitle        string
 	GroupsTitle         string
 	EventRulesTitle     string
 	EventActionsTitle   string
 	RolesTitle          string
+	AdminRolesTitle     string
 	StatusTitle         string
 	MaintenanceTitle    string
 	DefenderTitle       string
 	IPListsTitle        string
 	EventsTitle         string
 	ConfigsTitle        string
+	HostKeysTitle       string
+	AnalyticsTitle      string
+	DashboardTitle      string
 	Version             string
 	CSRFToken           string
 	IsEventManagerPage  bool
@@ -215,6 +242,11 @@ type rolesPage struct {
 	Roles []dataprovider.Role
 }
 
+type adminRolesPage struct {
+	basePage
+	Roles []dataprovider.AdminRole
+}
+
 type eventRulesPage struct {
 	basePage
 	Rules []dataprovider.EventRule
@@ -230,11 +262,61 @@ type connectionsPage struct {
 	Connections []common.ConnectionStatus
 }
 
+type dashboardPage struct {
+	basePage
+	LiveStatsURL string
+}
+
+type sessionsPage struct {
+	basePage
+	Sessions []webSession
+}
+
+type registrationsPage struct {
+	basePage
+	Registrations []pendingRegistration
+}
+
+type hostKeysPage struct {
+	basePage
+	HostKeys []sshHostKeyResponse
+}
+
 type statusPage struct {
 	basePage
 	Status *ServicesStatus
 }
 
+type analyticsHeatmapEntry struct {
+	common.FileAccessStats
+	LastAccessTime string
+	Percent        int
+}
+
+type analyticsExtensionEntry struct {
+	common.ExtensionStats
+	Percent int
+}
+
+type analyticsColdFile struct {
+	common.ColdFile
+	LastAccessTime string
+}
+
+type analyticsPage struct {
+	basePage
+	Enabled    bool
+	Username   string
+	Group      string
+	Order      string
+	Orders     []string
+	Heatmap    []analyticsHeatmapEntry
+	Report     *common.StorageReport
+	Extensions []analyticsExtensionEntry
+	ColdFiles  []analyticsColdFile
+	Error      string
+}
+
 type fsWrapper struct {
 	vfs.Filesystem
 	IsUserPage      bool
@@ -265,11 +347,12 @@ type userPage struct {
 
 type adminPage struct {
 	basePage
-	Admin  *dataprovider.Admin
-	Groups []dataprovider.Group
-	Roles  []dataprovider.Role
-	Error  string
-	IsAdd  bool
+	Admin      *dataprovider.Admin
+	Groups     []dataprovider.Group
+	Roles      []dataprovider.Role
+	AdminRoles []dataprovider.AdminRole
+	Error      string
+	IsAdd      bool
 }
 
 type profilePage struct {
@@ -351,6 +434,8 @@ type groupPage struct {
 	WebClientOptions   []string
 	VirtualFolders     []vfs.BaseVirtualFolder
 	FsWrapper          fsWrapper
+	// protocols for session policies, empty means all protocols
+	SessionPolicyProtocols []string
 }
 
 type rolePage struct {
@@ -360,11 +445,22 @@ type rolePage struct {
 	Mode  genericPageMode
 }
 
+type adminRolePage struct {
+	basePage
+	Role        *dataprovider.AdminRole
+	Groups      []dataprovider.Group
+	PermObjects []string
+	PermActions []string
+	Error       string
+	Mode        genericPageMode
+}
+
 type eventActionPage struct {
 	basePage
 	Action         dataprovider.BaseEventAction
 	ActionTypes    []dataprovider.EnumMapping
 	FsActions      []dataprovider.EnumMapping
+	Actions        []dataprovider.BaseEventAction
 	HTTPMethods    []string
 	RedactedSecret string
 	Error          string
@@ -395,6 +491,7 @@ type eventsPage struct {
 type configsPage struct {
 	basePage
 	Configs           dataprovider.Configs
+	UsernameAliases   string
 	ConfigSection     int
 	RedactedSecret    string
 	OAuth2TokenURL    string
@@ -452,6 +549,26 @@ func loadAdminTemplates(templatesPath string) {
 		filepath.Join(templatesPath, templateAdminDir, templateBase),
 		filepath.Join(templatesPath, templateAdminDir, templateConnections),
 	}
+	dashboardPaths := []string{
+		filepath.Join(templatesPath, templateCommonDir, templateCommonCSS),
+		filepath.Join(templatesPath, templateAdminDir, templateBase),
+		filepath.Join(templatesPath, templateAdminDir, templateDashboard),
+	}
+	sessionsPaths := []string{
+		filepath.Join(templatesPath, templateCommonDir, templateCommonCSS),
+		filepath.Join(templatesPath, templateAdminDir, templateBase),
+		filepath.Join(templatesPath, templateAdminDir, templateSessions),
+	}
+	registrationsPaths := []string{
+		filepath.Join(templatesPath, templateCommonDir, templateCommonCSS),
+		filepath.Join(templatesPath, templateAdminDir, templateBase),
+		filepath.Join(templatesPath, templateAdminDir, templateRegistrations),
+	}
+	hostKeysPaths := []string{
+		filepath.Join(templatesPath, templateCommonDir, templateCommonCSS),
+		filepath.Join(templatesPath, templateAdminDir, templateBase),
+		filepath.Join(templatesPath, templateAdminDir, templateHostKeys),
+	}
 	messagePaths := []string{
 		filepath.Join(templatesPath, templateCommonDir, templateCommonCSS),
 		filepath.Join(templatesPath, templateAdminDir, templateBase),
@@ -568,11 +685,26 @@ func loadAdminTemplates(templatesPath string) {
 		filepath.Join(templatesPath, templateAdminDir, templateBase),
 		filepath.Join(templatesPath, templateAdminDir, templateRole),
 	}
+	adminRolesPaths := []string{
+		filepath.Join(templatesPath, templateCommonDir, templateCommonCSS),
+		filepath.Join(templatesPath, templateAdminDir, templateBase),
+		filepath.Join(templatesPath, templateAdminDir, templateAdminRoles),
+	}
+	adminRolePaths := []string{
+		filepath.Join(templatesPath, templateCommonDir, templateCommonCSS),
+		filepath.Join(templatesPath, templateAdminDir, templateBase),
+		filepath.Join(templatesPath, templateAdminDir, templateAdminRole),
+	}
 	eventsPaths := []string{
 		filepath.Join(templatesPath, templateCommonDir, templateCommonCSS),
 		filepath.Join(templatesPath, templateAdminDir, templateBase),
 		filepath.Join(templatesPath, templateAdminDir, templateEvents),
 	}
+	analyticsPaths := []string{
+		filepath.Join(templatesPath, templateCommonDir, templateCommonCSS),
+		filepath.Join(templatesPath, templateAdminDir, templateBase),
+		filepath.Join(templatesPath, templateAdminDir, templateAnalytics),
+	}
 	configsPaths := []string{
 		filepath.Join(templatesPath, templateCommonDir, templateCommonCSS),
 		filepath.Join(templatesPath, templateAdminDir, templateBase),
@@ -583,16 +715,26 @@ func loadAdminTemplates(templatesPath string) {
 		"ListFSProviders": func() []sdk.FilesystemProvider {
 			return []sdk.FilesystemProvider{sdk.LocalFilesystemProvider, sdk.CryptedFilesystemProvider,
 				sdk.S3FilesystemProvider, sdk.GCSFilesystemProvider, sdk.AzureBlobFilesystemProvider,
-				sdk.SFTPFilesystemProvider, sdk.HTTPFilesystemProvider,
+				sdk.SFTPFilesystemProvider, sdk.HTTPFilesystemProvider, vfs.WebDAVFilesystemProvider,
 			}
 		},
-		"HumanizeBytes": util.ByteCountSI,
+		"FSProviderName":      vfs.GetProviderName,
+		"FSProviderShortInfo": vfs.GetProviderShortInfo,
+		"HumanizeBytes":       util.ByteCountSI,
+		"ListWeekDays": func() []time.Weekday {
+			return []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday,
+				time.Saturday, time.Sunday}
+		},
 	})
 	usersTmpl := util.LoadTemplate(nil, usersPaths...)
 	userTmpl := util.LoadTemplate(fsBaseTpl, userPaths...)
 	adminsTmpl := util.LoadTemplate(nil, adminsPaths...)
 	adminTmpl := util.LoadTemplate(nil, adminPaths...)
 	connectionsTmpl := util.LoadTemplate(nil, connectionsPaths...)
+	dashboardTmpl := util.LoadTemplate(nil, dashboardPaths...)
+	sessionsTmpl := util.LoadTemplate(nil, sessionsPaths...)
+	registrationsTmpl := util.LoadTemplate(nil, registrationsPaths...)
+	hostKeysTmpl := util.LoadTemplate(nil, hostKeysPaths...)
 	messageTmpl := util.LoadTemplate(nil, messagePaths...)
 	groupsTmpl := util.LoadTemplate(nil, groupsPaths...)
 	groupTmpl := util.LoadTemplate(fsBaseTpl, groupPaths...)
@@ -618,14 +760,21 @@ func loadAdminTemplates(templatesPath string) {
 	resetPwdTmpl := util.LoadTemplate(nil, resetPwdPaths...)
 	rolesTmpl := util.LoadTemplate(nil, rolesPaths...)
 	roleTmpl := util.LoadTemplate(nil, rolePaths...)
+	adminRolesTmpl := util.LoadTemplate(nil, adminRolesPaths...)
+	adminRoleTmpl := util.LoadTemplate(nil, adminRolePaths...)
 	eventsTmpl := util.LoadTemplate(nil, eventsPaths...)
 	configsTmpl := util.LoadTemplate(nil, configsPaths...)
+	analyticsTmpl := util.LoadTemplate(fsBaseTpl, analyticsPaths...)
 
 	adminTemplates[templateUsers] = usersTmpl
 	adminTemplates[templateUser] = userTmpl
 	adminTemplates[templateAdmins] = adminsTmpl
 	adminTemplates[templateAdmin] = adminTmpl
 	adminTemplates[templateConnections] = connectionsTmpl
+	adminTemplates[templateDashboard] = dashboardTmpl
+	adminTemplates[templateSessions] = sessionsTmpl
+	adminTemplates[templateRegistrations] = registrationsTmpl
+	adminTemplates[templateHostKeys] = hostKeysTmpl
 	adminTemplates[templateMessage] = messageTmpl
 	adminTemplates[templateGroups] = groupsTmpl
 	adminTemplates[templateGroup] = groupTmpl
@@ -651,8 +800,11 @@ func loadAdminTemplates(templatesPath string) {
 	adminTemplates[templateResetPassword] = resetPwdTmpl
 	adminTemplates[templateRoles] = rolesTmpl
 	adminTemplates[templateRole] = roleTmpl
+	adminTemplates[templateAdminRoles] = adminRolesTmpl
+	adminTemplates[templateAdminRole] = adminRoleTmpl
 	adminTemplates[templateEvents] = eventsTmpl
 	adminTemplates[templateConfigs] = configsTmpl
+	adminTemplates[templateAnalytics] = analyticsTmpl
 }
 
 func isEventManagerResource(currentURL string) bool {
@@ -686,7 +838,7 @@ func isIPListsResource(currentURL string) bool {
 
 func isServerManagerResource(currentURL string) bool {
 	return currentURL == webEventsPath || currentURL == webStatusPath || currentURL == webMaintenancePath ||
-		currentURL == webConfigsPath
+		currentURL == webConfigsPath || currentURL == webHostKeysPath
 }
 
 func (s *httpdServer) getBasePageData(title, currentURL string, r *http.Request) basePage {
@@ -694,6 +846,10 @@ func (s *httpdServer) getBasePageData(title, currentURL string, r *http.Request)
 	if currentURL != "" {
 		csrfToken = createCSRFToken(util.GetIPFromRemoteAddress(r.RemoteAddr))
 	}
+	var registrationsURL string
+	if registrationConfig.Enabled {
+		registrationsURL = webRegistrationsPath
+	}
 	return basePage{
 		Title:               title,
 		CurrentURL:          currentURL,
@@ -712,6 +868,9 @@ func (s *httpdServer) getBasePageData(title, currentURL string, r *http.Request)
 		IPListURL:           webIPListPath,
 		EventsURL:           webEventsPath,
 		ConfigsURL:          webConfigsPath,
+		HostKeysURL:         webHostKeysPath,
+		AnalyticsURL:        webAnalyticsPath,
+		DashboardURL:        webDashboardPath,
 		LogoutURL:           webLogoutPath,
 		ProfileURL:          webAdminProfilePath,
 		ChangePwdURL:        webChangeAdminPwdPath,
@@ -722,8 +881,12 @@ func (s *httpdServer) getBasePageData(title, currentURL string, r *http.Request)
 		EventActionURL:      webAdminEventActionPath,
 		RolesURL:            webAdminRolesPath,
 		RoleURL:             webAdminRolePath,
+		AdminRolesURL:       webAdminAdminRolesPath,
+		AdminRoleURL:        webAdminAdminRolePath,
 		QuotaScanURL:        webQuotaScanPath,
 		ConnectionsURL:      webConnectionsPath,
+		SessionsURL:         webSessionsPath,
+		RegistrationsURL:    registrationsURL,
 		StatusURL:           webStatusPath,
 		FolderQuotaScanURL:  webScanVFolderPath,
 		MaintenanceURL:      webMaintenancePath,
@@ -731,17 +894,23 @@ func (s *httpdServer) getBasePageData(title, currentURL string, r *http.Request)
 		UsersTitle:          pageUsersTitle,
 		AdminsTitle:         pageAdminsTitle,
 		ConnectionsTitle:    pageConnectionsTitle,
+		SessionsTitle:       pageSessionsTitle,
+		RegistrationsTitle:  pageRegistrationsTitle,
 		FoldersTitle:        pageFoldersTitle,
 		GroupsTitle:         pageGroupsTitle,
 		EventRulesTitle:     pageEventRulesTitle,
 		EventActionsTitle:   pageEventActionsTitle,
 		RolesTitle:          pageRolesTitle,
+		AdminRolesTitle:     pageAdminRolesTitle,
 		StatusTitle:         pageStatusTitle,
 		MaintenanceTitle:    pageMaintenanceTitle,
 		DefenderTitle:       pageDefenderTitle,
 		IPListsTitle:        pageIPListsTitle,
 		EventsTitle:         pageEventsTitle,
 		ConfigsTitle:        pageConfigsTitle,
+		HostKeysTitle:       pageHostKeysTitle,
+		AnalyticsTitle:      pageAnalyticsTitle,
+		DashboardTitle:      pageDashboardTitle,
 		Version:             version.GetAsString(),
 		LoggedAdmin:         getAdminFromToken(r),
 		IsEventManagerPage:  isEventManagerResource(currentURL),
@@ -916,6 +1085,7 @@ func (s *httpdServer) renderConfigsPage(w http.ResponseWriter, r *http.Request,
 	data := configsPage{
 		basePage:          s.getBasePageData(pageConfigsTitle, webConfigsPath, r),
 		Configs:           configs,
+		UsernameAliases:   configs.GetUsernameAliasesAsString(),
 		ConfigSection:     section,
 		RedactedSecret:    redactedSecret,
 		OAuth2TokenURL:    webOAuth2TokenPath,
@@ -941,7 +1111,7 @@ func (s *httpdServer) renderAdminSetupPage(w http.ResponseWriter, r *http.Reques
 
 func (s *httpdServer) renderAddUpdateAdminPage(w http.ResponseWriter, r *http.Request, admin *dataprovider.Admin,
 	error string, isAdd bool) {
-	groups, err := s.getWebGroups(w, r, defaultQueryLimit, true)
+	groups, err := s.getWebGroups(w, r, defaultQueryLimit, true, "")
 	if err != nil {
 		return
 	}
@@ -949,6 +1119,10 @@ func (s *httpdServer) renderAddUpdateAdminPage(w http.ResponseWriter, r *http.Re
 	if err != nil {
 		return
 	}
+	adminRoles, err := s.getWebAdminRoles(w, r, 10, true)
+	if err != nil {
+		return
+	}
 	currentURL := webAdminPath
 	title := "Add a new admin"
 	if !isAdd {
@@ -956,12 +1130,13 @@ func (s *httpdServer) renderAddUpdateAdminPage(w http.ResponseWriter, r *http.Re
 		title = "Update admin"
 	}
 	data := adminPage{
-		basePage: s.getBasePageData(title, currentURL, r),
-		Admin:    admin,
-		Groups:   groups,
-		Roles:    roles,
-		Error:    error,
-		IsAdd:    isAdd,
+		basePage:   s.getBasePageData(title, currentURL, r),
+		Admin:      admin,
+		Groups:     groups,
+		Roles:      roles,
+		AdminRoles: adminRoles,
+		Error:      error,
+		IsAdd:      isAdd,
 	}
 
 	renderAdminTemplate(w, templateAdmin, data)
@@ -1014,11 +1189,11 @@ func (s *httpdServer) renderUserPage(w http.ResponseWriter, r *http.Request, use
 			return
 		}
 	}
-	folders, err := s.getWebVirtualFolders(w, r, defaultQueryLimit, true)
+	folders, err := s.getWebVirtualFolders(w, r, defaultQueryLimit, true, "")
 	if err != nil {
 		return
 	}
-	groups, err := s.getWebGroups(w, r, defaultQueryLimit, true)
+	groups, err := s.getWebGroups(w, r, defaultQueryLimit, true, "")
 	if err != nil {
 		return
 	}
@@ -1091,10 +1266,38 @@ func (s *httpdServer) renderRolePage(w http.ResponseWriter, r *http.Request, rol
 	renderAdminTemplate(w, templateRole, data)
 }
 
+func (s *httpdServer) renderAdminRolePage(w http.ResponseWriter, r *http.Request, role dataprovider.AdminRole,
+	mode genericPageMode, error string,
+) {
+	var title, currentURL string
+	switch mode {
+	case genericPageModeAdd:
+		title = "Add a new admin role"
+		currentURL = webAdminAdminRolePath
+	case genericPageModeUpdate:
+		title = "Update admin role"
+		currentURL = fmt.Sprintf("%s/%s", webAdminAdminRolePath, url.PathEscape(role.Name))
+	}
+	groups, err := s.getWebGroups(w, r, defaultQueryLimit, true, "")
+	if err != nil {
+		return
+	}
+	data := adminRolePage{
+		basePage:    s.getBasePageData(title, currentURL, r),
+		Role:        &role,
+		Groups:      groups,
+		PermObjects: dataprovider.AdminPermObjects,
+		PermActions: dataprovider.AdminPermActions,
+		Error:       error,
+		Mode:        mode,
+	}
+	renderAdminTemplate(w, templateAdminRole, data)
+}
+
 func (s *httpdServer) renderGroupPage(w http.ResponseWriter, r *http.Request, group dataprovider.Group,
 	mode genericPageMode, error string,
 ) {
-	folders, err := s.getWebVirtualFolders(w, r, defaultQueryLimit, true)
+	folders, err := s.getWebVirtualFolders(w, r, defaultQueryLimit, true, "")
 	if err != nil {
 		return
 	}
@@ -1113,16 +1316,17 @@ func (s *httpdServer) renderGroupPage(w http.ResponseWriter, r *http.Request, gr
 	group.UserSettings.FsConfig.SetEmptySecretsIfNil()
 
 	data := groupPage{
-		basePage:           s.getBasePageData(title, currentURL, r),
-		Error:              error,
-		Group:              &group,
-		Mode:               mode,
-		ValidPerms:         dataprovider.ValidPerms,
-		ValidLoginMethods:  dataprovider.ValidLoginMethods,
-		ValidProtocols:     dataprovider.ValidProtocols,
-		TwoFactorProtocols: dataprovider.MFAProtocols,
-		WebClientOptions:   sdk.WebClientOptions,
-		VirtualFolders:     folders,
+		basePage:               s.getBasePageData(title, currentURL, r),
+		Error:                  error,
+		Group:                  &group,
+		Mode:                   mode,
+		ValidPerms:             dataprovider.ValidPerms,
+		ValidLoginMethods:      dataprovider.ValidLoginMethods,
+		ValidProtocols:         dataprovider.ValidProtocols,
+		TwoFactorProtocols:     dataprovider.MFAProtocols,
+		WebClientOptions:       sdk.WebClientOptions,
+		VirtualFolders:         folders,
+		SessionPolicyProtocols: append([]string{""}, dataprovider.ValidProtocols...),
 		FsWrapper: fsWrapper{
 			Filesystem:      group.UserSettings.FsConfig,
 			IsUserPage:      false,
@@ -1156,12 +1360,20 @@ func (s *httpdServer) renderEventActionPage(w http.ResponseWriter, r *http.Reque
 	if action.Options.PwdExpirationConfig.Threshold == 0 {
 		action.Options.PwdExpirationConfig.Threshold = 10
 	}
+	if action.Options.PubKeyExpirationConfig.Threshold == 0 {
+		action.Options.PubKeyExpirationConfig.Threshold = 10
+	}
+	actions, err := s.getWebEventActions(w, r, defaultQueryLimit, true)
+	if err != nil {
+		return
+	}
 
 	data := eventActionPage{
 		basePage:       s.getBasePageData(title, currentURL, r),
 		Action:         action,
 		ActionTypes:    dataprovider.EventActionTypes,
 		FsActions:      dataprovider.FsActionTypes,
+		Actions:        actions,
 		HTTPMethods:    dataprovider.SupportedHTTPActionMethods,
 		RedactedSecret: redactedSecret,
 		Error:          error,
@@ -1388,6 +1600,66 @@ func getBandwidthLimitsFromPostFields(r *http.Request) ([]sdk.BandwidthLimit, er
 	return result, nil
 }
 
+// getBandwidthSchedulesFromPostFields returns the bandwidth schedules ordered
+// as in the submitted form, the first active schedule wins
+func getBandwidthSchedulesFromPostFields(r *http.Request) ([]dataprovider.BandwidthSchedule, error) {
+	type indexedSchedule struct {
+		idx      int
+		schedule dataprovider.BandwidthSchedule
+	}
+	var schedules []indexedSchedule
+
+	for k := range r.Form {
+		if strings.HasPrefix(k, "bandwidth_schedule_hour") {
+			hour := strings.TrimSpace(r.Form.Get(k))
+			if hour == "" {
+				continue
+			}
+			idx := strings.TrimPrefix(k, "bandwidth_schedule_hour")
+			schedule := dataprovider.BandwidthSchedule{
+				Schedule: dataprovider.Schedule{
+					Hours:      hour,
+					DayOfWeek:  strings.TrimSpace(r.Form.Get(fmt.Sprintf("bandwidth_schedule_day_of_week%s", idx))),
+					DayOfMonth: strings.TrimSpace(r.Form.Get(fmt.Sprintf("bandwidth_schedule_day_of_month%s", idx))),
+					Month:      strings.TrimSpace(r.Form.Get(fmt.Sprintf("bandwidth_schedule_month%s", idx))),
+				},
+			}
+			ul := r.Form.Get(fmt.Sprintf("upload_bandwidth_schedule%s", idx))
+			if ul != "" {
+				bandwidthUL, err := strconv.ParseInt(ul, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid upload_bandwidth_schedule%s %q: %w", idx, ul, err)
+				}
+				schedule.UploadBandwidth = bandwidthUL
+			}
+			dl := r.Form.Get(fmt.Sprintf("download_bandwidth_schedule%s", idx))
+			if dl != "" {
+				bandwidthDL, err := strconv.ParseInt(dl, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid download_bandwidth_schedule%s %q: %w", idx, dl, err)
+				}
+				schedule.DownloadBandwidth = bandwidthDL
+			}
+			position, err := strconv.Atoi(idx)
+			if err != nil {
+				position = math.MaxInt
+			}
+			schedules = append(schedules, indexedSchedule{
+				idx:      position,
+				schedule: schedule,
+			})
+		}
+	}
+	sort.SliceStable(schedules, func(i, j int) bool {
+		return schedules[i].idx < schedules[j].idx
+	})
+	result := make([]dataprovider.BandwidthSchedule, 0, len(schedules))
+	for _, s := range schedules {
+		result = append(result, s.schedule)
+	}
+	return result, nil
+}
+
 func getPatterDenyPolicyFromString(policy string) int {
 	denyPolicy := sdk.DenyPolicyDefault
 	if policy == "1" {
@@ -1561,6 +1833,7 @@ func getS3Config(r *http.Request) (vfs.S3FsConfig, error) {
 	config.Region = strings.TrimSpace(r.Form.Get("s3_region"))
 	config.AccessKey = strings.TrimSpace(r.Form.Get("s3_access_key"))
 	config.RoleARN = strings.TrimSpace(r.Form.Get("s3_role_arn"))
+	config.VaultCredentialsPath = strings.TrimSpace(r.Form.Get("s3_vault_credentials_path"))
 	config.AccessSecret = getSecretFromFormField(r, "s3_access_secret")
 	config.Endpoint = strings.TrimSpace(r.Form.Get("s3_endpoint"))
 	config.StorageClass = strings.TrimSpace(r.Form.Get("s3_storage_class"))
@@ -1583,6 +1856,8 @@ func getS3Config(r *http.Request) (vfs.S3FsConfig, error) {
 		return config, fmt.Errorf("invalid s3 download concurrency: %w", err)
 	}
 	config.ForcePathStyle = r.Form.Get("s3_force_path_style") != ""
+	config.UseAccelerateEndpoint = r.Form.Get("s3_use_accelerate_endpoint") != ""
+	config.AdaptiveUploadPartSize = r.Form.Get("s3_adaptive_upload_part_size") != ""
 	config.DownloadPartMaxTime, err = strconv.Atoi(r.Form.Get("s3_download_part_max_time"))
 	if err != nil {
 		return config, fmt.Errorf("invalid s3 download part max time: %w", err)
@@ -1602,6 +1877,8 @@ func getGCSConfig(r *http.Request) (vfs.GCSFsConfig, error) {
 	config.StorageClass = strings.TrimSpace(r.Form.Get("gcs_storage_class"))
 	config.ACL = strings.TrimSpace(r.Form.Get("gcs_acl"))
 	config.KeyPrefix = strings.TrimSpace(strings.TrimPrefix(r.Form.Get("gcs_key_prefix"), "/"))
+	config.BillingProject = strings.TrimSpace(r.Form.Get("gcs_billing_project"))
+	config.KMSKeyName = strings.TrimSpace(r.Form.Get("gcs_kms_key_name"))
 	uploadPartSize, err := strconv.ParseInt(r.Form.Get("gcs_upload_part_size"), 10, 64)
 	if err == nil {
 		config.UploadPartSize = uploadPartSize
@@ -1610,6 +1887,14 @@ func getGCSConfig(r *http.Request) (vfs.GCSFsConfig, error) {
 	if err == nil {
 		config.UploadPartMaxTime = uploadPartMaxTime
 	}
+	downloadPartSize, err := strconv.ParseInt(r.Form.Get("gcs_download_part_size"), 10, 64)
+	if err == nil {
+		config.DownloadPartSize = downloadPartSize
+	}
+	downloadConcurrency, err := strconv.Atoi(r.Form.Get("gcs_download_concurrency"))
+	if err == nil {
+		config.DownloadConcurrency = downloadConcurrency
+	}
 	autoCredentials := r.Form.Get("gcs_auto_credentials")
 	if autoCredentials != "" {
 		config.AutomaticCredentials = 1
@@ -1675,6 +1960,22 @@ func getHTTPFsConfig(r *http.Request) vfs.HTTPFsConfig {
 	return config
 }
 
+func getWebDAVFsConfig(r *http.Request) vfs.WebDAVFsConfig {
+	config := vfs.WebDAVFsConfig{}
+	config.Endpoint = strings.TrimSpace(r.Form.Get("webdav_endpoint"))
+	config.Username = strings.TrimSpace(r.Form.Get("webdav_username"))
+	config.SkipTLSVerify = r.Form.Get("webdav_skip_tls_verify") != ""
+	config.Password = getSecretFromFormField(r, "webdav_password")
+	config.ClientCert = strings.TrimSpace(r.Form.Get("webdav_client_cert"))
+	config.ClientKey = getSecretFromFormField(r, "webdav_client_key")
+	if r.Form.Get("webdav_equality_check_mode") != "" {
+		config.EqualityCheckMode = 1
+	} else {
+		config.EqualityCheckMode = 0
+	}
+	return config
+}
+
 func getAzureConfig(r *http.Request) (vfs.AzBlobFsConfig, error) {
 	var err error
 	config := vfs.AzBlobFsConfig{}
@@ -1686,6 +1987,7 @@ func getAzureConfig(r *http.Request) (vfs.AzBlobFsConfig, error) {
 	config.KeyPrefix = strings.TrimSpace(strings.TrimPrefix(r.Form.Get("az_key_prefix"), "/"))
 	config.AccessTier = strings.TrimSpace(r.Form.Get("az_access_tier"))
 	config.UseEmulator = r.Form.Get("az_use_emulator") != ""
+	config.SASAutoRenew = r.Form.Get("az_sas_auto_renew") != ""
 	config.UploadPartSize, err = strconv.ParseInt(r.Form.Get("az_upload_part_size"), 10, 64)
 	if err != nil {
 		return config, fmt.Errorf("invalid azure upload part size: %w", err)
@@ -1720,10 +2022,11 @@ func getOsConfigFromPostFields(r *http.Request, readBufferField, writeBufferFiel
 
 func getFsConfigFromPostFields(r *http.Request) (vfs.Filesystem, error) {
 	var fs vfs.Filesystem
-	fs.Provider = sdk.GetProviderByName(r.Form.Get("fs_provider"))
+	fs.Provider = vfs.GetProviderByName(r.Form.Get("fs_provider"))
 	switch fs.Provider {
 	case sdk.LocalFilesystemProvider:
 		fs.OSConfig = getOsConfigFromPostFields(r, "osfs_read_buffer_size", "osfs_write_buffer_size")
+		fs.DedupConfig.Enabled = r.Form.Get("osfs_dedup") != ""
 	case sdk.S3FilesystemProvider:
 		config, err := getS3Config(r)
 		if err != nil {
@@ -1745,6 +2048,7 @@ func getFsConfigFromPostFields(r *http.Request) (vfs.Filesystem, error) {
 	case sdk.CryptedFilesystemProvider:
 		fs.CryptConfig.Passphrase = getSecretFromFormField(r, "crypt_passphrase")
 		fs.CryptConfig.OSFsConfig = getOsConfigFromPostFields(r, "cryptfs_read_buffer_size", "cryptfs_write_buffer_size")
+		fs.CryptConfig.EncryptNames = r.Form.Get("crypt_encrypt_names") != ""
 	case sdk.SFTPFilesystemProvider:
 		config, err := getSFTPConfig(r)
 		if err != nil {
@@ -1753,10 +2057,43 @@ func getFsConfigFromPostFields(r *http.Request) (vfs.Filesystem, error) {
 		fs.SFTPConfig = config
 	case sdk.HTTPFilesystemProvider:
 		fs.HTTPConfig = getHTTPFsConfig(r)
+	case vfs.WebDAVFilesystemProvider:
+		fs.WebDAVConfig = getWebDAVFsConfig(r)
+	}
+	fs.PGPConfig = getPGPFsConfig(r)
+	fs.WORMConfig.Enabled = r.Form.Get("worm_enabled") != ""
+	if fs.WORMConfig.Enabled {
+		retention, err := strconv.Atoi(r.Form.Get("worm_retention"))
+		if err != nil {
+			return fs, fmt.Errorf("invalid WORM retention: %w", err)
+		}
+		fs.WORMConfig.Retention = retention
+	}
+	fs.MIMEPolicy = vfs.MIMEPolicy{
+		AllowedTypes:   getSliceFromDelimitedValues(r.Form.Get("mime_allowed_types"), ","),
+		DeniedTypes:    getSliceFromDelimitedValues(r.Form.Get("mime_denied_types"), ","),
+		CheckExtension: r.Form.Get("mime_check_extension") != "",
 	}
 	return fs, nil
 }
 
+func getPGPFsConfig(r *http.Request) vfs.PGPFsConfig {
+	const pgpPublicKeyBlockHeader = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+
+	config := vfs.PGPFsConfig{}
+	// the public keys are concatenated in the same field, we split them
+	// so each key is validated on its own
+	for _, key := range strings.Split(r.Form.Get("pgp_public_keys"), pgpPublicKeyBlockHeader) {
+		if strings.TrimSpace(key) != "" {
+			config.PublicKeys = append(config.PublicKeys, pgpPublicKeyBlockHeader+key)
+		}
+	}
+	config.PrivateKey = getSecretFromFormField(r, "pgp_private_key")
+	config.Passphrase = getSecretFromFormField(r, "pgp_passphrase")
+	config.DecryptUsers = getSliceFromDelimitedValues(r.Form.Get("pgp_decrypt_users"), ",")
+	return config
+}
+
 func getAdminHiddenUserPageSections(r *http.Request) int {
 	var result int
 
@@ -1798,6 +2135,7 @@ func getAdminFromPostFields(r *http.Request) (dataprovider.Admin, error) {
 	admin.Email = strings.TrimSpace(r.Form.Get("email"))
 	admin.Status = status
 	admin.Role = strings.TrimSpace(r.Form.Get("role"))
+	admin.AdminRole = strings.TrimSpace(r.Form.Get("admin_role"))
 	admin.Filters.AllowList = getSliceFromDelimitedValues(r.Form.Get("allowed_ip"), ",")
 	admin.Filters.AllowAPIKeyAuth = r.Form.Get("allow_api_key_auth") != ""
 	admin.AdditionalInfo = r.Form.Get("additional_info")
@@ -1842,6 +2180,34 @@ func replacePlaceholders(field string, replacements map[string]string) string {
 	return field
 }
 
+func getFolderLimitsFromPostFields(r *http.Request) (*vfs.FolderLimits, error) {
+	var limits vfs.FolderLimits
+	var err error
+
+	if val := r.Form.Get("folder_upload_bandwidth"); val != "" {
+		limits.UploadBandwidth, err = strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upload bandwidth: %w", err)
+		}
+	}
+	if val := r.Form.Get("folder_download_bandwidth"); val != "" {
+		limits.DownloadBandwidth, err = strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid download bandwidth: %w", err)
+		}
+	}
+	if val := r.Form.Get("folder_max_transfers"); val != "" {
+		limits.MaxConcurrentTransfers, err = strconv.Atoi(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max concurrent transfers: %w", err)
+		}
+	}
+	if !limits.HasLimits() {
+		return nil, nil
+	}
+	return &limits, nil
+}
+
 func getFolderFromTemplate(folder vfs.BaseVirtualFolder, name string) vfs.BaseVirtualFolder {
 	folder.Name = name
 	replacements := make(map[string]string)
@@ -1862,6 +2228,8 @@ func getFolderFromTemplate(folder vfs.BaseVirtualFolder, name string) vfs.BaseVi
 		folder.FsConfig.SFTPConfig = getSFTPFsFromTemplate(folder.FsConfig.SFTPConfig, replacements)
 	case sdk.HTTPFilesystemProvider:
 		folder.FsConfig.HTTPConfig = getHTTPFsFromTemplate(folder.FsConfig.HTTPConfig, replacements)
+	case vfs.WebDAVFilesystemProvider:
+		folder.FsConfig.WebDAVConfig = getWebDAVFsFromTemplate(folder.FsConfig.WebDAVConfig, replacements)
 	}
 
 	return folder
@@ -1917,6 +2285,12 @@ func getHTTPFsFromTemplate(fsConfig vfs.HTTPFsConfig, replacements map[string]st
 	return fsConfig
 }
 
+func getWebDAVFsFromTemplate(fsConfig vfs.WebDAVFsConfig, replacements map[string]string) vfs.WebDAVFsConfig {
+	fsConfig.Endpoint = replacePlaceholders(fsConfig.Endpoint, replacements)
+	fsConfig.Username = replacePlaceholders(fsConfig.Username, replacements)
+	return fsConfig
+}
+
 func getUserFromTemplate(user dataprovider.User, template userTemplateFields) dataprovider.User {
 	user.Username = template.Username
 	user.Password = template.Password
@@ -1928,6 +2302,10 @@ func getUserFromTemplate(user dataprovider.User, template userTemplateFields) da
 		replacements["%password%"] = user.Password
 	}
 
+	return applyUserTemplateReplacements(user, replacements)
+}
+
+func applyUserTemplateReplacements(user dataprovider.User, replacements map[string]string) dataprovider.User {
 	user.HomeDir = replacePlaceholders(user.HomeDir, replacements)
 	var vfolders []vfs.VirtualFolder
 	for _, vfolder := range user.VirtualFolders {
@@ -1953,6 +2331,8 @@ func getUserFromTemplate(user dataprovider.User, template userTemplateFields) da
 		user.FsConfig.SFTPConfig = getSFTPFsFromTemplate(user.FsConfig.SFTPConfig, replacements)
 	case sdk.HTTPFilesystemProvider:
 		user.FsConfig.HTTPConfig = getHTTPFsFromTemplate(user.FsConfig.HTTPConfig, replacements)
+	case vfs.WebDAVFilesystemProvider:
+		user.FsConfig.WebDAVConfig = getWebDAVFsFromTemplate(user.FsConfig.WebDAVConfig, replacements)
 	}
 
 	return user
@@ -2034,6 +2414,15 @@ func getUserFromPostFields(r *http.Request) (dataprovider.User, error) {
 		}
 		expirationDateMillis = util.GetTimeAsMsSinceEpoch(expirationDate)
 	}
+	activationDateMillis := int64(0)
+	activationDateString := r.Form.Get("activation_date")
+	if strings.TrimSpace(activationDateString) != "" {
+		activationDate, err := time.Parse(webDateTimeFormat, activationDateString)
+		if err != nil {
+			return user, err
+		}
+		activationDateMillis = util.GetTimeAsMsSinceEpoch(activationDate)
+	}
 	fsConfig, err := getFsConfigFromPostFields(r)
 	if err != nil {
 		return user, err
@@ -2042,6 +2431,22 @@ func getUserFromPostFields(r *http.Request) (dataprovider.User, error) {
 	if err != nil {
 		return user, err
 	}
+	bwSchedules, err := getBandwidthSchedulesFromPostFields(r)
+	if err != nil {
+		return user, err
+	}
+	accessWindows, err := getAccessWindowsFromPostFields(r)
+	if err != nil {
+		return user, err
+	}
+	ftpMaxTransfers, err := getFTPMaxTransfersFromPostFields(r)
+	if err != nil {
+		return user, err
+	}
+	passivePortRange, err := getPassivePortRangeFromPostFields(r)
+	if err != nil {
+		return user, err
+	}
 	user = dataprovider.User{
 		BaseUser: sdk.BaseUser{
 			Username:             strings.TrimSpace(r.Form.Get("username")),
@@ -2067,8 +2472,23 @@ func getUserFromPostFields(r *http.Request) (dataprovider.User, error) {
 			Role:                 strings.TrimSpace(r.Form.Get("role")),
 		},
 		Filters: dataprovider.UserFilters{
-			BaseUserFilters:       filters,
-			RequirePasswordChange: r.Form.Get("require_password_change") != "",
+			BaseUserFilters:        filters,
+			RequirePasswordChange:  r.Form.Get("require_password_change") != "",
+			ClientEncryptedFolders: getSliceFromDelimitedValues(r.Form.Get("client_encrypted_folders"), ","),
+			StagingFolders:         getSliceFromDelimitedValues(r.Form.Get("staging_folders"), ","),
+			StoreChecksums:         r.Form.Get("store_checksums") != "",
+			BandwidthSchedules:     bwSchedules,
+			PriorityClass:          strings.TrimSpace(r.Form.Get("priority_class")),
+			FTPMaxTransfers:        ftpMaxTransfers,
+			PassivePortRange:       passivePortRange,
+			AccessWindows:          accessWindows,
+			AccessTimezone:         strings.TrimSpace(r.Form.Get("access_timezone")),
+			ActivationDate:         activationDateMillis,
+			TrustedCAKeys:          getSliceFromDelimitedValues(r.Form.Get("trusted_ca_keys"), "\n"),
+			CertPrincipals:         getSliceFromDelimitedValues(r.Form.Get("cert_principals"), ","),
+			SFTPOnly:               r.Form.Get("sftp_only") != "",
+			AllowedSSHCommands:     getSliceFromDelimitedValues(r.Form.Get("allowed_ssh_commands"), ","),
+			DeniedSSHCommands:      getSliceFromDelimitedValues(r.Form.Get("denied_ssh_commands"), ","),
 		},
 		VirtualFolders: getVirtualFoldersFromPostFields(r),
 		FsConfig:       fsConfig,
@@ -2077,6 +2497,197 @@ func getUserFromPostFields(r *http.Request) (dataprovider.User, error) {
 	return user, nil
 }
 
+func getSessionPoliciesFromPostFields(r *http.Request) ([]dataprovider.SessionPolicy, error) {
+	var policies []dataprovider.SessionPolicy
+	for _, protocol := range append([]string{""}, dataprovider.ValidProtocols...) {
+		key := protocol
+		if key == "" {
+			key = "all"
+		}
+		var values [3]int
+		for idx, name := range []string{"session_idle_timeout_", "session_keepalive_", "session_max_duration_"} {
+			val := strings.TrimSpace(r.Form.Get(name + key))
+			if val == "" {
+				continue
+			}
+			v, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid session policy for protocol %q: %w", key, err)
+			}
+			values[idx] = v
+		}
+		policy := dataprovider.SessionPolicy{
+			IdleTimeout:        values[0],
+			KeepaliveInterval:  values[1],
+			MaxSessionDuration: values[2],
+		}
+		if protocol != "" {
+			policy.Protocols = []string{protocol}
+		}
+		if !policy.IsEmpty() {
+			policies = append(policies, policy)
+		}
+	}
+	return policies, nil
+}
+
+// getAccessWindowsFromPostFields returns the access windows ordered as in the
+// submitted form
+func getAccessWindowsFromPostFields(r *http.Request) ([]dataprovider.AccessWindow, error) {
+	type indexedWindow struct {
+		idx    int
+		window dataprovider.AccessWindow
+	}
+	var windows []indexedWindow
+
+	for k := range r.Form {
+		if !strings.HasPrefix(k, "access_window_from") {
+			continue
+		}
+		idx := strings.TrimPrefix(k, "access_window_from")
+		window := dataprovider.AccessWindow{
+			From: strings.TrimSpace(r.Form.Get(k)),
+			To:   strings.TrimSpace(r.Form.Get(fmt.Sprintf("access_window_to%s", idx))),
+		}
+		if window.From == "" && window.To == "" {
+			continue
+		}
+		for _, val := range r.Form[fmt.Sprintf("access_window_days%s", idx)] {
+			day, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid access_window_days%s %q: %w", idx, val, err)
+			}
+			window.DaysOfWeek = append(window.DaysOfWeek, day)
+		}
+		position, err := strconv.Atoi(idx)
+		if err != nil {
+			position = math.MaxInt
+		}
+		windows = append(windows, indexedWindow{
+			idx:    position,
+			window: window,
+		})
+	}
+	sort.SliceStable(windows, func(i, j int) bool {
+		return windows[i].idx < windows[j].idx
+	})
+	var result []dataprovider.AccessWindow
+	for _, w := range windows {
+		result = append(result, w.window)
+	}
+	return result, nil
+}
+
+func getGroupOverridePermissions(value string) (map[string][]string, error) {
+	permissions := make(map[string][]string)
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		dir, perms, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid permissions %q, the expected format is \"/dir: perm1,perm2\"", line)
+		}
+		permissions[strings.TrimSpace(dir)] = getSliceFromDelimitedValues(perms, ",")
+	}
+	return permissions, nil
+}
+
+// getGroupOverridesFromPostFields returns the conditional overrides ordered
+// as in the submitted form, the first matching override wins
+func getGroupOverridesFromPostFields(r *http.Request) ([]dataprovider.GroupOverride, error) {
+	type indexedOverride struct {
+		idx      int
+		override dataprovider.GroupOverride
+	}
+	var overrides []indexedOverride
+
+	for k := range r.Form {
+		if !strings.HasPrefix(k, "override_sources") {
+			continue
+		}
+		idx := strings.TrimPrefix(k, "override_sources")
+		override := dataprovider.GroupOverride{
+			Protocols:      r.Form[fmt.Sprintf("override_protocols%s", idx)],
+			SourceNetworks: getSliceFromDelimitedValues(r.Form.Get(k), ","),
+		}
+		ul := strings.TrimSpace(r.Form.Get(fmt.Sprintf("override_upload_bandwidth%s", idx)))
+		if ul != "" {
+			bandwidthUL, err := strconv.ParseInt(ul, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid override_upload_bandwidth%s %q: %w", idx, ul, err)
+			}
+			override.UploadBandwidth = bandwidthUL
+		}
+		dl := strings.TrimSpace(r.Form.Get(fmt.Sprintf("override_download_bandwidth%s", idx)))
+		if dl != "" {
+			bandwidthDL, err := strconv.ParseInt(dl, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid override_download_bandwidth%s %q: %w", idx, dl, err)
+			}
+			override.DownloadBandwidth = bandwidthDL
+		}
+		permissions, err := getGroupOverridePermissions(r.Form.Get(fmt.Sprintf("override_permissions%s", idx)))
+		if err != nil {
+			return nil, err
+		}
+		if len(permissions) > 0 {
+			override.Permissions = permissions
+		}
+		if len(override.Protocols) == 0 && len(override.SourceNetworks) == 0 &&
+			override.UploadBandwidth == 0 && override.DownloadBandwidth == 0 && len(override.Permissions) == 0 {
+			continue
+		}
+		position, err := strconv.Atoi(idx)
+		if err != nil {
+			position = math.MaxInt
+		}
+		overrides = append(overrides, indexedOverride{
+			idx:      position,
+			override: override,
+		})
+	}
+	sort.SliceStable(overrides, func(i, j int) bool {
+		return overrides[i].idx < overrides[j].idx
+	})
+	var result []dataprovider.GroupOverride
+	for _, o := range overrides {
+		result = append(result, o.override)
+	}
+	return result, nil
+}
+
+func getFTPMaxTransfersFromPostFields(r *http.Request) (int, error) {
+	val := strings.TrimSpace(r.Form.Get("ftp_max_transfers"))
+	if val == "" {
+		return 0, nil
+	}
+	maxTransfers, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid FTP max transfers: %w", err)
+	}
+	return maxTransfers, nil
+}
+
+func getPassivePortRangeFromPostFields(r *http.Request) (dataprovider.PortRange, error) {
+	var portRange dataprovider.PortRange
+	var err error
+	if val := strings.TrimSpace(r.Form.Get("passive_port_start")); val != "" {
+		portRange.Start, err = strconv.Atoi(val)
+		if err != nil {
+			return portRange, fmt.Errorf("invalid passive port range start: %w", err)
+		}
+	}
+	if val := strings.TrimSpace(r.Form.Get("passive_port_end")); val != "" {
+		portRange.End, err = strconv.Atoi(val)
+		if err != nil {
+			return portRange, fmt.Errorf("invalid passive port range end: %w", err)
+		}
+	}
+	return portRange, nil
+}
+
 func getGroupFromPostFields(r *http.Request) (dataprovider.Group, error) {
 	group := dataprovider.Group{}
 	err := r.ParseMultipartForm(maxRequestSize)
@@ -2117,27 +2728,59 @@ func getGroupFromPostFields(r *http.Request) (dataprovider.Group, error) {
 	if err != nil {
 		return group, err
 	}
-	group = dataprovider.Group{
-		BaseGroup: sdk.BaseGroup{
-			Name:        strings.TrimSpace(r.Form.Get("name")),
-			Description: r.Form.Get("description"),
-		},
-		UserSettings: dataprovider.GroupUserSettings{
-			BaseGroupUserSettings: sdk.BaseGroupUserSettings{
-				HomeDir:              strings.TrimSpace(r.Form.Get("home_dir")),
-				MaxSessions:          maxSessions,
-				QuotaSize:            quotaSize,
-				QuotaFiles:           quotaFiles,
-				Permissions:          getSubDirPermissionsFromPostFields(r),
-				UploadBandwidth:      bandwidthUL,
-				DownloadBandwidth:    bandwidthDL,
+	sessionPolicies, err := getSessionPoliciesFromPostFields(r)
+	if err != nil {
+		return group, err
+	}
+	ftpMaxTransfers, err := getFTPMaxTransfersFromPostFields(r)
+	if err != nil {
+		return group, err
+	}
+	passivePortRange, err := getPassivePortRangeFromPostFields(r)
+	if err != nil {
+		return group, err
+	}
+	overrides, err := getGroupOverridesFromPostFields(r)
+	if err != nil {
+		return group, err
+	}
+	accessWindows, err := getAccessWindowsFromPostFields(r)
+	if err != nil {
+		return group, err
+	}
+	group = dataprovider.Group{
+		BaseGroup: sdk.BaseGroup{
+			Name:        strings.TrimSpace(r.Form.Get("name")),
+			Description: r.Form.Get("description"),
+		},
+		UserSettings: dataprovider.GroupUserSettings{
+			BaseGroupUserSettings: sdk.BaseGroupUserSettings{
+				HomeDir:              strings.TrimSpace(r.Form.Get("home_dir")),
+				MaxSessions:          maxSessions,
+				QuotaSize:            quotaSize,
+				QuotaFiles:           quotaFiles,
+				Permissions:          getSubDirPermissionsFromPostFields(r),
+				UploadBandwidth:      bandwidthUL,
+				DownloadBandwidth:    bandwidthDL,
 				UploadDataTransfer:   dataTransferUL,
 				DownloadDataTransfer: dataTransferDL,
 				TotalDataTransfer:    dataTransferTotal,
 				ExpiresIn:            expiresIn,
 				Filters:              filters,
 			},
-			FsConfig: fsConfig,
+			FsConfig:           fsConfig,
+			SessionPolicies:    sessionPolicies,
+			PriorityClass:      strings.TrimSpace(r.Form.Get("priority_class")),
+			FTPMaxTransfers:    ftpMaxTransfers,
+			PassivePortRange:   passivePortRange,
+			Overrides:          overrides,
+			AccessWindows:      accessWindows,
+			AccessTimezone:     strings.TrimSpace(r.Form.Get("access_timezone")),
+			TrustedCAKeys:      getSliceFromDelimitedValues(r.Form.Get("trusted_ca_keys"), "\n"),
+			CertPrincipals:     getSliceFromDelimitedValues(r.Form.Get("cert_principals"), ","),
+			SFTPOnly:           r.Form.Get("sftp_only") != "",
+			AllowedSSHCommands: getSliceFromDelimitedValues(r.Form.Get("allowed_ssh_commands"), ","),
+			DeniedSSHCommands:  getSliceFromDelimitedValues(r.Form.Get("denied_ssh_commands"), ","),
 		},
 		VirtualFolders: getVirtualFoldersFromPostFields(r),
 	}
@@ -2162,6 +2805,25 @@ func getKeyValsFromPostFields(r *http.Request, key, val string) []dataprovider.K
 	return res
 }
 
+// getPGPEncryptPathsFromPostFields returns the paths to encrypt, unlike the
+// other key values an empty target is allowed
+func getPGPEncryptPathsFromPostFields(r *http.Request) []dataprovider.KeyValue {
+	var res []dataprovider.KeyValue
+	for k := range r.Form {
+		if strings.HasPrefix(k, "fs_pgp_source") {
+			source := strings.TrimSpace(r.Form.Get(k))
+			if source != "" {
+				idx := strings.TrimPrefix(k, "fs_pgp_source")
+				res = append(res, dataprovider.KeyValue{
+					Key:   source,
+					Value: strings.TrimSpace(r.Form.Get(fmt.Sprintf("fs_pgp_target%s", idx))),
+				})
+			}
+		}
+	}
+	return res
+}
+
 func getFoldersRetentionFromPostFields(r *http.Request) ([]dataprovider.FolderRetention, error) {
 	var res []dataprovider.FolderRetention
 	for k := range r.Form {
@@ -2186,6 +2848,84 @@ func getFoldersRetentionFromPostFields(r *http.Request) ([]dataprovider.FolderRe
 	return res, nil
 }
 
+func getTieringPoliciesFromPostFields(r *http.Request) ([]dataprovider.TieringPolicy, error) {
+	var res []dataprovider.TieringPolicy
+	for k := range r.Form {
+		if strings.HasPrefix(k, "tiering_path") {
+			policyPath := strings.TrimSpace(r.Form.Get(k))
+			if policyPath != "" {
+				idx := strings.TrimPrefix(k, "tiering_path")
+				var minAge, minIdleTime int
+				var err error
+				if val := r.Form.Get(fmt.Sprintf("tiering_min_age%s", idx)); val != "" {
+					minAge, err = strconv.Atoi(val)
+					if err != nil {
+						return nil, fmt.Errorf("invalid tiering min age for path %q: %w", policyPath, err)
+					}
+				}
+				if val := r.Form.Get(fmt.Sprintf("tiering_min_idle_time%s", idx)); val != "" {
+					minIdleTime, err = strconv.Atoi(val)
+					if err != nil {
+						return nil, fmt.Errorf("invalid tiering min idle time for path %q: %w", policyPath, err)
+					}
+				}
+				var minSize int64
+				if val := strings.TrimSpace(r.Form.Get(fmt.Sprintf("tiering_min_size%s", idx))); val != "" {
+					minSize, err = util.ParseBytes(val)
+					if err != nil {
+						return nil, fmt.Errorf("invalid tiering min size for path %q: %w", policyPath, err)
+					}
+				}
+				res = append(res, dataprovider.TieringPolicy{
+					Path:        policyPath,
+					MinAge:      minAge,
+					MinIdleTime: minIdleTime,
+					MinSize:     minSize,
+				})
+			}
+		}
+	}
+	return res, nil
+}
+
+func getWorkflowStepsFromPostFields(r *http.Request) []dataprovider.WorkflowStep {
+	type indexedStep struct {
+		idx  int
+		step dataprovider.WorkflowStep
+	}
+	var steps []indexedStep
+	for k := range r.Form {
+		if strings.HasPrefix(k, "workflow_step_action") {
+			action := strings.TrimSpace(r.Form.Get(k))
+			if action != "" {
+				idx := strings.TrimPrefix(k, "workflow_step_action")
+				order, err := strconv.Atoi(idx)
+				if err != nil {
+					continue
+				}
+				steps = append(steps, indexedStep{
+					idx: order,
+					step: dataprovider.WorkflowStep{
+						Name:      strings.TrimSpace(r.Form.Get(fmt.Sprintf("workflow_step_name%s", idx))),
+						Action:    action,
+						OnSuccess: strings.TrimSpace(r.Form.Get(fmt.Sprintf("workflow_step_on_success%s", idx))),
+						OnFailure: strings.TrimSpace(r.Form.Get(fmt.Sprintf("workflow_step_on_failure%s", idx))),
+					},
+				})
+			}
+		}
+	}
+	// the step order matters, form fields are unordered
+	sort.Slice(steps, func(i, j int) bool {
+		return steps[i].idx < steps[j].idx
+	})
+	res := make([]dataprovider.WorkflowStep, 0, len(steps))
+	for _, s := range steps {
+		res = append(res, s.step)
+	}
+	return res
+}
+
 func getHTTPPartsFromPostFields(r *http.Request) []dataprovider.HTTPPart {
 	var result []dataprovider.HTTPPart
 	for k := range r.Form {
@@ -2239,6 +2979,10 @@ func getEventActionOptionsFromPostFields(r *http.Request) (dataprovider.BaseEven
 	if err != nil {
 		return dataprovider.BaseEventActionOptions{}, err
 	}
+	tieringPolicies, err := getTieringPoliciesFromPostFields(r)
+	if err != nil {
+		return dataprovider.BaseEventActionOptions{}, err
+	}
 	fsActionType, err := strconv.Atoi(r.Form.Get("fs_action_type"))
 	if err != nil {
 		return dataprovider.BaseEventActionOptions{}, fmt.Errorf("invalid fs action type: %w", err)
@@ -2247,6 +2991,10 @@ func getEventActionOptionsFromPostFields(r *http.Request) (dataprovider.BaseEven
 	if err != nil {
 		return dataprovider.BaseEventActionOptions{}, fmt.Errorf("invalid password expiration threshold: %w", err)
 	}
+	pubKeyExpirationThreshold, err := strconv.Atoi(r.Form.Get("pubkey_expiration_threshold"))
+	if err != nil {
+		return dataprovider.BaseEventActionOptions{}, fmt.Errorf("invalid public key expiration threshold: %w", err)
+	}
 	var emailAttachments []string
 	if r.Form.Get("email_attachments") != "" {
 		emailAttachments = getSliceFromDelimitedValues(r.Form.Get("email_attachments"), ",")
@@ -2263,6 +3011,13 @@ func getEventActionOptionsFromPostFields(r *http.Request) (dataprovider.BaseEven
 	if r.Form.Get("email_content_type") == "1" {
 		emailContentType = 1
 	}
+	reportPeriod := 0
+	if val := strings.TrimSpace(r.Form.Get("report_period")); val != "" {
+		reportPeriod, err = strconv.Atoi(val)
+		if err != nil {
+			return dataprovider.BaseEventActionOptions{}, fmt.Errorf("invalid report period: %w", err)
+		}
+	}
 	options := dataprovider.BaseEventActionOptions{
 		HTTPConfig: dataprovider.EventActionHTTPConfig{
 			Endpoint:        strings.TrimSpace(r.Form.Get("http_endpoint")),
@@ -2304,15 +3059,38 @@ func getEventActionOptionsFromPostFields(r *http.Request) (dataprovider.BaseEven
 				Name:  strings.TrimSpace(r.Form.Get("fs_compress_name")),
 				Paths: getSliceFromDelimitedValues(r.Form.Get("fs_compress_paths"), ","),
 			},
+			PGPEncrypt: dataprovider.EventActionFsPGPEncrypt{
+				Paths:        getPGPEncryptPathsFromPostFields(r),
+				PublicKey:    r.Form.Get("fs_pgp_public_key"),
+				RemoveSource: r.Form.Get("fs_pgp_remove_source") != "",
+			},
 		},
 		PwdExpirationConfig: dataprovider.EventActionPasswordExpiration{
 			Threshold: pwdExpirationThreshold,
 		},
+		PubKeyExpirationConfig: dataprovider.EventActionPublicKeyExpiration{
+			Threshold: pubKeyExpirationThreshold,
+		},
 		IDPConfig: dataprovider.EventActionIDPAccountCheck{
 			Mode:          idpMode,
 			TemplateUser:  strings.TrimSpace(r.Form.Get("idp_user")),
 			TemplateAdmin: strings.TrimSpace(r.Form.Get("idp_admin")),
 		},
+		TieringConfig: dataprovider.EventActionTieringConfig{
+			Folder:   strings.TrimSpace(r.Form.Get("tiering_folder")),
+			Policies: tieringPolicies,
+		},
+		WorkflowConfig: dataprovider.EventActionWorkflowConfig{
+			Steps: getWorkflowStepsFromPostFields(r),
+		},
+		ReportConfig: dataprovider.EventActionReportConfig{
+			Reports:    r.Form["report_types"],
+			Format:     r.Form.Get("report_format"),
+			Period:     reportPeriod,
+			Recipients: getSliceFromDelimitedValues(r.Form.Get("report_recipients"), ","),
+			Folder:     strings.TrimSpace(r.Form.Get("report_folder")),
+			Path:       strings.TrimSpace(r.Form.Get("report_path")),
+		},
 	}
 	return options, nil
 }
@@ -2454,6 +3232,12 @@ func getEventRuleActionsFromPostFields(r *http.Request) ([]dataprovider.EventAct
 					return actions, fmt.Errorf("invalid order: %w", err)
 				}
 				options := r.Form[fmt.Sprintf("action_options%s", idx)]
+				digest := 0
+				if util.Contains(options, "5") {
+					digest = dataprovider.DigestIntervalDaily
+				} else if util.Contains(options, "4") {
+					digest = dataprovider.DigestIntervalHourly
+				}
 				actions = append(actions, dataprovider.EventAction{
 					BaseEventAction: dataprovider.BaseEventAction{
 						Name: name,
@@ -2463,6 +3247,7 @@ func getEventRuleActionsFromPostFields(r *http.Request) ([]dataprovider.EventAct
 						IsFailureAction: util.Contains(options, "1"),
 						StopOnFailure:   util.Contains(options, "2"),
 						ExecuteSync:     util.Contains(options, "3"),
+						Digest:          digest,
 					},
 				})
 			}
@@ -2515,6 +3300,22 @@ func getRoleFromPostFields(r *http.Request) (dataprovider.Role, error) {
 	}, nil
 }
 
+func getAdminRoleFromPostFields(r *http.Request) (dataprovider.AdminRole, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return dataprovider.AdminRole{}, err
+	}
+
+	return dataprovider.AdminRole{
+		Name:        strings.TrimSpace(r.Form.Get("name")),
+		Description: r.Form.Get("description"),
+		Permissions: r.Form["permissions"],
+		Filters: dataprovider.AdminRoleFilters{
+			UserGroups: r.Form["user_groups"],
+		},
+	}, nil
+}
+
 func getIPListEntryFromPostFields(r *http.Request, listType dataprovider.IPListType) (dataprovider.IPListEntry, error) {
 	err := r.ParseForm()
 	if err != nil {
@@ -2547,12 +3348,29 @@ func getIPListEntryFromPostFields(r *http.Request, listType dataprovider.IPListT
 
 func getSFTPConfigsFromPostFields(r *http.Request) *dataprovider.SFTPDConfigs {
 	return &dataprovider.SFTPDConfigs{
-		HostKeyAlgos:  r.Form["sftp_host_key_algos"],
-		Moduli:        getSliceFromDelimitedValues(r.Form.Get("sftp_moduli"), ","),
-		KexAlgorithms: r.Form["sftp_kex_algos"],
-		Ciphers:       r.Form["sftp_ciphers"],
-		MACs:          r.Form["sftp_macs"],
+		HostKeyAlgos:    r.Form["sftp_host_key_algos"],
+		Moduli:          getSliceFromDelimitedValues(r.Form.Get("sftp_moduli"), ","),
+		KexAlgorithms:   r.Form["sftp_kex_algos"],
+		Ciphers:         r.Form["sftp_ciphers"],
+		MACs:            r.Form["sftp_macs"],
+		SecurityProfile: strings.TrimSpace(r.Form.Get("sftp_security_profile")),
+	}
+}
+
+func getUsernameAliasesFromPostFields(r *http.Request) (map[string]string, error) {
+	aliases := make(map[string]string)
+	for _, line := range strings.Split(r.Form.Get("username_aliases"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		alias, username, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, util.NewValidationError(fmt.Sprintf("invalid username alias %q, the format is alias:username", line))
+		}
+		aliases[strings.TrimSpace(alias)] = strings.TrimSpace(username)
 	}
+	return aliases, nil
 }
 
 func getACMEConfigsFromPostFields(r *http.Request) *dataprovider.ACMEConfigs {
@@ -2714,7 +3532,7 @@ func (s *httpdServer) handleWebAdminProfilePost(w http.ResponseWriter, r *http.R
 	admin.Filters.AllowAPIKeyAuth = r.Form.Get("allow_api_key_auth") != ""
 	admin.Email = r.Form.Get("email")
 	admin.Description = r.Form.Get("description")
-	err = dataprovider.UpdateAdmin(&admin, dataprovider.ActionExecutorSelf, ipAddr, admin.Role)
+	err = dataprovider.UpdateAdminContext(r.Context(), &admin, dataprovider.ActionExecutorSelf, ipAddr, admin.Role)
 	if err != nil {
 		s.renderProfilePage(w, r, err.Error())
 		return
@@ -2773,7 +3591,7 @@ func (s *httpdServer) handleWebRestore(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := restoreBackup(backupContent, "", scanQuota, restoreMode, claims.Username, ipAddr, claims.Role); err != nil {
+	if err := restoreBackup(r.Context(), backupContent, "", scanQuota, restoreMode, claims.Username, ipAddr, claims.Role); err != nil {
 		s.renderMaintenancePage(w, r, err.Error())
 		return
 	}
@@ -2861,7 +3679,7 @@ func (s *httpdServer) handleWebAddAdminPost(w http.ResponseWriter, r *http.Reque
 		s.renderForbiddenPage(w, r, err.Error())
 		return
 	}
-	err = dataprovider.AddAdmin(&admin, claims.Username, ipAddr, claims.Role)
+	err = dataprovider.AddAdminContext(r.Context(), &admin, claims.Username, ipAddr, claims.Role)
 	if err != nil {
 		s.renderAddUpdateAdminPage(w, r, &admin, err.Error(), true)
 		return
@@ -2905,7 +3723,7 @@ func (s *httpdServer) handleWebUpdateAdminPost(w http.ResponseWriter, r *http.Re
 		return
 	}
 	if username == claims.Username {
-		if claims.isCriticalPermRemoved(updatedAdmin.Permissions) {
+		if claims.isCriticalPermRemoved(&updatedAdmin) {
 			s.renderAddUpdateAdminPage(w, r, &updatedAdmin, "You cannot remove these permissions to yourself", false)
 			return
 		}
@@ -2918,7 +3736,7 @@ func (s *httpdServer) handleWebUpdateAdminPost(w http.ResponseWriter, r *http.Re
 			return
 		}
 	}
-	err = dataprovider.UpdateAdmin(&updatedAdmin, claims.Username, ipAddr, claims.Role)
+	err = dataprovider.UpdateAdminContext(r.Context(), &updatedAdmin, claims.Username, ipAddr, claims.Role)
 	if err != nil {
 		s.renderAddUpdateAdminPage(w, r, &updatedAdmin, err.Error(), false)
 		return
@@ -2954,13 +3772,15 @@ func (s *httpdServer) handleGetWebUsers(w http.ResponseWriter, r *http.Request)
 		limit = defaultQueryLimit
 	}
 	users := make([]dataprovider.User, 0, limit)
-	for {
-		u, err := dataprovider.GetUsers(limit, len(users), dataprovider.OrderASC, claims.Role)
+	for offset := 0; ; offset += limit {
+		u, err := dataprovider.GetUsers(limit, offset, dataprovider.OrderASC, claims.Role)
 		if err != nil {
 			s.renderInternalServerErrorPage(w, r, err)
 			return
 		}
-		users = append(users, u...)
+		// the offset is based on the provider results, the users out of
+		// scope are filtered for each batch
+		users = append(users, claims.filterUsersInScope(u)...)
 		if len(u) < limit {
 			break
 		}
@@ -2974,9 +3794,14 @@ func (s *httpdServer) handleGetWebUsers(w http.ResponseWriter, r *http.Request)
 
 func (s *httpdServer) handleWebTemplateFolderGet(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		s.renderBadRequestPage(w, r, errors.New("invalid token claims"))
+		return
+	}
 	if r.URL.Query().Get("from") != "" {
 		name := r.URL.Query().Get("from")
-		folder, err := dataprovider.GetFolderByName(name)
+		folder, err := claims.getFolder(name)
 		if err == nil {
 			folder.FsConfig.SetEmptySecrets()
 			s.renderFolderPage(w, r, folder, folderPageModeTemplate, "")
@@ -3020,6 +3845,11 @@ func (s *httpdServer) handleWebTemplateFolderPost(w http.ResponseWriter, r *http
 		return
 	}
 	templateFolder.FsConfig = fsConfig
+	templateFolder.Limits, err = getFolderLimitsFromPostFields(r)
+	if err != nil {
+		s.renderMessagePage(w, r, "Error parsing folders fields", "", http.StatusBadRequest, err, "")
+		return
+	}
 
 	var dump dataprovider.BackupData
 	dump.Version = dataprovider.DumpVersion
@@ -3056,15 +3886,19 @@ func (s *httpdServer) handleWebTemplateFolderPost(w http.ResponseWriter, r *http
 
 func (s *httpdServer) handleWebTemplateUserGet(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
-	tokenAdmin := getAdminFromToken(r)
-	admin, err := dataprovider.AdminExists(tokenAdmin.Username)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		s.renderBadRequestPage(w, r, errors.New("invalid token claims"))
+		return
+	}
+	admin, err := dataprovider.AdminExists(claims.Username)
 	if err != nil {
-		s.renderInternalServerErrorPage(w, r, fmt.Errorf("unable to get the admin %q: %w", tokenAdmin.Username, err))
+		s.renderInternalServerErrorPage(w, r, fmt.Errorf("unable to get the admin %q: %w", claims.Username, err))
 		return
 	}
 	if r.URL.Query().Get("from") != "" {
 		username := r.URL.Query().Get("from")
-		user, err := dataprovider.UserExists(username, admin.Role)
+		user, err := claims.getUser(username)
 		if err == nil {
 			user.SetEmptySecrets()
 			user.PublicKeys = nil
@@ -3122,6 +3956,11 @@ func (s *httpdServer) handleWebTemplateUserPost(w http.ResponseWriter, r *http.R
 				http.StatusBadRequest, err, "")
 			return
 		}
+		if err := claims.checkUserScope(&u); err != nil {
+			s.renderMessagePage(w, r, "User validation error", fmt.Sprintf("Error validating user %q", u.Username),
+				http.StatusBadRequest, err, "")
+			return
+		}
 		// to create a template the "manage_system" permission is required, so role admins cannot use
 		// this method, we don't need to force the role
 		dump.Users = append(dump.Users, u)
@@ -3179,7 +4018,7 @@ func (s *httpdServer) handleWebUpdateUserGet(w http.ResponseWriter, r *http.Requ
 		return
 	}
 	username := getURLParam(r, "username")
-	user, err := dataprovider.UserExists(username, claims.Role)
+	user, err := claims.getUser(username)
 	if err == nil {
 		s.renderUserPage(w, r, &user, userPageModeUpdate, "", nil)
 	} else if errors.Is(err, util.ErrNotFound) {
@@ -3218,7 +4057,10 @@ func (s *httpdServer) handleWebAddUserPost(w http.ResponseWriter, r *http.Reques
 	user.Filters.TOTPConfig = dataprovider.UserTOTPConfig{
 		Enabled: false,
 	}
-	err = dataprovider.AddUser(&user, claims.Username, ipAddr, claims.Role)
+	err = claims.checkUserScope(&user)
+	if err == nil {
+		err = dataprovider.AddUserContext(r.Context(), &user, claims.Username, ipAddr, claims.Role)
+	}
 	if err != nil {
 		s.renderUserPage(w, r, &user, userPageModeAdd, err.Error(), nil)
 		return
@@ -3234,7 +4076,7 @@ func (s *httpdServer) handleWebUpdateUserPost(w http.ResponseWriter, r *http.Req
 		return
 	}
 	username := getURLParam(r, "username")
-	user, err := dataprovider.UserExists(username, claims.Role)
+	user, err := claims.getUser(username)
 	if errors.Is(err, util.ErrNotFound) {
 		s.renderNotFoundPage(w, r, err)
 		return
@@ -3256,6 +4098,17 @@ func (s *httpdServer) handleWebUpdateUserPost(w http.ResponseWriter, r *http.Req
 	updatedUser.Username = user.Username
 	updatedUser.Filters.RecoveryCodes = user.Filters.RecoveryCodes
 	updatedUser.Filters.TOTPConfig = user.Filters.TOTPConfig
+	updatedUser.Filters.Consents = user.Filters.Consents
+	updatedUser.Filters.PendingRegistration = user.Filters.PendingRegistration
+	// session policies for users can only be set using the REST API
+	updatedUser.Filters.SessionPolicies = user.Filters.SessionPolicies
+	updatedUser.Filters.PublicKeysExpiration = user.Filters.PublicKeysExpiration
+	// webhooks are managed by the users themselves, admins can only remove them
+	for _, webhook := range user.Filters.Webhooks {
+		if !util.Contains(r.Form["webhooks_remove"], webhook.Name) {
+			updatedUser.Filters.Webhooks = append(updatedUser.Filters.Webhooks, webhook)
+		}
+	}
 	updatedUser.LastPasswordChange = user.LastPasswordChange
 	updatedUser.SetEmptySecretsIfNil()
 	if updatedUser.Password == redactedSecret {
@@ -3264,7 +4117,10 @@ func (s *httpdServer) handleWebUpdateUserPost(w http.ResponseWriter, r *http.Req
 	updateEncryptedSecrets(&updatedUser.FsConfig, user.FsConfig.S3Config.AccessSecret, user.FsConfig.AzBlobConfig.AccountKey,
 		user.FsConfig.AzBlobConfig.SASURL, user.FsConfig.GCSConfig.Credentials, user.FsConfig.CryptConfig.Passphrase,
 		user.FsConfig.SFTPConfig.Password, user.FsConfig.SFTPConfig.PrivateKey, user.FsConfig.SFTPConfig.KeyPassphrase,
-		user.FsConfig.HTTPConfig.Password, user.FsConfig.HTTPConfig.APIKey)
+		user.FsConfig.HTTPConfig.Password, user.FsConfig.HTTPConfig.APIKey, user.FsConfig.WebDAVConfig.Password,
+		user.FsConfig.WebDAVConfig.ClientKey)
+	updatePGPEncryptedSecrets(&updatedUser.FsConfig, user.FsConfig.PGPConfig)
+	updateCryptFsEncryptedSecrets(&updatedUser.FsConfig, user.FsConfig.CryptConfig)
 
 	updatedUser = getUserFromTemplate(updatedUser, userTemplateFields{
 		Username:   updatedUser.Username,
@@ -3275,7 +4131,10 @@ func (s *httpdServer) handleWebUpdateUserPost(w http.ResponseWriter, r *http.Req
 		updatedUser.Role = claims.Role
 	}
 
-	err = dataprovider.UpdateUser(&updatedUser, claims.Username, ipAddr, claims.Role)
+	err = claims.checkUserScope(&updatedUser)
+	if err == nil {
+		err = dataprovider.UpdateUserContext(r.Context(), &updatedUser, claims.Username, ipAddr, claims.Role)
+	}
 	if err != nil {
 		s.renderUserPage(w, r, &updatedUser, userPageModeUpdate, err.Error(), nil)
 		return
@@ -3295,6 +4154,93 @@ func (s *httpdServer) handleWebGetStatus(w http.ResponseWriter, r *http.Request)
 	renderAdminTemplate(w, templateStatus, data)
 }
 
+func getAnalyticsTimeAsString(msec int64) string {
+	if msec <= 0 {
+		return ""
+	}
+	return util.GetTimeFromMsecSinceEpoch(msec).UTC().Format("2006-01-02 15:04:05")
+}
+
+func getAnalyticsPercent(value, total int64) int {
+	if total <= 0 {
+		return 0
+	}
+	return int(value * 100 / total)
+}
+
+func (s *httpdServer) handleWebGetAnalytics(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		s.renderBadRequestPage(w, r, errors.New("invalid token claims"))
+		return
+	}
+	query, err := getHeatmapQueryFromRequest(r, claims.Role)
+	if err != nil {
+		s.renderBadRequestPage(w, r, err)
+		return
+	}
+	query.Limit = 50
+	data := analyticsPage{
+		basePage: s.getBasePageData(pageAnalyticsTitle, webAnalyticsPath, r),
+		Enabled:  common.IsAnalyticsEnabled(),
+		Username: query.Username,
+		Group:    r.URL.Query().Get("group"),
+		Order:    query.Order,
+		Orders: []string{common.HeatmapOrderReads, common.HeatmapOrderWrites, common.HeatmapOrderReadBytes,
+			common.HeatmapOrderWrittenBytes},
+	}
+	if data.Order == "" {
+		data.Order = common.HeatmapOrderReads
+	}
+	if data.Enabled {
+		heatmap, err := common.GetAccessHeatmap(query)
+		if err != nil {
+			s.renderBadRequestPage(w, r, err)
+			return
+		}
+		var maxValue int64
+		for idx := range heatmap {
+			if val := heatmap[idx].Reads + heatmap[idx].Writes; val > maxValue {
+				maxValue = val
+			}
+		}
+		for idx := range heatmap {
+			data.Heatmap = append(data.Heatmap, analyticsHeatmapEntry{
+				FileAccessStats: heatmap[idx],
+				LastAccessTime:  getAnalyticsTimeAsString(heatmap[idx].LastAccess),
+				Percent:         getAnalyticsPercent(heatmap[idx].Reads+heatmap[idx].Writes, maxValue),
+			})
+		}
+	}
+	if query.Username != "" {
+		user, err := claims.getUserWithGroupSettings(query.Username)
+		if err != nil {
+			s.renderMessagePage(w, r, "Unable to get the user", "", getRespStatus(err), err, "")
+			return
+		}
+		report, err := common.GetStorageReport(user, 0)
+		if err != nil {
+			data.Error = fmt.Sprintf("Unable to generate the storage report: %v", err)
+		} else {
+			data.Report = &report
+			for _, ext := range report.Extensions {
+				data.Extensions = append(data.Extensions, analyticsExtensionEntry{
+					ExtensionStats: ext,
+					Percent:        getAnalyticsPercent(ext.Size, report.Size),
+				})
+			}
+			for _, file := range report.ColdFiles {
+				data.ColdFiles = append(data.ColdFiles, analyticsColdFile{
+					ColdFile:       file,
+					LastAccessTime: getAnalyticsTimeAsString(file.LastAccess),
+				})
+			}
+		}
+	}
+	renderAdminTemplate(w, templateAnalytics, data)
+}
+
 func (s *httpdServer) handleWebGetConnections(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 	claims, err := getTokenClaims(r)
@@ -3311,6 +4257,69 @@ func (s *httpdServer) handleWebGetConnections(w http.ResponseWriter, r *http.Req
 	renderAdminTemplate(w, templateConnections, data)
 }
 
+func (s *httpdServer) handleWebGetDashboard(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	data := dashboardPage{
+		basePage:     s.getBasePageData(pageDashboardTitle, webDashboardPath, r),
+		LiveStatsURL: webDashboardPath + "/stats",
+	}
+	renderAdminTemplate(w, templateDashboard, data)
+}
+
+func (s *httpdServer) handleWebGetSessions(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		s.renderBadRequestPage(w, r, errors.New("invalid token claims"))
+		return
+	}
+	sessions, err := claims.getWebSessions()
+	if err != nil {
+		s.renderInternalServerErrorPage(w, r, err)
+		return
+	}
+	data := sessionsPage{
+		basePage: s.getBasePageData(pageSessionsTitle, webSessionsPath, r),
+		Sessions: sessions,
+	}
+	renderAdminTemplate(w, templateSessions, data)
+}
+
+func (s *httpdServer) handleWebGetSSHHostKeys(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	configs, err := getSSHHostKeysConfigs()
+	if err != nil {
+		s.renderInternalServerErrorPage(w, r, err)
+		return
+	}
+	data := hostKeysPage{
+		basePage: s.getBasePageData(pageHostKeysTitle, webHostKeysPath, r),
+	}
+	for _, k := range configs.SFTPD.HostKeys {
+		data.HostKeys = append(data.HostKeys, getSSHHostKeyResponse(k))
+	}
+	renderAdminTemplate(w, templateHostKeys, data)
+}
+
+func (s *httpdServer) handleWebGetRegistrations(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		s.renderBadRequestPage(w, r, errors.New("invalid token claims"))
+		return
+	}
+	registrations, err := claims.getPendingRegistrations()
+	if err != nil {
+		s.renderInternalServerErrorPage(w, r, err)
+		return
+	}
+	data := registrationsPage{
+		basePage:      s.getBasePageData(pageRegistrationsTitle, webRegistrationsPath, r),
+		Registrations: registrations,
+	}
+	renderAdminTemplate(w, templateRegistrations, data)
+}
+
 func (s *httpdServer) handleWebAddFolderGet(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 	s.renderFolderPage(w, r, vfs.BaseVirtualFolder{}, folderPageModeAdd, "")
@@ -3345,9 +4354,15 @@ func (s *httpdServer) handleWebAddFolderPost(w http.ResponseWriter, r *http.Requ
 		return
 	}
 	folder.FsConfig = fsConfig
+	folder.Limits, err = getFolderLimitsFromPostFields(r)
+	if err != nil {
+		s.renderFolderPage(w, r, folder, folderPageModeAdd, err.Error())
+		return
+	}
 	folder = getFolderFromTemplate(folder, folder.Name)
 
-	err = dataprovider.AddFolder(&folder, claims.Username, ipAddr, claims.Role)
+	folder.Role = claims.Role
+	err = dataprovider.AddFolderContext(r.Context(), &folder, claims.Username, ipAddr, claims.Role)
 	if err == nil {
 		http.Redirect(w, r, webFoldersPath, http.StatusSeeOther)
 	} else {
@@ -3357,8 +4372,13 @@ func (s *httpdServer) handleWebAddFolderPost(w http.ResponseWriter, r *http.Requ
 
 func (s *httpdServer) handleWebUpdateFolderGet(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		s.renderBadRequestPage(w, r, errors.New("invalid token claims"))
+		return
+	}
 	name := getURLParam(r, "name")
-	folder, err := dataprovider.GetFolderByName(name)
+	folder, err := claims.getFolder(name)
 	if err == nil {
 		s.renderFolderPage(w, r, folder, folderPageModeUpdate, "")
 	} else if errors.Is(err, util.ErrNotFound) {
@@ -3376,7 +4396,7 @@ func (s *httpdServer) handleWebUpdateFolderPost(w http.ResponseWriter, r *http.R
 		return
 	}
 	name := getURLParam(r, "name")
-	folder, err := dataprovider.GetFolderByName(name)
+	folder, err := claims.getFolder(name)
 	if errors.Is(err, util.ErrNotFound) {
 		s.renderNotFoundPage(w, r, err)
 		return
@@ -3402,22 +4422,34 @@ func (s *httpdServer) handleWebUpdateFolderPost(w http.ResponseWriter, r *http.R
 		s.renderFolderPage(w, r, folder, folderPageModeUpdate, err.Error())
 		return
 	}
+	limits, err := getFolderLimitsFromPostFields(r)
+	if err != nil {
+		s.renderFolderPage(w, r, folder, folderPageModeUpdate, err.Error())
+		return
+	}
 	updatedFolder := vfs.BaseVirtualFolder{
 		MappedPath:  strings.TrimSpace(r.Form.Get("mapped_path")),
 		Description: r.Form.Get("description"),
+		Limits:      limits,
 	}
 	updatedFolder.ID = folder.ID
 	updatedFolder.Name = folder.Name
+	updatedFolder.Role = folder.Role
 	updatedFolder.FsConfig = fsConfig
 	updatedFolder.FsConfig.SetEmptySecretsIfNil()
 	updateEncryptedSecrets(&updatedFolder.FsConfig, folder.FsConfig.S3Config.AccessSecret, folder.FsConfig.AzBlobConfig.AccountKey,
 		folder.FsConfig.AzBlobConfig.SASURL, folder.FsConfig.GCSConfig.Credentials, folder.FsConfig.CryptConfig.Passphrase,
 		folder.FsConfig.SFTPConfig.Password, folder.FsConfig.SFTPConfig.PrivateKey, folder.FsConfig.SFTPConfig.KeyPassphrase,
-		folder.FsConfig.HTTPConfig.Password, folder.FsConfig.HTTPConfig.APIKey)
+		folder.FsConfig.HTTPConfig.Password, folder.FsConfig.HTTPConfig.APIKey, folder.FsConfig.WebDAVConfig.Password,
+		folder.FsConfig.WebDAVConfig.ClientKey)
+	updatePGPEncryptedSecrets(&updatedFolder.FsConfig, folder.FsConfig.PGPConfig)
+	updateCryptFsEncryptedSecrets(&updatedFolder.FsConfig, folder.FsConfig.CryptConfig)
+	// the secondary storage backend can only be configured using the REST API
+	updatedFolder.Failover = folder.Failover
 
 	updatedFolder = getFolderFromTemplate(updatedFolder, updatedFolder.Name)
 
-	err = dataprovider.UpdateFolder(&updatedFolder, folder.Users, folder.Groups, claims.Username, ipAddr, claims.Role)
+	err = dataprovider.UpdateFolderContext(r.Context(), &updatedFolder, folder.Users, folder.Groups, claims.Username, ipAddr, claims.Role)
 	if err != nil {
 		s.renderFolderPage(w, r, updatedFolder, folderPageModeUpdate, err.Error())
 		return
@@ -3425,10 +4457,12 @@ func (s *httpdServer) handleWebUpdateFolderPost(w http.ResponseWriter, r *http.R
 	http.Redirect(w, r, webFoldersPath, http.StatusSeeOther)
 }
 
-func (s *httpdServer) getWebVirtualFolders(w http.ResponseWriter, r *http.Request, limit int, minimal bool) ([]vfs.BaseVirtualFolder, error) {
+func (s *httpdServer) getWebVirtualFolders(w http.ResponseWriter, r *http.Request, limit int, minimal bool,
+	role string,
+) ([]vfs.BaseVirtualFolder, error) {
 	folders := make([]vfs.BaseVirtualFolder, 0, limit)
 	for {
-		f, err := dataprovider.GetFolders(limit, len(folders), dataprovider.OrderASC, minimal)
+		f, err := dataprovider.GetFolders(limit, len(folders), dataprovider.OrderASC, minimal, role)
 		if err != nil {
 			s.renderInternalServerErrorPage(w, r, err)
 			return folders, err
@@ -3443,15 +4477,19 @@ func (s *httpdServer) getWebVirtualFolders(w http.ResponseWriter, r *http.Reques
 
 func (s *httpdServer) handleWebGetFolders(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		s.renderBadRequestPage(w, r, errors.New("invalid token claims"))
+		return
+	}
 	limit := defaultQueryLimit
 	if _, ok := r.URL.Query()["qlimit"]; ok {
-		var err error
 		limit, err = strconv.Atoi(r.URL.Query().Get("qlimit"))
 		if err != nil {
 			limit = defaultQueryLimit
 		}
 	}
-	folders, err := s.getWebVirtualFolders(w, r, limit, false)
+	folders, err := s.getWebVirtualFolders(w, r, limit, false, claims.Role)
 	if err != nil {
 		return
 	}
@@ -3463,10 +4501,12 @@ func (s *httpdServer) handleWebGetFolders(w http.ResponseWriter, r *http.Request
 	renderAdminTemplate(w, templateFolders, data)
 }
 
-func (s *httpdServer) getWebGroups(w http.ResponseWriter, r *http.Request, limit int, minimal bool) ([]dataprovider.Group, error) {
+func (s *httpdServer) getWebGroups(w http.ResponseWriter, r *http.Request, limit int, minimal bool,
+	role string,
+) ([]dataprovider.Group, error) {
 	groups := make([]dataprovider.Group, 0, limit)
 	for {
-		f, err := dataprovider.GetGroups(limit, len(groups), dataprovider.OrderASC, minimal)
+		f, err := dataprovider.GetGroups(limit, len(groups), dataprovider.OrderASC, minimal, role)
 		if err != nil {
 			s.renderInternalServerErrorPage(w, r, err)
 			return groups, err
@@ -3481,15 +4521,19 @@ func (s *httpdServer) getWebGroups(w http.ResponseWriter, r *http.Request, limit
 
 func (s *httpdServer) handleWebGetGroups(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		s.renderBadRequestPage(w, r, errors.New("invalid token claims"))
+		return
+	}
 	limit := defaultQueryLimit
 	if _, ok := r.URL.Query()["qlimit"]; ok {
-		var err error
 		limit, err = strconv.Atoi(r.URL.Query().Get("qlimit"))
 		if err != nil {
 			limit = defaultQueryLimit
 		}
 	}
-	groups, err := s.getWebGroups(w, r, limit, false)
+	groups, err := s.getWebGroups(w, r, limit, false, claims.Role)
 	if err != nil {
 		return
 	}
@@ -3523,7 +4567,8 @@ func (s *httpdServer) handleWebAddGroupPost(w http.ResponseWriter, r *http.Reque
 		s.renderForbiddenPage(w, r, err.Error())
 		return
 	}
-	err = dataprovider.AddGroup(&group, claims.Username, ipAddr, claims.Role)
+	group.Role = claims.Role
+	err = dataprovider.AddGroupContext(r.Context(), &group, claims.Username, ipAddr, claims.Role)
 	if err != nil {
 		s.renderGroupPage(w, r, group, genericPageModeAdd, err.Error())
 		return
@@ -3533,8 +4578,13 @@ func (s *httpdServer) handleWebAddGroupPost(w http.ResponseWriter, r *http.Reque
 
 func (s *httpdServer) handleWebUpdateGroupGet(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		s.renderBadRequestPage(w, r, errors.New("invalid token claims"))
+		return
+	}
 	name := getURLParam(r, "name")
-	group, err := dataprovider.GroupExists(name)
+	group, err := claims.getGroup(name)
 	if err == nil {
 		s.renderGroupPage(w, r, group, genericPageModeUpdate, "")
 	} else if errors.Is(err, util.ErrNotFound) {
@@ -3552,7 +4602,7 @@ func (s *httpdServer) handleWebUpdateGroupPost(w http.ResponseWriter, r *http.Re
 		return
 	}
 	name := getURLParam(r, "name")
-	group, err := dataprovider.GroupExists(name)
+	group, err := claims.getGroup(name)
 	if errors.Is(err, util.ErrNotFound) {
 		s.renderNotFoundPage(w, r, err)
 		return
@@ -3572,6 +4622,7 @@ func (s *httpdServer) handleWebUpdateGroupPost(w http.ResponseWriter, r *http.Re
 	}
 	updatedGroup.ID = group.ID
 	updatedGroup.Name = group.Name
+	updatedGroup.Role = group.Role
 	updatedGroup.SetEmptySecretsIfNil()
 
 	updateEncryptedSecrets(&updatedGroup.UserSettings.FsConfig, group.UserSettings.FsConfig.S3Config.AccessSecret,
@@ -3579,9 +4630,12 @@ func (s *httpdServer) handleWebUpdateGroupPost(w http.ResponseWriter, r *http.Re
 		group.UserSettings.FsConfig.GCSConfig.Credentials, group.UserSettings.FsConfig.CryptConfig.Passphrase,
 		group.UserSettings.FsConfig.SFTPConfig.Password, group.UserSettings.FsConfig.SFTPConfig.PrivateKey,
 		group.UserSettings.FsConfig.SFTPConfig.KeyPassphrase, group.UserSettings.FsConfig.HTTPConfig.Password,
-		group.UserSettings.FsConfig.HTTPConfig.APIKey)
+		group.UserSettings.FsConfig.HTTPConfig.APIKey, group.UserSettings.FsConfig.WebDAVConfig.Password,
+		group.UserSettings.FsConfig.WebDAVConfig.ClientKey)
+	updatePGPEncryptedSecrets(&updatedGroup.UserSettings.FsConfig, group.UserSettings.FsConfig.PGPConfig)
+	updateCryptFsEncryptedSecrets(&updatedGroup.UserSettings.FsConfig, group.UserSettings.FsConfig.CryptConfig)
 
-	err = dataprovider.UpdateGroup(&updatedGroup, group.Users, claims.Username, ipAddr, claims.Role)
+	err = dataprovider.UpdateGroupContext(r.Context(), &updatedGroup, group.Users, claims.Username, ipAddr, claims.Role)
 	if err != nil {
 		s.renderGroupPage(w, r, updatedGroup, genericPageModeUpdate, err.Error())
 		return
@@ -3643,6 +4697,10 @@ func (s *httpdServer) handleWebAddEventActionPost(w http.ResponseWriter, r *http
 		s.renderBadRequestPage(w, r, errors.New("invalid token claims"))
 		return
 	}
+	if claims.Role != "" {
+		s.renderForbiddenPage(w, r, "Role admins cannot manage event actions")
+		return
+	}
 	action, err := getEventActionFromPostFields(r)
 	if err != nil {
 		s.renderEventActionPage(w, r, action, genericPageModeAdd, err.Error())
@@ -3653,7 +4711,7 @@ func (s *httpdServer) handleWebAddEventActionPost(w http.ResponseWriter, r *http
 		s.renderForbiddenPage(w, r, err.Error())
 		return
 	}
-	if err = dataprovider.AddEventAction(&action, claims.Username, ipAddr, claims.Role); err != nil {
+	if err = dataprovider.AddEventActionContext(r.Context(), &action, claims.Username, ipAddr, claims.Role); err != nil {
 		s.renderEventActionPage(w, r, action, genericPageModeAdd, err.Error())
 		return
 	}
@@ -3680,6 +4738,10 @@ func (s *httpdServer) handleWebUpdateEventActionPost(w http.ResponseWriter, r *h
 		s.renderBadRequestPage(w, r, errors.New("invalid token claims"))
 		return
 	}
+	if claims.Role != "" {
+		s.renderForbiddenPage(w, r, "Role admins cannot manage event actions")
+		return
+	}
 	name := getURLParam(r, "name")
 	action, err := dataprovider.EventActionExists(name)
 	if errors.Is(err, util.ErrNotFound) {
@@ -3708,7 +4770,7 @@ func (s *httpdServer) handleWebUpdateEventActionPost(w http.ResponseWriter, r *h
 			updatedAction.Options.HTTPConfig.Password = action.Options.HTTPConfig.Password
 		}
 	}
-	err = dataprovider.UpdateEventAction(&updatedAction, claims.Username, ipAddr, claims.Role)
+	err = dataprovider.UpdateEventActionContext(r.Context(), &updatedAction, claims.Username, ipAddr, claims.Role)
 	if err != nil {
 		s.renderEventActionPage(w, r, updatedAction, genericPageModeUpdate, err.Error())
 		return
@@ -3718,6 +4780,11 @@ func (s *httpdServer) handleWebUpdateEventActionPost(w http.ResponseWriter, r *h
 
 func (s *httpdServer) handleWebGetEventRules(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		s.renderBadRequestPage(w, r, errors.New("invalid token claims"))
+		return
+	}
 	limit := defaultQueryLimit
 	if _, ok := r.URL.Query()["qlimit"]; ok {
 		if lim, err := strconv.Atoi(r.URL.Query().Get("qlimit")); err == nil {
@@ -3726,7 +4793,7 @@ func (s *httpdServer) handleWebGetEventRules(w http.ResponseWriter, r *http.Requ
 	}
 	rules := make([]dataprovider.EventRule, 0, limit)
 	for {
-		res, err := dataprovider.GetEventRules(limit, len(rules), dataprovider.OrderASC)
+		res, err := dataprovider.GetEventRules(limit, len(rules), dataprovider.OrderASC, claims.Role)
 		if err != nil {
 			s.renderInternalServerErrorPage(w, r, err)
 			return
@@ -3771,7 +4838,8 @@ func (s *httpdServer) handleWebAddEventRulePost(w http.ResponseWriter, r *http.R
 		s.renderForbiddenPage(w, r, err.Error())
 		return
 	}
-	if err = dataprovider.AddEventRule(&rule, claims.Username, ipAddr, claims.Role); err != nil {
+	rule.Role = claims.Role
+	if err = dataprovider.AddEventRuleContext(r.Context(), &rule, claims.Username, ipAddr, claims.Role); err != nil {
 		s.renderEventRulePage(w, r, rule, genericPageModeAdd, err.Error())
 		return
 	}
@@ -3780,8 +4848,13 @@ func (s *httpdServer) handleWebAddEventRulePost(w http.ResponseWriter, r *http.R
 
 func (s *httpdServer) handleWebUpdateEventRuleGet(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		s.renderBadRequestPage(w, r, errors.New("invalid token claims"))
+		return
+	}
 	name := getURLParam(r, "name")
-	rule, err := dataprovider.EventRuleExists(name)
+	rule, err := claims.getEventRule(name)
 	if err == nil {
 		s.renderEventRulePage(w, r, rule, genericPageModeUpdate, "")
 	} else if errors.Is(err, util.ErrNotFound) {
@@ -3799,7 +4872,7 @@ func (s *httpdServer) handleWebUpdateEventRulePost(w http.ResponseWriter, r *htt
 		return
 	}
 	name := getURLParam(r, "name")
-	rule, err := dataprovider.EventRuleExists(name)
+	rule, err := claims.getEventRule(name)
 	if errors.Is(err, util.ErrNotFound) {
 		s.renderNotFoundPage(w, r, err)
 		return
@@ -3819,7 +4892,8 @@ func (s *httpdServer) handleWebUpdateEventRulePost(w http.ResponseWriter, r *htt
 	}
 	updatedRule.ID = rule.ID
 	updatedRule.Name = rule.Name
-	err = dataprovider.UpdateEventRule(&updatedRule, claims.Username, ipAddr, claims.Role)
+	updatedRule.Role = rule.Role
+	err = dataprovider.UpdateEventRuleContext(r.Context(), &updatedRule, claims.Username, ipAddr, claims.Role)
 	if err != nil {
 		s.renderEventRulePage(w, r, updatedRule, genericPageModeUpdate, err.Error())
 		return
@@ -3878,7 +4952,7 @@ func (s *httpdServer) handleWebAddRolePost(w http.ResponseWriter, r *http.Reques
 		s.renderForbiddenPage(w, r, err.Error())
 		return
 	}
-	err = dataprovider.AddRole(&role, claims.Username, ipAddr, claims.Role)
+	err = dataprovider.AddRoleContext(r.Context(), &role, claims.Username, ipAddr, claims.Role)
 	if err != nil {
 		s.renderRolePage(w, r, role, genericPageModeAdd, err.Error())
 		return
@@ -3926,7 +5000,9 @@ func (s *httpdServer) handleWebUpdateRolePost(w http.ResponseWriter, r *http.Req
 	}
 	updatedRole.ID = role.ID
 	updatedRole.Name = role.Name
-	err = dataprovider.UpdateRole(&updatedRole, claims.Username, ipAddr, claims.Role)
+	// tenant settings can only be configured using the REST API
+	updatedRole.Tenant = role.Tenant
+	err = dataprovider.UpdateRoleContext(r.Context(), &updatedRole, claims.Username, ipAddr, claims.Role)
 	if err != nil {
 		s.renderRolePage(w, r, updatedRole, genericPageModeUpdate, err.Error())
 		return
@@ -3934,6 +5010,114 @@ func (s *httpdServer) handleWebUpdateRolePost(w http.ResponseWriter, r *http.Req
 	http.Redirect(w, r, webAdminRolesPath, http.StatusSeeOther)
 }
 
+func (s *httpdServer) getWebAdminRoles(w http.ResponseWriter, r *http.Request, limit int, minimal bool,
+) ([]dataprovider.AdminRole, error) {
+	roles := make([]dataprovider.AdminRole, 0, limit)
+	for {
+		res, err := dataprovider.GetAdminRoles(limit, len(roles), dataprovider.OrderASC, minimal)
+		if err != nil {
+			s.renderInternalServerErrorPage(w, r, err)
+			return roles, err
+		}
+		roles = append(roles, res...)
+		if len(res) < limit {
+			break
+		}
+	}
+	return roles, nil
+}
+
+func (s *httpdServer) handleWebGetAdminRoles(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	roles, err := s.getWebAdminRoles(w, r, 10, false)
+	if err != nil {
+		return
+	}
+	data := adminRolesPage{
+		basePage: s.getBasePageData(pageAdminRolesTitle, webAdminAdminRolesPath, r),
+		Roles:    roles,
+	}
+	renderAdminTemplate(w, templateAdminRoles, data)
+}
+
+func (s *httpdServer) handleWebAddAdminRoleGet(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	s.renderAdminRolePage(w, r, dataprovider.AdminRole{}, genericPageModeAdd, "")
+}
+
+func (s *httpdServer) handleWebAddAdminRolePost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	role, err := getAdminRoleFromPostFields(r)
+	if err != nil {
+		s.renderAdminRolePage(w, r, role, genericPageModeAdd, err.Error())
+		return
+	}
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		s.renderBadRequestPage(w, r, errors.New("invalid token claims"))
+		return
+	}
+	ipAddr := util.GetIPFromRemoteAddress(r.RemoteAddr)
+	if err := verifyCSRFToken(r.Form.Get(csrfFormToken), ipAddr); err != nil {
+		s.renderForbiddenPage(w, r, err.Error())
+		return
+	}
+	err = dataprovider.AddAdminRoleContext(r.Context(), &role, claims.Username, ipAddr, claims.Role)
+	if err != nil {
+		s.renderAdminRolePage(w, r, role, genericPageModeAdd, err.Error())
+		return
+	}
+	http.Redirect(w, r, webAdminAdminRolesPath, http.StatusSeeOther)
+}
+
+func (s *httpdServer) handleWebUpdateAdminRoleGet(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	role, err := dataprovider.AdminRoleExists(getURLParam(r, "name"))
+	if err == nil {
+		s.renderAdminRolePage(w, r, role, genericPageModeUpdate, "")
+	} else if errors.Is(err, util.ErrNotFound) {
+		s.renderNotFoundPage(w, r, err)
+	} else {
+		s.renderInternalServerErrorPage(w, r, err)
+	}
+}
+
+func (s *httpdServer) handleWebUpdateAdminRolePost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		s.renderBadRequestPage(w, r, errors.New("invalid token claims"))
+		return
+	}
+	role, err := dataprovider.AdminRoleExists(getURLParam(r, "name"))
+	if errors.Is(err, util.ErrNotFound) {
+		s.renderNotFoundPage(w, r, err)
+		return
+	} else if err != nil {
+		s.renderInternalServerErrorPage(w, r, err)
+		return
+	}
+
+	updatedRole, err := getAdminRoleFromPostFields(r)
+	if err != nil {
+		s.renderAdminRolePage(w, r, role, genericPageModeUpdate, err.Error())
+		return
+	}
+	ipAddr := util.GetIPFromRemoteAddress(r.RemoteAddr)
+	if err := verifyCSRFToken(r.Form.Get(csrfFormToken), ipAddr); err != nil {
+		s.renderForbiddenPage(w, r, err.Error())
+		return
+	}
+	updatedRole.ID = role.ID
+	updatedRole.Name = role.Name
+	err = dataprovider.UpdateAdminRoleContext(r.Context(), &updatedRole, claims.Username, ipAddr, claims.Role)
+	if err != nil {
+		s.renderAdminRolePage(w, r, updatedRole, genericPageModeUpdate, err.Error())
+		return
+	}
+	http.Redirect(w, r, webAdminAdminRolesPath, http.StatusSeeOther)
+}
+
 func (s *httpdServer) handleWebGetEvents(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 
@@ -3992,7 +5176,7 @@ func (s *httpdServer) handleWebAddIPListEntryPost(w http.ResponseWriter, r *http
 		s.renderForbiddenPage(w, r, err.Error())
 		return
 	}
-	err = dataprovider.AddIPListEntry(&entry, claims.Username, ipAddr, claims.Role)
+	err = dataprovider.AddIPListEntryContext(r.Context(), &entry, claims.Username, ipAddr, claims.Role)
 	if err != nil {
 		s.renderIPListPage(w, r, entry, genericPageModeAdd, err.Error())
 		return
@@ -4049,7 +5233,7 @@ func (s *httpdServer) handleWebUpdateIPListEntryPost(w http.ResponseWriter, r *h
 	}
 	updatedEntry.Type = listType
 	updatedEntry.IPOrNet = ipOrNet
-	err = dataprovider.UpdateIPListEntry(&updatedEntry, claims.Username, ipAddr, claims.Role)
+	err = dataprovider.UpdateIPListEntryContext(r.Context(), &updatedEntry, claims.Username, ipAddr, claims.Role)
 	if err != nil {
 		s.renderIPListPage(w, r, entry, genericPageModeUpdate, err.Error())
 		return
@@ -4094,6 +5278,9 @@ func (s *httpdServer) handleWebConfigsPost(w http.ResponseWriter, r *http.Reques
 	case "sftp_submit":
 		configSection = 1
 		sftpConfigs := getSFTPConfigsFromPostFields(r)
+		if configs.SFTPD != nil {
+			sftpConfigs.HostKeys = configs.SFTPD.HostKeys
+		}
 		configs.SFTPD = sftpConfigs
 	case "acme_submit":
 		configSection = 2
@@ -4108,12 +5295,20 @@ func (s *httpdServer) handleWebConfigsPost(w http.ResponseWriter, r *http.Reques
 		smtpConfigs := getSMTPConfigsFromPostFields(r)
 		updateSMTPSecrets(smtpConfigs, configs.SMTP)
 		configs.SMTP = smtpConfigs
+	case "aliases_submit":
+		configSection = 4
+		aliases, err := getUsernameAliasesFromPostFields(r)
+		if err != nil {
+			s.renderConfigsPage(w, r, configs, err.Error(), configSection)
+			return
+		}
+		configs.UsernameAliases = aliases
 	default:
 		s.renderBadRequestPage(w, r, errors.New("unsupported form action"))
 		return
 	}
 
-	err = dataprovider.UpdateConfigs(&configs, claims.Username, ipAddr, claims.Role)
+	err = dataprovider.UpdateConfigsContext(r.Context(), &configs, claims.Username, ipAddr, claims.Role)
 	if err != nil {
 		s.renderConfigsPage(w, r, configs, err.Error(), configSection)
 		return
@@ -27,20 +27,22 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-chi/jwtauth/v5"
 	"github.com/go-chi/render"
-	"github.com/rs/xid"
 	"github.com/sftpgo/sdk"
+	"golang.org/x/crypto/ssh"
 
 	"github.com/drakkan/sftpgo/v2/pkg/common"
 	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/kms"
 	"github.com/drakkan/sftpgo/v2/pkg/logger"
 	"github.com/drakkan/sftpgo/v2/pkg/mfa"
-	"github.com/drakkan/sftpgo/v2/pkg/smtp"
 	"github.com/drakkan/sftpgo/v2/pkg/util"
 	"github.com/drakkan/sftpgo/v2/pkg/version"
 	"github.com/drakkan/sftpgo/v2/pkg/vfs"
@@ -54,6 +56,9 @@ const (
 	templateClientFiles             = "files.html"
 	templateClientMessage           = "message.html"
 	templateClientProfile           = "profile.html"
+	templateClientWebhooks          = "webhooks.html"
+	templateClientConsents          = "consents.html"
+	templateClientSignUp            = "signup.html"
 	templateClientChangePwd         = "changepassword.html"
 	templateClientTwoFactor         = "twofactor.html"
 	templateClientTwoFactorRecovery = "twofactor-recovery.html"
@@ -65,14 +70,19 @@ const (
 	templateShareLogin              = "sharelogin.html"
 	templateShareFiles              = "sharefiles.html"
 	templateUploadToShare           = "shareupload.html"
+	templateSharePlayer             = "shareplayer.html"
+	templateClientShareStats        = "sharestats.html"
 	pageClientFilesTitle            = "My Files"
 	pageClientSharesTitle           = "Shares"
+	pageClientShareStatsTitle       = "Share stats"
 	pageClientProfileTitle          = "My Profile"
+	pageClientWebhooksTitle         = "Webhooks"
 	pageClientChangePwdTitle        = "Change password"
 	pageClient2FATitle              = "Two-factor auth"
 	pageClientEditFileTitle         = "Edit file"
 	pageClientForgotPwdTitle        = "SFTPGo WebClient - Forgot password"
 	pageClientResetPwdTitle         = "SFTPGo WebClient - Reset password"
+	pageClientSignUpTitle           = "Sign up"
 	pageExtShareTitle               = "Shared files"
 	pageUploadToShareTitle          = "Upload to share"
 	templateClientEditOfficeFile    = "editfile-office.html"
@@ -99,24 +109,30 @@ func isZeroTime(t time.Time) bool {
 }
 
 type baseClientPage struct {
-	Title        string
-	CurrentURL   string
-	FilesURL     string
-	SharesURL    string
-	ShareURL     string
-	ProfileURL   string
-	ChangePwdURL string
-	StaticURL    string
-	LogoutURL    string
-	MFAURL       string
-	MFATitle     string
-	FilesTitle   string
-	SharesTitle  string
-	ProfileTitle string
-	Version      string
-	CSRFToken    string
-	LoggedUser   *dataprovider.User
-	Branding     UIBranding
+	Title         string
+	CurrentURL    string
+	FilesURL      string
+	SharesURL     string
+	ShareURL      string
+	ProfileURL    string
+	WebhooksURL   string
+	ChangePwdURL  string
+	StaticURL     string
+	LogoutURL     string
+	MFAURL        string
+	MFATitle      string
+	FilesTitle    string
+	SharesTitle   string
+	ProfileTitle  string
+	WebhooksTitle string
+	Version       string
+	CSRFToken     string
+	LoggedUser    *dataprovider.User
+	Branding      UIBranding
+	// true if users can register webhooks for their folders
+	WebhooksEnabled bool
+	// max session duration expiration as unix timestamp in milliseconds, 0 means no limit
+	SessionExpiresAt int64
 }
 
 type dirMapping struct {
@@ -147,8 +163,11 @@ type filesPage struct {
 	DirsURL         string
 	FileActionsURL  string
 	DownloadURL     string
+	ArchiveJobsURL  string
+	ThumbnailsURL   string
 	ViewPDFURL      string
 	FileURL         string
+	SearchURL       string
 	CanAddFiles     bool
 	CanCreateDirs   bool
 	CanRename       bool
@@ -159,6 +178,12 @@ type filesPage struct {
 	Paths           []dirMapping
 	HasIntegrations bool
 	QuotaUsage      *userQuotaUsage
+	// client side encrypted folder including the current directory, if any
+	ClientEncryptedFolder string
+	// thumbnail sizes for the list and grid views
+	ThumbnailSize     int
+	ThumbnailGridSize int
+	ThumbnailsPDF     bool
 }
 
 type shareLoginPage struct {
@@ -180,12 +205,24 @@ type shareFilesPage struct {
 	Error         string
 	Paths         []dirMapping
 	Scope         dataprovider.ShareScope
+	// true if the shared contents are encrypted within the browser
+	ClientEncrypted bool
+}
+
+type sharePlayerPage struct {
+	baseClientPage
+	Share     *dataprovider.Share
+	FileName  string
+	StreamURL string
+	MediaType string
+	BrowseURL string
 }
 
 type shareUploadPage struct {
 	baseClientPage
-	Share          *dataprovider.Share
-	UploadBasePath string
+	Share           *dataprovider.Share
+	UploadBasePath  string
+	ClientEncrypted bool
 }
 
 type clientMessagePage struct {
@@ -194,9 +231,16 @@ type clientMessagePage struct {
 	Success string
 }
 
+type clientPublicKey struct {
+	Key string
+	// expiration date formatted as YYYY-MM-DD, empty if not set
+	ExpiresAt string
+}
+
 type clientProfilePage struct {
 	baseClientPage
-	PublicKeys      []string
+	PublicKeys      []clientPublicKey
+	PublicKeysURL   string
 	CanSubmit       bool
 	AllowAPIKeyAuth bool
 	Email           string
@@ -204,6 +248,82 @@ type clientProfilePage struct {
 	Error           string
 }
 
+type shareStatsRange struct {
+	Name        string
+	Label       string
+	Granularity string
+	Duration    time.Duration
+}
+
+var shareStatsRanges = []shareStatsRange{
+	{Name: "24h", Label: "Last 24 hours", Granularity: dataprovider.ShareStatsGranularityHour, Duration: 24 * time.Hour},
+	{Name: "7d", Label: "Last 7 days", Granularity: dataprovider.ShareStatsGranularityHour, Duration: 7 * 24 * time.Hour},
+	{Name: "30d", Label: "Last 30 days", Granularity: dataprovider.ShareStatsGranularityDay, Duration: 30 * 24 * time.Hour},
+	{Name: "90d", Label: "Last 90 days", Granularity: dataprovider.ShareStatsGranularityDay, Duration: 90 * 24 * time.Hour},
+	{Name: "365d", Label: "Last year", Granularity: dataprovider.ShareStatsGranularityDay, Duration: 365 * 24 * time.Hour},
+}
+
+type shareStatsChartBar struct {
+	X      int
+	Y      int
+	Height int
+	Title  string
+}
+
+type shareStatsRow struct {
+	Time      string
+	IP        string
+	UserAgent string
+	Path      string
+	Downloads int64
+	Size      string
+}
+
+type clientShareStatsPage struct {
+	baseClientPage
+	Share        *dataprovider.Share
+	Stats        dataprovider.ShareStats
+	Enabled      bool
+	Ranges       []shareStatsRange
+	Range        string
+	TotalSize    string
+	LastAccess   string
+	ChartWidth   int
+	ChartBars    []shareStatsChartBar
+	TopFiles     []shareStatsRow
+	RecentEvents []shareStatsRow
+}
+
+type clientWebhooksPage struct {
+	baseClientPage
+	Webhooks []dataprovider.UserWebhook
+	Events   []string
+	Error    string
+}
+
+type clientConsentsPage struct {
+	CurrentURL string
+	Version    string
+	Error      string
+	CSRFToken  string
+	StaticURL  string
+	LogoutURL  string
+	Username   string
+	Documents  []common.ConsentDocument
+	Branding   UIBranding
+}
+
+type clientSignUpPage struct {
+	CurrentURL string
+	Version    string
+	Error      string
+	Message    string
+	CSRFToken  string
+	StaticURL  string
+	LoginURL   string
+	Branding   UIBranding
+}
+
 type changeClientPasswordPage struct {
 	baseClientPage
 	Error string
@@ -225,13 +345,18 @@ type clientSharesPage struct {
 	Shares              []dataprovider.Share
 	BasePublicSharesURL string
 	EditPublicSharesURL string
+	// share IDs mapped to the client side encrypted folder including the shared paths
+	ClientEncryptedShares map[string]string
 }
 
 type clientSharePage struct {
 	baseClientPage
-	Share *dataprovider.Share
-	Error string
-	IsAdd bool
+	Share            *dataprovider.Share
+	Portal           *dataprovider.SharePortal
+	PortalFieldTypes []string
+	FileRequest      *dataprovider.ShareFileRequest
+	Error            string
+	IsAdd            bool
 }
 
 type userQuotaUsage struct {
@@ -450,6 +575,16 @@ func loadClientTemplates(templatesPath string) {
 		filepath.Join(templatesPath, templateClientDir, templateClientBase),
 		filepath.Join(templatesPath, templateClientDir, templateClientProfile),
 	}
+	shareStatsPaths := []string{
+		filepath.Join(templatesPath, templateCommonDir, templateCommonCSS),
+		filepath.Join(templatesPath, templateClientDir, templateClientBase),
+		filepath.Join(templatesPath, templateClientDir, templateClientShareStats),
+	}
+	webhooksPaths := []string{
+		filepath.Join(templatesPath, templateCommonDir, templateCommonCSS),
+		filepath.Join(templatesPath, templateClientDir, templateClientBase),
+		filepath.Join(templatesPath, templateClientDir, templateClientWebhooks),
+	}
 	changePwdPaths := []string{
 		filepath.Join(templatesPath, templateCommonDir, templateCommonCSS),
 		filepath.Join(templatesPath, templateClientDir, templateClientBase),
@@ -475,6 +610,16 @@ func loadClientTemplates(templatesPath string) {
 		filepath.Join(templatesPath, templateClientDir, templateClientBaseLogin),
 		filepath.Join(templatesPath, templateClientDir, templateClientTwoFactor),
 	}
+	consentsPath := []string{
+		filepath.Join(templatesPath, templateCommonDir, templateCommonCSS),
+		filepath.Join(templatesPath, templateClientDir, templateClientBaseLogin),
+		filepath.Join(templatesPath, templateClientDir, templateClientConsents),
+	}
+	signUpPath := []string{
+		filepath.Join(templatesPath, templateCommonDir, templateCommonCSS),
+		filepath.Join(templatesPath, templateClientDir, templateClientBaseLogin),
+		filepath.Join(templatesPath, templateClientDir, templateClientSignUp),
+	}
 	twoFactorRecoveryPath := []string{
 		filepath.Join(templatesPath, templateCommonDir, templateCommonCSS),
 		filepath.Join(templatesPath, templateClientDir, templateClientBaseLogin),
@@ -507,6 +652,11 @@ func loadClientTemplates(templatesPath string) {
 		filepath.Join(templatesPath, templateClientDir, templateClientBase),
 		filepath.Join(templatesPath, templateClientDir, templateUploadToShare),
 	}
+	sharePlayerPath := []string{
+		filepath.Join(templatesPath, templateCommonDir, templateCommonCSS),
+		filepath.Join(templatesPath, templateClientDir, templateClientBase),
+		filepath.Join(templatesPath, templateClientDir, templateSharePlayer),
+	}
 
 	editFileOfficePath := []string{
 		filepath.Join(templatesPath, templateCommonDir, templateCommonCSS),
@@ -516,40 +666,50 @@ func loadClientTemplates(templatesPath string) {
 
 	filesTmpl := util.LoadTemplate(nil, filesPaths...)
 	profileTmpl := util.LoadTemplate(nil, profilePaths...)
+	webhooksTmpl := util.LoadTemplate(nil, webhooksPaths...)
 	changePwdTmpl := util.LoadTemplate(nil, changePwdPaths...)
 	loginTmpl := util.LoadTemplate(nil, loginPath...)
 	messageTmpl := util.LoadTemplate(nil, messagePath...)
 	mfaTmpl := util.LoadTemplate(nil, mfaPath...)
 	twoFactorTmpl := util.LoadTemplate(nil, twoFactorPath...)
 	twoFactorRecoveryTmpl := util.LoadTemplate(nil, twoFactorRecoveryPath...)
+	consentsTmpl := util.LoadTemplate(nil, consentsPath...)
+	signUpTmpl := util.LoadTemplate(nil, signUpPath...)
 	editFileTmpl := util.LoadTemplate(nil, editFilePath...)
 	shareLoginTmpl := util.LoadTemplate(nil, shareLoginPath...)
 	sharesTmpl := util.LoadTemplate(nil, sharesPaths...)
 	shareTmpl := util.LoadTemplate(nil, sharePaths...)
+	shareStatsTmpl := util.LoadTemplate(nil, shareStatsPaths...)
 	forgotPwdTmpl := util.LoadTemplate(nil, forgotPwdPaths...)
 	resetPwdTmpl := util.LoadTemplate(nil, resetPwdPaths...)
 	viewPDFTmpl := util.LoadTemplate(nil, viewPDFPaths...)
 	shareFilesTmpl := util.LoadTemplate(nil, shareFilesPath...)
 	shareUploadTmpl := util.LoadTemplate(nil, shareUploadPath...)
+	sharePlayerTmpl := util.LoadTemplate(nil, sharePlayerPath...)
 	editFileOfficeTmpl := util.LoadTemplate(nil, editFileOfficePath...)
 
 	clientTemplates[templateClientFiles] = filesTmpl
 	clientTemplates[templateClientProfile] = profileTmpl
+	clientTemplates[templateClientWebhooks] = webhooksTmpl
 	clientTemplates[templateClientChangePwd] = changePwdTmpl
 	clientTemplates[templateClientLogin] = loginTmpl
 	clientTemplates[templateClientMessage] = messageTmpl
 	clientTemplates[templateClientMFA] = mfaTmpl
 	clientTemplates[templateClientTwoFactor] = twoFactorTmpl
 	clientTemplates[templateClientTwoFactorRecovery] = twoFactorRecoveryTmpl
+	clientTemplates[templateClientConsents] = consentsTmpl
+	clientTemplates[templateClientSignUp] = signUpTmpl
 	clientTemplates[templateClientEditFile] = editFileTmpl
 	clientTemplates[templateClientShares] = sharesTmpl
 	clientTemplates[templateClientShare] = shareTmpl
+	clientTemplates[templateClientShareStats] = shareStatsTmpl
 	clientTemplates[templateForgotPassword] = forgotPwdTmpl
 	clientTemplates[templateResetPassword] = resetPwdTmpl
 	clientTemplates[templateClientViewPDF] = viewPDFTmpl
 	clientTemplates[templateShareLogin] = shareLoginTmpl
 	clientTemplates[templateShareFiles] = shareFilesTmpl
 	clientTemplates[templateUploadToShare] = shareUploadTmpl
+	clientTemplates[templateSharePlayer] = sharePlayerTmpl
 	clientTemplates[templateClientEditOfficeFile] = editFileOfficeTmpl
 }
 
@@ -559,32 +719,40 @@ func (s *httpdServer) getBaseClientPageData(title, currentURL string, r *http.Re
 		csrfToken = createCSRFToken(util.GetIPFromRemoteAddress(r.RemoteAddr))
 	}
 	v := version.Get()
+	var sessionExpiresAt int64
+	if claims, err := getTokenClaims(r); err == nil {
+		sessionExpiresAt = claims.SessionExpiresAt
+	}
 
 	return baseClientPage{
-		Title:        title,
-		CurrentURL:   currentURL,
-		FilesURL:     webClientFilesPath,
-		SharesURL:    webClientSharesPath,
-		ShareURL:     webClientSharePath,
-		ProfileURL:   webClientProfilePath,
-		ChangePwdURL: webChangeClientPwdPath,
-		StaticURL:    webStaticFilesPath,
-		LogoutURL:    webClientLogoutPath,
-		MFAURL:       webClientMFAPath,
-		MFATitle:     pageClient2FATitle,
-		FilesTitle:   pageClientFilesTitle,
-		SharesTitle:  pageClientSharesTitle,
-		ProfileTitle: pageClientProfileTitle,
-		Version:      fmt.Sprintf("%v-%v", v.Version, v.CommitHash),
-		CSRFToken:    csrfToken,
-		LoggedUser:   getUserFromToken(r),
-		Branding:     s.binding.Branding.WebClient,
-	}
-}
-
-func (s *httpdServer) renderClientForgotPwdPage(w http.ResponseWriter, error, ip string) {
+		Title:            title,
+		CurrentURL:       currentURL,
+		FilesURL:         webClientFilesPath,
+		SharesURL:        webClientSharesPath,
+		ShareURL:         webClientSharePath,
+		ProfileURL:       webClientProfilePath,
+		WebhooksURL:      webClientWebhooksPath,
+		ChangePwdURL:     webChangeClientPwdPath,
+		StaticURL:        webStaticFilesPath,
+		LogoutURL:        webClientLogoutPath,
+		MFAURL:           webClientMFAPath,
+		MFATitle:         pageClient2FATitle,
+		FilesTitle:       pageClientFilesTitle,
+		SharesTitle:      pageClientSharesTitle,
+		ProfileTitle:     pageClientProfileTitle,
+		WebhooksTitle:    pageClientWebhooksTitle,
+		WebhooksEnabled:  common.IsUserWebhooksEnabled(),
+		Version:          fmt.Sprintf("%v-%v", v.Version, v.CommitHash),
+		CSRFToken:        csrfToken,
+		LoggedUser:       getUserFromToken(r),
+		Branding:         s.binding.Branding.WebClient,
+		SessionExpiresAt: sessionExpiresAt,
+	}
+}
+
+func (s *httpdServer) renderClientForgotPwdPage(w http.ResponseWriter, r *http.Request, error, ip string) {
 	data := forgotPwdPage{
-		CurrentURL: webClientForgotPwdPath,
+		CurrentURL: webClientForgotPwdPath + getTenantQuery(r),
 		Error:      error,
 		CSRFToken:  createCSRFToken(ip),
 		StaticURL:  webStaticFilesPath,
@@ -594,9 +762,23 @@ func (s *httpdServer) renderClientForgotPwdPage(w http.ResponseWriter, error, ip
 	renderClientTemplate(w, templateForgotPassword, data)
 }
 
-func (s *httpdServer) renderClientResetPwdPage(w http.ResponseWriter, _ *http.Request, error, ip string) {
+func (s *httpdServer) renderClientSignUpPage(w http.ResponseWriter, r *http.Request, error, message, ip string) {
+	data := clientSignUpPage{
+		CurrentURL: webClientSignUpPath,
+		Version:    version.Get().Version,
+		Error:      error,
+		Message:    message,
+		CSRFToken:  createCSRFToken(ip),
+		StaticURL:  webStaticFilesPath,
+		LoginURL:   webClientLoginPath,
+		Branding:   s.binding.Branding.WebClient,
+	}
+	renderClientTemplate(w, templateClientSignUp, data)
+}
+
+func (s *httpdServer) renderClientResetPwdPage(w http.ResponseWriter, r *http.Request, error, ip string) {
 	data := resetPwdPage{
-		CurrentURL: webClientResetPwdPath,
+		CurrentURL: webClientResetPwdPath + getTenantQuery(r),
 		Error:      error,
 		CSRFToken:  createCSRFToken(ip),
 		StaticURL:  webStaticFilesPath,
@@ -687,6 +869,25 @@ func (s *httpdServer) renderClientTwoFactorRecoveryPage(w http.ResponseWriter, _
 	renderClientTemplate(w, templateTwoFactorRecovery, data)
 }
 
+func (s *httpdServer) renderClientConsentsPage(w http.ResponseWriter, r *http.Request, currentURL, username string,
+	documents []common.ConsentDocument, error string,
+) {
+	data := clientConsentsPage{
+		CurrentURL: currentURL,
+		Version:    version.Get().Version,
+		Error:      error,
+		CSRFToken:  createCSRFToken(util.GetIPFromRemoteAddress(r.RemoteAddr)),
+		StaticURL:  webStaticFilesPath,
+		Username:   username,
+		Documents:  documents,
+		Branding:   s.binding.Branding.WebClient,
+	}
+	if currentURL == webClientConsentsPath {
+		data.LogoutURL = webClientLogoutPath
+	}
+	renderClientTemplate(w, templateClientConsents, data)
+}
+
 func (s *httpdServer) renderClientMFAPage(w http.ResponseWriter, r *http.Request) {
 	data := clientMFAPage{
 		baseClientPage:  s.getBaseClientPageData(pageMFATitle, webClientMFAPath, r),
@@ -775,11 +976,23 @@ func (s *httpdServer) renderAddUpdateSharePage(w http.ResponseWriter, r *http.Re
 		currentURL = fmt.Sprintf("%v/%v", webClientSharePath, url.PathEscape(share.ShareID))
 		title = "Update share"
 	}
+	portal := share.Portal
+	if portal == nil {
+		portal = &dataprovider.SharePortal{}
+	}
+	fileRequest := share.FileRequest
+	if fileRequest == nil {
+		fileRequest = &dataprovider.ShareFileRequest{NameTemplate: dataprovider.ShareFileRequestDefaultTemplate}
+	}
 	data := clientSharePage{
 		baseClientPage: s.getBaseClientPageData(title, currentURL, r),
 		Share:          share,
-		Error:          error,
-		IsAdd:          isAdd,
+		Portal:         portal,
+		PortalFieldTypes: []string{dataprovider.SharePortalFieldText, dataprovider.SharePortalFieldTextArea,
+			dataprovider.SharePortalFieldEmail, dataprovider.SharePortalFieldNumber, dataprovider.SharePortalFieldDate},
+		FileRequest: fileRequest,
+		Error:       error,
+		IsAdd:       isAdd,
 	}
 
 	renderClientTemplate(w, templateClientShare, data)
@@ -807,33 +1020,57 @@ func getDirMapping(dirName, baseWebPath string) []dirMapping {
 }
 
 func (s *httpdServer) renderSharedFilesPage(w http.ResponseWriter, r *http.Request, dirName, error string,
-	share dataprovider.Share,
+	share dataprovider.Share, clientEncrypted bool,
 ) {
 	currentURL := path.Join(webClientPubSharesPath, share.ShareID, "browse")
 	data := shareFilesPage{
-		baseClientPage: s.getBaseClientPageData(pageExtShareTitle, currentURL, r),
-		CurrentDir:     url.QueryEscape(dirName),
-		DirsURL:        path.Join(webClientPubSharesPath, share.ShareID, "dirs"),
-		FilesURL:       currentURL,
-		DownloadURL:    path.Join(webClientPubSharesPath, share.ShareID, "partial"),
-		UploadBaseURL:  path.Join(webClientPubSharesPath, share.ShareID, url.PathEscape(dirName)),
-		Error:          error,
-		Paths:          getDirMapping(dirName, currentURL),
-		Scope:          share.Scope,
+		baseClientPage:  s.getBaseClientPageData(pageExtShareTitle, currentURL, r),
+		CurrentDir:      url.QueryEscape(dirName),
+		DirsURL:         path.Join(webClientPubSharesPath, share.ShareID, "dirs"),
+		FilesURL:        currentURL,
+		DownloadURL:     path.Join(webClientPubSharesPath, share.ShareID, "partial"),
+		UploadBaseURL:   path.Join(webClientPubSharesPath, share.ShareID, url.PathEscape(dirName)),
+		Error:           error,
+		Paths:           getDirMapping(dirName, currentURL),
+		Scope:           share.Scope,
+		ClientEncrypted: clientEncrypted,
 	}
 	renderClientTemplate(w, templateShareFiles, data)
 }
 
-func (s *httpdServer) renderUploadToSharePage(w http.ResponseWriter, r *http.Request, share dataprovider.Share) {
+func (s *httpdServer) renderUploadToSharePage(w http.ResponseWriter, r *http.Request, share dataprovider.Share,
+	clientEncrypted bool,
+) {
 	currentURL := path.Join(webClientPubSharesPath, share.ShareID, "upload")
+	title := pageUploadToShareTitle
+	if share.HasPortal() {
+		title = share.GetPortalTitle()
+	}
 	data := shareUploadPage{
-		baseClientPage: s.getBaseClientPageData(pageUploadToShareTitle, currentURL, r),
-		Share:          &share,
-		UploadBasePath: path.Join(webClientPubSharesPath, share.ShareID),
+		baseClientPage:  s.getBaseClientPageData(title, currentURL, r),
+		Share:           &share,
+		UploadBasePath:  path.Join(webClientPubSharesPath, share.ShareID),
+		ClientEncrypted: clientEncrypted,
 	}
 	renderClientTemplate(w, templateUploadToShare, data)
 }
 
+func (s *httpdServer) renderSharePlayerPage(w http.ResponseWriter, r *http.Request, share dataprovider.Share,
+	name, mediaType string,
+) {
+	relativePath := share.GetRelativePath(name)
+	baseSharePath := path.Join(webClientPubSharesPath, share.ShareID)
+	data := sharePlayerPage{
+		baseClientPage: s.getBaseClientPageData(path.Base(name), path.Join(baseSharePath, "player"), r),
+		Share:          &share,
+		FileName:       path.Base(name),
+		StreamURL:      fmt.Sprintf("%s?path=%s", path.Join(baseSharePath, "stream"), url.QueryEscape(relativePath)),
+		MediaType:      mediaType,
+		BrowseURL:      fmt.Sprintf("%s?path=%s", path.Join(baseSharePath, "browse"), url.QueryEscape(path.Dir(relativePath))),
+	}
+	renderClientTemplate(w, templateSharePlayer, data)
+}
+
 func (s *httpdServer) renderFilesPage(w http.ResponseWriter, r *http.Request, dirName, error string, user *dataprovider.User,
 	hasIntegrations bool,
 ) {
@@ -855,6 +1092,20 @@ func (s *httpdServer) renderFilesPage(w http.ResponseWriter, r *http.Request, di
 		HasIntegrations: hasIntegrations,
 		Paths:           getDirMapping(dirName, webClientFilesPath),
 		QuotaUsage:      newUserQuotaUsage(user),
+		// the directory name is cleaned by the callers
+		ClientEncryptedFolder: user.GetClientEncryptedFolder(dirName),
+	}
+	if common.IsSearchEnabled() {
+		data.SearchURL = webClientSearchPath
+	}
+	if archiveJobs.getConfig().Enabled {
+		data.ArchiveJobsURL = webClientArchiveJobsPath
+	}
+	if config := thumbnails.getConfig(); config.Enabled && data.CanDownload {
+		data.ThumbnailsURL = webClientThumbnailsPath
+		data.ThumbnailSize = slices.Min(config.Sizes)
+		data.ThumbnailGridSize = slices.Max(config.Sizes)
+		data.ThumbnailsPDF = config.isPDFSupported()
 	}
 	renderClientTemplate(w, templateClientFiles, data)
 }
@@ -869,7 +1120,13 @@ func (s *httpdServer) renderClientProfilePage(w http.ResponseWriter, r *http.Req
 		s.renderClientInternalServerErrorPage(w, r, err)
 		return
 	}
-	data.PublicKeys = user.PublicKeys
+	for _, k := range user.PublicKeys {
+		data.PublicKeys = append(data.PublicKeys, clientPublicKey{
+			Key:       k,
+			ExpiresAt: getPublicKeyExpirationAsString(&user, k),
+		})
+	}
+	data.PublicKeysURL = getPublicKeysURL(user.Username)
 	data.AllowAPIKeyAuth = user.Filters.AllowAPIKeyAuth
 	data.Email = user.Email
 	data.Description = user.Description
@@ -877,6 +1134,26 @@ func (s *httpdServer) renderClientProfilePage(w http.ResponseWriter, r *http.Req
 	renderClientTemplate(w, templateClientProfile, data)
 }
 
+func (s *httpdServer) renderClientWebhooksPage(w http.ResponseWriter, r *http.Request, webhooks []dataprovider.UserWebhook,
+	error string,
+) {
+	data := clientWebhooksPage{
+		baseClientPage: s.getBaseClientPageData(pageClientWebhooksTitle, webClientWebhooksPath, r),
+		Webhooks:       webhooks,
+		Events:         dataprovider.UserWebhookEvents,
+		Error:          error,
+	}
+	if webhooks == nil {
+		user, err := dataprovider.UserExists(data.LoggedUser.Username, "")
+		if err != nil {
+			s.renderClientInternalServerErrorPage(w, r, err)
+			return
+		}
+		data.Webhooks = user.Filters.Webhooks
+	}
+	renderClientTemplate(w, templateClientWebhooks, data)
+}
+
 func (s *httpdServer) renderClientChangePasswordPage(w http.ResponseWriter, r *http.Request, error string) {
 	data := changeClientPasswordPage{
 		baseClientPage: s.getBaseClientPageData(pageClientChangePwdTitle, webChangeClientPwdPath, r),
@@ -900,7 +1177,7 @@ func (s *httpdServer) handleWebClientDownloadZip(w http.ResponseWriter, r *http.
 		return
 	}
 
-	connID := xid.New().String()
+	connID := getRequestID(r)
 	protocol := getProtocolFromRequest(r)
 	connectionID := fmt.Sprintf("%v_%v", protocol, connID)
 	if err := checkHTTPClientUser(&user, r, connectionID, false); err != nil {
@@ -926,10 +1203,15 @@ func (s *httpdServer) handleWebClientDownloadZip(w http.ResponseWriter, r *http.
 		s.renderClientMessagePage(w, r, "Unable to get files list", "", http.StatusInternalServerError, err, "")
 		return
 	}
+	format, err := getArchiveFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		s.renderClientMessagePage(w, r, "Invalid archive format", "", http.StatusBadRequest, err, "")
+		return
+	}
 
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"",
-		getCompressedFileName(connection.GetUsername(), filesList)))
-	renderCompressedFiles(w, connection, name, filesList, nil)
+		getCompressedFileName(connection.GetUsername(), filesList, format)))
+	renderCompressedFiles(w, connection, name, filesList, nil, format)
 }
 
 func (s *httpdServer) handleClientSharePartialDownload(w http.ResponseWriter, r *http.Request) {
@@ -968,11 +1250,16 @@ func (s *httpdServer) handleClientSharePartialDownload(w http.ResponseWriter, r
 		s.renderClientMessagePage(w, r, "Unable to get files list", "", http.StatusInternalServerError, err, "")
 		return
 	}
+	format, err := getArchiveFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		s.renderClientMessagePage(w, r, "Invalid archive format", "", http.StatusBadRequest, err, "")
+		return
+	}
 
-	dataprovider.UpdateShareLastUse(&share, 1) //nolint:errcheck
+	updateShareUsage(&share, connection.GetRemoteIP(), 1)
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"",
-		getCompressedFileName(fmt.Sprintf("share-%s", share.Name), filesList)))
-	renderCompressedFiles(w, connection, name, filesList, &share)
+		getCompressedFileName(fmt.Sprintf("share-%s", share.Name), filesList, format)))
+	renderCompressedFiles(w, connection, name, filesList, &share, format)
 }
 
 func (s *httpdServer) handleShareGetDirContents(w http.ResponseWriter, r *http.Request) {
@@ -1002,6 +1289,8 @@ func (s *httpdServer) handleShareGetDirContents(w http.ResponseWriter, r *http.R
 		sendAPIResponse(w, r, err, "Unable to get directory contents", getMappedStatusCode(err))
 		return
 	}
+	clientEncrypted := connection.User.GetClientEncryptedFolder(name) != ""
+	mediaConfig := mediaStreamer.getConfig()
 	results := make([]map[string]any, 0, len(contents))
 	for _, info := range contents {
 		if !info.Mode().IsDir() && !info.Mode().IsRegular() {
@@ -1020,10 +1309,14 @@ func (s *httpdServer) handleShareGetDirContents(w http.ResponseWriter, r *http.R
 		res["url"] = getFileObjectURL(share.GetRelativePath(name), info.Name(),
 			path.Join(webClientPubSharesPath, share.ShareID, "browse"))
 		res["last_modified"] = getFileObjectModTime(info.ModTime())
-		if info.Size() < httpdMaxEditFileSize {
+		if info.Size() < httpdMaxEditFileSize && !clientEncrypted {
 			res["edit_url"] = getFileObjectURL(name, info.Name(),
 				webClientEditFilePath) + fmt.Sprintf("&id=%s", share.ShareID)
 		}
+		if info.Mode().IsRegular() && !clientEncrypted && mediaConfig.getPlayerType(info.Name()) != "" {
+			res["player_url"] = getFileObjectURL(share.GetRelativePath(name), info.Name(),
+				path.Join(webClientPubSharesPath, share.ShareID, "player"))
+		}
 		results = append(results, res)
 	}
 
@@ -1032,8 +1325,9 @@ func (s *httpdServer) handleShareGetDirContents(w http.ResponseWriter, r *http.R
 
 func (s *httpdServer) handleClientUploadToShare(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
-	validScopes := []dataprovider.ShareScope{dataprovider.ShareScopeWrite, dataprovider.ShareScopeReadWrite}
-	share, _, err := s.checkPublicShare(w, r, validScopes)
+	validScopes := []dataprovider.ShareScope{dataprovider.ShareScopeWrite, dataprovider.ShareScopeReadWrite,
+		dataprovider.ShareScopeUploadPortal, dataprovider.ShareScopeFileRequest}
+	share, connection, err := s.checkPublicShare(w, r, validScopes)
 	if err != nil {
 		return
 	}
@@ -1041,7 +1335,7 @@ func (s *httpdServer) handleClientUploadToShare(w http.ResponseWriter, r *http.R
 		http.Redirect(w, r, path.Join(webClientPubSharesPath, share.ShareID, "browse"), http.StatusFound)
 		return
 	}
-	s.renderUploadToSharePage(w, r, share)
+	s.renderUploadToSharePage(w, r, share, getShareClientEncryptedFolder(&connection.User, &share) != "")
 }
 
 func (s *httpdServer) handleShareGetFiles(w http.ResponseWriter, r *http.Request) {
@@ -1073,23 +1367,65 @@ func (s *httpdServer) handleShareGetFiles(w http.ResponseWriter, r *http.Request
 	} else {
 		info, err = connection.Stat(name, 1)
 	}
+	clientEncrypted := getShareClientEncryptedFolder(&connection.User, &share) != ""
 	if err != nil {
-		s.renderSharedFilesPage(w, r, path.Dir(share.GetRelativePath(name)), err.Error(), share)
+		s.renderSharedFilesPage(w, r, path.Dir(share.GetRelativePath(name)), err.Error(), share, clientEncrypted)
 		return
 	}
 	if info.IsDir() {
-		s.renderSharedFilesPage(w, r, share.GetRelativePath(name), "", share)
+		s.renderSharedFilesPage(w, r, share.GetRelativePath(name), "", share, clientEncrypted)
 		return
 	}
-	dataprovider.UpdateShareLastUse(&share, 1) //nolint:errcheck
+	updateShareUsage(&share, connection.GetRemoteIP(), 1)
 	if status, err := downloadFile(w, r, connection, name, info, false, &share); err != nil {
-		dataprovider.UpdateShareLastUse(&share, -1) //nolint:errcheck
+		updateShareUsage(&share, connection.GetRemoteIP(), -1)
 		if status > 0 {
-			s.renderSharedFilesPage(w, r, path.Dir(share.GetRelativePath(name)), err.Error(), share)
+			s.renderSharedFilesPage(w, r, path.Dir(share.GetRelativePath(name)), err.Error(), share, clientEncrypted)
 		}
 	}
 }
 
+func (s *httpdServer) handleSharePlayer(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	validScopes := []dataprovider.ShareScope{dataprovider.ShareScopeRead, dataprovider.ShareScopeReadWrite}
+	share, connection, err := s.checkPublicShare(w, r, validScopes)
+	if err != nil {
+		return
+	}
+	if err := validateBrowsableShare(share, connection); err != nil {
+		s.renderClientMessagePage(w, r, "Unable to validate share", "", getRespStatus(err), err, "")
+		return
+	}
+	name, err := getBrowsableSharedPath(share, r)
+	if err != nil {
+		s.renderClientMessagePage(w, r, "Invalid share path", "", getRespStatus(err), err, "")
+		return
+	}
+	config := mediaStreamer.getConfig()
+	mediaType := config.getPlayerType(name)
+	if mediaType == "" || connection.User.GetClientEncryptedFolder(path.Dir(name)) != "" {
+		s.renderClientBadRequestPage(w, r, fmt.Errorf("unsupported media file %q", path.Base(name)))
+		return
+	}
+
+	if err = common.Connections.Add(connection); err != nil {
+		s.renderClientMessagePage(w, r, "Unable to add connection", "", http.StatusTooManyRequests, err, "")
+		return
+	}
+	defer common.Connections.Remove(connection.GetID())
+
+	info, err := connection.Stat(name, 1)
+	if err != nil {
+		s.renderClientMessagePage(w, r, "Unable to stat the requested file", "", getMappedStatusCode(err), err, "")
+		return
+	}
+	if !info.Mode().IsRegular() {
+		s.renderClientBadRequestPage(w, r, fmt.Errorf("%q is not a regular file", path.Base(name)))
+		return
+	}
+	s.renderSharePlayerPage(w, r, share, name, mediaType)
+}
+
 func (s *httpdServer) handleClientGetDirContents(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 	claims, err := getTokenClaims(r)
@@ -1104,7 +1440,7 @@ func (s *httpdServer) handleClientGetDirContents(w http.ResponseWriter, r *http.
 		return
 	}
 
-	connID := xid.New().String()
+	connID := getRequestID(r)
 	protocol := getProtocolFromRequest(r)
 	connectionID := fmt.Sprintf("%v_%v", protocol, connID)
 	if err := checkHTTPClientUser(&user, r, connectionID, false); err != nil {
@@ -1129,6 +1465,9 @@ func (s *httpdServer) handleClientGetDirContents(w http.ResponseWriter, r *http.
 		return
 	}
 
+	// client side encrypted files cannot be edited or opened by the integrations
+	clientEncrypted := connection.User.GetClientEncryptedFolder(name) != ""
+	mediaConfig := mediaStreamer.getConfig()
 	results := make([]map[string]any, 0, len(contents))
 	for _, info := range contents {
 		res := make(map[string]any)
@@ -1142,7 +1481,7 @@ func (s *httpdServer) handleClientGetDirContents(w http.ResponseWriter, r *http.
 				res["size"] = ""
 			} else {
 				res["size"] = info.Size()
-				if info.Size() < httpdMaxEditFileSize {
+				if info.Size() < httpdMaxEditFileSize && !clientEncrypted {
 					res["edit_url"] = strings.Replace(res["url"].(string), webClientFilesPath, webClientEditFilePath, 1)
 
 					// share request
@@ -1160,7 +1499,11 @@ func (s *httpdServer) handleClientGetDirContents(w http.ResponseWriter, r *http.
 					}
 					res["share_body"] = string(jsonShare)
 				}
-				if len(s.binding.WebClientIntegrations) > 0 {
+				if mediaType := mediaConfig.getPlayerType(info.Name()); mediaType != "" && !clientEncrypted {
+					res["stream_url"] = strings.Replace(res["url"].(string), webClientFilesPath, webClientStreamPath, 1)
+					res["media_type"] = mediaType
+				}
+				if len(s.binding.WebClientIntegrations) > 0 && !clientEncrypted {
 					extension := path.Ext(info.Name())
 					for idx := range s.binding.WebClientIntegrations {
 						if util.Contains(s.binding.WebClientIntegrations[idx].FileExtensions, extension) {
@@ -1196,7 +1539,7 @@ func (s *httpdServer) handleClientGetFiles(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	connID := xid.New().String()
+	connID := getRequestID(r)
 	protocol := getProtocolFromRequest(r)
 	connectionID := fmt.Sprintf("%v_%v", protocol, connID)
 	if err := checkHTTPClientUser(&user, r, connectionID, false); err != nil {
@@ -1271,7 +1614,7 @@ func (s *httpdServer) handleClientEditFile(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	connID := xid.New().String()
+	connID := getRequestID(r)
 	protocol := getProtocolFromRequest(r)
 	connectionID := fmt.Sprintf("%v_%v", protocol, connID)
 	if err := checkHTTPClientUser(&user, r, connectionID, false); err != nil {
@@ -1290,6 +1633,11 @@ func (s *httpdServer) handleClientEditFile(w http.ResponseWriter, r *http.Reques
 	defer common.Connections.Remove(connection.GetID())
 
 	name := connection.User.GetCleanedPath(r.URL.Query().Get("path"))
+	if connection.User.GetClientEncryptedFolder(name) != "" {
+		s.renderClientMessagePage(w, r, fmt.Sprintf("The file %q is encrypted within the browser and cannot be edited", name), "",
+			http.StatusBadRequest, nil, "")
+		return
+	}
 	info, err := connection.Stat(name, 0)
 	if err != nil {
 		s.renderClientMessagePage(w, r, fmt.Sprintf("Unable to stat file %q", name), "",
@@ -1385,6 +1733,107 @@ func (s *httpdServer) handleClientUpdateShareGet(w http.ResponseWriter, r *http.
 	}
 }
 
+func (s *httpdServer) handleClientShareStats(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		s.renderClientForbiddenPage(w, r, "Invalid token claims")
+		return
+	}
+	shareID := getURLParam(r, "id")
+	share, err := dataprovider.ShareExists(shareID, claims.Username)
+	if err != nil {
+		if errors.Is(err, util.ErrNotFound) {
+			s.renderClientNotFoundPage(w, r, err)
+		} else {
+			s.renderClientInternalServerErrorPage(w, r, err)
+		}
+		return
+	}
+	statsRange := shareStatsRanges[2]
+	for _, val := range shareStatsRanges {
+		if val.Name == r.URL.Query().Get("range") {
+			statsRange = val
+		}
+	}
+	now := time.Now()
+	filters := dataprovider.ShareStatsSearch{
+		From:        util.GetTimeAsMsSinceEpoch(now.Add(-statsRange.Duration)),
+		To:          util.GetTimeAsMsSinceEpoch(now),
+		Granularity: statsRange.Granularity,
+	}
+	stats, err := dataprovider.GetShareStats(share.ShareID, claims.Username, &filters)
+	if err != nil {
+		s.renderClientInternalServerErrorPage(w, r, err)
+		return
+	}
+	share.HideConfidentialData()
+	data := clientShareStatsPage{
+		baseClientPage: s.getBaseClientPageData(pageClientShareStatsTitle, webClientSharesPath, r),
+		Share:          &share,
+		Stats:          stats,
+		Enabled:        dataprovider.IsShareEventsEnabled(),
+		Ranges:         shareStatsRanges,
+		Range:          statsRange.Name,
+		TotalSize:      util.ByteCountIEC(stats.Bytes),
+	}
+	if stats.LastAccess > 0 {
+		data.LastAccess = util.GetTimeFromMsecSinceEpoch(stats.LastAccess).UTC().Format(time.RFC1123)
+	}
+	data.ChartWidth, data.ChartBars = getShareStatsChart(&stats)
+	for _, file := range stats.TopFiles {
+		data.TopFiles = append(data.TopFiles, shareStatsRow{
+			Path:      file.Path,
+			Downloads: file.Downloads,
+			Size:      util.ByteCountIEC(file.Bytes),
+		})
+	}
+	for _, event := range stats.RecentEvents {
+		data.RecentEvents = append(data.RecentEvents, shareStatsRow{
+			Time:      util.GetTimeFromMsecSinceEpoch(event.Timestamp).UTC().Format(time.RFC1123),
+			IP:        event.IP,
+			UserAgent: event.UserAgent,
+			Path:      event.Path,
+			Size:      util.ByteCountIEC(event.Size),
+		})
+	}
+	renderClientTemplate(w, templateClientShareStats, data)
+}
+
+// getShareStatsChart returns the width and the bars for an SVG chart with a
+// fixed height of 100 units and bars 10 units wide
+func getShareStatsChart(stats *dataprovider.ShareStats) (int, []shareStatsChartBar) {
+	var maxDownloads int64
+	for _, bucket := range stats.Timeline {
+		if bucket.Downloads > maxDownloads {
+			maxDownloads = bucket.Downloads
+		}
+	}
+	timeFormat := "2006-01-02"
+	if stats.Granularity == dataprovider.ShareStatsGranularityHour {
+		timeFormat = "2006-01-02 15:04"
+	}
+	bars := make([]shareStatsChartBar, 0, len(stats.Timeline))
+	for idx, bucket := range stats.Timeline {
+		height := 0
+		if maxDownloads > 0 {
+			height = int(bucket.Downloads * 100 / maxDownloads)
+		}
+		if bucket.Downloads > 0 && height == 0 {
+			height = 1
+		}
+		bars = append(bars, shareStatsChartBar{
+			X:      idx*10 + 1,
+			Y:      100 - height,
+			Height: height,
+			Title: fmt.Sprintf("%s: %d downloads, %s",
+				util.GetTimeFromMsecSinceEpoch(bucket.Timestamp).UTC().Format(timeFormat), bucket.Downloads,
+				util.ByteCountIEC(bucket.Bytes)),
+		})
+	}
+	return len(stats.Timeline) * 10, bars
+}
+
 func (s *httpdServer) handleClientAddSharePost(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 	claims, err := getTokenClaims(r)
@@ -1412,7 +1861,7 @@ func (s *httpdServer) handleClientAddSharePost(w http.ResponseWriter, r *http.Re
 			return
 		}
 	}
-	err = dataprovider.AddShare(share, claims.Username, ipAddr, claims.Role)
+	err = dataprovider.AddShareContext(r.Context(), share, claims.Username, ipAddr, claims.Role)
 	if err == nil {
 		http.Redirect(w, r, webClientSharesPath, http.StatusSeeOther)
 	} else {
@@ -1457,7 +1906,7 @@ func (s *httpdServer) handleClientUpdateSharePost(w http.ResponseWriter, r *http
 			return
 		}
 	}
-	err = dataprovider.UpdateShare(updatedShare, claims.Username, ipAddr, claims.Role)
+	err = dataprovider.UpdateShareContext(r.Context(), updatedShare, claims.Username, ipAddr, claims.Role)
 	if err == nil {
 		http.Redirect(w, r, webClientSharesPath, http.StatusSeeOther)
 	} else {
@@ -1493,10 +1942,18 @@ func (s *httpdServer) handleClientGetShares(w http.ResponseWriter, r *http.Reque
 		}
 	}
 	data := clientSharesPage{
-		baseClientPage:      s.getBaseClientPageData(pageClientSharesTitle, webClientSharesPath, r),
-		Shares:              shares,
-		BasePublicSharesURL: webClientPubSharesPath,
-		EditPublicSharesURL: webClientEditFilePathDefault,
+		baseClientPage:        s.getBaseClientPageData(pageClientSharesTitle, webClientSharesPath, r),
+		Shares:                shares,
+		BasePublicSharesURL:   webClientPubSharesPath,
+		EditPublicSharesURL:   webClientEditFilePathDefault,
+		ClientEncryptedShares: make(map[string]string),
+	}
+	if user, err := dataprovider.GetUserWithGroupSettings(claims.Username, ""); err == nil {
+		for idx := range shares {
+			if folder := getShareClientEncryptedFolder(&user, &shares[idx]); folder != "" {
+				data.ClientEncryptedShares[shares[idx].ShareID] = folder
+			}
+		}
 	}
 	renderClientTemplate(w, templateClientShares, data)
 }
@@ -1506,6 +1963,241 @@ func (s *httpdServer) handleClientGetProfile(w http.ResponseWriter, r *http.Requ
 	s.renderClientProfilePage(w, r, "")
 }
 
+func (s *httpdServer) handleClientGetConsents(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		s.renderClientForbiddenPage(w, r, "Invalid token claims")
+		return
+	}
+	user, err := dataprovider.GetUserWithGroupSettings(claims.Username, "")
+	if err != nil {
+		s.renderClientInternalServerErrorPage(w, r, err)
+		return
+	}
+	pending := common.GetPendingConsents(&user)
+	if len(pending) == 0 {
+		s.updateConsentsClaim(w, r, claims, &user)
+		http.Redirect(w, r, webClientFilesPath, http.StatusFound)
+		return
+	}
+	s.renderClientConsentsPage(w, r, webClientConsentsPath, user.Username, pending, "")
+}
+
+func (s *httpdServer) handleWebClientConsentsPost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		s.renderClientForbiddenPage(w, r, "Invalid token claims")
+		return
+	}
+	user, err := dataprovider.GetUserWithGroupSettings(claims.Username, "")
+	if err != nil {
+		s.renderClientInternalServerErrorPage(w, r, err)
+		return
+	}
+	pending, err := acceptConsents(r, &user, dataprovider.ConsentMethodWebClient)
+	if err != nil {
+		if errors.Is(err, util.ErrValidation) {
+			s.renderClientConsentsPage(w, r, webClientConsentsPath, user.Username, pending, err.Error())
+			return
+		}
+		s.renderClientForbiddenPage(w, r, err.Error())
+		return
+	}
+	user, err = dataprovider.GetUserWithGroupSettings(claims.Username, "")
+	if err != nil {
+		s.renderClientInternalServerErrorPage(w, r, err)
+		return
+	}
+	s.updateConsentsClaim(w, r, claims, &user)
+	http.Redirect(w, r, webClientFilesPath, http.StatusFound)
+}
+
+// updateConsentsClaim refreshes the login cookie, or the OpenID Connect token,
+// after the user accepted the consent documents
+func (s *httpdServer) updateConsentsClaim(w http.ResponseWriter, r *http.Request, claims jwtTokenClaims,
+	user *dataprovider.User,
+) {
+	if !claims.MustAcceptConsents {
+		return
+	}
+	if cookie, ok := r.Context().Value(oidcTokenKey).(string); ok {
+		token, err := oidcMgr.getToken(cookie)
+		if err != nil {
+			return
+		}
+		token.MustAcceptConsents = common.MustAcceptConsents(user)
+		oidcMgr.addToken(token)
+		return
+	}
+	claims.MustAcceptConsents = common.MustAcceptConsents(user)
+	claims.Signature = user.GetSignature()
+	err := claims.createAndSetCookie(w, r, s.tokenAuth, tokenAudienceWebClient, util.GetIPFromRemoteAddress(r.RemoteAddr))
+	if err != nil {
+		logger.Warn(logSender, getRequestID(r), "unable to refresh the cookie for user %q after accepting consents: %v",
+			user.Username, err)
+	}
+}
+
+func (s *httpdServer) getUserFromConsentLink(r *http.Request) (string, dataprovider.User, error) {
+	code := getURLParam(r, "code")
+	link, err := consentLinksMgr.Get(code)
+	if err != nil || link.isExpired() {
+		return code, dataprovider.User{}, util.NewRecordNotFoundError("consent link not found or expired")
+	}
+	user, err := dataprovider.GetUserWithGroupSettings(link.Username, "")
+	return code, user, err
+}
+
+func (s *httpdServer) handleClientConsentLinkGet(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	code, user, err := s.getUserFromConsentLink(r)
+	if err != nil {
+		s.renderClientNotFoundPage(w, r, err)
+		return
+	}
+	pending := common.GetPendingConsents(&user)
+	if len(pending) == 0 {
+		consentLinksMgr.Delete(code) //nolint:errcheck
+		s.renderClientMessagePage(w, r, "Consents accepted", "", http.StatusOK, nil,
+			"There are no documents left to accept")
+		return
+	}
+	s.renderClientConsentsPage(w, r, path.Join(webClientConsentLinkPath, code), user.Username, pending, "")
+}
+
+func (s *httpdServer) handleClientConsentLinkPost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	code, user, err := s.getUserFromConsentLink(r)
+	if err != nil {
+		s.renderClientNotFoundPage(w, r, err)
+		return
+	}
+	pending, err := acceptConsents(r, &user, dataprovider.ConsentMethodLink)
+	if err != nil {
+		if errors.Is(err, util.ErrValidation) {
+			s.renderClientConsentsPage(w, r, path.Join(webClientConsentLinkPath, code), user.Username, pending, err.Error())
+			return
+		}
+		s.renderClientForbiddenPage(w, r, err.Error())
+		return
+	}
+	consentLinksMgr.Delete(code) //nolint:errcheck
+	s.renderClientMessagePage(w, r, "Consents accepted", "", http.StatusOK, nil,
+		"Thank you, your acceptance has been recorded")
+}
+
+// acceptConsents records the acceptance of the pending consent documents for
+// the specified user. All the pending documents must be accepted
+func acceptConsents(r *http.Request, user *dataprovider.User, method string) ([]common.ConsentDocument, error) {
+	pending := common.GetPendingConsents(user)
+	if err := r.ParseForm(); err != nil {
+		return pending, util.NewValidationError(err.Error())
+	}
+	ipAddr := util.GetIPFromRemoteAddress(r.RemoteAddr)
+	if err := verifyCSRFToken(r.Form.Get(csrfFormToken), ipAddr); err != nil {
+		return pending, err
+	}
+	if len(pending) == 0 {
+		return pending, nil
+	}
+	for _, doc := range pending {
+		if !util.Contains(r.Form["consents"], doc.Name) {
+			return pending, util.NewValidationError(fmt.Sprintf("Please accept %q to continue", doc.Title))
+		}
+	}
+	err := dataprovider.AddUserConsents(r.Context(), user.Username, common.GetConsentRecords(pending, ipAddr, method),
+		dataprovider.ActionExecutorSelf, ipAddr, user.Role)
+	if err != nil {
+		return pending, err
+	}
+	logger.Info(logSender, getRequestID(r), "user %q accepted the consent documents %v, method %q",
+		user.Username, getConsentDocumentNames(pending), method)
+	return nil, nil
+}
+
+func getConsentDocumentNames(documents []common.ConsentDocument) []string {
+	result := make([]string, 0, len(documents))
+	for _, doc := range documents {
+		result = append(result, doc.Name)
+	}
+	return result
+}
+
+func (s *httpdServer) handleClientGetWebhooks(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	s.renderClientWebhooksPage(w, r, nil, "")
+}
+
+func (s *httpdServer) handleWebClientWebhooksPost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	err := r.ParseForm()
+	if err != nil {
+		s.renderClientWebhooksPage(w, r, nil, err.Error())
+		return
+	}
+	ipAddr := util.GetIPFromRemoteAddress(r.RemoteAddr)
+	if err := verifyCSRFToken(r.Form.Get(csrfFormToken), ipAddr); err != nil {
+		s.renderClientForbiddenPage(w, r, err.Error())
+		return
+	}
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		s.renderClientForbiddenPage(w, r, "Invalid token claims")
+		return
+	}
+	user, userMerged, err := dataprovider.GetUserVariants(claims.Username, "")
+	if err != nil {
+		s.renderClientWebhooksPage(w, r, nil, err.Error())
+		return
+	}
+	webhooks := getUserWebhooksFromPostFields(r)
+	if err := checkUserWebhooksPaths(&userMerged, webhooks); err != nil {
+		s.renderClientWebhooksPage(w, r, webhooks, err.Error())
+		return
+	}
+	currentWebhooks := user.Filters.Webhooks
+	user.Filters.Webhooks = webhooks
+	user.SetWebhookSecretsFrom(currentWebhooks)
+	err = dataprovider.UpdateUserContext(r.Context(), &user, dataprovider.ActionExecutorSelf, ipAddr, user.Role)
+	if err != nil {
+		s.renderClientWebhooksPage(w, r, webhooks, err.Error())
+		return
+	}
+	s.renderClientMessagePage(w, r, "Webhooks updated", "", http.StatusOK, nil,
+		"Your webhooks have been successfully updated")
+}
+
+// getUserWebhooksFromPostFields returns the webhooks defined in the posted form.
+// Blank secrets are returned as nil, this way the current secrets are preserved
+func getUserWebhooksFromPostFields(r *http.Request) []dataprovider.UserWebhook {
+	var res []dataprovider.UserWebhook
+	for k := range r.Form {
+		if strings.HasPrefix(k, "webhook_name") {
+			name := strings.TrimSpace(r.Form.Get(k))
+			if name == "" {
+				continue
+			}
+			idx := strings.TrimPrefix(k, "webhook_name")
+			webhook := dataprovider.UserWebhook{
+				Name:   name,
+				Path:   strings.TrimSpace(r.Form.Get(fmt.Sprintf("webhook_path%s", idx))),
+				URL:    strings.TrimSpace(r.Form.Get(fmt.Sprintf("webhook_url%s", idx))),
+				Events: r.Form[fmt.Sprintf("webhook_events%s", idx)],
+			}
+			if secret := r.Form.Get(fmt.Sprintf("webhook_secret%s", idx)); secret != "" {
+				webhook.Secret = kms.NewPlainSecret(secret)
+			}
+			res = append(res, webhook)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
 func (s *httpdServer) handleWebClientChangePwd(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 	s.renderClientChangePasswordPage(w, r, "")
@@ -1539,6 +2231,12 @@ func (s *httpdServer) handleWebClientProfilePost(w http.ResponseWriter, r *http.
 	}
 	if userMerged.CanManagePublicKeys() {
 		user.PublicKeys = r.Form["public_keys"]
+		expirations, err := getPublicKeysExpirationFromPostFields(r)
+		if err != nil {
+			s.renderClientProfilePage(w, r, err.Error())
+			return
+		}
+		user.Filters.PublicKeysExpiration = expirations
 	}
 	if userMerged.CanChangeAPIKeyAuth() {
 		user.Filters.AllowAPIKeyAuth = r.Form.Get("allow_api_key_auth") != ""
@@ -1547,7 +2245,7 @@ func (s *httpdServer) handleWebClientProfilePost(w http.ResponseWriter, r *http.
 		user.Email = strings.TrimSpace(r.Form.Get("email"))
 		user.Description = r.Form.Get("description")
 	}
-	err = dataprovider.UpdateUser(&user, dataprovider.ActionExecutorSelf, ipAddr, user.Role)
+	err = dataprovider.UpdateUserContext(r.Context(), &user, dataprovider.ActionExecutorSelf, ipAddr, user.Role)
 	if err != nil {
 		s.renderClientProfilePage(w, r, err.Error())
 		return
@@ -1556,6 +2254,48 @@ func (s *httpdServer) handleWebClientProfilePost(w http.ResponseWriter, r *http.
 		"Your profile has been successfully updated")
 }
 
+func getPublicKeyExpirationAsString(user *dataprovider.User, key string) string {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return ""
+	}
+	expiresAt := user.GetPublicKeyExpiration(ssh.FingerprintSHA256(pubKey))
+	if expiresAt == 0 {
+		return ""
+	}
+	return util.GetTimeFromMsecSinceEpoch(expiresAt).UTC().Format(webDateFormat)
+}
+
+// getPublicKeysExpirationFromPostFields returns the expiration dates for the posted
+// public keys. Each public key field has a matching expiration field
+func getPublicKeysExpirationFromPostFields(r *http.Request) ([]dataprovider.PublicKeyExpiration, error) {
+	var result []dataprovider.PublicKeyExpiration
+	expirations := r.Form["public_keys_expiration"]
+	for idx, k := range r.Form["public_keys"] {
+		if idx >= len(expirations) {
+			break
+		}
+		expiration := strings.TrimSpace(expirations[idx])
+		if k == "" || expiration == "" {
+			continue
+		}
+		expiresAt, err := time.Parse(webDateFormat, expiration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiration date for public key nr. %d: %w", idx+1, err)
+		}
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
+		if err != nil {
+			// invalid keys are reported by the data provider
+			continue
+		}
+		result = append(result, dataprovider.PublicKeyExpiration{
+			Fingerprint: ssh.FingerprintSHA256(pubKey),
+			ExpiresAt:   util.GetTimeAsMsSinceEpoch(expiresAt),
+		})
+	}
+	return result, nil
+}
+
 func (s *httpdServer) handleWebClientMFA(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 	s.renderClientMFAPage(w, r)
@@ -1595,6 +2335,20 @@ func getShareFromPostFields(r *http.Request) (*dataprovider.Share, error) {
 		return share, err
 	}
 	share.MaxTokens = maxTokens
+	if val := r.Form.Get("max_downloads_per_ip"); val != "" {
+		share.MaxDownloadsPerIP, err = strconv.Atoi(val)
+		if err != nil {
+			return share, err
+		}
+	}
+	if val := r.Form.Get("notify_before_expiration"); val != "" {
+		share.NotifyBeforeExpiration, err = strconv.Atoi(val)
+		if err != nil {
+			return share, err
+		}
+	}
+	share.BurnAfterDownload = r.Form.Get("burn_after_download") != ""
+	share.NotifyOnUse = r.Form.Get("notify_on_use") != ""
 	expirationDateMillis := int64(0)
 	expirationDateString := strings.TrimSpace(r.Form.Get("expiration_date"))
 	if expirationDateString != "" {
@@ -1605,16 +2359,57 @@ func getShareFromPostFields(r *http.Request) (*dataprovider.Share, error) {
 		expirationDateMillis = util.GetTimeAsMsSinceEpoch(expirationDate)
 	}
 	share.ExpiresAt = expirationDateMillis
+	if share.HasPortal() {
+		share.Portal = getSharePortalFromPostFields(r)
+	}
+	if share.Scope == dataprovider.ShareScopeFileRequest {
+		share.FileRequest = &dataprovider.ShareFileRequest{
+			NameTemplate:    strings.TrimSpace(r.Form.Get("file_request_template")),
+			RequireUploader: r.Form.Get("file_request_require_uploader") != "",
+		}
+	}
 	return share, nil
 }
 
+func getSharePortalFromPostFields(r *http.Request) *dataprovider.SharePortal {
+	portal := &dataprovider.SharePortal{
+		Title:   strings.TrimSpace(r.Form.Get("portal_title")),
+		Text:    strings.TrimSpace(r.Form.Get("portal_text")),
+		LogoURL: strings.TrimSpace(r.Form.Get("portal_logo_url")),
+	}
+	names := r.Form["portal_field_name"]
+	labels := r.Form["portal_field_label"]
+	types := r.Form["portal_field_type"]
+	required := r.Form["portal_field_required"]
+	for idx, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		field := dataprovider.SharePortalField{
+			Name: name,
+		}
+		if idx < len(labels) {
+			field.Label = strings.TrimSpace(labels[idx])
+		}
+		if idx < len(types) {
+			field.Type = types[idx]
+		}
+		if idx < len(required) {
+			field.Required = required[idx] == "1"
+		}
+		portal.Fields = append(portal.Fields, field)
+	}
+	return portal
+}
+
 func (s *httpdServer) handleWebClientForgotPwd(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
-	if !smtp.IsEnabled() {
+	if !isWebClientPasswordResetEnabled(r) {
 		s.renderClientNotFoundPage(w, r, errors.New("this page does not exist"))
 		return
 	}
-	s.renderClientForgotPwdPage(w, "", util.GetIPFromRemoteAddress(r.RemoteAddr))
+	s.renderClientForgotPwdPage(w, r, "", util.GetIPFromRemoteAddress(r.RemoteAddr))
 }
 
 func (s *httpdServer) handleWebClientForgotPwdPost(w http.ResponseWriter, r *http.Request) {
@@ -1623,7 +2418,7 @@ func (s *httpdServer) handleWebClientForgotPwdPost(w http.ResponseWriter, r *htt
 	ipAddr := util.GetIPFromRemoteAddress(r.RemoteAddr)
 	err := r.ParseForm()
 	if err != nil {
-		s.renderClientForgotPwdPage(w, err.Error(), ipAddr)
+		s.renderClientForgotPwdPage(w, r, err.Error(), ipAddr)
 		return
 	}
 	if err := verifyCSRFToken(r.Form.Get(csrfFormToken), ipAddr); err != nil {
@@ -1634,18 +2429,55 @@ func (s *httpdServer) handleWebClientForgotPwdPost(w http.ResponseWriter, r *htt
 	err = handleForgotPassword(r, username, false)
 	if err != nil {
 		if e, ok := err.(*util.ValidationError); ok {
-			s.renderClientForgotPwdPage(w, e.GetErrorString(), ipAddr)
+			s.renderClientForgotPwdPage(w, r, e.GetErrorString(), ipAddr)
+			return
+		}
+		s.renderClientForgotPwdPage(w, r, err.Error(), ipAddr)
+		return
+	}
+	http.Redirect(w, r, webClientResetPwdPath+getTenantQuery(r), http.StatusFound)
+}
+
+func (s *httpdServer) handleWebClientSignUp(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxLoginBodySize)
+	s.renderClientSignUpPage(w, r, "", "", util.GetIPFromRemoteAddress(r.RemoteAddr))
+}
+
+func (s *httpdServer) handleWebClientSignUpPost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxLoginBodySize)
+
+	ipAddr := util.GetIPFromRemoteAddress(r.RemoteAddr)
+	err := r.ParseForm()
+	if err != nil {
+		s.renderClientSignUpPage(w, r, err.Error(), "", ipAddr)
+		return
+	}
+	if err := verifyCSRFToken(r.Form.Get(csrfFormToken), ipAddr); err != nil {
+		s.renderClientForbiddenPage(w, r, err.Error())
+		return
+	}
+	password := r.Form.Get("password")
+	if password != r.Form.Get("confirm_password") {
+		s.renderClientSignUpPage(w, r, "The two password fields do not match", "", ipAddr)
+		return
+	}
+	_, err = registerUser(r.Context(), strings.TrimSpace(r.Form.Get("username")), strings.TrimSpace(r.Form.Get("email")),
+		password, ipAddr)
+	if err != nil {
+		if e, ok := err.(*util.ValidationError); ok {
+			s.renderClientSignUpPage(w, r, e.GetErrorString(), "", ipAddr)
 			return
 		}
-		s.renderClientForgotPwdPage(w, err.Error(), ipAddr)
+		s.renderClientSignUpPage(w, r, err.Error(), "", ipAddr)
 		return
 	}
-	http.Redirect(w, r, webClientResetPwdPath, http.StatusFound)
+	s.renderClientSignUpPage(w, r, "",
+		"Your registration has been received. You will be able to login once an administrator approves it", ipAddr)
 }
 
 func (s *httpdServer) handleWebClientPasswordReset(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxLoginBodySize)
-	if !smtp.IsEnabled() {
+	if !isWebClientPasswordResetEnabled(r) {
 		s.renderClientNotFoundPage(w, r, errors.New("this page does not exist"))
 		return
 	}
@@ -1688,7 +2520,7 @@ func (s *httpdServer) handleClientGetPDF(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	connID := xid.New().String()
+	connID := getRequestID(r)
 	protocol := getProtocolFromRequest(r)
 	connectionID := fmt.Sprintf("%v_%v", protocol, connID)
 	if err := checkHTTPClientUser(&user, r, connectionID, false); err != nil {
@@ -0,0 +1,426 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package httpd
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwt"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	webSessionTypeAdmin   = "admin"
+	webSessionTypeUser    = "user"
+	webSessionSourceWeb   = "web"
+	webSessionSourceAPI   = "api"
+	revokedWebSessionKey  = "revoked_"
+	webSessionTimeDisplay = "2006-01-02 15:04"
+)
+
+var (
+	webSessionsMgr webSessionManager
+)
+
+// webSession defines an authenticated WebAdmin, WebClient or REST API session.
+// A session starts with a login and it is kept alive while its JWT tokens are
+// refreshed
+type webSession struct {
+	ID        string `json:"id"`
+	Username  string `json:"username"`
+	Type      string `json:"type"`
+	Role      string `json:"role,omitempty"`
+	Source    string `json:"source"`
+	IP        string `json:"ip"`
+	CreatedAt int64  `json:"created_at"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+func (s *webSession) isExpired() bool {
+	return s.ExpiresAt < util.GetTimeAsMsSinceEpoch(time.Now())
+}
+
+// getRevocationExpiration returns the expiration for the revocation list entry,
+// the tokens issued for the session cannot be valid after this time
+func (s *webSession) getRevocationExpiration() int64 {
+	minExpiration := util.GetTimeAsMsSinceEpoch(time.Now().Add(tokenDuration))
+	if s.ExpiresAt > minExpiration {
+		return s.ExpiresAt
+	}
+	return minExpiration
+}
+
+// GetCreatedAsString returns the session creation time as string
+func (s *webSession) GetCreatedAsString() string {
+	return util.GetTimeFromMsecSinceEpoch(s.CreatedAt).Format(webSessionTimeDisplay)
+}
+
+// GetExpirationAsString returns the session expiration time as string
+func (s *webSession) GetExpirationAsString() string {
+	return util.GetTimeFromMsecSinceEpoch(s.ExpiresAt).Format(webSessionTimeDisplay)
+}
+
+type webSessionManager interface {
+	add(session *webSession) error
+	get(id string) (*webSession, error)
+	getAll() ([]webSession, error)
+	revoke(session *webSession) error
+	isRevoked(id string) bool
+	cleanup()
+}
+
+func newWebSessionManager(isShared int) webSessionManager {
+	if isShared == 1 {
+		logger.Info(logSender, "", "using provider web session manager")
+		return &dbWebSessionManager{}
+	}
+	logger.Info(logSender, "", "using memory web session manager")
+	mgr := &memoryWebSessionManager{}
+	mgr.loadRevoked()
+	return mgr
+}
+
+// addRevokedWebSession persists the revocation for the specified session in
+// the data provider, revocations must survive restarts
+func addRevokedWebSession(session *webSession) error {
+	return dataprovider.AddSharedSession(dataprovider.Session{
+		Key:       revokedWebSessionKey + session.ID,
+		Data:      session.ID,
+		Type:      dataprovider.SessionTypeRevokedWebSession,
+		Timestamp: session.getRevocationExpiration(),
+	})
+}
+
+// memoryWebSessionManager keeps the sessions in memory. Revocations are
+// stored in the data provider too and the memory manager acts as a cache in
+// front of it: the revocation list is loaded at startup and kept updated, this
+// is enough since the revocations are added by this instance only
+type memoryWebSessionManager struct {
+	sessions sync.Map
+	revoked  sync.Map
+}
+
+func (m *memoryWebSessionManager) loadRevoked() {
+	sessions, err := dataprovider.GetSharedSessions(dataprovider.SessionTypeRevokedWebSession, time.Now())
+	if err != nil {
+		logger.Warn(logSender, "", "unable to load revoked web sessions: %v", err)
+		return
+	}
+	for _, session := range sessions {
+		m.revoked.Store(strings.TrimPrefix(session.Key, revokedWebSessionKey), session.Timestamp)
+	}
+	logger.Debug(logSender, "", "revoked web sessions loaded: %d", len(sessions))
+}
+
+func (m *memoryWebSessionManager) add(session *webSession) error {
+	m.sessions.Store(session.ID, *session)
+	return nil
+}
+
+func (m *memoryWebSessionManager) get(id string) (*webSession, error) {
+	val, ok := m.sessions.Load(id)
+	if !ok {
+		return nil, util.NewRecordNotFoundError("session not found")
+	}
+	session := val.(webSession)
+	if session.isExpired() {
+		return nil, util.NewRecordNotFoundError("session expired")
+	}
+	return &session, nil
+}
+
+func (m *memoryWebSessionManager) getAll() ([]webSession, error) {
+	var sessions []webSession
+	m.sessions.Range(func(_, value any) bool {
+		session := value.(webSession)
+		if !session.isExpired() {
+			sessions = append(sessions, session)
+		}
+		return true
+	})
+	return sessions, nil
+}
+
+func (m *memoryWebSessionManager) revoke(session *webSession) error {
+	if err := addRevokedWebSession(session); err != nil {
+		return err
+	}
+	m.revoked.Store(session.ID, session.getRevocationExpiration())
+	m.sessions.Delete(session.ID)
+	return nil
+}
+
+func (m *memoryWebSessionManager) isRevoked(id string) bool {
+	val, ok := m.revoked.Load(id)
+	if !ok {
+		return false
+	}
+	return val.(int64) >= util.GetTimeAsMsSinceEpoch(time.Now())
+}
+
+func (m *memoryWebSessionManager) cleanup() {
+	now := util.GetTimeAsMsSinceEpoch(time.Now())
+	m.sessions.Range(func(key, value any) bool {
+		if session := value.(webSession); session.ExpiresAt < now {
+			m.sessions.Delete(key)
+		}
+		return true
+	})
+	m.revoked.Range(func(key, value any) bool {
+		if value.(int64) < now {
+			m.revoked.Delete(key)
+		}
+		return true
+	})
+	dataprovider.CleanupSharedSessions(dataprovider.SessionTypeRevokedWebSession, time.Now()) //nolint:errcheck
+}
+
+type dbWebSessionManager struct{}
+
+func (m *dbWebSessionManager) add(session *webSession) error {
+	return dataprovider.AddSharedSession(dataprovider.Session{
+		Key:       session.ID,
+		Data:      session,
+		Type:      dataprovider.SessionTypeWebSession,
+		Timestamp: session.ExpiresAt,
+	})
+}
+
+func (m *dbWebSessionManager) get(id string) (*webSession, error) {
+	session, err := dataprovider.GetSharedSession(id)
+	if err != nil {
+		return nil, err
+	}
+	if session.Type != dataprovider.SessionTypeWebSession {
+		return nil, util.NewRecordNotFoundError("session not found")
+	}
+	s, err := m.decodeData(session.Data)
+	if err != nil {
+		return nil, err
+	}
+	if s.isExpired() {
+		return nil, util.NewRecordNotFoundError("session expired")
+	}
+	return s, nil
+}
+
+func (m *dbWebSessionManager) getAll() ([]webSession, error) {
+	sessions, err := dataprovider.GetSharedSessions(dataprovider.SessionTypeWebSession, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	result := make([]webSession, 0, len(sessions))
+	for _, session := range sessions {
+		s, err := m.decodeData(session.Data)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *s)
+	}
+	return result, nil
+}
+
+func (m *dbWebSessionManager) revoke(session *webSession) error {
+	if err := addRevokedWebSession(session); err != nil {
+		return err
+	}
+	if session.Username != "" {
+		dataprovider.DeleteSharedSession(session.ID) //nolint:errcheck
+	}
+	return nil
+}
+
+func (m *dbWebSessionManager) isRevoked(id string) bool {
+	session, err := dataprovider.GetSharedSession(revokedWebSessionKey + id)
+	if err != nil {
+		return false
+	}
+	return session.Timestamp >= util.GetTimeAsMsSinceEpoch(time.Now())
+}
+
+func (m *dbWebSessionManager) decodeData(data any) (*webSession, error) {
+	if val, ok := data.([]byte); ok {
+		session := &webSession{}
+		err := json.Unmarshal(val, session)
+		return session, err
+	}
+	logger.Error(logSender, "", "invalid web session data type %T", data)
+	return nil, util.NewRecordNotFoundError("invalid web session")
+}
+
+func (m *dbWebSessionManager) cleanup() {
+	dataprovider.CleanupSharedSessions(dataprovider.SessionTypeWebSession, time.Now())        //nolint:errcheck
+	dataprovider.CleanupSharedSessions(dataprovider.SessionTypeRevokedWebSession, time.Now()) //nolint:errcheck
+}
+
+// getWebSessionAttributes returns the session type and source for the
+// specified audience. Only the audiences for fully authenticated admins and
+// users are tracked
+func getWebSessionAttributes(audience tokenAudience) (string, string, bool) {
+	switch audience {
+	case tokenAudienceWebAdmin:
+		return webSessionTypeAdmin, webSessionSourceWeb, true
+	case tokenAudienceAPI:
+		return webSessionTypeAdmin, webSessionSourceAPI, true
+	case tokenAudienceWebClient:
+		return webSessionTypeUser, webSessionSourceWeb, true
+	case tokenAudienceAPIUser:
+		return webSessionTypeUser, webSessionSourceAPI, true
+	default:
+		return "", "", false
+	}
+}
+
+// trackWebSession starts a new session or updates the expiration for an
+// existing one. Sessions are only tracked for tokens issued after a login,
+// tokens generated using API keys, node tokens or OpenID Connect are excluded
+func (c *jwtTokenClaims) trackWebSession(audience tokenAudience, ip string, expiration time.Time) {
+	if c.Signature == "" || c.APIKeyID != "" || c.NodeID != "" {
+		return
+	}
+	sessionType, source, ok := getWebSessionAttributes(audience)
+	if !ok {
+		return
+	}
+	session := &webSession{
+		Username:  c.Username,
+		Type:      sessionType,
+		Role:      c.Role,
+		Source:    source,
+		IP:        ip,
+		CreatedAt: util.GetTimeAsMsSinceEpoch(time.Now()),
+	}
+	if c.SessionID != "" {
+		if webSessionsMgr.isRevoked(c.SessionID) {
+			return
+		}
+		if existing, err := webSessionsMgr.get(c.SessionID); err == nil {
+			session.CreatedAt = existing.CreatedAt
+		}
+	} else {
+		c.SessionID = util.GenerateUniqueID()
+	}
+	session.ID = c.SessionID
+	session.ExpiresAt = util.GetTimeAsMsSinceEpoch(expiration)
+	if err := webSessionsMgr.add(session); err != nil {
+		logger.Warn(logSender, "", "unable to save session %q for %q: %v", session.ID, session.Username, err)
+	}
+}
+
+// isWebSessionRevoked returns true if the session for the specified token has been revoked
+func isWebSessionRevoked(token jwt.Token) bool {
+	val, ok := token.Get(claimSessionID)
+	if !ok {
+		return false
+	}
+	sessionID, ok := val.(string)
+	if !ok || sessionID == "" {
+		return false
+	}
+	return webSessionsMgr.isRevoked(sessionID)
+}
+
+// revokeWebSession adds the session with the specified ID to the revocation list
+func revokeWebSession(id string) error {
+	session, err := webSessionsMgr.get(id)
+	if err != nil {
+		session = &webSession{
+			ID: id,
+		}
+	}
+	return webSessionsMgr.revoke(session)
+}
+
+// revokeAllWebSessions revokes all the sessions for the specified admin or user
+// and returns the number of revoked sessions
+func revokeAllWebSessions(username, sessionType string) (int, error) {
+	sessions, err := webSessionsMgr.getAll()
+	if err != nil {
+		return 0, err
+	}
+	revoked := 0
+	for idx := range sessions {
+		session := &sessions[idx]
+		if session.Username != username || session.Type != sessionType {
+			continue
+		}
+		if err := webSessionsMgr.revoke(session); err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+// getWebSessions returns the sessions the admin with the specified claims can view
+func (c *jwtTokenClaims) getWebSessions() ([]webSession, error) {
+	sessions, err := webSessionsMgr.getAll()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]webSession, 0, len(sessions))
+	usersInScope := make(map[string]bool)
+	for idx := range sessions {
+		session := &sessions[idx]
+		if session.Type == webSessionTypeAdmin {
+			if c.hasPerm(dataprovider.PermAdminAdminsRead) {
+				result = append(result, *session)
+			}
+			continue
+		}
+		if c.Role != "" && session.Role != c.Role {
+			continue
+		}
+		inScope, ok := usersInScope[session.Username]
+		if !ok {
+			inScope = c.canManageUserWebSessions(session.Username)
+			usersInScope[session.Username] = inScope
+		}
+		if inScope {
+			result = append(result, *session)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt > result[j].CreatedAt
+	})
+	return result, nil
+}
+
+func (c *jwtTokenClaims) canManageUserWebSessions(username string) bool {
+	if len(c.UserGroups) == 0 {
+		return true
+	}
+	_, err := c.getUser(username)
+	return err == nil
+}
+
+// canRevokeWebSession returns true if the admin with the specified claims can
+// revoke the specified session
+func (c *jwtTokenClaims) canRevokeWebSession(session *webSession) bool {
+	if session.Type == webSessionTypeAdmin {
+		return c.hasPerm(dataprovider.PermAdminAdminsUpdate)
+	}
+	if c.Role != "" && session.Role != c.Role {
+		return false
+	}
+	return c.canManageUserWebSessions(session.Username)
+}
@@ -64,6 +64,7 @@ const (
 	eventRulesPath        = "/api/v2/eventrules"
 	rolesPath             = "/api/v2/roles"
 	ipListsPath           = "/api/v2/iplists"
+	auditLogPath          = "/api/v2/auditlog"
 )
 
 const (
@@ -816,6 +817,40 @@ func UpdateAPIKey(apiKey dataprovider.APIKey, expectedStatusCode int) (dataprovi
 	return newAPIKey, body, err
 }
 
+// RotateAPIKey generates a new secret for an existing API key and checks the received HTTP Status code
+// against expectedStatusCode. The returned string is the new key
+func RotateAPIKey(keyID string, gracePeriod int, expectedStatusCode int) (string, []byte, error) {
+	var body []byte
+	u, err := url.Parse(buildURLRelativeToBase(apiKeysPath, url.PathEscape(keyID), "rotate"))
+	if err != nil {
+		return "", body, err
+	}
+	if gracePeriod >= 0 {
+		q := u.Query()
+		q.Add("grace_period", strconv.Itoa(gracePeriod))
+		u.RawQuery = q.Encode()
+	}
+	resp, err := sendHTTPRequest(http.MethodPost, u.String(), nil, "", getDefaultToken())
+	if err != nil {
+		return "", body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	if err := checkResponse(resp.StatusCode, expectedStatusCode); err != nil {
+		return "", body, err
+	}
+	if expectedStatusCode != http.StatusOK {
+		return "", body, nil
+	}
+	response := make(map[string]any)
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return "", body, err
+	}
+	key, _ := response["key"].(string)
+	return key, body, nil
+}
+
 // RemoveAPIKey removes an existing API key and checks the received HTTP Status code against expectedStatusCode.
 func RemoveAPIKey(apiKey dataprovider.APIKey, expectedStatusCode int) ([]byte, error) {
 	var body []byte
@@ -1066,6 +1101,30 @@ func GetEventRules(limit, offset int64, expectedStatusCode int) ([]dataprovider.
 	return rules, body, err
 }
 
+// GetAuditLog searches the audit log using the specified query parameters
+// and checks the received HTTP Status code against expectedStatusCode.
+func GetAuditLog(params url.Values, expectedStatusCode int) ([]dataprovider.AuditLogEntry, []byte, error) {
+	var entries []dataprovider.AuditLogEntry
+	var body []byte
+	u, err := url.Parse(buildURLRelativeToBase(auditLogPath))
+	if err != nil {
+		return entries, body, err
+	}
+	u.RawQuery = params.Encode()
+	resp, err := sendHTTPRequest(http.MethodGet, u.String(), nil, "", getDefaultToken())
+	if err != nil {
+		return entries, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &entries)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return entries, body, err
+}
+
 // RunOnDemandRule executes the specified on demand rule
 func RunOnDemandRule(name string, expectedStatusCode int) ([]byte, error) {
 	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(eventRulesPath, "run", url.PathEscape(name)),
@@ -1304,6 +1363,46 @@ func GetFolderByName(name string, expectedStatusCode int) (vfs.BaseVirtualFolder
 	return folder, body, err
 }
 
+// GetFolderFailoverStatus returns the failover status for the specified folder and checks the received
+// HTTP Status code against expectedStatusCode.
+func GetFolderFailoverStatus(name string, expectedStatusCode int) (vfs.FolderFailoverStatus, []byte, error) {
+	var status vfs.FolderFailoverStatus
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(folderPath, url.PathEscape(name), "failover"),
+		nil, "", getDefaultToken())
+	if err != nil {
+		return status, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &status)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return status, body, err
+}
+
+// ReconcileFolderFailover replays the journaled operations for the specified folder to its primary
+// storage backend and checks the received HTTP Status code against expectedStatusCode.
+func ReconcileFolderFailover(name string, expectedStatusCode int) (vfs.FolderFailoverStatus, []byte, error) {
+	var status vfs.FolderFailoverStatus
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(folderPath, url.PathEscape(name), "failover",
+		"reconcile"), nil, "", getDefaultToken())
+	if err != nil {
+		return status, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &status)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return status, body, err
+}
+
 // GetFolders returns a list of folders and checks the received HTTP Status code against expectedStatusCode.
 // The number of results can be limited specifying a limit.
 // Some results can be skipped specifying an offset.
@@ -1455,6 +1554,26 @@ func GetDefenderHostByIP(ip string, expectedStatusCode int) (dataprovider.Defend
 	return host, body, err
 }
 
+// GetDefenderHostStatusByIP returns the escalation status for the host with the given IP
+func GetDefenderHostStatusByIP(ip string, expectedStatusCode int) (common.DefenderHostStatus, []byte, error) {
+	var status common.DefenderHostStatus
+	var body []byte
+	id := hex.EncodeToString([]byte(ip))
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(defenderHosts, id, "status"),
+		nil, "", getDefaultToken())
+	if err != nil {
+		return status, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &status)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return status, body, err
+}
+
 // RemoveDefenderHostByIP removes the host with the given IP from the defender list
 func RemoveDefenderHostByIP(ip string, expectedStatusCode int) ([]byte, error) {
 	var body []byte
@@ -1599,6 +1718,9 @@ func checkEventAction(expected, actual dataprovider.BaseEventAction) error {
 	if expected.Options.PwdExpirationConfig.Threshold != actual.Options.PwdExpirationConfig.Threshold {
 		return errors.New("password expiration threshold mismatch")
 	}
+	if expected.Options.PubKeyExpirationConfig.Threshold != actual.Options.PubKeyExpirationConfig.Threshold {
+		return errors.New("public key expiration threshold mismatch")
+	}
 	if err := compareEventActionIDPConfigFields(expected.Options.IDPConfig, actual.Options.IDPConfig); err != nil {
 		return err
 	}
@@ -1611,6 +1733,15 @@ func checkEventAction(expected, actual dataprovider.BaseEventAction) error {
 	if err := compareEventActionDataRetentionFields(expected.Options.RetentionConfig, actual.Options.RetentionConfig); err != nil {
 		return err
 	}
+	if err := compareEventActionTieringFields(expected.Options.TieringConfig, actual.Options.TieringConfig); err != nil {
+		return err
+	}
+	if err := compareEventActionWorkflowFields(expected.Options.WorkflowConfig, actual.Options.WorkflowConfig); err != nil {
+		return err
+	}
+	if err := compareEventActionReportFields(expected.Options.ReportConfig, actual.Options.ReportConfig); err != nil {
+		return err
+	}
 	if err := compareEventActionFsConfigFields(expected.Options.FsConfig, actual.Options.FsConfig); err != nil {
 		return err
 	}
@@ -1759,6 +1890,9 @@ func checkEventRule(expected, actual dataprovider.EventRule) error {
 	if expected.Description != actual.Description {
 		return errors.New("description mismatch")
 	}
+	if expected.Role != actual.Role {
+		return errors.New("role mismatch")
+	}
 	if actual.CreatedAt == 0 {
 		return errors.New("created_at unset")
 	}
@@ -1821,6 +1955,49 @@ func checkRole(expected, actual dataprovider.Role) error {
 	if actual.UpdatedAt == 0 {
 		return errors.New("updated_at unset")
 	}
+	return checkRoleTenant(expected.Tenant, actual.Tenant)
+}
+
+func checkRoleTenant(expected, actual *dataprovider.RoleTenant) error {
+	if expected == nil {
+		if actual != nil {
+			return errors.New("tenant mismatch")
+		}
+		return nil
+	}
+	if actual == nil {
+		return errors.New("tenant unset")
+	}
+	if expected.Slug != actual.Slug {
+		return errors.New("tenant slug mismatch")
+	}
+	if len(expected.Domains) != len(actual.Domains) {
+		return errors.New("tenant domains mismatch")
+	}
+	for _, domain := range expected.Domains {
+		if !util.Contains(actual.Domains, domain) {
+			return errors.New("tenant domains content mismatch")
+		}
+	}
+	if (expected.OIDC == nil) != (actual.OIDC == nil) {
+		return errors.New("tenant OIDC mismatch")
+	}
+	if expected.OIDC != nil {
+		if expected.OIDC.ClientID != actual.OIDC.ClientID {
+			return errors.New("tenant OIDC client ID mismatch")
+		}
+		if expected.OIDC.ConfigURL != actual.OIDC.ConfigURL {
+			return errors.New("tenant OIDC config URL mismatch")
+		}
+	}
+	if (expected.SMTP == nil) != (actual.SMTP == nil) {
+		return errors.New("tenant SMTP mismatch")
+	}
+	if expected.SMTP != nil {
+		if expected.SMTP.Host != actual.SMTP.Host || expected.SMTP.Port != actual.SMTP.Port {
+			return errors.New("tenant SMTP host mismatch")
+		}
+	}
 	return nil
 }
 
@@ -1840,6 +2017,9 @@ func checkGroup(expected, actual dataprovider.Group) error {
 	if expected.Description != actual.Description {
 		return errors.New("description mismatch")
 	}
+	if expected.Role != actual.Role {
+		return errors.New("role mismatch")
+	}
 	if actual.CreatedAt == 0 {
 		return errors.New("created_at unset")
 	}
@@ -1856,6 +2036,18 @@ func checkGroup(expected, actual dataprovider.Group) error {
 	if err := compareUserFilters(expected.UserSettings.Filters, actual.UserSettings.Filters); err != nil {
 		return err
 	}
+	if expected.UserSettings.PriorityClass != actual.UserSettings.PriorityClass {
+		return errors.New("priority class mismatch")
+	}
+	if expected.UserSettings.FTPMaxTransfers != actual.UserSettings.FTPMaxTransfers {
+		return errors.New("FTP max transfers mismatch")
+	}
+	if expected.UserSettings.PassivePortRange != actual.UserSettings.PassivePortRange {
+		return errors.New("passive port range mismatch")
+	}
+	if len(expected.UserSettings.AccessWindows) != len(actual.UserSettings.AccessWindows) {
+		return errors.New("access windows mismatch")
+	}
 	return compareFsConfig(&expected.UserSettings.FsConfig, &actual.UserSettings.FsConfig)
 }
 
@@ -1878,6 +2070,53 @@ func checkFolder(expected *vfs.BaseVirtualFolder, actual *vfs.BaseVirtualFolder)
 	if expected.Description != actual.Description {
 		return errors.New("description mismatch")
 	}
+	if err := checkFolderFailover(expected.Failover, actual.Failover); err != nil {
+		return err
+	}
+	if err := checkFolderLimits(expected.Limits, actual.Limits); err != nil {
+		return err
+	}
+	return compareFsConfig(&expected.FsConfig, &actual.FsConfig)
+}
+
+func checkFolderLimits(expected, actual *vfs.FolderLimits) error {
+	if !expected.HasLimits() {
+		if actual != nil {
+			return errors.New("folder limits must be empty")
+		}
+		return nil
+	}
+	if actual == nil {
+		return errors.New("folder limits mismatch")
+	}
+	if expected.UploadBandwidth != actual.UploadBandwidth {
+		return errors.New("folder upload bandwidth mismatch")
+	}
+	if expected.DownloadBandwidth != actual.DownloadBandwidth {
+		return errors.New("folder download bandwidth mismatch")
+	}
+	if expected.MaxConcurrentTransfers != actual.MaxConcurrentTransfers {
+		return errors.New("folder max concurrent transfers mismatch")
+	}
+	return nil
+}
+
+func checkFolderFailover(expected, actual *vfs.FolderFailover) error {
+	if expected == nil && actual == nil {
+		return nil
+	}
+	if expected == nil || actual == nil {
+		return errors.New("failover mismatch")
+	}
+	if expected.MappedPath != actual.MappedPath {
+		return errors.New("failover mapped path mismatch")
+	}
+	if expected.Timeout != actual.Timeout {
+		return errors.New("failover timeout mismatch")
+	}
+	if expected.RetryInterval != actual.RetryInterval {
+		return errors.New("failover retry interval mismatch")
+	}
 	return compareFsConfig(&expected.FsConfig, &actual.FsConfig)
 }
 
@@ -1912,6 +2151,28 @@ func checkAPIKey(expected, actual *dataprovider.APIKey) error {
 	if expected.Admin != actual.Admin {
 		return errors.New("admin mismatch")
 	}
+	if actual.Filters.PreviousKey != "" {
+		return errors.New("previous key must not be visible")
+	}
+	if len(expected.Filters.AllowList) != len(actual.Filters.AllowList) {
+		return errors.New("allow list mismatch")
+	}
+	for _, v := range expected.Filters.AllowList {
+		if !util.Contains(actual.Filters.AllowList, v) {
+			return errors.New("allow list content mismatch")
+		}
+	}
+	if len(expected.Filters.Endpoints) != len(actual.Filters.Endpoints) {
+		return errors.New("endpoints mismatch")
+	}
+	for idx, endpoint := range expected.Filters.Endpoints {
+		if endpoint.Path != actual.Filters.Endpoints[idx].Path {
+			return errors.New("endpoint path mismatch")
+		}
+		if len(endpoint.Methods) != len(actual.Filters.Endpoints[idx].Methods) {
+			return errors.New("endpoint methods mismatch")
+		}
+	}
 
 	return nil
 }
@@ -2019,6 +2280,36 @@ func checkUser(expected *dataprovider.User, actual *dataprovider.User) error {
 	if expected.Filters.RequirePasswordChange != actual.Filters.RequirePasswordChange {
 		return errors.New("require_password_change mismatch")
 	}
+	if expected.Filters.PriorityClass != actual.Filters.PriorityClass {
+		return errors.New("priority class mismatch")
+	}
+	if expected.Filters.FTPMaxTransfers != actual.Filters.FTPMaxTransfers {
+		return errors.New("FTP max transfers mismatch")
+	}
+	if expected.Filters.PassivePortRange != actual.Filters.PassivePortRange {
+		return errors.New("passive port range mismatch")
+	}
+	if expected.Filters.ActivationDate != actual.Filters.ActivationDate {
+		return errors.New("activation date mismatch")
+	}
+	if len(expected.Filters.AccessWindows) != len(actual.Filters.AccessWindows) {
+		return errors.New("access windows mismatch")
+	}
+	if len(expected.Filters.TrustedCAKeys) != len(actual.Filters.TrustedCAKeys) {
+		return errors.New("trusted CA keys mismatch")
+	}
+	if len(expected.Filters.CertPrincipals) != len(actual.Filters.CertPrincipals) {
+		return errors.New("cert principals mismatch")
+	}
+	if expected.Filters.SFTPOnly != actual.Filters.SFTPOnly {
+		return errors.New("SFTP only mismatch")
+	}
+	if len(expected.Filters.AllowedSSHCommands) != len(actual.Filters.AllowedSSHCommands) {
+		return errors.New("allowed SSH commands mismatch")
+	}
+	if len(expected.Filters.DeniedSSHCommands) != len(actual.Filters.DeniedSSHCommands) {
+		return errors.New("denied SSH commands mismatch")
+	}
 	if err := compareUserPermissions(expected.Permissions, actual.Permissions); err != nil {
 		return err
 	}
@@ -2135,6 +2426,18 @@ func compareFsConfig(expected *vfs.Filesystem, actual *vfs.Filesystem) error {
 	if expected.OSConfig.WriteBufferSize != actual.OSConfig.WriteBufferSize {
 		return fmt.Errorf("write buffer size mismatch")
 	}
+	if expected.DedupConfig.Enabled != actual.DedupConfig.Enabled {
+		return fmt.Errorf("dedup enabled mismatch")
+	}
+	if expected.WORMConfig.Enabled != actual.WORMConfig.Enabled {
+		return fmt.Errorf("WORM enabled mismatch")
+	}
+	if expected.WORMConfig.Enabled && expected.WORMConfig.Retention != actual.WORMConfig.Retention {
+		return fmt.Errorf("WORM retention mismatch")
+	}
+	if err := compareMIMEPolicy(expected.MIMEPolicy, actual.MIMEPolicy); err != nil {
+		return err
+	}
 	if err := compareS3Config(expected, actual); err != nil {
 		return err
 	}
@@ -2153,10 +2456,71 @@ func compareFsConfig(expected *vfs.Filesystem, actual *vfs.Filesystem) error {
 	if expected.CryptConfig.WriteBufferSize != actual.CryptConfig.WriteBufferSize {
 		return fmt.Errorf("crypt write buffer size mismatch")
 	}
+	if expected.CryptConfig.EncryptNames != actual.CryptConfig.EncryptNames {
+		return fmt.Errorf("crypt encrypt names mismatch")
+	}
+	if expected.CryptConfig.EncryptNames && (actual.CryptConfig.NamesKey == nil || actual.CryptConfig.NamesKey.IsEmpty()) {
+		return fmt.Errorf("crypt names key missing")
+	}
 	if err := compareSFTPFsConfig(expected, actual); err != nil {
 		return err
 	}
-	return compareHTTPFsConfig(expected, actual)
+	if err := compareHTTPFsConfig(expected, actual); err != nil {
+		return err
+	}
+	if err := comparePGPFsConfig(expected, actual); err != nil {
+		return err
+	}
+	return compareWebDAVFsConfig(expected, actual)
+}
+
+func comparePGPFsConfig(expected *vfs.Filesystem, actual *vfs.Filesystem) error {
+	if len(expected.PGPConfig.PublicKeys) != len(actual.PGPConfig.PublicKeys) {
+		return errors.New("PGP public keys mismatch")
+	}
+	for idx, key := range expected.PGPConfig.PublicKeys {
+		if strings.TrimSpace(key) != strings.TrimSpace(actual.PGPConfig.PublicKeys[idx]) {
+			return errors.New("PGP public keys content mismatch")
+		}
+	}
+	if len(expected.PGPConfig.DecryptUsers) != len(actual.PGPConfig.DecryptUsers) {
+		return errors.New("PGP decrypt users mismatch")
+	}
+	for _, username := range expected.PGPConfig.DecryptUsers {
+		if !util.Contains(actual.PGPConfig.DecryptUsers, username) {
+			return errors.New("PGP decrypt users content mismatch")
+		}
+	}
+	if err := checkEncryptedSecret(expected.PGPConfig.PrivateKey, actual.PGPConfig.PrivateKey); err != nil {
+		return fmt.Errorf("PGP private key mismatch: %w", err)
+	}
+	if err := checkEncryptedSecret(expected.PGPConfig.Passphrase, actual.PGPConfig.Passphrase); err != nil {
+		return fmt.Errorf("PGP passphrase mismatch: %w", err)
+	}
+	return nil
+}
+
+func compareMIMEPolicy(expected, actual vfs.MIMEPolicy) error {
+	if expected.CheckExtension != actual.CheckExtension {
+		return errors.New("MIME policy check extension mismatch")
+	}
+	if len(expected.AllowedTypes) != len(actual.AllowedTypes) {
+		return errors.New("MIME policy allowed types mismatch")
+	}
+	for _, t := range expected.AllowedTypes {
+		if !util.Contains(actual.AllowedTypes, t) {
+			return errors.New("MIME policy allowed types content mismatch")
+		}
+	}
+	if len(expected.DeniedTypes) != len(actual.DeniedTypes) {
+		return errors.New("MIME policy denied types mismatch")
+	}
+	for _, t := range expected.DeniedTypes {
+		if !util.Contains(actual.DeniedTypes, t) {
+			return errors.New("MIME policy denied types content mismatch")
+		}
+	}
+	return nil
 }
 
 func compareS3Config(expected *vfs.Filesystem, actual *vfs.Filesystem) error { //nolint:gocyclo
@@ -2172,6 +2536,9 @@ func compareS3Config(expected *vfs.Filesystem, actual *vfs.Filesystem) error { /
 	if expected.S3Config.RoleARN != actual.S3Config.RoleARN {
 		return errors.New("fs S3 role ARN mismatch")
 	}
+	if expected.S3Config.VaultCredentialsPath != actual.S3Config.VaultCredentialsPath {
+		return errors.New("fs S3 vault credentials path mismatch")
+	}
 	if err := checkEncryptedSecret(expected.S3Config.AccessSecret, actual.S3Config.AccessSecret); err != nil {
 		return fmt.Errorf("fs S3 access secret mismatch: %v", err)
 	}
@@ -2199,6 +2566,12 @@ func compareS3Config(expected *vfs.Filesystem, actual *vfs.Filesystem) error { /
 	if expected.S3Config.ForcePathStyle != actual.S3Config.ForcePathStyle {
 		return errors.New("fs S3 force path style mismatch")
 	}
+	if expected.S3Config.UseAccelerateEndpoint != actual.S3Config.UseAccelerateEndpoint {
+		return errors.New("fs S3 use accelerate endpoint mismatch")
+	}
+	if expected.S3Config.AdaptiveUploadPartSize != actual.S3Config.AdaptiveUploadPartSize {
+		return errors.New("fs S3 adaptive upload part size mismatch")
+	}
 	if expected.S3Config.DownloadPartMaxTime != actual.S3Config.DownloadPartMaxTime {
 		return errors.New("fs S3 download part max time mismatch")
 	}
@@ -2235,6 +2608,18 @@ func compareGCSConfig(expected *vfs.Filesystem, actual *vfs.Filesystem) error {
 	if expected.GCSConfig.UploadPartMaxTime != actual.GCSConfig.UploadPartMaxTime {
 		return errors.New("GCS upload part max time mismatch")
 	}
+	if expected.GCSConfig.DownloadPartSize != actual.GCSConfig.DownloadPartSize {
+		return errors.New("GCS download part size mismatch")
+	}
+	if expected.GCSConfig.DownloadConcurrency != actual.GCSConfig.DownloadConcurrency {
+		return errors.New("GCS download concurrency mismatch")
+	}
+	if expected.GCSConfig.BillingProject != actual.GCSConfig.BillingProject {
+		return errors.New("GCS billing project mismatch")
+	}
+	if expected.GCSConfig.KMSKeyName != actual.GCSConfig.KMSKeyName {
+		return errors.New("GCS KMS key name mismatch")
+	}
 	return nil
 }
 
@@ -2260,6 +2645,31 @@ func compareHTTPFsConfig(expected *vfs.Filesystem, actual *vfs.Filesystem) error
 	return nil
 }
 
+func compareWebDAVFsConfig(expected *vfs.Filesystem, actual *vfs.Filesystem) error {
+	if expected.WebDAVConfig.Endpoint != actual.WebDAVConfig.Endpoint {
+		return errors.New("WebDAVFs endpoint mismatch")
+	}
+	if expected.WebDAVConfig.Username != actual.WebDAVConfig.Username {
+		return errors.New("WebDAVFs username mismatch")
+	}
+	if expected.WebDAVConfig.SkipTLSVerify != actual.WebDAVConfig.SkipTLSVerify {
+		return errors.New("WebDAVFs skip_tls_verify mismatch")
+	}
+	if expected.WebDAVConfig.ClientCert != actual.WebDAVConfig.ClientCert {
+		return errors.New("WebDAVFs client_cert mismatch")
+	}
+	if expected.WebDAVConfig.EqualityCheckMode != actual.WebDAVConfig.EqualityCheckMode {
+		return errors.New("WebDAVFs equality_check_mode mismatch")
+	}
+	if err := checkEncryptedSecret(expected.WebDAVConfig.Password, actual.WebDAVConfig.Password); err != nil {
+		return fmt.Errorf("WebDAVFs password mismatch: %v", err)
+	}
+	if err := checkEncryptedSecret(expected.WebDAVConfig.ClientKey, actual.WebDAVConfig.ClientKey); err != nil {
+		return fmt.Errorf("WebDAVFs client key mismatch: %v", err)
+	}
+	return nil
+}
+
 func compareSFTPFsConfig(expected *vfs.Filesystem, actual *vfs.Filesystem) error {
 	if expected.SFTPConfig.Endpoint != actual.SFTPConfig.Endpoint {
 		return errors.New("SFTPFs endpoint mismatch")
@@ -2317,6 +2727,9 @@ func compareAzBlobConfig(expected *vfs.Filesystem, actual *vfs.Filesystem) error
 	if err := checkEncryptedSecret(expected.AzBlobConfig.SASURL, actual.AzBlobConfig.SASURL); err != nil {
 		return fmt.Errorf("azure Blob SAS URL mismatch: %v", err)
 	}
+	if expected.AzBlobConfig.SASAutoRenew != actual.AzBlobConfig.SASAutoRenew {
+		return errors.New("azure Blob SAS auto renew mismatch")
+	}
 	if expected.AzBlobConfig.UploadPartSize != actual.AzBlobConfig.UploadPartSize {
 		return errors.New("azure Blob upload part size mismatch")
 	}
@@ -2709,9 +3122,41 @@ func compareEventActionFsConfigFields(expected, actual dataprovider.EventActionF
 			return errors.New("fs exist content mismatch")
 		}
 	}
+	if err := compareEventActionFsPGPEncryptFields(expected.PGPEncrypt, actual.PGPEncrypt); err != nil {
+		return err
+	}
 	return compareEventActionFsCompressFields(expected.Compress, actual.Compress)
 }
 
+func compareEventActionFsPGPEncryptFields(expected, actual dataprovider.EventActionFsPGPEncrypt) error {
+	if strings.TrimSpace(expected.PublicKey) != actual.PublicKey {
+		return errors.New("fs pgp public key mismatch")
+	}
+	if expected.RemoveSource != actual.RemoveSource {
+		return errors.New("fs pgp remove source mismatch")
+	}
+	if len(expected.Paths) != len(actual.Paths) {
+		return errors.New("fs pgp paths mismatch")
+	}
+	for _, kv1 := range expected.Paths {
+		found := false
+		for _, kv2 := range actual.Paths {
+			if kv1.Key == kv2.Key {
+				found = true
+				// an empty target is replaced with the source path plus the .pgp extension
+				if kv1.Value != "" && kv1.Value != kv2.Value {
+					return fmt.Errorf("fs pgp target mismatch for path %q", kv1.Key)
+				}
+				break
+			}
+		}
+		if !found {
+			return errors.New("fs pgp paths content mismatch")
+		}
+	}
+	return nil
+}
+
 func compareEventActionIDPConfigFields(expected, actual dataprovider.EventActionIDPAccountCheck) error {
 	if expected.Mode != actual.Mode {
 		return errors.New("mode mismatch")
@@ -2746,6 +3191,92 @@ func compareEventActionCmdConfigFields(expected, actual dataprovider.EventAction
 	return nil
 }
 
+func compareEventActionWorkflowFields(expected, actual dataprovider.EventActionWorkflowConfig) error {
+	if len(expected.Steps) != len(actual.Steps) {
+		return errors.New("workflow steps mismatch")
+	}
+	// the steps order matters
+	for idx, s1 := range expected.Steps {
+		s2 := actual.Steps[idx]
+		if s1.Name != "" && s1.Name != s2.Name {
+			return fmt.Errorf("workflow step %d name mismatch", idx)
+		}
+		if s1.Action != s2.Action {
+			return fmt.Errorf("workflow step %d action mismatch", idx)
+		}
+		if s1.OnSuccess != s2.OnSuccess {
+			return fmt.Errorf("workflow step %d on success mismatch", idx)
+		}
+		if s1.OnFailure != s2.OnFailure {
+			return fmt.Errorf("workflow step %d on failure mismatch", idx)
+		}
+	}
+	return nil
+}
+
+func compareEventActionReportFields(expected, actual dataprovider.EventActionReportConfig) error {
+	if len(expected.Reports) != len(actual.Reports) {
+		return errors.New("reports mismatch")
+	}
+	for _, r := range expected.Reports {
+		if !util.Contains(actual.Reports, r) {
+			return errors.New("reports content mismatch")
+		}
+	}
+	if expected.Format != "" && expected.Format != actual.Format {
+		return errors.New("report format mismatch")
+	}
+	if expected.HasPeriodReports() && expected.Period != actual.Period {
+		return errors.New("report period mismatch")
+	}
+	if len(expected.Recipients) != len(actual.Recipients) {
+		return errors.New("report recipients mismatch")
+	}
+	for _, r := range expected.Recipients {
+		if !util.Contains(actual.Recipients, r) {
+			return errors.New("report recipients content mismatch")
+		}
+	}
+	if expected.Folder != actual.Folder {
+		return errors.New("report folder mismatch")
+	}
+	if expected.Folder != "" && util.CleanPath(expected.Path) != actual.Path {
+		return errors.New("report path mismatch")
+	}
+	return nil
+}
+
+func compareEventActionTieringFields(expected, actual dataprovider.EventActionTieringConfig) error {
+	if expected.Folder != actual.Folder {
+		return errors.New("tiering folder mismatch")
+	}
+	if len(expected.Policies) != len(actual.Policies) {
+		return errors.New("tiering policies mismatch")
+	}
+	for _, p1 := range expected.Policies {
+		found := false
+		for _, p2 := range actual.Policies {
+			if p1.Path == p2.Path {
+				found = true
+				if p1.MinAge != p2.MinAge {
+					return fmt.Errorf("min_age mismatch for tiering path %s", p1.Path)
+				}
+				if p1.MinIdleTime != p2.MinIdleTime {
+					return fmt.Errorf("min_idle_time mismatch for tiering path %s", p1.Path)
+				}
+				if p1.MinSize != p2.MinSize {
+					return fmt.Errorf("min_size mismatch for tiering path %s", p1.Path)
+				}
+				break
+			}
+		}
+		if !found {
+			return errors.New("tiering policies mismatch")
+		}
+	}
+	return nil
+}
+
 func compareEventActionDataRetentionFields(expected, actual dataprovider.EventActionDataRetentionConfig) error {
 	if len(expected.Folders) != len(actual.Folders) {
 		return errors.New("retention folders mismatch")
@@ -73,7 +73,8 @@ var (
 	// ErrInvalidSecret defines the error to return if a secret is not valid
 	ErrInvalidSecret    = errors.New("invalid secret")
 	validSecretStatuses = []string{sdkkms.SecretStatusPlain, sdkkms.SecretStatusAES256GCM, sdkkms.SecretStatusSecretBox,
-		sdkkms.SecretStatusVaultTransit, sdkkms.SecretStatusAWS, sdkkms.SecretStatusGCP, sdkkms.SecretStatusRedacted}
+		sdkkms.SecretStatusVaultTransit, sdkkms.SecretStatusAWS, sdkkms.SecretStatusGCP, SecretStatusPKCS11,
+		sdkkms.SecretStatusRedacted}
 	config          Configuration
 	secretProviders = make(map[string]registeredSecretProvider)
 )
@@ -115,6 +116,20 @@ func (c *Configuration) Initialize() error {
 		}
 		c.Secrets.masterKey = strings.TrimSpace(string(mKey))
 	}
+	if strings.HasPrefix(c.Secrets.URL, SchemePKCS11) {
+		uri, err := parsePKCS11URI(c.Secrets.URL)
+		if err != nil {
+			return err
+		}
+		if err := uri.validate(); err != nil {
+			return err
+		}
+	}
+	if strings.HasPrefix(c.Secrets.URL, sdkkms.SchemeVaultTransit) {
+		if _, _, err := parseVaultTransitURL(c.Secrets.URL); err != nil {
+			return err
+		}
+	}
 	config = *c
 	if config.Secrets.URL == "" {
 		config.Secrets.URL = sdkkms.SchemeLocal + "://"
@@ -126,6 +141,17 @@ func (c *Configuration) Initialize() error {
 	return nil
 }
 
+// GetEncryptedStatus returns the status of the secrets encrypted using the
+// configured secret provider
+func GetEncryptedStatus() sdkkms.SecretStatus {
+	for k, v := range secretProviders {
+		if strings.HasPrefix(config.Secrets.URL, k) {
+			return v.encryptedStatus
+		}
+	}
+	return sdkkms.SecretStatusSecretBox
+}
+
 func (c *Configuration) newSecret(status sdkkms.SecretStatus, payload, key, data string) *Secret {
 	base := BaseSecret{
 		Status:         status,
@@ -0,0 +1,110 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package kms
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Scheme and encrypted status for secrets protected by a PKCS#11 token, for
+// example an HSM or AWS CloudHSM. The cryptographic operations are performed
+// by a KMS plugin, the encryption key never leaves the token
+const (
+	SchemePKCS11        = "pkcs11"
+	SecretStatusPKCS11  = "PKCS11"
+	pkcs11PinValueAttr  = "pin-value"
+	pkcs11PinSourceAttr = "pin-source"
+)
+
+// pkcs11URI defines the attributes of a PKCS#11 URI as defined in RFC 7512
+type pkcs11URI struct {
+	pathAttributes  map[string]string
+	queryAttributes map[string]string
+}
+
+// parsePKCS11URI parses a PKCS#11 URI, for example:
+//
+//	pkcs11:token=sftpgo;object=kms-key?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-source=file:/etc/sftpgo/pin
+func parsePKCS11URI(uri string) (pkcs11URI, error) {
+	result := pkcs11URI{
+		pathAttributes:  make(map[string]string),
+		queryAttributes: make(map[string]string),
+	}
+	if !strings.HasPrefix(uri, SchemePKCS11+":") {
+		return result, fmt.Errorf("invalid PKCS#11 URI %q", uri)
+	}
+	path, query, _ := strings.Cut(strings.TrimPrefix(uri, SchemePKCS11+":"), "?")
+	if err := parsePKCS11Attributes(path, ";", result.pathAttributes); err != nil {
+		return result, err
+	}
+	if err := parsePKCS11Attributes(query, "&", result.queryAttributes); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+func parsePKCS11Attributes(value, separator string, attributes map[string]string) error {
+	for _, attr := range strings.Split(value, separator) {
+		if attr == "" {
+			continue
+		}
+		name, val, ok := strings.Cut(attr, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("invalid PKCS#11 URI attribute %q", attr)
+		}
+		unescaped, err := url.PathUnescape(val)
+		if err != nil {
+			return fmt.Errorf("invalid value for PKCS#11 URI attribute %q: %w", name, err)
+		}
+		if _, ok := attributes[name]; ok {
+			return fmt.Errorf("duplicated PKCS#11 URI attribute %q", name)
+		}
+		attributes[name] = unescaped
+	}
+	return nil
+}
+
+func (u *pkcs11URI) validate() error {
+	if u.pathAttributes["object"] == "" && u.pathAttributes["id"] == "" {
+		return errors.New("the PKCS#11 URI must identify the key using the \"object\" or \"id\" attribute")
+	}
+	if _, ok := u.queryAttributes[pkcs11PinValueAttr]; ok {
+		return fmt.Errorf("the PKCS#11 PIN cannot be set in the URI, use the %q attribute", pkcs11PinSourceAttr)
+	}
+	modulePath := u.queryAttributes["module-path"]
+	if modulePath == "" && u.queryAttributes["module-name"] == "" {
+		return errors.New("the PKCS#11 URI must define the \"module-path\" or \"module-name\" attribute")
+	}
+	if modulePath != "" {
+		if !filepath.IsAbs(modulePath) {
+			return fmt.Errorf("the PKCS#11 module path %q must be absolute", modulePath)
+		}
+		if _, err := os.Stat(modulePath); err != nil {
+			return fmt.Errorf("invalid PKCS#11 module path: %w", err)
+		}
+	}
+	if pinSource := u.queryAttributes[pkcs11PinSourceAttr]; pinSource != "" {
+		pinFile := strings.TrimPrefix(strings.TrimPrefix(pinSource, "file:"), "//")
+		if !strings.HasPrefix(pinSource, "file:") || !filepath.IsAbs(pinFile) {
+			return fmt.Errorf("unsupported PKCS#11 pin source %q, an absolute file path is required", pinSource)
+		}
+	}
+	return nil
+}
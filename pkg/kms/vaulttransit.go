@@ -0,0 +1,209 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package kms
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	sdkkms "github.com/sftpgo/sdk/kms"
+	"gocloud.dev/secrets/localsecrets"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/drakkan/sftpgo/v2/pkg/vault"
+)
+
+const (
+	vaultTransitDefaultMount = "transit"
+	vaultCiphertextPrefix    = "vault:"
+)
+
+func init() {
+	RegisterSecretProvider(sdkkms.SchemeVaultTransit, sdkkms.SecretStatusVaultTransit, NewVaultTransitSecret)
+}
+
+// vaultTransitSecret uses envelope encryption: the payload is encrypted using
+// a random data key and the data key is encrypted using a Vault transit key.
+// The Vault transit key never leaves Vault
+type vaultTransitSecret struct {
+	BaseSecret
+	url string
+}
+
+// NewVaultTransitSecret returns a SecretProvider that use HashiCorp Vault
+// transit secrets engine. The URL has the following format:
+//
+//	hashivault://<key name>?mount=<transit mount path>
+//
+// The Vault address and token are read from the VAULT_ADDR and VAULT_TOKEN
+// environment variables
+func NewVaultTransitSecret(base BaseSecret, url, _ string) SecretProvider {
+	return &vaultTransitSecret{
+		BaseSecret: base,
+		url:        url,
+	}
+}
+
+func parseVaultTransitURL(u string) (string, string, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid vault transit URL: %w", err)
+	}
+	if parsed.Scheme != sdkkms.SchemeVaultTransit || parsed.Host == "" {
+		return "", "", fmt.Errorf("invalid vault transit URL %q, the key name is required", u)
+	}
+	mount := strings.Trim(parsed.Query().Get("mount"), "/")
+	if mount == "" {
+		mount = vaultTransitDefaultMount
+	}
+	return mount, parsed.Host, nil
+}
+
+func (s *vaultTransitSecret) Name() string {
+	return "VaultTransit"
+}
+
+func (s *vaultTransitSecret) IsEncrypted() bool {
+	return s.Status == sdkkms.SecretStatusVaultTransit
+}
+
+func (s *vaultTransitSecret) Encrypt() error {
+	if s.Status != sdkkms.SecretStatusPlain {
+		return ErrWrongSecretStatus
+	}
+	if s.Payload == "" {
+		return ErrInvalidSecret
+	}
+	mount, keyName, err := parseVaultTransitURL(s.url)
+	if err != nil {
+		return err
+	}
+	client, err := vault.NewClientFromEnv()
+	if err != nil {
+		return err
+	}
+	dataKey, err := localsecrets.NewRandomKey()
+	if err != nil {
+		return err
+	}
+	key, err := s.deriveKey(dataKey[:])
+	if err != nil {
+		return err
+	}
+	keeper := localsecrets.NewKeeper(key)
+	defer keeper.Close()
+
+	ciphertext, err := keeper.Encrypt(context.Background(), []byte(s.Payload))
+	if err != nil {
+		return err
+	}
+	resp, err := client.Write(context.Background(), path.Join(mount, "encrypt", keyName), map[string]any{
+		"plaintext": base64.StdEncoding.EncodeToString(dataKey[:]),
+	})
+	if err != nil {
+		return err
+	}
+	wrappedKey := resp.GetString("ciphertext")
+	if !strings.HasPrefix(wrappedKey, vaultCiphertextPrefix) {
+		return errors.New("unexpected vault transit ciphertext")
+	}
+	s.Key = path.Join(mount, keyName) + "/" + wrappedKey
+	s.Payload = base64.StdEncoding.EncodeToString(ciphertext)
+	s.Status = sdkkms.SecretStatusVaultTransit
+	s.Mode = 0
+	return nil
+}
+
+func (s *vaultTransitSecret) Decrypt() error {
+	if !s.IsEncrypted() {
+		return ErrWrongSecretStatus
+	}
+	// the key used for encryption is stored with the secret, so secrets
+	// encrypted using a previous key can still be decrypted
+	keyPath, wrappedKey, ok := strings.Cut(s.Key, "/"+vaultCiphertextPrefix)
+	if !ok {
+		return ErrInvalidSecret
+	}
+	mount, keyName := path.Split(keyPath)
+	if mount == "" || keyName == "" {
+		return ErrInvalidSecret
+	}
+	encrypted, err := base64.StdEncoding.DecodeString(s.Payload)
+	if err != nil {
+		return err
+	}
+	client, err := vault.NewClientFromEnv()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Write(context.Background(), path.Join(mount, "decrypt", keyName), map[string]any{
+		"ciphertext": vaultCiphertextPrefix + wrappedKey,
+	})
+	if err != nil {
+		return err
+	}
+	dataKey, err := base64.StdEncoding.DecodeString(resp.GetString("plaintext"))
+	if err != nil {
+		return err
+	}
+	key, err := s.deriveKey(dataKey)
+	if err != nil {
+		return err
+	}
+	keeper := localsecrets.NewKeeper(key)
+	defer keeper.Close()
+
+	plaintext, err := keeper.Decrypt(context.Background(), encrypted)
+	if err != nil {
+		return err
+	}
+	s.Status = sdkkms.SecretStatusPlain
+	s.Payload = string(plaintext)
+	s.Key = ""
+	s.AdditionalData = ""
+	s.Mode = 0
+	return nil
+}
+
+func (s *vaultTransitSecret) deriveKey(dataKey []byte) ([32]byte, error) {
+	var derivedKey [32]byte
+	var info []byte
+	if s.AdditionalData != "" {
+		info = []byte(s.AdditionalData)
+	}
+	kdf := hkdf.New(sha256.New, dataKey, nil, info)
+	if _, err := io.ReadFull(kdf, derivedKey[:]); err != nil {
+		return derivedKey, err
+	}
+	return derivedKey, nil
+}
+
+func (s *vaultTransitSecret) Clone() SecretProvider {
+	baseSecret := BaseSecret{
+		Status:         s.Status,
+		Payload:        s.Payload,
+		Key:            s.Key,
+		AdditionalData: s.AdditionalData,
+		Mode:           s.Mode,
+	}
+	return NewVaultTransitSecret(baseSecret, s.url, "")
+}
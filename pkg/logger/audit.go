@@ -0,0 +1,481 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package logger
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/geoip"
+	"github.com/drakkan/sftpgo/v2/pkg/version"
+)
+
+// Supported audit log categories
+const (
+	AuditCategoryConnection = "connection"
+	AuditCategoryAuth       = "auth"
+	AuditCategoryTransfer   = "transfer"
+	AuditCategoryCommand    = "command"
+)
+
+// Supported audit log formats
+const (
+	AuditFormatRFC5424 = "rfc5424"
+	AuditFormatCEF     = "cef"
+	AuditFormatLEEF    = "leef"
+)
+
+const (
+	auditLogSender = "auditlog"
+	// syslog facility 13, log audit
+	auditSyslogFacility = 13
+	auditQueueSize      = 1024
+	auditDialTimeout    = 10 * time.Second
+	auditWriteTimeout   = 10 * time.Second
+)
+
+var (
+	auditSupportedCategories = []string{AuditCategoryConnection, AuditCategoryAuth, AuditCategoryTransfer,
+		AuditCategoryCommand}
+	auditSupportedFormats  = []string{AuditFormatRFC5424, AuditFormatCEF, AuditFormatLEEF}
+	auditSupportedNetworks = []string{"udp", "tcp", "tls"}
+	auditSink              atomic.Pointer[auditLogSink]
+)
+
+// AuditLogConfig defines the configuration to send audit records to a
+// remote syslog collector, for example a SIEM
+type AuditLogConfig struct {
+	// Address of the remote collector as host:port. Empty means disabled
+	Address string `json:"address" mapstructure:"address"`
+	// Network to use: udp, tcp, tls. For tcp and tls the records are framed
+	// using octet counting as described in RFC 6587 and RFC 5425
+	Network string `json:"network" mapstructure:"network"`
+	// Format for the records: rfc5424, cef, leef. CEF and LEEF records are
+	// sent as the message of an RFC 5424 syslog record
+	Format string `json:"format" mapstructure:"format"`
+	// Categories to send: connection, auth, transfer, command. Empty means all
+	Categories []string `json:"categories" mapstructure:"categories"`
+	// Path to a PEM encoded CA certificate used to verify the collector
+	// certificate, if the network is tls. Empty means the system trust store
+	CACertificate string `json:"ca_certificate" mapstructure:"ca_certificate"`
+}
+
+// IsEnabled returns true if the audit log is configured
+func (c *AuditLogConfig) IsEnabled() bool {
+	return c.Address != ""
+}
+
+func (c *AuditLogConfig) validate() error {
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return fmt.Errorf("invalid audit log address %q: %w", c.Address, err)
+	}
+	if c.Network == "" {
+		c.Network = "udp"
+	}
+	if !contains(auditSupportedNetworks, c.Network) {
+		return fmt.Errorf("unsupported audit log network %q", c.Network)
+	}
+	if c.Format == "" {
+		c.Format = AuditFormatRFC5424
+	}
+	if !contains(auditSupportedFormats, c.Format) {
+		return fmt.Errorf("unsupported audit log format %q", c.Format)
+	}
+	if len(c.Categories) == 0 {
+		c.Categories = auditSupportedCategories
+	}
+	for _, category := range c.Categories {
+		if !contains(auditSupportedCategories, category) {
+			return fmt.Errorf("unsupported audit log category %q", category)
+		}
+	}
+	return nil
+}
+
+func (c *AuditLogConfig) getTLSConfig() (*tls.Config, error) {
+	host, _, _ := net.SplitHostPort(c.Address)
+	config := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+	if c.CACertificate != "" {
+		pemCerts, err := os.ReadFile(c.CACertificate)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read audit log CA certificate: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pemCerts) {
+			return nil, errors.New("unable to parse audit log CA certificate")
+		}
+	}
+	return config, nil
+}
+
+// InitAuditLog configures the audit log. Any previously configured audit
+// log is stopped
+func InitAuditLog(config AuditLogConfig) error {
+	if old := auditSink.Swap(nil); old != nil {
+		old.stop()
+	}
+	if !config.IsEnabled() {
+		return nil
+	}
+	if err := config.validate(); err != nil {
+		return err
+	}
+	var tlsConfig *tls.Config
+	if config.Network == "tls" {
+		var err error
+		tlsConfig, err = config.getTLSConfig()
+		if err != nil {
+			return err
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	sink := &auditLogSink{
+		config:    config,
+		tlsConfig: tlsConfig,
+		hostname:  hostname,
+		records:   make(chan string, auditQueueSize),
+		done:      make(chan struct{}),
+	}
+	go sink.run()
+	auditSink.Store(sink)
+	Info(auditLogSender, "", "audit log enabled, address %q, network %q, format %q, categories %v",
+		config.Address, config.Network, config.Format, config.Categories)
+	return nil
+}
+
+// auditRecord defines an audit event. Empty fields are not sent
+type auditRecord struct {
+	category     string
+	event        string
+	warning      bool
+	username     string
+	ip           string
+	localAddr    string
+	protocol     string
+	loginMethod  string
+	connectionID string
+	path         string
+	targetPath   string
+	certSerial   string
+	size         int64
+	elapsed      int64
+	errorString  string
+}
+
+type auditLogSink struct {
+	config    AuditLogConfig
+	tlsConfig *tls.Config
+	hostname  string
+	records   chan string
+	done      chan struct{}
+	conn      net.Conn
+	dropped   atomic.Int64
+	failures  int64
+}
+
+func (s *auditLogSink) isEnabledFor(category string) bool {
+	return contains(s.config.Categories, category)
+}
+
+// send queues the record, it never blocks: records are discarded if the
+// collector cannot keep up
+func (s *auditLogSink) send(record *auditRecord) {
+	if !s.isEnabledFor(record.category) {
+		return
+	}
+	select {
+	case s.records <- s.format(record, time.Now()):
+	default:
+		if s.dropped.Add(1)%100 == 1 {
+			Warn(auditLogSender, "", "audit log queue full, discarded records: %d", s.dropped.Load())
+		}
+	}
+}
+
+func (s *auditLogSink) stop() {
+	close(s.done)
+}
+
+func (s *auditLogSink) run() {
+	defer func() {
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case msg := <-s.records:
+			if err := s.write(msg); err != nil {
+				// avoid flooding the logs if the collector is down
+				s.failures++
+				if s.failures%100 == 1 {
+					Warn(auditLogSender, "", "unable to send audit record, failed records: %d, err: %v", s.failures, err)
+				}
+			}
+		}
+	}
+}
+
+// write sends the message, reconnecting once if the connection is broken
+func (s *auditLogSink) write(msg string) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			conn, errDial := s.dial()
+			if errDial != nil {
+				return errDial
+			}
+			s.conn = conn
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(auditWriteTimeout)) //nolint:errcheck
+		if s.config.Network == "udp" {
+			_, err = s.conn.Write([]byte(msg))
+		} else {
+			_, err = s.conn.Write([]byte(strconv.Itoa(len(msg)) + " " + msg))
+		}
+		if err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *auditLogSink) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: auditDialTimeout}
+	if s.config.Network == "tls" {
+		return tls.DialWithDialer(dialer, "tcp", s.config.Address, s.tlsConfig)
+	}
+	return dialer.Dial(s.config.Network, s.config.Address)
+}
+
+func (s *auditLogSink) format(record *auditRecord, now time.Time) string {
+	// syslog severities: 4 warning, 6 informational
+	severity := 6
+	if record.warning {
+		severity = 4
+	}
+	header := fmt.Sprintf("<%d>1 %s %s sftpgo %d %s", auditSyslogFacility*8+severity,
+		now.UTC().Format("2006-01-02T15:04:05.000Z"), s.hostname, os.Getpid(), record.event)
+
+	switch s.config.Format {
+	case AuditFormatCEF:
+		return header + " - " + formatCEFRecord(record, now)
+	case AuditFormatLEEF:
+		return header + " - " + formatLEEFRecord(record, now)
+	default:
+		return header + " " + formatRFC5424Data(record) + " " + record.category + " " + record.event
+	}
+}
+
+// auditField is a key/value pair, the keys are the ones used in the JSON logs
+type auditField struct {
+	key   string
+	value string
+}
+
+func (r *auditRecord) getFields() []auditField {
+	fields := []auditField{
+		{"category", r.category},
+		{"username", r.username},
+		{"client_ip", r.ip},
+		{"client_country", geoip.GetCountry(r.ip)},
+		{"local_addr", r.localAddr},
+		{"protocol", r.protocol},
+		{"login_type", r.loginMethod},
+		{"connection_id", r.connectionID},
+		{"file_path", r.path},
+		{"target_path", r.targetPath},
+		{"tls_cert_serial", r.certSerial},
+	}
+	if r.size >= 0 {
+		fields = append(fields, auditField{"size_bytes", strconv.FormatInt(r.size, 10)})
+	}
+	if r.elapsed >= 0 {
+		fields = append(fields, auditField{"elapsed_ms", strconv.FormatInt(r.elapsed, 10)})
+	}
+	fields = append(fields, auditField{"error", r.errorString})
+	result := make([]auditField, 0, len(fields))
+	for _, f := range fields {
+		if f.value != "" {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+// formatRFC5424Data returns the structured data element, 32473 is the
+// private enterprise number reserved for documentation
+func formatRFC5424Data(record *auditRecord) string {
+	var sb strings.Builder
+	sb.WriteString("[sftpgo@32473")
+	for _, f := range record.getFields() {
+		sb.WriteString(" " + f.key + `="`)
+		sb.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(f.value))
+		sb.WriteString(`"`)
+	}
+	sb.WriteString("]")
+	return sb.String()
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+	leefValueEscaper    = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+	// mapping between our field names and the CEF and LEEF keys
+	cefKeys = map[string]string{
+		"username":        "suser",
+		"client_ip":       "src",
+		"client_country":  "cs4",
+		"local_addr":      "dvchost",
+		"protocol":        "app",
+		"login_type":      "cs1",
+		"connection_id":   "externalId",
+		"file_path":       "filePath",
+		"target_path":     "cs2",
+		"tls_cert_serial": "cs3",
+		"size_bytes":      "fsize",
+		"elapsed_ms":      "cn1",
+		"error":           "reason",
+		"category":        "cat",
+	}
+	leefKeys = map[string]string{
+		"username":        "usrName",
+		"client_ip":       "src",
+		"client_country":  "srcCountry",
+		"local_addr":      "dst",
+		"protocol":        "proto",
+		"login_type":      "loginType",
+		"connection_id":   "connectionId",
+		"file_path":       "resource",
+		"target_path":     "targetPath",
+		"tls_cert_serial": "tlsCertSerial",
+		"size_bytes":      "totalBytes",
+		"elapsed_ms":      "elapsedMs",
+		"error":           "reason",
+		"category":        "cat",
+	}
+)
+
+func formatCEFRecord(record *auditRecord, now time.Time) string {
+	severity := "3"
+	if record.warning {
+		severity = "7"
+	}
+	var sb strings.Builder
+	sb.WriteString("CEF:0|SFTPGo|SFTPGo|")
+	sb.WriteString(cefHeaderEscaper.Replace(version.Get().Version))
+	sb.WriteString("|" + cefHeaderEscaper.Replace(record.event))
+	sb.WriteString("|" + cefHeaderEscaper.Replace(record.category+" "+record.event))
+	sb.WriteString("|" + severity + "|")
+	sb.WriteString("rt=" + strconv.FormatInt(now.UnixMilli(), 10))
+	for _, f := range record.getFields() {
+		sb.WriteString(" " + cefKeys[f.key] + "=" + cefExtensionEscaper.Replace(f.value))
+		switch f.key {
+		case "login_type":
+			sb.WriteString(" cs1Label=loginType")
+		case "target_path":
+			sb.WriteString(" cs2Label=targetPath")
+		case "tls_cert_serial":
+			sb.WriteString(" cs3Label=tlsCertSerial")
+		case "client_country":
+			sb.WriteString(" cs4Label=clientCountry")
+		case "elapsed_ms":
+			sb.WriteString(" cn1Label=elapsedMs")
+		}
+	}
+	return sb.String()
+}
+
+func formatLEEFRecord(record *auditRecord, now time.Time) string {
+	severity := "3"
+	if record.warning {
+		severity = "7"
+	}
+	var sb strings.Builder
+	sb.WriteString("LEEF:1.0|SFTPGo|SFTPGo|")
+	sb.WriteString(strings.ReplaceAll(version.Get().Version, "|", " "))
+	sb.WriteString("|" + strings.ReplaceAll(record.event, "|", " ") + "|")
+	sb.WriteString("devTime=" + now.UTC().Format("Jan 02 2006 15:04:05.000 UTC"))
+	sb.WriteString("\tdevTimeFormat=MMM dd yyyy HH:mm:ss.SSS z")
+	sb.WriteString("\tsev=" + severity)
+	for _, f := range record.getFields() {
+		sb.WriteString("\t" + leefKeys[f.key] + "=" + leefValueEscaper.Replace(f.value))
+	}
+	return sb.String()
+}
+
+func sendAuditRecord(record *auditRecord) {
+	if sink := auditSink.Load(); sink != nil {
+		sink.send(record)
+	}
+}
+
+// AuditLoginLog sends the login outcome to the audit log, if enabled.
+// It is not written to the JSON logs, failed logins are already logged
+// using ConnectionFailedLog
+func AuditLoginLog(user, ip, loginMethod, protocol, errorString string) {
+	event := "login"
+	if errorString != "" {
+		event = "login_failed"
+	}
+	sendAuditRecord(&auditRecord{
+		category:    AuditCategoryAuth,
+		event:       event,
+		warning:     errorString != "",
+		username:    user,
+		ip:          ip,
+		protocol:    protocol,
+		loginMethod: loginMethod,
+		size:        -1,
+		elapsed:     -1,
+		errorString: errorString,
+	})
+}
+
+func getIPFromRemoteAddress(remoteAddr string) string {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return ip
+}
+
+func contains(elems []string, v string) bool {
+	for _, s := range elems {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package logger
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLogConfig(t *testing.T) {
+	c := AuditLogConfig{}
+	assert.False(t, c.IsEnabled())
+	assert.NoError(t, InitAuditLog(c))
+	assert.Nil(t, auditSink.Load())
+
+	c.Address = "invalid"
+	assert.Error(t, InitAuditLog(c))
+	c.Address = "127.0.0.1:5514"
+	c.Network = "unix"
+	assert.Error(t, InitAuditLog(c))
+	c.Network = ""
+	c.Format = "json"
+	assert.Error(t, InitAuditLog(c))
+	c.Format = ""
+	c.Categories = []string{AuditCategoryAuth, "unknown"}
+	assert.Error(t, InitAuditLog(c))
+	c.Categories = nil
+	c.Network = "tls"
+	c.CACertificate = "missing.pem"
+	assert.Error(t, InitAuditLog(c))
+	assert.Nil(t, auditSink.Load())
+
+	c.Network = ""
+	c.CACertificate = ""
+	require.NoError(t, InitAuditLog(c))
+	sink := auditSink.Load()
+	require.NotNil(t, sink)
+	assert.Equal(t, "udp", sink.config.Network)
+	assert.Equal(t, AuditFormatRFC5424, sink.config.Format)
+	assert.Equal(t, auditSupportedCategories, sink.config.Categories)
+	require.NoError(t, InitAuditLog(AuditLogConfig{}))
+	assert.Nil(t, auditSink.Load())
+}
+
+func TestAuditLogUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	err = InitAuditLog(AuditLogConfig{
+		Address:    pc.LocalAddr().String(),
+		Categories: []string{AuditCategoryTransfer, AuditCategoryAuth},
+	})
+	require.NoError(t, err)
+	defer InitAuditLog(AuditLogConfig{}) //nolint:errcheck
+
+	// the command category is not enabled
+	CommandLog("Rename", "/tmp/a", "/tmp/b", "user", "", "id", "SFTP", -1, -1, "", "", "", -1,
+		"127.0.0.1:2022", "192.168.1.2:1234", 1)
+	TransferLog("Upload", "/tmp/file \"quoted\"", 10, 1024, "user", "id", "SFTP", "127.0.0.1:2022",
+		"192.168.1.2:1234", "")
+	AuditLoginLog("user", "192.168.1.2", "password", "SSH", "invalid credentials")
+
+	buf := make([]byte, 4096)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+	n, _, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	msg := string(buf[:n])
+	assert.True(t, strings.HasPrefix(msg, "<110>1 "), msg)
+	assert.Contains(t, msg, " sftpgo "+strconv.Itoa(os.Getpid())+" Upload [sftpgo@32473 category=\"transfer\"")
+	assert.Contains(t, msg, `username="user" client_ip="192.168.1.2" local_addr="127.0.0.1:2022" protocol="SFTP"`)
+	assert.Contains(t, msg, `file_path="/tmp/file \"quoted\"" size_bytes="1024" elapsed_ms="10"]`)
+	assert.NotContains(t, msg, "login_type")
+
+	n, _, err = pc.ReadFrom(buf)
+	require.NoError(t, err)
+	msg = string(buf[:n])
+	assert.True(t, strings.HasPrefix(msg, "<108>1 "), msg)
+	assert.Contains(t, msg, ` login_failed [sftpgo@32473 category="auth" username="user" client_ip="192.168.1.2"`)
+	assert.Contains(t, msg, `login_type="password" error="invalid credentials"]`)
+	assert.NotContains(t, msg, "size_bytes")
+}
+
+func TestAuditLogTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	records := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// each audit log sink uses its own connection
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				reader := bufio.NewReader(conn)
+				for {
+					length, err := reader.ReadString(' ')
+					if err != nil {
+						return
+					}
+					size, err := strconv.Atoi(strings.TrimSpace(length))
+					if err != nil {
+						return
+					}
+					msg := make([]byte, size)
+					if _, err := io.ReadFull(reader, msg); err != nil {
+						return
+					}
+					records <- string(msg)
+				}
+			}(conn)
+		}
+	}()
+
+	for _, format := range []string{AuditFormatCEF, AuditFormatLEEF} {
+		err = InitAuditLog(AuditLogConfig{
+			Address:    l.Addr().String(),
+			Network:    "tcp",
+			Format:     format,
+			Categories: []string{AuditCategoryConnection, AuditCategoryCommand},
+		})
+		require.NoError(t, err)
+		CommandLog("Rename", "/tmp/a=b", "/tmp/c", "user", "", "id", "FTP", -1, -1, "", "", "", -1,
+			"127.0.0.1:2121", "192.168.1.2:1234", 1)
+		DefenderBanLog("192.168.1.3", "SSH", time.Now().Add(time.Minute))
+
+		select {
+		case msg := <-records:
+			if format == AuditFormatCEF {
+				assert.Contains(t, msg, " Rename - CEF:0|SFTPGo|SFTPGo|")
+				assert.Contains(t, msg, "|Rename|command Rename|3|rt=")
+				assert.Contains(t, msg, ` cat=command suser=user src=192.168.1.2 dvchost=127.0.0.1:2121 app=FTP`)
+				assert.Contains(t, msg, ` filePath=/tmp/a\=b cs2=/tmp/c cs2Label=targetPath`)
+			} else {
+				assert.Contains(t, msg, " Rename - LEEF:1.0|SFTPGo|SFTPGo|")
+				assert.Contains(t, msg, "|Rename|devTime=")
+				assert.Contains(t, msg, "\tsev=3\tcat=command\tusrName=user\tsrc=192.168.1.2")
+				assert.Contains(t, msg, "\tresource=/tmp/a=b\ttargetPath=/tmp/c")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("audit record not received")
+		}
+		select {
+		case msg := <-records:
+			assert.True(t, strings.HasPrefix(msg, "<108>1 "), msg)
+			assert.Contains(t, msg, "defender_ban")
+			assert.Contains(t, msg, "192.168.1.3")
+			if format == AuditFormatCEF {
+				assert.Contains(t, msg, "|7|")
+			} else {
+				assert.Contains(t, msg, "\tsev=7\t")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("audit record not received")
+		}
+	}
+	require.NoError(t, InitAuditLog(AuditLogConfig{}))
+}
+
+func TestAuditLogWriteErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	sink := &auditLogSink{
+		config: AuditLogConfig{
+			Address: addr,
+			Network: "tcp",
+		},
+	}
+	assert.Error(t, sink.write("test"))
+	assert.Nil(t, sink.conn)
+	// the queue is full
+	sink.config.Categories = auditSupportedCategories
+	sink.records = make(chan string, 1)
+	sink.send(&auditRecord{category: AuditCategoryAuth, event: "login"})
+	sink.send(&auditRecord{category: AuditCategoryAuth, event: "login"})
+	assert.Equal(t, int64(1), sink.dropped.Load())
+}
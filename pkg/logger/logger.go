@@ -33,6 +33,8 @@ import (
 	ftpserverlog "github.com/fclairamb/go-log"
 	"github.com/rs/zerolog"
 	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/drakkan/sftpgo/v2/pkg/geoip"
 )
 
 const (
@@ -219,6 +221,18 @@ func TransferLog(operation, path string, elapsed int64, size int64, user, connec
 		ev.Str("ftp_mode", ftpMode)
 	}
 	ev.Send()
+	sendAuditRecord(&auditRecord{
+		category:     AuditCategoryTransfer,
+		event:        operation,
+		username:     user,
+		ip:           getIPFromRemoteAddress(remoteAddr),
+		localAddr:    localAddr,
+		protocol:     protocol,
+		connectionID: connectionID,
+		path:         path,
+		size:         size,
+		elapsed:      elapsed,
+	})
 }
 
 // CommandLog logs an SFTP/SCP/SSH command
@@ -243,6 +257,19 @@ func CommandLog(command, path, target, user, fileMode, connectionID, protocol st
 		Str("connection_id", connectionID).
 		Str("protocol", protocol).
 		Send()
+	sendAuditRecord(&auditRecord{
+		category:     AuditCategoryCommand,
+		event:        command,
+		username:     user,
+		ip:           getIPFromRemoteAddress(remoteAddr),
+		localAddr:    localAddr,
+		protocol:     protocol,
+		connectionID: connectionID,
+		path:         path,
+		targetPath:   target,
+		size:         size,
+		elapsed:      elapsed,
+	})
 }
 
 // ConnectionFailedLog logs failed attempts to initialize a connection.
@@ -254,11 +281,82 @@ func ConnectionFailedLog(user, ip, loginType, protocol, errorString string) {
 		Timestamp().
 		Str("sender", "connection_failed").
 		Str("client_ip", ip).
+		Str("client_country", geoip.GetCountry(ip)).
 		Str("username", user).
 		Str("login_type", loginType).
 		Str("protocol", protocol).
 		Str("error", errorString).
 		Send()
+	sendAuditRecord(&auditRecord{
+		category:    AuditCategoryConnection,
+		event:       "connection_failed",
+		warning:     true,
+		username:    user,
+		ip:          ip,
+		protocol:    protocol,
+		loginMethod: loginType,
+		size:        -1,
+		elapsed:     -1,
+		errorString: errorString,
+	})
+}
+
+// TLSCertificateAuthLog logs the outcome of an authentication using a TLS
+// client certificate, the certificate is identified by its subject and serial
+// number
+func TLSCertificateAuthLog(user, ip, loginType, protocol, subject, serial, errorString string) {
+	logger.Info().
+		Timestamp().
+		Str("sender", "tls_certificate_auth").
+		Str("client_ip", ip).
+		Str("client_country", geoip.GetCountry(ip)).
+		Str("username", user).
+		Str("login_type", loginType).
+		Str("protocol", protocol).
+		Str("tls_cert_subject", subject).
+		Str("tls_cert_serial", serial).
+		Str("error", errorString).
+		Send()
+	event := "tls_certificate_auth"
+	if errorString != "" {
+		event = "tls_certificate_auth_failed"
+	}
+	sendAuditRecord(&auditRecord{
+		category:    AuditCategoryAuth,
+		event:       event,
+		warning:     errorString != "",
+		username:    user,
+		ip:          ip,
+		protocol:    protocol,
+		loginMethod: loginType,
+		certSerial:  serial,
+		size:        -1,
+		elapsed:     -1,
+		errorString: errorString,
+	})
+}
+
+// DefenderBanLog logs the hosts banned by the defender.
+// These logs can be used to ban hosts at the firewall level using tools such as Fail2ban
+func DefenderBanLog(ip, protocol string, banTime time.Time) {
+	logger.Info().
+		Timestamp().
+		Str("sender", "defender_ban").
+		Str("client_ip", ip).
+		Str("client_country", geoip.GetCountry(ip)).
+		Str("protocol", protocol).
+		Str("ban_time", banTime.UTC().Format(time.RFC3339)).
+		Int64("ban_duration", int64(time.Until(banTime).Seconds())).
+		Send()
+	sendAuditRecord(&auditRecord{
+		category: AuditCategoryConnection,
+		event:    "defender_ban",
+		warning:  true,
+		ip:       ip,
+		protocol: protocol,
+		size:     -1,
+		elapsed:  -1,
+	})
 }
 
 func isLogFilePathValid(logFilePath string) bool {
@@ -15,6 +15,7 @@
 package logger
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
@@ -26,6 +27,41 @@ import (
 	"github.com/drakkan/sftpgo/v2/pkg/metric"
 )
 
+// Correlation IDs allow to follow a connection or an HTTP request across logs,
+// hooks and event actions. For HTTP requests the correlation ID is the request ID,
+// for the other protocols it is the connection ID
+const (
+	// CorrelationIDHeader is the HTTP header used to return the correlation ID to
+	// the clients and to send it to the HTTP hooks
+	CorrelationIDHeader = "X-Request-ID"
+	// CorrelationIDEnvVar is the environment variable used to send the correlation ID
+	// to the external commands
+	CorrelationIDEnvVar = "SFTPGO_CORRELATION_ID"
+)
+
+type correlationIDKey struct{}
+
+// WithCorrelationID returns a copy of ctx that carries the specified correlation ID.
+// The returned context is used to propagate the ID to the hooks and to the event
+// actions, it does not affect their cancellation
+func WithCorrelationID(ctx context.Context, correlationID string) context.Context {
+	if correlationID == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, correlationIDKey{}, correlationID)
+}
+
+// GetCorrelationID returns the correlation ID carried by ctx, if any
+func GetCorrelationID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	if correlationID, ok := ctx.Value(correlationIDKey{}).(string); ok {
+		return correlationID
+	}
+	return ""
+}
+
 // StructuredLogger defines a simple wrapper around zerolog logger.
 // It implements chi.middleware.LogFormatter interface
 type StructuredLogger struct {
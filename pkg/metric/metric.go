@@ -54,6 +54,90 @@ var (
 		Help: "Total number of logged in users",
 	})
 
+	// totalRejectedConnections is the metric that reports the total number of rejected
+	// client connections by reason
+	totalRejectedConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sftpgo_rejected_connections_total",
+		Help: "The total number of client connections rejected for exceeding the configured limits",
+	}, []string{"reason"})
+
+	// totalRateLimitedRequests is the metric that reports the total number of
+	// requests rejected by the rate limiters by protocol and rate limiter type
+	totalRateLimitedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sftpgo_rate_limited_requests_total",
+		Help: "The total number of requests rejected for exceeding the configured rate limits",
+	}, []string{"protocol", "type"})
+
+	// totalQoSTransferredBytes is the metric that reports the total number of bytes
+	// transferred for each priority class and direction
+	totalQoSTransferredBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sftpgo_qos_transferred_bytes_total",
+		Help: "The total number of bytes transferred for each priority class",
+	}, []string{"class", "direction"})
+
+	// qosActiveTransfers is the metric that reports the number of active transfers
+	// for each priority class and direction
+	qosActiveTransfers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sftpgo_qos_active_transfers",
+		Help: "The number of active transfers for each priority class",
+	}, []string{"class", "direction"})
+
+	// qosBandwidth is the metric that reports the share of the global bandwidth,
+	// as bytes per second, currently assigned to each priority class
+	qosBandwidth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sftpgo_qos_bandwidth_bytes",
+		Help: "The bandwidth, as bytes per second, currently assigned to each priority class",
+	}, []string{"class", "direction"})
+
+	// folderFailoverActive is the metric that reports if a virtual folder is using
+	// the secondary storage backend
+	folderFailoverActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sftpgo_folder_failover_active",
+		Help: "1 if the virtual folder is using the secondary storage backend, 0 otherwise",
+	}, []string{"folder"})
+
+	// totalFolderFailovers is the metric that reports the total number of switches
+	// to the secondary storage backend for a virtual folder
+	totalFolderFailovers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sftpgo_folder_failovers_total",
+		Help: "The total number of switches to the secondary storage backend",
+	}, []string{"folder"})
+
+	// folderFailoverJournalEntries is the metric that reports the number of write
+	// operations to reconcile for a virtual folder
+	folderFailoverJournalEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sftpgo_folder_failover_journal_entries",
+		Help: "The number of write operations executed on the secondary storage backend and not yet reconciled",
+	}, []string{"folder"})
+
+	// sftpFsPoolConnections is the metric that reports the number of upstream
+	// connections in the SFTP storage backend pool
+	sftpFsPoolConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftpgo_sftpfs_pool_connections",
+		Help: "The number of upstream connections in the SFTP storage backend pool",
+	})
+
+	// sftpFsPoolSessions is the metric that reports the number of SFTPGo sessions
+	// using the SFTP storage backend pool
+	sftpFsPoolSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftpgo_sftpfs_pool_sessions",
+		Help: "The number of SFTPGo sessions sharing the upstream connections",
+	})
+
+	// totalSFTPFsPoolConnectErrors is the metric that reports the total number of
+	// failed connection attempts to the upstream SFTP servers
+	totalSFTPFsPoolConnectErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_sftpfs_pool_connect_errors_total",
+		Help: "The total number of failed connection attempts to the upstream SFTP servers",
+	})
+
+	// totalSFTPFsPoolHealthCheckErrors is the metric that reports the total number
+	// of upstream connections closed after a failed health check
+	totalSFTPFsPoolHealthCheckErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_sftpfs_pool_health_check_errors_total",
+		Help: "The total number of upstream connections closed after a failed health check",
+	})
+
 	// totalUploads is the metric that reports the total number of successful uploads
 	totalUploads = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "sftpgo_uploads_total",
@@ -638,6 +722,169 @@ var (
 		Name: "sftpgo_httpfs_download_size",
 		Help: "The total HTTPFs download size as bytes, partial downloads are included",
 	})
+
+	// totalWebDAVFsUploads is the metric that reports the total number of successful WebDAVFs uploads
+	totalWebDAVFsUploads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_webdavfs_uploads_total",
+		Help: "The total number of successful WebDAVFs uploads",
+	})
+
+	// totalWebDAVFsDownloads is the metric that reports the total number of successful WebDAVFs downloads
+	totalWebDAVFsDownloads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_webdavfs_downloads_total",
+		Help: "The total number of successful WebDAVFs downloads",
+	})
+
+	// totalWebDAVFsUploadErrors is the metric that reports the total number of WebDAVFs upload errors
+	totalWebDAVFsUploadErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_webdavfs_upload_errors_total",
+		Help: "The total number of WebDAVFs upload errors",
+	})
+
+	// totalWebDAVFsDownloadErrors is the metric that reports the total number of WebDAVFs download errors
+	totalWebDAVFsDownloadErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_webdavfs_download_errors_total",
+		Help: "The total number of WebDAVFs download errors",
+	})
+
+	// totalWebDAVFsUploadSize is the metric that reports the total WebDAVFs uploads size as bytes
+	totalWebDAVFsUploadSize = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_webdavfs_upload_size",
+		Help: "The total WebDAVFs upload size as bytes, partial uploads are included",
+	})
+
+	// totalWebDAVFsDownloadSize is the metric that reports the total WebDAVFs downloads size as bytes
+	totalWebDAVFsDownloadSize = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_webdavfs_download_size",
+		Help: "The total WebDAVFs download size as bytes, partial downloads are included",
+	})
+
+	// totalObjectCacheHits is the metric that reports the total number of downloads served from the object cache
+	totalObjectCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_object_cache_hits_total",
+		Help: "The total number of downloads served from the object cache",
+	})
+
+	// totalObjectCacheMisses is the metric that reports the total number of cacheable downloads not found in the object cache
+	totalObjectCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_object_cache_misses_total",
+		Help: "The total number of cacheable downloads not found in the object cache",
+	})
+
+	// totalObjectCacheHitSize is the metric that reports the total size as bytes of the objects served from the object cache
+	totalObjectCacheHitSize = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_object_cache_hit_size",
+		Help: "The total size as bytes of the objects served from the object cache",
+	})
+
+	// totalObjectCacheEvictions is the metric that reports the total number of objects evicted from the object cache
+	totalObjectCacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_object_cache_evictions_total",
+		Help: "The total number of objects evicted from the object cache",
+	})
+
+	// objectCacheSize is the metric that reports the current object cache size as bytes
+	objectCacheSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftpgo_object_cache_size",
+		Help: "The current object cache size as bytes",
+	})
+
+	// totalDirListCacheHits is the metric that reports the total number of directory listings served from the cache
+	totalDirListCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_dir_list_cache_hits_total",
+		Help: "The total number of directory listings served from the directory listing cache",
+	})
+
+	// totalDirListCacheMisses is the metric that reports the total number of directory listings not found in the cache
+	totalDirListCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_dir_list_cache_misses_total",
+		Help: "The total number of directory listings not found in the directory listing cache",
+	})
+
+	// totalDirListCacheInvalidations is the metric that reports the total number of cached directory listings
+	// invalidated by write operations
+	totalDirListCacheInvalidations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_dir_list_cache_invalidations_total",
+		Help: "The total number of cached directory listings invalidated by write operations",
+	})
+
+	// dirListCacheEntries is the metric that reports the current number of cached directory listings
+	dirListCacheEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftpgo_dir_list_cache_entries",
+		Help: "The current number of cached directory listings",
+	})
+
+	// totalDedupStoredFiles is the metric that reports the total number of files added to the dedup store
+	totalDedupStoredFiles = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_dedup_stored_files_total",
+		Help: "The total number of files added to the dedup store as new blocks",
+	})
+
+	// totalDedupLinkedFiles is the metric that reports the total number of files linked to existing blocks
+	totalDedupLinkedFiles = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_dedup_linked_files_total",
+		Help: "The total number of files linked to existing blocks in the dedup store",
+	})
+
+	// totalDedupSavedSize is the metric that reports the total size as bytes saved by the deduplication
+	totalDedupSavedSize = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_dedup_saved_size",
+		Help: "The total size as bytes saved linking files to existing blocks",
+	})
+
+	// totalDedupGCRemovedBlocks is the metric that reports the total number of unreferenced blocks removed
+	totalDedupGCRemovedBlocks = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_dedup_gc_removed_blocks_total",
+		Help: "The total number of unreferenced blocks removed from the dedup store",
+	})
+
+	// totalDedupGCErrors is the metric that reports the total number of dedup store garbage collection errors
+	totalDedupGCErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_dedup_gc_errors_total",
+		Help: "The total number of dedup store garbage collection errors",
+	})
+
+	// dedupBlocks is the metric that reports the number of blocks in the dedup store after the last garbage collection
+	dedupBlocks = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftpgo_dedup_blocks",
+		Help: "The number of blocks in the dedup store after the last garbage collection",
+	})
+
+	// dedupStoreSize is the metric that reports the dedup store size as bytes after the last garbage collection
+	dedupStoreSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftpgo_dedup_store_size",
+		Help: "The dedup store size as bytes after the last garbage collection",
+	})
+
+	// totalTieringMovedFiles is the metric that reports the total number of files moved to the cold storage
+	totalTieringMovedFiles = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_tiering_moved_files_total",
+		Help: "The total number of files moved to the cold storage",
+	})
+
+	// totalTieringMovedSize is the metric that reports the total size as bytes moved to the cold storage
+	totalTieringMovedSize = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_tiering_moved_size",
+		Help: "The total size as bytes moved to the cold storage",
+	})
+
+	// totalTieringRecalledFiles is the metric that reports the total number of files recalled from the cold storage
+	totalTieringRecalledFiles = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_tiering_recalled_files_total",
+		Help: "The total number of files recalled from the cold storage",
+	})
+
+	// totalTieringRecalledSize is the metric that reports the total size as bytes recalled from the cold storage
+	totalTieringRecalledSize = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_tiering_recalled_size",
+		Help: "The total size as bytes recalled from the cold storage",
+	})
+
+	// totalTieringRecallErrors is the metric that reports the total number of recall errors
+	totalTieringRecallErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_tiering_recall_errors_total",
+		Help: "The total number of errors recalling files from the cold storage",
+	})
 )
 
 // AddMetricsEndpoint publishes metrics to the specified endpoint
@@ -890,6 +1137,107 @@ func HTTPFsTransferCompleted(bytes int64, transferKind int, err error) {
 	}
 }
 
+// WebDAVFsTransferCompleted updates metrics after a WebDAVFs upload or a download
+func WebDAVFsTransferCompleted(bytes int64, transferKind int, err error) {
+	if transferKind == 0 {
+		// upload
+		if err == nil {
+			totalWebDAVFsUploads.Inc()
+		} else {
+			totalWebDAVFsUploadErrors.Inc()
+		}
+		totalWebDAVFsUploadSize.Add(float64(bytes))
+	} else {
+		// download
+		if err == nil {
+			totalWebDAVFsDownloads.Inc()
+		} else {
+			totalWebDAVFsDownloadErrors.Inc()
+		}
+		totalWebDAVFsDownloadSize.Add(float64(bytes))
+	}
+}
+
+// ObjectCacheHit updates metrics after a download served from the object cache
+func ObjectCacheHit(size int64) {
+	totalObjectCacheHits.Inc()
+	totalObjectCacheHitSize.Add(float64(size))
+}
+
+// ObjectCacheMiss updates metrics after a cacheable download not found in the object cache
+func ObjectCacheMiss() {
+	totalObjectCacheMisses.Inc()
+}
+
+// ObjectCacheEviction updates metrics after an object is evicted from the object cache
+func ObjectCacheEviction() {
+	totalObjectCacheEvictions.Inc()
+}
+
+// UpdateObjectCacheSize sets the current object cache size as bytes
+func UpdateObjectCacheSize(size int64) {
+	objectCacheSize.Set(float64(size))
+}
+
+// DirListCacheHit updates metrics after a directory listing served from the cache
+func DirListCacheHit() {
+	totalDirListCacheHits.Inc()
+}
+
+// DirListCacheMiss updates metrics after a directory listing not found in the cache
+func DirListCacheMiss() {
+	totalDirListCacheMisses.Inc()
+}
+
+// DirListCacheInvalidation updates metrics after cached directory listings are
+// invalidated by a write operation
+func DirListCacheInvalidation(count int) {
+	totalDirListCacheInvalidations.Add(float64(count))
+}
+
+// UpdateDirListCacheEntries sets the current number of cached directory listings
+func UpdateDirListCacheEntries(count int) {
+	dirListCacheEntries.Set(float64(count))
+}
+
+// DedupFileStored updates metrics after a file is added to the dedup store.
+// Deduplicated is true if the file was linked to an existing block
+func DedupFileStored(size int64, deduplicated bool) {
+	if deduplicated {
+		totalDedupLinkedFiles.Inc()
+		totalDedupSavedSize.Add(float64(size))
+	} else {
+		totalDedupStoredFiles.Inc()
+	}
+}
+
+// DedupGCCompleted updates metrics after a dedup store garbage collection
+func DedupGCCompleted(blocks int, size int64, removedBlocks int, err error) {
+	totalDedupGCRemovedBlocks.Add(float64(removedBlocks))
+	if err != nil {
+		totalDedupGCErrors.Inc()
+		return
+	}
+	dedupBlocks.Set(float64(blocks))
+	dedupStoreSize.Set(float64(size))
+}
+
+// TieringFileMoved updates metrics after a file is moved to the cold storage
+func TieringFileMoved(size int64) {
+	totalTieringMovedFiles.Inc()
+	totalTieringMovedSize.Add(float64(size))
+}
+
+// TieringFileRecalled updates metrics after a file is recalled from the cold storage
+func TieringFileRecalled(size int64, err error) {
+	if err != nil {
+		totalTieringRecallErrors.Inc()
+		return
+	}
+	totalTieringRecalledFiles.Inc()
+	totalTieringRecalledSize.Add(float64(size))
+}
+
 // SSHCommandCompleted update metrics after an SSH command terminates
 func SSHCommandCompleted(err error) {
 	if err == nil {
@@ -1002,7 +1350,72 @@ func HTTPRequestServed(status int) {
 	}
 }
 
+// AddRejectedConnection increments the metric for client connections rejected
+// for the specified reason
+func AddRejectedConnection(reason string) {
+	totalRejectedConnections.WithLabelValues(reason).Inc()
+}
+
+// AddRateLimitedRequest increments the metric for requests rejected by the
+// rate limiters
+func AddRateLimitedRequest(protocol, limiterType string) {
+	totalRateLimitedRequests.WithLabelValues(protocol, limiterType).Inc()
+}
+
 // UpdateActiveConnectionsSize sets the metric for active connections
 func UpdateActiveConnectionsSize(size int) {
 	activeConnections.Set(float64(size))
 }
+
+// AddFolderFailover increments the metric for switches to the secondary storage backend
+func AddFolderFailover(folder string) {
+	totalFolderFailovers.WithLabelValues(folder).Inc()
+}
+
+// UpdateFolderFailoverStatus sets the failover metrics for the specified folder
+func UpdateFolderFailoverStatus(folder string, active bool, journalEntries int) {
+	var val float64
+	if active {
+		val = 1
+	}
+	folderFailoverActive.WithLabelValues(folder).Set(val)
+	folderFailoverJournalEntries.WithLabelValues(folder).Set(float64(journalEntries))
+}
+
+// RemoveFolderFailoverStatus removes the failover metrics for the specified folder
+func RemoveFolderFailoverStatus(folder string) {
+	folderFailoverActive.DeleteLabelValues(folder)
+	totalFolderFailovers.DeleteLabelValues(folder)
+	folderFailoverJournalEntries.DeleteLabelValues(folder)
+}
+
+// UpdateSFTPFsPoolStatus sets the metrics for the upstream connections and the
+// sessions in the SFTP storage backend pool
+func UpdateSFTPFsPoolStatus(connections, sessions int) {
+	sftpFsPoolConnections.Set(float64(connections))
+	sftpFsPoolSessions.Set(float64(sessions))
+}
+
+// AddSFTPFsPoolConnectError increments the metric for failed connection attempts
+// to the upstream SFTP servers
+func AddSFTPFsPoolConnectError() {
+	totalSFTPFsPoolConnectErrors.Inc()
+}
+
+// AddSFTPFsPoolHealthCheckError increments the metric for failed health checks
+// of the upstream SFTP connections
+func AddSFTPFsPoolHealthCheckError() {
+	totalSFTPFsPoolHealthCheckErrors.Inc()
+}
+
+// AddQoSTransferredBytes increments the bytes transferred for the specified priority class
+func AddQoSTransferredBytes(class, direction string, n int64) {
+	totalQoSTransferredBytes.WithLabelValues(class, direction).Add(float64(n))
+}
+
+// UpdateQoSClassStatus sets the active transfers and the assigned bandwidth
+// for the specified priority class
+func UpdateQoSClassStatus(class, direction string, transfers int, bandwidth int64) {
+	qosActiveTransfers.WithLabelValues(class, direction).Set(float64(transfers))
+	qosBandwidth.WithLabelValues(class, direction).Set(float64(bandwidth))
+}
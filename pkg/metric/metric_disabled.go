@@ -52,6 +52,47 @@ func GCSHeadBucketCompleted(_ error) {}
 // HTTPFsTransferCompleted updates metrics after an HTTPFs upload or a download
 func HTTPFsTransferCompleted(_ int64, _ int, _ error) {}
 
+// WebDAVFsTransferCompleted updates metrics after a WebDAVFs upload or a download
+func WebDAVFsTransferCompleted(_ int64, _ int, _ error) {}
+
+// ObjectCacheHit updates metrics after a download served from the object cache
+func ObjectCacheHit(_ int64) {}
+
+// ObjectCacheMiss updates metrics after a cacheable download not found in the object cache
+func ObjectCacheMiss() {}
+
+// ObjectCacheEviction updates metrics after an object is evicted from the object cache
+func ObjectCacheEviction() {}
+
+// UpdateObjectCacheSize sets the current object cache size as bytes
+func UpdateObjectCacheSize(_ int64) {}
+
+// DirListCacheHit updates metrics after a directory listing served from the cache
+func DirListCacheHit() {}
+
+// DirListCacheMiss updates metrics after a directory listing not found in the cache
+func DirListCacheMiss() {}
+
+// DirListCacheInvalidation updates metrics after cached directory listings are
+// invalidated by a write operation
+func DirListCacheInvalidation(_ int) {}
+
+// UpdateDirListCacheEntries sets the current number of cached directory listings
+func UpdateDirListCacheEntries(_ int) {}
+
+// DedupFileStored updates metrics after a file is added to the dedup store.
+// Deduplicated is true if the file was linked to an existing block
+func DedupFileStored(_ int64, _ bool) {}
+
+// DedupGCCompleted updates metrics after a dedup store garbage collection
+func DedupGCCompleted(_ int, _ int64, _ int, _ error) {}
+
+// TieringFileMoved updates metrics after a file is moved to the cold storage
+func TieringFileMoved(_ int64) {}
+
+// TieringFileRecalled updates metrics after a file is recalled from the cold storage
+func TieringFileRecalled(_ int64, _ error) {}
+
 // SSHCommandCompleted update metrics after an SSH command terminates
 func SSHCommandCompleted(_ error) {}
 
@@ -71,5 +112,41 @@ func AddNoAuthTried() {}
 // HTTPRequestServed increments the metrics for HTTP requests
 func HTTPRequestServed(_ int) {}
 
+// AddRejectedConnection increments the metric for client connections rejected
+// for the specified reason
+func AddRejectedConnection(_ string) {}
+
+// AddRateLimitedRequest increments the metric for requests rejected by the
+// rate limiters
+func AddRateLimitedRequest(_, _ string) {}
+
 // UpdateActiveConnectionsSize sets the metric for active connections
 func UpdateActiveConnectionsSize(_ int) {}
+
+// AddFolderFailover increments the metric for switches to the secondary storage backend
+func AddFolderFailover(_ string) {}
+
+// UpdateFolderFailoverStatus sets the failover metrics for the specified folder
+func UpdateFolderFailoverStatus(_ string, _ bool, _ int) {}
+
+// RemoveFolderFailoverStatus removes the failover metrics for the specified folder
+func RemoveFolderFailoverStatus(_ string) {}
+
+// UpdateSFTPFsPoolStatus sets the metrics for the upstream connections and the
+// sessions in the SFTP storage backend pool
+func UpdateSFTPFsPoolStatus(_, _ int) {}
+
+// AddSFTPFsPoolConnectError increments the metric for failed connection attempts
+// to the upstream SFTP servers
+func AddSFTPFsPoolConnectError() {}
+
+// AddSFTPFsPoolHealthCheckError increments the metric for failed health checks
+// of the upstream SFTP connections
+func AddSFTPFsPoolHealthCheckError() {}
+
+// AddQoSTransferredBytes increments the bytes transferred for the specified priority class
+func AddQoSTransferredBytes(_, _ string, _ int64) {}
+
+// UpdateQoSClassStatus sets the active transfers and the assigned bandwidth
+// for the specified priority class
+func UpdateQoSClassStatus(_, _ string, _ int, _ int64) {}
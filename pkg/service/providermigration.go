@@ -0,0 +1,157 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+)
+
+// ProviderMigration defines a data migration between two data providers
+type ProviderMigration struct {
+	Source    dataprovider.Config
+	Target    dataprovider.Config
+	ConfigDir string
+	// If set, the data are copied even if the target provider is not empty.
+	// Existing objects are updated
+	AllowNonEmptyTarget bool
+}
+
+func (m *ProviderMigration) validate() error {
+	if m.Target.Driver == dataprovider.MemoryDataProviderName {
+		return errors.New("the memory provider is not supported as migration target")
+	}
+	if m.Source.Driver == m.Target.Driver && m.Source.Name == m.Target.Name && m.Source.Host == m.Target.Host &&
+		m.Source.Port == m.Target.Port && m.Source.SQLTablesPrefix == m.Target.SQLTablesPrefix {
+		return errors.New("source and target data providers must be different")
+	}
+	return nil
+}
+
+// getMigrationProviderConf returns a copy of the specified configuration
+// with hooks, actions and cluster node registration disabled
+func getMigrationProviderConf(conf dataprovider.Config) dataprovider.Config {
+	conf.Actions.Hook = ""
+	conf.Actions.ExecuteFor = nil
+	conf.Actions.ExecuteOn = nil
+	conf.ExternalAuthHook = ""
+	conf.PreLoginHook = ""
+	conf.PostLoginHook = ""
+	conf.CheckPasswordHook = ""
+	conf.CreateDefaultAdmin = false
+	conf.Node = dataprovider.NodeConfig{}
+	return conf
+}
+
+func (m *ProviderMigration) dumpSource() (dataprovider.BackupData, error) {
+	if err := dataprovider.Initialize(getMigrationProviderConf(m.Source), m.ConfigDir, false); err != nil {
+		return dataprovider.BackupData{}, fmt.Errorf("unable to initialize the source provider: %w", err)
+	}
+	defer dataprovider.Close() //nolint:errcheck
+
+	dump, err := dataprovider.DumpData(nil)
+	if err != nil {
+		return dump, fmt.Errorf("unable to dump the source provider: %w", err)
+	}
+	return dump, nil
+}
+
+// restoreQuotaUsage copies the used quota and transfer quota from the source dump.
+// They are not restored by the standard restore procedure
+func (m *ProviderMigration) restoreQuotaUsage(dump *dataprovider.BackupData) error {
+	if m.Target.TrackQuota == 0 {
+		return nil
+	}
+	for idx := range dump.Users {
+		user := &dump.Users[idx]
+		if err := dataprovider.UpdateUserQuota(user, user.UsedQuotaFiles, user.UsedQuotaSize, true); err != nil {
+			return fmt.Errorf("unable to restore quota usage for user %q: %w", user.Username, err)
+		}
+		if err := dataprovider.UpdateUserTransferQuota(user, user.UsedUploadDataTransfer,
+			user.UsedDownloadDataTransfer, true); err != nil {
+			return fmt.Errorf("unable to restore transfer quota usage for user %q: %w", user.Username, err)
+		}
+	}
+	for idx := range dump.Folders {
+		folder := &dump.Folders[idx]
+		if err := dataprovider.UpdateVirtualFolderQuota(folder, folder.UsedQuotaFiles, folder.UsedQuotaSize, true); err != nil {
+			return fmt.Errorf("unable to restore quota usage for folder %q: %w", folder.Name, err)
+		}
+	}
+	return nil
+}
+
+func (m *ProviderMigration) restoreTarget(dump *dataprovider.BackupData) ([]dataprovider.MigrationSummary, error) {
+	if err := dataprovider.Initialize(getMigrationProviderConf(m.Target), m.ConfigDir, false); err != nil {
+		return nil, fmt.Errorf("unable to initialize the target provider: %w", err)
+	}
+	defer dataprovider.Close() //nolint:errcheck
+
+	if !m.AllowNonEmptyTarget {
+		existing, err := dataprovider.DumpData(nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to check the target provider: %w", err)
+		}
+		if existing.HasObjects() {
+			return nil, errors.New("the target provider is not empty")
+		}
+	}
+	s := Service{
+		LoadDataFrom: fmt.Sprintf("%s provider", m.Source.Driver),
+		LoadDataMode: 0,
+	}
+	if err := s.restoreDump(dump); err != nil {
+		return nil, err
+	}
+	if err := m.restoreQuotaUsage(dump); err != nil {
+		return nil, err
+	}
+	if err := dataprovider.ResetSequences(); err != nil {
+		return nil, err
+	}
+	restored, err := dataprovider.DumpData(nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to dump the target provider: %w", err)
+	}
+	return dataprovider.CompareDumps(dump, &restored), nil
+}
+
+// Migrate copies all the data from the source provider to the target one and
+// verifies the result. The source provider is only read, so it can be used by
+// running SFTPGo instances while migrating
+func (m *ProviderMigration) Migrate() ([]dataprovider.MigrationSummary, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	logger.InfoToConsole("Reading data from the source provider %q", m.Source.Driver)
+	dump, err := m.dumpSource()
+	if err != nil {
+		return nil, err
+	}
+	logger.InfoToConsole("Copying data to the target provider %q", m.Target.Driver)
+	summary, err := m.restoreTarget(&dump)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range summary {
+		if !s.IsValid() {
+			return summary, fmt.Errorf("verification failed for %s", s.Object)
+		}
+	}
+	return summary, nil
+}
@@ -102,6 +102,7 @@ func (s *Service) Start(disableAWSInstallationCode bool) error {
 			logger.Error(logSender, "", "error loading configuration: %v", err)
 			return err
 		}
+		httpd.SetConfigReportResolver(config.GetConfigReport)
 	}
 	if !config.HasServicesToStart() {
 		infoString := "no service configured, nothing to do"
@@ -136,6 +137,12 @@ func (s *Service) initializeServices(disableAWSInstallationCode bool) error {
 		logger.ErrorToConsole("unable to initialize MFA: %v", err)
 		return err
 	}
+	tracingConfig := config.GetTelemetryConfig().Tracing
+	if err := tracingConfig.Initialize(); err != nil {
+		logger.Error(logSender, "", "unable to initialize tracing: %v", err)
+		logger.ErrorToConsole("unable to initialize tracing: %v", err)
+		return err
+	}
 	err = dataprovider.Initialize(providerConf, s.ConfigDir, s.PortableMode == 0)
 	if err != nil {
 		logger.Error(logSender, "", "error initializing data provider: %v", err)
@@ -197,6 +204,7 @@ func (s *Service) initializeServices(disableAWSInstallationCode bool) error {
 		logger.ErrorToConsole("error initializing commands configuration: %v", err)
 		return err
 	}
+	config.StartSecretRefsRefresh()
 
 	return nil
 }
@@ -327,16 +335,9 @@ func (s *Service) LoadInitialData() error {
 	if err != nil {
 		return fmt.Errorf("unable to read input file %q: %w", s.LoadDataFrom, err)
 	}
-	dump, err := dataprovider.ParseDumpData(content)
-	if err != nil {
-		return fmt.Errorf("unable to parse file to restore %q: %w", s.LoadDataFrom, err)
-	}
-	err = s.restoreDump(&dump)
-	if err != nil {
+	if err := s.LoadData(content); err != nil {
 		return err
 	}
-	logger.Info(logSender, "", "data loaded from file %q mode: %v", s.LoadDataFrom, s.LoadDataMode)
-	logger.InfoToConsole("data loaded from file %q mode: %v", s.LoadDataFrom, s.LoadDataMode)
 	if s.LoadDataClean {
 		err = os.Remove(s.LoadDataFrom)
 		if err == nil {
@@ -350,6 +351,33 @@ func (s *Service) LoadInitialData() error {
 	return nil
 }
 
+// LoadData restores the specified backup content. Encrypted provider backups
+// are decrypted using the configured KMS. LoadDataFrom is only used to identify
+// the backup in logs and errors
+func (s *Service) LoadData(content []byte) error {
+	if s.LoadDataMode < 0 || s.LoadDataMode > 1 {
+		return fmt.Errorf("invalid loaddata-mode %v", s.LoadDataMode)
+	}
+	if s.LoadDataQuotaScan < 0 || s.LoadDataQuotaScan > 2 {
+		return fmt.Errorf("invalid loaddata-scan %v", s.LoadDataQuotaScan)
+	}
+	content, err := common.DecodeProviderBackup(content)
+	if err != nil {
+		return fmt.Errorf("unable to decode file to restore %q: %w", s.LoadDataFrom, err)
+	}
+	dump, err := dataprovider.ParseDumpData(content)
+	if err != nil {
+		return fmt.Errorf("unable to parse file to restore %q: %w", s.LoadDataFrom, err)
+	}
+	err = s.restoreDump(&dump)
+	if err != nil {
+		return err
+	}
+	logger.Info(logSender, "", "data loaded from file %q mode: %v", s.LoadDataFrom, s.LoadDataMode)
+	logger.InfoToConsole("data loaded from file %q mode: %v", s.LoadDataFrom, s.LoadDataMode)
+	return nil
+}
+
 func (s *Service) restoreDump(dump *dataprovider.BackupData) error {
 	err := httpd.RestoreConfigs(dump.Configs, s.LoadDataMode, dataprovider.ActionExecutorSystem, "", "")
 	if err != nil {
@@ -363,6 +391,10 @@ func (s *Service) restoreDump(dump *dataprovider.BackupData) error {
 	if err != nil {
 		return fmt.Errorf("unable to restore roles from file %q: %v", s.LoadDataFrom, err)
 	}
+	err = httpd.RestoreAdminRoles(dump.AdminRoles, s.LoadDataFrom, s.LoadDataMode, dataprovider.ActionExecutorSystem, "", "")
+	if err != nil {
+		return fmt.Errorf("unable to restore admin roles from file %q: %v", s.LoadDataFrom, err)
+	}
 	err = httpd.RestoreFolders(dump.Folders, s.LoadDataFrom, s.LoadDataMode, s.LoadDataQuotaScan, dataprovider.ActionExecutorSystem, "", "")
 	if err != nil {
 		return fmt.Errorf("unable to restore folders from file %q: %v", s.LoadDataFrom, err)
@@ -33,6 +33,7 @@ import (
 	"github.com/drakkan/sftpgo/v2/pkg/plugin"
 	"github.com/drakkan/sftpgo/v2/pkg/sftpd"
 	"github.com/drakkan/sftpgo/v2/pkg/telemetry"
+	"github.com/drakkan/sftpgo/v2/pkg/tracing"
 	"github.com/drakkan/sftpgo/v2/pkg/webdavd"
 )
 
@@ -138,6 +139,7 @@ loop:
 			s.Service.Stop()
 			plugin.Handler.Cleanup()
 			common.WaitForTransfers(graceTime)
+			tracing.Shutdown()
 			break loop
 		case svc.ParamChange:
 			logger.Debug(logSender, "", "Received reload request")
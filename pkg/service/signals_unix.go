@@ -30,6 +30,7 @@ import (
 	"github.com/drakkan/sftpgo/v2/pkg/plugin"
 	"github.com/drakkan/sftpgo/v2/pkg/sftpd"
 	"github.com/drakkan/sftpgo/v2/pkg/telemetry"
+	"github.com/drakkan/sftpgo/v2/pkg/tracing"
 	"github.com/drakkan/sftpgo/v2/pkg/webdavd"
 )
 
@@ -94,5 +95,6 @@ func handleInterrupt() {
 	logger.Debug(logSender, "", "Received interrupt request")
 	plugin.Handler.Cleanup()
 	common.WaitForTransfers(graceTime)
+	tracing.Shutdown()
 	os.Exit(0)
 }
@@ -21,6 +21,7 @@ import (
 	"github.com/drakkan/sftpgo/v2/pkg/common"
 	"github.com/drakkan/sftpgo/v2/pkg/logger"
 	"github.com/drakkan/sftpgo/v2/pkg/plugin"
+	"github.com/drakkan/sftpgo/v2/pkg/tracing"
 )
 
 func registerSignals() {
@@ -31,6 +32,7 @@ func registerSignals() {
 			logger.Debug(logSender, "", "Received interrupt request")
 			plugin.Handler.Cleanup()
 			common.WaitForTransfers(graceTime)
+			tracing.Shutdown()
 			os.Exit(0)
 		}
 	}()
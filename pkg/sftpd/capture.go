@@ -0,0 +1,252 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package sftpd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/drakkan/sftpgo/v2/pkg/common"
+)
+
+// SFTP packet types used to describe the captured packets, the other ones
+// are defined with the extended requests
+const (
+	sftpPacketRename  = 18
+	sftpPacketSymlink = 20
+	sftpPacketName    = 104
+	// we only need the packet header to describe the packet
+	maxCapturedPacketHeader = 1024
+)
+
+var sftpPacketNames = map[byte]string{
+	1:   "SSH_FXP_INIT",
+	2:   "SSH_FXP_VERSION",
+	3:   "SSH_FXP_OPEN",
+	4:   "SSH_FXP_CLOSE",
+	5:   "SSH_FXP_READ",
+	6:   "SSH_FXP_WRITE",
+	7:   "SSH_FXP_LSTAT",
+	8:   "SSH_FXP_FSTAT",
+	9:   "SSH_FXP_SETSTAT",
+	10:  "SSH_FXP_FSETSTAT",
+	11:  "SSH_FXP_OPENDIR",
+	12:  "SSH_FXP_READDIR",
+	13:  "SSH_FXP_REMOVE",
+	14:  "SSH_FXP_MKDIR",
+	15:  "SSH_FXP_RMDIR",
+	16:  "SSH_FXP_REALPATH",
+	17:  "SSH_FXP_STAT",
+	18:  "SSH_FXP_RENAME",
+	19:  "SSH_FXP_READLINK",
+	20:  "SSH_FXP_SYMLINK",
+	101: "SSH_FXP_STATUS",
+	102: "SSH_FXP_HANDLE",
+	103: "SSH_FXP_DATA",
+	104: "SSH_FXP_NAME",
+	105: "SSH_FXP_ATTRS",
+	200: "SSH_FXP_EXTENDED",
+	201: "SSH_FXP_EXTENDED_REPLY",
+}
+
+// packets with a path as first field after the request ID
+var sftpPathPackets = map[byte]bool{
+	3: true, 7: true, 9: true, 11: true, 13: true, 14: true, 15: true, 16: true, 17: true,
+	18: true, 19: true, 20: true,
+}
+
+// sftpPacketTracer splits a stream in SFTP packets and describes them
+type sftpPacketTracer struct {
+	mu        sync.Mutex
+	direction string
+	lenBuf    [4]byte
+	lenRead   int
+	length    uint32
+	remaining uint32
+	header    []byte
+	emit      func(direction string, length uint32, header []byte)
+}
+
+func (t *sftpPacketTracer) feed(data []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for len(data) > 0 {
+		if t.lenRead < 4 {
+			n := copy(t.lenBuf[t.lenRead:], data)
+			t.lenRead += n
+			data = data[n:]
+			if t.lenRead == 4 {
+				t.length = binary.BigEndian.Uint32(t.lenBuf[:])
+				t.remaining = t.length
+				t.header = t.header[:0]
+				if t.remaining == 0 {
+					t.emit(t.direction, 0, nil)
+					t.lenRead = 0
+				}
+			}
+			continue
+		}
+		n := min(uint32(len(data)), t.remaining)
+		if len(t.header) < maxCapturedPacketHeader {
+			t.header = append(t.header, data[:min(int(n), maxCapturedPacketHeader-len(t.header))]...)
+		}
+		t.remaining -= n
+		data = data[n:]
+		if t.remaining == 0 {
+			t.emit(t.direction, t.length, t.header)
+			t.lenRead = 0
+		}
+	}
+}
+
+// captureChannel wraps the channel used by the SFTP server to add the
+// exchanged packets to the matching debug captures
+type captureChannel struct {
+	io.ReadWriteCloser
+	in  sftpPacketTracer
+	out sftpPacketTracer
+}
+
+func newCaptureChannel(channel io.ReadWriteCloser, connection *Connection) *captureChannel {
+	emit := func(direction string, length uint32, header []byte) {
+		common.DebugCaptures.Capture(connection, direction, func() string {
+			return describeSFTPPacket(length, header)
+		})
+	}
+	return &captureChannel{
+		ReadWriteCloser: channel,
+		in:              sftpPacketTracer{direction: common.DebugCaptureDirectionIn, emit: emit},
+		out:             sftpPacketTracer{direction: common.DebugCaptureDirectionOut, emit: emit},
+	}
+}
+
+func (c *captureChannel) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		c.in.feed(p[:n])
+	}
+	return n, err
+}
+
+func (c *captureChannel) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	if n > 0 {
+		c.out.feed(p[:n])
+	}
+	return n, err
+}
+
+type sftpPacketDecoder struct {
+	data []byte
+	ok   bool
+}
+
+func (d *sftpPacketDecoder) uint32() uint32 {
+	if !d.ok || len(d.data) < 4 {
+		d.ok = false
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.data)
+	d.data = d.data[4:]
+	return v
+}
+
+func (d *sftpPacketDecoder) uint64() uint64 {
+	if !d.ok || len(d.data) < 8 {
+		d.ok = false
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.data)
+	d.data = d.data[8:]
+	return v
+}
+
+func (d *sftpPacketDecoder) string() string {
+	l := d.uint32()
+	if !d.ok {
+		return ""
+	}
+	if uint32(len(d.data)) < l {
+		// the header is truncated, return what we have
+		v := string(d.data)
+		d.data = nil
+		d.ok = false
+		return v + "..."
+	}
+	v := string(d.data[:l])
+	d.data = d.data[l:]
+	return v
+}
+
+func describeSFTPPacket(length uint32, header []byte) string {
+	if len(header) == 0 {
+		return fmt.Sprintf("empty packet, length: %d", length)
+	}
+	packetType := header[0]
+	name, ok := sftpPacketNames[packetType]
+	if !ok {
+		name = fmt.Sprintf("unknown packet type %d", packetType)
+	}
+	d := sftpPacketDecoder{data: header[1:], ok: true}
+	var sb strings.Builder
+	sb.WriteString(name)
+	if packetType == sftpPacketInit || packetType == sftpPacketVersion {
+		sb.WriteString(fmt.Sprintf(" version: %d", d.uint32()))
+		for d.ok && len(d.data) > 0 {
+			ext := d.string()
+			data := d.string()
+			if ext != "" {
+				sb.WriteString(fmt.Sprintf(", extension: %s=%q", ext, data))
+			}
+		}
+		sb.WriteString(fmt.Sprintf(", length: %d", length))
+		return sb.String()
+	}
+	sb.WriteString(fmt.Sprintf(" id: %d", d.uint32()))
+	switch {
+	case packetType == sftpPacketExtended:
+		sb.WriteString(fmt.Sprintf(", request: %q", d.string()))
+	case sftpPathPackets[packetType]:
+		sb.WriteString(fmt.Sprintf(", path: %q", d.string()))
+		switch packetType {
+		case sftpPacketOpen:
+			sb.WriteString(fmt.Sprintf(", pflags: %#x", d.uint32()))
+		case sftpPacketRename, sftpPacketSymlink:
+			sb.WriteString(fmt.Sprintf(", target: %q", d.string()))
+		}
+	case packetType == sftpPacketRead || packetType == sftpPacketWrite:
+		d.string() // handle
+		sb.WriteString(fmt.Sprintf(", offset: %d, len: %d", d.uint64(), d.uint32()))
+	case packetType == sftpPacketStatus:
+		sb.WriteString(fmt.Sprintf(", code: %d", d.uint32()))
+		if msg := d.string(); msg != "" {
+			sb.WriteString(fmt.Sprintf(", message: %q", msg))
+		}
+	case packetType == sftpPacketData:
+		sb.WriteString(fmt.Sprintf(", data len: %d", d.uint32()))
+	case packetType == sftpPacketName:
+		count := d.uint32()
+		sb.WriteString(fmt.Sprintf(", count: %d", count))
+		if count == 1 {
+			sb.WriteString(fmt.Sprintf(", name: %q", d.string()))
+		}
+	}
+	sb.WriteString(fmt.Sprintf(", length: %d", length))
+	return sb.String()
+}
@@ -0,0 +1,446 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package sftpd
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/drakkan/sftpgo/v2/pkg/common"
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/vfs"
+)
+
+const (
+	copyDataExtension = "copy-data"
+	copyFileExtension = "copy-file"
+	// vendor extensions to start background recursive file operations and
+	// to poll their status
+	fileOperationExtension       = "file-operation@sftpgo.com"
+	fileOperationStatusExtension = "file-operation-status@sftpgo.com"
+	checkFileNameExtension       = "check-file-name"
+	checkFileHandleExtension     = "check-file-handle"
+	// the minimum block size allowed by the check-file extension
+	checkFileMinBlockSize = 256
+)
+
+var (
+	// supported check-file hash algorithms, in the order we prefer them
+	checkFileHashAlgos = []string{"sha256", "sha512", "sha384", "sha224", "sha1", "md5"}
+	// extended requests handled by SFTPGo, they are not supported by pkg/sftp
+	sftpExtendedRequests = []sftpExtension{
+		{Name: copyDataExtension, Data: "1"},
+		{Name: copyFileExtension, Data: "1"},
+		{Name: fileOperationExtension, Data: "1"},
+		{Name: fileOperationStatusExtension, Data: "1"},
+		{Name: checkFileNameExtension, Data: strings.Join(checkFileHashAlgos, ",")},
+		{Name: checkFileHandleExtension, Data: strings.Join(checkFileHashAlgos, ",")},
+	}
+)
+
+// copyDataRequest defines the "copy-data" extension as described in
+// draft-ietf-secsh-filexfer-extensions-00, section 7
+type copyDataRequest struct {
+	ReadHandle  string
+	ReadOffset  uint64
+	ReadLength  uint64
+	WriteHandle string
+	WriteOffset uint64
+}
+
+// copyFileRequest defines the "copy-file" extension as described in
+// draft-ietf-secsh-filexfer-extensions-00, section 6
+type copyFileRequest struct {
+	Source      string
+	Destination string
+	Overwrite   bool
+}
+
+// fileOperationRequest defines the "file-operation@sftpgo.com" extension.
+// Type is one of the supported background file operations: copy, move,
+// delete, extract. Target is ignored for delete
+type fileOperationRequest struct {
+	Type   string
+	Source string
+	Target string
+}
+
+// fileOperationReply is the reply for the "file-operation@sftpgo.com"
+// extension
+type fileOperationReply struct {
+	ID string
+}
+
+// fileOperationStatusRequest defines the "file-operation-status@sftpgo.com"
+// extension
+type fileOperationStatusRequest struct {
+	ID string
+}
+
+// fileOperationStatusReply is the reply for the
+// "file-operation-status@sftpgo.com" extension
+type fileOperationStatusReply struct {
+	Status string
+	Files  uint64
+	Size   uint64
+	Error  string
+}
+
+// checkFileRequest defines the "check-file-name" and "check-file-handle"
+// extensions as described in draft-ietf-secsh-filexfer-extensions-00,
+// section 3. Name is a path for "check-file-name" and an open handle for
+// "check-file-handle", a zero length means up to the end of the file, a zero
+// block size means a single hash for the whole range
+type checkFileRequest struct {
+	Name        string
+	HashAlgos   string
+	StartOffset uint64
+	Length      uint64
+	BlockSize   uint32
+}
+
+// checkFileReply is the reply for the check-file extensions, Hash is the
+// concatenation of the hashes of each block
+type checkFileReply struct {
+	Type     string
+	HashAlgo string
+	Hash     []byte `ssh:"rest"`
+}
+
+// ExtendedCmd handles the SFTP extended requests not supported by pkg/sftp
+func (c *Connection) ExtendedCmd(request *extendedRequest) ([]byte, error) {
+	c.UpdateLastActivity()
+
+	switch request.Name {
+	case copyDataExtension:
+		return nil, c.handleSFTPCopyData(request)
+	case copyFileExtension:
+		return nil, c.handleSFTPCopyFile(request)
+	case fileOperationExtension:
+		return c.handleSFTPFileOperation(request)
+	case fileOperationStatusExtension:
+		return c.handleSFTPFileOperationStatus(request)
+	case checkFileNameExtension, checkFileHandleExtension:
+		return c.handleSFTPCheckFile(request)
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+// handleSFTPCopyData copies data between two open handles. Both handles are
+// SFTPGo transfers so quotas, bandwidth limits and the transfer actions are
+// honored as for a client side copy
+func (c *Connection) handleSFTPCopyData(request *extendedRequest) error {
+	var req copyDataRequest
+	if err := ssh.Unmarshal(request.Data, &req); err != nil {
+		return sftp.ErrSSHFxBadMessage
+	}
+	src, ok := request.GetOpenHandle(req.ReadHandle)
+	if !ok || src.ReaderAt == nil {
+		return fmt.Errorf("%w: invalid read handle", sftp.ErrSSHFxFailure)
+	}
+	dst, ok := request.GetOpenHandle(req.WriteHandle)
+	if !ok || dst.WriterAt == nil {
+		return fmt.Errorf("%w: invalid write handle", sftp.ErrSSHFxFailure)
+	}
+	if req.ReadHandle == req.WriteHandle && req.WriteOffset >= req.ReadOffset &&
+		(req.ReadLength == 0 || req.WriteOffset < req.ReadOffset+req.ReadLength) {
+		return fmt.Errorf("%w: overlapping copy ranges", sftp.ErrSSHFxFailure)
+	}
+	c.Log(logger.LevelDebug, "copy data from %q offset %d length %d to %q offset %d", src.Filepath,
+		req.ReadOffset, req.ReadLength, dst.Filepath, req.WriteOffset)
+
+	readOffset := int64(req.ReadOffset)
+	writeOffset := int64(req.WriteOffset)
+	remaining := int64(req.ReadLength)
+	buffer, err := c.GetTransferBuffer()
+	if err != nil {
+		return c.GetGenericError(err)
+	}
+	defer buffer.Release()
+
+	buf := buffer.Buf
+	for {
+		chunk := buf
+		if req.ReadLength > 0 {
+			if remaining <= 0 {
+				return nil
+			}
+			if remaining < int64(len(chunk)) {
+				chunk = chunk[:remaining]
+			}
+		}
+		nr, errRead := src.ReaderAt.ReadAt(chunk, readOffset)
+		if nr > 0 {
+			nw, errWrite := dst.WriterAt.WriteAt(chunk[:nr], writeOffset)
+			if errWrite != nil {
+				return errWrite
+			}
+			if nw != nr {
+				return fmt.Errorf("%w: %v", sftp.ErrSSHFxFailure, io.ErrShortWrite)
+			}
+			readOffset += int64(nr)
+			writeOffset += int64(nw)
+			remaining -= int64(nr)
+		}
+		if errRead == io.EOF {
+			return nil
+		}
+		if errRead != nil {
+			return errRead
+		}
+	}
+}
+
+// handleSFTPCopyFile copies a single file using the server side copy
+// implementation also used by the sftpgo-copy SSH command
+func (c *Connection) handleSFTPCopyFile(request *extendedRequest) error {
+	var req copyFileRequest
+	if err := ssh.Unmarshal(request.Data, &req); err != nil {
+		return sftp.ErrSSHFxBadMessage
+	}
+	source := request.CleanPath(req.Source)
+	target := request.CleanPath(req.Destination)
+
+	srcInfo, err := c.DoStat(source, 1, false)
+	if err != nil {
+		return err
+	}
+	if !srcInfo.Mode().IsRegular() {
+		return fmt.Errorf("copy-file source %q is not a regular file: %w", source, c.GetOpUnsupportedError())
+	}
+	dstInfo, err := c.DoStat(target, 1, false)
+	if err == nil {
+		if dstInfo.IsDir() {
+			return fmt.Errorf("copy-file target %q is a directory: %w", target, c.GetOpUnsupportedError())
+		}
+		if !req.Overwrite {
+			return fmt.Errorf("%w: copy-file target %q already exists", sftp.ErrSSHFxFailure, target)
+		}
+	} else if !c.IsNotExistError(err) {
+		return err
+	}
+
+	return c.Copy(source, target)
+}
+
+// handleSFTPFileOperation starts a background file operation and returns its ID
+func (c *Connection) handleSFTPFileOperation(request *extendedRequest) ([]byte, error) {
+	var req fileOperationRequest
+	if err := ssh.Unmarshal(request.Data, &req); err != nil {
+		return nil, sftp.ErrSSHFxBadMessage
+	}
+	source := request.CleanPath(req.Source)
+	target := ""
+	if req.Target != "" {
+		target = request.CleanPath(req.Target)
+	}
+	if req.Type == common.FileOperationCopy {
+		// preserve the same semantic of the synchronous copy
+		if strings.HasSuffix(req.Source, "/") && source != "/" {
+			source += "/"
+		}
+		if strings.HasSuffix(req.Target, "/") && target != "/" {
+			target += "/"
+		}
+	}
+	op, err := common.FileOperations.Start(c.BaseConnection, req.Type, source, target)
+	if err != nil {
+		c.Log(logger.LevelInfo, "unable to start %s operation, source %q target %q: %v", req.Type, source, target, err)
+		return nil, fmt.Errorf("%w: %v", sftp.ErrSSHFxFailure, err)
+	}
+	return ssh.Marshal(&fileOperationReply{ID: op.ID}), nil
+}
+
+// handleSFTPFileOperationStatus returns the status of a background file operation
+func (c *Connection) handleSFTPFileOperationStatus(request *extendedRequest) ([]byte, error) {
+	var req fileOperationStatusRequest
+	if err := ssh.Unmarshal(request.Data, &req); err != nil {
+		return nil, sftp.ErrSSHFxBadMessage
+	}
+	op, err := common.FileOperations.Get(c.User.Username, req.ID)
+	if err != nil {
+		return nil, c.GetNotExistError()
+	}
+	return ssh.Marshal(&fileOperationStatusReply{
+		Status: op.Status,
+		Files:  uint64(op.Files),
+		Size:   uint64(op.Size),
+		Error:  op.Error,
+	}), nil
+}
+
+// handleSFTPCheckFile computes the hash for a file or an open handle. For a
+// single SHA-256 hash of the whole file, the checksum stored while uploading
+// is returned without reading the file
+func (c *Connection) handleSFTPCheckFile(request *extendedRequest) ([]byte, error) {
+	var req checkFileRequest
+	if err := ssh.Unmarshal(request.Data, &req); err != nil {
+		return nil, sftp.ErrSSHFxBadMessage
+	}
+	algo, newHash := getCheckFileHash(req.HashAlgos)
+	if newHash == nil {
+		return nil, fmt.Errorf("%w: unsupported hash algorithms %q", sftp.ErrSSHFxOpUnsupported, req.HashAlgos)
+	}
+	if req.BlockSize != 0 && req.BlockSize < checkFileMinBlockSize {
+		return nil, fmt.Errorf("%w: invalid block size %d", sftp.ErrSSHFxFailure, req.BlockSize)
+	}
+	if req.StartOffset > math.MaxInt64 || req.Length > math.MaxInt64 {
+		return nil, sftp.ErrSSHFxBadMessage
+	}
+	var sum []byte
+	var err error
+	if request.Name == checkFileHandleExtension {
+		handle, ok := request.GetOpenHandle(req.Name)
+		if !ok || handle.ReaderAt == nil {
+			return nil, fmt.Errorf("%w: invalid handle", sftp.ErrSSHFxFailure)
+		}
+		length := int64(req.Length)
+		if length == 0 {
+			length = math.MaxInt64 - int64(req.StartOffset)
+		}
+		sum, err = computeCheckFileHash(io.NewSectionReader(handle.ReaderAt, int64(req.StartOffset), length),
+			newHash, req.BlockSize)
+	} else {
+		sum, err = c.getCheckFileHashForPath(request.CleanPath(req.Name), algo, newHash, &req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ssh.Marshal(&checkFileReply{
+		Type:     "check-file",
+		HashAlgo: algo,
+		Hash:     sum,
+	}), nil
+}
+
+func (c *Connection) getCheckFileHashForPath(virtualPath, algo string, newHash func() hash.Hash,
+	req *checkFileRequest,
+) ([]byte, error) {
+	if ok, policy := c.User.IsFileAllowed(virtualPath); !ok {
+		c.Log(logger.LevelInfo, "check-file not allowed for file %q", virtualPath)
+		return nil, c.GetErrorForDeniedFile(policy)
+	}
+	fs, fsPath, err := c.GetFsAndResolvedPath(virtualPath)
+	if err != nil {
+		return nil, err
+	}
+	if !c.User.HasPerm(dataprovider.PermListItems, virtualPath) {
+		return nil, c.GetPermissionDeniedError()
+	}
+	if algo == "sha256" && req.StartOffset == 0 && req.Length == 0 && req.BlockSize == 0 {
+		if checksum := c.GetStoredChecksum(fs, fsPath, virtualPath); checksum != "" {
+			if sum, err := hex.DecodeString(checksum); err == nil {
+				return sum, nil
+			}
+		}
+	}
+	sum, err := c.computeCheckFileHashForPath(fs, fsPath, newHash, req)
+	if err != nil {
+		return nil, c.GetFsError(fs, err)
+	}
+	return sum, nil
+}
+
+func (c *Connection) computeCheckFileHashForPath(fs vfs.Fs, fsPath string, newHash func() hash.Hash,
+	req *checkFileRequest,
+) ([]byte, error) {
+	info, err := fs.Stat(fsPath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%w: %q is not a regular file", sftp.ErrSSHFxFailure, fsPath)
+	}
+	f, r, cancelFn, err := fs.Open(fsPath, int64(req.StartOffset))
+	if err != nil {
+		return nil, err
+	}
+	if cancelFn != nil {
+		defer cancelFn()
+	}
+	var reader io.ReadCloser = r
+	if f != nil {
+		reader = f
+	}
+	defer reader.Close()
+
+	if req.Length > 0 {
+		return computeCheckFileHash(io.LimitReader(reader, int64(req.Length)), newHash, req.BlockSize)
+	}
+	return computeCheckFileHash(reader, newHash, req.BlockSize)
+}
+
+// getCheckFileHash returns the first supported algorithm from the specified
+// comma separated list
+func getCheckFileHash(algos string) (string, func() hash.Hash) {
+	for _, algo := range strings.Split(algos, ",") {
+		switch strings.TrimSpace(algo) {
+		case "md5":
+			return "md5", md5.New
+		case "sha1":
+			return "sha1", sha1.New
+		case "sha224":
+			return "sha224", sha256.New224
+		case "sha256":
+			return "sha256", sha256.New
+		case "sha384":
+			return "sha384", sha512.New384
+		case "sha512":
+			return "sha512", sha512.New
+		}
+	}
+	return "", nil
+}
+
+// computeCheckFileHash reads the reader until EOF and returns a hash for each
+// block, or a single hash if blockSize is 0
+func computeCheckFileHash(reader io.Reader, newHash func() hash.Hash, blockSize uint32) ([]byte, error) {
+	if blockSize == 0 {
+		h := newHash()
+		if _, err := io.Copy(h, reader); err != nil {
+			return nil, err
+		}
+		return h.Sum(nil), nil
+	}
+	var result []byte
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 {
+			h := newHash()
+			h.Write(buf[:n]) //nolint:errcheck
+			result = h.Sum(result)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return result, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
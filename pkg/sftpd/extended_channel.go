@@ -0,0 +1,691 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package sftpd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"runtime/debug"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// SFTP packet types, see draft-ietf-secsh-filexfer-02
+const (
+	sftpPacketInit          = 1
+	sftpPacketVersion       = 2
+	sftpPacketOpen          = 3
+	sftpPacketClose         = 4
+	sftpPacketRead          = 5
+	sftpPacketWrite         = 6
+	sftpPacketStatus        = 101
+	sftpPacketHandle        = 102
+	sftpPacketData          = 103
+	sftpPacketExtended      = 200
+	sftpPacketExtendedReply = 201
+)
+
+const (
+	// SSH_FXF_READ and SSH_FXF_WRITE open flags
+	sftpOpenFlagRead  = 0x00000001
+	sftpOpenFlagWrite = 0x00000002
+	// the same packet length limit used by pkg/sftp
+	sftpMaxPacketLength = 256 * 1024
+	// the max data length for the read and write requests sent for the
+	// extended requests, pkg/sftp returns at most 32768 bytes for each read
+	sftpMaxDataLength = 32768
+)
+
+var (
+	errExtendedChannelClosed = errors.New("sftp channel closed")
+	// the same errors returned by pkg/sftp
+	errSFTPPacketTooLong  = errors.New("packet too long")
+	errSFTPPacketTooShort = errors.New("packet too short")
+	sftpStatusErrors      = []struct {
+		err  error
+		code uint32
+	}{
+		{sftp.ErrSSHFxEOF, 1},
+		{sftp.ErrSSHFxNoSuchFile, 2},
+		{sftp.ErrSSHFxPermissionDenied, 3},
+		{sftp.ErrSSHFxFailure, 4},
+		{sftp.ErrSSHFxBadMessage, 5},
+		{sftp.ErrSSHFxNoConnection, 6},
+		{sftp.ErrSSHFxConnectionLost, 7},
+		{sftp.ErrSSHFxOpUnsupported, 8},
+	}
+)
+
+// extendedCmder handles the SFTP extended requests not supported by pkg/sftp
+type extendedCmder interface {
+	// ExtendedCmd returns the data to send to the client using an
+	// SSH_FXP_EXTENDED_REPLY packet, if the returned data is nil an
+	// SSH_FXP_STATUS packet is sent
+	ExtendedCmd(request *extendedRequest) ([]byte, error)
+}
+
+// sftpExtension defines an extension advertised to the clients
+type sftpExtension struct {
+	Name string
+	Data string
+}
+
+// extendedRequest defines an extended request handled by SFTPGo
+type extendedRequest struct {
+	// Extension name, for example "copy-data"
+	Name string
+	// Request specific data following the extension name
+	Data []byte
+	// StartDirectory is the directory to use as base for relative paths
+	StartDirectory string
+	channel        *extendedChannel
+}
+
+// openHandle defines a file opened by the client
+type openHandle struct {
+	// Filepath is the path as requested by the client
+	Filepath string
+	// ReaderAt reads the file using the handle, it is nil if the file is not
+	// open for reading
+	ReaderAt io.ReaderAt
+	// WriterAt writes the file using the handle, it is nil if the file is not
+	// open for writing
+	WriterAt io.WriterAt
+}
+
+// GetOpenHandle returns the file opened by the client with the specified
+// handle. It returns false if the handle is not valid or it refers to a
+// directory
+func (r *extendedRequest) GetOpenHandle(handle string) (openHandle, bool) {
+	if r.channel == nil {
+		return openHandle{}, false
+	}
+	return r.channel.getOpenHandle(handle)
+}
+
+// CleanPath returns a clean absolute path, relative paths are resolved
+// against the start directory
+func (r *extendedRequest) CleanPath(p string) string {
+	if !path.IsAbs(p) {
+		p = path.Join(r.StartDirectory, p)
+	}
+	return util.CleanPath(p)
+}
+
+type openHandleInfo struct {
+	filepath string
+	pflags   uint32
+}
+
+// forwardedRequest is a request sent to the SFTP request server. The
+// requests originated from extended requests have a response channel
+type forwardedRequest struct {
+	clientID   uint32
+	packetType byte
+	open       openHandleInfo
+	handle     string
+	response   chan []byte
+}
+
+// extendedChannel sits between the SSH channel and the pkg/sftp request
+// server. It handles the extended requests the request server does not
+// support, advertises them in the version packet and tracks the files opened
+// by the client. The extended requests can read and write these files using
+// their handles, the read and write requests are sent to the request server
+// like the client ones, so the same transfers are used. The request IDs are
+// remapped to avoid conflicts between the client requests and ours
+type extendedChannel struct {
+	channel        io.ReadWriteCloser
+	handler        extendedCmder
+	extensions     []sftpExtension
+	startDirectory string
+	connectionID   string
+	incoming       chan []byte
+	pending        []byte
+	readDone       chan struct{}
+	readErr        error
+	done           chan struct{}
+	closeOnce      sync.Once
+	writeMu        sync.Mutex
+	outgoing       []byte
+	mu             sync.Mutex
+	nextID         uint32
+	requests       map[uint32]*forwardedRequest
+	handles        map[string]openHandleInfo
+}
+
+func newExtendedChannel(channel io.ReadWriteCloser, handler extendedCmder, extensions []sftpExtension,
+	startDirectory, connectionID string,
+) *extendedChannel {
+	if startDirectory == "" {
+		startDirectory = "/"
+	}
+	c := &extendedChannel{
+		channel:        channel,
+		handler:        handler,
+		extensions:     extensions,
+		startDirectory: startDirectory,
+		connectionID:   connectionID,
+		incoming:       make(chan []byte),
+		readDone:       make(chan struct{}),
+		done:           make(chan struct{}),
+		requests:       make(map[uint32]*forwardedRequest),
+		handles:        make(map[string]openHandleInfo),
+	}
+	go c.readPackets()
+	return c
+}
+
+// Read returns the packets for the request server
+func (c *extendedChannel) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		select {
+		case pkt := <-c.incoming:
+			c.pending = pkt
+		case <-c.readDone:
+			return 0, c.readErr
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write receives the packets sent by the request server. pkg/sftp
+// serializes the writes but it can write a packet using multiple calls
+func (c *extendedChannel) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.outgoing = append(c.outgoing, p...)
+	for len(c.outgoing) >= 4 {
+		length := int(binary.BigEndian.Uint32(c.outgoing))
+		if len(c.outgoing) < length+4 {
+			break
+		}
+		pkt := c.outgoing[:length+4]
+		c.outgoing = c.outgoing[length+4:]
+		if err := c.handleResponse(pkt); err != nil {
+			return 0, err
+		}
+	}
+	if len(c.outgoing) == 0 {
+		c.outgoing = nil
+	}
+	return len(p), nil
+}
+
+// Close closes the channel and aborts the pending extended requests
+func (c *extendedChannel) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return c.channel.Close()
+}
+
+func (c *extendedChannel) readPackets() {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error(logSender, c.connectionID, "panic while reading SFTP packets: %q stack trace: %v", r,
+				string(debug.Stack()))
+			c.readErr = fmt.Errorf("unable to read SFTP packets: %v", r)
+		}
+		close(c.readDone)
+	}()
+
+	for {
+		pkt, err := readSFTPPacket(c.channel)
+		if err != nil {
+			c.readErr = err
+			return
+		}
+		if len(pkt) < 5 || pkt[4] == sftpPacketInit {
+			// the request server will handle invalid packets
+			if !c.sendToServer(pkt) {
+				c.readErr = io.EOF
+				return
+			}
+			continue
+		}
+		if pkt[4] == sftpPacketExtended {
+			if id, name, data, ok := parseExtendedPacket(pkt); ok && c.isExtensionSupported(name) {
+				go c.handleExtended(id, name, data)
+				continue
+			}
+		}
+		if !c.forward(pkt) {
+			c.readErr = io.EOF
+			return
+		}
+	}
+}
+
+func (c *extendedChannel) sendToServer(pkt []byte) bool {
+	select {
+	case c.incoming <- pkt:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// forward sends a client request to the request server using a new ID
+func (c *extendedChannel) forward(pkt []byte) bool {
+	if len(pkt) < 9 {
+		return c.sendToServer(pkt)
+	}
+	req := &forwardedRequest{
+		clientID:   binary.BigEndian.Uint32(pkt[5:]),
+		packetType: pkt[4],
+	}
+	switch req.packetType {
+	case sftpPacketOpen:
+		var open struct {
+			Filename string
+			Pflags   uint32
+			Rest     []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(pkt[9:], &open); err == nil {
+			req.open = openHandleInfo{
+				filepath: open.Filename,
+				pflags:   open.Pflags,
+			}
+		}
+	case sftpPacketClose:
+		var closeReq struct {
+			Handle string
+			Rest   []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(pkt[9:], &closeReq); err == nil {
+			req.handle = closeReq.Handle
+		}
+	}
+	c.setRequestID(pkt, req)
+	return c.sendToServer(pkt)
+}
+
+func (c *extendedChannel) setRequestID(pkt []byte, req *forwardedRequest) uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		c.nextID++
+		if _, ok := c.requests[c.nextID]; !ok {
+			break
+		}
+	}
+	c.requests[c.nextID] = req
+	binary.BigEndian.PutUint32(pkt[5:], c.nextID)
+	return c.nextID
+}
+
+func (c *extendedChannel) handleResponse(pkt []byte) error {
+	if len(pkt) < 9 {
+		return c.writeToClient(pkt)
+	}
+	if pkt[4] == sftpPacketVersion {
+		return c.writeToClient(c.addExtensions(pkt))
+	}
+	id := binary.BigEndian.Uint32(pkt[5:])
+	c.mu.Lock()
+	req, ok := c.requests[id]
+	if ok {
+		delete(c.requests, id)
+		switch {
+		case req.response != nil:
+		case req.packetType == sftpPacketOpen && pkt[4] == sftpPacketHandle:
+			var handle struct {
+				Handle string
+			}
+			if err := ssh.Unmarshal(pkt[9:], &handle); err == nil {
+				c.handles[handle.Handle] = req.open
+			}
+		case req.packetType == sftpPacketClose:
+			delete(c.handles, req.handle)
+		}
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return c.writeToClient(pkt)
+	}
+	if req.response != nil {
+		req.response <- append([]byte(nil), pkt...)
+		return nil
+	}
+	binary.BigEndian.PutUint32(pkt[5:], req.clientID)
+	return c.writeToClient(pkt)
+}
+
+// addExtensions adds the supported extended requests to the version packet
+func (c *extendedChannel) addExtensions(pkt []byte) []byte {
+	result := make([]byte, 0, len(pkt)+64)
+	result = append(result, pkt...)
+	for _, ext := range c.extensions {
+		result = appendSFTPString(result, ext.Name)
+		result = appendSFTPString(result, ext.Data)
+	}
+	binary.BigEndian.PutUint32(result, uint32(len(result)-4))
+	return result
+}
+
+func (c *extendedChannel) writeToClient(pkt []byte) error {
+	_, err := c.channel.Write(pkt)
+	return err
+}
+
+func (c *extendedChannel) isExtensionSupported(name string) bool {
+	for _, ext := range c.extensions {
+		if ext.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *extendedChannel) handleExtended(id uint32, name string, data []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error(logSender, c.connectionID, "panic while handling the extended request %q: %v", name, r)
+			c.sendStatus(id, sftp.ErrSSHFxFailure) //nolint:errcheck
+		}
+	}()
+
+	reply, err := c.handler.ExtendedCmd(&extendedRequest{
+		Name:           name,
+		Data:           data,
+		StartDirectory: c.startDirectory,
+		channel:        c,
+	})
+	if err != nil || reply == nil {
+		err = c.sendStatus(id, err)
+	} else {
+		err = c.sendExtendedReply(id, reply)
+	}
+	if err != nil {
+		logger.Debug(logSender, c.connectionID, "unable to send the response for the extended request %q: %v",
+			name, err)
+	}
+}
+
+func (c *extendedChannel) sendStatus(id uint32, err error) error {
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
+	pkt := []byte{0, 0, 0, 0, sftpPacketStatus}
+	pkt = binary.BigEndian.AppendUint32(pkt, id)
+	pkt = binary.BigEndian.AppendUint32(pkt, getSFTPStatusCode(err))
+	pkt = appendSFTPString(pkt, msg)
+	pkt = appendSFTPString(pkt, "")
+	return c.sendPacketToClient(pkt)
+}
+
+func (c *extendedChannel) sendExtendedReply(id uint32, data []byte) error {
+	pkt := []byte{0, 0, 0, 0, sftpPacketExtendedReply}
+	pkt = binary.BigEndian.AppendUint32(pkt, id)
+	pkt = append(pkt, data...)
+	return c.sendPacketToClient(pkt)
+}
+
+func (c *extendedChannel) sendPacketToClient(pkt []byte) error {
+	binary.BigEndian.PutUint32(pkt, uint32(len(pkt)-4))
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return c.writeToClient(pkt)
+}
+
+// sendRequest sends a request to the request server and waits for its
+// response. The payload is the packet content after the request ID
+func (c *extendedChannel) sendRequest(packetType byte, payload []byte) ([]byte, error) {
+	pkt := make([]byte, 9, 9+len(payload))
+	pkt[4] = packetType
+	pkt = append(pkt, payload...)
+	binary.BigEndian.PutUint32(pkt, uint32(len(pkt)-4))
+	req := &forwardedRequest{
+		packetType: packetType,
+		response:   make(chan []byte, 1),
+	}
+	id := c.setRequestID(pkt, req)
+
+	select {
+	case c.incoming <- pkt:
+	case <-c.readDone:
+		c.removeRequest(id)
+		return nil, errExtendedChannelClosed
+	case <-c.done:
+		c.removeRequest(id)
+		return nil, errExtendedChannelClosed
+	}
+	select {
+	case resp := <-req.response:
+		return resp, nil
+	case <-c.done:
+		c.removeRequest(id)
+		return nil, errExtendedChannelClosed
+	}
+}
+
+func (c *extendedChannel) removeRequest(id uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.requests, id)
+}
+
+func (c *extendedChannel) getOpenHandle(handle string) (openHandle, bool) {
+	c.mu.Lock()
+	info, ok := c.handles[handle]
+	c.mu.Unlock()
+
+	if !ok {
+		return openHandle{}, false
+	}
+	result := openHandle{
+		Filepath: info.filepath,
+	}
+	h := &handleReaderWriter{
+		channel: c,
+		handle:  handle,
+	}
+	if info.pflags&sftpOpenFlagRead != 0 {
+		result.ReaderAt = h
+	}
+	if info.pflags&sftpOpenFlagWrite != 0 {
+		result.WriterAt = h
+	}
+	if result.ReaderAt == nil && result.WriterAt == nil {
+		return openHandle{}, false
+	}
+	return result, true
+}
+
+// handleReaderWriter reads and writes a file opened by the client using
+// read and write requests
+type handleReaderWriter struct {
+	channel *extendedChannel
+	handle  string
+}
+
+func (h *handleReaderWriter) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) {
+		length := len(p) - n
+		if length > sftpMaxDataLength {
+			length = sftpMaxDataLength
+		}
+		payload := appendSFTPString(nil, h.handle)
+		payload = binary.BigEndian.AppendUint64(payload, uint64(off+int64(n)))
+		payload = binary.BigEndian.AppendUint32(payload, uint32(length))
+		resp, err := h.channel.sendRequest(sftpPacketRead, payload)
+		if err != nil {
+			return n, err
+		}
+		if resp[4] != sftpPacketData {
+			if err := getSFTPStatusError(resp); err != nil {
+				return n, err
+			}
+			return n, fmt.Errorf("%w: unexpected response type %d", sftp.ErrSSHFxFailure, resp[4])
+		}
+		var data struct {
+			Data string
+		}
+		if err := ssh.Unmarshal(resp[9:], &data); err != nil {
+			return n, sftp.ErrSSHFxBadMessage
+		}
+		if len(data.Data) == 0 {
+			return n, io.EOF
+		}
+		n += copy(p[n:], data.Data)
+	}
+	return n, nil
+}
+
+func (h *handleReaderWriter) WriteAt(p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) {
+		length := len(p) - n
+		if length > sftpMaxDataLength {
+			length = sftpMaxDataLength
+		}
+		payload := appendSFTPString(nil, h.handle)
+		payload = binary.BigEndian.AppendUint64(payload, uint64(off+int64(n)))
+		payload = appendSFTPString(payload, string(p[n:n+length]))
+		resp, err := h.channel.sendRequest(sftpPacketWrite, payload)
+		if err != nil {
+			return n, err
+		}
+		if err := getSFTPStatusError(resp); err != nil {
+			return n, err
+		}
+		n += length
+	}
+	return n, nil
+}
+
+func readSFTPPacket(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length > sftpMaxPacketLength {
+		return nil, errSFTPPacketTooLong
+	}
+	if length == 0 {
+		return nil, errSFTPPacketTooShort
+	}
+	pkt := make([]byte, length+4)
+	copy(pkt, header[:])
+	if _, err := io.ReadFull(r, pkt[4:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return pkt, nil
+}
+
+func parseExtendedPacket(pkt []byte) (uint32, string, []byte, bool) {
+	var req struct {
+		ID   uint32
+		Name string
+		Data []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(pkt[5:], &req); err != nil {
+		return 0, "", nil, false
+	}
+	return req.ID, req.Name, req.Data, true
+}
+
+// getSFTPStatusError returns the error for an SSH_FXP_STATUS packet, nil
+// means SSH_FX_OK
+func getSFTPStatusError(pkt []byte) error {
+	if pkt[4] != sftpPacketStatus {
+		return fmt.Errorf("%w: unexpected response type %d", sftp.ErrSSHFxFailure, pkt[4])
+	}
+	var status struct {
+		Code uint32
+		Msg  string
+		Rest []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(pkt[9:], &status); err != nil {
+		return sftp.ErrSSHFxBadMessage
+	}
+	var err error
+	switch status.Code {
+	case 0:
+		return nil
+	case 1:
+		return io.EOF
+	case 2:
+		err = sftp.ErrSSHFxNoSuchFile
+	case 3:
+		err = sftp.ErrSSHFxPermissionDenied
+	case 5:
+		err = sftp.ErrSSHFxBadMessage
+	case 8:
+		err = sftp.ErrSSHFxOpUnsupported
+	default:
+		err = sftp.ErrSSHFxFailure
+	}
+	if status.Msg != "" {
+		return fmt.Errorf("%w: %v", err, status.Msg)
+	}
+	return err
+}
+
+// getSFTPStatusCode returns the SSH_FXP_STATUS code for the specified error,
+// it follows the same logic as pkg/sftp
+func getSFTPStatusCode(err error) uint32 {
+	if err == nil {
+		return 0
+	}
+	if errors.Is(err, io.EOF) {
+		return 1
+	}
+	if os.IsNotExist(err) {
+		return 2
+	}
+	var statusErr *sftp.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code
+	}
+	for _, status := range sftpStatusErrors {
+		if errors.Is(err, status.err) {
+			return status.code
+		}
+	}
+	if os.IsPermission(err) {
+		return 3
+	}
+	return 4
+}
+
+func appendSFTPString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
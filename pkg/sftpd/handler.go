@@ -134,9 +134,9 @@ func (c *Connection) handleFilewrite(request *sftp.Request) (sftp.WriterAtReader
 		return nil, err
 	}
 
-	filePath := p
-	if common.Config.IsAtomicUploadEnabled() && fs.IsAtomicUploadSupported() {
-		filePath = fs.GetAtomicUploadPath(p)
+	filePath, err := c.GetUploadFsPath(fs, p, request.Filepath)
+	if err != nil {
+		return nil, err
 	}
 
 	var errForRead error
@@ -174,6 +174,15 @@ func (c *Connection) handleFilewrite(request *sftp.Request) (sftp.WriterAtReader
 		return nil, sftp.ErrSSHFxPermissionDenied
 	}
 
+	if err := c.CheckWORMProtection(request.Filepath, stat); err != nil {
+		return nil, err
+	}
+
+	if c.IsStagedUpload(request.Filepath) {
+		// the existing file is replaced when the staged upload is published
+		return c.handleSFTPUploadToNewFile(fs, request.Pflags(), p, filePath, request.Filepath, errForRead)
+	}
+
 	return c.handleSFTPUploadToExistingFile(fs, request.Pflags(), p, filePath, stat.Size(), request.Filepath, errForRead)
 }
 
@@ -216,16 +225,16 @@ func (c *Connection) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
 
 	switch request.Method {
 	case "List":
-		files, err := c.ListDir(request.Filepath)
+		lister, err := c.GetDirLister(request.Filepath)
 		if err != nil {
 			return nil, err
 		}
 		modTime := time.Unix(0, 0)
 		if request.Filepath != "/" || c.folderPrefix != "" {
-			files = util.PrependFileInfo(files, vfs.NewFileInfo("..", true, 0, modTime, false))
+			lister.Prepend(vfs.NewFileInfo("..", true, 0, modTime, false))
 		}
-		files = util.PrependFileInfo(files, vfs.NewFileInfo(".", true, 0, modTime, false))
-		return listerAt(files), nil
+		lister.Prepend(vfs.NewFileInfo(".", true, 0, modTime, false))
+		return lister, nil
 	case "Stat":
 		if !c.User.HasPerm(dataprovider.PermListItems, path.Dir(request.Filepath)) {
 			return nil, sftp.ErrSSHFxPermissionDenied
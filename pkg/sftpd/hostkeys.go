@@ -0,0 +1,425 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package sftpd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	hostKeysNotificationRequest = "hostkeys-00@openssh.com"
+	hostKeysProveRequest        = "hostkeys-prove-00@openssh.com"
+)
+
+var hostKeysManagers hostKeysRegistry
+
+// hostKeysRegistry tracks the initialized host keys managers, one for each
+// configured SFTP service
+type hostKeysRegistry struct {
+	mu       sync.Mutex
+	managers []*hostKeysManager
+}
+
+func (r *hostKeysRegistry) add(m *hostKeysManager) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.managers = append(r.managers, m)
+}
+
+func (r *hostKeysRegistry) reload() error {
+	r.mu.Lock()
+	managers := r.managers
+	r.mu.Unlock()
+
+	for _, m := range managers {
+		if err := m.reload(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type managedHostKey struct {
+	key        dataprovider.SSHHostKey
+	signer     ssh.Signer
+	certSigner ssh.Signer
+}
+
+func (k *managedHostKey) getSigner(isCert bool) ssh.Signer {
+	if isCert {
+		return k.certSigner
+	}
+	return k.signer
+}
+
+// hostKeysManager handles the host keys stored in the data provider.
+// For each key type a single signer is added to the server configuration,
+// it delegates to the active managed key, if any, or to the key loaded from
+// file so keys can be added and rotated without restarting
+type hostKeysManager struct {
+	mu          sync.RWMutex
+	keys        []managedHostKey
+	fileSigners []ssh.Signer
+	// signers used, by key type, if there is no active managed key
+	registered    map[string]ssh.Signer
+	getAlgorithms func(string) []string
+}
+
+func newHostKeysManager(getAlgorithms func(string) []string) *hostKeysManager {
+	return &hostKeysManager{
+		registered:    make(map[string]ssh.Signer),
+		getAlgorithms: getAlgorithms,
+	}
+}
+
+func (m *hostKeysManager) hasKeys() bool {
+	if m == nil {
+		return false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.keys) > 0
+}
+
+func (m *hostKeysManager) load() ([]managedHostKey, error) {
+	configs, err := dataprovider.GetConfigs()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load host keys from provider: %w", err)
+	}
+	configs.SetNilsToEmpty()
+	if err := configs.SFTPD.TryDecrypt(); err != nil {
+		return nil, err
+	}
+	var keys []managedHostKey
+	for _, k := range configs.SFTPD.HostKeys {
+		private, certSigner, err := k.GetSigner()
+		if err != nil {
+			logger.Warn(logSender, "", "unable to load managed host key %q: %v", k.ID, err)
+			continue
+		}
+		algos := m.getAlgorithms(private.PublicKey().Type())
+		signer, err := ssh.NewSignerWithAlgorithms(private.(ssh.AlgorithmSigner), algos)
+		if err != nil {
+			logger.Warn(logSender, "", "could not create signer for managed host key %q with algorithms %+v: %v",
+				k.ID, algos, err)
+			continue
+		}
+		if certSigner != nil {
+			certSigner, err = ssh.NewCertSigner(certSigner.PublicKey().(*ssh.Certificate), signer)
+			if err != nil {
+				logger.Warn(logSender, "", "unable to load the certificate for managed host key %q: %v", k.ID, err)
+				certSigner = nil
+			}
+		}
+		k.PrivateKey = nil
+		keys = append(keys, managedHostKey{
+			key:        k,
+			signer:     signer,
+			certSigner: certSigner,
+		})
+		logger.Info(logSender, "", "Managed host key %q loaded, type %q, fingerprint %q, status %q", k.ID,
+			signer.PublicKey().Type(), ssh.FingerprintSHA256(signer.PublicKey()), k.GetStatus(time.Now()))
+	}
+	return keys, nil
+}
+
+// init loads the managed host keys and adds them to the server configuration
+func (m *hostKeysManager) init(serverConfig *ssh.ServerConfig, fileSigners []ssh.Signer) ([]HostKey, error) {
+	keys, err := m.load()
+	if err != nil {
+		return nil, err
+	}
+	var result []HostKey
+	var signers []*managedHostKeySigner
+
+	m.mu.Lock()
+	m.keys = keys
+	m.fileSigners = fileSigners
+	for _, s := range fileSigners {
+		keyType := s.PublicKey().Type()
+		if _, ok := m.registered[keyType]; !ok {
+			signers = append(signers, &managedHostKeySigner{manager: m, keyType: keyType})
+		}
+		m.registered[keyType] = s
+	}
+	for idx := range keys {
+		k := &keys[idx]
+		for _, s := range []ssh.Signer{k.signer, k.certSigner} {
+			if s == nil {
+				continue
+			}
+			keyType := s.PublicKey().Type()
+			if _, ok := m.registered[keyType]; !ok {
+				m.registered[keyType] = s
+				signers = append(signers, &managedHostKeySigner{
+					manager: m,
+					keyType: keyType,
+					isCert:  s == k.certSigner,
+				})
+			}
+			var algos []string
+			if mas, ok := s.(ssh.MultiAlgorithmSigner); ok {
+				algos = mas.Algorithms()
+			}
+			result = append(result, HostKey{
+				Path:        fmt.Sprintf("managed:%s", k.key.ID),
+				Fingerprint: ssh.FingerprintSHA256(s.PublicKey()),
+				Algorithms:  algos,
+			})
+		}
+	}
+	m.mu.Unlock()
+
+	// the signers delegate to the manager so they must be added without
+	// holding the lock
+	for _, s := range signers {
+		serverConfig.AddHostKey(s)
+	}
+	hostKeysManagers.add(m)
+	return result, nil
+}
+
+func (m *hostKeysManager) reload() error {
+	keys, err := m.load()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for idx := range keys {
+		for _, s := range []ssh.Signer{keys[idx].signer, keys[idx].certSigner} {
+			if s == nil {
+				continue
+			}
+			if _, ok := m.registered[s.PublicKey().Type()]; !ok {
+				logger.Warn(logSender, "", "managed host key %q of type %q will be used after a service restart",
+					keys[idx].key.ID, s.PublicKey().Type())
+			}
+		}
+	}
+	m.keys = keys
+	return nil
+}
+
+// getSigner returns the signer to use for the specified key type
+func (m *hostKeysManager) getSigner(keyType string, isCert bool) ssh.Signer {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	var result *managedHostKey
+	for idx := range m.keys {
+		k := &m.keys[idx]
+		s := k.getSigner(isCert)
+		if s == nil || s.PublicKey().Type() != keyType || k.key.GetStatus(now) != dataprovider.SSHHostKeyStatusActive {
+			continue
+		}
+		if result == nil || k.key.ActivateAt > result.key.ActivateAt ||
+			(k.key.ActivateAt == result.key.ActivateAt && k.key.CreatedAt > result.key.CreatedAt) {
+			result = k
+		}
+	}
+	if result != nil {
+		return result.getSigner(isCert)
+	}
+	return m.registered[keyType]
+}
+
+// getAdvertisedSigners returns the signers for the host keys to notify to
+// the clients: the not retired managed keys and the file based keys not
+// replaced by an active managed key of the same type
+func (m *hostKeysManager) getAdvertisedSigners() []ssh.Signer {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var result []ssh.Signer
+	now := time.Now()
+	activeTypes := make(map[string]bool)
+	for idx := range m.keys {
+		switch m.keys[idx].key.GetStatus(now) {
+		case dataprovider.SSHHostKeyStatusActive:
+			activeTypes[m.keys[idx].signer.PublicKey().Type()] = true
+			result = append(result, m.keys[idx].signer)
+		case dataprovider.SSHHostKeyStatusPending:
+			result = append(result, m.keys[idx].signer)
+		}
+	}
+	for _, s := range m.fileSigners {
+		if !activeTypes[s.PublicKey().Type()] {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// notifyHostKeys sends the host keys to the clients supporting the OpenSSH
+// host keys update extension, so they can learn the keys that will replace
+// the current ones
+func (m *hostKeysManager) notifyHostKeys(conn ssh.Conn) {
+	if !m.hasKeys() {
+		return
+	}
+	var payload []byte
+	for _, s := range m.getAdvertisedSigners() {
+		payload = appendSSHString(payload, s.PublicKey().Marshal())
+	}
+	if _, _, err := conn.SendRequest(hostKeysNotificationRequest, false, payload); err != nil {
+		logger.Debug(logSender, "", "unable to send host keys notification: %v", err)
+	}
+}
+
+// proveHostKeys returns the signatures proving the ownership of the
+// requested host keys
+func (m *hostKeysManager) proveHostKeys(sessionID, payload []byte) ([]byte, error) {
+	signers := m.getAdvertisedSigners()
+	var result []byte
+	for len(payload) > 0 {
+		var blob []byte
+		var err error
+		blob, payload, err = parseSSHString(payload)
+		if err != nil {
+			return nil, err
+		}
+		var signer ssh.Signer
+		for _, s := range signers {
+			if bytes.Equal(s.PublicKey().Marshal(), blob) {
+				signer = s
+				break
+			}
+		}
+		if signer == nil {
+			return nil, errors.New("requested host key not found")
+		}
+		data := ssh.Marshal(struct {
+			Request   string
+			SessionID []byte
+			Key       []byte
+		}{
+			Request:   hostKeysProveRequest,
+			SessionID: sessionID,
+			Key:       blob,
+		})
+		sig, err := signHostKeyProof(signer, data)
+		if err != nil {
+			return nil, err
+		}
+		result = appendSSHString(result, ssh.Marshal(sig))
+	}
+	return result, nil
+}
+
+func signHostKeyProof(signer ssh.Signer, data []byte) (*ssh.Signature, error) {
+	if signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		if mas, ok := signer.(ssh.MultiAlgorithmSigner); ok {
+			for _, algo := range []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256} {
+				if util.Contains(mas.Algorithms(), algo) {
+					return mas.SignWithAlgorithm(rand.Reader, data, algo)
+				}
+			}
+		}
+	}
+	return signer.Sign(rand.Reader, data)
+}
+
+func handleGlobalRequests(sconn *ssh.ServerConn, reqs <-chan *ssh.Request, m *hostKeysManager) {
+	for req := range reqs {
+		if req.Type == hostKeysProveRequest && m.hasKeys() {
+			resp, err := m.proveHostKeys(sconn.SessionID(), req.Payload)
+			if err != nil {
+				logger.Debug(logSender, "", "unable to prove host keys: %v", err)
+			}
+			req.Reply(err == nil, resp) //nolint:errcheck
+			continue
+		}
+		if req.WantReply {
+			req.Reply(false, nil) //nolint:errcheck
+		}
+	}
+}
+
+func appendSSHString(buf, s []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+func parseSSHString(in []byte) ([]byte, []byte, error) {
+	if len(in) < 4 {
+		return nil, nil, errors.New("invalid string")
+	}
+	length := binary.BigEndian.Uint32(in)
+	in = in[4:]
+	if uint32(len(in)) < length {
+		return nil, nil, errors.New("invalid string length")
+	}
+	return in[:length], in[length:], nil
+}
+
+// managedHostKeySigner is the signer added to the server configuration for
+// a managed host key type, it delegates to the active key of that type
+type managedHostKeySigner struct {
+	manager *hostKeysManager
+	keyType string
+	isCert  bool
+}
+
+func (s *managedHostKeySigner) get() ssh.Signer {
+	return s.manager.getSigner(s.keyType, s.isCert)
+}
+
+func (s *managedHostKeySigner) PublicKey() ssh.PublicKey {
+	return s.get().PublicKey()
+}
+
+func (s *managedHostKeySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.get().Sign(rand, data)
+}
+
+func (s *managedHostKeySigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	signer, ok := s.get().(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, fmt.Errorf("host key of type %q does not support algorithm %q", s.keyType, algorithm)
+	}
+	return signer.SignWithAlgorithm(rand, data, algorithm)
+}
+
+func (s *managedHostKeySigner) Algorithms() []string {
+	if signer, ok := s.get().(ssh.MultiAlgorithmSigner); ok {
+		return signer.Algorithms()
+	}
+	return []string{s.keyType}
+}
+
+// ReloadHostKeys reloads the host keys stored in the data provider.
+// Keys of types not loaded at startup are used after a service restart
+func ReloadHostKeys() error {
+	return hostKeysManagers.reload()
+}
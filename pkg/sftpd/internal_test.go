@@ -16,6 +16,7 @@ package sftpd
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -1895,6 +1896,20 @@ func TestConfigsFromProvider(t *testing.T) {
 	assert.Equal(t, expectedCiphers, c.Ciphers)
 	assert.Equal(t, expectedMACs, c.MACs)
 	assert.Equal(t, configs.SFTPD.Moduli, c.Moduli)
+	// with a security profile the additional algorithms are added to the profile ones
+	configs.SFTPD.SecurityProfile = SecurityProfileModern
+	err = dataprovider.UpdateConfigs(&configs, "", "", "")
+	assert.NoError(t, err)
+	c = Configuration{}
+	err = c.loadFromProvider()
+	assert.NoError(t, err)
+	assert.Equal(t, SecurityProfileModern, c.SecurityProfile)
+	assert.Equal(t, configs.SFTPD.KexAlgorithms, c.KexAlgorithms)
+	assert.Equal(t, configs.SFTPD.Ciphers, c.Ciphers)
+	assert.Equal(t, configs.SFTPD.MACs, c.MACs)
+	configs.SFTPD.SecurityProfile = "invalid"
+	err = dataprovider.UpdateConfigs(&configs, "", "", "")
+	assert.Error(t, err)
 
 	err = dataprovider.UpdateConfigs(nil, "", "", "")
 	assert.NoError(t, err)
@@ -1934,6 +1949,57 @@ func TestSupportedSecurityOptions(t *testing.T) {
 	assert.Equal(t, preferredKexAlgos, serverConfig.KeyExchanges)
 }
 
+func TestSecurityProfiles(t *testing.T) {
+	for _, name := range GetSecurityProfiles() {
+		profile, err := getSecurityProfile(name)
+		assert.NoError(t, err, name)
+		assert.NotEmpty(t, profile.getKexAlgos(), name)
+		assert.NotEmpty(t, profile.getCiphers(), name)
+		assert.NotEmpty(t, profile.getMACs(), name)
+	}
+	_, err := getSecurityProfile("unknown")
+	assert.Error(t, err)
+	_, err = getSecurityProfile("pq-hybrid")
+	assert.Error(t, err)
+	assert.NotContains(t, GetSecurityProfiles(), "pq-hybrid")
+	profile, err := getSecurityProfile(SecurityProfileIntermediate)
+	assert.NoError(t, err)
+	assert.Equal(t, preferredKexAlgos, profile.getKexAlgos())
+	assert.Equal(t, preferredCiphers, profile.getCiphers())
+	assert.Equal(t, preferredMACs, profile.getMACs())
+
+	c := Configuration{
+		SecurityProfile: SecurityProfileModern,
+		MACs:            []string{"hmac-sha2-256"},
+	}
+	serverConfig := &ssh.ServerConfig{}
+	err = c.configureSecurityOptions(serverConfig)
+	assert.NoError(t, err)
+	assert.NotContains(t, serverConfig.Ciphers, "aes128-ctr")
+	assert.Equal(t, []string{"hmac-sha2-512-etm@openssh.com", "hmac-sha2-256-etm@openssh.com", "hmac-sha2-256"},
+		serverConfig.MACs)
+	assert.Equal(t, SecurityProfileModern, GetStatus().SecurityProfile)
+	c.SecurityProfile = "invalid"
+	err = c.configureSecurityOptions(serverConfig)
+	assert.Error(t, err)
+	c.SecurityProfile = "pq-hybrid"
+	err = c.configureSecurityOptions(serverConfig)
+	assert.ErrorContains(t, err, "unsupported security profile")
+	serviceStatus.SecurityProfile = ""
+
+	c = Configuration{}
+	bindingConfig, err := c.getServerConfigForBinding(serverConfig, Binding{Port: 2022})
+	assert.NoError(t, err)
+	assert.Equal(t, serverConfig, bindingConfig)
+	bindingConfig, err = c.getServerConfigForBinding(serverConfig, Binding{Port: 2022, SecurityProfile: SecurityProfileLegacy})
+	assert.NoError(t, err)
+	assert.Contains(t, bindingConfig.Ciphers, "aes128-cbc")
+	assert.Contains(t, bindingConfig.MACs, "hmac-sha1")
+	assert.NotContains(t, serverConfig.Ciphers, "aes128-cbc")
+	_, err = c.getServerConfigForBinding(serverConfig, Binding{Port: 2022, SecurityProfile: "unknown"})
+	assert.Error(t, err)
+}
+
 func TestLoadModuli(t *testing.T) {
 	dhGEXSha1 := "diffie-hellman-group-exchange-sha1"
 	dhGEXSha256 := "diffie-hellman-group-exchange-sha256"
@@ -2305,3 +2371,202 @@ func TestAuthenticationErrors(t *testing.T) {
 	assert.ErrorIs(t, err, sftpAuthError)
 	assert.NotErrorIs(t, err, util.ErrNotFound)
 }
+
+func buildSFTPTestPacket(packetType byte, id uint32, fields ...any) []byte {
+	payload := []byte{packetType}
+	payload = binary.BigEndian.AppendUint32(payload, id)
+	for _, f := range fields {
+		switch v := f.(type) {
+		case string:
+			payload = binary.BigEndian.AppendUint32(payload, uint32(len(v)))
+			payload = append(payload, v...)
+		case uint32:
+			payload = binary.BigEndian.AppendUint32(payload, v)
+		case uint64:
+			payload = binary.BigEndian.AppendUint64(payload, v)
+		}
+	}
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(payload))), payload...)
+}
+
+type extendedCmdFunc func(request *extendedRequest) ([]byte, error)
+
+func (f extendedCmdFunc) ExtendedCmd(request *extendedRequest) ([]byte, error) {
+	return f(request)
+}
+
+func TestExtendedChannel(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	handler := extendedCmdFunc(func(request *extendedRequest) ([]byte, error) {
+		if request.Name == fileOperationStatusExtension {
+			return nil, fmt.Errorf("%w: invalid handle", sftp.ErrSSHFxFailure)
+		}
+		var req struct {
+			Handle string
+		}
+		if err := ssh.Unmarshal(request.Data, &req); err != nil {
+			return nil, sftp.ErrSSHFxBadMessage
+		}
+		h, ok := request.GetOpenHandle(req.Handle)
+		if !ok || h.ReaderAt == nil {
+			return nil, sftp.ErrSSHFxFailure
+		}
+		return []byte(h.Filepath), nil
+	})
+	channel := newExtendedChannel(serverConn, handler, []sftpExtension{
+		{Name: fileOperationExtension, Data: "1"},
+		{Name: fileOperationStatusExtension, Data: "1"},
+	}, "", xid.New().String())
+	defer channel.Close()
+
+	readFromServer := func() []byte {
+		pkt := make([]byte, 4)
+		_, err := io.ReadFull(channel, pkt)
+		require.NoError(t, err)
+		pkt = append(pkt, make([]byte, binary.BigEndian.Uint32(pkt))...)
+		_, err = io.ReadFull(channel, pkt[4:])
+		require.NoError(t, err)
+		return pkt
+	}
+	writeToClient := func(pkt []byte) {
+		go func() {
+			_, err := channel.Write(pkt[:5])
+			assert.NoError(t, err)
+			_, err = channel.Write(pkt[5:])
+			assert.NoError(t, err)
+		}()
+	}
+	readFromClient := func() []byte {
+		pkt, err := readSFTPPacket(clientConn)
+		require.NoError(t, err)
+		return pkt
+	}
+	// the supported extensions are added to the version packet
+	version := binary.BigEndian.AppendUint32([]byte{0, 0, 0, 5, sftpPacketVersion}, 3)
+	writeToClient(version)
+	pkt := readFromClient()
+	assert.Equal(t, byte(sftpPacketVersion), pkt[4])
+	assert.Contains(t, string(pkt), fileOperationExtension)
+	assert.Contains(t, string(pkt), fileOperationStatusExtension)
+	// the open requests are forwarded using a different ID, the returned handle is tracked
+	go func() {
+		_, err := clientConn.Write(buildSFTPTestPacket(sftpPacketOpen, 7, "/file.txt", uint32(sftpOpenFlagRead),
+			uint32(0)))
+		assert.NoError(t, err)
+	}()
+	pkt = readFromServer()
+	assert.Equal(t, byte(sftpPacketOpen), pkt[4])
+	serverID := binary.BigEndian.Uint32(pkt[5:])
+	assert.NotEqual(t, uint32(7), serverID)
+	writeToClient(buildSFTPTestPacket(sftpPacketHandle, serverID, "1"))
+	pkt = readFromClient()
+	assert.Equal(t, byte(sftpPacketHandle), pkt[4])
+	assert.Equal(t, uint32(7), binary.BigEndian.Uint32(pkt[5:]))
+	h, ok := channel.getOpenHandle("1")
+	assert.True(t, ok)
+	assert.Equal(t, "/file.txt", h.Filepath)
+	assert.NotNil(t, h.ReaderAt)
+	assert.Nil(t, h.WriterAt)
+	_, ok = channel.getOpenHandle("2")
+	assert.False(t, ok)
+	// the supported extended requests are handled without reaching the server
+	go func() {
+		_, err := clientConn.Write(buildSFTPTestPacket(sftpPacketExtended, 8, fileOperationExtension, "1"))
+		assert.NoError(t, err)
+	}()
+	pkt = readFromClient()
+	assert.Equal(t, byte(sftpPacketExtendedReply), pkt[4])
+	assert.Equal(t, uint32(8), binary.BigEndian.Uint32(pkt[5:]))
+	assert.Equal(t, "/file.txt", string(pkt[9:]))
+	go func() {
+		_, err := clientConn.Write(buildSFTPTestPacket(sftpPacketExtended, 9, fileOperationStatusExtension, "2"))
+		assert.NoError(t, err)
+	}()
+	pkt = readFromClient()
+	assert.Equal(t, byte(sftpPacketStatus), pkt[4])
+	assert.Equal(t, uint32(9), binary.BigEndian.Uint32(pkt[5:]))
+	assert.Equal(t, uint32(4), binary.BigEndian.Uint32(pkt[9:]))
+	// the unsupported ones are forwarded
+	go func() {
+		_, err := clientConn.Write(buildSFTPTestPacket(sftpPacketExtended, 10, "unknown@example.com"))
+		assert.NoError(t, err)
+	}()
+	pkt = readFromServer()
+	assert.Equal(t, byte(sftpPacketExtended), pkt[4])
+	assert.NotEqual(t, uint32(10), binary.BigEndian.Uint32(pkt[5:]))
+	// a closed handle cannot be used anymore
+	go func() {
+		_, err := clientConn.Write(buildSFTPTestPacket(sftpPacketClose, 11, "1"))
+		assert.NoError(t, err)
+	}()
+	pkt = readFromServer()
+	assert.Equal(t, byte(sftpPacketClose), pkt[4])
+	writeToClient(buildSFTPTestPacket(sftpPacketStatus, binary.BigEndian.Uint32(pkt[5:]), uint32(0), "", ""))
+	pkt = readFromClient()
+	assert.Equal(t, uint32(11), binary.BigEndian.Uint32(pkt[5:]))
+	_, ok = channel.getOpenHandle("1")
+	assert.False(t, ok)
+
+	err := clientConn.Close()
+	assert.NoError(t, err)
+	_, err = channel.Read(make([]byte, 4))
+	assert.ErrorIs(t, err, io.EOF)
+	_, err = channel.sendRequest(sftpPacketRead, nil)
+	assert.ErrorIs(t, err, errExtendedChannelClosed)
+}
+
+func TestSFTPStatusErrors(t *testing.T) {
+	assert.Equal(t, uint32(0), getSFTPStatusCode(nil))
+	assert.Equal(t, uint32(1), getSFTPStatusCode(io.EOF))
+	assert.Equal(t, uint32(2), getSFTPStatusCode(os.ErrNotExist))
+	assert.Equal(t, uint32(3), getSFTPStatusCode(fmt.Errorf("%w: denied", sftp.ErrSSHFxPermissionDenied)))
+	assert.Equal(t, uint32(3), getSFTPStatusCode(os.ErrPermission))
+	assert.Equal(t, uint32(5), getSFTPStatusCode(sftp.ErrSSHFxBadMessage))
+	assert.Equal(t, uint32(8), getSFTPStatusCode(sftp.ErrSSHFxOpUnsupported))
+	assert.Equal(t, uint32(4), getSFTPStatusCode(errors.New("generic error")))
+
+	assert.NoError(t, getSFTPStatusError(buildSFTPTestPacket(sftpPacketStatus, 1, uint32(0), "", "")))
+	assert.ErrorIs(t, getSFTPStatusError(buildSFTPTestPacket(sftpPacketStatus, 1, uint32(1), "", "")), io.EOF)
+	err := getSFTPStatusError(buildSFTPTestPacket(sftpPacketStatus, 1, uint32(3), "denied", ""))
+	assert.ErrorIs(t, err, sftp.ErrSSHFxPermissionDenied)
+	assert.Contains(t, err.Error(), "denied")
+	err = getSFTPStatusError(buildSFTPTestPacket(sftpPacketStatus, 1, uint32(7), "", ""))
+	assert.ErrorIs(t, err, sftp.ErrSSHFxFailure)
+	err = getSFTPStatusError(buildSFTPTestPacket(sftpPacketData, 1, "data"))
+	assert.ErrorIs(t, err, sftp.ErrSSHFxFailure)
+	err = getSFTPStatusError(buildSFTPTestPacket(sftpPacketStatus, 1))
+	assert.ErrorIs(t, err, sftp.ErrSSHFxBadMessage)
+}
+
+func TestSFTPPacketTracer(t *testing.T) {
+	var packets []string
+	tracer := sftpPacketTracer{
+		direction: common.DebugCaptureDirectionIn,
+		emit: func(direction string, length uint32, header []byte) {
+			packets = append(packets, direction+" "+describeSFTPPacket(length, header))
+		},
+	}
+	rename := buildSFTPTestPacket(sftpPacketRename, 7, "/src", "/dst")
+	for _, b := range rename {
+		tracer.feed([]byte{b})
+	}
+	write := buildSFTPTestPacket(sftpPacketWrite, 8, "handle", uint64(4096), string(make([]byte, 2048)))
+	extended := buildSFTPTestPacket(sftpPacketExtended, 9, "copy-data", "handle")
+	tracer.feed(append(append([]byte{0, 0, 0, 0}, write...), extended...))
+	tracer.feed(buildSFTPTestPacket(sftpPacketStatus, 10, uint32(3), "permission denied"))
+	tracer.feed(buildSFTPTestPacket(sftpPacketName, 11, uint32(1), "/home"))
+	tracer.feed(buildSFTPTestPacket(150, 12))
+	longPath := string(bytes.Repeat([]byte("a"), 2*maxCapturedPacketHeader))
+	tracer.feed(buildSFTPTestPacket(sftpPacketOpen, 13, longPath, uint32(1)))
+
+	require.Len(t, packets, 8)
+	assert.Equal(t, `in SSH_FXP_RENAME id: 7, path: "/src", target: "/dst", length: 21`, packets[0])
+	assert.Equal(t, "in empty packet, length: 0", packets[1])
+	assert.Equal(t, "in SSH_FXP_WRITE id: 8, offset: 4096, len: 2048, length: 2075", packets[2])
+	assert.Equal(t, `in SSH_FXP_EXTENDED id: 9, request: "copy-data", length: 28`, packets[3])
+	assert.Equal(t, `in SSH_FXP_STATUS id: 10, code: 3, message: "permission denied", length: 30`, packets[4])
+	assert.Equal(t, `in SSH_FXP_NAME id: 11, count: 1, name: "/home", length: 18`, packets[5])
+	assert.Equal(t, "in unknown packet type 150 id: 12, length: 5", packets[6])
+	assert.Contains(t, packets[7], "in SSH_FXP_OPEN id: 13, path: \"aaa")
+	assert.Contains(t, packets[7], "...\", pflags: 0x0, length: 2061")
+}
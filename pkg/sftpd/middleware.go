@@ -22,6 +22,7 @@ import (
 	"time"
 
 	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
 
 	"github.com/drakkan/sftpgo/v2/pkg/vfs"
 )
@@ -168,6 +169,72 @@ func (p *prefixMiddleware) StatVFS(request *sftp.Request) (*sftp.StatVFS, error)
 	}
 }
 
+func (p *prefixMiddleware) ExtendedCmd(request *extendedRequest) ([]byte, error) {
+	next, ok := p.next.(extendedCmder)
+	if !ok {
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+	switch request.Name {
+	case copyDataExtension, fileOperationStatusExtension, checkFileHandleExtension:
+		// the handles were opened using this middleware, operation IDs are not paths
+		return next.ExtendedCmd(request)
+	case copyFileExtension:
+		var req copyFileRequest
+		if err := ssh.Unmarshal(request.Data, &req); err != nil {
+			return nil, sftp.ErrSSHFxBadMessage
+		}
+		req.Source = request.CleanPath(req.Source)
+		req.Destination = request.CleanPath(req.Destination)
+		if getPrefixHierarchy(p.prefix, req.Source) == pathContainsPrefix &&
+			getPrefixHierarchy(p.prefix, req.Destination) == pathContainsPrefix {
+			req.Source, _ = p.removeFolderPrefix(req.Source)
+			req.Destination, _ = p.removeFolderPrefix(req.Destination)
+			request.Data = ssh.Marshal(&req)
+			return next.ExtendedCmd(request)
+		}
+		return nil, sftp.ErrSSHFxPermissionDenied
+	case checkFileNameExtension:
+		var req checkFileRequest
+		if err := ssh.Unmarshal(request.Data, &req); err != nil {
+			return nil, sftp.ErrSSHFxBadMessage
+		}
+		req.Name = request.CleanPath(req.Name)
+		if getPrefixHierarchy(p.prefix, req.Name) != pathContainsPrefix {
+			return nil, sftp.ErrSSHFxPermissionDenied
+		}
+		req.Name, _ = p.removeFolderPrefix(req.Name)
+		request.Data = ssh.Marshal(&req)
+		return next.ExtendedCmd(request)
+	case fileOperationExtension:
+		var req fileOperationRequest
+		if err := ssh.Unmarshal(request.Data, &req); err != nil {
+			return nil, sftp.ErrSSHFxBadMessage
+		}
+		if getPrefixHierarchy(p.prefix, request.CleanPath(req.Source)) != pathContainsPrefix ||
+			(req.Target != "" && getPrefixHierarchy(p.prefix, request.CleanPath(req.Target)) != pathContainsPrefix) {
+			return nil, sftp.ErrSSHFxPermissionDenied
+		}
+		req.Source = p.removeFolderPrefixKeepSlash(request.CleanPath(req.Source), req.Source)
+		if req.Target != "" {
+			req.Target = p.removeFolderPrefixKeepSlash(request.CleanPath(req.Target), req.Target)
+		}
+		request.Data = ssh.Marshal(&req)
+		return next.ExtendedCmd(request)
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+// removeFolderPrefixKeepSlash removes the prefix from the cleaned path and
+// preserves the trailing slash of the original path, it is relevant for copies
+func (p *prefixMiddleware) removeFolderPrefixKeepSlash(cleanedPath, originalPath string) string {
+	virtualPath, _ := p.removeFolderPrefix(cleanedPath)
+	if strings.HasSuffix(originalPath, "/") && virtualPath != "/" {
+		virtualPath += "/"
+	}
+	return virtualPath
+}
+
 func (p *prefixMiddleware) nextListFolder(requestPath string) string {
 	cleanPath := path.Clean(`/` + requestPath)
 	cleanPrefix := path.Clean(`/` + p.prefix)
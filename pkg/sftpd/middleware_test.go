@@ -20,6 +20,7 @@ import (
 	"github.com/golang/mock/gomock"
 	"github.com/pkg/sftp"
 	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/ssh"
 
 	"github.com/drakkan/sftpgo/v2/pkg/sftpd/mocks"
 )
@@ -324,6 +325,138 @@ func (Suite *PrefixMiddlewareSuite) TestFileCmdErrors() {
 	}
 }
 
+func (Suite *PrefixMiddlewareSuite) TestExtendedCmd() {
+	copyFileData := func(source, destination string) []byte {
+		return ssh.Marshal(&copyFileRequest{
+			Source:      source,
+			Destination: destination,
+			Overwrite:   true,
+		})
+	}
+
+	fileOperationData := func(opType, source, target string) []byte {
+		return ssh.Marshal(&fileOperationRequest{
+			Type:   opType,
+			Source: source,
+			Target: target,
+		})
+	}
+
+	checkFileData := func(name string) []byte {
+		return ssh.Marshal(&checkFileRequest{
+			Name:      name,
+			HashAlgos: `sha256`,
+		})
+	}
+
+	next := &extendedCmdRecorder{
+		MockMiddleware: mocks.NewMockMiddleware(Suite.MockCtl),
+	}
+	middleware := prefixMiddleware{
+		prefix: `/files`,
+		next:   next,
+	}
+	_, err := middleware.ExtendedCmd(&extendedRequest{
+		Name:           copyFileExtension,
+		Data:           copyFileData(`/files/data.csv`, `files/copy/data.csv`),
+		StartDirectory: `/`,
+	})
+	Suite.NoError(err)
+	_, err = middleware.ExtendedCmd(&extendedRequest{
+		Name: copyDataExtension,
+		Data: []byte(`data`),
+	})
+	Suite.NoError(err)
+	data, err := middleware.ExtendedCmd(&extendedRequest{
+		Name:           fileOperationExtension,
+		Data:           fileOperationData(`copy`, `/files/dir/`, `/files`),
+		StartDirectory: `/`,
+	})
+	Suite.NoError(err)
+	Suite.Equal([]byte(`id`), data)
+	_, err = middleware.ExtendedCmd(&extendedRequest{
+		Name:           fileOperationExtension,
+		Data:           fileOperationData(`delete`, `files/dir`, ``),
+		StartDirectory: `/`,
+	})
+	Suite.NoError(err)
+	_, err = middleware.ExtendedCmd(&extendedRequest{
+		Name: fileOperationStatusExtension,
+		Data: []byte(`id`),
+	})
+	Suite.NoError(err)
+	data, err = middleware.ExtendedCmd(&extendedRequest{
+		Name:           checkFileNameExtension,
+		Data:           checkFileData(`/files/data.csv`),
+		StartDirectory: `/`,
+	})
+	Suite.NoError(err)
+	Suite.Equal([]byte(`hash`), data)
+	Suite.Equal([]*extendedRequest{
+		{
+			Name:           copyFileExtension,
+			Data:           copyFileData(`/data.csv`, `/copy/data.csv`),
+			StartDirectory: `/`,
+		},
+		{
+			Name: copyDataExtension,
+			Data: []byte(`data`),
+		},
+		{
+			Name:           fileOperationExtension,
+			Data:           fileOperationData(`copy`, `/dir/`, `/`),
+			StartDirectory: `/`,
+		},
+		{
+			Name:           fileOperationExtension,
+			Data:           fileOperationData(`delete`, `/dir`, ``),
+			StartDirectory: `/`,
+		},
+		{
+			Name: fileOperationStatusExtension,
+			Data: []byte(`id`),
+		},
+		{
+			Name:           checkFileNameExtension,
+			Data:           checkFileData(`/data.csv`),
+			StartDirectory: `/`,
+		},
+	}, next.requests)
+
+	var tests = []struct {
+		Name        string
+		Data        []byte
+		ExpectedErr error
+	}{
+		{Name: copyFileExtension, Data: copyFileData(`/files/data.csv`, `/data.csv`), ExpectedErr: sftp.ErrSSHFxPermissionDenied},
+		{Name: copyFileExtension, Data: copyFileData(`/random`, `/files/data.csv`), ExpectedErr: sftp.ErrSSHFxPermissionDenied},
+		{Name: copyFileExtension, Data: []byte(`invalid`), ExpectedErr: sftp.ErrSSHFxBadMessage},
+		{Name: fileOperationExtension, Data: fileOperationData(`copy`, `/files/a`, `/b`), ExpectedErr: sftp.ErrSSHFxPermissionDenied},
+		{Name: fileOperationExtension, Data: fileOperationData(`delete`, `/random`, ``), ExpectedErr: sftp.ErrSSHFxPermissionDenied},
+		{Name: fileOperationExtension, Data: []byte(`invalid`), ExpectedErr: sftp.ErrSSHFxBadMessage},
+		{Name: checkFileNameExtension, Data: checkFileData(`/data.csv`), ExpectedErr: sftp.ErrSSHFxPermissionDenied},
+		{Name: checkFileNameExtension, Data: []byte(`invalid`), ExpectedErr: sftp.ErrSSHFxBadMessage},
+		{Name: `unknown`, ExpectedErr: sftp.ErrSSHFxOpUnsupported},
+	}
+
+	for _, test := range tests {
+		_, err := middleware.ExtendedCmd(&extendedRequest{
+			Name:           test.Name,
+			Data:           test.Data,
+			StartDirectory: `/`,
+		})
+		Suite.Equal(test.ExpectedErr, err)
+	}
+	Suite.Len(next.requests, 6)
+	// the extended requests are not supported if the next handler does not implement them
+	middleware.next = next.MockMiddleware
+	_, err = middleware.ExtendedCmd(&extendedRequest{
+		Name: fileOperationStatusExtension,
+		Data: []byte(`id`),
+	})
+	Suite.Equal(sftp.ErrSSHFxOpUnsupported, err)
+}
+
 func (Suite *PrefixMiddlewareSuite) TestNextFolder() {
 	prefix := prefixMiddleware{prefix: `/files/data`}
 	Suite.Equal(`files`, prefix.nextListFolder(`/`))
@@ -368,3 +501,21 @@ func (Suite *PrefixMiddlewareSuite) TestRemoveFolderPrefix() {
 func TestFolderPrefixSuite(t *testing.T) {
 	suite.Run(t, new(PrefixMiddlewareSuite))
 }
+
+// extendedCmdRecorder records the extended requests forwarded by the prefix middleware
+type extendedCmdRecorder struct {
+	*mocks.MockMiddleware
+	requests []*extendedRequest
+}
+
+func (r *extendedCmdRecorder) ExtendedCmd(request *extendedRequest) ([]byte, error) {
+	r.requests = append(r.requests, request)
+	switch request.Name {
+	case fileOperationExtension:
+		return []byte(`id`), nil
+	case checkFileNameExtension:
+		return []byte(`hash`), nil
+	default:
+		return nil, nil
+	}
+}
@@ -18,7 +18,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"math"
 	"os"
 	"path"
 	"path/filepath"
@@ -188,7 +187,19 @@ func (c *scpCommand) getUploadFileData(sizeToRead int64, transfer *transfer) err
 	if sizeToRead > 0 {
 		// we could replace this method with io.CopyN implementing "Write" method in transfer struct
 		remaining := sizeToRead
-		buf := make([]byte, int64(math.Min(32768, float64(sizeToRead))))
+		buffer, err := c.connection.GetTransferBuffer()
+		if err != nil {
+			c.sendErrorMessage(transfer.Fs, err)
+			transfer.TransferError(err)
+			transfer.Close()
+			return err
+		}
+		defer buffer.Release()
+
+		buf := buffer.Buf
+		if remaining < int64(len(buf)) {
+			buf = buf[:remaining]
+		}
 		for {
 			n, err := c.connection.channel.Read(buf)
 			if err != nil {
@@ -208,7 +219,7 @@ func (c *scpCommand) getUploadFileData(sizeToRead int64, transfer *transfer) err
 				break
 			}
 			if remaining < int64(len(buf)) {
-				buf = make([]byte, remaining)
+				buf = buf[:remaining]
 			}
 		}
 	}
@@ -299,9 +310,10 @@ func (c *scpCommand) handleUpload(uploadFilePath string, sizeToRead int64) error
 		return common.ErrPermissionDenied
 	}
 
-	filePath := p
-	if common.Config.IsAtomicUploadEnabled() && fs.IsAtomicUploadSupported() {
-		filePath = fs.GetAtomicUploadPath(p)
+	filePath, err := c.connection.GetUploadFsPath(fs, p, uploadFilePath)
+	if err != nil {
+		c.sendErrorMessage(fs, err)
+		return err
 	}
 	stat, statErr := fs.Lstat(p)
 	if (statErr == nil && stat.Mode()&os.ModeSymlink != 0) || fs.IsNotExist(statErr) {
@@ -332,6 +344,16 @@ func (c *scpCommand) handleUpload(uploadFilePath string, sizeToRead int64) error
 		return common.ErrPermissionDenied
 	}
 
+	if err := c.connection.CheckWORMProtection(uploadFilePath, stat); err != nil {
+		c.sendErrorMessage(fs, err)
+		return err
+	}
+
+	if c.connection.IsStagedUpload(uploadFilePath) {
+		// the existing file is replaced when the staged upload is published
+		return c.handleUploadFile(fs, p, filePath, sizeToRead, true, 0, uploadFilePath)
+	}
+
 	if common.Config.IsAtomicUploadEnabled() && fs.IsAtomicUploadSupported() {
 		_, _, err = fs.Rename(p, filePath)
 		if err != nil {
@@ -458,7 +480,14 @@ func (c *scpCommand) sendDownloadFileData(fs vfs.Fs, filePath string, stat os.Fi
 	}
 
 	// we could replace this method with io.CopyN implementing "Read" method in transfer struct
-	buf := make([]byte, 32768)
+	buffer, err := c.connection.GetTransferBuffer()
+	if err != nil {
+		c.sendErrorMessage(fs, err)
+		return err
+	}
+	defer buffer.Release()
+
+	buf := buffer.Buf
 	var n int
 	for {
 		n, err = transfer.ReadAt(buf, readed)
@@ -0,0 +1,142 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package sftpd
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+// Supported security profiles
+const (
+	SecurityProfileModern       = "modern"
+	SecurityProfileIntermediate = "intermediate"
+	SecurityProfileLegacy       = "legacy"
+)
+
+// securityProfile defines the KEX algorithms, ciphers and MACs, in preference
+// order, for a named profile
+type securityProfile struct {
+	kexAlgos []string
+	ciphers  []string
+	macs     []string
+}
+
+var securityProfiles = map[string]securityProfile{
+	SecurityProfileModern: {
+		kexAlgos: []string{
+			"curve25519-sha256", "curve25519-sha256@libssh.org",
+			"diffie-hellman-group16-sha512", "diffie-hellman-group18-sha512",
+		},
+		ciphers: []string{
+			"chacha20-poly1305@openssh.com", "aes256-gcm@openssh.com", "aes128-gcm@openssh.com",
+		},
+		macs: []string{
+			"hmac-sha2-512-etm@openssh.com", "hmac-sha2-256-etm@openssh.com",
+		},
+	},
+	SecurityProfileLegacy: {
+		kexAlgos: []string{
+			"curve25519-sha256", "curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+			"diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512",
+			kexDHGroupExchangeSHA256, "diffie-hellman-group14-sha1", kexDHGroupExchangeSHA1,
+		},
+		ciphers: []string{
+			"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+			"chacha20-poly1305@openssh.com",
+			"aes128-ctr", "aes192-ctr", "aes256-ctr",
+			"aes128-cbc", "aes192-cbc", "aes256-cbc",
+		},
+		macs: []string{
+			"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256",
+			"hmac-sha2-512-etm@openssh.com", "hmac-sha2-512",
+			"hmac-sha1",
+		},
+	},
+}
+
+// GetSecurityProfiles returns the names of the supported security profiles
+func GetSecurityProfiles() []string {
+	return []string{SecurityProfileModern, SecurityProfileIntermediate, SecurityProfileLegacy}
+}
+
+func getSecurityProfile(name string) (securityProfile, error) {
+	if name == SecurityProfileIntermediate {
+		// the intermediate profile matches the default algorithms, they
+		// depend on the moduli configuration
+		return securityProfile{
+			kexAlgos: preferredKexAlgos,
+			ciphers:  preferredCiphers,
+			macs:     preferredMACs,
+		}, nil
+	}
+	profile, ok := securityProfiles[name]
+	if !ok {
+		return profile, fmt.Errorf("unsupported security profile %q", name)
+	}
+	return profile, nil
+}
+
+// getKexAlgos returns the profile KEX algorithms supported by the SSH library
+// and by the current configuration, for example the group exchange algorithms
+// require moduli files
+func (p *securityProfile) getKexAlgos() []string {
+	return filterSupportedAlgos(p.kexAlgos, supportedKexAlgos)
+}
+
+func (p *securityProfile) getCiphers() []string {
+	return filterSupportedAlgos(p.ciphers, supportedCiphers)
+}
+
+func (p *securityProfile) getMACs() []string {
+	return filterSupportedAlgos(p.macs, supportedMACs)
+}
+
+// apply sets the profile algorithms in the specified SSH server configuration
+func (p *securityProfile) apply(serverConfig *ssh.ServerConfig) {
+	serverConfig.KeyExchanges = p.getKexAlgos()
+	serverConfig.Ciphers = p.getCiphers()
+	serverConfig.MACs = p.getMACs()
+}
+
+// getServerConfigForBinding returns the SSH server configuration to use for
+// the specified binding. Bindings without a security profile share the
+// global configuration
+func (c *Configuration) getServerConfigForBinding(serverConfig *ssh.ServerConfig, binding Binding) (*ssh.ServerConfig, error) {
+	if binding.SecurityProfile == "" {
+		return serverConfig, nil
+	}
+	profile, err := getSecurityProfile(binding.SecurityProfile)
+	if err != nil {
+		return nil, fmt.Errorf("binding %q: %w", binding.GetAddress(), err)
+	}
+	bindingConfig := *serverConfig
+	profile.apply(&bindingConfig)
+	return &bindingConfig, nil
+}
+
+func filterSupportedAlgos(algos, supported []string) []string {
+	var result []string
+	for _, algo := range algos {
+		if util.Contains(supported, algo) {
+			result = append(result, algo)
+		}
+	}
+	return result
+}
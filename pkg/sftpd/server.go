@@ -16,12 +16,14 @@ package sftpd
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"math"
 	"net"
 	"os"
 	"path"
@@ -118,6 +120,9 @@ type Binding struct {
 	Port int `json:"port" mapstructure:"port"`
 	// Apply the proxy configuration, if any, for this binding
 	ApplyProxyConfig bool `json:"apply_proxy_config" mapstructure:"apply_proxy_config"`
+	// SecurityProfile defines the KEX algorithms, ciphers and MACs for this
+	// binding. Empty means the global settings
+	SecurityProfile string `json:"security_profile" mapstructure:"security_profile"`
 }
 
 // GetAddress returns the binding address
@@ -171,6 +176,11 @@ type Configuration struct {
 	// MACs Specifies the available MAC (message authentication code) algorithms
 	// in preference order
 	MACs []string `json:"macs" mapstructure:"macs"`
+	// SecurityProfile selects a named set of KEX algorithms, ciphers and MACs.
+	// Supported profiles: "modern", "intermediate", "legacy".
+	// The algorithms configured using KexAlgorithms, Ciphers and MACs are
+	// added to the profile ones
+	SecurityProfile string `json:"security_profile" mapstructure:"security_profile"`
 	// TrustedUserCAKeys specifies a list of public keys paths of certificate authorities
 	// that are trusted to sign user certificates for authentication.
 	// The paths can be absolute or relative to the configuration directory
@@ -220,6 +230,7 @@ type Configuration struct {
 	// This setting can help some migrations from OpenSSH. It is not recommended for general usage.
 	FolderPrefix     string `json:"folder_prefix" mapstructure:"folder_prefix"`
 	certChecker      *ssh.CertChecker
+	hostKeysManager  *hostKeysManager
 	parsedUserCAKeys []ssh.PublicKey
 }
 
@@ -280,7 +291,7 @@ func (c *Configuration) getServerConfig() *ssh.ServerConfig {
 		},
 		NextAuthMethodsCallback: func(conn ssh.ConnMetadata) []string {
 			var nextMethods []string
-			user, err := dataprovider.GetUserWithGroupSettings(conn.User(), "")
+			user, err := dataprovider.GetUserWithGroupSettings(dataprovider.CanonicalizeLoginName(conn.User()), "")
 			if err == nil {
 				nextMethods = user.GetNextAuthMethods(conn.PartialSuccessMethods(), c.PasswordAuthentication)
 			}
@@ -326,6 +337,9 @@ func (c *Configuration) loadFromProvider() error {
 		return fmt.Errorf("unable to load config from provider: %w", err)
 	}
 	configs.SetNilsToEmpty()
+	if configs.SFTPD.SecurityProfile != "" {
+		c.SecurityProfile = configs.SFTPD.SecurityProfile
+	}
 	if len(configs.SFTPD.HostKeyAlgos) > 0 {
 		if len(c.HostKeyAlgorithms) == 0 {
 			c.HostKeyAlgorithms = preferredHostKeyAlgos
@@ -333,20 +347,23 @@ func (c *Configuration) loadFromProvider() error {
 		c.HostKeyAlgorithms = append(c.HostKeyAlgorithms, configs.SFTPD.HostKeyAlgos...)
 	}
 	c.Moduli = append(c.Moduli, configs.SFTPD.Moduli...)
+	// if a security profile is set, the additional algorithms are added to
+	// the profile ones
+	hasProfile := c.SecurityProfile != ""
 	if len(configs.SFTPD.KexAlgorithms) > 0 {
-		if len(c.KexAlgorithms) == 0 {
+		if len(c.KexAlgorithms) == 0 && !hasProfile {
 			c.KexAlgorithms = preferredKexAlgos
 		}
 		c.KexAlgorithms = append(c.KexAlgorithms, configs.SFTPD.KexAlgorithms...)
 	}
 	if len(configs.SFTPD.Ciphers) > 0 {
-		if len(c.Ciphers) == 0 {
+		if len(c.Ciphers) == 0 && !hasProfile {
 			c.Ciphers = preferredCiphers
 		}
 		c.Ciphers = append(c.Ciphers, configs.SFTPD.Ciphers...)
 	}
 	if len(configs.SFTPD.MACs) > 0 {
-		if len(c.MACs) == 0 {
+		if len(c.MACs) == 0 && !hasProfile {
 			c.MACs = preferredMACs
 		}
 		c.MACs = append(c.MACs, configs.SFTPD.MACs...)
@@ -385,16 +402,28 @@ func (c *Configuration) Initialize(configDir string) error {
 	c.checkSSHCommands()
 	c.checkFolderPrefix()
 
+	bindingConfigs := make(map[int]*ssh.ServerConfig)
+	for idx, binding := range c.Bindings {
+		if !binding.IsValid() {
+			continue
+		}
+		bindingConfig, err := c.getServerConfigForBinding(serverConfig, binding)
+		if err != nil {
+			return err
+		}
+		bindingConfigs[idx] = bindingConfig
+	}
+
 	exitChannel := make(chan error, 1)
 	serviceStatus.Bindings = nil
 
-	for _, binding := range c.Bindings {
+	for idx, binding := range c.Bindings {
 		if !binding.IsValid() {
 			continue
 		}
 		serviceStatus.Bindings = append(serviceStatus.Bindings, binding)
 
-		go func(binding Binding) {
+		go func(binding Binding, serverConfig *ssh.ServerConfig) {
 			addr := binding.GetAddress()
 			util.CheckTCP4Port(binding.Port)
 			listener, err := net.Listen("tcp", addr)
@@ -415,7 +444,7 @@ func (c *Configuration) Initialize(configDir string) error {
 			}
 
 			exitChannel <- c.serve(listener, serverConfig)
-		}(binding)
+		}(binding, bindingConfigs[idx])
 	}
 
 	serviceStatus.IsActive = true
@@ -467,6 +496,16 @@ func (c *Configuration) configureSecurityOptions(serverConfig *ssh.ServerConfig)
 		}
 	}
 
+	if c.SecurityProfile != "" {
+		profile, err := getSecurityProfile(c.SecurityProfile)
+		if err != nil {
+			return err
+		}
+		c.KexAlgorithms = append(profile.getKexAlgos(), c.KexAlgorithms...)
+		c.Ciphers = append(profile.getCiphers(), c.Ciphers...)
+		c.MACs = append(profile.getMACs(), c.MACs...)
+		serviceStatus.SecurityProfile = c.SecurityProfile
+	}
 	if len(c.KexAlgorithms) > 0 {
 		hasDHGroupKEX := util.Contains(supportedKexAlgos, kexDHGroupExchangeSHA256)
 		if !hasDHGroupKEX {
@@ -592,7 +631,8 @@ func (c *Configuration) AcceptInboundConnection(conn net.Conn, config *ssh.Serve
 	}
 	// handshake completed so remove the deadline, we'll use IdleTimeout configuration from now on
 	conn.SetDeadline(time.Time{}) //nolint:errcheck
-	go ssh.DiscardRequests(reqs)
+	go handleGlobalRequests(sconn, reqs, c.hostKeysManager)
+	go c.hostKeysManager.notifyHostKeys(sconn)
 
 	defer conn.Close()
 
@@ -621,6 +661,14 @@ func (c *Configuration) AcceptInboundConnection(conn net.Conn, config *ssh.Serve
 
 	defer common.Connections.RemoveSSHConnection(connectionID)
 
+	policy := user.GetSessionPolicy(common.ProtocolSSH)
+	if policy.KeepaliveInterval > 0 {
+		done := make(chan bool)
+		defer close(done)
+
+		go sendKeepalives(sconn, policy.GetKeepaliveInterval(), connectionID, done)
+	}
+
 	channelCounter := int64(0)
 	for newChannel := range chans {
 		// If its not a session channel we just move on because its not something we
@@ -683,6 +731,40 @@ func (c *Configuration) AcceptInboundConnection(conn net.Conn, config *ssh.Serve
 	}
 }
 
+// sendKeepalives sends keepalive requests to the client at the specified interval
+// and closes the connection if the client does not respond
+func sendKeepalives(sconn *ssh.ServerConn, interval time.Duration, connectionID string, done chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			errCh := make(chan error, 1)
+			go func() {
+				_, _, err := sconn.SendRequest("keepalive@openssh.com", true, nil)
+				errCh <- err
+			}()
+			select {
+			case err := <-errCh:
+				if err != nil {
+					logger.Debug(logSender, connectionID, "keepalive error: %v, closing the connection", err)
+					sconn.Close()
+					return
+				}
+			case <-time.After(interval):
+				logger.Debug(logSender, connectionID, "no keepalive response within %s, closing the connection", interval)
+				sconn.Close()
+				return
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
 func (c *Configuration) handleSftpConnection(channel ssh.Channel, connection *Connection) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -697,7 +779,10 @@ func (c *Configuration) handleSftpConnection(channel ssh.Channel, connection *Co
 	defer common.Connections.Remove(connection.GetID())
 
 	// Create the server instance for the channel using the handler we created above.
-	server := sftp.NewRequestServer(channel, c.createHandlers(connection), sftp.WithRSAllocator(),
+	handlers := c.createHandlers(connection)
+	sftpChannel := newExtendedChannel(newCaptureChannel(channel, connection), handlers.FileCmd.(extendedCmder),
+		sftpExtendedRequests, connection.User.Filters.StartDirectory, connection.GetID())
+	server := sftp.NewRequestServer(sftpChannel, handlers, sftp.WithRSAllocator(),
 		sftp.WithStartDirectory(connection.User.Filters.StartDirectory))
 
 	defer server.Close()
@@ -779,7 +864,8 @@ func checkAuthError(ip string, err error) {
 		logger.ConnectionFailedLog("", ip, dataprovider.LoginMethodNoAuthTried, common.ProtocolSSH, err.Error())
 		metric.AddNoAuthTried()
 		common.AddDefenderEvent(ip, common.ProtocolSSH, common.HostEventNoLoginTried)
-		dataprovider.ExecutePostLoginHook(&dataprovider.User{}, dataprovider.LoginMethodNoAuthTried, ip, common.ProtocolSSH, err)
+		dataprovider.ExecutePostLoginHook(context.Background(), &dataprovider.User{}, dataprovider.LoginMethodNoAuthTried, ip,
+			common.ProtocolSSH, err)
 		logEv := notifier.LogEventTypeNoLoginTried
 		if errors.Is(err, ssh.ErrNoCommonAlgo) {
 			logEv = notifier.LogEventTypeNotNegotiated
@@ -820,6 +906,10 @@ func loginUser(user *dataprovider.User, loginMethod, publicKey string, conn ssh.
 			user.Username)
 		return nil, fmt.Errorf("second factor authentication is not set for user %q", user.Username)
 	}
+	if err := common.CheckConsentsForProtocol(user, common.ProtocolSSH); err != nil {
+		logger.Info(logSender, connectionID, "cannot login user %q, consent documents not accepted", user.Username)
+		return nil, err
+	}
 	remoteAddr := conn.RemoteAddr().String()
 	if !user.IsLoginFromAddrAllowed(remoteAddr) {
 		logger.Info(logSender, connectionID, "cannot login user %q, remote address is not allowed: %v",
@@ -1002,6 +1092,7 @@ func (c *Configuration) checkAndLoadHostKeys(configDir string, serverConfig *ssh
 		return err
 	}
 	serviceStatus.HostKeys = nil
+	var fileSigners []ssh.Signer
 	for _, hostKey := range c.HostKeys {
 		hostKey = strings.TrimSpace(hostKey)
 		if !util.IsFileInputValid(hostKey) {
@@ -1040,6 +1131,7 @@ func (c *Configuration) checkAndLoadHostKeys(configDir string, serverConfig *ssh
 
 		// Add private key to the server configuration.
 		serverConfig.AddHostKey(mas)
+		fileSigners = append(fileSigners, mas)
 		for _, cert := range hostCertificates {
 			signer, err := ssh.NewCertSigner(cert.Certificate, mas)
 			if err == nil {
@@ -1062,6 +1154,12 @@ func (c *Configuration) checkAndLoadHostKeys(configDir string, serverConfig *ssh
 			}
 		}
 	}
+	c.hostKeysManager = newHostKeysManager(c.getHostKeyAlgorithms)
+	managedKeys, err := c.hostKeysManager.init(serverConfig, fileSigners)
+	if err != nil {
+		return err
+	}
+	serviceStatus.HostKeys = append(serviceStatus.HostKeys, managedKeys...)
 	if len(serviceStatus.HostKeys) == 0 {
 		return errors.New("ssh: server has no host keys")
 	}
@@ -1167,6 +1265,7 @@ func (c *Configuration) validatePublicKeyCredentials(conn ssh.ConnMetadata, pubK
 	var certPerm *ssh.Permissions
 
 	connectionID := hex.EncodeToString(conn.SessionID())
+	ctx := getLoginContext(conn)
 	method := dataprovider.SSHLoginMethodPublicKey
 	ipAddr := util.GetIPFromRemoteAddress(conn.RemoteAddr().String())
 	cert, ok := pubKey.(*ssh.Certificate)
@@ -1176,38 +1275,34 @@ func (c *Configuration) validatePublicKeyCredentials(conn ssh.ConnMetadata, pubK
 		if cert.CertType != ssh.UserCert {
 			err = fmt.Errorf("ssh: cert has type %d", cert.CertType)
 			user.Username = conn.User()
-			updateLoginMetrics(&user, ipAddr, method, err)
-			return nil, err
-		}
-		if !c.certChecker.IsUserAuthority(cert.SignatureKey) {
-			err = errors.New("ssh: certificate signed by unrecognized authority")
-			user.Username = conn.User()
-			updateLoginMetrics(&user, ipAddr, method, err)
+			updateLoginMetrics(ctx, &user, ipAddr, method, err)
 			return nil, err
 		}
 		if len(cert.ValidPrincipals) == 0 {
 			err = fmt.Errorf("ssh: certificate %s has no valid principals, user: \"%s\"", certFingerprint, conn.User())
 			user.Username = conn.User()
-			updateLoginMetrics(&user, ipAddr, method, err)
+			updateLoginMetrics(ctx, &user, ipAddr, method, err)
 			return nil, err
 		}
 		if revokedCertManager.isRevoked(certFingerprint) {
 			err = fmt.Errorf("ssh: certificate %s is revoked", certFingerprint)
 			user.Username = conn.User()
-			updateLoginMetrics(&user, ipAddr, method, err)
-			return nil, err
-		}
-		if err := c.certChecker.CheckCert(conn.User(), cert); err != nil {
-			user.Username = conn.User()
-			updateLoginMetrics(&user, ipAddr, method, err)
+			updateLoginMetrics(ctx, &user, ipAddr, method, err)
 			return nil, err
 		}
 		certPerm = &cert.Permissions
 	}
-	if user, keyID, err = dataprovider.CheckUserAndPubKey(conn.User(), pubKey.Marshal(), ipAddr, common.ProtocolSSH, ok); err == nil {
+	if user, keyID, err = dataprovider.CheckUserAndPubKeyContext(ctx, conn.User(), pubKey.Marshal(), ipAddr,
+		common.ProtocolSSH, ok); err == nil {
 		if ok {
-			keyID = fmt.Sprintf("%s: ID: %s, serial: %v, CA %s %s", certFingerprint,
-				cert.KeyId, cert.Serial, cert.Type(), ssh.FingerprintSHA256(cert.SignatureKey))
+			keyID, err = c.checkUserCertificate(&user, cert, certFingerprint)
+			if err != nil {
+				logger.Info(logSender, connectionID, "certificate rejected for user %q: %v, certificate: %s",
+					user.Username, err, keyID)
+				user.Username = conn.User()
+				updateLoginMetrics(ctx, &user, ipAddr, method, err)
+				return nil, err
+			}
 		}
 		if user.IsPartialAuth(method) {
 			logger.Debug(logSender, connectionID, "user %q authenticated with partial success", conn.User())
@@ -1226,25 +1321,69 @@ func (c *Configuration) validatePublicKeyCredentials(conn ssh.ConnMetadata, pubK
 		}
 	}
 	user.Username = conn.User()
-	updateLoginMetrics(&user, ipAddr, method, err)
+	updateLoginMetrics(ctx, &user, ipAddr, method, err)
 	return sshPerm, err
 }
 
+// checkUserCertificate checks that the certificate is signed by a globally
+// trusted CA or by a CA trusted for the user and that it is valid for one of the
+// principals mapped to the user. It returns a description of the certificate
+func (c *Configuration) checkUserCertificate(user *dataprovider.User, cert *ssh.Certificate, fingerprint string) (string, error) {
+	checker := &ssh.CertChecker{
+		SupportedCriticalOptions: c.certChecker.SupportedCriticalOptions,
+		IsUserAuthority: func(k ssh.PublicKey) bool {
+			return c.certChecker.IsUserAuthority(k) || user.IsTrustedUserCA(k)
+		},
+	}
+	var principal string
+	for _, p := range user.GetCertPrincipals() {
+		if util.Contains(cert.ValidPrincipals, p) {
+			principal = p
+			break
+		}
+	}
+	info := fmt.Sprintf("%s: ID: %s, serial: %v, CA %s %s, principal: %q, valid after: %s, valid before: %s",
+		fingerprint, cert.KeyId, cert.Serial, cert.Type(), ssh.FingerprintSHA256(cert.SignatureKey), principal,
+		formatCertTime(cert.ValidAfter), formatCertTime(cert.ValidBefore))
+	if !checker.IsUserAuthority(cert.SignatureKey) {
+		return info, errors.New("ssh: certificate signed by unrecognized authority")
+	}
+	if principal == "" {
+		return info, fmt.Errorf("ssh: no principal mapped to user %q in the set of valid principals for given certificate: %q",
+			user.Username, cert.ValidPrincipals)
+	}
+	if err := checker.CheckCert(principal, cert); err != nil {
+		return info, err
+	}
+	return info, nil
+}
+
+func formatCertTime(t uint64) string {
+	if t == ssh.CertTimeInfinity {
+		return "forever"
+	}
+	if t > math.MaxInt64 {
+		return fmt.Sprintf("%d", t)
+	}
+	return time.Unix(int64(t), 0).UTC().Format(time.RFC3339)
+}
+
 func (c *Configuration) validatePasswordCredentials(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
 	var err error
 	var user dataprovider.User
 	var sshPerm *ssh.Permissions
 
+	ctx := getLoginContext(conn)
 	method := dataprovider.LoginMethodPassword
 	if len(conn.PartialSuccessMethods()) == 1 {
 		method = dataprovider.SSHLoginMethodKeyAndPassword
 	}
 	ipAddr := util.GetIPFromRemoteAddress(conn.RemoteAddr().String())
-	if user, err = dataprovider.CheckUserAndPass(conn.User(), string(pass), ipAddr, common.ProtocolSSH); err == nil {
+	if user, err = dataprovider.CheckUserAndPassContext(ctx, conn.User(), string(pass), ipAddr, common.ProtocolSSH); err == nil {
 		sshPerm, err = loginUser(&user, method, "", conn)
 	}
 	user.Username = conn.User()
-	updateLoginMetrics(&user, ipAddr, method, err)
+	updateLoginMetrics(ctx, &user, ipAddr, method, err)
 	return sshPerm, err
 }
 
@@ -1253,21 +1392,28 @@ func (c *Configuration) validateKeyboardInteractiveCredentials(conn ssh.ConnMeta
 	var user dataprovider.User
 	var sshPerm *ssh.Permissions
 
+	ctx := getLoginContext(conn)
 	method := dataprovider.SSHLoginMethodKeyboardInteractive
 	if len(conn.PartialSuccessMethods()) == 1 {
 		method = dataprovider.SSHLoginMethodKeyAndKeyboardInt
 	}
 	ipAddr := util.GetIPFromRemoteAddress(conn.RemoteAddr().String())
-	if user, err = dataprovider.CheckKeyboardInteractiveAuth(conn.User(), c.KeyboardInteractiveHook, client,
+	if user, err = dataprovider.CheckKeyboardInteractiveAuth(ctx, conn.User(), c.KeyboardInteractiveHook, client,
 		ipAddr, common.ProtocolSSH); err == nil {
 		sshPerm, err = loginUser(&user, method, "", conn)
 	}
 	user.Username = conn.User()
-	updateLoginMetrics(&user, ipAddr, method, err)
+	updateLoginMetrics(ctx, &user, ipAddr, method, err)
 	return sshPerm, err
 }
 
-func updateLoginMetrics(user *dataprovider.User, ip, method string, err error) {
+// getLoginContext returns the context used to send the SSH session ID, as
+// correlation ID, to the login hooks
+func getLoginContext(conn ssh.ConnMetadata) context.Context {
+	return logger.WithCorrelationID(context.Background(), hex.EncodeToString(conn.SessionID()))
+}
+
+func updateLoginMetrics(ctx context.Context, user *dataprovider.User, ip, method string, err error) {
 	metric.AddLoginAttempt(method)
 	if err != nil {
 		logger.ConnectionFailedLog(user.Username, ip, method, common.ProtocolSSH, err.Error())
@@ -1286,7 +1432,7 @@ func updateLoginMetrics(user *dataprovider.User, ip, method string, err error) {
 		}
 	}
 	metric.AddLoginResult(method, err)
-	dataprovider.ExecutePostLoginHook(user, method, ip, common.ProtocolSSH, err)
+	dataprovider.ExecutePostLoginHook(ctx, user, method, ip, common.ProtocolSSH, err)
 }
 
 type revokedCertificates struct {
@@ -15,10 +15,13 @@
 package sftpd_test
 
 import (
+	"archive/zip"
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/base64"
@@ -32,6 +35,7 @@ import (
 	"math"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path"
@@ -2246,6 +2250,184 @@ func TestLoginUserCert(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestManagedHostKeys(t *testing.T) {
+	u := getTestUser(true)
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+
+	fileHostKey, _, err := getHostKeysNotification(user, ssh.KeyAlgoED25519, false)
+	assert.NoError(t, err)
+	keyBytes, err := util.GeneratePrivateKey("ed25519")
+	assert.NoError(t, err)
+	managedSigner, err := ssh.ParsePrivateKey(keyBytes)
+	assert.NoError(t, err)
+	pendingKeyBytes, err := util.GeneratePrivateKey("ed25519")
+	assert.NoError(t, err)
+	pendingSigner, err := ssh.ParsePrivateKey(pendingKeyBytes)
+	assert.NoError(t, err)
+
+	configs, err := dataprovider.GetConfigs()
+	assert.NoError(t, err)
+	configs.SetNilsToEmpty()
+	configs.SFTPD.HostKeys = []dataprovider.SSHHostKey{
+		{
+			ID:         "managed",
+			PrivateKey: kms.NewPlainSecret(string(keyBytes)),
+		},
+		{
+			ID:         "pending",
+			PrivateKey: kms.NewPlainSecret(string(pendingKeyBytes)),
+			ActivateAt: util.GetTimeAsMsSinceEpoch(time.Now().Add(24 * time.Hour)),
+		},
+	}
+	err = dataprovider.UpdateConfigs(&configs, "", "", "")
+	assert.NoError(t, err)
+	err = sftpd.ReloadHostKeys()
+	assert.NoError(t, err)
+	// the managed key replaces the file based one and the pending key is advertised
+	hostKey, advertised, err := getHostKeysNotification(user, ssh.KeyAlgoED25519, true)
+	assert.NoError(t, err)
+	if assert.NotNil(t, hostKey) {
+		assert.Equal(t, ssh.FingerprintSHA256(managedSigner.PublicKey()), ssh.FingerprintSHA256(hostKey))
+	}
+	var fingerprints []string
+	for _, k := range advertised {
+		fingerprints = append(fingerprints, ssh.FingerprintSHA256(k))
+	}
+	assert.Contains(t, fingerprints, ssh.FingerprintSHA256(managedSigner.PublicKey()))
+	assert.Contains(t, fingerprints, ssh.FingerprintSHA256(pendingSigner.PublicKey()))
+	assert.NotContains(t, fingerprints, ssh.FingerprintSHA256(fileHostKey))
+	// activate the pending key
+	configs, err = dataprovider.GetConfigs()
+	assert.NoError(t, err)
+	configs.SFTPD.HostKeys[0].RetireAt = util.GetTimeAsMsSinceEpoch(time.Now())
+	configs.SFTPD.HostKeys[1].ActivateAt = configs.SFTPD.HostKeys[0].RetireAt
+	err = dataprovider.UpdateConfigs(&configs, "", "", "")
+	assert.NoError(t, err)
+	err = sftpd.ReloadHostKeys()
+	assert.NoError(t, err)
+	hostKey, _, err = getHostKeysNotification(user, ssh.KeyAlgoED25519, false)
+	assert.NoError(t, err)
+	if assert.NotNil(t, hostKey) {
+		assert.Equal(t, ssh.FingerprintSHA256(pendingSigner.PublicKey()), ssh.FingerprintSHA256(hostKey))
+	}
+	// remove the managed keys, the file based key is used again
+	configs, err = dataprovider.GetConfigs()
+	assert.NoError(t, err)
+	configs.SFTPD.HostKeys = nil
+	err = dataprovider.UpdateConfigs(&configs, "", "", "")
+	assert.NoError(t, err)
+	err = sftpd.ReloadHostKeys()
+	assert.NoError(t, err)
+	hostKey, _, err = getHostKeysNotification(user, ssh.KeyAlgoED25519, false)
+	assert.NoError(t, err)
+	if assert.NotNil(t, hostKey) {
+		assert.Equal(t, ssh.FingerprintSHA256(fileHostKey), ssh.FingerprintSHA256(hostKey))
+	}
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestLoginUserCertPerUserCA(t *testing.T) {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(testCertUntrustedCA))
+	assert.NoError(t, err)
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !assert.True(t, ok) {
+		return
+	}
+	caKey := string(ssh.MarshalAuthorizedKey(cert.SignatureKey))
+
+	u := getTestUser(true)
+	u.Filters.TrustedCAKeys = []string{"invalid CA key"}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.TrustedCAKeys = []string{testCertValid}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.TrustedCAKeys = []string{caKey}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	// the CA is trusted for this user
+	signer, err := getSignerForUserCert([]byte(testCertUntrustedCA))
+	assert.NoError(t, err)
+	conn, client, err := getCustomAuthSftpClient(user, []ssh.AuthMethod{ssh.PublicKeys(signer)}, "")
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+		assert.NoError(t, checkBasicSFTP(client))
+	}
+	// the globally trusted CA is still accepted
+	signer, err = getSignerForUserCert([]byte(testCertValid))
+	assert.NoError(t, err)
+	conn, client, err = getCustomAuthSftpClient(user, []ssh.AuthMethod{ssh.PublicKeys(signer)}, "")
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+		assert.NoError(t, checkBasicSFTP(client))
+	}
+	// the username is not mapped anymore
+	user.Filters.CertPrincipals = []string{"admin_%username%"}
+	_, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	conn, client, err = getCustomAuthSftpClient(user, []ssh.AuthMethod{ssh.PublicKeys(signer)}, "")
+	if !assert.Error(t, err) {
+		client.Close()
+		conn.Close()
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	// map the certificate principal to a different username using a group
+	group := getTestGroup()
+	group.UserSettings.CertPrincipals = []string{"test_user_sftp", "%username%"}
+	group, _, err = httpdtest.AddGroup(group, http.StatusCreated)
+	assert.NoError(t, err)
+	u = getTestUser(true)
+	u.Username += "_mapped"
+	u.Groups = []sdk.GroupMapping{
+		{
+			Name: group.Name,
+			Type: sdk.GroupTypePrimary,
+		},
+	}
+	user, _, err = httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	conn, client, err = getCustomAuthSftpClient(user, []ssh.AuthMethod{ssh.PublicKeys(signer)}, "")
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+		assert.NoError(t, checkBasicSFTP(client))
+	}
+	// the CA is not trusted for this user
+	signer, err = getSignerForUserCert([]byte(testCertUntrustedCA))
+	assert.NoError(t, err)
+	conn, client, err = getCustomAuthSftpClient(user, []ssh.AuthMethod{ssh.PublicKeys(signer)}, "")
+	if !assert.Error(t, err) {
+		client.Close()
+		conn.Close()
+	}
+	// now trust the CA at group level
+	group.UserSettings.TrustedCAKeys = []string{caKey}
+	_, _, err = httpdtest.UpdateGroup(group, http.StatusOK)
+	assert.NoError(t, err)
+	conn, client, err = getCustomAuthSftpClient(user, []ssh.AuthMethod{ssh.PublicKeys(signer)}, "")
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+		assert.NoError(t, checkBasicSFTP(client))
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveGroup(group, http.StatusOK)
+	assert.NoError(t, err)
+}
+
 func TestMultiStepLoginKeyAndPwd(t *testing.T) {
 	u := getTestUser(true)
 	u.Password = defaultPassword
@@ -3214,6 +3396,87 @@ func TestPreLoginHookPreserveMFAConfig(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestPreLoginHookCorrelationID(t *testing.T) {
+	if runtime.GOOS == osWindows {
+		t.Skip("this test is not available on Windows")
+	}
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+
+	correlationIDPath := filepath.Join(os.TempDir(), "prelogin_correlation_id")
+	err = os.WriteFile(preLoginPath, []byte(fmt.Sprintf("#!/bin/sh\n\nprintf \"%%s\" \"$%s\" > %s\n",
+		logger.CorrelationIDEnvVar, correlationIDPath)), os.ModePerm)
+	assert.NoError(t, err)
+	err = dataprovider.Close()
+	assert.NoError(t, err)
+	err = config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	providerConf := config.GetProviderConf()
+	providerConf.PreLoginHook = preLoginPath
+	err = dataprovider.Initialize(providerConf, configDir, true)
+	assert.NoError(t, err)
+
+	conn, client, err := getSftpClient(u, usePubKey)
+	if assert.NoError(t, err) {
+		stats := common.Connections.GetStats("")
+		if assert.Len(t, stats, 1) {
+			content, err := os.ReadFile(correlationIDPath)
+			assert.NoError(t, err)
+			assert.NotEmpty(t, content)
+			assert.Contains(t, stats[0].ConnectionID, string(content))
+		}
+		client.Close()
+		conn.Close()
+	}
+	assert.Eventually(t, func() bool {
+		return len(common.Connections.GetStats("")) == 0
+	}, 1*time.Second, 50*time.Millisecond)
+
+	var hookCorrelationID atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hookCorrelationID.Store(r.Header.Get(logger.CorrelationIDHeader))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	err = dataprovider.Close()
+	assert.NoError(t, err)
+	providerConf.PreLoginHook = server.URL
+	err = dataprovider.Initialize(providerConf, configDir, true)
+	assert.NoError(t, err)
+
+	conn, client, err = getSftpClient(u, usePubKey)
+	if assert.NoError(t, err) {
+		stats := common.Connections.GetStats("")
+		if assert.Len(t, stats, 1) {
+			correlationID, ok := hookCorrelationID.Load().(string)
+			assert.True(t, ok)
+			assert.NotEmpty(t, correlationID)
+			assert.Contains(t, stats[0].ConnectionID, correlationID)
+		}
+		client.Close()
+		conn.Close()
+	}
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	err = dataprovider.Close()
+	assert.NoError(t, err)
+	err = config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir, true)
+	assert.NoError(t, err)
+	err = os.Remove(preLoginPath)
+	assert.NoError(t, err)
+	err = os.Remove(correlationIDPath)
+	assert.NoError(t, err)
+}
+
 func TestPreDownloadHook(t *testing.T) {
 	if runtime.GOOS == osWindows {
 		t.Skip("this test is not available on Windows")
@@ -8866,6 +9129,93 @@ func TestSSHCommands(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestSSHCommandsPolicy(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Filters.AllowedSSHCommands = []string{"md5sum", "sha1sum", "pwd"}
+	u.Filters.DeniedSSHCommands = []string{"sftpgo copy"}
+	_, _, err := httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.DeniedSSHCommands = []string{"sha1sum"}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+
+	out, err := runSSHCommand("md5sum", user, usePubKey)
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), "d41d8cd98f00b204e9800998ecf8427e")
+	out, err = runSSHCommand("pwd", user, usePubKey)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "/\n", string(out))
+	}
+	_, err = runSSHCommand("sha1sum", user, usePubKey)
+	assert.Error(t, err, "denied ssh command must fail")
+	_, err = runSSHCommand("sha256sum", user, usePubKey)
+	assert.Error(t, err, "ssh command not allowed must fail")
+
+	user.Filters.SFTPOnly = true
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	_, err = runSSHCommand("md5sum", user, usePubKey)
+	assert.Error(t, err, "ssh commands must fail for SFTP only users")
+	conn, client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+		assert.NoError(t, checkBasicSFTP(client))
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	// the policy is inherited from the groups
+	g1 := getTestGroup()
+	g1.UserSettings.AllowedSSHCommands = []string{"md5sum", "sha256sum", "pwd"}
+	g1.UserSettings.DeniedSSHCommands = []string{"pwd"}
+	group1, _, err := httpdtest.AddGroup(g1, http.StatusCreated)
+	assert.NoError(t, err)
+	g2 := getTestGroup()
+	g2.Name += "_1"
+	g2.UserSettings.DeniedSSHCommands = []string{"sha256sum"}
+	group2, _, err := httpdtest.AddGroup(g2, http.StatusCreated)
+	assert.NoError(t, err)
+	u = getTestUser(usePubKey)
+	u.Groups = []sdk.GroupMapping{
+		{
+			Name: group1.Name,
+			Type: sdk.GroupTypePrimary,
+		},
+		{
+			Name: group2.Name,
+			Type: sdk.GroupTypeSecondary,
+		},
+	}
+	user, _, err = httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	_, err = runSSHCommand("md5sum", user, usePubKey)
+	assert.NoError(t, err)
+	_, err = runSSHCommand("sha1sum", user, usePubKey)
+	assert.Error(t, err)
+	_, err = runSSHCommand("sha256sum", user, usePubKey)
+	assert.Error(t, err)
+	_, err = runSSHCommand("pwd", user, usePubKey)
+	assert.Error(t, err)
+
+	group2.UserSettings.SFTPOnly = true
+	_, _, err = httpdtest.UpdateGroup(group2, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = runSSHCommand("md5sum", user, usePubKey)
+	assert.Error(t, err)
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveGroup(group1, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveGroup(group2, http.StatusOK)
+	assert.NoError(t, err)
+}
+
 func TestSSHFileHash(t *testing.T) {
 	usePubKey := true
 	localUser, _, err := httpdtest.AddUser(getTestUser(usePubKey), http.StatusCreated)
@@ -8922,6 +9272,373 @@ func TestSSHFileHash(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestSFTPCopyExtensions(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 100
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	testFileSize := int64(131073)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	err = createTestFile(testFilePath, testFileSize)
+	assert.NoError(t, err)
+	conn, client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+
+		for _, ext := range []string{"copy-data", "copy-file"} {
+			v, ok := client.HasExtension(ext)
+			assert.True(t, ok, ext)
+			assert.Equal(t, "1", v)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		err = client.Mkdir("adir")
+		assert.NoError(t, err)
+	}
+	rawClient, err := getRawSFTPClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer rawClient.Close()
+
+		readHandle, err := rawClient.open(testFileName, sshFxfRead)
+		assert.NoError(t, err)
+		writeHandle, err := rawClient.open(testFileName+".data", sshFxfWrite|sshFxfCreat|sshFxfTrunc)
+		assert.NoError(t, err)
+		code, err := rawClient.extended("copy-data", struct {
+			ReadHandle  string
+			ReadOffset  uint64
+			ReadLength  uint64
+			WriteHandle string
+			WriteOffset uint64
+		}{readHandle, 0, 0, writeHandle, 0})
+		assert.NoError(t, err)
+		assert.Equal(t, sshFxOk, code)
+		// invalid handle
+		code, err = rawClient.extended("copy-data", struct {
+			ReadHandle  string
+			ReadOffset  uint64
+			ReadLength  uint64
+			WriteHandle string
+			WriteOffset uint64
+		}{"invalid", 0, 0, writeHandle, 0})
+		assert.NoError(t, err)
+		assert.Equal(t, sshFxFailure, code)
+		// the read handle is not writable
+		code, err = rawClient.extended("copy-data", struct {
+			ReadHandle  string
+			ReadOffset  uint64
+			ReadLength  uint64
+			WriteHandle string
+			WriteOffset uint64
+		}{readHandle, 0, 0, readHandle, 0})
+		assert.NoError(t, err)
+		assert.Equal(t, sshFxFailure, code)
+		// partial copy appended at the end of the target file
+		code, err = rawClient.extended("copy-data", struct {
+			ReadHandle  string
+			ReadOffset  uint64
+			ReadLength  uint64
+			WriteHandle string
+			WriteOffset uint64
+		}{readHandle, 100, 1000, writeHandle, uint64(testFileSize)})
+		assert.NoError(t, err)
+		assert.Equal(t, sshFxOk, code)
+		assert.NoError(t, rawClient.close(readHandle))
+		assert.NoError(t, rawClient.close(writeHandle))
+
+		code, err = rawClient.extended("copy-file", struct {
+			Source      string
+			Destination string
+			Overwrite   bool
+		}{testFileName, "/adir/" + testFileName, false})
+		assert.NoError(t, err)
+		assert.Equal(t, sshFxOk, code)
+		code, err = rawClient.extended("copy-file", struct {
+			Source      string
+			Destination string
+			Overwrite   bool
+		}{testFileName, "/adir/" + testFileName, false})
+		assert.NoError(t, err)
+		assert.Equal(t, sshFxFailure, code)
+		code, err = rawClient.extended("copy-file", struct {
+			Source      string
+			Destination string
+			Overwrite   bool
+		}{testFileName + ".data", "/adir/" + testFileName, true})
+		assert.NoError(t, err)
+		assert.Equal(t, sshFxOk, code)
+		code, err = rawClient.extended("copy-file", struct {
+			Source      string
+			Destination string
+			Overwrite   bool
+		}{testFileName, "/adir", true})
+		assert.NoError(t, err)
+		assert.Equal(t, sshFxOPUnsupported, code)
+		code, err = rawClient.extended("copy-file", struct {
+			Source      string
+			Destination string
+			Overwrite   bool
+		}{"/adir", "/adir1", true})
+		assert.NoError(t, err)
+		assert.Equal(t, sshFxOPUnsupported, code)
+		code, err = rawClient.extended("copy-file", struct {
+			Source      string
+			Destination string
+			Overwrite   bool
+		}{"missing", "/adir1", true})
+		assert.NoError(t, err)
+		assert.Equal(t, sshFxNoSuchFile, code)
+		code, err = rawClient.extended("unknown@example.com", struct{ Data string }{"data"})
+		assert.NoError(t, err)
+		assert.Equal(t, sshFxOPUnsupported, code)
+	}
+	info, err := os.Stat(filepath.Join(user.GetHomeDir(), testFileName+".data"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, testFileSize+1000, info.Size())
+	}
+	info, err = os.Stat(filepath.Join(user.GetHomeDir(), "adir", testFileName))
+	if assert.NoError(t, err) {
+		assert.Equal(t, testFileSize+1000, info.Size())
+	}
+	user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, user.UsedQuotaFiles)
+	assert.Equal(t, 3*testFileSize+2000, user.UsedQuotaSize)
+
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestSFTPFileOperationExtensions(t *testing.T) {
+	usePubKey := false
+	user, _, err := httpdtest.AddUser(getTestUser(usePubKey), http.StatusCreated)
+	assert.NoError(t, err)
+	testFileSize := int64(65535)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	err = createTestFile(testFilePath, testFileSize)
+	assert.NoError(t, err)
+	conn, client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+
+		for _, ext := range []string{"file-operation@sftpgo.com", "file-operation-status@sftpgo.com"} {
+			_, ok := client.HasExtension(ext)
+			assert.True(t, ok, ext)
+		}
+		err = client.MkdirAll("adir/sub")
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, "adir/sub/"+testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, "adir/"+testFileName, testFileSize, client)
+		assert.NoError(t, err)
+	}
+	type fileOperationStatus struct {
+		Status string
+		Files  uint64
+		Size   uint64
+		Error  string
+	}
+	waitForOperation := func(client *rawSFTPClient, id string) fileOperationStatus {
+		var status fileOperationStatus
+		assert.Eventually(t, func() bool {
+			err := client.extendedReply("file-operation-status@sftpgo.com", struct{ ID string }{id}, &status)
+			return err == nil && status.Status != common.FileOperationStatusRunning
+		}, 2*time.Second, 50*time.Millisecond)
+		return status
+	}
+	rawClient, err := getRawSFTPClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer rawClient.Close()
+
+		var reply struct {
+			ID string
+		}
+		err = rawClient.extendedReply("file-operation@sftpgo.com", struct {
+			Type   string
+			Source string
+			Target string
+		}{common.FileOperationCopy, "adir", "bdir"}, &reply)
+		assert.NoError(t, err)
+		status := waitForOperation(rawClient, reply.ID)
+		assert.Equal(t, common.FileOperationStatusCompleted, status.Status)
+		assert.Equal(t, uint64(2), status.Files)
+		assert.Equal(t, uint64(2*testFileSize), status.Size)
+
+		err = rawClient.extendedReply("file-operation@sftpgo.com", struct {
+			Type   string
+			Source string
+			Target string
+		}{common.FileOperationMove, "/bdir", "/cdir"}, &reply)
+		assert.NoError(t, err)
+		status = waitForOperation(rawClient, reply.ID)
+		assert.Equal(t, common.FileOperationStatusCompleted, status.Status)
+
+		err = rawClient.extendedReply("file-operation@sftpgo.com", struct {
+			Type   string
+			Source string
+			Target string
+		}{common.FileOperationDelete, "/cdir", ""}, &reply)
+		assert.NoError(t, err)
+		status = waitForOperation(rawClient, reply.ID)
+		assert.Equal(t, common.FileOperationStatusCompleted, status.Status)
+
+		err = rawClient.extendedReply("file-operation@sftpgo.com", struct {
+			Type   string
+			Source string
+			Target string
+		}{common.FileOperationDelete, "/missing", ""}, &reply)
+		assert.NoError(t, err)
+		status = waitForOperation(rawClient, reply.ID)
+		assert.Equal(t, common.FileOperationStatusFailed, status.Status)
+		assert.NotEmpty(t, status.Error)
+
+		err = rawClient.extendedReply("file-operation@sftpgo.com", struct {
+			Type   string
+			Source string
+			Target string
+		}{"unsupported", "/adir", "/ddir"}, &reply)
+		assert.Error(t, err)
+		err = rawClient.extendedReply("file-operation@sftpgo.com", struct {
+			Type   string
+			Source string
+			Target string
+		}{common.FileOperationDelete, "/", ""}, &reply)
+		assert.Error(t, err)
+		code, err := rawClient.extended("file-operation-status@sftpgo.com", struct{ ID string }{"missing"})
+		assert.NoError(t, err)
+		assert.Equal(t, sshFxNoSuchFile, code)
+	}
+	_, err = os.Stat(filepath.Join(user.GetHomeDir(), "adir", "sub", testFileName))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(user.GetHomeDir(), "bdir"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = os.Stat(filepath.Join(user.GetHomeDir(), "cdir"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestSFTPCheckFileExtensions(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Filters.StoreChecksums = true
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	testFileSize := int64(65535)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	err = createTestFile(testFilePath, testFileSize)
+	assert.NoError(t, err)
+	content, err := os.ReadFile(testFilePath)
+	assert.NoError(t, err)
+	conn, client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+
+		for _, ext := range []string{"check-file-name", "check-file-handle"} {
+			v, ok := client.HasExtension(ext)
+			assert.True(t, ok, ext)
+			assert.Contains(t, v, "sha256")
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		err = client.Mkdir("adir")
+		assert.NoError(t, err)
+	}
+	type checkFileRequest struct {
+		Name        string
+		HashAlgos   string
+		StartOffset uint64
+		Length      uint64
+		BlockSize   uint32
+	}
+	type checkFileReply struct {
+		Type     string
+		HashAlgo string
+		Hash     []byte `ssh:"rest"`
+	}
+	sha256Sum := sha256.Sum256(content)
+	md5Sum := md5.Sum(content[100:1100])
+	rawClient, err := getRawSFTPClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer rawClient.Close()
+
+		var reply checkFileReply
+		err = rawClient.extendedReply("check-file-name", checkFileRequest{testFileName, "crc32,sha256", 0, 0, 0}, &reply)
+		assert.NoError(t, err)
+		assert.Equal(t, "check-file", reply.Type)
+		assert.Equal(t, "sha256", reply.HashAlgo)
+		assert.Equal(t, sha256Sum[:], reply.Hash)
+		err = rawClient.extendedReply("check-file-name", checkFileRequest{"/" + testFileName, "md5", 100, 1000, 0}, &reply)
+		assert.NoError(t, err)
+		assert.Equal(t, "md5", reply.HashAlgo)
+		assert.Equal(t, md5Sum[:], reply.Hash)
+		// one hash for each block, the last block is shorter
+		err = rawClient.extendedReply("check-file-name", checkFileRequest{testFileName, "sha1", 0, 0, 32768}, &reply)
+		assert.NoError(t, err)
+		assert.Equal(t, "sha1", reply.HashAlgo)
+		block1 := sha1.Sum(content[:32768])
+		block2 := sha1.Sum(content[32768:])
+		assert.Equal(t, append(block1[:], block2[:]...), reply.Hash)
+
+		handle, err := rawClient.open(testFileName, sshFxfRead)
+		assert.NoError(t, err)
+		err = rawClient.extendedReply("check-file-handle", checkFileRequest{handle, "md5,sha256", 100, 1000, 0}, &reply)
+		assert.NoError(t, err)
+		assert.Equal(t, "md5", reply.HashAlgo)
+		assert.Equal(t, md5Sum[:], reply.Hash)
+		err = rawClient.extendedReply("check-file-handle", checkFileRequest{handle, "sha256", 0, 0, 0}, &reply)
+		assert.NoError(t, err)
+		assert.Equal(t, sha256Sum[:], reply.Hash)
+		assert.NoError(t, rawClient.close(handle))
+
+		code, err := rawClient.extended("check-file-handle", checkFileRequest{"invalid", "sha256", 0, 0, 0})
+		assert.NoError(t, err)
+		assert.Equal(t, sshFxFailure, code)
+		code, err = rawClient.extended("check-file-name", checkFileRequest{testFileName, "crc32", 0, 0, 0})
+		assert.NoError(t, err)
+		assert.Equal(t, sshFxOPUnsupported, code)
+		code, err = rawClient.extended("check-file-name", checkFileRequest{testFileName, "sha256", 0, 0, 100})
+		assert.NoError(t, err)
+		assert.Equal(t, sshFxFailure, code)
+		code, err = rawClient.extended("check-file-name", checkFileRequest{"missing", "sha256", 0, 0, 0})
+		assert.NoError(t, err)
+		assert.Equal(t, sshFxNoSuchFile, code)
+		code, err = rawClient.extended("check-file-name", checkFileRequest{"adir", "sha256", 0, 0, 0})
+		assert.NoError(t, err)
+		assert.Equal(t, sshFxFailure, code)
+
+		// the stored checksum is returned without reading the file
+		err = os.WriteFile(filepath.Join(user.GetHomeDir(), testFileName), make([]byte, testFileSize), os.ModePerm)
+		assert.NoError(t, err)
+		err = rawClient.extendedReply("check-file-name", checkFileRequest{testFileName, "sha256", 0, 0, 0}, &reply)
+		assert.NoError(t, err)
+		assert.Equal(t, sha256Sum[:], reply.Hash)
+		err = rawClient.extendedReply("check-file-name", checkFileRequest{testFileName, "sha256", 0, 0, 65536}, &reply)
+		assert.NoError(t, err)
+		zeroSum := sha256.Sum256(make([]byte, testFileSize))
+		assert.Equal(t, zeroSum[:], reply.Hash)
+	}
+
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestSSHCopy(t *testing.T) {
 	usePubKey := true
 	u := getTestUser(usePubKey)
@@ -9513,6 +10230,73 @@ func TestSSHRemove(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestSSHExtract(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 3
+	u.Permissions["/denied"] = []string{dataprovider.PermListItems, dataprovider.PermDownload}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	conn, client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+
+		buf := bytes.NewBuffer(nil)
+		zipWriter := zip.NewWriter(buf)
+		for _, name := range []string{"dir/file1.txt", "dir/sub/file2.txt"} {
+			w, err := zipWriter.Create(name)
+			assert.NoError(t, err)
+			_, err = w.Write([]byte("content"))
+			assert.NoError(t, err)
+		}
+		err = zipWriter.Close()
+		assert.NoError(t, err)
+		archivePath := filepath.Join(homeBasePath, "archive.zip")
+		err = os.WriteFile(archivePath, buf.Bytes(), os.ModePerm)
+		assert.NoError(t, err)
+		archiveSize := int64(buf.Len())
+		err = sftpUploadFile(archivePath, "archive.zip", archiveSize, client)
+		assert.NoError(t, err)
+
+		_, err = runSSHCommand("sftpgo-extract archive.zip", user, usePubKey)
+		assert.Error(t, err)
+		_, err = runSSHCommand("sftpgo-extract archive.zip /denied", user, usePubKey)
+		assert.Error(t, err)
+		_, err = runSSHCommand("sftpgo-extract missing.zip /dst", user, usePubKey)
+		assert.Error(t, err)
+		out, err := runSSHCommand("sftpgo-extract archive.zip /dst", user, usePubKey)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "OK\n", string(out))
+		}
+		info, err := client.Stat(path.Join("/dst", "dir", "sub", "file2.txt"))
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(7), info.Size())
+		}
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, user.UsedQuotaFiles)
+		assert.Equal(t, archiveSize+14, user.UsedQuotaSize)
+		// overwriting existing files is allowed
+		_, err = runSSHCommand("sftpgo-extract archive.zip /dst", user, usePubKey)
+		assert.NoError(t, err)
+		// the files quota is exceeded
+		_, err = runSSHCommand("sftpgo-extract archive.zip /dst1", user, usePubKey)
+		assert.Error(t, err)
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, user.UsedQuotaFiles)
+		assert.Equal(t, archiveSize+14, user.UsedQuotaSize)
+
+		err = os.Remove(archivePath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestSSHRemoveCryptFs(t *testing.T) {
 	usePubKey := false
 	u := getTestUserWithCryptFs(usePubKey)
@@ -11010,6 +11794,190 @@ func runSSHCommand(command string, user dataprovider.User, usePubKey bool) ([]by
 	return stdout.Bytes(), err
 }
 
+const (
+	sshFxOk            = uint32(0)
+	sshFxNoSuchFile    = uint32(2)
+	sshFxFailure       = uint32(4)
+	sshFxOPUnsupported = uint32(8)
+
+	sshFxfRead  = uint32(0x00000001)
+	sshFxfWrite = uint32(0x00000002)
+	sshFxfCreat = uint32(0x00000008)
+	sshFxfTrunc = uint32(0x00000010)
+)
+
+// rawSFTPClient allows to send SFTP packets not supported by the SFTP client library
+type rawSFTPClient struct {
+	conn    *ssh.Client
+	session *ssh.Session
+	w       io.WriteCloser
+	r       io.Reader
+	id      uint32
+}
+
+func getRawSFTPClient(user dataprovider.User, usePubKey bool) (*rawSFTPClient, error) {
+	config := &ssh.ClientConfig{
+		User: user.Username,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return nil
+		},
+		Timeout: 5 * time.Second,
+	}
+	if usePubKey {
+		key, err := ssh.ParsePrivateKey([]byte(testPrivateKey))
+		if err != nil {
+			return nil, err
+		}
+		config.Auth = []ssh.AuthMethod{ssh.PublicKeys(key)}
+	} else {
+		config.Auth = []ssh.AuthMethod{ssh.Password(defaultPassword)}
+	}
+	conn, err := ssh.Dial("tcp", sftpServerAddr, config)
+	if err != nil {
+		return nil, err
+	}
+	c := &rawSFTPClient{conn: conn}
+	c.session, err = conn.NewSession()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.w, err = c.session.StdinPipe()
+	if err == nil {
+		c.r, err = c.session.StdoutPipe()
+	}
+	if err == nil {
+		err = c.session.RequestSubsystem("sftp")
+	}
+	if err == nil {
+		// SSH_FXP_INIT, version 3
+		err = c.writePacket([]byte{1, 0, 0, 0, 3})
+	}
+	if err == nil {
+		var pkt []byte
+		pkt, err = c.readPacket()
+		if err == nil && pkt[0] != 2 {
+			err = fmt.Errorf("unexpected packet type %d", pkt[0])
+		}
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *rawSFTPClient) writePacket(data []byte) error {
+	pkt := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	_, err := c.w.Write(append(pkt, data...))
+	return err
+}
+
+func (c *rawSFTPClient) readPacket() ([]byte, error) {
+	var length uint32
+	if err := binary.Read(c.r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	pkt := make([]byte, length)
+	_, err := io.ReadFull(c.r, pkt)
+	return pkt, err
+}
+
+// sendRequest sends a request with the specified packet type and payload and
+// returns the response type and payload
+func (c *rawSFTPClient) sendRequest(pktType byte, payload []byte) (byte, []byte, error) {
+	c.id++
+	data := binary.BigEndian.AppendUint32([]byte{pktType}, c.id)
+	if err := c.writePacket(append(data, payload...)); err != nil {
+		return 0, nil, err
+	}
+	pkt, err := c.readPacket()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(pkt) < 5 || binary.BigEndian.Uint32(pkt[1:]) != c.id {
+		return 0, nil, errors.New("unexpected response")
+	}
+	return pkt[0], pkt[5:], nil
+}
+
+func (c *rawSFTPClient) getStatusCode(pktType byte, payload []byte, err error) (uint32, error) {
+	if err != nil {
+		return 0, err
+	}
+	if pktType != 101 || len(payload) < 4 {
+		return 0, fmt.Errorf("unexpected response type %d", pktType)
+	}
+	return binary.BigEndian.Uint32(payload), nil
+}
+
+func (c *rawSFTPClient) open(name string, pflags uint32) (string, error) {
+	pktType, payload, err := c.sendRequest(3, ssh.Marshal(struct {
+		Name   string
+		PFlags uint32
+		Flags  uint32
+	}{name, pflags, 0}))
+	if err != nil {
+		return "", err
+	}
+	if pktType != 102 {
+		code, err := c.getStatusCode(pktType, payload, nil)
+		if err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("unable to open %q, status code: %d", name, code)
+	}
+	var handle struct {
+		Handle string
+	}
+	err = ssh.Unmarshal(payload, &handle)
+	return handle.Handle, err
+}
+
+func (c *rawSFTPClient) close(handle string) error {
+	code, err := c.getStatusCode(c.sendRequest(4, ssh.Marshal(struct{ Handle string }{handle})))
+	if err != nil {
+		return err
+	}
+	if code != sshFxOk {
+		return fmt.Errorf("unable to close handle, status code: %d", code)
+	}
+	return nil
+}
+
+// extended sends an SSH_FXP_EXTENDED request and returns the status code
+func (c *rawSFTPClient) extended(name string, request any) (uint32, error) {
+	payload := ssh.Marshal(struct{ Name string }{name})
+	payload = append(payload, ssh.Marshal(request)...)
+	return c.getStatusCode(c.sendRequest(200, payload))
+}
+
+// extendedReply sends an SSH_FXP_EXTENDED request and decodes the
+// SSH_FXP_EXTENDED_REPLY response into reply
+func (c *rawSFTPClient) extendedReply(name string, request, reply any) error {
+	payload := ssh.Marshal(struct{ Name string }{name})
+	payload = append(payload, ssh.Marshal(request)...)
+	pktType, data, err := c.sendRequest(200, payload)
+	if err != nil {
+		return err
+	}
+	if pktType != 201 {
+		code, err := c.getStatusCode(pktType, data, nil)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("extended request %q failed, status code: %d", name, code)
+	}
+	return ssh.Unmarshal(data, reply)
+}
+
+func (c *rawSFTPClient) Close() error {
+	if c.session != nil {
+		c.session.Close()
+	}
+	return c.conn.Close()
+}
+
 func getSignerForUserCert(certBytes []byte) (ssh.Signer, error) {
 	signer, err := ssh.ParsePrivateKey([]byte(testPrivateKey))
 	if err != nil {
@@ -11088,6 +12056,101 @@ func getKeyboardInteractiveSftpClient(user dataprovider.User, answers []string)
 	return conn, sftpClient, err
 }
 
+// getHostKeysNotification returns the host key used for the handshake and, if
+// waitNotification is true, the host keys advertised by the server after
+// verifying their ownership
+func getHostKeysNotification(user dataprovider.User, hostKeyAlgo string, waitNotification bool,
+) (ssh.PublicKey, []ssh.PublicKey, error) {
+	signer, err := ssh.ParsePrivateKey([]byte(testPrivateKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	var hostKey ssh.PublicKey
+	config := &ssh.ClientConfig{
+		User: user.Username,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return nil
+		},
+		HostKeyAlgorithms: []string{hostKeyAlgo},
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		Timeout:           5 * time.Second,
+	}
+	netConn, err := net.Dial("tcp", sftpServerAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, chans, reqs, err := ssh.NewClientConn(netConn, sftpServerAddr, config)
+	if err != nil {
+		netConn.Close()
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	go func() {
+		for ch := range chans {
+			ch.Reject(ssh.Prohibited, "unsupported") //nolint:errcheck
+		}
+	}()
+	if !waitNotification {
+		go ssh.DiscardRequests(reqs)
+		return hostKey, nil, nil
+	}
+	var notification *ssh.Request
+	select {
+	case notification = <-reqs:
+	case <-time.After(5 * time.Second):
+		return hostKey, nil, errors.New("host keys notification not received")
+	}
+	go ssh.DiscardRequests(reqs)
+	if notification.Type != "hostkeys-00@openssh.com" {
+		return hostKey, nil, fmt.Errorf("unexpected request %q", notification.Type)
+	}
+	var keys []ssh.PublicKey
+	var blobs [][]byte
+	payload := notification.Payload
+	for len(payload) > 0 {
+		length := binary.BigEndian.Uint32(payload)
+		blobs = append(blobs, payload[4:4+length])
+		payload = payload[4+length:]
+	}
+	for _, blob := range blobs {
+		key, err := ssh.ParsePublicKey(blob)
+		if err != nil {
+			return hostKey, nil, err
+		}
+		keys = append(keys, key)
+	}
+	ok, resp, err := conn.SendRequest("hostkeys-prove-00@openssh.com", true, notification.Payload)
+	if err != nil {
+		return hostKey, nil, err
+	}
+	if !ok {
+		return hostKey, nil, errors.New("unable to prove host keys")
+	}
+	for idx, key := range keys {
+		length := binary.BigEndian.Uint32(resp)
+		var sig ssh.Signature
+		if err := ssh.Unmarshal(resp[4:4+length], &sig); err != nil {
+			return hostKey, nil, err
+		}
+		resp = resp[4+length:]
+		data := ssh.Marshal(struct {
+			Request   string
+			SessionID []byte
+			Key       []byte
+		}{
+			Request:   "hostkeys-prove-00@openssh.com",
+			SessionID: conn.SessionID(),
+			Key:       blobs[idx],
+		})
+		if err := key.Verify(data, &sig); err != nil {
+			return hostKey, nil, fmt.Errorf("invalid proof for key %q: %w", ssh.FingerprintSHA256(key), err)
+		}
+	}
+	return hostKey, keys, nil
+}
+
 func getCustomAuthSftpClient(user dataprovider.User, authMethods []ssh.AuthMethod, addr string) (*ssh.Client, *sftp.Client, error) {
 	var sftpClient *sftp.Client
 	config := &ssh.ClientConfig{
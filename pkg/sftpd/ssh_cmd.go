@@ -91,7 +91,9 @@ func processSSHCommand(payload []byte, connection *Connection, enabledSSHCommand
 		name, args, err := parseCommandPayload(msg.Command)
 		connection.Log(logger.LevelDebug, "new ssh command: %q args: %v num args: %d user: %s, error: %v",
 			name, args, len(args), connection.User.Username, err)
-		if err == nil && util.Contains(enabledSSHCommands, name) {
+		if err == nil && util.Contains(enabledSSHCommands, name) && !connection.User.IsSSHCommandAllowed(name) {
+			connection.Log(logger.LevelInfo, "ssh command %q not allowed for user %q", name, connection.User.Username)
+		} else if err == nil && util.Contains(enabledSSHCommands, name) {
 			connection.command = msg.Command
 			if name == scpCmdName && len(args) >= 2 {
 				connection.SetProtocol(common.ProtocolSCP)
@@ -157,6 +159,8 @@ func (c *sshCommand) handle() (err error) {
 		return c.handleSFTPGoCopy()
 	} else if c.command == "sftpgo-remove" {
 		return c.handleSFTPGoRemove()
+	} else if c.command == "sftpgo-extract" {
+		return c.handleSFTPGoExtract()
 	}
 	return
 }
@@ -189,6 +193,21 @@ func (c *sshCommand) handleSFTPGoRemove() error {
 	return nil
 }
 
+func (c *sshCommand) handleSFTPGoExtract() error {
+	sshSourcePath := c.getSourcePath()
+	sshDestPath := c.getDestPath()
+	if sshSourcePath == "" || sshDestPath == "" || len(c.args) != 2 {
+		return c.sendErrorResponse(errors.New("usage sftpgo-extract <archive path> <destination dir path>"))
+	}
+	c.connection.Log(logger.LevelDebug, "requested extract %q -> %q", sshSourcePath, sshDestPath)
+	if err := c.connection.Extract(sshSourcePath, sshDestPath); err != nil {
+		return c.sendErrorResponse(err)
+	}
+	c.connection.channel.Write([]byte("OK\n")) //nolint:errcheck
+	c.sendExitStatus(nil)
+	return nil
+}
+
 func (c *sshCommand) updateQuota(sshDestPath string, filesNum int, filesSize int64) {
 	vfolder, err := c.connection.User.GetVirtualFolderForPath(sshDestPath)
 	if err == nil {
@@ -237,9 +256,16 @@ func (c *sshCommand) handleHashCommands() error {
 		if !c.connection.User.HasPerm(dataprovider.PermListItems, sshPath) {
 			return c.sendErrorResponse(c.connection.GetPermissionDeniedError())
 		}
-		hash, err := c.computeHashForFile(fs, h, fsPath)
-		if err != nil {
-			return c.sendErrorResponse(c.connection.GetFsError(fs, err))
+		// the SHA-256 checksum stored while uploading is returned without reading the file
+		hash := ""
+		if c.command == "sha256sum" {
+			hash = c.connection.GetStoredChecksum(fs, fsPath, sshPath)
+		}
+		if hash == "" {
+			hash, err = c.computeHashForFile(fs, h, fsPath)
+			if err != nil {
+				return c.sendErrorResponse(c.connection.GetFsError(fs, err))
+			}
 		}
 		response = fmt.Sprintf("%v  %v\n", hash, sshPath)
 	}
@@ -347,6 +373,16 @@ func (c *sshCommand) executeSystemCommand(command systemCommand) error {
 
 func (c *sshCommand) isSystemCommandAllowed() error {
 	sshDestPath := c.getDestPath()
+	if c.connection.IsWORMEnabled(sshDestPath) {
+		c.connection.Log(logger.LevelDebug, "command %q is not allowed inside WORM folders, path %q, user %q",
+			c.command, sshDestPath, c.connection.User.Username)
+		return errUnsupportedConfig
+	}
+	if c.connection.IsMIMEPolicyEnabled(sshDestPath) {
+		c.connection.Log(logger.LevelDebug, "command %q is not allowed inside folders with a MIME policy, path %q, user %q",
+			c.command, sshDestPath, c.connection.User.Username)
+		return errUnsupportedConfig
+	}
 	if c.connection.User.IsVirtualFolder(sshDestPath) {
 		// overlapped virtual path are not allowed
 		return nil
@@ -536,7 +572,7 @@ func (c *sshCommand) sendExitStatus(err error) {
 	cmdPath := ""
 	targetPath := ""
 	vTargetPath := ""
-	if c.command == "sftpgo-copy" {
+	if c.command == "sftpgo-copy" || c.command == "sftpgo-extract" {
 		vTargetPath = vCmdPath
 		vCmdPath = c.getSourcePath()
 	}
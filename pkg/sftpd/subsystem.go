@@ -75,7 +75,9 @@ func ServeSubSystemConnection(user *dataprovider.User, connectionID string, read
 
 	dataprovider.UpdateLastLogin(user)
 	sftp.SetSFTPExtensions(sftpExtensions...) //nolint:errcheck
-	server := sftp.NewRequestServer(connection.channel, sftp.Handlers{
+	sftpChannel := newExtendedChannel(newCaptureChannel(connection.channel, connection), connection,
+		sftpExtendedRequests, "", connectionID)
+	server := sftp.NewRequestServer(sftpChannel, sftp.Handlers{
 		FileGet:  connection,
 		FilePut:  connection,
 		FileCmd:  connection,
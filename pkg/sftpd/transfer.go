@@ -131,9 +131,9 @@ func (t *transfer) WriteAt(p []byte, off int64) (n int, err error) {
 		t.TransferError(err)
 		return 0, err
 	}
-
-	n, err = t.writerAt.WriteAt(p, off)
+	n, err = t.WriteUploadContentAt(t.writerAt, p, off)
 	t.BytesReceived.Add(int64(n))
+	t.UpdateChecksum(p[:n], off)
 
 	if err == nil {
 		err = t.CheckWrite()
@@ -156,6 +156,12 @@ func (t *transfer) Close() error {
 	if err := t.setFinished(); err != nil {
 		return err
 	}
+	if t.writerAt != nil {
+		// the data buffered to detect the content type must be written before closing
+		if err := t.FlushUploadContentAt(t.writerAt); err != nil {
+			t.TransferError(err)
+		}
+	}
 	err := t.closeIO()
 	errBaseClose := t.BaseTransfer.Close()
 	if errBaseClose != nil {
@@ -205,7 +211,14 @@ func (t *transfer) copyFromReaderToWriter(dst io.Writer, src io.Reader) (int64,
 		return 0, common.ErrQuotaExceeded
 	}
 	isDownload := t.GetType() == common.TransferDownload
-	buf := make([]byte, 32768)
+	buffer, err := t.Connection.GetTransferBuffer()
+	if err != nil {
+		t.TransferError(err)
+		return 0, err
+	}
+	defer buffer.Release()
+
+	buf := buffer.Buf
 	for {
 		t.Connection.UpdateLastActivity()
 		nr, er := src.Read(buf)
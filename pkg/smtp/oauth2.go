@@ -52,6 +52,8 @@ type OAuth2Config struct {
 	mu           *sync.RWMutex
 	config       *oauth2.Config
 	accessToken  *oauth2.Token
+	// role defining this configuration, empty for the global configuration
+	role string
 }
 
 // Validate validates and initializes the configuration
@@ -121,7 +123,11 @@ func (c *OAuth2Config) getAccessToken() (string, error) {
 		c.mu.Unlock()
 
 		logger.Debug(logSender, "", "oauth2 refresh token changed")
-		go updateRefreshToken(refreshToken)
+		if c.role != "" {
+			go updateRoleRefreshToken(c.role, refreshToken)
+		} else {
+			go updateRefreshToken(refreshToken)
+		}
 	}
 	if accessToken != token.AccessToken {
 		c.mu.Lock()
@@ -0,0 +1,134 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package smtp
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/wneessen/go-mail"
+
+	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
+	"github.com/drakkan/sftpgo/v2/pkg/kms"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+var roleConfigs = &roleConfigsCache{
+	configs: make(map[string]roleConfig),
+}
+
+type roleConfig struct {
+	updatedAt int64
+	config    *Config
+}
+
+// roleConfigsCache caches the SMTP configurations defined within tenant roles,
+// a cached configuration is replaced if the role is updated
+type roleConfigsCache struct {
+	sync.RWMutex
+	configs map[string]roleConfig
+}
+
+func (c *roleConfigsCache) get(roleName string) (*Config, error) {
+	if roleName == "" {
+		return nil, util.NewRecordNotFoundError("no role specified")
+	}
+	role, err := dataprovider.RoleExists(roleName)
+	if err != nil {
+		return nil, err
+	}
+	if !role.HasTenantSMTP() {
+		c.remove(roleName)
+		return nil, util.NewRecordNotFoundError("smtp not configured for role " + roleName)
+	}
+
+	c.RLock()
+	cached, ok := c.configs[roleName]
+	c.RUnlock()
+
+	if ok && cached.updatedAt == role.UpdatedAt {
+		return cached.config, nil
+	}
+	if err := role.Tenant.SMTP.TryDecrypt(); err != nil {
+		logger.Error(logSender, "", "unable to decrypt smtp config for role %q: %v", roleName, err)
+		return nil, err
+	}
+	config := newConfigFromProvider(role.Tenant.SMTP)
+	config.OAuth2.role = roleName
+
+	c.Lock()
+	c.configs[roleName] = roleConfig{
+		updatedAt: role.UpdatedAt,
+		config:    config,
+	}
+	c.Unlock()
+
+	logger.Debug(logSender, "", "loaded smtp config for role %q, server %s:%d", roleName, config.Host, config.Port)
+	return config, nil
+}
+
+func (c *roleConfigsCache) remove(roleName string) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.configs, roleName)
+}
+
+// IsEnabledForRole returns true if an SMTP server is configured for the specified
+// role or globally
+func IsEnabledForRole(role string) bool {
+	if role != "" {
+		if _, err := roleConfigs.get(role); err == nil {
+			return true
+		}
+	}
+	return IsEnabled()
+}
+
+// SendEmailForRole sends an email using the SMTP configuration defined for the specified
+// role, if any, or the global one
+func SendEmailForRole(role string, to, bcc []string, subject, body string, contentType EmailContentType,
+	attachments ...*mail.File,
+) error {
+	if role != "" {
+		config, err := roleConfigs.get(role)
+		if err == nil {
+			return config.SendEmail(to, bcc, subject, body, contentType, attachments...)
+		}
+		if !errors.Is(err, util.ErrNotFound) {
+			return err
+		}
+	}
+	return SendEmail(to, bcc, subject, body, contentType, attachments...)
+}
+
+func updateRoleRefreshToken(roleName, token string) {
+	role, err := dataprovider.RoleExists(roleName)
+	if err != nil {
+		logger.Error(logSender, "", "unable to load role %q, updating refresh token not possible: %v", roleName, err)
+		return
+	}
+	if !role.HasTenantSMTP() {
+		logger.Warn(logSender, "", "unable to update refresh token, smtp not configured for role %q", roleName)
+		return
+	}
+	role.Tenant.SMTP.OAuth2.RefreshToken = kms.NewPlainSecret(token)
+	if err := dataprovider.UpdateRole(&role, dataprovider.ActionExecutorSystem, "", ""); err != nil {
+		logger.Error(logSender, "", "unable to save new refresh token for role %q: %v", roleName, err)
+		return
+	}
+	logger.Info(logSender, "", "refresh token updated for role %q", roleName)
+}
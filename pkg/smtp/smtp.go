@@ -52,6 +52,12 @@ const (
 	templateEmailDir           = "email"
 	templatePasswordReset      = "reset-password.html"
 	templatePasswordExpiration = "password-expiration.html"
+	templatePubKeyExpiration   = "public-key-expiration.html"
+	templateShareUsage         = "share-usage.html"
+	templateShareExpiration    = "share-expiration.html"
+	templateShareFileRequest   = "share-file-request.html"
+	templateRegistrationReview = "registration-review.html"
+	templateRegistrationResult = "registration-result.html"
 	dialTimeout                = 10 * time.Second
 )
 
@@ -73,28 +79,35 @@ func (c *activeConfig) isEnabled() bool {
 	return c.config != nil && c.config.Host != ""
 }
 
+// newConfigFromProvider returns a Config from the specified provider configuration,
+// the secrets must be already decrypted
+func newConfigFromProvider(cfg *dataprovider.SMTPConfigs) *Config {
+	config := &Config{
+		Host:       cfg.Host,
+		Port:       cfg.Port,
+		From:       cfg.From,
+		User:       cfg.User,
+		Password:   cfg.Password.GetPayload(),
+		AuthType:   cfg.AuthType,
+		Encryption: cfg.Encryption,
+		Domain:     cfg.Domain,
+		Debug:      cfg.Debug,
+		OAuth2: OAuth2Config{
+			Provider:     cfg.OAuth2.Provider,
+			Tenant:       cfg.OAuth2.Tenant,
+			ClientID:     cfg.OAuth2.ClientID,
+			ClientSecret: cfg.OAuth2.ClientSecret.GetPayload(),
+			RefreshToken: cfg.OAuth2.RefreshToken.GetPayload(),
+		},
+	}
+	config.OAuth2.initialize()
+	return config
+}
+
 func (c *activeConfig) Set(cfg *dataprovider.SMTPConfigs) {
 	var config *Config
 	if cfg != nil {
-		config = &Config{
-			Host:       cfg.Host,
-			Port:       cfg.Port,
-			From:       cfg.From,
-			User:       cfg.User,
-			Password:   cfg.Password.GetPayload(),
-			AuthType:   cfg.AuthType,
-			Encryption: cfg.Encryption,
-			Domain:     cfg.Domain,
-			Debug:      cfg.Debug,
-			OAuth2: OAuth2Config{
-				Provider:     cfg.OAuth2.Provider,
-				Tenant:       cfg.OAuth2.Tenant,
-				ClientID:     cfg.OAuth2.ClientID,
-				ClientSecret: cfg.OAuth2.ClientSecret.GetPayload(),
-				RefreshToken: cfg.OAuth2.RefreshToken.GetPayload(),
-			},
-		}
-		config.OAuth2.initialize()
+		config = newConfigFromProvider(cfg)
 	}
 
 	c.Lock()
@@ -387,25 +400,85 @@ func loadTemplates(templatesPath string) {
 	pwdResetTmpl := util.LoadTemplate(nil, passwordResetPath)
 	passwordExpirationPath := filepath.Join(templatesPath, templatePasswordExpiration)
 	pwdExpirationTmpl := util.LoadTemplate(nil, passwordExpirationPath)
+	pubKeyExpirationPath := filepath.Join(templatesPath, templatePubKeyExpiration)
+	pubKeyExpirationTmpl := util.LoadTemplate(nil, pubKeyExpirationPath)
+	shareUsagePath := filepath.Join(templatesPath, templateShareUsage)
+	shareUsageTmpl := util.LoadTemplate(nil, shareUsagePath)
+	shareExpirationPath := filepath.Join(templatesPath, templateShareExpiration)
+	shareExpirationTmpl := util.LoadTemplate(nil, shareExpirationPath)
+	shareFileRequestPath := filepath.Join(templatesPath, templateShareFileRequest)
+	shareFileRequestTmpl := util.LoadTemplate(nil, shareFileRequestPath)
+	registrationReviewPath := filepath.Join(templatesPath, templateRegistrationReview)
+	registrationReviewTmpl := util.LoadTemplate(nil, registrationReviewPath)
+	registrationResultPath := filepath.Join(templatesPath, templateRegistrationResult)
+	registrationResultTmpl := util.LoadTemplate(nil, registrationResultPath)
 
 	emailTemplates[templatePasswordReset] = pwdResetTmpl
 	emailTemplates[templatePasswordExpiration] = pwdExpirationTmpl
+	emailTemplates[templatePubKeyExpiration] = pubKeyExpirationTmpl
+	emailTemplates[templateShareUsage] = shareUsageTmpl
+	emailTemplates[templateShareExpiration] = shareExpirationTmpl
+	emailTemplates[templateShareFileRequest] = shareFileRequestTmpl
+	emailTemplates[templateRegistrationReview] = registrationReviewTmpl
+	emailTemplates[templateRegistrationResult] = registrationResultTmpl
 }
 
-// RenderPasswordResetTemplate executes the password reset template
-func RenderPasswordResetTemplate(buf *bytes.Buffer, data any) error {
-	if !IsEnabled() {
+func renderTemplate(role, name string, buf *bytes.Buffer, data any) error {
+	tmpl := emailTemplates[name]
+	if tmpl == nil || !IsEnabledForRole(role) {
 		return errors.New("smtp: not configured")
 	}
-	return emailTemplates[templatePasswordReset].Execute(buf, data)
+	return tmpl.Execute(buf, data)
 }
 
-// RenderPasswordExpirationTemplate executes the password expiration template
-func RenderPasswordExpirationTemplate(buf *bytes.Buffer, data any) error {
-	if !IsEnabled() {
-		return errors.New("smtp: not configured")
-	}
-	return emailTemplates[templatePasswordExpiration].Execute(buf, data)
+// RenderPasswordResetTemplate executes the password reset template.
+// An SMTP server must be configured for the specified role or globally
+func RenderPasswordResetTemplate(role string, buf *bytes.Buffer, data any) error {
+	return renderTemplate(role, templatePasswordReset, buf, data)
+}
+
+// RenderPasswordExpirationTemplate executes the password expiration template.
+// An SMTP server must be configured for the specified role or globally
+func RenderPasswordExpirationTemplate(role string, buf *bytes.Buffer, data any) error {
+	return renderTemplate(role, templatePasswordExpiration, buf, data)
+}
+
+// RenderPublicKeyExpirationTemplate executes the public key expiration template.
+// An SMTP server must be configured for the specified role or globally
+func RenderPublicKeyExpirationTemplate(role string, buf *bytes.Buffer, data any) error {
+	return renderTemplate(role, templatePubKeyExpiration, buf, data)
+}
+
+// RenderShareUsageTemplate executes the share usage template.
+// An SMTP server must be configured for the specified role or globally
+func RenderShareUsageTemplate(role string, buf *bytes.Buffer, data any) error {
+	return renderTemplate(role, templateShareUsage, buf, data)
+}
+
+// RenderShareExpirationTemplate executes the share expiration template.
+// An SMTP server must be configured for the specified role or globally
+func RenderShareExpirationTemplate(role string, buf *bytes.Buffer, data any) error {
+	return renderTemplate(role, templateShareExpiration, buf, data)
+}
+
+// RenderShareFileRequestTemplate executes the file request uploads template.
+// An SMTP server must be configured for the specified role or globally
+func RenderShareFileRequestTemplate(role string, buf *bytes.Buffer, data any) error {
+	return renderTemplate(role, templateShareFileRequest, buf, data)
+}
+
+// RenderRegistrationReviewTemplate executes the template used to notify the
+// admins about a new registration to review.
+// An SMTP server must be configured for the specified role or globally
+func RenderRegistrationReviewTemplate(role string, buf *bytes.Buffer, data any) error {
+	return renderTemplate(role, templateRegistrationReview, buf, data)
+}
+
+// RenderRegistrationResultTemplate executes the template used to notify the
+// users about the approval or rejection of their registration.
+// An SMTP server must be configured for the specified role or globally
+func RenderRegistrationResultTemplate(role string, buf *bytes.Buffer, data any) error {
+	return renderTemplate(role, templateRegistrationResult, buf, data)
 }
 
 // SendEmail tries to send an email using the specified parameters.
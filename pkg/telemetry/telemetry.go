@@ -30,6 +30,7 @@ import (
 
 	"github.com/drakkan/sftpgo/v2/pkg/common"
 	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/tracing"
 	"github.com/drakkan/sftpgo/v2/pkg/util"
 )
 
@@ -79,6 +80,9 @@ type Conf struct {
 	TLSCipherSuites []string `json:"tls_cipher_suites" mapstructure:"tls_cipher_suites"`
 	// Defines the minimum TLS version. 13 means TLS 1.3, default is TLS 1.2
 	MinTLSVersion int `json:"min_tls_version" mapstructure:"min_tls_version"`
+	// OpenTelemetry tracing configuration. Tracing is independent from the
+	// telemetry server and can be enabled even if the server is disabled
+	Tracing tracing.Config `json:"tracing" mapstructure:"tracing"`
 }
 
 // ShouldBind returns true if there service must be started
@@ -0,0 +1,258 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Package tracing provides OpenTelemetry tracing for SFTPGo.
+// Connections, transfers, authentications and hooks are exported as spans
+// using the OTLP HTTP protocol
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/version"
+)
+
+const (
+	logSender          = "tracing"
+	tracerName         = "github.com/drakkan/sftpgo"
+	defaultServiceName = "sftpgo"
+	shutdownTimeout    = 10 * time.Second
+)
+
+var (
+	enabled        atomic.Bool
+	tracerProvider *sdktrace.TracerProvider
+	tracer         trace.Tracer = trace.NewNoopTracerProvider().Tracer(tracerName)
+	// maps the connection IDs to the contexts used as parents for their spans
+	connContexts sync.Map
+	// maps the connection IDs to their spans
+	connSpans sync.Map
+)
+
+// Config defines the OpenTelemetry tracing configuration
+type Config struct {
+	// Set to true to enable tracing
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// OTLP HTTP collector endpoint as host:port, for example "localhost:4318".
+	// If empty the OTEL_EXPORTER_OTLP_ENDPOINT environment variable or the
+	// exporter default, "localhost:4318", is used
+	Endpoint string `json:"endpoint" mapstructure:"endpoint"`
+	// Set to true to use plain HTTP instead of HTTPS to connect to the collector
+	Insecure bool `json:"insecure" mapstructure:"insecure"`
+	// The service name to report. Default: "sftpgo"
+	ServiceName string `json:"service_name" mapstructure:"service_name"`
+	// Fraction of the traces to sample, between 0 and 1. Default: 1, all the traces
+	// are sampled
+	SampleRatio float64 `json:"sample_ratio" mapstructure:"sample_ratio"`
+}
+
+func (c *Config) validate() error {
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("tracing: invalid sample ratio %v, it must be between 0 and 1", c.SampleRatio)
+	}
+	if c.ServiceName == "" {
+		c.ServiceName = defaultServiceName
+	}
+	return nil
+}
+
+// Initialize configures the tracer provider and the OTLP exporter.
+// It does nothing if tracing is disabled
+func (c *Config) Initialize() error {
+	Shutdown()
+	if !c.Enabled {
+		logger.Debug(logSender, "", "tracing disabled")
+		return nil
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+	var opts []otlptracehttp.Option
+	if c.Endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpoint(c.Endpoint))
+	}
+	if c.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return fmt.Errorf("tracing: unable to create the OTLP exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(c.ServiceName),
+		semconv.ServiceVersion(version.Get().Version),
+	))
+	if err != nil {
+		return fmt.Errorf("tracing: unable to create the resource: %w", err)
+	}
+	setTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+	))
+	logger.Info(logSender, "", "tracing enabled, endpoint %q, insecure: %t, service name %q, sample ratio: %v",
+		c.Endpoint, c.Insecure, c.ServiceName, c.SampleRatio)
+	return nil
+}
+
+func setTracerProvider(provider *sdktrace.TracerProvider) {
+	tracerProvider = provider
+	tracer = provider.Tracer(tracerName, trace.WithInstrumentationVersion(version.Get().Version))
+	enabled.Store(true)
+}
+
+// Shutdown flushes the pending spans and stops the tracer provider
+func Shutdown() {
+	if !enabled.Load() {
+		return
+	}
+	enabled.Store(false)
+	tracer = trace.NewNoopTracerProvider().Tracer(tracerName)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		logger.Warn(logSender, "", "unable to shutdown the tracer provider: %v", err)
+	}
+	tracerProvider = nil
+	connContexts.Range(func(key, _ any) bool {
+		connContexts.Delete(key)
+		return true
+	})
+	connSpans.Range(func(key, _ any) bool {
+		connSpans.Delete(key)
+		return true
+	})
+}
+
+// IsEnabled returns true if tracing is enabled
+func IsEnabled() bool {
+	return enabled.Load()
+}
+
+// Start starts a new span as child of the span in the specified context, if any
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartSpan starts a new span as child of the span for the connection with
+// the specified ID. A new trace is started if the connection ID is empty or
+// there is no span for it
+func StartSpan(connectionID, name string, attrs ...attribute.KeyValue) trace.Span {
+	if !enabled.Load() {
+		return trace.SpanFromContext(context.Background())
+	}
+	_, span := Start(getConnectionContext(connectionID), name, attrs...)
+	return span
+}
+
+// EndSpan records the specified error, if any, and ends the span
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// SetConnectionContext sets the context to use as parent for the spans of the
+// connection with the specified ID. It is useful for protocols, such as HTTP,
+// where a request span is started before the connection. The context is also
+// used for the connection IDs with a protocol prefix, for example for the ID
+// "abc" it is used for the connection "HTTP_abc" too
+func SetConnectionContext(ctx context.Context, connectionID string) {
+	if !enabled.Load() {
+		return
+	}
+	connContexts.Store(connectionID, ctx)
+}
+
+// RemoveConnectionContext removes the context set using SetConnectionContext
+func RemoveConnectionContext(connectionID string) {
+	if !enabled.Load() {
+		return
+	}
+	connContexts.Delete(connectionID)
+}
+
+// StartConnection starts the span for the connection with the specified ID,
+// the spans started using StartSpan for the same connection ID will be its
+// children
+func StartConnection(connectionID, name string, attrs ...attribute.KeyValue) {
+	if !enabled.Load() {
+		return
+	}
+	ctx, span := Start(getConnectionContext(connectionID), name, attrs...)
+	connContexts.Store(connectionID, ctx)
+	connSpans.Store(connectionID, span)
+}
+
+// SetConnectionAttributes sets the specified attributes for the span of the
+// connection with the specified ID
+func SetConnectionAttributes(connectionID string, attrs ...attribute.KeyValue) {
+	if !enabled.Load() {
+		return
+	}
+	if val, ok := connSpans.Load(connectionID); ok {
+		val.(trace.Span).SetAttributes(attrs...)
+	}
+}
+
+// EndConnection ends the span for the connection with the specified ID
+func EndConnection(connectionID string, err error) {
+	if !enabled.Load() {
+		return
+	}
+	connContexts.Delete(connectionID)
+	if val, ok := connSpans.LoadAndDelete(connectionID); ok {
+		EndSpan(val.(trace.Span), err)
+	}
+}
+
+func getConnectionContext(connectionID string) context.Context {
+	if connectionID != "" {
+		if val, ok := connContexts.Load(connectionID); ok {
+			return val.(context.Context)
+		}
+		if _, id, ok := strings.Cut(connectionID, "_"); ok && id != "" {
+			if val, ok := connContexts.Load(id); ok {
+				return val.(context.Context)
+			}
+		}
+	}
+	return context.Background()
+}
+
+// ErrorFromStatus returns an error for HTTP status codes >= 500, the
+// client errors are not considered span errors
+func ErrorFromStatus(statusCode int) error {
+	if statusCode >= 500 {
+		return fmt.Errorf("HTTP status %d", statusCode)
+	}
+	return nil
+}
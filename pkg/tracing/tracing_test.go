@@ -0,0 +1,131 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func setupRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	setTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(Shutdown)
+	return recorder
+}
+
+func getEndedSpan(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			return span
+		}
+	}
+	require.Fail(t, "span not found", "name: %q", name)
+	return nil
+}
+
+func TestConfig(t *testing.T) {
+	c := Config{
+		Enabled:     true,
+		SampleRatio: 1.1,
+	}
+	err := c.Initialize()
+	assert.Error(t, err)
+	assert.False(t, IsEnabled())
+	c.SampleRatio = 0.5
+	c.Endpoint = "127.0.0.1:4318"
+	c.Insecure = true
+	err = c.Initialize()
+	assert.NoError(t, err)
+	assert.True(t, IsEnabled())
+	assert.Equal(t, defaultServiceName, c.ServiceName)
+	c.Enabled = false
+	err = c.Initialize()
+	assert.NoError(t, err)
+	assert.False(t, IsEnabled())
+}
+
+func TestDisabled(t *testing.T) {
+	connID := "SFTP_disabled"
+	StartConnection(connID, "connection")
+	span := StartSpan(connID, "upload")
+	assert.False(t, span.SpanContext().IsValid())
+	EndSpan(span, errors.New("error"))
+	SetConnectionAttributes(connID, attribute.String("key", "value"))
+	SetConnectionContext(context.Background(), connID)
+	RemoveConnectionContext(connID)
+	EndConnection(connID, nil)
+	_, ok := connSpans.Load(connID)
+	assert.False(t, ok)
+}
+
+func TestConnectionSpans(t *testing.T) {
+	recorder := setupRecorder(t)
+
+	connID := "SFTP_123"
+	StartConnection(connID, "SFTP connection", attribute.String("sftpgo.username", ""))
+	SetConnectionAttributes(connID, attribute.String("sftpgo.username", "user"))
+	span := StartSpan(connID, "upload")
+	EndSpan(span, errors.New("transfer error"))
+	EndConnection(connID, nil)
+	// the connection is ended, a new trace is started
+	span = StartSpan(connID, "post-disconnect hook")
+	EndSpan(span, nil)
+
+	connSpan := getEndedSpan(t, recorder, "SFTP connection")
+	assert.Contains(t, connSpan.Attributes(), attribute.String("sftpgo.username", "user"))
+	assert.Equal(t, codes.Unset, connSpan.Status().Code)
+	uploadSpan := getEndedSpan(t, recorder, "upload")
+	assert.Equal(t, connSpan.SpanContext().SpanID(), uploadSpan.Parent().SpanID())
+	assert.Equal(t, connSpan.SpanContext().TraceID(), uploadSpan.SpanContext().TraceID())
+	assert.Equal(t, codes.Error, uploadSpan.Status().Code)
+	assert.Len(t, uploadSpan.Events(), 1)
+	hookSpan := getEndedSpan(t, recorder, "post-disconnect hook")
+	assert.False(t, hookSpan.Parent().IsValid())
+	assert.NotEqual(t, connSpan.SpanContext().TraceID(), hookSpan.SpanContext().TraceID())
+}
+
+func TestRequestContext(t *testing.T) {
+	recorder := setupRecorder(t)
+
+	reqID := "req1"
+	ctx, reqSpan := Start(context.Background(), "HTTP GET")
+	SetConnectionContext(ctx, reqID)
+	StartConnection("HTTP_"+reqID, "HTTP connection")
+	span := StartSpan("HTTP_"+reqID, "download")
+	EndSpan(span, nil)
+	EndConnection("HTTP_"+reqID, nil)
+	RemoveConnectionContext(reqID)
+	EndSpan(reqSpan, ErrorFromStatus(http.StatusInternalServerError))
+
+	requestSpan := getEndedSpan(t, recorder, "HTTP GET")
+	assert.Equal(t, codes.Error, requestSpan.Status().Code)
+	connSpan := getEndedSpan(t, recorder, "HTTP connection")
+	assert.Equal(t, requestSpan.SpanContext().SpanID(), connSpan.Parent().SpanID())
+	downloadSpan := getEndedSpan(t, recorder, "download")
+	assert.Equal(t, connSpan.SpanContext().SpanID(), downloadSpan.Parent().SpanID())
+	_, ok := connContexts.Load(reqID)
+	assert.False(t, ok)
+	assert.NoError(t, ErrorFromStatus(http.StatusNotFound))
+}
@@ -0,0 +1,140 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"        //nolint:staticcheck
+	"golang.org/x/crypto/openpgp/packet" //nolint:staticcheck
+)
+
+// ReadPGPPublicKeys parses the specified armored OpenPGP public keys and
+// checks that they can be used for encryption
+func ReadPGPPublicKeys(armored string) (openpgp.EntityList, error) {
+	if strings.TrimSpace(armored) == "" {
+		return nil, errors.New("no PGP public key provided")
+	}
+	keys, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the PGP public key: %w", err)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no PGP public key found")
+	}
+	for _, key := range keys {
+		if key.PrivateKey != nil {
+			return nil, errors.New("a PGP private key is not allowed, please provide the public key")
+		}
+	}
+	w, err := openpgp.Encrypt(io.Discard, keys, nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("the PGP public key cannot be used for encryption: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("the PGP public key cannot be used for encryption: %w", err)
+	}
+	return keys, nil
+}
+
+// PGPEncrypt encrypts the data read from r for the specified public keys and
+// writes the result to w in binary format
+func PGPEncrypt(w io.Writer, r io.Reader, keys openpgp.EntityList, fileName string) error {
+	hints := &openpgp.FileHints{
+		IsBinary: true,
+		FileName: fileName,
+	}
+	pw, err := openpgp.Encrypt(w, keys, nil, hints, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(pw, r); err != nil {
+		pw.Close() //nolint:errcheck
+		return err
+	}
+	return pw.Close()
+}
+
+// ReadPGPPrivateKeys parses the specified armored OpenPGP private keys and
+// decrypts them using the specified passphrase, if they are encrypted
+func ReadPGPPrivateKeys(armored, passphrase string) (openpgp.EntityList, error) {
+	if strings.TrimSpace(armored) == "" {
+		return nil, errors.New("no PGP private key provided")
+	}
+	keys, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the PGP private key: %w", err)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no PGP private key found")
+	}
+	for _, key := range keys {
+		if key.PrivateKey == nil {
+			return nil, errors.New("a PGP public key is not allowed, please provide the private key")
+		}
+		if err := decryptPGPPrivateKey(key.PrivateKey, passphrase); err != nil {
+			return nil, err
+		}
+		for _, subkey := range key.Subkeys {
+			if subkey.PrivateKey != nil {
+				if err := decryptPGPPrivateKey(subkey.PrivateKey, passphrase); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return keys, nil
+}
+
+func decryptPGPPrivateKey(key *packet.PrivateKey, passphrase string) error {
+	if !key.Encrypted {
+		return nil
+	}
+	if passphrase == "" {
+		return errors.New("the PGP private key is encrypted, a passphrase is required")
+	}
+	if err := key.Decrypt([]byte(passphrase)); err != nil {
+		return fmt.Errorf("unable to decrypt the PGP private key: %w", err)
+	}
+	return nil
+}
+
+// NewPGPDecryptReader returns a reader that decrypts the data read from r
+// using the specified private keys. The integrity of the decrypted data is
+// verified once the returned reader is fully read, an error is returned
+// from the last read if the check fails
+func NewPGPDecryptReader(r io.Reader, keys openpgp.EntityList) (io.Reader, error) {
+	md, err := openpgp.ReadMessage(r, keys, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt the PGP message: %w", err)
+	}
+	if !md.IsEncrypted {
+		return nil, errors.New("the data is not PGP encrypted")
+	}
+	return md.UnverifiedBody, nil
+}
+
+// PGPDecrypt decrypts the data read from r using the specified private keys
+// and writes the result to w. It returns the number of decrypted bytes
+func PGPDecrypt(w io.Writer, r io.Reader, keys openpgp.EntityList) (int64, error) {
+	dr, err := NewPGPDecryptReader(r, keys)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(w, dr)
+}
@@ -445,6 +445,35 @@ func GenerateEd25519Keys(file string) error {
 	return os.WriteFile(file+".pub", ssh.MarshalAuthorizedKey(pub), 0600)
 }
 
+// GeneratePrivateKey generates a private key of the specified type, rsa,
+// ecdsa or ed25519, and returns it PEM encoded
+func GeneratePrivateKey(keyType string) ([]byte, error) {
+	var key any
+	var err error
+
+	switch keyType {
+	case "rsa":
+		key, err = rsa.GenerateKey(rand.Reader, 4096)
+	case "ecdsa":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ed25519":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", keyType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: keyBytes,
+	}), nil
+}
+
 // IsDirOverlapped returns true if dir1 and dir2 overlap
 func IsDirOverlapped(dir1, dir2 string, fullCheck bool, separator string) bool {
 	if dir1 == dir2 {
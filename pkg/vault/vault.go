@@ -0,0 +1,157 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Package vault provides a minimal HashiCorp Vault HTTP API client
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/httpclient"
+)
+
+// Environment variables used to configure the Vault client, they are the
+// same used by the Vault CLI
+const (
+	EnvAddress   = "VAULT_ADDR"
+	EnvToken     = "VAULT_TOKEN"
+	EnvNamespace = "VAULT_NAMESPACE"
+)
+
+const (
+	requestTimeout  = 30 * time.Second
+	maxResponseSize = 1048576
+)
+
+// ErrNotConfigured is returned if the Vault address or token are not set
+var ErrNotConfigured = fmt.Errorf("vault is not configured, %s and %s environment variables are required",
+	EnvAddress, EnvToken)
+
+// Secret defines a secret returned by Vault
+type Secret struct {
+	LeaseID       string         `json:"lease_id"`
+	LeaseDuration int            `json:"lease_duration"`
+	Renewable     bool           `json:"renewable"`
+	Data          map[string]any `json:"data"`
+}
+
+// GetString returns the string value for the specified data key
+func (s *Secret) GetString(key string) string {
+	if val, ok := s.Data[key].(string); ok {
+		return val
+	}
+	return ""
+}
+
+// Client defines a Vault client
+type Client struct {
+	address   string
+	token     string
+	namespace string
+}
+
+// IsConfigured returns true if the Vault address and token are set
+func IsConfigured() bool {
+	return os.Getenv(EnvAddress) != "" && os.Getenv(EnvToken) != ""
+}
+
+// NewClientFromEnv returns a Vault client configured using the standard
+// Vault environment variables
+func NewClientFromEnv() (*Client, error) {
+	if !IsConfigured() {
+		return nil, ErrNotConfigured
+	}
+	return &Client{
+		address:   strings.TrimRight(os.Getenv(EnvAddress), "/"),
+		token:     os.Getenv(EnvToken),
+		namespace: os.Getenv(EnvNamespace),
+	}, nil
+}
+
+// Read reads the secret at the specified path
+func (c *Client) Read(ctx context.Context, path string) (*Secret, error) {
+	return c.do(ctx, http.MethodGet, path, nil)
+}
+
+// Write writes the specified data to the specified path
+func (c *Client) Write(ctx context.Context, path string, data map[string]any) (*Secret, error) {
+	return c.do(ctx, http.MethodPost, path, data)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, data map[string]any) (*Secret, error) {
+	var body io.Reader
+	if data != nil {
+		asJSON, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewBuffer(asJSON)
+	}
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/v1/%s", c.address, strings.TrimLeft(path, "/"))
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", c.token)
+	req.Header.Set("X-Vault-Request", "true")
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := httpclient.GetHTTPClient()
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("vault request to %q failed: %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the vault response for %q: %w", path, err)
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusNoContent {
+		var errResp struct {
+			Errors []string `json:"errors"`
+		}
+		if err := json.Unmarshal(respBody, &errResp); err == nil && len(errResp.Errors) > 0 {
+			return nil, fmt.Errorf("vault request to %q failed, status code: %d, errors: %s", path, resp.StatusCode,
+				strings.Join(errResp.Errors, ", "))
+		}
+		return nil, fmt.Errorf("vault request to %q failed, unexpected status code: %d", path, resp.StatusCode)
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, errors.New("no data returned from vault")
+	}
+	var secret Secret
+	if err := json.Unmarshal(respBody, &secret); err != nil {
+		return nil, fmt.Errorf("unable to decode the vault response for %q: %w", path, err)
+	}
+	return &secret, nil
+}
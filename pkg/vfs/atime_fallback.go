@@ -0,0 +1,29 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !darwin && !linux && !freebsd
+// +build !darwin,!linux,!freebsd
+
+package vfs
+
+import (
+	"os"
+	"time"
+)
+
+// getFileAccessTime returns the modification time, the last access
+// time is not available on this platform
+func getFileAccessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
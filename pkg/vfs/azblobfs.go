@@ -26,6 +26,7 @@ import (
 	"io"
 	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
@@ -40,6 +41,7 @@ import (
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
 	"github.com/eikenb/pipeat"
 	"github.com/google/uuid"
 	"github.com/pkg/sftp"
@@ -54,6 +56,9 @@ import (
 const (
 	azureDefaultEndpoint = "blob.core.windows.net"
 	azFolderKey          = "hdi_isfolder"
+	// SAS tokens are renewed when they expire within this threshold
+	azSASRenewThreshold = 5 * time.Minute
+	azSASRenewValidity  = time.Hour
 )
 
 // AzureBlobFs is a Fs implementation for Azure Blob storage.
@@ -64,6 +69,7 @@ type AzureBlobFs struct {
 	mountPath       string
 	config          *AzBlobFsConfig
 	containerClient *container.Client
+	sasRenewer      *azSASRenewer
 	ctxTimeout      time.Duration
 	ctxLongTimeout  time.Duration
 }
@@ -100,7 +106,10 @@ func NewAzBlobFs(connectionID, localTempDir, mountPath string, config AzBlobFsCo
 	fs.setConfigDefaults()
 
 	if fs.config.SASURL.GetPayload() != "" {
-		return fs.initFromSASURL()
+		if _, err := fs.initFromSASURL(); err != nil {
+			return fs, err
+		}
+		return newObjectStorageFs(fs, fs.getObjectCacheNamespace()), nil
 	}
 
 	credential, err := blob.NewSharedKeyCredential(fs.config.AccountName, fs.config.AccountKey.GetPayload())
@@ -119,7 +128,14 @@ func NewAzBlobFs(connectionID, localTempDir, mountPath string, config AzBlobFsCo
 		return fs, fmt.Errorf("invalid credentials: %v", err)
 	}
 	fs.containerClient = svc
-	return fs, err
+	return newObjectStorageFs(fs, fs.getObjectCacheNamespace()), nil
+}
+
+// getObjectCacheNamespace returns the container URL without the query string,
+// SAS tokens are not included
+func (fs *AzureBlobFs) getObjectCacheNamespace() string {
+	containerURL, _, _ := strings.Cut(fs.containerClient.URL(), "?")
+	return fmt.Sprintf("%s|%s", azBlobFsName, containerURL)
 }
 
 func (fs *AzureBlobFs) initFromSASURL() (Fs, error) {
@@ -130,24 +146,30 @@ func (fs *AzureBlobFs) initFromSASURL() (Fs, error) {
 	if parts.BlobName != "" {
 		return fs, fmt.Errorf("SAS URL with blob name not supported")
 	}
+	sasURL := fs.config.SASURL.GetPayload()
 	if parts.ContainerName != "" {
 		if fs.config.Container != "" && fs.config.Container != parts.ContainerName {
 			return fs, fmt.Errorf("container name in SAS URL %q and container provided %q do not match",
 				parts.ContainerName, fs.config.Container)
 		}
-		svc, err := container.NewClientWithNoCredential(fs.config.SASURL.GetPayload(), getAzContainerClientOptions())
-		if err != nil {
-			return fs, fmt.Errorf("invalid credentials: %v", err)
-		}
 		fs.config.Container = parts.ContainerName
-		fs.containerClient = svc
-		return fs, nil
+	} else {
+		if fs.config.Container == "" {
+			return fs, errors.New("container is required with this SAS URL")
+		}
+		sasURL = runtime.JoinPaths(sasURL, fs.config.Container)
 	}
-	if fs.config.Container == "" {
-		return fs, errors.New("container is required with this SAS URL")
+	clientOptions := getAzContainerClientOptions()
+	if fs.config.SASAutoRenew {
+		renewer, err := newAzSASRenewer(parts.SAS, fs.config.Container, fs.config.AccountName,
+			fs.config.AccountKey.GetPayload())
+		if err != nil {
+			return fs, err
+		}
+		fs.sasRenewer = renewer
+		clientOptions.PerRetryPolicies = append(clientOptions.PerRetryPolicies, renewer)
 	}
-	sasURL := runtime.JoinPaths(fs.config.SASURL.GetPayload(), fs.config.Container)
-	svc, err := container.NewClientWithNoCredential(sasURL, getAzContainerClientOptions())
+	svc, err := container.NewClientWithNoCredential(sasURL, clientOptions)
 	if err != nil {
 		return fs, fmt.Errorf("invalid credentials: %v", err)
 	}
@@ -384,16 +406,23 @@ func (*AzureBlobFs) Truncate(_ string, _ int64) error {
 // ReadDir reads the directory named by dirname and returns
 // a list of directory entries.
 func (fs *AzureBlobFs) ReadDir(dirname string) ([]os.FileInfo, error) {
-	var result []os.FileInfo
+	lister, err := fs.ListDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	return ReadAllFromDirLister(lister)
+}
+
+// ListDir implements the FsDirLister interface.
+// The blobs are listed a page at a time while the entries are requested
+func (fs *AzureBlobFs) ListDir(dirname string) (DirLister, error) {
 	// dirname must be already cleaned
 	prefix := fs.getPrefix(dirname)
 
 	modTimes, err := getFolderModTimes(fs.getStorageID(), dirname)
 	if err != nil {
-		return result, err
+		return nil, err
 	}
-	prefixes := make(map[string]bool)
-
 	pager := fs.containerClient.NewListBlobsHierarchyPager("/", &container.ListBlobsHierarchyOptions{
 		Include: container.ListBlobsInclude{
 			//Metadata: true,
@@ -401,58 +430,13 @@ func (fs *AzureBlobFs) ReadDir(dirname string) ([]os.FileInfo, error) {
 		Prefix: &prefix,
 	})
 
-	for pager.More() {
-		ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
-		defer cancelFn()
-
-		resp, err := pager.NextPage(ctx)
-		if err != nil {
-			metric.AZListObjectsCompleted(err)
-			return result, err
-		}
-		for _, blobPrefix := range resp.ListBlobsHierarchySegmentResponse.Segment.BlobPrefixes {
-			name := util.GetStringFromPointer(blobPrefix.Name)
-			// we don't support prefixes == "/" this will be sent if a key starts with "/"
-			if name == "" || name == "/" {
-				continue
-			}
-			// sometime we have duplicate prefixes, maybe an Azurite bug
-			name = strings.TrimPrefix(name, prefix)
-			if _, ok := prefixes[strings.TrimSuffix(name, "/")]; ok {
-				continue
-			}
-			result = append(result, NewFileInfo(name, true, 0, time.Unix(0, 0), false))
-			prefixes[strings.TrimSuffix(name, "/")] = true
-		}
-
-		for _, blobItem := range resp.ListBlobsHierarchySegmentResponse.Segment.BlobItems {
-			name := util.GetStringFromPointer(blobItem.Name)
-			name = strings.TrimPrefix(name, prefix)
-			size := int64(0)
-			isDir := false
-			modTime := time.Unix(0, 0)
-			if blobItem.Properties != nil {
-				size = util.GetIntFromPointer(blobItem.Properties.ContentLength)
-				modTime = util.GetTimeFromPointer(blobItem.Properties.LastModified)
-				contentType := util.GetStringFromPointer(blobItem.Properties.ContentType)
-				isDir = checkDirectoryMarkers(contentType, blobItem.Metadata)
-				if isDir {
-					// check if the dir is already included, it will be sent as blob prefix if it contains at least one item
-					if _, ok := prefixes[name]; ok {
-						continue
-					}
-					prefixes[name] = true
-				}
-			}
-			if t, ok := modTimes[name]; ok {
-				modTime = util.GetTimeFromMsecSinceEpoch(t)
-			}
-			result = append(result, NewFileInfo(name, isDir, size, modTime, false))
-		}
-	}
-	metric.AZListObjectsCompleted(nil)
-
-	return result, nil
+	return &azureBlobDirLister{
+		fs:       fs,
+		pager:    pager,
+		prefix:   prefix,
+		modTimes: modTimes,
+		prefixes: make(map[string]bool),
+	}, nil
 }
 
 // IsUploadResumeSupported returns true if resuming uploads is supported.
@@ -799,7 +783,12 @@ func (fs *AzureBlobFs) copyFileInternal(source, target string) error {
 
 	srcBlob := fs.containerClient.NewBlockBlobClient(source)
 	dstBlob := fs.containerClient.NewBlockBlobClient(target)
-	resp, err := dstBlob.StartCopyFromURL(ctx, srcBlob.URL(), fs.getCopyOptions())
+	srcURL, err := fs.getCopySourceURL(srcBlob.URL())
+	if err != nil {
+		metric.AZCopyObjectCompleted(err)
+		return err
+	}
+	resp, err := dstBlob.StartCopyFromURL(ctx, srcURL, fs.getCopyOptions())
 	if err != nil {
 		metric.AZCopyObjectCompleted(err)
 		return err
@@ -1171,6 +1160,23 @@ func (fs *AzureBlobFs) getCopyOptions() *blob.StartCopyFromURLOptions {
 	return copyOptions
 }
 
+// getCopySourceURL returns the URL to use as copy source. The source blob URL
+// embeds the SAS token used to create the container client, it is replaced
+// with a valid one if the SAS auto renewal is enabled
+func (fs *AzureBlobFs) getCopySourceURL(blobURL string) (string, error) {
+	if fs.sasRenewer == nil {
+		return blobURL, nil
+	}
+	u, err := url.Parse(blobURL)
+	if err != nil {
+		return "", err
+	}
+	if err := fs.sasRenewer.setSAS(u); err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
 func (fs *AzureBlobFs) getStorageID() string {
 	if fs.config.Endpoint != "" {
 		if !strings.HasSuffix(fs.config.Endpoint, "/") {
@@ -1204,62 +1210,189 @@ func getAzContainerClientOptions() *container.ClientOptions {
 	}
 }
 
-type bytesReaderWrapper struct {
-	*bytes.Reader
+// azSASRenewer is a pipeline policy that replaces the SAS token of each
+// request with a valid one. The SAS token from the configured URL is used
+// until it is about to expire, then a container SAS with the same permissions
+// is signed using the account key
+type azSASRenewer struct {
+	credential  *sas.SharedKeyCredential
+	container   string
+	permissions string
+	protocol    sas.Protocol
+	ipRange     sas.IPRange
+	mu          sync.Mutex
+	token       string
+	expiry      time.Time
 }
 
-func (b *bytesReaderWrapper) Close() error {
-	return nil
+func newAzSASRenewer(params sas.QueryParameters, containerName, accountName, accountKey string) (*azSASRenewer, error) {
+	credential, err := blob.NewSharedKeyCredential(accountName, accountKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials for SAS renewal: %w", err)
+	}
+	return &azSASRenewer{
+		credential:  credential,
+		container:   containerName,
+		permissions: getAzContainerSASPermissions(params.Permissions()),
+		protocol:    params.Protocol(),
+		ipRange:     params.IPRange(),
+		token:       params.Encode(),
+		expiry:      params.ExpiryTime(),
+	}, nil
+}
+
+func (r *azSASRenewer) getToken() (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// SAS tokens without an expiration, for example the ones associated to a
+	// stored access policy, are never renewed
+	if r.expiry.IsZero() || time.Until(r.expiry) > azSASRenewThreshold {
+		return r.token, nil
+	}
+	now := time.Now().UTC()
+	values := sas.BlobSignatureValues{
+		Protocol:      r.protocol,
+		StartTime:     now.Add(-azSASRenewThreshold),
+		ExpiryTime:    now.Add(azSASRenewValidity),
+		Permissions:   r.permissions,
+		IPRange:       r.ipRange,
+		ContainerName: r.container,
+	}
+	params, err := values.SignWithSharedKey(r.credential)
+	if err != nil {
+		return "", fmt.Errorf("unable to renew the SAS token: %w", err)
+	}
+	r.token = params.Encode()
+	r.expiry = values.ExpiryTime
+	logger.Debug(azBlobFsName, "", "SAS token for container %q renewed, new expiration: %v", r.container, r.expiry)
+	return r.token, nil
 }
 
-type bufferAllocator struct {
-	sync.Mutex
-	available  [][]byte
-	bufferSize int
-	finalized  bool
+func (r *azSASRenewer) setSAS(u *url.URL) error {
+	token, err := r.getToken()
+	if err != nil {
+		return err
+	}
+	values := u.Query()
+	sas.NewQueryParameters(values, true)
+	query := values.Encode()
+	if query != "" && token != "" {
+		query += "&"
+	}
+	u.RawQuery = query + token
+	return nil
 }
 
-func newBufferAllocator(size int) *bufferAllocator {
-	return &bufferAllocator{
-		bufferSize: size,
-		finalized:  false,
+// Do implements the policy.Policy interface
+func (r *azSASRenewer) Do(req *policy.Request) (*http.Response, error) {
+	if err := r.setSAS(req.Raw().URL); err != nil {
+		return nil, err
 	}
+	return req.Next()
 }
 
-func (b *bufferAllocator) getBuffer() []byte {
-	b.Lock()
-	defer b.Unlock()
+// getAzContainerSASPermissions returns the permissions, from the given ones,
+// allowed within a container SAS
+func getAzContainerSASPermissions(permissions string) string {
+	var sb strings.Builder
+	for _, p := range permissions {
+		if strings.ContainsRune("racwdxltfmeopi", p) {
+			sb.WriteRune(p)
+		}
+	}
+	return sb.String()
+}
 
-	if len(b.available) > 0 {
-		var result []byte
+type bytesReaderWrapper struct {
+	*bytes.Reader
+}
 
-		truncLength := len(b.available) - 1
-		result = b.available[truncLength]
+func (b *bytesReaderWrapper) Close() error {
+	return nil
+}
 
-		b.available[truncLength] = nil
-		b.available = b.available[:truncLength]
+type azureBlobDirLister struct {
+	baseDirLister
+	fs            *AzureBlobFs
+	pager         *runtime.Pager[container.ListBlobsHierarchyResponse]
+	prefix        string
+	modTimes      map[string]int64
+	prefixes      map[string]bool
+	metricUpdated bool
+}
 
-		return result
+// Next implements the DirLister interface
+func (l *azureBlobDirLister) Next(limit int) ([]os.FileInfo, error) {
+	limit = getListerLimit(limit)
+	for len(l.cache) < limit && l.pager.More() {
+		if err := l.fetchPage(); err != nil {
+			return nil, err
+		}
 	}
-
-	return make([]byte, b.bufferSize)
+	if !l.pager.More() && !l.metricUpdated {
+		l.metricUpdated = true
+		metric.AZListObjectsCompleted(nil)
+	}
+	return l.returnFromCache(limit)
 }
 
-func (b *bufferAllocator) releaseBuffer(buf []byte) {
-	b.Lock()
-	defer b.Unlock()
+func (l *azureBlobDirLister) fetchPage() error {
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(l.fs.ctxTimeout))
+	defer cancelFn()
 
-	if b.finalized || len(buf) != b.bufferSize {
-		return
+	resp, err := l.pager.NextPage(ctx)
+	if err != nil {
+		if !l.metricUpdated {
+			l.metricUpdated = true
+			metric.AZListObjectsCompleted(err)
+		}
+		return err
 	}
-
-	b.available = append(b.available, buf)
+	for _, blobPrefix := range resp.ListBlobsHierarchySegmentResponse.Segment.BlobPrefixes {
+		name := util.GetStringFromPointer(blobPrefix.Name)
+		// we don't support prefixes == "/" this will be sent if a key starts with "/"
+		if name == "" || name == "/" {
+			continue
+		}
+		// sometime we have duplicate prefixes, maybe an Azurite bug
+		name = strings.TrimPrefix(name, l.prefix)
+		if _, ok := l.prefixes[strings.TrimSuffix(name, "/")]; ok {
+			continue
+		}
+		l.cache = append(l.cache, NewFileInfo(name, true, 0, time.Unix(0, 0), false))
+		l.prefixes[strings.TrimSuffix(name, "/")] = true
+	}
+
+	for _, blobItem := range resp.ListBlobsHierarchySegmentResponse.Segment.BlobItems {
+		name := util.GetStringFromPointer(blobItem.Name)
+		name = strings.TrimPrefix(name, l.prefix)
+		size := int64(0)
+		isDir := false
+		modTime := time.Unix(0, 0)
+		if blobItem.Properties != nil {
+			size = util.GetIntFromPointer(blobItem.Properties.ContentLength)
+			modTime = util.GetTimeFromPointer(blobItem.Properties.LastModified)
+			contentType := util.GetStringFromPointer(blobItem.Properties.ContentType)
+			isDir = checkDirectoryMarkers(contentType, blobItem.Metadata)
+			if isDir {
+				// check if the dir is already included, it will be sent as blob prefix if it contains at least one item
+				if _, ok := l.prefixes[name]; ok {
+					continue
+				}
+				l.prefixes[name] = true
+			}
+		}
+		if t, ok := l.modTimes[name]; ok {
+			modTime = util.GetTimeFromMsecSinceEpoch(t)
+		}
+		l.cache = append(l.cache, NewFileInfo(name, isDir, size, modTime, false))
+	}
+	return nil
 }
 
-func (b *bufferAllocator) free() {
-	b.Lock()
-	defer b.Unlock()
-
-	b.available = nil
-	b.finalized = true
+// Close implements the DirLister interface
+func (l *azureBlobDirLister) Close() error {
+	l.prefixes = nil
+	return l.baseDirLister.Close()
 }
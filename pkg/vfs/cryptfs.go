@@ -17,15 +17,24 @@ package vfs
 import (
 	"bufio"
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base32"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 
 	"github.com/eikenb/pipeat"
 	"github.com/minio/sio"
+	"github.com/rs/xid"
 	"golang.org/x/crypto/hkdf"
 
 	"github.com/drakkan/sftpgo/v2/pkg/logger"
@@ -37,6 +46,15 @@ const (
 	version10     byte  = 0x10
 	nonceV10Size  int   = 32
 	headerV10Size int64 = 33 // 1 (version byte) + 32 (nonce size)
+	// the encrypted names are stored base32 encoded and must fit the
+	// maximum name length supported by the most common filesystems
+	maxEncryptedNameLen = 255
+)
+
+var (
+	namesEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+	// errNameTooLong is returned if an encrypted name exceeds the maximum length
+	errNameTooLong = errors.New("the name is too long to be encrypted")
 )
 
 // CryptFs is a Fs implementation that allows to encrypts/decrypts local files
@@ -44,6 +62,12 @@ type CryptFs struct {
 	*OsFs
 	localTempDir string
 	masterKey    []byte
+	// master keys derived from the previous passphrases, they are used to
+	// decrypt the files not yet re-encrypted after a key rotation
+	previousKeys [][]byte
+	// names encryption, namesCipher is nil if disabled
+	namesCipher cipher.AEAD
+	namesMacKey []byte
 }
 
 // NewCryptFs returns a CryptFs object
@@ -65,6 +89,20 @@ func NewCryptFs(connectionID, rootDir, mountPath string, config CryptFsConfig) (
 		},
 		masterKey: []byte(config.Passphrase.GetPayload()),
 	}
+	for _, passphrase := range config.PreviousPassphrases {
+		if err := passphrase.TryDecrypt(); err != nil {
+			return nil, err
+		}
+		fs.previousKeys = append(fs.previousKeys, []byte(passphrase.GetPayload()))
+	}
+	if config.EncryptNames {
+		if err := config.NamesKey.TryDecrypt(); err != nil {
+			return nil, err
+		}
+		if err := fs.initNamesEncryption([]byte(config.NamesKey.GetPayload())); err != nil {
+			return nil, err
+		}
+	}
 	if tempPath == "" {
 		fs.localTempDir = rootDir
 	} else {
@@ -73,6 +111,25 @@ func NewCryptFs(connectionID, rootDir, mountPath string, config CryptFsConfig) (
 	return fs, nil
 }
 
+func (fs *CryptFs) initNamesEncryption(namesKey []byte) error {
+	// derive independent keys for the encryption and the synthetic nonces
+	var keys [64]byte
+	kdf := hkdf.New(sha256.New, namesKey, nil, []byte("sftpgo names encryption"))
+	if _, err := io.ReadFull(kdf, keys[:]); err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(keys[:32])
+	if err != nil {
+		return err
+	}
+	fs.namesCipher, err = cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	fs.namesMacKey = keys[32:]
+	return nil
+}
+
 // Name returns the name for the Fs implementation
 func (fs *CryptFs) Name() string {
 	return fs.name
@@ -167,9 +224,7 @@ func (fs *CryptFs) Create(name string, _, _ int) (File, *PipeWriter, func(), err
 		f.Close()
 		return nil, nil, nil, err
 	}
-	var key [32]byte
-	kdf := hkdf.New(sha256.New, fs.masterKey, header.nonce, nil)
-	_, err = io.ReadFull(kdf, key[:])
+	key, err := deriveEncryptionKey(fs.masterKey, header.nonce)
 	if err != nil {
 		f.Close()
 		return nil, nil, nil, err
@@ -221,20 +276,164 @@ func (*CryptFs) Truncate(_ string, _ int64) error {
 // ReadDir reads the directory named by dirname and returns
 // a list of directory entries.
 func (fs *CryptFs) ReadDir(dirname string) ([]os.FileInfo, error) {
-	f, err := os.Open(dirname)
+	lister, err := fs.ListDir(dirname)
 	if err != nil {
 		return nil, err
 	}
-	list, err := f.Readdir(-1)
-	f.Close()
+	return ReadAllFromDirLister(lister)
+}
+
+// ListDir implements the FsDirLister interface, the returned sizes are
+// converted to the decrypted sizes. If the names encryption is enabled, the
+// entries with names that cannot be decrypted are skipped
+func (fs *CryptFs) ListDir(dirname string) (DirLister, error) {
+	f, err := os.Open(dirname)
 	if err != nil {
 		return nil, err
 	}
-	result := make([]os.FileInfo, 0, len(list))
-	for _, info := range list {
-		result = append(result, fs.ConvertFileInfo(info))
+	return &fileInfoConverterDirLister{
+		DirLister: &osDirLister{f: f},
+		convert: func(info os.FileInfo) os.FileInfo {
+			return fs.convertFileInfo(info, true)
+		},
+	}, nil
+}
+
+// ResolvePath returns the matching filesystem path for the specified virtual
+// path, the names are encrypted if the names encryption is enabled
+func (fs *CryptFs) ResolvePath(virtualPath string) (string, error) {
+	p, err := fs.encryptVirtualPath(virtualPath)
+	if err != nil {
+		return "", err
+	}
+	return fs.OsFs.ResolvePath(p)
+}
+
+// GetRelativePath returns the path for a file relative to the user's home dir.
+// This is the path as seen by SFTPGo users
+func (fs *CryptFs) GetRelativePath(name string) string {
+	return fs.decryptVirtualPath(fs.OsFs.GetRelativePath(name))
+}
+
+// Readlink returns the destination of the named symbolic link
+// as absolute virtual path
+func (fs *CryptFs) Readlink(name string) (string, error) {
+	p, err := fs.OsFs.Readlink(name)
+	if err != nil {
+		return "", err
 	}
-	return result, nil
+	return fs.decryptVirtualPath(p), nil
+}
+
+// RealPath implements the FsRealPather interface
+func (fs *CryptFs) RealPath(p string) (string, error) {
+	realPath, err := fs.OsFs.RealPath(p)
+	if err != nil {
+		return "", err
+	}
+	return fs.decryptVirtualPath(realPath), nil
+}
+
+// ReEncrypt encrypts again, using the current passphrase, the named file if
+// it was encrypted using a previous passphrase. It returns true if the file
+// was re-encrypted
+func (fs *CryptFs) ReEncrypt(name string) (bool, error) {
+	if len(fs.previousKeys) == 0 {
+		return false, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	header := encryptedFileHeader{}
+	if err := header.Load(f); err != nil {
+		return false, err
+	}
+	key, keyIndex, err := fs.getEncryptionKey(f, header.nonce)
+	if err != nil || keyIndex == 0 {
+		return false, err
+	}
+	tempName := filepath.Join(filepath.Dir(name), ".sftpgo-reencrypt."+xid.New().String())
+	if err := fs.reEncryptFile(f, tempName, key); err != nil {
+		os.Remove(tempName)
+		return false, err
+	}
+	// the file could be overwritten while it is re-encrypted
+	current, err := os.Stat(name)
+	if err == nil && (!os.SameFile(info, current) || current.Size() != info.Size() ||
+		!current.ModTime().Equal(info.ModTime())) {
+		err = fmt.Errorf("the file %q was modified while re-encrypting it", name)
+	}
+	if err == nil {
+		err = fs.copyMetadata(tempName, info)
+	}
+	if err == nil {
+		err = os.Rename(tempName, name)
+	}
+	if err != nil {
+		os.Remove(tempName)
+		return false, err
+	}
+	fsLog(fs, logger.LevelDebug, "file %q re-encrypted, previous passphrase index: %d", name, keyIndex)
+	return true, nil
+}
+
+func (fs *CryptFs) reEncryptFile(src *os.File, tempName string, key [32]byte) error {
+	dst, err := os.OpenFile(tempName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	header := encryptedFileHeader{
+		version: version10,
+		nonce:   make([]byte, nonceV10Size),
+	}
+	_, err = io.ReadFull(rand.Reader, header.nonce)
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	newKey, err := deriveEncryptionKey(fs.masterKey, header.nonce)
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	if err := header.Store(dst); err != nil {
+		dst.Close()
+		return err
+	}
+	decReader, err := sio.DecryptReader(src, fs.getSIOConfig(key))
+	if err == nil {
+		_, err = sio.Encrypt(dst, decReader, fs.getSIOConfig(newKey))
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	errClose := dst.Close()
+	if err == nil {
+		err = errClose
+	}
+	return err
+}
+
+// copyMetadata applies the permissions, the owner and the modification
+// time of the specified file info to name
+func (fs *CryptFs) copyMetadata(name string, info os.FileInfo) error {
+	if err := os.Chmod(name, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if uid, gid, _ := getFileOwnerAndLinks(info); uid != -1 {
+		// this can fail if SFTPGo does not run as root, the file keeps the SFTPGo owner
+		if err := os.Lchown(name, uid, gid); err != nil {
+			fsLog(fs, logger.LevelDebug, "unable to preserve the owner for %q: %v", name, err)
+		}
+	}
+	return os.Chtimes(name, info.ModTime(), info.ModTime())
 }
 
 // IsUploadResumeSupported returns false sio does not support random access writes
@@ -280,8 +479,23 @@ func (fs *CryptFs) getSIOConfig(key [32]byte) sio.Config {
 	}
 }
 
-// ConvertFileInfo returns a FileInfo with the decrypted size
+// ConvertFileInfo returns a FileInfo with the decrypted size and name
 func (fs *CryptFs) ConvertFileInfo(info os.FileInfo) os.FileInfo {
+	return fs.convertFileInfo(info, false)
+}
+
+// convertFileInfo returns a FileInfo with the decrypted size and name. If
+// skipInvalidName is true, nil is returned for names that cannot be decrypted
+func (fs *CryptFs) convertFileInfo(info os.FileInfo, skipInvalidName bool) os.FileInfo {
+	if fs.namesCipher != nil {
+		name, err := fs.decryptName(info.Name())
+		if err == nil {
+			info = &decryptedNameFileInfo{FileInfo: info, name: name}
+		} else if skipInvalidName {
+			fsLog(fs, logger.LevelDebug, "skipping %q, unable to decrypt the name: %v", info.Name(), err)
+			return nil
+		}
+	}
 	if !info.Mode().IsRegular() {
 		return info
 	}
@@ -310,8 +524,7 @@ func (fs *CryptFs) getFileAndEncryptionKey(name string) (*os.File, [32]byte, err
 		f.Close()
 		return nil, key, err
 	}
-	kdf := hkdf.New(sha256.New, fs.masterKey, header.nonce, nil)
-	_, err = io.ReadFull(kdf, key[:])
+	key, _, err = fs.getEncryptionKey(f, header.nonce)
 	if err != nil {
 		f.Close()
 		return nil, key, err
@@ -319,6 +532,124 @@ func (fs *CryptFs) getFileAndEncryptionKey(name string) (*os.File, [32]byte, err
 	return f, key, err
 }
 
+// getEncryptionKey returns the key to decrypt the specified file and the
+// index of the passphrase used to derive it: 0 is the current passphrase,
+// the following indexes are the previous passphrases
+func (fs *CryptFs) getEncryptionKey(f *os.File, nonce []byte) ([32]byte, int, error) {
+	key, err := deriveEncryptionKey(fs.masterKey, nonce)
+	if err != nil || len(fs.previousKeys) == 0 {
+		return key, 0, err
+	}
+	if fs.isValidEncryptionKey(f, key) {
+		return key, 0, nil
+	}
+	for idx, masterKey := range fs.previousKeys {
+		previousKey, err := deriveEncryptionKey(masterKey, nonce)
+		if err != nil {
+			return key, 0, err
+		}
+		if fs.isValidEncryptionKey(f, previousKey) {
+			return previousKey, idx + 1, nil
+		}
+	}
+	// no passphrase matches, the decryption will fail using the current one
+	return key, 0, nil
+}
+
+// isValidEncryptionKey returns true if the first package of the specified
+// file can be authenticated using the given key
+func (fs *CryptFs) isValidEncryptionKey(f *os.File, key [32]byte) bool {
+	readerAt, err := sio.DecryptReaderAt(&cryptedFileWrapper{File: f}, fs.getSIOConfig(key))
+	if err != nil {
+		return false
+	}
+	var buf [1]byte
+	_, err = readerAt.ReadAt(buf[:], 0)
+	return err == nil || err == io.EOF
+}
+
+// encryptVirtualPath encrypts the names in the specified virtual path, the
+// mount path is not encrypted
+func (fs *CryptFs) encryptVirtualPath(virtualPath string) (string, error) {
+	if fs.namesCipher == nil {
+		return virtualPath, nil
+	}
+	rel := path.Clean("/" + strings.TrimPrefix(virtualPath, fs.mountPath))
+	if rel == "/" {
+		return virtualPath, nil
+	}
+	names := strings.Split(rel[1:], "/")
+	for idx, name := range names {
+		encrypted, err := fs.encryptName(name)
+		if err != nil {
+			return "", fmt.Errorf("unable to encrypt %q: %w", name, err)
+		}
+		names[idx] = encrypted
+	}
+	return path.Join(fs.mountPath, "/"+strings.Join(names, "/")), nil
+}
+
+// decryptVirtualPath decrypts the names in the specified virtual path, the
+// names that cannot be decrypted are returned unchanged
+func (fs *CryptFs) decryptVirtualPath(virtualPath string) string {
+	if fs.namesCipher == nil || virtualPath == "" {
+		return virtualPath
+	}
+	prefix := "/"
+	if fs.mountPath != "" {
+		prefix = fs.mountPath
+	}
+	rel := strings.TrimPrefix(strings.TrimPrefix(virtualPath, fs.mountPath), "/")
+	if rel == "" {
+		return virtualPath
+	}
+	names := strings.Split(rel, "/")
+	for idx, name := range names {
+		if decrypted, err := fs.decryptName(name); err == nil {
+			names[idx] = decrypted
+		}
+	}
+	return path.Join(prefix, strings.Join(names, "/"))
+}
+
+// encryptName encrypts the specified file or directory name. The nonce is
+// derived from the name, so the same name is always encrypted in the same
+// way and can be found without listing the directory
+func (fs *CryptFs) encryptName(name string) (string, error) {
+	mac := hmac.New(sha256.New, fs.namesMacKey)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:fs.namesCipher.NonceSize()]
+	sealed := fs.namesCipher.Seal(append([]byte{}, nonce...), nonce, []byte(name), nil)
+	encrypted := strings.ToLower(namesEncoding.EncodeToString(sealed))
+	if len(encrypted) > maxEncryptedNameLen {
+		return "", errNameTooLong
+	}
+	return encrypted, nil
+}
+
+func (fs *CryptFs) decryptName(name string) (string, error) {
+	data, err := namesEncoding.DecodeString(strings.ToUpper(name))
+	if err != nil {
+		return "", err
+	}
+	nonceSize := fs.namesCipher.NonceSize()
+	if len(data) <= nonceSize {
+		return "", errors.New("invalid encrypted name")
+	}
+	decrypted, err := fs.namesCipher.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(decrypted), nil
+}
+
+func deriveEncryptionKey(masterKey, nonce []byte) ([32]byte, error) {
+	var key [32]byte
+	kdf := hkdf.New(sha256.New, masterKey, nonce, nil)
+	_, err := io.ReadFull(kdf, key[:])
+	return key, err
+}
+
 func (*CryptFs) encryptWrapper(dst io.Writer, src io.Reader, config sio.Config) (int64, error) {
 	encReader, err := sio.EncryptReader(src, config)
 	if err != nil {
@@ -386,6 +717,17 @@ func (h *encryptedFileHeader) Load(f *os.File) error {
 	return fmt.Errorf("unsupported encryption version: %v", h.version)
 }
 
+// decryptedNameFileInfo overrides the name of the wrapped FileInfo
+type decryptedNameFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+// Name returns the decrypted name
+func (fi *decryptedNameFileInfo) Name() string {
+	return fi.name
+}
+
 type cryptedFileWrapper struct {
 	*os.File
 }
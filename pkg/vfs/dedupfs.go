@@ -0,0 +1,466 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/metric"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	dedupLogSender          = "dedup"
+	dedupDefaultGCInterval  = 60
+	dedupTempSuffix         = ".sftpgo-dedup"
+	dedupMaxLinkAttempts    = 3
+	dedupBlockNameSeparator = "_"
+)
+
+var (
+	errDedupDisabled = errors.New("deduplication is not enabled in the configuration")
+	dedupConfig      DedupConfig
+	dedupGCMutex     sync.Mutex
+)
+
+// DedupConfig defines the global configuration for the deduplication store
+type DedupConfig struct {
+	// Absolute path to the block store. It must be on the same filesystem as
+	// the deduplicated directories, the blocks are hard links to the users'
+	// files. Empty means deduplication disabled
+	StorePath string `json:"store_path" mapstructure:"store_path"`
+	// Files smaller than this size, as KB, are not deduplicated
+	MinFileSize int64 `json:"min_file_size" mapstructure:"min_file_size"`
+	// Interval, in minutes, between the removals of the unreferenced blocks.
+	// 0 means the default: 60 minutes
+	GCInterval int `json:"gc_interval" mapstructure:"gc_interval"`
+}
+
+// IsEnabled returns true if the deduplication store is enabled
+func (c *DedupConfig) IsEnabled() bool {
+	return c.StorePath != ""
+}
+
+// Validate returns an error if the configuration is not valid.
+// Zero values are replaced with the defaults
+func (c *DedupConfig) Validate() error {
+	if !c.IsEnabled() {
+		return nil
+	}
+	if runtime.GOOS == "windows" {
+		return errors.New("deduplication is not supported on Windows")
+	}
+	if !filepath.IsAbs(c.StorePath) {
+		return fmt.Errorf("invalid dedup store path %q, it must be an absolute path", c.StorePath)
+	}
+	if c.MinFileSize < 0 {
+		return fmt.Errorf("invalid dedup min file size: %d", c.MinFileSize)
+	}
+	if c.GCInterval == 0 {
+		c.GCInterval = dedupDefaultGCInterval
+	}
+	if c.GCInterval < 0 {
+		return fmt.Errorf("invalid dedup GC interval: %d", c.GCInterval)
+	}
+	return os.MkdirAll(c.StorePath, 0700)
+}
+
+// SetDedupConfig sets the configuration for the deduplication store.
+// The configuration must be validated before calling this method
+func SetDedupConfig(config DedupConfig) {
+	dedupConfig = config
+}
+
+// DedupFsConfig defines the deduplication settings for a local filesystem
+type DedupFsConfig struct {
+	// If enabled the contents of the uploaded files are stored once in the
+	// deduplication store and the files are hard links to the stored blocks
+	Enabled bool `json:"enabled,omitempty"`
+}
+
+func (c *DedupFsConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if !dedupConfig.IsEnabled() {
+		return util.NewValidationError(errDedupDisabled.Error())
+	}
+	return nil
+}
+
+// DedupGCResult defines the result of a deduplication store garbage collection
+type DedupGCResult struct {
+	// Blocks still referenced by at least one file
+	Blocks int
+	// Size, as bytes, of the referenced blocks
+	Size int64
+	// Removed blocks, they were no longer referenced
+	RemovedBlocks int
+	// Size, as bytes, of the removed blocks
+	RemovedSize int64
+}
+
+// RunDedupGC removes the blocks no longer referenced by any file.
+// A block is not referenced if the store entry is its only hard link
+func RunDedupGC() (DedupGCResult, error) {
+	var result DedupGCResult
+	if !dedupConfig.IsEnabled() {
+		return result, errDedupDisabled
+	}
+	dedupGCMutex.Lock()
+	defer dedupGCMutex.Unlock()
+
+	startTime := time.Now()
+	err := filepath.WalkDir(dedupConfig.StorePath, func(walkedPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if _, _, links := getFileOwnerAndLinks(info); links > 1 {
+			result.Blocks++
+			result.Size += info.Size()
+			return nil
+		}
+		if err := os.Remove(walkedPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.Warn(dedupLogSender, "", "unable to remove unreferenced block %q: %v", walkedPath, err)
+			return nil
+		}
+		result.RemovedBlocks++
+		result.RemovedSize += info.Size()
+		return nil
+	})
+	metric.DedupGCCompleted(result.Blocks, result.Size, result.RemovedBlocks, err)
+	logger.Info(dedupLogSender, "", "dedup GC completed in %s, blocks: %d, size: %d, removed blocks: %d, removed size: %d, err: %v",
+		time.Since(startTime), result.Blocks, result.Size, result.RemovedBlocks, result.RemovedSize, err)
+	return result, err
+}
+
+// getDedupBlockPath returns the store path for a file with the specified hash.
+// The owner, the permissions and the modification time are shared by all the
+// hard links, so they are part of the block name too: files with the same
+// contents and different metadata are stored as different blocks
+func getDedupBlockPath(hash string, info os.FileInfo) string {
+	uid, gid, _ := getFileOwnerAndLinks(info)
+	name := strings.Join([]string{
+		hash,
+		fmt.Sprintf("%d", info.Size()),
+		fmt.Sprintf("%d", info.ModTime().UnixNano()),
+		fmt.Sprintf("%o", info.Mode().Perm()),
+		fmt.Sprintf("%d", uid),
+		fmt.Sprintf("%d", gid),
+	}, dedupBlockNameSeparator)
+	return filepath.Join(dedupConfig.StorePath, hash[:2], name)
+}
+
+func computeDedupHash(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// dedupFile wraps a local file to deduplicate it on close
+type dedupFile struct {
+	*os.File
+	once    sync.Once
+	onClose func()
+}
+
+func (f *dedupFile) Close() error {
+	err := f.File.Close()
+	f.once.Do(func() {
+		if err == nil {
+			f.onClose()
+		}
+	})
+	return err
+}
+
+// DedupFs is a local Fs implementation that stores the contents of the
+// uploaded files once. After an upload the file is hashed and replaced with
+// a hard link to the matching block in the deduplication store, or added to
+// the store if there is no matching block. Modifying a deduplicated file
+// detaches it from the shared block first, so the other files are not affected
+type DedupFs struct {
+	*OsFs
+}
+
+// NewDedupFs returns a DedupFs object
+func NewDedupFs(connectionID, rootDir, mountPath string) (Fs, error) {
+	if !dedupConfig.IsEnabled() {
+		return nil, errDedupDisabled
+	}
+	fs := &DedupFs{
+		OsFs: &OsFs{
+			name:         osFsName,
+			connectionID: connectionID,
+			rootDir:      rootDir,
+			mountPath:    getMountPath(mountPath),
+		},
+	}
+	if tempPath == "" {
+		fs.localTempDir = filepath.Clean(os.TempDir())
+	} else {
+		fs.localTempDir = tempPath
+	}
+	return fs, nil
+}
+
+// Create creates or opens the named file for writing, the file is
+// deduplicated when closed
+func (fs *DedupFs) Create(name string, flag, checks int) (File, *PipeWriter, func(), error) {
+	if err := fs.prepareWrite(name, flag); err != nil {
+		return nil, nil, nil, err
+	}
+	f, p, cancelFn, err := fs.OsFs.Create(name, flag, checks)
+	if err != nil {
+		return f, p, cancelFn, err
+	}
+	file, ok := f.(*os.File)
+	if !ok {
+		return f, p, cancelFn, err
+	}
+	return &dedupFile{
+		File: file,
+		onClose: func() {
+			if err := fs.deduplicate(name); err != nil {
+				fsLog(fs, logger.LevelWarn, "unable to deduplicate file %q: %v", name, err)
+			}
+		},
+	}, p, cancelFn, nil
+}
+
+// Truncate changes the size of the named file, it is detached
+// from the shared block first
+func (fs *DedupFs) Truncate(name string, size int64) error {
+	if err := fs.prepareWrite(name, os.O_WRONLY); err != nil {
+		return err
+	}
+	return fs.OsFs.Truncate(name, size)
+}
+
+// Chown changes the numeric uid and gid of the named file
+func (fs *DedupFs) Chown(name string, uid int, gid int) error {
+	return fs.changeMetadata(name, func() error {
+		return fs.OsFs.Chown(name, uid, gid)
+	})
+}
+
+// Chmod changes the mode of the named file to mode
+func (fs *DedupFs) Chmod(name string, mode os.FileMode) error {
+	return fs.changeMetadata(name, func() error {
+		return fs.OsFs.Chmod(name, mode)
+	})
+}
+
+// Chtimes changes the access and modification times of the named file
+func (fs *DedupFs) Chtimes(name string, atime, mtime time.Time, isUploading bool) error {
+	return fs.changeMetadata(name, func() error {
+		return fs.OsFs.Chtimes(name, atime, mtime, isUploading)
+	})
+}
+
+// prepareWrite detaches the named file from the shared block before
+// modifying it. Truncated files are simply unlinked
+func (fs *DedupFs) prepareWrite(name string, flag int) error {
+	info, err := os.Lstat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	if _, _, links := getFileOwnerAndLinks(info); links <= 1 {
+		return nil
+	}
+	if flag == 0 || flag&os.O_TRUNC != 0 {
+		return os.Remove(name)
+	}
+	return fs.copyOnWrite(name, info)
+}
+
+// changeMetadata detaches the named file from the shared block, applies the
+// metadata change and deduplicates the file again using the new metadata
+func (fs *DedupFs) changeMetadata(name string, fn func() error) error {
+	info, err := os.Lstat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return fn()
+	}
+	if _, _, links := getFileOwnerAndLinks(info); links <= 1 {
+		return fn()
+	}
+	hash, err := computeDedupHash(name)
+	if err != nil {
+		return err
+	}
+	if err := fs.detach(name, hash, info); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	if err := fs.linkToBlock(name, hash); err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to deduplicate file %q after a metadata change: %v", name, err)
+	}
+	return nil
+}
+
+// detach makes sure the named file is the only reference to its contents.
+// If the file is only shared with its own block, removing the block is enough
+func (fs *DedupFs) detach(name, hash string, info os.FileInfo) error {
+	if _, _, links := getFileOwnerAndLinks(info); links == 2 {
+		blockPath := getDedupBlockPath(hash, info)
+		blockInfo, err := os.Lstat(blockPath)
+		if err == nil && os.SameFile(info, blockInfo) {
+			return os.Remove(blockPath)
+		}
+	}
+	return fs.copyOnWrite(name, info)
+}
+
+// copyOnWrite replaces the named file with a private copy
+func (fs *DedupFs) copyOnWrite(name string, info os.FileInfo) error {
+	tempName := filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+dedupTempSuffix)
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(tempName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if errClose := dst.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Chmod(tempName, info.Mode().Perm())
+	}
+	if err == nil {
+		err = os.Chtimes(tempName, info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		if uid, gid, _ := getFileOwnerAndLinks(info); uid != -1 {
+			// this can fail if SFTPGo does not run as root, the file keeps the SFTPGo owner
+			os.Lchown(tempName, uid, gid) //nolint:errcheck
+		}
+		err = os.Rename(tempName, name)
+	}
+	if err != nil {
+		os.Remove(tempName) //nolint:errcheck
+		return err
+	}
+	fsLog(fs, logger.LevelDebug, "file %q detached from the dedup store", name)
+	return nil
+}
+
+func (fs *DedupFs) deduplicate(name string) error {
+	info, err := os.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() || info.Size() < dedupConfig.MinFileSize*1024 {
+		return nil
+	}
+	hash, err := computeDedupHash(name)
+	if err != nil {
+		return err
+	}
+	return fs.linkToBlock(name, hash)
+}
+
+// linkToBlock replaces the named file with a hard link to the block matching
+// its contents and metadata or adds the file to the store as a new block
+func (fs *DedupFs) linkToBlock(name, hash string) error {
+	for attempt := 0; attempt < dedupMaxLinkAttempts; attempt++ {
+		info, err := os.Lstat(name)
+		if err != nil {
+			return err
+		}
+		blockPath := getDedupBlockPath(hash, info)
+		blockInfo, err := os.Lstat(blockPath)
+		if err == nil {
+			if os.SameFile(info, blockInfo) {
+				return nil
+			}
+			if blockInfo.Size() != info.Size() || !blockInfo.ModTime().Equal(info.ModTime()) ||
+				blockInfo.Mode() != info.Mode() {
+				// the block metadata were changed outside SFTPGo, the block
+				// name is not valid anymore, the existing links are not affected
+				if err := os.Remove(blockPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+					return err
+				}
+				continue
+			}
+			tempName := filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+dedupTempSuffix)
+			if err := os.Link(blockPath, tempName); err != nil {
+				// the block could have been removed by the GC
+				fsLog(fs, logger.LevelDebug, "unable to link block %q: %v", blockPath, err)
+				continue
+			}
+			if err := os.Rename(tempName, name); err != nil {
+				os.Remove(tempName) //nolint:errcheck
+				return err
+			}
+			fsLog(fs, logger.LevelDebug, "file %q deduplicated, size: %d", name, info.Size())
+			metric.DedupFileStored(info.Size(), true)
+			return nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(blockPath), 0700); err != nil {
+			return err
+		}
+		err = os.Link(name, blockPath)
+		if err == nil {
+			fsLog(fs, logger.LevelDebug, "file %q added to the dedup store, size: %d", name, info.Size())
+			metric.DedupFileStored(info.Size(), false)
+			return nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return err
+		}
+		// the same block was stored concurrently
+	}
+	return fmt.Errorf("unable to link %q to the dedup store after %d attempts", name, dedupMaxLinkAttempts)
+}
@@ -0,0 +1,426 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vfs
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/metric"
+)
+
+const (
+	dirListCacheLogSender = "dirlistcache"
+)
+
+var (
+	dirListCacheMutex    sync.RWMutex
+	dirListCacheInstance *dirListCache
+)
+
+// DirListCacheConfig defines the configuration for the in memory cache of the
+// directory listings used by the S3, Google Cloud Storage and Azure Blob storage backends
+type DirListCacheConfig struct {
+	// Time to live, as seconds, for the cached listings. 0 means cache disabled
+	TTL int `json:"ttl" mapstructure:"ttl"`
+	// Maximum number of cached directory listings. The least recently used
+	// listings are evicted when this number is exceeded
+	MaxDirs int `json:"max_dirs" mapstructure:"max_dirs"`
+	// Listings with more entries than this limit are never cached.
+	// 0 means no limit
+	MaxDirEntries int `json:"max_dir_entries" mapstructure:"max_dir_entries"`
+}
+
+// IsEnabled returns true if the directory listing cache is enabled
+func (c *DirListCacheConfig) IsEnabled() bool {
+	return c.TTL > 0
+}
+
+// Validate returns an error if the configuration is not valid
+func (c *DirListCacheConfig) Validate() error {
+	if c.TTL < 0 {
+		return fmt.Errorf("invalid directory listing cache ttl: %d", c.TTL)
+	}
+	if !c.IsEnabled() {
+		return nil
+	}
+	if c.MaxDirs <= 0 {
+		return fmt.Errorf("invalid directory listing cache max dirs: %d", c.MaxDirs)
+	}
+	if c.MaxDirEntries < 0 {
+		return errors.New("directory listing cache max dir entries cannot be negative")
+	}
+	return nil
+}
+
+// SetDirListCacheConfig sets the configuration for the directory listing cache.
+// The cached listings, if any, are discarded.
+// The configuration must be validated before calling this method
+func SetDirListCacheConfig(config DirListCacheConfig) {
+	var cache *dirListCache
+	if config.IsEnabled() {
+		cache = &dirListCache{
+			ttl:           time.Duration(config.TTL) * time.Second,
+			maxDirs:       config.MaxDirs,
+			maxDirEntries: config.MaxDirEntries,
+			lru:           list.New(),
+			entries:       make(map[dirListCacheKey]*list.Element),
+		}
+		logger.Info(dirListCacheLogSender, "", "directory listing cache enabled, ttl: %v, max dirs: %d, max dir entries: %d",
+			cache.ttl, cache.maxDirs, cache.maxDirEntries)
+	}
+	dirListCacheMutex.Lock()
+	defer dirListCacheMutex.Unlock()
+
+	dirListCacheInstance = cache
+	metric.UpdateDirListCacheEntries(0)
+}
+
+func getDirListCache() *dirListCache {
+	dirListCacheMutex.RLock()
+	defer dirListCacheMutex.RUnlock()
+
+	return dirListCacheInstance
+}
+
+type dirListCacheKey struct {
+	namespace string
+	dir       string
+}
+
+type dirListCacheEntry struct {
+	key       dirListCacheKey
+	files     []os.FileInfo
+	expiresAt time.Time
+}
+
+// dirListCache keeps the directory listings ordered by recent use, the least
+// recently used listings are evicted to stay within the configured number.
+// The generation is incremented for each invalidation, a listing started
+// before an invalidation is not added to the cache, it could be stale
+type dirListCache struct {
+	mu            sync.Mutex
+	ttl           time.Duration
+	maxDirs       int
+	maxDirEntries int
+	generation    uint64
+	lru           *list.List
+	entries       map[dirListCacheKey]*list.Element
+}
+
+func (c *dirListCache) getGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.generation
+}
+
+// get returns a copy of the cached listing, if any and not expired
+func (c *dirListCache) get(key dirListCacheKey) ([]os.FileInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*dirListCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.removeElement(el)
+		metric.UpdateDirListCacheEntries(c.lru.Len())
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	result := make([]os.FileInfo, len(entry.files))
+	copy(result, entry.files)
+	return result, true
+}
+
+// add stores a copy of the listing if no invalidation happened after the
+// specified generation
+func (c *dirListCache) add(key dirListCacheKey, files []os.FileInfo, generation uint64) {
+	if c.maxDirEntries > 0 && len(files) > c.maxDirEntries {
+		return
+	}
+	cached := make([]os.FileInfo, len(files))
+	copy(cached, files)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generation != generation {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el)
+	}
+	for c.lru.Len() >= c.maxDirs {
+		c.removeElement(c.lru.Back())
+	}
+	c.entries[key] = c.lru.PushFront(&dirListCacheEntry{
+		key:       key,
+		files:     cached,
+		expiresAt: time.Now().Add(c.ttl),
+	})
+	metric.UpdateDirListCacheEntries(c.lru.Len())
+}
+
+// invalidate removes the listings of the parent directories of the specified
+// name. If recursive is true the listings of name and of its subdirectories
+// are removed too
+func (c *dirListCache) invalidate(namespace, name string, recursive bool) {
+	name = path.Clean(name)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	removed := 0
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		if el, ok := c.entries[dirListCacheKey{namespace: namespace, dir: dir}]; ok {
+			c.removeElement(el)
+			removed++
+		}
+		if dir == path.Dir(dir) {
+			break
+		}
+	}
+	if recursive {
+		prefix := name + "/"
+		for key, el := range c.entries {
+			if key.namespace == namespace && (key.dir == name || strings.HasPrefix(key.dir, prefix)) {
+				c.removeElement(el)
+				removed++
+			}
+		}
+	}
+	if removed > 0 {
+		metric.DirListCacheInvalidation(removed)
+		metric.UpdateDirListCacheEntries(c.lru.Len())
+	}
+}
+
+// removeElement must be called with the lock held
+func (c *dirListCache) removeElement(el *list.Element) {
+	entry := el.Value.(*dirListCacheEntry)
+	c.lru.Remove(el)
+	delete(c.entries, entry.key)
+}
+
+// NewDirListCacheFs returns a Fs that caches the directory listings in memory
+// if the directory listing cache is enabled, the provided Fs otherwise.
+// The namespace identifies the storage, for example the endpoint and the bucket,
+// so the listings are shared among the connections using the same storage
+// and the write operations made by any of them invalidate the cached listings
+func NewDirListCacheFs(fs Fs, namespace string) Fs {
+	cache := getDirListCache()
+	if cache == nil {
+		return fs
+	}
+	cacheFs := &dirListCacheFs{
+		Fs:        fs,
+		cache:     cache,
+		namespace: namespace,
+	}
+	if _, ok := fs.(FsFileCopier); ok {
+		if _, ok := fs.(FsBatchRemover); ok {
+			return &dirListCacheBatchRemoverFs{
+				dirListCacheCopierFs: &dirListCacheCopierFs{dirListCacheFs: cacheFs},
+			}
+		}
+		return &dirListCacheCopierFs{dirListCacheFs: cacheFs}
+	}
+	return cacheFs
+}
+
+// newObjectStorageFs wraps an object storage Fs with the enabled caches
+func newObjectStorageFs(fs Fs, namespace string) Fs {
+	return NewDirListCacheFs(NewObjectCacheFs(fs, namespace), namespace)
+}
+
+// dirListCacheFs wraps a Fs adding a cache for the directory listings.
+// The cached listings expire after the configured TTL and they are
+// invalidated after the write operations made using this Fs, changes made
+// outside SFTPGo are visible after the TTL expiration
+type dirListCacheFs struct {
+	Fs
+	cache     *dirListCache
+	namespace string
+}
+
+func (fs *dirListCacheFs) getCacheKey(dirname string) dirListCacheKey {
+	return dirListCacheKey{
+		namespace: fs.namespace,
+		dir:       path.Clean(dirname),
+	}
+}
+
+// ReadDir returns the cached listing for dirname if available, otherwise
+// the directory is listed and the result is added to the cache
+func (fs *dirListCacheFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	key := fs.getCacheKey(dirname)
+	if files, ok := fs.cache.get(key); ok {
+		fsLog(fs, logger.LevelDebug, "directory listing cache hit for path %q", dirname)
+		metric.DirListCacheHit()
+		return files, nil
+	}
+	metric.DirListCacheMiss()
+	generation := fs.cache.getGeneration()
+	files, err := fs.Fs.ReadDir(dirname)
+	if err == nil {
+		fs.cache.add(key, files, generation)
+	}
+	return files, err
+}
+
+// ListDir implements the FsDirLister interface. The cached listing for dirname
+// is returned if available, otherwise the listing is read in chunks from the
+// wrapped Fs and it is added to the cache once complete
+func (fs *dirListCacheFs) ListDir(dirname string) (DirLister, error) {
+	key := fs.getCacheKey(dirname)
+	if files, ok := fs.cache.get(key); ok {
+		fsLog(fs, logger.LevelDebug, "directory listing cache hit for path %q", dirname)
+		metric.DirListCacheHit()
+		return NewSliceDirLister(files), nil
+	}
+	metric.DirListCacheMiss()
+	generation := fs.cache.getGeneration()
+	lister, err := ListDir(fs.Fs, dirname)
+	if err != nil {
+		return nil, err
+	}
+	return &dirListCacheLister{
+		DirLister:  lister,
+		cache:      fs.cache,
+		key:        key,
+		generation: generation,
+	}, nil
+}
+
+// Create invalidates the listings of the parent directories after the upload
+func (fs *dirListCacheFs) Create(name string, flag, checks int) (File, *PipeWriter, func(), error) {
+	f, p, cancelFn, err := fs.Fs.Create(name, flag, checks)
+	if err != nil || p == nil {
+		fs.cache.invalidate(fs.namespace, name, false)
+		return f, p, cancelFn, err
+	}
+	p.setDoneHook(func(_ error) {
+		fs.cache.invalidate(fs.namespace, name, false)
+	})
+	return f, p, cancelFn, err
+}
+
+// Rename renames source to target and invalidates the affected listings
+func (fs *dirListCacheFs) Rename(source, target string) (int, int64, error) {
+	numFiles, size, err := fs.Fs.Rename(source, target)
+	fs.cache.invalidate(fs.namespace, source, true)
+	fs.cache.invalidate(fs.namespace, target, true)
+	return numFiles, size, err
+}
+
+// Remove removes the named file or directory and invalidates the affected listings
+func (fs *dirListCacheFs) Remove(name string, isDir bool) error {
+	err := fs.Fs.Remove(name, isDir)
+	fs.cache.invalidate(fs.namespace, name, isDir)
+	return err
+}
+
+// Mkdir creates the named directory and invalidates the listings of the
+// parent directories
+func (fs *dirListCacheFs) Mkdir(name string) error {
+	err := fs.Fs.Mkdir(name)
+	fs.cache.invalidate(fs.namespace, name, false)
+	return err
+}
+
+// Chtimes changes the modification time of the named file and invalidates
+// the listings of the parent directories
+func (fs *dirListCacheFs) Chtimes(name string, atime, mtime time.Time, isUploading bool) error {
+	err := fs.Fs.Chtimes(name, atime, mtime, isUploading)
+	fs.cache.invalidate(fs.namespace, name, false)
+	return err
+}
+
+// dirListCacheCopierFs is a dirListCacheFs for storages supporting server side copy
+type dirListCacheCopierFs struct {
+	*dirListCacheFs
+}
+
+// CopyFile implements the FsFileCopier interface
+func (fs *dirListCacheCopierFs) CopyFile(source, target string, srcSize int64) error {
+	err := fs.Fs.(FsFileCopier).CopyFile(source, target, srcSize)
+	fs.cache.invalidate(fs.namespace, target, false)
+	return err
+}
+
+// dirListCacheBatchRemoverFs is a dirListCacheCopierFs for storages supporting
+// batch removals
+type dirListCacheBatchRemoverFs struct {
+	*dirListCacheCopierFs
+}
+
+// RemoveFiles implements the FsBatchRemover interface
+func (fs *dirListCacheBatchRemoverFs) RemoveFiles(names []string) error {
+	err := fs.Fs.(FsBatchRemover).RemoveFiles(names)
+	for _, name := range names {
+		fs.cache.invalidate(fs.namespace, name, false)
+	}
+	return err
+}
+
+// dirListCacheLister collects the entries returned by the wrapped lister and
+// adds them to the cache when the listing is complete. Listings with too many
+// entries are not collected
+type dirListCacheLister struct {
+	DirLister
+	cache      *dirListCache
+	key        dirListCacheKey
+	generation uint64
+	files      []os.FileInfo
+	skipCache  bool
+}
+
+// Next implements the DirLister interface
+func (l *dirListCacheLister) Next(limit int) ([]os.FileInfo, error) {
+	files, err := l.DirLister.Next(limit)
+	if l.skipCache {
+		return files, err
+	}
+	l.files = append(l.files, files...)
+	if l.cache.maxDirEntries > 0 && len(l.files) > l.cache.maxDirEntries {
+		l.discard()
+		return files, err
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			l.cache.add(l.key, l.files, l.generation)
+		}
+		l.discard()
+	}
+	return files, err
+}
+
+func (l *dirListCacheLister) discard() {
+	l.skipCache = true
+	l.files = nil
+}
@@ -0,0 +1,133 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// ListerBatchSize defines the default number of entries returned by a
+// DirLister if no valid limit is requested
+const ListerBatchSize = 1000
+
+// ListDir returns a DirLister for the directory named by dirname.
+// The listing is read in chunks if the Fs implements FsDirLister,
+// otherwise the whole listing is read using ReadDir
+func ListDir(fs Fs, dirname string) (DirLister, error) {
+	if fsLister, ok := fs.(FsDirLister); ok {
+		return fsLister.ListDir(dirname)
+	}
+	files, err := fs.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	return NewSliceDirLister(files), nil
+}
+
+// ReadAllFromDirLister reads all the entries from the specified lister and closes it
+func ReadAllFromDirLister(lister DirLister) ([]os.FileInfo, error) {
+	defer lister.Close()
+
+	var result []os.FileInfo
+	for {
+		files, err := lister.Next(ListerBatchSize)
+		result = append(result, files...)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return result, nil
+			}
+			return nil, err
+		}
+	}
+}
+
+// NewSliceDirLister returns a DirLister for an already loaded listing
+func NewSliceDirLister(files []os.FileInfo) DirLister {
+	return &baseDirLister{cache: files}
+}
+
+// baseDirLister returns the entries from its cache, the listers for the
+// object storage backends use it to buffer the entries of the listed pages
+type baseDirLister struct {
+	cache []os.FileInfo
+}
+
+// Next implements the DirLister interface
+func (l *baseDirLister) Next(limit int) ([]os.FileInfo, error) {
+	return l.returnFromCache(limit)
+}
+
+func (l *baseDirLister) returnFromCache(limit int) ([]os.FileInfo, error) {
+	if len(l.cache) == 0 {
+		return nil, io.EOF
+	}
+	if limit <= 0 || limit >= len(l.cache) {
+		result := l.cache
+		l.cache = nil
+		return result, nil
+	}
+	result := l.cache[:limit:limit]
+	l.cache = l.cache[limit:]
+	return result, nil
+}
+
+// Close implements the DirLister interface
+func (l *baseDirLister) Close() error {
+	l.cache = nil
+	return nil
+}
+
+func getListerLimit(limit int) int {
+	if limit <= 0 {
+		return ListerBatchSize
+	}
+	return limit
+}
+
+// osDirLister reads the directory entries from an opened directory
+type osDirLister struct {
+	f *os.File
+}
+
+// Next implements the DirLister interface
+func (l *osDirLister) Next(limit int) ([]os.FileInfo, error) {
+	return l.f.Readdir(getListerLimit(limit))
+}
+
+// Close implements the DirLister interface
+func (l *osDirLister) Close() error {
+	return l.f.Close()
+}
+
+// fileInfoConverterDirLister converts the entries returned by a lister,
+// the entries converted to nil are skipped
+type fileInfoConverterDirLister struct {
+	DirLister
+	convert func(os.FileInfo) os.FileInfo
+}
+
+// Next implements the DirLister interface
+func (l *fileInfoConverterDirLister) Next(limit int) ([]os.FileInfo, error) {
+	files, err := l.DirLister.Next(limit)
+	converted := files[:0]
+	for _, info := range files {
+		if info = l.convert(info); info != nil {
+			converted = append(converted, info)
+		}
+	}
+	return converted, err
+}
@@ -0,0 +1,942 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/eikenb/pipeat"
+	"github.com/pkg/sftp"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/metric"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	failoverFsName = "failoverfs"
+	// maximum number of journal entries for each folder
+	failoverJournalMaxSize       = 10000
+	failoverDefaultRetryInterval = 30
+)
+
+// Supported failover journal operations
+const (
+	FailoverOpCreate   = "create"
+	FailoverOpRename   = "rename"
+	FailoverOpRemove   = "remove"
+	FailoverOpMkdir    = "mkdir"
+	FailoverOpSymlink  = "symlink"
+	FailoverOpChmod    = "chmod"
+	FailoverOpChtimes  = "chtimes"
+	FailoverOpTruncate = "truncate"
+)
+
+var (
+	errFailoverTimeout = errors.New("timeout waiting for the primary storage backend")
+	failoverStates     = failoverRegistry{
+		states: make(map[string]*failoverState),
+	}
+)
+
+// FolderFailover defines a secondary storage backend for a virtual folder.
+// Reads are served by the secondary backend if the primary one returns
+// errors or timeouts, writes are executed on the secondary backend and
+// journaled so they can be reconciled later
+type FolderFailover struct {
+	// Mapped path for the local and local encrypted secondary backends
+	MappedPath string `json:"mapped_path,omitempty"`
+	// Filesystem configuration for the secondary backend
+	FsConfig Filesystem `json:"filesystem"`
+	// Timeout, in seconds, for the metadata operations, such as stat and
+	// directory listing, on the primary backend. 0 means no timeout
+	Timeout int `json:"timeout,omitempty"`
+	// Interval, in seconds, before retrying the primary backend after a failover.
+	// 0 means the default interval: 30 seconds
+	RetryInterval int `json:"retry_interval,omitempty"`
+}
+
+// GetACopy returns a copy
+func (f *FolderFailover) GetACopy() *FolderFailover {
+	if f == nil {
+		return nil
+	}
+	return &FolderFailover{
+		MappedPath:    f.MappedPath,
+		FsConfig:      f.FsConfig.GetACopy(),
+		Timeout:       f.Timeout,
+		RetryInterval: f.RetryInterval,
+	}
+}
+
+func (f *FolderFailover) getRetryInterval() time.Duration {
+	if f.RetryInterval > 0 {
+		return time.Duration(f.RetryInterval) * time.Second
+	}
+	return failoverDefaultRetryInterval * time.Second
+}
+
+// FailoverJournalEntry defines a write operation executed on the secondary
+// storage backend while the primary one was unavailable
+type FailoverJournalEntry struct {
+	ID int64 `json:"id"`
+	// Unix timestamp in milliseconds
+	Timestamp int64  `json:"timestamp"`
+	Operation string `json:"operation"`
+	// Path relative to the folder root
+	Path string `json:"path"`
+	// Rename target or symlink name, relative to the folder root
+	Target string `json:"target,omitempty"`
+	IsDir  bool   `json:"is_dir,omitempty"`
+}
+
+// FolderFailoverStatus defines the failover status for a virtual folder
+type FolderFailoverStatus struct {
+	Folder string `json:"folder"`
+	// True if the operations are served by the secondary backend
+	Active bool `json:"active"`
+	// Unix timestamp in milliseconds of the last switch to the secondary backend
+	Since     int64  `json:"since,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+	// Number of switches to the secondary backend since the service start
+	Failovers int64 `json:"failovers"`
+	// True if some journal entries were discarded because the maximum size was reached.
+	// A full synchronization between the backends is required in this case
+	JournalOverflow bool                   `json:"journal_overflow,omitempty"`
+	Journal         []FailoverJournalEntry `json:"journal"`
+}
+
+type failoverState struct {
+	sync.RWMutex
+	folder        string
+	active        atomic.Bool
+	since         int64
+	lastCheck     int64
+	lastError     string
+	failovers     int64
+	journal       []FailoverJournalEntry
+	lastJournalID int64
+	overflow      bool
+}
+
+// usePrimary returns true if the primary backend must be used.
+// After a failover the primary backend is retried once the retry interval
+// elapses, but only if there are no journaled writes to reconcile
+func (s *failoverState) usePrimary(retryInterval time.Duration) bool {
+	if !s.active.Load() {
+		return true
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.journal) > 0 {
+		return false
+	}
+	now := util.GetTimeAsMsSinceEpoch(time.Now())
+	if now-s.lastCheck < retryInterval.Milliseconds() {
+		return false
+	}
+	s.lastCheck = now
+	return true
+}
+
+func (s *failoverState) setFailed(err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := util.GetTimeAsMsSinceEpoch(time.Now())
+	s.lastCheck = now
+	s.lastError = err.Error()
+	if !s.active.Load() {
+		s.active.Store(true)
+		s.since = now
+		s.failovers++
+		metric.AddFolderFailover(s.folder)
+		logger.Warn(failoverFsName, "", "folder %q: primary storage backend unavailable, switching to the secondary one: %v",
+			s.folder, err)
+	}
+	metric.UpdateFolderFailoverStatus(s.folder, true, len(s.journal))
+}
+
+func (s *failoverState) setRecovered() {
+	if !s.active.Load() {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.journal) > 0 || !s.active.Load() {
+		return
+	}
+	s.active.Store(false)
+	s.overflow = false
+	logger.Info(failoverFsName, "", "folder %q: primary storage backend available again", s.folder)
+	metric.UpdateFolderFailoverStatus(s.folder, false, 0)
+}
+
+func (s *failoverState) addJournalEntry(operation, name, target string, isDir bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.lastJournalID++
+	s.journal = append(s.journal, FailoverJournalEntry{
+		ID:        s.lastJournalID,
+		Timestamp: util.GetTimeAsMsSinceEpoch(time.Now()),
+		Operation: operation,
+		Path:      name,
+		Target:    target,
+		IsDir:     isDir,
+	})
+	if len(s.journal) > failoverJournalMaxSize {
+		s.journal = s.journal[len(s.journal)-failoverJournalMaxSize:]
+		s.overflow = true
+	}
+	metric.UpdateFolderFailoverStatus(s.folder, s.active.Load(), len(s.journal))
+}
+
+func (s *failoverState) getJournal() []FailoverJournalEntry {
+	s.RLock()
+	defer s.RUnlock()
+
+	journal := make([]FailoverJournalEntry, len(s.journal))
+	copy(journal, s.journal)
+	return journal
+}
+
+// removeJournalEntries removes the journal entries up to the specified ID,
+// the folder switches back to the primary backend if the journal is empty
+func (s *failoverState) removeJournalEntries(lastID int64) {
+	s.Lock()
+	defer s.Unlock()
+
+	idx := sort.Search(len(s.journal), func(i int) bool {
+		return s.journal[i].ID > lastID
+	})
+	s.journal = s.journal[idx:]
+	if len(s.journal) == 0 && s.active.Load() {
+		s.active.Store(false)
+		s.overflow = false
+		logger.Info(failoverFsName, "", "folder %q: journal reconciled, switching back to the primary storage backend",
+			s.folder)
+	}
+	metric.UpdateFolderFailoverStatus(s.folder, s.active.Load(), len(s.journal))
+}
+
+func (s *failoverState) getStatus() FolderFailoverStatus {
+	s.RLock()
+	defer s.RUnlock()
+
+	journal := make([]FailoverJournalEntry, len(s.journal))
+	copy(journal, s.journal)
+	return FolderFailoverStatus{
+		Folder:          s.folder,
+		Active:          s.active.Load(),
+		Since:           s.since,
+		LastError:       s.lastError,
+		Failovers:       s.failovers,
+		JournalOverflow: s.overflow,
+		Journal:         journal,
+	}
+}
+
+type failoverRegistry struct {
+	sync.RWMutex
+	states map[string]*failoverState
+}
+
+func (r *failoverRegistry) get(folder string) *failoverState {
+	r.RLock()
+	state, ok := r.states[folder]
+	r.RUnlock()
+	if ok {
+		return state
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if state, ok := r.states[folder]; ok {
+		return state
+	}
+	state = &failoverState{
+		folder: folder,
+	}
+	r.states[folder] = state
+	return state
+}
+
+// GetFolderFailoverStatus returns the failover status for the specified folder
+func GetFolderFailoverStatus(folder string) FolderFailoverStatus {
+	return failoverStates.get(folder).getStatus()
+}
+
+// GetFoldersFailoverStatus returns the failover status for the folders
+// with a secondary backend used since the service start
+func GetFoldersFailoverStatus() []FolderFailoverStatus {
+	failoverStates.RLock()
+	defer failoverStates.RUnlock()
+
+	result := make([]FolderFailoverStatus, 0, len(failoverStates.states))
+	for _, state := range failoverStates.states {
+		result = append(result, state.getStatus())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Folder < result[j].Folder
+	})
+	return result
+}
+
+// RemoveFolderFailoverStatus removes the failover status, and the journal,
+// for the specified folder
+func RemoveFolderFailoverStatus(folder string) {
+	failoverStates.Lock()
+	defer failoverStates.Unlock()
+
+	if _, ok := failoverStates.states[folder]; ok {
+		delete(failoverStates.states, folder)
+		metric.RemoveFolderFailoverStatus(folder)
+	}
+}
+
+// isBackendUnavailableError returns true if the error is not caused by the
+// request itself, for example a missing file, and so the backend is considered
+// unavailable
+func isBackendUnavailableError(fs Fs, err error) bool {
+	if err == nil || fs.IsNotExist(err) || fs.IsPermission(err) || fs.IsNotSupported(err) {
+		return false
+	}
+	var pathErr *pathResolutionError
+	if errors.As(err, &pathErr) {
+		return false
+	}
+	for _, target := range []error{os.ErrExist, os.ErrInvalid, io.EOF, ErrVfsUnsupported, ErrStorageSizeUnavailable,
+		syscall.ENOTEMPTY, syscall.EISDIR, syscall.ENOTDIR, syscall.EINVAL, syscall.ENAMETOOLONG} {
+		if errors.Is(err, target) {
+			return false
+		}
+	}
+	return true
+}
+
+func runWithTimeout[T any](timeout time.Duration, fn func() (T, error)) (T, error) {
+	if timeout <= 0 {
+		return fn()
+	}
+	type result struct {
+		val T
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		val, err := fn()
+		ch <- result{val: val, err: err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-ch:
+		return res.val, res.err
+	case <-timer.C:
+		var val T
+		return val, errFailoverTimeout
+	}
+}
+
+// failoverRead executes a read operation on the primary backend and on the
+// secondary one if the primary is unavailable
+func failoverRead[T any](fs *FailoverFs, name string, withTimeout bool, fn func(Fs, string) (T, error)) (T, error) {
+	if fs.primary != nil && fs.state.usePrimary(fs.retryInterval) {
+		var timeout time.Duration
+		if withTimeout {
+			timeout = fs.timeout
+		}
+		res, err := runWithTimeout(timeout, func() (T, error) {
+			fsPath, err := fs.primary.ResolvePath(name)
+			if err != nil {
+				var val T
+				return val, err
+			}
+			return fn(fs.primary, fsPath)
+		})
+		if !isBackendUnavailableError(fs.primary, err) {
+			fs.state.setRecovered()
+			return res, err
+		}
+		fsLog(fs, logger.LevelWarn, "read operation on path %q failed on the primary backend: %v", name, err)
+		fs.state.setFailed(err)
+	}
+	fsPath, err := fs.secondary.ResolvePath(name)
+	if err != nil {
+		var val T
+		return val, err
+	}
+	return fn(fs.secondary, fsPath)
+}
+
+// failoverWrite executes a write operation on the primary backend and on the
+// secondary one if the primary is unavailable. The operations executed on the
+// secondary backend are journaled
+func failoverWrite[T any](fs *FailoverFs, operation string, isDir bool, names []string, fn func(Fs, []string) (T, error)) (T, error) {
+	resolve := func(backend Fs) ([]string, error) {
+		fsPaths := make([]string, 0, len(names))
+		for _, name := range names {
+			fsPath, err := backend.ResolvePath(name)
+			if err != nil {
+				return nil, err
+			}
+			fsPaths = append(fsPaths, fsPath)
+		}
+		return fsPaths, nil
+	}
+	if fs.primary != nil && fs.state.usePrimary(fs.retryInterval) {
+		fsPaths, err := resolve(fs.primary)
+		var res T
+		if err == nil {
+			res, err = fn(fs.primary, fsPaths)
+		}
+		if !isBackendUnavailableError(fs.primary, err) {
+			fs.state.setRecovered()
+			return res, err
+		}
+		fsLog(fs, logger.LevelWarn, "write operation %q on path %q failed on the primary backend: %v",
+			operation, names[0], err)
+		fs.state.setFailed(err)
+	}
+	fsPaths, err := resolve(fs.secondary)
+	if err != nil {
+		var val T
+		return val, err
+	}
+	res, err := fn(fs.secondary, fsPaths)
+	if err == nil && operation != "" {
+		var target string
+		if len(names) > 1 {
+			target = fs.getFolderPath(names[1])
+		}
+		fs.state.addJournalEntry(operation, fs.getFolderPath(names[0]), target, isDir)
+	}
+	return res, err
+}
+
+type failoverOpenResult struct {
+	file   File
+	reader *pipeat.PipeReaderAt
+	cancel func()
+}
+
+type failoverCreateResult struct {
+	file   File
+	writer *PipeWriter
+	cancel func()
+}
+
+type failoverRenameResult struct {
+	numFiles int
+	size     int64
+}
+
+// FailoverFs is a Fs implementation that uses a secondary storage backend
+// if the primary one is unavailable.
+// The paths used by this Fs are the virtual paths, they are resolved
+// using the backend that serves each request
+type FailoverFs struct {
+	connectionID  string
+	mountPath     string
+	primary       Fs
+	secondary     Fs
+	state         *failoverState
+	timeout       time.Duration
+	retryInterval time.Duration
+}
+
+// NewFailoverFs returns a FailoverFs object for the specified folder.
+// The primary backend can be nil if it cannot be initialized
+func NewFailoverFs(connectionID, mountPath, folderName string, primary, secondary Fs, config FolderFailover) Fs {
+	fs := &FailoverFs{
+		connectionID:  connectionID,
+		mountPath:     getMountPath(mountPath),
+		primary:       primary,
+		secondary:     secondary,
+		state:         failoverStates.get(folderName),
+		timeout:       time.Duration(config.Timeout) * time.Second,
+		retryInterval: config.getRetryInterval(),
+	}
+	metric.UpdateFolderFailoverStatus(folderName, fs.state.active.Load(), len(fs.state.getJournal()))
+	return fs
+}
+
+// getFolderPath returns the path relative to the folder root
+func (fs *FailoverFs) getFolderPath(name string) string {
+	rel := path.Clean("/" + name)
+	if fs.mountPath != "" {
+		rel = path.Clean("/" + strings.TrimPrefix(rel, fs.mountPath))
+	}
+	return rel
+}
+
+// Name returns the name for the Fs implementation
+func (fs *FailoverFs) Name() string {
+	return failoverFsName
+}
+
+// ConnectionID returns the connection ID associated to this Fs implementation
+func (fs *FailoverFs) ConnectionID() string {
+	return fs.connectionID
+}
+
+// Stat returns a FileInfo describing the named file
+func (fs *FailoverFs) Stat(name string) (os.FileInfo, error) {
+	return failoverRead(fs, name, true, func(backend Fs, fsPath string) (os.FileInfo, error) {
+		return backend.Stat(fsPath)
+	})
+}
+
+// Lstat returns a FileInfo describing the named file
+func (fs *FailoverFs) Lstat(name string) (os.FileInfo, error) {
+	return failoverRead(fs, name, true, func(backend Fs, fsPath string) (os.FileInfo, error) {
+		return backend.Lstat(fsPath)
+	})
+}
+
+// Open opens the named file for reading
+func (fs *FailoverFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	res, err := failoverRead(fs, name, false, func(backend Fs, fsPath string) (failoverOpenResult, error) {
+		f, r, cancelFn, err := backend.Open(fsPath, offset)
+		return failoverOpenResult{file: f, reader: r, cancel: cancelFn}, err
+	})
+	return res.file, res.reader, res.cancel, err
+}
+
+// Create creates or opens the named file for writing
+func (fs *FailoverFs) Create(name string, flag, checks int) (File, *PipeWriter, func(), error) {
+	res, err := failoverWrite(fs, FailoverOpCreate, false, []string{name},
+		func(backend Fs, fsPaths []string) (failoverCreateResult, error) {
+			f, w, cancelFn, err := backend.Create(fsPaths[0], flag, checks)
+			return failoverCreateResult{file: f, writer: w, cancel: cancelFn}, err
+		})
+	return res.file, res.writer, res.cancel, err
+}
+
+// Rename renames (moves) source to target
+func (fs *FailoverFs) Rename(source, target string) (int, int64, error) {
+	res, err := failoverWrite(fs, FailoverOpRename, false, []string{source, target},
+		func(backend Fs, fsPaths []string) (failoverRenameResult, error) {
+			numFiles, size, err := backend.Rename(fsPaths[0], fsPaths[1])
+			return failoverRenameResult{numFiles: numFiles, size: size}, err
+		})
+	return res.numFiles, res.size, err
+}
+
+// Remove removes the named file or (empty) directory.
+func (fs *FailoverFs) Remove(name string, isDir bool) error {
+	_, err := failoverWrite(fs, FailoverOpRemove, isDir, []string{name}, func(backend Fs, fsPaths []string) (any, error) {
+		return nil, backend.Remove(fsPaths[0], isDir)
+	})
+	return err
+}
+
+// Mkdir creates a new directory with the specified name and default permissions
+func (fs *FailoverFs) Mkdir(name string) error {
+	_, err := failoverWrite(fs, FailoverOpMkdir, true, []string{name}, func(backend Fs, fsPaths []string) (any, error) {
+		return nil, backend.Mkdir(fsPaths[0])
+	})
+	return err
+}
+
+// Symlink creates source as a symbolic link to target.
+func (fs *FailoverFs) Symlink(source, target string) error {
+	_, err := failoverWrite(fs, FailoverOpSymlink, false, []string{source, target},
+		func(backend Fs, fsPaths []string) (any, error) {
+			return nil, backend.Symlink(fsPaths[0], fsPaths[1])
+		})
+	return err
+}
+
+// Chown changes the numeric uid and gid of the named file.
+// Ownership changes are not journaled
+func (fs *FailoverFs) Chown(name string, uid int, gid int) error {
+	_, err := failoverWrite(fs, "", false, []string{name}, func(backend Fs, fsPaths []string) (any, error) {
+		return nil, backend.Chown(fsPaths[0], uid, gid)
+	})
+	return err
+}
+
+// Chmod changes the mode of the named file to mode
+func (fs *FailoverFs) Chmod(name string, mode os.FileMode) error {
+	_, err := failoverWrite(fs, FailoverOpChmod, false, []string{name}, func(backend Fs, fsPaths []string) (any, error) {
+		return nil, backend.Chmod(fsPaths[0], mode)
+	})
+	return err
+}
+
+// Chtimes changes the access and modification times of the named file
+func (fs *FailoverFs) Chtimes(name string, atime, mtime time.Time, isUploading bool) error {
+	_, err := failoverWrite(fs, FailoverOpChtimes, false, []string{name}, func(backend Fs, fsPaths []string) (any, error) {
+		return nil, backend.Chtimes(fsPaths[0], atime, mtime, isUploading)
+	})
+	return err
+}
+
+// Truncate changes the size of the named file
+func (fs *FailoverFs) Truncate(name string, size int64) error {
+	_, err := failoverWrite(fs, FailoverOpTruncate, false, []string{name}, func(backend Fs, fsPaths []string) (any, error) {
+		return nil, backend.Truncate(fsPaths[0], size)
+	})
+	return err
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries.
+func (fs *FailoverFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return failoverRead(fs, dirname, true, func(backend Fs, fsPath string) ([]os.FileInfo, error) {
+		return backend.ReadDir(fsPath)
+	})
+}
+
+// Readlink returns the destination of the named symbolic link
+func (fs *FailoverFs) Readlink(name string) (string, error) {
+	return failoverRead(fs, name, true, func(backend Fs, fsPath string) (string, error) {
+		return backend.Readlink(fsPath)
+	})
+}
+
+// IsUploadResumeSupported returns true if resuming uploads is supported
+// by both the backends
+func (fs *FailoverFs) IsUploadResumeSupported() bool {
+	if fs.primary != nil && !fs.primary.IsUploadResumeSupported() {
+		return false
+	}
+	return fs.secondary.IsUploadResumeSupported()
+}
+
+// IsAtomicUploadSupported returns false, atomic uploads are not supported
+// since the temporary file could be created on a different backend
+func (*FailoverFs) IsAtomicUploadSupported() bool {
+	return false
+}
+
+// CheckRootPath creates the root directory for both the backends if it does not exists
+func (fs *FailoverFs) CheckRootPath(username string, uid int, gid int) bool {
+	result := fs.secondary.CheckRootPath(username, uid, gid)
+	if fs.primary != nil {
+		if fs.primary.CheckRootPath(username, uid, gid) {
+			return true
+		}
+	}
+	return result
+}
+
+// ResolvePath returns the cleaned virtual path, the paths are resolved
+// by the backend that serves each request
+func (fs *FailoverFs) ResolvePath(virtualPath string) (string, error) {
+	return path.Clean("/" + virtualPath), nil
+}
+
+// IsNotExist returns a boolean indicating whether the error is known to
+// report that a file or directory does not exist
+func (fs *FailoverFs) IsNotExist(err error) bool {
+	if fs.primary != nil && fs.primary.IsNotExist(err) {
+		return true
+	}
+	return fs.secondary.IsNotExist(err)
+}
+
+// IsPermission returns a boolean indicating whether the error is known to
+// report that permission is denied.
+func (fs *FailoverFs) IsPermission(err error) bool {
+	if fs.primary != nil && fs.primary.IsPermission(err) {
+		return true
+	}
+	return fs.secondary.IsPermission(err)
+}
+
+// IsNotSupported returns true if the error indicate an unsupported operation
+func (fs *FailoverFs) IsNotSupported(err error) bool {
+	if fs.primary != nil && fs.primary.IsNotSupported(err) {
+		return true
+	}
+	return fs.secondary.IsNotSupported(err)
+}
+
+// ScanRootDirContents returns the number of files and their size
+func (fs *FailoverFs) ScanRootDirContents() (int, int64, error) {
+	res, err := failoverRead(fs, fs.mountPath, false, func(backend Fs, _ string) (failoverRenameResult, error) {
+		numFiles, size, err := backend.ScanRootDirContents()
+		return failoverRenameResult{numFiles: numFiles, size: size}, err
+	})
+	return res.numFiles, res.size, err
+}
+
+// GetDirSize returns the number of files and the size for a folder
+// including any subfolders
+func (fs *FailoverFs) GetDirSize(dirname string) (int, int64, error) {
+	res, err := failoverRead(fs, dirname, false, func(backend Fs, fsPath string) (failoverRenameResult, error) {
+		numFiles, size, err := backend.GetDirSize(fsPath)
+		return failoverRenameResult{numFiles: numFiles, size: size}, err
+	})
+	return res.numFiles, res.size, err
+}
+
+// GetAtomicUploadPath returns an empty string, atomic uploads are not supported
+func (*FailoverFs) GetAtomicUploadPath(_ string) string {
+	return ""
+}
+
+// GetRelativePath returns the path for a file relative to the user's home dir.
+// The paths used by this Fs are already virtual paths
+func (fs *FailoverFs) GetRelativePath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// Walk walks the file tree rooted at root, calling walkFn for each file or
+// directory in the tree, including root.
+// The secondary backend is used only if the primary one fails before
+// returning any entry
+func (fs *FailoverFs) Walk(root string, walkFn filepath.WalkFunc) error {
+	var called bool
+	walk := func(backend Fs) error {
+		fsPath, err := backend.ResolvePath(root)
+		if err != nil {
+			return err
+		}
+		return backend.Walk(fsPath, func(walkedPath string, info os.FileInfo, err error) error {
+			called = true
+			return walkFn(backend.GetRelativePath(walkedPath), info, err)
+		})
+	}
+	if fs.primary != nil && fs.state.usePrimary(fs.retryInterval) {
+		err := walk(fs.primary)
+		if !isBackendUnavailableError(fs.primary, err) {
+			fs.state.setRecovered()
+			return err
+		}
+		if called {
+			// some entries were already returned, the error could be
+			// returned by walkFn too
+			return err
+		}
+		fsLog(fs, logger.LevelWarn, "walk on path %q failed on the primary backend: %v", root, err)
+		fs.state.setFailed(err)
+	}
+	return walk(fs.secondary)
+}
+
+// Join joins any number of path elements into a single path
+func (*FailoverFs) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// HasVirtualFolders returns true if folders are emulated
+func (*FailoverFs) HasVirtualFolders() bool {
+	return false
+}
+
+// GetMimeType returns the content type
+func (fs *FailoverFs) GetMimeType(name string) (string, error) {
+	return failoverRead(fs, name, true, func(backend Fs, fsPath string) (string, error) {
+		return backend.GetMimeType(fsPath)
+	})
+}
+
+// GetAvailableDiskSize returns the available size for the specified path
+func (fs *FailoverFs) GetAvailableDiskSize(dirName string) (*sftp.StatVFS, error) {
+	return failoverRead(fs, dirName, true, func(backend Fs, fsPath string) (*sftp.StatVFS, error) {
+		return backend.GetAvailableDiskSize(fsPath)
+	})
+}
+
+// CheckMetadata checks the metadata consistency for the primary backend
+func (fs *FailoverFs) CheckMetadata() error {
+	if fs.primary != nil {
+		return fs.primary.CheckMetadata()
+	}
+	return fs.secondary.CheckMetadata()
+}
+
+// Close closes both the backends
+func (fs *FailoverFs) Close() error {
+	var err error
+	if fs.primary != nil {
+		err = fs.primary.Close()
+	}
+	if errSecondary := fs.secondary.Close(); err == nil {
+		err = errSecondary
+	}
+	return err
+}
+
+// reconcileFailoverJournal replays the journaled writes on the primary backend.
+// It stops at the first error and returns the number of reconciled entries
+func reconcileFailoverJournal(state *failoverState, mountPath string, primary, secondary Fs) (int, error) {
+	journal := state.getJournal()
+	var lastID int64
+	var reconciled int
+	var err error
+
+	for _, entry := range journal {
+		// the journaled paths are relative to the folder root, the backends expect virtual paths
+		entry.Path = path.Join(mountPath, entry.Path)
+		if entry.Target != "" {
+			entry.Target = path.Join(mountPath, entry.Target)
+		}
+		if err = reconcileFailoverJournalEntry(entry, primary, secondary); err != nil {
+			err = fmt.Errorf("unable to reconcile operation %q for path %q: %w", entry.Operation, entry.Path, err)
+			break
+		}
+		lastID = entry.ID
+		reconciled++
+	}
+	if reconciled > 0 || len(journal) == 0 {
+		state.removeJournalEntries(lastID)
+	}
+	return reconciled, err
+}
+
+func reconcileFailoverJournalEntry(entry FailoverJournalEntry, primary, secondary Fs) error {
+	primaryPath, err := primary.ResolvePath(entry.Path)
+	if err != nil {
+		return err
+	}
+	switch entry.Operation {
+	case FailoverOpMkdir:
+		if err := primary.Mkdir(primaryPath); err != nil {
+			if info, errStat := primary.Stat(primaryPath); errStat == nil && info.IsDir() {
+				return nil
+			}
+			return err
+		}
+		return nil
+	case FailoverOpRemove:
+		if err := primary.Remove(primaryPath, entry.IsDir); err != nil && !primary.IsNotExist(err) {
+			return err
+		}
+		return nil
+	case FailoverOpRename:
+		targetPath, err := primary.ResolvePath(entry.Target)
+		if err != nil {
+			return err
+		}
+		if _, err := primary.Lstat(primaryPath); err == nil {
+			_, _, err = primary.Rename(primaryPath, targetPath)
+			return err
+		}
+		// the source does not exist on the primary backend,
+		// it was probably created while the failover was active
+		return copyFailoverPath(secondary, primary, entry.Target)
+	case FailoverOpSymlink:
+		targetPath, err := primary.ResolvePath(entry.Target)
+		if err != nil {
+			return err
+		}
+		if err := primary.Symlink(primaryPath, targetPath); err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+		return nil
+	case FailoverOpChmod, FailoverOpChtimes:
+		info, err := getFailoverPathInfo(secondary, entry.Path)
+		if err != nil {
+			if secondary.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if entry.Operation == FailoverOpChmod {
+			err = primary.Chmod(primaryPath, info.Mode())
+		} else {
+			err = primary.Chtimes(primaryPath, info.ModTime(), info.ModTime(), false)
+		}
+		if err != nil && (primary.IsNotSupported(err) || primary.IsNotExist(err)) {
+			return nil
+		}
+		return err
+	default:
+		return copyFailoverPath(secondary, primary, entry.Path)
+	}
+}
+
+func getFailoverPathInfo(fs Fs, name string) (os.FileInfo, error) {
+	fsPath, err := fs.ResolvePath(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Stat(fsPath)
+}
+
+// copyFailoverPath copies a file from the source to the destination backend.
+// Missing files and directories are ignored, they were removed or renamed
+// after the journaled operation and another journal entry exists
+func copyFailoverPath(src, dst Fs, name string) error {
+	info, err := getFailoverPathInfo(src, name)
+	if err != nil {
+		if src.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	srcPath, err := src.ResolvePath(name)
+	if err != nil {
+		return err
+	}
+	dstPath, err := dst.ResolvePath(name)
+	if err != nil {
+		return err
+	}
+	f, r, rCancelFn, err := src.Open(srcPath, 0)
+	if err != nil {
+		return err
+	}
+	if rCancelFn != nil {
+		defer rCancelFn()
+	}
+	var reader io.ReadCloser = r
+	if f != nil {
+		reader = f
+	}
+	defer reader.Close()
+
+	wf, w, wCancelFn, err := dst.Create(dstPath, 0, 0)
+	if err != nil {
+		return err
+	}
+	var writer io.WriteCloser = w
+	if wf != nil {
+		writer = wf
+	}
+	_, err = io.Copy(writer, reader)
+	if err != nil && wCancelFn != nil {
+		wCancelFn()
+	}
+	errClose := writer.Close()
+	if err == nil {
+		err = errClose
+	}
+	return err
+}
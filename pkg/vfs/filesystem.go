@@ -22,6 +22,32 @@ import (
 	"github.com/drakkan/sftpgo/v2/pkg/kms"
 )
 
+// GetProviderByName returns the FilesystemProvider matching a given name.
+// It extends sdk.GetProviderByName with the providers not defined in the SDK
+func GetProviderByName(name string) sdk.FilesystemProvider {
+	switch name {
+	case "7", webDAVFsName:
+		return WebDAVFilesystemProvider
+	}
+	return sdk.GetProviderByName(name)
+}
+
+// GetProviderName returns the unique name for the specified provider
+func GetProviderName(p sdk.FilesystemProvider) string {
+	if p == WebDAVFilesystemProvider {
+		return webDAVFsName
+	}
+	return p.Name()
+}
+
+// GetProviderShortInfo returns a human readable, short description for the specified provider
+func GetProviderShortInfo(p sdk.FilesystemProvider) string {
+	if p == WebDAVFilesystemProvider {
+		return "WebDAV"
+	}
+	return p.ShortInfo()
+}
+
 // Filesystem defines filesystem details
 type Filesystem struct {
 	RedactedSecret string                 `json:"-"`
@@ -33,6 +59,15 @@ type Filesystem struct {
 	CryptConfig    CryptFsConfig          `json:"cryptconfig,omitempty"`
 	SFTPConfig     SFTPFsConfig           `json:"sftpconfig,omitempty"`
 	HTTPConfig     HTTPFsConfig           `json:"httpconfig,omitempty"`
+	WebDAVConfig   WebDAVFsConfig         `json:"webdavconfig,omitempty"`
+	// DedupConfig is used with the local provider only
+	DedupConfig DedupFsConfig `json:"dedupconfig,omitempty"`
+	// PGPConfig is supported for all the providers
+	PGPConfig PGPFsConfig `json:"pgpconfig,omitempty"`
+	// WORMConfig is supported for all the providers
+	WORMConfig WORMConfig `json:"wormconfig,omitempty"`
+	// MIMEPolicy is supported for all the providers
+	MIMEPolicy MIMEPolicy `json:"mimepolicy,omitempty"`
 }
 
 // SetEmptySecrets sets the secrets to empty
@@ -42,11 +77,17 @@ func (f *Filesystem) SetEmptySecrets() {
 	f.AzBlobConfig.AccountKey = kms.NewEmptySecret()
 	f.AzBlobConfig.SASURL = kms.NewEmptySecret()
 	f.CryptConfig.Passphrase = kms.NewEmptySecret()
+	f.CryptConfig.PreviousPassphrases = nil
+	f.CryptConfig.NamesKey = kms.NewEmptySecret()
 	f.SFTPConfig.Password = kms.NewEmptySecret()
 	f.SFTPConfig.PrivateKey = kms.NewEmptySecret()
 	f.SFTPConfig.KeyPassphrase = kms.NewEmptySecret()
 	f.HTTPConfig.Password = kms.NewEmptySecret()
 	f.HTTPConfig.APIKey = kms.NewEmptySecret()
+	f.WebDAVConfig.Password = kms.NewEmptySecret()
+	f.WebDAVConfig.ClientKey = kms.NewEmptySecret()
+	f.PGPConfig.PrivateKey = kms.NewEmptySecret()
+	f.PGPConfig.Passphrase = kms.NewEmptySecret()
 }
 
 // SetEmptySecretsIfNil sets the secrets to empty if nil
@@ -63,9 +104,7 @@ func (f *Filesystem) SetEmptySecretsIfNil() {
 	if f.AzBlobConfig.SASURL == nil {
 		f.AzBlobConfig.SASURL = kms.NewEmptySecret()
 	}
-	if f.CryptConfig.Passphrase == nil {
-		f.CryptConfig.Passphrase = kms.NewEmptySecret()
-	}
+	f.CryptConfig.setEmptySecretsIfNil()
 	if f.SFTPConfig.Password == nil {
 		f.SFTPConfig.Password = kms.NewEmptySecret()
 	}
@@ -81,6 +120,31 @@ func (f *Filesystem) SetEmptySecretsIfNil() {
 	if f.HTTPConfig.APIKey == nil {
 		f.HTTPConfig.APIKey = kms.NewEmptySecret()
 	}
+	if f.WebDAVConfig.Password == nil {
+		f.WebDAVConfig.Password = kms.NewEmptySecret()
+	}
+	if f.WebDAVConfig.ClientKey == nil {
+		f.WebDAVConfig.ClientKey = kms.NewEmptySecret()
+	}
+	f.PGPConfig.setEmptySecretsIfNil()
+}
+
+// TryDecryptSecrets decrypts the encrypted secrets. This is useful to copy
+// the configuration to a different object, the plain secrets will be encrypted
+// again using the new additional data
+func (f *Filesystem) TryDecryptSecrets() error {
+	f.SetEmptySecretsIfNil()
+	secrets := []*kms.Secret{f.S3Config.AccessSecret, f.GCSConfig.Credentials, f.AzBlobConfig.AccountKey,
+		f.AzBlobConfig.SASURL, f.CryptConfig.Passphrase, f.SFTPConfig.Password, f.SFTPConfig.PrivateKey,
+		f.SFTPConfig.KeyPassphrase, f.HTTPConfig.Password, f.HTTPConfig.APIKey, f.WebDAVConfig.Password,
+		f.WebDAVConfig.ClientKey, f.PGPConfig.PrivateKey, f.PGPConfig.Passphrase, f.CryptConfig.NamesKey}
+	secrets = append(secrets, f.CryptConfig.PreviousPassphrases...)
+	for _, secret := range secrets {
+		if err := secret.TryDecrypt(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // SetNilSecretsIfEmpty set the secrets to nil if empty.
@@ -99,11 +163,11 @@ func (f *Filesystem) SetNilSecretsIfEmpty() {
 	if f.AzBlobConfig.SASURL != nil && f.AzBlobConfig.SASURL.IsEmpty() {
 		f.AzBlobConfig.SASURL = nil
 	}
-	if f.CryptConfig.Passphrase != nil && f.CryptConfig.Passphrase.IsEmpty() {
-		f.CryptConfig.Passphrase = nil
-	}
+	f.CryptConfig.setNilSecretsIfEmpty()
 	f.SFTPConfig.setNilSecretsIfEmpty()
 	f.HTTPConfig.setNilSecretsIfEmpty()
+	f.WebDAVConfig.setNilSecretsIfEmpty()
+	f.PGPConfig.setNilSecretsIfEmpty()
 }
 
 // IsEqual returns true if the fs is equal to other
@@ -111,6 +175,9 @@ func (f *Filesystem) IsEqual(other Filesystem) bool {
 	if f.Provider != other.Provider {
 		return false
 	}
+	if !f.PGPConfig.isEqual(other.PGPConfig) {
+		return false
+	}
 	switch f.Provider {
 	case sdk.S3FilesystemProvider:
 		return f.S3Config.isEqual(other.S3Config)
@@ -124,6 +191,8 @@ func (f *Filesystem) IsEqual(other Filesystem) bool {
 		return f.SFTPConfig.isEqual(other.SFTPConfig)
 	case sdk.HTTPFilesystemProvider:
 		return f.HTTPConfig.isEqual(other.HTTPConfig)
+	case WebDAVFilesystemProvider:
+		return f.WebDAVConfig.isEqual(other.WebDAVConfig)
 	default:
 		return true
 	}
@@ -147,6 +216,8 @@ func (f *Filesystem) IsSameResource(other Filesystem) bool {
 		return f.SFTPConfig.isSameResource(other.SFTPConfig)
 	case sdk.HTTPFilesystemProvider:
 		return f.HTTPConfig.isSameResource(other.HTTPConfig)
+	case WebDAVFilesystemProvider:
+		return f.WebDAVConfig.isSameResource(other.WebDAVConfig)
 	default:
 		return true
 	}
@@ -165,72 +236,106 @@ func (f *Filesystem) GetPathSeparator() string {
 // Validate verifies the FsConfig matching the configured provider and sets all other
 // Filesystem.*Config to their zero value if successful
 func (f *Filesystem) Validate(additionalData string) error {
+	if err := f.PGPConfig.ValidateAndEncryptCredentials(additionalData); err != nil {
+		return err
+	}
+	if err := f.WORMConfig.validate(); err != nil {
+		return err
+	}
+	if err := f.MIMEPolicy.validate(); err != nil {
+		return err
+	}
 	switch f.Provider {
 	case sdk.S3FilesystemProvider:
 		if err := f.S3Config.ValidateAndEncryptCredentials(additionalData); err != nil {
 			return err
 		}
 		f.OSConfig = sdk.OSFsConfig{}
+		f.DedupConfig = DedupFsConfig{}
 		f.GCSConfig = GCSFsConfig{}
 		f.AzBlobConfig = AzBlobFsConfig{}
 		f.CryptConfig = CryptFsConfig{}
 		f.SFTPConfig = SFTPFsConfig{}
 		f.HTTPConfig = HTTPFsConfig{}
+		f.WebDAVConfig = WebDAVFsConfig{}
 		return nil
 	case sdk.GCSFilesystemProvider:
 		if err := f.GCSConfig.ValidateAndEncryptCredentials(additionalData); err != nil {
 			return err
 		}
 		f.OSConfig = sdk.OSFsConfig{}
+		f.DedupConfig = DedupFsConfig{}
 		f.S3Config = S3FsConfig{}
 		f.AzBlobConfig = AzBlobFsConfig{}
 		f.CryptConfig = CryptFsConfig{}
 		f.SFTPConfig = SFTPFsConfig{}
 		f.HTTPConfig = HTTPFsConfig{}
+		f.WebDAVConfig = WebDAVFsConfig{}
 		return nil
 	case sdk.AzureBlobFilesystemProvider:
 		if err := f.AzBlobConfig.ValidateAndEncryptCredentials(additionalData); err != nil {
 			return err
 		}
 		f.OSConfig = sdk.OSFsConfig{}
+		f.DedupConfig = DedupFsConfig{}
 		f.S3Config = S3FsConfig{}
 		f.GCSConfig = GCSFsConfig{}
 		f.CryptConfig = CryptFsConfig{}
 		f.SFTPConfig = SFTPFsConfig{}
 		f.HTTPConfig = HTTPFsConfig{}
+		f.WebDAVConfig = WebDAVFsConfig{}
 		return nil
 	case sdk.CryptedFilesystemProvider:
 		if err := f.CryptConfig.ValidateAndEncryptCredentials(additionalData); err != nil {
 			return err
 		}
 		f.OSConfig = sdk.OSFsConfig{}
+		f.DedupConfig = DedupFsConfig{}
 		f.S3Config = S3FsConfig{}
 		f.GCSConfig = GCSFsConfig{}
 		f.AzBlobConfig = AzBlobFsConfig{}
 		f.SFTPConfig = SFTPFsConfig{}
 		f.HTTPConfig = HTTPFsConfig{}
+		f.WebDAVConfig = WebDAVFsConfig{}
 		return validateOSFsConfig(&f.CryptConfig.OSFsConfig)
 	case sdk.SFTPFilesystemProvider:
 		if err := f.SFTPConfig.ValidateAndEncryptCredentials(additionalData); err != nil {
 			return err
 		}
 		f.OSConfig = sdk.OSFsConfig{}
+		f.DedupConfig = DedupFsConfig{}
 		f.S3Config = S3FsConfig{}
 		f.GCSConfig = GCSFsConfig{}
 		f.AzBlobConfig = AzBlobFsConfig{}
 		f.CryptConfig = CryptFsConfig{}
 		f.HTTPConfig = HTTPFsConfig{}
+		f.WebDAVConfig = WebDAVFsConfig{}
 		return nil
 	case sdk.HTTPFilesystemProvider:
 		if err := f.HTTPConfig.ValidateAndEncryptCredentials(additionalData); err != nil {
 			return err
 		}
 		f.OSConfig = sdk.OSFsConfig{}
+		f.DedupConfig = DedupFsConfig{}
+		f.S3Config = S3FsConfig{}
+		f.GCSConfig = GCSFsConfig{}
+		f.AzBlobConfig = AzBlobFsConfig{}
+		f.CryptConfig = CryptFsConfig{}
+		f.SFTPConfig = SFTPFsConfig{}
+		f.WebDAVConfig = WebDAVFsConfig{}
+		return nil
+	case WebDAVFilesystemProvider:
+		if err := f.WebDAVConfig.ValidateAndEncryptCredentials(additionalData); err != nil {
+			return err
+		}
+		f.OSConfig = sdk.OSFsConfig{}
+		f.DedupConfig = DedupFsConfig{}
 		f.S3Config = S3FsConfig{}
 		f.GCSConfig = GCSFsConfig{}
 		f.AzBlobConfig = AzBlobFsConfig{}
 		f.CryptConfig = CryptFsConfig{}
 		f.SFTPConfig = SFTPFsConfig{}
+		f.HTTPConfig = HTTPFsConfig{}
 		return nil
 	default:
 		f.Provider = sdk.LocalFilesystemProvider
@@ -240,6 +345,10 @@ func (f *Filesystem) Validate(additionalData string) error {
 		f.CryptConfig = CryptFsConfig{}
 		f.SFTPConfig = SFTPFsConfig{}
 		f.HTTPConfig = HTTPFsConfig{}
+		f.WebDAVConfig = WebDAVFsConfig{}
+		if err := f.DedupConfig.validate(); err != nil {
+			return err
+		}
 		return validateOSFsConfig(&f.OSConfig)
 	}
 }
@@ -247,6 +356,9 @@ func (f *Filesystem) Validate(additionalData string) error {
 // HasRedactedSecret returns true if configured the filesystem configuration has a redacted secret
 func (f *Filesystem) HasRedactedSecret() bool {
 	// TODO move vfs specific code into each *FsConfig struct
+	if f.PGPConfig.hasRedactedSecret() {
+		return true
+	}
 	switch f.Provider {
 	case sdk.S3FilesystemProvider:
 		return f.S3Config.AccessSecret.IsRedacted()
@@ -258,7 +370,7 @@ func (f *Filesystem) HasRedactedSecret() bool {
 		}
 		return f.AzBlobConfig.SASURL.IsRedacted()
 	case sdk.CryptedFilesystemProvider:
-		return f.CryptConfig.Passphrase.IsRedacted()
+		return f.CryptConfig.hasRedactedSecret()
 	case sdk.SFTPFilesystemProvider:
 		if f.SFTPConfig.Password.IsRedacted() {
 			return true
@@ -272,6 +384,11 @@ func (f *Filesystem) HasRedactedSecret() bool {
 			return true
 		}
 		return f.HTTPConfig.APIKey.IsRedacted()
+	case WebDAVFilesystemProvider:
+		if f.WebDAVConfig.Password.IsRedacted() {
+			return true
+		}
+		return f.WebDAVConfig.ClientKey.IsRedacted()
 	}
 
 	return false
@@ -279,6 +396,7 @@ func (f *Filesystem) HasRedactedSecret() bool {
 
 // HideConfidentialData hides filesystem confidential data
 func (f *Filesystem) HideConfidentialData() {
+	f.PGPConfig.HideConfidentialData()
 	switch f.Provider {
 	case sdk.S3FilesystemProvider:
 		f.S3Config.HideConfidentialData()
@@ -292,6 +410,8 @@ func (f *Filesystem) HideConfidentialData() {
 		f.SFTPConfig.HideConfidentialData()
 	case sdk.HTTPFilesystemProvider:
 		f.HTTPConfig.HideConfidentialData()
+	case WebDAVFilesystemProvider:
+		f.WebDAVConfig.HideConfidentialData()
 	}
 }
 
@@ -322,7 +442,10 @@ func (f *Filesystem) GetACopy() Filesystem {
 				UploadPartMaxTime:   f.S3Config.UploadPartMaxTime,
 				ForcePathStyle:      f.S3Config.ForcePathStyle,
 			},
-			AccessSecret: f.S3Config.AccessSecret.Clone(),
+			AccessSecret:           f.S3Config.AccessSecret.Clone(),
+			VaultCredentialsPath:   f.S3Config.VaultCredentialsPath,
+			UseAccelerateEndpoint:  f.S3Config.UseAccelerateEndpoint,
+			AdaptiveUploadPartSize: f.S3Config.AdaptiveUploadPartSize,
 		},
 		GCSConfig: GCSFsConfig{
 			BaseGCSFsConfig: sdk.BaseGCSFsConfig{
@@ -334,7 +457,11 @@ func (f *Filesystem) GetACopy() Filesystem {
 				UploadPartSize:       f.GCSConfig.UploadPartSize,
 				UploadPartMaxTime:    f.GCSConfig.UploadPartMaxTime,
 			},
-			Credentials: f.GCSConfig.Credentials.Clone(),
+			Credentials:         f.GCSConfig.Credentials.Clone(),
+			DownloadPartSize:    f.GCSConfig.DownloadPartSize,
+			DownloadConcurrency: f.GCSConfig.DownloadConcurrency,
+			BillingProject:      f.GCSConfig.BillingProject,
+			KMSKeyName:          f.GCSConfig.KMSKeyName,
 		},
 		AzBlobConfig: AzBlobFsConfig{
 			BaseAzBlobFsConfig: sdk.BaseAzBlobFsConfig{
@@ -349,16 +476,11 @@ func (f *Filesystem) GetACopy() Filesystem {
 				UseEmulator:         f.AzBlobConfig.UseEmulator,
 				AccessTier:          f.AzBlobConfig.AccessTier,
 			},
-			AccountKey: f.AzBlobConfig.AccountKey.Clone(),
-			SASURL:     f.AzBlobConfig.SASURL.Clone(),
-		},
-		CryptConfig: CryptFsConfig{
-			OSFsConfig: sdk.OSFsConfig{
-				ReadBufferSize:  f.CryptConfig.ReadBufferSize,
-				WriteBufferSize: f.CryptConfig.WriteBufferSize,
-			},
-			Passphrase: f.CryptConfig.Passphrase.Clone(),
+			AccountKey:   f.AzBlobConfig.AccountKey.Clone(),
+			SASURL:       f.AzBlobConfig.SASURL.Clone(),
+			SASAutoRenew: f.AzBlobConfig.SASAutoRenew,
 		},
+		CryptConfig: f.CryptConfig.GetACopy(),
 		SFTPConfig: SFTPFsConfig{
 			BaseSFTPFsConfig: sdk.BaseSFTPFsConfig{
 				Endpoint:                f.SFTPConfig.Endpoint,
@@ -382,6 +504,21 @@ func (f *Filesystem) GetACopy() Filesystem {
 			Password: f.HTTPConfig.Password.Clone(),
 			APIKey:   f.HTTPConfig.APIKey.Clone(),
 		},
+		WebDAVConfig: WebDAVFsConfig{
+			Endpoint:          f.WebDAVConfig.Endpoint,
+			Username:          f.WebDAVConfig.Username,
+			Password:          f.WebDAVConfig.Password.Clone(),
+			SkipTLSVerify:     f.WebDAVConfig.SkipTLSVerify,
+			ClientCert:        f.WebDAVConfig.ClientCert,
+			ClientKey:         f.WebDAVConfig.ClientKey.Clone(),
+			EqualityCheckMode: f.WebDAVConfig.EqualityCheckMode,
+		},
+		DedupConfig: DedupFsConfig{
+			Enabled: f.DedupConfig.Enabled,
+		},
+		PGPConfig:  f.PGPConfig.GetACopy(),
+		WORMConfig: f.WORMConfig,
+		MIMEPolicy: f.MIMEPolicy.GetACopy(),
 	}
 	if len(f.SFTPConfig.Fingerprints) > 0 {
 		fs.SFTPConfig.Fingerprints = make([]string, len(f.SFTPConfig.Fingerprints))
@@ -23,6 +23,7 @@ import (
 	"github.com/rs/xid"
 	"github.com/sftpgo/sdk"
 
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
 	"github.com/drakkan/sftpgo/v2/pkg/util"
 )
 
@@ -45,6 +46,43 @@ type BaseVirtualFolder struct {
 	Groups []string `json:"groups,omitempty"`
 	// Filesystem configuration details
 	FsConfig Filesystem `json:"filesystem"`
+	// Optional secondary storage backend
+	Failover *FolderFailover `json:"failover,omitempty"`
+	// Optional limits shared by all the transfers inside this folder
+	Limits *FolderLimits `json:"limits,omitempty"`
+	// Role (tenant) owning this folder, empty means a global folder
+	Role string `json:"role,omitempty"`
+}
+
+// FolderLimits defines the bandwidth and concurrency limits for a virtual folder.
+// The limits are shared by all the transfers inside the folder, regardless of the
+// users and protocols, and they apply in addition to the users limits
+type FolderLimits struct {
+	// Maximum upload and download bandwidth as KB/s, 0 means unlimited
+	UploadBandwidth   int64 `json:"upload_bandwidth,omitempty"`
+	DownloadBandwidth int64 `json:"download_bandwidth,omitempty"`
+	// Maximum number of concurrent transfers, 0 means unlimited
+	MaxConcurrentTransfers int `json:"max_concurrent_transfers,omitempty"`
+}
+
+// HasLimits returns true if at least a limit is defined
+func (l *FolderLimits) HasLimits() bool {
+	if l == nil {
+		return false
+	}
+	return l.UploadBandwidth > 0 || l.DownloadBandwidth > 0 || l.MaxConcurrentTransfers > 0
+}
+
+// GetACopy returns a copy
+func (l *FolderLimits) GetACopy() *FolderLimits {
+	if l == nil {
+		return nil
+	}
+	return &FolderLimits{
+		UploadBandwidth:        l.UploadBandwidth,
+		DownloadBandwidth:      l.DownloadBandwidth,
+		MaxConcurrentTransfers: l.MaxConcurrentTransfers,
+	}
 }
 
 // GetEncryptionAdditionalData returns the additional data to use for AEAD
@@ -52,6 +90,17 @@ func (v *BaseVirtualFolder) GetEncryptionAdditionalData() string {
 	return fmt.Sprintf("folder_%v", v.Name)
 }
 
+// GetFailoverEncryptionAdditionalData returns the additional data to use for AEAD
+// for the secondary storage backend
+func (v *BaseVirtualFolder) GetFailoverEncryptionAdditionalData() string {
+	return fmt.Sprintf("folder_%v_failover", v.Name)
+}
+
+// HasFailover returns true if a secondary storage backend is configured
+func (v *BaseVirtualFolder) HasFailover() bool {
+	return v.Failover != nil
+}
+
 // GetACopy returns a copy
 func (v *BaseVirtualFolder) GetACopy() BaseVirtualFolder {
 	users := make([]string, len(v.Users))
@@ -69,6 +118,9 @@ func (v *BaseVirtualFolder) GetACopy() BaseVirtualFolder {
 		Users:           users,
 		Groups:          v.Groups,
 		FsConfig:        v.FsConfig.GetACopy(),
+		Failover:        v.Failover.GetACopy(),
+		Limits:          v.Limits.GetACopy(),
+		Role:            v.Role,
 	}
 }
 
@@ -117,6 +169,8 @@ func (v *BaseVirtualFolder) GetStorageDescrition() string {
 		return fmt.Sprintf("SFTP: %s", v.FsConfig.SFTPConfig.Endpoint)
 	case sdk.HTTPFilesystemProvider:
 		return fmt.Sprintf("HTTP: %s", v.FsConfig.HTTPConfig.Endpoint)
+	case WebDAVFilesystemProvider:
+		return fmt.Sprintf("WebDAV: %s", v.FsConfig.WebDAVConfig.Endpoint)
 	default:
 		return ""
 	}
@@ -129,19 +183,29 @@ func (v *BaseVirtualFolder) IsLocalOrLocalCrypted() bool {
 
 // hideConfidentialData hides folder confidential data
 func (v *BaseVirtualFolder) hideConfidentialData() {
-	switch v.FsConfig.Provider {
+	hideFsConfidentialData(&v.FsConfig)
+	if v.Failover != nil {
+		hideFsConfidentialData(&v.Failover.FsConfig)
+	}
+}
+
+func hideFsConfidentialData(fsConfig *Filesystem) {
+	fsConfig.PGPConfig.HideConfidentialData()
+	switch fsConfig.Provider {
 	case sdk.S3FilesystemProvider:
-		v.FsConfig.S3Config.HideConfidentialData()
+		fsConfig.S3Config.HideConfidentialData()
 	case sdk.GCSFilesystemProvider:
-		v.FsConfig.GCSConfig.HideConfidentialData()
+		fsConfig.GCSConfig.HideConfidentialData()
 	case sdk.AzureBlobFilesystemProvider:
-		v.FsConfig.AzBlobConfig.HideConfidentialData()
+		fsConfig.AzBlobConfig.HideConfidentialData()
 	case sdk.CryptedFilesystemProvider:
-		v.FsConfig.CryptConfig.HideConfidentialData()
+		fsConfig.CryptConfig.HideConfidentialData()
 	case sdk.SFTPFilesystemProvider:
-		v.FsConfig.SFTPConfig.HideConfidentialData()
+		fsConfig.SFTPConfig.HideConfidentialData()
 	case sdk.HTTPFilesystemProvider:
-		v.FsConfig.HTTPConfig.HideConfidentialData()
+		fsConfig.HTTPConfig.HideConfidentialData()
+	case WebDAVFilesystemProvider:
+		fsConfig.WebDAVConfig.HideConfidentialData()
 	}
 }
 
@@ -151,27 +215,46 @@ func (v *BaseVirtualFolder) hideConfidentialData() {
 func (v *BaseVirtualFolder) PrepareForRendering() {
 	v.hideConfidentialData()
 	v.FsConfig.SetEmptySecretsIfNil()
+	if v.Failover != nil {
+		v.Failover.FsConfig.SetEmptySecretsIfNil()
+	}
 }
 
 // HasRedactedSecret returns true if the folder has a redacted secret
 func (v *BaseVirtualFolder) HasRedactedSecret() bool {
+	if v.Failover != nil && v.Failover.FsConfig.HasRedactedSecret() {
+		return true
+	}
 	return v.FsConfig.HasRedactedSecret()
 }
 
 // hasPathPlaceholder returns true if the folder has a path placeholder
 func (v *BaseVirtualFolder) hasPathPlaceholder() bool {
+	return fsHasPathPlaceholder(v.MappedPath, &v.FsConfig)
+}
+
+// HasFailoverPathPlaceholder returns true if the folder, or its secondary
+// storage backend, has a path placeholder
+func (v *BaseVirtualFolder) HasFailoverPathPlaceholder() bool {
+	if v.hasPathPlaceholder() {
+		return true
+	}
+	return v.Failover != nil && fsHasPathPlaceholder(v.Failover.MappedPath, &v.Failover.FsConfig)
+}
+
+func fsHasPathPlaceholder(mappedPath string, fsConfig *Filesystem) bool {
 	placeholder := "%username%"
-	switch v.FsConfig.Provider {
+	switch fsConfig.Provider {
 	case sdk.S3FilesystemProvider:
-		return strings.Contains(v.FsConfig.S3Config.KeyPrefix, placeholder)
+		return strings.Contains(fsConfig.S3Config.KeyPrefix, placeholder)
 	case sdk.GCSFilesystemProvider:
-		return strings.Contains(v.FsConfig.GCSConfig.KeyPrefix, placeholder)
+		return strings.Contains(fsConfig.GCSConfig.KeyPrefix, placeholder)
 	case sdk.AzureBlobFilesystemProvider:
-		return strings.Contains(v.FsConfig.AzBlobConfig.KeyPrefix, placeholder)
+		return strings.Contains(fsConfig.AzBlobConfig.KeyPrefix, placeholder)
 	case sdk.SFTPFilesystemProvider:
-		return strings.Contains(v.FsConfig.SFTPConfig.Prefix, placeholder)
+		return strings.Contains(fsConfig.SFTPConfig.Prefix, placeholder)
 	case sdk.LocalFilesystemProvider, sdk.CryptedFilesystemProvider:
-		return strings.Contains(v.MappedPath, placeholder)
+		return strings.Contains(mappedPath, placeholder)
 	}
 	return false
 }
@@ -193,22 +276,71 @@ type VirtualFolder struct {
 
 // GetFilesystem returns the filesystem for this folder
 func (v *VirtualFolder) GetFilesystem(connectionID string, forbiddenSelfUsers []string) (Fs, error) {
-	switch v.FsConfig.Provider {
+	if v.Failover == nil {
+		return v.getFilesystem(connectionID, v.MappedPath, &v.FsConfig, forbiddenSelfUsers)
+	}
+	secondary, err := v.getFilesystem(connectionID, v.Failover.MappedPath, &v.Failover.FsConfig, forbiddenSelfUsers)
+	if err != nil {
+		return nil, err
+	}
+	primary, err := v.getFilesystem(connectionID, v.MappedPath, &v.FsConfig, forbiddenSelfUsers)
+	if err != nil {
+		logger.Warn(failoverFsName, connectionID, "unable to get the primary filesystem for folder %q, using the secondary one: %v",
+			v.Name, err)
+		failoverStates.get(v.Name).setFailed(err)
+		primary = nil
+	}
+	return NewFailoverFs(connectionID, v.VirtualPath, v.Name, primary, secondary, *v.Failover), nil
+}
+
+func (v *VirtualFolder) getFilesystem(connectionID, mappedPath string, fsConfig *Filesystem,
+	forbiddenSelfUsers []string,
+) (Fs, error) {
+	switch fsConfig.Provider {
 	case sdk.S3FilesystemProvider:
-		return NewS3Fs(connectionID, v.MappedPath, v.VirtualPath, v.FsConfig.S3Config)
+		return NewS3Fs(connectionID, mappedPath, v.VirtualPath, fsConfig.S3Config)
 	case sdk.GCSFilesystemProvider:
-		return NewGCSFs(connectionID, v.MappedPath, v.VirtualPath, v.FsConfig.GCSConfig)
+		return NewGCSFs(connectionID, mappedPath, v.VirtualPath, fsConfig.GCSConfig)
 	case sdk.AzureBlobFilesystemProvider:
-		return NewAzBlobFs(connectionID, v.MappedPath, v.VirtualPath, v.FsConfig.AzBlobConfig)
+		return NewAzBlobFs(connectionID, mappedPath, v.VirtualPath, fsConfig.AzBlobConfig)
 	case sdk.CryptedFilesystemProvider:
-		return NewCryptFs(connectionID, v.MappedPath, v.VirtualPath, v.FsConfig.CryptConfig)
+		return NewCryptFs(connectionID, mappedPath, v.VirtualPath, fsConfig.CryptConfig)
 	case sdk.SFTPFilesystemProvider:
-		return NewSFTPFs(connectionID, v.VirtualPath, v.MappedPath, forbiddenSelfUsers, v.FsConfig.SFTPConfig)
+		return NewSFTPFs(connectionID, v.VirtualPath, mappedPath, forbiddenSelfUsers, fsConfig.SFTPConfig)
 	case sdk.HTTPFilesystemProvider:
-		return NewHTTPFs(connectionID, v.MappedPath, v.VirtualPath, v.FsConfig.HTTPConfig)
+		return NewHTTPFs(connectionID, mappedPath, v.VirtualPath, fsConfig.HTTPConfig)
+	case WebDAVFilesystemProvider:
+		return NewWebDAVFs(connectionID, mappedPath, v.VirtualPath, fsConfig.WebDAVConfig)
 	default:
-		return NewOsFs(connectionID, v.MappedPath, v.VirtualPath, &v.FsConfig.OSConfig), nil
+		if fsConfig.DedupConfig.Enabled {
+			return NewDedupFs(connectionID, mappedPath, v.VirtualPath)
+		}
+		return NewOsFs(connectionID, mappedPath, v.VirtualPath, &fsConfig.OSConfig), nil
+	}
+}
+
+// ReconcileFailover replays the write operations executed on the secondary
+// storage backend to the primary one. It returns the number of reconciled
+// operations. The folder switches back to the primary backend once all the
+// journaled operations are reconciled
+func (v *VirtualFolder) ReconcileFailover() (int, error) {
+	if v.Failover == nil {
+		return 0, errors.New("no secondary storage backend configured for this folder")
+	}
+	connectionID := xid.New().String()
+	primary, err := v.getFilesystem(connectionID, v.MappedPath, &v.FsConfig, nil)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get the primary filesystem: %w", err)
+	}
+	defer primary.Close()
+
+	secondary, err := v.getFilesystem(connectionID, v.Failover.MappedPath, &v.Failover.FsConfig, nil)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get the secondary filesystem: %w", err)
 	}
+	defer secondary.Close()
+
+	return reconcileFailoverJournal(failoverStates.get(v.Name), v.VirtualPath, primary, secondary)
 }
 
 // CheckMetadataConsistency checks the consistency between the metadata stored
@@ -237,6 +369,21 @@ func (v *VirtualFolder) ScanQuota() (int, int64, error) {
 	return fs.ScanRootDirContents()
 }
 
+// ScanQuotaIncremental is like ScanQuota but, for local filesystems, it only
+// lists the directories modified since the scans recorded in states, if not nil
+func (v *VirtualFolder) ScanQuotaIncremental(states *QuotaScanStates, progress QuotaScanProgress) (int, int64, error) {
+	if v.hasPathPlaceholder() {
+		return 0, 0, errors.New("cannot scan quota: this folder has a path placeholder")
+	}
+	fs, err := v.GetFilesystem(xid.New().String(), nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fs.Close()
+
+	return ScanRootDirContentsIncremental(fs, states, progress)
+}
+
 // IsIncludedInUserQuota returns true if the virtual folder is included in user quota
 func (v *VirtualFolder) IsIncludedInUserQuota() bool {
 	return v.QuotaFiles == -1 && v.QuotaSize == -1
@@ -19,6 +19,7 @@ package vfs
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
@@ -27,6 +28,8 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/storage"
@@ -89,6 +92,12 @@ func NewGCSFs(connectionID, localTempDir, mountPath string, config GCSFsConfig)
 	if err = fs.config.validate(); err != nil {
 		return fs, err
 	}
+	if fs.config.DownloadPartSize > 0 {
+		fs.config.DownloadPartSize *= 1024 * 1024
+		if fs.config.DownloadConcurrency == 0 {
+			fs.config.DownloadConcurrency = 5
+		}
+	}
 	ctx := context.Background()
 	if fs.config.AutomaticCredentials > 0 {
 		fs.svc, err = storage.NewClient(ctx)
@@ -99,7 +108,10 @@ func NewGCSFs(connectionID, localTempDir, mountPath string, config GCSFsConfig)
 		}
 		fs.svc, err = storage.NewClient(ctx, option.WithCredentialsJSON([]byte(fs.config.Credentials.GetPayload())))
 	}
-	return fs, err
+	if err != nil {
+		return fs, err
+	}
+	return newObjectStorageFs(fs, fmt.Sprintf("%s|%s", gcsfsName, fs.config.Bucket)), nil
 }
 
 // Name returns the name for the Fs implementation
@@ -130,17 +142,32 @@ func (fs *GCSFs) Lstat(name string) (os.FileInfo, error) {
 
 // Open opens the named file for reading
 func (fs *GCSFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	if fs.config.DownloadPartSize > 0 {
+		attrs, err := fs.headObject(name)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		// ranged reads return the compressed bytes for gzip content encoding
+		if attrs.ContentEncoding != "gzip" {
+			return fs.openMultipart(name, offset, attrs)
+		}
+	}
 	r, w, err := pipeat.PipeInDir(fs.localTempDir)
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	bkt := fs.svc.Bucket(fs.config.Bucket)
+	bkt := fs.getBucket()
 	obj := bkt.Object(name)
 	ctx, cancelFn := context.WithCancel(context.Background())
 	objectReader, err := obj.NewRangeReader(ctx, offset, -1)
+	discard := int64(0)
 	if err == nil && offset > 0 && objectReader.Attrs.ContentEncoding == "gzip" {
-		err = fmt.Errorf("range request is not possible for gzip content encoding, requested offset %v", offset)
+		// range requests are not possible for gzip content encoding, the
+		// object is read from the beginning and the bytes before the
+		// requested offset are discarded
 		objectReader.Close()
+		discard = offset
+		objectReader, err = obj.NewRangeReader(ctx, 0, -1)
 	}
 	if err != nil {
 		r.Close()
@@ -152,6 +179,13 @@ func (fs *GCSFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, fu
 		defer cancelFn()
 		defer objectReader.Close()
 
+		if discard > 0 {
+			if _, err := io.CopyN(io.Discard, objectReader, discard); err != nil {
+				w.CloseWithError(err) //nolint:errcheck
+				fsLog(fs, logger.LevelDebug, "unable to skip %d bytes for path %q: %+v", discard, name, err)
+				return
+			}
+		}
 		n, err := io.Copy(w, objectReader)
 		w.CloseWithError(err) //nolint:errcheck
 		fsLog(fs, logger.LevelDebug, "download completed, path: %q size: %v, err: %+v", name, n, err)
@@ -160,6 +194,27 @@ func (fs *GCSFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, fu
 	return nil, r, cancelFn, nil
 }
 
+func (fs *GCSFs) openMultipart(name string, offset int64, attrs *storage.ObjectAttrs) (File, *pipeat.PipeReaderAt, func(), error) {
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+
+	go func() {
+		defer cancelFn()
+
+		// read all the parts from the same object generation
+		obj := fs.getBucket().Object(name).Generation(attrs.Generation)
+		err := fs.handleMultipartDownload(ctx, obj, attrs.Size, offset, w)
+		w.CloseWithError(err) //nolint:errcheck
+		fsLog(fs, logger.LevelDebug, "download completed, path: %q size: %v, err: %+v", name, w.GetWrittenBytes(), err)
+		metric.GCSTransferCompleted(w.GetWrittenBytes(), 1, err)
+	}()
+
+	return nil, r, cancelFn, nil
+}
+
 // Create creates or opens the named file for writing
 func (fs *GCSFs) Create(name string, flag, checks int) (File, *PipeWriter, func(), error) {
 	if checks&CheckParentDir != 0 {
@@ -173,7 +228,7 @@ func (fs *GCSFs) Create(name string, flag, checks int) (File, *PipeWriter, func(
 		return nil, nil, nil, err
 	}
 	p := NewPipeWriter(w)
-	bkt := fs.svc.Bucket(fs.config.Bucket)
+	bkt := fs.getBucket()
 	obj := bkt.Object(name)
 	if flag == -1 {
 		obj = obj.If(storage.Conditions{DoesNotExist: true})
@@ -208,6 +263,9 @@ func (fs *GCSFs) Create(name string, flag, checks int) (File, *PipeWriter, func(
 	if fs.config.StorageClass != "" {
 		objectWriter.ObjectAttrs.StorageClass = fs.config.StorageClass
 	}
+	if fs.config.KMSKeyName != "" {
+		objectWriter.KMSKeyName = fs.config.KMSKeyName
+	}
 	if fs.config.ACL != "" {
 		objectWriter.PredefinedACL = fs.config.ACL
 	}
@@ -258,7 +316,7 @@ func (fs *GCSFs) Remove(name string, isDir bool) error {
 			name += "/"
 		}
 	}
-	obj := fs.svc.Bucket(fs.config.Bucket).Object(name)
+	obj := fs.getBucket().Object(name)
 	attrs, statErr := fs.headObject(name)
 	if statErr == nil {
 		obj = obj.If(storage.Conditions{GenerationMatch: attrs.Generation})
@@ -273,7 +331,7 @@ func (fs *GCSFs) Remove(name string, isDir bool) error {
 	err := obj.Delete(ctx)
 	if isDir && fs.IsNotExist(err) {
 		// we can have directories without a trailing "/" (created using v2.1.0 and before)
-		err = fs.svc.Bucket(fs.config.Bucket).Object(strings.TrimSuffix(name, "/")).Delete(ctx)
+		err = fs.getBucket().Object(strings.TrimSuffix(name, "/")).Delete(ctx)
 	}
 	metric.GCSDeleteObjectCompleted(err)
 	if plugin.Handler.HasMetadater() && err == nil && !isDir {
@@ -342,7 +400,16 @@ func (*GCSFs) Truncate(_ string, _ int64) error {
 // ReadDir reads the directory named by dirname and returns
 // a list of directory entries.
 func (fs *GCSFs) ReadDir(dirname string) ([]os.FileInfo, error) {
-	var result []os.FileInfo
+	lister, err := fs.ListDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	return ReadAllFromDirLister(lister)
+}
+
+// ListDir implements the FsDirLister interface.
+// The objects are listed a page at a time while the entries are requested
+func (fs *GCSFs) ListDir(dirname string) (DirLister, error) {
 	// dirname must be already cleaned
 	prefix := fs.getPrefix(dirname)
 
@@ -354,67 +421,21 @@ func (fs *GCSFs) ReadDir(dirname string) ([]os.FileInfo, error) {
 
 	modTimes, err := getFolderModTimes(fs.getStorageID(), dirname)
 	if err != nil {
-		return result, err
+		return nil, err
 	}
 
-	prefixes := make(map[string]bool)
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxLongTimeout))
-	defer cancelFn()
-
-	bkt := fs.svc.Bucket(fs.config.Bucket)
+	bkt := fs.getBucket()
 	it := bkt.Objects(ctx, query)
-	pager := iterator.NewPager(it, defaultGCSPageSize, "")
-
-	for {
-		var objects []*storage.ObjectAttrs
-		pageToken, err := pager.NextPage(&objects)
-		if err != nil {
-			metric.GCSListObjectsCompleted(err)
-			return result, err
-		}
-
-		for _, attrs := range objects {
-			if attrs.Prefix != "" {
-				name, _ := fs.resolve(attrs.Prefix, prefix, attrs.ContentType)
-				if name == "" {
-					continue
-				}
-				if _, ok := prefixes[name]; ok {
-					continue
-				}
-				result = append(result, NewFileInfo(name, true, 0, time.Unix(0, 0), false))
-				prefixes[name] = true
-			} else {
-				name, isDir := fs.resolve(attrs.Name, prefix, attrs.ContentType)
-				if name == "" {
-					continue
-				}
-				if !attrs.Deleted.IsZero() {
-					continue
-				}
-				if isDir {
-					// check if the dir is already included, it will be sent as blob prefix if it contains at least one item
-					if _, ok := prefixes[name]; ok {
-						continue
-					}
-					prefixes[name] = true
-				}
-				modTime := attrs.Updated
-				if t, ok := modTimes[name]; ok {
-					modTime = util.GetTimeFromMsecSinceEpoch(t)
-				}
-				result = append(result, NewFileInfo(name, isDir, attrs.Size, modTime, false))
-			}
-		}
 
-		objects = nil
-		if pageToken == "" {
-			break
-		}
-	}
-
-	metric.GCSListObjectsCompleted(nil)
-	return result, nil
+	return &gcsDirLister{
+		fs:       fs,
+		pager:    iterator.NewPager(it, defaultGCSPageSize, ""),
+		cancelFn: cancelFn,
+		prefix:   prefix,
+		modTimes: modTimes,
+		prefixes: make(map[string]bool),
+	}, nil
 }
 
 // IsUploadResumeSupported returns true if resuming uploads is supported.
@@ -500,7 +521,7 @@ func (fs *GCSFs) getFileNamesInPrefix(fsPrefix string) (map[string]bool, error)
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxLongTimeout))
 	defer cancelFn()
 
-	bkt := fs.svc.Bucket(fs.config.Bucket)
+	bkt := fs.getBucket()
 	it := bkt.Objects(ctx, query)
 	pager := iterator.NewPager(it, defaultGCSPageSize, "")
 
@@ -558,7 +579,7 @@ func (fs *GCSFs) GetDirSize(dirname string) (int, int64, error) {
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxLongTimeout))
 	defer cancelFn()
 
-	bkt := fs.svc.Bucket(fs.config.Bucket)
+	bkt := fs.getBucket()
 	it := bkt.Objects(ctx, query)
 	pager := iterator.NewPager(it, defaultGCSPageSize, "")
 
@@ -638,7 +659,7 @@ func (fs *GCSFs) Walk(root string, walkFn filepath.WalkFunc) error {
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxLongTimeout))
 	defer cancelFn()
 
-	bkt := fs.svc.Bucket(fs.config.Bucket)
+	bkt := fs.getBucket()
 	it := bkt.Objects(ctx, query)
 	pager := iterator.NewPager(it, defaultGCSPageSize, "")
 
@@ -743,8 +764,8 @@ func (fs *GCSFs) getObjectStat(name string) (os.FileInfo, error) {
 }
 
 func (fs *GCSFs) copyFileInternal(source, target string) error {
-	src := fs.svc.Bucket(fs.config.Bucket).Object(source)
-	dst := fs.svc.Bucket(fs.config.Bucket).Object(target)
+	src := fs.getBucket().Object(source)
+	dst := fs.getBucket().Object(target)
 	attrs, statErr := fs.headObject(target)
 	if statErr == nil {
 		dst = dst.If(storage.Conditions{GenerationMatch: attrs.Generation})
@@ -762,6 +783,9 @@ func (fs *GCSFs) copyFileInternal(source, target string) error {
 	if fs.config.StorageClass != "" {
 		copier.StorageClass = fs.config.StorageClass
 	}
+	if fs.config.KMSKeyName != "" {
+		copier.DestinationKMSKeyName = fs.config.KMSKeyName
+	}
 	if fs.config.ACL != "" {
 		copier.PredefinedACL = fs.config.ACL
 	}
@@ -855,7 +879,7 @@ func (fs *GCSFs) hasContents(name string) (bool, error) {
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
 	defer cancelFn()
 
-	bkt := fs.svc.Bucket(fs.config.Bucket)
+	bkt := fs.getBucket()
 	it := bkt.Objects(ctx, query)
 	// if we have a dir object with a trailing slash it will be returned so we set the size to 2
 	pager := iterator.NewPager(it, 2, "")
@@ -896,7 +920,7 @@ func (fs *GCSFs) headObject(name string) (*storage.ObjectAttrs, error) {
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
 	defer cancelFn()
 
-	bkt := fs.svc.Bucket(fs.config.Bucket)
+	bkt := fs.getBucket()
 	obj := bkt.Object(name)
 	attrs, err := obj.Attrs(ctx)
 	metric.GCSHeadObjectCompleted(err)
@@ -922,6 +946,200 @@ func (*GCSFs) GetAvailableDiskSize(_ string) (*sftp.StatVFS, error) {
 	return nil, ErrStorageSizeUnavailable
 }
 
+// getBucket returns the handle for the configured bucket, requests are billed
+// to the configured billing project, if any
+func (fs *GCSFs) getBucket() *storage.BucketHandle {
+	bkt := fs.svc.Bucket(fs.config.Bucket)
+	if fs.config.BillingProject != "" {
+		return bkt.UserProject(fs.config.BillingProject)
+	}
+	return bkt
+}
+
 func (fs *GCSFs) getStorageID() string {
 	return fmt.Sprintf("gs://%v", fs.config.Bucket)
 }
+
+func (fs *GCSFs) downloadPart(ctx context.Context, obj *storage.ObjectHandle, buf []byte,
+	w io.WriterAt, offset, count, writeOffset int64,
+) error {
+	if count == 0 {
+		return nil
+	}
+	objectReader, err := obj.NewRangeReader(ctx, offset, count)
+	if err != nil {
+		return err
+	}
+	defer objectReader.Close()
+
+	_, err = io.ReadFull(objectReader, buf[:count])
+	if err != nil {
+		return err
+	}
+	written := int64(0)
+	for written < count {
+		n, err := w.WriteAt(buf[written:count], writeOffset+written)
+		written += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleMultipartDownload downloads the object, starting from the specified offset,
+// using parallel ranged reads
+func (fs *GCSFs) handleMultipartDownload(ctx context.Context, obj *storage.ObjectHandle, contentLength,
+	offset int64, writer io.WriterAt,
+) error {
+	sizeToDownload := contentLength - offset
+	if sizeToDownload < 0 {
+		fsLog(fs, logger.LevelError, "invalid multipart download size or offset, size: %v, offset: %v, size to download: %v",
+			contentLength, offset, sizeToDownload)
+		return errors.New("the requested offset exceeds the file size")
+	}
+	if sizeToDownload == 0 {
+		fsLog(fs, logger.LevelDebug, "nothing to download, offset %v, content length %v", offset, contentLength)
+		return nil
+	}
+	partSize := fs.config.DownloadPartSize
+	guard := make(chan struct{}, fs.config.DownloadConcurrency)
+	partCtxTimeout := time.Duration(fs.config.DownloadPartSize/(1024*1024)) * time.Minute
+	pool := newBufferAllocator(int(partSize))
+	finished := false
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var hasError atomic.Bool
+	var poolError error
+
+	poolCtx, poolCancel := context.WithCancel(ctx)
+	defer poolCancel()
+
+	for part := 0; !finished; part++ {
+		start := offset
+		end := offset + partSize
+		if end >= contentLength {
+			end = contentLength
+			finished = true
+		}
+		writeOffset := int64(part) * partSize
+		offset = end
+
+		guard <- struct{}{}
+		if hasError.Load() {
+			fsLog(fs, logger.LevelDebug, "pool error, download for part %v not started", part)
+			break
+		}
+
+		buf := pool.getBuffer()
+		wg.Add(1)
+		go func(start, end, writeOffset int64, buf []byte) {
+			defer func() {
+				pool.releaseBuffer(buf)
+				<-guard
+				wg.Done()
+			}()
+
+			innerCtx, cancelFn := context.WithDeadline(poolCtx, time.Now().Add(partCtxTimeout))
+			defer cancelFn()
+
+			err := fs.downloadPart(innerCtx, obj, buf, writer, start, end-start, writeOffset)
+			if err != nil {
+				errOnce.Do(func() {
+					fsLog(fs, logger.LevelError, "multipart download error: %+v", err)
+					hasError.Store(true)
+					poolError = fmt.Errorf("multipart download error: %w", err)
+					poolCancel()
+				})
+			}
+		}(start, end, writeOffset, buf)
+	}
+
+	wg.Wait()
+	close(guard)
+	pool.free()
+
+	return poolError
+}
+
+type gcsDirLister struct {
+	baseDirLister
+	fs            *GCSFs
+	pager         *iterator.Pager
+	cancelFn      context.CancelFunc
+	prefix        string
+	modTimes      map[string]int64
+	prefixes      map[string]bool
+	noMorePages   bool
+	metricUpdated bool
+}
+
+// Next implements the DirLister interface
+func (l *gcsDirLister) Next(limit int) ([]os.FileInfo, error) {
+	limit = getListerLimit(limit)
+	for len(l.cache) < limit && !l.noMorePages {
+		if err := l.fetchPage(); err != nil {
+			return nil, err
+		}
+	}
+	if l.noMorePages && !l.metricUpdated {
+		l.metricUpdated = true
+		metric.GCSListObjectsCompleted(nil)
+	}
+	return l.returnFromCache(limit)
+}
+
+func (l *gcsDirLister) fetchPage() error {
+	var objects []*storage.ObjectAttrs
+	pageToken, err := l.pager.NextPage(&objects)
+	if err != nil {
+		if !l.metricUpdated {
+			l.metricUpdated = true
+			metric.GCSListObjectsCompleted(err)
+		}
+		return err
+	}
+	l.noMorePages = pageToken == ""
+
+	for _, attrs := range objects {
+		if attrs.Prefix != "" {
+			name, _ := l.fs.resolve(attrs.Prefix, l.prefix, attrs.ContentType)
+			if name == "" {
+				continue
+			}
+			if _, ok := l.prefixes[name]; ok {
+				continue
+			}
+			l.cache = append(l.cache, NewFileInfo(name, true, 0, time.Unix(0, 0), false))
+			l.prefixes[name] = true
+		} else {
+			name, isDir := l.fs.resolve(attrs.Name, l.prefix, attrs.ContentType)
+			if name == "" {
+				continue
+			}
+			if !attrs.Deleted.IsZero() {
+				continue
+			}
+			if isDir {
+				// check if the dir is already included, it will be sent as blob prefix if it contains at least one item
+				if _, ok := l.prefixes[name]; ok {
+					continue
+				}
+				l.prefixes[name] = true
+			}
+			modTime := attrs.Updated
+			if t, ok := l.modTimes[name]; ok {
+				modTime = util.GetTimeFromMsecSinceEpoch(t)
+			}
+			l.cache = append(l.cache, NewFileInfo(name, isDir, attrs.Size, modTime, false))
+		}
+	}
+	return nil
+}
+
+// Close implements the DirLister interface
+func (l *gcsDirLister) Close() error {
+	l.cancelFn()
+	l.prefixes = nil
+	return l.baseDirLister.Close()
+}
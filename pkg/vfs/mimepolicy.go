@@ -0,0 +1,215 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vfs
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+var (
+	// zip based formats, they are detected as application/zip
+	zipContainerTypes = []string{"application/java-archive", "application/vnd.android.package-archive",
+		"application/vnd.ms-xpsdocument"}
+	// binary formats recognized by the content detection, the "x-" prefix is
+	// removed from the subtypes
+	sniffedMIMETypes = []string{"image/icon", "image/bmp", "image/gif", "image/webp", "image/png", "image/jpeg",
+		"audio/basic", "audio/aiff", "audio/mpeg", "application/ogg", "audio/midi", "video/avi", "audio/wave",
+		"video/mp4", "video/webm", "font/ttf", "font/otf", "font/collection", "font/woff", "font/woff2",
+		"application/gzip", "application/zip", "application/rar-compressed", "application/wasm",
+		"application/pdf", "application/postscript", "application/vnd.ms-fontobject"}
+	// equivalent content types, the "x-" prefix is removed from the subtypes
+	mimeTypeAliases = map[string]string{
+		"image/vnd.microsoft.icon": "image/icon",
+		"audio/wav":                "audio/wave",
+		"audio/vnd.wave":           "audio/wave",
+		"audio/mp3":                "audio/mpeg",
+		"video/msvideo":            "video/avi",
+		"application/vnd.rar":      "application/rar-compressed",
+		"application/rar":          "application/rar-compressed",
+		"application/font-woff":    "font/woff",
+	}
+)
+
+// MIMEPolicy defines the content types allowed for the uploaded files.
+// The content type is detected from the first bytes of the files
+type MIMEPolicy struct {
+	// Allowed content types, for example "application/pdf" or "image/*".
+	// Empty means that any content type not explicitly denied is allowed
+	AllowedTypes []string `json:"allowed_types,omitempty"`
+	// Denied content types, they have precedence over the allowed ones
+	DeniedTypes []string `json:"denied_types,omitempty"`
+	// If enabled, uploads whose detected content type does not match the
+	// file extension are rejected
+	CheckExtension bool `json:"check_extension,omitempty"`
+}
+
+// IsEnabled returns true if the uploaded contents must be checked
+func (p *MIMEPolicy) IsEnabled() bool {
+	return len(p.AllowedTypes) > 0 || len(p.DeniedTypes) > 0 || p.CheckExtension
+}
+
+// CheckContentType returns an error if the detected content type is not
+// allowed for a file with the specified name
+func (p *MIMEPolicy) CheckContentType(name, contentType string) error {
+	contentType = getBaseMIMEType(contentType)
+	for _, denied := range p.DeniedTypes {
+		if matchMIMEType(denied, contentType) {
+			return fmt.Errorf("content type %q is denied", contentType)
+		}
+	}
+	if len(p.AllowedTypes) > 0 {
+		allowed := false
+		for _, t := range p.AllowedTypes {
+			if matchMIMEType(t, contentType) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("content type %q is not allowed", contentType)
+		}
+	}
+	if p.CheckExtension {
+		ext := path.Ext(name)
+		expected := getBaseMIMEType(mime.TypeByExtension(ext))
+		if !isMIMETypeCompatible(expected, contentType) {
+			return fmt.Errorf("content type %q does not match the extension %q, expected %q", contentType, ext, expected)
+		}
+	}
+	return nil
+}
+
+// GetACopy returns a copy
+func (p *MIMEPolicy) GetACopy() MIMEPolicy {
+	policy := MIMEPolicy{
+		CheckExtension: p.CheckExtension,
+	}
+	if len(p.AllowedTypes) > 0 {
+		policy.AllowedTypes = make([]string, len(p.AllowedTypes))
+		copy(policy.AllowedTypes, p.AllowedTypes)
+	}
+	if len(p.DeniedTypes) > 0 {
+		policy.DeniedTypes = make([]string, len(p.DeniedTypes))
+		copy(policy.DeniedTypes, p.DeniedTypes)
+	}
+	return policy
+}
+
+func (p *MIMEPolicy) validate() error {
+	var err error
+	p.AllowedTypes, err = validateMIMETypes(p.AllowedTypes)
+	if err != nil {
+		return err
+	}
+	p.DeniedTypes, err = validateMIMETypes(p.DeniedTypes)
+	return err
+}
+
+func validateMIMETypes(types []string) ([]string, error) {
+	var result []string
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		mainType, subType, ok := strings.Cut(t, "/")
+		if !ok || mainType == "" || subType == "" || mainType == "*" || strings.ContainsAny(t, "; ") ||
+			strings.Contains(subType, "/") {
+			return nil, util.NewValidationError(fmt.Sprintf("invalid content type %q", t))
+		}
+		if !util.Contains(result, t) {
+			result = append(result, t)
+		}
+	}
+	return result, nil
+}
+
+// getBaseMIMEType returns the content type without parameters
+func getBaseMIMEType(contentType string) string {
+	contentType, _, _ = strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// matchMIMEType returns true if the content type matches the pattern,
+// "type/*" matches all the subtypes
+func matchMIMEType(pattern, contentType string) bool {
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(contentType, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == contentType
+}
+
+// isMIMETypeCompatible returns true if the detected content type is
+// compatible with the one expected for the file extension. The detection
+// recognizes a limited set of signatures: text based formats are detected
+// as text, zip based formats, such as office documents, as zip archives and
+// the unknown binary formats as application/octet-stream
+func isMIMETypeCompatible(expected, detected string) bool {
+	if expected == "" || expected == detected {
+		return true
+	}
+	expected = normalizeMIMEType(expected)
+	detected = normalizeMIMEType(detected)
+	if expected == detected {
+		return true
+	}
+	if strings.HasPrefix(detected, "text/") {
+		return isTextMIMEType(expected)
+	}
+	isZipContainer := strings.HasSuffix(expected, "+zip") || strings.Contains(expected, "openxmlformats") ||
+		strings.Contains(expected, "opendocument") || util.Contains(zipContainerTypes, expected)
+	switch detected {
+	case "application/zip":
+		return isZipContainer
+	case "application/octet-stream":
+		return !isZipContainer && !isTextMIMEType(expected) && !util.Contains(sniffedMIMETypes, expected)
+	default:
+		return false
+	}
+}
+
+// normalizeMIMEType removes the "x-" prefix from the subtype and resolves
+// the aliases
+func normalizeMIMEType(contentType string) string {
+	mainType, subType, _ := strings.Cut(contentType, "/")
+	contentType = mainType + "/" + strings.TrimPrefix(subType, "x-")
+	if alias, ok := mimeTypeAliases[contentType]; ok {
+		return alias
+	}
+	return contentType
+}
+
+// isTextMIMEType returns true for the text based formats, the content type
+// must be normalized
+func isTextMIMEType(contentType string) bool {
+	if strings.HasPrefix(contentType, "text/") {
+		return true
+	}
+	if strings.HasSuffix(contentType, "+xml") || strings.HasSuffix(contentType, "+json") {
+		return true
+	}
+	switch contentType {
+	case "application/json", "application/xml", "application/javascript", "application/sh", "application/yaml",
+		"application/toml", "application/sql":
+		return true
+	default:
+		return false
+	}
+}
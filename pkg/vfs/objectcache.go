@@ -0,0 +1,496 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vfs
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eikenb/pipeat"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/metric"
+)
+
+const (
+	objectCacheLogSender = "objectcache"
+	objectCacheFileExt   = ".cache"
+	objectCachePartExt   = ".part"
+)
+
+var (
+	objectCacheMutex    sync.RWMutex
+	objectCacheInstance *objectCache
+)
+
+// ObjectCacheConfig defines the configuration for the local disk cache used
+// by the S3, Google Cloud Storage and Azure Blob storage backends
+type ObjectCacheConfig struct {
+	// Absolute path to the directory used to store the cached objects.
+	// Empty means object cache disabled
+	Path string `json:"path" mapstructure:"path"`
+	// Maximum size of the cache as MB. The least recently used objects are
+	// evicted when this size is exceeded
+	MaxSize int64 `json:"max_size" mapstructure:"max_size"`
+	// Objects bigger than this size, as MB, are never cached.
+	// 0 means up to max_size
+	MaxObjectSize int64 `json:"max_object_size" mapstructure:"max_object_size"`
+	// If enabled the uploaded files are added to the cache too, so they
+	// can be downloaded without reading them back from the object storage
+	CacheUploads bool `json:"cache_uploads" mapstructure:"cache_uploads"`
+}
+
+// IsEnabled returns true if the object cache is enabled
+func (c *ObjectCacheConfig) IsEnabled() bool {
+	return c.Path != ""
+}
+
+// Validate returns an error if the configuration is not valid
+func (c *ObjectCacheConfig) Validate() error {
+	if !c.IsEnabled() {
+		return nil
+	}
+	if !filepath.IsAbs(c.Path) {
+		return fmt.Errorf("invalid object cache path %q, it must be an absolute path", c.Path)
+	}
+	if c.MaxSize <= 0 {
+		return fmt.Errorf("invalid object cache max size: %d", c.MaxSize)
+	}
+	if c.MaxObjectSize < 0 || c.MaxObjectSize > c.MaxSize {
+		return fmt.Errorf("invalid object cache max object size: %d, it must be between 0 and max size", c.MaxObjectSize)
+	}
+	return os.MkdirAll(c.Path, 0700)
+}
+
+// SetObjectCacheConfig sets the configuration for the object cache and loads
+// the objects already cached on disk.
+// The configuration must be validated before calling this method
+func SetObjectCacheConfig(config ObjectCacheConfig) {
+	var cache *objectCache
+	if config.IsEnabled() {
+		cache = &objectCache{
+			path:          config.Path,
+			maxSize:       config.MaxSize * 1048576,
+			maxObjectSize: config.MaxObjectSize * 1048576,
+			cacheUploads:  config.CacheUploads,
+			lru:           list.New(),
+			entries:       make(map[string]*list.Element),
+		}
+		if cache.maxObjectSize == 0 {
+			cache.maxObjectSize = cache.maxSize
+		}
+		cache.load()
+	}
+	objectCacheMutex.Lock()
+	defer objectCacheMutex.Unlock()
+
+	objectCacheInstance = cache
+	if cache == nil {
+		metric.UpdateObjectCacheSize(0)
+	}
+}
+
+func getObjectCache() *objectCache {
+	objectCacheMutex.RLock()
+	defer objectCacheMutex.RUnlock()
+
+	return objectCacheInstance
+}
+
+type objectCacheEntry struct {
+	key     string
+	size    int64
+	modTime time.Time
+}
+
+// objectCache keeps the cached objects ordered by recent use, the least
+// recently used objects are evicted to stay within the configured size.
+// The cached files have the modification time of the remote objects,
+// so the cache can be reloaded after a restart
+type objectCache struct {
+	mu            sync.Mutex
+	path          string
+	maxSize       int64
+	maxObjectSize int64
+	cacheUploads  bool
+	size          int64
+	lru           *list.List
+	entries       map[string]*list.Element
+}
+
+func (c *objectCache) load() {
+	entries, err := os.ReadDir(c.path)
+	if err != nil {
+		logger.Warn(objectCacheLogSender, "", "unable to read the object cache directory %q: %v", c.path, err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if strings.HasSuffix(name, objectCachePartExt) {
+			// partial object from a previous run
+			os.Remove(filepath.Join(c.path, name)) //nolint:errcheck
+			continue
+		}
+		if !strings.HasSuffix(name, objectCacheFileExt) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		key := strings.TrimSuffix(name, objectCacheFileExt)
+		c.entries[key] = c.lru.PushBack(&objectCacheEntry{
+			key:     key,
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+		c.size += info.Size()
+	}
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		c.removeElement(c.lru.Back())
+		metric.ObjectCacheEviction()
+	}
+	metric.UpdateObjectCacheSize(c.size)
+	logger.Info(objectCacheLogSender, "", "object cache loaded, objects: %d, size: %d", c.lru.Len(), c.size)
+}
+
+func (c *objectCache) isCacheable(size int64) bool {
+	return size <= c.maxObjectSize
+}
+
+func (c *objectCache) getObjectPath(key string) string {
+	return filepath.Join(c.path, key+objectCacheFileExt)
+}
+
+// open returns the cached file for the specified key if it matches the
+// size and the modification time of the remote object, nil otherwise.
+// Stale objects are removed
+func (c *objectCache) open(key string, info os.FileInfo) *os.File {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := el.Value.(*objectCacheEntry)
+	if entry.size != info.Size() || !entry.modTime.Equal(info.ModTime()) {
+		c.removeElement(el)
+		return nil
+	}
+	f, err := os.Open(c.getObjectPath(key))
+	if err != nil {
+		c.removeElement(el)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return f
+}
+
+func (c *objectCache) newPartFile() (*os.File, error) {
+	return os.CreateTemp(c.path, "*"+objectCachePartExt)
+}
+
+func (c *objectCache) discard(part *os.File) {
+	part.Close()           //nolint:errcheck
+	os.Remove(part.Name()) //nolint:errcheck
+}
+
+// store adds the part file to the cache, the least recently used objects
+// are evicted to make room for it
+func (c *objectCache) store(key string, part *os.File, size int64, modTime time.Time) error {
+	partName := part.Name()
+	if err := part.Close(); err != nil {
+		os.Remove(partName) //nolint:errcheck
+		return err
+	}
+	if err := os.Chtimes(partName, modTime, modTime); err != nil {
+		os.Remove(partName) //nolint:errcheck
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el)
+	}
+	for c.size+size > c.maxSize && c.lru.Len() > 0 {
+		c.removeElement(c.lru.Back())
+		metric.ObjectCacheEviction()
+	}
+	if err := os.Rename(partName, c.getObjectPath(key)); err != nil {
+		os.Remove(partName) //nolint:errcheck
+		metric.UpdateObjectCacheSize(c.size)
+		return err
+	}
+	c.entries[key] = c.lru.PushFront(&objectCacheEntry{
+		key:     key,
+		size:    size,
+		modTime: modTime,
+	})
+	c.size += size
+	metric.UpdateObjectCacheSize(c.size)
+	return nil
+}
+
+func (c *objectCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el)
+		metric.UpdateObjectCacheSize(c.size)
+	}
+}
+
+// removeElement must be called with the lock held. Open files are not
+// affected, they can still be read until closed
+func (c *objectCache) removeElement(el *list.Element) {
+	entry := el.Value.(*objectCacheEntry)
+	if err := os.Remove(c.getObjectPath(entry.key)); err != nil && !os.IsNotExist(err) {
+		logger.Warn(objectCacheLogSender, "", "unable to remove cached object %q: %v", entry.key, err)
+	}
+	c.lru.Remove(el)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+// objectCacheWriter writes to the cache part file. Write errors are recorded
+// and never returned, a failure writing the cache must not affect the transfer
+type objectCacheWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *objectCacheWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// NewObjectCacheFs returns a Fs that caches the downloaded objects on the local
+// disk if the object cache is enabled, the provided Fs otherwise.
+// The namespace identifies the storage, for example the endpoint and the bucket,
+// and it is combined with the object names to build the cache keys
+func NewObjectCacheFs(fs Fs, namespace string) Fs {
+	cache := getObjectCache()
+	if cache == nil {
+		return fs
+	}
+	cacheFs := &objectCacheFs{
+		Fs:        fs,
+		cache:     cache,
+		namespace: namespace,
+	}
+	if _, ok := fs.(FsFileCopier); ok {
+		if _, ok := fs.(FsBatchRemover); ok {
+			return &objectCacheBatchRemoverFs{
+				objectCacheCopierFs: &objectCacheCopierFs{objectCacheFs: cacheFs},
+			}
+		}
+		return &objectCacheCopierFs{objectCacheFs: cacheFs}
+	}
+	return cacheFs
+}
+
+// objectCacheFs wraps a Fs adding a read-through cache for the downloads and,
+// optionally, a write-through cache for the uploads. The cached objects are
+// validated against the size and the modification time of the remote objects
+// before using them, so changes made outside SFTPGo are detected
+type objectCacheFs struct {
+	Fs
+	cache     *objectCache
+	namespace string
+}
+
+func (fs *objectCacheFs) getCacheKey(name string) string {
+	h := sha256.New()
+	h.Write([]byte(fs.namespace))
+	h.Write([]byte{0})
+	h.Write([]byte(name))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Open serves the named file from the cache if available, otherwise the
+// object is downloaded and added to the cache while it is read
+func (fs *objectCacheFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	info, err := fs.Fs.Stat(name)
+	if err != nil || !info.Mode().IsRegular() || !fs.cache.isCacheable(info.Size()) {
+		return fs.Fs.Open(name, offset)
+	}
+	key := fs.getCacheKey(name)
+	if f := fs.cache.open(key, info); f != nil {
+		_, err = f.Seek(offset, io.SeekStart)
+		if err == nil {
+			fsLog(fs, logger.LevelDebug, "object cache hit for path %q, offset: %d", name, offset)
+			metric.ObjectCacheHit(info.Size() - offset)
+			return f, nil, nil, nil
+		}
+		f.Close()
+	}
+	metric.ObjectCacheMiss()
+	if offset > 0 {
+		// partial downloads are not cached
+		return fs.Fs.Open(name, offset)
+	}
+	return fs.openAndCache(name, key, info)
+}
+
+func (fs *objectCacheFs) openAndCache(name, key string, info os.FileInfo) (File, *pipeat.PipeReaderAt, func(), error) {
+	f, r, cancelFn, err := fs.Fs.Open(name, 0)
+	if err != nil || r == nil {
+		return f, r, cancelFn, err
+	}
+	part, err := fs.cache.newPartFile()
+	if err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to create object cache file for path %q: %v", name, err)
+		return f, r, cancelFn, nil
+	}
+	pipeReader, pipeWriter, err := pipeat.PipeInDir(fs.cache.path)
+	if err != nil {
+		fs.cache.discard(part)
+		fsLog(fs, logger.LevelWarn, "unable to create object cache pipe for path %q: %v", name, err)
+		return f, r, cancelFn, nil
+	}
+
+	go func() {
+		cw := &objectCacheWriter{w: part}
+		n, err := io.Copy(io.MultiWriter(pipeWriter, cw), r)
+		if err != nil && cancelFn != nil {
+			cancelFn()
+		}
+		r.CloseWithError(err) //nolint:errcheck
+		if err == nil && cw.err == nil && n == info.Size() {
+			err := fs.cache.store(key, part, n, info.ModTime())
+			fsLog(fs, logger.LevelDebug, "object cache updated for path %q, size: %d, err: %v", name, n, err)
+		} else {
+			fs.cache.discard(part)
+		}
+		pipeWriter.CloseWithError(err) //nolint:errcheck
+	}()
+
+	return nil, pipeReader, cancelFn, nil
+}
+
+// Create removes the named file from the cache. If the uploads must be
+// cached the uploaded contents are added to the cache after a successful upload
+func (fs *objectCacheFs) Create(name string, flag, checks int) (File, *PipeWriter, func(), error) {
+	key := fs.getCacheKey(name)
+	fs.cache.remove(key)
+	f, p, cancelFn, err := fs.Fs.Create(name, flag, checks)
+	if err != nil || p == nil || flag == -1 || !fs.cache.cacheUploads {
+		return f, p, cancelFn, err
+	}
+	part, err := fs.cache.newPartFile()
+	if err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to create object cache file for path %q: %v", name, err)
+		return f, p, cancelFn, nil
+	}
+	pipeReader, pipeWriter, err := pipeat.PipeInDir(fs.cache.path)
+	if err != nil {
+		fs.cache.discard(part)
+		fsLog(fs, logger.LevelWarn, "unable to create object cache pipe for path %q: %v", name, err)
+		return f, p, cancelFn, nil
+	}
+	cacheWriter := NewPipeWriter(pipeWriter)
+
+	go func() {
+		cw := &objectCacheWriter{w: part}
+		n, err := io.Copy(io.MultiWriter(p, cw), pipeReader)
+		if err != nil && cancelFn != nil {
+			cancelFn()
+		}
+		pipeReader.CloseWithError(err) //nolint:errcheck
+		errClose := p.Close()
+		if err == nil {
+			err = errClose
+		}
+		cacheWriter.Done(err)
+		if err != nil || cw.err != nil {
+			fs.cache.discard(part)
+			return
+		}
+		info, err := fs.Fs.Stat(name)
+		if err != nil || info.Size() != n || !fs.cache.isCacheable(n) {
+			fs.cache.discard(part)
+			return
+		}
+		err = fs.cache.store(key, part, n, info.ModTime())
+		fsLog(fs, logger.LevelDebug, "object cache updated after upload for path %q, size: %d, err: %v", name, n, err)
+	}()
+
+	return f, cacheWriter, cancelFn, nil
+}
+
+// Rename removes the source and the target from the cache and renames the source
+func (fs *objectCacheFs) Rename(source, target string) (int, int64, error) {
+	fs.cache.remove(fs.getCacheKey(source))
+	fs.cache.remove(fs.getCacheKey(target))
+	return fs.Fs.Rename(source, target)
+}
+
+// ListDir implements the FsDirLister interface, the listing is read in chunks
+// if supported by the wrapped Fs
+func (fs *objectCacheFs) ListDir(dirname string) (DirLister, error) {
+	return ListDir(fs.Fs, dirname)
+}
+
+// Remove removes the named file from the cache and from the storage
+func (fs *objectCacheFs) Remove(name string, isDir bool) error {
+	if !isDir {
+		fs.cache.remove(fs.getCacheKey(name))
+	}
+	return fs.Fs.Remove(name, isDir)
+}
+
+// objectCacheCopierFs is an objectCacheFs for storages supporting server side copy
+type objectCacheCopierFs struct {
+	*objectCacheFs
+}
+
+// CopyFile implements the FsFileCopier interface
+func (fs *objectCacheCopierFs) CopyFile(source, target string, srcSize int64) error {
+	fs.cache.remove(fs.getCacheKey(target))
+	return fs.Fs.(FsFileCopier).CopyFile(source, target, srcSize)
+}
+
+// objectCacheBatchRemoverFs is an objectCacheCopierFs for storages supporting
+// batch removals
+type objectCacheBatchRemoverFs struct {
+	*objectCacheCopierFs
+}
+
+// RemoveFiles implements the FsBatchRemover interface
+func (fs *objectCacheBatchRemoverFs) RemoveFiles(names []string) error {
+	for _, name := range names {
+		fs.cache.remove(fs.getCacheKey(name))
+	}
+	return fs.Fs.(FsBatchRemover).RemoveFiles(names)
+}
@@ -263,7 +263,16 @@ func (*OsFs) Truncate(name string, size int64) error {
 
 // ReadDir reads the directory named by dirname and returns
 // a list of directory entries.
-func (*OsFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+func (fs *OsFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	lister, err := fs.ListDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	return ReadAllFromDirLister(lister)
+}
+
+// ListDir implements the FsDirLister interface
+func (*OsFs) ListDir(dirname string) (DirLister, error) {
 	f, err := os.Open(dirname)
 	if err != nil {
 		if isInvalidNameError(err) {
@@ -271,12 +280,7 @@ func (*OsFs) ReadDir(dirname string) ([]os.FileInfo, error) {
 		}
 		return nil, err
 	}
-	list, err := f.Readdir(-1)
-	f.Close()
-	if err != nil {
-		return nil, err
-	}
-	return list, nil
+	return &osDirLister{f: f}, nil
 }
 
 // IsUploadResumeSupported returns true if resuming uploads is supported
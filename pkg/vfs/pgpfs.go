@@ -0,0 +1,502 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eikenb/pipeat"
+	"golang.org/x/crypto/openpgp" //nolint:staticcheck
+
+	"github.com/drakkan/sftpgo/v2/pkg/kms"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	// pgpFsName is the name for the Fs implementation that PGP encrypts the uploaded files
+	pgpFsName = "pgpfs"
+	// maximum number of decrypted sizes cached for each connection
+	pgpSizeCacheMaxEntries = 1000
+)
+
+var errPGPTransferAborted = errors.New("PGP transfer aborted")
+
+// PGPFsConfig defines the settings to PGP encrypt the uploaded files and to
+// optionally decrypt them on download
+type PGPFsConfig struct {
+	// Armored OpenPGP public keys for the recipients. The uploaded files are
+	// encrypted if at least one key is configured
+	PublicKeys []string `json:"public_keys,omitempty"`
+	// Armored OpenPGP private key used to decrypt the files on download
+	PrivateKey *kms.Secret `json:"private_key,omitempty"`
+	// Passphrase for the private key, if it is encrypted
+	Passphrase *kms.Secret `json:"passphrase,omitempty"`
+	// Users allowed to download the decrypted files. The other users download
+	// the encrypted files. A private key is required
+	DecryptUsers []string `json:"decrypt_users,omitempty"`
+}
+
+// IsEnabled returns true if the uploaded files must be encrypted
+func (c *PGPFsConfig) IsEnabled() bool {
+	return len(c.PublicKeys) > 0
+}
+
+// CanDecrypt returns true if the specified user downloads the decrypted files
+func (c *PGPFsConfig) CanDecrypt(username string) bool {
+	if c.PrivateKey == nil || c.PrivateKey.IsEmpty() {
+		return false
+	}
+	return util.Contains(c.DecryptUsers, username)
+}
+
+// GetACopy returns a copy
+func (c *PGPFsConfig) GetACopy() PGPFsConfig {
+	c.setEmptySecretsIfNil()
+	config := PGPFsConfig{
+		PrivateKey: c.PrivateKey.Clone(),
+		Passphrase: c.Passphrase.Clone(),
+	}
+	if len(c.PublicKeys) > 0 {
+		config.PublicKeys = make([]string, len(c.PublicKeys))
+		copy(config.PublicKeys, c.PublicKeys)
+	}
+	if len(c.DecryptUsers) > 0 {
+		config.DecryptUsers = make([]string, len(c.DecryptUsers))
+		copy(config.DecryptUsers, c.DecryptUsers)
+	}
+	return config
+}
+
+// HideConfidentialData hides confidential data
+func (c *PGPFsConfig) HideConfidentialData() {
+	if c.PrivateKey != nil {
+		c.PrivateKey.Hide()
+	}
+	if c.Passphrase != nil {
+		c.Passphrase.Hide()
+	}
+}
+
+func (c *PGPFsConfig) hasRedactedSecret() bool {
+	if c.PrivateKey != nil && c.PrivateKey.IsRedacted() {
+		return true
+	}
+	return c.Passphrase != nil && c.Passphrase.IsRedacted()
+}
+
+func (c *PGPFsConfig) setEmptySecretsIfNil() {
+	if c.PrivateKey == nil {
+		c.PrivateKey = kms.NewEmptySecret()
+	}
+	if c.Passphrase == nil {
+		c.Passphrase = kms.NewEmptySecret()
+	}
+}
+
+func (c *PGPFsConfig) setNilSecretsIfEmpty() {
+	if c.PrivateKey != nil && c.PrivateKey.IsEmpty() {
+		c.PrivateKey = nil
+	}
+	if c.Passphrase != nil && c.Passphrase.IsEmpty() {
+		c.Passphrase = nil
+	}
+}
+
+func (c *PGPFsConfig) isEqual(other PGPFsConfig) bool {
+	if len(c.PublicKeys) != len(other.PublicKeys) || len(c.DecryptUsers) != len(other.DecryptUsers) {
+		return false
+	}
+	for idx := range c.PublicKeys {
+		if c.PublicKeys[idx] != other.PublicKeys[idx] {
+			return false
+		}
+	}
+	for _, username := range c.DecryptUsers {
+		if !util.Contains(other.DecryptUsers, username) {
+			return false
+		}
+	}
+	c.setEmptySecretsIfNil()
+	other.setEmptySecretsIfNil()
+	if !c.PrivateKey.IsEqual(other.PrivateKey) {
+		return false
+	}
+	return c.Passphrase.IsEqual(other.Passphrase)
+}
+
+// ValidateAndEncryptCredentials validates the configuration and encrypts the
+// private key and its passphrase if they are in plain text
+func (c *PGPFsConfig) ValidateAndEncryptCredentials(additionalData string) error {
+	if err := c.validate(); err != nil {
+		return util.NewValidationError(fmt.Sprintf("could not validate PGP config: %v", err))
+	}
+	for _, secret := range []*kms.Secret{c.PrivateKey, c.Passphrase} {
+		if secret.IsPlain() {
+			secret.SetAdditionalData(additionalData)
+			if err := secret.Encrypt(); err != nil {
+				return util.NewValidationError(fmt.Sprintf("could not encrypt PGP private key: %v", err))
+			}
+		}
+	}
+	return nil
+}
+
+func (c *PGPFsConfig) validate() error {
+	var publicKeys []string
+	for _, key := range c.PublicKeys {
+		if strings.TrimSpace(key) != "" {
+			publicKeys = append(publicKeys, key)
+		}
+	}
+	if len(publicKeys) == 0 {
+		*c = PGPFsConfig{}
+		c.setEmptySecretsIfNil()
+		return nil
+	}
+	c.PublicKeys = publicKeys
+	var decryptUsers []string
+	for _, username := range util.RemoveDuplicates(c.DecryptUsers, true) {
+		if username != "" {
+			decryptUsers = append(decryptUsers, username)
+		}
+	}
+	c.DecryptUsers = decryptUsers
+	c.setEmptySecretsIfNil()
+	recipients, err := c.getPublicKeys()
+	if err != nil {
+		return err
+	}
+	if c.PrivateKey.IsEmpty() {
+		if len(c.DecryptUsers) > 0 {
+			return errors.New("a private key is required to decrypt the files on download")
+		}
+		c.Passphrase = kms.NewEmptySecret()
+		return nil
+	}
+	for _, secret := range []*kms.Secret{c.PrivateKey, c.Passphrase} {
+		if !secret.IsEmpty() && !secret.IsValidInput() {
+			return errors.New("the private key and its passphrase cannot be empty or invalid")
+		}
+		if secret.IsEncrypted() && !secret.IsValid() {
+			return errors.New("invalid encrypted private key or passphrase")
+		}
+	}
+	if !c.PrivateKey.IsPlain() && !c.Passphrase.IsPlain() {
+		// already validated
+		return nil
+	}
+	keys, err := c.getPrivateKeys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if recipients.KeysById(key.PrimaryKey.KeyId) != nil {
+			return nil
+		}
+	}
+	return errors.New("the private key does not match any of the public keys")
+}
+
+func (c *PGPFsConfig) getPublicKeys() (openpgp.EntityList, error) {
+	var keys openpgp.EntityList
+	for _, armored := range c.PublicKeys {
+		entities, err := util.ReadPGPPublicKeys(armored)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, entities...)
+	}
+	return keys, nil
+}
+
+// getPrivateKeys returns the decrypted private keys. The secrets are not modified
+func (c *PGPFsConfig) getPrivateKeys() (openpgp.EntityList, error) {
+	privateKey := c.PrivateKey.Clone()
+	if err := privateKey.TryDecrypt(); err != nil {
+		return nil, err
+	}
+	passphrase := c.Passphrase.Clone()
+	if err := passphrase.TryDecrypt(); err != nil {
+		return nil, err
+	}
+	return util.ReadPGPPrivateKeys(privateKey.GetPayload(), passphrase.GetPayload())
+}
+
+type pgpSizeCacheEntry struct {
+	modTime       time.Time
+	encryptedSize int64
+	size          int64
+}
+
+// pgpFs wraps a Fs and PGP encrypts the uploaded files. The files are
+// decrypted on download if a private key is available
+type pgpFs struct {
+	Fs
+	localTempDir string
+	publicKeys   openpgp.EntityList
+	privateKeys  openpgp.EntityList
+	mu           sync.Mutex
+	sizes        map[string]pgpSizeCacheEntry
+}
+
+// NewPGPFs returns a Fs that PGP encrypts the uploaded files if encryption is
+// enabled in the provided configuration, the provided Fs otherwise.
+// The files are decrypted on download if the specified user is allowed
+func NewPGPFs(fs Fs, config PGPFsConfig, username string) (Fs, error) {
+	if !config.IsEnabled() {
+		return fs, nil
+	}
+	publicKeys, err := config.getPublicKeys()
+	if err != nil {
+		return nil, err
+	}
+	pgp := &pgpFs{
+		Fs:           fs,
+		localTempDir: tempPath,
+		publicKeys:   publicKeys,
+	}
+	if config.CanDecrypt(username) {
+		pgp.privateKeys, err = config.getPrivateKeys()
+		if err != nil {
+			return nil, err
+		}
+		pgp.sizes = make(map[string]pgpSizeCacheEntry)
+	}
+	return pgp, nil
+}
+
+// IsPGPFs returns true if fs PGP encrypts the uploaded files
+func IsPGPFs(fs Fs) bool {
+	return fs.Name() == pgpFsName
+}
+
+// Name returns the name for the Fs implementation
+func (*pgpFs) Name() string {
+	return pgpFsName
+}
+
+// Stat returns a FileInfo describing the named file.
+// The decrypted size is returned if the file can be decrypted
+func (fs *pgpFs) Stat(name string) (os.FileInfo, error) {
+	info, err := fs.Fs.Stat(name)
+	if err != nil {
+		return info, err
+	}
+	return fs.convertFileInfo(name, info), nil
+}
+
+// Lstat returns a FileInfo describing the named file.
+// The decrypted size is returned if the file can be decrypted
+func (fs *pgpFs) Lstat(name string) (os.FileInfo, error) {
+	info, err := fs.Fs.Lstat(name)
+	if err != nil {
+		return info, err
+	}
+	return fs.convertFileInfo(name, info), nil
+}
+
+// Open opens the named file for reading. The file is decrypted if a private
+// key is available, the encrypted contents are returned otherwise
+func (fs *pgpFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	if fs.privateKeys == nil {
+		return fs.Fs.Open(name, offset)
+	}
+	src, cancelFn, err := fs.openInner(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		src.Close()
+		cancelFn()
+		return nil, nil, nil, err
+	}
+
+	go func() {
+		var n int64
+		dr, err := util.NewPGPDecryptReader(src, fs.privateKeys)
+		if err == nil {
+			if offset > 0 {
+				_, err = io.CopyN(io.Discard, dr, offset)
+			}
+			if err == nil {
+				n, err = doCopy(w, dr, nil)
+			}
+		}
+		w.CloseWithError(err) //nolint:errcheck
+		src.Close()
+		cancelFn()
+		fsLog(fs, logger.LevelDebug, "decrypted download completed, path: %q size: %v, err: %v", name, n, err)
+	}()
+
+	return nil, r, cancelFn, nil
+}
+
+// Create creates the named file for writing, the written data are PGP encrypted
+func (fs *pgpFs) Create(name string, flag, checks int) (File, *PipeWriter, func(), error) {
+	if flag&os.O_APPEND != 0 {
+		return nil, nil, nil, ErrVfsUnsupported
+	}
+	f, innerWriter, innerCancelFn, err := fs.Fs.Create(name, 0, checks)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var dst io.WriteCloser = f
+	if f == nil {
+		dst = innerWriter
+	}
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		fs.abortUpload(name, dst, f != nil, innerCancelFn, err)
+		return nil, nil, nil, err
+	}
+	p := NewPipeWriter(w)
+	var aborted atomic.Bool
+	cancelFn := func() {
+		aborted.Store(true)
+		if innerCancelFn != nil {
+			innerCancelFn()
+		}
+	}
+
+	go func() {
+		err := util.PGPEncrypt(dst, r, fs.publicKeys, path.Base(name))
+		if err == nil && aborted.Load() {
+			err = errPGPTransferAborted
+		}
+		if err == nil {
+			err = dst.Close()
+		} else {
+			fs.abortUpload(name, dst, f != nil, innerCancelFn, err)
+		}
+		r.CloseWithError(err) //nolint:errcheck
+		p.Done(err)
+		fsLog(fs, logger.LevelDebug, "encrypted upload completed, path: %q, readed bytes: %v, err: %v",
+			name, r.GetReadedBytes(), err)
+	}()
+
+	return nil, p, cancelFn, nil
+}
+
+// Truncate is not supported, the encrypted files cannot be truncated
+func (*pgpFs) Truncate(_ string, _ int64) error {
+	return ErrVfsUnsupported
+}
+
+// IsUploadResumeSupported returns false, the encrypted files cannot be resumed
+func (*pgpFs) IsUploadResumeSupported() bool {
+	return false
+}
+
+// GetMimeType returns the content type. The content type of the decrypted
+// file is returned if a private key is available
+func (fs *pgpFs) GetMimeType(name string) (string, error) {
+	if fs.privateKeys == nil {
+		return "application/pgp-encrypted", nil
+	}
+	src, cancelFn, err := fs.openInner(name)
+	if err != nil {
+		return "", err
+	}
+	defer cancelFn()
+	defer src.Close()
+
+	dr, err := util.NewPGPDecryptReader(src, fs.privateKeys)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(dr, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+func (fs *pgpFs) openInner(name string) (io.ReadCloser, func(), error) {
+	f, r, cancelFn, err := fs.Fs.Open(name, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cancelFn == nil {
+		cancelFn = func() {}
+	}
+	if f != nil {
+		return f, cancelFn, nil
+	}
+	return r, cancelFn, nil
+}
+
+func (fs *pgpFs) abortUpload(name string, dst io.WriteCloser, isFile bool, cancelFn func(), err error) {
+	if cancelFn != nil {
+		cancelFn()
+	}
+	if w, ok := dst.(*PipeWriter); ok {
+		w.writer.CloseWithError(err) //nolint:errcheck
+		<-w.done
+		return
+	}
+	dst.Close()
+	if isFile {
+		if errRemove := fs.Fs.Remove(name, false); errRemove != nil {
+			fsLog(fs, logger.LevelWarn, "unable to remove partial encrypted file %q: %v", name, errRemove)
+		}
+	}
+}
+
+func (fs *pgpFs) convertFileInfo(name string, info os.FileInfo) os.FileInfo {
+	if fs.privateKeys == nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		return info
+	}
+	fs.mu.Lock()
+	entry, ok := fs.sizes[name]
+	fs.mu.Unlock()
+	if ok && entry.encryptedSize == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return NewFileInfo(info.Name(), false, entry.size, info.ModTime(), false)
+	}
+	src, cancelFn, err := fs.openInner(name)
+	if err != nil {
+		return info
+	}
+	defer cancelFn()
+	defer src.Close()
+
+	size, err := util.PGPDecrypt(io.Discard, src, fs.privateKeys)
+	if err != nil {
+		fsLog(fs, logger.LevelDebug, "unable to get the decrypted size for %q: %v", name, err)
+		return info
+	}
+	fs.mu.Lock()
+	if len(fs.sizes) >= pgpSizeCacheMaxEntries {
+		fs.sizes = make(map[string]pgpSizeCacheEntry)
+	}
+	fs.sizes[name] = pgpSizeCacheEntry{
+		modTime:       info.ModTime(),
+		encryptedSize: info.Size(),
+		size:          size,
+	}
+	fs.mu.Unlock()
+	return NewFileInfo(info.Name(), false, size, info.ModTime(), false)
+}
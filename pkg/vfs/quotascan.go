@@ -0,0 +1,213 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vfs
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+)
+
+// QuotaScanProgress is called while scanning a quota with the files and the
+// size found so far
+type QuotaScanProgress func(numFiles int, size int64)
+
+// quotaScanDir stores the contents of a directory as found by the last scan.
+// Only the regular files directly inside the directory are counted
+type quotaScanDir struct {
+	modTime  time.Time
+	numFiles int
+	size     int64
+	subdirs  []string
+}
+
+// quotaScanTree stores the directories found by the last scan of a root
+// directory
+type quotaScanTree struct {
+	sync.Mutex
+	dirs map[string]quotaScanDir
+}
+
+// QuotaScanStates stores the results of the previous quota scans for local
+// filesystems, so the next scans only need to list the directories modified
+// in the meantime
+type QuotaScanStates struct {
+	sync.Mutex
+	trees map[string]*quotaScanTree
+}
+
+// NewQuotaScanStates returns an empty QuotaScanStates
+func NewQuotaScanStates() *QuotaScanStates {
+	return &QuotaScanStates{
+		trees: make(map[string]*quotaScanTree),
+	}
+}
+
+func (s *QuotaScanStates) getTree(rootDir string) *quotaScanTree {
+	s.Lock()
+	defer s.Unlock()
+
+	tree, ok := s.trees[rootDir]
+	if !ok {
+		tree = &quotaScanTree{}
+		s.trees[rootDir] = tree
+	}
+	return tree
+}
+
+// Reset removes the results of the previous scans, the next scans will be full
+func (s *QuotaScanStates) Reset() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.trees = make(map[string]*quotaScanTree)
+}
+
+type quotaScanner struct {
+	fs       *OsFs
+	previous map[string]quotaScanDir
+	current  map[string]quotaScanDir
+	numFiles int
+	size     int64
+	progress QuotaScanProgress
+}
+
+func (s *quotaScanner) scanDir(dirPath string, info os.FileInfo) error {
+	var err error
+	dir, ok := s.previous[dirPath]
+	if !ok || !dir.modTime.Equal(info.ModTime()) {
+		// adding or removing an entry updates the directory modification time,
+		// so the directory contents must be listed again
+		dir, err = s.listDir(dirPath, info.ModTime())
+		if err != nil {
+			return err
+		}
+	}
+	s.current[dirPath] = dir
+	prevFiles := s.numFiles
+	s.numFiles += dir.numFiles
+	s.size += dir.size
+	if s.progress != nil && s.numFiles/1000 > prevFiles/1000 {
+		s.progress(s.numFiles, s.size)
+	}
+	for _, subdir := range dir.subdirs {
+		info, err := os.Lstat(subdir)
+		if err != nil {
+			if s.fs.IsNotExist(err) {
+				// removed after the parent directory was listed
+				continue
+			}
+			return err
+		}
+		if !info.IsDir() {
+			continue
+		}
+		if err := s.scanDir(subdir, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *quotaScanner) listDir(dirPath string, modTime time.Time) (quotaScanDir, error) {
+	dir := quotaScanDir{
+		modTime: modTime,
+	}
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return dir, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dir.subdirs = append(dir.subdirs, filepath.Join(dirPath, entry.Name()))
+			continue
+		}
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if s.fs.IsNotExist(err) {
+				continue
+			}
+			return dir, err
+		}
+		dir.numFiles++
+		dir.size += info.Size()
+	}
+	return dir, nil
+}
+
+// ScanRootDirContentsIncremental returns the number of files contained in the
+// root directory of the specified filesystem and their size.
+// For local filesystems, if states is not nil, only the directories modified
+// since the previous scan are listed. Files modified in place, without adding
+// or removing directory entries, are not detected, a full scan is required
+// to account for them. Other filesystems are always fully scanned and the
+// progress is reported only on completion
+func ScanRootDirContentsIncremental(fs Fs, states *QuotaScanStates, progress QuotaScanProgress) (int, int64, error) {
+	osFs, ok := fs.(*OsFs)
+	if !ok {
+		numFiles, size, err := fs.ScanRootDirContents()
+		if err == nil && progress != nil {
+			progress(numFiles, size)
+		}
+		return numFiles, size, err
+	}
+	scanner := &quotaScanner{
+		fs:       osFs,
+		current:  make(map[string]quotaScanDir),
+		progress: progress,
+	}
+	rootDir := filepath.Clean(osFs.rootDir)
+	var tree *quotaScanTree
+	if states != nil {
+		tree = states.getTree(rootDir)
+		tree.Lock()
+		defer tree.Unlock()
+
+		scanner.previous = tree.dirs
+	}
+	startTime := time.Now()
+	// the root directory can be a symlink
+	info, err := os.Stat(rootDir)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !info.IsDir() {
+		return 0, 0, nil
+	}
+	if err := scanner.scanDir(rootDir, info); err != nil {
+		return scanner.numFiles, scanner.size, err
+	}
+	if tree != nil {
+		reused := 0
+		for dirPath, dir := range scanner.current {
+			if prev, ok := scanner.previous[dirPath]; ok && prev.modTime.Equal(dir.modTime) {
+				reused++
+			}
+		}
+		fsLog(osFs, logger.LevelDebug, "incremental scan for %q completed in %s, dirs: %d, unchanged: %d",
+			rootDir, time.Since(startTime), len(scanner.current), reused)
+		tree.dirs = scanner.current
+	}
+	if progress != nil {
+		progress(scanner.numFiles, scanner.size)
+	}
+	return scanner.numFiles, scanner.size, nil
+}
@@ -0,0 +1,299 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !nos3
+// +build !nos3
+
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	// the part size is doubled every s3AdaptivePartsPerStep parts
+	s3AdaptivePartsPerStep = 1000
+	// maximum part size for adaptive uploads, unless the configured part size is greater
+	s3AdaptiveMaxPartSize = 512 * 1024 * 1024
+	// the part size is increased so that a part is uploaded in about this time
+	s3AdaptiveTargetPartTime = 10 * time.Second
+)
+
+// s3PartSizer computes the part sizes for adaptive multipart uploads
+type s3PartSizer struct {
+	sync.Mutex
+	minPartSize int64
+	maxPartSize int64
+	targetTime  time.Duration
+	// observed throughput, in bytes per second, for a single part upload
+	throughput float64
+	lastSize   int64
+}
+
+func newS3PartSizer(minPartSize int64, partMaxTime int) *s3PartSizer {
+	maxPartSize := int64(s3AdaptiveMaxPartSize)
+	if minPartSize > maxPartSize {
+		maxPartSize = minPartSize
+	}
+	targetTime := s3AdaptiveTargetPartTime
+	if partMaxTime > 0 {
+		// leave a safety margin for the configured max time
+		if maxTime := time.Duration(partMaxTime) * time.Second / 2; maxTime < targetTime {
+			targetTime = maxTime
+		}
+	}
+	return &s3PartSizer{
+		minPartSize: minPartSize,
+		maxPartSize: maxPartSize,
+		targetTime:  targetTime,
+	}
+}
+
+// AddSample updates the observed throughput after a part upload
+func (s *s3PartSizer) AddSample(size int64, elapsed time.Duration) {
+	if elapsed <= 0 {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	sample := float64(size) / elapsed.Seconds()
+	if s.throughput == 0 {
+		s.throughput = sample
+		return
+	}
+	// exponentially weighted moving average
+	s.throughput = 0.7*s.throughput + 0.3*sample
+}
+
+// GetPartSize returns the size for the specified part number. The size never
+// decreases and it is at most doubled from one part to the next one
+func (s *s3PartSizer) GetPartSize(partNumber int32) int64 {
+	s.Lock()
+	defer s.Unlock()
+
+	size := s.minPartSize
+	for step := (partNumber - 1) / s3AdaptivePartsPerStep; step > 0 && size < s.maxPartSize; step-- {
+		size *= 2
+	}
+	if s.throughput > 0 {
+		if target := int64(s.throughput * s.targetTime.Seconds()); target > size {
+			size = target
+		}
+	}
+	if s.lastSize > 0 {
+		if size < s.lastSize {
+			size = s.lastSize
+		}
+		if size > 2*s.lastSize {
+			size = 2 * s.lastSize
+		}
+	}
+	// round up to MB
+	size = (size + 1024*1024 - 1) / (1024 * 1024) * (1024 * 1024)
+	if size > s.maxPartSize {
+		size = s.maxPartSize
+	}
+	if size < s.minPartSize {
+		size = s.minPartSize
+	}
+	s.lastSize = size
+	return size
+}
+
+func (fs *S3Fs) handleAdaptiveUpload(ctx context.Context, reader io.Reader, name, contentType string) error {
+	sizer := newS3PartSizer(fs.config.UploadPartSize, fs.config.UploadPartMaxTime)
+	buf := make([]byte, sizer.GetPartSize(1))
+	n, err := io.ReadFull(reader, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if err != nil {
+		// the whole file fits in a single part
+		_, err = fs.svc.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:        aws.String(fs.config.Bucket),
+			Key:           aws.String(name),
+			Body:          bytes.NewReader(buf[:n]),
+			ContentLength: int64(n),
+			ACL:           types.ObjectCannedACL(fs.config.ACL),
+			StorageClass:  types.StorageClass(fs.config.StorageClass),
+			ContentType:   util.NilIfEmpty(contentType),
+		})
+		return err
+	}
+
+	res, err := fs.svc.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:       aws.String(fs.config.Bucket),
+		Key:          aws.String(name),
+		StorageClass: types.StorageClass(fs.config.StorageClass),
+		ACL:          types.ObjectCannedACL(fs.config.ACL),
+		ContentType:  util.NilIfEmpty(contentType),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create multipart upload request: %w", err)
+	}
+	uploadID := util.GetStringFromPointer(res.UploadId)
+	if uploadID == "" {
+		return errors.New("unable to get multipart upload ID")
+	}
+
+	guard := make(chan struct{}, fs.config.UploadConcurrency)
+	finished := false
+	var completedParts []types.CompletedPart
+	var partMutex sync.Mutex
+	var wg sync.WaitGroup
+	var hasError atomic.Bool
+	var errOnce sync.Once
+	var uploadError error
+
+	poolCtx, poolCancel := context.WithCancel(ctx)
+	defer poolCancel()
+
+	setError := func(err error) {
+		errOnce.Do(func() {
+			fsLog(fs, logger.LevelError, "adaptive multipart upload error: %+v", err)
+			hasError.Store(true)
+			uploadError = err
+			poolCancel()
+		})
+	}
+
+	for partNumber := int32(1); !finished; partNumber++ {
+		if partNumber > 1 {
+			buf = make([]byte, sizer.GetPartSize(partNumber))
+			n, err = io.ReadFull(reader, buf)
+		}
+		if err != nil {
+			if !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+				setError(fmt.Errorf("unable to read part number %d: %w", partNumber, err))
+				break
+			}
+			finished = true
+			if n == 0 {
+				break
+			}
+		}
+		if partNumber > manager.MaxUploadParts {
+			setError(fmt.Errorf("exceeded the maximum number of parts: %d", manager.MaxUploadParts))
+			break
+		}
+
+		guard <- struct{}{}
+		if hasError.Load() {
+			fsLog(fs, logger.LevelDebug, "previous multipart upload error, upload for part %d not started", partNumber)
+			break
+		}
+
+		wg.Add(1)
+		go func(partNum int32, data []byte) {
+			defer func() {
+				<-guard
+				wg.Done()
+			}()
+
+			innerCtx, innerCancelFn := context.WithDeadline(poolCtx, time.Now().Add(fs.getPartUploadTimeout(int64(len(data)))))
+			defer innerCancelFn()
+
+			startTime := time.Now()
+			partResp, err := fs.svc.UploadPart(innerCtx, &s3.UploadPartInput{
+				Bucket:        aws.String(fs.config.Bucket),
+				Key:           aws.String(name),
+				PartNumber:    partNum,
+				UploadId:      aws.String(uploadID),
+				Body:          bytes.NewReader(data),
+				ContentLength: int64(len(data)),
+			})
+			if err != nil {
+				setError(fmt.Errorf("error uploading part number %d: %w", partNum, err))
+				return
+			}
+			sizer.AddSample(int64(len(data)), time.Since(startTime))
+
+			partMutex.Lock()
+			completedParts = append(completedParts, types.CompletedPart{
+				ETag:       partResp.ETag,
+				PartNumber: partNum,
+			})
+			partMutex.Unlock()
+		}(partNumber, buf[:n])
+	}
+
+	wg.Wait()
+	close(guard)
+
+	if uploadError != nil {
+		fs.abortMultipartUpload(name, uploadID)
+		return uploadError
+	}
+	sort.Slice(completedParts, func(i, j int) bool {
+		return completedParts[i].PartNumber < completedParts[j].PartNumber
+	})
+	fsLog(fs, logger.LevelDebug, "adaptive multipart upload for %q, parts: %d, last part size: %d",
+		name, len(completedParts), sizer.lastSize)
+
+	_, err = fs.svc.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(fs.config.Bucket),
+		Key:      aws.String(name),
+		UploadId: aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{
+			Parts: completedParts,
+		},
+	})
+	if err != nil {
+		fs.abortMultipartUpload(name, uploadID)
+		return fmt.Errorf("unable to complete multipart upload: %w", err)
+	}
+	return nil
+}
+
+func (fs *S3Fs) getPartUploadTimeout(partSize int64) time.Duration {
+	if fs.config.UploadPartMaxTime > 0 {
+		return time.Duration(fs.config.UploadPartMaxTime) * time.Second
+	}
+	timeout := time.Duration(partSize/(1024*1024)) * time.Minute
+	if timeout < fs.ctxTimeout {
+		return fs.ctxTimeout
+	}
+	return timeout
+}
+
+func (fs *S3Fs) abortMultipartUpload(name, uploadID string) {
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	_, err := fs.svc.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(fs.config.Bucket),
+		Key:      aws.String(name),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		fsLog(fs, logger.LevelError, "unable to abort multipart upload: %+v", err)
+	}
+}
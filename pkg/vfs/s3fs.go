@@ -50,6 +50,7 @@ import (
 	"github.com/drakkan/sftpgo/v2/pkg/metric"
 	"github.com/drakkan/sftpgo/v2/pkg/plugin"
 	"github.com/drakkan/sftpgo/v2/pkg/util"
+	"github.com/drakkan/sftpgo/v2/pkg/vault"
 	"github.com/drakkan/sftpgo/v2/pkg/version"
 )
 
@@ -57,6 +58,8 @@ const (
 	// using this mime type for directories improves compatibility with s3fs-fuse
 	s3DirMimeType        = "application/x-directory"
 	s3TransferBufferSize = 256 * 1024
+	// maximum number of keys allowed in a single DeleteObjects request
+	s3DeleteObjectsMaxKeys = 1000
 )
 
 var (
@@ -115,6 +118,9 @@ func NewS3Fs(connectionID, localTempDir, mountPath string, s3Config S3FsConfig)
 		awsConfig.Credentials = aws.NewCredentialsCache(
 			credentials.NewStaticCredentialsProvider(fs.config.AccessKey, fs.config.AccessSecret.GetPayload(), ""))
 	}
+	if fs.config.VaultCredentialsPath != "" {
+		awsConfig.Credentials = getVaultAWSCredentials(fs.config.VaultCredentialsPath)
+	}
 	fs.setConfigDefaults()
 
 	if fs.config.RoleARN != "" {
@@ -124,11 +130,13 @@ func NewS3Fs(connectionID, localTempDir, mountPath string, s3Config S3FsConfig)
 	}
 	fs.svc = s3.NewFromConfig(awsConfig, func(o *s3.Options) {
 		o.UsePathStyle = fs.config.ForcePathStyle
+		o.UseAccelerate = fs.config.UseAccelerateEndpoint
 		if fs.config.Endpoint != "" {
 			o.BaseEndpoint = aws.String(fs.config.Endpoint)
 		}
 	})
-	return fs, nil
+	return newObjectStorageFs(fs, fmt.Sprintf("%s|%s|%s|%s", s3fsName, fs.config.Endpoint, fs.config.Region,
+		fs.config.Bucket)), nil
 }
 
 // Name returns the name for the Fs implementation
@@ -264,14 +272,19 @@ func (fs *S3Fs) Create(name string, flag, checks int) (File, *PipeWriter, func()
 		} else {
 			contentType = mime.TypeByExtension(path.Ext(name))
 		}
-		_, err := uploader.Upload(ctx, &s3.PutObjectInput{
-			Bucket:       aws.String(fs.config.Bucket),
-			Key:          aws.String(name),
-			Body:         r,
-			ACL:          types.ObjectCannedACL(fs.config.ACL),
-			StorageClass: types.StorageClass(fs.config.StorageClass),
-			ContentType:  util.NilIfEmpty(contentType),
-		})
+		var err error
+		if fs.config.AdaptiveUploadPartSize {
+			err = fs.handleAdaptiveUpload(ctx, r, name, contentType)
+		} else {
+			_, err = uploader.Upload(ctx, &s3.PutObjectInput{
+				Bucket:       aws.String(fs.config.Bucket),
+				Key:          aws.String(name),
+				Body:         r,
+				ACL:          types.ObjectCannedACL(fs.config.ACL),
+				StorageClass: types.StorageClass(fs.config.StorageClass),
+				ContentType:  util.NilIfEmpty(contentType),
+			})
+		}
 		r.CloseWithError(err) //nolint:errcheck
 		p.Done(err)
 		fsLog(fs, logger.LevelDebug, "upload completed, path: %q, acl: %q, readed bytes: %v, err: %+v",
@@ -327,6 +340,55 @@ func (fs *S3Fs) Remove(name string, isDir bool) error {
 	return err
 }
 
+// RemoveFiles removes the named files using batch requests, up to 1000 objects
+// can be removed with a single request
+func (fs *S3Fs) RemoveFiles(names []string) error {
+	for len(names) > 0 {
+		batchSize := len(names)
+		if batchSize > s3DeleteObjectsMaxKeys {
+			batchSize = s3DeleteObjectsMaxKeys
+		}
+		if err := fs.removeFilesBatch(names[:batchSize]); err != nil {
+			return err
+		}
+		names = names[batchSize:]
+	}
+	return nil
+}
+
+func (fs *S3Fs) removeFilesBatch(names []string) error {
+	objects := make([]types.ObjectIdentifier, 0, len(names))
+	for _, name := range names {
+		objects = append(objects, types.ObjectIdentifier{Key: aws.String(name)})
+	}
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	res, err := fs.svc.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String(fs.config.Bucket),
+		Delete: &types.Delete{
+			Objects: objects,
+			Quiet:   true,
+		},
+	})
+	if err == nil && len(res.Errors) > 0 {
+		err = fmt.Errorf("unable to remove %d objects, first error for key %q: %s",
+			len(res.Errors), util.GetStringFromPointer(res.Errors[0].Key), util.GetStringFromPointer(res.Errors[0].Message))
+	}
+	metric.S3DeleteObjectCompleted(err)
+	if err != nil {
+		return err
+	}
+	if plugin.Handler.HasMetadater() {
+		for _, name := range names {
+			if errMetadata := plugin.Handler.RemoveMetadata(fs.getStorageID(), ensureAbsPath(name)); errMetadata != nil {
+				fsLog(fs, logger.LevelWarn, "unable to remove metadata for path %q: %+v", name, errMetadata)
+			}
+		}
+	}
+	return nil
+}
+
 // Mkdir creates a new directory with the specified name and default permissions
 func (fs *S3Fs) Mkdir(name string) error {
 	_, err := fs.Stat(name)
@@ -384,65 +446,36 @@ func (*S3Fs) Truncate(_ string, _ int64) error {
 // ReadDir reads the directory named by dirname and returns
 // a list of directory entries.
 func (fs *S3Fs) ReadDir(dirname string) ([]os.FileInfo, error) {
-	var result []os.FileInfo
+	lister, err := fs.ListDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	return ReadAllFromDirLister(lister)
+}
+
+// ListDir implements the FsDirLister interface.
+// The objects are listed a page at a time while the entries are requested
+func (fs *S3Fs) ListDir(dirname string) (DirLister, error) {
 	// dirname must be already cleaned
 	prefix := fs.getPrefix(dirname)
 
 	modTimes, err := getFolderModTimes(fs.getStorageID(), dirname)
 	if err != nil {
-		return result, err
+		return nil, err
 	}
-	prefixes := make(map[string]bool)
-
 	paginator := s3.NewListObjectsV2Paginator(fs.svc, &s3.ListObjectsV2Input{
 		Bucket:    aws.String(fs.config.Bucket),
 		Prefix:    aws.String(prefix),
 		Delimiter: aws.String("/"),
 	})
 
-	for paginator.HasMorePages() {
-		ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
-		defer cancelFn()
-
-		page, err := paginator.NextPage(ctx)
-		if err != nil {
-			metric.S3ListObjectsCompleted(err)
-			return result, err
-		}
-		for _, p := range page.CommonPrefixes {
-			// prefixes have a trailing slash
-			name, _ := fs.resolve(p.Prefix, prefix)
-			if name == "" {
-				continue
-			}
-			if _, ok := prefixes[name]; ok {
-				continue
-			}
-			result = append(result, NewFileInfo(name, true, 0, time.Unix(0, 0), false))
-			prefixes[name] = true
-		}
-		for _, fileObject := range page.Contents {
-			objectModTime := util.GetTimeFromPointer(fileObject.LastModified)
-			name, isDir := fs.resolve(fileObject.Key, prefix)
-			if name == "" || name == "/" {
-				continue
-			}
-			if isDir {
-				if _, ok := prefixes[name]; ok {
-					continue
-				}
-				prefixes[name] = true
-			}
-			if t, ok := modTimes[name]; ok {
-				objectModTime = util.GetTimeFromMsecSinceEpoch(t)
-			}
-			result = append(result, NewFileInfo(name, (isDir && fileObject.Size == 0), fileObject.Size,
-				objectModTime, false))
-		}
-	}
-
-	metric.S3ListObjectsCompleted(nil)
-	return result, nil
+	return &s3DirLister{
+		fs:        fs,
+		paginator: paginator,
+		prefix:    prefix,
+		modTimes:  modTimes,
+		prefixes:  make(map[string]bool),
+	}, nil
 }
 
 // IsUploadResumeSupported returns true if resuming uploads is supported.
@@ -1027,6 +1060,63 @@ func (fs *S3Fs) getStorageID() string {
 	return fmt.Sprintf("s3://%v", fs.config.Bucket)
 }
 
+// vaultAWSCredentials caches the credentials providers for the Vault AWS
+// secrets engine roles, so the short-lived credentials are shared among
+// the connections
+var vaultAWSCredentials = struct {
+	sync.Mutex
+	providers map[string]aws.CredentialsProvider
+}{
+	providers: make(map[string]aws.CredentialsProvider),
+}
+
+func getVaultAWSCredentials(credsPath string) aws.CredentialsProvider {
+	vaultAWSCredentials.Lock()
+	defer vaultAWSCredentials.Unlock()
+
+	if p, ok := vaultAWSCredentials.providers[credsPath]; ok {
+		return p
+	}
+	p := aws.NewCredentialsCache(&vaultAWSCredentialsProvider{path: credsPath})
+	vaultAWSCredentials.providers[credsPath] = p
+	return p
+}
+
+// vaultAWSCredentialsProvider retrieves AWS credentials from a Vault AWS
+// secrets engine role
+type vaultAWSCredentialsProvider struct {
+	path string
+}
+
+func (p *vaultAWSCredentialsProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	client, err := vault.NewClientFromEnv()
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	secret, err := client.Read(ctx, p.path)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	creds := aws.Credentials{
+		AccessKeyID:     secret.GetString("access_key"),
+		SecretAccessKey: secret.GetString("secret_key"),
+		SessionToken:    secret.GetString("security_token"),
+		Source:          "Vault",
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return aws.Credentials{}, fmt.Errorf("no AWS credentials returned from vault path %q", p.path)
+	}
+	if secret.LeaseDuration > 0 {
+		lease := time.Duration(secret.LeaseDuration) * time.Second
+		creds.CanExpire = true
+		// refresh the credentials when 80% of the lease duration has elapsed
+		creds.Expires = time.Now().Add(lease - lease/5)
+	}
+	logger.Debug(s3fsName, "", "AWS credentials retrieved from vault path %q, lease duration: %d seconds",
+		p.path, secret.LeaseDuration)
+	return creds, nil
+}
+
 func getAWSHTTPClient(timeout int, idleConnectionTimeout time.Duration) *awshttp.BuildableClient {
 	c := awshttp.NewBuildableClient().
 		WithDialerOptions(func(d *net.Dialer) {
@@ -1053,3 +1143,83 @@ func pathEscape(in string) string {
 	u.Path = in
 	return strings.ReplaceAll(u.String(), "+", "%2B")
 }
+
+type s3DirLister struct {
+	baseDirLister
+	fs            *S3Fs
+	paginator     *s3.ListObjectsV2Paginator
+	prefix        string
+	modTimes      map[string]int64
+	prefixes      map[string]bool
+	metricUpdated bool
+}
+
+func (l *s3DirLister) resolve(name *string) (string, bool) {
+	return l.fs.resolve(name, l.prefix)
+}
+
+// Next implements the DirLister interface
+func (l *s3DirLister) Next(limit int) ([]os.FileInfo, error) {
+	limit = getListerLimit(limit)
+	for len(l.cache) < limit && l.paginator.HasMorePages() {
+		if err := l.fetchPage(); err != nil {
+			return nil, err
+		}
+	}
+	if !l.paginator.HasMorePages() && !l.metricUpdated {
+		l.metricUpdated = true
+		metric.S3ListObjectsCompleted(nil)
+	}
+	return l.returnFromCache(limit)
+}
+
+func (l *s3DirLister) fetchPage() error {
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(l.fs.ctxTimeout))
+	defer cancelFn()
+
+	page, err := l.paginator.NextPage(ctx)
+	if err != nil {
+		if !l.metricUpdated {
+			l.metricUpdated = true
+			metric.S3ListObjectsCompleted(err)
+		}
+		return err
+	}
+	for _, p := range page.CommonPrefixes {
+		// prefixes have a trailing slash
+		name, _ := l.resolve(p.Prefix)
+		if name == "" {
+			continue
+		}
+		if _, ok := l.prefixes[name]; ok {
+			continue
+		}
+		l.cache = append(l.cache, NewFileInfo(name, true, 0, time.Unix(0, 0), false))
+		l.prefixes[name] = true
+	}
+	for _, fileObject := range page.Contents {
+		objectModTime := util.GetTimeFromPointer(fileObject.LastModified)
+		name, isDir := l.resolve(fileObject.Key)
+		if name == "" || name == "/" {
+			continue
+		}
+		if isDir {
+			if _, ok := l.prefixes[name]; ok {
+				continue
+			}
+			l.prefixes[name] = true
+		}
+		if t, ok := l.modTimes[name]; ok {
+			objectModTime = util.GetTimeFromMsecSinceEpoch(t)
+		}
+		l.cache = append(l.cache, NewFileInfo(name, (isDir && fileObject.Size == 0), fileObject.Size,
+			objectModTime, false))
+	}
+	return nil
+}
+
+// Close implements the DirLister interface
+func (l *s3DirLister) Close() error {
+	l.prefixes = nil
+	return l.baseDirLister.Close()
+}
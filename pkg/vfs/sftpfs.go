@@ -34,6 +34,7 @@ import (
 	"time"
 
 	"github.com/eikenb/pipeat"
+	"github.com/pires/go-proxyproto"
 	"github.com/pkg/sftp"
 	"github.com/robfig/cron/v3"
 	"github.com/rs/xid"
@@ -42,23 +43,126 @@ import (
 
 	"github.com/drakkan/sftpgo/v2/pkg/kms"
 	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/metric"
 	"github.com/drakkan/sftpgo/v2/pkg/util"
 	"github.com/drakkan/sftpgo/v2/pkg/version"
 )
 
 const (
 	// sftpFsName is the name for the SFTP Fs implementation
-	sftpFsName               = "sftpfs"
-	logSenderSFTPCache       = "sftpCache"
-	maxSessionsPerConnection = 5
+	sftpFsName         = "sftpfs"
+	logSenderSFTPCache = "sftpCache"
 )
 
 var (
 	// ErrSFTPLoop defines the error to return if an SFTP loop is detected
 	ErrSFTPLoop    = errors.New("SFTP loop or nested local SFTP folders detected")
 	sftpConnsCache = newSFTPConnectionCache()
+	sftpPool       = SFTPPoolConfig{
+		MaxSessionsPerConnection: 5,
+		MaxConnections:           0,
+		HealthCheckInterval:      30,
+		IdleTimeout:              30,
+		MaxBackoff:               60,
+	}
 )
 
+// SFTPPoolConfig defines the configuration for the pool of connections
+// to the upstream SFTP servers used by the SFTP storage backend.
+// Connections are shared between SFTPGo sessions using the same
+// backend configuration.
+type SFTPPoolConfig struct {
+	// Maximum number of SFTPGo sessions multiplexed on a single upstream connection
+	MaxSessionsPerConnection int `json:"max_sessions_per_connection" mapstructure:"max_sessions_per_connection"`
+	// Maximum number of upstream connections for each backend configuration, for
+	// example for each user. When the limit is reached new sessions share the
+	// least loaded connection. 0 means no limit
+	MaxConnections int `json:"max_connections" mapstructure:"max_connections"`
+	// Interval, in seconds, between the health checks for each upstream connection.
+	// Connections that fail a health check are closed and reopened on next use
+	HealthCheckInterval int `json:"health_check_interval" mapstructure:"health_check_interval"`
+	// Time, in seconds, after which an upstream connection without sessions is closed
+	IdleTimeout int `json:"idle_timeout" mapstructure:"idle_timeout"`
+	// Maximum delay, in seconds, between reconnection attempts. After a failed
+	// connection attempt the delay starts at 1 second and doubles on each failure
+	MaxBackoff int `json:"max_backoff" mapstructure:"max_backoff"`
+	// ProxyProtocol defines the PROXY protocol version to use to propagate the
+	// IP address of the SFTPGo clients to the upstream SFTP servers.
+	// Supported values:
+	// - 0 disabled
+	// - 1 PROXY protocol v1
+	// - 2 PROXY protocol v2
+	// If enabled, upstream connections are shared only between sessions from
+	// the same client IP
+	ProxyProtocol int `json:"proxy_protocol" mapstructure:"proxy_protocol"`
+}
+
+// Validate returns an error if the configuration is not valid.
+// Zero values are replaced with the defaults
+func (c *SFTPPoolConfig) Validate() error {
+	if c.MaxSessionsPerConnection == 0 {
+		c.MaxSessionsPerConnection = 5
+	}
+	if c.HealthCheckInterval == 0 {
+		c.HealthCheckInterval = 30
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = 30
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = 60
+	}
+	if c.MaxSessionsPerConnection < 0 {
+		return fmt.Errorf("invalid SFTP pool max sessions per connection: %d", c.MaxSessionsPerConnection)
+	}
+	if c.MaxConnections < 0 {
+		return fmt.Errorf("invalid SFTP pool max connections: %d", c.MaxConnections)
+	}
+	if c.HealthCheckInterval < 5 {
+		return fmt.Errorf("invalid SFTP pool health check interval: %d, minimum is 5 seconds", c.HealthCheckInterval)
+	}
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("invalid SFTP pool idle timeout: %d", c.IdleTimeout)
+	}
+	if c.MaxBackoff < 0 {
+		return fmt.Errorf("invalid SFTP pool max backoff: %d", c.MaxBackoff)
+	}
+	if c.ProxyProtocol < 0 || c.ProxyProtocol > 2 {
+		return fmt.Errorf("invalid SFTP pool proxy protocol: %d", c.ProxyProtocol)
+	}
+	return nil
+}
+
+// SFTPPoolStatus defines the status of the SFTP connections pool
+type SFTPPoolStatus struct {
+	// Number of upstream connections in the pool
+	Connections int `json:"connections"`
+	// Number of SFTPGo sessions sharing the upstream connections
+	Sessions                 int `json:"sessions"`
+	MaxSessionsPerConnection int `json:"max_sessions_per_connection"`
+	MaxConnections           int `json:"max_connections"`
+}
+
+// GetSFTPPoolStatus returns the status of the SFTP connections pool
+func GetSFTPPoolStatus() SFTPPoolStatus {
+	sftpConnsCache.RLock()
+	defer sftpConnsCache.RUnlock()
+
+	connections, sessions := sftpConnsCache.getStatsNoLock()
+	return SFTPPoolStatus{
+		Connections:              connections,
+		Sessions:                 sessions,
+		MaxSessionsPerConnection: sftpPool.MaxSessionsPerConnection,
+		MaxConnections:           sftpPool.MaxConnections,
+	}
+}
+
+// SetSFTPPoolConfig sets the configuration for the SFTP connections pool.
+// The configuration must be validated before calling this method
+func SetSFTPPoolConfig(config SFTPPoolConfig) {
+	sftpPool = config
+}
+
 // SFTPFsConfig defines the configuration for SFTP based filesystem
 type SFTPFsConfig struct {
 	sdk.BaseSFTPFsConfig
@@ -66,6 +170,13 @@ type SFTPFsConfig struct {
 	PrivateKey             *kms.Secret `json:"private_key,omitempty"`
 	KeyPassphrase          *kms.Secret `json:"key_passphrase,omitempty"`
 	forbiddenSelfUsernames []string    `json:"-"`
+	clientIP               string
+}
+
+// SetClientIP sets the IP address of the SFTPGo client to propagate to the
+// upstream SFTP server, if the PROXY protocol is enabled. It is not persisted
+func (c *SFTPFsConfig) SetClientIP(ip string) {
+	c.clientIP = ip
 }
 
 // HideConfidentialData hides confidential data
@@ -249,6 +360,9 @@ func (c *SFTPFsConfig) getUniqueID(partition int) uint64 {
 	if allowSelfConnections != 0 {
 		b.WriteString(strings.Join(c.forbiddenSelfUsernames, ""))
 	}
+	if sftpPool.ProxyProtocol > 0 {
+		b.WriteString(c.clientIP)
+	}
 	b.WriteString(strconv.Itoa(partition))
 
 	h.Write(b.Bytes())
@@ -319,20 +433,24 @@ func (fs *SFTPFs) ConnectionID() string {
 
 // Stat returns a FileInfo describing the named file
 func (fs *SFTPFs) Stat(name string) (os.FileInfo, error) {
-	client, err := fs.conn.getClient()
-	if err != nil {
-		return nil, err
-	}
-	return client.Stat(name)
+	var info os.FileInfo
+	err := fs.withClient(func(client *sftp.Client) error {
+		var err error
+		info, err = client.Stat(name)
+		return err
+	})
+	return info, err
 }
 
 // Lstat returns a FileInfo describing the named file
 func (fs *SFTPFs) Lstat(name string) (os.FileInfo, error) {
-	client, err := fs.conn.getClient()
-	if err != nil {
-		return nil, err
-	}
-	return client.Lstat(name)
+	var info os.FileInfo
+	err := fs.withClient(func(client *sftp.Client) error {
+		var err error
+		info, err = client.Lstat(name)
+		return err
+	})
+	return info, err
 }
 
 // Open opens the named file for reading
@@ -530,11 +648,13 @@ func (fs *SFTPFs) Truncate(name string, size int64) error {
 // ReadDir reads the directory named by dirname and returns
 // a list of directory entries.
 func (fs *SFTPFs) ReadDir(dirname string) ([]os.FileInfo, error) {
-	client, err := fs.conn.getClient()
-	if err != nil {
-		return nil, err
-	}
-	return client.ReadDir(dirname)
+	var entries []os.FileInfo
+	err := fs.withClient(func(client *sftp.Client) error {
+		var err error
+		entries, err = client.ReadDir(dirname)
+		return err
+	})
+	return entries, err
 }
 
 // IsUploadResumeSupported returns true if resuming uploads is supported.
@@ -838,6 +958,7 @@ func (fs *SFTPFs) GetAvailableDiskSize(dirName string) (*sftp.StatVFS, error) {
 // Close the connection
 func (fs *SFTPFs) Close() error {
 	fs.conn.RemoveSession(fs.connectionID)
+	sftpConnsCache.updateMetrics()
 	return nil
 }
 
@@ -850,6 +971,27 @@ func (fs *SFTPFs) createConnection() error {
 	return nil
 }
 
+// withClient executes the given read only operation. If the upstream
+// connection was lost, for example because it was stale, the operation
+// is retried once on a new connection
+func (fs *SFTPFs) withClient(fn func(client *sftp.Client) error) error {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return err
+	}
+	err = fn(client)
+	if !errors.Is(err, sftp.ErrSSHFxConnectionLost) {
+		return err
+	}
+	fsLog(fs, logger.LevelDebug, "connection lost, retrying on a new connection")
+	fs.conn.setDisconnected(client)
+	client, err = fs.conn.getClient()
+	if err != nil {
+		return err
+	}
+	return fn(client)
+}
+
 type sftpConnection struct {
 	config       *SFTPFsConfig
 	logSender    string
@@ -859,6 +1001,11 @@ type sftpConnection struct {
 	isConnected  bool
 	sessions     map[string]bool
 	lastActivity time.Time
+	// consecutive failed connection attempts and the time before which
+	// a new attempt is not allowed
+	failures  int
+	lastError error
+	nextRetry time.Time
 }
 
 func newSFTPConnection(config *SFTPFsConfig, sessionID string) *sftpConnection {
@@ -885,7 +1032,24 @@ func (c *sftpConnection) openConnNoLock() error {
 		logger.Debug(c.logSender, "", "reusing connection")
 		return nil
 	}
+	if c.failures > 0 && time.Now().Before(c.nextRetry) {
+		logger.Debug(c.logSender, "", "reconnection delayed until %s, failed attempts: %d", c.nextRetry, c.failures)
+		return c.lastError
+	}
+	err := c.dialNoLock()
+	if err != nil {
+		metric.AddSFTPFsPoolConnectError()
+		c.failures++
+		c.lastError = err
+		c.nextRetry = time.Now().Add(getSFTPBackoff(c.failures))
+		return err
+	}
+	c.failures = 0
+	c.lastError = nil
+	return nil
+}
 
+func (c *sftpConnection) dialNoLock() error {
 	logger.Debug(c.logSender, "", "try to open a new connection")
 	clientConfig := &ssh.ClientConfig{
 		User: c.config.Username,
@@ -945,7 +1109,7 @@ func (c *sftpConnection) openConnNoLock() error {
 	clientConfig.MACs = []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256",
 		"hmac-sha2-512-etm@openssh.com", "hmac-sha2-512",
 		"hmac-sha1", "hmac-sha1-96"}
-	sshClient, err := ssh.Dial("tcp", c.config.Endpoint, clientConfig)
+	sshClient, err := c.dialSSH(clientConfig)
 	if err != nil {
 		return fmt.Errorf("sftpfs: unable to connect: %w", err)
 	}
@@ -957,10 +1121,61 @@ func (c *sftpConnection) openConnNoLock() error {
 	c.sshClient = sshClient
 	c.sftpClient = sftpClient
 	c.isConnected = true
-	go c.Wait()
+	go c.Wait(sshClient, sftpClient)
 	return nil
 }
 
+// dialSSH opens the SSH connection to the upstream server. If enabled, the
+// PROXY protocol header with the client IP is sent before the SSH handshake
+func (c *sftpConnection) dialSSH(clientConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	if sftpPool.ProxyProtocol == 0 {
+		return ssh.Dial("tcp", c.config.Endpoint, clientConfig)
+	}
+	conn, err := net.DialTimeout("tcp", c.config.Endpoint, clientConfig.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	header := getProxyProtocolHeader(byte(sftpPool.ProxyProtocol), c.config.clientIP, conn.RemoteAddr())
+	if _, err := header.WriteTo(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to write the PROXY protocol header: %w", err)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, c.config.Endpoint, clientConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// getProxyProtocolHeader returns the PROXY protocol header for the specified
+// client IP. If the client IP is unknown, for example for connections not
+// related to an SFTPGo client, a LOCAL header is returned
+func getProxyProtocolHeader(version byte, clientIP string, remoteAddr net.Addr) *proxyproto.Header {
+	var sourceAddr net.Addr
+	if ip := net.ParseIP(clientIP); ip != nil {
+		// the source and destination addresses must have the same family
+		if dest, ok := remoteAddr.(*net.TCPAddr); ok && (ip.To4() == nil) == (dest.IP.To4() == nil) {
+			sourceAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	return proxyproto.HeaderProxyFromAddrs(version, sourceAddr, remoteAddr)
+}
+
+// getSFTPBackoff returns the delay before the next connection attempt after
+// the specified number of consecutive failures
+func getSFTPBackoff(failures int) time.Duration {
+	maxBackoff := time.Duration(sftpPool.MaxBackoff) * time.Second
+	if failures > 30 {
+		return maxBackoff
+	}
+	backoff := time.Duration(1<<(failures-1)) * time.Second
+	if backoff > maxBackoff {
+		return maxBackoff
+	}
+	return backoff
+}
+
 func (c *sftpConnection) getClientOptions() []sftp.ClientOption {
 	var options []sftp.ClientOption
 	if c.config.DisableCouncurrentReads {
@@ -982,15 +1197,34 @@ func (c *sftpConnection) getClient() (*sftp.Client, error) {
 		return c.sftpClient, nil
 	}
 	err := c.openConnNoLock()
-	return c.sftpClient, err
+	if err != nil {
+		return nil, err
+	}
+	return c.sftpClient, nil
 }
 
-func (c *sftpConnection) Wait() {
+// setDisconnected marks the connection as disconnected, if the given client is
+// still the active one, so that the next request opens a new connection
+func (c *sftpConnection) setDisconnected(client *sftp.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sftpClient != client || !c.isConnected {
+		return
+	}
+	logger.Debug(c.logSender, "", "closing broken connection")
+	c.isConnected = false
+	if c.sshClient != nil {
+		c.sshClient.Close()
+	}
+}
+
+func (c *sftpConnection) Wait(sshClient *ssh.Client, sftpClient *sftp.Client) {
 	done := make(chan struct{})
 
 	go func() {
 		var watchdogInProgress atomic.Bool
-		ticker := time.NewTicker(30 * time.Second)
+		ticker := time.NewTicker(time.Duration(sftpPool.HealthCheckInterval) * time.Second)
 		defer ticker.Stop()
 
 		for {
@@ -998,16 +1232,18 @@ func (c *sftpConnection) Wait() {
 			case <-ticker.C:
 				if watchdogInProgress.Load() {
 					logger.Error(c.logSender, "", "watchdog still in progress, closing hanging connection")
-					c.sshClient.Close()
+					sshClient.Close()
 					return
 				}
 				go func() {
 					watchdogInProgress.Store(true)
 					defer watchdogInProgress.Store(false)
 
-					_, err := c.sftpClient.Getwd()
+					_, err := sftpClient.Getwd()
 					if err != nil {
-						logger.Error(c.logSender, "", "watchdog error: %v", err)
+						metric.AddSFTPFsPoolHealthCheckError()
+						logger.Error(c.logSender, "", "watchdog error: %v, closing stale connection", err)
+						sshClient.Close()
 					}
 				}()
 			case <-done:
@@ -1019,16 +1255,17 @@ func (c *sftpConnection) Wait() {
 
 	// we wait on the sftp client otherwise if the channel is closed but not the connection
 	// we don't detect the event.
-	err := c.sftpClient.Wait()
+	err := sftpClient.Wait()
 	logger.Log(logger.LevelDebug, c.logSender, "", "sftp channel closed: %v", err)
 	close(done)
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.isConnected = false
-	if c.sshClient != nil {
-		c.sshClient.Close()
+	sshClient.Close()
+	// a new connection could be already established
+	if c.sftpClient == sftpClient {
+		c.isConnected = false
 	}
 }
 
@@ -1106,30 +1343,16 @@ func newSFTPConnectionCache() *sftpConnectionsCache {
 }
 
 func (c *sftpConnectionsCache) Get(config *SFTPFsConfig, sessionID string) *sftpConnection {
-	partition := 0
-	key := config.getUniqueID(partition)
-
 	c.Lock()
 	defer c.Unlock()
-
-	var oldKey uint64
-	for {
-		if val, ok := c.items[key]; ok {
-			activeSessions := val.ActiveSessions()
-			if activeSessions < maxSessionsPerConnection || key == oldKey {
-				logger.Debug(logSenderSFTPCache, "",
-					"reusing connection for session ID %q, key: %d, active sessions %d, active connections: %d",
-					sessionID, key, activeSessions+1, len(c.items))
-				val.AddSession(sessionID)
-				return val
-			}
-			partition++
-			oldKey = key
-			key = config.getUniqueID(partition)
-			logger.Debug(logSenderSFTPCache, "",
-				"connection full, generated new key for partition: %d, active sessions: %d, key: %d, old key: %d",
-				partition, activeSessions, oldKey, key)
-		} else {
+	defer c.updateMetricsNoLock()
+
+	var leastLoaded *sftpConnection
+	minSessions := 0
+	for partition := 0; sftpPool.MaxConnections == 0 || partition < sftpPool.MaxConnections; partition++ {
+		key := config.getUniqueID(partition)
+		val, ok := c.items[key]
+		if !ok {
 			conn := newSFTPConnection(config, sessionID)
 			c.items[key] = conn
 			logger.Debug(logSenderSFTPCache, "",
@@ -1137,7 +1360,46 @@ func (c *sftpConnectionsCache) Get(config *SFTPFsConfig, sessionID string) *sftp
 				sessionID, partition, key, len(c.items))
 			return conn
 		}
+		activeSessions := val.ActiveSessions()
+		if activeSessions < sftpPool.MaxSessionsPerConnection {
+			logger.Debug(logSenderSFTPCache, "",
+				"reusing connection for session ID %q, key: %d, active sessions %d, active connections: %d",
+				sessionID, key, activeSessions+1, len(c.items))
+			val.AddSession(sessionID)
+			return val
+		}
+		if leastLoaded == nil || activeSessions < minSessions {
+			leastLoaded = val
+			minSessions = activeSessions
+		}
+		logger.Debug(logSenderSFTPCache, "", "connection full for partition: %d, active sessions: %d, key: %d",
+			partition, activeSessions, key)
+	}
+	// the maximum number of connections is reached, share the least loaded one
+	logger.Debug(logSenderSFTPCache, "",
+		"max connections reached, sharing connection for session ID %q, active sessions %d",
+		sessionID, minSessions+1)
+	leastLoaded.AddSession(sessionID)
+	return leastLoaded
+}
+
+func (c *sftpConnectionsCache) getStatsNoLock() (int, int) {
+	sessions := 0
+	for _, conn := range c.items {
+		sessions += conn.ActiveSessions()
 	}
+	return len(c.items), sessions
+}
+
+func (c *sftpConnectionsCache) updateMetrics() {
+	c.RLock()
+	defer c.RUnlock()
+
+	c.updateMetricsNoLock()
+}
+
+func (c *sftpConnectionsCache) updateMetricsNoLock() {
+	metric.UpdateSFTPFsPoolStatus(c.getStatsNoLock())
 }
 
 func (c *sftpConnectionsCache) Remove(key uint64) {
@@ -1147,6 +1409,7 @@ func (c *sftpConnectionsCache) Remove(key uint64) {
 	if conn, ok := c.items[key]; ok {
 		delete(c.items, key)
 		logger.Debug(logSenderSFTPCache, "", "removed connection with key %d, active connections: %d", key, len(c.items))
+		c.updateMetricsNoLock()
 
 		defer conn.Close()
 	}
@@ -1156,7 +1419,7 @@ func (c *sftpConnectionsCache) Cleanup() {
 	c.RLock()
 
 	for k, conn := range c.items {
-		if val := conn.GetLastActivity(); val.Before(time.Now().Add(-30 * time.Second)) {
+		if val := conn.GetLastActivity(); val.Before(time.Now().Add(-time.Duration(sftpPool.IdleTimeout) * time.Second)) {
 			logger.Debug(conn.logSender, "", "removing inactive connection, last activity %s", val)
 
 			defer func(key uint64) {
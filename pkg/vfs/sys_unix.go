@@ -19,6 +19,8 @@ package vfs
 
 import (
 	"errors"
+	"os"
+	"syscall"
 
 	"golang.org/x/sys/unix"
 )
@@ -30,3 +32,21 @@ func isCrossDeviceError(err error) bool {
 func isInvalidNameError(_ error) bool {
 	return false
 }
+
+// getFileOwnerAndLinks returns the uid, the gid and the number of hard links
+// for the specified file
+func getFileOwnerAndLinks(info os.FileInfo) (int, int, uint64) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(st.Uid), int(st.Gid), uint64(st.Nlink) //nolint:unconvert
+	}
+	return -1, -1, 1
+}
+
+// getFileBlocks returns the number of 512-byte blocks allocated for the
+// specified file, -1 if unknown
+func getFileBlocks(info os.FileInfo) int64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int64(st.Blocks) //nolint:unconvert
+	}
+	return -1
+}
@@ -16,6 +16,7 @@ package vfs
 
 import (
 	"errors"
+	"os"
 
 	"golang.org/x/sys/windows"
 )
@@ -30,3 +31,15 @@ func isInvalidNameError(err error) bool {
 	}
 	return errors.Is(err, windows.ERROR_INVALID_NAME)
 }
+
+// getFileOwnerAndLinks returns the uid, the gid and the number of hard links
+// for the specified file. Hard links are not detected on Windows
+func getFileOwnerAndLinks(_ os.FileInfo) (int, int, uint64) {
+	return -1, -1, 1
+}
+
+// getFileBlocks returns the number of 512-byte blocks allocated for the
+// specified file. Allocated blocks are not detected on Windows
+func getFileBlocks(_ os.FileInfo) int64 {
+	return -1
+}
@@ -0,0 +1,567 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eikenb/pipeat"
+	"github.com/sftpgo/sdk"
+
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/metric"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	tieringTempSuffix = ".sftpgo-tiering"
+)
+
+var (
+	tieringFiles = tieringRegistry{
+		files: make(map[string]*tieringFileLock),
+	}
+)
+
+// TieredObject defines a file moved to the cold storage
+type TieredObject struct {
+	// Name of the virtual folder used as cold storage
+	Folder string
+	// Object path inside the cold storage folder
+	Path string
+	// Size of the moved file
+	Size int64
+	// Modification time of the stub, a stub is valid only if its size and
+	// modification time match the stored ones
+	ModTime time.Time
+}
+
+// TieringStore persists the tiered objects and provides access to the cold
+// storage folders. The objects are identified by the virtual path of the
+// related files, so they follow renames
+type TieringStore interface {
+	// GetObject returns util.ErrNotFound if the file is not a stub
+	GetObject(virtualPath string) (TieredObject, error)
+	SetObject(virtualPath string, object TieredObject) error
+	RemoveObject(virtualPath string) error
+	// GetColdFs returns the filesystem for the specified cold storage folder
+	GetColdFs(folder string) (Fs, error)
+}
+
+type tieringFileLock struct {
+	sync.Mutex
+	refs int
+}
+
+// tieringRegistry serializes moves and recalls for the same file, it is
+// shared between connections so files are recalled once
+type tieringRegistry struct {
+	sync.Mutex
+	files map[string]*tieringFileLock
+}
+
+func (r *tieringRegistry) lock(name string) {
+	r.Lock()
+	l, ok := r.files[name]
+	if !ok {
+		l = &tieringFileLock{}
+		r.files[name] = l
+	}
+	l.refs++
+	r.Unlock()
+
+	l.Lock()
+}
+
+func (r *tieringRegistry) unlock(name string) {
+	r.Lock()
+	defer r.Unlock()
+
+	l, ok := r.files[name]
+	if !ok {
+		return
+	}
+	l.Unlock()
+	l.refs--
+	if l.refs <= 0 {
+		delete(r.files, name)
+	}
+}
+
+// TieredFs is a local Fs implementation whose files can be moved to a cold
+// storage. A moved file is replaced with a sparse stub of the same size, the
+// contents are recalled from the cold storage when the stub is opened
+type TieredFs struct {
+	*OsFs
+	store TieringStore
+}
+
+// NewTieredFs returns a TieredFs object
+func NewTieredFs(connectionID, rootDir, mountPath string, config *sdk.OSFsConfig, store TieringStore) Fs {
+	return &TieredFs{
+		OsFs:  NewOsFs(connectionID, rootDir, mountPath, config).(*OsFs),
+		store: store,
+	}
+}
+
+// Open opens the named file for reading, a stub is recalled first
+func (fs *TieredFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	if err := fs.recall(name); err != nil {
+		return nil, nil, nil, err
+	}
+	return fs.OsFs.Open(name, offset)
+}
+
+// Create creates or opens the named file for writing. A stub is recalled
+// before appending to it and its cold storage object is removed if the
+// stub is overwritten
+func (fs *TieredFs) Create(name string, flag, checks int) (File, *PipeWriter, func(), error) {
+	if flag != 0 && flag&os.O_TRUNC == 0 {
+		if err := fs.recall(name); err != nil {
+			return nil, nil, nil, err
+		}
+		return fs.OsFs.Create(name, flag, checks)
+	}
+	object, isStub := fs.getStubForPath(name)
+	f, p, cancelFn, err := fs.OsFs.Create(name, flag, checks)
+	if err == nil && isStub {
+		fs.releaseObject(name, object)
+	}
+	return f, p, cancelFn, err
+}
+
+// Rename renames (moves) source to target. A stub is recalled before moving
+// it outside this filesystem, an overwritten stub releases its cold storage object
+func (fs *TieredFs) Rename(source, target string) (int, int64, error) {
+	if !fs.isInsideRoot(target) {
+		if err := fs.recall(source); err != nil {
+			return -1, -1, err
+		}
+	}
+	object, isStub := fs.getStubForPath(target)
+	files, size, err := fs.OsFs.Rename(source, target)
+	if err == nil && isStub {
+		fs.releaseObject(target, object)
+	}
+	return files, size, err
+}
+
+// Remove removes the named file or (empty) directory. The cold
+// storage object for a removed stub is removed too
+func (fs *TieredFs) Remove(name string, isDir bool) error {
+	object, isStub := fs.getStubForPath(name)
+	err := fs.OsFs.Remove(name, isDir)
+	if err == nil && isStub {
+		fs.releaseObject(name, object)
+	}
+	return err
+}
+
+// Chtimes changes the access and modification times of the named file,
+// the stored object is updated for stubs so they remain valid
+func (fs *TieredFs) Chtimes(name string, atime, mtime time.Time, isUploading bool) error {
+	tieringFiles.lock(name)
+	defer tieringFiles.unlock(name)
+
+	object, isStub := fs.getStubForPath(name)
+	if err := fs.OsFs.Chtimes(name, atime, mtime, isUploading); err != nil || !isStub {
+		return err
+	}
+	info, err := os.Lstat(name)
+	if err != nil {
+		return err
+	}
+	object.ModTime = info.ModTime()
+	return fs.store.SetObject(fs.GetRelativePath(name), object)
+}
+
+// Truncate changes the size of the named file, a stub is recalled first
+func (fs *TieredFs) Truncate(name string, size int64) error {
+	if size == 0 {
+		object, isStub := fs.getStubForPath(name)
+		err := fs.OsFs.Truncate(name, size)
+		if err == nil && isStub {
+			fs.releaseObject(name, object)
+		}
+		return err
+	}
+	if err := fs.recall(name); err != nil {
+		return err
+	}
+	return fs.OsFs.Truncate(name, size)
+}
+
+// GetMimeType returns the content type. The type for stubs
+// is detected from the file extension
+func (fs *TieredFs) GetMimeType(name string) (string, error) {
+	if _, isStub := fs.getStubForPath(name); isStub {
+		if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+			return ctype, nil
+		}
+		return "application/octet-stream", nil
+	}
+	return fs.OsFs.GetMimeType(name)
+}
+
+// TierFile moves the contents of the named file to the specified cold
+// storage folder and replaces the file with a sparse stub. The object is
+// stored inside objectsDir in the cold storage. It returns false if the file
+// was not moved: not a regular file, empty, already moved, with multiple
+// hard links or modified while moving it
+func (fs *TieredFs) TierFile(name, folder, objectsDir string) (bool, error) {
+	tieringFiles.lock(name)
+	defer tieringFiles.unlock(name)
+
+	info, err := os.Lstat(name)
+	if err != nil {
+		return false, err
+	}
+	if !info.Mode().IsRegular() || info.Size() == 0 {
+		return false, nil
+	}
+	if _, _, links := getFileOwnerAndLinks(info); links > 1 {
+		return false, nil
+	}
+	if getFileBlocks(info) < 0 {
+		return false, errors.New("tiering is not supported on this platform")
+	}
+	if _, isStub, err := fs.getStub(name, info); err != nil || isStub {
+		return false, err
+	}
+	coldFs, err := fs.store.GetColdFs(folder)
+	if err != nil {
+		return false, fmt.Errorf("unable to get the cold storage folder %q: %w", folder, err)
+	}
+	defer coldFs.Close()
+	// local cold storage folders are created if missing, like the other folders
+	coldFs.CheckRootPath(objectsDir, -1, -1)
+
+	objectPath := path.Join("/", objectsDir, util.GenerateUniqueID()+"_"+filepath.Base(name))
+	if err := fs.upload(coldFs, name, objectPath, info.Size()); err != nil {
+		return false, fmt.Errorf("unable to move %q to the cold storage folder %q: %w", name, folder, err)
+	}
+	moved, err := fs.replaceWithStub(name, info, TieredObject{
+		Folder: folder,
+		Path:   objectPath,
+		Size:   info.Size(),
+	})
+	if err != nil || !moved {
+		removeColdObject(coldFs, objectPath) //nolint:errcheck
+		return false, err
+	}
+	fsLog(fs, logger.LevelDebug, "file %q moved to the cold storage folder %q as %q, size: %d",
+		name, folder, objectPath, info.Size())
+	metric.TieringFileMoved(info.Size())
+	return true, nil
+}
+
+// upload copies the named local file to objectPath in the cold storage
+func (fs *TieredFs) upload(coldFs Fs, name, objectPath string, size int64) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	fsPath, err := coldFs.ResolvePath(objectPath)
+	if err != nil {
+		return err
+	}
+	f, w, cancelFn, err := coldFs.Create(fsPath, 0, 0)
+	if err != nil && coldFs.IsNotExist(err) {
+		// local cold storage folders need the parent directories
+		dirs := util.GetDirsForVirtualPath(path.Dir(objectPath))
+		for idx := len(dirs) - 1; idx >= 0; idx-- {
+			if dirPath, errResolve := coldFs.ResolvePath(dirs[idx]); errResolve == nil && dirs[idx] != "/" {
+				coldFs.Mkdir(dirPath) //nolint:errcheck
+			}
+		}
+		f, w, cancelFn, err = coldFs.Create(fsPath, 0, 0)
+	}
+	if err != nil {
+		return err
+	}
+	var dst io.WriteCloser = w
+	if f != nil {
+		dst = f
+	}
+	_, err = io.Copy(dst, src)
+	if err != nil && cancelFn != nil {
+		cancelFn()
+	}
+	if errClose := dst.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		var info os.FileInfo
+		info, err = coldFs.Stat(fsPath)
+		if err == nil && info.Size() != size {
+			err = fmt.Errorf("size mismatch, expected %d, actual %d", size, info.Size())
+		}
+	}
+	if err != nil {
+		coldFs.Remove(fsPath, false) //nolint:errcheck
+	}
+	return err
+}
+
+// replaceWithStub atomically replaces the named file with a sparse stub
+// of the same size, preserving its metadata. The file lock must be held
+func (fs *TieredFs) replaceWithStub(name string, info os.FileInfo, object TieredObject) (bool, error) {
+	current, err := os.Lstat(name)
+	if err != nil {
+		return false, err
+	}
+	if !os.SameFile(info, current) || current.Size() != info.Size() || !current.ModTime().Equal(info.ModTime()) {
+		fsLog(fs, logger.LevelDebug, "file %q modified while moving it to the cold storage", name)
+		return false, nil
+	}
+	tempName := fs.getTempPath(name)
+	f, err := os.OpenFile(tempName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return false, err
+	}
+	err = f.Truncate(info.Size())
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = fs.copyMetadata(tempName, info, getFileAccessTime(info))
+	}
+	var stubInfo os.FileInfo
+	if err == nil {
+		stubInfo, err = os.Lstat(tempName)
+	}
+	if err == nil && !isTieringStubCandidate(stubInfo) {
+		err = errors.New("sparse files are not supported by the local filesystem")
+	}
+	if err != nil {
+		os.Remove(tempName) //nolint:errcheck
+		return false, err
+	}
+	virtualPath := fs.GetRelativePath(name)
+	if previous, err := fs.store.GetObject(virtualPath); err == nil {
+		// the file was overwritten outside SFTPGo after a previous move
+		fs.removeColdObject(previous)
+	}
+	object.ModTime = stubInfo.ModTime()
+	if err := fs.store.SetObject(virtualPath, object); err != nil {
+		os.Remove(tempName) //nolint:errcheck
+		return false, err
+	}
+	if err := os.Rename(tempName, name); err != nil {
+		os.Remove(tempName)                //nolint:errcheck
+		fs.store.RemoveObject(virtualPath) //nolint:errcheck
+		return false, err
+	}
+	return true, nil
+}
+
+// recall restores the contents of a stub from the cold storage
+func (fs *TieredFs) recall(name string) error {
+	info, err := os.Lstat(name)
+	if err != nil || !isTieringStubCandidate(info) {
+		return nil
+	}
+	tieringFiles.lock(name)
+	defer tieringFiles.unlock(name)
+
+	info, err = os.Lstat(name)
+	if err != nil {
+		return nil
+	}
+	object, isStub, err := fs.getStub(name, info)
+	if err != nil || !isStub {
+		return err
+	}
+	startTime := time.Now()
+	err = fs.download(name, info, object)
+	metric.TieringFileRecalled(object.Size, err)
+	if err != nil {
+		fsLog(fs, logger.LevelError, "unable to recall %q from the cold storage folder %q: %v", name, object.Folder, err)
+		return fmt.Errorf("unable to recall %q from the cold storage: %w", fs.GetRelativePath(name), err)
+	}
+	fsLog(fs, logger.LevelDebug, "file %q recalled from the cold storage folder %q, size: %d, elapsed: %s",
+		name, object.Folder, object.Size, time.Since(startTime))
+	fs.releaseObject(name, object)
+	return nil
+}
+
+// download replaces the stub with the contents stored in the cold storage.
+// The file lock must be held
+func (fs *TieredFs) download(name string, info os.FileInfo, object TieredObject) error {
+	coldFs, err := fs.store.GetColdFs(object.Folder)
+	if err != nil {
+		return err
+	}
+	defer coldFs.Close()
+
+	fsPath, err := coldFs.ResolvePath(object.Path)
+	if err != nil {
+		return err
+	}
+	f, r, cancelFn, err := coldFs.Open(fsPath, 0)
+	if err != nil {
+		return err
+	}
+	var src io.ReadCloser = r
+	if f != nil {
+		src = f
+	}
+	defer src.Close()
+
+	tempName := fs.getTempPath(name)
+	dst, err := os.OpenFile(tempName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		if cancelFn != nil {
+			cancelFn()
+		}
+		return err
+	}
+	n, err := io.Copy(dst, src)
+	if err != nil && cancelFn != nil {
+		cancelFn()
+	}
+	if errClose := dst.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil && n != object.Size {
+		err = fmt.Errorf("size mismatch, expected %d, actual %d", object.Size, n)
+	}
+	if err == nil {
+		err = fs.copyMetadata(tempName, info, time.Now())
+	}
+	if err == nil {
+		err = os.Rename(tempName, name)
+	}
+	if err != nil {
+		os.Remove(tempName) //nolint:errcheck
+	}
+	return err
+}
+
+// copyMetadata applies the permissions, the owner and the modification
+// time of the specified file info to name
+func (fs *TieredFs) copyMetadata(name string, info os.FileInfo, atime time.Time) error {
+	if err := os.Chmod(name, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if uid, gid, _ := getFileOwnerAndLinks(info); uid != -1 {
+		// this can fail if SFTPGo does not run as root, the file keeps the SFTPGo owner
+		if err := os.Lchown(name, uid, gid); err != nil {
+			fsLog(fs, logger.LevelDebug, "unable to preserve the owner for %q: %v", name, err)
+		}
+	}
+	return os.Chtimes(name, atime, info.ModTime())
+}
+
+// getStub returns the stored object if the named file is a valid stub
+func (fs *TieredFs) getStub(name string, info os.FileInfo) (TieredObject, bool, error) {
+	if !isTieringStubCandidate(info) {
+		return TieredObject{}, false, nil
+	}
+	object, err := fs.store.GetObject(fs.GetRelativePath(name))
+	if err != nil {
+		if errors.Is(err, util.ErrNotFound) {
+			return object, false, nil
+		}
+		return object, false, err
+	}
+	if object.Size != info.Size() || !object.ModTime.Equal(info.ModTime()) {
+		// the file was modified outside SFTPGo, it is not a stub anymore
+		return object, false, nil
+	}
+	return object, true, nil
+}
+
+func (fs *TieredFs) getStubForPath(name string) (TieredObject, bool) {
+	info, err := os.Lstat(name)
+	if err != nil {
+		return TieredObject{}, false
+	}
+	object, isStub, err := fs.getStub(name, info)
+	if err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to check if %q is a stub: %v", name, err)
+	}
+	return object, isStub
+}
+
+// releaseObject removes the cold storage object for a stub that
+// was recalled, overwritten or removed
+func (fs *TieredFs) releaseObject(name string, object TieredObject) {
+	if err := fs.store.RemoveObject(fs.GetRelativePath(name)); err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to remove the tiering metadata for %q: %v", name, err)
+	}
+	fs.removeColdObject(object)
+}
+
+func (fs *TieredFs) removeColdObject(object TieredObject) {
+	coldFs, err := fs.store.GetColdFs(object.Folder)
+	if err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to remove object %q, cold storage folder %q not available: %v",
+			object.Path, object.Folder, err)
+		return
+	}
+	defer coldFs.Close()
+
+	if err := removeColdObject(coldFs, object.Path); err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to remove object %q from the cold storage folder %q: %v",
+			object.Path, object.Folder, err)
+	}
+}
+
+func (fs *TieredFs) getTempPath(name string) string {
+	return filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+tieringTempSuffix)
+}
+
+func (fs *TieredFs) isInsideRoot(name string) bool {
+	return name == fs.rootDir || strings.HasPrefix(name, fs.rootDir+string(os.PathSeparator))
+}
+
+func removeColdObject(coldFs Fs, objectPath string) error {
+	fsPath, err := coldFs.ResolvePath(objectPath)
+	if err != nil {
+		return err
+	}
+	if err := coldFs.Remove(fsPath, false); err != nil && !coldFs.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// isTieringStubCandidate returns true if the file could be a stub. Stubs are
+// sparse files, the stored objects are checked only for partially allocated files
+func isTieringStubCandidate(info os.FileInfo) bool {
+	if !info.Mode().IsRegular() || info.Size() == 0 {
+		return false
+	}
+	blocks := getFileBlocks(info)
+	return blocks >= 0 && blocks*512 < info.Size()
+}
+
+// GetFileAccessTime returns the last access time for the specified file info.
+// The modification time is returned if the access time is not available
+func GetFileAccessTime(info os.FileInfo) time.Time {
+	return getFileAccessTime(info)
+}
@@ -16,6 +16,7 @@
 package vfs
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -25,6 +26,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/eikenb/pipeat"
@@ -144,6 +146,29 @@ type FsFileCopier interface {
 	CopyFile(source, target string, srcSize int64) error
 }
 
+// FsBatchRemover is a Fs that implements the RemoveFiles method.
+// It allows to remove multiple files with a single request
+type FsBatchRemover interface {
+	Fs
+	RemoveFiles(names []string) error
+}
+
+// FsDirLister is a Fs that implements the ListDir method.
+// It allows to read the directory listings in chunks instead of
+// loading the whole listing in memory
+type FsDirLister interface {
+	Fs
+	ListDir(dirname string) (DirLister, error)
+}
+
+// DirLister defines an interface for a directory listing that can be read in chunks
+type DirLister interface {
+	// Next returns up to limit entries, io.EOF is returned when there are no
+	// more entries. Entries and io.EOF can be returned together
+	Next(limit int) ([]os.FileInfo, error)
+	Close() error
+}
+
 // File defines an interface representing a SFTPGo file
 type File interface {
 	io.Reader
@@ -188,6 +213,18 @@ func (q *QuotaCheckResult) GetRemainingFiles() int {
 type S3FsConfig struct {
 	sdk.BaseS3FsConfig
 	AccessSecret *kms.Secret `json:"access_secret,omitempty"`
+	// Path of a Vault AWS secrets engine role, for example "aws/creds/sftpgo".
+	// If set, short-lived credentials are requested to Vault and automatically
+	// refreshed before they expire
+	VaultCredentialsPath string `json:"vault_credentials_path,omitempty"`
+	// UseAccelerateEndpoint enables S3 Transfer Acceleration for the bucket.
+	// It cannot be used with a custom endpoint or with path style addressing
+	UseAccelerateEndpoint bool `json:"use_accelerate_endpoint,omitempty"`
+	// AdaptiveUploadPartSize enables adaptive part sizing for multipart uploads.
+	// The upload part size is used for the first parts and then increased based
+	// on the observed throughput and on the number of uploaded parts, so that
+	// huge uploads don't hit the limit of 10000 parts
+	AdaptiveUploadPartSize bool `json:"adaptive_upload_part_size,omitempty"`
 }
 
 // HideConfidentialData hides confidential data
@@ -213,6 +250,9 @@ func (c *S3FsConfig) isEqual(other S3FsConfig) bool {
 	if c.RoleARN != other.RoleARN {
 		return false
 	}
+	if c.VaultCredentialsPath != other.VaultCredentialsPath {
+		return false
+	}
 	if c.Endpoint != other.Endpoint {
 		return false
 	}
@@ -229,6 +269,9 @@ func (c *S3FsConfig) isEqual(other S3FsConfig) bool {
 	if c.ForcePathStyle != other.ForcePathStyle {
 		return false
 	}
+	if c.UseAccelerateEndpoint != other.UseAccelerateEndpoint {
+		return false
+	}
 	return c.isSecretEqual(other)
 }
 
@@ -251,6 +294,9 @@ func (c *S3FsConfig) areMultipartFieldsEqual(other S3FsConfig) bool {
 	if c.UploadPartMaxTime != other.UploadPartMaxTime {
 		return false
 	}
+	if c.AdaptiveUploadPartSize != other.AdaptiveUploadPartSize {
+		return false
+	}
 	return true
 }
 
@@ -277,6 +323,15 @@ func (c *S3FsConfig) checkCredentials() error {
 	if !c.AccessSecret.IsEmpty() && !c.AccessSecret.IsValidInput() {
 		return errors.New("invalid access_secret")
 	}
+	c.VaultCredentialsPath = strings.Trim(strings.TrimSpace(c.VaultCredentialsPath), "/")
+	if c.VaultCredentialsPath != "" {
+		if c.AccessKey != "" {
+			return errors.New("access_key and vault_credentials_path are mutually exclusive")
+		}
+		if strings.Contains(c.VaultCredentialsPath, "..") {
+			return fmt.Errorf("invalid vault_credentials_path %q", c.VaultCredentialsPath)
+		}
+	}
 	return nil
 }
 
@@ -348,6 +403,17 @@ func (c *S3FsConfig) validate() error {
 	}
 	c.StorageClass = strings.TrimSpace(c.StorageClass)
 	c.ACL = strings.TrimSpace(c.ACL)
+	if c.UseAccelerateEndpoint {
+		if c.Endpoint != "" {
+			return errors.New("use_accelerate_endpoint cannot be used with a custom endpoint")
+		}
+		if c.ForcePathStyle {
+			return errors.New("use_accelerate_endpoint cannot be used with force_path_style")
+		}
+		if strings.Contains(c.Bucket, ".") {
+			return errors.New("use_accelerate_endpoint is not supported for bucket names containing dots")
+		}
+	}
 	return c.checkPartSizeAndConcurrency()
 }
 
@@ -355,6 +421,19 @@ func (c *S3FsConfig) validate() error {
 type GCSFsConfig struct {
 	sdk.BaseGCSFsConfig
 	Credentials *kms.Secret `json:"credentials,omitempty"`
+	// DownloadPartSize defines the size, in MB, of the parts downloaded in parallel
+	// using ranged reads. 0 means disabled, objects are downloaded using a single stream
+	DownloadPartSize int64 `json:"download_part_size,omitempty"`
+	// DownloadConcurrency defines how many parts are downloaded in parallel.
+	// 0 means the default (5)
+	DownloadConcurrency int `json:"download_concurrency,omitempty"`
+	// BillingProject is the project billed for the requests. It is required
+	// to access buckets with requester pays enabled
+	BillingProject string `json:"billing_project,omitempty"`
+	// KMSKeyName is the Cloud KMS key, in the form
+	// projects/P/locations/L/keyRings/R/cryptoKeys/K, used to encrypt the
+	// uploaded objects. Leave empty to use the bucket default encryption
+	KMSKeyName string `json:"kms_key_name,omitempty"`
 }
 
 // HideConfidentialData hides confidential data
@@ -401,6 +480,18 @@ func (c *GCSFsConfig) isEqual(other GCSFsConfig) bool {
 	if c.UploadPartMaxTime != other.UploadPartMaxTime {
 		return false
 	}
+	if c.DownloadPartSize != other.DownloadPartSize {
+		return false
+	}
+	if c.DownloadConcurrency != other.DownloadConcurrency {
+		return false
+	}
+	if c.BillingProject != other.BillingProject {
+		return false
+	}
+	if c.KMSKeyName != other.KMSKeyName {
+		return false
+	}
 	if c.Credentials == nil {
 		c.Credentials = kms.NewEmptySecret()
 	}
@@ -445,6 +536,29 @@ func (c *GCSFsConfig) validate() error {
 	if c.UploadPartMaxTime < 0 {
 		c.UploadPartMaxTime = 0
 	}
+	if c.DownloadPartSize < 0 || c.DownloadPartSize > 100 {
+		return fmt.Errorf("invalid download part size: %v", c.DownloadPartSize)
+	}
+	if c.DownloadConcurrency < 0 || c.DownloadConcurrency > 64 {
+		return fmt.Errorf("invalid download concurrency: %v", c.DownloadConcurrency)
+	}
+	return c.validateBillingAndEncryption()
+}
+
+func (c *GCSFsConfig) validateBillingAndEncryption() error {
+	c.BillingProject = strings.TrimSpace(c.BillingProject)
+	if strings.ContainsAny(c.BillingProject, " \t/") {
+		return fmt.Errorf("invalid billing project %q", c.BillingProject)
+	}
+	c.KMSKeyName = strings.TrimSpace(c.KMSKeyName)
+	if c.KMSKeyName != "" {
+		parts := strings.Split(c.KMSKeyName, "/")
+		if len(parts) != 8 || parts[0] != "projects" || parts[2] != "locations" || parts[4] != "keyRings" ||
+			parts[6] != "cryptoKeys" || util.Contains(parts, "") {
+			return fmt.Errorf("invalid KMS key name %q, the expected format is projects/<project>/locations/<location>/keyRings/<key ring>/cryptoKeys/<key>",
+				c.KMSKeyName)
+		}
+	}
 	return nil
 }
 
@@ -456,6 +570,9 @@ type AzBlobFsConfig struct {
 	AccountKey *kms.Secret `json:"account_key,omitempty"`
 	// Shared access signature URL, leave blank if using account/key
 	SASURL *kms.Secret `json:"sas_url,omitempty"`
+	// SASAutoRenew enables the automatic regeneration of the SAS token, using
+	// the account name and key, when it is about to expire
+	SASAutoRenew bool `json:"sas_auto_renew,omitempty"`
 }
 
 // HideConfidentialData hides confidential data
@@ -487,6 +604,9 @@ func (c *AzBlobFsConfig) isEqual(other AzBlobFsConfig) bool {
 	if !c.SASURL.IsEqual(other.SASURL) {
 		return false
 	}
+	if c.SASAutoRenew != other.SASAutoRenew {
+		return false
+	}
 	if c.KeyPrefix != other.KeyPrefix {
 		return false
 	}
@@ -543,15 +663,27 @@ func (c *AzBlobFsConfig) ValidateAndEncryptCredentials(additionalData string) er
 
 func (c *AzBlobFsConfig) checkCredentials() error {
 	if c.SASURL.IsPlain() {
-		_, err := url.Parse(c.SASURL.GetPayload())
-		return err
+		if _, err := url.Parse(c.SASURL.GetPayload()); err != nil {
+			return err
+		}
 	}
 	if c.SASURL.IsEncrypted() && !c.SASURL.IsValid() {
 		return errors.New("invalid encrypted sas_url")
 	}
 	if !c.SASURL.IsEmpty() {
+		if c.SASAutoRenew {
+			// the account key is required to sign the renewed SAS tokens
+			return c.checkAccountCredentials()
+		}
 		return nil
 	}
+	if c.SASAutoRenew {
+		return errors.New("sas_auto_renew requires a SAS URL")
+	}
+	return c.checkAccountCredentials()
+}
+
+func (c *AzBlobFsConfig) checkAccountCredentials() error {
 	if c.AccountName == "" || !c.AccountKey.IsValidInput() {
 		return errors.New("credentials cannot be empty or invalid")
 	}
@@ -634,6 +766,14 @@ func (c *AzBlobFsConfig) validate() error {
 type CryptFsConfig struct {
 	sdk.OSFsConfig
 	Passphrase *kms.Secret `json:"passphrase,omitempty"`
+	// PreviousPassphrases are the passphrases replaced by a key rotation,
+	// they are used to decrypt the files not yet re-encrypted
+	PreviousPassphrases []*kms.Secret `json:"previous_passphrases,omitempty"`
+	// EncryptNames enables the encryption of the file and directory names
+	EncryptNames bool `json:"encrypt_names,omitempty"`
+	// NamesKey is the key used to encrypt the names, it is randomly
+	// generated if the names encryption is enabled and it is not set
+	NamesKey *kms.Secret `json:"names_key,omitempty"`
 }
 
 // HideConfidentialData hides confidential data
@@ -641,33 +781,119 @@ func (c *CryptFsConfig) HideConfidentialData() {
 	if c.Passphrase != nil {
 		c.Passphrase.Hide()
 	}
+	for _, passphrase := range c.PreviousPassphrases {
+		passphrase.Hide()
+	}
+	if c.NamesKey != nil {
+		c.NamesKey.Hide()
+	}
 }
 
-func (c *CryptFsConfig) isEqual(other CryptFsConfig) bool {
+func (c *CryptFsConfig) setEmptySecretsIfNil() {
 	if c.Passphrase == nil {
 		c.Passphrase = kms.NewEmptySecret()
 	}
-	if other.Passphrase == nil {
-		other.Passphrase = kms.NewEmptySecret()
+	if c.NamesKey == nil {
+		c.NamesKey = kms.NewEmptySecret()
+	}
+}
+
+func (c *CryptFsConfig) setNilSecretsIfEmpty() {
+	if c.Passphrase != nil && c.Passphrase.IsEmpty() {
+		c.Passphrase = nil
+	}
+	if c.NamesKey != nil && c.NamesKey.IsEmpty() {
+		c.NamesKey = nil
+	}
+	if len(c.PreviousPassphrases) == 0 {
+		c.PreviousPassphrases = nil
+	}
+}
+
+func (c *CryptFsConfig) hasRedactedSecret() bool {
+	c.setEmptySecretsIfNil()
+	if c.Passphrase.IsRedacted() || c.NamesKey.IsRedacted() {
+		return true
+	}
+	for _, passphrase := range c.PreviousPassphrases {
+		if passphrase.IsRedacted() {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CryptFsConfig) getSecrets() []*kms.Secret {
+	c.setEmptySecretsIfNil()
+	secrets := []*kms.Secret{c.Passphrase, c.NamesKey}
+	return append(secrets, c.PreviousPassphrases...)
+}
+
+// GetACopy returns a copy
+func (c *CryptFsConfig) GetACopy() CryptFsConfig {
+	c.setEmptySecretsIfNil()
+	var previousPassphrases []*kms.Secret
+	for _, passphrase := range c.PreviousPassphrases {
+		previousPassphrases = append(previousPassphrases, passphrase.Clone())
+	}
+	return CryptFsConfig{
+		OSFsConfig: sdk.OSFsConfig{
+			ReadBufferSize:  c.ReadBufferSize,
+			WriteBufferSize: c.WriteBufferSize,
+		},
+		Passphrase:          c.Passphrase.Clone(),
+		PreviousPassphrases: previousPassphrases,
+		EncryptNames:        c.EncryptNames,
+		NamesKey:            c.NamesKey.Clone(),
+	}
+}
+
+func (c *CryptFsConfig) isEqual(other CryptFsConfig) bool {
+	c.setEmptySecretsIfNil()
+	other.setEmptySecretsIfNil()
+	if c.EncryptNames != other.EncryptNames {
+		return false
+	}
+	if !c.NamesKey.IsEqual(other.NamesKey) {
+		return false
+	}
+	if len(c.PreviousPassphrases) != len(other.PreviousPassphrases) {
+		return false
+	}
+	for idx := range c.PreviousPassphrases {
+		if !c.PreviousPassphrases[idx].IsEqual(other.PreviousPassphrases[idx]) {
+			return false
+		}
 	}
 	return c.Passphrase.IsEqual(other.Passphrase)
 }
 
 // ValidateAndEncryptCredentials validates the configuration and encrypts the passphrase if it is in plain text
 func (c *CryptFsConfig) ValidateAndEncryptCredentials(additionalData string) error {
+	if c.EncryptNames && (c.NamesKey == nil || c.NamesKey.IsEmpty()) {
+		c.NamesKey = kms.NewPlainSecret(hex.EncodeToString(util.GenerateRandomBytes(32)))
+	}
 	if err := c.validate(); err != nil {
 		return util.NewValidationError(fmt.Sprintf("could not validate Crypt fs config: %v", err))
 	}
-	if c.Passphrase.IsPlain() {
-		c.Passphrase.SetAdditionalData(additionalData)
-		if err := c.Passphrase.Encrypt(); err != nil {
-			return util.NewValidationError(fmt.Sprintf("could not encrypt Crypt fs passphrase: %v", err))
+	for _, secret := range c.getSecrets() {
+		if secret.IsPlain() {
+			secret.SetAdditionalData(additionalData)
+			if err := secret.Encrypt(); err != nil {
+				return util.NewValidationError(fmt.Sprintf("could not encrypt Crypt fs secrets: %v", err))
+			}
 		}
 	}
 	return nil
 }
 
 func (c *CryptFsConfig) isSameResource(other CryptFsConfig) bool {
+	if c.EncryptNames != other.EncryptNames {
+		return false
+	}
+	if c.EncryptNames && c.NamesKey.GetPayload() != other.NamesKey.GetPayload() {
+		return false
+	}
 	return c.Passphrase.GetPayload() == other.Passphrase.GetPayload()
 }
 
@@ -682,14 +908,40 @@ func (c *CryptFsConfig) validate() error {
 	if c.Passphrase.IsEncrypted() && !c.Passphrase.IsValid() {
 		return errors.New("invalid encrypted passphrase")
 	}
+	var previousPassphrases []*kms.Secret
+	for _, passphrase := range c.PreviousPassphrases {
+		if passphrase == nil || passphrase.IsEmpty() {
+			continue
+		}
+		if !passphrase.IsValidInput() || (passphrase.IsEncrypted() && !passphrase.IsValid()) {
+			return errors.New("invalid previous passphrase")
+		}
+		previousPassphrases = append(previousPassphrases, passphrase)
+	}
+	c.PreviousPassphrases = previousPassphrases
+	if !c.EncryptNames {
+		c.NamesKey = kms.NewEmptySecret()
+		return nil
+	}
+	if c.NamesKey == nil || c.NamesKey.IsEmpty() {
+		return errors.New("the names encryption key is required")
+	}
+	if !c.NamesKey.IsValidInput() {
+		return errors.New("invalid names encryption key")
+	}
+	if c.NamesKey.IsEncrypted() && !c.NamesKey.IsValid() {
+		return errors.New("invalid encrypted names encryption key")
+	}
 	return nil
 }
 
 // PipeWriter defines a wrapper for pipeat.PipeWriterAt.
 type PipeWriter struct {
-	writer *pipeat.PipeWriterAt
-	err    error
-	done   chan bool
+	writer   *pipeat.PipeWriterAt
+	err      error
+	done     chan bool
+	mu       sync.Mutex
+	doneHook func(err error)
 }
 
 // NewPipeWriter initializes a new PipeWriter
@@ -711,10 +963,25 @@ func (p *PipeWriter) Close() error {
 // Done unlocks other goroutines waiting on Close().
 // It must be called when the upload ends
 func (p *PipeWriter) Done(err error) {
+	p.mu.Lock()
+	doneHook := p.doneHook
+	p.mu.Unlock()
+	if doneHook != nil {
+		doneHook(err)
+	}
 	p.err = err
 	p.done <- true
 }
 
+// setDoneHook sets a function to execute when the upload ends,
+// before unlocking the goroutines waiting on Close()
+func (p *PipeWriter) setDoneHook(fn func(err error)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.doneHook = fn
+}
+
 // WriteAt is a wrapper for pipeat WriteAt
 func (p *PipeWriter) WriteAt(data []byte, off int64) (int, error) {
 	return p.writer.WriteAt(data, off)
@@ -758,6 +1025,11 @@ func IsHTTPFs(fs Fs) bool {
 	return strings.HasPrefix(fs.Name(), httpFsName)
 }
 
+// IsWebDAVFs returns true if fs is a WebDAV filesystem
+func IsWebDAVFs(fs Fs) bool {
+	return strings.HasPrefix(fs.Name(), webDAVFsName)
+}
+
 // IsBufferedLocalOrSFTPFs returns true if this is a buffered SFTP or local filesystem
 func IsBufferedLocalOrSFTPFs(fs Fs) bool {
 	if osFs, ok := fs.(*OsFs); ok {
@@ -771,9 +1043,15 @@ func IsBufferedLocalOrSFTPFs(fs Fs) bool {
 
 // FsOpenReturnsFile returns true if fs.Open returns a *os.File handle
 func FsOpenReturnsFile(fs Fs) bool {
+	if _, ok := fs.(*DedupFs); ok {
+		return true
+	}
 	if osFs, ok := fs.(*OsFs); ok {
 		return osFs.readBufferSize == 0
 	}
+	if tieredFs, ok := fs.(*TieredFs); ok {
+		return tieredFs.readBufferSize == 0
+	}
 	if sftpFs, ok := fs.(*SFTPFs); ok {
 		return sftpFs.config.BufferSize == 0
 	}
@@ -987,3 +1265,55 @@ func getMountPath(mountPath string) string {
 func fsLog(fs Fs, level logger.LogLevel, format string, v ...any) {
 	logger.Log(level, fs.Name(), fs.ConnectionID(), format, v...)
 }
+
+type bufferAllocator struct {
+	sync.Mutex
+	available  [][]byte
+	bufferSize int
+	finalized  bool
+}
+
+func newBufferAllocator(size int) *bufferAllocator {
+	return &bufferAllocator{
+		bufferSize: size,
+		finalized:  false,
+	}
+}
+
+func (b *bufferAllocator) getBuffer() []byte {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.available) > 0 {
+		var result []byte
+
+		truncLength := len(b.available) - 1
+		result = b.available[truncLength]
+
+		b.available[truncLength] = nil
+		b.available = b.available[:truncLength]
+
+		return result
+	}
+
+	return make([]byte, b.bufferSize)
+}
+
+func (b *bufferAllocator) releaseBuffer(buf []byte) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.finalized || len(buf) != b.bufferSize {
+		return
+	}
+
+	b.available = append(b.available, buf)
+}
+
+func (b *bufferAllocator) free() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.available = nil
+	b.finalized = true
+}
@@ -0,0 +1,896 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vfs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eikenb/pipeat"
+	"github.com/pkg/sftp"
+	"github.com/sftpgo/sdk"
+
+	"github.com/drakkan/sftpgo/v2/pkg/kms"
+	"github.com/drakkan/sftpgo/v2/pkg/logger"
+	"github.com/drakkan/sftpgo/v2/pkg/metric"
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	// webDAVFsName is the name for the WebDAV Fs implementation
+	webDAVFsName = "webdavfs"
+	// WebDAVFilesystemProvider defines the provider for remote WebDAV servers.
+	// The SDK does not define this provider so we use the first free value
+	WebDAVFilesystemProvider sdk.FilesystemProvider = 7
+)
+
+const (
+	webDAVPropfindStat = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/><d:getlastmodified/><d:getcontenttype/></d:prop></d:propfind>`
+	webDAVPropfindQuota = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:quota-available-bytes/><d:quota-used-bytes/></d:prop></d:propfind>`
+	webDAVStatVFSBlockSize = 4096
+)
+
+// WebDAVFsConfig defines the configuration for WebDAV based filesystem
+type WebDAVFsConfig struct {
+	// WebDAV endpoint, for example https://cloud.example.com/remote.php/dav/files/username
+	Endpoint string `json:"endpoint,omitempty"`
+	// Username for HTTP basic authentication, optional
+	Username string      `json:"username,omitempty"`
+	Password *kms.Secret `json:"password,omitempty"`
+	// SkipTLSVerify disables the server certificate verification
+	SkipTLSVerify bool `json:"skip_tls_verify,omitempty"`
+	// ClientCert is a PEM encoded certificate used for TLS client authentication
+	ClientCert string `json:"client_cert,omitempty"`
+	// ClientKey is the PEM encoded private key for ClientCert
+	ClientKey *kms.Secret `json:"client_key,omitempty"`
+	// EqualityCheckMode defines how to compare two WebDAV filesystems:
+	// 0 the endpoint only, 1 the endpoint and the username
+	EqualityCheckMode int `json:"equality_check_mode,omitempty"`
+}
+
+// HideConfidentialData hides confidential data
+func (c *WebDAVFsConfig) HideConfidentialData() {
+	if c.Password != nil {
+		c.Password.Hide()
+	}
+	if c.ClientKey != nil {
+		c.ClientKey.Hide()
+	}
+}
+
+func (c *WebDAVFsConfig) setNilSecretsIfEmpty() {
+	if c.Password != nil && c.Password.IsEmpty() {
+		c.Password = nil
+	}
+	if c.ClientKey != nil && c.ClientKey.IsEmpty() {
+		c.ClientKey = nil
+	}
+}
+
+func (c *WebDAVFsConfig) setEmptyCredentialsIfNil() {
+	if c.Password == nil {
+		c.Password = kms.NewEmptySecret()
+	}
+	if c.ClientKey == nil {
+		c.ClientKey = kms.NewEmptySecret()
+	}
+}
+
+func (c *WebDAVFsConfig) isEqual(other WebDAVFsConfig) bool {
+	if c.Endpoint != other.Endpoint {
+		return false
+	}
+	if c.Username != other.Username {
+		return false
+	}
+	if c.SkipTLSVerify != other.SkipTLSVerify {
+		return false
+	}
+	if c.ClientCert != other.ClientCert {
+		return false
+	}
+	c.setEmptyCredentialsIfNil()
+	other.setEmptyCredentialsIfNil()
+	if !c.Password.IsEqual(other.Password) {
+		return false
+	}
+	return c.ClientKey.IsEqual(other.ClientKey)
+}
+
+func (c *WebDAVFsConfig) isSameResource(other WebDAVFsConfig) bool {
+	if c.EqualityCheckMode > 0 || other.EqualityCheckMode > 0 {
+		if c.Username != other.Username {
+			return false
+		}
+	}
+	return c.Endpoint == other.Endpoint
+}
+
+func (c *WebDAVFsConfig) validateClientCert() error {
+	if c.ClientCert == "" {
+		if !c.ClientKey.IsEmpty() {
+			return errors.New("webdavfs: a client key requires a client certificate")
+		}
+		return nil
+	}
+	block, _ := pem.Decode([]byte(c.ClientCert))
+	if block == nil {
+		return errors.New("webdavfs: invalid client certificate, PEM format expected")
+	}
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		return fmt.Errorf("webdavfs: invalid client certificate: %w", err)
+	}
+	if c.ClientKey.IsEmpty() {
+		return errors.New("webdavfs: a client certificate requires a client key")
+	}
+	if c.ClientKey.IsEncrypted() && !c.ClientKey.IsValid() {
+		return errors.New("webdavfs: invalid encrypted client key")
+	}
+	if c.ClientKey.IsPlain() {
+		if !c.ClientKey.IsValidInput() {
+			return errors.New("webdavfs: invalid client key")
+		}
+		if _, err := tls.X509KeyPair([]byte(c.ClientCert), []byte(c.ClientKey.GetPayload())); err != nil {
+			return fmt.Errorf("webdavfs: invalid client certificate/key pair: %w", err)
+		}
+	}
+	return nil
+}
+
+// validate returns an error if the configuration is not valid
+func (c *WebDAVFsConfig) validate() error {
+	c.setEmptyCredentialsIfNil()
+	if c.Endpoint == "" {
+		return errors.New("webdavfs: endpoint cannot be empty")
+	}
+	c.Endpoint = strings.TrimRight(c.Endpoint, "/")
+	endpointURL, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return fmt.Errorf("webdavfs: invalid endpoint: %w", err)
+	}
+	if !util.IsStringPrefixInSlice(c.Endpoint, supportedEndpointSchema) {
+		return errors.New("webdavfs: invalid endpoint schema: http and https are supported")
+	}
+	if endpointURL.Host == "" {
+		return errors.New("webdavfs: invalid endpoint, the host is missing")
+	}
+	if endpointURL.RawQuery != "" || endpointURL.Fragment != "" {
+		return errors.New("webdavfs: invalid endpoint, query parameters and fragments are not allowed")
+	}
+	if !isEqualityCheckModeValid(c.EqualityCheckMode) {
+		return errors.New("invalid equality_check_mode")
+	}
+	if c.Password.IsEncrypted() && !c.Password.IsValid() {
+		return errors.New("webdavfs: invalid encrypted password")
+	}
+	if !c.Password.IsEmpty() && !c.Password.IsValidInput() {
+		return errors.New("webdavfs: invalid password")
+	}
+	return c.validateClientCert()
+}
+
+// ValidateAndEncryptCredentials validates the config and encrypts credentials if they are in plain text
+func (c *WebDAVFsConfig) ValidateAndEncryptCredentials(additionalData string) error {
+	if err := c.validate(); err != nil {
+		return util.NewValidationError(fmt.Sprintf("could not validate WebDAV fs config: %v", err))
+	}
+	if c.Password.IsPlain() {
+		c.Password.SetAdditionalData(additionalData)
+		if err := c.Password.Encrypt(); err != nil {
+			return util.NewValidationError(fmt.Sprintf("could not encrypt WebDAV fs password: %v", err))
+		}
+	}
+	if c.ClientKey.IsPlain() {
+		c.ClientKey.SetAdditionalData(additionalData)
+		if err := c.ClientKey.Encrypt(); err != nil {
+			return util.NewValidationError(fmt.Sprintf("could not encrypt WebDAV fs client key: %v", err))
+		}
+	}
+	return nil
+}
+
+// WebDAVFs is a Fs implementation for remote WebDAV servers such as Nextcloud and ownCloud
+type WebDAVFs struct {
+	connectionID string
+	localTempDir string
+	// if not empty this fs is mouted as virtual folder in the specified path
+	mountPath  string
+	config     *WebDAVFsConfig
+	endpoint   *url.URL
+	client     *http.Client
+	ctxTimeout time.Duration
+}
+
+// NewWebDAVFs returns a WebDAVFs object that allows to interact with a remote WebDAV server
+func NewWebDAVFs(connectionID, localTempDir, mountPath string, config WebDAVFsConfig) (Fs, error) {
+	if localTempDir == "" {
+		if tempPath != "" {
+			localTempDir = tempPath
+		} else {
+			localTempDir = filepath.Clean(os.TempDir())
+		}
+	}
+	config.setEmptyCredentialsIfNil()
+	if !config.Password.IsEmpty() {
+		if err := config.Password.TryDecrypt(); err != nil {
+			return nil, err
+		}
+	}
+	if !config.ClientKey.IsEmpty() {
+		if err := config.ClientKey.TryDecrypt(); err != nil {
+			return nil, err
+		}
+	}
+	endpointURL, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	fs := &WebDAVFs{
+		connectionID: connectionID,
+		localTempDir: localTempDir,
+		mountPath:    mountPath,
+		config:       &config,
+		endpoint:     endpointURL,
+		ctxTimeout:   30 * time.Second,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxResponseHeaderBytes = 1 << 16
+	transport.WriteBufferSize = 1 << 16
+	transport.ReadBufferSize = 1 << 16
+	if config.SkipTLSVerify {
+		transport.TLSClientConfig = getInsecureTLSConfig()
+	}
+	if config.ClientCert != "" {
+		cert, err := tls.X509KeyPair([]byte(config.ClientCert), []byte(config.ClientKey.GetPayload()))
+		if err != nil {
+			return nil, fmt.Errorf("webdavfs: unable to load the client certificate: %w", err)
+		}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{
+				NextProtos: []string{"h2", "http/1.1"},
+			}
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+	fs.client = &http.Client{
+		Transport: transport,
+	}
+	return fs, nil
+}
+
+// Name returns the name for the Fs implementation
+func (fs *WebDAVFs) Name() string {
+	return fmt.Sprintf("%v %q", webDAVFsName, fs.config.Endpoint)
+}
+
+// ConnectionID returns the connection ID associated to this Fs implementation
+func (fs *WebDAVFs) ConnectionID() string {
+	return fs.connectionID
+}
+
+// Stat returns a FileInfo describing the named file
+func (fs *WebDAVFs) Stat(name string) (os.FileInfo, error) {
+	resources, err := fs.propfind(name, "0", webDAVPropfindStat)
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range resources {
+		if res.isSelf {
+			return res.getFileInfo(name), nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// Lstat returns a FileInfo describing the named file
+func (fs *WebDAVFs) Lstat(name string) (os.FileInfo, error) {
+	return fs.Stat(name)
+}
+
+// Open opens the named file for reading.
+// If offset is greater than zero, a ranged GET request is used
+func (fs *WebDAVFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+
+	go func() {
+		defer cancelFn()
+
+		var headers map[string]string
+		if offset > 0 {
+			headers = map[string]string{
+				"Range": fmt.Sprintf("bytes=%d-", offset),
+			}
+		}
+		resp, err := fs.doRequest(ctx, http.MethodGet, name, headers, nil)
+		if err != nil {
+			fsLog(fs, logger.LevelError, "download error, path %q, err: %v", name, err)
+			w.CloseWithError(err) //nolint:errcheck
+			metric.WebDAVFsTransferCompleted(0, 1, err)
+			return
+		}
+		defer resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+			// the offset is equal to the file size, nothing to read
+			w.CloseWithError(nil) //nolint:errcheck
+			metric.WebDAVFsTransferCompleted(0, 1, nil)
+			return
+		case resp.StatusCode == http.StatusOK && offset > 0:
+			// the server does not support ranges, skip the first offset bytes
+			fsLog(fs, logger.LevelDebug, "range not supported, discarding the first %d bytes for path %q", offset, name)
+			if _, err = io.CopyN(io.Discard, resp.Body, offset); err != nil {
+				fsLog(fs, logger.LevelError, "download error, path %q, err: %v", name, err)
+				w.CloseWithError(err) //nolint:errcheck
+				metric.WebDAVFsTransferCompleted(0, 1, err)
+				return
+			}
+		default:
+			if err = getWebDAVErrorFromResponseCode(resp.StatusCode); err != nil {
+				fsLog(fs, logger.LevelError, "download error, path %q, err: %v", name, err)
+				w.CloseWithError(err) //nolint:errcheck
+				metric.WebDAVFsTransferCompleted(0, 1, err)
+				return
+			}
+		}
+		n, err := io.Copy(w, resp.Body)
+		w.CloseWithError(err) //nolint:errcheck
+		fsLog(fs, logger.LevelDebug, "download completed, path %q size: %v, err: %+v", name, n, err)
+		metric.WebDAVFsTransferCompleted(n, 1, err)
+	}()
+
+	return nil, r, cancelFn, nil
+}
+
+// Create creates or opens the named file for writing
+func (fs *WebDAVFs) Create(name string, _, _ int) (File, *PipeWriter, func(), error) {
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	p := NewPipeWriter(w)
+	ctx, cancelFn := context.WithCancel(context.Background())
+
+	go func() {
+		defer cancelFn()
+
+		var headers map[string]string
+		if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+			headers = map[string]string{
+				"Content-Type": contentType,
+			}
+		}
+		resp, err := fs.sendRequest(ctx, http.MethodPut, name, headers, &wrapReader{reader: r})
+		if err != nil {
+			fsLog(fs, logger.LevelError, "upload error, path %q, err: %v", name, err)
+			r.CloseWithError(err) //nolint:errcheck
+			p.Done(err)
+			metric.WebDAVFsTransferCompleted(0, 0, err)
+			return
+		}
+		defer resp.Body.Close()
+
+		r.CloseWithError(err) //nolint:errcheck
+		p.Done(err)
+		fsLog(fs, logger.LevelDebug, "upload completed, path: %q, readed bytes: %d", name, r.GetReadedBytes())
+		metric.WebDAVFsTransferCompleted(r.GetReadedBytes(), 0, err)
+	}()
+
+	return nil, p, cancelFn, nil
+}
+
+// Rename renames (moves) source to target.
+func (fs *WebDAVFs) Rename(source, target string) (int, int64, error) {
+	if source == target {
+		return -1, -1, nil
+	}
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	headers := map[string]string{
+		"Destination": fs.getURL(target).String(),
+		"Overwrite":   "T",
+	}
+	resp, err := fs.sendRequest(ctx, "MOVE", source, headers, nil)
+	if err != nil {
+		return -1, -1, err
+	}
+	defer resp.Body.Close()
+	return -1, -1, nil
+}
+
+// Remove removes the named file or (empty) directory.
+func (fs *WebDAVFs) Remove(name string, isDir bool) error {
+	if isDir {
+		// WebDAV removes directories recursively
+		contents, err := fs.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		if len(contents) > 0 {
+			return fmt.Errorf("cannot remove non empty directory: %q", name)
+		}
+	}
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	resp, err := fs.sendRequest(ctx, http.MethodDelete, name, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return nil
+}
+
+// Mkdir creates a new directory with the specified name and default permissions
+func (fs *WebDAVFs) Mkdir(name string) error {
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	resp, err := fs.doRequest(ctx, "MKCOL", name, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusMethodNotAllowed {
+		// MKCOL is not allowed on existing resources
+		return os.ErrExist
+	}
+	return getWebDAVErrorFromResponseCode(resp.StatusCode)
+}
+
+// Symlink creates source as a symbolic link to target.
+func (*WebDAVFs) Symlink(_, _ string) error {
+	return ErrVfsUnsupported
+}
+
+// Readlink returns the destination of the named symbolic link
+func (*WebDAVFs) Readlink(_ string) (string, error) {
+	return "", ErrVfsUnsupported
+}
+
+// Chown changes the numeric uid and gid of the named file.
+func (*WebDAVFs) Chown(_ string, _ int, _ int) error {
+	return ErrVfsUnsupported
+}
+
+// Chmod changes the mode of the named file to mode.
+func (*WebDAVFs) Chmod(_ string, _ os.FileMode) error {
+	return ErrVfsUnsupported
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (*WebDAVFs) Chtimes(_ string, _, _ time.Time, _ bool) error {
+	return ErrVfsUnsupported
+}
+
+// Truncate changes the size of the named file.
+// Truncate by path is not supported, while truncating an opened
+// file is handled inside base transfer
+func (*WebDAVFs) Truncate(_ string, _ int64) error {
+	return ErrVfsUnsupported
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries.
+func (fs *WebDAVFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	resources, err := fs.propfind(dirname, "1", webDAVPropfindStat)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]os.FileInfo, 0, len(resources))
+	for _, res := range resources {
+		if res.isSelf {
+			if !res.isDir {
+				return nil, fmt.Errorf("%q is not a directory", dirname)
+			}
+			continue
+		}
+		result = append(result, res.getFileInfo(res.name))
+	}
+	return result, nil
+}
+
+// IsUploadResumeSupported returns true if resuming uploads is supported.
+func (*WebDAVFs) IsUploadResumeSupported() bool {
+	return false
+}
+
+// IsAtomicUploadSupported returns true if atomic upload is supported.
+func (*WebDAVFs) IsAtomicUploadSupported() bool {
+	return false
+}
+
+// IsNotExist returns a boolean indicating whether the error is known to
+// report that a file or directory does not exist
+func (*WebDAVFs) IsNotExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+// IsPermission returns a boolean indicating whether the error is known to
+// report that permission is denied.
+func (*WebDAVFs) IsPermission(err error) bool {
+	return errors.Is(err, fs.ErrPermission)
+}
+
+// IsNotSupported returns true if the error indicate an unsupported operation
+func (*WebDAVFs) IsNotSupported(err error) bool {
+	if err == nil {
+		return false
+	}
+	return err == ErrVfsUnsupported
+}
+
+// CheckRootPath creates the specified local root directory if it does not exists
+func (fs *WebDAVFs) CheckRootPath(username string, uid int, gid int) bool {
+	// we need a local directory for temporary files
+	osFs := NewOsFs(fs.ConnectionID(), fs.localTempDir, "", nil)
+	return osFs.CheckRootPath(username, uid, gid)
+}
+
+// ScanRootDirContents returns the number of files and their size
+func (fs *WebDAVFs) ScanRootDirContents() (int, int64, error) {
+	return fs.GetDirSize("/")
+}
+
+// CheckMetadata checks the metadata consistency
+func (*WebDAVFs) CheckMetadata() error {
+	return nil
+}
+
+// GetDirSize returns the number of files and the size for a folder
+// including any subfolders
+func (fs *WebDAVFs) GetDirSize(dirname string) (int, int64, error) {
+	numFiles := 0
+	size := int64(0)
+	err := fs.Walk(dirname, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info != nil && info.Mode().IsRegular() {
+			size += info.Size()
+			numFiles++
+		}
+		return nil
+	})
+	return numFiles, size, err
+}
+
+// GetAtomicUploadPath returns the path to use for an atomic upload.
+func (*WebDAVFs) GetAtomicUploadPath(_ string) string {
+	return ""
+}
+
+// GetRelativePath returns the path for a file relative to the user's home dir.
+// This is the path as seen by SFTPGo users
+func (fs *WebDAVFs) GetRelativePath(name string) string {
+	rel := path.Clean(name)
+	if rel == "." {
+		rel = ""
+	}
+	if !path.IsAbs(rel) {
+		rel = "/" + rel
+	}
+	if fs.mountPath != "" {
+		rel = path.Join(fs.mountPath, rel)
+	}
+	return rel
+}
+
+// Walk walks the file tree rooted at root, calling walkFn for each file or
+// directory in the tree, including root. The result are unordered
+func (fs *WebDAVFs) Walk(root string, walkFn filepath.WalkFunc) error {
+	info, err := fs.Lstat(root)
+	if err != nil {
+		return walkFn(root, nil, err)
+	}
+	return fs.walk(root, info, walkFn)
+}
+
+// Join joins any number of path elements into a single path
+func (*WebDAVFs) Join(elem ...string) string {
+	return strings.TrimPrefix(path.Join(elem...), "/")
+}
+
+// HasVirtualFolders returns true if folders are emulated
+func (*WebDAVFs) HasVirtualFolders() bool {
+	return false
+}
+
+// ResolvePath returns the matching filesystem path for the specified virtual path
+func (fs *WebDAVFs) ResolvePath(virtualPath string) (string, error) {
+	if fs.mountPath != "" {
+		virtualPath = strings.TrimPrefix(virtualPath, fs.mountPath)
+	}
+	if !path.IsAbs(virtualPath) {
+		virtualPath = path.Clean("/" + virtualPath)
+	}
+	return virtualPath, nil
+}
+
+// GetMimeType returns the content type
+func (fs *WebDAVFs) GetMimeType(name string) (string, error) {
+	resources, err := fs.propfind(name, "0", webDAVPropfindStat)
+	if err != nil {
+		return "", err
+	}
+	for _, res := range resources {
+		if res.isSelf && res.contentType != "" {
+			return res.contentType, nil
+		}
+	}
+	return mime.TypeByExtension(path.Ext(name)), nil
+}
+
+// Close closes the fs
+func (fs *WebDAVFs) Close() error {
+	fs.client.CloseIdleConnections()
+	return nil
+}
+
+// GetAvailableDiskSize returns the available size for the specified path
+// using the quota properties defined in RFC 4331
+func (fs *WebDAVFs) GetAvailableDiskSize(dirName string) (*sftp.StatVFS, error) {
+	resources, err := fs.propfind(dirName, "0", webDAVPropfindQuota)
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range resources {
+		if !res.isSelf {
+			continue
+		}
+		// negative values are used by some servers, for example Nextcloud, for unknown or unlimited quota
+		if res.quotaAvailable < 0 || res.quotaUsed < 0 {
+			break
+		}
+		blocks := uint64(res.quotaAvailable+res.quotaUsed) / webDAVStatVFSBlockSize
+		bfree := uint64(res.quotaAvailable) / webDAVStatVFSBlockSize
+		return &sftp.StatVFS{
+			Bsize:   webDAVStatVFSBlockSize,
+			Frsize:  webDAVStatVFSBlockSize,
+			Blocks:  blocks,
+			Bfree:   bfree,
+			Bavail:  bfree,
+			Files:   blocks / 4,
+			Ffree:   bfree / 4,
+			Favail:  bfree / 4,
+			Namemax: 255,
+		}, nil
+	}
+	return nil, ErrStorageSizeUnavailable
+}
+
+func (fs *WebDAVFs) getURL(name string) *url.URL {
+	u := *fs.endpoint
+	u.Path = path.Join(fs.endpoint.Path, name)
+	u.RawPath = ""
+	return &u
+}
+
+// doRequest sends a request to the WebDAV server, the response status code is not checked
+func (fs *WebDAVFs) doRequest(ctx context.Context, method, name string, headers map[string]string,
+	body io.Reader,
+) (*http.Response, error) {
+	reqURL := fs.getURL(name).String()
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if fs.config.Username != "" || fs.config.Password.GetPayload() != "" {
+		req.SetBasicAuth(fs.config.Username, fs.config.Password.GetPayload())
+	}
+	resp, err := fs.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to send %s request to URL %v: %w", method, reqURL, err)
+	}
+	return resp, nil
+}
+
+// sendRequest sends a request to the WebDAV server and returns an error if the response
+// status code does not indicate success
+func (fs *WebDAVFs) sendRequest(ctx context.Context, method, name string, headers map[string]string,
+	body io.Reader,
+) (*http.Response, error) {
+	resp, err := fs.doRequest(ctx, method, name, headers, body)
+	if err != nil {
+		return nil, err
+	}
+	if err = getWebDAVErrorFromResponseCode(resp.StatusCode); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (fs *WebDAVFs) propfind(name, depth, body string) ([]webDAVResource, error) {
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	headers := map[string]string{
+		"Depth":        depth,
+		"Content-Type": "application/xml; charset=utf-8",
+	}
+	resp, err := fs.sendRequest(ctx, "PROPFIND", name, headers, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("unexpected PROPFIND response code: %v", resp.StatusCode)
+	}
+	var ms webDAVMultiStatus
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 32*1024*1024)).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("unable to decode PROPFIND response: %w", err)
+	}
+	requestPath := strings.TrimRight(fs.getURL(name).Path, "/")
+	result := make([]webDAVResource, 0, len(ms.Responses))
+	for _, r := range ms.Responses {
+		res, err := r.toResource(requestPath)
+		if err != nil {
+			fsLog(fs, logger.LevelWarn, "skipping invalid PROPFIND response for path %q: %v", name, err)
+			continue
+		}
+		result = append(result, res)
+	}
+	return result, nil
+}
+
+// walk recursively descends path, calling walkFn.
+func (fs *WebDAVFs) walk(filePath string, info fs.FileInfo, walkFn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return walkFn(filePath, info, nil)
+	}
+	files, err := fs.ReadDir(filePath)
+	err1 := walkFn(filePath, info, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+	for _, fi := range files {
+		objName := path.Join(filePath, fi.Name())
+		err = fs.walk(objName, fi, walkFn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getWebDAVErrorFromResponseCode(code int) error {
+	switch {
+	case code >= 200 && code <= 299:
+		return nil
+	case code == http.StatusUnauthorized, code == http.StatusForbidden:
+		return os.ErrPermission
+	case code == http.StatusNotFound, code == http.StatusConflict:
+		// 409 is returned if a parent collection does not exist
+		return os.ErrNotExist
+	case code == http.StatusPreconditionFailed:
+		return os.ErrExist
+	case code == http.StatusMethodNotAllowed, code == http.StatusNotImplemented:
+		return ErrVfsUnsupported
+	default:
+		return fmt.Errorf("unexpected response code: %v", code)
+	}
+}
+
+type webDAVMultiStatus struct {
+	XMLName   xml.Name         `xml:"DAV: multistatus"`
+	Responses []webDAVResponse `xml:"DAV: response"`
+}
+
+type webDAVResponse struct {
+	Href      string           `xml:"DAV: href"`
+	Propstats []webDAVPropstat `xml:"DAV: propstat"`
+}
+
+type webDAVPropstat struct {
+	Status string     `xml:"DAV: status"`
+	Prop   webDAVProp `xml:"DAV: prop"`
+}
+
+type webDAVProp struct {
+	ResourceType struct {
+		Collection *struct{} `xml:"DAV: collection"`
+	} `xml:"DAV: resourcetype"`
+	ContentLength  string `xml:"DAV: getcontentlength"`
+	LastModified   string `xml:"DAV: getlastmodified"`
+	ContentType    string `xml:"DAV: getcontenttype"`
+	QuotaAvailable string `xml:"DAV: quota-available-bytes"`
+	QuotaUsed      string `xml:"DAV: quota-used-bytes"`
+}
+
+func (r *webDAVResponse) toResource(requestPath string) (webDAVResource, error) {
+	hrefURL, err := url.Parse(r.Href)
+	if err != nil {
+		return webDAVResource{}, err
+	}
+	hrefPath := strings.TrimRight(hrefURL.Path, "/")
+	res := webDAVResource{
+		name:           path.Base(hrefPath),
+		isSelf:         hrefPath == requestPath,
+		quotaAvailable: -1,
+		quotaUsed:      -1,
+	}
+	for _, ps := range r.Propstats {
+		// properties not found are reported with a 404 status
+		if !strings.Contains(ps.Status, " 200") {
+			continue
+		}
+		if ps.Prop.ResourceType.Collection != nil {
+			res.isDir = true
+		}
+		if ps.Prop.ContentLength != "" {
+			res.size, _ = strconv.ParseInt(strings.TrimSpace(ps.Prop.ContentLength), 10, 64)
+		}
+		if ps.Prop.LastModified != "" {
+			res.modTime, _ = http.ParseTime(strings.TrimSpace(ps.Prop.LastModified))
+		}
+		if ps.Prop.ContentType != "" {
+			res.contentType = ps.Prop.ContentType
+		}
+		if ps.Prop.QuotaAvailable != "" {
+			res.quotaAvailable, _ = strconv.ParseInt(strings.TrimSpace(ps.Prop.QuotaAvailable), 10, 64)
+		}
+		if ps.Prop.QuotaUsed != "" {
+			res.quotaUsed, _ = strconv.ParseInt(strings.TrimSpace(ps.Prop.QuotaUsed), 10, 64)
+		}
+	}
+	return res, nil
+}
+
+type webDAVResource struct {
+	name           string
+	isSelf         bool
+	isDir          bool
+	size           int64
+	modTime        time.Time
+	contentType    string
+	quotaAvailable int64
+	quotaUsed      int64
+}
+
+func (r *webDAVResource) getFileInfo(name string) os.FileInfo {
+	if r.isDir {
+		return NewFileInfo(name, true, 0, r.modTime, false)
+	}
+	return NewFileInfo(name, false, r.size, r.modTime, false)
+}
@@ -0,0 +1,71 @@
+// Copyright (C) 2019-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vfs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/pkg/util"
+)
+
+const (
+	// max WORM retention: 100 years
+	maxWORMRetention = 100 * 365 * 24
+)
+
+// WORMConfig defines the write once read many settings. If enabled, files
+// can be created but they cannot be modified, renamed or deleted until the
+// retention period expires
+type WORMConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Retention period as hours, starting from the file modification time.
+	// 0 means that the files are protected as long as WORM is enabled
+	Retention int `json:"retention,omitempty"`
+}
+
+// IsProtected returns true if a file with the specified modification time
+// cannot be modified, renamed or deleted
+func (c *WORMConfig) IsProtected(modTime time.Time) bool {
+	if !c.Enabled {
+		return false
+	}
+	if c.Retention == 0 {
+		return true
+	}
+	return time.Now().Before(c.GetRetainUntil(modTime))
+}
+
+// GetRetainUntil returns the retention date for a file with the specified
+// modification time. The zero time is returned if the files are protected
+// without time limits
+func (c *WORMConfig) GetRetainUntil(modTime time.Time) time.Time {
+	if c.Retention == 0 {
+		return time.Time{}
+	}
+	return modTime.Add(time.Duration(c.Retention) * time.Hour)
+}
+
+func (c *WORMConfig) validate() error {
+	if !c.Enabled {
+		c.Retention = 0
+		return nil
+	}
+	if c.Retention < 0 || c.Retention > maxWORMRetention {
+		return util.NewValidationError(fmt.Sprintf("invalid WORM retention %d, it must be between 0 and %d hours",
+			c.Retention, maxWORMRetention))
+	}
+	return nil
+}
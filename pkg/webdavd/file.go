@@ -234,6 +234,16 @@ func (f *webDavFile) Read(p []byte) (n int, err error) {
 	return
 }
 
+// ReadFrom implements io.ReaderFrom. It is used by io.Copy to receive the
+// uploads using a buffer from the transfer buffers pool
+func (f *webDavFile) ReadFrom(r io.Reader) (int64, error) {
+	n, err := f.Connection.CopyBuffer(f, r)
+	if errors.Is(err, common.ErrMemoryBudgetExhausted) {
+		f.TransferError(err)
+	}
+	return n, err
+}
+
 // Write writes the uploaded contents.
 func (f *webDavFile) Write(p []byte) (n int, err error) {
 	if f.AbortTransfer.Load() {
@@ -241,9 +251,9 @@ func (f *webDavFile) Write(p []byte) (n int, err error) {
 	}
 
 	f.Connection.UpdateLastActivity()
-
-	n, err = f.writer.Write(p)
+	n, err = f.WriteUploadContent(f.writer, p)
 	f.BytesReceived.Add(int64(n))
+	f.UpdateChecksum(p[:n], -1)
 
 	if err == nil {
 		err = f.CheckWrite()
@@ -353,12 +363,17 @@ func (f *webDavFile) Seek(offset int64, whence int) (int64, error) {
 			startByte = f.info.Size() - offset
 		}
 
-		_, r, cancelFn, err := f.Fs.Open(f.GetFsPath(), startByte)
+		file, r, cancelFn, err := f.Fs.Open(f.GetFsPath(), startByte)
 
 		f.Lock()
 		if err == nil {
 			f.startOffset = startByte
-			f.reader = r
+			if file != nil {
+				// the object cache returns a file positioned at startByte
+				f.reader = file
+			} else {
+				f.reader = r
+			}
 		}
 		f.ErrTransfer = err
 		f.BaseTransfer.SetCancelFn(cancelFn)
@@ -374,6 +389,12 @@ func (f *webDavFile) Close() error {
 	if err := f.setFinished(); err != nil {
 		return err
 	}
+	if f.writer != nil {
+		// the data buffered to detect the content type must be written before closing
+		if err := f.FlushUploadContent(f.writer); err != nil {
+			f.TransferError(err)
+		}
+	}
 	err := f.closeIO()
 	if f.isTransfer() {
 		errBaseClose := f.BaseTransfer.Close()
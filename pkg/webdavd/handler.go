@@ -174,9 +174,9 @@ func (c *Connection) putFile(fs vfs.Fs, fsPath, virtualPath string) (webdav.File
 		return nil, c.GetPermissionDeniedError()
 	}
 
-	filePath := fsPath
-	if common.Config.IsAtomicUploadEnabled() && fs.IsAtomicUploadSupported() {
-		filePath = fs.GetAtomicUploadPath(fsPath)
+	filePath, err := c.GetUploadFsPath(fs, fsPath, virtualPath)
+	if err != nil {
+		return nil, err
 	}
 
 	stat, statErr := fs.Lstat(fsPath)
@@ -202,6 +202,15 @@ func (c *Connection) putFile(fs vfs.Fs, fsPath, virtualPath string) (webdav.File
 		return nil, c.GetPermissionDeniedError()
 	}
 
+	if err := c.CheckWORMProtection(virtualPath, stat); err != nil {
+		return nil, err
+	}
+
+	if c.IsStagedUpload(virtualPath) {
+		// the existing file is replaced when the staged upload is published
+		return c.handleUploadToNewFile(fs, fsPath, filePath, virtualPath)
+	}
+
 	return c.handleUploadToExistingFile(fs, fsPath, filePath, stat.Size(), virtualPath)
 }
 
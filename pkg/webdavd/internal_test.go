@@ -357,7 +357,7 @@ func TestUserInvalidParams(t *testing.T) {
 	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("/%v", u.Username), nil)
 	assert.NoError(t, err)
 
-	_, err = server.validateUser(u, req, dataprovider.LoginMethodPassword)
+	_, err = server.validateUser(u, req, dataprovider.LoginMethodPassword, "connID")
 	if assert.Error(t, err) {
 		assert.EqualError(t, err, fmt.Sprintf("cannot login user with invalid home dir: %q", u.HomeDir))
 	}
@@ -34,12 +34,14 @@ import (
 	"github.com/rs/cors"
 	"github.com/rs/xid"
 	"github.com/sftpgo/sdk/plugin/notifier"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/drakkan/sftpgo/v2/pkg/common"
 	"github.com/drakkan/sftpgo/v2/pkg/dataprovider"
 	"github.com/drakkan/sftpgo/v2/pkg/logger"
 	"github.com/drakkan/sftpgo/v2/pkg/metric"
 	"github.com/drakkan/sftpgo/v2/pkg/plugin"
+	"github.com/drakkan/sftpgo/v2/pkg/tracing"
 	"github.com/drakkan/sftpgo/v2/pkg/util"
 )
 
@@ -79,8 +81,12 @@ func (s *webDavServer) listenAndServe(compressor *middleware.Compressor) error {
 		if getConfigPath(s.binding.CertificateFile, "") != "" && getConfigPath(s.binding.CertificateKeyFile, "") != "" {
 			certID = s.binding.GetAddress()
 		}
+		getCertificate := certMgr.GetCertificateFunc(certID)
+		if len(s.binding.SNICertificates) > 0 || s.binding.ACMEOnDemand {
+			getCertificate = certMgr.GetCertificateFuncWithSNI(certID, s.binding.GetAddress(), s.binding.ACMEOnDemand)
+		}
 		httpServer.TLSConfig = &tls.Config{
-			GetCertificate:           certMgr.GetCertificateFunc(certID),
+			GetCertificate:           getCertificate,
 			MinVersion:               util.GetTLSVersion(s.binding.MinTLSVersion),
 			NextProtos:               []string{"http/1.1", "h2"},
 			CipherSuites:             util.GetTLSCiphersFromNames(s.binding.TLSCipherSuites),
@@ -192,6 +198,8 @@ func (s *webDavServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, common.ErrConnectionDenied.Error(), http.StatusForbidden)
 		return
 	}
+	connID := xid.New().String()
+	r = r.WithContext(logger.WithCorrelationID(r.Context(), fmt.Sprintf("%v_%v", common.ProtocolWebDAV, connID)))
 	user, isCached, lockSystem, loginMethod, err := s.authenticate(r, ipAddr)
 	if err != nil {
 		if !s.binding.DisableWWWAuthHeader {
@@ -201,11 +209,11 @@ func (s *webDavServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	connectionID, err := s.validateUser(&user, r, loginMethod)
+	connectionID, err := s.validateUser(&user, r, loginMethod, connID)
 	if err != nil {
 		// remove the cached user, we have not yet validated its filesystem
 		dataprovider.RemoveCachedWebDAVUser(user.Username)
-		updateLoginMetrics(&user, ipAddr, loginMethod, err)
+		updateLoginMetrics(r.Context(), &user, ipAddr, loginMethod, err)
 		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
@@ -218,7 +226,7 @@ func (s *webDavServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		errClose := user.CloseFs()
 		logger.Warn(logSender, connectionID, "unable to check fs root: %v close fs error: %v", err, errClose)
-		updateLoginMetrics(&user, ipAddr, loginMethod, common.ErrInternalFailure)
+		updateLoginMetrics(r.Context(), &user, ipAddr, loginMethod, common.ErrInternalFailure)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -231,13 +239,26 @@ func (s *webDavServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err = common.Connections.Add(connection); err != nil {
 		errClose := user.CloseFs()
 		logger.Warn(logSender, connectionID, "unable add connection: %v close fs error: %v", err, errClose)
-		updateLoginMetrics(&user, ipAddr, loginMethod, err)
+		updateLoginMetrics(r.Context(), &user, ipAddr, loginMethod, err)
 		http.Error(w, err.Error(), http.StatusTooManyRequests)
 		return
 	}
 	defer common.Connections.Remove(connection.GetID())
+	tracing.SetConnectionAttributes(connection.GetID(), attribute.String("http.method", r.Method),
+		attribute.String("http.target", r.URL.Path))
+
+	if common.DebugCaptures.IsActive() {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+		defer func() {
+			common.DebugCaptures.CaptureHTTPRequest(connection, r, ww.Status(), int64(ww.BytesWritten()),
+				time.Since(start))
+		}()
+		w = ww
+	}
 
-	updateLoginMetrics(&user, ipAddr, loginMethod, err)
+	updateLoginMetrics(r.Context(), &user, ipAddr, loginMethod, err)
+	w.Header().Set(logger.CorrelationIDHeader, connection.GetID())
 
 	ctx := context.WithValue(r.Context(), requestIDKey, connectionID)
 	ctx = context.WithValue(ctx, requestStartKey, time.Now())
@@ -289,17 +310,18 @@ func (s *webDavServer) authenticate(r *http.Request, ip string) (dataprovider.Us
 		user.Username = username
 		return user, false, nil, loginMethod, common.ErrNoCredentials
 	}
-	cachedUser, ok := dataprovider.GetCachedWebDAVUser(username)
+	cachedUser, ok := dataprovider.GetCachedWebDAVUser(dataprovider.CanonicalizeLoginName(username))
 	if ok {
 		if cachedUser.IsExpired() {
-			dataprovider.RemoveCachedWebDAVUser(username)
+			dataprovider.RemoveCachedWebDAVUser(cachedUser.User.Username)
 		} else {
 			if !cachedUser.User.IsTLSUsernameVerificationEnabled() {
 				// for backward compatibility with 2.0.x we only check the password
 				tlsCert = nil
 				loginMethod = dataprovider.LoginMethodPassword
 			}
-			cu, u, err := dataprovider.CheckCachedUserCredentials(cachedUser, password, ip, loginMethod, common.ProtocolWebDAV, tlsCert)
+			cu, u, err := dataprovider.CheckCachedUserCredentials(r.Context(), cachedUser, password, ip, loginMethod,
+				common.ProtocolWebDAV, tlsCert)
 			if err == nil {
 				if cu != nil {
 					return cu.User, true, cu.LockSystem, loginMethod, nil
@@ -314,15 +336,15 @@ func (s *webDavServer) authenticate(r *http.Request, ip string) (dataprovider.Us
 				dataprovider.CacheWebDAVUser(cachedUser)
 				return cachedUser.User, false, cachedUser.LockSystem, loginMethod, nil
 			}
-			updateLoginMetrics(&cachedUser.User, ip, loginMethod, dataprovider.ErrInvalidCredentials)
+			updateLoginMetrics(r.Context(), &cachedUser.User, ip, loginMethod, dataprovider.ErrInvalidCredentials)
 			return user, false, nil, loginMethod, dataprovider.ErrInvalidCredentials
 		}
 	}
-	user, loginMethod, err = dataprovider.CheckCompositeCredentials(username, password, ip, loginMethod,
-		common.ProtocolWebDAV, tlsCert)
+	user, loginMethod, err = dataprovider.CheckCompositeCredentialsContext(r.Context(), username, password, ip,
+		loginMethod, common.ProtocolWebDAV, tlsCert)
 	if err != nil {
 		user.Username = username
-		updateLoginMetrics(&user, ip, loginMethod, err)
+		updateLoginMetrics(r.Context(), &user, ip, loginMethod, err)
 		return user, false, nil, loginMethod, dataprovider.ErrInvalidCredentials
 	}
 	lockSystem := webdav.NewMemLS()
@@ -336,8 +358,7 @@ func (s *webDavServer) authenticate(r *http.Request, ip string) (dataprovider.Us
 	return user, false, lockSystem, loginMethod, nil
 }
 
-func (s *webDavServer) validateUser(user *dataprovider.User, r *http.Request, loginMethod string) (string, error) {
-	connID := xid.New().String()
+func (s *webDavServer) validateUser(user *dataprovider.User, r *http.Request, loginMethod, connID string) (string, error) {
 	connectionID := fmt.Sprintf("%v_%v", common.ProtocolWebDAV, connID)
 
 	if !filepath.IsAbs(user.HomeDir) {
@@ -354,6 +375,10 @@ func (s *webDavServer) validateUser(user *dataprovider.User, r *http.Request, lo
 			user.Username, loginMethod)
 		return connID, fmt.Errorf("login method %v is not allowed for user %q", loginMethod, user.Username)
 	}
+	if err := common.CheckConsentsForProtocol(user, common.ProtocolWebDAV); err != nil {
+		logger.Info(logSender, connectionID, "cannot login user %q, consent documents not accepted", user.Username)
+		return connID, err
+	}
 	if !user.IsLoginFromAddrAllowed(r.RemoteAddr) {
 		logger.Info(logSender, connectionID, "cannot login user %q, remote address is not allowed: %v",
 			user.Username, r.RemoteAddr)
@@ -421,7 +446,7 @@ func writeLog(r *http.Request, status int, err error) {
 		Send()
 }
 
-func updateLoginMetrics(user *dataprovider.User, ip, loginMethod string, err error) {
+func updateLoginMetrics(ctx context.Context, user *dataprovider.User, ip, loginMethod string, err error) {
 	metric.AddLoginAttempt(loginMethod)
 	if err != nil && err != common.ErrInternalFailure && err != common.ErrNoCredentials {
 		logger.ConnectionFailedLog(user.Username, ip, loginMethod, common.ProtocolWebDAV, err.Error())
@@ -435,5 +460,5 @@ func updateLoginMetrics(user *dataprovider.User, ip, loginMethod string, err err
 		plugin.Handler.NotifyLogEvent(logEv, common.ProtocolWebDAV, user.Username, ip, "", err)
 	}
 	metric.AddLoginResult(loginMethod, err)
-	dataprovider.ExecutePostLoginHook(user, loginMethod, ip, common.ProtocolWebDAV, err)
+	dataprovider.ExecutePostLoginHook(ctx, user, loginMethod, ip, common.ProtocolWebDAV, err)
 }
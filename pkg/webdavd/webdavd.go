@@ -117,6 +117,14 @@ type Binding struct {
 	// ones will be used, if any
 	CertificateFile    string `json:"certificate_file" mapstructure:"certificate_file"`
 	CertificateKeyFile string `json:"certificate_key_file" mapstructure:"certificate_key_file"`
+	// Additional certificates for this binding, selected based on the server name
+	// requested by the client (SNI). If no additional certificate matches, the
+	// binding specific or the global certificate is used
+	SNICertificates []common.SNICertificate `json:"sni_certificates" mapstructure:"sni_certificates"`
+	// Obtain, using ACME, a certificate for the server name requested by the
+	// client, if no configured certificate matches and the server name is allowed
+	// in the ACME on-demand configuration
+	ACMEOnDemand bool `json:"acme_on_demand" mapstructure:"acme_on_demand"`
 	// Defines the minimum TLS version. 13 means TLS 1.3, default is TLS 1.2
 	MinTLSVersion int `json:"min_tls_version" mapstructure:"min_tls_version"`
 	// set to 1 to require client certificate authentication in addition to basic auth.
@@ -230,6 +238,18 @@ func (c *Configuration) getKeyPairs(configDir string) []common.TLSKeyPair {
 				ID:   binding.GetAddress(),
 			})
 		}
+		for _, sniCert := range binding.SNICertificates {
+			certificateFile := getConfigPath(sniCert.CertificateFile, configDir)
+			certificateKeyFile := getConfigPath(sniCert.CertificateKeyFile, configDir)
+			if certificateFile != "" && certificateKeyFile != "" {
+				keyPairs = append(keyPairs, common.TLSKeyPair{
+					Cert: certificateFile,
+					Key:  certificateKeyFile,
+					ID:   binding.GetAddress(),
+					SNI:  true,
+				})
+			}
+		}
 	}
 	var certificateFile, certificateKeyFile string
 	if c.acmeDomain != "" {
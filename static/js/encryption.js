@@ -0,0 +1,304 @@
+/*
+Copyright (C) 2019-2023 Nicola Murino
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+Client side encryption for the WebClient.
+
+Files inside client encrypted folders are encrypted and decrypted within the
+browser using the WebCrypto API, the server only stores the encrypted contents.
+
+Keys:
+- user key: PBKDF2-SHA256(passphrase, "sftpgo-e2e|" + username), it is kept in
+  the browser session storage and never sent to the server
+- folder key: HKDF-SHA256(user key, info "sftpgo-e2e-folder:" + folder path),
+  share links embed this key in the URL fragment
+- file key: HKDF-SHA256(folder key, random file salt, info "sftpgo-e2e-file")
+
+File format:
+- 40 bytes header: "SFTPGOE2" marker, version (1 byte), 3 reserved bytes,
+  chunk size (uint32 big endian), file salt (16 bytes), nonce prefix (8 bytes)
+- the plain text is split in chunks, each chunk is encrypted using AES-256-GCM,
+  the IV is the nonce prefix followed by the chunk counter (uint32 big endian)
+  and the additional data is a single byte: 1 for the last chunk, 0 otherwise.
+  An empty file is encoded as a single, empty, last chunk
+*/
+(function (global) {
+    "use strict";
+
+    const encoder = new TextEncoder();
+    const marker = encoder.encode("SFTPGOE2");
+    const formatVersion = 1;
+    const headerSize = 40;
+    const saltSize = 16;
+    const noncePrefixSize = 8;
+    const tagSize = 16;
+    const defaultChunkSize = 65536;
+    const maxChunkSize = 16777216;
+    const pbkdf2Iterations = 600000;
+    const storagePrefix = "sftpgo_e2e_";
+
+    function toBase64URL(bytes) {
+        let binary = "";
+        for (let i = 0; i < bytes.length; i++) {
+            binary += String.fromCharCode(bytes[i]);
+        }
+        return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+    }
+
+    function fromBase64URL(value) {
+        let b64 = value.replace(/-/g, "+").replace(/_/g, "/");
+        while (b64.length % 4) {
+            b64 += "=";
+        }
+        const binary = atob(b64);
+        const bytes = new Uint8Array(binary.length);
+        for (let i = 0; i < binary.length; i++) {
+            bytes[i] = binary.charCodeAt(i);
+        }
+        return bytes;
+    }
+
+    function concat(a, b) {
+        const result = new Uint8Array(a.length + b.length);
+        result.set(a, 0);
+        result.set(b, a.length);
+        return result;
+    }
+
+    async function hkdf(keyBytes, salt, info) {
+        const key = await crypto.subtle.importKey("raw", keyBytes, "HKDF", false, ["deriveBits"]);
+        const bits = await crypto.subtle.deriveBits({
+            name: "HKDF",
+            hash: "SHA-256",
+            salt: salt,
+            info: encoder.encode(info)
+        }, key, 256);
+        return new Uint8Array(bits);
+    }
+
+    async function deriveUserKey(username, passphrase) {
+        const key = await crypto.subtle.importKey("raw", encoder.encode(passphrase), "PBKDF2", false, ["deriveBits"]);
+        const bits = await crypto.subtle.deriveBits({
+            name: "PBKDF2",
+            hash: "SHA-256",
+            salt: encoder.encode("sftpgo-e2e|" + username),
+            iterations: pbkdf2Iterations
+        }, key, 256);
+        return new Uint8Array(bits);
+    }
+
+    async function getFileKey(folderKey, salt, usage) {
+        const keyBytes = await hkdf(folderKey, salt, "sftpgo-e2e-file");
+        return crypto.subtle.importKey("raw", keyBytes, { name: "AES-GCM" }, false, [usage]);
+    }
+
+    function getIV(noncePrefix, counter) {
+        const iv = new Uint8Array(12);
+        iv.set(noncePrefix, 0);
+        new DataView(iv.buffer).setUint32(noncePrefixSize, counter, false);
+        return iv;
+    }
+
+    function parseHeader(header) {
+        for (let i = 0; i < marker.length; i++) {
+            if (header[i] !== marker[i]) {
+                throw new Error("the file is not encrypted");
+            }
+        }
+        if (header[marker.length] !== formatVersion) {
+            throw new Error("unsupported encryption format version: " + header[marker.length]);
+        }
+        const chunkSize = new DataView(header.buffer, header.byteOffset, header.byteLength).getUint32(12, false);
+        if (chunkSize === 0 || chunkSize > maxChunkSize) {
+            throw new Error("invalid chunk size: " + chunkSize);
+        }
+        return {
+            chunkSize: chunkSize,
+            salt: header.slice(16, 16 + saltSize),
+            noncePrefix: header.slice(16 + saltSize, headerSize)
+        };
+    }
+
+    // unlock derives the user key from the specified passphrase and keeps it in
+    // the session storage
+    async function unlock(username, passphrase) {
+        const userKey = await deriveUserKey(username, passphrase);
+        sessionStorage.setItem(storagePrefix + username, toBase64URL(userKey));
+    }
+
+    function lock(username) {
+        sessionStorage.removeItem(storagePrefix + username);
+    }
+
+    function isUnlocked(username) {
+        return sessionStorage.getItem(storagePrefix + username) != null;
+    }
+
+    // getFolderKey returns the key for the specified client encrypted folder
+    async function getFolderKey(username, folder) {
+        const userKey = sessionStorage.getItem(storagePrefix + username);
+        if (userKey == null) {
+            throw new Error("encryption key not available, please unlock the encrypted folder");
+        }
+        return hkdf(fromBase64URL(userKey), new Uint8Array(0), "sftpgo-e2e-folder:" + folder);
+    }
+
+    // getKeyFromFragment returns the folder key embedded in the URL fragment, if any
+    function getKeyFromFragment() {
+        const params = new URLSearchParams(global.location.hash.substring(1));
+        const key = params.get("key");
+        if (!key) {
+            return null;
+        }
+        const keyBytes = fromBase64URL(key);
+        if (keyBytes.length !== 32) {
+            return null;
+        }
+        return keyBytes;
+    }
+
+    function getShareFragment(folderKey) {
+        return "#key=" + toBase64URL(folderKey);
+    }
+
+    // encryptFile encrypts the specified File or Blob, the file is read chunk by chunk
+    async function encryptFile(folderKey, file) {
+        const salt = crypto.getRandomValues(new Uint8Array(saltSize));
+        const noncePrefix = crypto.getRandomValues(new Uint8Array(noncePrefixSize));
+        const header = new Uint8Array(headerSize);
+        header.set(marker, 0);
+        header[marker.length] = formatVersion;
+        new DataView(header.buffer).setUint32(12, defaultChunkSize, false);
+        header.set(salt, 16);
+        header.set(noncePrefix, 16 + saltSize);
+
+        const key = await getFileKey(folderKey, salt, "encrypt");
+        const parts = [header];
+        let offset = 0;
+        let counter = 0;
+        do {
+            const end = Math.min(offset + defaultChunkSize, file.size);
+            const plain = new Uint8Array(await file.slice(offset, end).arrayBuffer());
+            const isLast = end >= file.size;
+            const encrypted = await crypto.subtle.encrypt({
+                name: "AES-GCM",
+                iv: getIV(noncePrefix, counter),
+                additionalData: new Uint8Array([isLast ? 1 : 0])
+            }, key, plain);
+            parts.push(new Uint8Array(encrypted));
+            counter++;
+            offset = end;
+        } while (offset < file.size);
+        return new Blob(parts, { type: "application/octet-stream" });
+    }
+
+    // decryptStream decrypts the specified ReadableStream as it is received
+    async function decryptStream(folderKey, stream) {
+        const reader = stream.getReader();
+        const parts = [];
+        let buffer = new Uint8Array(0);
+        let params = null;
+        let key = null;
+        let counter = 0;
+
+        async function decryptChunk(chunk, isLast) {
+            let plain;
+            try {
+                plain = await crypto.subtle.decrypt({
+                    name: "AES-GCM",
+                    iv: getIV(params.noncePrefix, counter),
+                    additionalData: new Uint8Array([isLast ? 1 : 0])
+                }, key, chunk);
+            } catch (e) {
+                throw new Error("unable to decrypt the file, wrong key or corrupted data");
+            }
+            parts.push(new Uint8Array(plain));
+            counter++;
+        }
+
+        for (;;) {
+            const { done, value } = await reader.read();
+            if (value) {
+                buffer = concat(buffer, value);
+            }
+            if (params == null && buffer.length >= headerSize) {
+                params = parseHeader(buffer.slice(0, headerSize));
+                key = await getFileKey(folderKey, params.salt, "decrypt");
+                buffer = buffer.slice(headerSize);
+            }
+            if (params != null) {
+                const encryptedChunkSize = params.chunkSize + tagSize;
+                // we cannot know if a chunk is the last one until we receive more data
+                while (buffer.length > encryptedChunkSize) {
+                    await decryptChunk(buffer.slice(0, encryptedChunkSize), false);
+                    buffer = buffer.slice(encryptedChunkSize);
+                }
+            }
+            if (done) {
+                break;
+            }
+        }
+        if (params == null || buffer.length < tagSize) {
+            throw new Error("the file is not encrypted or it is truncated");
+        }
+        await decryptChunk(buffer, true);
+        return new Blob(parts, { type: "application/octet-stream" });
+    }
+
+    // getPlainSize returns the plain text size for an encrypted file of the specified size
+    function getPlainSize(size) {
+        const encryptedSize = size - headerSize;
+        if (encryptedSize < tagSize) {
+            return size;
+        }
+        const chunks = Math.max(1, Math.ceil(encryptedSize / (defaultChunkSize + tagSize)));
+        return encryptedSize - chunks * tagSize;
+    }
+
+    // download fetches and decrypts the specified URL and saves it with the given name
+    async function download(folderKey, url, name) {
+        const response = await fetch(url, {
+            credentials: "same-origin"
+        });
+        if (!response.ok) {
+            throw new Error("unable to download the file, status code: " + response.status);
+        }
+        const blob = await decryptStream(folderKey, response.body);
+        const link = document.createElement("a");
+        const objectURL = URL.createObjectURL(blob);
+        link.href = objectURL;
+        link.download = name;
+        document.body.appendChild(link);
+        link.click();
+        document.body.removeChild(link);
+        setTimeout(function () {
+            URL.revokeObjectURL(objectURL);
+        }, 60000);
+    }
+
+    global.SFTPGoE2E = {
+        unlock: unlock,
+        lock: lock,
+        isUnlocked: isUnlocked,
+        getFolderKey: getFolderKey,
+        getKeyFromFragment: getKeyFromFragment,
+        getShareFragment: getShareFragment,
+        encryptFile: encryptFile,
+        decryptStream: decryptStream,
+        getPlainSize: getPlainSize,
+        download: download
+    };
+})(window);